@@ -1,7 +1,11 @@
 package astore
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -53,6 +57,10 @@ func NewNative(server string, mods ...grpc.DialOption) (*Client, error) {
 
 type DownloadOptions struct {
 	*ccontext.Context
+
+	// If not nil, the SHA256 of each downloaded file is recorded here, and the
+	// download is verified against the MD5 provided by the server, if any.
+	Checksums *Checksums
 }
 
 type FileToDownload struct {
@@ -219,11 +227,27 @@ func (c *Client) Download(files []FileToDownload, o DownloadOptions) ([]*apb.Art
 		}
 
 		p.Step("%s: downloading", shortpath)
-		if err := Download(context.TODO(), progress.WriterCreator(p, f), response.Url); err != nil {
+		creator := progress.WriterCreator(p, f)
+		sha, md := sha256.New(), md5.New()
+		if o.Checksums != nil {
+			creator = func(size int64) io.WriteCloser {
+				return &teeWriteCloser{WriteCloser: progress.WriterCreator(p, f)(size), tee: io.MultiWriter(sha, md)}
+			}
+		}
+		if err := Download(context.TODO(), creator, response.Url); err != nil {
 			os.Remove(f.Name())
 			return nil, err
 		}
 
+		source := DigestLocal
+		if o.Checksums != nil && len(response.Artifact.GetMD5()) > 0 {
+			if !bytes.Equal(md.Sum(nil), response.Artifact.GetMD5()) {
+				os.Remove(f.Name())
+				return nil, fmt.Errorf("%s: integrity check failed - server reported md5 %x, downloaded %x", shortpath, response.Artifact.GetMD5(), md.Sum(nil))
+			}
+			source = DigestServer
+		}
+
 		if err := os.Link(f.Name(), output); err != nil {
 			if !os.IsExist(err) || !file.Overwrite {
 				return nil, fmt.Errorf("trying to store file as %s, failed with: %w", output, err)
@@ -234,6 +258,11 @@ func (c *Client) Download(files []FileToDownload, o DownloadOptions) ([]*apb.Art
 		}
 
 		os.Remove(f.Name())
+		if o.Checksums != nil {
+			if err := o.Checksums.Record(output, hex.EncodeToString(sha.Sum(nil)), source); err != nil {
+				return nil, err
+			}
+		}
 		p.Done()
 	}
 	return arts, nil
@@ -316,6 +345,20 @@ func (c *Client) Upload(files []FileToUpload, o UploadOptions) ([]*apb.Artifact,
 	return artifacts, nil
 }
 
+// teeWriteCloser copies all the data written to tee, like io.TeeReader does for readers.
+type teeWriteCloser struct {
+	io.WriteCloser
+	tee io.Writer
+}
+
+func (t *teeWriteCloser) Write(p []byte) (int, error) {
+	n, err := t.WriteCloser.Write(p)
+	if n > 0 {
+		t.tee.Write(p[:n])
+	}
+	return n, err
+}
+
 func Download(ctx context.Context, f func(int64) io.WriteCloser, url string) error {
 	client := &http.Client{}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -329,7 +372,7 @@ func Download(ctx context.Context, f func(int64) io.WriteCloser, url string) err
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request returned status code %d - %s", resp.StatusCode, resp.Status)
+		return httpRateLimited(resp, fmt.Errorf("request returned status code %d - %s", resp.StatusCode, resp.Status))
 	}
 
 	w := f(resp.ContentLength)
@@ -341,7 +384,11 @@ func Download(ctx context.Context, f func(int64) io.WriteCloser, url string) err
 }
 
 func Upload(ctx context.Context, r io.ReadCloser, size int64, url string) error {
-	client := &http.Client{}
+	return uploadWith(ctx, &http.Client{}, r, size, url)
+}
+
+// uploadWith is like Upload, but sends the request with the specified client.
+func uploadWith(ctx context.Context, client *http.Client, r io.ReadCloser, size int64, url string) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
 	if err != nil {
 		return err
@@ -355,7 +402,9 @@ func Upload(ctx context.Context, r io.ReadCloser, size int64, url string) error
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("Upload to url:\n\t%s\nFailed: status %s", url, resp.Status)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return httpRateLimited(resp, fmt.Errorf("Upload to url:\n\t%s\nFailed: status %s", url, resp.Status))
 	}
 
 	// Flush and discard any reply. This is strictly not needed.
@@ -383,6 +432,15 @@ type SuggestOptions struct {
 	AllowAbsolute bool
 	// Allow a file name without directory.
 	AllowSingleElement bool
+
+	// If Template is set, and the remote is not specified with @, Directory or File,
+	// the remote is computed by expanding the template, like "tools/{name}/{version}/{file}".
+	// See RemoteVars for the variables available.
+	Template string
+	// Additional variables for Template, in the form key=value.
+	Vars []string
+	// Architecture of the file in the cpu-os format, used by Template instead of guessing it.
+	Arch string
 }
 
 func SuggestGitName(name string) (string, error) {
@@ -505,6 +563,18 @@ func FindRemote(name string, options SuggestOptions) (string, string, error) {
 		return name, remote, nil
 	}
 
+	if options.Template != "" {
+		vars, err := RemoteVars(name, options)
+		if err != nil {
+			return "", "", err
+		}
+		remote, err := ExpandRemote(options.Template, vars)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %w", name, err)
+		}
+		return name, remote, nil
+	}
+
 	if !options.DisableGit {
 		remote, err := SuggestGitName(name)
 		if err == nil {
@@ -518,16 +588,60 @@ func FindRemote(name string, options SuggestOptions) (string, string, error) {
 type ListOptions struct {
 	*ccontext.Context
 	Tag []string
+
+	// Maximum number of results to return in a page, 0 to use the server limit.
+	MaxResults int32
+	// Page to start listing from, the NextPageToken of a previous ListPage.
+	PageToken string
 }
 
-func (c *Client) List(path string, o ListOptions) ([]*apb.Artifact, []*apb.Element, error) {
+// ListPage returns a single page of results.
+//
+// If the server had more results than it could return, the response is
+// Truncated, and its NextPageToken can be passed in ListOptions to retrieve the rest.
+func (c *Client) ListPage(path string, o ListOptions) (*apb.ListResponse, error) {
 	resp, err := c.client.List(context.TODO(), &apb.ListRequest{
-		Path: path,
-		Tag:  &apb.TagSet{Tag: o.Tag},
+		Path:       path,
+		Tag:        &apb.TagSet{Tag: o.Tag},
+		MaxResults: o.MaxResults,
+		PageToken:  o.PageToken,
 	})
+	if err != nil {
+		return nil, client.NiceError(err, "list command failed - %s", err)
+	}
+	return resp, nil
+}
 
+// List returns all the artifacts and sub paths of path, retrieving all the pages of results.
+func (c *Client) List(path string, o ListOptions) ([]*apb.Artifact, []*apb.Element, error) {
+	resp, err := listAll(context.TODO(), c.client, &apb.ListRequest{
+		Path:       path,
+		Tag:        &apb.TagSet{Tag: o.Tag},
+		MaxResults: o.MaxResults,
+		PageToken:  o.PageToken,
+	})
 	if err != nil {
 		return nil, nil, client.NiceError(err, "list command failed - %s", err)
 	}
 	return resp.Artifact, resp.Element, nil
 }
+
+// listAll invokes List until all the pages of results have been retrieved, and merges them.
+func listAll(ctx context.Context, ac apb.AstoreClient, req *apb.ListRequest) (*apb.ListResponse, error) {
+	result := &apb.ListResponse{}
+	for {
+		resp, err := ac.List(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		result.Artifact = append(result.Artifact, resp.Artifact...)
+		result.Element = append(result.Element, resp.Element...)
+		if !resp.Truncated || resp.NextPageToken == "" || resp.NextPageToken == req.PageToken {
+			return result, nil
+		}
+
+		next := *req
+		next.PageToken = resp.NextPageToken
+		req = &next
+	}
+}
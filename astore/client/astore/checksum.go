@@ -0,0 +1,243 @@
+package astore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/System233/enkit/lib/atomicfile"
+)
+
+// ManifestName is the name of the checksum manifest written next to downloaded files.
+const ManifestName = "SHA256SUMS"
+
+// DigestSource indicates how the digest of a file in a manifest was obtained.
+type DigestSource string
+
+const (
+	// The digest was computed while downloading, and the download was verified
+	// against the digest provided by the server.
+	DigestServer DigestSource = "server"
+	// The digest was computed locally, the server provided no digest to verify the file with.
+	DigestLocal DigestSource = "local"
+)
+
+// ManifestEntry is a file listed in a checksum manifest.
+type ManifestEntry struct {
+	// Path of the file, relative to the directory containing the manifest.
+	Path string
+	// SHA256 of the file, hex encoded.
+	SHA256 string
+	// How the digest was obtained. Empty if unknown, like for manifests generated by other tools.
+	Source DigestSource
+}
+
+// Manifest is a list of files and their SHA256 digest.
+//
+// Manifests are stored in the same format as the output of sha256sum, and can
+// be verified with `sha256sum -c`. The source of each digest is recorded as a
+// comment preceding the entry.
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// Add adds or replaces the entry for the file with the same path.
+func (m *Manifest) Add(entry ManifestEntry) {
+	for ix := range m.Entries {
+		if m.Entries[ix].Path == entry.Path {
+			m.Entries[ix] = entry
+			return
+		}
+	}
+	m.Entries = append(m.Entries, entry)
+}
+
+const sourcePrefix = "# digest source: "
+
+// Marshal returns the manifest in sha256sum format, with entries sorted by path.
+func (m *Manifest) Marshal() []byte {
+	entries := append([]ManifestEntry{}, m.Entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "# Generated by astore download - verify with 'sha256sum -c %s' or 'astore checksum verify %s'.\n", ManifestName, ManifestName)
+	for _, entry := range entries {
+		switch entry.Source {
+		case DigestServer:
+			fmt.Fprintf(&buffer, "%s%s - download verified against the digest provided by the server\n", sourcePrefix, entry.Source)
+		case DigestLocal:
+			fmt.Fprintf(&buffer, "%s%s - computed locally, the server provided no digest\n", sourcePrefix, entry.Source)
+		}
+		fmt.Fprintf(&buffer, "%s  %s\n", entry.SHA256, entry.Path)
+	}
+	return buffer.Bytes()
+}
+
+// ParseManifest parses a manifest in sha256sum format, as generated by Marshal, or sha256sum.
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	var source DigestSource
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, sourcePrefix) {
+				source = DigestSource(strings.Fields(strings.TrimPrefix(line, sourcePrefix))[0])
+			}
+			continue
+		}
+
+		// sha256sum uses "<digest>  <path>" for text mode, and "<digest> *<path>" for binary mode.
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[1]) < 2 {
+			return nil, fmt.Errorf("line %d: invalid format, expected '<sha256>  <path>'", lineno)
+		}
+		digest, path := fields[0], fields[1][1:]
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid sha256 digest %q", lineno, digest)
+		}
+		manifest.Add(ManifestEntry{Path: path, SHA256: strings.ToLower(digest), Source: source})
+		source = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadManifest reads a manifest from file. If the file does not exist, an empty manifest is returned.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// WriteManifest atomically replaces the manifest at path.
+func WriteManifest(path string, manifest *Manifest) error {
+	return atomicfile.WriteFile(path, manifest.Marshal(), 0644)
+}
+
+// SHA256File returns the hex encoded SHA256 of the file at path.
+func SHA256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Checksums collects the digests of downloaded files, to write one manifest per output directory.
+type Checksums struct {
+	manifests map[string]*Manifest
+}
+
+func NewChecksums() *Checksums {
+	return &Checksums{manifests: map[string]*Manifest{}}
+}
+
+// Record adds the digest of the file at path to the manifest in the same directory.
+//
+// Entries for other files already in an existing manifest are preserved.
+func (c *Checksums) Record(path, digest string, source DigestSource) error {
+	dir, name := filepath.Split(path)
+	mpath := filepath.Join(dir, ManifestName)
+	manifest, found := c.manifests[mpath]
+	if !found {
+		var err error
+		manifest, err = ReadManifest(mpath)
+		if err != nil {
+			return err
+		}
+		c.manifests[mpath] = manifest
+	}
+	manifest.Add(ManifestEntry{Path: name, SHA256: digest, Source: source})
+	return nil
+}
+
+// Write writes all the manifests with recorded digests. Returns the paths of the manifests written.
+func (c *Checksums) Write() ([]string, error) {
+	var written []string
+	for mpath, manifest := range c.manifests {
+		if err := WriteManifest(mpath, manifest); err != nil {
+			return written, err
+		}
+		written = append(written, mpath)
+	}
+	sort.Strings(written)
+	return written, nil
+}
+
+// VerifyStatus is the result of verifying a file in a manifest.
+type VerifyStatus string
+
+const (
+	VerifyOK       VerifyStatus = "OK"
+	VerifyFailed   VerifyStatus = "FAILED"
+	VerifyMissing  VerifyStatus = "MISSING"
+	VerifyReadFail VerifyStatus = "UNREADABLE"
+)
+
+type VerifyResult struct {
+	ManifestEntry
+	Status VerifyStatus
+	// SHA256 computed from the file, if it could be read.
+	Actual string
+	// Error encountered reading the file, if any.
+	Err error
+}
+
+// Verify checks all the files in the manifest, with paths relative to dir.
+//
+// Returns one result per entry, and an error if any of the files did not match.
+func (m *Manifest) Verify(dir string) ([]VerifyResult, error) {
+	var results []VerifyResult
+	failed := 0
+	for _, entry := range m.Entries {
+		result := VerifyResult{ManifestEntry: entry, Status: VerifyOK}
+		actual, err := SHA256File(filepath.Join(dir, entry.Path))
+		switch {
+		case os.IsNotExist(err):
+			result.Status, result.Err = VerifyMissing, err
+		case err != nil:
+			result.Status, result.Err = VerifyReadFail, err
+		case actual != entry.SHA256:
+			result.Status, result.Actual = VerifyFailed, actual
+		default:
+			result.Actual = actual
+		}
+		if result.Status != VerifyOK {
+			failed++
+		}
+		results = append(results, result)
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d files failed verification", failed, len(m.Entries))
+	}
+	return results, nil
+}
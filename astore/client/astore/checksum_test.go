@@ -0,0 +1,130 @@
+package astore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/System233/enkit/lib/client/ccontext"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/progress"
+	"github.com/stretchr/testify/assert"
+)
+
+func downloadOptions(checksums *Checksums) DownloadOptions {
+	return DownloadOptions{
+		Context:   &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard},
+		Checksums: checksums,
+	}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloadWriteChecksums(t *testing.T) {
+	store := newFakeStore()
+	defer store.web.Close()
+
+	withMD5 := store.add("tools/gcc", "all", "gcc content", "")
+	withoutMD5 := store.add("tools/clang", "all", "clang content", "")
+	store.find(withoutMD5).art.MD5 = nil
+
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ManifestName), []byte(sha256Hex("old")+"  old-file\n"), 0644))
+
+	checksums := NewChecksums()
+	c := New(nil).withClient(store)
+	_, err := c.Download([]FileToDownload{
+		{Remote: withMD5, Local: filepath.Join(dir, "gcc")},
+		{Remote: withoutMD5, Local: filepath.Join(dir, "clang")},
+	}, downloadOptions(checksums))
+	assert.NoError(t, err)
+
+	written, err := checksums.Write()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, ManifestName)}, written)
+
+	manifest, err := ReadManifest(written[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []ManifestEntry{
+		{Path: "clang", SHA256: sha256Hex("clang content"), Source: DigestLocal},
+		{Path: "gcc", SHA256: sha256Hex("gcc content"), Source: DigestServer},
+		{Path: "old-file", SHA256: sha256Hex("old")},
+	}, manifest.Entries)
+
+	// old-file does not exist.
+	results, err := manifest.Verify(dir)
+	assert.Error(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, VerifyOK, results[0].Status)
+	assert.Equal(t, VerifyOK, results[1].Status)
+	assert.Equal(t, VerifyMissing, results[2].Status)
+
+	// The manifest is compatible with sha256sum.
+	if sha256sum, err := exec.LookPath("sha256sum"); err == nil {
+		assert.Nil(t, os.Remove(filepath.Join(dir, ManifestName)))
+		manifest.Entries = manifest.Entries[:2]
+		assert.Nil(t, WriteManifest(filepath.Join(dir, ManifestName), manifest))
+
+		cmd := exec.Command(sha256sum, "--strict", "-c", ManifestName)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, "%s", output)
+	}
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a content"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("b content"), 0644))
+
+	manifest := &Manifest{}
+	for _, name := range []string{"a", "b"} {
+		digest, err := SHA256File(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		manifest.Add(ManifestEntry{Path: name, SHA256: digest, Source: DigestLocal})
+	}
+	_, err := manifest.Verify(dir)
+	assert.NoError(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("b corrupted"), 0644))
+	results, err := manifest.Verify(dir)
+	assert.Error(t, err)
+	assert.Equal(t, VerifyOK, results[0].Status)
+	assert.Equal(t, VerifyFailed, results[1].Status)
+	assert.Equal(t, sha256Hex("b corrupted"), results[1].Actual)
+
+	// Manifests generated by sha256sum in binary mode are accepted too.
+	parsed, err := ParseManifest([]byte(sha256Hex("a content") + " *a\n"))
+	assert.NoError(t, err)
+	_, err = parsed.Verify(dir)
+	assert.NoError(t, err)
+
+	_, err = ParseManifest([]byte("not-a-digest  a\n"))
+	assert.Error(t, err)
+}
+
+func TestDownloadDetectsServerMismatch(t *testing.T) {
+	store := newFakeStore()
+	defer store.web.Close()
+
+	uid := store.add("tools/gcc", "all", "gcc content", "")
+	store.find(uid).art.MD5 = []byte("0123456789abcdef")
+
+	dir := t.TempDir()
+	checksums := NewChecksums()
+	_, err := New(nil).withClient(store).Download([]FileToDownload{{Remote: uid, Local: filepath.Join(dir, "gcc")}}, downloadOptions(checksums))
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "gcc"))
+	assert.True(t, os.IsNotExist(err))
+
+	written, err := checksums.Write()
+	assert.NoError(t, err)
+	assert.Empty(t, written)
+}
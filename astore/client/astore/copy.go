@@ -0,0 +1,54 @@
+package astore
+
+import (
+	"context"
+
+	"github.com/System233/enkit/astore/rpc/astore"
+)
+
+type ToCopy struct {
+	// Path or uid of the artifact to copy.
+	Source     string
+	SourceType PathType
+	// Architecture of the artifact to copy. If empty, the latest artifact
+	// of any architecture is copied.
+	Architecture string
+
+	// Path to copy the artifact to.
+	Destination string
+
+	// Tags and note of the copy.
+	Tag  []string
+	Note string
+
+	// Also assign the tags of the source to the copy.
+	KeepTags bool
+	// Use the note of the source, if Note is empty.
+	KeepNote bool
+	// Copy even if the destination already has an artifact with the same content.
+	AllowDuplicate bool
+}
+
+// Copy copies an artifact to a different path.
+//
+// The copy is performed by the server: no bytes are downloaded or uploaded,
+// the copy shares the storage of the source.
+func (c *Client) Copy(el ToCopy) (*astore.CopyResponse, error) {
+	source, id := RetrieveRequestFromPath(el.Source, el.SourceType)
+	if id == IdUid {
+		// Like in GetRetrieveResponse, a uid identifies the artifact regardless of its tags.
+		source.Tag = &astore.TagSet{}
+	}
+	source.Architecture = el.Architecture
+
+	req := &astore.CopyRequest{
+		Source:         source,
+		Path:           el.Destination,
+		Tag:            el.Tag,
+		Note:           el.Note,
+		KeepTags:       el.KeepTags,
+		KeepNote:       el.KeepNote,
+		AllowDuplicate: el.AllowDuplicate,
+	}
+	return c.client.Copy(context.TODO(), req)
+}
@@ -0,0 +1,39 @@
+package astore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCopy(t *testing.T) {
+	fs := newFakeStore()
+	defer fs.web.Close()
+	client := New(nil).withClient(fs)
+
+	uid := fs.add("staging/kernel", "amd64-linux", "kernel image", "built from main", "latest", "tested")
+	fs.add("releases/kernel", "amd64-linux", "previous kernel", "", "latest", "stable")
+
+	resp, err := client.Copy(ToCopy{Source: uid, Destination: "releases/kernel", Tag: []string{"stable"}, KeepNote: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "releases/kernel", resp.Path)
+	assert.NotEqual(t, uid, resp.Artifact.Uid)
+	assert.Equal(t, fs.find(uid).art.Sid, resp.Artifact.Sid)
+	assert.Equal(t, []string{
+		`releases/kernel amd64-linux d63912aa29a98af7aaf036a285c6314d "" []`,
+		`releases/kernel amd64-linux 3bbdb5cd36eb367cdabdd681893606e1 "built from main" [latest stable]`,
+	}, fs.state("releases"))
+
+	// The destination already has the same content.
+	_, err = client.Copy(ToCopy{Source: uid, Destination: "releases/kernel"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	resp, err = client.Copy(ToCopy{Source: uid, Destination: "releases/kernel", KeepTags: true, AllowDuplicate: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"latest", "tested"}, sortedTags(resp.Artifact.Tag))
+
+	_, err = client.Copy(ToCopy{Source: "00000000000000000000000000000000", Destination: "releases/kernel"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
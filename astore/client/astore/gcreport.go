@@ -0,0 +1,40 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/System233/enkit/astore/retention"
+	apb "github.com/System233/enkit/astore/rpc/astore"
+)
+
+// nopWriteCloser adapts a Writer for Download.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// GCReport downloads and parses the latest GC report stored at path by the
+// astore server, as configured with its --gc-report-path flag.
+func (c *Client) GCReport(path string) (*retention.Report, *apb.Artifact, error) {
+	response, _, _, err := c.GetRetrieveResponse(path, nil, IdPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data bytes.Buffer
+	if err := Download(context.TODO(), func(int64) io.WriteCloser { return nopWriteCloser{&data} }, response.Url); err != nil {
+		return nil, nil, fmt.Errorf("could not download the GC report %s - %w", path, err)
+	}
+	report := &retention.Report{}
+	if err := json.Unmarshal(data.Bytes(), report); err != nil {
+		return nil, nil, fmt.Errorf("invalid GC report %s - %w", path, err)
+	}
+	return report, response.Artifact, nil
+}
@@ -0,0 +1,563 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/client/ccontext"
+	"github.com/System233/enkit/lib/multierror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// MirrorOptions controls the behavior of Client.Mirror.
+type MirrorOptions struct {
+	*ccontext.Context
+
+	// Only artifacts below this path are mirrored. Empty means everything.
+	Prefix string
+	// Compute and return the report, but don't change the destination.
+	DryRun bool
+	// Delete artifacts on the destination that don't exist on the source.
+	DeleteExtraneous bool
+	// Maximum number of artifacts copied at the same time. <= 0 means 1.
+	//
+	// When the servers rate limit requests, fewer artifacts are copied at the
+	// same time for the remainder of the run, down to 1.
+	Parallelism int
+	// Maximum number of times the copy of an artifact is retried when rate limited.
+	// <= 0 means DefaultRateLimitRetries.
+	RateLimitRetries int
+	// Client used to download the artifacts from the source, and upload them to
+	// the destination. If nil, http.DefaultClient is used.
+	HTTP *http.Client
+}
+
+// MirrorAction describes what the mirror did (or would do) for one artifact.
+type MirrorAction string
+
+const (
+	MirrorCopy   MirrorAction = "copy"
+	MirrorUpdate MirrorAction = "update"
+	MirrorDelete MirrorAction = "delete"
+	// A published alias was created or changed on the destination.
+	MirrorPublish MirrorAction = "publish"
+	// A published alias was removed from the destination.
+	MirrorUnpublish MirrorAction = "unpublish"
+)
+
+// MirrorEntry describes a single change made (or planned) to the destination.
+type MirrorEntry struct {
+	Action MirrorAction
+	// Path of the artifact, or of the alias for publish and unpublish.
+	Path         string
+	Architecture string
+	// Uid of the artifact on the source for copies and updates,
+	// uid of the artifact on the destination for deletions,
+	// uid selected by the alias, if any, for publish and unpublish.
+	Uid string
+	// MD5 of the artifact, hex encoded.
+	MD5 string
+	// If not nil, the action failed. Running the mirror again will retry it.
+	Err error
+}
+
+// MirrorReport summarizes the outcome of a mirror run.
+type MirrorReport struct {
+	DryRun bool
+
+	// Artifacts on the source that already matched the destination.
+	Unchanged int
+	Entries   []MirrorEntry
+
+	// Number of copies rate limited by the servers, and retried.
+	Throttled int
+	// Lowest number of artifacts copied at the same time, after adapting to rate limits.
+	MinParallelism int
+}
+
+// Count returns the number of entries with the specified action, and how many of them failed.
+func (r *MirrorReport) Count(action MirrorAction) (total, failed int) {
+	for _, e := range r.Entries {
+		if e.Action != action {
+			continue
+		}
+		total++
+		if e.Err != nil {
+			failed++
+		}
+	}
+	return total, failed
+}
+
+// Err returns an error summarizing all the failed entries, nil if there were none.
+func (r *MirrorReport) Err() error {
+	var errs []error
+	for _, e := range r.Entries {
+		if e.Err != nil {
+			errs = append(errs, fmt.Errorf("%s %s (%s, %s) failed - %w", e.Action, e.Path, e.Architecture, e.Uid, e.Err))
+		}
+	}
+	return multierror.New(errs)
+}
+
+// mirrorKey identifies the same artifact across two different astore servers.
+//
+// uids and sids are assigned by each server independently, the only thing
+// that is preserved across servers is the content, architecture and path.
+func mirrorKey(art *apb.Artifact) string {
+	return art.Architecture + "/" + hex.EncodeToString(art.MD5)
+}
+
+// walk returns all the artifacts with any tag below the specified prefix, indexed by path.
+func (c *Client) walk(ctx context.Context, prefix string) (map[string][]*apb.Artifact, error) {
+	result := map[string][]*apb.Artifact{}
+
+	todo := []string{strings.Trim(prefix, "/")}
+	for len(todo) > 0 {
+		cursor := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+
+		resp, err := listAll(ctx, c.client, &apb.ListRequest{Path: cursor, Tag: &apb.TagSet{}})
+		if err != nil {
+			return nil, client.NiceError(err, "listing %s failed - %s", cursor, err)
+		}
+		if len(resp.Artifact) > 0 {
+			result[cursor] = resp.Artifact
+		}
+		for _, el := range resp.Element {
+			todo = append(todo, path.Join(cursor, el.Name))
+		}
+	}
+	return result, nil
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := append([]string{}, a...)
+	bs := append([]string{}, b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for ix := range as {
+		if as[ix] != bs[ix] {
+			return false
+		}
+	}
+	return true
+}
+
+// Mirror makes the content of the destination below o.Prefix match the content of c.
+//
+// Artifacts are compared by path, architecture and MD5. Missing artifacts are
+// streamed from the source to the destination through this client, and verified
+// against the source MD5 before being committed. Tags and notes of artifacts
+// present on both sides are updated to match the source.
+//
+// Published aliases selecting artifacts below o.Prefix are published on the
+// destination as well, see mirrorAliases.
+//
+// Mirror is idempotent: if some artifacts fail to copy, running it again will only
+// retry what is still different. The returned report is always valid, even when
+// an error is returned.
+func (c *Client) Mirror(dest *Client, o MirrorOptions) (*MirrorReport, error) {
+	ctx := context.TODO()
+	report := &MirrorReport{DryRun: o.DryRun}
+	hc := o.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	o.Logger.Infof("listing source artifacts below '%s'", o.Prefix)
+	src, err := c.walk(ctx, o.Prefix)
+	if err != nil {
+		return report, err
+	}
+	o.Logger.Infof("listing destination artifacts below '%s'", o.Prefix)
+	dst, err := dest.walk(ctx, o.Prefix)
+	if err != nil {
+		return report, err
+	}
+
+	paths := []string{}
+	for p := range src {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var copies []*apb.Artifact
+	var copyPaths []string
+	for _, p := range paths {
+		existing := map[string]*apb.Artifact{}
+		for _, art := range dst[p] {
+			existing[mirrorKey(art)] = art
+		}
+
+		// Copy the oldest artifacts first, so creation order on the destination
+		// roughly matches that on the source.
+		arts := append([]*apb.Artifact{}, src[p]...)
+		sort.SliceStable(arts, func(i, j int) bool { return arts[i].Created < arts[j].Created })
+		for _, art := range arts {
+			found := existing[mirrorKey(art)]
+			if found == nil {
+				copies = append(copies, art)
+				copyPaths = append(copyPaths, p)
+				continue
+			}
+			if sameStrings(found.Tag, art.Tag) && found.Note == art.Note {
+				report.Unchanged++
+				continue
+			}
+
+			entry := MirrorEntry{Action: MirrorUpdate, Path: p, Architecture: art.Architecture, Uid: art.Uid, MD5: hex.EncodeToString(art.MD5)}
+			if !o.DryRun {
+				entry.Err = dest.replicateMeta(ctx, found.Uid, art)
+			}
+			report.Entries = append(report.Entries, entry)
+		}
+	}
+
+	retries := o.RateLimitRetries
+	if retries <= 0 {
+		retries = DefaultRateLimitRetries
+	}
+
+	entries := make([]MirrorEntry, len(copies))
+	pacer := newPacer(o.Parallelism)
+	var wg sync.WaitGroup
+	for ix, art := range copies {
+		entries[ix] = MirrorEntry{Action: MirrorCopy, Path: copyPaths[ix], Architecture: art.Architecture, Uid: art.Uid, MD5: hex.EncodeToString(art.MD5)}
+		if o.DryRun {
+			continue
+		}
+
+		wg.Add(1)
+		started := pacer.Acquire()
+		go func(entry *MirrorEntry, art *apb.Artifact, started time.Time) {
+			defer wg.Done()
+
+			for attempt := 0; ; attempt++ {
+				o.Logger.Infof("copying %s (%s, %s)", entry.Path, entry.Architecture, entry.Uid)
+				entry.Err = c.copyTo(ctx, hc, dest, entry.Path, art)
+				if !pacer.Release(started, entry.Err) || attempt >= retries {
+					return
+				}
+				o.Logger.Warnf("copying %s (%s, %s) was rate limited, will retry - %s", entry.Path, entry.Architecture, entry.Uid, entry.Err)
+				started = pacer.Acquire()
+			}
+		}(&entries[ix], art, started)
+	}
+	wg.Wait()
+	report.Entries = append(report.Entries, entries...)
+	report.Throttled, report.MinParallelism = pacer.Stats()
+
+	// Tags can only live on one artifact per path and architecture. Copying an artifact
+	// moves the "latest" tag, so tags need to be re-aligned once all copies are done.
+	if !o.DryRun && len(copies) > 0 {
+		if err := c.realign(ctx, dest, src, copyPaths); err != nil {
+			return report, err
+		}
+	}
+
+	// Failing to list the aliases does not prevent the deletion of extraneous artifacts.
+	aliasErr := c.mirrorAliases(ctx, dest, src, dst, o, report)
+
+	if o.DeleteExtraneous {
+		for _, p := range sortedKeys(dst) {
+			wanted := map[string]struct{}{}
+			for _, art := range src[p] {
+				wanted[mirrorKey(art)] = struct{}{}
+			}
+
+			for _, art := range dst[p] {
+				if _, found := wanted[mirrorKey(art)]; found {
+					continue
+				}
+				entry := MirrorEntry{Action: MirrorDelete, Path: p, Architecture: art.Architecture, Uid: art.Uid, MD5: hex.EncodeToString(art.MD5)}
+				if !o.DryRun {
+					if _, err := dest.client.Delete(ctx, &apb.DeleteRequest{Id: art.Uid}); err != nil {
+						entry.Err = client.NiceError(err, "delete failed - %s", err)
+					}
+				}
+				report.Entries = append(report.Entries, entry)
+			}
+		}
+	}
+
+	if aliasErr != nil {
+		if err := report.Err(); err != nil {
+			return report, multierror.New([]error{aliasErr, err})
+		}
+		return report, aliasErr
+	}
+	return report, report.Err()
+}
+
+func sortedKeys(m map[string][]*apb.Artifact) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// located is an artifact, and the path it is stored at.
+type located struct {
+	path string
+	art  *apb.Artifact
+}
+
+func byUid(arts map[string][]*apb.Artifact) map[string]located {
+	result := map[string]located{}
+	for p, list := range arts {
+		for _, art := range list {
+			result[art.Uid] = located{path: p, art: art}
+		}
+	}
+	return result
+}
+
+// inPrefix returns true if the path p is prefix, or below prefix. Every path is below the empty prefix.
+func inPrefix(p, prefix string) bool {
+	p, prefix = strings.Trim(p, "/"), strings.Trim(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// aliasTarget returns where the artifacts selected by an alias are stored, and for aliases
+// selecting an uid, the artifact selected. Returns false if the uid is not one of arts.
+func aliasTarget(sel *apb.ListRequest, arts map[string]located) (located, bool) {
+	if sel.Uid == "" {
+		return located{path: sel.Path}, true
+	}
+	found, ok := arts[sel.Uid]
+	return found, ok
+}
+
+// mirrorAliases makes the aliases published on dest match the aliases published on c,
+// for the aliases selecting artifacts below o.Prefix.
+//
+// As uids are assigned by each server, an alias selecting an uid is published on dest
+// with the uid of the copy of the artifact. Aliases selecting an uid that is not below
+// o.Prefix on the source are not mirrored. With o.DeleteExtraneous, aliases selecting
+// artifacts below o.Prefix that are not published on c are removed from dest.
+func (c *Client) mirrorAliases(ctx context.Context, dest *Client, src, dst map[string][]*apb.Artifact, o MirrorOptions, report *MirrorReport) error {
+	srcAliases, err := c.client.ListAliases(ctx, &apb.ListAliasesRequest{})
+	if err != nil {
+		return client.NiceError(err, "listing the aliases published on the source failed, aliases were not mirrored - %s", err)
+	}
+	dstAliases, err := dest.client.ListAliases(ctx, &apb.ListAliasesRequest{})
+	if err != nil {
+		return client.NiceError(err, "listing the aliases published on the destination failed, aliases were not mirrored - %s", err)
+	}
+	existing := map[string]*apb.ListRequest{}
+	for _, alias := range dstAliases.Alias {
+		existing[alias.Path] = alias.Select
+	}
+
+	srcByUid := byUid(src)
+	wanted := map[string]struct{}{}
+	for _, alias := range srcAliases.Alias {
+		if alias.Select == nil {
+			continue
+		}
+		target, found := aliasTarget(alias.Select, srcByUid)
+		if !found || !inPrefix(target.path, o.Prefix) {
+			if !found && o.Prefix == "" {
+				o.Logger.Warnf("alias %s selects uid %s, which does not exist on the source - not mirrored", alias.Path, alias.Select.Uid)
+			}
+			continue
+		}
+		wanted[alias.Path] = struct{}{}
+
+		entry := MirrorEntry{Action: MirrorPublish, Path: alias.Path, Architecture: alias.Select.Architecture, Uid: alias.Select.Uid}
+		sel := proto.Clone(alias.Select).(*apb.ListRequest)
+		if target.art != nil {
+			uid, err := dest.mirroredUid(ctx, target)
+			if err != nil {
+				entry.Err = err
+				report.Entries = append(report.Entries, entry)
+				continue
+			}
+			if uid == "" {
+				// In a dry run, the artifact has not been copied yet.
+				if !o.DryRun {
+					entry.Err = fmt.Errorf("artifact %s selected by the alias was not copied to the destination", target.art.Uid)
+				}
+				report.Entries = append(report.Entries, entry)
+				continue
+			}
+			sel.Uid = uid
+		}
+		if previous, found := existing[alias.Path]; found && proto.Equal(previous, sel) {
+			continue
+		}
+
+		if !o.DryRun {
+			entry.Err = dest.republish(ctx, alias.Path, sel, existing[alias.Path] != nil)
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	if !o.DeleteExtraneous {
+		return nil
+	}
+	dstByUid := byUid(dst)
+	for _, alias := range dstAliases.Alias {
+		if _, found := wanted[alias.Path]; found || alias.Select == nil {
+			continue
+		}
+		target, found := aliasTarget(alias.Select, dstByUid)
+		if !found || !inPrefix(target.path, o.Prefix) {
+			continue
+		}
+		entry := MirrorEntry{Action: MirrorUnpublish, Path: alias.Path, Architecture: alias.Select.Architecture, Uid: alias.Select.Uid}
+		if !o.DryRun {
+			if _, err := dest.client.Unpublish(ctx, &apb.UnpublishRequest{Path: alias.Path}); err != nil {
+				entry.Err = client.NiceError(err, "unpublish failed - %s", err)
+			}
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	return nil
+}
+
+// mirroredUid returns the uid of the copy of the artifact on c, empty if there is none.
+func (c *Client) mirroredUid(ctx context.Context, target located) (string, error) {
+	resp, err := listAll(ctx, c.client, &apb.ListRequest{Path: target.path, Tag: &apb.TagSet{}})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return "", client.NiceError(err, "listing %s failed - %s", target.path, err)
+	}
+	for _, art := range resp.GetArtifact() {
+		if mirrorKey(art) == mirrorKey(target.art) {
+			return art.Uid, nil
+		}
+	}
+	return "", nil
+}
+
+// republish publishes an alias at p selecting sel, replacing the alias already there, if any.
+func (c *Client) republish(ctx context.Context, p string, sel *apb.ListRequest, replace bool) error {
+	if replace {
+		if _, err := c.client.Unpublish(ctx, &apb.UnpublishRequest{Path: p}); err != nil {
+			return client.NiceError(err, "could not remove the previous alias - %s", err)
+		}
+	}
+	if _, err := c.client.Publish(ctx, &apb.PublishRequest{Path: p, Select: sel}); err != nil {
+		return client.NiceError(err, "publish failed - %s", err)
+	}
+	return nil
+}
+
+// replicateMeta sets the tags and note of the artifact uid to those of art.
+func (c *Client) replicateMeta(ctx context.Context, uid string, art *apb.Artifact) error {
+	if _, err := c.client.Tag(ctx, &apb.TagRequest{Uid: uid, Set: &apb.TagSet{Tag: art.Tag}}); err != nil {
+		return client.NiceError(err, "could not set tags - %s", err)
+	}
+	if _, err := c.client.Note(ctx, &apb.NoteRequest{Uid: uid, Note: art.Note}); err != nil {
+		return client.NiceError(err, "could not set note - %s", err)
+	}
+	return nil
+}
+
+// realign re-lists the specified paths on the destination, and makes sure tags and notes match the source.
+func (c *Client) realign(ctx context.Context, dest *Client, src map[string][]*apb.Artifact, paths []string) error {
+	seen := map[string]struct{}{}
+	var errs []error
+	for _, p := range paths {
+		if _, found := seen[p]; found {
+			continue
+		}
+		seen[p] = struct{}{}
+
+		resp, err := listAll(ctx, dest.client, &apb.ListRequest{Path: p, Tag: &apb.TagSet{}})
+		if err != nil {
+			errs = append(errs, client.NiceError(err, "listing %s failed - %s", p, err))
+			continue
+		}
+		existing := map[string]*apb.Artifact{}
+		for _, art := range resp.Artifact {
+			existing[mirrorKey(art)] = art
+		}
+		for _, art := range src[p] {
+			found := existing[mirrorKey(art)]
+			if found == nil || (sameStrings(found.Tag, art.Tag) && found.Note == art.Note) {
+				continue
+			}
+			if err := dest.replicateMeta(ctx, found.Uid, art); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			}
+		}
+	}
+	return multierror.New(errs)
+}
+
+// copyTo streams the artifact from c to dest through hc, verifying its MD5 before committing it.
+func (c *Client) copyTo(ctx context.Context, hc *http.Client, dest *Client, p string, art *apb.Artifact) error {
+	retrieved, err := c.client.Retrieve(ctx, &apb.RetrieveRequest{Uid: art.Uid, Tag: &apb.TagSet{}})
+	if err != nil {
+		return grpcRateLimited(err, client.NiceError(err, "could not retrieve source - %s", err))
+	}
+	if retrieved.Url == "" {
+		return fmt.Errorf("invalid empty URL returned by source server")
+	}
+
+	stored, err := dest.client.Store(ctx, &apb.StoreRequest{})
+	if err != nil {
+		return grpcRateLimited(err, client.NiceError(err, "could not initiate store request - %s", err))
+	}
+	if stored.Sid == "" || stored.Url == "" {
+		return fmt.Errorf("invalid destination server response")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, retrieved.Url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return httpRateLimited(resp, fmt.Errorf("download returned status code %d - %s", resp.StatusCode, resp.Status))
+	}
+
+	hash := md5.New()
+	body := io.NopCloser(io.TeeReader(resp.Body, hash))
+	if err := uploadWith(ctx, hc, body, art.Size, stored.Url); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), art.MD5) {
+		return fmt.Errorf("integrity check failed - source reported md5 %x, streamed %x", art.MD5, hash.Sum(nil))
+	}
+
+	committed, err := dest.client.Commit(ctx, &apb.CommitRequest{
+		Sid:          stored.Sid,
+		Path:         p,
+		Architecture: art.Architecture,
+		Tag:          art.Tag,
+		Note:         art.Note,
+	})
+	if err != nil {
+		return grpcRateLimited(err, client.NiceError(err, "commit failed - %s", err))
+	}
+	if committed.Artifact != nil && len(committed.Artifact.MD5) > 0 && !bytes.Equal(committed.Artifact.MD5, art.MD5) {
+		return fmt.Errorf("integrity check failed - destination stored md5 %x, expected %x", committed.Artifact.MD5, art.MD5)
+	}
+	return nil
+}
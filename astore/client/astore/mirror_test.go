@@ -0,0 +1,748 @@
+package astore
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/client/ccontext"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeArtifact struct {
+	art  *apb.Artifact
+	path string
+}
+
+// fakeStore is an in memory implementation of the astore API, with blobs served over http.
+type fakeStore struct {
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	artifacts []*fakeArtifact
+	counter   int
+	deleted   []string
+	// Published aliases, by path.
+	aliases map[string]*apb.ListRequest
+	// If true, ListAliases is not implemented, like on older servers.
+	noListAliases bool
+
+	// If > 0, uploads above this number in parallel are rate limited.
+	maxUploads int
+	uploads    int
+	throttled  int
+
+	// If > 0, List returns at most this number of results per page.
+	pageSize int
+
+	web *httptest.Server
+}
+
+func newFakeStore() *fakeStore {
+	fs := &fakeStore{blobs: map[string][]byte{}, aliases: map[string]*apb.ListRequest{}}
+	fs.web = httptest.NewServer(http.HandlerFunc(fs.serveBlob))
+	return fs
+}
+
+func (fs *fakeStore) serveBlob(w http.ResponseWriter, r *http.Request) {
+	sid := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodGet:
+		fs.lock.Lock()
+		data, found := fs.blobs[sid]
+		fs.lock.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case http.MethodPut:
+		fs.lock.Lock()
+		if fs.maxUploads > 0 && fs.uploads >= fs.maxUploads {
+			fs.throttled++
+			fs.lock.Unlock()
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		fs.uploads++
+		fs.lock.Unlock()
+		defer func() {
+			fs.lock.Lock()
+			defer fs.lock.Unlock()
+			fs.uploads--
+		}()
+		if fs.maxUploads > 0 {
+			// Make sure uploads overlap.
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fs.lock.Lock()
+		fs.blobs[sid] = data
+		fs.lock.Unlock()
+	}
+}
+
+func (fs *fakeStore) nextId(prefix string) string {
+	fs.counter++
+	return fmt.Sprintf("%s%031d", prefix, fs.counter)
+}
+
+// add creates an artifact directly, returning its uid.
+func (fs *fakeStore) add(p, arch, content, note string, tags ...string) string {
+	fs.lock.Lock()
+	sid := fs.nextId("s")
+	fs.blobs[sid] = []byte(content)
+	fs.lock.Unlock()
+
+	resp, err := fs.Commit(context.Background(), &apb.CommitRequest{Sid: sid, Path: p, Architecture: arch, Note: note})
+	if err != nil {
+		panic(err)
+	}
+	fs.Tag(context.Background(), &apb.TagRequest{Uid: resp.Artifact.Uid, Set: &apb.TagSet{Tag: tags}})
+	return resp.Artifact.Uid
+}
+
+func (fs *fakeStore) Store(ctx context.Context, in *apb.StoreRequest, opts ...grpc.CallOption) (*apb.StoreResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	sid := fs.nextId("s")
+	return &apb.StoreResponse{Sid: sid, Url: fs.web.URL + "/" + sid}, nil
+}
+
+// moveTags removes the specified tags from all the other artifacts in the same path and architecture.
+func (fs *fakeStore) moveTags(owner *fakeArtifact) {
+	for _, other := range fs.artifacts {
+		if other == owner || other.path != owner.path || other.art.Architecture != owner.art.Architecture {
+			continue
+		}
+		other.art.Tag = cleanTags(other.art.Tag, owner.art.Tag)
+	}
+}
+
+func cleanTags(tags, del []string) []string {
+	result := []string{}
+	for _, t := range tags {
+		keep := true
+		for _, d := range del {
+			if t == d {
+				keep = false
+			}
+		}
+		if keep {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func (fs *fakeStore) Commit(ctx context.Context, in *apb.CommitRequest, opts ...grpc.CallOption) (*apb.CommitResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	data, found := fs.blobs[in.Sid]
+	if !found {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sid %s", in.Sid)
+	}
+	sum := md5.Sum(data)
+	fa := &fakeArtifact{path: in.Path, art: &apb.Artifact{
+		Sid:          in.Sid,
+		Uid:          fs.nextId("u"),
+		Tag:          append(cleanTags(in.Tag, []string{"latest"}), "latest"),
+		MD5:          sum[:],
+		Size:         int64(len(data)),
+		Created:      int64(fs.counter),
+		Note:         in.Note,
+		Architecture: in.Architecture,
+	}}
+	fs.artifacts = append(fs.artifacts, fa)
+	fs.moveTags(fa)
+	return &apb.CommitResponse{Artifact: fa.art}, nil
+}
+
+func (fs *fakeStore) find(uid string) *fakeArtifact {
+	for _, fa := range fs.artifacts {
+		if fa.art.Uid == uid {
+			return fa
+		}
+	}
+	return nil
+}
+
+func (fs *fakeStore) Retrieve(ctx context.Context, in *apb.RetrieveRequest, opts ...grpc.CallOption) (*apb.RetrieveResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fa := fs.find(in.Uid)
+	if fa == nil {
+		return nil, status.Errorf(codes.NotFound, "uid %s not found", in.Uid)
+	}
+	return &apb.RetrieveResponse{Path: fa.path, Url: fs.web.URL + "/" + fa.art.Sid, Artifact: fa.art}, nil
+}
+
+func (fs *fakeStore) List(ctx context.Context, in *apb.ListRequest, opts ...grpc.CallOption) (*apb.ListResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	tags := []string{"latest"}
+	if in.Tag != nil {
+		tags = in.Tag.Tag
+	}
+
+	resp := &apb.ListResponse{}
+	children := map[string]struct{}{}
+	for _, fa := range fs.artifacts {
+		if fa.path == in.Path {
+			if len(cleanTags(tags, fa.art.Tag)) == 0 {
+				resp.Artifact = append(resp.Artifact, fa.art)
+			}
+			continue
+		}
+
+		rel := fa.path
+		if in.Path != "" {
+			if !strings.HasPrefix(fa.path, in.Path+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(fa.path, in.Path+"/")
+		}
+		child := strings.SplitN(rel, "/", 2)[0]
+		if _, found := children[child]; !found {
+			children[child] = struct{}{}
+			resp.Element = append(resp.Element, &apb.Element{Name: child})
+		}
+	}
+	if fs.pageSize <= 0 {
+		return resp, nil
+	}
+
+	// Like the server, return elements first, then artifacts.
+	start, _ := strconv.Atoi(in.PageToken)
+	page := &apb.ListResponse{}
+	for ix := start; ix < len(resp.Element)+len(resp.Artifact); ix++ {
+		if ix-start >= fs.pageSize {
+			page.Truncated = true
+			page.NextPageToken = strconv.Itoa(ix)
+			break
+		}
+		if ix < len(resp.Element) {
+			page.Element = append(page.Element, resp.Element[ix])
+		} else {
+			page.Artifact = append(page.Artifact, resp.Artifact[ix-len(resp.Element)])
+		}
+	}
+	return page, nil
+}
+
+func (fs *fakeStore) Tag(ctx context.Context, in *apb.TagRequest, opts ...grpc.CallOption) (*apb.TagResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fa := fs.find(in.Uid)
+	if fa == nil {
+		return nil, status.Errorf(codes.NotFound, "uid %s not found", in.Uid)
+	}
+	if in.Set != nil {
+		fa.art.Tag = append([]string{}, in.Set.Tag...)
+	}
+	fs.moveTags(fa)
+	return &apb.TagResponse{Artifact: []*apb.Artifact{fa.art}}, nil
+}
+
+func (fs *fakeStore) Note(ctx context.Context, in *apb.NoteRequest, opts ...grpc.CallOption) (*apb.NoteResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fa := fs.find(in.Uid)
+	if fa == nil {
+		return nil, status.Errorf(codes.NotFound, "uid %s not found", in.Uid)
+	}
+	fa.art.Note = in.Note
+	return &apb.NoteResponse{Artifact: []*apb.Artifact{fa.art}}, nil
+}
+
+func (fs *fakeStore) Copy(ctx context.Context, in *apb.CopyRequest, opts ...grpc.CallOption) (*apb.CopyResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	source := fs.find(in.Source.GetUid())
+	if source == nil {
+		return nil, status.Errorf(codes.NotFound, "uid %s not found", in.Source.GetUid())
+	}
+	if !in.AllowDuplicate {
+		for _, other := range fs.artifacts {
+			if other.path == in.Path && other.art.Architecture == source.art.Architecture && string(other.art.MD5) == string(source.art.MD5) {
+				return nil, status.Errorf(codes.AlreadyExists, "artifact %s has the same content", other.art.Uid)
+			}
+		}
+	}
+
+	tags := in.Tag
+	if in.KeepTags {
+		tags = append(append([]string{}, tags...), source.art.Tag...)
+	}
+	note := in.Note
+	if note == "" && in.KeepNote {
+		note = source.art.Note
+	}
+	fa := &fakeArtifact{path: in.Path, art: &apb.Artifact{
+		Sid:          source.art.Sid,
+		Uid:          fs.nextId("u"),
+		Tag:          append(cleanTags(tags, []string{"latest"}), "latest"),
+		MD5:          source.art.MD5,
+		Size:         source.art.Size,
+		Created:      int64(fs.counter),
+		Note:         note,
+		Architecture: source.art.Architecture,
+	}}
+	fs.artifacts = append(fs.artifacts, fa)
+	fs.moveTags(fa)
+	return &apb.CopyResponse{Path: in.Path, Artifact: fa.art}, nil
+}
+
+func (fs *fakeStore) Delete(ctx context.Context, in *apb.DeleteRequest, opts ...grpc.CallOption) (*apb.DeleteResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for ix, fa := range fs.artifacts {
+		if fa.art.Uid == in.Id {
+			fs.artifacts = append(fs.artifacts[:ix], fs.artifacts[ix+1:]...)
+			fs.deleted = append(fs.deleted, in.Id)
+			return &apb.DeleteResponse{Ids: []string{in.Id}}, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "id %s not found", in.Id)
+}
+
+func (fs *fakeStore) Search(ctx context.Context, in *apb.SearchRequest, opts ...grpc.CallOption) (*apb.SearchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "not implemented")
+}
+
+func (fs *fakeStore) Publish(ctx context.Context, in *apb.PublishRequest, opts ...grpc.CallOption) (*apb.PublishResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, found := fs.aliases[in.Path]; found {
+		return nil, status.Errorf(codes.AlreadyExists, "alias %s already exists", in.Path)
+	}
+	fs.aliases[in.Path] = in.Select
+	return &apb.PublishResponse{Url: fs.web.URL + "/" + in.Path}, nil
+}
+
+func (fs *fakeStore) Unpublish(ctx context.Context, in *apb.UnpublishRequest, opts ...grpc.CallOption) (*apb.UnpublishResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.aliases, in.Path)
+	return &apb.UnpublishResponse{}, nil
+}
+
+func (fs *fakeStore) ListAliases(ctx context.Context, in *apb.ListAliasesRequest, opts ...grpc.CallOption) (*apb.ListAliasesResponse, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.noListAliases {
+		return nil, status.Errorf(codes.Unimplemented, "not implemented")
+	}
+	resp := &apb.ListAliasesResponse{}
+	for p, sel := range fs.aliases {
+		if inPrefix(p, in.Prefix) {
+			resp.Alias = append(resp.Alias, &apb.PublishedAlias{Path: p, Select: sel})
+		}
+	}
+	sort.Slice(resp.Alias, func(i, j int) bool { return resp.Alias[i].Path < resp.Alias[j].Path })
+	return resp, nil
+}
+
+// aliasState returns a server independent representation of the aliases published.
+func (fs *fakeStore) aliasState() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	result := []string{}
+	for p, sel := range fs.aliases {
+		selected := fmt.Sprintf("path %s arch %q tags %v", sel.Path, sel.Architecture, sel.Tag.GetTag())
+		if sel.Uid != "" {
+			fa := fs.find(sel.Uid)
+			selected = fmt.Sprintf("uid of %s %s %x", fa.path, fa.art.Architecture, fa.art.MD5)
+		}
+		result = append(result, p+" -> "+selected)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// state returns a server independent representation of the content of the store.
+func (fs *fakeStore) state(prefix string) []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	result := []string{}
+	for _, fa := range fs.artifacts {
+		if !strings.HasPrefix(fa.path, prefix) {
+			continue
+		}
+		tags := append([]string{}, fa.art.Tag...)
+		result = append(result, fmt.Sprintf("%s %s %x %q %v", path.Clean(fa.path), fa.art.Architecture, fa.art.MD5, fa.art.Note, sortedTags(tags)))
+	}
+	return result
+}
+
+func sortedTags(tags []string) []string {
+	for i := range tags {
+		for j := i + 1; j < len(tags); j++ {
+			if tags[j] < tags[i] {
+				tags[i], tags[j] = tags[j], tags[i]
+			}
+		}
+	}
+	return tags
+}
+
+func mirrorOptions() MirrorOptions {
+	return MirrorOptions{
+		Context:     &ccontext.Context{Logger: logger.Nil},
+		Parallelism: 3,
+	}
+}
+
+func TestMirrorConverges(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+
+	src.add("tools/a/bin", "amd64-linux", "version 1", "first")
+	src.add("tools/a/bin", "amd64-linux", "version 2", "second", "latest", "stable")
+	src.add("tools/b/bin", "all", "b content", "")
+	src.add("other/c", "all", "not mirrored", "", "latest")
+
+	// Already present on the destination, but with different metadata.
+	dst.add("tools/b/bin", "all", "b content", "stale note", "old")
+
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), withPrefix(mirrorOptions(), "tools"))
+	assert.NoError(t, err)
+	copies, failed := report.Count(MirrorCopy)
+	assert.Equal(t, 2, copies)
+	assert.Equal(t, 0, failed)
+	updates, _ := report.Count(MirrorUpdate)
+	assert.Equal(t, 1, updates)
+
+	assert.ElementsMatch(t, src.state("tools"), dst.state("tools"))
+	assert.Empty(t, dst.state("other"))
+
+	// Running it again is a noop.
+	report, err = New(nil).withClient(src).Mirror(New(nil).withClient(dst), withPrefix(mirrorOptions(), "tools"))
+	assert.NoError(t, err)
+	assert.Empty(t, report.Entries)
+	assert.Equal(t, 3, report.Unchanged)
+}
+
+func TestMirrorPaginated(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+	src.pageSize, dst.pageSize = 1, 1
+
+	src.add("tools/a/bin", "amd64-linux", "version 1", "first")
+	src.add("tools/a/bin", "amd64-linux", "version 2", "second", "latest")
+	src.add("tools/b/bin", "all", "b content", "")
+	src.add("tools/c/bin", "all", "c content", "")
+	dst.add("tools/a/bin", "amd64-linux", "version 1", "stale note")
+
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), withPrefix(mirrorOptions(), "tools"))
+	assert.NoError(t, err)
+	copies, _ := report.Count(MirrorCopy)
+	assert.Equal(t, 3, copies)
+	updates, _ := report.Count(MirrorUpdate)
+	assert.Equal(t, 1, updates)
+	assert.ElementsMatch(t, src.state("tools"), dst.state("tools"))
+
+	// List retrieves all the pages, ListPage only one.
+	client := New(nil).withClient(src)
+	arts, els, err := client.List("tools/a/bin", ListOptions{Tag: []string{}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(arts))
+	assert.Equal(t, 0, len(els))
+
+	resp, err := client.ListPage("tools", ListOptions{Tag: []string{}})
+	assert.NoError(t, err)
+	assert.True(t, resp.Truncated)
+	assert.Equal(t, 1, len(resp.Element))
+	resp, err = client.ListPage("tools", ListOptions{Tag: []string{}, PageToken: resp.NextPageToken})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(resp.Element))
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+
+	src.add("tools/a", "all", "a", "", "latest")
+	src.add("tools/b", "all", "b", "new note", "latest")
+	dst.add("tools/b", "all", "b", "old note", "latest")
+	dst.add("tools/c", "all", "c", "", "latest")
+
+	before := dst.state("")
+	options := mirrorOptions()
+	options.DryRun = true
+	options.DeleteExtraneous = true
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, before, dst.state(""))
+
+	planned := map[MirrorAction][]string{}
+	for _, e := range report.Entries {
+		planned[e.Action] = append(planned[e.Action], e.Path)
+	}
+	assert.Equal(t, []string{"tools/a"}, planned[MirrorCopy])
+	assert.Equal(t, []string{"tools/b"}, planned[MirrorUpdate])
+	assert.Equal(t, []string{"tools/c"}, planned[MirrorDelete])
+
+	// The real run must do exactly what the dry run announced.
+	options.DryRun = false
+	real, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	assert.Equal(t, len(report.Entries), len(real.Entries))
+	assert.ElementsMatch(t, src.state(""), dst.state(""))
+}
+
+func TestMirrorDeletionGating(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+
+	src.add("tools/a", "all", "a", "", "latest")
+	extra := dst.add("tools/extra", "all", "extra", "", "latest")
+
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), mirrorOptions())
+	assert.NoError(t, err)
+	deletes, _ := report.Count(MirrorDelete)
+	assert.Equal(t, 0, deletes)
+	assert.Empty(t, dst.deleted)
+	assert.Equal(t, 2, len(dst.state("")))
+
+	options := mirrorOptions()
+	options.DeleteExtraneous = true
+	report, err = New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	deletes, _ = report.Count(MirrorDelete)
+	assert.Equal(t, 1, deletes)
+	assert.Equal(t, []string{extra}, dst.deleted)
+	assert.ElementsMatch(t, src.state(""), dst.state(""))
+}
+
+func TestMirrorPartialFailureRetry(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+
+	src.add("tools/a", "all", "a", "", "latest")
+	broken := src.add("tools/b", "all", "b", "", "latest")
+
+	// Corrupt the blob so the integrity check fails.
+	src.lock.Lock()
+	src.blobs[src.find(broken).art.Sid] = []byte("corrupted")
+	src.lock.Unlock()
+
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), mirrorOptions())
+	assert.Error(t, err)
+	copies, failed := report.Count(MirrorCopy)
+	assert.Equal(t, 2, copies)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, 1, len(dst.state("")))
+
+	src.lock.Lock()
+	src.blobs[src.find(broken).art.Sid] = []byte("b")
+	src.lock.Unlock()
+
+	report, err = New(nil).withClient(src).Mirror(New(nil).withClient(dst), mirrorOptions())
+	assert.NoError(t, err)
+	copies, _ = report.Count(MirrorCopy)
+	assert.Equal(t, 1, copies)
+	assert.ElementsMatch(t, src.state(""), dst.state(""))
+}
+
+func (c *Client) withClient(client apb.AstoreClient) *Client {
+	c.client = client
+	return c
+}
+
+func withPrefix(o MirrorOptions, prefix string) MirrorOptions {
+	o.Prefix = prefix
+	return o
+}
+
+func TestMirrorRateLimited(t *testing.T) {
+	defer func(delay time.Duration) { DefaultRateLimitDelay = delay }(DefaultRateLimitDelay)
+	DefaultRateLimitDelay = 10 * time.Millisecond
+
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+	dst.maxUploads = 2
+
+	for ix := 0; ix < 16; ix++ {
+		src.add(fmt.Sprintf("tools/%02d", ix), "all", fmt.Sprintf("content %d", ix), "", "latest")
+	}
+
+	options := mirrorOptions()
+	options.Parallelism = 8
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	copies, failed := report.Count(MirrorCopy)
+	assert.Equal(t, 16, copies)
+	assert.Equal(t, 0, failed)
+	assert.ElementsMatch(t, src.state(""), dst.state(""))
+
+	// The parallelism was reduced, and every rate limited request was retried.
+	assert.Equal(t, dst.throttled, report.Throttled)
+	assert.True(t, report.Throttled > 0)
+	assert.True(t, report.MinParallelism >= 1 && report.MinParallelism <= 2, "%d", report.MinParallelism)
+}
+
+func TestMirrorRateLimitedGivesUp(t *testing.T) {
+	defer func(delay time.Duration) { DefaultRateLimitDelay = delay }(DefaultRateLimitDelay)
+	DefaultRateLimitDelay = time.Millisecond
+
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+	// All uploads are rate limited.
+	dst.maxUploads = 1
+	dst.uploads = 1
+
+	src.add("tools/a", "all", "a", "", "latest")
+	options := mirrorOptions()
+	options.RateLimitRetries = 3
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.Error(t, err)
+	_, failed := report.Count(MirrorCopy)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, 4, report.Throttled)
+	assert.Equal(t, 1, report.MinParallelism)
+
+	var rle *RateLimitError
+	assert.True(t, errors.As(report.Entries[0].Err, &rle), "%v", report.Entries[0].Err)
+}
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	requests int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestMirrorHTTPClient(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+
+	src.add("tools/a", "all", "a", "", "latest")
+	src.add("tools/b", "all", "b", "", "latest")
+
+	transport := &countingTransport{}
+	options := mirrorOptions()
+	options.HTTP = &http.Client{Transport: transport}
+	_, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, src.state(""), dst.state(""))
+
+	// Each artifact is downloaded and uploaded through the client configured.
+	assert.Equal(t, int32(4), atomic.LoadInt32(&transport.requests))
+}
+
+func TestMirrorAliases(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+
+	first := src.add("tools/a", "all", "a version 1", "")
+	src.add("tools/a", "all", "a version 2", "", "latest", "stable")
+	src.add("other/b", "all", "b", "", "latest")
+	for p, sel := range map[string]*apb.ListRequest{
+		"a-stable": {Path: "tools/a", Tag: &apb.TagSet{Tag: []string{"stable"}}},
+		"a-first":  {Uid: first},
+		"b":        {Path: "other/b"},
+	} {
+		_, err := src.Publish(context.Background(), &apb.PublishRequest{Path: p, Select: sel})
+		assert.NoError(t, err)
+	}
+	for p, sel := range map[string]*apb.ListRequest{
+		"a-stable":  {Path: "tools/a", Tag: &apb.TagSet{Tag: []string{"latest"}}},
+		"a-removed": {Path: "tools/removed"},
+		"unrelated": {Path: "other/c"},
+	} {
+		_, err := dst.Publish(context.Background(), &apb.PublishRequest{Path: p, Select: sel})
+		assert.NoError(t, err)
+	}
+
+	options := withPrefix(mirrorOptions(), "tools")
+	options.DeleteExtraneous = true
+	options.DryRun = true
+	before := dst.aliasState()
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	assert.Equal(t, before, dst.aliasState())
+	planned := map[MirrorAction][]string{}
+	for _, e := range report.Entries {
+		planned[e.Action] = append(planned[e.Action], e.Path)
+	}
+	assert.ElementsMatch(t, []string{"a-first", "a-stable"}, planned[MirrorPublish])
+	assert.Equal(t, []string{"a-removed"}, planned[MirrorUnpublish])
+
+	options.DryRun = false
+	report, err = New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	published, _ := report.Count(MirrorPublish)
+	assert.Equal(t, 2, published)
+	unpublished, _ := report.Count(MirrorUnpublish)
+	assert.Equal(t, 1, unpublished)
+
+	// The alias selecting an uid selects the copy of the artifact, aliases
+	// selecting artifacts outside of the prefix are left alone.
+	assert.Equal(t, []string{
+		"a-first -> uid of tools/a all " + fmt.Sprintf("%x", md5.Sum([]byte("a version 1"))),
+		`a-stable -> path tools/a arch "" tags [stable]`,
+		`unrelated -> path other/c arch "" tags []`,
+	}, dst.aliasState())
+	assert.NotEqual(t, first, dst.aliases["a-first"].Uid)
+
+	// Running it again is a noop.
+	report, err = New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Entries)
+}
+
+func TestMirrorAliasesUnsupported(t *testing.T) {
+	src, dst := newFakeStore(), newFakeStore()
+	defer src.web.Close()
+	defer dst.web.Close()
+	dst.noListAliases = true
+
+	src.add("tools/a", "all", "a", "", "latest")
+	dst.add("tools/extra", "all", "extra", "", "latest")
+
+	options := mirrorOptions()
+	options.DeleteExtraneous = true
+	report, err := New(nil).withClient(src).Mirror(New(nil).withClient(dst), options)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "aliases were not mirrored")
+
+	// Artifacts are mirrored nonetheless.
+	assert.NoError(t, report.Err())
+	assert.ElementsMatch(t, src.state(""), dst.state(""))
+}
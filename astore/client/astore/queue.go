@@ -0,0 +1,186 @@
+package astore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/flock"
+)
+
+const (
+	// QueueName is the name of the file storing the queued uploads.
+	QueueName     = "upload-queue.json"
+	queueLockName = "upload-queue.lock"
+)
+
+// QueuedUpload is an upload recorded in a Queue, to be performed later.
+type QueuedUpload struct {
+	FileToUpload
+
+	// SHA256 of the file at the time it was queued, hex encoded.
+	SHA256 string
+	Queued time.Time
+}
+
+// Queue records uploads to perform once the server can be reached, like on a machine without network.
+//
+// The queue is stored as a json file in a directory, generally the astore
+// config directory. Concurrent invocations are serialized with a lock file
+// in the same directory.
+type Queue struct {
+	dir string
+}
+
+func OpenQueue(dir string) *Queue {
+	return &Queue{dir: dir}
+}
+
+// lock blocks until no other process is using the queue. The returned function releases the lock.
+func (q *Queue) lock() (func(), error) {
+	if err := os.MkdirAll(q.dir, 0770); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(q.dir, queueLockName), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock.Lock(f, flock.Exclusive, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock the upload queue in %s - %w", q.dir, err)
+	}
+	return func() {
+		flock.Unlock(f)
+		f.Close()
+	}, nil
+}
+
+func (q *Queue) read() ([]QueuedUpload, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, QueueName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []QueuedUpload
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: invalid upload queue - %w", filepath.Join(q.dir, QueueName), err)
+	}
+	return entries, nil
+}
+
+// write atomically replaces the queue with entries. An empty queue is removed.
+func (q *Queue) write(entries []QueuedUpload) error {
+	path := filepath.Join(q.dir, QueueName)
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
+
+// Add records the files in the queue, together with their current SHA256.
+//
+// Local paths are made absolute, so the queue can be flushed from any directory.
+func (q *Queue) Add(files []FileToUpload, now time.Time) ([]QueuedUpload, error) {
+	added := []QueuedUpload{}
+	for _, file := range files {
+		local, err := filepath.Abs(file.Local)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := SHA256File(local)
+		if err != nil {
+			return nil, fmt.Errorf("cannot queue %s - %w", file.Local, err)
+		}
+		file.Local = local
+		added = append(added, QueuedUpload{FileToUpload: file, SHA256: digest, Queued: now})
+	}
+
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := q.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := q.write(append(entries, added...)); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// List returns the uploads in the queue, in the order they were queued.
+func (q *Queue) List() ([]QueuedUpload, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return q.read()
+}
+
+// Flush uploads the queued files with c, removing each from the queue once uploaded.
+//
+// Files that changed or were removed since they were queued are not uploaded:
+// a warning is logged, and they are dropped from the queue. Those files are
+// returned as skipped.
+//
+// Flush stops at the first failed upload, leaving the file and all the ones
+// queued after it in the queue, for the next attempt.
+func (q *Queue) Flush(c *Client, o UploadOptions) ([]*apb.Artifact, []QueuedUpload, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	entries, err := q.read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	artifacts := []*apb.Artifact{}
+	skipped := []QueuedUpload{}
+	for len(entries) > 0 {
+		entry := entries[0]
+
+		digest, err := SHA256File(entry.Local)
+		switch {
+		case err != nil:
+			o.Logger.Warnf("skipping %s, queued %s as %s - cannot be read - %s", entry.Local, entry.Queued.Format(time.RFC3339), entry.Remote, err)
+			skipped = append(skipped, entry)
+		case digest != entry.SHA256:
+			o.Logger.Warnf("skipping %s, queued %s as %s - changed since it was queued: sha256 was %s, now %s", entry.Local, entry.Queued.Format(time.RFC3339), entry.Remote, entry.SHA256, digest)
+			skipped = append(skipped, entry)
+		default:
+			arts, err := c.Upload([]FileToUpload{entry.FileToUpload}, o)
+			artifacts = append(artifacts, arts...)
+			if err != nil {
+				return artifacts, skipped, fmt.Errorf("uploading %s - %w - %d uploads left in the queue", entry.Local, err, len(entries))
+			}
+		}
+
+		entries = entries[1:]
+		if err := q.write(entries); err != nil {
+			return artifacts, skipped, err
+		}
+	}
+	return artifacts, skipped, nil
+}
@@ -0,0 +1,102 @@
+package astore
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/client/ccontext"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/progress"
+	"github.com/stretchr/testify/assert"
+)
+
+func uploadOptions() UploadOptions {
+	return UploadOptions{
+		Context: &ccontext.Context{Logger: logger.Nil, Progress: progress.NewDiscard},
+	}
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestQueueFlush(t *testing.T) {
+	store := newFakeStore()
+	defer store.web.Close()
+
+	data, config := t.TempDir(), t.TempDir()
+	for name, content := range map[string]string{"a.log": "log a", "b.log": "log b", "c.log": "log c"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0644))
+	}
+
+	queue := OpenQueue(config)
+	now := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	added, err := queue.Add([]FileToUpload{
+		{Local: filepath.Join(data, "a.log"), Remote: "logs/a.log", Architecture: []string{"all"}, Tag: []string{"field"}},
+		{Local: filepath.Join(data, "b.log"), Remote: "logs/b.log", Note: "changed later"},
+	}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(added))
+	assert.Equal(t, sha256Hex("log a"), added[0].SHA256)
+
+	// Files queued by a second invocation are appended.
+	_, err = queue.Add([]FileToUpload{{Local: filepath.Join(data, "c.log"), Remote: "logs/c.log"}}, now)
+	assert.NoError(t, err)
+
+	// Files that cannot be read are not queued.
+	_, err = queue.Add([]FileToUpload{{Local: filepath.Join(data, "missing.log"), Remote: "logs/missing.log"}}, now)
+	assert.Error(t, err)
+
+	entries, err := queue.List()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "logs/c.log", entries[2].Remote)
+
+	// Mutate a file after it was queued, it must be skipped.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(data, "b.log"), []byte("log b, modified"), 0644))
+
+	arts, skipped, err := queue.Flush(New(nil).withClient(store), uploadOptions())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(arts))
+	assert.Equal(t, 1, len(skipped))
+	assert.Equal(t, "logs/b.log", skipped[0].Remote)
+
+	assert.ElementsMatch(t, []string{
+		`logs/a.log all ` + md5Hex("log a") + ` "" [field latest]`,
+		`logs/c.log all ` + md5Hex("log c") + ` "" [latest]`,
+	}, store.state("logs"))
+
+	// The queue is removed once empty.
+	entries, err = queue.List()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+	_, err = os.Stat(filepath.Join(config, QueueName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestQueueConcurrentAdd(t *testing.T) {
+	data, config := t.TempDir(), t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(data, "file"), []byte("content"), 0644))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := OpenQueue(config).Add([]FileToUpload{{Local: filepath.Join(data, "file"), Remote: "file"}}, time.Now())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	entries, err := OpenQueue(config).List()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(entries))
+}
@@ -0,0 +1,59 @@
+package astore
+
+import (
+	"context"
+	"time"
+
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/client/ccontext"
+)
+
+type SearchOptions struct {
+	*ccontext.Context
+
+	// Glob matched against the full path of the artifacts, as per path.Match.
+	PathGlob string
+	// Artifacts must have all the tags.
+	Tag []string
+	// Substring of the note, case insensitive.
+	Note string
+	// Exact user that uploaded the artifacts.
+	Creator string
+	// Zero to not limit the time range.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Maximum number of results to return in a page, 0 to use the server default.
+	MaxResults int32
+	// Page to start searching from, the NextPageToken of a previous Search.
+	PageToken string
+}
+
+// Search returns a single page of artifacts matching all the options, most recent first.
+//
+// If the server had more results, or stopped before examining all the artifacts,
+// the response is Truncated, and its NextPageToken can be passed in SearchOptions
+// to retrieve the rest.
+func (c *Client) Search(o SearchOptions) (*astore.SearchResponse, error) {
+	req := &astore.SearchRequest{
+		PathGlob:   o.PathGlob,
+		Tag:        o.Tag,
+		Note:       o.Note,
+		Creator:    o.Creator,
+		MaxResults: o.MaxResults,
+		PageToken:  o.PageToken,
+	}
+	if !o.CreatedAfter.IsZero() {
+		req.CreatedAfter = o.CreatedAfter.UnixNano()
+	}
+	if !o.CreatedBefore.IsZero() {
+		req.CreatedBefore = o.CreatedBefore.UnixNano()
+	}
+
+	resp, err := c.client.Search(context.TODO(), req)
+	if err != nil {
+		return nil, client.NiceError(err, "search command failed - %s", err)
+	}
+	return resp, nil
+}
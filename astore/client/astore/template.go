@@ -0,0 +1,159 @@
+package astore
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/System233/enkit/lib/kflags"
+)
+
+// Variables guessed from the local file to upload, available in remote templates.
+const (
+	// Name of the file, like "tool-1.2.3-linux-amd64.tar.gz".
+	VarFile = "file"
+	// Name of the file without version and extension, like "tool".
+	VarName = "name"
+	// Extension of the file, like ".tar.gz".
+	VarExt = "ext"
+	// Version guessed from the name of the file, like "1.2.3".
+	VarVersion = "version"
+	// Operating system and cpu, guessed by GuessArchOS or specified with --arch.
+	VarOs   = "os"
+	VarArch = "arch"
+)
+
+var versionRe = regexp.MustCompile(`(^|[-_.])v?([0-9]+(\.[0-9]+)+)`)
+
+// Extensions have at least a letter, so versions like "1.2" are not extensions.
+var extRe = regexp.MustCompile(`^\.[0-9]*[A-Za-z][A-Za-z0-9]*$`)
+
+var templateVarRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// SplitExt returns the name of a file without extension, and its extension.
+//
+// Compressed tarballs keep their double extension, like ".tar.gz", while
+// numeric extensions are considered part of a version, and not returned.
+func SplitExt(base string) (string, string) {
+	ext := filepath.Ext(base)
+	if !extRe.MatchString(ext) {
+		return base, ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	if filepath.Ext(stem) == ".tar" {
+		ext = ".tar" + ext
+		stem = strings.TrimSuffix(stem, ".tar")
+	}
+	return stem, ext
+}
+
+// GuessVersion returns the version in the name of a file, and the name without it.
+//
+// For example, "tool-v1.2.3-linux" returns "1.2.3" and "tool". If no version
+// is found, the version is empty, and the name is returned unchanged.
+func GuessVersion(name string) (string, string) {
+	match := versionRe.FindStringSubmatchIndex(name)
+	if match == nil {
+		return "", name
+	}
+	version := name[match[4]:match[5]]
+	if match[0] == 0 {
+		// The name is just a version, like "v1.2.3".
+		return version, name
+	}
+	return version, name[:match[0]]
+}
+
+// ParseArch parses an architecture in the cpu-os format used by --arch, like "amd64-linux".
+func ParseArch(arch string) (Arch, bool) {
+	cpu, os, found := strings.Cut(arch, "-")
+	if !found || cpu == "" || os == "" {
+		return Arch{}, false
+	}
+	return Arch{Cpu: cpu, Os: os}, true
+}
+
+// RemoteVars returns the variables available to expand options.Template for
+// the local file name.
+//
+// The variables are guessed from the name and content of the file, see the
+// Var constants, and can be added to or overridden with options.Vars.
+// The os and arch variables are only defined if a single architecture was
+// specified or guessed.
+func RemoteVars(name string, options SuggestOptions) (map[string]string, error) {
+	base := filepath.Base(name)
+	stem, ext := SplitExt(base)
+	version, short := GuessVersion(stem)
+
+	vars := map[string]string{
+		VarFile: base,
+		VarName: short,
+		VarExt:  ext,
+	}
+	if version != "" {
+		vars[VarVersion] = version
+	}
+
+	var archs []Arch
+	if options.Arch != "" {
+		if arch, ok := ParseArch(options.Arch); ok {
+			archs = []Arch{arch}
+		}
+	} else {
+		archs, _ = GuessArchOS(name)
+	}
+	if len(archs) == 1 {
+		vars[VarOs] = archs[0].Os
+		vars[VarArch] = archs[0].Cpu
+	}
+
+	for _, kv := range options.Vars {
+		key, value, found := strings.Cut(kv, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, kflags.NewUsageErrorf("invalid --var %q - must be in the form key=value", kv)
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
+// ExpandRemote replaces each {variable} in template with its value in vars.
+//
+// If any of the variables is not defined, an error listing all the missing
+// ones is returned.
+func ExpandRemote(template string, vars map[string]string) (string, error) {
+	missing := map[string]struct{}{}
+	expanded := templateVarRe.ReplaceAllStringFunc(template, func(match string) string {
+		key := strings.TrimSpace(match[1 : len(match)-1])
+		value, found := vars[key]
+		if !found {
+			missing[key] = struct{}{}
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		keys := make([]string, 0, len(missing))
+		for key := range missing {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return "", kflags.NewUsageErrorf("remote template %q uses undefined variables: %s - define them with --var, like --var %s=... (defined: %s)", template, strings.Join(keys, ", "), keys[0], FormatVars(vars))
+	}
+	if strings.ContainsAny(expanded, "{}") {
+		return "", kflags.NewUsageErrorf("remote template %q has unbalanced braces - variables must be in the form {name}", template)
+	}
+	return expanded, nil
+}
+
+// FormatVars returns the vars as a sorted list of key=value.
+func FormatVars(vars map[string]string) string {
+	kvs := make([]string, 0, len(vars))
+	for key, value := range vars {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, " ")
+}
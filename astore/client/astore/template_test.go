@@ -0,0 +1,84 @@
+package astore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuessVersion(t *testing.T) {
+	for name, expected := range map[string][2]string{
+		"tool-1.2.3-linux-amd64.tar.gz": {"1.2.3", "tool"},
+		"tool_v2.0.zip":                 {"2.0", "tool"},
+		"tool":                          {"", "tool"},
+		"python3.11-tool":               {"", "python3.11-tool"},
+		"v1.4.0":                        {"1.4.0", "v1.4.0"},
+	} {
+		stem, _ := SplitExt(name)
+		version, short := GuessVersion(stem)
+		assert.Equal(t, expected, [2]string{version, short}, "%s", name)
+	}
+}
+
+func TestSplitExt(t *testing.T) {
+	for name, expected := range map[string][2]string{
+		"tool.tar.gz":  {"tool", ".tar.gz"},
+		"tool.exe":     {"tool", ".exe"},
+		"tool":         {"tool", ""},
+		"tool-1.2":     {"tool-1.2", ""},
+		"tool-1.2.deb": {"tool-1.2", ".deb"},
+	} {
+		stem, ext := SplitExt(name)
+		assert.Equal(t, expected, [2]string{stem, ext}, "%s", name)
+	}
+}
+
+func TestRemoteTemplate(t *testing.T) {
+	options := SuggestOptions{
+		Template: "infra/tools/{name}/{version}/{os}-{arch}/{file}",
+		Arch:     "amd64-linux",
+	}
+	local, remote, err := SuggestRemote("bin/fetch-1.2.0-linux.tar.gz", options)
+	assert.NoError(t, err)
+	assert.Equal(t, "bin/fetch-1.2.0-linux.tar.gz", local)
+	assert.Equal(t, "infra/tools/fetch/1.2.0/linux-amd64/fetch-1.2.0-linux.tar.gz", remote)
+
+	// User variables override the guessed ones, and can be added.
+	options.Template = "{team}/{name}/{version}{ext}"
+	options.Vars = []string{"version=2.0", "team=infra"}
+	_, remote, err = SuggestRemote("fetch-1.2.0.tar.gz", options)
+	assert.NoError(t, err)
+	assert.Equal(t, "infra/fetch/2.0.tar.gz", remote)
+
+	// Explicit remotes take precedence over the template.
+	_, remote, err = SuggestRemote("fetch@tools/fetch", options)
+	assert.NoError(t, err)
+	assert.Equal(t, "tools/fetch", remote)
+	options.Directory = "tools"
+	_, remote, err = SuggestRemote("fetch", options)
+	assert.NoError(t, err)
+	assert.Equal(t, "tools/fetch", remote)
+}
+
+func TestRemoteTemplateErrors(t *testing.T) {
+	var ue *kflags.UsageError
+
+	// Not a binary, and no --arch: os and arch are not defined.
+	_, _, err := SuggestRemote("README-1.0", SuggestOptions{Template: "docs/{name}/{ os }/{arch}/{team}/{file}"})
+	assert.True(t, errors.As(err, &ue))
+	assert.Contains(t, err.Error(), "undefined variables: arch, os, team")
+
+	_, err = ExpandRemote("docs/{name", map[string]string{"name": "readme"})
+	assert.True(t, errors.As(err, &ue))
+
+	_, err = RemoteVars("README", SuggestOptions{Vars: []string{"team"}})
+	assert.True(t, errors.As(err, &ue))
+	_, err = RemoteVars("README", SuggestOptions{Vars: []string{"=infra"}})
+	assert.True(t, errors.As(err, &ue))
+
+	expanded, err := ExpandRemote("docs/{name}/", map[string]string{"name": "readme"})
+	assert.NoError(t, err)
+	assert.Equal(t, "docs/readme/", expanded)
+}
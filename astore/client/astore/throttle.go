@@ -0,0 +1,181 @@
+package astore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRateLimitDelay is how long to wait before retrying a request rate limited
+// by a server that did not indicate for how long, with a Retry-After header.
+var DefaultRateLimitDelay = time.Second
+
+// DefaultRateLimitRetries is the number of times a rate limited operation is retried, unless configured otherwise.
+const DefaultRateLimitRetries = 10
+
+// RateLimitError is returned when the server, or its storage backend, rejected a request as rate limited.
+type RateLimitError struct {
+	// How long the server asked to wait before retrying, 0 if not indicated.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited, retry after %s - %s", e.RetryAfter, e.Err)
+	}
+	return fmt.Sprintf("rate limited - %s", e.Err)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter returns the delay indicated by the value of a Retry-After header,
+// either a number of seconds or an http date, or 0 if invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	when, err := http.ParseTime(value)
+	if err != nil || !when.After(now) {
+		return 0
+	}
+	return when.Sub(now)
+}
+
+// httpRateLimited returns a RateLimitError wrapping err if resp indicates the request was rate limited, err otherwise.
+func httpRateLimited(resp *http.Response, err error) error {
+	retryAfter := resp.Header.Get("Retry-After")
+	if resp.StatusCode != http.StatusTooManyRequests && (resp.StatusCode != http.StatusServiceUnavailable || retryAfter == "") {
+		return err
+	}
+	return &RateLimitError{RetryAfter: parseRetryAfter(retryAfter, time.Now()), Err: err}
+}
+
+// grpcRateLimited returns a RateLimitError wrapping nice if the rpc error orig is ResourceExhausted, nice otherwise.
+//
+// nice is generally the result of client.NiceError(orig, ...), which does not preserve
+// the original error.
+func grpcRateLimited(orig, nice error) error {
+	if status.Code(orig) != codes.ResourceExhausted {
+		return nice
+	}
+	return &RateLimitError{Err: nice}
+}
+
+// pacer limits the number of operations running in parallel, adapting to rate limit signals.
+//
+// The limit is increased by one every time as many operations as the limit
+// complete successfully (additive increase), and halved when an operation is
+// rate limited (multiplicative decrease). The limit is never lower than 1, so
+// progress is always possible, or higher than the maximum configured.
+type pacer struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	max     int
+	limit   float64
+	running int
+
+	// No operation is started before this time, as requested by the server.
+	pause time.Time
+	// When the limit was last decreased. Rate limit errors of operations
+	// started before then don't decrease it further, they were part of the same burst.
+	decreased time.Time
+
+	throttled int
+	lowest    int
+}
+
+func newPacer(max int) *pacer {
+	if max <= 0 {
+		max = 1
+	}
+	p := &pacer{max: max, limit: float64(max), lowest: max}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// Acquire waits until a new operation can be started, returning the time it was started.
+func (p *pacer) Acquire() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		if p.running >= int(p.limit) {
+			p.cond.Wait()
+			continue
+		}
+		if wait := time.Until(p.pause); wait > 0 {
+			p.lock.Unlock()
+			time.Sleep(wait)
+			p.lock.Lock()
+			continue
+		}
+		break
+	}
+	p.running++
+	return time.Now()
+}
+
+// Release records the outcome of an operation started at the time returned by Acquire.
+//
+// Returns true if the operation was rate limited, and should be retried.
+func (p *pacer) Release(started time.Time, err error) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	defer p.cond.Broadcast()
+	p.running--
+
+	var rle *RateLimitError
+	if !errors.As(err, &rle) {
+		if err == nil && p.limit < float64(p.max) {
+			p.limit += 1 / p.limit
+			if p.limit > float64(p.max) {
+				p.limit = float64(p.max)
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	p.throttled++
+	if !started.Before(p.decreased) {
+		p.limit = p.limit / 2
+		if p.limit < 1 {
+			p.limit = 1
+		}
+		p.decreased = now
+		if int(p.limit) < p.lowest {
+			p.lowest = int(p.limit)
+		}
+	}
+
+	delay := rle.RetryAfter
+	if delay <= 0 {
+		delay = DefaultRateLimitDelay
+	}
+	if until := now.Add(delay); until.After(p.pause) {
+		p.pause = until
+	}
+	return true
+}
+
+// Stats returns the number of rate limited operations, and the lowest limit reached.
+func (p *pacer) Stats() (throttled, lowest int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.throttled, p.lowest
+}
@@ -0,0 +1,119 @@
+package astore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-3", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Thu, 04 Mar 2021 10:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Thu, 04 Mar 2021 09:59:00 GMT", now))
+}
+
+func TestRateLimitErrors(t *testing.T) {
+	err := fmt.Errorf("upload failed")
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"5"}}}
+	var rle *RateLimitError
+	assert.True(t, errors.As(httpRateLimited(resp, err), &rle))
+	assert.Equal(t, 5*time.Second, rle.RetryAfter)
+	assert.True(t, errors.Is(rle, err))
+
+	// 503 is a rate limit signal only with a Retry-After.
+	resp = &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	assert.Equal(t, err, httpRateLimited(resp, err))
+	resp.Header.Set("Retry-After", "1")
+	assert.True(t, errors.As(httpRateLimited(resp, err), &rle))
+
+	resp = &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}}
+	assert.Equal(t, err, httpRateLimited(resp, err))
+
+	assert.True(t, errors.As(grpcRateLimited(status.Errorf(codes.ResourceExhausted, "quota"), err), &rle))
+	assert.Equal(t, err, grpcRateLimited(status.Errorf(codes.Internal, "boom"), err))
+}
+
+func TestPacer(t *testing.T) {
+	defer func(delay time.Duration) { DefaultRateLimitDelay = delay }(DefaultRateLimitDelay)
+	DefaultRateLimitDelay = 20 * time.Millisecond
+
+	p := newPacer(8)
+	var starts []time.Time
+	for ix := 0; ix < 8; ix++ {
+		starts = append(starts, p.Acquire())
+	}
+
+	// A burst of rate limit errors halves the limit only once.
+	throttled := &RateLimitError{Err: fmt.Errorf("slow down")}
+	for ix := 0; ix < 4; ix++ {
+		assert.True(t, p.Release(starts[ix], throttled))
+	}
+	assert.Equal(t, 4.0, p.limit)
+
+	// New operations wait for the delay requested, and for the number running to be below the limit.
+	for ix := 4; ix < 8; ix++ {
+		assert.False(t, p.Release(starts[ix], nil))
+	}
+	start := time.Now()
+	started := p.Acquire()
+	assert.True(t, time.Since(start) >= 10*time.Millisecond, "%s", time.Since(start))
+
+	// Operations started after the decrease decrease the limit further, never below 1.
+	for ix := 0; ix < 4; ix++ {
+		p.Release(started, &RateLimitError{RetryAfter: time.Millisecond, Err: throttled})
+		started = p.Acquire()
+	}
+	assert.Equal(t, 1.0, p.limit)
+	p.Release(started, nil)
+
+	// Successes increase the limit again, up to the maximum.
+	for ix := 0; ix < 100; ix++ {
+		p.Release(p.Acquire(), nil)
+	}
+	assert.Equal(t, 8.0, p.limit)
+
+	count, lowest := p.Stats()
+	assert.Equal(t, 8, count)
+	assert.Equal(t, 1, lowest)
+}
+
+func TestPacerLimitsParallelism(t *testing.T) {
+	p := newPacer(3)
+	var lock sync.Mutex
+	running, max := 0, 0
+
+	var wg sync.WaitGroup
+	for ix := 0; ix < 20; ix++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := p.Acquire()
+			lock.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			lock.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+			p.Release(started, nil)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, max)
+}
@@ -0,0 +1,167 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/System233/enkit/astore/retention"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// DefaultGCReportPath is where the GC report is looked up, unless specified otherwise.
+const DefaultGCReportPath = "astore/gc-report.json"
+
+func NewAdmin(root *Root) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "admin",
+		Short: "Commands to administer the artifact store",
+	}
+	command.AddCommand(NewGCReport(root).Command)
+	return command
+}
+
+type GCReport struct {
+	*cobra.Command
+	root *Root
+
+	File       string
+	Candidates int
+}
+
+func NewGCReport(root *Root) *GCReport {
+	command := &GCReport{
+		Command: &cobra.Command{
+			Use:   "gc-report [PATH]",
+			Short: "Summarizes the latest report of the artifacts the retention rules would collect",
+			Example: `  $ astore admin gc-report
+    Shows, for each retention rule, how many artifacts would be collected, and how much space reclaimed.
+    The report is fetched from ` + DefaultGCReportPath + `, where the server stores it with --gc-report-path.
+
+  $ astore admin gc-report --candidates 50
+    Same as above, also showing the 50 largest artifacts that would be collected.
+
+  $ astore admin gc-report --file /var/lib/astore/gc-report.json
+    Summarizes a report written by the server with --gc-report-file.
+`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringVarP(&command.File, "file", "f", "", "Read the report from this local file, rather than from the store")
+	command.Flags().IntVarP(&command.Candidates, "candidates", "c", 10, "How many of the largest artifacts that would be collected to show")
+	return command
+}
+
+// GCReportOutput is the output of 'astore admin gc-report' with --format=json.
+type GCReportOutput struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	Summary  retention.Summary     `json:"summary"`
+	Prefixes []GCPrefixOutput      `json:"prefixes"`
+	Largest  []retention.Candidate `json:"largest"`
+}
+
+// GCPrefixOutput summarizes the candidates of a single retention rule.
+type GCPrefixOutput struct {
+	Rule       string `json:"rule"`
+	Prefix     string `json:"prefix"`
+	Artifacts  int    `json:"artifacts"`
+	Bytes      int64  `json:"bytes"`
+	Candidates int    `json:"candidates"`
+	Reclaim    int64  `json:"reclaim"`
+}
+
+// NewGCReportOutput summarizes report, listing its n largest candidates.
+func NewGCReportOutput(report *retention.Report, n int) *GCReportOutput {
+	output := &GCReportOutput{
+		Started:  report.Started,
+		Finished: report.Finished,
+		Summary:  report.Summary(),
+		Prefixes: []GCPrefixOutput{},
+		Largest:  report.Largest(n),
+	}
+	for _, prefix := range report.Prefixes {
+		output.Prefixes = append(output.Prefixes, GCPrefixOutput{
+			Rule:       prefix.Rule,
+			Prefix:     prefix.Prefix,
+			Artifacts:  prefix.Artifacts,
+			Bytes:      prefix.Bytes,
+			Candidates: len(prefix.Candidates),
+			Reclaim:    prefix.Reclaim,
+		})
+	}
+	return output
+}
+
+func (gc *GCReport) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore admin gc-report [PATH]' - with a single, optional, PATH argument (got %d arguments)", len(args))
+	}
+	if len(args) == 1 && gc.File != "" {
+		return kflags.NewUsageErrorf("cannot specify both a PATH and --file - the report is read from either the store or a local file")
+	}
+
+	report := &retention.Report{}
+	if gc.File != "" {
+		data, err := ioutil.ReadFile(gc.File)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, report); err != nil {
+			return fmt.Errorf("invalid GC report %s - %w", gc.File, err)
+		}
+	} else {
+		path := DefaultGCReportPath
+		if len(args) == 1 {
+			path = args[0]
+		}
+		client, err := gc.root.StoreClient()
+		if err != nil {
+			return err
+		}
+		if report, _, err = client.GCReport(path); err != nil {
+			return err
+		}
+	}
+
+	render := gc.root.Render
+	if !report.Complete() {
+		render.Infof("*** PARTIAL REPORT: the scan started at %s did not complete, totals are underestimated ***\n\n", report.Started.Format(time.RFC3339))
+	}
+	output := NewGCReportOutput(report, gc.Candidates)
+	return render.Render(output, func(w io.Writer) error {
+		fmt.Fprintf(w, "Report started %s, finished %s\n\n", output.Started.Format(time.RFC3339), output.Finished.Format(time.RFC3339))
+
+		table := render.Table("RULE", "PREFIX", "ARTIFACTS", "SIZE", "CANDIDATES", "RECLAIM")
+		for _, prefix := range output.Prefixes {
+			shown := prefix.Prefix
+			if shown == "" {
+				shown = "(all)"
+			}
+			table.Row(prefix.Rule, shown, prefix.Artifacts, humanize.Bytes(uint64(prefix.Bytes)), prefix.Candidates, humanize.Bytes(uint64(prefix.Reclaim)))
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+
+		summary := output.Summary
+		fmt.Fprintf(w, "\nTotal: %d of %d artifacts would be collected, reclaiming %s of %s (%.1f%%)\n",
+			summary.Candidates, summary.Artifacts, humanize.Bytes(uint64(summary.Reclaim)), humanize.Bytes(uint64(summary.Bytes)), summary.ReclaimPercent)
+		if len(output.Largest) == 0 {
+			return nil
+		}
+
+		fmt.Fprintf(w, "\nLargest candidates:\n")
+		table = render.Table("PATH", "ARCH", "UID", "CREATED", "SIZE", "RULE", "REASON")
+		for _, candidate := range output.Largest {
+			table.Row(candidate.Path, candidate.Architecture, candidate.Uid, candidate.Created.Format("2006-01-02"), humanize.Bytes(uint64(candidate.Size)), candidate.Rule, candidate.Reason)
+		}
+		return table.Flush()
+	})
+}
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+func NewChecksum(root *Root) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "checksum",
+		Short: "Commands to work with the checksum manifests written by 'download --write-checksums'",
+	}
+	command.AddCommand(NewChecksumVerify(root).Command)
+	return command
+}
+
+type ChecksumVerify struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewChecksumVerify(root *Root) *ChecksumVerify {
+	command := &ChecksumVerify{
+		Command: &cobra.Command{
+			Use:   "verify <manifest>...",
+			Short: "Verifies the files listed in a checksum manifest, without contacting the server",
+			Example: `  $ astore download --write-checksums -o tools/ tools/gcc tools/clang
+  $ astore checksum verify tools/SHA256SUMS
+        Verifies that the files downloaded in tools/ have not changed since.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (vc *ChecksumVerify) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return kflags.NewUsageErrorf("use as 'astore checksum verify <manifest>...' - one or more manifests to verify")
+	}
+
+	failed := 0
+	for _, mpath := range args {
+		manifest, err := astore.ReadManifest(mpath)
+		if err != nil {
+			return err
+		}
+		if len(manifest.Entries) == 0 {
+			return fmt.Errorf("%s: manifest does not exist, or lists no files", mpath)
+		}
+
+		results, err := manifest.Verify(filepath.Dir(mpath))
+		for _, result := range results {
+			path := filepath.Join(filepath.Dir(mpath), result.Path)
+			switch {
+			case result.Err != nil:
+				fmt.Printf("%s: %s - %s\n", path, result.Status, result.Err)
+			case result.Status != astore.VerifyOK:
+				fmt.Printf("%s: %s - expected sha256 %s, got %s\n", path, result.Status, result.SHA256, result.Actual)
+			default:
+				fmt.Printf("%s: %s\n", path, result.Status)
+			}
+		}
+		if err != nil {
+			vc.root.Log.Errorf("%s: %s", mpath, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d manifests failed verification", failed, len(args))
+	}
+	return nil
+}
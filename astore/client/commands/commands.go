@@ -12,6 +12,7 @@ import (
 	"github.com/System233/enkit/lib/client"
 	"github.com/System233/enkit/lib/config"
 	"github.com/System233/enkit/lib/config/defcon"
+	"github.com/System233/enkit/lib/config/directory"
 	"github.com/System233/enkit/lib/config/marshal"
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/kflags/kcobra"
@@ -47,7 +48,15 @@ func New(base *client.BaseFlags) *Root {
 	root.AddCommand(NewGuess(root).Command)
 	root.AddCommand(NewTag(root).Command)
 	root.AddCommand(NewNote(root).Command)
+	root.AddCommand(NewCopy(root).Command)
+	root.AddCommand(NewHistory(root).Command)
+	root.AddCommand(NewSearch(root).Command)
 	root.AddCommand(NewPublic(root).Command)
+	root.AddCommand(NewMirror(root).Command)
+	root.AddCommand(NewDoctor(root).Command)
+	root.AddCommand(NewChecksum(root))
+	root.AddCommand(NewQueue(root))
+	root.AddCommand(NewAdmin(root))
 	return root
 }
 
@@ -105,12 +114,12 @@ func (rc *Root) StoreClient() (*astore.Client, error) {
 		file.Close()
 	}
 
-	_, cookie, err := rc.IdentityCookie()
+	username, cookie, err := rc.IdentityCookie()
 	if err != nil {
 		return nil, err
 	}
 
-	storeconn, err := rc.store.Connect(client.WithCookie(cookie))
+	storeconn, err := rc.store.Connect(rc.WithRefreshingCookie(username, cookie))
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +127,23 @@ func (rc *Root) StoreClient() (*astore.Client, error) {
 	return astore.New(storeconn), nil
 }
 
+// StoreClientFor returns a client for an arbitrary astore server, using the
+// same credentials and security settings as the --store-server.
+func (rc *Root) StoreClientFor(server string) (*astore.Client, error) {
+	username, cookie, err := rc.IdentityCookie()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := *rc.store
+	flags.Server = server
+	storeconn, err := flags.Connect(rc.WithRefreshingCookie(username, cookie))
+	if err != nil {
+		return nil, err
+	}
+	return astore.New(storeconn), nil
+}
+
 func (rc *Root) Formatter(mods ...Modifier) astore.Formatter {
 	// The table formatter doesn't follow the same interface as the others, and
 	// can't be constructed until this point. This code should only be called once
@@ -125,20 +151,32 @@ func (rc *Root) Formatter(mods ...Modifier) astore.Formatter {
 	// the "table" value each time so should behave as expected.
 	formatterMap["table"] = NewTableFormatter(mods...)
 
-	formatterList := NewFormatterList()
+	formatterList := rc.MetaFormatter()
 
-	if format, ok := formatterMap[strings.ToLower(rc.consoleFormat)]; ok {
+	consoleFormat := strings.ToLower(rc.consoleFormat)
+	if rc.BaseFlags != nil && rc.Render.JSON() && !rc.PersistentFlags().Changed("console-format") {
+		// --format=json applies to the commands not using the Renderer yet.
+		consoleFormat = "json"
+	}
+	if format, ok := formatterMap[consoleFormat]; ok {
 		formatterList.Append(format)
 	} else {
 		// Fall back to the table formatter
 		formatterList.Append(formatterMap["table"])
 	}
 
+	return formatterList
+}
+
+// MetaFormatter returns a formatter writing only the --meta-file, if any.
+//
+// Commands printing their output with the Renderer use it instead of Formatter.
+func (rc *Root) MetaFormatter() *FormatterList {
+	formatterList := NewFormatterList()
 	if rc.outputFile != "" {
 		// add a marshal-aware formatter
 		formatterList.Append(NewOpFile(rc.outputFile))
 	}
-
 	return formatterList
 }
 
@@ -150,6 +188,15 @@ func (rc *Root) OutputArtifacts(arts []*arpc.Artifact) {
 	formatter.Flush()
 }
 
+// UploadQueue returns the queue of uploads recorded with 'upload --queue', stored in the astore config directory.
+func (rc *Root) UploadQueue() (*astore.Queue, error) {
+	dir, err := directory.GetConfigDir("astore")
+	if err != nil {
+		return nil, err
+	}
+	return astore.OpenQueue(dir), nil
+}
+
 func (rc *Root) ConfigStore(namespace ...string) (config.Store, error) {
 	return defcon.Open("astore", namespace...)
 }
@@ -164,6 +211,8 @@ type Download struct {
 	Overwrite bool
 	Arch      string
 	Tag       []string
+
+	WriteChecksums bool
 }
 
 func SystemArch() string {
@@ -187,6 +236,7 @@ func NewDownload(root *Root) *Download {
 	command.Flags().BoolVarP(&command.Overwrite, "overwrite", "w", false, "Overwrite files that already exist")
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{"latest"}, "Download artifacts matching the tag specified. More than one tag can be specified")
 	command.Flags().StringVarP(&command.Arch, "arch", "a", SystemArch(), "Architecture to download the file for")
+	command.Flags().BoolVar(&command.WriteChecksums, "write-checksums", false, "Write a "+astore.ManifestName+" file, in sha256sum format, next to the downloaded files")
 
 	return command
 }
@@ -243,18 +293,73 @@ func (dc *Download) Run(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	arts, err := client.Download(ftd, astore.DownloadOptions{
+	options := astore.DownloadOptions{
 		Context: dc.root.BaseFlags.Context(),
-	})
+	}
+	if dc.WriteChecksums {
+		options.Checksums = astore.NewChecksums()
+	}
+	arts, err := client.Download(ftd, options)
+	var written []string
+	if options.Checksums != nil {
+		// Write the manifests even on failure, to cover the files that were downloaded successfully.
+		var werr error
+		written, werr = options.Checksums.Write()
+		for _, manifest := range written {
+			dc.root.Log.Infof("Checksums written to %s", manifest)
+		}
+		if werr != nil && err == nil {
+			err = fmt.Errorf("could not write checksums - %w", werr)
+		}
+	}
 	if err != nil && os.IsExist(err) {
 		return fmt.Errorf("file already exists? To overwrite, pass the -w or --overwrite flag - %s", err)
 	}
 
-	formatter := dc.root.Formatter()
+	render := dc.root.Render
+	var formatter astore.Formatter = dc.root.MetaFormatter()
+	if !render.JSON() {
+		formatter = dc.root.Formatter()
+	}
 	for _, art := range arts {
 		formatter.Artifact(art)
 	}
-	return err
+	formatter.Flush()
+	if err != nil {
+		// With --format=json, the error is the only document written on stdout.
+		return err
+	}
+	return render.Render(&DownloadOutput{Artifacts: nonNilArtifacts(arts), Checksums: written}, nil)
+}
+
+// DownloadOutput is the output of 'astore download' with --format=json.
+type DownloadOutput struct {
+	Artifacts []*arpc.Artifact `json:"artifacts"`
+	// Manifests written with --write-checksums.
+	Checksums []string `json:"checksums,omitempty"`
+}
+
+// ListOutput is the output of 'astore list' with --format=json.
+type ListOutput struct {
+	Artifacts     []*arpc.Artifact `json:"artifacts"`
+	Elements      []*arpc.Element  `json:"elements"`
+	Truncated     bool             `json:"truncated,omitempty"`
+	NextPageToken string           `json:"next_page_token,omitempty"`
+}
+
+// nonNilArtifacts returns an empty list rather than nil, so the JSON output has [] rather than null.
+func nonNilArtifacts(arts []*arpc.Artifact) []*arpc.Artifact {
+	if arts == nil {
+		return []*arpc.Artifact{}
+	}
+	return arts
+}
+
+func nonNilElements(els []*arpc.Element) []*arpc.Element {
+	if els == nil {
+		return []*arpc.Element{}
+	}
+	return els
 }
 
 type List struct {
@@ -263,6 +368,9 @@ type List struct {
 
 	Tag []string
 	All bool
+
+	MaxResults int32
+	PageToken  string
 }
 
 func NewList(root *Root) *List {
@@ -277,6 +385,8 @@ func NewList(root *Root) *List {
 	command.Command.RunE = command.Run
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{"latest"}, "Restrict the output to artifacts having this tag")
 	command.Flags().BoolVarP(&command.All, "all", "l", false, "Show all binaries")
+	command.Flags().Int32Var(&command.MaxResults, "max-results", 0, "Maximum number of paths and artifacts to show, 0 to use the limit of the server")
+	command.Flags().StringVar(&command.PageToken, "page-token", "", "Continue a truncated listing, with the token printed by the previous command")
 
 	return command
 }
@@ -300,21 +410,28 @@ func (l *List) Run(cmd *cobra.Command, args []string) error {
 		tags = []string{}
 	}
 	options := astore.ListOptions{
-		Context: l.root.BaseFlags.Context(),
-		Tag:     tags,
+		Context:    l.root.BaseFlags.Context(),
+		Tag:        tags,
+		MaxResults: l.MaxResults,
+		PageToken:  l.PageToken,
 	}
 
-	arts, els, err := client.List(query, options)
+	resp, err := client.ListPage(query, options)
 	if err != nil {
 		return err
 	}
+	arts, els := resp.Artifact, resp.Element
 
-	formatter := l.root.Formatter()
+	render := l.root.Render
+	var formatter astore.Formatter = l.root.MetaFormatter()
+	if !render.JSON() {
+		formatter = l.root.Formatter()
+	}
 	for _, art := range arts {
 		formatter.Artifact(art)
 	}
 	if !l.All && len(arts) >= 1 {
-		fmt.Printf("(only showing artifacts with %d tags: %v - use --all or -l to show all)\n", len(l.Tag), l.Tag)
+		render.Infof("(only showing artifacts with %d tags: %v - use --all or -l to show all)\n", len(l.Tag), l.Tag)
 	}
 
 	for _, el := range els {
@@ -322,7 +439,16 @@ func (l *List) Run(cmd *cobra.Command, args []string) error {
 	}
 	formatter.Flush()
 
-	return nil
+	if resp.Truncated {
+		render.Infof("\n*** TRUNCATED: %d results shown, more are available. To see them, run again with --page-token=%s ***\n",
+			len(arts)+len(els), resp.NextPageToken)
+	}
+	return render.Render(&ListOutput{
+		Artifacts:     nonNilArtifacts(arts),
+		Elements:      nonNilElements(els),
+		Truncated:     resp.Truncated,
+		NextPageToken: resp.NextPageToken,
+	}, nil)
 }
 
 type SuggestFlags astore.SuggestOptions
@@ -334,6 +460,9 @@ func (sf *SuggestFlags) Register(flagset *pflag.FlagSet) {
 	flagset.BoolVarP(&sf.DisableAt, "disable-at", "A", false, "Don't use the @ convention to name the remote file")
 	flagset.BoolVarP(&sf.AllowAbsolute, "allow-absolute", "b", false, "Allow absolute local paths to name remote paths")
 	flagset.BoolVarP(&sf.AllowSingleElement, "allow-single", "l", false, "Allow a single element path to be used as remote")
+	flagset.StringVar(&sf.Template, "remote-template", "", "Template to compute the remote name of files when not specified explicitly, like 'infra/tools/{name}/{version}/{file}' - usually set for your team in the enkit configuration. "+
+		"Variables: {file}, {name}, {ext}, {version}, {os}, {arch}, or any defined with --var")
+	flagset.StringArrayVar(&sf.Vars, "var", nil, "Variable to use in --remote-template, in the form key=value - overrides the guessed variables, can be repeated")
 }
 
 func (sf *SuggestFlags) Options() *astore.SuggestOptions {
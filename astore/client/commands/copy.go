@@ -0,0 +1,103 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/System233/enkit/astore/client/astore"
+	arpc "github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Copy struct {
+	*cobra.Command
+	root *Root
+
+	ForceUid       bool
+	ForcePath      bool
+	Arch           string
+	Tag            []string
+	Note           string
+	KeepTags       bool
+	KeepNote       bool
+	AllowDuplicate bool
+}
+
+func NewCopy(root *Root) *Copy {
+	command := &Copy{
+		Command: &cobra.Command{
+			Use:     "cp <path|uid> <path>",
+			Short:   "Copies an artifact to a different path, without downloading it",
+			Aliases: []string{"copy"},
+			Example: `  $ astore cp staging/kernel releases/kernel -t stable --keep-note
+    Copies the latest kernel in staging to releases, tagged as stable, with the same note.
+
+  $ astore cp wusyhsim6h5nhukvu5sejtp7eg6eqdgp releases/kernel
+    Copies the artifact with uid wusy...gp to releases.
+
+The copy is performed by the server, and shares the storage of the original
+artifact: it has the same architecture and MD5, but its own uid.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+
+	command.Flags().BoolVarP(&command.ForceUid, "force-uid", "u", false, "The source specified identifies an uid")
+	command.Flags().BoolVarP(&command.ForcePath, "force-path", "p", false, "The source specified identifies a file path")
+	command.Flags().StringVarP(&command.Arch, "arch", "a", "", "Architecture of the artifact to copy. If empty, the latest artifact of any architecture is copied")
+	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", []string{}, "Tags to assign to the copy, in addition to latest. More than one tag can be specified")
+	command.Flags().StringVarP(&command.Note, "note", "n", "", "Note to assign to the copy")
+	command.Flags().BoolVar(&command.KeepTags, "keep-tags", false, "Assign the tags of the original artifact to the copy as well")
+	command.Flags().BoolVar(&command.KeepNote, "keep-note", false, "Assign the note of the original artifact to the copy, unless --note is specified")
+	command.Flags().BoolVar(&command.AllowDuplicate, "allow-duplicate", false, "Copy even if an artifact with the same content and architecture already exists at the destination")
+
+	return command
+}
+
+func (cc *Copy) Run(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return kflags.NewUsageErrorf("use as 'astore cp <path|uid> <path>' - the artifact to copy, followed by the path to copy it to")
+	}
+	if cc.ForceUid && cc.ForcePath {
+		return kflags.NewUsageErrorf("cannot specify --force-uid together with --force-path - an argument can be either one, but not both")
+	}
+
+	mode := astore.IdAuto
+	if cc.ForceUid {
+		mode = astore.IdUid
+	}
+	if cc.ForcePath {
+		mode = astore.IdPath
+	}
+
+	client, err := cc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Copy(astore.ToCopy{
+		Source:         args[0],
+		SourceType:     mode,
+		Architecture:   cc.Arch,
+		Destination:    args[1],
+		Tag:            cc.Tag,
+		Note:           cc.Note,
+		KeepTags:       cc.KeepTags,
+		KeepNote:       cc.KeepNote,
+		AllowDuplicate: cc.AllowDuplicate,
+	})
+	if err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return fmt.Errorf("%s already has an artifact with the same content - use --allow-duplicate to copy anyway\nFor debugging: %s", args[1], err)
+		}
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("no artifact '%s' could be found on the server - nothing to copy", args[0])
+		}
+		return err
+	}
+
+	cc.root.OutputArtifacts([]*arpc.Artifact{resp.Artifact})
+	return nil
+}
@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/spf13/cobra"
+)
+
+type Doctor struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewDoctor(root *Root) *Doctor {
+	command := &Doctor{
+		Command: &cobra.Command{
+			Use:   "doctor",
+			Short: "Checks the configuration and connectivity of astore, and prints a report",
+			Long: `Checks the configuration and connectivity of astore, and prints a report.
+
+The report ends with the last messages logged, including debug messages,
+so it can be attached to a bug report as is. Secrets, like the flags
+holding secrets and the credentials of the user, are redacted.`,
+			Example: `  $ astore doctor > report.txt
+	Checks that astore can reach the --store-server, and saves the report.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+// doctorCheck is a single check performed by astore doctor.
+type doctorCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+func (dc *Doctor) checks() []doctorCheck {
+	return []doctorCheck{
+		{"credentials", func() (string, error) {
+			username, _, err := dc.root.IdentityToken()
+			if err != nil {
+				return "", err
+			}
+			return "using the credentials of " + username, nil
+		}},
+		{"store server", func() (string, error) {
+			client, err := dc.root.StoreClient()
+			if err != nil {
+				return "", err
+			}
+			start := time.Now()
+			if _, err := client.ListPage("", astore.ListOptions{MaxResults: 1}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s replied in %s", dc.root.store.Server, time.Since(start).Round(time.Millisecond)), nil
+		}},
+		{"upload queue", func() (string, error) {
+			queue, err := dc.root.UploadQueue()
+			if err != nil {
+				return "", err
+			}
+			entries, err := queue.List()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d uploads waiting", len(entries)), nil
+		}},
+	}
+}
+
+func (dc *Doctor) Run(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "astore doctor report - %s\n\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(out, "System: %s, %s\n", SystemArch(), runtime.Version())
+	fmt.Fprintf(out, "Store server: %s\n\n", dc.root.store.Server)
+
+	failed := 0
+	for _, check := range dc.checks() {
+		result, err := check.run()
+		if err != nil {
+			failed++
+			dc.root.Log.Debugf("doctor: %s check failed - %s", check.name, err)
+			fmt.Fprintf(out, "[FAIL] %s:\n%s\n", check.name, logger.IndentLines(err.Error(), "    "))
+			continue
+		}
+		fmt.Fprintf(out, "[ OK ] %s: %s\n", check.name, result)
+	}
+
+	dc.dumpLogs(out)
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed - see the report above for details", failed)
+	}
+	return nil
+}
+
+// dumpLogs writes the messages retained by the DebugRing, secrets redacted.
+func (dc *Doctor) dumpLogs(out io.Writer) {
+	if dc.root.DebugRing == nil {
+		return
+	}
+	var dump strings.Builder
+	if err := dc.root.DebugRing.Dump(&dump); err != nil || dump.Len() <= 0 {
+		return
+	}
+	fmt.Fprintf(out, "\nLast messages logged (secrets redacted):\n%s\n", logger.IndentLines(dump.String(), "    "))
+}
@@ -19,6 +19,7 @@ type TableFormatter struct {
 	elHeaderPrinted bool
 
 	disableNesting bool
+	showHistory    bool
 	heading        string
 
 	tPrint func(fmt string, args ...interface{})
@@ -32,6 +33,12 @@ type Modifier func(*TableFormatter)
 func WithNoNesting(f *TableFormatter) {
 	f.disableNesting = true
 }
+
+// WithHistory shows the changes to the note and tags of each artifact.
+func WithHistory(f *TableFormatter) {
+	f.showHistory = true
+}
+
 func WithHeading(heading string) Modifier {
 	return func(f *TableFormatter) {
 		f.heading = heading
@@ -74,11 +81,37 @@ func (ff *TableFormatter) Artifact(af *astore.Artifact) {
 	fmt.Printf(prefix+"| %-23s %-30s %-14s %-32x %-32s %-7s %s\n",
 		time.Unix(0, af.Created).Format("2006-01-02 15:04:05.000"),
 		af.Creator, af.Architecture, af.MD5, af.Uid, humanize.Bytes(uint64(af.Size)), af.Tag)
+	if af.Path != "" {
+		fmt.Printf(prefix + "|            ")
+		ff.nPrint("PATH:")
+		fmt.Printf(" %s\n", af.Path)
+	}
 	if af.Note != "" {
 		fmt.Printf(prefix + "|            ")
 		ff.nPrint("NOTES:")
 		ff.wPrint(" %s\n", af.Note)
 	}
+	if ff.showHistory {
+		for _, change := range af.History {
+			fmt.Printf(prefix + "|            ")
+			ff.hPrint("CHANGED:")
+			fmt.Printf(" %s\n", formatChange(change))
+		}
+	}
+}
+
+// formatChange returns a human readable description of a change to the metadata of an artifact.
+func formatChange(change *astore.MetadataChange) string {
+	when := time.Unix(0, change.Timestamp).Format("2006-01-02 15:04:05.000")
+	switch change.Field {
+	case astore.MetadataChange_NOTE:
+		return fmt.Sprintf("%s by %s - note %q -> %q", when, change.Actor, change.OldNote, change.NewNote)
+	case astore.MetadataChange_TAG:
+		return fmt.Sprintf("%s by %s - tags %v -> %v", when, change.Actor, change.OldTag, change.NewTag)
+	case astore.MetadataChange_TRUNCATED:
+		return fmt.Sprintf("%s - %d older changes dropped", when, change.Dropped)
+	}
+	return fmt.Sprintf("%s by %s - unknown change %v", when, change.Actor, change.Field)
 }
 
 func (ff *TableFormatter) Element(el *astore.Element) {
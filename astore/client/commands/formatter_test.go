@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/System233/enkit/astore/rpc/astore"
 	"github.com/stretchr/testify/assert"
@@ -46,3 +47,17 @@ func TestMarshalFormat(t *testing.T) {
 	}
 
 }
+
+func TestFormatChange(t *testing.T) {
+	when := time.Date(2026, 10, 15, 10, 0, 0, 0, time.Local)
+	assert.Equal(t, `2026-10-15 10:00:00.000 by alice@enkit.io - note "" -> "broken"`, formatChange(&astore.MetadataChange{
+		Field: astore.MetadataChange_NOTE, Actor: "alice@enkit.io", Timestamp: when.UnixNano(), NewNote: "broken",
+	}))
+	assert.Equal(t, "2026-10-15 10:00:00.000 by bob@enkit.io - tags [latest stable] -> [stable]", formatChange(&astore.MetadataChange{
+		Field: astore.MetadataChange_TAG, Actor: "bob@enkit.io", Timestamp: when.UnixNano(),
+		OldTag: []string{"latest", "stable"}, NewTag: []string{"stable"},
+	}))
+	assert.Equal(t, "2026-10-15 10:00:00.000 - 12 older changes dropped", formatChange(&astore.MetadataChange{
+		Field: astore.MetadataChange_TRUNCATED, Timestamp: when.UnixNano(), Dropped: 12,
+	}))
+}
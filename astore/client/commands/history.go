@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+type History struct {
+	*cobra.Command
+	root *Root
+
+	Metadata bool
+}
+
+func NewHistory(root *Root) *History {
+	command := &History{
+		Command: &cobra.Command{
+			Use:   "history PATH",
+			Short: "Shows all the versions of an artifact, and who changed their notes and tags",
+			Example: `  $ astore history experiments/builds/build.out
+    Shows all the versions uploaded of build.out, regardless of their tags.
+
+  $ astore history --metadata experiments/builds/build.out
+    Same as above, also showing who changed the notes and tags of each version, and when.
+`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().BoolVarP(&command.Metadata, "metadata", "M", false, "Show the history of changes to the notes and tags of each version")
+	return command
+}
+
+func (hc *History) Run(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return kflags.NewUsageErrorf("use as 'astore history PATH' - with exactly one PATH argument (got %d arguments)", len(args))
+	}
+
+	client, err := hc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+
+	arts, _, err := client.List(args[0], astore.ListOptions{
+		Context: hc.root.BaseFlags.Context(),
+		Tag:     []string{},
+	})
+	if err != nil {
+		return err
+	}
+
+	mods := []Modifier{WithNoNesting}
+	if hc.Metadata {
+		mods = append(mods, WithHistory)
+	}
+	formatter := hc.root.Formatter(mods...)
+	for _, art := range arts {
+		formatter.Artifact(art)
+	}
+	formatter.Flush()
+	return nil
+}
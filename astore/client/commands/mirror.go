@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/khttp/kclient"
+	"github.com/spf13/cobra"
+)
+
+type Mirror struct {
+	*cobra.Command
+	root *Root
+
+	From             string
+	To               string
+	Prefix           string
+	DryRun           bool
+	DeleteExtraneous bool
+	Parallelism      int
+	RateLimitRetries int
+}
+
+func NewMirror(root *Root) *Mirror {
+	command := &Mirror{
+		Command: &cobra.Command{
+			Use:   "mirror --to <server> [--from <server>] [--prefix <path>]",
+			Short: "Copies artifacts, their metadata and published aliases from one astore server to another",
+			Long: `Copies artifacts, their metadata and published aliases from one astore server to another.
+
+Artifacts are copied with their tags and notes. Published aliases selecting
+artifacts below --prefix are published on the destination as well, with
+aliases selecting an uid re-pointed to the uid of the copy of the artifact.
+Both servers must support listing published aliases.`,
+			Example: `  $ astore mirror --to https://astore.eu.example.com/ --prefix tools/ --dry-run
+        Shows what would be copied from the default server to the eu one.
+
+  $ astore mirror --from https://astore.example.com/ --to https://astore.eu.example.com/ --delete-extraneous
+        Makes the eu server an exact copy of the main one.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+
+	command.Flags().StringVar(&command.From, "from", "", "Server to copy artifacts from. Defaults to the --store-server")
+	command.Flags().StringVar(&command.To, "to", "", "Server to copy artifacts to")
+	command.Flags().StringVarP(&command.Prefix, "prefix", "p", "", "Only mirror artifacts below this path")
+	command.Flags().BoolVarP(&command.DryRun, "dry-run", "n", false, "Show what would be changed, without changing anything")
+	command.Flags().BoolVar(&command.DeleteExtraneous, "delete-extraneous", false, "Delete artifacts and unpublish aliases on the destination that do not exist on the source")
+	command.Flags().IntVarP(&command.Parallelism, "parallelism", "j", 4, "How many artifacts to copy at the same time - reduced automatically if the servers rate limit requests")
+	command.Flags().IntVar(&command.RateLimitRetries, "rate-limit-retries", astore.DefaultRateLimitRetries, "How many times to retry copying an artifact rate limited by the servers")
+	return command
+}
+
+func (mc *Mirror) Run(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return kflags.NewUsageErrorf("use as 'astore mirror --to <server>' - no positional arguments are accepted")
+	}
+	if mc.To == "" {
+		return kflags.NewUsageErrorf("must specify the destination server with --to")
+	}
+	from := mc.From
+	if from == "" {
+		from = mc.root.store.Server
+	}
+	if from == mc.To {
+		return kflags.NewUsageErrorf("source and destination server are the same - %s", from)
+	}
+
+	src, err := mc.root.StoreClientFor(from)
+	if err != nil {
+		return err
+	}
+	dest, err := mc.root.StoreClientFor(mc.To)
+	if err != nil {
+		return err
+	}
+	// Artifacts are streamed through this client, honor the --http-* flags.
+	hc := &http.Client{}
+	if err := kclient.FromFlags(mc.root.HTTP)(hc); err != nil {
+		return err
+	}
+
+	report, err := src.Mirror(dest, astore.MirrorOptions{
+		Context:          mc.root.BaseFlags.Context(),
+		Prefix:           mc.Prefix,
+		DryRun:           mc.DryRun,
+		DeleteExtraneous: mc.DeleteExtraneous,
+		Parallelism:      mc.Parallelism,
+		RateLimitRetries: mc.RateLimitRetries,
+		HTTP:             hc,
+	})
+
+	verb := "done"
+	if report.DryRun {
+		verb = "would be done"
+	}
+	for _, e := range report.Entries {
+		state := "ok"
+		if e.Err != nil {
+			state = fmt.Sprintf("FAILED - %s", e.Err)
+		}
+		fmt.Printf("%-9s %s (%s, %s) %s\n", e.Action, e.Path, e.Architecture, e.Uid, state)
+	}
+	fmt.Printf("Summary (%s): %d unchanged", verb, report.Unchanged)
+	for _, action := range []astore.MirrorAction{astore.MirrorCopy, astore.MirrorUpdate, astore.MirrorDelete, astore.MirrorPublish, astore.MirrorUnpublish} {
+		total, failed := report.Count(action)
+		fmt.Printf(", %d %s (%d failed)", total, action, failed)
+	}
+	if report.Throttled > 0 {
+		fmt.Printf(", %d rate limited (parallelism reduced to %d)", report.Throttled, report.MinParallelism)
+	}
+	fmt.Printf("\n")
+
+	if err != nil {
+		return client.NiceError(err, "mirror completed with errors, running it again will retry what failed - %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/spf13/cobra"
+)
+
+func NewQueue(root *Root) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "queue",
+		Short: "Commands to work with the uploads recorded by 'upload --queue'",
+	}
+	command.AddCommand(NewQueueList(root).Command)
+	command.AddCommand(NewQueueFlush(root).Command)
+	return command
+}
+
+type QueueList struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewQueueList(root *Root) *QueueList {
+	command := &QueueList{
+		Command: &cobra.Command{
+			Use:     "list",
+			Short:   "Lists the uploads waiting in the queue",
+			Aliases: []string{"ls"},
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (lc *QueueList) Run(cmd *cobra.Command, args []string) error {
+	queue, err := lc.root.UploadQueue()
+	if err != nil {
+		return err
+	}
+	entries, err := queue.List()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s: queued %s as %s, sha256 %s\n", entry.Local, entry.Queued.Format(time.RFC3339), entry.Remote, entry.SHA256)
+	}
+	return nil
+}
+
+type QueueFlush struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewQueueFlush(root *Root) *QueueFlush {
+	command := &QueueFlush{
+		Command: &cobra.Command{
+			Use:   "flush",
+			Short: "Uploads the files in the queue",
+			Long: `Uploads the files in the queue.
+
+Files are uploaded in the order they were queued, and removed from the
+queue once uploaded. Files that changed or were removed since they were
+queued are skipped with a warning, and dropped from the queue: queue
+them again to upload their new content.
+
+If an upload fails, the file and all the ones after it are left in the
+queue, and can be uploaded by running flush again.`,
+			Example: `  $ astore upload --queue /var/log/syslog@logs/host1/
+  $ astore queue flush
+	Uploads /var/log/syslog as logs/host1/syslog, once connectivity returns.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (fc *QueueFlush) Run(cmd *cobra.Command, args []string) error {
+	queue, err := fc.root.UploadQueue()
+	if err != nil {
+		return err
+	}
+	client, err := fc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+
+	options := astore.UploadOptions{
+		Context: fc.root.BaseFlags.Context(),
+	}
+	arts, skipped, err := queue.Flush(client, options)
+	fc.root.OutputArtifacts(arts)
+	if len(skipped) > 0 {
+		fc.root.Log.Warnf("%d queued files changed or were removed before being uploaded, and were dropped from the queue", len(skipped))
+	}
+	return err
+}
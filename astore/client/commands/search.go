@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+type Search struct {
+	*cobra.Command
+	root *Root
+
+	Tag     []string
+	Note    string
+	Creator string
+	After   string
+	Before  string
+
+	MaxResults int32
+	PageToken  string
+}
+
+func NewSearch(root *Root) *Search {
+	command := &Search{
+		Command: &cobra.Command{
+			Use:   "search [PATH-GLOB]",
+			Short: "Finds artifacts by path, tags, note, creator or upload time",
+			Example: `  $ astore search 'tools/*' --note hotfix
+    Shows the artifacts stored directly under tools/ with "hotfix" in their note.
+
+  $ astore search --creator alice@enkit.cloud --after 48h -t stable
+    Shows the artifacts uploaded by alice in the last 2 days, tagged stable.
+
+  $ astore search --after 2026-09-01 --before 2026-10-01
+    Shows all the artifacts uploaded in September 2026.
+`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", nil, "Restrict the output to artifacts having this tag, can be repeated")
+	command.Flags().StringVar(&command.Note, "note", "", "Restrict the output to artifacts with a note containing this text, case insensitive")
+	command.Flags().StringVar(&command.Creator, "creator", "", "Restrict the output to artifacts uploaded by this user")
+	command.Flags().StringVar(&command.After, "after", "", "Restrict the output to artifacts uploaded after this time - as RFC3339, a YYYY-MM-DD date, or a duration ago, like 24h")
+	command.Flags().StringVar(&command.Before, "before", "", "Restrict the output to artifacts uploaded before this time - same formats as --after")
+	command.Flags().Int32Var(&command.MaxResults, "max-results", 0, "Maximum number of artifacts to show, 0 to use the default of the server")
+	command.Flags().StringVar(&command.PageToken, "page-token", "", "Continue a truncated search, with the token printed by the previous command")
+
+	return command
+}
+
+// parseSearchTime parses a time as RFC3339, as a date, or as a duration before now.
+func parseSearchTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q - must be RFC3339 like 2006-01-02T15:04:05Z, a date like 2006-01-02, or a positive duration like 36h", value)
+}
+
+func (sc *Search) Run(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return kflags.NewUsageErrorf("use as 'astore search [PATH-GLOB]' - with a single, optional, PATH-GLOB argument (got %d arguments)", len(args))
+	}
+
+	now := time.Now()
+	after, err := parseSearchTime(sc.After, now)
+	if err != nil {
+		return kflags.NewUsageErrorf("invalid --after flag - %s", err)
+	}
+	before, err := parseSearchTime(sc.Before, now)
+	if err != nil {
+		return kflags.NewUsageErrorf("invalid --before flag - %s", err)
+	}
+
+	options := astore.SearchOptions{
+		Context:       sc.root.BaseFlags.Context(),
+		Tag:           sc.Tag,
+		Note:          sc.Note,
+		Creator:       sc.Creator,
+		CreatedAfter:  after,
+		CreatedBefore: before,
+		MaxResults:    sc.MaxResults,
+		PageToken:     sc.PageToken,
+	}
+	if len(args) == 1 {
+		options.PathGlob = args[0]
+	}
+
+	client, err := sc.root.StoreClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Search(options)
+	if err != nil {
+		return err
+	}
+
+	formatter := sc.root.Formatter(WithNoNesting)
+	for _, art := range resp.Artifact {
+		formatter.Artifact(art)
+	}
+	formatter.Flush()
+
+	if resp.ScanLimited {
+		fmt.Fprintf(os.Stderr, "\n*** TRUNCATED: %d results shown, the server stopped at its scan limit before examining all the artifacts. To continue, run again with --page-token=%s ***\n",
+			len(resp.Artifact), resp.NextPageToken)
+	} else if resp.Truncated {
+		fmt.Fprintf(os.Stderr, "\n*** TRUNCATED: %d results shown, more are available. To see them, run again with --page-token=%s ***\n",
+			len(resp.Artifact), resp.NextPageToken)
+	}
+	return nil
+}
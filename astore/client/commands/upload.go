@@ -1,8 +1,14 @@
 package commands
 
 import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
 	"github.com/System233/enkit/astore/client/astore"
 	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/render"
 	"github.com/spf13/cobra"
 )
 
@@ -14,6 +20,9 @@ type Upload struct {
 	Arch    string
 	Note    string
 	Tag     []string
+	Queue   bool
+
+	ShowRemote bool
 }
 
 func NewUpload(root *Root) *Upload {
@@ -60,7 +69,22 @@ c) Let astore figure it out. It has a bunch of heuristics built in.
    If you are in a git repository, for example, a relative path
    will be turned into 'repository-name/path/to/the/file'.
 
-d) Use a relative path. Relative paths are preserved as is in the
+d) Use a remote template, with --remote-template. Teams usually configure
+   one in the enkit configuration, so all their artifacts follow the same
+   conventions. For example, with 'infra/tools/{name}/{version}/{file}',
+   uploading 'bin/fetch-1.2.0-linux' stores it as
+   'infra/tools/fetch/1.2.0/fetch-1.2.0-linux'.
+
+   Variables are guessed from the file: {file} is its name, {name} the
+   name without version and extension, {ext} the extension, {version}
+   the version in the name, {os} and {arch} the architecture of the binary.
+   Use --var to define additional variables, or override the guessed ones,
+   like '--var version=2.0'. If a variable cannot be guessed nor is defined,
+   no file is uploaded.
+
+   Use --show-remote to print the remote names computed, without uploading.
+
+e) Use a relative path. Relative paths are preserved as is in the
    remote repository.
 
 For the architecture:
@@ -96,6 +120,14 @@ c) If no architecture is guessed or specified, it is assumed that the
   $ astore upload -t kernel:2.6.0 -t debug-binary /etc/hosts@configs/
 	Similar to previous commands, but assign tags to the binary, available
 	for querying.
+
+  $ astore upload --queue -t field /var/log/syslog@logs/host1/
+	Without network access, record the upload in the local queue instead.
+	Run 'astore queue flush' once connectivity returns to upload the file.
+
+  $ astore upload --remote-template 'infra/tools/{name}/{version}/{os}/{file}' --var version=2.1 --show-remote ./fetch
+	Show where ./fetch would be stored, without uploading it, like
+	'infra/tools/fetch/2.1/linux/fetch'.
 `,
 			Aliases: []string{"up", "put", "push", "send"},
 		},
@@ -107,6 +139,8 @@ c) If no architecture is guessed or specified, it is assumed that the
 	command.Flags().StringVarP(&command.Arch, "arch", "a", "", "Architecture of the file, avoid automated detection")
 	command.Flags().StringVarP(&command.Note, "note", "n", "", "Note to add to the upload")
 	command.Flags().StringArrayVarP(&command.Tag, "tag", "t", nil, "Tags to assign to the binary being uploaded")
+	command.Flags().BoolVar(&command.Queue, "queue", false, "Record the upload in the local queue rather than uploading, run 'astore queue flush' to upload later")
+	command.Flags().BoolVar(&command.ShowRemote, "show-remote", false, "Only show the remote name and architecture each file would be uploaded as, without uploading")
 
 	return command
 }
@@ -116,18 +150,18 @@ func (uc *Upload) Run(cmd *cobra.Command, args []string) error {
 		return kflags.NewUsageErrorf("use as 'astore upload <file>...' - one or more paths to upload")
 	}
 
-	client, err := uc.root.StoreClient()
-	if err != nil {
-		return err
-	}
-
 	options := astore.UploadOptions{
 		Context: uc.root.BaseFlags.Context(),
 	}
 
+	suggest := *uc.Suggest.Options()
+	suggest.Arch = uc.Arch
+
+	// All the remote names are computed before uploading, so an invalid name
+	// or template stops the upload before any file is stored.
 	files := []astore.FileToUpload{}
 	for _, arg := range args {
-		local, remote, err := astore.SuggestRemote(arg, *uc.Suggest.Options())
+		local, remote, err := astore.SuggestRemote(arg, suggest)
 		if err != nil {
 			return err
 		}
@@ -144,6 +178,30 @@ func (uc *Upload) Run(cmd *cobra.Command, args []string) error {
 
 		files = append(files, astore.FileToUpload{Local: local, Remote: remote, Architecture: architectures, Note: uc.Note, Tag: uc.Tag})
 	}
+
+	if uc.ShowRemote {
+		return WriteRemotes(uc.root.Render, files)
+	}
+
+	if uc.Queue {
+		queue, err := uc.root.UploadQueue()
+		if err != nil {
+			return err
+		}
+		queued, err := queue.Add(files, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, entry := range queued {
+			fmt.Printf("%s: queued as %s, sha256 %s\n", entry.Local, entry.Remote, entry.SHA256)
+		}
+		return nil
+	}
+
+	client, err := uc.root.StoreClient()
+	if err != nil {
+		return err
+	}
 	arts, err := client.Upload(files, options)
 	if err != nil {
 		return err
@@ -152,3 +210,30 @@ func (uc *Upload) Run(cmd *cobra.Command, args []string) error {
 	uc.root.OutputArtifacts(arts)
 	return nil
 }
+
+// RemotesOutput is the output of 'astore upload --show-remote' with --format=json.
+type RemotesOutput struct {
+	Files []RemoteOutput `json:"files"`
+}
+
+type RemoteOutput struct {
+	Local         string   `json:"local"`
+	Remote        string   `json:"remote"`
+	Architectures []string `json:"architectures"`
+}
+
+// WriteRemotes shows where each file would be uploaded.
+func WriteRemotes(r *render.Renderer, files []astore.FileToUpload) error {
+	output := RemotesOutput{Files: []RemoteOutput{}}
+	for _, file := range files {
+		output.Files = append(output.Files, RemoteOutput{Local: file.Local, Remote: file.Remote, Architectures: file.Architecture})
+	}
+	return r.Render(&output, func(w io.Writer) error {
+		for _, file := range output.Files {
+			if _, err := fmt.Fprintf(w, "%s -> %s (%s)\n", file.Local, file.Remote, strings.Join(file.Architectures, ", ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/System233/enkit/astore/client/astore"
+	"github.com/System233/enkit/lib/render"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRemotes(t *testing.T) {
+	files := []astore.FileToUpload{
+		{Local: "bin/fetch-1.2.0", Remote: "infra/tools/fetch/1.2.0/fetch-1.2.0", Architecture: []string{"amd64-linux"}},
+		{Local: "fetch.app", Remote: "infra/tools/fetch/1.2.0/fetch.app", Architecture: []string{"amd64-mac", "arm64-mac"}},
+	}
+
+	out := &bytes.Buffer{}
+	r, err := render.New(render.WithWriters(out, out))
+	assert.NoError(t, err)
+	assert.NoError(t, WriteRemotes(r, files))
+	assert.Equal(t, ""+
+		"bin/fetch-1.2.0 -> infra/tools/fetch/1.2.0/fetch-1.2.0 (amd64-linux)\n"+
+		"fetch.app -> infra/tools/fetch/1.2.0/fetch.app (amd64-mac, arm64-mac)\n", out.String())
+
+	out.Reset()
+	r, err = render.New(render.WithWriters(out, out), render.WithFormat(render.FormatJSON))
+	assert.NoError(t, err)
+	assert.NoError(t, WriteRemotes(r, files[:1]))
+	assert.JSONEq(t, `{"files": [{"local": "bin/fetch-1.2.0", "remote": "infra/tools/fetch/1.2.0/fetch-1.2.0", "architectures": ["amd64-linux"]}]}`, out.String())
+}
@@ -9,16 +9,18 @@ import (
 
 	"github.com/System233/enkit/lib/srand"
 	"math/rand"
+	"os"
 )
 
 func main() {
 	base := client.DefaultBaseFlags("astore", "enkit")
 	root := acommands.New(base)
 
-	set, populator, runner := kcobra.Runner(root.Command, nil, base.IdentityErrorHandler("astore login"))
+	set, populator, runner := kcobra.Runner(root.Command, nil, base.IdentityErrorHandler("astore login"), base.DebugDumpErrorHandler(), base.RPCTraceErrorHandler(), base.RenderErrorHandler())
 
 	rng := rand.New(srand.Source)
 	root.AddCommand(bcommands.NewLogin(base, rng, populator).Command)
 
+	base.Completing = kcobra.IsCompletion(os.Args)
 	base.Run(set, populator, runner)
 }
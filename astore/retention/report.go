@@ -0,0 +1,142 @@
+package retention
+
+import (
+	"sort"
+	"time"
+)
+
+// PrefixReport lists the artifacts a single rule would collect.
+type PrefixReport struct {
+	Rule   string `json:"rule"`
+	Prefix string `json:"prefix"`
+
+	// Artifacts matched by the rule, and their total size in bytes.
+	Artifacts int   `json:"artifacts"`
+	Bytes     int64 `json:"bytes"`
+
+	Candidates []Candidate `json:"candidates"`
+	// Total size of the candidates, in bytes.
+	Reclaim int64 `json:"reclaim"`
+}
+
+// Report describes the artifacts the retention rules would collect.
+//
+// A report is built incrementally: Add is invoked with the versions of each
+// path and architecture as the store is scanned, and Finish once the scan
+// is complete. A partial report can be serialized, and resumed later.
+type Report struct {
+	// When the scan started. Ages are computed relative to this time, so
+	// a report resumed later evaluates all the artifacts consistently.
+	Started time.Time `json:"started"`
+	// When the scan completed, zero while the report is partial.
+	Finished time.Time `json:"finished"`
+
+	Rules    []Rule          `json:"rules"`
+	Prefixes []*PrefixReport `json:"prefixes"`
+
+	// Artifacts matched by no rule, and thus always kept, and their total size.
+	Unmatched      int   `json:"unmatched"`
+	UnmatchedBytes int64 `json:"unmatched_bytes"`
+}
+
+// NewReport returns an empty report for the rules in config.
+func NewReport(config *Config, started time.Time) *Report {
+	report := &Report{
+		Started: started,
+		Rules:   append([]Rule{}, config.Rules...),
+	}
+	for _, rule := range config.Rules {
+		report.Prefixes = append(report.Prefixes, &PrefixReport{Rule: rule.Name, Prefix: rule.Prefix})
+	}
+	return report
+}
+
+// Add evaluates the versions of the artifact stored at a single path and architecture.
+func (r *Report) Add(versions []Artifact) {
+	if len(versions) == 0 {
+		return
+	}
+
+	var size int64
+	for _, art := range versions {
+		size += art.Size
+	}
+
+	config := &Config{Rules: r.Rules}
+	rule := config.Match(versions[0].Path)
+	if rule == nil {
+		r.Unmatched += len(versions)
+		r.UnmatchedBytes += size
+		return
+	}
+
+	prefix := r.prefix(rule.Name)
+	prefix.Artifacts += len(versions)
+	prefix.Bytes += size
+	for _, candidate := range rule.Evaluate(versions, r.Started) {
+		prefix.Candidates = append(prefix.Candidates, candidate)
+		prefix.Reclaim += candidate.Size
+	}
+}
+
+func (r *Report) prefix(rule string) *PrefixReport {
+	for _, prefix := range r.Prefixes {
+		if prefix.Rule == rule {
+			return prefix
+		}
+	}
+	prefix := &PrefixReport{Rule: rule}
+	r.Prefixes = append(r.Prefixes, prefix)
+	return prefix
+}
+
+// Finish marks the report as complete.
+func (r *Report) Finish(finished time.Time) {
+	r.Finished = finished
+}
+
+// Complete returns true if the report covers the whole store.
+func (r *Report) Complete() bool {
+	return !r.Finished.IsZero()
+}
+
+// Summary is the total of a report, across all rules.
+type Summary struct {
+	Artifacts  int   `json:"artifacts"`
+	Bytes      int64 `json:"bytes"`
+	Candidates int   `json:"candidates"`
+	Reclaim    int64 `json:"reclaim"`
+	// Percentage of Bytes that would be reclaimed.
+	ReclaimPercent float64 `json:"reclaim_percent"`
+}
+
+// Summary computes the totals of the report. Unmatched artifacts are
+// counted in Artifacts and Bytes, as they are part of the store.
+func (r *Report) Summary() Summary {
+	summary := Summary{Artifacts: r.Unmatched, Bytes: r.UnmatchedBytes}
+	for _, prefix := range r.Prefixes {
+		summary.Artifacts += prefix.Artifacts
+		summary.Bytes += prefix.Bytes
+		summary.Candidates += len(prefix.Candidates)
+		summary.Reclaim += prefix.Reclaim
+	}
+	if summary.Bytes > 0 {
+		summary.ReclaimPercent = float64(summary.Reclaim) * 100 / float64(summary.Bytes)
+	}
+	return summary
+}
+
+// Largest returns the n largest candidates across all rules, largest first.
+func (r *Report) Largest(n int) []Candidate {
+	all := []Candidate{}
+	for _, prefix := range r.Prefixes {
+		all = append(all, prefix.Candidates...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Size > all[j].Size
+	})
+	if n >= 0 && len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
@@ -0,0 +1,169 @@
+// Package retention evaluates the retention rules of an artifact store, and
+// describes the artifacts they would collect in a Report.
+//
+// The package knows nothing about how artifacts are stored: the server scans
+// its metadata, and feeds the artifacts to a Report one path and architecture
+// at a time. The same Report is parsed by the clients to summarize it.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/lib/config/marshal"
+)
+
+// Rule describes which artifacts to keep under a path prefix.
+//
+// All artifacts are kept unless they are older than MaxAgeDays, and are not
+// among the KeepLast most recent of their path and architecture, and have
+// none of the KeepTags.
+type Rule struct {
+	// Name of the rule, reported for each candidate it matched.
+	Name string `json:"name" yaml:"name" toml:"name"`
+	// Path prefix the rule applies to, matched on path element boundaries.
+	// Empty to match all the artifacts.
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"`
+
+	// How many of the most recent artifacts of each path and architecture to keep.
+	KeepLast int `json:"keep_last" yaml:"keep_last" toml:"keep_last"`
+	// Artifacts created less than this many days ago are kept. 0 to ignore age.
+	MaxAgeDays int `json:"max_age_days" yaml:"max_age_days" toml:"max_age_days"`
+	// Artifacts with any of those tags are kept.
+	KeepTags []string `json:"keep_tags" yaml:"keep_tags" toml:"keep_tags"`
+}
+
+// Matches returns true if the rule applies to the artifacts stored at path.
+func (r *Rule) Matches(path string) bool {
+	prefix := strings.Trim(r.Prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Config is the set of retention rules of a store.
+type Config struct {
+	Rules []Rule `json:"rules" yaml:"rules" toml:"rules"`
+}
+
+// LoadConfig reads the rules from a file, in any of the formats supported by marshal.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if err := marshal.UnmarshalFile(path, config); err != nil {
+		return nil, fmt.Errorf("could not load retention rules from %s - %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention rules in %s - %w", path, err)
+	}
+	return config, nil
+}
+
+// Validate returns an error if a rule is ambiguous, or would collect every artifact it matches.
+func (c *Config) Validate() error {
+	names := map[string]struct{}{}
+	prefixes := map[string]string{}
+	for _, rule := range c.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule with prefix %q has no name", rule.Prefix)
+		}
+		if _, found := names[rule.Name]; found {
+			return fmt.Errorf("rule %s defined twice", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+
+		prefix := strings.Trim(rule.Prefix, "/")
+		if other, found := prefixes[prefix]; found {
+			return fmt.Errorf("rules %s and %s have the same prefix %q", other, rule.Name, prefix)
+		}
+		prefixes[prefix] = rule.Name
+
+		if rule.KeepLast < 0 || rule.MaxAgeDays < 0 {
+			return fmt.Errorf("rule %s - keep_last and max_age_days cannot be negative", rule.Name)
+		}
+		if rule.KeepLast == 0 && rule.MaxAgeDays == 0 {
+			return fmt.Errorf("rule %s - one of keep_last or max_age_days must be set, or all the artifacts would be collected", rule.Name)
+		}
+	}
+	return nil
+}
+
+// Match returns the rule applying to the artifacts stored at path, nil if none.
+//
+// When more rules match, the one with the longest prefix wins.
+func (c *Config) Match(path string) *Rule {
+	var match *Rule
+	for ix := range c.Rules {
+		rule := &c.Rules[ix]
+		if !rule.Matches(path) {
+			continue
+		}
+		if match == nil || len(strings.Trim(rule.Prefix, "/")) > len(strings.Trim(match.Prefix, "/")) {
+			match = rule
+		}
+	}
+	return match
+}
+
+// Artifact is the metadata of an artifact needed to evaluate the rules.
+type Artifact struct {
+	Path         string    `json:"path"`
+	Architecture string    `json:"architecture"`
+	Uid          string    `json:"uid"`
+	Size         int64     `json:"size"`
+	Created      time.Time `json:"created"`
+	Tags         []string  `json:"tags,omitempty"`
+}
+
+// Candidate is an artifact the rules would collect.
+type Candidate struct {
+	Artifact
+	// Name of the rule collecting the artifact.
+	Rule string `json:"rule"`
+	// Why the artifact is collected, in human readable form.
+	Reason string `json:"reason"`
+}
+
+// Evaluate returns the artifacts that rule would collect among versions,
+// the artifacts stored at a single path and architecture.
+func (r *Rule) Evaluate(versions []Artifact, now time.Time) []Candidate {
+	sorted := append([]Artifact{}, versions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created.After(sorted[j].Created)
+	})
+
+	maxAge := time.Duration(r.MaxAgeDays) * 24 * time.Hour
+	var candidates []Candidate
+	for ix, art := range sorted {
+		if ix < r.KeepLast {
+			continue
+		}
+		if r.MaxAgeDays > 0 && now.Sub(art.Created) < maxAge {
+			continue
+		}
+		if hasAnyTag(art.Tags, r.KeepTags) {
+			continue
+		}
+
+		var reasons []string
+		if r.MaxAgeDays > 0 {
+			reasons = append(reasons, fmt.Sprintf("older than %d days", r.MaxAgeDays))
+		}
+		if r.KeepLast > 0 {
+			reasons = append(reasons, fmt.Sprintf("not among the %d most recent", r.KeepLast))
+		}
+		candidates = append(candidates, Candidate{Artifact: art, Rule: r.Name, Reason: strings.Join(reasons, ", ")})
+	}
+	return candidates
+}
+
+// hasAnyTag returns true if any of tags is also in keep.
+func hasAnyTag(tags, keep []string) bool {
+	for _, tag := range tags {
+		for _, k := range keep {
+			if tag == k {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package retention
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+rules:
+  - name: tools
+    prefix: tools/
+    keep_last: 3
+    keep_tags: [stable]
+  - name: default
+    max_age_days: 90
+`), 0644))
+
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Name: "tools", Prefix: "tools/", KeepLast: 3, KeepTags: []string{"stable"}},
+		{Name: "default", MaxAgeDays: 90},
+	}, config.Rules)
+
+	for _, invalid := range []string{
+		"rules: [{prefix: tools, keep_last: 1}]",
+		"rules: [{name: a, prefix: tools, keep_last: 1}, {name: a, prefix: images, keep_last: 1}]",
+		"rules: [{name: a, prefix: tools, keep_last: 1}, {name: b, prefix: /tools/, keep_last: 1}]",
+		"rules: [{name: a, prefix: tools}]",
+		"rules: [{name: a, prefix: tools, keep_last: -1, max_age_days: 1}]",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(invalid), 0644))
+		_, err := LoadConfig(path)
+		assert.Error(t, err, "%s", invalid)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	config := &Config{Rules: []Rule{
+		{Name: "default", KeepLast: 10},
+		{Name: "tools", Prefix: "tools", KeepLast: 3},
+		{Name: "enkit", Prefix: "/tools/enkit/", KeepLast: 1},
+	}}
+	assert.Equal(t, "enkit", config.Match("tools/enkit").Name)
+	assert.Equal(t, "enkit", config.Match("tools/enkit/enkit.tar.gz").Name)
+	assert.Equal(t, "tools", config.Match("tools/enkitten").Name)
+	assert.Equal(t, "tools", config.Match("tools/astore").Name)
+	assert.Equal(t, "default", config.Match("toolset/astore").Name)
+
+	config.Rules = config.Rules[1:]
+	assert.Nil(t, config.Match("toolset/astore"))
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	days := func(d int) time.Time { return now.Add(-time.Duration(d) * 24 * time.Hour) }
+	versions := []Artifact{
+		{Uid: "a", Created: days(50), Size: 1},
+		{Uid: "b", Created: days(1), Size: 2},
+		{Uid: "c", Created: days(20), Size: 4},
+		{Uid: "d", Created: days(40), Size: 8, Tags: []string{"stable"}},
+		{Uid: "e", Created: days(10), Size: 16},
+	}
+	uids := func(candidates []Candidate) []string {
+		result := []string{}
+		for _, candidate := range candidates {
+			result = append(result, candidate.Uid)
+		}
+		return result
+	}
+
+	rule := &Rule{Name: "last", KeepLast: 2}
+	assert.Equal(t, []string{"c", "d", "a"}, uids(rule.Evaluate(versions, now)))
+	assert.Equal(t, "not among the 2 most recent", rule.Evaluate(versions, now)[0].Reason)
+
+	rule = &Rule{Name: "age", MaxAgeDays: 15, KeepTags: []string{"stable"}}
+	assert.Equal(t, []string{"c", "a"}, uids(rule.Evaluate(versions, now)))
+	assert.Equal(t, "older than 15 days", rule.Evaluate(versions, now)[0].Reason)
+
+	rule = &Rule{Name: "both", KeepLast: 4, MaxAgeDays: 15}
+	candidates := rule.Evaluate(versions, now)
+	assert.Equal(t, []string{"a"}, uids(candidates))
+	assert.Equal(t, "both", candidates[0].Rule)
+}
+
+func TestReport(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	config := &Config{Rules: []Rule{{Name: "tools", Prefix: "tools", KeepLast: 1}}}
+	report := NewReport(config, now)
+	report.Add([]Artifact{
+		{Path: "tools/enkit", Uid: "a", Created: now.Add(-time.Hour), Size: 100},
+		{Path: "tools/enkit", Uid: "b", Created: now.Add(-2 * time.Hour), Size: 300},
+	})
+	report.Add([]Artifact{
+		{Path: "tools/astore", Uid: "c", Created: now.Add(-time.Hour), Size: 50},
+		{Path: "tools/astore", Uid: "d", Created: now.Add(-2 * time.Hour), Size: 150},
+	})
+	report.Add([]Artifact{{Path: "images/base", Uid: "e", Created: now, Size: 400}})
+	report.Add(nil)
+	assert.False(t, report.Complete())
+	report.Finish(now.Add(time.Minute))
+	assert.True(t, report.Complete())
+
+	assert.Equal(t, Summary{Artifacts: 5, Bytes: 1000, Candidates: 2, Reclaim: 450, ReclaimPercent: 45}, report.Summary())
+	largest := report.Largest(1)
+	assert.Equal(t, 1, len(largest))
+	assert.Equal(t, "b", largest[0].Uid)
+	assert.Equal(t, 2, len(report.Largest(10)))
+}
@@ -0,0 +1,125 @@
+package astore
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/oauth"
+	"github.com/System233/enkit/lib/retry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkAdmin returns an error unless the user of the request is one of the administrators configured with WithAdmins.
+func (s *Server) checkAdmin(ctx context.Context) (string, error) {
+	creds := oauth.GetCredentials(ctx)
+	if creds == nil {
+		return "", status.Errorf(codes.Unauthenticated, "authentication required")
+	}
+	name := creds.Identity.GlobalName()
+	for _, admin := range s.options.admins {
+		if admin == name {
+			return name, nil
+		}
+	}
+	return "", status.Errorf(codes.PermissionDenied, "user %s is not an administrator", name)
+}
+
+// ListQuotas implements the AstoreAdmin.ListQuotas RPC.
+//
+// Returns the usage of all the quotas with uploads accounted against them,
+// and of the path prefix quotas configured that have none.
+func (s *Server) ListQuotas(ctx context.Context, req *astore.ListQuotasRequest) (*astore.ListQuotasResponse, error) {
+	if _, err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.backendContext(ctx)
+	defer cancel()
+
+	query := datastore.NewQuery(KindQuota)
+	if req.Kind != astore.Quota_UNKNOWN {
+		query = query.Filter("Kind = ", req.Kind.String())
+	}
+	var quotas []*Quota
+	if _, err := s.ds.GetAll(ctx, query, &quotas); err != nil {
+		return nil, s.backendError("ListQuotas", err)
+	}
+
+	now := time.Now()
+	seen := map[quotaRef]bool{}
+	response := &astore.ListQuotasResponse{}
+	for _, quota := range quotas {
+		ref := s.quotaRef(astore.Quota_Kind(astore.Quota_Kind_value[quota.Kind]), quota.Name)
+		quota.current(ref, now)
+		seen[ref] = true
+		response.Quota = append(response.Quota, quota.ToProto(ref))
+	}
+	if req.Kind == astore.Quota_UNKNOWN || req.Kind == astore.Quota_PATH_PREFIX {
+		for prefix := range s.options.quota.prefixes {
+			if ref := s.quotaRef(astore.Quota_PATH_PREFIX, prefix); !seen[ref] {
+				response.Quota = append(response.Quota, (&Quota{}).ToProto(ref))
+			}
+		}
+	}
+
+	sort.Slice(response.Quota, func(i, j int) bool {
+		a, b := response.Quota[i], response.Quota[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return response, nil
+}
+
+// AdjustQuota implements the AstoreAdmin.AdjustQuota RPC.
+func (s *Server) AdjustQuota(ctx context.Context, req *astore.AdjustQuotaRequest) (*astore.AdjustQuotaResponse, error) {
+	actor, err := s.checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Kind != astore.Quota_IDENTITY && req.Kind != astore.Quota_PATH_PREFIX {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid quota kind %s", req.Kind)
+	}
+	if req.Kind == astore.Quota_IDENTITY && req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must supply the name of the user")
+	}
+	if req.UsedBytes < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid usage %d - must not be negative", req.UsedBytes)
+	}
+
+	ref := s.quotaRef(req.Kind, req.Name)
+	quota := &Quota{}
+	err = retry.New(retry.WithDescription("adjust quota transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
+		t, err := s.ds.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		quota = &Quota{}
+		if err := t.Get(ref.key(), quota); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		quota.current(ref, now)
+		quota.Used = req.UsedBytes
+		quota.Updated = now
+
+		if _, err := t.Mutate(datastore.NewUpsert(ref.key(), quota)); err != nil {
+			return err
+		}
+		return Commit(&t)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.options.logger.Infof("quota %s of %q adjusted to %d bytes by %s", ref.kind, ref.name, quota.Used, actor)
+	exportQuota(ref, quota)
+	return &astore.AdjustQuotaResponse{Quota: quota.ToProto(ref)}, nil
+}
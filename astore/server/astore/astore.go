@@ -4,13 +4,13 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/storage"
 	"encoding/base32"
 	"github.com/System233/enkit/astore/rpc/astore"
 	"github.com/System233/enkit/lib/oauth"
@@ -36,14 +36,22 @@ type Server struct {
 
 	rng *rand.Rand
 
-	gcs *storage.Client
-	bkt *storage.BucketHandle
+	blobs BlobStore
 
 	ds datastoreClient
 
 	options Options
 }
 
+// BlobHandler returns the http.Handler serving uploads and downloads, if the storage backend requires one.
+//
+// The handler must be reachable at the URL configured for the backend. For
+// backends issuing URLs of an external service, like GCS or S3, returns nil.
+func (s *Server) BlobHandler() http.Handler {
+	handler, _ := s.blobs.(http.Handler)
+	return handler
+}
+
 // Why base32?
 // - fixed length (base58 is not fixed length)
 // - has no characters other than letters and numbers (base64 has a few symbols)
@@ -73,12 +81,16 @@ func GenerateUid(rng *rand.Rand) (string, error) {
 }
 
 func (s *Server) Store(ctx context.Context, req *astore.StoreRequest) (*astore.StoreResponse, error) {
+	if err := s.checkQuotas(ctx); err != nil {
+		return nil, err
+	}
+
 	sid, err := GenerateSid(s.rng)
 	if err != nil {
 		return nil, fmt.Errorf("problems with secure prng - %w", err)
 	}
 
-	url, err := storage.SignedURL(s.options.bucket, objectPath(sid), s.options.ForSigning("PUT"))
+	url, err := s.blobs.UploadURL(objectPath(sid))
 	if err != nil {
 		return nil, fmt.Errorf("could not sign the url - %w", err)
 	}
@@ -99,59 +111,88 @@ func queryForPath(kind, path, arch string) (*datastore.Query, error) {
 	return datastore.NewQuery(kind).Filter("Parent = ", path).Order("-Created").Ancestor(akey), nil
 }
 
+// List returns the sub paths and artifacts of a path.
+//
+// Results are returned in pages of at most listLimit entries, sub paths first,
+// so a single request on a path with many entries cannot hold the backend for long.
 func (s *Server) List(ctx context.Context, req *astore.ListRequest) (*astore.ListResponse, error) {
+	limit := s.listLimit(req.MaxResults)
+	page, err := parsePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page token - %s", err)
+	}
+
+	ctx, cancel := s.backendContext(ctx)
+	defer cancel()
+
 	// Two queries are necessary:
-	//   1) To retrieve artifacts.
-	//   2) To retrieve sub-paths.
+	//   1) To retrieve sub-paths.
+	//   2) To retrieve artifacts, only if all sub-paths fit in the page.
+	//
+	// Each query asks for one more entry than can be returned, to detect
+	// if the results have to be truncated.
 	childFiles := []*PathElement{}
 	queryPath, err := queryForPath(KindPathElement, req.Path, "")
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
 	}
-	kf, err := s.ds.GetAll(s.ctx, queryPath, &childFiles)
+	kf, err := s.ds.GetAll(ctx, queryPath.Offset(page.elements).Limit(limit+1), &childFiles)
 	if err != nil {
-		return nil, err
+		return nil, s.backendError("List", err)
 	}
 
-	reqarch := strings.TrimSpace(req.Architecture)
-	queryArtifact, err := queryForPath(KindArtifact, req.Path, reqarch)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
-	}
-	if req.Uid != "" {
-		queryArtifact = queryArtifact.Filter("Uid = ", req.Uid)
-	}
-
-	tags := []string{"latest"}
-	if req.Tag != nil {
-		tags = req.Tag.Tag
-	}
-	for _, tag := range tags {
-		queryArtifact = queryArtifact.Filter("Tag = ", tag)
+	response := &astore.ListResponse{}
+	next := listPage{elements: page.elements + len(childFiles), artifacts: page.artifacts}
+	if len(childFiles) > limit {
+		childFiles, kf = childFiles[:limit], kf[:limit]
+		next.elements = page.elements + limit
+		response.Truncated = true
 	}
 
 	childArtifacts := []*Artifact{}
-	ka, err := s.ds.GetAll(s.ctx, queryArtifact, &childArtifacts)
-	if err != nil {
-		return nil, err
+	var ka []*datastore.Key
+	if !response.Truncated {
+		reqarch := strings.TrimSpace(req.Architecture)
+		queryArtifact, err := queryForPath(KindArtifact, req.Path, reqarch)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+		}
+		if req.Uid != "" {
+			queryArtifact = queryArtifact.Filter("Uid = ", req.Uid)
+		}
+
+		tags := []string{"latest"}
+		if req.Tag != nil {
+			tags = req.Tag.Tag
+		}
+		for _, tag := range tags {
+			queryArtifact = queryArtifact.Filter("Tag = ", tag)
+		}
+
+		available := limit - len(childFiles)
+		ka, err = s.ds.GetAll(ctx, queryArtifact.Offset(page.artifacts).Limit(available+1), &childArtifacts)
+		if err != nil {
+			return nil, s.backendError("List", err)
+		}
+		if len(childArtifacts) > available {
+			childArtifacts, ka = childArtifacts[:available], ka[:available]
+			next.artifacts = page.artifacts + available
+			response.Truncated = true
+		}
 	}
 
-	dirs := []*astore.Element{}
 	for ix, file := range childFiles {
 		k := kf[ix]
-		dirs = append(dirs, &astore.Element{Name: k.Name, Created: file.Created.UnixNano(), Creator: file.Creator})
+		response.Element = append(response.Element, &astore.Element{Name: k.Name, Created: file.Created.UnixNano(), Creator: file.Creator})
 	}
-
-	arts := []*astore.Artifact{}
 	for ix, art := range childArtifacts {
-		arts = append(arts, art.ToProto(keyToArchitecture(ka[ix])))
+		response.Artifact = append(response.Artifact, art.ToProto(keyToArchitecture(ka[ix])))
 	}
-
-	response := astore.ListResponse{
-		Element:  dirs,
-		Artifact: arts,
+	if response.Truncated {
+		metricListTruncated.Inc()
+		response.NextPageToken = next.Token()
 	}
-	return &response, nil
+	return response, nil
 }
 
 func objectPath(sid string) string {
@@ -177,9 +218,13 @@ func (s *Server) Tag(ctx context.Context, req *astore.TagRequest) (*astore.TagRe
 	if req.Uid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no sid and no path")
 	}
+	actor, err := requestActor(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	arts := []*astore.Artifact{}
-	err := retry.New(retry.WithDescription("tag transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
+	err = retry.New(retry.WithDescription("tag transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
 		t, err := s.ds.NewTransaction(s.ctx)
 		if err != nil {
 			return err
@@ -199,22 +244,24 @@ func (s *Server) Tag(ctx context.Context, req *astore.TagRequest) (*astore.TagRe
 		// Found list of artifacts to update. This should be a single artifact, as UIDs should
 		// be globally unique. Using a loop for defense in depth.
 		muts := []*datastore.Mutation{}
+		now := time.Now()
 		for ix, art := range artifacts {
 			key := keys[ix]
 
+			tags := art.Tag
 			if req.Set != nil {
-				art.Tag = req.Set.Tag
+				tags = req.Set.Tag
 			}
 			if req.Add != nil {
-				art.Tag = append(art.Tag, req.Add.Tag...)
+				tags = append(append([]string{}, tags...), req.Add.Tag...)
 			}
 			var del []string
 			if req.Del != nil {
 				del = req.Del.Tag
 			}
 
-			art.Tag = cleanUniqueDelete(art.Tag, del)
-			m, err := s.deleteTagsMutation(t, key, art.Tag)
+			art.SetTags(actor, now, cleanUniqueDelete(tags, del), s.options.historyLimit)
+			m, err := s.deleteTagsMutation(t, key, art.Tag, actor, now)
 			if err != nil {
 				return err
 			}
@@ -264,10 +311,7 @@ func keyToPath(key *datastore.Key) string {
 		cursor = cursor.Parent
 	}
 
-	if path[len(path)-1] == '/' {
-		return path[:len(path)-1]
-	}
-	return path
+	return strings.TrimSuffix(path, "/")
 }
 
 func keyForArtifact(key *datastore.Key) *datastore.Key {
@@ -410,7 +454,8 @@ func alreadyExistsError(err error) bool {
 //
 // key is the key of the artifact owning the tags supplied, or the key of the parent where the artifact is supposed to be stored.
 // tags is the list of tags to be added to the specified artifact. Those tags need to be removed from any other artifact.
-func (s *Server) deleteTagsMutation(t *datastore.Transaction, key *datastore.Key, tags []string) ([]*datastore.Mutation, error) {
+// actor and now are recorded in the history of the artifacts losing tags.
+func (s *Server) deleteTagsMutation(t *datastore.Transaction, key *datastore.Key, tags []string, actor string, now time.Time) ([]*datastore.Mutation, error) {
 	pkey := key
 	if key.Kind == KindArtifact {
 		pkey = key.Parent
@@ -457,7 +502,7 @@ func (s *Server) deleteTagsMutation(t *datastore.Transaction, key *datastore.Key
 	}
 
 	for _, ka := range entries {
-		ka.Art.Tag = cleanUniqueDelete(ka.Art.Tag, tags)
+		ka.Art.SetTags(actor, now, cleanUniqueDelete(ka.Art.Tag, tags), s.options.historyLimit)
 		muts = append(muts, datastore.NewUpdate(ka.Key, ka.Art))
 	}
 
@@ -466,6 +511,11 @@ func (s *Server) deleteTagsMutation(t *datastore.Transaction, key *datastore.Key
 
 func (s *Server) Commit(ctx context.Context, req *astore.CommitRequest) (*astore.CommitResponse, error) {
 	creds := oauth.GetCredentials(ctx)
+	return s.commit(creds.Identity.GlobalName(), req)
+}
+
+// commit records the blob uploaded at req.Sid as a new artifact, created by creator.
+func (s *Server) commit(creator string, req *astore.CommitRequest) (*astore.CommitResponse, error) {
 	if req.Sid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Must supply an sid")
 	}
@@ -479,24 +529,25 @@ func (s *Server) Commit(ctx context.Context, req *astore.CommitRequest) (*astore
 	}
 
 	opath := objectPath(req.Sid)
-	attrs, err := s.bkt.Object(opath).Attrs(s.ctx)
+	info, err := s.blobs.Stat(s.ctx, opath)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "SID %s is invalid - %s", opath, err)
 	}
+	// Accounted before the artifact is inserted: a failed commit retried
+	// by the client is accounted twice.
+	if err := s.chargeQuotas(s.ctx, creator, req.Path, info.Size); err != nil {
+		return nil, err
+	}
 
 	uid, err := GenerateUid(s.rng)
 	if err != nil {
 		return nil, err
 	}
 
-	creator := creds.Identity.GlobalName()
-
-	_, err = s.bkt.Object(opath).Update(s.ctx, storage.ObjectAttrsToUpdate{
-		Metadata: map[string]string{
-			"path":    req.Path,
-			"uid":     uid,
-			"creator": creator,
-		},
+	err = s.blobs.SetMetadata(s.ctx, opath, map[string]string{
+		"path":    req.Path,
+		"uid":     uid,
+		"creator": creator,
 	})
 	if err != nil {
 		return nil, err
@@ -516,8 +567,8 @@ func (s *Server) Commit(ctx context.Context, req *astore.CommitRequest) (*astore
 	artifact := &Artifact{
 		Uid:     uid,
 		Sid:     req.Sid,
-		MD5:     attrs.MD5,
-		Size:    attrs.Size,
+		MD5:     info.MD5,
+		Size:    info.Size,
 		Tag:     tags,
 		Parent:  path,
 		Creator: creator,
@@ -532,7 +583,7 @@ func (s *Server) Commit(ctx context.Context, req *astore.CommitRequest) (*astore
 		}
 		defer Rollback(&t)
 
-		muts, err := s.deleteTagsMutation(t, pkey, tags)
+		muts, err := s.deleteTagsMutation(t, pkey, tags, creator, artifact.Created)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,89 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+)
+
+var (
+	// Functions mocked in unit tests
+	storageSignedURL = storage.SignedURL
+)
+
+// BlobInfo describes a blob stored in a BlobStore.
+type BlobInfo struct {
+	Size int64
+	// MD5 of the content, nil if the backend cannot provide it.
+	MD5 []byte
+}
+
+// BlobStore stores the content of artifacts.
+//
+// Blobs are never streamed through the gRPC API. Clients upload and download
+// them directly with the URLs generated by the BlobStore, while the server
+// keeps the metadata in datastore.
+type BlobStore interface {
+	// UploadURL returns a URL the client can upload the blob to with an http PUT.
+	UploadURL(name string) (string, error)
+	// DownloadURL returns a URL the client can download the blob from with an http GET.
+	//
+	// If filename is not empty, the URL instructs browsers to save the
+	// blob with that file name.
+	DownloadURL(name, filename string) (string, error)
+
+	// Stat returns the size and checksum of an uploaded blob.
+	Stat(ctx context.Context, name string) (*BlobInfo, error)
+	// SetMetadata attaches key value pairs to the blob, to help debugging and recovery.
+	SetMetadata(ctx context.Context, name string, metadata map[string]string) error
+	Delete(ctx context.Context, name string) error
+}
+
+// contentDisposition is the value of the Content-Disposition header that has browsers save a file as filename.
+func contentDisposition(filename string) string {
+	return fmt.Sprintf(`inline; filename="%s"`, filename)
+}
+
+// gcsBlobStore stores blobs in a Google Cloud Storage bucket, using signed URLs.
+type gcsBlobStore struct {
+	bucket  string
+	bkt     *storage.BucketHandle
+	signing func(method string) *storage.SignedURLOptions
+}
+
+func (g *gcsBlobStore) UploadURL(name string) (string, error) {
+	return storageSignedURL(g.bucket, name, g.signing("PUT"))
+}
+
+func (g *gcsBlobStore) DownloadURL(name, filename string) (string, error) {
+	signed, err := storageSignedURL(g.bucket, name, g.signing("GET"))
+	if err != nil || filename == "" {
+		return signed, err
+	}
+
+	// Ensure that the file, when the browser goes to download it, has the original file name, rather than the uid.
+	// Wget and curl get it right, surprisingly, as they stick to the original file name from the URL before the redirect.
+	// If it wasn't for that, they'd need the --content-disposition or -J flag.
+	//
+	// The parameter is not part of the signature, so it can just be appended.
+	return signed + "&response-content-disposition=" + url.PathEscape(contentDisposition(filename)), nil
+}
+
+func (g *gcsBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	attrs, err := g.bkt.Object(name).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{Size: attrs.Size, MD5: attrs.MD5}, nil
+}
+
+func (g *gcsBlobStore) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	_, err := g.bkt.Object(name).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	return err
+}
+
+func (g *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	return g.bkt.Object(name).Delete(ctx)
+}
@@ -0,0 +1,255 @@
+package astore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const blobContent = "The quick brown fox jumps over the lazy dog"
+
+func httpDo(t *testing.T, method, url string, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp, string(data)
+}
+
+// testBlobLifecycle uploads, inspects, downloads and deletes a blob, the way the server does for an artifact.
+func testBlobLifecycle(t *testing.T, blobs BlobStore) {
+	ctx := context.Background()
+	name := objectPath("ab/cd/efghijkmnopqrstuvwxyz")
+
+	_, err := blobs.Stat(ctx, name)
+	assert.NotNil(t, err)
+
+	upload, err := blobs.UploadURL(name)
+	assert.Nil(t, err)
+	resp, _ := httpDo(t, http.MethodPut, upload, blobContent)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	info, err := blobs.Stat(ctx, name)
+	assert.Nil(t, err)
+	sum := md5.Sum([]byte(blobContent))
+	assert.Equal(t, &BlobInfo{Size: int64(len(blobContent)), MD5: sum[:]}, info)
+
+	assert.Nil(t, blobs.SetMetadata(ctx, name, map[string]string{"path": "tools/fox", "uid": "uid", "creator": "joe@corp"}))
+
+	download, err := blobs.DownloadURL(name, "fox.txt")
+	assert.Nil(t, err)
+	resp, body := httpDo(t, http.MethodGet, download, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, blobContent, body)
+	assert.Equal(t, `inline; filename="fox.txt"`, resp.Header.Get("Content-Disposition"))
+
+	// URLs only authorize the operation they were issued for.
+	resp, _ = httpDo(t, http.MethodGet, upload, "")
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, download, "overwritten")
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	resp, body = httpDo(t, http.MethodGet, download, "")
+	assert.Equal(t, blobContent, body)
+
+	assert.Nil(t, blobs.Delete(ctx, name))
+	_, err = blobs.Stat(ctx, name)
+	assert.NotNil(t, err)
+	resp, _ = httpDo(t, http.MethodGet, download, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	blobs, err := newLocalBlobStore(rand.New(rand.NewSource(0)), localOptions{dir: t.TempDir(), url: server.URL + "/b/"}, time.Hour)
+	assert.Nil(t, err)
+	mux.Handle("/b/", blobs)
+
+	testBlobLifecycle(t, blobs)
+
+	// URLs issued by a store with a different key, or expired, are rejected.
+	other, err := newLocalBlobStore(rand.New(rand.NewSource(1)), localOptions{dir: t.TempDir(), url: server.URL + "/b/"}, time.Hour)
+	assert.Nil(t, err)
+	upload, err := other.UploadURL(objectPath("ab/cd/efgh"))
+	assert.Nil(t, err)
+	resp, _ := httpDo(t, http.MethodPut, upload, blobContent)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	expired, err := newLocalBlobStore(rand.New(rand.NewSource(0)), localOptions{dir: t.TempDir(), url: server.URL + "/b/"}, -time.Minute)
+	assert.Nil(t, err)
+	upload, err = expired.UploadURL(objectPath("ab/cd/efgh"))
+	assert.Nil(t, err)
+	mux.Handle("/expired/", expired)
+	resp, _ = httpDo(t, http.MethodPut, strings.Replace(upload, "/b/", "/expired/", 1), blobContent)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	srv := &Server{blobs: blobs}
+	assert.NotNil(t, srv.BlobHandler())
+}
+
+// fakeS3 is a minimal S3 service, verifying the signature of each request before serving it.
+type fakeS3 struct {
+	store *s3BlobStore
+
+	lock    sync.Mutex
+	objects map[string]string
+	// Metadata set by the last copy.
+	metadata map[string]string
+}
+
+func (f *fakeS3) verify(r *http.Request) error {
+	query := r.URL.Query()
+	signature := query.Get("X-Amz-Signature")
+	canonical := ""
+	date := query.Get("X-Amz-Date")
+	if signature != "" {
+		query.Del("X-Amz-Signature")
+		canonical = strings.Join([]string{r.Method, r.URL.EscapedPath(), s3CanonicalQuery(query), "host:" + r.Host + "\n", "host", s3UnsignedPayload}, "\n")
+	} else {
+		auth := r.Header.Get("Authorization")
+		fields := strings.Split(strings.TrimPrefix(auth, s3Algorithm+" "), ", ")
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid authorization header %q", auth)
+		}
+		signed := strings.TrimPrefix(fields[1], "SignedHeaders=")
+		signature = strings.TrimPrefix(fields[2], "Signature=")
+		date = r.Header.Get("X-Amz-Date")
+
+		headers := ""
+		for _, name := range strings.Split(signed, ";") {
+			value := r.Header.Get(name)
+			if name == "host" {
+				value = r.Host
+			}
+			headers += name + ":" + value + "\n"
+		}
+		canonical = strings.Join([]string{r.Method, r.URL.EscapedPath(), s3CanonicalQuery(query), headers, signed, r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	}
+
+	now, err := time.Parse(s3TimeFormat, date)
+	if err != nil {
+		return err
+	}
+	if expected := f.store.signature(now, canonical); signature != expected {
+		return fmt.Errorf("signature mismatch - got %s, expected %s", signature, expected)
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			if _, found := f.objects[source]; !found {
+				http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+				return
+			}
+			if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+				http.Error(w, "<Error><Code>InvalidRequest</Code></Error>", http.StatusBadRequest)
+				return
+			}
+			f.objects[key] = f.objects[source]
+			f.metadata = map[string]string{}
+			for name := range r.Header {
+				if strings.HasPrefix(name, "X-Amz-Meta-") {
+					f.metadata[strings.ToLower(strings.TrimPrefix(name, "X-Amz-Meta-"))] = r.Header.Get(name)
+				}
+			}
+			fmt.Fprintf(w, "<CopyObjectResult></CopyObjectResult>")
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = string(data)
+
+	case http.MethodGet, http.MethodHead:
+		data, found := f.objects[key]
+		if !found {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		sum := md5.Sum([]byte(data))
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		if disposition := r.URL.Query().Get("response-content-disposition"); disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, data)
+		}
+
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	fake := &fakeS3{objects: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	blobs, err := newS3BlobStore("artifacts", s3Options{
+		endpoint:        server.URL,
+		region:          "eu-west-1",
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "secret",
+	}, time.Hour)
+	assert.Nil(t, err)
+	fake.store = blobs
+
+	testBlobLifecycle(t, blobs)
+	assert.Equal(t, map[string]string{"path": "tools/fox", "uid": "uid", "creator": "joe@corp"}, fake.metadata)
+
+	assert.ErrorContains(t, blobs.SetMetadata(context.Background(), "missing", nil), "404 Not Found")
+	assert.Empty(t, fake.objects)
+
+	srv := &Server{blobs: blobs}
+	assert.Nil(t, srv.BlobHandler())
+}
+
+func TestNewS3BlobStore(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	_, err := newS3BlobStore("artifacts", s3Options{endpoint: "s3.amazonaws.com", region: "us-east-1"}, time.Hour)
+	assert.ErrorContains(t, err, "must be an http:// or https:// URL")
+	_, err = newS3BlobStore("artifacts", s3Options{endpoint: "https://s3.amazonaws.com", region: "us-east-1"}, time.Hour)
+	assert.ErrorContains(t, err, "requires an access key id")
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	blobs, err := newS3BlobStore("artifacts", s3Options{endpoint: "https://s3.amazonaws.com", region: "us-east-1"}, 30*24*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIDEXAMPLE", blobs.options.accessKeyID)
+	assert.Equal(t, s3MaxExpires, blobs.expires)
+
+	u, err := url.Parse(blobs.presign(http.MethodGet, "upload/ab", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "/artifacts/upload/ab", u.Path)
+}
@@ -0,0 +1,130 @@
+package astore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/retry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// copyArtifact returns the metadata of a copy of source, as requested by req.
+//
+// The copy shares the blob of the source. Uid, Parent and Creator are left
+// for the caller to fill.
+func copyArtifact(source *Artifact, req *astore.CopyRequest, now time.Time) *Artifact {
+	tags := append([]string{}, req.Tag...)
+	if req.KeepTags {
+		tags = append(tags, source.Tag...)
+	}
+	note := req.Note
+	if note == "" && req.KeepNote {
+		note = source.Note
+	}
+
+	return &Artifact{
+		Sid:     source.Sid,
+		MD5:     source.MD5,
+		Size:    source.Size,
+		Tag:     cleanUnique(append(tags, "latest")),
+		Created: now,
+		Note:    note,
+	}
+}
+
+// duplicateQuery returns a query for the artifacts under the path and architecture of pkey with the same content as artifact.
+//
+// Artifacts are compared by MD5, or by sid if the MD5 is unknown.
+func duplicateQuery(pkey *datastore.Key, artifact *Artifact) *datastore.Query {
+	query := datastore.NewQuery(KindArtifact).Ancestor(pkey).Limit(1)
+	if len(artifact.MD5) > 0 {
+		return query.Filter("MD5 = ", artifact.MD5)
+	}
+	return query.Filter("Sid = ", artifact.Sid)
+}
+
+// Copy creates a new artifact at req.Path, sharing the blob of the source artifact.
+//
+// No bytes are transferred, and no upload quota is charged: the copy has the
+// same sid, MD5, size and architecture of the source, with its own uid.
+// The copy is inserted in a single transaction, together with the removal of
+// its tags from the other artifacts of the destination.
+func (s *Server) Copy(ctx context.Context, req *astore.CopyRequest) (*astore.CopyResponse, error) {
+	actor, err := requestActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Source == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "must supply the artifact to copy")
+	}
+	if strings.TrimSpace(req.Path) == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must supply a destination path")
+	}
+
+	source, skey, err := s.findArtifact(ctx, req.Source)
+	if err != nil {
+		return nil, err
+	}
+	architecture := keyToArchitecture(skey)
+	if architecture == "" {
+		architecture = "all"
+	}
+
+	path, pkey, err := keyFromPath(req.Path, architecture)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+	}
+
+	uid, err := GenerateUid(s.rng)
+	if err != nil {
+		return nil, err
+	}
+	artifact := copyArtifact(source, req, time.Now())
+	artifact.Uid = uid
+	artifact.Parent = path
+	artifact.Creator = actor
+
+	muts := mutationsForKeyPath(path, pkey, actor)
+	_, err = s.ds.Mutate(s.ctx, muts...)
+	if err != nil && !alreadyExistsError(err) {
+		return nil, err
+	}
+
+	err = retry.New(retry.WithDescription("copy transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
+		t, err := s.ds.NewTransaction(s.ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		if !req.AllowDuplicate {
+			var existing []*Artifact
+			if _, err := s.ds.GetAll(s.ctx, duplicateQuery(pkey, artifact).Transaction(t), &existing); err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				return retry.Fatal(status.Errorf(codes.AlreadyExists, "artifact %s at %s %s already has the same content - allow duplicates to copy anyway", existing[0].Uid, req.Path, architecture))
+			}
+		}
+
+		muts, err := s.deleteTagsMutation(t, pkey, artifact.Tag, actor, artifact.Created)
+		if err != nil {
+			return err
+		}
+		muts = append(muts, datastore.NewInsert(keyForArtifact(pkey), artifact))
+
+		if _, err := t.Mutate(muts...); err != nil {
+			return err
+		}
+		return Commit(&t)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &astore.CopyResponse{Path: keyToPath(pkey), Artifact: artifact.ToProto(architecture)}, nil
+}
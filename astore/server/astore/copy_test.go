@@ -0,0 +1,63 @@
+package astore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCopyArtifact(t *testing.T) {
+	now := time.Now()
+	source := &Artifact{
+		Uid:     "source-uid",
+		Sid:     "source-sid",
+		MD5:     []byte{1, 2, 3},
+		Size:    1024,
+		Tag:     []string{"latest", "stable"},
+		Parent:  "root/staging/kernel",
+		Creator: "alice@enkit.io",
+		Note:    "built from main",
+		History: []Change{{Field: FieldNote, Actor: "alice@enkit.io"}},
+	}
+
+	copied := copyArtifact(source, &apb.CopyRequest{Tag: []string{"release"}}, now)
+	assert.Equal(t, &Artifact{
+		Sid:     "source-sid",
+		MD5:     []byte{1, 2, 3},
+		Size:    1024,
+		Tag:     []string{"release", "latest"},
+		Created: now,
+	}, copied)
+
+	copied = copyArtifact(source, &apb.CopyRequest{Tag: []string{"release"}, KeepTags: true, KeepNote: true}, now)
+	assert.Equal(t, []string{"release", "latest", "stable"}, copied.Tag)
+	assert.Equal(t, "built from main", copied.Note)
+
+	// A note supplied with the request has precedence over the one of the source.
+	copied = copyArtifact(source, &apb.CopyRequest{Note: "promoted", KeepNote: true}, now)
+	assert.Equal(t, "promoted", copied.Note)
+	assert.Equal(t, []string{"latest"}, copied.Tag)
+	assert.Equal(t, []string{"latest", "stable"}, source.Tag)
+}
+
+func TestCopyErrors(t *testing.T) {
+	s, _ := serverForTest()
+
+	_, err := s.Copy(context.Background(), &apb.CopyRequest{Source: &apb.RetrieveRequest{Path: "staging/kernel"}, Path: "releases/kernel"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = s.Copy(userContext("alice"), &apb.CopyRequest{Path: "releases/kernel"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = s.Copy(userContext("alice"), &apb.CopyRequest{Source: &apb.RetrieveRequest{Path: "staging/kernel"}, Path: " "})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = s.Copy(userContext("alice"), &apb.CopyRequest{Source: &apb.RetrieveRequest{Architecture: "all"}, Path: "releases/kernel"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
+	"github.com/System233/enkit/astore/retention"
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/logger"
 	"golang.org/x/oauth2/google"
@@ -105,6 +107,61 @@ func WithPublishBaseURL(url string) Modifier {
 	}
 }
 
+// WithS3Storage stores artifacts in the bucket of an S3 compatible service, rather than in GCS.
+//
+// endpoint is the URL of the service, like https://s3.us-east-1.amazonaws.com,
+// region the region the requests are signed for.
+func WithS3Storage(endpoint, region string) Modifier {
+	return func(o *Options) error {
+		o.storage = StorageS3
+		o.s3.endpoint = endpoint
+		o.s3.region = region
+		return nil
+	}
+}
+
+// WithS3Credentials configures the access key used to sign S3 requests.
+//
+// If not specified, the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables are used.
+func WithS3Credentials(accessKeyID, secretAccessKey string) Modifier {
+	return func(o *Options) error {
+		o.s3.accessKeyID = accessKeyID
+		o.s3.secretAccessKey = secretAccessKey
+		return nil
+	}
+}
+
+// WithS3VirtualHost addresses the bucket as a subdomain of the S3 endpoint, rather than as the first element of the path.
+func WithS3VirtualHost(virtualHost bool) Modifier {
+	return func(o *Options) error {
+		o.s3.virtualHost = virtualHost
+		return nil
+	}
+}
+
+// WithLocalStorage stores artifacts in a directory of the local file system, rather than in GCS.
+//
+// Artifacts are uploaded and downloaded through the handler returned by
+// Server.BlobHandler, which must be reachable by clients at url.
+func WithLocalStorage(dir, url string) Modifier {
+	return func(o *Options) error {
+		o.storage = StorageLocal
+		o.local.dir = dir
+		o.local.url = url
+		return nil
+	}
+}
+
+// WithLocalTokenKey reads the key used to protect the URLs of the local storage from a file, generating it if necessary.
+//
+// Without a key file, URLs issued before a restart of the server are invalid.
+func WithLocalTokenKey(path string) Modifier {
+	return func(o *Options) error {
+		o.local.keyFile = path
+		return nil
+	}
+}
+
 func WithLogger(log logger.Logger) Modifier {
 	return func(o *Options) error {
 		o.logger = log
@@ -112,7 +169,172 @@ func WithLogger(log logger.Logger) Modifier {
 	}
 }
 
+// WithHistoryLimit sets how many note and tag changes are kept in the history of each artifact.
+//
+// Older changes are replaced by a marker counting them. Must be at least 2.
+func WithHistoryLimit(limit int) Modifier {
+	return func(o *Options) error {
+		if limit < 2 {
+			return kflags.NewUsageErrorf("invalid history limit %d - must keep at least 2 changes", limit)
+		}
+		o.historyLimit = limit
+		return nil
+	}
+}
+
+// WithListMaxResults sets the maximum number of sub paths and artifacts returned by a single List request.
+//
+// Clients retrieve further results with the page token returned. Must be at least 1.
+func WithListMaxResults(max int) Modifier {
+	return func(o *Options) error {
+		if max < 1 {
+			return kflags.NewUsageErrorf("invalid list max results %d - must be at least 1", max)
+		}
+		o.listMaxResults = max
+		return nil
+	}
+}
+
+// WithMetadataTimeout sets how long the metadata queries of a single request can take.
+//
+// Requests taking longer fail with DeadlineExceeded. 0 disables the timeout.
+func WithMetadataTimeout(timeout time.Duration) Modifier {
+	return func(o *Options) error {
+		if timeout < 0 {
+			return kflags.NewUsageErrorf("invalid metadata timeout %s - must be positive, or 0 to disable", timeout)
+		}
+		o.metadataTimeout = timeout
+		return nil
+	}
+}
+
+// WithSearchScanLimit sets the maximum number of artifacts examined by a single Search request.
+//
+// Requests examining more artifacts are truncated, and continued by the client
+// with the page token returned. Must be at least 1.
+func WithSearchScanLimit(limit int) Modifier {
+	return func(o *Options) error {
+		if limit < 1 {
+			return kflags.NewUsageErrorf("invalid search scan limit %d - must be at least 1", limit)
+		}
+		o.searchScanLimit = limit
+		return nil
+	}
+}
+
+// WithGCRules enables the generation of GC reports, describing the artifacts
+// the retention rules would collect. Nothing is ever deleted.
+//
+// Reports are generated by RunGCReports, and published with WithGCReport.
+func WithGCRules(rules *retention.Config) Modifier {
+	return func(o *Options) error {
+		if err := rules.Validate(); err != nil {
+			return kflags.NewUsageErrorf("invalid retention rules - %s", err)
+		}
+		o.gcRules = rules
+		return nil
+	}
+}
+
+// WithGCReport sets where to publish the GC reports: a local file, an astore path, or both.
+func WithGCReport(file, apath string) Modifier {
+	return func(o *Options) error {
+		o.gcReportFile = file
+		o.gcReportPath = apath
+		return nil
+	}
+}
+
+// WithGCStateFile sets the file storing the progress of GC reports.
+//
+// With a state file, a report interrupted by an error or a restart is resumed
+// rather than restarted, which matters for stores taking hours to scan.
+func WithGCStateFile(path string) Modifier {
+	return func(o *Options) error {
+		o.gcStateFile = path
+		return nil
+	}
+}
+
+// WithGCReportInterval sets how often a GC report is generated. Must be positive.
+func WithGCReportInterval(interval time.Duration) Modifier {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return kflags.NewUsageErrorf("invalid gc report interval %s - must be positive", interval)
+		}
+		o.gcReportInterval = interval
+		return nil
+	}
+}
+
+// WithGCBatchSize sets how many artifacts are read per query when generating a GC report. Must be at least 1.
+func WithGCBatchSize(size int) Modifier {
+	return func(o *Options) error {
+		if size < 1 {
+			return kflags.NewUsageErrorf("invalid gc batch size %d - must be at least 1", size)
+		}
+		o.gcBatchSize = size
+		return nil
+	}
+}
+
+// WithIdentityQuota limits the bytes each user can upload per day, UTC. 0 for unlimited.
+//
+// Uploads exceeding the quota fail with ResourceExhausted.
+func WithIdentityQuota(daily int64) Modifier {
+	return func(o *Options) error {
+		if daily < 0 {
+			return kflags.NewUsageErrorf("invalid daily quota %d - must be positive, or 0 for unlimited", daily)
+		}
+		o.quota.identityDaily = daily
+		return nil
+	}
+}
+
+// WithPathQuota limits the bytes that can be uploaded in total under a path prefix. 0 removes the limit.
+//
+// Uploads exceeding the quota fail with ResourceExhausted. Can be used
+// multiple times: uploads are accounted against all the prefixes of their path.
+func WithPathQuota(prefix string, total int64) Modifier {
+	return func(o *Options) error {
+		if total < 0 {
+			return kflags.NewUsageErrorf("invalid quota %d for %q - must be positive, or 0 for unlimited", total, prefix)
+		}
+		prefix = cleanQuotaPath(prefix)
+		if total == 0 {
+			delete(o.quota.prefixes, prefix)
+			return nil
+		}
+		if o.quota.prefixes == nil {
+			o.quota.prefixes = map[string]int64{}
+		}
+		o.quota.prefixes[prefix] = total
+		return nil
+	}
+}
+
+// WithAdmins configures the users allowed to invoke the AstoreAdmin RPCs, as a comma separated list of global names.
+func WithAdmins(raw string) Modifier {
+	return func(o *Options) error {
+		o.admins = nil
+		for _, admin := range strings.Split(raw, ",") {
+			if admin = strings.TrimSpace(admin); admin != "" {
+				o.admins = append(o.admins, admin)
+			}
+		}
+		return nil
+	}
+}
+
+const (
+	StorageGCS   = "gcs"
+	StorageS3    = "s3"
+	StorageLocal = "local"
+)
+
 type Flags struct {
+	Storage string
+
 	Bucket    string
 	ProjectID string
 
@@ -122,6 +344,32 @@ type Flags struct {
 	ProjectIDJSON       []byte
 	SigningConfigJSON   []byte
 	CredentialsFileJSON []byte
+
+	S3Endpoint        string
+	S3Region          string
+	S3AccessKeyID     string
+	S3SecretAccessKey []byte
+	S3VirtualHost     bool
+
+	LocalDir      string
+	LocalURL      string
+	LocalTokenKey string
+
+	HistoryLimit int
+
+	ListMaxResults  int
+	MetadataTimeout time.Duration
+	SearchScanLimit int
+
+	GCRules          string
+	GCReportFile     string
+	GCReportPath     string
+	GCStateFile      string
+	GCReportInterval time.Duration
+	GCBatchSize      int
+
+	QuotaIdentityDaily string
+	QuotaPaths         string
 }
 
 func WithFlags(flags *Flags) Modifier {
@@ -132,10 +380,90 @@ func WithFlags(flags *Flags) Modifier {
 		if len(flags.ProjectIDJSON) > 0 {
 			WithProjectIDJSON(flags.ProjectIDJSON)(o)
 		}
-		if flags.Bucket == "" {
-			return kflags.NewUsageErrorf("A bucket must be specified with the --bucket option")
+		switch flags.Storage {
+		case "", StorageGCS, StorageS3:
+			if flags.Bucket == "" {
+				return kflags.NewUsageErrorf("A bucket must be specified with the --bucket option")
+			}
+			WithBucket(flags.Bucket)(o)
+		case StorageLocal:
+		default:
+			return kflags.NewUsageErrorf("Invalid --storage %q - must be one of %s, %s or %s", flags.Storage, StorageGCS, StorageS3, StorageLocal)
+		}
+
+		if flags.Storage == StorageS3 {
+			if flags.S3Endpoint == "" {
+				return kflags.NewUsageErrorf("An endpoint must be specified with the --s3-endpoint option")
+			}
+			WithS3Storage(flags.S3Endpoint, flags.S3Region)(o)
+			WithS3Credentials(flags.S3AccessKeyID, strings.TrimSpace(string(flags.S3SecretAccessKey)))(o)
+			WithS3VirtualHost(flags.S3VirtualHost)(o)
+		}
+		if flags.Storage == StorageLocal {
+			if flags.LocalDir == "" {
+				return kflags.NewUsageErrorf("A directory must be specified with the --local-dir option")
+			}
+			if flags.LocalURL == "" {
+				return kflags.NewUsageErrorf("The URL of the local storage must be specified with the --local-url option")
+			}
+			WithLocalStorage(flags.LocalDir, flags.LocalURL)(o)
+			WithLocalTokenKey(flags.LocalTokenKey)(o)
+		}
+
+		if err := WithHistoryLimit(flags.HistoryLimit)(o); err != nil {
+			return err
+		}
+		if err := WithListMaxResults(flags.ListMaxResults)(o); err != nil {
+			return err
+		}
+		if err := WithMetadataTimeout(flags.MetadataTimeout)(o); err != nil {
+			return err
+		}
+		if err := WithSearchScanLimit(flags.SearchScanLimit)(o); err != nil {
+			return err
+		}
+
+		if flags.GCRules != "" {
+			rules, err := retention.LoadConfig(flags.GCRules)
+			if err != nil {
+				return kflags.NewUsageErrorf("invalid --gc-rules - %s", err)
+			}
+			if err := WithGCRules(rules)(o); err != nil {
+				return err
+			}
+			if flags.GCReportFile == "" && flags.GCReportPath == "" {
+				return kflags.NewUsageErrorf("with --gc-rules, one of --gc-report-file or --gc-report-path must be specified")
+			}
+			WithGCReport(flags.GCReportFile, flags.GCReportPath)(o)
+			WithGCStateFile(flags.GCStateFile)(o)
+			if err := WithGCReportInterval(flags.GCReportInterval)(o); err != nil {
+				return err
+			}
+			if err := WithGCBatchSize(flags.GCBatchSize)(o); err != nil {
+				return err
+			}
+		}
+
+		if flags.QuotaIdentityDaily != "" {
+			daily, err := parseQuotaBytes(flags.QuotaIdentityDaily)
+			if err != nil {
+				return kflags.NewUsageErrorf("invalid --quota-identity-daily - %s", err)
+			}
+			if err := WithIdentityQuota(daily)(o); err != nil {
+				return err
+			}
+		}
+		if flags.QuotaPaths != "" {
+			quotas, err := parsePathQuotas(flags.QuotaPaths)
+			if err != nil {
+				return kflags.NewUsageErrorf("invalid --quota-paths - %s", err)
+			}
+			for prefix, total := range quotas {
+				if err := WithPathQuota(prefix, total)(o); err != nil {
+					return err
+				}
+			}
 		}
-		WithBucket(flags.Bucket)(o)
 
 		WithPublishBaseURL(flags.PublishBaseURL)(o)
 		if flags.SignatureValidity != 0 {
@@ -162,13 +490,22 @@ func WithFlags(flags *Flags) Modifier {
 func DefaultFlags() *Flags {
 	options := DefaultOptions()
 	return &Flags{
+		Storage:           options.storage,
 		Bucket:            options.bucket,
 		ProjectID:         options.projectID,
 		SignatureValidity: options.expires,
+		S3Region:          "us-east-1",
+		HistoryLimit:      options.historyLimit,
+		ListMaxResults:    options.listMaxResults,
+		MetadataTimeout:   options.metadataTimeout,
+		SearchScanLimit:   options.searchScanLimit,
+		GCReportInterval:  options.gcReportInterval,
+		GCBatchSize:       options.gcBatchSize,
 	}
 }
 
 func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
+	set.StringVar(&f.Storage, prefix+"storage", f.Storage, "Where to store the artifacts - one of gcs, s3 or local. Metadata is always stored in datastore")
 	set.StringVar(&f.Bucket, prefix+"bucket", f.Bucket, "Datastore bucket where to store the artifacts")
 	set.StringVar(&f.ProjectID, prefix+"project-id", f.ProjectID, "Project id for datastore access")
 	set.StringVar(&f.PublishBaseURL, prefix+"publish-base-url", "", "URL prependend to published file paths, to turn them into downloadable URLs")
@@ -179,6 +516,44 @@ func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 		"Path to a signing config file - this is a normal credentials file containing a private_key. If not specified, defaults to the value of "+prefix+"credentials-file")
 	set.ByteFileVar(&f.CredentialsFileJSON, prefix+"credentials-file", "",
 		"Credentials file to use to authenticate against datastore and gcs")
+
+	set.StringVar(&f.S3Endpoint, prefix+"s3-endpoint", f.S3Endpoint, "With --storage=s3, URL of the S3 compatible service, like https://s3.us-east-1.amazonaws.com")
+	set.StringVar(&f.S3Region, prefix+"s3-region", f.S3Region, "With --storage=s3, region to sign the requests for")
+	set.StringVar(&f.S3AccessKeyID, prefix+"s3-access-key-id", f.S3AccessKeyID, "With --storage=s3, access key id to sign the requests with. Defaults to $AWS_ACCESS_KEY_ID")
+	set.ByteFileVar(&f.S3SecretAccessKey, prefix+"s3-secret-access-key-file", "",
+		"With --storage=s3, path to a file containing the secret access key to sign the requests with. Defaults to $AWS_SECRET_ACCESS_KEY")
+	set.BoolVar(&f.S3VirtualHost, prefix+"s3-virtual-host", f.S3VirtualHost,
+		"With --storage=s3, address the bucket as a subdomain of the endpoint, rather than as the first element of the path")
+
+	set.StringVar(&f.LocalDir, prefix+"local-dir", f.LocalDir, "With --storage=local, directory where to store the artifacts")
+	set.StringVar(&f.LocalURL, prefix+"local-url", f.LocalURL, "With --storage=local, URL clients can reach the upload and download handler at")
+	set.StringVar(&f.LocalTokenKey, prefix+"local-token-key", f.LocalTokenKey,
+		"With --storage=local, file containing the key protecting upload and download URLs, generated if it does not exist. "+
+			"If not specified, URLs become invalid when the server restarts")
+
+	set.IntVar(&f.HistoryLimit, prefix+"history-limit", f.HistoryLimit,
+		"How many note and tag changes to keep in the history of each artifact. Older changes are replaced by a marker counting them")
+	set.IntVar(&f.ListMaxResults, prefix+"list-max-results", f.ListMaxResults,
+		"Maximum number of paths and artifacts returned by a single list request. Clients retrieve the rest in further requests")
+	set.DurationVar(&f.MetadataTimeout, prefix+"metadata-timeout", f.MetadataTimeout,
+		"How long the metadata queries of a list or download request can take before failing. 0 to wait indefinitely")
+	set.IntVar(&f.SearchScanLimit, prefix+"search-scan-limit", f.SearchScanLimit,
+		"Maximum number of artifacts examined by a single search request. Clients continue longer searches in further requests")
+
+	set.StringVar(&f.GCRules, prefix+"gc-rules", f.GCRules,
+		"File with the retention rules, in any supported format. If set, a report of the artifacts the rules would collect is generated periodically - nothing is deleted")
+	set.StringVar(&f.GCReportFile, prefix+"gc-report-file", f.GCReportFile, "With --gc-rules, local file where to write the GC report")
+	set.StringVar(&f.GCReportPath, prefix+"gc-report-path", f.GCReportPath, "With --gc-rules, astore path where to store the GC report, like 'astore/gc-report.json'")
+	set.StringVar(&f.GCStateFile, prefix+"gc-state-file", f.GCStateFile,
+		"With --gc-rules, file storing the progress of the GC report, so an interrupted report is resumed after a restart")
+	set.DurationVar(&f.GCReportInterval, prefix+"gc-report-interval", f.GCReportInterval, "With --gc-rules, how often to generate the GC report")
+	set.IntVar(&f.GCBatchSize, prefix+"gc-batch-size", f.GCBatchSize, "With --gc-rules, how many artifacts to read per query when generating the GC report")
+
+	set.StringVar(&f.QuotaIdentityDaily, prefix+"quota-identity-daily", f.QuotaIdentityDaily,
+		"Maximum size each user can upload per day, UTC, like 500GB. Uploads exceeding it are rejected. Unlimited if not specified")
+	set.StringVar(&f.QuotaPaths, prefix+"quota-paths", f.QuotaPaths,
+		"Maximum size that can be uploaded in total under each path prefix, as a comma separated list like 'debug/symbols=1TB,ci=10TB'. "+
+			"Usage is persisted in datastore, and can be inspected and adjusted with the AstoreAdmin RPCs")
 	return f
 }
 
@@ -186,6 +561,10 @@ type Options struct {
 	projectID string
 	bucket    string
 
+	storage string
+	s3      s3Options
+	local   localOptions
+
 	publishBaseURL string
 
 	expires time.Duration
@@ -193,6 +572,24 @@ type Options struct {
 
 	logger logger.Logger
 
+	historyLimit int
+
+	listMaxResults  int
+	metadataTimeout time.Duration
+	searchScanLimit int
+
+	// Retention rules, nil if GC reports are disabled.
+	gcRules          *retention.Config
+	gcReportFile     string
+	gcReportPath     string
+	gcStateFile      string
+	gcReportInterval time.Duration
+	gcBatchSize      int
+
+	quota quotaOptions
+	// Users allowed to invoke the AstoreAdmin RPCs.
+	admins []string
+
 	clientOptions []option.ClientOption
 }
 
@@ -200,9 +597,19 @@ func DefaultOptions() Options {
 	return Options{
 		projectID: datastore.DetectProjectID,
 		bucket:    "artifacts",
+		storage:   StorageGCS,
 
 		expires: time.Hour * 24,
 		logger:  &logger.NilLogger{},
+
+		historyLimit: DefaultHistoryLimit,
+
+		listMaxResults:  DefaultListMaxResults,
+		metadataTimeout: DefaultMetadataTimeout,
+		searchScanLimit: DefaultSearchScanLimit,
+
+		gcReportInterval: DefaultGCReportInterval,
+		gcBatchSize:      DefaultGCBatchSize,
 	}
 }
 
@@ -221,14 +628,33 @@ func New(rng *rand.Rand, mods ...Modifier) (*Server, error) {
 		}
 	}
 
-	if options.bucket == "" {
+	if options.bucket == "" && options.storage != StorageLocal {
 		return nil, fmt.Errorf("incorrect API usage - need to provide a bucket with WithBucket")
 	}
 
 	ctx := context.Background()
-	gcs, err := storage.NewClient(ctx, options.clientOptions...)
-	if err != nil {
-		return nil, err
+	var blobs BlobStore
+	switch options.storage {
+	case StorageGCS:
+		gcs, err := storage.NewClient(ctx, options.clientOptions...)
+		if err != nil {
+			return nil, err
+		}
+		blobs = &gcsBlobStore{bucket: options.bucket, bkt: gcs.Bucket(options.bucket), signing: options.ForSigning}
+	case StorageS3:
+		s3, err := newS3BlobStore(options.bucket, options.s3, options.expires)
+		if err != nil {
+			return nil, err
+		}
+		blobs = s3
+	case StorageLocal:
+		local, err := newLocalBlobStore(rng, options.local, options.expires)
+		if err != nil {
+			return nil, err
+		}
+		blobs = local
+	default:
+		return nil, fmt.Errorf("incorrect API usage - unknown storage %q", options.storage)
 	}
 
 	ds, err := datastore.NewClient(ctx, options.projectID, options.clientOptions...)
@@ -236,14 +662,11 @@ func New(rng *rand.Rand, mods ...Modifier) (*Server, error) {
 		return nil, err
 	}
 
-	bkt := gcs.Bucket(options.bucket)
-
 	server := &Server{
 		rng: rng,
 		ctx: ctx,
 
-		gcs: gcs,
-		bkt: bkt,
+		blobs: blobs,
 
 		ds: ds,
 
@@ -0,0 +1,295 @@
+package astore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/System233/enkit/astore/retention"
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultGCBatchSize is the number of artifacts read per query when generating a GC report.
+	DefaultGCBatchSize = 500
+	// DefaultGCReportInterval is how often a GC report is generated, unless configured otherwise.
+	DefaultGCReportInterval = 7 * 24 * time.Hour
+	// GCReportCreator is the creator of the GC reports stored in astore.
+	GCReportCreator = "astore-gc"
+)
+
+var (
+	metricGCReportCandidates = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "astore",
+		Name:      "gc_report_candidates",
+		Help:      "Number of artifacts the retention rules would collect, as of the last complete GC report",
+	})
+	metricGCReportReclaim = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "astore",
+		Name:      "gc_report_reclaim_bytes",
+		Help:      "Bytes the retention rules would reclaim, as of the last complete GC report",
+	})
+	metricGCReportScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "astore",
+		Name:      "gc_report_scanned_total",
+		Help:      "Number of artifacts examined to generate GC reports",
+	})
+)
+
+// gcState is the progress of GC reports, stored in the state file after each batch.
+type gcState struct {
+	// When the last report was completed, zero if never.
+	Completed time.Time `json:"completed"`
+
+	// Encoded key of the last artifact of the last path and architecture
+	// added to Report. Empty if no artifact was added yet.
+	Cursor string `json:"cursor"`
+	// Report being generated, nil if none is in progress.
+	Report *retention.Report `json:"report"`
+}
+
+func (s *Server) loadGCState() (*gcState, error) {
+	state := &gcState{}
+	if s.options.gcStateFile == "" {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(s.options.gcStateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid GC state file %s - %w", s.options.gcStateFile, err)
+	}
+	return state, nil
+}
+
+func (s *Server) saveGCState(state *gcState) error {
+	if s.options.gcStateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.options.gcStateFile, data)
+}
+
+// writeFileAtomic replaces the file at path with data, creating its directory if necessary.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
+
+// GCReport scans all the artifacts in the store, and returns the report of
+// those the retention rules would collect. Nothing is deleted.
+//
+// Artifacts are read in batches, ordered by key, so all the versions of a
+// path and architecture are read one after the other. If a state file is
+// configured, the progress is stored after each batch, and a report
+// interrupted by an error or a restart is resumed where it stopped, as long
+// as the rules did not change.
+func (s *Server) GCReport(ctx context.Context) (*retention.Report, error) {
+	rules := s.options.gcRules
+	if rules == nil {
+		return nil, fmt.Errorf("no retention rules configured")
+	}
+	batch := s.options.gcBatchSize
+	if batch <= 0 {
+		batch = DefaultGCBatchSize
+	}
+
+	state, err := s.loadGCState()
+	if err != nil {
+		s.options.logger.Warnf("Starting a new GC report - %s", err)
+		state = &gcState{}
+	}
+	var after *datastore.Key
+	if state.Report != nil && reflect.DeepEqual(state.Report.Rules, rules.Rules) {
+		if state.Cursor != "" {
+			if after, err = datastore.DecodeKey(state.Cursor); err != nil {
+				return nil, fmt.Errorf("invalid cursor in GC state file %s - %w", s.options.gcStateFile, err)
+			}
+		}
+		s.options.logger.Infof("Resuming the GC report started at %s", state.Report.Started.Format(time.RFC3339))
+	} else {
+		state.Report, state.Cursor = retention.NewReport(rules, time.Now()), ""
+	}
+
+	// Versions of the path and architecture being read, possibly spanning batches.
+	var versions []retention.Artifact
+	var parent, last *datastore.Key
+	for {
+		query := datastore.NewQuery(KindArtifact).Order("__key__").Limit(batch)
+		if after != nil {
+			query = query.Filter("__key__ >", after)
+		}
+		var artifacts []*Artifact
+		keys, err := s.ds.GetAll(ctx, query, &artifacts)
+		if err != nil {
+			return nil, s.backendError("GCReport", err)
+		}
+		metricGCReportScanned.Add(float64(len(artifacts)))
+
+		for ix, art := range artifacts {
+			key := keys[ix]
+			if parent != nil && !key.Parent.Equal(parent) {
+				state.Report.Add(versions)
+				state.Cursor = last.Encode()
+				versions = nil
+			}
+			parent, last = key.Parent, key
+			versions = append(versions, retention.Artifact{
+				Path:         keyToPath(key),
+				Architecture: keyToArchitecture(key),
+				Uid:          art.Uid,
+				Size:         art.Size,
+				Created:      art.Created,
+				Tags:         art.Tag,
+			})
+		}
+		if len(artifacts) < batch {
+			break
+		}
+		after = keys[len(keys)-1]
+		if err := s.saveGCState(state); err != nil {
+			return nil, fmt.Errorf("could not store the progress of the GC report - %w", err)
+		}
+	}
+	state.Report.Add(versions)
+	state.Report.Finish(time.Now())
+
+	report := state.Report
+	summary := report.Summary()
+	metricGCReportCandidates.Set(float64(summary.Candidates))
+	metricGCReportReclaim.Set(float64(summary.Reclaim))
+
+	if err := s.saveGCState(&gcState{Completed: report.Finished}); err != nil {
+		s.options.logger.Warnf("Could not store the completion of the GC report - %s", err)
+	}
+	return report, nil
+}
+
+// PublishGCReport writes the report to the configured file and astore path.
+func (s *Server) PublishGCReport(ctx context.Context, report *retention.Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.options.gcReportFile != "" {
+		if err := writeFileAtomic(s.options.gcReportFile, data); err != nil {
+			return fmt.Errorf("could not write GC report to %s - %w", s.options.gcReportFile, err)
+		}
+	}
+	if s.options.gcReportPath != "" {
+		summary := report.Summary()
+		note := fmt.Sprintf("GC dry-run report - %d of %d artifacts would be collected, reclaiming %d of %d bytes",
+			summary.Candidates, summary.Artifacts, summary.Reclaim, summary.Bytes)
+		if err := s.storeBlob(ctx, s.options.gcReportPath, note, data); err != nil {
+			return fmt.Errorf("could not store GC report in %s - %w", s.options.gcReportPath, err)
+		}
+	}
+	return nil
+}
+
+// storeBlob uploads data, and commits it as the latest artifact at apath.
+func (s *Server) storeBlob(ctx context.Context, apath, note string, data []byte) error {
+	sid, err := GenerateSid(s.rng)
+	if err != nil {
+		return err
+	}
+	url, err := s.blobs.UploadURL(objectPath(sid))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload failed with status %s", resp.Status)
+	}
+
+	_, err = s.commit(GCReportCreator, &astore.CommitRequest{Sid: sid, Path: apath, Note: note})
+	return err
+}
+
+// GCEnabled returns true if retention rules are configured, and RunGCReports should run.
+func (s *Server) GCEnabled() bool {
+	return s.options.gcRules != nil
+}
+
+// RunGCReports generates and publishes a GC report every configured interval, until ctx is done.
+//
+// The time of the last report is kept in the state file, so restarting the
+// server does not delay the next report, nor generate one early. A report
+// interrupted by a restart is resumed immediately.
+func (s *Server) RunGCReports(ctx context.Context) {
+	interval := s.options.gcReportInterval
+	if interval <= 0 {
+		interval = DefaultGCReportInterval
+	}
+	var completed time.Time
+	for {
+		state, err := s.loadGCState()
+		if err != nil {
+			state = &gcState{}
+		}
+		if state.Completed.After(completed) {
+			completed = state.Completed
+		}
+		var wait time.Duration
+		if state.Report == nil && !completed.IsZero() {
+			wait = time.Until(completed.Add(interval))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		report, err := s.GCReport(ctx)
+		if err == nil {
+			err = s.PublishGCReport(ctx, report)
+		}
+		if err != nil {
+			s.options.logger.Errorf("GC report failed - %s - retrying in %s", err, interval/10)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval / 10):
+			}
+			continue
+		}
+		completed = report.Finished
+		summary := report.Summary()
+		s.options.logger.Infof("GC report completed - %d of %d artifacts would be collected, reclaiming %d of %d bytes",
+			summary.Candidates, summary.Artifacts, summary.Reclaim, summary.Bytes)
+	}
+}
@@ -0,0 +1,207 @@
+package astore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/astore/retention"
+	"github.com/System233/enkit/lib/logger"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	dpb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// gcDatastore returns its artifacts in the order they were added, honoring
+// the __key__ > filter and the limit of the queries.
+type gcDatastore struct {
+	testDatastore
+
+	keys      []*datastore.Key
+	artifacts []*Artifact
+
+	// If not 0, GetAll fails once called this many times.
+	failAt int
+	calls  int
+	// Artifacts returned by GetAll, across all calls.
+	returned int
+}
+
+// add stores an artifact created days ago. All the versions of a path and architecture must be added one after the other.
+func (d *gcDatastore) add(path, arch string, days int, size int64, tags ...string) {
+	_, pkey, _ := keyFromPath(path, arch)
+	d.keys = append(d.keys, datastore.IDKey(KindArtifact, int64(len(d.keys)+1), pkey))
+	d.artifacts = append(d.artifacts, &Artifact{
+		Uid:     fmt.Sprintf("uid%02d", len(d.artifacts)),
+		Tag:     tags,
+		Size:    size,
+		Created: time.Now().Add(-time.Duration(days) * 24 * time.Hour),
+	})
+}
+
+// keyMatches returns true if the proto key pk identifies key.
+func keyMatches(key *datastore.Key, pk *dpb.Key) bool {
+	elements := pk.GetPath()
+	for ix := len(elements) - 1; ix >= 0; ix, key = ix-1, key.Parent {
+		el := elements[ix]
+		if key == nil || key.Kind != el.GetKind() || key.Name != el.GetName() || key.ID != el.GetId() {
+			return false
+		}
+	}
+	return key == nil
+}
+
+func (d *gcDatastore) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	d.calls++
+	if d.failAt != 0 && d.calls >= d.failAt {
+		return nil, fmt.Errorf("datastore unavailable")
+	}
+
+	req := dpb.RunQueryRequest{}
+	if err := q.ToProto(&req); err != nil {
+		return nil, err
+	}
+	query := req.GetQuery()
+	start := 0
+	if filter := query.GetFilter().GetPropertyFilter(); filter.GetProperty().GetName() == "__key__" {
+		for ix, key := range d.keys {
+			if keyMatches(key, filter.GetValue().GetKeyValue()) {
+				start = ix + 1
+			}
+		}
+	}
+	end := start + int(query.GetLimit().GetValue())
+
+	artifacts := dst.(*[]*Artifact)
+	var keys []*datastore.Key
+	for ix := start; ix < end && ix < len(d.artifacts); ix++ {
+		*artifacts = append(*artifacts, d.artifacts[ix])
+		keys = append(keys, d.keys[ix])
+	}
+	d.returned += len(keys)
+	return keys, nil
+}
+
+func newGCDatastore() *gcDatastore {
+	ds := &gcDatastore{}
+	ds.add("experiments/x", "all", 3, 7)
+	ds.add("experiments/x", "all", 8, 8)
+	ds.add("images/base", "all", 100, 5000)
+	ds.add("tools/astore", "amd64-linux", 1, 100, "latest")
+	ds.add("tools/astore", "amd64-linux", 10, 100)
+	ds.add("tools/astore", "amd64-linux", 20, 100)
+	ds.add("tools/astore", "amd64-linux", 40, 100, "stable")
+	ds.add("tools/astore", "arm64-linux", 50, 1000, "latest")
+	ds.add("tools/enkit", "amd64-linux", 5, 10, "latest")
+	ds.add("tools/enkit", "amd64-linux", 35, 20)
+	ds.add("tools/enkit", "amd64-linux", 60, 30)
+	return ds
+}
+
+var gcRules = &retention.Config{Rules: []retention.Rule{
+	{Name: "tools", Prefix: "tools", KeepLast: 2, KeepTags: []string{"stable"}},
+	{Name: "tools-enkit", Prefix: "tools/enkit", KeepLast: 1, MaxAgeDays: 30},
+	{Name: "experiments", Prefix: "experiments/", MaxAgeDays: 7},
+}}
+
+func gcServerForTest(t *testing.T, ds *gcDatastore, mods ...Modifier) *Server {
+	options := DefaultOptions()
+	options.logger = logger.Nil
+	for _, mod := range append([]Modifier{WithGCRules(gcRules), WithGCBatchSize(3)}, mods...) {
+		assert.NoError(t, mod(&options))
+	}
+	return &Server{ctx: context.Background(), ds: ds, options: options}
+}
+
+// candidates returns the uids of the candidates of each rule.
+func candidates(report *retention.Report) map[string][]string {
+	result := map[string][]string{}
+	for _, prefix := range report.Prefixes {
+		result[prefix.Rule] = []string{}
+		for _, candidate := range prefix.Candidates {
+			result[prefix.Rule] = append(result[prefix.Rule], candidate.Uid)
+		}
+	}
+	return result
+}
+
+func TestGCReport(t *testing.T) {
+	ds := newGCDatastore()
+	s := gcServerForTest(t, ds)
+
+	report, err := s.GCReport(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, report.Complete())
+
+	// The most specific rule wins, tags and the most recent versions are kept.
+	assert.Equal(t, map[string][]string{
+		"tools":       {"uid05"},
+		"tools-enkit": {"uid09", "uid10"},
+		"experiments": {"uid01"},
+	}, candidates(report))
+	assert.Equal(t, "older than 30 days, not among the 1 most recent", report.Prefixes[1].Candidates[0].Reason)
+	assert.Equal(t, "tools/enkit", report.Prefixes[1].Candidates[0].Path)
+	assert.Equal(t, "amd64-linux", report.Prefixes[1].Candidates[0].Architecture)
+
+	assert.Equal(t, 5, report.Prefixes[0].Artifacts)
+	assert.Equal(t, int64(1400), report.Prefixes[0].Bytes)
+	assert.Equal(t, int64(100), report.Prefixes[0].Reclaim)
+	assert.Equal(t, int64(50), report.Prefixes[1].Reclaim)
+	assert.Equal(t, 1, report.Unmatched)
+	assert.Equal(t, int64(5000), report.UnmatchedBytes)
+
+	summary := report.Summary()
+	assert.Equal(t, 11, summary.Artifacts)
+	assert.Equal(t, int64(6475), summary.Bytes)
+	assert.Equal(t, 4, summary.Candidates)
+	assert.Equal(t, int64(158), summary.Reclaim)
+	assert.InDelta(t, 2.44, summary.ReclaimPercent, 0.01)
+}
+
+func TestGCReportResume(t *testing.T) {
+	dir := t.TempDir()
+	reference, err := gcServerForTest(t, newGCDatastore()).GCReport(context.Background())
+	assert.NoError(t, err)
+
+	// The backend fails while reading the third batch.
+	ds := newGCDatastore()
+	ds.failAt = 3
+	s := gcServerForTest(t, ds, WithGCStateFile(filepath.Join(dir, "state.json")), WithGCReport(filepath.Join(dir, "report.json"), ""))
+	_, err = s.GCReport(context.Background())
+	assert.Error(t, err)
+
+	state, err := s.loadGCState()
+	assert.NoError(t, err)
+	assert.NotNil(t, state.Report)
+	assert.NotEqual(t, "", state.Cursor)
+	assert.False(t, state.Report.Complete())
+	started := state.Report.Started
+
+	// Once the backend is back, the report is resumed from the last complete path and architecture.
+	ds.failAt, ds.returned = 0, 0
+	report, err := s.GCReport(context.Background())
+	assert.NoError(t, err)
+	assert.Less(t, ds.returned, len(ds.artifacts))
+	assert.True(t, started.Equal(report.Started))
+	assert.Equal(t, candidates(reference), candidates(report))
+	assert.Equal(t, reference.Summary(), report.Summary())
+
+	// The state only records the completion, the next report starts from scratch.
+	state, err = s.loadGCState()
+	assert.NoError(t, err)
+	assert.Nil(t, state.Report)
+	assert.True(t, report.Finished.Equal(state.Completed))
+
+	assert.NoError(t, s.PublishGCReport(context.Background(), report))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "report.json"))
+	assert.NoError(t, err)
+	published := &retention.Report{}
+	assert.NoError(t, json.Unmarshal(data, published))
+	assert.Equal(t, report.Summary(), published.Summary())
+	assert.Equal(t, candidates(report), candidates(published))
+}
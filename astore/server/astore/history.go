@@ -0,0 +1,127 @@
+package astore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/oauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Fields of an artifact whose changes are recorded in its History.
+const (
+	FieldNote = "note"
+	FieldTag  = "tag"
+	// Marker replacing the oldest changes once the history exceeds the limit.
+	FieldTruncated = "truncated"
+)
+
+// DefaultHistoryLimit is the number of changes kept in the History of an artifact, unless configured otherwise.
+const DefaultHistoryLimit = 50
+
+// Change records a change to the metadata of an artifact.
+//
+// Datastore does not allow slices within slices of structs, so tags are
+// stored comma separated.
+type Change struct {
+	Field string
+	Actor string
+	Time  time.Time
+
+	Old string
+	New string
+
+	// For FieldTruncated markers, the number of changes dropped.
+	Dropped int64
+}
+
+func joinTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
+
+func (c *Change) ToProto() *astore.MetadataChange {
+	change := &astore.MetadataChange{
+		Actor:     c.Actor,
+		Timestamp: c.Time.UnixNano(),
+	}
+	switch c.Field {
+	case FieldNote:
+		change.Field = astore.MetadataChange_NOTE
+		change.OldNote = c.Old
+		change.NewNote = c.New
+	case FieldTag:
+		change.Field = astore.MetadataChange_TAG
+		change.OldTag = splitTags(c.Old)
+		change.NewTag = splitTags(c.New)
+	case FieldTruncated:
+		change.Field = astore.MetadataChange_TRUNCATED
+		change.Dropped = c.Dropped
+	}
+	return change
+}
+
+// record appends a change to the History, keeping at most limit entries.
+//
+// When the limit is exceeded, the oldest changes are replaced by a single
+// FieldTruncated marker, counting all the changes dropped so far.
+func (af *Artifact) record(limit int, change Change) {
+	af.History = append(af.History, change)
+	if limit <= 0 || len(af.History) <= limit {
+		return
+	}
+
+	marker := Change{Field: FieldTruncated, Time: change.Time}
+	history := af.History
+	if history[0].Field == FieldTruncated {
+		marker.Dropped = history[0].Dropped
+		history = history[1:]
+	}
+	// Keep the latest limit-1 changes, leaving room for the marker.
+	keep := limit - 1
+	dropped := history[:len(history)-keep]
+	marker.Dropped += int64(len(dropped))
+
+	af.History = append([]Change{marker}, history[len(history)-keep:]...)
+}
+
+// SetNote changes the note of the artifact, recording the change in its History.
+//
+// Setting the same note again is not recorded.
+func (af *Artifact) SetNote(actor string, now time.Time, note string, limit int) {
+	if af.Note == note {
+		return
+	}
+	af.record(limit, Change{Field: FieldNote, Actor: actor, Time: now, Old: af.Note, New: note})
+	af.Note = note
+}
+
+// SetTags changes the tags of the artifact, recording the change in its History.
+//
+// Setting the same tags again is not recorded.
+func (af *Artifact) SetTags(actor string, now time.Time, tags []string, limit int) {
+	if joinTags(af.Tag) == joinTags(tags) {
+		af.Tag = tags
+		return
+	}
+	af.record(limit, Change{Field: FieldTag, Actor: actor, Time: now, Old: joinTags(af.Tag), New: joinTags(tags)})
+	af.Tag = tags
+}
+
+// requestActor returns the name of the authenticated user performing the request, to attribute changes to.
+func requestActor(ctx context.Context) (string, error) {
+	creds := oauth.GetCredentials(ctx)
+	if creds == nil {
+		return "", status.Errorf(codes.Unauthenticated, "no credentials supplied - metadata changes must be attributed to a user")
+	}
+	return creds.Identity.GlobalName(), nil
+}
@@ -0,0 +1,96 @@
+package astore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/oauth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHistory(t *testing.T) {
+	start := time.Unix(1000, 0)
+	art := &Artifact{Uid: "uid", Tag: []string{"latest"}, Note: "first upload"}
+
+	art.SetNote("alice@enkit.io", start, "broken, do not use", 10)
+	art.SetTags("bob@enkit.io", start.Add(time.Second), []string{"latest", "stable"}, 10)
+	// No-op changes are not recorded.
+	art.SetNote("bob@enkit.io", start.Add(2*time.Second), "broken, do not use", 10)
+	art.SetTags("bob@enkit.io", start.Add(2*time.Second), []string{"latest", "stable"}, 10)
+	// The tag moved to a newer upload.
+	art.SetTags("carl@enkit.io", start.Add(3*time.Second), []string{"stable"}, 10)
+	art.SetNote("alice@enkit.io", start.Add(4*time.Second), "", 10)
+
+	assert.Equal(t, "", art.Note)
+	assert.Equal(t, []string{"stable"}, art.Tag)
+	assert.Equal(t, []Change{
+		{Field: FieldNote, Actor: "alice@enkit.io", Time: start, Old: "first upload", New: "broken, do not use"},
+		{Field: FieldTag, Actor: "bob@enkit.io", Time: start.Add(time.Second), Old: "latest", New: "latest,stable"},
+		{Field: FieldTag, Actor: "carl@enkit.io", Time: start.Add(3 * time.Second), Old: "latest,stable", New: "stable"},
+		{Field: FieldNote, Actor: "alice@enkit.io", Time: start.Add(4 * time.Second), Old: "broken, do not use", New: ""},
+	}, art.History)
+
+	assert.Equal(t, []*astore.MetadataChange{
+		{Field: astore.MetadataChange_NOTE, Actor: "alice@enkit.io", Timestamp: start.UnixNano(), OldNote: "first upload", NewNote: "broken, do not use"},
+		{Field: astore.MetadataChange_TAG, Actor: "bob@enkit.io", Timestamp: start.Add(time.Second).UnixNano(), OldTag: []string{"latest"}, NewTag: []string{"latest", "stable"}},
+		{Field: astore.MetadataChange_TAG, Actor: "carl@enkit.io", Timestamp: start.Add(3 * time.Second).UnixNano(), OldTag: []string{"latest", "stable"}, NewTag: []string{"stable"}},
+		{Field: astore.MetadataChange_NOTE, Actor: "alice@enkit.io", Timestamp: start.Add(4 * time.Second).UnixNano(), OldNote: "broken, do not use"},
+	}, art.ToProto("amd64").History)
+}
+
+func TestHistoryLimit(t *testing.T) {
+	start := time.Unix(1000, 0)
+	art := &Artifact{Uid: "uid"}
+
+	notes := []string{"one", "two", "three", "four", "five", "six", "seven"}
+	for ix, note := range notes[:4] {
+		art.SetNote("alice@enkit.io", start.Add(time.Duration(ix)*time.Second), note, 4)
+	}
+	assert.Equal(t, 4, len(art.History))
+	assert.Equal(t, FieldNote, art.History[0].Field)
+
+	// The oldest 2 changes are replaced by a marker, to make room for the new one.
+	art.SetNote("bob@enkit.io", start.Add(4*time.Second), notes[4], 4)
+	assert.Equal(t, []Change{
+		{Field: FieldTruncated, Time: start.Add(4 * time.Second), Dropped: 2},
+		{Field: FieldNote, Actor: "alice@enkit.io", Time: start.Add(2 * time.Second), Old: "two", New: "three"},
+		{Field: FieldNote, Actor: "alice@enkit.io", Time: start.Add(3 * time.Second), Old: "three", New: "four"},
+		{Field: FieldNote, Actor: "bob@enkit.io", Time: start.Add(4 * time.Second), Old: "four", New: "five"},
+	}, art.History)
+
+	// The marker keeps counting all the changes dropped.
+	art.SetNote("bob@enkit.io", start.Add(5*time.Second), notes[5], 4)
+	art.SetNote("bob@enkit.io", start.Add(6*time.Second), notes[6], 4)
+	assert.Equal(t, 4, len(art.History))
+	assert.Equal(t, Change{Field: FieldTruncated, Time: start.Add(6 * time.Second), Dropped: 4}, art.History[0])
+	assert.Equal(t, "six", art.History[3].Old)
+	assert.Equal(t, "seven", art.History[3].New)
+
+	converted := art.ToProto("")
+	assert.Equal(t, &astore.MetadataChange{Field: astore.MetadataChange_TRUNCATED, Timestamp: start.Add(6 * time.Second).UnixNano(), Dropped: 4}, converted.History[0])
+
+	assert.NotNil(t, WithHistoryLimit(1)(&Options{}))
+}
+
+func TestRequestActor(t *testing.T) {
+	_, err := requestActor(context.Background())
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: "alice", Organization: "enkit.io"},
+	})
+	actor, err := requestActor(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice@enkit.io", actor)
+
+	// Attribution is required to change metadata.
+	server, _ := serverForTest()
+	_, err = server.Note(context.Background(), &astore.NoteRequest{Uid: "uid", Note: "note"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = server.Tag(context.Background(), &astore.TagRequest{Uid: "uid", Add: &astore.TagSet{Tag: []string{"stable"}}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
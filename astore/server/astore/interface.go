@@ -19,9 +19,16 @@ type Artifact struct {
 	Creator string
 	Created time.Time
 	Note    string `datastore:",noindex"`
+
+	// Changes to Note and Tag, oldest first. See SetNote and SetTags.
+	History []Change `datastore:",noindex"`
 }
 
 func (af *Artifact) ToProto(arch string) *astore.Artifact {
+	var history []*astore.MetadataChange
+	for _, change := range af.History {
+		history = append(history, change.ToProto())
+	}
 	return &astore.Artifact{
 		Uid:          af.Uid,
 		Sid:          af.Sid,
@@ -32,6 +39,7 @@ func (af *Artifact) ToProto(arch string) *astore.Artifact {
 		Creator:      af.Creator,
 		Created:      af.Created.UnixNano(),
 		Note:         af.Note,
+		History:      history,
 	}
 }
 
@@ -121,3 +129,19 @@ func (pub *Published) ToListRequest() *astore.ListRequest {
 
 	return req
 }
+
+const KindQuota = "Quota"
+
+// Quota is the usage of an upload quota, see quota.go.
+type Quota struct {
+	// Name of the astore.Quota_Kind of the quota.
+	Kind string
+	// Global name of the user, or path prefix, the quota applies to.
+	Name string
+
+	// Bytes uploaded since WindowStart.
+	Used int64
+	// Start of the day Used refers to, for IDENTITY quotas. Zero otherwise.
+	WindowStart time.Time
+	Updated     time.Time
+}
@@ -0,0 +1,101 @@
+package astore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultListMaxResults is the maximum number of results of a List request, unless configured otherwise.
+	DefaultListMaxResults = 1000
+	// DefaultMetadataTimeout is how long the metadata queries of a request can take, unless configured otherwise.
+	DefaultMetadataTimeout = 30 * time.Second
+)
+
+var (
+	metricListTruncated = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "astore",
+		Name:      "list_truncated_total",
+		Help:      "Number of List requests returning only part of the results, with a next page token",
+	})
+	metricTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "astore",
+		Name:      "metadata_timeouts_total",
+		Help:      "Number of requests failed as the metadata backend did not complete within the deadline, by rpc",
+	}, []string{"rpc"})
+)
+
+// listLimit returns the maximum number of results a List request can return.
+//
+// Clients can request fewer results than the limit configured on the server, not more.
+func (s *Server) listLimit(requested int32) int {
+	limit := s.options.listMaxResults
+	if limit <= 0 {
+		limit = DefaultListMaxResults
+	}
+	if requested > 0 && int(requested) < limit {
+		return int(requested)
+	}
+	return limit
+}
+
+// listPage is the position a List request continues from, serialized in the page token.
+//
+// List returns the sub paths first, and then the artifacts: the position is
+// the number of each already returned in previous pages.
+type listPage struct {
+	elements  int
+	artifacts int
+}
+
+func (lp listPage) Token() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", lp.elements, lp.artifacts)))
+}
+
+func parsePageToken(token string) (listPage, error) {
+	var page listPage
+	if token == "" {
+		return page, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return page, err
+	}
+	if _, err := fmt.Sscanf(string(data), "%d:%d", &page.elements, &page.artifacts); err != nil {
+		return page, err
+	}
+	if page.elements < 0 || page.artifacts < 0 {
+		return page, fmt.Errorf("negative offset")
+	}
+	return page, nil
+}
+
+// backendContext returns the context to use for the metadata queries of a request.
+//
+// The context is canceled when the request is, or once the metadata timeout
+// configured expires, so a slow query cannot hold the backend indefinitely.
+func (s *Server) backendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.options.metadataTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.options.metadataTimeout)
+}
+
+// backendError turns a deadline exceeded while querying the metadata into a gRPC status, counting it.
+//
+// Other errors are returned unchanged.
+func (s *Server) backendError(rpc string, err error) error {
+	if !errors.Is(err, context.DeadlineExceeded) && status.Code(err) != codes.DeadlineExceeded {
+		return err
+	}
+	metricTimeouts.WithLabelValues(rpc).Inc()
+	return status.Errorf(codes.DeadlineExceeded, "%s did not complete within %s - try a more specific request", rpc, s.options.metadataTimeout)
+}
@@ -0,0 +1,173 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+
+	"cloud.google.com/go/datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	dpb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hugeDatastore simulates a path with many sub paths and artifacts, served by a slow backend.
+type hugeDatastore struct {
+	testDatastore
+
+	elements  int
+	artifacts int
+	delay     time.Duration
+}
+
+func (d *hugeDatastore) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	d.queries = append(d.queries, q)
+	select {
+	case <-time.After(d.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	req := dpb.RunQueryRequest{}
+	if err := q.ToProto(&req); err != nil {
+		return nil, err
+	}
+	query := req.GetQuery()
+	start := int(query.GetOffset())
+	end := start + int(query.GetLimit().GetValue())
+
+	var keys []*datastore.Key
+	switch query.GetKind()[0].GetName() {
+	case KindPathElement:
+		elements := dst.(*[]*PathElement)
+		for ix := start; ix < end && ix < d.elements; ix++ {
+			*elements = append(*elements, &PathElement{Creator: "tester"})
+			keys = append(keys, datastore.NameKey(KindPathElement, fmt.Sprintf("dir%03d", ix), nil))
+		}
+	case KindArtifact:
+		artifacts := dst.(*[]*Artifact)
+		for ix := start; ix < end && ix < d.artifacts; ix++ {
+			*artifacts = append(*artifacts, &Artifact{Uid: fmt.Sprintf("uid%03d", ix)})
+			keys = append(keys, datastore.IDKey(KindArtifact, int64(ix+1), nil))
+		}
+	}
+	return keys, nil
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, c.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+// listAll lists the test path, following the page tokens, and returns the names of the elements
+// and uids of the artifacts in the order they were returned, and the number of pages.
+func listAll(t *testing.T, s *Server, req *apb.ListRequest) ([]string, int) {
+	var names []string
+	pages := 0
+	for {
+		resp, err := s.List(context.Background(), req)
+		assert.Nil(t, err)
+		if err != nil {
+			return names, pages
+		}
+		pages++
+		for _, el := range resp.Element {
+			names = append(names, el.Name)
+		}
+		for _, art := range resp.Artifact {
+			names = append(names, art.Uid)
+		}
+		assert.Equal(t, resp.Truncated, resp.NextPageToken != "")
+		if !resp.Truncated {
+			return names, pages
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+func TestListTruncation(t *testing.T) {
+	s, _ := serverForTest()
+	ds := &hugeDatastore{elements: 25, artifacts: 12}
+	s.ds = ds
+	s.options.listMaxResults = 10
+
+	truncated := counterValue(t, metricListTruncated)
+	resp, err := s.List(context.Background(), &apb.ListRequest{Path: "test/huge"})
+	assert.Nil(t, err)
+	assert.True(t, resp.Truncated)
+	assert.NotEqual(t, "", resp.NextPageToken)
+	assert.Equal(t, 10, len(resp.Element))
+	assert.Equal(t, 0, len(resp.Artifact))
+	assert.Equal(t, truncated+1, counterValue(t, metricListTruncated))
+	// The artifacts are not queried until all the sub paths have been returned.
+	assert.Equal(t, 1, len(ds.queries))
+
+	var want []string
+	for ix := 0; ix < ds.elements; ix++ {
+		want = append(want, fmt.Sprintf("dir%03d", ix))
+	}
+	for ix := 0; ix < ds.artifacts; ix++ {
+		want = append(want, fmt.Sprintf("uid%03d", ix))
+	}
+	names, pages := listAll(t, s, &apb.ListRequest{Path: "test/huge"})
+	assert.Equal(t, want, names)
+	assert.Equal(t, 4, pages)
+
+	// Clients can ask for less results than the server limit, not more.
+	names, pages = listAll(t, s, &apb.ListRequest{Path: "test/huge", MaxResults: 20})
+	assert.Equal(t, want, names)
+	assert.Equal(t, 4, pages)
+	names, pages = listAll(t, s, &apb.ListRequest{Path: "test/huge", MaxResults: 7})
+	assert.Equal(t, want, names)
+	assert.Equal(t, 6, pages)
+
+	// Results fitting exactly in a page are not truncated.
+	ds.elements, ds.artifacts = 4, 6
+	truncated = counterValue(t, metricListTruncated)
+	resp, err = s.List(context.Background(), &apb.ListRequest{Path: "test/huge"})
+	assert.Nil(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Equal(t, "", resp.NextPageToken)
+	assert.Equal(t, 4, len(resp.Element))
+	assert.Equal(t, 6, len(resp.Artifact))
+	assert.Equal(t, truncated, counterValue(t, metricListTruncated))
+
+	for _, token := range []string{"invalid token", "MTI", "LTE6MA"} {
+		_, err = s.List(context.Background(), &apb.ListRequest{Path: "test/huge", PageToken: token})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%s", token)
+	}
+}
+
+func TestListDeadline(t *testing.T) {
+	s, _ := serverForTest()
+	s.ds = &hugeDatastore{elements: 5, delay: time.Minute}
+	s.options.metadataTimeout = 50 * time.Millisecond
+
+	timeouts := counterValue(t, metricTimeouts.WithLabelValues("List"))
+	start := time.Now()
+	_, err := s.List(context.Background(), &apb.ListRequest{Path: "test/slow"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "%s", err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.Equal(t, timeouts+1, counterValue(t, metricTimeouts.WithLabelValues("List")))
+
+	timeouts = counterValue(t, metricTimeouts.WithLabelValues("Retrieve"))
+	_, err = s.Retrieve(context.Background(), &apb.RetrieveRequest{Path: "test/slow"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "%s", err)
+	assert.Equal(t, timeouts+1, counterValue(t, metricTimeouts.WithLabelValues("Retrieve")))
+
+	// Requests canceled by the client are not counted as timeouts.
+	s.options.metadataTimeout = 0
+	timeouts = counterValue(t, metricTimeouts.WithLabelValues("List"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.List(ctx, &apb.ListRequest{Path: "test/slow"})
+	assert.NotNil(t, err)
+	assert.Equal(t, timeouts, counterValue(t, metricTimeouts.WithLabelValues("List")))
+}
@@ -0,0 +1,224 @@
+package astore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/lib/token"
+)
+
+// localAttrsSuffix is appended to the name of a blob to obtain the file storing its localAttrs.
+const localAttrsSuffix = ".attrs"
+
+type localOptions struct {
+	dir string
+	url string
+
+	keyFile string
+}
+
+// localToken is carried, encrypted, in the URLs returned by localBlobStore.
+type localToken struct {
+	Method   string
+	Name     string
+	Filename string
+}
+
+// localAttrs is stored in json format alongside each blob.
+type localAttrs struct {
+	MD5      []byte
+	Metadata map[string]string
+}
+
+// localBlobStore stores blobs in a directory of the local file system.
+//
+// Blobs are uploaded and downloaded through the http handler implemented by
+// the store, which must be reachable by clients at the configured URL.
+// Each URL carries an encrypted and expiring token, authorizing a single
+// method on a single blob, so the handler needs no other authentication.
+type localBlobStore struct {
+	dir string
+	url string
+
+	encoder *token.TypeEncoder
+}
+
+func newLocalBlobStore(rng *rand.Rand, options localOptions, expires time.Duration) (*localBlobStore, error) {
+	if options.dir == "" {
+		return nil, fmt.Errorf("incorrect API usage - need to provide a directory for local storage")
+	}
+	if options.url == "" {
+		return nil, fmt.Errorf("incorrect API usage - need to provide the URL the local storage handler is reachable at")
+	}
+	if err := os.MkdirAll(options.dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create local storage directory %s - %w", options.dir, err)
+	}
+
+	// Without a key file, a new key is generated at each start, which invalidates all URLs issued before.
+	be, err := token.NewSymmetricEncoder(rng, token.ReadOrGenerateSymmetricKey(options.keyFile, 0))
+	if err != nil {
+		return nil, fmt.Errorf("could not set up local storage token encryption - %w", err)
+	}
+
+	return &localBlobStore{
+		dir:     options.dir,
+		url:     strings.TrimSuffix(options.url, "/") + "/",
+		encoder: token.NewTypeEncoder(token.NewChainedEncoder(token.NewExpireEncoder(nil, expires), be, token.NewBase64UrlEncoder())),
+	}, nil
+}
+
+// file returns the path of the file storing the named blob.
+func (l *localBlobStore) file(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (l *localBlobStore) tokenURL(tok localToken) (string, error) {
+	encoded, err := l.encoder.Encode(tok)
+	if err != nil {
+		return "", err
+	}
+	return l.url + string(encoded), nil
+}
+
+func (l *localBlobStore) UploadURL(name string) (string, error) {
+	return l.tokenURL(localToken{Method: http.MethodPut, Name: name})
+}
+
+func (l *localBlobStore) DownloadURL(name, filename string) (string, error) {
+	return l.tokenURL(localToken{Method: http.MethodGet, Name: name, Filename: filename})
+}
+
+func (l *localBlobStore) readAttrs(name string) (*localAttrs, error) {
+	data, err := ioutil.ReadFile(l.file(name) + localAttrsSuffix)
+	if err != nil {
+		return nil, err
+	}
+	attrs := &localAttrs{}
+	if err := json.Unmarshal(data, attrs); err != nil {
+		return nil, fmt.Errorf("invalid attributes for %s - %w", name, err)
+	}
+	return attrs, nil
+}
+
+func (l *localBlobStore) writeAttrs(name string, attrs *localAttrs) error {
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.file(name)+localAttrsSuffix, data, 0600)
+}
+
+func (l *localBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	stat, err := os.Stat(l.file(name))
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := l.readAttrs(name)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{Size: stat.Size(), MD5: attrs.MD5}, nil
+}
+
+func (l *localBlobStore) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	attrs, err := l.readAttrs(name)
+	if err != nil {
+		return err
+	}
+	attrs.Metadata = metadata
+	return l.writeAttrs(name, attrs)
+}
+
+func (l *localBlobStore) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(l.file(name)); err != nil {
+		return err
+	}
+	return os.Remove(l.file(name) + localAttrsSuffix)
+}
+
+// ServeHTTP handles the uploads and downloads of blobs with the URLs returned by UploadURL and DownloadURL.
+func (l *localBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var tok localToken
+	if _, err := l.encoder.Decode(r.Context(), []byte(path.Base(r.URL.Path)), &tok); err != nil {
+		http.Error(w, "invalid or expired URL", http.StatusForbidden)
+		return
+	}
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if method != tok.Method {
+		http.Error(w, fmt.Sprintf("URL can only be used with %s", tok.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch tok.Method {
+	case http.MethodPut:
+		if err := l.receive(tok.Name, r.Body); err != nil {
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		file, err := os.Open(l.file(tok.Name))
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if tok.Filename != "" {
+			w.Header().Set("Content-Disposition", contentDisposition(tok.Filename))
+		}
+		http.ServeContent(w, r, "", stat.ModTime(), file)
+	}
+}
+
+// receive stores the content of a blob.
+//
+// The content is written to a temporary file first, so that a failed or
+// concurrent upload never leaves a partial blob behind.
+func (l *localBlobStore) receive(name string, content io.Reader) error {
+	dest := l.file(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(dest), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(temp, hash), content)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := l.writeAttrs(name, &localAttrs{MD5: hash.Sum(nil)}); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), dest)
+}
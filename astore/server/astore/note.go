@@ -7,15 +7,20 @@ import (
 	"github.com/System233/enkit/lib/retry"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"time"
 )
 
 func (s *Server) Note(ctx context.Context, req *astore.NoteRequest) (*astore.NoteResponse, error) {
 	if req.Uid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no sid and no path")
 	}
+	actor, err := requestActor(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	arts := []*astore.Artifact{}
-	err := retry.New(retry.WithDescription("note transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
+	err = retry.New(retry.WithDescription("note transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
 		t, err := s.ds.NewTransaction(s.ctx)
 		if err != nil {
 			return err
@@ -38,7 +43,7 @@ func (s *Server) Note(ctx context.Context, req *astore.NoteRequest) (*astore.Not
 		for ix, art := range artifacts {
 			key := keys[ix]
 
-			art.Note = req.Note
+			art.SetNote(actor, time.Now(), req.Note, s.options.historyLimit)
 			muts = append(muts, datastore.NewUpdate(key, art))
 			arts = append(arts, art.ToProto(keyToArchitecture(key)))
 		}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -52,13 +53,16 @@ func (s *Server) getPublished(prefix string, w http.ResponseWriter, r *http.Requ
 		return upath, nil, status.Errorf(codes.InvalidArgument, "path %s is invalid - results in empty path after cleanups", upath)
 	}
 
+	ctx, cancel := s.backendContext(r.Context())
+	defer cancel()
+
 	published := Published{}
-	err = s.ds.Get(s.ctx, keyForPublished(pkey), &published)
+	err = s.ds.Get(ctx, keyForPublished(pkey), &published)
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			err = status.Errorf(codes.NotFound, "artifact not found")
 		}
-		return upath, nil, err
+		return upath, nil, s.backendError("GetPublished", err)
 	}
 	return keypath, &published, nil
 }
@@ -89,7 +93,7 @@ func (s *Server) DownloadPublished(prefix string, ehandler DownloadHandler, w ht
 		req.Uid = uid
 	}
 
-	retr, err := s.Retrieve(context.TODO(), req)
+	retr, err := s.retrieve(r.Context(), req, path.Base(upath))
 	ehandler(upath, retr, err, w, r)
 }
 
@@ -103,7 +107,7 @@ func (s *Server) ListPublished(prefix string, ehandler ListHandler, w http.Respo
 	}
 
 	req := pub.ToListRequest()
-	retr, err := s.List(context.TODO(), req)
+	retr, err := s.List(r.Context(), req)
 	ehandler(upath, retr, err, w, r)
 }
 
@@ -152,3 +156,34 @@ func (s *Server) Unpublish(ctx context.Context, req *astore.UnpublishRequest) (*
 
 	return &astore.UnpublishResponse{}, nil
 }
+
+// ListAliases returns the aliases published at or below req.Prefix, so they can be replicated.
+func (s *Server) ListAliases(ctx context.Context, req *astore.ListAliasesRequest) (*astore.ListAliasesResponse, error) {
+	prefix := ""
+	if strings.TrimSpace(req.Prefix) != "" {
+		_, cleaned, _, err := publishKeyFromPath(req.Prefix)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "prefix %s is invalid - results in empty path after cleanups", req.Prefix)
+		}
+		prefix = strings.Trim(cleaned, "/")
+	}
+
+	ctx, cancel := s.backendContext(ctx)
+	defer cancel()
+
+	var published []*Published
+	if _, err := s.ds.GetAll(ctx, datastore.NewQuery(KindPublished), &published); err != nil {
+		return nil, s.backendError("ListAliases", err)
+	}
+
+	resp := &astore.ListAliasesResponse{}
+	for _, pub := range published {
+		apath := strings.TrimPrefix(pub.Parent, "published/")
+		if prefix != "" && apath != prefix && !strings.HasPrefix(apath, prefix+"/") {
+			continue
+		}
+		resp.Alias = append(resp.Alias, &astore.PublishedAlias{Path: apath, Select: pub.ToListRequest()})
+	}
+	sort.Slice(resp.Alias, func(i, j int) bool { return resp.Alias[i].Path < resp.Alias[j].Path })
+	return resp, nil
+}
@@ -0,0 +1,61 @@
+package astore
+
+import (
+	"context"
+	"testing"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// publishedDatastore serves the published aliases configured.
+type publishedDatastore struct {
+	testDatastore
+
+	published []*Published
+}
+
+func (d *publishedDatastore) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	d.queries = append(d.queries, q)
+
+	var keys []*datastore.Key
+	published := dst.(*[]*Published)
+	for _, pub := range d.published {
+		copied := *pub
+		*published = append(*published, &copied)
+		keys = append(keys, keyForPublished(datastore.NameKey(KindPathElement, pub.Parent, nil)))
+	}
+	return keys, nil
+}
+
+func TestListAliases(t *testing.T) {
+	ds := &publishedDatastore{published: []*Published{
+		{Parent: "published/tools/latest", Path: "tools/kernel", HasTags: true, Tag: []string{"stable"}},
+		{Parent: "published/docs", Uid: "wusyhsim6h5nhukvu5sejtp7eg6eqdgp"},
+		{Parent: "published/tools/kernel-amd64", Path: "tools/kernel", Architecture: "amd64-linux"},
+		{Parent: "published/toolsets", Path: "toolsets"},
+	}}
+	s := quotaServer(t, ds)
+
+	resp, err := s.ListAliases(context.Background(), &apb.ListAliasesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []*apb.PublishedAlias{
+		{Path: "docs", Select: &apb.ListRequest{Uid: "wusyhsim6h5nhukvu5sejtp7eg6eqdgp"}},
+		{Path: "tools/kernel-amd64", Select: &apb.ListRequest{Path: "tools/kernel", Architecture: "amd64-linux"}},
+		{Path: "tools/latest", Select: &apb.ListRequest{Path: "tools/kernel", Tag: &apb.TagSet{Tag: []string{"stable"}}}},
+		{Path: "toolsets", Select: &apb.ListRequest{Path: "toolsets"}},
+	}, resp.Alias)
+
+	resp, err = s.ListAliases(context.Background(), &apb.ListAliasesRequest{Prefix: "/tools/"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.Alias))
+	assert.Equal(t, "tools/kernel-amd64", resp.Alias[0].Path)
+	assert.Equal(t, "tools/latest", resp.Alias[1].Path)
+
+	_, err = s.ListAliases(context.Background(), &apb.ListAliasesRequest{Prefix: "."})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,305 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/oauth"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	metricQuotaUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "astore",
+		Name:      "quota_used_bytes",
+		Help:      "Bytes accounted against each upload quota: uploaded by a user in the current day, or in total under a path prefix",
+	}, []string{"kind", "name"})
+	metricQuotaLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "astore",
+		Name:      "quota_limit_bytes",
+		Help:      "Limit of each upload quota, as configured on the server",
+	}, []string{"kind", "name"})
+	metricQuotaExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "astore",
+		Name:      "quota_exceeded_total",
+		Help:      "Number of uploads rejected as they would exceed an upload quota, by kind of quota",
+	}, []string{"kind"})
+)
+
+// quotaOptions are the upload quotas enforced by the server.
+type quotaOptions struct {
+	// Bytes each user can upload per day, 0 for unlimited.
+	identityDaily int64
+	// Bytes that can be uploaded in total under each path prefix.
+	prefixes map[string]int64
+}
+
+// cleanQuotaPath normalizes an artifact path or quota prefix, so they can be compared.
+func cleanQuotaPath(p string) string {
+	return strings.Trim(path.Clean("/"+strings.TrimSpace(p)), "/")
+}
+
+// parseQuotaBytes parses a size like 1TB or 500GiB, as accepted by humanize.ParseBytes.
+func parseQuotaBytes(value string) (int64, error) {
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, err
+	}
+	if size > uint64(1<<63-1) {
+		return 0, fmt.Errorf("%s is too large", value)
+	}
+	return int64(size), nil
+}
+
+// parsePathQuotas parses a comma separated list of prefix=size quotas, like 'debug/symbols=1TB,ci=10TB'.
+func parsePathQuotas(value string) (map[string]int64, error) {
+	quotas := map[string]int64{}
+	for _, quota := range strings.Split(value, ",") {
+		quota = strings.TrimSpace(quota)
+		if quota == "" {
+			continue
+		}
+		ix := strings.LastIndex(quota, "=")
+		if ix < 0 {
+			return nil, fmt.Errorf("invalid quota %q - must be in the form prefix=size", quota)
+		}
+		size, err := parseQuotaBytes(quota[ix+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in quota %q - %w", quota, err)
+		}
+		quotas[cleanQuotaPath(quota[:ix])] = size
+	}
+	return quotas, nil
+}
+
+// quotaRef is a quota an upload is accounted against.
+type quotaRef struct {
+	kind  astore.Quota_Kind
+	name  string
+	limit int64
+}
+
+func (qr quotaRef) key() *datastore.Key {
+	return datastore.NameKey(KindQuota, qr.kind.String()+":"+qr.name, nil)
+}
+
+// label returns the value of the kind label of the quota metrics.
+func (qr quotaRef) label() string {
+	return strings.ToLower(qr.kind.String())
+}
+
+// quotaRef returns the quota of the kind and name, with the limit configured.
+func (s *Server) quotaRef(kind astore.Quota_Kind, name string) quotaRef {
+	ref := quotaRef{kind: kind, name: name}
+	switch kind {
+	case astore.Quota_IDENTITY:
+		ref.limit = s.options.quota.identityDaily
+	case astore.Quota_PATH_PREFIX:
+		ref.name = cleanQuotaPath(name)
+		ref.limit = s.options.quota.prefixes[ref.name]
+	}
+	return ref
+}
+
+// uploadQuotas returns the quotas an upload by creator to apath is accounted against.
+//
+// Uploads are accounted against every prefix of apath with a quota, so nested
+// prefixes are all enforced.
+func (s *Server) uploadQuotas(creator, apath string) []quotaRef {
+	var refs []quotaRef
+	if s.options.quota.identityDaily > 0 && creator != "" {
+		refs = append(refs, s.quotaRef(astore.Quota_IDENTITY, creator))
+	}
+
+	apath = cleanQuotaPath(apath)
+	var prefixes []string
+	for prefix := range s.options.quota.prefixes {
+		if prefix == "" || apath == prefix || strings.HasPrefix(apath, prefix+"/") {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		refs = append(refs, s.quotaRef(astore.Quota_PATH_PREFIX, prefix))
+	}
+	return refs
+}
+
+// quotaWindow returns the start of the day, UTC, including now.
+func quotaWindow(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour)
+}
+
+// current updates the quota to the window including now, resetting the usage of an IDENTITY quota if a new day started.
+func (q *Quota) current(ref quotaRef, now time.Time) {
+	q.Kind = ref.kind.String()
+	q.Name = ref.name
+	if ref.kind != astore.Quota_IDENTITY {
+		return
+	}
+	if window := quotaWindow(now); !q.WindowStart.Equal(window) {
+		q.Used = 0
+		q.WindowStart = window
+	}
+}
+
+// charge accounts size bytes against the quota, as of now.
+//
+// Returns false, leaving the usage unchanged, if the quota would be exceeded.
+func (q *Quota) charge(ref quotaRef, size int64, now time.Time) bool {
+	q.current(ref, now)
+	if ref.limit > 0 && q.Used+size > ref.limit {
+		return false
+	}
+	q.Used += size
+	q.Updated = now
+	return true
+}
+
+func (q *Quota) ToProto(ref quotaRef) *astore.Quota {
+	result := &astore.Quota{
+		Kind:       ref.kind,
+		Name:       ref.name,
+		UsedBytes:  q.Used,
+		LimitBytes: ref.limit,
+	}
+	if !q.WindowStart.IsZero() {
+		result.WindowStart = q.WindowStart.UnixNano()
+	}
+	return result
+}
+
+// exportQuota updates the metrics of the quota.
+func exportQuota(ref quotaRef, q *Quota) {
+	metricQuotaUsed.WithLabelValues(ref.label(), ref.name).Set(float64(q.Used))
+	metricQuotaLimit.WithLabelValues(ref.label(), ref.name).Set(float64(ref.limit))
+}
+
+// quotaError returns a ResourceExhausted error describing the quotas an upload of size bytes would exceed.
+//
+// The error carries an errdetails.QuotaFailure, with a violation per quota.
+func quotaError(size int64, exceeded map[quotaRef]*Quota) error {
+	var refs []quotaRef
+	for ref := range exceeded {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].kind != refs[j].kind {
+			return refs[i].kind < refs[j].kind
+		}
+		return refs[i].name < refs[j].name
+	})
+
+	failure := &errdetails.QuotaFailure{}
+	var descriptions []string
+	for _, ref := range refs {
+		quota := exceeded[ref]
+		description := fmt.Sprintf("%s quota of %q has %s used of %s", ref.label(), ref.name,
+			humanize.Bytes(uint64(quota.Used)), humanize.Bytes(uint64(ref.limit)))
+		if ref.kind == astore.Quota_IDENTITY {
+			description += fmt.Sprintf(", until %s", quota.WindowStart.Add(24*time.Hour).Format(time.RFC3339))
+		}
+		descriptions = append(descriptions, description)
+		failure.Violations = append(failure.Violations, &errdetails.QuotaFailure_Violation{
+			Subject:     ref.kind.String() + ":" + ref.name,
+			Description: description,
+		})
+	}
+
+	st := status.Newf(codes.ResourceExhausted, "upload of %s would exceed the quota - %s",
+		humanize.Bytes(uint64(size)), strings.Join(descriptions, ", "))
+	if detailed, err := st.WithDetails(failure); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// chargeQuotas accounts an upload of size bytes by creator to apath against the quotas configured.
+//
+// Usage is persisted in datastore, so it survives restarts of the server.
+// Returns ResourceExhausted, accounting nothing, if any quota would be exceeded.
+func (s *Server) chargeQuotas(ctx context.Context, creator, apath string, size int64) error {
+	refs := s.uploadQuotas(creator, apath)
+	if len(refs) == 0 {
+		return nil
+	}
+
+	var charged map[quotaRef]*Quota
+	err := retry.New(retry.WithDescription("quota transaction"), retry.WithLogger(s.options.logger)).Run(func() error {
+		t, err := s.ds.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer Rollback(&t)
+
+		now := time.Now()
+		charged = map[quotaRef]*Quota{}
+		exceeded := map[quotaRef]*Quota{}
+		muts := []*datastore.Mutation{}
+		for _, ref := range refs {
+			quota := &Quota{}
+			if err := t.Get(ref.key(), quota); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if !quota.charge(ref, size, now) {
+				exceeded[ref] = quota
+				continue
+			}
+			charged[ref] = quota
+			muts = append(muts, datastore.NewUpsert(ref.key(), quota))
+		}
+		if len(exceeded) > 0 {
+			for ref := range exceeded {
+				metricQuotaExceeded.WithLabelValues(ref.label()).Inc()
+			}
+			return retry.Fatal(quotaError(size, exceeded))
+		}
+
+		if _, err := t.Mutate(muts...); err != nil {
+			return err
+		}
+		return Commit(&t)
+	})
+	if err != nil {
+		return err
+	}
+
+	for ref, quota := range charged {
+		exportQuota(ref, quota)
+	}
+	return nil
+}
+
+// checkQuotas fails with ResourceExhausted if the user of the request already exhausted their daily quota.
+//
+// Used before issuing an upload URL, so clients don't upload blobs Commit would reject.
+// Uploads are accounted against the quotas by Commit, once their size is known.
+func (s *Server) checkQuotas(ctx context.Context) error {
+	creds := oauth.GetCredentials(ctx)
+	if s.options.quota.identityDaily <= 0 || creds == nil {
+		return nil
+	}
+
+	ref := s.quotaRef(astore.Quota_IDENTITY, creds.Identity.GlobalName())
+	quota := &Quota{}
+	if err := s.ds.Get(ctx, ref.key(), quota); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if quota.charge(ref, 1, time.Now()) {
+		return nil
+	}
+	metricQuotaExceeded.WithLabelValues(ref.label()).Inc()
+	return quotaError(1, map[quotaRef]*Quota{ref: quota})
+}
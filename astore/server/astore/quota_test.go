@@ -0,0 +1,205 @@
+package astore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+	"github.com/System233/enkit/lib/oauth"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quotaDatastore serves the quotas stored, keyed by name.
+type quotaDatastore struct {
+	testDatastore
+
+	quotas map[string]*Quota
+}
+
+func (d *quotaDatastore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	quota, found := d.quotas[key.Name]
+	if !found {
+		return datastore.ErrNoSuchEntity
+	}
+	*dst.(*Quota) = *quota
+	return nil
+}
+
+func (d *quotaDatastore) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	d.queries = append(d.queries, q)
+
+	var keys []*datastore.Key
+	quotas := dst.(*[]*Quota)
+	for name, quota := range d.quotas {
+		copied := *quota
+		*quotas = append(*quotas, &copied)
+		keys = append(keys, datastore.NameKey(KindQuota, name, nil))
+	}
+	return keys, nil
+}
+
+func quotaServer(t *testing.T, ds datastoreClient, mods ...Modifier) *Server {
+	options := DefaultOptions()
+	for _, mod := range mods {
+		assert.NoError(t, mod(&options))
+	}
+	return &Server{ctx: context.Background(), ds: ds, options: options}
+}
+
+func userContext(username string) context.Context {
+	return oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{
+		Identity: oauth.Identity{Username: username, Organization: "enkit.io"},
+	})
+}
+
+func TestQuotaFlags(t *testing.T) {
+	flags := DefaultFlags()
+	flags.Bucket = "artifacts"
+	flags.QuotaIdentityDaily = "500GB"
+	flags.QuotaPaths = "debug/symbols/=1TB, /ci=10 TiB"
+
+	options := DefaultOptions()
+	assert.NoError(t, WithFlags(flags)(&options))
+	assert.Equal(t, int64(500*1000*1000*1000), options.quota.identityDaily)
+	assert.Equal(t, map[string]int64{
+		"debug/symbols": 1000 * 1000 * 1000 * 1000,
+		"ci":            10 << 40,
+	}, options.quota.prefixes)
+
+	for _, invalid := range []string{"debug", "debug=lots", "debug=-1GB"} {
+		flags.QuotaPaths = invalid
+		assert.Error(t, WithFlags(flags)(&options), "%s", invalid)
+	}
+}
+
+func TestUploadQuotas(t *testing.T) {
+	s := quotaServer(t, &testDatastore{}, WithIdentityQuota(100), WithPathQuota("debug", 1000), WithPathQuota("debug/symbols/", 500), WithPathQuota("ci", 10))
+
+	assert.Equal(t, []quotaRef{
+		{kind: apb.Quota_IDENTITY, name: "alice@enkit.io", limit: 100},
+		{kind: apb.Quota_PATH_PREFIX, name: "debug", limit: 1000},
+		{kind: apb.Quota_PATH_PREFIX, name: "debug/symbols", limit: 500},
+	}, s.uploadQuotas("alice@enkit.io", "/debug/symbols/kernel.dbg"))
+	assert.Equal(t, []quotaRef{
+		{kind: apb.Quota_PATH_PREFIX, name: "debug", limit: 1000},
+	}, s.uploadQuotas("", "debug/symbolsx/kernel.dbg"))
+	assert.Nil(t, s.uploadQuotas("", "cix/artifact"))
+
+	// No quotas configured, nothing to account.
+	s = quotaServer(t, &testDatastore{})
+	assert.Nil(t, s.uploadQuotas("alice@enkit.io", "debug/symbols/kernel.dbg"))
+}
+
+func TestQuotaCharge(t *testing.T) {
+	ref := quotaRef{kind: apb.Quota_IDENTITY, name: "alice@enkit.io", limit: 100}
+	day := time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC)
+
+	quota := &Quota{}
+	assert.True(t, quota.charge(ref, 60, day))
+	assert.Equal(t, int64(60), quota.Used)
+	assert.Equal(t, "IDENTITY", quota.Kind)
+	assert.Equal(t, time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), quota.WindowStart)
+
+	// Exceeding the quota leaves the usage unchanged.
+	assert.False(t, quota.charge(ref, 41, day.Add(time.Minute)))
+	assert.Equal(t, int64(60), quota.Used)
+	assert.True(t, quota.charge(ref, 40, day.Add(time.Minute)))
+	assert.Equal(t, int64(100), quota.Used)
+
+	// The next day, the usage is reset.
+	assert.True(t, quota.charge(ref, 50, day.Add(2*time.Hour)))
+	assert.Equal(t, int64(50), quota.Used)
+	assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), quota.WindowStart)
+
+	// Path prefix quotas are never reset.
+	ref = quotaRef{kind: apb.Quota_PATH_PREFIX, name: "debug", limit: 100}
+	quota = &Quota{}
+	assert.True(t, quota.charge(ref, 100, day))
+	assert.False(t, quota.charge(ref, 1, day.Add(48*time.Hour)))
+	assert.True(t, quota.WindowStart.IsZero())
+
+	// Unlimited quotas only account.
+	ref.limit = 0
+	assert.True(t, quota.charge(ref, 1<<40, day))
+}
+
+func TestQuotaError(t *testing.T) {
+	window := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	err := quotaError(2000, map[quotaRef]*Quota{
+		{kind: apb.Quota_PATH_PREFIX, name: "debug", limit: 1000}:          {Used: 900},
+		{kind: apb.Quota_IDENTITY, name: "alice@enkit.io", limit: 1000000}: {Used: 999000, WindowStart: window},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), `identity quota of "alice@enkit.io" has 999 kB used of 1.0 MB, until 2024-03-11T00:00:00Z`)
+	assert.Contains(t, err.Error(), `path_prefix quota of "debug" has 900 B used of 1.0 kB`)
+
+	details := status.Convert(err).Details()
+	assert.Len(t, details, 1)
+	failure, ok := details[0].(*errdetails.QuotaFailure)
+	assert.True(t, ok)
+	if ok {
+		assert.Len(t, failure.Violations, 2)
+		assert.Equal(t, "IDENTITY:alice@enkit.io", failure.Violations[0].Subject)
+		assert.Equal(t, "PATH_PREFIX:debug", failure.Violations[1].Subject)
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	today := quotaWindow(time.Now())
+	ds := &quotaDatastore{quotas: map[string]*Quota{
+		"IDENTITY:alice@enkit.io": {Kind: "IDENTITY", Name: "alice@enkit.io", Used: 100, WindowStart: today},
+		"IDENTITY:bob@enkit.io":   {Kind: "IDENTITY", Name: "bob@enkit.io", Used: 100, WindowStart: today.Add(-24 * time.Hour)},
+	}}
+	s := quotaServer(t, ds, WithIdentityQuota(100))
+	exceeded := counterValue(t, metricQuotaExceeded.WithLabelValues("identity"))
+
+	assert.Equal(t, codes.ResourceExhausted, status.Code(s.checkQuotas(userContext("alice"))))
+	assert.Equal(t, exceeded+1, counterValue(t, metricQuotaExceeded.WithLabelValues("identity")))
+	// Yesterday's usage does not count, neither do unauthenticated requests.
+	assert.NoError(t, s.checkQuotas(userContext("bob")))
+	assert.NoError(t, s.checkQuotas(userContext("carol")))
+	assert.NoError(t, s.checkQuotas(context.Background()))
+
+	_, err := s.Store(userContext("alice"), &apb.StoreRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestListQuotas(t *testing.T) {
+	today := quotaWindow(time.Now())
+	ds := &quotaDatastore{quotas: map[string]*Quota{
+		"IDENTITY:alice@enkit.io": {Kind: "IDENTITY", Name: "alice@enkit.io", Used: 100, WindowStart: today},
+		"IDENTITY:bob@enkit.io":   {Kind: "IDENTITY", Name: "bob@enkit.io", Used: 100, WindowStart: today.Add(-24 * time.Hour)},
+		"PATH_PREFIX:debug":       {Kind: "PATH_PREFIX", Name: "debug", Used: 700},
+	}}
+	s := quotaServer(t, ds, WithIdentityQuota(500), WithPathQuota("debug", 1000), WithPathQuota("ci", 10), WithAdmins("admin@enkit.io, root@enkit.io"))
+
+	_, err := s.ListQuotas(context.Background(), &apb.ListQuotasRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = s.ListQuotas(userContext("alice"), &apb.ListQuotasRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.AdjustQuota(userContext("alice"), &apb.AdjustQuotaRequest{Kind: apb.Quota_IDENTITY, Name: "alice@enkit.io"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	resp, err := s.ListQuotas(userContext("root"), &apb.ListQuotasRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Quota, 4)
+	if len(resp.Quota) == 4 {
+		assert.Equal(t, &apb.Quota{Kind: apb.Quota_IDENTITY, Name: "alice@enkit.io", UsedBytes: 100, LimitBytes: 500, WindowStart: today.UnixNano()}, resp.Quota[0])
+		// Usage of a previous day is reported as reset.
+		assert.Equal(t, &apb.Quota{Kind: apb.Quota_IDENTITY, Name: "bob@enkit.io", UsedBytes: 0, LimitBytes: 500, WindowStart: today.UnixNano()}, resp.Quota[1])
+		// Configured quotas are reported, even if nothing was uploaded.
+		assert.Equal(t, &apb.Quota{Kind: apb.Quota_PATH_PREFIX, Name: "ci", LimitBytes: 10}, resp.Quota[2])
+		assert.Equal(t, &apb.Quota{Kind: apb.Quota_PATH_PREFIX, Name: "debug", UsedBytes: 700, LimitBytes: 1000}, resp.Quota[3])
+	}
+
+	_, err = s.AdjustQuota(userContext("admin"), &apb.AdjustQuotaRequest{Kind: apb.Quota_UNKNOWN, Name: "debug"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.AdjustQuota(userContext("admin"), &apb.AdjustQuotaRequest{Kind: apb.Quota_PATH_PREFIX, Name: "debug", UsedBytes: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
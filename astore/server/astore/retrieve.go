@@ -9,16 +9,10 @@ import (
 	"github.com/System233/enkit/astore/rpc/astore"
 
 	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/storage"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-var (
-	// Functions mocked in unit tests
-	storageSignedURL = storage.SignedURL
-)
-
 // DownalodArtifact turns an http.Request into an astore.RetrieveRequest, executes it, and invokes the specified handler with the result.
 func (s *Server) DownloadArtifact(prefix string, ehandler DownloadHandler, w http.ResponseWriter, r *http.Request) {
 	upath := path.Clean(r.URL.Path)
@@ -57,13 +51,43 @@ func (s *Server) DownloadArtifact(prefix string, ehandler DownloadHandler, w htt
 		}
 	}
 
-	retr, err := s.Retrieve(context.TODO(), req)
+	retr, err := s.retrieve(r.Context(), req, path.Base(upath))
 	ehandler(upath, retr, err, w, r)
 }
 
 func (s *Server) Retrieve(ctx context.Context, req *astore.RetrieveRequest) (*astore.RetrieveResponse, error) {
+	return s.retrieve(ctx, req, "")
+}
+
+// retrieve looks up the artifact matching req, and returns it with a download URL.
+//
+// If filename is not empty, the URL instructs browsers to save the artifact
+// with that name, rather than with the sid.
+func (s *Server) retrieve(ctx context.Context, req *astore.RetrieveRequest, filename string) (*astore.RetrieveResponse, error) {
+	artifact, key, err := s.findArtifact(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	url, err := s.blobs.DownloadURL(objectPath(artifact.Sid), filename)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not generate download URL - %s", err)
+	}
+
+	resp := &astore.RetrieveResponse{
+		Path:     keyToPath(key),
+		Artifact: artifact.ToProto(keyToArchitecture(key)),
+		Url:      url,
+	}
+	return resp, nil
+}
+
+// findArtifact returns the artifact matching req, with its key.
+//
+// Returns NotFound unless exactly one artifact matches.
+func (s *Server) findArtifact(ctx context.Context, req *astore.RetrieveRequest) (*Artifact, *datastore.Key, error) {
 	if req.Uid == "" && req.Path == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid request - no uid and no path")
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid request - no uid and no path")
 	}
 
 	reqarch := strings.TrimSpace(req.Architecture)
@@ -73,7 +97,7 @@ func (s *Server) Retrieve(ctx context.Context, req *astore.RetrieveRequest) (*as
 	if req.Path != "" {
 		query, err = queryForPath(KindArtifact, req.Path, reqarch)
 		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
+			return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid path - %s", err)
 		}
 	} else {
 		query = datastore.NewQuery(KindArtifact)
@@ -92,25 +116,19 @@ func (s *Server) Retrieve(ctx context.Context, req *astore.RetrieveRequest) (*as
 		query = query.Filter("Tag = ", tag)
 	}
 
+	ctx, cancel := s.backendContext(ctx)
+	defer cancel()
+
 	var artifacts []*Artifact
-	keys, err := s.ds.GetAll(s.ctx, query, &artifacts)
+	keys, err := s.ds.GetAll(ctx, query, &artifacts)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "error running query - %s", err)
+		if err := s.backendError("Retrieve", err); status.Code(err) == codes.DeadlineExceeded {
+			return nil, nil, err
+		}
+		return nil, nil, status.Errorf(codes.Internal, "error running query - %s", err)
 	}
 	if len(keys) != 1 || len(artifacts) != 1 {
-		return nil, status.Errorf(codes.NotFound, "artifact not found (%d found)", len(artifacts))
-	}
-
-	artifact := artifacts[0]
-	url, err := storageSignedURL(s.options.bucket, objectPath(artifact.Sid), s.options.ForSigning("GET"))
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "could not generate download URL - %s", err)
+		return nil, nil, status.Errorf(codes.NotFound, "artifact not found (%d found)", len(artifacts))
 	}
-
-	resp := &astore.RetrieveResponse{
-		Path:     keyToPath(keys[0]),
-		Artifact: artifact.ToProto(keyToArchitecture(keys[0])),
-		Url:      url,
-	}
-	return resp, nil
+	return artifacts[0], keys[0], nil
 }
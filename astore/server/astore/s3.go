@@ -0,0 +1,303 @@
+package astore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3TimeFormat = "20060102T150405Z"
+	s3DateFormat = "20060102"
+
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// Hex encoded sha256 of an empty body.
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// Longest validity S3 accepts for presigned URLs.
+	s3MaxExpires = 7 * 24 * time.Hour
+)
+
+type s3Options struct {
+	endpoint string
+	region   string
+
+	accessKeyID     string
+	secretAccessKey string
+
+	virtualHost bool
+}
+
+// s3BlobStore stores blobs in a bucket of an S3 compatible service, using presigned URLs.
+//
+// Requests are signed with AWS signature version 4. By default the bucket is
+// addressed path-style, as the first element of the path, which is supported
+// by AWS as well as minio, ceph, and most other implementations.
+type s3BlobStore struct {
+	endpoint *url.URL
+	bucket   string
+	options  s3Options
+	expires  time.Duration
+
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3BlobStore(bucket string, options s3Options, expires time.Duration) (*s3BlobStore, error) {
+	endpoint, err := url.Parse(options.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s - %w", options.endpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %s - must be an http:// or https:// URL", options.endpoint)
+	}
+	if options.region == "" {
+		return nil, fmt.Errorf("incorrect API usage - need to provide an S3 region")
+	}
+	if options.accessKeyID == "" {
+		options.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if options.secretAccessKey == "" {
+		options.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if options.accessKeyID == "" || options.secretAccessKey == "" {
+		return nil, fmt.Errorf("S3 storage requires an access key id and a secret access key")
+	}
+	if expires > s3MaxExpires {
+		expires = s3MaxExpires
+	}
+
+	return &s3BlobStore{
+		endpoint: endpoint,
+		bucket:   bucket,
+		options:  options,
+		expires:  expires,
+		client:   http.DefaultClient,
+		now:      time.Now,
+	}, nil
+}
+
+func (s *s3BlobStore) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	u.RawQuery = ""
+	if s.options.virtualHost {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, name)
+	} else {
+		u.Path = path.Join("/", u.Path, s.bucket, name)
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	return &u
+}
+
+func (s *s3BlobStore) scope(now time.Time) string {
+	return strings.Join([]string{now.Format(s3DateFormat), s.options.region, "s3", "aws4_request"}, "/")
+}
+
+// signature computes the signature of a canonical request, as per AWS signature version 4.
+func (s *s3BlobStore) signature(now time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	tosign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), s.scope(now), hex.EncodeToString(hash[:])}, "\n")
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+s.options.secretAccessKey), now.Format(s3DateFormat))
+	key = mac(key, s.options.region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	return hex.EncodeToString(mac(key, tosign))
+}
+
+// presign returns a URL allowing anyone holding it to perform the request until it expires.
+func (s *s3BlobStore) presign(method, name string, query url.Values) string {
+	now := s.now().UTC()
+	u := s.objectURL(name)
+
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", s.options.accessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(s.expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{method, u.EscapedPath(), s3CanonicalQuery(query), "host:" + u.Host + "\n", "host", s3UnsignedPayload}, "\n")
+	query.Set("X-Amz-Signature", s.signature(now, canonical))
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+// sign adds the Authorization header to a request with an empty body.
+func (s *s3BlobStore) sign(req *http.Request) {
+	now := s.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayload)
+
+	headers := map[string]string{"host": req.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), s3CanonicalQuery(req.URL.Query()), canonicalHeaders, signed, s3EmptyPayload}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.options.accessKeyID, s.scope(now), signed, s.signature(now, canonical)))
+}
+
+// do performs a signed request on the named object, and returns an error unless the request succeeded.
+func (s *s3BlobStore) do(ctx context.Context, method, name string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("S3 %s of %s failed with status %s - %s", method, name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (s *s3BlobStore) UploadURL(name string) (string, error) {
+	return s.presign(http.MethodPut, name, nil), nil
+}
+
+func (s *s3BlobStore) DownloadURL(name, filename string) (string, error) {
+	query := url.Values{}
+	if filename != "" {
+		// Unlike with GCS, the parameter must be signed.
+		query.Set("response-content-disposition", contentDisposition(filename))
+	}
+	return s.presign(http.MethodGet, name, query), nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	info := &BlobInfo{Size: resp.ContentLength}
+	// The ETag of objects uploaded with a single PUT is the MD5 of
+	// their content. Multipart uploads have a different ETag, with a -.
+	md5sum, err := hex.DecodeString(strings.Trim(resp.Header.Get("ETag"), `"`))
+	if err == nil && len(md5sum) == md5.Size {
+		info.MD5 = md5sum
+	}
+	return info, nil
+}
+
+// SetMetadata replaces the metadata of the object by copying it onto itself, the only way S3 allows.
+func (s *s3BlobStore) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3Escape(path.Join("/", s.bucket, name), false))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	for key, value := range metadata {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, name, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A copy can fail after S3 already returned 200, with the error in the body.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "<Error>") {
+		return fmt.Errorf("S3 copy of %s failed - %s", name, body)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Escape URI encodes a string as required by AWS signature version 4.
+//
+// Only unreserved characters are left as is, and / is escaped unless escaping a path.
+func s3Escape(value string, escapeSlash bool) string {
+	result := strings.Builder{}
+	for _, c := range []byte(value) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			result.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			result.WriteByte(c)
+		default:
+			fmt.Fprintf(&result, "%%%02X", c)
+		}
+	}
+	return result.String()
+}
+
+// s3CanonicalQuery returns the query string sorted and escaped as required by AWS signature version 4.
+func s3CanonicalQuery(query url.Values) string {
+	escaped := map[string]string{}
+	keys := []string{}
+	for key := range query {
+		escaped[s3Escape(key, true)] = key
+		keys = append(keys, s3Escape(key, true))
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := []string{}
+		for _, value := range query[escaped[key]] {
+			values = append(values, s3Escape(value, true))
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,226 @@
+package astore
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/System233/enkit/astore/rpc/astore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultSearchMaxResults is the number of results of a Search request not specifying a maximum.
+	DefaultSearchMaxResults = 100
+	// DefaultSearchScanLimit is the number of artifacts a Search request examines, unless configured otherwise.
+	DefaultSearchScanLimit = 5000
+)
+
+var (
+	metricSearchScanLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "astore",
+		Name:      "search_scan_limited_total",
+		Help:      "Number of Search requests truncated as they examined the maximum number of artifacts",
+	})
+)
+
+// searchLimit returns the maximum number of results a Search request can return.
+//
+// Search is capped by the same limit as List, and returns DefaultSearchMaxResults
+// if the client does not request a number of results.
+func (s *Server) searchLimit(requested int32) int {
+	limit := s.listLimit(requested)
+	if requested <= 0 && limit > DefaultSearchMaxResults {
+		return DefaultSearchMaxResults
+	}
+	return limit
+}
+
+// searchPage is the position a Search request continues from, serialized in the page token.
+//
+// It is the number of candidate artifacts examined by previous pages.
+type searchPage struct {
+	scanned int
+}
+
+func (sp searchPage) Token() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(sp.scanned)))
+}
+
+func parseSearchPageToken(token string) (searchPage, error) {
+	var page searchPage
+	if token == "" {
+		return page, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return page, err
+	}
+	page.scanned, err = strconv.Atoi(string(data))
+	if err != nil {
+		return page, err
+	}
+	if page.scanned < 0 {
+		return page, fmt.Errorf("negative offset")
+	}
+	return page, nil
+}
+
+// searchFilter holds the predicates of a SearchRequest.
+type searchFilter struct {
+	glob string
+	// True if the glob has no special characters, and matches a single path.
+	literal bool
+
+	tags    []string
+	note    string // Lower case.
+	creator string
+
+	// Zero if not limited.
+	after  time.Time
+	before time.Time
+}
+
+func newSearchFilter(req *astore.SearchRequest) (*searchFilter, error) {
+	filter := &searchFilter{
+		tags:    cleanUnique(req.Tag),
+		note:    strings.ToLower(strings.TrimSpace(req.Note)),
+		creator: strings.TrimSpace(req.Creator),
+	}
+	if glob := strings.Trim(strings.TrimSpace(req.PathGlob), "/"); glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("path glob %q - %w", req.PathGlob, err)
+		}
+		filter.glob = glob
+		filter.literal = !strings.ContainsAny(glob, `*?[\`)
+	}
+	if req.CreatedAfter != 0 {
+		filter.after = time.Unix(0, req.CreatedAfter)
+	}
+	if req.CreatedBefore != 0 {
+		filter.before = time.Unix(0, req.CreatedBefore)
+	}
+	if !filter.after.IsZero() && !filter.before.IsZero() && !filter.before.After(filter.after) {
+		return nil, fmt.Errorf("empty time range - created before %s is not after created after %s", filter.before, filter.after)
+	}
+	return filter, nil
+}
+
+// Query returns the datastore query retrieving the candidate artifacts, most recent first.
+//
+// Literal paths, tags, creator and time range are all supported by the
+// datastore indexes, and restrict the candidates. Globs and notes are only
+// checked by Match.
+func (f *searchFilter) Query() *datastore.Query {
+	query := datastore.NewQuery(KindArtifact)
+	if f.literal {
+		parent, _, _ := keyFromPath(f.glob, "")
+		query = query.Filter("Parent = ", parent)
+	}
+	for _, tag := range f.tags {
+		query = query.Filter("Tag = ", tag)
+	}
+	if f.creator != "" {
+		query = query.Filter("Creator = ", f.creator)
+	}
+	if !f.after.IsZero() {
+		query = query.Filter("Created >= ", f.after)
+	}
+	if !f.before.IsZero() {
+		query = query.Filter("Created < ", f.before)
+	}
+	return query.Order("-Created")
+}
+
+// Match returns true if the artifact, stored at apath, matches all the predicates.
+func (f *searchFilter) Match(apath string, art *Artifact) bool {
+	if f.glob != "" {
+		if matched, _ := path.Match(f.glob, apath); !matched {
+			return false
+		}
+	}
+	if f.creator != "" && art.Creator != f.creator {
+		return false
+	}
+	if !f.after.IsZero() && art.Created.Before(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && !art.Created.Before(f.before) {
+		return false
+	}
+	if f.note != "" && !strings.Contains(strings.ToLower(art.Note), f.note) {
+		return false
+	}
+	tags := indexStrings(art.Tag)
+	for _, tag := range f.tags {
+		if _, found := tags[tag]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Search returns the artifacts matching all the predicates of the request, most recent first.
+//
+// Each request examines at most the scan limit configured of candidate artifacts,
+// as retrieved with the datastore indexes. If more candidates are left, the
+// response is truncated, even if no artifact matched.
+func (s *Server) Search(ctx context.Context, req *astore.SearchRequest) (*astore.SearchResponse, error) {
+	filter, err := newSearchFilter(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid search - %s", err)
+	}
+	page, err := parseSearchPageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page token - %s", err)
+	}
+	limit := s.searchLimit(req.MaxResults)
+	scanLimit := s.options.searchScanLimit
+	if scanLimit <= 0 {
+		scanLimit = DefaultSearchScanLimit
+	}
+
+	ctx, cancel := s.backendContext(ctx)
+	defer cancel()
+
+	candidates := []*Artifact{}
+	keys, err := s.ds.GetAll(ctx, filter.Query().Offset(page.scanned).Limit(scanLimit), &candidates)
+	if err != nil {
+		return nil, s.backendError("Search", err)
+	}
+
+	response := &astore.SearchResponse{}
+	next := searchPage{scanned: page.scanned + len(candidates)}
+	for ix, art := range candidates {
+		apath := keyToPath(keys[ix])
+		if !filter.Match(apath, art) {
+			continue
+		}
+		// One more match than can be returned: the next page starts from it.
+		if len(response.Artifact) >= limit {
+			next.scanned = page.scanned + ix
+			response.Truncated = true
+			break
+		}
+		result := art.ToProto(keyToArchitecture(keys[ix]))
+		result.Path = apath
+		response.Artifact = append(response.Artifact, result)
+	}
+	if !response.Truncated && len(candidates) >= scanLimit {
+		metricSearchScanLimited.Inc()
+		response.Truncated = true
+		response.ScanLimited = true
+	}
+	if response.Truncated {
+		response.NextPageToken = next.Token()
+	}
+	return response, nil
+}
@@ -0,0 +1,252 @@
+package astore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/astore/rpc/astore"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	dpb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// searchDatastore returns its artifacts most recent first, honoring offset and limit only.
+//
+// Filters are ignored, as if no index could be used, so all the predicates are checked by Search.
+type searchDatastore struct {
+	testDatastore
+
+	keys      []*datastore.Key
+	artifacts []*Artifact
+}
+
+var searchEpoch = time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+// add stores an artifact created days after searchEpoch. Artifacts must be added most recent first.
+func (d *searchDatastore) add(path, creator string, days int, note string, tags ...string) {
+	_, pkey, _ := keyFromPath(path, "amd64-linux")
+	parent, _, _ := keyFromPath(path, "")
+	d.keys = append(d.keys, datastore.IDKey(KindArtifact, int64(len(d.keys)+1), pkey))
+	d.artifacts = append(d.artifacts, &Artifact{
+		Uid:     fmt.Sprintf("uid%02d", len(d.artifacts)),
+		Tag:     tags,
+		Parent:  parent,
+		Creator: creator,
+		Created: searchEpoch.Add(time.Duration(days) * 24 * time.Hour),
+		Note:    note,
+	})
+}
+
+func (d *searchDatastore) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	d.queries = append(d.queries, q)
+	req := dpb.RunQueryRequest{}
+	if err := q.ToProto(&req); err != nil {
+		return nil, err
+	}
+	query := req.GetQuery()
+	start := int(query.GetOffset())
+	end := start + int(query.GetLimit().GetValue())
+
+	artifacts := dst.(*[]*Artifact)
+	var keys []*datastore.Key
+	for ix := start; ix < end && ix < len(d.artifacts); ix++ {
+		*artifacts = append(*artifacts, d.artifacts[ix])
+		keys = append(keys, d.keys[ix])
+	}
+	return keys, nil
+}
+
+func newSearchDatastore() *searchDatastore {
+	ds := &searchDatastore{}
+	ds.add("tools/enkit", "alice@enkit", 40, "Hotfix for the tunnel", "latest", "stable")
+	ds.add("tools/astore", "bob@enkit", 35, "", "latest")
+	ds.add("tools/enkit", "bob@enkit", 30, "regular release", "stable")
+	ds.add("images/builder/base", "alice@enkit", 20, "HOTFIX: openssl")
+	ds.add("tools/enkit", "alice@enkit", 10, "first upload", "old")
+	ds.add("tools/astore", "carol@enkit", 5, "another hotfix", "old")
+	return ds
+}
+
+// search returns the uids of the artifacts returned by a single Search request.
+func search(t *testing.T, s *Server, req *apb.SearchRequest) []string {
+	resp, err := s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	if err != nil {
+		return nil
+	}
+	uids := []string{}
+	for _, art := range resp.Artifact {
+		uids = append(uids, art.Uid)
+	}
+	return uids
+}
+
+func TestSearchPredicates(t *testing.T) {
+	s, _ := serverForTest()
+	ds := newSearchDatastore()
+	s.ds = ds
+
+	day := func(days int) int64 {
+		return searchEpoch.Add(time.Duration(days) * 24 * time.Hour).UnixNano()
+	}
+	for _, tc := range []struct {
+		req  *apb.SearchRequest
+		want []string
+	}{
+		{&apb.SearchRequest{}, []string{"uid00", "uid01", "uid02", "uid03", "uid04", "uid05"}},
+		{&apb.SearchRequest{PathGlob: "tools/enkit"}, []string{"uid00", "uid02", "uid04"}},
+		{&apb.SearchRequest{PathGlob: "/tools/enkit/"}, []string{"uid00", "uid02", "uid04"}},
+		{&apb.SearchRequest{PathGlob: "tools/*"}, []string{"uid00", "uid01", "uid02", "uid04", "uid05"}},
+		{&apb.SearchRequest{PathGlob: "*/*/base"}, []string{"uid03"}},
+		{&apb.SearchRequest{PathGlob: "tools"}, []string{}},
+		{&apb.SearchRequest{Tag: []string{"stable"}}, []string{"uid00", "uid02"}},
+		{&apb.SearchRequest{Tag: []string{"stable", "latest"}}, []string{"uid00"}},
+		{&apb.SearchRequest{Note: "hotfix"}, []string{"uid00", "uid03", "uid05"}},
+		{&apb.SearchRequest{Note: "  OpenSSL "}, []string{"uid03"}},
+		{&apb.SearchRequest{Creator: "bob@enkit"}, []string{"uid01", "uid02"}},
+		{&apb.SearchRequest{CreatedAfter: day(30)}, []string{"uid00", "uid01", "uid02"}},
+		{&apb.SearchRequest{CreatedBefore: day(30)}, []string{"uid03", "uid04", "uid05"}},
+		{&apb.SearchRequest{CreatedAfter: day(10), CreatedBefore: day(35)}, []string{"uid02", "uid03", "uid04"}},
+		// Predicates are combined with and.
+		{&apb.SearchRequest{Note: "hotfix", Creator: "alice@enkit"}, []string{"uid00", "uid03"}},
+		{&apb.SearchRequest{Note: "hotfix", PathGlob: "tools/*", CreatedBefore: day(30)}, []string{"uid05"}},
+		{&apb.SearchRequest{PathGlob: "tools/enkit", Tag: []string{"old"}, Creator: "alice@enkit", CreatedAfter: day(1)}, []string{"uid04"}},
+		{&apb.SearchRequest{Note: "hotfix", Creator: "bob@enkit"}, []string{}},
+	} {
+		assert.Equal(t, tc.want, search(t, s, tc.req), "%v", tc.req)
+	}
+
+	resp, err := s.Search(context.Background(), &apb.SearchRequest{Creator: "bob@enkit"})
+	assert.Nil(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Equal(t, "tools/astore", resp.Artifact[0].Path)
+	assert.Equal(t, "amd64-linux", resp.Artifact[0].Architecture)
+
+	// Predicates supported by the indexes are sent to the datastore, globs and notes are not.
+	ds.queries = nil
+	search(t, s, &apb.SearchRequest{PathGlob: "tools/enkit", Tag: []string{"old"}, Creator: "alice@enkit", CreatedAfter: day(1), Note: "upload"})
+	queries := ds.RecordedQueries(t)
+	assert.Equal(t, 1, len(queries))
+	filters := queries[0].GetQuery().GetFilter().GetCompositeFilter().GetFilters()
+	var properties []string
+	for _, filter := range filters {
+		properties = append(properties, filter.GetPropertyFilter().GetProperty().GetName())
+	}
+	assert.Equal(t, []string{"Parent", "Tag", "Creator", "Created"}, properties)
+	assert.Equal(t, "root/tools/enkit", filters[0].GetPropertyFilter().GetValue().GetStringValue())
+
+	ds.queries = nil
+	search(t, s, &apb.SearchRequest{PathGlob: "tools/*", Note: "hotfix"})
+	queries = ds.RecordedQueries(t)
+	assert.Nil(t, queries[0].GetQuery().GetFilter())
+
+	for _, req := range []*apb.SearchRequest{
+		{PathGlob: "tools/[enkit"},
+		{CreatedAfter: day(10), CreatedBefore: day(10)},
+		{PageToken: "invalid token"},
+		{PageToken: "LTE"},
+	} {
+		_, err := s.Search(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", req)
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	s, _ := serverForTest()
+	s.ds = newSearchDatastore()
+
+	var uids []string
+	req := &apb.SearchRequest{Note: "hotfix", MaxResults: 2}
+	resp, err := s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Truncated)
+	assert.False(t, resp.ScanLimited)
+	assert.Equal(t, 2, len(resp.Artifact))
+	for _, art := range resp.Artifact {
+		uids = append(uids, art.Uid)
+	}
+
+	req.PageToken = resp.NextPageToken
+	resp, err = s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Equal(t, "", resp.NextPageToken)
+	for _, art := range resp.Artifact {
+		uids = append(uids, art.Uid)
+	}
+	assert.Equal(t, []string{"uid00", "uid03", "uid05"}, uids)
+
+	// Results fitting exactly in a page are not truncated.
+	resp, err = s.Search(context.Background(), &apb.SearchRequest{Note: "hotfix", MaxResults: 3})
+	assert.Nil(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Equal(t, 3, len(resp.Artifact))
+
+	// Without a maximum, the server default applies, capped by the list limit.
+	s.options.listMaxResults = 4
+	assert.Equal(t, 4, len(search(t, s, &apb.SearchRequest{})))
+	assert.Equal(t, 4, len(search(t, s, &apb.SearchRequest{MaxResults: 10})))
+	s.options.listMaxResults = 1000
+	assert.Equal(t, DefaultSearchMaxResults, s.searchLimit(0))
+	assert.Equal(t, 500, s.searchLimit(500))
+}
+
+func TestSearchScanLimit(t *testing.T) {
+	s, _ := serverForTest()
+	ds := newSearchDatastore()
+	s.ds = ds
+	s.options.searchScanLimit = 2
+
+	limited := counterValue(t, metricSearchScanLimited)
+	req := &apb.SearchRequest{Note: "openssl"}
+	resp, err := s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	// No match among the first 2 artifacts, but the scan stopped before examining them all.
+	assert.Equal(t, 0, len(resp.Artifact))
+	assert.True(t, resp.Truncated)
+	assert.True(t, resp.ScanLimited)
+	assert.NotEqual(t, "", resp.NextPageToken)
+	assert.Equal(t, limited+1, counterValue(t, metricSearchScanLimited))
+
+	req.PageToken = resp.NextPageToken
+	resp, err = s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Artifact))
+	assert.Equal(t, "uid03", resp.Artifact[0].Uid)
+	assert.True(t, resp.ScanLimited)
+
+	req.PageToken = resp.NextPageToken
+	resp, err = s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(resp.Artifact))
+	assert.True(t, resp.ScanLimited)
+
+	// The scan reached the end.
+	req.PageToken = resp.NextPageToken
+	resp, err = s.Search(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(resp.Artifact))
+	assert.False(t, resp.Truncated)
+	assert.False(t, resp.ScanLimited)
+
+	// Each request retrieves at most the scan limit of artifacts.
+	for _, q := range ds.RecordedQueries(t) {
+		assert.Equal(t, int32(2), q.GetQuery().GetLimit().GetValue())
+	}
+}
+
+func TestSearchDeadline(t *testing.T) {
+	s, _ := serverForTest()
+	s.ds = &hugeDatastore{delay: time.Minute}
+	s.options.metadataTimeout = 50 * time.Millisecond
+
+	timeouts := counterValue(t, metricTimeouts.WithLabelValues("Search"))
+	_, err := s.Search(context.Background(), &apb.SearchRequest{Note: "hotfix"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "%s", err)
+	assert.Equal(t, timeouts+1, counterValue(t, metricTimeouts.WithLabelValues("Search")))
+}
@@ -89,8 +89,7 @@ func serverForTest() (*Server, *testDatastore) {
 	return &Server{
 		ctx:     context.Background(),
 		rng:     nil,
-		gcs:     nil,
-		bkt:     nil,
+		blobs:   &gcsBlobStore{signing: (&Options{}).ForSigning},
 		ds:      ds,
 		options: Options{},
 	}, ds
@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"strings"
 	"time"
 
@@ -74,11 +73,8 @@ func DownloadHandler(base, upath string, resp *rpc_astore.RetrieveResponse, err
 		return
 	}
 
-	// Ensure that the file, when the browser goes to download it, has the original file name, rather than the uid.
-	// Wget and curl get it right, surprisingly, as they stick to the original file name from the URL before the redirect.
-	// If it wasn't for that, they'd need the --content-disposition or -J flag.
-	disposition := "&response-content-disposition=" + url.PathEscape(fmt.Sprintf(`inline; filename="%s"`, path.Base(upath)))
-	http.Redirect(w, r, resp.Url+disposition, http.StatusTemporaryRedirect)
+	// The URL already carries the original file name, so the browser does not save the file with the sid.
+	http.Redirect(w, r, resp.Url, http.StatusTemporaryRedirect)
 }
 
 // ListHandler implements the astore.ListHandler contract.
@@ -127,8 +123,12 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 		downloadURL = trimmed + "/d/"
 		astoreFlags.PublishBaseURL = listURL
 	}
+	if astoreFlags.Storage == astore.StorageLocal && astoreFlags.LocalURL == "" {
+		astoreFlags.LocalURL = strings.TrimSuffix(targetURL, "/") + "/b/"
+	}
 
-	astoreServer, err := astore.New(rng, astore.WithFlags(astoreFlags))
+	// The administrators of the auth server administer the artifact store as well.
+	astoreServer, err := astore.New(rng, astore.WithFlags(astoreFlags), astore.WithAdmins(authFlags.Admins))
 	if err != nil {
 		return fmt.Errorf("could not initialize storage - %s Maybe you need to pass --credentials-file or --project-id-file?", err)
 	}
@@ -157,7 +157,13 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 		grpc.UnaryInterceptor(ogrpc.UnaryInterceptor(reqAuth, "/auth.Auth/")),
 	)
 	rpc_astore.RegisterAstoreServer(grpcs, astoreServer)
+	rpc_astore.RegisterAstoreAdminServer(grpcs, astoreServer)
 	rpc_auth.RegisterAuthServer(grpcs, authServer)
+	rpc_auth.RegisterAuthAdminServer(grpcs, authServer)
+	go authServer.SweepJars(ctx)
+	if astoreServer.GCEnabled() {
+		go astoreServer.RunGCReports(ctx)
+	}
 
 	mux := http.NewServeMux()
 	stats := kassets.AssetStats{}
@@ -197,6 +203,14 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 		}, w, r)
 	}))
 
+	// Uploads and downloads of artifacts, when they are stored by the server itself. URLs carry their own authorization.
+	if handler := astoreServer.BlobHandler(); handler != nil {
+		mux.Handle("/b/", handler)
+	}
+
+	// OpenSSH Key Revocation List, for hosts to fetch periodically and use with RevokedKeys.
+	mux.HandleFunc("/krl", authServer.ServeKRL)
+
 	// Web authentication endpoint. Other web services can redirect the user to /w here with an r= parameter to perform authentication,
 	// and redirect the user back to the r= target if authentication succeeds.
 	mux.HandleFunc("/w", func(w http.ResponseWriter, r *http.Request) {
@@ -259,7 +273,11 @@ func Start(ctx context.Context, targetURL, cookieDomain string, astoreFlags *ast
 		}
 		if authWeb.Complete(data) {
 			if key, ok := data.State.(common.Key); ok {
-				authServer.FeedToken(key, data)
+				if err := authServer.FeedToken(key, data); err != nil {
+					ShowResult(w, r, "broken", "Something Went Wrong", messageError, http.StatusServiceUnavailable)
+					log.Printf("ERROR - could not deliver token to CLI - %s", err)
+					return
+				}
 			}
 			if !oauth.CheckRedirect(w, r, data) {
 				ShowResult(w, r, "thumbs-up", "Good Job!", messageSuccess, http.StatusOK)
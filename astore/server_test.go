@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 
 	"github.com/System233/enkit/astore/atesting"
@@ -23,6 +25,9 @@ type AStoreDescriptor struct {
 }
 
 // RunAStoreServer will spin up an emulated datastore along with an instance of the astore grpc server.
+//
+// Artifacts are stored in a temporary directory, with the local storage
+// backend, served by an http server on localhost.
 func RunAStoreServer() (*AStoreDescriptor, atesting.KillAbleProcess, error) {
 	killFunctions := atesting.KillAbleProcess{}
 	emulatorDescriptor, emulatorKill, err := atesting.RunEmulatedDatastore()
@@ -30,13 +35,24 @@ func RunAStoreServer() (*AStoreDescriptor, atesting.KillAbleProcess, error) {
 	if err != nil {
 		return nil, killFunctions, err
 	}
-	// Causes the google-could-go/storage library to use a local emulator rather than the real endpoint.
+	// Causes the google-could-go/datastore library to use the emulator rather than the real endpoint.
 	err = os.Setenv(
-		"STORAGE_EMULATOR_HOST",
+		"DATASTORE_EMULATOR_HOST",
 		fmt.Sprintf("localhost:%d", emulatorDescriptor.Addr.Port))
 	if err != nil {
 		return nil, killFunctions, err
 	}
+
+	storageDir, err := ioutil.TempDir("", "astore-storage")
+	if err != nil {
+		return nil, killFunctions, err
+	}
+	killFunctions.Add(func() {
+		os.RemoveAll(storageDir)
+	})
+	mux := http.NewServeMux()
+	httpServer := httptest.NewServer(mux)
+	killFunctions.Add(httpServer.Close)
 	buffListener := bufconn.Listen(2048 * 2048)
 	bufDialer := func(context.Context, string) (net.Conn, error) {
 		return buffListener.Dial()
@@ -49,16 +65,14 @@ func RunAStoreServer() (*AStoreDescriptor, atesting.KillAbleProcess, error) {
 
 	server, err := astore.New(rand.New(srand.Source),
 		astore.WithCredentialsJSON(credentialString),
-		astore.WithSigningJSON(credentialString),
-		astore.WithBucket("example-bucket"))
+		astore.WithLocalStorage(storageDir, httpServer.URL+"/b/"))
 
 	if err != nil {
 		return nil, killFunctions, err
 	}
+	mux.Handle("/b/", server.BlobHandler())
 	apb.RegisterAstoreServer(grpcServer, server)
-	if err := grpcServer.Serve(buffListener); err != nil {
-		return nil, killFunctions, err
-	}
+	go grpcServer.Serve(buffListener)
 	killGrpcFunc := func() {
 		grpcServer.Stop()
 	}
@@ -11,6 +11,8 @@ import (
 	"github.com/System233/enkit/lib/kcerts"
 	"github.com/System233/enkit/lib/logger"
 	"github.com/System233/enkit/lib/oauth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc/codes"
@@ -21,22 +23,51 @@ import (
 	"time"
 )
 
+var (
+	metricLiveJars = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "live_jars",
+		Help:      "Number of authentication flows waiting to be completed or claimed",
+	})
+	metricExpiredJars = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "expired_jars",
+		Help:      "Number of authentication flows abandoned, and removed after expiring",
+	})
+)
+
 type Server struct {
 	rng                   *rand.Rand
 	serverPub, serverPriv *common.Key
 
-	jarlock sync.Mutex
-	jars    map[common.Key]*Jar
+	jarlock   sync.Mutex
+	jars      map[common.Key]*Jar
+	jarMaxAge time.Duration
+	maxJars   int
+
+	authURL      string
+	useGroups    bool
+	limit        time.Duration
+	pollInterval time.Duration
+
+	// caLock protects ca and stagedCAs, which can change at run time with PromoteCA.
+	caLock      sync.RWMutex
+	ca          *certAuthority
+	stagedCAs   []*certAuthority
+	trustedCAs  []ssh.PublicKey
+	principals  []string
+	userCertTTL time.Duration
+	log         logger.Logger
 
-	authURL   string
-	useGroups bool
-	limit     time.Duration
+	serialLock  sync.Mutex
+	revocations *Revocations
+	sessions    SessionStore
+	admins      []string
 
-	caPrivateKey          kcerts.PrivateKey
-	principals            []string
-	marshalledCAPublicKey []byte
-	userCertTTL           time.Duration
-	log                   logger.Logger
+	// Machinist controller used to verify hosts requesting certificates, nil to sign for any host.
+	nodes        NodeLookup
+	nodesBypass  bool
+	nodesTimeout time.Duration
 }
 
 func (s *Server) HostCertificate(ctx context.Context, request *apb.HostCertificateRequest) (*apb.HostCertificateResponse, error) {
@@ -48,12 +79,21 @@ func (s *Server) HostCertificate(ctx context.Context, request *apb.HostCertifica
 	if err != nil {
 		return nil, err
 	}
-	cert, err := kcerts.SignPublicKey(s.caPrivateKey, ssh.HostCert, request.Hosts, s.userCertTTL, pubKey)
+	if err := s.verifyHost(ctx, request.Hosts); err != nil {
+		return nil, err
+	}
+	ca := s.signer()
+	if ca == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "no CA configured - cannot sign host certificates")
+	}
+	serial := s.nextSerial()
+	cert, err := kcerts.SignPublicKey(ca.private, ssh.HostCert, request.Hosts, s.userCertTTL, pubKey, kcerts.WithSerial(serial))
 	if err != nil {
 		return nil, err
 	}
+	s.recordIssued(cert, "")
 	return &apb.HostCertificateResponse{
-		Capublickey:    s.marshalledCAPublicKey,
+		Capublickey:    s.marshalledTrustedCAs(),
 		Signedhostcert: ssh.MarshalAuthorizedKey(cert),
 	}, nil
 }
@@ -64,9 +104,56 @@ type Jar struct {
 	cancel  context.CancelFunc
 }
 
-func (s *Server) GetChannel(cancel context.CancelFunc, pub common.Key) chan oauth.AuthData {
+// expireJars drops the jars created more than s.jarMaxAge ago, with any token delivered but never claimed.
+//
+// Clients still waiting on an expired jar have their context canceled.
+// Must be called with jarlock held.
+func (s *Server) expireJars(now time.Time) {
+	for key, jar := range s.jars {
+		if now.Sub(jar.created) <= s.jarMaxAge {
+			continue
+		}
+		if jar.cancel != nil {
+			jar.cancel()
+		}
+		delete(s.jars, key)
+		metricExpiredJars.Inc()
+	}
+	metricLiveJars.Set(float64(len(s.jars)))
+}
+
+// SweepJars periodically expires abandoned jars, until the context is canceled.
+//
+// Jars are also expired every time a new one is created, SweepJars guarantees
+// memory is reclaimed even if the server stops receiving requests.
+func (s *Server) SweepJars(ctx context.Context) {
+	interval := s.jarMaxAge / 4
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.jarlock.Lock()
+			s.expireJars(now)
+			s.jarlock.Unlock()
+		}
+	}
+}
+
+// errTooManyJars is returned when the number of authentication flows in progress reaches s.maxJars.
+func (s *Server) errTooManyJars() error {
+	return status.Errorf(codes.ResourceExhausted, "too many authentication requests in progress (%d) - try again later", s.maxJars)
+}
+
+func (s *Server) GetChannel(cancel context.CancelFunc, pub common.Key) (chan oauth.AuthData, error) {
 	s.jarlock.Lock()
 	defer s.jarlock.Unlock()
+	s.expireJars(time.Now())
 
 	jar := s.jars[pub]
 	if jar != nil {
@@ -74,7 +161,10 @@ func (s *Server) GetChannel(cancel context.CancelFunc, pub common.Key) chan oaut
 			jar.cancel()
 		}
 		jar.cancel = cancel
-		return jar.channel
+		return jar.channel, nil
+	}
+	if s.maxJars > 0 && len(s.jars) >= s.maxJars {
+		return nil, s.errTooManyJars()
 	}
 
 	jar = &Jar{
@@ -82,12 +172,24 @@ func (s *Server) GetChannel(cancel context.CancelFunc, pub common.Key) chan oaut
 		// Hold at least one token in the buffer.
 		//
 		// This allows a client supllying a token to not block until the token
-		// has in facts been consumed.
+		// has in facts been consumed, and a polling client to find it at the
+		// next poll.
 		channel: make(chan oauth.AuthData, 1),
 		cancel:  cancel,
 	}
 	s.jars[pub] = jar
-	return jar.channel
+	metricLiveJars.Set(float64(len(s.jars)))
+	return jar.channel, nil
+}
+
+// ClaimedChannel removes the jar once its token has been returned to the client.
+func (s *Server) ClaimedChannel(pub common.Key, channel chan oauth.AuthData) {
+	s.jarlock.Lock()
+	defer s.jarlock.Unlock()
+	if jar := s.jars[pub]; jar != nil && jar.channel == channel {
+		delete(s.jars, pub)
+		metricLiveJars.Set(float64(len(s.jars)))
+	}
 }
 
 func (s *Server) Authenticate(ctx context.Context, req *apb.AuthenticateRequest) (*apb.AuthenticateResponse, error) {
@@ -95,6 +197,16 @@ func (s *Server) Authenticate(ctx context.Context, req *apb.AuthenticateRequest)
 	if err != nil {
 		return nil, err
 	}
+
+	// Bound the memory used by authentication flows that may never complete.
+	s.jarlock.Lock()
+	live := len(s.jars)
+	s.jarlock.Unlock()
+	if s.maxJars > 0 && live >= s.maxJars {
+		s.log.Warnf("rejecting authentication request - %d authentication flows in progress", live)
+		return nil, s.errTooManyJars()
+	}
+
 	resp := &apb.AuthenticateResponse{
 		Key: (*s.serverPub)[:],
 		Url: fmt.Sprintf("%s/%s", s.authURL, hex.EncodeToString(key[:])),
@@ -102,9 +214,23 @@ func (s *Server) Authenticate(ctx context.Context, req *apb.AuthenticateRequest)
 	return resp, nil
 }
 
-func (s *Server) FeedToken(key common.Key, cookie oauth.AuthData) {
-	channel := s.GetChannel(nil, key)
-	channel <- cookie
+func (s *Server) FeedToken(key common.Key, cookie oauth.AuthData) error {
+	channel, err := s.GetChannel(nil, key)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case channel <- cookie:
+			return nil
+		default:
+		}
+		// A token was delivered, but not claimed yet, replace it with the newer one.
+		select {
+		case <-channel:
+		default:
+		}
+	}
 }
 
 func (s *Server) Token(ctx context.Context, req *apb.TokenRequest) (*apb.TokenResponse, error) {
@@ -112,62 +238,88 @@ func (s *Server) Token(ctx context.Context, req *apb.TokenRequest) (*apb.TokenRe
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(ctx)
-	channel := s.GetChannel(cancel, *clientPub)
-	select {
-	case <-ctx.Done():
-		return nil, status.Errorf(codes.Canceled, "context canceled while waiting for authentication")
-	case <-time.After(s.limit):
-		return nil, status.Errorf(codes.DeadlineExceeded, "timed out waiting for your lazy fingers to complete authentication")
-
-	case authData := <-channel:
-		var nonce [common.NonceLength]byte
-		if _, err := io.ReadFull(s.rng, nonce[:]); err != nil {
-			return nil, status.Errorf(codes.Internal, "could not generate nonce - %s", err)
+	var authData oauth.AuthData
+	if req.Nowait {
+		channel, err := s.GetChannel(nil, *clientPub)
+		if err != nil {
+			return nil, err
 		}
-
-		// If the ca signer is nil that means the CA was never passed in flags, if the request never sent a public key
-		// then so ssh certs will be sent back.
-		if s.caPrivateKey == nil || len(req.Publickey) <= 0 {
-			return &apb.TokenResponse{
-				Nonce: nonce[:],
-				Token: box.Seal(nil, []byte(authData.Cookie), &nonce, (*[32]byte)(clientPub), (*[32]byte)(s.serverPriv)),
-			}, nil
+		select {
+		case authData = <-channel:
+		default:
+			return &apb.TokenResponse{Pending: true, PollIntervalMs: s.pollInterval.Milliseconds()}, nil
 		}
-		// If the ca signer was present, continuing with public keys.
-		savedPubKey, _, _, _, err := ssh.ParseAuthorizedKey(req.Publickey)
+		s.ClaimedChannel(*clientPub, channel)
+	} else {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		channel, err := s.GetChannel(cancel, *clientPub)
 		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "PublicKey cannot be parsed as an ssh authorized key - %s", err)
+			return nil, err
 		}
-		var certMods []kcerts.CertMod
-		effectivePrincipals := append([]string{}, s.principals...)
-		effectivePrincipals = append(effectivePrincipals, authData.Creds.Identity.Username)
-		effectivePrincipals = append(effectivePrincipals, authData.Creds.Identity.GlobalName())
-		if s.useGroups {
-			effectivePrincipals = append(effectivePrincipals, authData.Creds.Identity.Groups...)
+		select {
+		case <-ctx.Done():
+			return nil, status.Errorf(codes.Canceled, "context canceled while waiting for authentication")
+		case <-time.After(s.limit):
+			return nil, status.Errorf(codes.DeadlineExceeded, "timed out waiting for your lazy fingers to complete authentication")
+		case authData = <-channel:
 		}
+		s.ClaimedChannel(*clientPub, channel)
+	}
+	return s.issueToken(ctx, req, clientPub, authData)
+}
 
-		for _, i := range authData.Identities {
-			effectivePrincipals = append(effectivePrincipals, i.GlobalName())
-			if s.useGroups {
-				effectivePrincipals = append(effectivePrincipals, i.Groups...)
-			}
-			certMods = append(certMods, i.CertMod())
-		}
-		userCert, err := kcerts.SignPublicKey(s.caPrivateKey, ssh.UserCert, effectivePrincipals, s.userCertTTL, savedPubKey, certMods...)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "error signing key - %s", err)
-		}
+// issueToken returns the token to the client, encrypted with its key, and signs the public key supplied, if any.
+func (s *Server) issueToken(ctx context.Context, req *apb.TokenRequest, clientPub *common.Key, authData oauth.AuthData) (*apb.TokenResponse, error) {
+	var nonce [common.NonceLength]byte
+	if _, err := io.ReadFull(s.rng, nonce[:]); err != nil {
+		return nil, status.Errorf(codes.Internal, "could not generate nonce - %s", err)
+	}
+
+	// If the ca signer is nil that means the CA was never passed in flags, if the request never sent a public key
+	// then so ssh certs will be sent back.
+	ca := s.signer()
+	if ca == nil || len(req.Publickey) <= 0 {
 		return &apb.TokenResponse{
-			Nonce:       nonce[:],
-			Token:       box.Seal(nil, []byte(authData.Cookie), &nonce, (*[32]byte)(clientPub), (*[32]byte)(s.serverPriv)),
-			Capublickey: s.marshalledCAPublicKey,
-			// Always trust the CA for now since the DNS gets resolved behind tunnel and therefore the client doesn't know
-			// which to trust.
-			Cahosts: []string{"*"},
-			Cert:    ssh.MarshalAuthorizedKey(userCert),
+			Nonce: nonce[:],
+			Token: box.Seal(nil, []byte(authData.Cookie), &nonce, (*[32]byte)(clientPub), (*[32]byte)(s.serverPriv)),
 		}, nil
 	}
+	// If the ca signer was present, continuing with public keys.
+	savedPubKey, _, _, _, err := ssh.ParseAuthorizedKey(req.Publickey)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "PublicKey cannot be parsed as an ssh authorized key - %s", err)
+	}
+	var certMods []kcerts.CertMod
+	effectivePrincipals := append([]string{}, s.principals...)
+	effectivePrincipals = append(effectivePrincipals, authData.Creds.Identity.Username)
+	effectivePrincipals = append(effectivePrincipals, authData.Creds.Identity.GlobalName())
+	if s.useGroups {
+		effectivePrincipals = append(effectivePrincipals, authData.Creds.Identity.Groups...)
+	}
 
-	return nil, status.Errorf(codes.Internal, "never reached, clearly")
+	for _, i := range authData.Identities {
+		effectivePrincipals = append(effectivePrincipals, i.GlobalName())
+		if s.useGroups {
+			effectivePrincipals = append(effectivePrincipals, i.Groups...)
+		}
+		certMods = append(certMods, i.CertMod())
+	}
+	serial := s.nextSerial()
+	certMods = append(certMods, kcerts.WithSerial(serial))
+	userCert, err := kcerts.SignPublicKey(ca.private, ssh.UserCert, effectivePrincipals, s.userCertTTL, savedPubKey, certMods...)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error signing key - %s", err)
+	}
+	s.recordIssued(userCert, authData.Creds.Identity.GlobalName())
+	s.recordSession(ctx, userCert, authData.Creds.Identity.GlobalName())
+	return &apb.TokenResponse{
+		Nonce:       nonce[:],
+		Token:       box.Seal(nil, []byte(authData.Cookie), &nonce, (*[32]byte)(clientPub), (*[32]byte)(s.serverPriv)),
+		Capublickey: s.marshalledTrustedCAs(),
+		// Always trust the CA for now since the DNS gets resolved behind tunnel and therefore the client doesn't know
+		// which to trust.
+		Cahosts: []string{"*"},
+		Cert:    ssh.MarshalAuthorizedKey(userCert),
+	}, nil
 }
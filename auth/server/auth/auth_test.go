@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"encoding/hex"
 	"github.com/System233/enkit/auth/common"
 	apb "github.com/System233/enkit/auth/proto"
 	"github.com/System233/enkit/lib/cache"
@@ -12,6 +13,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"math/rand"
 	"strings"
@@ -85,6 +88,125 @@ func TestBasicAuth(t *testing.T) {
 	assert.Equal(t, 0, len(tresp.Capublickey), "%v", tresp.Capublickey)
 }
 
+func TestNoWaitToken(t *testing.T) {
+	rng := rand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"), WithPollInterval(3*time.Second))
+	assert.Nil(t, err, err)
+
+	pub, priv, err := box.GenerateKey(rng)
+	assert.Nil(t, err, err)
+	aresp, err := server.Authenticate(context.Background(), &apb.AuthenticateRequest{Key: (*pub)[:]})
+	assert.Nil(t, err, err)
+	key, err := common.KeyFromURL(aresp.Url)
+	assert.Nil(t, err, err)
+	servPub, err := common.KeyFromSlice(aresp.Key)
+	assert.Nil(t, err, err)
+
+	// Authentication not completed yet, the server returns immediately.
+	treq := &apb.TokenRequest{Url: aresp.Url, Nowait: true}
+	tresp, err := server.Token(context.Background(), treq)
+	assert.Nil(t, err, err)
+	assert.True(t, tresp.Pending)
+	assert.Equal(t, int64(3000), tresp.PollIntervalMs)
+	assert.Equal(t, 0, len(tresp.Token))
+
+	// Delivering the token twice before it is claimed does not block, the newest wins.
+	creds := &oauth.CredentialsCookie{Identity: oauth.Identity{Username: "emma.goldman", Organization: "writers.org"}}
+	server.FeedToken(*key, oauth.AuthData{Creds: creds, Cookie: "old"})
+	server.FeedToken(*key, oauth.AuthData{Creds: creds, Cookie: "new"})
+
+	// The token is retained across polls until claimed.
+	tresp, err = server.Token(context.Background(), treq)
+	assert.Nil(t, err, err)
+	assert.False(t, tresp.Pending)
+	nonce, err := common.NonceFromSlice(tresp.Nonce)
+	assert.Nil(t, err, err)
+	decrypted, ok := box.Open(nil, tresp.Token, nonce.ToByte(), servPub.ToByte(), priv)
+	assert.True(t, ok)
+	assert.Equal(t, "new", string(decrypted))
+
+	// Once claimed, it is gone.
+	tresp, err = server.Token(context.Background(), treq)
+	assert.Nil(t, err, err)
+	assert.True(t, tresp.Pending)
+	server.jarlock.Lock()
+	assert.Equal(t, 1, len(server.jars))
+	server.jarlock.Unlock()
+}
+
+func TestJarExpiry(t *testing.T) {
+	rng := rand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"), WithTimeLimit(50*time.Millisecond))
+	assert.Nil(t, err, err)
+
+	pub, _, err := box.GenerateKey(rng)
+	assert.Nil(t, err, err)
+	key := common.Key(*pub)
+	url := "static-prefix/" + hex.EncodeToString(key[:])
+
+	// A token that is never claimed expires with its jar.
+	assert.Nil(t, server.FeedToken(key, oauth.AuthData{Creds: &oauth.CredentialsCookie{}, Cookie: "unclaimed"}))
+	time.Sleep(150 * time.Millisecond)
+	tresp, err := server.Token(context.Background(), &apb.TokenRequest{Url: url, Nowait: true})
+	assert.Nil(t, err, err)
+	assert.True(t, tresp.Pending)
+
+	// Blocking clients still time out.
+	_, err = server.Token(context.Background(), &apb.TokenRequest{Url: url})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestJarSweepAndLimit(t *testing.T) {
+	rng := rand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"), WithJarMaxAge(50*time.Millisecond), WithMaxJars(2))
+	assert.Nil(t, err, err)
+
+	authenticate := func() (*apb.AuthenticateResponse, error) {
+		pub, _, err := box.GenerateKey(rng)
+		assert.Nil(t, err, err)
+		return server.Authenticate(context.Background(), &apb.AuthenticateRequest{Key: (*pub)[:]})
+	}
+
+	// Fill up the jars with clients that never complete the flow.
+	var waiting []chan error
+	for i := 0; i < 2; i++ {
+		aresp, err := authenticate()
+		assert.Nil(t, err, err)
+		result := make(chan error, 1)
+		waiting = append(waiting, result)
+		go func() {
+			_, err := server.Token(context.Background(), &apb.TokenRequest{Url: aresp.Url})
+			result <- err
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		server.jarlock.Lock()
+		defer server.jarlock.Unlock()
+		return len(server.jars) == 2
+	}, time.Second, time.Millisecond)
+
+	_, err = authenticate()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	pub, _, err := box.GenerateKey(rng)
+	assert.Nil(t, err, err)
+	_, err = server.Token(context.Background(), &apb.TokenRequest{Url: "static-prefix/" + hex.EncodeToString(pub[:]), Nowait: true})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// The sweeper frees the abandoned jars, and cancels the waiting clients.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.SweepJars(ctx)
+	for _, result := range waiting {
+		assert.Equal(t, codes.Canceled, status.Code(<-result))
+	}
+	server.jarlock.Lock()
+	assert.Equal(t, 0, len(server.jars))
+	server.jarlock.Unlock()
+
+	_, err = authenticate()
+	assert.Nil(t, err, err)
+}
+
 // Just in case your security scanner goes crazy on this:
 // This is a test key, it is actually not used anywehere, at all.
 // Yes, it has no passphrase.
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"reflect"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/oauth"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// certAuthority is a CA the server holds the private key of, and can thus sign certificates with.
+type certAuthority struct {
+	private kcerts.PrivateKey
+	public  ssh.PublicKey
+}
+
+func (ca *certAuthority) Fingerprint() string {
+	return ssh.FingerprintSHA256(ca.public)
+}
+
+// parseCA parses a private key in any of the formats supported by ssh.ParseRawPrivateKey.
+func parseCA(fileContent []byte) (*certAuthority, error) {
+	caPrivateKey, err := ssh.ParseRawPrivateKey(fileContent)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse CA key - %w", err)
+	}
+	// TODO(adam): make parsing existing keys cleaner
+	if key, ok := caPrivateKey.(*ed25519.PrivateKey); ok {
+		sshPubKey, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &certAuthority{private: kcerts.FromEC25519(*key), public: sshPubKey}, nil
+	}
+	if key, ok := caPrivateKey.(*rsa.PrivateKey); ok {
+		sshPubKey, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &certAuthority{private: kcerts.FromRSA(key), public: sshPubKey}, nil
+	}
+	if key, ok := caPrivateKey.(*ecdsa.PrivateKey); ok {
+		sshPubKey, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &certAuthority{private: kcerts.FromECDSA(key), public: sshPubKey}, nil
+	}
+	return nil, fmt.Errorf("keys could not be processed, keys of type %v are not supported", reflect.TypeOf(caPrivateKey))
+}
+
+// parseTrustedCAs parses a list of public keys in authorized_keys format.
+func parseTrustedCAs(fileContent []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for rest := bytes.TrimSpace(fileContent); len(rest) > 0; rest = bytes.TrimSpace(rest) {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse trusted CA public key - %w", err)
+		}
+		keys = append(keys, key)
+		rest = next
+	}
+	return keys, nil
+}
+
+// signer returns the primary CA, used to sign certificates, or nil if none is configured.
+func (s *Server) signer() *certAuthority {
+	s.caLock.RLock()
+	defer s.caLock.RUnlock()
+	return s.ca
+}
+
+// TrustedCAs returns the public keys of all the CAs that clients and hosts should trust.
+//
+// This includes the primary CA, the staged CAs that may be promoted, and the
+// additional CAs configured to be trusted, normally retired CAs that may
+// still have valid certificates around.
+func (s *Server) TrustedCAs() []ssh.PublicKey {
+	s.caLock.RLock()
+	defer s.caLock.RUnlock()
+
+	var keys []ssh.PublicKey
+	seen := map[string]struct{}{}
+	add := func(key ssh.PublicKey) {
+		if _, found := seen[string(key.Marshal())]; found {
+			return
+		}
+		seen[string(key.Marshal())] = struct{}{}
+		keys = append(keys, key)
+	}
+	if s.ca != nil {
+		add(s.ca.public)
+	}
+	for _, ca := range s.stagedCAs {
+		add(ca.public)
+	}
+	for _, key := range s.trustedCAs {
+		add(key)
+	}
+	return keys
+}
+
+// marshalledTrustedCAs returns the TrustedCAs in authorized_keys format, one per line.
+func (s *Server) marshalledTrustedCAs() []byte {
+	var result []byte
+	for _, key := range s.TrustedCAs() {
+		result = append(result, ssh.MarshalAuthorizedKey(key)...)
+	}
+	return result
+}
+
+// PromoteCA implements the AuthAdmin.PromoteCA RPC.
+//
+// The promotion only lasts until the server is restarted: the flags must be
+// updated to make the change permanent.
+func (s *Server) PromoteCA(ctx context.Context, req *apb.PromoteCARequest) (*apb.PromoteCAResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	s.caLock.Lock()
+	defer s.caLock.Unlock()
+
+	var available []string
+	for ix, staged := range s.stagedCAs {
+		if staged.Fingerprint() != req.Fingerprint {
+			available = append(available, staged.Fingerprint())
+			continue
+		}
+
+		resp := &apb.PromoteCAResponse{Primary: staged.Fingerprint()}
+		// The previous primary remains staged, so it is still trusted and the promotion can be undone.
+		if s.ca != nil {
+			resp.Previous = s.ca.Fingerprint()
+			s.stagedCAs[ix] = s.ca
+		} else {
+			s.stagedCAs = append(s.stagedCAs[:ix], s.stagedCAs[ix+1:]...)
+		}
+		s.ca = staged
+
+		s.log.Infof("CA %s promoted to primary on request of %s, previous primary %s",
+			resp.Primary, oauth.GetCredentials(ctx).Identity.GlobalName(), resp.Previous)
+		return resp, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "no staged CA with fingerprint %s - staged CAs: %v", req.Fingerprint, available)
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// trustedBy returns a function checking certificates like sshd configured with TrustedUserCAKeys
+// set to the public keys returned by the auth server.
+func trustedBy(t *testing.T, marshalled []byte) func(cert *ssh.Certificate) error {
+	cas, err := parseTrustedCAs(marshalled)
+	assert.Nil(t, err, err)
+	checker := &ssh.CertChecker{}
+	return func(cert *ssh.Certificate) error {
+		for _, ca := range cas {
+			if string(ca.Marshal()) == string(cert.SignatureKey.Marshal()) {
+				return checker.CheckCert("emma.goldman", cert)
+			}
+		}
+		return fmt.Errorf("certificate signed by untrusted CA %s", ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+}
+
+func TestCARotation(t *testing.T) {
+	rng := rand.New(srand.Source)
+
+	oldCA, err := parseCA([]byte(edTestCert))
+	assert.Nil(t, err, err)
+	newPub, newPriv, err := kcerts.GenerateED25519()
+	assert.Nil(t, err, err)
+	newPem, err := newPriv.SSHPemEncode()
+	assert.Nil(t, err, err)
+	newFingerprint := ssh.FingerprintSHA256(newPub)
+
+	server, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithStagedCA(newPem),
+		WithUserCertTimeLimit(time.Hour), WithAdmins("root@writers.org"))
+	assert.Nil(t, err, err)
+
+	// While staged, the new CA is trusted, but not used for signing.
+	tresp := Authenticate(t, rng, server, ssh.MarshalAuthorizedKey(newPub))
+	trusted, err := parseTrustedCAs(tresp.Capublickey)
+	assert.Nil(t, err, err)
+	assert.Equal(t, 2, len(trusted))
+	oldCert := issueCert(t, rng, server)
+	assert.Equal(t, oldCA.public.Marshal(), oldCert.SignatureKey.Marshal())
+
+	_, err = server.PromoteCA(adminContext("emma.goldman", "writers.org"), &apb.PromoteCARequest{Fingerprint: newFingerprint})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.PromoteCA(adminContext("root", "writers.org"), &apb.PromoteCARequest{Fingerprint: "SHA256:unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	presp, err := server.PromoteCA(adminContext("root", "writers.org"), &apb.PromoteCARequest{Fingerprint: newFingerprint})
+	assert.Nil(t, err, err)
+	assert.Equal(t, newFingerprint, presp.Primary)
+	assert.Equal(t, oldCA.Fingerprint(), presp.Previous)
+
+	// New certificates are signed by the new CA, old certificates are still accepted during the overlap.
+	tresp = Authenticate(t, rng, server, ssh.MarshalAuthorizedKey(newPub))
+	checker := trustedBy(t, tresp.Capublickey)
+	newCert := issueCert(t, rng, server)
+	assert.Equal(t, newPub.Marshal(), newCert.SignatureKey.Marshal())
+	assert.Nil(t, checker(newCert))
+	assert.Nil(t, checker(oldCert))
+
+	// Hosts that only trust the old CA keep working with certificates issued before the promotion.
+	oldOnly := trustedBy(t, ssh.MarshalAuthorizedKey(oldCA.public))
+	assert.Nil(t, oldOnly(oldCert))
+	assert.NotNil(t, oldOnly(newCert))
+
+	// The previous primary is now staged, so the promotion can be undone.
+	presp, err = server.PromoteCA(adminContext("root", "writers.org"), &apb.PromoteCARequest{Fingerprint: oldCA.Fingerprint()})
+	assert.Nil(t, err, err)
+	assert.Equal(t, newFingerprint, presp.Previous)
+}
+
+func TestRetiredCA(t *testing.T) {
+	rng := rand.New(srand.Source)
+
+	oldServer, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithUserCertTimeLimit(time.Hour))
+	assert.Nil(t, err, err)
+	oldCert := issueCert(t, rng, oldServer)
+	oldCA := oldServer.signer().public
+
+	_, newPriv, err := kcerts.GenerateED25519()
+	assert.Nil(t, err, err)
+	newPem, err := newPriv.SSHPemEncode()
+	assert.Nil(t, err, err)
+
+	// After the rotation is complete, the old CA can be configured as trusted only.
+	server, err := New(rng, WithAuthURL("static-prefix"), WithCA(newPem), WithTrustedCAs(ssh.MarshalAuthorizedKey(oldCA)),
+		WithUserCertTimeLimit(time.Hour), WithAdmins("root@writers.org"))
+	assert.Nil(t, err, err)
+	assert.Equal(t, 2, len(server.TrustedCAs()))
+
+	hostPub, _, err := kcerts.GenerateED25519()
+	assert.Nil(t, err, err)
+	hresp, err := server.HostCertificate(context.Background(), &apb.HostCertificateRequest{
+		Hostcert: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ssh.MarshalAuthorizedKey(hostPub)}),
+		Hosts:    []string{"localhost"},
+	})
+	assert.Nil(t, err, err)
+	hostCert, _, _, _, err := ssh.ParseAuthorizedKey(hresp.Signedhostcert)
+	assert.Nil(t, err, err)
+	assert.Equal(t, server.signer().public.Marshal(), hostCert.(*ssh.Certificate).SignatureKey.Marshal())
+	assert.Nil(t, trustedBy(t, hresp.Capublickey)(oldCert))
+
+	// Certificates of the retired CA can still be revoked.
+	_, err = server.Revoke(adminContext("root", "writers.org"), &apb.RevokeRequest{Serial: []uint64{oldCert.Serial}})
+	assert.Nil(t, err, err)
+	krl := fetchKRL(t, server)
+	assert.Equal(t, 2, len(krl.Certificates))
+	assert.True(t, krl.IsRevoked(oldCert))
+
+	_, err = New(rng, WithAuthURL("static-prefix"), WithTrustedCAs([]byte("not a key")))
+	assert.NotNil(t, err)
+}
@@ -1,44 +1,77 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
-	"github.com/System233/enkit/lib/kcerts"
 	"github.com/System233/enkit/lib/logger"
-	"golang.org/x/crypto/ed25519"
-	"golang.org/x/crypto/ssh"
 	"math/rand"
-	"reflect"
 	"strings"
 	"time"
 
 	"github.com/System233/enkit/auth/common"
 	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/khttp/kclient"
+	mpb "github.com/System233/enkit/machinist/rpc"
 	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Flags struct {
 	TimeLimit         time.Duration
+	JarMaxAge         time.Duration
+	MaxJars           int
+	PollInterval      time.Duration
 	AuthURL           string
 	Principals        string
-	UseGroups	  bool
+	UseGroups         bool
 	CA                []byte
+	StagedCA          []byte
+	TrustedCAs        []byte
 	UserCertTimeLimit time.Duration
+	RevocationFile    string
+	SessionFile       string
+	SessionKey        []byte
+	Admins            string
+	MachinistAddress  string
+	MachinistBypass   bool
+	MachinistTLS      bool
+	MachinistCAFile   string
+	MachinistCertFile string
+	MachinistKeyFile  string
 }
 
 func DefaultFlags() *Flags {
 	return &Flags{
-		TimeLimit: time.Minute * 30,
-		UseGroups: true,
+		TimeLimit:    time.Minute * 30,
+		MaxJars:      100000,
+		PollInterval: time.Second * 2,
+		UseGroups:    true,
 	}
 }
 
 func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.DurationVar(&f.TimeLimit, prefix+"time-limit", f.TimeLimit, "How long to wait at most for the user to complete authentication, before freeing resources")
+	set.DurationVar(&f.JarMaxAge, prefix+"jar-max-age", f.JarMaxAge, "How long to keep the state of an abandoned authentication request around, before freeing it. If 0, twice the time-limit")
+	set.IntVar(&f.MaxJars, prefix+"max-jars", f.MaxJars, "How many authentication requests can be in progress at once, before new ones are rejected. If 0, no limit")
+	set.DurationVar(&f.PollInterval, prefix+"poll-interval", f.PollInterval, "How often clients not willing to wait for authentication to complete are asked to poll")
 	set.DurationVar(&f.UserCertTimeLimit, prefix+"user-cert-ttl", 24*time.Hour, "How long a user's ssh certificates are valid for before they expire")
 	set.StringVar(&f.Principals, prefix+"principals", f.Principals, "Authorized ssh users which the ability to auth, in a comma separated string e.g. \"john,root,admin,smith\"")
 	set.ByteFileVar(&f.CA, prefix+"ca", "", "Path to the certificate authority private file")
+	set.ByteFileVar(&f.StagedCA, prefix+"staged-ca", "", "Path to the private file of a certificate authority to trust, and use for signing once promoted via the PromoteCA RPC")
+	set.ByteFileVar(&f.TrustedCAs, prefix+"trusted-cas", "", "Path to a file with the public keys of additional certificate authorities to trust, in authorized_keys format")
 	set.BoolVar(&f.UseGroups, prefix+"use-groups", f.UseGroups, "If set to true, user groups are saved as principals in the user certificate")
+	set.StringVar(&f.RevocationFile, prefix+"revocation-file", f.RevocationFile, "Path of a file where to persist issued and revoked certificates. If empty, revocations are lost on restart")
+	set.StringVar(&f.SessionFile, prefix+"session-file", f.SessionFile, "Path of a file where to persist, encrypted, the certificates issued to users, to list and revoke sessions. If empty, sessions are kept in memory only")
+	set.ByteFileVar(&f.SessionKey, prefix+"session-key", "", "Path to a file with the key to encrypt the session-file with - 32 random bytes, or 64 hex digits")
+	set.StringVar(&f.Admins, prefix+"admins", f.Admins, "Users allowed to perform administrative operations, like revoking certificates, in a comma separated string e.g. \"john@example.com,admin@example.com\"")
+	set.StringVar(&f.MachinistAddress, prefix+"machinist-controller", f.MachinistAddress, "Address (host:port) of the machinist controller. If set, host certificates are only signed for registered, non drained, nodes")
+	set.BoolVar(&f.MachinistTLS, prefix+"machinist-tls", f.MachinistTLS, "Connect to the machinist-controller with TLS, verifying its certificate with the system CAs. Implied by the other machinist-*-file flags")
+	set.StringVar(&f.MachinistCAFile, prefix+"machinist-ca-file", f.MachinistCAFile, "Path of the PEM encoded CAs to verify the certificate of the machinist-controller with, in addition to the system ones")
+	set.StringVar(&f.MachinistCertFile, prefix+"machinist-cert-file", f.MachinistCertFile, "Path of the PEM encoded certificate to present to the machinist-controller, if it requires clients to authenticate")
+	set.StringVar(&f.MachinistKeyFile, prefix+"machinist-key-file", f.MachinistKeyFile, "Path of the PEM encoded private key of the machinist-cert-file")
+	set.BoolVar(&f.MachinistBypass, prefix+"machinist-bypass", f.MachinistBypass, "Sign host certificates even if the host is not a registered, non drained, machinist node - rejections are still logged. Useful to bootstrap hosts that have not registered yet")
 	return f
 }
 
@@ -47,12 +80,27 @@ func WithFlags(f *Flags) Modifier {
 		if err := WithTimeLimit(f.TimeLimit)(s); err != nil {
 			return err
 		}
+		if err := WithJarMaxAge(f.JarMaxAge)(s); err != nil {
+			return err
+		}
+		if err := WithMaxJars(f.MaxJars)(s); err != nil {
+			return err
+		}
+		if err := WithPollInterval(f.PollInterval)(s); err != nil {
+			return err
+		}
 		if err := WithAuthURL(f.AuthURL)(s); err != nil {
 			return err
 		}
 		if err := WithCA(f.CA)(s); err != nil {
 			return err
 		}
+		if err := WithStagedCA(f.StagedCA)(s); err != nil {
+			return err
+		}
+		if err := WithTrustedCAs(f.TrustedCAs)(s); err != nil {
+			return err
+		}
 		if err := WithUserCertTimeLimit(f.UserCertTimeLimit)(s); err != nil {
 			return err
 		}
@@ -62,6 +110,25 @@ func WithFlags(f *Flags) Modifier {
 		if err := WithUseGroups(f.UseGroups)(s); err != nil {
 			return err
 		}
+		if err := WithRevocationFile(f.RevocationFile)(s); err != nil {
+			return err
+		}
+		if err := WithSessionFile(f.SessionFile, f.SessionKey)(s); err != nil {
+			return err
+		}
+		if err := WithAdmins(f.Admins)(s); err != nil {
+			return err
+		}
+		config, err := MachinistTLSConfig(f)
+		if err != nil {
+			return err
+		}
+		if err := WithMachinistController(f.MachinistAddress, config)(s); err != nil {
+			return err
+		}
+		if err := WithMachinistBypass(f.MachinistBypass)(s); err != nil {
+			return err
+		}
 		if s.authURL == "" || s.authURL == "/" {
 			return fmt.Errorf("an auth-url must be supplied using the --auth-url parameter")
 		}
@@ -88,6 +155,14 @@ func WithUseGroups(use bool) Modifier {
 	}
 }
 
+// WithPollInterval sets the poll interval suggested to clients using the nowait mode of Token.
+func WithPollInterval(interval time.Duration) Modifier {
+	return func(s *Server) error {
+		s.pollInterval = interval
+		return nil
+	}
+}
+
 func WithTimeLimit(limit time.Duration) Modifier {
 	return func(s *Server) error {
 		s.limit = limit
@@ -95,36 +170,69 @@ func WithTimeLimit(limit time.Duration) Modifier {
 	}
 }
 
+// WithJarMaxAge sets how long to keep the state of authentication requests that are never completed or claimed.
+//
+// If 0, twice the time limit is used.
+func WithJarMaxAge(age time.Duration) Modifier {
+	return func(s *Server) error {
+		s.jarMaxAge = age
+		return nil
+	}
+}
+
+// WithMaxJars limits the number of authentication requests in progress. If 0, there is no limit.
+func WithMaxJars(max int) Modifier {
+	return func(s *Server) error {
+		s.maxJars = max
+		return nil
+	}
+}
+
 func WithCA(fileContent []byte) Modifier {
 	return func(server *Server) error {
 		if len(fileContent) == 0 {
 			server.log.Warnf("CA file not specified - will operate without certificates")
 			return nil
 		}
-		caPrivateKey, err := ssh.ParseRawPrivateKey(fileContent)
+		ca, err := parseCA(fileContent)
 		if err != nil {
-			return fmt.Errorf("Could not parse CA key - %w", err)
-		}
-		// TODO(adam): make parsing existing keys cleaner
-		if key, ok := caPrivateKey.(*ed25519.PrivateKey); ok {
-			server.caPrivateKey = kcerts.FromEC25519(*key)
-			sshPubKey, err := ssh.NewPublicKey(key.Public())
-			if err != nil {
-				return err
-			}
-			server.marshalledCAPublicKey = ssh.MarshalAuthorizedKey(sshPubKey)
-			return nil
+			return err
 		}
-		if key, ok := caPrivateKey.(*rsa.PrivateKey); ok {
-			server.caPrivateKey = kcerts.FromRSA(key)
-			sshPubKey, err := ssh.NewPublicKey(key.Public())
-			if err != nil {
-				return err
-			}
-			server.marshalledCAPublicKey = ssh.MarshalAuthorizedKey(sshPubKey)
+		server.ca = ca
+		return nil
+	}
+}
+
+// WithStagedCA adds a CA that is trusted, but not used for signing until promoted with PromoteCA.
+//
+// During a rotation, the new CA should be staged long enough for all the
+// clients and hosts to have refreshed their list of trusted CAs.
+func WithStagedCA(fileContent []byte) Modifier {
+	return func(server *Server) error {
+		if len(fileContent) == 0 {
 			return nil
 		}
-		return fmt.Errorf("keys could not be processed, keys of type %v are not supported", reflect.TypeOf(caPrivateKey))
+		ca, err := parseCA(fileContent)
+		if err != nil {
+			return fmt.Errorf("staged CA - %w", err)
+		}
+		server.stagedCAs = append(server.stagedCAs, ca)
+		return nil
+	}
+}
+
+// WithTrustedCAs adds public keys of CAs to trust, in authorized_keys format.
+//
+// This is typically used to keep trusting a retired CA until all the
+// certificates it signed have expired.
+func WithTrustedCAs(fileContent []byte) Modifier {
+	return func(server *Server) error {
+		keys, err := parseTrustedCAs(fileContent)
+		if err != nil {
+			return err
+		}
+		server.trustedCAs = append(server.trustedCAs, keys...)
+		return nil
 	}
 }
 
@@ -138,6 +246,128 @@ func WithPrincipals(raw string) Modifier {
 	}
 }
 
+// WithRevocationFile configures the file used to persist issued and revoked certificates.
+func WithRevocationFile(path string) Modifier {
+	return func(server *Server) error {
+		revocations, err := NewRevocations(path)
+		if err != nil {
+			return err
+		}
+		server.revocations = revocations
+		return nil
+	}
+}
+
+// WithSessionStore configures the store used to persist the sessions of users.
+func WithSessionStore(store SessionStore) Modifier {
+	return func(server *Server) error {
+		server.sessions = store
+		return nil
+	}
+}
+
+// WithSessionFile persists the sessions of users in the file specified, encrypted with key.
+//
+// If path is empty, sessions are kept in memory only.
+func WithSessionFile(path string, key []byte) Modifier {
+	return func(server *Server) error {
+		if path == "" {
+			return nil
+		}
+		parsed, err := ParseSessionKey(key)
+		if err != nil {
+			return fmt.Errorf("invalid session key for %s - %w", path, err)
+		}
+		store, err := NewFileSessionStore(path, parsed)
+		if err != nil {
+			return err
+		}
+		return WithSessionStore(store)(server)
+	}
+}
+
+// WithAdmins configures the users allowed to invoke the AuthAdmin RPCs, as a comma separated list of global names.
+func WithAdmins(raw string) Modifier {
+	return func(server *Server) error {
+		server.admins = nil
+		for _, admin := range strings.Split(raw, ",") {
+			if admin = strings.TrimSpace(admin); admin != "" {
+				server.admins = append(server.admins, admin)
+			}
+		}
+		return nil
+	}
+}
+
+// WithNodeLookup verifies hosts requesting certificates against the nodes returned by lookup.
+func WithNodeLookup(lookup NodeLookup) Modifier {
+	return func(server *Server) error {
+		server.nodes = lookup
+		return nil
+	}
+}
+
+// MachinistTLSConfig returns the TLS configuration to connect to the machinist controller with.
+//
+// Returns nil if none of the machinist TLS flags are set, in which case the
+// connection is not encrypted.
+func MachinistTLSConfig(f *Flags) (*tls.Config, error) {
+	if !f.MachinistTLS && f.MachinistCAFile == "" && f.MachinistCertFile == "" && f.MachinistKeyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if f.MachinistCAFile != "" {
+		pool, err := kclient.LoadRootCAs(f.MachinistCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if f.MachinistCertFile != "" || f.MachinistKeyFile != "" {
+		if f.MachinistCertFile == "" || f.MachinistKeyFile == "" {
+			return nil, kflags.NewUsageErrorf("--machinist-cert-file and --machinist-key-file must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(f.MachinistCertFile, f.MachinistKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the machinist client certificate - %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// WithMachinistController verifies hosts requesting certificates with the machinist controller at address.
+//
+// If config is nil, the connection to the controller is not encrypted.
+// If address is empty, host certificates are signed for any host.
+func WithMachinistController(address string, config *tls.Config) Modifier {
+	return func(server *Server) error {
+		if address == "" {
+			return nil
+		}
+		creds := insecure.NewCredentials()
+		if config != nil {
+			creds = credentials.NewTLS(config)
+		}
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return fmt.Errorf("could not connect to machinist controller %s - %w", address, err)
+		}
+		return WithNodeLookup(mpb.NewControllerClient(conn))(server)
+	}
+}
+
+// WithMachinistBypass signs host certificates even when the machinist verification fails.
+//
+// Failures are still logged, this is meant to bootstrap hosts not registered yet.
+func WithMachinistBypass(bypass bool) Modifier {
+	return func(server *Server) error {
+		server.nodesBypass = bypass
+		return nil
+	}
+}
+
 func WithUserCertTimeLimit(duration time.Duration) Modifier {
 	return func(server *Server) error {
 		server.userCertTTL = duration
@@ -159,12 +389,15 @@ func New(rng *rand.Rand, mods ...Modifier) (*Server, error) {
 	}
 
 	s := &Server{
-		rng:        rng,
-		serverPub:  (*common.Key)(pub),
-		serverPriv: (*common.Key)(priv),
-		useGroups:  true,
-		jars:       map[common.Key]*Jar{},
-		limit:      30 * time.Minute,
+		rng:          rng,
+		serverPub:    (*common.Key)(pub),
+		serverPriv:   (*common.Key)(priv),
+		useGroups:    true,
+		jars:         map[common.Key]*Jar{},
+		limit:        30 * time.Minute,
+		pollInterval: 2 * time.Second,
+		nodesTimeout: DefaultNodeLookupTimeout,
+		log:          logger.Nil,
 	}
 
 	for _, m := range mods {
@@ -173,6 +406,16 @@ func New(rng *rand.Rand, mods ...Modifier) (*Server, error) {
 		}
 	}
 
+	if s.jarMaxAge <= 0 {
+		s.jarMaxAge = 2 * s.limit
+	}
+	if s.revocations == nil {
+		s.revocations = &Revocations{}
+	}
+	if s.sessions == nil {
+		s.sessions = NewMemorySessionStore()
+	}
+
 	s.authURL = strings.TrimSuffix(s.authURL, "/")
 	if s.authURL == "" {
 		return nil, fmt.Errorf("API usage error - an authentication URL must be set")
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var metricHostChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "auth",
+	Name:      "host_certificate_checks",
+	Help:      "Number of host certificate requests checked against the nodes registered with machinist",
+},
+	[]string{
+		// One of allowed, denied, or bypassed - denied, but signed as the bypass is enabled.
+		"result",
+	},
+)
+
+// NodeLookup finds the machinist nodes matching the principals of a host.
+//
+// It is implemented by the machinist ControllerClient.
+type NodeLookup interface {
+	Lookup(ctx context.Context, in *mpb.LookupRequest, opts ...grpc.CallOption) (*mpb.LookupResponse, error)
+}
+
+// DefaultNodeLookupTimeout is how long to wait for machinist before rejecting a host certificate request.
+const DefaultNodeLookupTimeout = 10 * time.Second
+
+// unidentifyingPrincipals are valid for every host, and are not looked up in machinist.
+var unidentifyingPrincipals = map[string]bool{
+	"localhost": true,
+	"127.0.0.1": true,
+	"::1":       true,
+}
+
+// formatLookup describes the result of a machinist lookup, for audit logs.
+func formatLookup(nodes []*mpb.LookupNode) string {
+	if len(nodes) == 0 {
+		return "no matching nodes"
+	}
+	var result []string
+	for _, node := range nodes {
+		entry := fmt.Sprintf("%s -> %s/%s", node.Principal, node.Site, node.Name)
+		if node.Drained {
+			entry += " (drained)"
+		}
+		result = append(result, entry)
+	}
+	return strings.Join(result, ", ")
+}
+
+// checkNode verifies that the principals identify a single registered, non drained node.
+//
+// Principals not identifying a host, like localhost, are ignored. Every other
+// principal must match the same node, so a host cannot request a certificate
+// valid for the name of another host.
+func checkNode(principals []string, nodes []*mpb.LookupNode) error {
+	var candidates map[string]*mpb.LookupNode
+	checked := 0
+	for _, principal := range principals {
+		if unidentifyingPrincipals[principal] {
+			continue
+		}
+		checked++
+
+		found := false
+		matching := map[string]*mpb.LookupNode{}
+		for _, node := range nodes {
+			if node.Principal != principal {
+				continue
+			}
+			found = true
+			key := node.Site + "/" + node.Name
+			if candidates == nil || candidates[key] != nil {
+				matching[key] = node
+			}
+		}
+		if !found {
+			return fmt.Errorf("principal %s does not match any registered node", principal)
+		}
+		if len(matching) == 0 {
+			return fmt.Errorf("principal %s does not match the same node as the other principals", principal)
+		}
+		candidates = matching
+	}
+	if checked == 0 {
+		return fmt.Errorf("no principal identifying the host was requested")
+	}
+	if len(candidates) > 1 {
+		var names []string
+		for key := range candidates {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("principals match multiple nodes (%s) - request the fully qualified name of the host", strings.Join(names, ", "))
+	}
+	for key, node := range candidates {
+		if node.Drained {
+			return fmt.Errorf("node %s is drained", key)
+		}
+	}
+	return nil
+}
+
+// verifyHost checks a host certificate request against the nodes registered with machinist.
+//
+// If no machinist controller is configured, all requests are accepted.
+// Rejections are audited with the result of the lookup. With the bypass
+// enabled, rejected requests are audited, but allowed to proceed. This is
+// necessary to bootstrap hosts, which only register with machinist after
+// obtaining their certificate.
+func (s *Server) verifyHost(ctx context.Context, principals []string) error {
+	if s.nodes == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.nodesTimeout)
+	defer cancel()
+	resp, err := s.nodes.Lookup(ctx, &mpb.LookupRequest{Principal: principals})
+	var lookup string
+	if err != nil {
+		lookup = fmt.Sprintf("lookup failed - %s", err)
+		err = fmt.Errorf("could not verify the host with machinist")
+	} else {
+		lookup = formatLookup(resp.Node)
+		err = checkNode(principals, resp.Node)
+	}
+
+	if err == nil {
+		metricHostChecks.WithLabelValues("allowed").Inc()
+		s.log.Infof("AUDIT: host certificate for %v ALLOWED - machinist lookup: %s", principals, lookup)
+		return nil
+	}
+	if s.nodesBypass {
+		metricHostChecks.WithLabelValues("bypassed").Inc()
+		s.log.Warnf("AUDIT: host certificate for %v would be DENIED, signing anyway as the machinist bypass is enabled - %s - machinist lookup: %s", principals, err, lookup)
+		return nil
+	}
+	metricHostChecks.WithLabelValues("denied").Inc()
+	s.log.Warnf("AUDIT: host certificate for %v DENIED - %s - machinist lookup: %s", principals, err, lookup)
+	return status.Errorf(codes.PermissionDenied, "host certificate denied - %s", err)
+}
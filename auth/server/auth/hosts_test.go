@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/srand"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeNodeLookup returns the nodes configured for each principal, like a machinist controller would.
+type fakeNodeLookup struct {
+	nodes map[string][]*mpb.LookupNode
+	err   error
+}
+
+func (f *fakeNodeLookup) Lookup(ctx context.Context, in *mpb.LookupRequest, opts ...grpc.CallOption) (*mpb.LookupResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp := &mpb.LookupResponse{}
+	for _, principal := range in.Principal {
+		for _, node := range f.nodes[principal] {
+			resp.Node = append(resp.Node, &mpb.LookupNode{Principal: principal, Name: node.Name, Site: node.Site, Drained: node.Drained})
+		}
+	}
+	return resp, nil
+}
+
+func hostCertRequest(t *testing.T, hosts ...string) *apb.HostCertificateRequest {
+	pub, _, err := kcerts.GenerateED25519()
+	assert.Nil(t, err, err)
+	return &apb.HostCertificateRequest{
+		Hostcert: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ssh.MarshalAuthorizedKey(pub)}),
+		Hosts:    hosts,
+	}
+}
+
+func TestHostCertificateMachinist(t *testing.T) {
+	rng := rand.New(srand.Source)
+	node01 := &mpb.LookupNode{Name: "node01", Site: "default"}
+	lab2node01 := &mpb.LookupNode{Name: "node01", Site: "lab2"}
+	node02 := &mpb.LookupNode{Name: "node02", Site: "lab2"}
+	drained := &mpb.LookupNode{Name: "node03", Site: "lab2", Drained: true}
+	lookup := &fakeNodeLookup{nodes: map[string][]*mpb.LookupNode{
+		"node01":                  {node01, lab2node01},
+		"node01.enkit.cloud":      {node01},
+		"node01.lab2.enkit.cloud": {lab2node01},
+		"10.1.0.1":                {lab2node01},
+		"node02.lab2.enkit.cloud": {node02},
+		"node03.lab2.enkit.cloud": {drained},
+	}}
+
+	server, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithNodeLookup(lookup))
+	assert.Nil(t, err, err)
+
+	for _, tc := range []struct {
+		hosts   []string
+		allowed bool
+	}{
+		{[]string{"localhost", "node01.enkit.cloud"}, true},
+		{[]string{"node01.lab2.enkit.cloud", "node01", "10.1.0.1"}, true},
+		// Unknown hosts.
+		{[]string{"unknown.enkit.cloud"}, false},
+		{[]string{"node01.enkit.cloud", "unknown.enkit.cloud"}, false},
+		// Drained hosts.
+		{[]string{"node03.lab2.enkit.cloud"}, false},
+		// Names of other hosts, or ambiguous names.
+		{[]string{"node01.lab2.enkit.cloud", "node02.lab2.enkit.cloud"}, false},
+		{[]string{"node01"}, false},
+		// Nothing identifying the host.
+		{[]string{"localhost"}, false},
+		{nil, false},
+	} {
+		t.Run(fmt.Sprintf("%v", tc.hosts), func(t *testing.T) {
+			resp, err := server.HostCertificate(context.Background(), hostCertRequest(t, tc.hosts...))
+			if !tc.allowed {
+				assert.Equal(t, codes.PermissionDenied, status.Code(err), "%v", err)
+				return
+			}
+			assert.Nil(t, err, err)
+			cert, _, _, _, err := ssh.ParseAuthorizedKey(resp.Signedhostcert)
+			assert.Nil(t, err, err)
+			assert.Equal(t, tc.hosts, cert.(*ssh.Certificate).ValidPrincipals)
+		})
+	}
+
+	// Fail closed if machinist cannot be reached.
+	lookup.err = status.Errorf(codes.Unavailable, "connection refused")
+	_, err = server.HostCertificate(context.Background(), hostCertRequest(t, "node01.enkit.cloud"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "%v", err)
+
+	// With the bypass, rejected hosts are signed anyway.
+	lookup.err = nil
+	bypass, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithNodeLookup(lookup), WithMachinistBypass(true))
+	assert.Nil(t, err, err)
+	_, err = bypass.HostCertificate(context.Background(), hostCertRequest(t, "unknown.enkit.cloud"))
+	assert.Nil(t, err, err)
+	_, err = bypass.HostCertificate(context.Background(), hostCertRequest(t, "node03.lab2.enkit.cloud"))
+	assert.Nil(t, err, err)
+
+	// Without machinist, any host is signed.
+	open, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)))
+	assert.Nil(t, err, err)
+	_, err = open.HostCertificate(context.Background(), hostCertRequest(t, "unknown.enkit.cloud"))
+	assert.Nil(t, err, err)
+}
+
+func TestFormatLookup(t *testing.T) {
+	assert.Equal(t, "no matching nodes", formatLookup(nil))
+	assert.Equal(t, "a -> lab2/node01, b -> default/node02 (drained)", formatLookup([]*mpb.LookupNode{
+		{Principal: "a", Name: "node01", Site: "lab2"},
+		{Principal: "b", Name: "node02", Site: "default", Drained: true},
+	}))
+}
+
+func TestMachinistTLSConfig(t *testing.T) {
+	config, err := MachinistTLSConfig(DefaultFlags())
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	config, err = MachinistTLSConfig(&Flags{MachinistTLS: true})
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	assert.Nil(t, config.RootCAs)
+	assert.Empty(t, config.Certificates)
+
+	var ue *kflags.UsageError
+	_, err = MachinistTLSConfig(&Flags{MachinistCertFile: "client.crt"})
+	assert.True(t, errors.As(err, &ue), "%v", err)
+	_, err = MachinistTLSConfig(&Flags{MachinistCAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+
+	// The connection is established lazily, the controller does not need to be running.
+	server, err := New(rand.New(srand.Source), WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithMachinistController("localhost:1", config))
+	assert.NoError(t, err)
+	assert.NotNil(t, server.nodes)
+}
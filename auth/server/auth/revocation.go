@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/oauth"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IssuedCert records a certificate signed by the server, so it can be revoked later.
+type IssuedCert struct {
+	Serial uint64
+	// GlobalName of the user the certificate was issued to, empty for host certificates.
+	User        string
+	Issued      time.Time
+	ValidBefore time.Time
+}
+
+// RevokedCert is an entry in the revocation list.
+type RevokedCert struct {
+	Serial  uint64
+	Revoked time.Time
+	// Once the certificate expires, there is no need to keep it in the KRL.
+	ValidBefore time.Time
+}
+
+type revocationState struct {
+	Version uint64
+	Issued  []IssuedCert
+	Revoked []RevokedCert
+}
+
+// issuedSaveDelay is how long the records of issued certificates are batched before being saved.
+const issuedSaveDelay = 5 * time.Second
+
+// Revocations keeps track of issued and revoked certificates.
+//
+// If a path is configured, the state is saved there after each revocation, and
+// loaded at startup, so that revocations survive restarts. Records of issued
+// certificates are batched, and saved at most once every saveDelay.
+type Revocations struct {
+	lock  sync.Mutex
+	path  string
+	state revocationState
+
+	saveDelay time.Duration
+	// True while a save of the issued certificates is scheduled.
+	pending bool
+	// Error of the last scheduled save, returned by the next call to Issued.
+	pendingErr error
+}
+
+// NewRevocations returns a Revocations object, loading the existing state from path if set and present.
+func NewRevocations(path string) (*Revocations, error) {
+	r := &Revocations{path: path, saveDelay: issuedSaveDelay}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("could not read revocation state - %w", err)
+	}
+	if err := json.Unmarshal(data, &r.state); err != nil {
+		return nil, fmt.Errorf("could not parse revocation state in %s - %w", path, err)
+	}
+	return r, nil
+}
+
+// save must be called with the lock held. It also saves the issued certificates pending a scheduled save.
+func (r *Revocations) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&r.state)
+	if err != nil {
+		return err
+	}
+	r.pending = false
+	return atomicfile.WriteFile(r.path, data, 0600)
+}
+
+// saveLater schedules a save after saveDelay, unless one is already scheduled. Must be called with the lock held.
+func (r *Revocations) saveLater() {
+	if r.path == "" || r.pending {
+		return
+	}
+	r.pending = true
+	time.AfterFunc(r.saveDelay, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.pending {
+			r.pendingErr = r.save()
+		}
+	})
+}
+
+// expire drops entries for certificates that are no longer valid. Must be called with the lock held.
+func (r *Revocations) expire(now time.Time) {
+	issued := r.state.Issued[:0]
+	for _, i := range r.state.Issued {
+		if i.ValidBefore.After(now) {
+			issued = append(issued, i)
+		}
+	}
+	r.state.Issued = issued
+
+	revoked := r.state.Revoked[:0]
+	for _, i := range r.state.Revoked {
+		if i.ValidBefore.After(now) {
+			revoked = append(revoked, i)
+		}
+	}
+	r.state.Revoked = revoked
+}
+
+// Issued records a newly signed certificate.
+//
+// The record is saved with a delay: an error returned is from saving previous records.
+func (r *Revocations) Issued(cert IssuedCert) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expire(time.Now())
+	r.state.Issued = append(r.state.Issued, cert)
+	r.saveLater()
+
+	err := r.pendingErr
+	r.pendingErr = nil
+	return err
+}
+
+func (r *Revocations) isRevoked(serial uint64) bool {
+	for _, rev := range r.state.Revoked {
+		if rev.Serial == serial {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRevoked returns true if the certificate with the serial specified has been revoked.
+func (r *Revocations) IsRevoked(serial uint64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.isRevoked(serial)
+}
+
+func matchesUser(global, user string) bool {
+	if global == user {
+		return true
+	}
+	return !strings.Contains(user, "@") && strings.SplitN(global, "@", 2)[0] == user
+}
+
+// Revoke adds the certificates selected by the request to the revocation list.
+//
+// maxValidity is used as the expiry time for serials the server has no record of.
+// Returns the list of serials newly revoked, and the version of the list.
+func (r *Revocations) Revoke(req *apb.RevokeRequest, now time.Time, maxValidity time.Duration) ([]uint64, uint64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expire(now)
+
+	var revoked []uint64
+	add := func(serial uint64, validBefore time.Time) {
+		if r.isRevoked(serial) {
+			return
+		}
+		r.state.Revoked = append(r.state.Revoked, RevokedCert{Serial: serial, Revoked: now, ValidBefore: validBefore})
+		revoked = append(revoked, serial)
+	}
+
+	for _, serial := range req.Serial {
+		validBefore := now.Add(maxValidity)
+		for _, issued := range r.state.Issued {
+			if issued.Serial == serial {
+				validBefore = issued.ValidBefore
+				break
+			}
+		}
+		add(serial, validBefore)
+	}
+
+	if req.Username != "" {
+		for _, issued := range r.state.Issued {
+			if !matchesUser(issued.User, req.Username) {
+				continue
+			}
+			if req.IssuedAfter != 0 && issued.Issued.Before(time.Unix(req.IssuedAfter, 0)) {
+				continue
+			}
+			if req.IssuedBefore != 0 && issued.Issued.After(time.Unix(req.IssuedBefore, 0)) {
+				continue
+			}
+			add(issued.Serial, issued.ValidBefore)
+		}
+	}
+
+	if len(revoked) > 0 {
+		r.state.Version++
+		if err := r.save(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return revoked, r.state.Version, nil
+}
+
+// Serials returns the list of revoked serials, and the version of the list.
+func (r *Revocations) Serials() ([]uint64, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	serials := []uint64{}
+	for _, rev := range r.state.Revoked {
+		serials = append(serials, rev.Serial)
+	}
+	return serials, r.state.Version
+}
+
+// nextSerial returns a random, non zero, serial for a new certificate.
+func (s *Server) nextSerial() uint64 {
+	s.serialLock.Lock()
+	defer s.serialLock.Unlock()
+	for {
+		if serial := s.rng.Uint64(); serial != 0 {
+			return serial
+		}
+	}
+}
+
+// recordIssued keeps track of a certificate, so it can be revoked later. Failures are logged, but not fatal.
+func (s *Server) recordIssued(cert *ssh.Certificate, user string) {
+	issued := IssuedCert{
+		Serial:      cert.Serial,
+		User:        user,
+		Issued:      time.Now(),
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+	}
+	if err := s.revocations.Issued(issued); err != nil {
+		s.log.Warnf("could not save the records of issued certificates - %s", err)
+	}
+}
+
+func (s *Server) checkAdmin(ctx context.Context) error {
+	creds := oauth.GetCredentials(ctx)
+	if creds == nil {
+		return status.Errorf(codes.Unauthenticated, "authentication required")
+	}
+	name := creds.Identity.GlobalName()
+	for _, admin := range s.admins {
+		if admin == name {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "user %s is not an administrator", name)
+}
+
+// Revoke implements the AuthAdmin.Revoke RPC.
+func (s *Server) Revoke(ctx context.Context, req *apb.RevokeRequest) (*apb.RevokeResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.Serial) == 0 && req.Username == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must specify either serials or a username to revoke")
+	}
+
+	revoked, version, err := s.revocations.Revoke(req, time.Now(), s.userCertTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not persist revocations - %s", err)
+	}
+	s.log.Infof("revoked %d certificates (%v) on request of %s, KRL now at version %d",
+		len(revoked), revoked, oauth.GetCredentials(ctx).Identity.GlobalName(), version)
+	return &apb.RevokeResponse{Serial: revoked, Version: version}, nil
+}
+
+// KRL returns the current revocation list in OpenSSH format.
+func (s *Server) KRL() ([]byte, error) {
+	cas := s.TrustedCAs()
+	if len(cas) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "no CA configured - nothing to revoke")
+	}
+	serials, version := s.revocations.Serials()
+	krl := &kcerts.KRL{
+		Version:   version,
+		Generated: time.Now(),
+		Comment:   "enkit auth server",
+	}
+	// Serials are random 64 bit numbers, and the server does not track which
+	// CA signed which certificate: revoke them for all trusted CAs.
+	for _, ca := range cas {
+		krl.Certificates = append(krl.Certificates, kcerts.KRLCertificates{CA: ca, Serials: serials})
+	}
+	return krl.Marshal()
+}
+
+// ServeKRL is an http.HandlerFunc returning the KRL, suitable for the sshd RevokedKeys option.
+func (s *Server) ServeKRL(w http.ResponseWriter, r *http.Request) {
+	data, err := s.KRL()
+	if err != nil {
+		code := http.StatusInternalServerError
+		if status.Code(err) == codes.FailedPrecondition {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/oauth"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func adminContext(name, org string) context.Context {
+	return oauth.SetCredentials(context.Background(), &oauth.CredentialsCookie{Identity: oauth.Identity{
+		Username:     name,
+		Organization: org,
+	}})
+}
+
+func issueCert(t *testing.T, rng *rand.Rand, server *Server) *ssh.Certificate {
+	pubKey, _, err := kcerts.GenerateED25519()
+	assert.Nil(t, err, err)
+	tresp := Authenticate(t, rng, server, ssh.MarshalAuthorizedKey(pubKey))
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(tresp.Cert)
+	assert.Nil(t, err, err)
+	cert, ok := parsed.(*ssh.Certificate)
+	assert.True(t, ok)
+	assert.NotEqual(t, uint64(0), cert.Serial)
+	return cert
+}
+
+func fetchKRL(t *testing.T, server *Server) *kcerts.KRL {
+	recorder := httptest.NewRecorder()
+	server.ServeKRL(recorder, httptest.NewRequest(http.MethodGet, "/krl", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	krl, err := kcerts.ParseKRL(recorder.Body.Bytes())
+	assert.Nil(t, err, err)
+	return krl
+}
+
+func TestRevokeBySerial(t *testing.T) {
+	rng := rand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithUserCertTimeLimit(time.Hour), WithAdmins("root@writers.org"))
+	assert.Nil(t, err, err)
+
+	stolen := issueCert(t, rng, server)
+	other := issueCert(t, rng, server)
+	assert.NotEqual(t, stolen.Serial, other.Serial)
+
+	krl := fetchKRL(t, server)
+	assert.False(t, krl.IsRevoked(stolen))
+	assert.Equal(t, uint64(0), krl.Version)
+
+	// Only administrators can revoke.
+	_, err = server.Revoke(context.Background(), &apb.RevokeRequest{Serial: []uint64{stolen.Serial}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = server.Revoke(adminContext("emma.goldman", "writers.org"), &apb.RevokeRequest{Serial: []uint64{stolen.Serial}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	resp, err := server.Revoke(adminContext("root", "writers.org"), &apb.RevokeRequest{Serial: []uint64{stolen.Serial}})
+	assert.Nil(t, err, err)
+	assert.Equal(t, []uint64{stolen.Serial}, resp.Serial)
+	assert.Equal(t, uint64(1), resp.Version)
+
+	krl = fetchKRL(t, server)
+	assert.True(t, krl.IsRevoked(stolen))
+	assert.False(t, krl.IsRevoked(other))
+	assert.Equal(t, uint64(1), krl.Version)
+
+	// Revoking again is a noop.
+	resp, err = server.Revoke(adminContext("root", "writers.org"), &apb.RevokeRequest{Serial: []uint64{stolen.Serial}})
+	assert.Nil(t, err, err)
+	assert.Empty(t, resp.Serial)
+	assert.Equal(t, uint64(1), resp.Version)
+}
+
+func TestRevokeByUserAndTime(t *testing.T) {
+	rng := rand.New(srand.Source)
+	state := filepath.Join(t.TempDir(), "revocations.json")
+	server, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithUserCertTimeLimit(time.Hour), WithAdmins("root@writers.org"), WithRevocationFile(state))
+	assert.Nil(t, err, err)
+
+	before := issueCert(t, rng, server)
+	start := time.Now().Unix() + 1
+	time.Sleep(1100 * time.Millisecond)
+	after := issueCert(t, rng, server)
+
+	resp, err := server.Revoke(adminContext("root", "writers.org"), &apb.RevokeRequest{Username: "emma.goldman", IssuedAfter: start})
+	assert.Nil(t, err, err)
+	assert.Equal(t, []uint64{after.Serial}, resp.Serial)
+
+	krl := fetchKRL(t, server)
+	assert.True(t, krl.IsRevoked(after))
+	assert.False(t, krl.IsRevoked(before))
+
+	// Revocations survive a restart.
+	restarted, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithUserCertTimeLimit(time.Hour), WithAdmins("root@writers.org"), WithRevocationFile(state))
+	assert.Nil(t, err, err)
+	krl = fetchKRL(t, restarted)
+	assert.True(t, krl.IsRevoked(after))
+	assert.False(t, krl.IsRevoked(before))
+
+	// So do the records of issued certificates.
+	resp, err = restarted.Revoke(adminContext("root", "writers.org"), &apb.RevokeRequest{Username: "emma.goldman@writers.org"})
+	assert.Nil(t, err, err)
+	assert.Equal(t, []uint64{before.Serial}, resp.Serial)
+	assert.Equal(t, uint64(2), resp.Version)
+}
+
+func TestRevocationsExpire(t *testing.T) {
+	r, err := NewRevocations("")
+	assert.Nil(t, err)
+
+	now := time.Now()
+	assert.Nil(t, r.Issued(IssuedCert{Serial: 1, User: "a@b", Issued: now.Add(-2 * time.Hour), ValidBefore: now.Add(-time.Hour)}))
+	assert.Nil(t, r.Issued(IssuedCert{Serial: 2, User: "a@b", Issued: now, ValidBefore: now.Add(time.Hour)}))
+
+	revoked, version, err := r.Revoke(&apb.RevokeRequest{Username: "a"}, now, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{2}, revoked)
+	assert.Equal(t, uint64(1), version)
+
+	// Once expired, there is no need to carry the entry in the KRL.
+	_, _, err = r.Revoke(&apb.RevokeRequest{Serial: []uint64{3}}, now.Add(2*time.Hour), time.Hour)
+	assert.Nil(t, err)
+	serials, _ := r.Serials()
+	assert.Equal(t, []uint64{3}, serials)
+}
+
+func TestKRLWithoutCA(t *testing.T) {
+	rng := rand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"))
+	assert.Nil(t, err, err)
+
+	recorder := httptest.NewRecorder()
+	server.ServeKRL(recorder, httptest.NewRequest(http.MethodGet, "/krl", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestRevocationsBatchIssued(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "revocations.json")
+	r, err := NewRevocations(state)
+	assert.Nil(t, err)
+	r.saveDelay = time.Hour
+
+	now := time.Now()
+	assert.Nil(t, r.Issued(IssuedCert{Serial: 1, User: "a@b", Issued: now, ValidBefore: now.Add(time.Hour)}))
+	assert.Nil(t, r.Issued(IssuedCert{Serial: 2, User: "a@b", Issued: now, ValidBefore: now.Add(time.Hour)}))
+	_, err = os.Stat(state)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// A revocation is saved immediately, together with the pending issued certificates.
+	_, _, err = r.Revoke(&apb.RevokeRequest{Serial: []uint64{1}}, now, time.Hour)
+	assert.Nil(t, err)
+	loaded, err := NewRevocations(state)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(loaded.state.Issued))
+
+	r.saveDelay = time.Millisecond
+	assert.Nil(t, r.Issued(IssuedCert{Serial: 3, User: "a@b", Issued: now, ValidBefore: now.Add(time.Hour)}))
+	assert.Eventually(t, func() bool {
+		loaded, err := NewRevocations(state)
+		return err == nil && len(loaded.state.Issued) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
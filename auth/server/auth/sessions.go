@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/oauth"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Session records a user certificate issued by the server.
+type Session struct {
+	Serial uint64
+	// GlobalName of the user the certificate was issued to.
+	User string
+	// SHA256 fingerprint of the public key signed.
+	Fingerprint string
+	Issued      time.Time
+	ValidBefore time.Time
+	// Address of the client requesting the certificate, as seen by the server.
+	ClientIP string
+}
+
+// SessionStore keeps track of the sessions of users.
+//
+// Implementations must be thread safe, and can forget sessions that are no
+// longer valid.
+type SessionStore interface {
+	// Add records a new session.
+	Add(session Session) error
+	// List returns the sessions still valid at the time specified, oldest first.
+	List(now time.Time) ([]Session, error)
+}
+
+// MemorySessionStore is a SessionStore keeping sessions in memory only, lost on restart.
+type MemorySessionStore struct {
+	lock     sync.Mutex
+	sessions []Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{}
+}
+
+// expire must be called with the lock held.
+func (m *MemorySessionStore) expire(now time.Time) {
+	valid := m.sessions[:0]
+	for _, session := range m.sessions {
+		if session.ValidBefore.After(now) {
+			valid = append(valid, session)
+		}
+	}
+	m.sessions = valid
+}
+
+func (m *MemorySessionStore) Add(session Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.expire(time.Now())
+	m.sessions = append(m.sessions, session)
+	return nil
+}
+
+func (m *MemorySessionStore) List(now time.Time) ([]Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result []Session
+	for _, session := range m.sessions {
+		if session.ValidBefore.After(now) {
+			result = append(result, session)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Issued.Before(result[j].Issued) })
+	return result, nil
+}
+
+// SessionKeySize is the size of the keys used to encrypt sessions at rest.
+const SessionKeySize = 32
+
+// ParseSessionKey parses a key to encrypt sessions, either as raw bytes or hex encoded.
+func ParseSessionKey(data []byte) (*[SessionKeySize]byte, error) {
+	var key [SessionKeySize]byte
+	if len(data) == SessionKeySize {
+		copy(key[:], data)
+		return &key, nil
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(decoded) != SessionKeySize {
+		return nil, fmt.Errorf("session key must be %d random bytes, or %d hex digits - generate one with 'openssl rand -hex %d'",
+			SessionKeySize, SessionKeySize*2, SessionKeySize)
+	}
+	copy(key[:], decoded)
+	return &key, nil
+}
+
+// FileSessionStore is a SessionStore persisting sessions in a file, encrypted with a secret key.
+//
+// Sessions include the IP addresses users connect from, which is why they
+// are not stored in clear. The whole file is rewritten at each change, which
+// is fine for the small number of sessions an auth server normally tracks.
+type FileSessionStore struct {
+	MemorySessionStore
+	path string
+	key  *[SessionKeySize]byte
+}
+
+// NewFileSessionStore returns a FileSessionStore, loading the existing sessions from path, if any.
+func NewFileSessionStore(path string, key *[SessionKeySize]byte) (*FileSessionStore, error) {
+	fs := &FileSessionStore{path: path, key: key}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fs, nil
+		}
+		return nil, fmt.Errorf("could not read sessions - %w", err)
+	}
+
+	var nonce [24]byte
+	if len(data) < len(nonce) {
+		return nil, fmt.Errorf("could not decrypt sessions in %s - file truncated", path)
+	}
+	copy(nonce[:], data)
+	clear, ok := secretbox.Open(nil, data[len(nonce):], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("could not decrypt sessions in %s - corrupted file, or wrong key", path)
+	}
+	if err := json.Unmarshal(clear, &fs.sessions); err != nil {
+		return nil, fmt.Errorf("could not parse sessions in %s - %w", path, err)
+	}
+	return fs, nil
+}
+
+// save must be called with the lock held.
+func (fs *FileSessionStore) save() error {
+	clear, err := json.Marshal(fs.sessions)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	data := secretbox.Seal(nonce[:], clear, &nonce, fs.key)
+
+	return atomicfile.WriteFile(fs.path, data, 0600)
+}
+
+func (fs *FileSessionStore) Add(session Session) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.expire(time.Now())
+	fs.sessions = append(fs.sessions, session)
+	return fs.save()
+}
+
+// recordSession keeps track of a user certificate, so the user can find and revoke it. Failures are logged, but not fatal.
+func (s *Server) recordSession(ctx context.Context, cert *ssh.Certificate, user string) {
+	session := Session{
+		Serial:      cert.Serial,
+		User:        user,
+		Fingerprint: ssh.FingerprintSHA256(cert.Key),
+		Issued:      time.Now(),
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		session.ClientIP = p.Addr.String()
+	}
+	if err := s.sessions.Add(session); err != nil {
+		s.log.Warnf("could not record session %d for '%s' - %s", cert.Serial, user, err)
+	}
+}
+
+func (s *Server) isAdmin(ctx context.Context) bool {
+	return s.checkAdmin(ctx) == nil
+}
+
+// ListSessions implements the AuthAdmin.ListSessions RPC.
+func (s *Server) ListSessions(ctx context.Context, req *apb.ListSessionsRequest) (*apb.ListSessionsResponse, error) {
+	creds := oauth.GetCredentials(ctx)
+	if creds == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "authentication required")
+	}
+	username := req.Username
+	if username == "" {
+		username = creds.Identity.GlobalName()
+	}
+	if username != creds.Identity.GlobalName() && !s.isAdmin(ctx) {
+		return nil, status.Errorf(codes.PermissionDenied, "user %s can only list their own sessions", creds.Identity.GlobalName())
+	}
+
+	sessions, err := s.sessions.List(time.Now())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not retrieve sessions - %s", err)
+	}
+	resp := &apb.ListSessionsResponse{}
+	for _, session := range sessions {
+		if username != "*" && !matchesUser(session.User, username) {
+			continue
+		}
+		resp.Session = append(resp.Session, &apb.Session{
+			Serial:      session.Serial,
+			Username:    session.User,
+			Fingerprint: session.Fingerprint,
+			Issued:      session.Issued.Unix(),
+			ValidBefore: session.ValidBefore.Unix(),
+			ClientIp:    session.ClientIP,
+			Revoked:     s.revocations.IsRevoked(session.Serial),
+		})
+	}
+	return resp, nil
+}
+
+// RevokeSession implements the AuthAdmin.RevokeSession RPC.
+func (s *Server) RevokeSession(ctx context.Context, req *apb.RevokeSessionRequest) (*apb.RevokeSessionResponse, error) {
+	creds := oauth.GetCredentials(ctx)
+	if creds == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "authentication required")
+	}
+	sessions, err := s.sessions.List(time.Now())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not retrieve sessions - %s", err)
+	}
+
+	var found *Session
+	for ix := range sessions {
+		if sessions[ix].Serial == req.Serial {
+			found = &sessions[ix]
+		}
+	}
+	// Don't disclose the existence of sessions of other users.
+	if found == nil || (found.User != creds.Identity.GlobalName() && !s.isAdmin(ctx)) {
+		return nil, status.Errorf(codes.NotFound, "no valid session with serial %d", req.Serial)
+	}
+
+	revoked, version, err := s.revocations.Revoke(&apb.RevokeRequest{Serial: []uint64{found.Serial}}, time.Now(), s.userCertTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not persist revocations - %s", err)
+	}
+	s.log.Infof("session %d of %s revoked (%d new revocations) on request of %s, KRL now at version %d",
+		found.Serial, found.User, len(revoked), creds.Identity.GlobalName(), version)
+	return &apb.RevokeSessionResponse{Version: version}, nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestSessions(t *testing.T) {
+	rng := mrand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"), WithCA([]byte(edTestCert)), WithUserCertTimeLimit(time.Hour), WithAdmins("root@writers.org"))
+	assert.Nil(t, err, err)
+
+	first := issueCert(t, rng, server)
+	second := issueCert(t, rng, server)
+
+	_, err = server.ListSessions(context.Background(), &apb.ListSessionsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	user := adminContext("emma.goldman", "writers.org")
+	resp, err := server.ListSessions(user, &apb.ListSessionsRequest{})
+	assert.Nil(t, err, err)
+	assert.Equal(t, 2, len(resp.Session))
+	assert.Equal(t, first.Serial, resp.Session[0].Serial)
+	assert.Equal(t, ssh.FingerprintSHA256(first.Key), resp.Session[0].Fingerprint)
+	assert.Equal(t, "emma.goldman@writers.org", resp.Session[0].Username)
+	assert.Equal(t, int64(first.ValidBefore), resp.Session[0].ValidBefore)
+	assert.False(t, resp.Session[0].Revoked)
+
+	// Users can only see their own sessions, admins can see everyone's.
+	other := adminContext("lucy.parsons", "writers.org")
+	_, err = server.ListSessions(other, &apb.ListSessionsRequest{Username: "emma.goldman@writers.org"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	resp, err = server.ListSessions(other, &apb.ListSessionsRequest{})
+	assert.Nil(t, err, err)
+	assert.Equal(t, 0, len(resp.Session))
+	resp, err = server.ListSessions(adminContext("root", "writers.org"), &apb.ListSessionsRequest{Username: "*"})
+	assert.Nil(t, err, err)
+	assert.Equal(t, 2, len(resp.Session))
+
+	// Revoking a session of another user looks like the session does not exist.
+	_, err = server.RevokeSession(other, &apb.RevokeSessionRequest{Serial: first.Serial})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	rresp, err := server.RevokeSession(user, &apb.RevokeSessionRequest{Serial: first.Serial})
+	assert.Nil(t, err, err)
+	assert.Equal(t, uint64(1), rresp.Version)
+	krl := fetchKRL(t, server)
+	assert.True(t, krl.IsRevoked(first))
+	assert.False(t, krl.IsRevoked(second))
+
+	resp, err = server.ListSessions(user, &apb.ListSessionsRequest{})
+	assert.Nil(t, err, err)
+	assert.True(t, resp.Session[0].Revoked)
+	assert.False(t, resp.Session[1].Revoked)
+
+	// Admins can revoke anyone's session.
+	_, err = server.RevokeSession(adminContext("root", "writers.org"), &apb.RevokeSessionRequest{Serial: second.Serial})
+	assert.Nil(t, err, err)
+	assert.True(t, fetchKRL(t, server).IsRevoked(second))
+}
+
+func TestSessionClientIP(t *testing.T) {
+	rng := mrand.New(srand.Source)
+	server, err := New(rng, WithAuthURL("static-prefix"))
+	assert.Nil(t, err, err)
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}})
+	server.recordSession(ctx, &ssh.Certificate{Serial: 12, Key: certKey(t), ValidBefore: uint64(time.Now().Add(time.Hour).Unix())}, "emma.goldman@writers.org")
+	server.recordSession(ctx, &ssh.Certificate{Serial: 13, Key: certKey(t), ValidBefore: uint64(time.Now().Add(-time.Hour).Unix())}, "emma.goldman@writers.org")
+
+	sessions, err := server.sessions.List(time.Now())
+	assert.Nil(t, err, err)
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, "192.0.2.1:4242", sessions[0].ClientIP)
+}
+
+func certKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err, err)
+	return key
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	var raw [SessionKeySize]byte
+	_, err := rand.Read(raw[:])
+	assert.Nil(t, err)
+	key, err := ParseSessionKey([]byte(hex.EncodeToString(raw[:]) + "\n"))
+	assert.Nil(t, err, err)
+
+	store, err := NewFileSessionStore(path, key)
+	assert.Nil(t, err, err)
+	now := time.Now()
+	session := Session{Serial: 1, User: "emma.goldman@writers.org", Fingerprint: "SHA256:x", Issued: now, ValidBefore: now.Add(time.Hour), ClientIP: "192.0.2.1:4242"}
+	assert.Nil(t, store.Add(session))
+
+	// Sessions are persisted encrypted.
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "192.0.2.1")
+	assert.NotContains(t, string(data), "emma.goldman")
+
+	reloaded, err := NewFileSessionStore(path, key)
+	assert.Nil(t, err, err)
+	sessions, err := reloaded.List(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, session.ClientIP, sessions[0].ClientIP)
+	assert.True(t, session.ValidBefore.Equal(sessions[0].ValidBefore))
+
+	var wrong [SessionKeySize]byte
+	_, err = NewFileSessionStore(path, &wrong)
+	assert.NotNil(t, err)
+
+	_, err = ParseSessionKey([]byte("too short"))
+	assert.NotNil(t, err)
+	_, err = New(mrand.New(srand.Source), WithAuthURL("static-prefix"), WithSessionFile(path, nil))
+	assert.NotNil(t, err)
+}
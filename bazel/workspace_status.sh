@@ -26,6 +26,9 @@ echo GIT_BRANCH "$GIT_BRANCH"
 GIT_SHA="$(git rev-parse HEAD)"
 echo COMMIT_SHA "$GIT_SHA"
 
+# Closest tag, with the number of commits since then and the SHA, like v0.2.1-14-g2414721.
+echo STABLE_GIT_VERSION "$(git describe --tags --always --dirty 2>/dev/null)"
+
 # prints out the current branch with the current tracked remote from branch. e.g. origin/branch or source/branch
 GIT_ORIGIN_BRANCH="$(git for-each-ref --format='%(upstream:lstrip=-2)' "$(git symbolic-ref -q HEAD)")"
 echo STABLE_GIT_ORIGIN_BRANCH "$GIT_ORIGIN_BRANCH"
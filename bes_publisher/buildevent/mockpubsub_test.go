@@ -12,9 +12,9 @@ type mockTopic struct {
 	mock.Mock
 }
 
-func (m *mockTopic) Publish(ctx context.Context, msg *pubsub.Message) fetcher {
+func (m *mockTopic) Publish(ctx context.Context, msg *pubsub.Message) PublishResult {
 	args := m.Called(ctx, msg)
-	return args.Get(0).(fetcher)
+	return args.Get(0).(PublishResult)
 }
 
 // newMockPublishResult returns a mockPublishResult with expectations pre-set:
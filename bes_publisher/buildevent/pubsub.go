@@ -6,14 +6,16 @@ import (
 	"cloud.google.com/go/pubsub"
 )
 
-// fetcher wraps the interface exposed by pubsub.MessageResult.
-type fetcher interface {
+// PublishResult wraps the interface exposed by pubsub.PublishResult.
+type PublishResult interface {
 	Get(context.Context) (string, error)
 }
 
-// sender wraps the interface exposed by pubsub.Topic.
-type sender interface {
-	Publish(context.Context, *pubsub.Message) fetcher
+// Sink wraps the interface exposed by pubsub.Topic.
+//
+// It is implemented by *Topic, and can be implemented by fakes in tests.
+type Sink interface {
+	Publish(context.Context, *pubsub.Message) PublishResult
 }
 
 // Topic wraps a pubsub.Topic so that it can expose the proper return type for
@@ -22,12 +24,12 @@ type Topic struct {
 	*pubsub.Topic
 }
 
-// NewTopic wraps a pubsub.Topic with a *Topic so it can be used as a `sender`.
+// NewTopic wraps a pubsub.Topic with a *Topic so it can be used as a Sink.
 func NewTopic(t *pubsub.Topic) *Topic {
 	return &Topic{t}
 }
 
-// Publish effectively casts a pubsub.MessageResult into a fetcher.
-func (t *Topic) Publish(ctx context.Context, msg *pubsub.Message) fetcher {
+// Publish effectively casts a pubsub.PublishResult into a PublishResult.
+func (t *Topic) Publish(ctx context.Context, msg *pubsub.Message) PublishResult {
 	return t.Topic.Publish(ctx, msg)
 }
@@ -126,10 +126,10 @@ func bazelEventFrom(req *bpb.PublishBuildToolEventStreamRequest) (*bes.BuildEven
 
 // Service implements the Build Event Protocol service.
 type Service struct {
-	besTopic sender
+	besTopic Sink
 }
 
-func NewService(besTopic sender) (*Service, error) {
+func NewService(besTopic Sink) (*Service, error) {
 	return &Service{
 		besTopic: besTopic,
 	}, nil
@@ -171,7 +171,7 @@ func (s *Service) PublishBuildToolEventStream(stream bpb.PublishBuildEvent_Publi
 // build type.
 type buildStream struct {
 	stream   bpb.PublishBuildEvent_PublishBuildToolEventStreamServer
-	besTopic sender
+	besTopic Sink
 
 	attrs                         map[string]string
 	typeFromLabelAndAspect        map[string]string
@@ -370,8 +370,8 @@ func (b *buildStream) maybePublish(event *bes.BuildEvent) error {
 	return nil
 }
 
-// recordErrFrom waits on the fetcher and records any error the fetcher reports.
-func (b *buildStream) recordErrFrom(res fetcher) {
+// recordErrFrom waits on the PublishResult and records any error it reports.
+func (b *buildStream) recordErrFrom(res PublishResult) {
 	defer b.outstandingPublish.Done()
 	_, err := res.Get(b.stream.Context())
 	if err != nil {
@@ -133,12 +133,18 @@ func (t *bigQueryTable) isTableExist(ctx context.Context, client *bigquery.Clien
 }
 
 // Normalize BigQuery table references by filling in with defaults, as needed.
-func (t *bigQueryTable) normalizeTableRef() {
+//
+// A dataset not specified by the metrics is selected based on the keywords of the stream,
+// see --keyword_datasets, before falling back to the default.
+func (t *bigQueryTable) normalizeTableRef(keywords *invocationKeywords) {
 	// Always use the default project.
 	t.project = bigQueryTableDefault.project
 
 	// If either of the following were not found in the protobuf message,
 	// their zero value will show up here.
+	if len(t.dataset) == 0 {
+		t.dataset = keywords.dataset()
+	}
 	if len(t.dataset) == 0 {
 		t.dataset = bigQueryTableDefault.dataset
 	}
@@ -215,6 +221,9 @@ func translateMetric(stream *bazelStream, m *testMetric) (*bigQueryMetric, error
 	dat["_invocation_sha"] = stream.invocationSha
 	dat["_run"] = stream.run
 	dat["_test_target"] = stream.testTarget
+	if keywords := stream.keywords.String(); len(keywords) != 0 {
+		dat["_keywords"] = keywords
+	}
 	tags, err := json.Marshal(dat)
 	if err != nil {
 		return nil, fmt.Errorf("Error converting JSON to string: %w", err)
@@ -232,29 +241,9 @@ func translateMetric(stream *bazelStream, m *testMetric) (*bigQueryMetric, error
 func uploadTestMetrics(stream *bazelStream, r *metricTestResult) error {
 	// Normalize the BigQuery table identifier based on whether one was specified
 	// in the protobuf message.
-	r.table.normalizeTableRef()
+	r.table.normalizeTableRef(stream.keywords)
 	glog.V(2).Infof("Normalized table ref: %q", r.table.formatTableId())
 
-	// Get client context for this BigQuery operation.
-	ctx := context.Background()
-	client, err := bigquery.NewClient(ctx, r.table.project)
-	if err != nil {
-		return fmt.Errorf("Error opening bigquery.NewClient: %w", err)
-	}
-	defer client.Close()
-
-	// Check that the BigQuery dataset and table already exists.
-	// For simplicity, the BES Endpoint is not responsible for creating
-	// either one. An administrator is expected to create these ahead of time.
-	if exist := r.table.isDatasetExist(ctx, client); !exist {
-		metricBigqueryExceptionsTotal.WithLabelValues("dataset_not_found").Inc()
-		return fmt.Errorf("dataset_not_found for bigquery dataset %q", r.table.formatDatasetId())
-	}
-	if exist := r.table.isTableExist(ctx, client); !exist {
-		metricBigqueryExceptionsTotal.WithLabelValues("table_not_found").Inc()
-		return fmt.Errorf("table_not_found for bigquery table %q in dataset %q", r.table.formatTableId(), r.table.formatDatasetId())
-	}
-
 	// Prepare the metric rows for uploading to BigQuery.
 	// Make sure each row element references its own array item.
 	// Note: bigQueryMetric implements the ValueSaver interface.
@@ -282,6 +271,30 @@ func uploadTestMetrics(stream *bazelStream, r *metricTestResult) error {
 		sbuf.WriteString("\n")
 		glog.Info(sbuf.String())
 	}
+	return insertMetrics(&r.table, rows)
+}
+
+// Insert the rows in the specified BigQuery table, normalized by the caller.
+func insertMetrics(table *bigQueryTable, rows []*bigQueryMetric) error {
+	// Get client context for this BigQuery operation.
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, table.project)
+	if err != nil {
+		return fmt.Errorf("Error opening bigquery.NewClient: %w", err)
+	}
+	defer client.Close()
+
+	// Check that the BigQuery dataset and table already exists.
+	// For simplicity, the BES Endpoint is not responsible for creating
+	// either one. An administrator is expected to create these ahead of time.
+	if exist := table.isDatasetExist(ctx, client); !exist {
+		metricBigqueryExceptionsTotal.WithLabelValues("dataset_not_found").Inc()
+		return fmt.Errorf("dataset_not_found for bigquery dataset %q", table.formatDatasetId())
+	}
+	if exist := table.isTableExist(ctx, client); !exist {
+		metricBigqueryExceptionsTotal.WithLabelValues("table_not_found").Inc()
+		return fmt.Errorf("table_not_found for bigquery table %q in dataset %q", table.formatTableId(), table.formatDatasetId())
+	}
 
 	// Attempt to upload the metrics, assuming the dataset and table
 	// both exist. If a "not found" error occurs, sleep for a while
@@ -292,7 +305,7 @@ func uploadTestMetrics(stream *bazelStream, r *metricTestResult) error {
 	ok := false
 	insertStart := time.Now()
 	sleepTime := 10
-	inserter := client.Dataset(r.table.dataset).Table(r.table.tableName).Inserter()
+	inserter := client.Dataset(table.dataset).Table(table.tableName).Inserter()
 	glog.V(2).Info("Waiting for table insertion...")
 	for i := 0; i < 12; i++ {
 		if err := inserter.Put(ctx, rows); err != nil {
@@ -309,7 +322,7 @@ func uploadTestMetrics(stream *bazelStream, r *metricTestResult) error {
 	}
 	if !ok {
 		metricBigqueryInsertsTotal.WithLabelValues("timeout").Inc()
-		return fmt.Errorf("Error uploading rows to table %q: insertion timed out", r.table.formatTableId())
+		return fmt.Errorf("Error uploading rows to table %q: insertion timed out", table.formatTableId())
 	}
 	metricBigqueryInsertsTotal.WithLabelValues("ok").Inc()
 	metricBigqueryInsertDelay.Observe(time.Now().Sub(insertStart).Seconds())
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/devtools/build/v1"
+)
+
+// Name of the metric of the rows describing a flaky test.
+const flakeMetricName = "flake"
+
+var (
+	// Maximum number of test attempts tracked per stream to detect flaky
+	// tests, overridden from the command line.
+	maxFlakeAttempts = 10000
+
+	metricFlakesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "bestie",
+			Name:      "flakes_total",
+			Help:      "Total flaky tests detected, failing in one attempt and passing in another of the same invocation",
+		},
+	)
+	metricFlakeAttemptsTracked = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "bestie",
+			Name:      "flake_attempts_tracked",
+			Help:      "Test attempts currently tracked across all streams to detect flaky tests",
+		},
+	)
+	metricFlakeAttemptsDroppedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "bestie",
+			Name:      "flake_attempts_dropped_total",
+			Help:      "Total test attempts not tracked because the stream exceeded --max_flake_attempts",
+		},
+	)
+)
+
+// Identifies a test action, possibly retried in multiple attempts.
+type testAction struct {
+	label string
+	run   int32
+	shard int32
+}
+
+// Outcome of a single attempt of a test action, from a TestResult event.
+type testAttempt struct {
+	testAction
+	attempt  int32
+	status   string // TestStatus name, like PASSED or FAILED.
+	duration time.Duration
+}
+
+func (a *testAttempt) passed() bool {
+	return a.status == "PASSED"
+}
+
+func (a *testAttempt) failed() bool {
+	return a.status == "FAILED" || a.status == "TIMEOUT"
+}
+
+// Tracks the attempts of the test actions of a stream, to detect flaky tests.
+//
+// The number of attempts tracked is bounded by maxFlakeAttempts. close must
+// be invoked once the stream is done, whether it reached EOF or failed.
+type flakeTracker struct {
+	actions map[testAction]map[int32]testAttempt
+	tracked int
+	dropped int
+}
+
+func newFlakeTracker() *flakeTracker {
+	return &flakeTracker{actions: map[testAction]map[int32]testAttempt{}}
+}
+
+// Record the outcome of a test attempt.
+//
+// An attempt reported more than once replaces the previous report.
+func (f *flakeTracker) record(a testAttempt) {
+	attempts := f.actions[a.testAction]
+	if _, ok := attempts[a.attempt]; !ok {
+		if f.tracked >= maxFlakeAttempts {
+			if f.dropped == 0 {
+				glog.Warningf("Stream exceeded --max_flake_attempts after %d test attempts: no longer tracking flaky tests", f.tracked)
+			}
+			f.dropped += 1
+			metricFlakeAttemptsDroppedTotal.Inc()
+			return
+		}
+		f.tracked += 1
+		metricFlakeAttemptsTracked.Inc()
+	}
+	if attempts == nil {
+		attempts = map[int32]testAttempt{}
+		f.actions[a.testAction] = attempts
+	}
+	attempts[a.attempt] = a
+}
+
+// Release the state of the stream.
+func (f *flakeTracker) close() {
+	metricFlakeAttemptsTracked.Sub(float64(f.tracked))
+	f.actions = map[testAction]map[int32]testAttempt{}
+	f.tracked = 0
+	f.dropped = 0
+}
+
+// A test action that both failed and passed across its attempts.
+type flake struct {
+	testAction
+	// Sorted by attempt number.
+	attempts []testAttempt
+}
+
+// Return the flaky tests detected so far, sorted by label, run and shard.
+func (f *flakeTracker) flakes() []flake {
+	var flakes []flake
+	for action, attempts := range f.actions {
+		passed, failed := false, false
+		for _, attempt := range attempts {
+			passed = passed || attempt.passed()
+			failed = failed || attempt.failed()
+		}
+		if !passed || !failed {
+			continue
+		}
+
+		fl := flake{testAction: action}
+		for _, attempt := range attempts {
+			fl.attempts = append(fl.attempts, attempt)
+		}
+		sort.Slice(fl.attempts, func(i, j int) bool {
+			return fl.attempts[i].attempt < fl.attempts[j].attempt
+		})
+		flakes = append(flakes, fl)
+	}
+	sort.Slice(flakes, func(i, j int) bool {
+		a, b := flakes[i].testAction, flakes[j].testAction
+		if a.label != b.label {
+			return a.label < b.label
+		}
+		if a.run != b.run {
+			return a.run < b.run
+		}
+		return a.shard < b.shard
+	})
+	return flakes
+}
+
+// Return the metric describing the flake.
+//
+// The value is the number of attempts, with the status and duration of each
+// attempt stored as comma separated lists in the tags, in attempt order.
+func (fl *flake) metric(timestamp time.Time) testMetric {
+	var statuses, durations []string
+	failed := 0
+	for _, attempt := range fl.attempts {
+		if attempt.failed() {
+			failed += 1
+		}
+		statuses = append(statuses, attempt.status)
+		durations = append(durations, strconv.FormatInt(attempt.duration.Milliseconds(), 10))
+	}
+	return testMetric{
+		metricName: flakeMetricName,
+		tags: map[string]string{
+			"_shard":           strconv.Itoa(int(fl.shard)),
+			"_attempts":        strconv.Itoa(len(fl.attempts)),
+			"_failed_attempts": strconv.Itoa(failed),
+			"_statuses":        strings.Join(statuses, ","),
+			"_durations_ms":    strings.Join(durations, ","),
+		},
+		value:     float64(len(fl.attempts)),
+		timestamp: timestamp.UnixNano(),
+	}
+}
+
+// Return the BigQuery rows for the flakes detected in the stream.
+func translateFlakes(streamId *build.StreamId, keywords *invocationKeywords, flakes []flake, timestamp time.Time) ([]*bigQueryMetric, error) {
+	var rows []*bigQueryMetric
+	for _, fl := range flakes {
+		stream := &bazelStream{
+			buildId:      streamId.GetBuildId(),
+			invocationId: streamId.GetInvocationId(),
+			testTarget:   fl.label,
+			run:          strconv.Itoa(int(fl.run)),
+			keywords:     keywords,
+		}
+		stream.invocationSha = deriveInvocationSha([]string{stream.invocationId, stream.buildId, stream.run})
+
+		m := fl.metric(timestamp)
+		row, err := translateMetric(stream, &m)
+		if err != nil {
+			return nil, fmt.Errorf("Error translating flake of %s: %w", fl.label, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Upload a row for each of the flaky tests detected in the stream, once the build is finished.
+func uploadFlakes(streamId *build.StreamId, keywords *invocationKeywords, tracker *flakeTracker) error {
+	flakes := tracker.flakes()
+	if len(flakes) == 0 {
+		return nil
+	}
+	metricFlakesTotal.Add(float64(len(flakes)))
+	for _, fl := range flakes {
+		glog.Infof("Flaky test in invocation %s: %s run %d shard %d, %d attempts", streamId.GetInvocationId(), fl.label, fl.run, fl.shard, len(fl.attempts))
+	}
+
+	rows, err := translateFlakes(streamId, keywords, flakes, time.Now())
+	if err != nil {
+		return err
+	}
+	table := bigQueryTable{}
+	table.normalizeTableRef(keywords)
+	if err := insertMetrics(&table, rows); err != nil {
+		return fmt.Errorf("Error uploading flakes to BigQuery: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/devtools/build/v1"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, g.Write(m))
+	return m.GetGauge().GetValue()
+}
+
+func attempt(label string, shard, number int32, status string, duration time.Duration) testAttempt {
+	return testAttempt{
+		testAction: testAction{label: label, run: 1, shard: shard},
+		attempt:    number,
+		status:     status,
+		duration:   duration,
+	}
+}
+
+func TestFlakeTracker(t *testing.T) {
+	tracked := gaugeValue(t, metricFlakeAttemptsTracked)
+
+	tracker := newFlakeTracker()
+	tracker.record(attempt("//a:test", 0, 2, "PASSED", 2*time.Second))
+	tracker.record(attempt("//a:test", 0, 1, "FAILED", 3*time.Second))
+	// A different shard of the same test, always passing.
+	tracker.record(attempt("//a:test", 1, 1, "PASSED", time.Second))
+	// Always failing.
+	tracker.record(attempt("//b:test", 0, 1, "FAILED", time.Second))
+	tracker.record(attempt("//b:test", 0, 2, "FAILED", time.Second))
+	// Timeouts count as failures, repeated reports are only tracked once.
+	tracker.record(attempt("//c:test", 0, 1, "TIMEOUT", time.Minute))
+	tracker.record(attempt("//c:test", 0, 2, "FAILED", 10*time.Second))
+	tracker.record(attempt("//c:test", 0, 2, "PASSED", 10*time.Second))
+	assert.Equal(t, tracked+7, gaugeValue(t, metricFlakeAttemptsTracked))
+
+	flakes := tracker.flakes()
+	assert.Len(t, flakes, 2)
+	assert.Equal(t, "//a:test", flakes[0].label)
+	assert.Equal(t, []int32{1, 2}, []int32{flakes[0].attempts[0].attempt, flakes[0].attempts[1].attempt})
+	assert.Equal(t, "//c:test", flakes[1].label)
+
+	m := flakes[1].metric(time.Unix(1700000000, 0))
+	assert.Equal(t, flakeMetricName, m.metricName)
+	assert.Equal(t, 2.0, m.value)
+	assert.Equal(t, map[string]string{
+		"_shard":           "0",
+		"_attempts":        "2",
+		"_failed_attempts": "1",
+		"_statuses":        "TIMEOUT,PASSED",
+		"_durations_ms":    "60000,10000",
+	}, m.tags)
+
+	tracker.close()
+	assert.Equal(t, tracked, gaugeValue(t, metricFlakeAttemptsTracked))
+	assert.Len(t, tracker.flakes(), 0)
+}
+
+func TestFlakeTrackerBounded(t *testing.T) {
+	defer func(saved int) { maxFlakeAttempts = saved }(maxFlakeAttempts)
+	maxFlakeAttempts = 3
+	dropped := counterValue(t, metricFlakeAttemptsDroppedTotal)
+
+	tracker := newFlakeTracker()
+	defer tracker.close()
+	tracker.record(attempt("//a:test", 0, 1, "FAILED", time.Second))
+	tracker.record(attempt("//b:test", 0, 1, "FAILED", time.Second))
+	tracker.record(attempt("//a:test", 0, 2, "PASSED", time.Second))
+	tracker.record(attempt("//b:test", 0, 2, "PASSED", time.Second))
+	// Updates of attempts already tracked are still accepted.
+	tracker.record(attempt("//b:test", 0, 1, "PASSED", time.Second))
+
+	assert.Equal(t, 3, tracker.tracked)
+	assert.Equal(t, dropped+1, counterValue(t, metricFlakeAttemptsDroppedTotal))
+	flakes := tracker.flakes()
+	assert.Len(t, flakes, 1)
+	assert.Equal(t, "//a:test", flakes[0].label)
+}
+
+func TestTranslateFlakes(t *testing.T) {
+	tracker := newFlakeTracker()
+	defer tracker.close()
+	tracker.record(attempt("//a:test", 2, 1, "FAILED", 1500*time.Millisecond))
+	tracker.record(attempt("//a:test", 2, 2, "PASSED", 500*time.Millisecond))
+
+	streamId := &build.StreamId{BuildId: "build", InvocationId: "invocation"}
+	rows, err := translateFlakes(streamId, parseKeywords([]string{"user_keyword=ci"}), tracker.flakes(), time.Unix(1700000000, 0))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, flakeMetricName, rows[0].metricName)
+	assert.Equal(t, 2.0, rows[0].value)
+
+	tags := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(rows[0].tags), &tags))
+	assert.Equal(t, "//a:test", tags["_test_target"])
+	assert.Equal(t, "1", tags["_run"])
+	assert.Equal(t, "2", tags["_shard"])
+	assert.Equal(t, "invocation", tags["_invocation_id"])
+	assert.Equal(t, deriveInvocationSha([]string{"invocation", "build", "1"}), tags["_invocation_sha"])
+	assert.Equal(t, "FAILED,PASSED", tags["_statuses"])
+	assert.Equal(t, "1500,500", tags["_durations_ms"])
+	assert.Equal(t, "ci", tags["_keywords"])
+}
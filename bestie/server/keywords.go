@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prefix added by Bazel to the keywords passed with --bes_keywords.
+const userKeywordPrefix = "user_keyword="
+
+// Label value used once a keyword has more distinct values than maxKeywordLabelValues.
+const keywordLabelOther = "other"
+
+var (
+	// Limits applied to the keywords of each stream, overridden from the command line.
+	maxKeywords           = 32
+	maxKeywordLength      = 128
+	maxKeywordLabelValues = 20
+
+	// Routes from keyword to BigQuery dataset, in order of priority.
+	keywordDatasets []keywordRoute
+	// Names of the name=value keywords exported as metric labels.
+	labelKeywords = map[string]bool{}
+
+	metricKeywordsDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "bestie",
+			Name:      "keywords_dropped_total",
+			Help:      "Total keywords ignored because invalid, tagged by reason",
+		},
+		[]string{"reason"},
+	)
+	metricKeywordBuildsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "bestie",
+			Name:      "keyword_builds_total",
+			Help:      "Total number of Bazel builds seen, tagged by the keywords selected with --label_keywords",
+		},
+		[]string{"keyword", "value"},
+	)
+)
+
+// Route the metrics of streams with the keyword to the dataset.
+type keywordRoute struct {
+	keyword string
+	dataset string
+}
+
+// Parse a comma separated list of keyword=dataset routes.
+//
+// As keywords can contain '=' themselves, the dataset is what follows the last '='.
+func parseKeywordDatasets(value string) ([]keywordRoute, error) {
+	var routes []keywordRoute
+	for _, route := range strings.Split(value, ",") {
+		route = strings.TrimSpace(route)
+		if len(route) == 0 {
+			continue
+		}
+		ix := strings.LastIndex(route, "=")
+		if ix <= 0 || ix == len(route)-1 {
+			return nil, fmt.Errorf("invalid route %q: must be in the form keyword=dataset", route)
+		}
+		routes = append(routes, keywordRoute{keyword: route[:ix], dataset: route[ix+1:]})
+	}
+	return routes, nil
+}
+
+// Keywords attached by Bazel to an event stream, as set with --bes_keywords.
+type invocationKeywords struct {
+	// Sorted list of valid keywords, without the user keyword prefix.
+	list []string
+	// Value of the keywords in the form name=value.
+	values map[string]string
+}
+
+// Validate and parse the notification keywords of a stream.
+//
+// Keywords that are empty, too long, or contain control characters are
+// dropped, as are the keywords past the maximum number allowed.
+func parseKeywords(raw []string) *invocationKeywords {
+	seen := map[string]bool{}
+	keywords := &invocationKeywords{values: map[string]string{}}
+	for _, keyword := range raw {
+		keyword = strings.TrimPrefix(keyword, userKeywordPrefix)
+		reason := ""
+		switch {
+		case len(keyword) == 0 || strings.IndexFunc(keyword, unicode.IsControl) >= 0:
+			reason = "invalid"
+		case len(keyword) > maxKeywordLength:
+			reason = "too_long"
+		case seen[keyword]:
+			continue
+		case len(keywords.list) >= maxKeywords:
+			reason = "too_many"
+		}
+		if reason != "" {
+			metricKeywordsDroppedTotal.WithLabelValues(reason).Inc()
+			glog.Warningf("Ignoring keyword %.32q: %s", keyword, reason)
+			continue
+		}
+
+		seen[keyword] = true
+		keywords.list = append(keywords.list, keyword)
+		if ix := strings.Index(keyword, "="); ix > 0 {
+			keywords.values[keyword[:ix]] = keyword[ix+1:]
+		}
+	}
+	sort.Strings(keywords.list)
+	return keywords
+}
+
+// Check if the stream has the keyword.
+func (k *invocationKeywords) has(keyword string) bool {
+	if k == nil {
+		return false
+	}
+	ix := sort.SearchStrings(k.list, keyword)
+	return ix < len(k.list) && k.list[ix] == keyword
+}
+
+// Format the keywords as the value of a tag, empty if there are none.
+func (k *invocationKeywords) String() string {
+	if k == nil {
+		return ""
+	}
+	return strings.Join(k.list, ",")
+}
+
+// Return the dataset the metrics of the stream are routed to, empty if none.
+func (k *invocationKeywords) dataset() string {
+	for _, route := range keywordDatasets {
+		if k.has(route.keyword) {
+			return route.dataset
+		}
+	}
+	return ""
+}
+
+// Distinct values seen so far for each keyword exported as a label, to bound the label cardinality.
+var keywordLabelValues = struct {
+	sync.Mutex
+	values map[string]map[string]bool
+}{values: map[string]map[string]bool{}}
+
+// Return the label value for a keyword, replacing values past maxKeywordLabelValues with keywordLabelOther.
+func keywordLabelValue(name, value string) string {
+	keywordLabelValues.Lock()
+	defer keywordLabelValues.Unlock()
+	values := keywordLabelValues.values[name]
+	if values == nil {
+		values = map[string]bool{}
+		keywordLabelValues.values[name] = values
+	}
+	if values[value] {
+		return value
+	}
+	if len(values) >= maxKeywordLabelValues {
+		return keywordLabelOther
+	}
+	values[value] = true
+	return value
+}
+
+// Count a completed build for each of the keywords exported as labels.
+func countKeywordBuild(k *invocationKeywords) {
+	if k == nil {
+		return
+	}
+	for name, value := range k.values {
+		if labelKeywords[name] {
+			metricKeywordBuildsTotal.WithLabelValues(name, keywordLabelValue(name, value)).Inc()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Return the current value of a counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, c.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestParseKeywords(t *testing.T) {
+	k := parseKeywords([]string{"command_name=test", "user_keyword=team=infra", "user_keyword=nightly", "user_keyword=nightly"})
+	assert.Equal(t, []string{"command_name=test", "nightly", "team=infra"}, k.list)
+	assert.Equal(t, map[string]string{"command_name": "test", "team": "infra"}, k.values)
+	assert.True(t, k.has("nightly"))
+	assert.False(t, k.has("user_keyword=nightly"))
+	assert.Equal(t, "command_name=test,nightly,team=infra", k.String())
+
+	var none *invocationKeywords
+	assert.False(t, none.has("nightly"))
+	assert.Equal(t, "", none.String())
+	assert.Equal(t, "", none.dataset())
+}
+
+func TestParseKeywordsPathological(t *testing.T) {
+	tooLong := counterValue(t, metricKeywordsDroppedTotal.WithLabelValues("too_long"))
+	tooMany := counterValue(t, metricKeywordsDroppedTotal.WithLabelValues("too_many"))
+	invalid := counterValue(t, metricKeywordsDroppedTotal.WithLabelValues("invalid"))
+
+	var raw []string
+	for ix := 0; ix < 1000; ix++ {
+		raw = append(raw, fmt.Sprintf("user_keyword=k%04d", ix))
+	}
+	raw = append([]string{
+		"user_keyword=" + strings.Repeat("x", maxKeywordLength+1),
+		strings.Repeat("y", 10*1024*1024),
+		"",
+		"user_keyword=",
+		"evil\nkeyword",
+		"nul\x00",
+	}, raw...)
+
+	k := parseKeywords(raw)
+	assert.Equal(t, maxKeywords, len(k.list))
+	assert.Equal(t, "k0000", k.list[0])
+	for _, keyword := range k.list {
+		assert.True(t, len(keyword) <= maxKeywordLength)
+	}
+
+	assert.Equal(t, tooLong+2, counterValue(t, metricKeywordsDroppedTotal.WithLabelValues("too_long")))
+	assert.Equal(t, tooMany+float64(1000-maxKeywords), counterValue(t, metricKeywordsDroppedTotal.WithLabelValues("too_many")))
+	assert.Equal(t, invalid+4, counterValue(t, metricKeywordsDroppedTotal.WithLabelValues("invalid")))
+}
+
+func TestParseKeywordDatasets(t *testing.T) {
+	routes, err := parseKeywordDatasets("team=infra=infra_metrics, nightly=nightly_metrics,")
+	assert.Nil(t, err)
+	assert.Equal(t, []keywordRoute{{"team=infra", "infra_metrics"}, {"nightly", "nightly_metrics"}}, routes)
+
+	routes, err = parseKeywordDatasets("")
+	assert.Nil(t, err)
+	assert.Nil(t, routes)
+
+	for _, invalid := range []string{"nightly", "=dataset", "nightly="} {
+		_, err := parseKeywordDatasets(invalid)
+		assert.NotNil(t, err, "%s", invalid)
+	}
+}
+
+func TestKeywordRouting(t *testing.T) {
+	defer func(routes []keywordRoute, dataset string) {
+		keywordDatasets = routes
+		bigQueryTableDefault.dataset = dataset
+	}(keywordDatasets, bigQueryTableDefault.dataset)
+
+	bigQueryTableDefault.dataset = "staging"
+	keywordDatasets = []keywordRoute{{"team=infra", "infra"}, {"nightly", "nightly"}}
+
+	route := func(table bigQueryTable, keywords ...string) string {
+		table.normalizeTableRef(parseKeywords(keywords))
+		return table.dataset
+	}
+	assert.Equal(t, "infra", route(bigQueryTable{}, "user_keyword=team=infra"))
+	assert.Equal(t, "infra", route(bigQueryTable{}, "user_keyword=nightly", "user_keyword=team=infra"))
+	assert.Equal(t, "nightly", route(bigQueryTable{}, "user_keyword=nightly", "user_keyword=team=hw"))
+	assert.Equal(t, "staging", route(bigQueryTable{}, "user_keyword=team=hw"))
+	assert.Equal(t, "staging", route(bigQueryTable{}))
+	// A dataset chosen by the test metrics takes precedence.
+	assert.Equal(t, "explicit", route(bigQueryTable{dataset: "explicit"}, "user_keyword=nightly"))
+}
+
+func TestKeywordsColumn(t *testing.T) {
+	stream := &bazelStream{invocationId: "1234", keywords: parseKeywords([]string{"user_keyword=team=infra", "user_keyword=nightly"})}
+	row, err := translateMetric(stream, &testMetric{metricName: "latency", tags: map[string]string{}, value: 1})
+	assert.Nil(t, err)
+	tags := map[string]string{}
+	assert.Nil(t, json.Unmarshal([]byte(row.tags), &tags))
+	assert.Equal(t, "nightly,team=infra", tags["_keywords"])
+
+	stream.keywords = nil
+	row, err = translateMetric(stream, &testMetric{metricName: "latency", tags: map[string]string{}, value: 1})
+	assert.Nil(t, err)
+	assert.NotContains(t, row.tags, "_keywords")
+}
+
+func TestKeywordLabels(t *testing.T) {
+	defer func(labels map[string]bool, max int) {
+		labelKeywords = labels
+		maxKeywordLabelValues = max
+	}(labelKeywords, maxKeywordLabelValues)
+	labelKeywords = map[string]bool{"team": true}
+	maxKeywordLabelValues = 2
+
+	for _, team := range []string{"infra", "hw", "infra", "sw", "fw"} {
+		countKeywordBuild(parseKeywords([]string{"user_keyword=team=" + team, "user_keyword=pipeline=" + team}))
+	}
+	countKeywordBuild(nil)
+
+	assert.Equal(t, 2.0, counterValue(t, metricKeywordBuildsTotal.WithLabelValues("team", "infra")))
+	assert.Equal(t, 1.0, counterValue(t, metricKeywordBuildsTotal.WithLabelValues("team", "hw")))
+	assert.Equal(t, 2.0, counterValue(t, metricKeywordBuildsTotal.WithLabelValues("team", "other")))
+	// Only the keywords selected are exported.
+	series := make(chan prometheus.Metric, 10)
+	metricKeywordBuildsTotal.Collect(series)
+	assert.Equal(t, 3, len(series))
+}
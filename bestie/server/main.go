@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
+	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/metrics"
 	"github.com/System233/enkit/lib/multierror"
 	"github.com/System233/enkit/lib/server"
@@ -52,6 +54,13 @@ func (s *BuildEventService) PublishLifecycleEvent(ctx context.Context, req *bpb.
 }
 
 func (s *BuildEventService) PublishBuildToolEventStream(stream bpb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	// Keywords are set by Bazel on the first request of the stream.
+	var keywords *invocationKeywords
+	stats := &streamStats{}
+	// Released when the stream is done, at EOF, or when Recv fails because
+	// the client went away or the stream timed out.
+	flakes := newFlakeTracker()
+	defer flakes.close()
 	for {
 		req, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
@@ -61,7 +70,15 @@ func (s *BuildEventService) PublishBuildToolEventStream(stream bpb.PublishBuildE
 			return err
 		}
 
-		glog.V(2).Infof("# BEP BuildToolEvent message:\n%s", prototext.Format(req))
+		// Events of truncated streams are only unmarshalled to account for the
+		// build, but are not logged nor processed in detail.
+		detailed := stats.add(req)
+		if detailed {
+			glog.V(2).Infof("# BEP BuildToolEvent message:\n%s", prototext.Format(req))
+		}
+		if raw := req.GetNotificationKeywords(); len(raw) > 0 {
+			keywords = parseKeywords(raw)
+		}
 
 		// Access protobuf message sections of interest.
 		obe := req.GetOrderedBuildEvent()
@@ -77,12 +94,22 @@ func (s *BuildEventService) PublishBuildToolEventStream(stream bpb.PublishBuildE
 				return err
 			}
 			bazelEventId := bazelBuildEvent.GetId()
+			if m := bazelBuildEvent.GetBuildMetadata(); m != nil {
+				stats.setMetadata(m.GetMetadata())
+			}
 			if ok := bazelEventId.GetBuildFinished(); ok != nil {
 				metricBuildsTotal.Inc()
+				countKeywordBuild(keywords)
+				stats.finish(streamId.GetInvocationId())
+				if err := uploadFlakes(streamId, keywords, flakes); err != nil {
+					glog.Errorf("Error handling flaky tests of %s: %s", streamId.GetInvocationId(), err)
+				}
+				flakes.close()
 			}
 			metricEventsTotal.WithLabelValues(getEventLabel(bazelEventId.Id)).Inc()
-			if m := bazelBuildEvent.GetTestResult(); m != nil {
-				if err := handleTestResultEvent(bazelBuildEvent, streamId); err != nil {
+			if m := bazelBuildEvent.GetTestResult(); m != nil && detailed {
+				flakes.record(testAttemptFromEvent(bazelBuildEvent))
+				if err := handleTestResultEvent(bazelBuildEvent, streamId, keywords); err != nil {
 					glog.Errorf("Error handling Bazel event %T: %s", bazelEventId.Id, err)
 					return err
 				}
@@ -112,6 +139,20 @@ var (
 	// BuildBuddy, Bazel). Bazel targets ~50MB messages, so that is the default
 	// here.
 	argMaxMessageSize = flag.Int("grpc_max_message_size_bytes", 50*1024*1024, "Maximum receive message size in bytes accepted by gRPC methods")
+
+	argMaxFlakeAttempts = flag.Int("max_flake_attempts", maxFlakeAttempts, "Maximum number of test attempts tracked per stream to detect flaky tests")
+	argMaxStreamBytes   = flag.Int64("max_stream_bytes", maxStreamBytes, "Maximum size in bytes of the events of a stream: events past it are acknowledged, but not processed - 0 means unlimited")
+
+	argDrainTimeout = flag.Duration("drain_timeout", server.DefaultDrainTimeout, "On SIGTERM, how long to wait for in-flight BEP streams to complete before exiting")
+	debugFlags      = server.DefaultDebugFlags().Register(&kflags.GoFlagSet{FlagSet: flag.CommandLine}, "")
+	tlsFlags        = server.DefaultTLSFlags().Register(&kflags.GoFlagSet{FlagSet: flag.CommandLine}, "")
+
+	// Keywords are set with the --bes_keywords option of Bazel.
+	argMaxKeywords           = flag.Int("max_keywords", maxKeywords, "Maximum number of keywords accepted per stream, additional keywords are ignored")
+	argMaxKeywordLength      = flag.Int("max_keyword_length", maxKeywordLength, "Maximum length of a keyword, longer keywords are ignored")
+	argKeywordDatasets       = flag.String("keyword_datasets", "", "Comma separated list of keyword=dataset, routing the metrics of streams with the keyword to the dataset, unless one is specified by the metrics. The first matching route is used")
+	argLabelKeywords         = flag.String("label_keywords", "", "Comma separated list of names of name=value keywords (e.g. team for --bes_keywords=team=infra) exported as labels of the keyword_builds_total metric")
+	argMaxKeywordLabelValues = flag.Int("max_keyword_label_values", maxKeywordLabelValues, "Maximum number of distinct values exported for each of --label_keywords, additional values are exported as 'other'")
 )
 
 func checkCommandArgs() error {
@@ -125,6 +166,19 @@ func checkCommandArgs() error {
 	if len(*argDataset) == 0 {
 		errs = append(errs, fmt.Errorf("--dataset must be specified"))
 	}
+	if *argMaxFlakeAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("--max_flake_attempts must be positive"))
+	}
+	if *argMaxStreamBytes < 0 {
+		errs = append(errs, fmt.Errorf("--max_stream_bytes must not be negative"))
+	}
+	if *argMaxKeywords <= 0 || *argMaxKeywordLength <= 0 || *argMaxKeywordLabelValues <= 0 {
+		errs = append(errs, fmt.Errorf("--max_keywords, --max_keyword_length and --max_keyword_label_values must be positive"))
+	}
+	routes, err := parseKeywordDatasets(*argKeywordDatasets)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("--keyword_datasets: %w", err))
+	}
 	if len(errs) > 0 {
 		return multierror.New(errs)
 	}
@@ -132,8 +186,19 @@ func checkCommandArgs() error {
 	// Set/override the default values.
 	deploymentBaseUrl = *argBaseUrl
 	maxFileSize = *argMaxFileSize
+	maxStreamBytes = *argMaxStreamBytes
+	maxFlakeAttempts = *argMaxFlakeAttempts
 	bigQueryTableDefault.dataset = *argDataset
 	bigQueryTableDefault.tableName = *argTableName
+	maxKeywords = *argMaxKeywords
+	maxKeywordLength = *argMaxKeywordLength
+	maxKeywordLabelValues = *argMaxKeywordLabelValues
+	keywordDatasets = routes
+	for _, name := range strings.Split(*argLabelKeywords, ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			labelKeywords[name] = true
+		}
+	}
 
 	return nil
 }
@@ -146,13 +211,20 @@ func main() {
 		glog.Exitf("Invalid command: %s", err)
 	}
 
-	grpcs := grpc.NewServer(
+	grpcOpts, err := metrics.Register(metrics.WithGRPCServer())
+	if err != nil {
+		glog.Exitf("Could not register metrics: %s", err)
+	}
+	grpcs := grpc.NewServer(append(grpcOpts,
 		grpc.MaxRecvMsgSize(*argMaxMessageSize),
-	)
+	)...)
 	bpb.RegisterPublishBuildEventServer(grpcs, &BuildEventService{})
 
 	mux := http.NewServeMux()
 	metrics.AddHandler(mux, "/metrics")
 
-	glog.Exit(server.Run(ctx, mux, grpcs, nil))
+	if err := server.Run(ctx, mux, grpcs, nil, server.WithShutdown(server.NewShutdown(server.WithDrainTimeout(*argDrainTimeout))), server.WithDebug(debugFlags), server.WithTLS(tlsFlags)); err != nil {
+		glog.Exit(err)
+	}
+	glog.Flush()
 }
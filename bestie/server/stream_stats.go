@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Name of the build metadata set by Bazel with --build_metadata=ROLE=...
+const roleMetadata = "ROLE"
+
+// Label value used for streams without a ROLE.
+const roleLabelUnknown = "unknown"
+
+var (
+	// Size in bytes of the events of a stream past which its events are
+	// no longer processed, 0 for unlimited. Overridden from the command line.
+	maxStreamBytes int64 = 0
+
+	metricStreamEvents = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "bestie",
+			Name:      "stream_events",
+			Help:      "Number of events in a stream at BuildFinished, tagged by the ROLE of the invocation",
+			Buckets:   prometheus.ExponentialBuckets(16, 4, 10),
+		},
+		[]string{"role"},
+	)
+	metricStreamBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "bestie",
+			Name:      "stream_bytes",
+			Help:      "Serialized size in bytes of the events in a stream at BuildFinished, tagged by the ROLE of the invocation",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 12),
+		},
+		[]string{"role"},
+	)
+	metricStreamTruncatedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "bestie",
+			Name:      "stream_truncated_total",
+			Help:      "Total streams whose events were no longer processed after exceeding --max_stream_bytes",
+		},
+	)
+)
+
+// Accounting of the events received on a stream.
+type streamStats struct {
+	events int
+	bytes  int64
+	// ROLE of the invocation, from its build metadata.
+	role string
+	// Set once the stream exceeds maxStreamBytes.
+	truncated bool
+}
+
+// Account for a request received on the stream.
+//
+// Returns false if the stream exceeded maxStreamBytes, and the event must
+// not be processed in detail. The event must still be acknowledged.
+func (s *streamStats) add(req *bpb.PublishBuildToolEventStreamRequest) bool {
+	s.events += 1
+	s.bytes += int64(proto.Size(req))
+	if s.truncated {
+		return false
+	}
+	if maxStreamBytes > 0 && s.bytes > maxStreamBytes {
+		s.truncated = true
+		metricStreamTruncatedTotal.Inc()
+		glog.Warningf("Stream %s exceeded --max_stream_bytes after %d events, %d bytes: no longer processing its events",
+			req.GetOrderedBuildEvent().GetStreamId().GetInvocationId(), s.events, s.bytes)
+		return false
+	}
+	return true
+}
+
+// Record the build metadata of the invocation.
+func (s *streamStats) setMetadata(metadata map[string]string) {
+	if role, ok := metadata[roleMetadata]; ok {
+		s.role = role
+	}
+}
+
+// Return the label value for the ROLE of the stream, with a bounded number of distinct values.
+func (s *streamStats) roleLabel() string {
+	role := strings.ToLower(strings.TrimSpace(s.role))
+	if len(role) == 0 {
+		return roleLabelUnknown
+	}
+	return keywordLabelValue("metadata."+roleMetadata, role)
+}
+
+// Log and export the size of the stream, once the build is finished.
+func (s *streamStats) finish(invocationId string) {
+	role := s.roleLabel()
+	glog.Infof("Stream %s finished: %d events, %d bytes, role %s, truncated %t", invocationId, s.events, s.bytes, role, s.truncated)
+	metricStreamEvents.WithLabelValues(role).Observe(float64(s.events))
+	metricStreamBytes.WithLabelValues(role).Observe(float64(s.bytes))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Return the number of observations and their sum in a histogram.
+func histogramValues(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	m := &dto.Metric{}
+	assert.Nil(t, o.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// Return a request of the stream of the invocation, of roughly the size specified.
+func streamRequest(invocationId string, size int) *bpb.PublishBuildToolEventStreamRequest {
+	return &bpb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &bpb.OrderedBuildEvent{
+			StreamId: &bpb.StreamId{InvocationId: invocationId},
+		},
+		NotificationKeywords: []string{strings.Repeat("x", size)},
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	count, sum := histogramValues(t, metricStreamBytes.WithLabelValues("ci"))
+	events, _ := histogramValues(t, metricStreamEvents.WithLabelValues("ci"))
+
+	stats := &streamStats{}
+	var total int64
+	for i := 0; i < 3; i++ {
+		req := streamRequest("invocation-1", 100)
+		total += int64(proto.Size(req))
+		assert.True(t, stats.add(req))
+	}
+	stats.setMetadata(map[string]string{"ROLE": " CI ", "OTHER": "ignored"})
+	stats.finish("invocation-1")
+
+	assert.Equal(t, 3, stats.events)
+	assert.Equal(t, total, stats.bytes)
+	gotCount, gotSum := histogramValues(t, metricStreamBytes.WithLabelValues("ci"))
+	assert.Equal(t, count+1, gotCount)
+	assert.Equal(t, sum+float64(total), gotSum)
+	gotEvents, _ := histogramValues(t, metricStreamEvents.WithLabelValues("ci"))
+	assert.Equal(t, events+1, gotEvents)
+
+	// Streams without a ROLE are still accounted for.
+	count, _ = histogramValues(t, metricStreamBytes.WithLabelValues(roleLabelUnknown))
+	stats = &streamStats{}
+	stats.add(streamRequest("invocation-2", 10))
+	stats.finish("invocation-2")
+	gotCount, _ = histogramValues(t, metricStreamBytes.WithLabelValues(roleLabelUnknown))
+	assert.Equal(t, count+1, gotCount)
+}
+
+func TestStreamStatsTruncated(t *testing.T) {
+	defer func(saved int64) { maxStreamBytes = saved }(maxStreamBytes)
+	size := int64(proto.Size(streamRequest("invocation-3", 100)))
+	maxStreamBytes = 9*size + size/2
+	truncated := counterValue(t, metricStreamTruncatedTotal)
+
+	stats := &streamStats{}
+	for i := 0; i < 9; i++ {
+		assert.True(t, stats.add(streamRequest("invocation-3", 100)))
+	}
+	// Past the limit, events are still accounted for, but not processed.
+	for i := 0; i < 5; i++ {
+		assert.False(t, stats.add(streamRequest("invocation-3", 100)))
+	}
+	assert.Equal(t, 14, stats.events)
+	assert.True(t, stats.truncated)
+	assert.Equal(t, truncated+1, counterValue(t, metricStreamTruncatedTotal))
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	tpb "github.com/System233/enkit/bestie/proto"
 	"github.com/System233/enkit/lib/kbuildbarn"
@@ -46,6 +47,7 @@ type bazelStream struct {
 	testTarget    string
 	run           string
 	invocationSha string // derived
+	keywords      *invocationKeywords
 }
 
 // Derive a unique invocation SHA value.
@@ -58,19 +60,42 @@ func deriveInvocationSha(items []string) string {
 }
 
 // Store fields that help identify this Bazel stream.
-func identifyStream(bazelBuildEvent bes.BuildEvent, streamId *build.StreamId) *bazelStream {
+func identifyStream(bazelBuildEvent bes.BuildEvent, streamId *build.StreamId, keywords *invocationKeywords) *bazelStream {
 	// Extract the stream identifier fields of interest.
 	stream := bazelStream{
 		buildId:      streamId.GetBuildId(),
 		invocationId: streamId.GetInvocationId(),
 		run:          strconv.Itoa(int(bazelBuildEvent.GetId().GetTestResult().GetRun())),
 		testTarget:   bazelBuildEvent.GetId().GetTestResult().GetLabel(),
+		keywords:     keywords,
 	}
 	// Calculate a SHA256 hash using the following fields to uniquely identify this stream.
 	stream.invocationSha = deriveInvocationSha([]string{stream.invocationId, stream.buildId, stream.run})
 	return &stream
 }
 
+// Extract the outcome of the test attempt reported by a TestResult event.
+func testAttemptFromEvent(bazelBuildEvent bes.BuildEvent) testAttempt {
+	id := bazelBuildEvent.GetId().GetTestResult()
+	m := bazelBuildEvent.GetTestResult()
+
+	// test_attempt_duration_millis is deprecated, but still set by older Bazel versions.
+	duration := time.Duration(m.GetTestAttemptDurationMillis()) * time.Millisecond
+	if d := m.GetTestAttemptDuration(); d != nil {
+		duration = d.AsDuration()
+	}
+	return testAttempt{
+		testAction: testAction{
+			label: id.GetLabel(),
+			run:   id.GetRun(),
+			shard: id.GetShard(),
+		},
+		attempt:  id.GetAttempt(),
+		status:   m.GetStatus().String(),
+		duration: duration,
+	}
+}
+
 func readFileWithLimit(fileReader io.Reader, limit int) ([]byte, error) {
 	// Attempt to read the file contents all at once, bounded by
 	// the specified limit. This uses a LimitReader to restrict the number
@@ -162,8 +187,8 @@ func openLocalFile(file string) (io.ReadCloser, error) {
 }
 
 // Handle metrics extraction from the TestResult event.
-func handleTestResultEvent(bazelBuildEvent bes.BuildEvent, streamId *build.StreamId) error {
-	stream := identifyStream(bazelBuildEvent, streamId)
+func handleTestResultEvent(bazelBuildEvent bes.BuildEvent, streamId *build.StreamId, keywords *invocationKeywords) error {
+	stream := identifyStream(bazelBuildEvent, streamId, keywords)
 	m := bazelBuildEvent.GetTestResult()
 	if m == nil {
 		return fmt.Errorf("Error extracting TestResult data from event message")
@@ -176,6 +201,7 @@ func handleTestResultEvent(bazelBuildEvent bes.BuildEvent, streamId *build.Strea
 		sbuf.WriteString(fmt.Sprintf("\tbuildId: %s\n", stream.buildId))
 		sbuf.WriteString(fmt.Sprintf("\tinvocationId: %s\n", stream.invocationId))
 		sbuf.WriteString(fmt.Sprintf("\tinvocationSha: %s\n", stream.invocationSha))
+		sbuf.WriteString(fmt.Sprintf("\tkeywords: %s\n", stream.keywords))
 		glog.Info(sbuf.String())
 	} else {
 		glog.Info(fmt.Sprintf("Processing invocationId: %s\n", stream.invocationId))
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"math/rand"
+	"os"
 
 	acommands "github.com/System233/enkit/astore/client/commands"
 	"github.com/System233/enkit/enkit/machinecert"
@@ -40,7 +41,7 @@ func New() (*EnkitCommand, error) {
 
 	base := client.DefaultBaseFlags(root.Name(), "enkit")
 
-	set, populator, runner := kcobra.Runner(root, nil, base.IdentityErrorHandler("enkit login"))
+	set, populator, runner := kcobra.Runner(root, nil, base.IdentityErrorHandler("enkit login"), base.DebugDumpErrorHandler(), base.RPCTraceErrorHandler(), base.RenderErrorHandler())
 
 	login := bcommands.NewLogin(base, rng, populator)
 	root.AddCommand(login.Command)
@@ -75,6 +76,9 @@ func New() (*EnkitCommand, error) {
 	}
 	root.AddCommand(machineCert.Command)
 
+	// Plugins are added last, so they cannot replace the built in commands.
+	addPlugins(root, base)
+
 	return &EnkitCommand{
 		cmd:       root,
 		baseFlags: base,
@@ -85,6 +89,7 @@ func New() (*EnkitCommand, error) {
 }
 
 func (c *EnkitCommand) Run() {
+	c.baseFlags.Completing = kcobra.IsCompletion(os.Args)
 	c.baseFlags.Run(kcobra.HideFlags(c.flagSet), c.populator, c.runner)
 }
 
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/config/directory"
+	"github.com/System233/enkit/lib/kflags/kcobra"
+
+	"github.com/spf13/cobra"
+)
+
+// PluginPrefix is the prefix of the name of the executables implementing enkit sub commands.
+//
+// For example, an executable enkit-deploy in the PATH is available as `enkit deploy`.
+const PluginPrefix = "enkit-"
+
+// PluginDirEnv is the environment variable overriding the directory plugins are
+// looked up in before PATH, by default the plugins directory in the enkit config dir.
+const PluginDirEnv = "ENKIT_PLUGIN_DIR"
+
+// pluginEnv returns the environment variables describing the base flags, to pass to plugins.
+func pluginEnv(base *client.BaseFlags) kcobra.PluginEnv {
+	return func() []string {
+		env := []string{
+			"ENKIT_IDENTITY=" + base.Identity(),
+			"ENKIT_DOMAIN=" + base.Domain(),
+			"ENKIT_AUTH_SERVER=" + base.AuthFlags.Server,
+			"ENKIT_CONFIG_NAME=" + base.ConfigName,
+			"ENKIT_CACHE_DIR=" + base.Local.Root,
+		}
+		if dir, err := directory.GetConfigDir(base.ConfigName); err == nil {
+			env = append(env, "ENKIT_CONFIG_DIR="+dir)
+		}
+		if binary, err := os.Executable(); err == nil {
+			env = append(env, "ENKIT_BINARY="+binary)
+		}
+		return env
+	}
+}
+
+// addPlugins adds the plugins found in the plugin dir and PATH as sub commands of root.
+func addPlugins(root *cobra.Command, base *client.BaseFlags) {
+	dir := os.Getenv(PluginDirEnv)
+	if dir == "" {
+		var err error
+		if dir, err = directory.GetConfigDir(base.ConfigName, "plugins"); err != nil {
+			base.Log.Infof("could not determine the plugin directory - %s", err)
+		}
+	}
+
+	var dirs []string
+	if dir != "" {
+		dirs = append(dirs, dir)
+	}
+	kcobra.AddPlugins(root, kcobra.FindPlugins(PluginPrefix, kcobra.PluginDirs(dirs...)), pluginEnv(base), base.Log)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/kcerts"
 
 	"github.com/spf13/cobra"
 )
@@ -106,6 +107,8 @@ type Install struct {
 	ExistingPublicKeyPath  string
 	ExistingPrivateKeyPath string
 	SshPrincipals []string
+	KeyType                string
+	KeyBits                int
 	Overwrite              bool
 	ConfigureSshd          bool
 	RestartSshd            bool
@@ -153,6 +156,18 @@ func NewInstall(root *Root) *Install {
 		true,
 		"If set, restart sshd when configuration is modified automatically",
 	)
+	command.Flags().StringVar(
+		&command.KeyType,
+		"key-type",
+		string(kcerts.KeyTypeED25519),
+		fmt.Sprintf("Type of key to generate, one of %v. Use rsa or ecdsa only if clients do not accept ed25519 keys", kcerts.KeyTypes),
+	)
+	command.Flags().IntVar(
+		&command.KeyBits,
+		"key-bits",
+		0,
+		"Size of the key to generate, 0 for the default size of the key type",
+	)
 	command.Flags().StringSliceVar(
 		&command.SshPrincipals,
 		"ssh-principals",
@@ -57,7 +57,7 @@ func (i *Install) Run(cmd *cobra.Command, args []string) error {
 	}
 	if privateKey == nil || publicKey == nil {
 		// Create new keypair
-		pubKey, privKey, err := kcerts.GenerateED25519()
+		pubKey, privKey, err := kcerts.GenerateKey(kcerts.KeyType(i.KeyType), i.KeyBits)
 		if err != nil {
 			return fmt.Errorf("failed to generate new keypair: %w", err)
 		}
@@ -6,15 +6,18 @@ import (
         "io/ioutil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"time"
 
 	faketreeexec "github.com/System233/enkit/faketree/exec"
 	"github.com/System233/enkit/lib/bes"
 	"github.com/System233/enkit/lib/client"
 	"github.com/System233/enkit/lib/karchive"
 	"github.com/System233/enkit/lib/kbuildbarn"
-	"github.com/System233/enkit/lib/multierror"
+	"github.com/System233/enkit/lib/kflags/kcobra"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
 
@@ -29,8 +32,8 @@ type Root struct {
 	*cobra.Command
 	*client.BaseFlags
 
-	BuildBuddyApiKey      string
-	BuildBuddyUrl         string
+	BuildBuddyAuth *bes.AuthFlags
+	BuildBuddyUrl  string
 }
 
 func New(base *client.BaseFlags) (*Root, error) {
@@ -43,6 +46,7 @@ func New(base *client.BaseFlags) (*Root, error) {
 	root.AddCommand(NewUnmount(root).Command)
 	root.AddCommand(NewRun(root).Command)
 	root.AddCommand(NewShutdown(root).Command)
+	root.AddCommand(NewCleanup(root).Command)
 
 	return root, nil
 }
@@ -59,17 +63,36 @@ func NewRoot(base *client.BaseFlags) (*Root, error) {
 		BaseFlags: base,
 	}
 
-	rc.PersistentFlags().StringVar(&rc.BuildBuddyApiKey, "api-key", "", "build buddy api key used to bypass oauth2")
+	rc.BuildBuddyAuth = bes.DefaultAuthFlags().Register(&kcobra.FlagSet{FlagSet: rc.PersistentFlags()}, "")
 	rc.PersistentFlags().StringVar(&rc.BuildBuddyUrl, "buildbuddy-url", "", "build buddy url instance")
 	return rc, nil
 }
 
+// BuildBuddyClient returns a client for the BuildBuddy instance configured with flags.
+func (r *Root) BuildBuddyClient() (*bes.BuildBuddyClient, error) {
+	buddyUrl, err := url.Parse(r.BuildBuddyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing buildbuddy url: %w", err)
+	}
+	auth, err := r.BuildBuddyAuth.Modifier(r.BaseFlags)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := bes.NewBuildBuddyClient(buddyUrl, r.BaseFlags, "", auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating new buildbuddy client: %w", err)
+	}
+	return bc, nil
+}
+
 type Mount struct {
 	*cobra.Command
 	root *Root
 
 	DryRun       bool
 	InvocationID string
+	Materialize  string
+	Workers      int
 }
 
 func NewMount(root *Root) *Mount {
@@ -85,19 +108,21 @@ func NewMount(root *Root) *Mount {
 	}
 	command.Flags().StringVarP(&command.InvocationID, "invocation-id", "i", "", "invocation id to mount")
 	command.Flags().BoolVar(&command.DryRun, "dry-run", false, "if set, will print out the hardlinks generated from the invocation, and not attempt to create them")
+	command.Flags().IntVar(&command.Workers, "workers", kbuildbarn.DefaultApplyWorkers, "number of outputs to create in parallel")
+	command.Flags().StringVar(&command.Materialize, "materialize", string(kbuildbarn.StrategyAuto), "how to create the outputs from the bb_clientd cas: hardlink, symlink, copy, or auto to hardlink and copy when the cas is on a different filesystem")
 
 	command.Command.RunE = command.Run
 	return command
 }
 
 func (c *Mount) Run(cmd *cobra.Command, args []string) error {
-	buddyUrl, err := url.Parse(c.root.BuildBuddyUrl)
+	strategy, err := kbuildbarn.ParseStrategy(c.Materialize)
 	if err != nil {
-		return fmt.Errorf("failed parsing buildbuddy url: %w", err)
+		return fmt.Errorf("invalid --materialize: %w", err)
 	}
-	bc, err := bes.NewBuildBuddyClient(buddyUrl, c.root.BaseFlags, c.root.BuildBuddyApiKey)
+	bc, err := c.root.BuildBuddyClient()
 	if err != nil {
-		return fmt.Errorf("failed generating new buildbuddy client: %w", err)
+		return err
 	}
 	r, err := kbuildbarn.GenerateHardlinks(
 		context.Background(),
@@ -112,33 +137,102 @@ func (c *Mount) Run(cmd *cobra.Command, args []string) error {
 	}
 
 	scratchInvocationPath := filepath.Join(DefaultOutputsRoot, c.InvocationID)
-	if err := os.Mkdir(scratchInvocationPath, 0777); err != nil && !os.IsExist(err) {
+	// Protects the outputs from enkit outputs cleanup while they are created.
+	lock, err := kbuildbarn.LockScratch(scratchInvocationPath)
+	if err != nil {
 		return fmt.Errorf("could not create scratch dir %w", err)
 	}
-	var errs []error
+	defer lock.Release()
 	if c.DryRun {
 		for _, v := range r {
 			fmt.Printf("link to generate from:%s to:%s \n ", v.Src, v.Dest)
 		}
 	} else {
-		for _, v := range r {
-			dir := filepath.Dir(v.Dest)
-			if err := os.MkdirAll(dir, 0777); err != nil && !os.IsExist(err) {
-				errs = append(errs, err)
-				continue
-			}
-			if err := os.Link(v.Src, v.Dest); err != nil && !os.IsExist(err) {
-				errs = append(errs, err)
-			}
+		// Stop creating outputs on ^C, still reporting how many were created.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		bar := c.root.Context().Progress()
+		report, err := kbuildbarn.ApplyHardlinks(ctx, r, kbuildbarn.ApplyOptions{
+			Strategy:      strategy,
+			Workers:       c.Workers,
+			ProgressEvery: 1000,
+			Progress: func(done, total int) {
+				bar.Step("%d of %d outputs created", done, total)
+			},
+		})
+		bar.Done()
+		if copied := report.Count(kbuildbarn.StrategyCopy); copied > 0 && strategy != kbuildbarn.StrategyCopy {
+			c.root.Log.Warnf("%d of %d outputs were copied, as the cas is on a different filesystem than %s - consider --materialize=symlink", copied, len(r), DefaultOutputsRoot)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing links to disk %w", err)
 		}
-	}
-	if len(errs) != 0 {
-		return fmt.Errorf("error writing links to disk %w", multierror.New(errs))
 	}
 	fmt.Printf("Outputs mounted in: %s/%s \n", DefaultOutputsRoot, c.InvocationID)
 	return nil
 }
 
+type Cleanup struct {
+	*cobra.Command
+	root *Root
+
+	DryRun  bool
+	MaxAge  time.Duration
+	MaxSize string
+}
+
+func NewCleanup(root *Root) *Cleanup {
+	command := &Cleanup{
+		Command: &cobra.Command{
+			Use:   "cleanup",
+			Short: "Remove the outputs of old invocations, to free disk space",
+			Example: `  $ enkit outputs cleanup --max-age=72h --max-size=50GB
+	Removes the outputs not used in the last 3 days, and then the least
+	recently used ones until less than 50GB are left. Suitable for cron.
+
+  $ enkit outputs cleanup --dry-run
+	Prints the outputs that would be removed with the default policy.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().BoolVar(&command.DryRun, "dry-run", false, "if set, only print the outputs that would be removed")
+	command.Flags().DurationVar(&command.MaxAge, "max-age", 7*24*time.Hour, "remove the outputs not used for longer than this, 0 to ignore age")
+	command.Flags().StringVar(&command.MaxSize, "max-size", "", "remove the least recently used outputs until their total size is below this, like 50GB - empty to ignore size")
+	return command
+}
+
+func (c *Cleanup) Run(cmd *cobra.Command, args []string) error {
+	policy := kbuildbarn.CleanupPolicy{MaxAge: c.MaxAge, DryRun: c.DryRun}
+	if c.MaxSize != "" {
+		size, err := humanize.ParseBytes(c.MaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid --max-size: %w", err)
+		}
+		policy.MaxSize = int64(size)
+	}
+
+	result, err := kbuildbarn.Cleanup(DefaultMountDir, policy)
+	if result != nil {
+		verb := "removed"
+		if c.DryRun {
+			verb = "would remove"
+		}
+		for _, dir := range result.Removed {
+			fmt.Printf("%s %s (%s, last used %s)\n", verb, dir.Path, humanize.Bytes(uint64(dir.Size)), humanize.Time(dir.LastUsed))
+		}
+		for _, dir := range result.InUse {
+			fmt.Printf("in use, skipped %s (%s, last used %s)\n", dir.Path, humanize.Bytes(uint64(dir.Size)), humanize.Time(dir.LastUsed))
+		}
+		fmt.Printf("%s %d directories, %s - %d in use, %d kept\n", verb, len(result.Removed), humanize.Bytes(uint64(result.Freed)), len(result.InUse), len(result.Kept))
+	}
+	if err != nil {
+		return fmt.Errorf("cleanup of %s failed: %w", DefaultOutputsRoot, err)
+	}
+	return nil
+}
+
 type Unmount struct {
 	*cobra.Command
 	root       *Root
@@ -0,0 +1,408 @@
+// Package filedb implements the license Notifier and Reserver on top of
+// local files, for setups without a Postgres database.
+//
+// The license table is read from a YAML or JSON file, like:
+//
+//	licenses:
+//	  - id: xilinx-vivado-1
+//	    vendor: xilinx
+//	    feature: vivado
+//
+// while the state of each license is recorded in a sidecar JSON file,
+// updated atomically, with a flock protecting it from concurrent updates,
+// including the ones from other processes.
+package filedb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+	"gopkg.in/fsnotify.v1"
+	"gopkg.in/yaml.v3"
+
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/flock"
+)
+
+const (
+	StateFree     = "FREE"
+	stateReserved = "RESERVED"
+	stateInUse    = "IN_USE"
+
+	// StateFileSuffix is appended to the path of the license file to get the
+	// path of the state file, if not configured.
+	StateFileSuffix = ".state"
+	// lockFileSuffix is appended to the path of the state file to get the
+	// path of the file locked while updating it.
+	lockFileSuffix = ".lock"
+)
+
+var (
+	metricGetCurrentDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "licensedevice",
+		Subsystem: "filedb",
+		Name:      "get_current_duration_seconds",
+		Help:      "GetCurrent execution time",
+	})
+	metricFileCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "licensedevice",
+		Subsystem: "filedb",
+		Name:      "results",
+		Help:      "The number of times file operations have succeeded or errored in various sections of the code",
+	},
+		[]string{
+			"location",
+			"outcome",
+		})
+)
+
+// licenseFile is the format of the license table.
+type licenseFile struct {
+	Licenses []licenseEntry `yaml:"licenses"`
+}
+
+type licenseEntry struct {
+	ID      string `yaml:"id"`
+	Vendor  string `yaml:"vendor"`
+	Feature string `yaml:"feature"`
+}
+
+// licenseState is the state of a license, as recorded in the state file.
+type licenseState struct {
+	Status         string    `json:"status"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+	UserNode       *string   `json:"user_node,omitempty"`
+	UserProcess    *string   `json:"user_process,omitempty"`
+}
+
+type Table struct {
+	licensePath string
+	statePath   string
+	nodeID      string
+
+	// Serializes the updates from this process; the flock on the lock file
+	// only excludes other processes.
+	lock sync.Mutex
+}
+
+// OpenTable returns a Table reading the licenses from licensePath, and
+// recording their state in statePath, or licensePath + StateFileSuffix if
+// empty.
+func OpenTable(licensePath string, statePath string, nodeID string) (*Table, error) {
+	if statePath == "" {
+		statePath = licensePath + StateFileSuffix
+	}
+	t := &Table{
+		licensePath: filepath.Clean(licensePath),
+		statePath:   filepath.Clean(statePath),
+		nodeID:      nodeID,
+	}
+	if _, err := t.readLicenses(); err != nil {
+		metricFileCounter.WithLabelValues("OpenTable", "error_read_licenses").Inc()
+		return nil, err
+	}
+	metricFileCounter.WithLabelValues("OpenTable", "ok").Inc()
+	return t, nil
+}
+
+func (t *Table) GetCurrent(ctx context.Context) ([]*types.License, error) {
+	startTime := time.Now()
+	defer metricGetCurrentDuration.Observe(float64(time.Now().Sub(startTime).Seconds()))
+
+	// The state file is replaced atomically, there is no need to lock it for reading.
+	licenses, _, err := t.load()
+	if err != nil {
+		metricFileCounter.WithLabelValues("GetCurrent", "error_load").Inc()
+		return nil, err
+	}
+	metricFileCounter.WithLabelValues("GetCurrent", "ok").Inc()
+	return licenses, nil
+}
+
+func (t *Table) Reserve(ctx context.Context, licenseIDs []string, node string) ([]*types.License, error) {
+	var ret []*types.License
+	licenses := []*types.License{}
+	for _, id := range licenseIDs {
+		licenses = append(licenses, &types.License{
+			ID:       id,
+			Status:   stateReserved,
+			UserNode: &node,
+		})
+	}
+
+	err := t.update(func(current map[string]*types.License) error {
+		var err error
+		ret, err = t.updateLicenses(current, licenses, "Reserve() called on device plugin")
+		return err
+	})
+	if err != nil {
+		metricFileCounter.WithLabelValues("Reserve", "error_update").Inc()
+		return nil, err
+	}
+	metricFileCounter.WithLabelValues("Reserve", "ok").Inc()
+	return ret, nil
+}
+
+func (t *Table) UpdateInUse(ctx context.Context, licenses []*types.License) error {
+	err := t.update(func(current map[string]*types.License) error {
+		// Every license recorded as IN_USE by this node but not mentioned in
+		// the supplied licenses is no longer used, and needs to be freed.
+		updates := append([]*types.License{}, licenses...)
+	nextLicense:
+		for _, l := range current {
+			if l.Status != stateInUse || l.UserNode == nil || *l.UserNode != t.nodeID {
+				continue
+			}
+			for _, used := range licenses {
+				if used.ID == l.ID {
+					continue nextLicense
+				}
+			}
+			updates = append(updates, &types.License{ID: l.ID, Status: StateFree})
+		}
+
+		_, err := t.updateLicenses(current, updates, "detected in scan")
+		return err
+	})
+	if err != nil {
+		metricFileCounter.WithLabelValues("UpdateInUse", "error_update").Inc()
+		return fmt.Errorf("failed to update license status: %w", err)
+	}
+	metricFileCounter.WithLabelValues("UpdateInUse", "ok").Inc()
+	return nil
+}
+
+func (t *Table) Release(ctx context.Context, licenseIDs []string, node string) ([]*types.License, error) {
+	var ret []*types.License
+	err := t.update(func(current map[string]*types.License) error {
+		licenses := []*types.License{}
+		for _, id := range licenseIDs {
+			l, ok := current[id]
+			if !ok {
+				return fmt.Errorf("failed to get current state of license %q: not in %s", id, t.licensePath)
+			}
+			if l.Status != stateReserved || l.UserNode == nil || *l.UserNode != node {
+				continue
+			}
+			licenses = append(licenses, &types.License{ID: id, Status: StateFree})
+		}
+
+		var err error
+		ret, err = t.updateLicenses(current, licenses, "reservation expired without the license being used")
+		return err
+	})
+	if err != nil {
+		metricFileCounter.WithLabelValues("Release", "error_update").Inc()
+		return nil, err
+	}
+	metricFileCounter.WithLabelValues("Release", "ok").Inc()
+	return ret, nil
+}
+
+// Chan returns a channel notified every time the license or state file changes.
+//
+// If the files cannot be watched, the channel is never notified, and the
+// error is logged.
+func (t *Table) Chan(ctx context.Context) chan struct{} {
+	c := make(chan struct{})
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		metricFileCounter.WithLabelValues("Chan", "error_new_watcher").Inc()
+		slog.Error("Error, failed to watch license files", "error", err)
+		return c
+	}
+	// Directories are watched, rather than the files, as the files are
+	// generally replaced, rather than modified in place.
+	for _, dir := range []string{filepath.Dir(t.licensePath), filepath.Dir(t.statePath)} {
+		if err := watcher.Add(dir); err != nil {
+			metricFileCounter.WithLabelValues("Chan", "error_watch").Inc()
+			slog.Error("Error, failed to watch license files", "dir", dir, "error", err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				metricFileCounter.WithLabelValues("Chan", "error_watcher").Inc()
+				slog.Error("Error, failed watching license files", "error", err)
+				continue
+			case event := <-watcher.Events:
+				if name := filepath.Clean(event.Name); name != t.licensePath && name != t.statePath {
+					continue
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case c <- struct{}{}:
+			}
+		}
+	}()
+	metricFileCounter.WithLabelValues("Chan", "ok").Inc()
+	return c
+}
+
+// update invokes fn with the current state of the licenses, by ID, while
+// holding the lock, and saves the state as modified by fn, unless fn fails.
+func (t *Table) update(fn func(current map[string]*types.License) error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	lockPath := t.statePath + lockFileSuffix
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer lock.Close()
+	if err := flock.Lock(lock, flock.Exclusive, 0); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", lockPath, err)
+	}
+	defer flock.Unlock(lock)
+
+	licenses, current, err := t.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(current); err != nil {
+		return err
+	}
+	return t.saveState(licenses)
+}
+
+// updateLicenses applies the status, node and process of each license to
+// the current state, returning the licenses whose status changed.
+//
+// Just like the database backend, licenses already in the requested status
+// are left untouched, and unknown licenses are an error.
+func (t *Table) updateLicenses(current map[string]*types.License, licenses []*types.License, reason string) ([]*types.License, error) {
+	ret := []*types.License{}
+	now := time.Now()
+	for _, license := range licenses {
+		l, ok := current[license.ID]
+		if !ok {
+			metricFileCounter.WithLabelValues("updateLicenses", "error_unknown_license").Inc()
+			return nil, fmt.Errorf("failed to get current state of license %q: not in %s", license.ID, t.licensePath)
+		}
+		if l.Status == license.Status {
+			continue
+		}
+
+		slog.Info("license state changed", "id", l.ID, "node", t.nodeID, "previous_state", l.Status, "current_state", license.Status, "reason", reason)
+		l.Status = license.Status
+		l.LastUpdateTime = now
+		l.UserNode = license.UserNode
+		l.UserProcess = license.UserProcess
+
+		updated := *l
+		ret = append(ret, &updated)
+	}
+	return ret, nil
+}
+
+// readLicenses reads the license table.
+func (t *Table) readLicenses() ([]licenseEntry, error) {
+	data, err := os.ReadFile(t.licensePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read license file: %w", err)
+	}
+	// YAML is a superset of JSON, the same parser works for both.
+	table := licenseFile{}
+	if err := yaml.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse license file %s: %w", t.licensePath, err)
+	}
+
+	seen := map[string]bool{}
+	for i, entry := range table.Licenses {
+		if entry.ID == "" || entry.Vendor == "" || entry.Feature == "" {
+			return nil, fmt.Errorf("license file %s: license %d must have an id, vendor and feature", t.licensePath, i)
+		}
+		if seen[entry.ID] {
+			return nil, fmt.Errorf("license file %s: duplicate license id %q", t.licensePath, entry.ID)
+		}
+		seen[entry.ID] = true
+	}
+	return table.Licenses, nil
+}
+
+// load returns the licenses in the license table, in order, with the state
+// recorded in the state file, and a map of the same licenses by ID.
+//
+// Licenses without a recorded state are FREE.
+func (t *Table) load() ([]*types.License, map[string]*types.License, error) {
+	entries, err := t.readLicenses()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	states := map[string]*licenseState{}
+	data, err := os.ReadFile(t.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to read license state file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse license state file %s: %w", t.statePath, err)
+		}
+	}
+
+	licenses := []*types.License{}
+	byID := map[string]*types.License{}
+	for _, entry := range entries {
+		l := &types.License{
+			ID:      entry.ID,
+			Vendor:  entry.Vendor,
+			Feature: entry.Feature,
+			Status:  StateFree,
+		}
+		if state := states[entry.ID]; state != nil {
+			l.Status = state.Status
+			l.LastUpdateTime = state.LastUpdateTime
+			l.UserNode = state.UserNode
+			l.UserProcess = state.UserProcess
+		}
+		licenses = append(licenses, l)
+		byID[l.ID] = l
+	}
+	return licenses, byID, nil
+}
+
+// saveState atomically replaces the state file with the state of the licenses.
+func (t *Table) saveState(licenses []*types.License) error {
+	states := map[string]*licenseState{}
+	for _, l := range licenses {
+		if l.Status == StateFree && l.LastUpdateTime.IsZero() {
+			continue
+		}
+		states[l.ID] = &licenseState{
+			Status:         l.Status,
+			LastUpdateTime: l.LastUpdateTime,
+			UserNode:       l.UserNode,
+			UserProcess:    l.UserProcess,
+		}
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode license state: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(t.statePath, data, 0600); err != nil {
+		metricFileCounter.WithLabelValues("saveState", "error_write").Inc()
+		return fmt.Errorf("failed to write license state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package filedb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+	"github.com/System233/enkit/lib/str"
+)
+
+const sampleLicenseFile = `
+licenses:
+  - id: aaaa
+    vendor: vendor_a
+    feature: feature_1
+  - id: bbbb
+    vendor: vendor_a
+    feature: feature_1
+  - id: cccc
+    vendor: vendor_b
+    feature: feature_2
+`
+
+func openTestTable(t *testing.T, nodeID string) (*Table, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "licenses.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(sampleLicenseFile), 0644))
+
+	table, err := OpenTable(path, "", nodeID)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return table, path
+}
+
+// statuses returns the status of each license, and the node using it, if any.
+func statuses(t *testing.T, table *Table) map[string]string {
+	licenses, err := table.GetCurrent(context.Background())
+	assert.NoError(t, err)
+	got := map[string]string{}
+	for _, l := range licenses {
+		got[l.ID] = l.Status + str.ValueOrDefault(l.UserNode, "")
+	}
+	return got
+}
+
+func ids(licenses []*types.License) []string {
+	ret := []string{}
+	for _, l := range licenses {
+		ret = append(ret, l.ID)
+	}
+	return ret
+}
+
+func TestTableIsNotifierAndReserver(t *testing.T) {
+	var notifierType *types.Notifier
+	assert.Implements(t, notifierType, &Table{})
+	var reserverType *types.Reserver
+	assert.Implements(t, reserverType, &Table{})
+}
+
+func TestOpenTable(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		content string
+		wantErr string
+	}{
+		{
+			desc:    "json",
+			content: `{"licenses": [{"id": "aaaa", "vendor": "vendor_a", "feature": "feature_1"}]}`,
+		},
+		{
+			desc:    "invalid syntax",
+			content: `licenses: [`,
+			wantErr: "failed to parse license file",
+		},
+		{
+			desc:    "missing vendor",
+			content: `{"licenses": [{"id": "aaaa", "feature": "feature_1"}]}`,
+			wantErr: "license 0 must have an id, vendor and feature",
+		},
+		{
+			desc:    "duplicate id",
+			content: sampleLicenseFile + "  - {id: aaaa, vendor: vendor_c, feature: feature_3}\n",
+			wantErr: `duplicate license id "aaaa"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "licenses")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0644))
+
+			_, gotErr := OpenTable(path, "", "client_a")
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, gotErr, tc.wantErr)
+			} else {
+				assert.NoError(t, gotErr)
+			}
+		})
+	}
+
+	_, gotErr := OpenTable(filepath.Join(t.TempDir(), "missing"), "", "client_a")
+	assert.ErrorContains(t, gotErr, "failed to read license file")
+}
+
+func TestReserveAndRelease(t *testing.T) {
+	ctx := context.Background()
+	table, path := openTestTable(t, "client_a")
+
+	licenses, err := table.GetCurrent(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*types.License{
+		{ID: "aaaa", Vendor: "vendor_a", Feature: "feature_1", Status: "FREE"},
+		{ID: "bbbb", Vendor: "vendor_a", Feature: "feature_1", Status: "FREE"},
+		{ID: "cccc", Vendor: "vendor_b", Feature: "feature_2", Status: "FREE"},
+	}, licenses)
+
+	got, err := table.Reserve(ctx, []string{"aaaa", "bbbb"}, "client_a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aaaa", "bbbb"}, ids(got))
+	assert.Equal(t, "RESERVED", got[0].Status)
+	assert.False(t, got[0].LastUpdateTime.IsZero())
+
+	// Licenses already reserved are not returned again.
+	got, err = table.Reserve(ctx, []string{"bbbb"}, "client_a")
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Unknown licenses fail the whole reservation.
+	_, err = table.Reserve(ctx, []string{"cccc", "zzzz"}, "client_a")
+	assert.ErrorContains(t, err, `license "zzzz"`)
+	assert.Equal(t, map[string]string{
+		"aaaa": "RESERVEDclient_a",
+		"bbbb": "RESERVEDclient_a",
+		"cccc": "FREE",
+	}, statuses(t, table))
+
+	// Licenses in use, or reserved by other nodes, are never released.
+	assert.NoError(t, table.UpdateInUse(ctx, []*types.License{
+		{ID: "aaaa", Status: "IN_USE", UserNode: str.Pointer("client_a"), UserProcess: str.Pointer("job-abcd")},
+	}))
+	_, err = table.Reserve(ctx, []string{"cccc"}, "client_b")
+	assert.NoError(t, err)
+	got, err = table.Release(ctx, []string{"aaaa", "bbbb", "cccc"}, "client_a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bbbb"}, ids(got))
+
+	// The state survives restarts.
+	reopened, err := OpenTable(path, "", "client_a")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"aaaa": "IN_USEclient_a",
+		"bbbb": "FREE",
+		"cccc": "RESERVEDclient_b",
+	}, statuses(t, reopened))
+
+	// Licenses no longer in use on this node are freed.
+	assert.NoError(t, reopened.UpdateInUse(ctx, []*types.License{}))
+	assert.Equal(t, map[string]string{
+		"aaaa": "FREE",
+		"bbbb": "FREE",
+		"cccc": "RESERVEDclient_b",
+	}, statuses(t, table))
+}
+
+func TestReserveConcurrent(t *testing.T) {
+	ctx := context.Background()
+	table, path := openTestTable(t, "client_a")
+	// A second table on the same files, as if opened by another process.
+	other, err := OpenTable(path, "", "client_a")
+	assert.NoError(t, err)
+
+	var lock sync.Mutex
+	reserved := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tables := []*Table{table, other}
+			got, err := tables[i%2].Reserve(ctx, []string{[]string{"aaaa", "bbbb", "cccc"}[i%3]}, "client_a")
+			assert.NoError(t, err)
+
+			lock.Lock()
+			defer lock.Unlock()
+			for _, id := range ids(got) {
+				reserved[id]++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Each license is reserved exactly once, and no update is lost.
+	assert.Equal(t, map[string]int{"aaaa": 1, "bbbb": 1, "cccc": 1}, reserved)
+	assert.Equal(t, map[string]string{
+		"aaaa": "RESERVEDclient_a",
+		"bbbb": "RESERVEDclient_a",
+		"cccc": "RESERVEDclient_a",
+	}, statuses(t, table))
+}
+
+func TestChan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	table, path := openTestTable(t, "client_a")
+
+	notifications := table.Chan(ctx)
+	receive := func() bool {
+		timeout := time.After(time.Second)
+		select {
+		case <-notifications:
+		case <-timeout:
+			return false
+		}
+		// Drain the notifications for the other events caused by the same change.
+		for {
+			select {
+			case <-notifications:
+			case <-time.After(50 * time.Millisecond):
+				return true
+			}
+		}
+	}
+
+	_, err := table.Reserve(ctx, []string{"aaaa"}, "client_a")
+	assert.NoError(t, err)
+	assert.True(t, receive(), "no notification for reservation")
+
+	assert.NoError(t, os.WriteFile(path, []byte(sampleLicenseFile+"  - {id: dddd, vendor: vendor_d, feature: feature_4}\n"), 0644))
+	assert.True(t, receive(), "no notification for license file change")
+	assert.Contains(t, statuses(t, table), "dddd")
+
+	// Other files in the directory are ignored.
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), "unrelated"), []byte("data"), 0644))
+	assert.False(t, receive(), "notification for unrelated file")
+}
@@ -35,3 +35,8 @@ func (m *mockReserver) UpdateInUse(ctx context.Context, licenses []*types.Licens
 	args := m.Called(ctx, licenses)
 	return args.Error(0)
 }
+
+func (m *mockReserver) Release(ctx context.Context, licenseIDs []string, node string) ([]*types.License, error) {
+	args := m.Called(ctx, licenseIDs, node)
+	return args.Get(0).([]*types.License), args.Error(1)
+}
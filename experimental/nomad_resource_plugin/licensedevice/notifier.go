@@ -0,0 +1,127 @@
+package licensedevice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+)
+
+var metricNotifierCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "licensedevice",
+	Subsystem: "notifier",
+	Name:      "results",
+	Help:      "The number of times the resilient notifier has succeeded or errored in various sections of the code",
+},
+	[]string{
+		"location",
+		"outcome",
+	})
+
+// DefaultNotifierHeartbeat is how long the license state can go without
+// notifications before it is fetched again anyway.
+const DefaultNotifierHeartbeat = time.Minute
+
+// ResilientNotifier wraps a Notifier, like sqldb.Table, to never serve a
+// stale license state for long.
+//
+// If no notification arrives within the heartbeat window, because nothing
+// changed, or because notifications were lost, one is sent anyway, forcing a
+// resync of the license state.
+//
+// ResilientNotifier is a HealthReporter: the backing store is considered
+// unreachable if the last GetCurrent failed, or if the wrapped Notifier, as a
+// HealthReporter, says so.
+type ResilientNotifier struct {
+	notifier  types.Notifier
+	heartbeat time.Duration
+
+	// Protects err.
+	lock sync.Mutex
+	// Error returned by the last GetCurrent, nil if successful.
+	err error
+}
+
+func NewResilientNotifier(notifier types.Notifier, heartbeat time.Duration) *ResilientNotifier {
+	if heartbeat <= 0 {
+		heartbeat = DefaultNotifierHeartbeat
+	}
+	return &ResilientNotifier{
+		notifier:  notifier,
+		heartbeat: heartbeat,
+	}
+}
+
+func (r *ResilientNotifier) GetCurrent(ctx context.Context) ([]*types.License, error) {
+	licenses, err := r.notifier.GetCurrent(ctx)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.err = err
+	return licenses, err
+}
+
+// Chan returns a channel notified every time the wrapped Notifier is, and
+// after every heartbeat window without notifications.
+func (r *ResilientNotifier) Chan(ctx context.Context) chan struct{} {
+	c := make(chan struct{})
+	notifications := r.notifier.Chan(ctx)
+
+	go func() {
+		timer := time.NewTimer(r.heartbeat)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-notifications:
+				if !ok {
+					metricNotifierCounter.WithLabelValues("Chan", "error_notifier_closed").Inc()
+					slog.Error("license state notifications stopped, relying on heartbeat")
+					notifications = nil
+					continue
+				}
+				metricNotifierCounter.WithLabelValues("Chan", "notification").Inc()
+			case <-timer.C:
+				metricNotifierCounter.WithLabelValues("Chan", "heartbeat").Inc()
+				slog.Debug("no license state notification within heartbeat window, forcing resync")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case c <- struct{}{}:
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(r.heartbeat)
+		}
+	}()
+	return c
+}
+
+func (r *ResilientNotifier) Healthy() error {
+	r.lock.Lock()
+	err := r.err
+	r.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to fetch license state: %w", err)
+	}
+
+	if reporter, ok := r.notifier.(types.HealthReporter); ok {
+		return reporter.Healthy()
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package licensedevice
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+)
+
+// reportingNotifier is a Notifier reporting the health of its backing store.
+type reportingNotifier struct {
+	mockNotifier
+	err error
+}
+
+func (r *reportingNotifier) Healthy() error {
+	return r.err
+}
+
+func TestResilientNotifierIsNotifier(t *testing.T) {
+	var notifierType *types.Notifier
+	assert.Implements(t, notifierType, &ResilientNotifier{})
+	var reporterType *types.HealthReporter
+	assert.Implements(t, reporterType, &ResilientNotifier{})
+}
+
+func TestResilientNotifierChan(t *testing.T) {
+	notifier := &mockNotifier{}
+	notifyChan := make(chan struct{})
+	notifier.On("Chan").Return(notifyChan)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewResilientNotifier(notifier, 200*time.Millisecond)
+	gotChan := r.Chan(ctx)
+
+	receive := func(within time.Duration) bool {
+		select {
+		case <-gotChan:
+			return true
+		case <-time.After(within):
+			return false
+		}
+	}
+
+	// Notifications are forwarded immediately.
+	start := time.Now()
+	notifyChan <- struct{}{}
+	assert.True(t, receive(100*time.Millisecond), "notification not forwarded")
+
+	// Without notifications, the heartbeat forces a resync.
+	assert.True(t, receive(time.Second), "no heartbeat")
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// Heartbeats go on even if the notifier stops.
+	close(notifyChan)
+	assert.True(t, receive(time.Second), "no heartbeat after notifier stopped")
+}
+
+func TestResilientNotifierHealthy(t *testing.T) {
+	notifier := &reportingNotifier{}
+	r := NewResilientNotifier(notifier, time.Hour)
+	assert.NoError(t, r.Healthy())
+
+	notifier.On("GetCurrent").Return([]*types.License(nil), fmt.Errorf("connection refused")).Once()
+	_, err := r.GetCurrent(context.Background())
+	assert.ErrorContains(t, err, "connection refused")
+	assert.ErrorContains(t, r.Healthy(), "failed to fetch license state: connection refused")
+
+	notifier.On("GetCurrent").Return(sampleLicenseTable, nil)
+	got, err := r.GetCurrent(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, sampleLicenseTable, got)
+	assert.NoError(t, r.Healthy())
+
+	notifier.err = fmt.Errorf("lost connection listening for license state updates")
+	assert.ErrorContains(t, r.Healthy(), "lost connection")
+}
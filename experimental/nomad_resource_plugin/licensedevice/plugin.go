@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/device"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
@@ -18,6 +21,7 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/docker"
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/filedb"
 	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/sqldb"
 	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
 	"github.com/System233/enkit/lib/str"
@@ -34,26 +38,90 @@ var metricPluginCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		"outcome",
 	})
 
+const (
+	// DefaultLicenseHandleRoot is where the plugin records the licenses reserved on the node.
+	DefaultLicenseHandleRoot = "/var/lib/nomad/license_handles"
+	// DefaultReservationTTL is how long a reserved license can go unused before being released.
+	DefaultReservationTTL = 10 * time.Minute
+	// DefaultStatsInterval is how often stats are sent if Nomad does not provide an interval.
+	DefaultStatsInterval = 30 * time.Second
+
+	// BackendPostgres stores the license state in a Postgres database, shared by all nodes.
+	BackendPostgres = "postgres"
+	// BackendFile reads the licenses from a local file, and stores their state in a sidecar file.
+	BackendFile = "file"
+)
+
 type Plugin struct {
 	reserver          types.Reserver
 	globalUpdater     types.Notifier
 	localUpdater      types.Notifier
 	licenseHandleRoot string
 	nodeID            string
+
+	// How long a reserved license can go unused before being released.
+	reservationTTL time.Duration
+	// How long the global license state can go without notifications before being fetched again.
+	notifierHeartbeat time.Duration
+	// Held while reserving licenses and writing their handles, and while
+	// releasing orphaned reservations, so a license being reserved again is
+	// never released.
+	reserveLock sync.Mutex
+	// Returns the current time, to be stubbed out in tests.
+	now func() time.Time
+
+	// Protects snapshot and snapshotUpdated.
+	snapshotLock sync.Mutex
+	// Last global license state fingerprinted, nil until the first fingerprint.
+	snapshot *licenseSnapshot
+	// Closed and replaced every time snapshot is updated.
+	snapshotUpdated chan struct{}
+
+	// Pools of licenses advertised as fungible slots.
+	pools []*PoolConfig
+	// Protects poolSlots.
+	poolLock sync.Mutex
+	// License chosen for each slot reserved on this node.
+	poolSlots map[string]string
+
+	// Protects stopLoops.
+	loopsLock sync.Mutex
+	// Stops the background loops started by the last configuration, nil if none.
+	stopLoops context.CancelFunc
+}
+
+// licenseSnapshot is the global license state returned by a single call to
+// GetCurrent, shared by fingerprints and stats so they never disagree.
+type licenseSnapshot struct {
+	licenses []*types.License
+	// Time the state was fetched.
+	updated time.Time
 }
 
 type Config struct {
-	DatabaseConnStr string `codec:"database_connection_string"`
-	TableName       string `codec:"database_table_name"`
-	NodeID          string `codec:"node_id"`
+	Backend           string        `codec:"backend"`
+	DatabaseConnStr   string        `codec:"database_connection_string"`
+	TableName         string        `codec:"database_table_name"`
+	NodeID            string        `codec:"node_id"`
+	LicenseHandleRoot string        `codec:"license_handle_root"`
+	ReservationTTL    string        `codec:"reservation_ttl"`
+	NotifierHeartbeat string        `codec:"notifier_heartbeat"`
+	LicenseFile       string        `codec:"license_file"`
+	LicenseStateFile  string        `codec:"license_state_file"`
+	Pools             []*PoolConfig `codec:"pool"`
 }
 
 func NewPlugin() *Plugin {
-	return &Plugin{}
+	return &Plugin{
+		licenseHandleRoot: DefaultLicenseHandleRoot,
+		reservationTTL:    DefaultReservationTTL,
+		notifierHeartbeat: DefaultNotifierHeartbeat,
+		now:               time.Now,
+	}
 }
 
 func ConfiguredPlugin(config *Config) (*Plugin, error) {
-	p := &Plugin{}
+	p := NewPlugin()
 	if err := p.configure(config); err != nil {
 		metricPluginCounter.WithLabelValues("ConfiguredPlugin", "error_configure").Inc()
 		return nil, fmt.Errorf("failed to configure plugin: %w", err)
@@ -74,12 +142,31 @@ func (p *Plugin) PluginInfo() (*base.PluginInfoResponse, error) {
 func (p *Plugin) ConfigSchema() (*hclspec.Spec, error) {
 	metricPluginCounter.WithLabelValues("ConfigSchema", "ok").Inc()
 	return hclspec.NewObject(map[string]*hclspec.Spec{
-		"database_connection_string": hclspec.NewAttr("database_connection_string", "string", true),
+		"backend": hclspec.NewDefault(
+			hclspec.NewAttr("backend", "string", false),
+			hclspec.NewLiteral(`"`+BackendPostgres+`"`),
+		),
+		"database_connection_string": hclspec.NewAttr("database_connection_string", "string", false),
 		"database_table_name": hclspec.NewDefault(
 			hclspec.NewAttr("database_table_name", "string", true),
 			hclspec.NewLiteral(`"license_status"`),
 		),
 		"node_id": hclspec.NewAttr("node_id", "string", true),
+		"license_handle_root": hclspec.NewDefault(
+			hclspec.NewAttr("license_handle_root", "string", false),
+			hclspec.NewLiteral(`"`+DefaultLicenseHandleRoot+`"`),
+		),
+		"reservation_ttl": hclspec.NewDefault(
+			hclspec.NewAttr("reservation_ttl", "string", false),
+			hclspec.NewLiteral(`"`+DefaultReservationTTL.String()+`"`),
+		),
+		"notifier_heartbeat": hclspec.NewDefault(
+			hclspec.NewAttr("notifier_heartbeat", "string", false),
+			hclspec.NewLiteral(`"`+DefaultNotifierHeartbeat.String()+`"`),
+		),
+		"license_file":       hclspec.NewAttr("license_file", "string", false),
+		"license_state_file": hclspec.NewAttr("license_state_file", "string", false),
+		"pool":               hclspec.NewBlockList("pool", poolConfigSpec()),
 	}), nil
 }
 
@@ -112,14 +199,37 @@ func (p *Plugin) Fingerprint(ctx context.Context) (<-chan *device.FingerprintRes
 func (p *Plugin) Reserve(deviceIDs []string) (*device.ContainerReservation, error) {
 	slog.Info("Reserve() called")
 
+	p.reserveLock.Lock()
+	defer p.reserveLock.Unlock()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	licenses, err := p.reserver.Reserve(ctx, deviceIDs, p.nodeID)
+	reserve, shared, assigned, err := p.resolveDevices(ctx, deviceIDs)
 	if err != nil {
-		metricPluginCounter.WithLabelValues("Reserve", "error_reserve").Inc()
+		metricPluginCounter.WithLabelValues("Reserve", "error_resolve_devices").Inc()
 		return nil, fmt.Errorf("failed to reserve %v: %w", deviceIDs, err)
 	}
 
+	// Handles are written first, so a reservation is never without a handle,
+	// and can always be released if the allocation never uses it. Handles of
+	// shared licenses are refreshed, as another allocation is about to use them.
+	handles := append(append([]string{}, reserve...), shared...)
+	if err := p.writeHandles(handles); err != nil {
+		metricPluginCounter.WithLabelValues("Reserve", "error_write_handles").Inc()
+		return nil, fmt.Errorf("failed to reserve %v: %w", deviceIDs, err)
+	}
+
+	var licenses []*types.License
+	if len(reserve) > 0 {
+		licenses, err = p.reserver.Reserve(ctx, reserve, p.nodeID)
+		if err != nil {
+			p.removeHandles(reserve)
+			metricPluginCounter.WithLabelValues("Reserve", "error_reserve").Inc()
+			return nil, fmt.Errorf("failed to reserve %v: %w", deviceIDs, err)
+		}
+	}
+	p.assignSlots(assigned)
+
 	cr := &device.ContainerReservation{}
 
 	var licenseString string
@@ -129,6 +239,12 @@ func (p *Plugin) Reserve(deviceIDs []string) (*device.ContainerReservation, erro
 		}
 		licenseString += l.ID
 	}
+	for _, id := range shared {
+		if licenseString != "" {
+			licenseString += ","
+		}
+		licenseString += id
+	}
 	cr.Envs = make(map[string]string)
 	cr.Envs[docker.LicenseEnvVar] = licenseString
 	metricPluginCounter.WithLabelValues("Reserve", "ok").Inc()
@@ -136,7 +252,72 @@ func (p *Plugin) Reserve(deviceIDs []string) (*device.ContainerReservation, erro
 }
 
 func (p *Plugin) Stats(ctx context.Context, interval time.Duration) (<-chan *device.StatsResponse, error) {
-	return nil, fmt.Errorf("Stats not implemented")
+	slog.Info("Stats() called")
+	if p.globalUpdater == nil {
+		metricPluginCounter.WithLabelValues("Stats", "error_global_updater").Inc()
+		return nil, fmt.Errorf("plugin is not configured: nil notifier")
+	}
+	if interval <= 0 {
+		interval = DefaultStatsInterval
+	}
+
+	resChan := make(chan *device.StatsResponse)
+	go p.statsLoop(ctx, interval, resChan)
+	metricPluginCounter.WithLabelValues("Stats", "ok").Inc()
+	return resChan, nil
+}
+
+// setSnapshot records the global license state, and wakes up the stats loops.
+func (p *Plugin) setSnapshot(licenses []*types.License) {
+	p.snapshotLock.Lock()
+	defer p.snapshotLock.Unlock()
+
+	p.snapshot = &licenseSnapshot{licenses: licenses, updated: p.now()}
+	if p.snapshotUpdated != nil {
+		close(p.snapshotUpdated)
+	}
+	p.snapshotUpdated = make(chan struct{})
+}
+
+// getSnapshot returns the last global license state recorded, or nil if
+// none, and a channel closed when a newer state is recorded.
+func (p *Plugin) getSnapshot() (*licenseSnapshot, <-chan struct{}) {
+	p.snapshotLock.Lock()
+	defer p.snapshotLock.Unlock()
+
+	if p.snapshotUpdated == nil {
+		p.snapshotUpdated = make(chan struct{})
+	}
+	return p.snapshot, p.snapshotUpdated
+}
+
+// statsLoop sends the stats of the last fingerprinted license state every
+// interval, and every time the state is fingerprinted again.
+func (p *Plugin) statsLoop(ctx context.Context, interval time.Duration, resChan chan<- *device.StatsResponse) {
+	slog.Debug("starting stats response loop")
+	defer close(resChan)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		snapshot, updated := p.getSnapshot()
+		// Before the first fingerprint there is nothing to report.
+		if snapshot != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case resChan <- &device.StatsResponse{Groups: statsFromSnapshot(snapshot, p.pools)}:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-updated:
+		}
+	}
 }
 
 func (p *Plugin) fingerprintLoop(ctx context.Context, notifyChan chan struct{}, resChan chan<- *device.FingerprintResponse) {
@@ -168,11 +349,20 @@ nextNotification:
 		if err != nil {
 			metricPluginCounter.WithLabelValues("fingerprintLoop", "error_global_updater_get_current").Inc()
 			slog.Error("failed to get global license state", "error", err)
-			continue nextNotification
+
+			// Rather than leaving the last fingerprint in place, the licenses
+			// last seen are reported as unhealthy until the state can be fetched.
+			snapshot, _ := p.getSnapshot()
+			if snapshot == nil {
+				continue nextNotification
+			}
+			licenses = snapshot.licenses
+		} else {
+			p.setSnapshot(licenses)
 		}
 
 		slog.Debug("parsing global license state")
-		groups, err := deviceGroupsFromLicenses(licenses)
+		groups, err := p.deviceGroups(licenses)
 		slog.Debug("finished parsing global license state")
 		if err != nil {
 			metricPluginCounter.WithLabelValues("fingerprintLoop", "error_device_groups_from_licenses").Inc()
@@ -180,11 +370,34 @@ nextNotification:
 			continue nextNotification
 		}
 
+		if err := p.globalHealth(); err != nil {
+			metricPluginCounter.WithLabelValues("fingerprintLoop", "unhealthy_global_updater").Inc()
+			markUnhealthy(groups, err)
+		}
+
 		slog.Info("sending fingerprint response")
 		resChan <- &device.FingerprintResponse{Devices: groups}
 	}
 }
 
+// globalHealth returns why the global license state is unreachable, or nil.
+func (p *Plugin) globalHealth() error {
+	if reporter, ok := p.globalUpdater.(types.HealthReporter); ok {
+		return reporter.Healthy()
+	}
+	return nil
+}
+
+// markUnhealthy marks all the devices as unhealthy, as the license state is unreachable.
+func markUnhealthy(groups []*device.DeviceGroup, err error) {
+	for _, group := range groups {
+		for _, device := range group.Devices {
+			device.Healthy = false
+			device.HealthDesc = fmt.Sprintf("license state unreachable: %v", err)
+		}
+	}
+}
+
 func (p *Plugin) configure(config *Config) error {
 	rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	if config.NodeID == "" {
@@ -195,11 +408,11 @@ func (p *Plugin) configure(config *Config) error {
 			return fmt.Errorf("no node id, hostname also failed: %w", err)
 		}
 	}
-	table, err := sqldb.OpenTable(rctx, config.DatabaseConnStr, config.TableName, config.NodeID)
+	table, err := openBackend(rctx, config)
 	cancel()
 	if err != nil {
 		metricPluginCounter.WithLabelValues("configure", "error_open_table").Inc()
-		return fmt.Errorf("failed to open DB: %w", err)
+		return err
 	}
 
 	dockerClient, err := docker.NewClient(context.Background(), config.NodeID)
@@ -208,13 +421,220 @@ func (p *Plugin) configure(config *Config) error {
 		return fmt.Errorf("failed to create local notifier: %w", err)
 	}
 
+	if err := validatePools(config.Pools); err != nil {
+		metricPluginCounter.WithLabelValues("configure", "error_pools").Inc()
+		return fmt.Errorf("invalid pool config: %w", err)
+	}
+	p.pools = config.Pools
+
+	if config.LicenseHandleRoot != "" {
+		p.licenseHandleRoot = config.LicenseHandleRoot
+	}
+	if config.ReservationTTL != "" {
+		p.reservationTTL, err = time.ParseDuration(config.ReservationTTL)
+		if err != nil {
+			metricPluginCounter.WithLabelValues("configure", "error_reservation_ttl").Inc()
+			return fmt.Errorf("invalid reservation_ttl %q: %w", config.ReservationTTL, err)
+		}
+	}
+	if config.NotifierHeartbeat != "" {
+		p.notifierHeartbeat, err = time.ParseDuration(config.NotifierHeartbeat)
+		if err != nil {
+			metricPluginCounter.WithLabelValues("configure", "error_notifier_heartbeat").Inc()
+			return fmt.Errorf("invalid notifier_heartbeat %q: %w", config.NotifierHeartbeat, err)
+		}
+	}
+
 	p.nodeID = config.NodeID
 	p.reserver = table
-	p.globalUpdater = table
+	p.globalUpdater = NewResilientNotifier(table, p.notifierHeartbeat)
 	p.localUpdater = dockerClient
 
-	go p.localUpdatesLoop(context.Background(), p.localUpdater.Chan(context.Background()))
+	p.startLoops()
+	return nil
+}
+
+// startLoops starts the background loops of the plugin, stopping the ones
+// started by a previous configuration, if any.
+func (p *Plugin) startLoops() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p.loopsLock.Lock()
+	if p.stopLoops != nil {
+		p.stopLoops()
+	}
+	p.stopLoops = cancel
+	p.loopsLock.Unlock()
+
+	go p.localUpdatesLoop(ctx, p.localUpdater.Chan(ctx))
+	go p.reconcileLoop(ctx)
+}
+
+// Shutdown stops the background loops started when the plugin was configured.
+func (p *Plugin) Shutdown() {
+	p.loopsLock.Lock()
+	defer p.loopsLock.Unlock()
+	if p.stopLoops != nil {
+		p.stopLoops()
+		p.stopLoops = nil
+	}
+}
 
+// backend stores the global license state.
+type backend interface {
+	types.Reserver
+	types.Notifier
+}
+
+// openBackend opens the backend selected by the config.
+func openBackend(ctx context.Context, config *Config) (backend, error) {
+	switch config.Backend {
+	case BackendPostgres, "":
+		if config.DatabaseConnStr == "" {
+			return nil, fmt.Errorf("database_connection_string is required with the %q backend", BackendPostgres)
+		}
+		table, err := sqldb.OpenTable(ctx, config.DatabaseConnStr, config.TableName, config.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open DB: %w", err)
+		}
+		return table, nil
+	case BackendFile:
+		if config.LicenseFile == "" {
+			return nil, fmt.Errorf("license_file is required with the %q backend", BackendFile)
+		}
+		table, err := filedb.OpenTable(config.LicenseFile, config.LicenseStateFile, config.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open license file: %w", err)
+		}
+		return table, nil
+	}
+	return nil, fmt.Errorf("invalid backend %q - must be one of %q, %q", config.Backend, BackendPostgres, BackendFile)
+}
+
+// handlePath returns the path of the handle recording the reservation of a license.
+func (p *Plugin) handlePath(id string) string {
+	return filepath.Join(p.licenseHandleRoot, id)
+}
+
+// writeHandles records the reservation of the licenses, at the current time.
+func (p *Plugin) writeHandles(ids []string) error {
+	if err := os.MkdirAll(p.licenseHandleRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create license handle dir: %w", err)
+	}
+	now := p.now()
+	for _, id := range ids {
+		path := p.handlePath(id)
+		if err := os.WriteFile(path, []byte(p.nodeID+"\n"), 0644); err != nil {
+			p.removeHandles(ids)
+			return fmt.Errorf("failed to write license handle: %w", err)
+		}
+		// Rewriting a file may not update its modification time on all file systems.
+		if err := os.Chtimes(path, now, now); err != nil {
+			p.removeHandles(ids)
+			return fmt.Errorf("failed to write license handle: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) removeHandles(ids []string) {
+	for _, id := range ids {
+		if err := os.Remove(p.handlePath(id)); err != nil && !os.IsNotExist(err) {
+			slog.Error("failed to remove license handle", "id", id, "error", err)
+		}
+	}
+}
+
+// reconcileLoop periodically releases the licenses whose reservations were orphaned.
+func (p *Plugin) reconcileLoop(ctx context.Context) {
+	interval := p.reservationTTL / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := p.reconcile(rctx)
+		cancel()
+		if err != nil {
+			slog.Error("failed to release orphaned licenses", "error", err)
+		}
+	}
+}
+
+// reconcile compares the licenses reserved on this node with the ones used
+// by the containers running on the node.
+//
+// Licenses in use are reported to the reserver, freeing the licenses whose
+// containers went away unnoticed. Licenses reserved longer than the
+// reservation TTL ago, and not in use, are released: Nomad garbage
+// collected the allocation, or it never started.
+func (p *Plugin) reconcile(ctx context.Context) error {
+	inUse, err := p.localUpdater.GetCurrent(ctx)
+	if err != nil {
+		metricPluginCounter.WithLabelValues("reconcile", "error_local_updater_get_current").Inc()
+		return fmt.Errorf("failed to get local license state: %w", err)
+	}
+	if err := p.reserver.UpdateInUse(ctx, inUse); err != nil {
+		metricPluginCounter.WithLabelValues("reconcile", "error_reserver_update_in_use").Inc()
+		return fmt.Errorf("failed to update global license state with in-use info: %w", err)
+	}
+	used := map[string]bool{}
+	for _, l := range inUse {
+		used[l.ID] = true
+	}
+
+	// The handles are read with the lock held, so any reservation made since
+	// inUse was computed has a fresh handle, and is not released.
+	p.reserveLock.Lock()
+	defer p.reserveLock.Unlock()
+
+	entries, err := os.ReadDir(p.licenseHandleRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		metricPluginCounter.WithLabelValues("reconcile", "error_read_handles").Inc()
+		return fmt.Errorf("failed to read license handles: %w", err)
+	}
+
+	now := p.now()
+	orphans := []string{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || used[entry.Name()] {
+			continue
+		}
+		if now.Sub(info.ModTime()) < p.reservationTTL {
+			continue
+		}
+		orphans = append(orphans, entry.Name())
+	}
+	if len(orphans) == 0 {
+		metricPluginCounter.WithLabelValues("reconcile", "ok").Inc()
+		return nil
+	}
+
+	released, err := p.reserver.Release(ctx, orphans, p.nodeID)
+	if err != nil {
+		metricPluginCounter.WithLabelValues("reconcile", "error_reserver_release").Inc()
+		return fmt.Errorf("failed to release licenses %v: %w", orphans, err)
+	}
+	// Handles of licenses used and then freed by UpdateInUse expire as well,
+	// and are removed even if there was nothing left to release.
+	p.removeHandles(orphans)
+	for _, l := range released {
+		slog.Info("released orphaned license reservation", "id", l.ID)
+	}
+	metricPluginCounter.WithLabelValues("reconcile", "ok").Inc()
 	return nil
 }
 
@@ -254,6 +674,33 @@ nextNotification:
 	}
 }
 
+// deviceGroups returns the device groups advertising the licenses: a group
+// of slots for each pool, and a group for each vendor and feature of the
+// licenses in no pool.
+func (p *Plugin) deviceGroups(ls []*types.License) ([]*device.DeviceGroup, error) {
+	pools, remaining := splitPools(p.pools, ls)
+	groups, err := deviceGroupsFromLicenses(remaining)
+	if err != nil {
+		return nil, err
+	}
+
+	local := p.localSlots(ls)
+	for _, pool := range pools {
+		groups = append(groups, poolDeviceGroup(pool, local))
+	}
+	sortDeviceGroups(groups)
+	return groups, nil
+}
+
+func sortDeviceGroups(groups []*device.DeviceGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Vendor != groups[j].Vendor {
+			return groups[i].Vendor < groups[j].Vendor
+		}
+		return groups[i].Name < groups[j].Name
+	})
+}
+
 func deviceGroupsFromLicenses(ls []*types.License) ([]*device.DeviceGroup, error) {
 	deviceGroupMap := map[string]*device.DeviceGroup{}
 
@@ -295,12 +742,89 @@ func deviceGroupsFromLicenses(ls []*types.License) ([]*device.DeviceGroup, error
 	for _, g := range deviceGroupMap {
 		groups = append(groups, g)
 	}
+	sortDeviceGroups(groups)
+
+	return groups, nil
+}
+
+// statsFromSnapshot computes the stats of each license, grouped like the
+// devices returned by deviceGroups.
+//
+// The summary of each license is the fraction of licenses in its group that
+// are in use, and its stats include the counts of licenses in the group in each
+// state, how long ago the license was reserved, if held, and the time the
+// state was fetched. Pools report the same stats for each slot, see poolStats.
+func statsFromSnapshot(snapshot *licenseSnapshot, pools []*PoolConfig) []*device.DeviceGroupStats {
+	poolStates, licenses := splitPools(pools, snapshot.licenses)
+
+	type groupCounts struct {
+		stats  *device.DeviceGroupStats
+		counts map[string]int64
+	}
+	groupMap := map[string]*groupCounts{}
+	for _, l := range licenses {
+		groupName := fmt.Sprintf("%s::%s", l.Vendor, l.Feature)
+		group := groupMap[groupName]
+		if group == nil {
+			group = &groupCounts{
+				stats: &device.DeviceGroupStats{
+					Type:          "flexlm_license",
+					Vendor:        l.Vendor,
+					Name:          l.Feature,
+					InstanceStats: map[string]*device.DeviceStats{},
+				},
+				counts: map[string]int64{},
+			}
+			groupMap[groupName] = group
+		}
+		group.counts[l.Status]++
+	}
+
+	lastUpdate := snapshot.updated.UTC().Format(time.RFC3339)
+	for _, l := range licenses {
+		group := groupMap[fmt.Sprintf("%s::%s", l.Vendor, l.Feature)]
+		total := int64(0)
+		for _, count := range group.counts {
+			total += count
+		}
+		inUse, free, reserved := group.counts["IN_USE"], group.counts["FREE"], group.counts["RESERVED"]
+
+		attributes := map[string]*structs.StatValue{
+			"status":      {StringVal: str.Pointer(l.Status), Desc: "State of the license"},
+			"in_use":      {IntNumeratorVal: &inUse, Unit: "licenses", Desc: "Licenses in the group in use"},
+			"free":        {IntNumeratorVal: &free, Unit: "licenses", Desc: "Licenses in the group free"},
+			"reserved":    {IntNumeratorVal: &reserved, Unit: "licenses", Desc: "Licenses in the group reserved, but not in use yet"},
+			"last_update": {StringVal: &lastUpdate, Desc: "Time the license state was last fetched"},
+		}
+		if (l.Status == "IN_USE" || l.Status == "RESERVED") && !l.LastUpdateTime.IsZero() {
+			age := snapshot.updated.Sub(l.LastUpdateTime).Seconds()
+			attributes["reservation_age"] = &structs.StatValue{FloatNumeratorVal: &age, Unit: "s", Desc: "Time since the license was reserved or put in use"}
+		}
+
+		group.stats.InstanceStats[l.ID] = &device.DeviceStats{
+			Summary: &structs.StatValue{
+				IntNumeratorVal:   &inUse,
+				IntDenominatorVal: &total,
+				Unit:              "licenses",
+				Desc:              "Licenses in the group in use",
+			},
+			Stats:     &structs.StatObject{Attributes: attributes},
+			Timestamp: snapshot.updated,
+		}
+	}
+
+	groups := []*device.DeviceGroupStats{}
+	for _, g := range groupMap {
+		groups = append(groups, g.stats)
+	}
+	for _, state := range poolStates {
+		groups = append(groups, poolStats(state, snapshot))
+	}
 	sort.Slice(groups, func(i, j int) bool {
 		if groups[i].Vendor != groups[j].Vendor {
 			return groups[i].Vendor < groups[j].Vendor
 		}
 		return groups[i].Name < groups[j].Name
 	})
-
-	return groups, nil
+	return groups
 }
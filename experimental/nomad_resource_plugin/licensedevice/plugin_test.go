@@ -3,6 +3,9 @@ package licensedevice
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -143,13 +146,240 @@ func TestPluginFingerprint(t *testing.T) {
 	assert.Equal(t, &device.FingerprintResponse{Error: fmt.Errorf("context canceled")}, got)
 }
 
+func TestPluginFingerprintUnreachable(t *testing.T) {
+	notifier := &mockNotifier{}
+	notifyChan := make(chan struct{})
+	notifier.On("Chan").Return(notifyChan)
+	notifier.On("GetCurrent").Return(sampleLicenseTable[:1], nil).Once()
+	notifier.On("GetCurrent").Return([]*types.License(nil), fmt.Errorf("connection refused")).Once()
+	notifier.On("GetCurrent").Return(sampleLicenseTable[:1], nil)
+
+	p := NewPlugin()
+	p.globalUpdater = NewResilientNotifier(notifier, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gotChan, gotErr := p.Fingerprint(ctx)
+	if !assert.NoError(t, gotErr) {
+		return
+	}
+
+	receive := func() *device.Device {
+		select {
+		case got := <-gotChan:
+			if assert.Len(t, got.Devices, 1) && assert.Len(t, got.Devices[0].Devices, 1) {
+				return got.Devices[0].Devices[0]
+			}
+		case <-time.After(time.Second):
+			t.Errorf("never got license info")
+		}
+		return &device.Device{}
+	}
+
+	assert.Equal(t, &device.Device{ID: "aaaa", Healthy: true}, receive())
+
+	// The licenses last seen are reported as unhealthy while the state cannot be fetched.
+	notifyChan <- struct{}{}
+	assert.Equal(t, &device.Device{
+		ID:         "aaaa",
+		HealthDesc: "license state unreachable: failed to fetch license state: connection refused",
+	}, receive())
+
+	notifyChan <- struct{}{}
+	assert.Equal(t, &device.Device{ID: "aaaa", Healthy: true}, receive())
+}
+
+func TestOpenBackend(t *testing.T) {
+	licenseFile := filepath.Join(t.TempDir(), "licenses.yaml")
+	assert.NoError(t, os.WriteFile(licenseFile, []byte("licenses:\n  - {id: aaaa, vendor: vendor_a, feature: feature_1}\n"), 0644))
+
+	testCases := []struct {
+		desc    string
+		config  *Config
+		wantErr string
+	}{
+		{
+			desc:   "file",
+			config: &Config{Backend: BackendFile, LicenseFile: licenseFile},
+		},
+		{
+			desc:    "file without license file",
+			config:  &Config{Backend: BackendFile},
+			wantErr: "license_file is required",
+		},
+		{
+			desc:    "file missing",
+			config:  &Config{Backend: BackendFile, LicenseFile: licenseFile + ".missing"},
+			wantErr: "failed to open license file",
+		},
+		{
+			desc:    "postgres without connection string",
+			config:  &Config{LicenseFile: licenseFile},
+			wantErr: "database_connection_string is required",
+		},
+		{
+			desc:    "invalid",
+			config:  &Config{Backend: "mysql"},
+			wantErr: `invalid backend "mysql"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, gotErr := openBackend(context.Background(), tc.config)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, gotErr, tc.wantErr)
+				return
+			}
+			if !assert.NoError(t, gotErr) {
+				return
+			}
+			licenses, err := got.GetCurrent(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, licenses, 1)
+		})
+	}
+}
+
+func TestStatsBeforeSetConfig(t *testing.T) {
+	p := NewPlugin()
+	_, gotErr := p.Stats(context.Background(), time.Second)
+
+	assert.Error(t, gotErr)
+}
+
+// receiveStats returns the next stats response, or nil if none is sent in time.
+func receiveStats(t *testing.T, statsChan <-chan *device.StatsResponse) *device.StatsResponse {
+	select {
+	case got := <-statsChan:
+		return got
+	case <-time.After(time.Second):
+		t.Errorf("never got stats")
+		return nil
+	}
+}
+
+// statValues summarizes the stats of a device group: the license state, and
+// its age if held, by license ID, followed by the counts of licenses in use,
+// reserved and free in the group.
+func statValues(group *device.DeviceGroupStats) map[string]string {
+	values := map[string]string{}
+	for id, stats := range group.InstanceStats {
+		attrs := stats.Stats.Attributes
+		value := *attrs["status"].StringVal
+		if age := attrs["reservation_age"]; age != nil {
+			value += fmt.Sprintf(" for %.0fs", *age.FloatNumeratorVal)
+		}
+		values[id] = value
+		values["group"] = fmt.Sprintf("%d/%d in use, %d reserved, %d free, at %s",
+			*stats.Summary.IntNumeratorVal, *stats.Summary.IntDenominatorVal,
+			*attrs["reserved"].IntNumeratorVal, *attrs["free"].IntNumeratorVal, *attrs["last_update"].StringVal)
+	}
+	return values
+}
+
+func TestStats(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	before := []*types.License{
+		{ID: "aaaa", Vendor: "vendor_a", Feature: "feature_1", Status: "FREE"},
+		{ID: "bbbb", Vendor: "vendor_a", Feature: "feature_1", Status: "IN_USE", LastUpdateTime: now.Add(-time.Hour)},
+		{ID: "cccc", Vendor: "vendor_b", Feature: "feature_2", Status: "RESERVED", LastUpdateTime: now.Add(-time.Minute)},
+	}
+	after := []*types.License{
+		{ID: "aaaa", Vendor: "vendor_a", Feature: "feature_1", Status: "RESERVED", LastUpdateTime: now.Add(-time.Second)},
+		{ID: "bbbb", Vendor: "vendor_a", Feature: "feature_1", Status: "IN_USE", LastUpdateTime: now.Add(-time.Hour)},
+		{ID: "cccc", Vendor: "vendor_b", Feature: "feature_2", Status: "FREE", LastUpdateTime: now},
+	}
+
+	notifier := &mockNotifier{}
+	notifyChan := make(chan struct{})
+	notifier.On("Chan").Return(notifyChan)
+	notifier.On("GetCurrent").Return(before, nil).Once()
+	notifier.On("GetCurrent").Return(after, nil)
+
+	p := NewPlugin()
+	p.globalUpdater = notifier
+	p.now = func() time.Time { return now }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stats are only sent once the licenses have been fingerprinted.
+	statsChan, gotErr := p.Stats(ctx, time.Hour)
+	if !assert.NoError(t, gotErr) {
+		return
+	}
+	select {
+	case got := <-statsChan:
+		t.Fatalf("got stats before fingerprinting: %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fingerprintChan, gotErr := p.Fingerprint(ctx)
+	if !assert.NoError(t, gotErr) {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-fingerprintChan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	got := receiveStats(t, statsChan)
+	if !assert.NotNil(t, got) || !assert.Len(t, got.Groups, 2) {
+		return
+	}
+	assert.Equal(t, "vendor_a", got.Groups[0].Vendor)
+	assert.Equal(t, "feature_1", got.Groups[0].Name)
+	assert.Equal(t, map[string]string{
+		"aaaa":  "FREE",
+		"bbbb":  "IN_USE for 3600s",
+		"group": "1/2 in use, 0 reserved, 1 free, at 2023-06-01T12:00:00Z",
+	}, statValues(got.Groups[0]))
+	assert.Equal(t, map[string]string{
+		"cccc":  "RESERVED for 60s",
+		"group": "0/1 in use, 1 reserved, 0 free, at 2023-06-01T12:00:00Z",
+	}, statValues(got.Groups[1]))
+	assert.Equal(t, now, got.Groups[1].InstanceStats["cccc"].Timestamp)
+
+	// A new fingerprint refreshes the stats, without waiting for the interval.
+	now = now.Add(time.Minute)
+	notifyChan <- struct{}{}
+	got = receiveStats(t, statsChan)
+	if !assert.NotNil(t, got) || !assert.Len(t, got.Groups, 2) {
+		return
+	}
+	assert.Equal(t, map[string]string{
+		"aaaa":  "RESERVED for 61s",
+		"bbbb":  "IN_USE for 3660s",
+		"group": "1/2 in use, 1 reserved, 0 free, at 2023-06-01T12:01:00Z",
+	}, statValues(got.Groups[0]))
+	assert.Equal(t, map[string]string{
+		"cccc":  "FREE",
+		"group": "0/1 in use, 0 reserved, 1 free, at 2023-06-01T12:01:00Z",
+	}, statValues(got.Groups[1]))
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		select {
+		case _, ok := <-statsChan:
+			return !ok
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond, "stats channel never closed")
+}
+
 func TestReserve(t *testing.T) {
 	reserver := &mockReserver{}
 
 	p := NewPlugin()
 	p.nodeID = "client_a"
 	p.reserver = reserver
-	p.licenseHandleRoot = bazel.TestTmpDir()
+	p.licenseHandleRoot = t.TempDir()
 
 	reserver.On("Reserve", mock.Anything, []string{"aaaa", "bbbb"}, "client_a").Return([]*types.License{
 		{
@@ -181,4 +411,192 @@ func TestReserve(t *testing.T) {
 			"LICENSEPLUGIN_RESERVED_IDS": "aaaa,bbbb",
 		},
 	}, got)
+	assert.FileExists(t, filepath.Join(p.licenseHandleRoot, "aaaa"))
+	assert.FileExists(t, filepath.Join(p.licenseHandleRoot, "bbbb"))
+}
+
+func TestReserveFailure(t *testing.T) {
+	reserver := &mockReserver{}
+
+	p := NewPlugin()
+	p.nodeID = "client_a"
+	p.reserver = reserver
+	p.licenseHandleRoot = t.TempDir()
+
+	reserver.On("Reserve", mock.Anything, []string{"aaaa"}, "client_a").Return([]*types.License(nil), fmt.Errorf("already reserved"))
+
+	_, gotErr := p.Reserve([]string{"aaaa"})
+	assert.ErrorContains(t, gotErr, "already reserved")
+	assert.NoFileExists(t, filepath.Join(p.licenseHandleRoot, "aaaa"))
+}
+
+// reconcilePlugin returns a plugin with handles for the licenses in reserved,
+// written at the times specified.
+func reconcilePlugin(t *testing.T, now time.Time, reserved map[string]time.Time) (*Plugin, *mockReserver, *mockNotifier) {
+	reserver := &mockReserver{}
+	local := &mockNotifier{}
+
+	p := NewPlugin()
+	p.nodeID = "client_a"
+	p.reserver = reserver
+	p.localUpdater = local
+	p.licenseHandleRoot = t.TempDir()
+	p.reservationTTL = 10 * time.Minute
+	p.now = func() time.Time { return now }
+
+	for id, when := range reserved {
+		path := filepath.Join(p.licenseHandleRoot, id)
+		assert.NoError(t, os.WriteFile(path, []byte("client_a\n"), 0644))
+		assert.NoError(t, os.Chtimes(path, when, when))
+	}
+	return p, reserver, local
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	inUse := []*types.License{
+		{
+			ID:          "cccc",
+			Status:      "IN_USE",
+			UserNode:    str.Pointer("client_a"),
+			UserProcess: str.Pointer("job-abcd"),
+		},
+	}
+
+	testCases := []struct {
+		desc        string
+		reserved    map[string]time.Time
+		wantRelease []string
+		releaseErr  error
+		wantErr     string
+		wantHandles []string
+	}{
+		{
+			desc: "nothing expired",
+			reserved: map[string]time.Time{
+				"aaaa": now.Add(-time.Minute),
+				"cccc": now.Add(-time.Hour),
+			},
+			wantHandles: []string{"aaaa", "cccc"},
+		},
+		{
+			desc: "expired reservations are released",
+			reserved: map[string]time.Time{
+				"aaaa": now.Add(-time.Minute),
+				"bbbb": now.Add(-time.Hour),
+				"cccc": now.Add(-time.Hour),
+				"dddd": now.Add(-11 * time.Minute),
+			},
+			wantRelease: []string{"bbbb", "dddd"},
+			wantHandles: []string{"aaaa", "cccc"},
+		},
+		{
+			desc: "handles are kept if release fails",
+			reserved: map[string]time.Time{
+				"bbbb": now.Add(-time.Hour),
+			},
+			wantRelease: []string{"bbbb"},
+			releaseErr:  fmt.Errorf("database unavailable"),
+			wantErr:     "database unavailable",
+			wantHandles: []string{"bbbb"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, reserver, local := reconcilePlugin(t, now, tc.reserved)
+			local.On("GetCurrent").Return(inUse, nil)
+			reserver.On("UpdateInUse", mock.Anything, inUse).Return(nil)
+			if tc.wantRelease != nil {
+				released := []*types.License{}
+				for _, id := range tc.wantRelease {
+					released = append(released, &types.License{ID: id, Status: "FREE"})
+				}
+				reserver.On("Release", mock.Anything, tc.wantRelease, "client_a").Return(released, tc.releaseErr)
+			}
+
+			gotErr := p.reconcile(context.Background())
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, gotErr, tc.wantErr)
+			} else {
+				assert.NoError(t, gotErr)
+			}
+			reserver.AssertExpectations(t)
+			if tc.wantRelease == nil {
+				reserver.AssertNotCalled(t, "Release", mock.Anything, mock.Anything, mock.Anything)
+			}
+
+			handles := []string{}
+			entries, err := os.ReadDir(p.licenseHandleRoot)
+			assert.NoError(t, err)
+			for _, entry := range entries {
+				handles = append(handles, entry.Name())
+			}
+			assert.Equal(t, tc.wantHandles, handles)
+		})
+	}
+}
+
+func TestReconcileReserveAgain(t *testing.T) {
+	now := time.Now()
+	p, reserver, local := reconcilePlugin(t, now, map[string]time.Time{
+		"aaaa": now.Add(-time.Hour),
+	})
+	local.On("GetCurrent").Return([]*types.License{}, nil)
+	reserver.On("UpdateInUse", mock.Anything, []*types.License{}).Return(nil)
+	reserver.On("Reserve", mock.Anything, []string{"aaaa"}, "client_a").Return([]*types.License{
+		{ID: "aaaa", Status: "RESERVED", UserNode: str.Pointer("client_a")},
+	}, nil)
+
+	// A license reserved again gets a fresh handle, and is not released.
+	_, err := p.Reserve([]string{"aaaa"})
+	assert.NoError(t, err)
+	assert.NoError(t, p.reconcile(context.Background()))
+	reserver.AssertNotCalled(t, "Release", mock.Anything, mock.Anything, mock.Anything)
+
+	// Reservations racing with reconcile are never released.
+	reserver.On("Release", mock.Anything, mock.Anything, "client_a").Return([]*types.License{}, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := p.Reserve([]string{"aaaa"})
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, p.reconcile(context.Background()))
+		}()
+	}
+	wg.Wait()
+	reserver.AssertNotCalled(t, "Release", mock.Anything, mock.Anything, mock.Anything)
+	assert.FileExists(t, filepath.Join(p.licenseHandleRoot, "aaaa"))
+}
+
+// contextNotifier records the contexts its channel is requested with.
+type contextNotifier struct {
+	mockNotifier
+	ctxs []context.Context
+}
+
+func (c *contextNotifier) Chan(ctx context.Context) chan struct{} {
+	c.ctxs = append(c.ctxs, ctx)
+	return make(chan struct{})
+}
+
+func TestLoopsStopped(t *testing.T) {
+	local := &contextNotifier{}
+	p := NewPlugin()
+	p.localUpdater = local
+
+	// Configuring the plugin again stops the loops of the previous configuration.
+	p.startLoops()
+	p.startLoops()
+	assert.Len(t, local.ctxs, 2)
+	assert.Error(t, local.ctxs[0].Err())
+	assert.NoError(t, local.ctxs[1].Err())
+
+	p.Shutdown()
+	assert.Error(t, local.ctxs[1].Err())
+	p.Shutdown()
 }
@@ -0,0 +1,372 @@
+package licensedevice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+)
+
+// poolSlotPrefix starts the IDs of the devices advertised for pools.
+const poolSlotPrefix = "pool:"
+
+// PoolConfig collapses multiple licenses into a single device group, whose
+// devices are fungible slots, rather than specific licenses.
+//
+// When a slot is reserved, a free license of the pool is reserved in its
+// place. With an overcommit factor larger than 1, the pool advertises more
+// slots than licenses: once all the licenses are held, reserving the extra
+// slots shares a license already held, for features floating across sites,
+// intentionally oversubscribed.
+//
+// A pool with just a vendor, a feature and an overcommit factor
+// oversubscribes all the licenses of that feature.
+type PoolConfig struct {
+	// Name of the device group in Nomad. Defaults to the feature.
+	Name string `codec:"name"`
+	// Vendor of the licenses in the pool, and of the device group.
+	Vendor string `codec:"vendor"`
+	// Feature of the licenses in the pool, if LicenseIDs is empty.
+	Feature string `codec:"feature"`
+	// IDs of the licenses in the pool, possibly of different features.
+	LicenseIDs []string `codec:"license_ids"`
+	// Number of slots advertised per license in the pool, 1 if 0.
+	Overcommit float64 `codec:"overcommit"`
+}
+
+// poolConfigSpec is the hclspec of a pool block.
+func poolConfigSpec() *hclspec.Spec {
+	return hclspec.NewObject(map[string]*hclspec.Spec{
+		"name":        hclspec.NewAttr("name", "string", false),
+		"vendor":      hclspec.NewAttr("vendor", "string", true),
+		"feature":     hclspec.NewAttr("feature", "string", false),
+		"license_ids": hclspec.NewAttr("license_ids", "list(string)", false),
+		"overcommit": hclspec.NewDefault(
+			hclspec.NewAttr("overcommit", "number", false),
+			hclspec.NewLiteral("1.0"),
+		),
+	})
+}
+
+// validatePools checks the pools, and fills in their defaults.
+func validatePools(pools []*PoolConfig) error {
+	names := map[string]bool{}
+	for i, pool := range pools {
+		if pool.Vendor == "" {
+			return fmt.Errorf("pool %d: vendor is required", i)
+		}
+		if pool.Feature == "" && len(pool.LicenseIDs) == 0 {
+			return fmt.Errorf("pool %d: one of feature or license_ids is required", i)
+		}
+		if pool.Name == "" {
+			pool.Name = pool.Feature
+		}
+		if pool.Name == "" || strings.Contains(pool.Name, ":") {
+			return fmt.Errorf("pool %d: invalid name %q", i, pool.Name)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("pool %d: duplicate name %q", i, pool.Name)
+		}
+		names[pool.Name] = true
+
+		if pool.Overcommit == 0 {
+			pool.Overcommit = 1
+		}
+		if pool.Overcommit < 0 || math.IsNaN(pool.Overcommit) || math.IsInf(pool.Overcommit, 0) {
+			return fmt.Errorf("pool %s: invalid overcommit %v", pool.Name, pool.Overcommit)
+		}
+	}
+	return nil
+}
+
+// contains returns true if the license belongs to the pool.
+func (pc *PoolConfig) contains(l *types.License) bool {
+	if len(pc.LicenseIDs) == 0 {
+		return l.Vendor == pc.Vendor && l.Feature == pc.Feature
+	}
+	for _, id := range pc.LicenseIDs {
+		if id == l.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// capacity returns the number of slots advertised for the specified number of licenses.
+func (pc *PoolConfig) capacity(licenses int) int {
+	// The epsilon avoids losing a slot to rounding, like with 10 * 1.1.
+	return int(math.Floor(float64(licenses)*pc.Overcommit + 1e-9))
+}
+
+func poolSlotID(pool string, index int) string {
+	return fmt.Sprintf("%s%s:%d", poolSlotPrefix, pool, index)
+}
+
+// parsePoolSlotID returns the pool of a slot, and false if id is not a slot.
+func parsePoolSlotID(id string) (string, bool) {
+	if !strings.HasPrefix(id, poolSlotPrefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(id, poolSlotPrefix)
+	sep := strings.LastIndex(rest, ":")
+	if sep <= 0 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(rest[sep+1:]); err != nil {
+		return "", false
+	}
+	return rest[:sep], true
+}
+
+// poolState is the state of the licenses of a pool, from a snapshot.
+type poolState struct {
+	config *PoolConfig
+	// Licenses in the pool, sorted by ID.
+	licenses []*types.License
+	// Counts of licenses in each status.
+	counts map[string]int64
+}
+
+// held returns the number of licenses of the pool reserved or in use.
+func (ps *poolState) held() int {
+	return int(ps.counts["RESERVED"] + ps.counts["IN_USE"])
+}
+
+// splitPools assigns the licenses to the pools they belong to, the first
+// matching if more than one. Returns the state of each pool, in config
+// order, and the licenses in no pool.
+func splitPools(pools []*PoolConfig, licenses []*types.License) ([]*poolState, []*types.License) {
+	states := []*poolState{}
+	for _, pool := range pools {
+		states = append(states, &poolState{config: pool, counts: map[string]int64{}})
+	}
+
+	remaining := []*types.License{}
+nextLicense:
+	for _, l := range licenses {
+		for _, state := range states {
+			if state.config.contains(l) {
+				state.licenses = append(state.licenses, l)
+				state.counts[l.Status]++
+				continue nextLicense
+			}
+		}
+		remaining = append(remaining, l)
+	}
+	for _, state := range states {
+		sort.Slice(state.licenses, func(i, j int) bool {
+			return state.licenses[i].ID < state.licenses[j].ID
+		})
+	}
+	return states, remaining
+}
+
+// poolDeviceGroup returns the device group advertising the slots of a pool.
+//
+// Slots degrade as licenses are held: for each license reserved or in use, a
+// slot is reported unhealthy, so the group advertises how many more slots can
+// be reserved. The slots reserved on this node, listed in local, are the
+// first to be reported unhealthy, so the ones Nomad considers free stay
+// healthy.
+func poolDeviceGroup(state *poolState, local map[string]string) *device.DeviceGroup {
+	pool := state.config
+	capacity := pool.capacity(len(state.licenses))
+	held := state.held()
+	if held > capacity {
+		held = capacity
+	}
+
+	slots := []string{}
+	for i := 0; i < capacity; i++ {
+		slots = append(slots, poolSlotID(pool.Name, i))
+	}
+	unhealthy := map[string]bool{}
+	for _, slot := range slots {
+		if len(unhealthy) < held && local[slot] != "" {
+			unhealthy[slot] = true
+		}
+	}
+	for i := len(slots) - 1; i >= 0 && len(unhealthy) < held; i-- {
+		unhealthy[slots[i]] = true
+	}
+
+	group := &device.DeviceGroup{
+		Type:   "flexlm_license",
+		Vendor: pool.Vendor,
+		Name:   pool.Name,
+	}
+	for _, slot := range slots {
+		d := &device.Device{
+			ID:      slot,
+			Healthy: !unhealthy[slot],
+		}
+		if !d.Healthy {
+			d.HealthDesc = fmt.Sprintf("pool in use: %d of %d licenses held, %d slots", state.held(), len(state.licenses), capacity)
+		}
+		group.Devices = append(group.Devices, d)
+	}
+	return group
+}
+
+// poolStats returns the stats of the slots of a pool.
+//
+// The summary of each slot is the fraction of licenses in the pool held,
+// and its stats include the counts of licenses in the pool in each state,
+// the number of slots, and the time the state was fetched.
+func poolStats(state *poolState, snapshot *licenseSnapshot) *device.DeviceGroupStats {
+	pool := state.config
+	capacity := int64(pool.capacity(len(state.licenses)))
+	total := int64(len(state.licenses))
+	held := int64(state.held())
+	inUse, free, reserved := state.counts["IN_USE"], state.counts["FREE"], state.counts["RESERVED"]
+	lastUpdate := snapshot.updated.UTC().Format(time.RFC3339)
+
+	group := &device.DeviceGroupStats{
+		Type:          "flexlm_license",
+		Vendor:        pool.Vendor,
+		Name:          pool.Name,
+		InstanceStats: map[string]*device.DeviceStats{},
+	}
+	for i := 0; i < int(capacity); i++ {
+		group.InstanceStats[poolSlotID(pool.Name, i)] = &device.DeviceStats{
+			Summary: &structs.StatValue{
+				IntNumeratorVal:   &held,
+				IntDenominatorVal: &total,
+				Unit:              "licenses",
+				Desc:              "Licenses in the pool held",
+			},
+			Stats: &structs.StatObject{Attributes: map[string]*structs.StatValue{
+				"in_use":      {IntNumeratorVal: &inUse, Unit: "licenses", Desc: "Licenses in the pool in use"},
+				"free":        {IntNumeratorVal: &free, Unit: "licenses", Desc: "Licenses in the pool free"},
+				"reserved":    {IntNumeratorVal: &reserved, Unit: "licenses", Desc: "Licenses in the pool reserved, but not in use yet"},
+				"slots":       {IntNumeratorVal: &capacity, Unit: "slots", Desc: "Slots advertised for the pool, including the overcommitted ones"},
+				"last_update": {StringVal: &lastUpdate, Desc: "Time the license state was last fetched"},
+			}},
+			Timestamp: snapshot.updated,
+		}
+	}
+	return group
+}
+
+// resolveDevices translates the devices Nomad asked to reserve into licenses.
+//
+// Returns the licenses to reserve, and the licenses of overcommitted slots,
+// already held, to share without reserving them again. Both are to be
+// passed to the container. Also returns the license chosen for each slot.
+func (p *Plugin) resolveDevices(ctx context.Context, deviceIDs []string) ([]string, []string, map[string]string, error) {
+	reserve := []string{}
+	slots := []string{}
+	for _, id := range deviceIDs {
+		if _, ok := parsePoolSlotID(id); ok {
+			slots = append(slots, id)
+			continue
+		}
+		reserve = append(reserve, id)
+	}
+	if len(slots) == 0 {
+		return reserve, nil, nil, nil
+	}
+
+	if p.globalUpdater == nil {
+		return nil, nil, nil, fmt.Errorf("plugin is not configured: nil notifier")
+	}
+	licenses, err := p.globalUpdater.GetCurrent(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get global license state: %w", err)
+	}
+	states, _ := splitPools(p.pools, licenses)
+	byName := map[string]*poolState{}
+	for _, state := range states {
+		byName[state.config.Name] = state
+	}
+
+	// Number of slots sharing each license, to spread the overcommitted slots.
+	p.poolLock.Lock()
+	sharing := map[string]int{}
+	for _, id := range p.poolSlots {
+		sharing[id]++
+	}
+	p.poolLock.Unlock()
+
+	chosen := map[string]bool{}
+	for _, id := range reserve {
+		chosen[id] = true
+	}
+	shared := []string{}
+	assigned := map[string]string{}
+	for _, slot := range slots {
+		name, _ := parsePoolSlotID(slot)
+		state := byName[name]
+		if state == nil || len(state.licenses) == 0 {
+			return nil, nil, nil, fmt.Errorf("no licenses in pool %q for device %s", name, slot)
+		}
+
+		var license *types.License
+		for _, l := range state.licenses {
+			if l.Status == "FREE" && !chosen[l.ID] {
+				license = l
+				break
+			}
+		}
+		if license != nil {
+			reserve = append(reserve, license.ID)
+		} else {
+			// All the licenses are held, the slot is an overcommitted one.
+			for _, l := range state.licenses {
+				if license == nil || sharing[l.ID] < sharing[license.ID] {
+					license = l
+				}
+			}
+			shared = append(shared, license.ID)
+		}
+		chosen[license.ID] = true
+		sharing[license.ID]++
+		assigned[slot] = license.ID
+	}
+	return reserve, shared, assigned, nil
+}
+
+// assignSlots records the licenses chosen for the slots reserved on this node.
+func (p *Plugin) assignSlots(assigned map[string]string) {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+
+	if p.poolSlots == nil {
+		p.poolSlots = map[string]string{}
+	}
+	for slot, id := range assigned {
+		p.poolSlots[slot] = id
+	}
+}
+
+// localSlots returns the slots reserved on this node whose license is still
+// held, forgetting the others.
+func (p *Plugin) localSlots(licenses []*types.License) map[string]string {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+
+	free := map[string]bool{}
+	for _, l := range licenses {
+		if l.Status == "FREE" {
+			free[l.ID] = true
+		}
+	}
+	local := map[string]string{}
+	for slot, id := range p.poolSlots {
+		if free[id] {
+			delete(p.poolSlots, slot)
+			continue
+		}
+		local[slot] = id
+	}
+	return local
+}
@@ -0,0 +1,192 @@
+package licensedevice
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+	"github.com/System233/enkit/lib/str"
+)
+
+// poolLicenses returns the licenses of a feature, with the specified statuses.
+func poolLicenses(feature string, statuses ...string) []*types.License {
+	licenses := []*types.License{}
+	for i, status := range statuses {
+		l := &types.License{
+			ID:      feature + "-" + string(rune('a'+i)),
+			Vendor:  "xilinx",
+			Feature: feature,
+			Status:  status,
+		}
+		if status != "FREE" {
+			l.UserNode = str.Pointer("node-1234")
+		}
+		licenses = append(licenses, l)
+	}
+	return licenses
+}
+
+func TestValidatePools(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		pools    []*PoolConfig
+		wantErr  string
+		wantPool *PoolConfig
+	}{
+		{
+			desc:     "defaults",
+			pools:    []*PoolConfig{{Vendor: "xilinx", Feature: "vivado"}},
+			wantPool: &PoolConfig{Name: "vivado", Vendor: "xilinx", Feature: "vivado", Overcommit: 1},
+		},
+		{
+			desc:     "license ids",
+			pools:    []*PoolConfig{{Name: "any", Vendor: "xilinx", LicenseIDs: []string{"a", "b"}, Overcommit: 1.2}},
+			wantPool: &PoolConfig{Name: "any", Vendor: "xilinx", LicenseIDs: []string{"a", "b"}, Overcommit: 1.2},
+		},
+		{
+			desc:    "no vendor",
+			pools:   []*PoolConfig{{Feature: "vivado"}},
+			wantErr: "vendor is required",
+		},
+		{
+			desc:    "no licenses",
+			pools:   []*PoolConfig{{Name: "any", Vendor: "xilinx"}},
+			wantErr: "one of feature or license_ids is required",
+		},
+		{
+			desc:    "invalid name",
+			pools:   []*PoolConfig{{Name: "a:b", Vendor: "xilinx", Feature: "vivado"}},
+			wantErr: `invalid name "a:b"`,
+		},
+		{
+			desc: "duplicate name",
+			pools: []*PoolConfig{
+				{Vendor: "xilinx", Feature: "vivado"},
+				{Name: "vivado", Vendor: "xilinx", LicenseIDs: []string{"a"}},
+			},
+			wantErr: `duplicate name "vivado"`,
+		},
+		{
+			desc:    "negative overcommit",
+			pools:   []*PoolConfig{{Vendor: "xilinx", Feature: "vivado", Overcommit: -1}},
+			wantErr: "invalid overcommit",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotErr := validatePools(tc.pools)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, gotErr, tc.wantErr)
+				return
+			}
+			assert.NoError(t, gotErr)
+			assert.Equal(t, tc.wantPool, tc.pools[0])
+		})
+	}
+}
+
+func TestParsePoolSlotID(t *testing.T) {
+	pool, ok := parsePoolSlotID(poolSlotID("vivado", 3))
+	assert.True(t, ok)
+	assert.Equal(t, "vivado", pool)
+
+	for _, id := range []string{"aaaa", "pool:vivado", "pool::1", "pool:vivado:x"} {
+		_, ok := parsePoolSlotID(id)
+		assert.False(t, ok, id)
+	}
+}
+
+// healthySlots returns the IDs of the healthy devices, and the number of devices.
+func healthySlots(group *device.DeviceGroup) ([]string, int) {
+	healthy := []string{}
+	for _, d := range group.Devices {
+		if d.Healthy {
+			healthy = append(healthy, d.ID)
+		}
+	}
+	return healthy, len(group.Devices)
+}
+
+func TestPoolDeviceGroups(t *testing.T) {
+	p := NewPlugin()
+	p.pools = []*PoolConfig{
+		{Name: "vivado", Vendor: "xilinx", Feature: "vivado", Overcommit: 1.2},
+		{Name: "sim", Vendor: "xilinx", LicenseIDs: []string{"questa-a", "modelsim-a"}, Overcommit: 1},
+	}
+
+	licenses := append(poolLicenses("vivado", "FREE", "IN_USE", "FREE", "RESERVED", "FREE"), poolLicenses("questa", "IN_USE")...)
+	licenses = append(licenses, poolLicenses("modelsim", "FREE", "FREE")...)
+
+	groups, err := p.deviceGroups(licenses)
+	assert.NoError(t, err)
+	if !assert.Len(t, groups, 3) {
+		return
+	}
+
+	// Licenses in no pool are advertised as usual.
+	assert.Equal(t, "modelsim", groups[0].Name)
+	assert.Equal(t, []*device.Device{{ID: "modelsim-b", Healthy: true}}, groups[0].Devices)
+
+	// Each held license makes a slot unhealthy, the last ones first.
+	assert.Equal(t, "sim", groups[1].Name)
+	healthy, total := healthySlots(groups[1])
+	assert.Equal(t, []string{"pool:sim:0"}, healthy)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "pool in use: 1 of 2 licenses held, 2 slots", groups[1].Devices[1].HealthDesc)
+
+	// 5 licenses overcommitted by 20% are 6 slots.
+	assert.Equal(t, "vivado", groups[2].Name)
+	healthy, total = healthySlots(groups[2])
+	assert.Equal(t, []string{"pool:vivado:0", "pool:vivado:1", "pool:vivado:2", "pool:vivado:3"}, healthy)
+	assert.Equal(t, 6, total)
+
+	// Slots reserved on this node are the first to be reported unhealthy,
+	// while slots whose license was freed are forgotten.
+	p.assignSlots(map[string]string{"pool:vivado:1": "vivado-b", "pool:vivado:2": "vivado-c"})
+	groups, err = p.deviceGroups(licenses)
+	assert.NoError(t, err)
+	healthy, _ = healthySlots(groups[2])
+	assert.Equal(t, []string{"pool:vivado:0", "pool:vivado:2", "pool:vivado:3", "pool:vivado:4"}, healthy)
+	assert.Equal(t, map[string]string{"pool:vivado:1": "vivado-b"}, p.poolSlots)
+}
+
+func TestReservePool(t *testing.T) {
+	reserver := &mockReserver{}
+	notifier := &mockNotifier{}
+
+	p := NewPlugin()
+	p.nodeID = "client_a"
+	p.reserver = reserver
+	p.globalUpdater = notifier
+	p.licenseHandleRoot = t.TempDir()
+	p.pools = []*PoolConfig{{Name: "vivado", Vendor: "xilinx", Feature: "vivado", Overcommit: 1.5}}
+
+	notifier.On("GetCurrent").Return(poolLicenses("vivado", "IN_USE", "FREE", "FREE"), nil).Once()
+	reserver.On("Reserve", mock.Anything, []string{"aaaa", "vivado-b", "vivado-c"}, "client_a").Return([]*types.License{
+		{ID: "aaaa", Status: "RESERVED"},
+		{ID: "vivado-b", Status: "RESERVED"},
+		{ID: "vivado-c", Status: "RESERVED"},
+	}, nil).Once()
+
+	// Slots are translated into free licenses of the pool.
+	got, err := p.Reserve([]string{"aaaa", "pool:vivado:0", "pool:vivado:1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "aaaa,vivado-b,vivado-c", got.Envs["LICENSEPLUGIN_RESERVED_IDS"])
+	assert.Equal(t, map[string]string{"pool:vivado:0": "vivado-b", "pool:vivado:1": "vivado-c"}, p.poolSlots)
+
+	// Once all the licenses are held, overcommitted slots share the license
+	// shared by the fewest slots, without reserving it again.
+	notifier.On("GetCurrent").Return(poolLicenses("vivado", "IN_USE", "RESERVED", "RESERVED"), nil)
+	got, err = p.Reserve([]string{"pool:vivado:3"})
+	assert.NoError(t, err)
+	assert.Equal(t, "vivado-a", got.Envs["LICENSEPLUGIN_RESERVED_IDS"])
+	assert.FileExists(t, filepath.Join(p.licenseHandleRoot, "vivado-a"))
+	reserver.AssertExpectations(t)
+
+	_, err = p.Reserve([]string{"pool:questa:0"})
+	assert.ErrorContains(t, err, `no licenses in pool "questa"`)
+}
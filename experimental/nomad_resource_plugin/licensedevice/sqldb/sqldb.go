@@ -3,6 +3,7 @@ package sqldb
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -15,12 +16,14 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/System233/enkit/experimental/nomad_resource_plugin/licensedevice/types"
+	"github.com/System233/enkit/lib/retry"
 )
 
 const (
 	QueryAllLicenses      = "SELECT id, vendor, feature, usage_state, last_state_change, reserved_by_node, used_by_process FROM license_state"
 	queryLocalLicenses    = "SELECT id, vendor, feature, usage_state, last_state_change, reserved_by_node, used_by_process FROM license_state WHERE usage_state = 'IN_USE' AND reserved_by_node = $1"
 	querySingleLicense    = "SELECT id, vendor, feature, usage_state, last_state_change, reserved_by_node, used_by_process FROM license_state WHERE id = $1"
+	lockSingleLicense     = "SELECT id, vendor, feature, usage_state, last_state_change, reserved_by_node, used_by_process FROM license_state WHERE id = $1 FOR UPDATE"
 	updateLicenseState    = "UPDATE license_state SET usage_state = $2, last_state_change = $3, reserved_by_node = $4, used_by_process = $5 WHERE id = $1"
 	appendLicenseStateLog = "INSERT INTO license_state_log (license_id, node, ts, previous_state, current_state, reason, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7)"
 	listenLicenseState    = "LISTEN license_state_update_channel"
@@ -29,6 +32,11 @@ const (
 	StateFree     = "FREE"
 	stateReserved = "RESERVED"
 	stateInUse    = "IN_USE"
+
+	// Wait before the first attempt to listen for license state updates again, doubled at every failure.
+	listenMinBackoff = time.Second
+	// Maximum wait between attempts to listen for license state updates.
+	listenMaxBackoff = time.Minute
 )
 
 var (
@@ -60,6 +68,11 @@ type Table struct {
 	db        *pgxpool.Pool
 	tableName string
 	nodeID    string
+
+	// Protects listenErr.
+	listenLock sync.Mutex
+	// Error that broke the connection listening for updates, nil while listening.
+	listenErr error
 }
 
 func OpenTable(ctx context.Context, connStr string, table string, nodeID string) (*Table, error) {
@@ -216,6 +229,64 @@ nextLicense:
 	return nil
 }
 
+func (t *Table) Release(ctx context.Context, licenseIDs []string, node string) (ret []*types.License, retErr error) {
+	tx, err := t.db.Begin(ctx)
+	if err != nil {
+		metricSqlCounter.WithLabelValues("Release", "error_db_begin").Inc()
+		return nil, fmt.Errorf("failed to start DB transaction: %w", err)
+	}
+
+	defer func() {
+		// Handle the transaction commit/rollback here in one place, by hooking the
+		// end of the function and checking the error being returned. An error means
+		// roll back; no error means commit.
+
+		// If rolling back, this could be due to a cancelled context. In this case,
+		// we can't use the context to rollback the transaction, so make a new
+		// ephemeral one from the background context.
+		shortCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if retErr != nil {
+			if err := tx.Rollback(shortCtx); err != nil {
+				metricSqlCounter.WithLabelValues("Release", "error_rollback").Inc()
+				slog.Error("Error, failed to rollback", "original_error", retErr, "rollback_error", err)
+			}
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			retErr = fmt.Errorf("failed to commit DB changes: %w", err)
+			metricSqlCounter.WithLabelValues("Release", "error_commit").Inc()
+			slog.Error("Error, failed to commit in Release", "commit_error", retErr)
+			ret = nil
+		} else {
+			metricSqlCounter.WithLabelValues("Release", "ok").Inc()
+		}
+	}()
+
+	// Lock the rows, so a license cannot be used or reserved again between
+	// checking its state and freeing it.
+	licenses := []*types.License{}
+	for _, id := range licenseIDs {
+		row := tx.QueryRow(ctx, lockSingleLicense, id)
+		l := &types.License{}
+		if err := row.Scan(&l.ID, &l.Vendor, &l.Feature, &l.Status, &l.LastUpdateTime, &l.UserNode, &l.UserProcess); err != nil {
+			metricSqlCounter.WithLabelValues("Release", "error_scan").Inc()
+			return nil, fmt.Errorf("failed to get current state of license %q: %w", id, err)
+		}
+		if l.Status != stateReserved || l.UserNode == nil || *l.UserNode != node {
+			continue
+		}
+		l.UserNode = nil
+		l.UserProcess = nil
+		l.Status = StateFree
+		licenses = append(licenses, l)
+	}
+
+	return t.updateLicenses(ctx, tx, licenses, "reservation expired without the license being used")
+}
+
 func (t *Table) getLicenses(ctx context.Context, tx pgx.Tx) ([]*types.License, error) {
 	rows, err := tx.Query(ctx, queryLocalLicenses, t.nodeID)
 	if err != nil {
@@ -309,23 +380,77 @@ nextLicense:
 	return ret, nil
 }
 
+// Healthy returns the error that broke the connection listening for license
+// state updates, or nil if listening.
+func (t *Table) Healthy() error {
+	t.listenLock.Lock()
+	defer t.listenLock.Unlock()
+	return t.listenErr
+}
+
+func (t *Table) setListenErr(err error) {
+	t.listenLock.Lock()
+	defer t.listenLock.Unlock()
+	t.listenErr = err
+}
+
+// Chan returns a channel notified every time the license state changes.
+//
+// The connection listening for changes is re-established with exponential
+// backoff if lost. Changes made while disconnected are never notified, so a
+// notification is also sent every time the connection is established, to
+// force a resync.
 func (t *Table) Chan(ctx context.Context) chan struct{} {
 	c := make(chan struct{})
+	backoff := retry.New(
+		retry.WithWait(listenMinBackoff),
+		retry.WithBackoff(listenMaxBackoff),
+		retry.WithJitter(retry.JitterEqual),
+	)
 
 	go func() {
-		var err error
-		var conn *pgxpool.Conn = nil
-		for {
+		var conn *pgxpool.Conn
+		failures := 0
+		// Records the error, and waits before trying to listen again. Returns false if ctx is done.
+		retryAfter := func(err error) bool {
+			t.setListenErr(err)
+			if conn != nil {
+				conn.Release()
+				conn = nil
+			}
+			delay := backoff.AttemptDelay(failures)
+			failures++
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(delay):
+				return true
+			}
+		}
+		notify := func() bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case c <- struct{}{}:
+				return true
+			}
+		}
+		defer func() {
+			if conn != nil {
+				conn.Release()
+			}
+		}()
+
+		for ctx.Err() == nil {
 			if conn == nil {
+				var err error
 				conn, err = t.db.Acquire(ctx)
 				if err != nil {
 					slog.Error("Error, failed to db Acquire", "db_error", err)
 					metricSqlCounter.WithLabelValues("Chan", "error_acquire_db").Inc()
-					if conn != nil {
-						conn.Release()
-						conn = nil
+					if !retryAfter(fmt.Errorf("failed to connect to DB: %w", err)) {
+						return
 					}
-					time.Sleep(time.Second * 10)
 					continue // try to acquire again
 				}
 
@@ -333,21 +458,38 @@ func (t *Table) Chan(ctx context.Context) chan struct{} {
 				if err != nil {
 					slog.Error("Error, failed to listenLicenseState", "db_error", err)
 					metricSqlCounter.WithLabelValues("Chan", "error_exec_listen_license_state").Inc()
-					conn.Release()
-					conn = nil
-					time.Sleep(time.Second * 10)
+					if !retryAfter(fmt.Errorf("failed to listen for license state updates: %w", err)) {
+						return
+					}
 					continue // try to acquire again
 				}
+
+				if failures > 0 {
+					slog.Info("listening for license state updates again", "failures", failures)
+					metricSqlCounter.WithLabelValues("Chan", "reconnected").Inc()
+				}
+				failures = 0
+				t.setListenErr(nil)
+				// Force a resync, updates may have been missed while not listening.
+				if !notify() {
+					return
+				}
 			}
-			_, err = conn.Conn().WaitForNotification(ctx)
+			_, err := conn.Conn().WaitForNotification(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("Error, lost connection listening for license state updates", "db_error", err)
 				metricSqlCounter.WithLabelValues("Chan", "retry_wait_for_notification").Inc()
-				conn.Release()
-				conn = nil
-				time.Sleep(time.Second * 5)
+				if !retryAfter(fmt.Errorf("lost connection listening for license state updates: %w", err)) {
+					return
+				}
 				continue // try to acquire again
 			}
-			c <- struct{}{}
+			if !notify() {
+				return
+			}
 		}
 	}()
 	metricSqlCounter.WithLabelValues("Chan", "ok").Inc()
@@ -73,6 +73,11 @@ type Reserver interface {
 	Reserve(ctx context.Context, licenseIDs []string, node string) ([]*License, error)
 
 	UpdateInUse(ctx context.Context, licenses []*License) error
+
+	// Release frees the licenses that are still RESERVED by node, leaving
+	// licenses in any other state, or reserved by other nodes, untouched.
+	// Returns the licenses actually freed.
+	Release(ctx context.Context, licenseIDs []string, node string) ([]*License, error)
 }
 
 type Notifier interface {
@@ -80,3 +85,10 @@ type Notifier interface {
 
 	Chan(ctx context.Context) chan struct{}
 }
+
+// HealthReporter is implemented by the Notifiers that can tell if their
+// backing store is reachable.
+type HealthReporter interface {
+	// Healthy returns why the backing store is unreachable, or nil if reachable.
+	Healthy() error
+}
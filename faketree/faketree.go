@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -11,6 +12,8 @@ import (
 	"syscall"
 
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -62,6 +65,178 @@ func (es ExitStatus) ExitCode() int {
 	return int(es)
 }
 
+// Reap policies, as accepted by --reap-policy.
+const (
+	// Wait for all children, send them SIGTERM and SIGKILL as configured.
+	ReapWaitAll = "wait-all"
+	// Like wait-all, but processes matching a --detach expression are not
+	// signaled or waited for.
+	ReapDetachNamed = "detach-named"
+	// Send SIGKILL to all children as soon as the main child terminates.
+	ReapKillAllNow = "kill-all-now"
+)
+
+var kReapPolicies = []string{ReapWaitAll, ReapDetachNamed, ReapKillAllNow}
+
+// How often to check if only detached processes are left.
+const kReapPollInterval = 100 * time.Millisecond
+
+// ReapPolicy defines what to do with the children left once the main child terminates.
+type ReapPolicy struct {
+	// One of the Reap* constants.
+	Name string
+	// With ReapDetachNamed, processes with a command line matching any of these
+	// expressions, and their descendants, are left running.
+	Detach []*regexp.Regexp
+
+	// Directory where proc is mounted.
+	proc string
+}
+
+// NewReapPolicy returns a ReapPolicy from the name of the policy, and the expressions of the processes to detach.
+func NewReapPolicy(name string, detach []string) (*ReapPolicy, error) {
+	policy := &ReapPolicy{Name: name, proc: "/proc"}
+	switch name {
+	case ReapWaitAll, ReapKillAllNow:
+		if len(detach) > 0 {
+			return nil, fmt.Errorf("--detach can only be used with --reap-policy=%s", ReapDetachNamed)
+		}
+	case ReapDetachNamed:
+		if len(detach) == 0 {
+			return nil, fmt.Errorf("--reap-policy=%s requires at least one --detach expression", ReapDetachNamed)
+		}
+	default:
+		return nil, fmt.Errorf("invalid reap policy %q - must be one of %s", name, strings.Join(kReapPolicies, ", "))
+	}
+
+	for _, expr := range detach {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --detach expression %q - %w", expr, err)
+		}
+		policy.Detach = append(policy.Detach, re)
+	}
+	return policy, nil
+}
+
+// Process is a process spawned, directly or indirectly, by faketree.
+type Process struct {
+	Pid, Ppid int
+	// Command line of the process, with arguments separated by spaces.
+	Cmdline string
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("pid %d (%s)", p.Pid, p.Cmdline)
+}
+
+// Descendants returns the processes descending from pid, by walking the proc file system.
+//
+// When faketree runs as pid==1 of a namespace, those are all the processes in the namespace.
+func Descendants(proc string, pid int) ([]Process, error) {
+	entries, err := os.ReadDir(proc)
+	if err != nil {
+		return nil, err
+	}
+
+	all := map[int]Process{}
+	for _, entry := range entries {
+		cpid, err := strconv.Atoi(entry.Name())
+		if err != nil || cpid == pid {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join(proc, entry.Name(), "stat"))
+		if err != nil {
+			// Processes may terminate while the directory is being read.
+			continue
+		}
+		// Format is "pid (comm) state ppid ...", comm can contain spaces and parens.
+		closed := strings.LastIndexByte(string(stat), ')')
+		opened := strings.IndexByte(string(stat), '(')
+		fields := strings.Fields(string(stat[closed+1:]))
+		if opened < 0 || closed < opened || len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		cmdline, _ := os.ReadFile(filepath.Join(proc, entry.Name(), "cmdline"))
+		process := Process{Pid: cpid, Ppid: ppid, Cmdline: strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))}
+		if process.Cmdline == "" {
+			// Kernel threads and zombies have no command line.
+			process.Cmdline = "[" + string(stat[opened+1:closed]) + "]"
+		}
+		all[cpid] = process
+	}
+
+	var descendants []Process
+	for _, process := range all {
+		for parent, found := process.Ppid, true; found; parent = all[parent].Ppid {
+			if parent == pid {
+				descendants = append(descendants, process)
+				break
+			}
+			_, found = all[parent]
+		}
+	}
+	sort.Slice(descendants, func(i, j int) bool { return descendants[i].Pid < descendants[j].Pid })
+	return descendants, nil
+}
+
+// Split separates the descendants of faketree that are detached according to the policy from the others.
+//
+// A process is detached if its command line matches one of the Detach
+// expressions, or if it descends from a detached process.
+func (rp *ReapPolicy) Split() (detached []Process, others []Process, err error) {
+	processes, err := Descendants(rp.proc, os.Getpid())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byPid := map[int]Process{}
+	for _, process := range processes {
+		byPid[process.Pid] = process
+	}
+	matches := func(process Process) bool {
+		for _, re := range rp.Detach {
+			if re.MatchString(process.Cmdline) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, process := range processes {
+		isDetached := false
+		for current, found := process, true; found; current, found = byPid[current.Ppid] {
+			if matches(current) {
+				isDetached = true
+				break
+			}
+		}
+		if isDetached {
+			detached = append(detached, process)
+		} else {
+			others = append(others, process)
+		}
+	}
+	return detached, others, nil
+}
+
+// Signal sends the signal to all the descendants of faketree that are not detached.
+func (rp *ReapPolicy) Signal(signal syscall.Signal) error {
+	_, others, err := rp.Split()
+	if err != nil {
+		return err
+	}
+	for _, process := range others {
+		syscall.Kill(process.Pid, signal)
+	}
+	return nil
+}
+
 // WaitChildren waits for all children of this process to die.
 //
 // If invoked from a normal process, it will only wait for direct children.
@@ -72,7 +247,11 @@ func (es ExitStatus) ExitCode() int {
 //
 // If timeout is specified, it will send SIGKILL itself to all children left
 // after timeout time has passed after the main process has terminated.
-func WaitChildren(timeout time.Duration, process *os.Process, termOnWait bool) error {
+//
+// The policy decides which children are signaled and waited for, nil is
+// the same as ReapWaitAll. With ReapDetachNamed, WaitChildren returns as soon
+// as only detached processes are left, and returns them.
+func WaitChildren(timeout time.Duration, process *os.Process, termOnWait bool, policy *ReapPolicy) ([]Process, error) {
 	// Wait4 will fail with ECHILD if there are no children left.
 	// If no children are left it means that the process we spawned
 	// has completed, so let's return the status of that child.
@@ -87,16 +266,33 @@ func WaitChildren(timeout time.Duration, process *os.Process, termOnWait bool) e
 		}
 		return err
 	}
+	if policy == nil {
+		policy = &ReapPolicy{Name: ReapWaitAll, proc: "/proc"}
+	}
 
+	// Once the main child has died, detached processes may be left running
+	// forever: poll instead of blocking until a child terminates.
+	options := 0
 	for {
 		var status syscall.WaitStatus
 		var rusage syscall.Rusage
 
 		// Wait for "any process that is our responsibility (-1)" to finish.
 		// (we are guaranteed at least one process was spawned, process)
-		pid, err := syscall.Wait4(-1, &status, 0, &rusage)
+		pid, err := syscall.Wait4(-1, &status, options, &rusage)
 		if err != nil {
-			return childerr(err)
+			return nil, childerr(err)
+		}
+		if pid == 0 {
+			detached, others, err := policy.Split()
+			if err != nil {
+				return nil, err
+			}
+			if len(others) == 0 {
+				return detached, perr
+			}
+			time.Sleep(kReapPollInterval)
+			continue
 		}
 
 		// If pid == 0, with no error, it means there are more porcesses
@@ -117,30 +313,50 @@ func WaitChildren(timeout time.Duration, process *os.Process, termOnWait bool) e
 					perr = ExitStatus(status)
 				}
 
-				// The main child of faketree has died.
-				//
-				// It should have taken care of its own
-				// children, but if it didn't, it's probably a
-				// good idea to ask them nicely to terminate.
-				//
-				// The timeout below won't be as nice.
-				//
-				// This path is hit commonly when the main
-				// process completes succesfully (job control
-				// system does not send SIGTERM) but children
-				// are left around.
-				if termOnWait {
-					syscall.Kill(-1, syscall.SIGTERM)
-				}
-
-				if timeout != 0 {
-					// goroutine will die if the process completes
-					// before the timeout.
-					go func() {
-						time.Sleep(timeout)
-						// kill all children (-1) in the namespace.
-						syscall.Kill(-1, syscall.SIGKILL)
-					}()
+				switch policy.Name {
+				case ReapKillAllNow:
+					// No mercy, all children are killed right away.
+					policy.Signal(syscall.SIGKILL)
+
+				case ReapDetachNamed:
+					// Same as below, but sparing the detached processes.
+					if termOnWait {
+						policy.Signal(syscall.SIGTERM)
+					}
+					if timeout != 0 {
+						go func() {
+							time.Sleep(timeout)
+							policy.Signal(syscall.SIGKILL)
+						}()
+					}
+					options = syscall.WNOHANG
+
+				default:
+					// The main child of faketree has died.
+					//
+					// It should have taken care of its own
+					// children, but if it didn't, it's probably a
+					// good idea to ask them nicely to terminate.
+					//
+					// The timeout below won't be as nice.
+					//
+					// This path is hit commonly when the main
+					// process completes succesfully (job control
+					// system does not send SIGTERM) but children
+					// are left around.
+					if termOnWait {
+						syscall.Kill(-1, syscall.SIGTERM)
+					}
+
+					if timeout != 0 {
+						// goroutine will die if the process completes
+						// before the timeout.
+						go func() {
+							time.Sleep(timeout)
+							// kill all children (-1) in the namespace.
+							syscall.Kill(-1, syscall.SIGKILL)
+						}()
+					}
 				}
 			}
 
@@ -148,11 +364,181 @@ func WaitChildren(timeout time.Duration, process *os.Process, termOnWait bool) e
 			// also collect the status code.
 			pid, err = syscall.Wait4(-1, &status, syscall.WNOHANG, &rusage)
 			if err != nil {
-				return childerr(err)
+				return nil, childerr(err)
 			}
 		}
 	}
-	return perr
+}
+
+// Kinds of assertions, as accepted by --assert kind:value.
+const (
+	// The path is a mount point.
+	AssertMount = "mount"
+	// The path is on a read only mount.
+	AssertReadOnly = "readonly"
+	// The command runs with this uid.
+	AssertUid = "uid"
+	// The path exists.
+	AssertExists = "exists"
+)
+
+var kAssertKinds = []string{AssertMount, AssertReadOnly, AssertUid, AssertExists}
+
+// File listing the mounts visible to the process, checked by assertions.
+const kMountInfo = "/proc/self/mountinfo"
+
+// Assertion is a check on the environment set up by faketree, verified right
+// before the command is run.
+type Assertion struct {
+	// One of the Assert* constants.
+	Kind string
+	// Path, or uid for AssertUid.
+	Value string
+}
+
+// NewAssertion parses an assertion in kind:value format, like "readonly:/etc".
+//
+// A username passed to uid: is converted to a numeric uid, as the name may
+// no longer resolve once the environment is set up.
+func NewAssertion(assertion string) (Assertion, error) {
+	kind, value, found := strings.Cut(assertion, ":")
+	if !found || value == "" {
+		return Assertion{}, fmt.Errorf("invalid assertion %q - format is 'kind:value', with kind one of %s", assertion, strings.Join(kAssertKinds, ", "))
+	}
+
+	switch kind {
+	case AssertMount, AssertReadOnly, AssertExists:
+		if !filepath.IsAbs(value) {
+			return Assertion{}, fmt.Errorf("invalid assertion %q - path must be absolute", assertion)
+		}
+	case AssertUid:
+		uid, _, err := ParseOrLookupUser(value)
+		if err != nil {
+			return Assertion{}, fmt.Errorf("invalid assertion %q - %w", assertion, err)
+		}
+		value = strconv.Itoa(uid)
+	default:
+		return Assertion{}, fmt.Errorf("invalid assertion %q - unknown kind %q, must be one of %s", assertion, kind, strings.Join(kAssertKinds, ", "))
+	}
+	return Assertion{Kind: kind, Value: value}, nil
+}
+
+func (a Assertion) String() string {
+	return a.Kind + ":" + a.Value
+}
+
+// Mount is a file system mounted, as listed in /proc/self/mountinfo.
+type Mount struct {
+	Point    string
+	ReadOnly bool
+}
+
+// ReadMounts parses a file in the format of /proc/self/mountinfo.
+func ReadMounts(mountinfo string) ([]Mount, error) {
+	data, err := os.ReadFile(mountinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Spaces, tabs, new lines and backslashes in paths are escaped as octal.
+	unescape := func(field string) string {
+		if !strings.Contains(field, `\`) {
+			return field
+		}
+		unquoted, err := strconv.Unquote(`"` + field + `"`)
+		if err != nil {
+			return field
+		}
+		return unquoted
+	}
+	hasRo := func(options string) bool {
+		for _, option := range strings.Split(options, ",") {
+			if option == "ro" {
+				return true
+			}
+		}
+		return false
+	}
+
+	var mounts []Mount
+	for _, line := range strings.Split(string(data), "\n") {
+		// Format is "id parent major:minor root point options [optional...] - type source super-options".
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		mount := Mount{Point: unescape(fields[4]), ReadOnly: hasRo(fields[5])}
+		for ix := 6; ix < len(fields); ix++ {
+			if fields[ix] == "-" && ix+3 < len(fields) {
+				mount.ReadOnly = mount.ReadOnly || hasRo(fields[ix+3])
+				break
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// MountOf returns the mount the path is on: the most recent mount with the longest mount point prefix of path.
+func MountOf(mounts []Mount, path string) *Mount {
+	var found *Mount
+	for ix := range mounts {
+		mount := &mounts[ix]
+		if path != mount.Point && mount.Point != "/" && !strings.HasPrefix(path, mount.Point+"/") {
+			continue
+		}
+		if found == nil || len(mount.Point) >= len(found.Point) {
+			found = mount
+		}
+	}
+	return found
+}
+
+// Check returns an error if the assertion does not hold, with the mounts listed in mountinfo.
+func (a Assertion) Check(mountinfo string) error {
+	if a.Kind == AssertUid {
+		if uid := strconv.Itoa(os.Getuid()); uid != a.Value {
+			return fmt.Errorf("running as uid %s", uid)
+		}
+		return nil
+	}
+
+	path, err := RealPath(a.Value)
+	if err != nil {
+		return err
+	}
+	if a.Kind == AssertExists {
+		return nil
+	}
+
+	mounts, err := ReadMounts(mountinfo)
+	if err != nil {
+		return fmt.Errorf("could not read mounts - %w", err)
+	}
+	mount := MountOf(mounts, path)
+	switch {
+	case mount == nil:
+		return fmt.Errorf("%s is not on any mount", path)
+	case a.Kind == AssertMount && mount.Point != path:
+		return fmt.Errorf("%s is not a mount point, it is on mount %s", path, mount.Point)
+	case a.Kind == AssertReadOnly && !mount.ReadOnly:
+		return fmt.Errorf("%s is on mount %s, which is writable", path, mount.Point)
+	}
+	return nil
+}
+
+// CheckAssertions verifies all the assertions, reporting each failure to w.
+//
+// Returns an error if any assertion failed.
+func CheckAssertions(w io.Writer, assertions []Assertion, mountinfo string) error {
+	var errs []error
+	for _, assertion := range assertions {
+		if err := assertion.Check(mountinfo); err != nil {
+			fmt.Fprintf(w, "faketree: assertion %s FAILED - %s\n", assertion, err)
+			errs = append(errs, fmt.Errorf("assertion %s - %w", assertion, err))
+		}
+	}
+	return multierror.New(errs)
 }
 
 func (mf *MountFlags) Mount() error {
@@ -346,9 +732,12 @@ type Flags struct {
 	Propagate  bool
 	TermOnWait bool
 	Timeout    time.Duration
+	ReapPolicy string
+	Detach     []string
 
 	Uid, Gid int
 	Mount    []MountFlags
+	Assert   []Assertion
 }
 
 // Args turns the content of the Flags object into a set of command line flags.
@@ -396,10 +785,19 @@ func (opts *Flags) Args() []string {
 	if opts.Timeout != kDefaultTimeout {
 		args = append(args, "--wait-timeout", opts.Timeout.String())
 	}
+	if opts.ReapPolicy != ReapWaitAll {
+		args = append(args, "--reap-policy", opts.ReapPolicy)
+	}
+	for _, detach := range opts.Detach {
+		args = append(args, "--detach", detach)
+	}
 
 	for _, mount := range opts.Mount {
 		args = append(args, "--mount", mount.String())
 	}
+	for _, assertion := range opts.Assert {
+		args = append(args, "--assert", assertion.String())
+	}
 	return args
 }
 
@@ -492,6 +890,7 @@ func NewFlags() *Flags {
 		TermOnWait: true,
 		Propagate:  true,
 		Timeout:    kDefaultTimeout,
+		ReapPolicy: ReapWaitAll,
 	}
 
 	// Realpath may fail due to how procfs is mounted.
@@ -531,6 +930,11 @@ func (opts *Flags) Parse(argv []string) ([]string, error) {
 	fs.DurationVar(&opts.Timeout, "wait-timeout", opts.Timeout,
 		"If wait is enabled, defines how long to wait at most for non-direct child processes to terminate. "+
 			"SIGKILL will be sent once timer expires. See help screen for more details, set to 0 to disable.")
+	fs.StringVar(&opts.ReapPolicy, "reap-policy", opts.ReapPolicy,
+		"If wait is enabled, what to do with the children left once the main command terminates. "+
+			"One of "+strings.Join(kReapPolicies, ", ")+". See help screen for more details.")
+	fs.StringArrayVar(&opts.Detach, "detach", opts.Detach,
+		"With --reap-policy="+ReapDetachNamed+", regular expression matching the command line of processes to leave running.")
 
 	fs.StringVar(&opts.Hostname, "hostname", opts.Hostname, "Make the command believe it is running on a different host name")
 	fs.StringVar(&opts.Chdir, "chdir", opts.Chdir, "Change the current workingn directory to the one specified")
@@ -548,10 +952,18 @@ func (opts *Flags) Parse(argv []string) ([]string, error) {
 	fs.StringArrayVar(&mounts, "mount", nil, "Override the layout of the filesystem to have the specified directories mounted. "+
 		"Syntax is: --mount path:destination:[options[,type=type]?[,data=...]?]?.")
 
+	var asserts []string
+	fs.StringArrayVar(&asserts, "assert", nil, "Before running the command, verify the environment, and fail if the assertion does not hold. "+
+		"Syntax is: --assert kind:value, with kind one of "+strings.Join(kAssertKinds, ", ")+". See help screen for more details.")
+
 	if err := fs.Parse(argv); err != nil {
 		return nil, err
 	}
 
+	if _, err := NewReapPolicy(opts.ReapPolicy, opts.Detach); err != nil {
+		return nil, err
+	}
+
 	for _, mount := range mounts {
 		m, err := NewMountFlags(mount)
 		if err != nil {
@@ -559,6 +971,13 @@ func (opts *Flags) Parse(argv []string) ([]string, error) {
 		}
 		opts.Mount = append(opts.Mount, *m)
 	}
+	for _, assert := range asserts {
+		assertion, err := NewAssertion(assert)
+		if err != nil {
+			return nil, err
+		}
+		opts.Assert = append(opts.Assert, assertion)
+	}
 
 	var err error
 	if !opts.Root {
@@ -676,6 +1095,11 @@ func initializePrivileges() {
 		os.Setenv("PWD", flags.Chdir)
 	}
 
+	// Assertions are fatal regardless of --fail: the environment is not the one expected.
+	if err := CheckAssertions(os.Stderr, flags.Assert, kMountInfo); err != nil {
+		exit(fmt.Errorf("the environment does not match the assertions - %w", err))
+	}
+
 	Exec(left...)
 }
 
@@ -756,7 +1180,7 @@ func enterSystem() {
 		false,           // Wait for ALL children.
 		flags.Propagate, // Make sure signals are propagated.
 		false,           // Do not send SIGTERM to children if the main command dies (would duplicate).
-		flags.Timeout, cmd, 0)
+		flags.Timeout, nil, cmd, 0)
 }
 
 var kHelpScreen = `
@@ -816,6 +1240,23 @@ Mount syntax:
     - Most mount(8) options are supported, with the similar semantics:
       ` + strings.Join(KnownOptions.List(), ",") + `
 
+Assertions:
+
+  The --assert option verifies the environment right before running the
+  command, after all the mounts, the uid and the working directory are set up.
+  If any assertion does not hold, faketree prints the failed assertions, and
+  exits with status 125, as for any other setup error, without running the
+  command. Can be repeated, all the assertions must hold:
+
+    --assert mount:/opt/build     /opt/build is a mount point.
+    --assert readonly:/etc        /etc is on a read only mount.
+    --assert uid:0                the command runs as uid 0 (a username is
+                                  converted to its uid before setup).
+    --assert exists:/usr/bin/gcc  /usr/bin/gcc exists.
+
+  For example:
+    faketree --mount /opt/data/build-0014:/opt/build --assert mount:/opt/build -- make
+
 Signals handling:
 
   When --signals=false, faketree does nothing for signal handling:
@@ -887,6 +1328,21 @@ Process Termination handling:
     to start terminates. Once it expires, all remaining children are sent SIGKILL.
     It DOES NOT set a maximum time for the command set, rather a maximum time
     for other processes spawned to terminate.
+
+    The --reap-policy option changes what happens to the remaining children once
+    the one command terminates:
+      wait-all      - the default, as described above.
+      detach-named  - processes with a command line matching one of the --detach
+                      regular expressions, and their children, are not sent
+                      SIGTERM or SIGKILL, and are not waited for. faketree exits
+                      as soon as only those processes are left, printing the
+                      list of detached processes still running.
+                      As they run in the PID namespace of faketree, they are
+                      killed by the kernel as faketree exits.
+      kill-all-now  - all remaining children are sent SIGKILL immediately.
+
+    For example:
+      faketree --reap-policy=detach-named --detach='^cache-server ' -- ./build.sh
 `
 
 func exit(err error) {
@@ -965,7 +1421,11 @@ func enterPrivileges(flags *Flags, left []string) {
 		},
 	}
 
-	RunAndWait(flags.Wait, flags.Propagate, flags.TermOnWait, flags.Timeout, cmd, -1)
+	policy, err := NewReapPolicy(flags.ReapPolicy, flags.Detach)
+	if err != nil {
+		exit(err)
+	}
+	RunAndWait(flags.Wait, flags.Propagate, flags.TermOnWait, flags.Timeout, policy, cmd, -1)
 }
 
 // RunAndWait runs the specified command and waits for it.
@@ -973,9 +1433,9 @@ func enterPrivileges(flags *Flags, left []string) {
 // RunAndWait never returns, as it invokes exit() at the end.
 //
 // It impelemnts the wait and propagate flag, configures the kill policy based
-// on the tow flag (term on wait) as well as waiting for the entire set of
-// children, or just one.
-func RunAndWait(wait, propagate, tow bool, timeout time.Duration, cmd *exec.Cmd, pid int) {
+// on the tow flag (term on wait) and reap policy, as well as waiting for the
+// entire set of children, or just one.
+func RunAndWait(wait, propagate, tow bool, timeout time.Duration, policy *ReapPolicy, cmd *exec.Cmd, pid int) {
 	// Avoid race condition by setting signal handlers before any chance of SIGCHLD.
 	var c chan os.Signal
 	if propagate {
@@ -993,7 +1453,9 @@ func RunAndWait(wait, propagate, tow bool, timeout time.Duration, cmd *exec.Cmd,
 
 	var err error
 	if wait {
-		err = WaitChildren(timeout, cmd.Process, tow)
+		var detached []Process
+		detached, err = WaitChildren(timeout, cmd.Process, tow, policy)
+		ReportDetached(os.Stderr, detached)
 	} else {
 		err = cmd.Wait()
 	}
@@ -1001,6 +1463,17 @@ func RunAndWait(wait, propagate, tow bool, timeout time.Duration, cmd *exec.Cmd,
 	exit(err)
 }
 
+// ReportDetached prints the list of detached processes still running.
+func ReportDetached(w io.Writer, detached []Process) {
+	if len(detached) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "faketree: %d detached processes still running, they will be killed as faketree exits:\n", len(detached))
+	for _, process := range detached {
+		fmt.Fprintf(w, "  %s\n", process)
+	}
+}
+
 func main() {
 	// Namespaces require the use of clone() to create a new child process
 	// into a new, isolated, namespace. clone() is a fork equivalent, which is
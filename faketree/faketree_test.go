@@ -1,12 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultShell(t *testing.T) {
@@ -114,3 +119,165 @@ func TestParseFlags(t *testing.T) {
 	args = fl.Args()
 	assert.Equal(t, []string{"--uid", u.Uid, "--gid", u.Gid, "--faketree", fl.Faketree, "--wait-term=false"}, args)
 }
+
+// alive returns true if the process exists, and is not a zombie.
+func alive(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	return err == nil && !strings.Contains(string(stat), ") Z ")
+}
+
+func TestReapPolicy(t *testing.T) {
+	_, err := NewReapPolicy("wait-some", nil)
+	assert.Error(t, err)
+	_, err = NewReapPolicy(ReapDetachNamed, nil)
+	assert.Error(t, err)
+	_, err = NewReapPolicy(ReapWaitAll, []string{"cache"})
+	assert.Error(t, err)
+	_, err = NewReapPolicy(ReapDetachNamed, []string{"("})
+	assert.Error(t, err)
+
+	fl := NewFlags()
+	_, err = fl.Parse([]string{"--reap-policy=detach-named", "--detach=^sleep 31", "--detach=cache"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--reap-policy", "detach-named", "--detach", "^sleep 31", "--detach", "cache"}, fl.Args()[len(fl.Args())-6:])
+}
+
+func TestWaitChildrenDetachNamed(t *testing.T) {
+	policy, err := NewReapPolicy(ReapDetachNamed, []string{"^sleep 31$"})
+	assert.NoError(t, err)
+
+	detach := exec.Command("sleep", "31")
+	assert.NoError(t, detach.Start())
+	defer detach.Process.Kill()
+	other := exec.Command("sleep", "32")
+	assert.NoError(t, other.Start())
+	defer other.Process.Kill()
+
+	main := exec.Command("sh", "-c", "exit 3")
+	assert.NoError(t, main.Start())
+
+	start := time.Now()
+	detached, err := WaitChildren(0, main.Process, true, policy)
+	assert.Equal(t, ExitStatus(3), err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	// The non matching process was sent SIGTERM, and waited for, the other survives.
+	assert.False(t, alive(other.Process.Pid))
+	assert.True(t, alive(detach.Process.Pid))
+	assert.Equal(t, []Process{{Pid: detach.Process.Pid, Ppid: os.Getpid(), Cmdline: "sleep 31"}}, detached)
+
+	report := &strings.Builder{}
+	ReportDetached(report, detached)
+	assert.Contains(t, report.String(), fmt.Sprintf("pid %d (sleep 31)", detach.Process.Pid))
+
+	detach.Process.Kill()
+	detach.Wait()
+}
+
+func TestWaitChildrenKillAllNow(t *testing.T) {
+	policy, err := NewReapPolicy(ReapKillAllNow, nil)
+	assert.NoError(t, err)
+
+	background := exec.Command("sleep", "33")
+	assert.NoError(t, background.Start())
+	defer background.Process.Kill()
+
+	main := exec.Command("sh", "-c", "exit 0")
+	assert.NoError(t, main.Start())
+
+	// No SIGTERM, no timeout: the background process would be waited for forever with wait-all.
+	start := time.Now()
+	detached, err := WaitChildren(0, main.Process, false, policy)
+	assert.Equal(t, ExitStatus(0), err)
+	assert.Nil(t, detached)
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.False(t, alive(background.Process.Pid))
+}
+
+func TestAssertionFlags(t *testing.T) {
+	u, err := user.Current()
+	assert.NoError(t, err)
+
+	for _, invalid := range []string{"mount", "mount:", "mount:relative/path", "cpu:4", "uid:-1", "exists"} {
+		_, err := NewAssertion(invalid)
+		assert.Error(t, err, "%s", invalid)
+	}
+
+	fl := NewFlags()
+	_, err = fl.Parse([]string{"--assert", "mount:/opt/build", "--assert=readonly:/etc", "--assert", "uid:" + u.Username, "--assert", "exists:/usr/bin/gcc"})
+	assert.NoError(t, err)
+	expected := []string{"--assert", "mount:/opt/build", "--assert", "readonly:/etc", "--assert", "uid:" + u.Uid, "--assert", "exists:/usr/bin/gcc"}
+	args := fl.Args()
+	assert.Equal(t, expected, args[len(args)-len(expected):])
+
+	// The assertions survive the trip to the next stage.
+	next := NewFlags()
+	_, err = next.Parse(args)
+	assert.NoError(t, err)
+	assert.Equal(t, fl.Assert, next.Assert)
+
+	_, err = NewFlags().Parse([]string{"--assert", "mounted:/opt"})
+	assert.Error(t, err)
+}
+
+func TestAssertionCheck(t *testing.T) {
+	// Paths must be real paths, as mount points are.
+	dir, err := RealPath(t.TempDir())
+	assert.NoError(t, err)
+	build := filepath.Join(dir, "opt", "build")
+	etc := filepath.Join(dir, "etc")
+	assert.NoError(t, os.MkdirAll(filepath.Join(build, "src"), 0o755))
+	assert.NoError(t, os.MkdirAll(etc, 0o755))
+	gcc := filepath.Join(dir, "gcc")
+	assert.NoError(t, ioutil.WriteFile(gcc, nil, 0o755))
+	spaced := filepath.Join(dir, "with space")
+	assert.NoError(t, os.MkdirAll(spaced, 0o755))
+
+	mountinfo := filepath.Join(dir, "mountinfo")
+	assert.NoError(t, ioutil.WriteFile(mountinfo, []byte(strings.Join([]string{
+		"22 1 0:21 / / rw,relatime - ext4 /dev/sda1 rw",
+		fmt.Sprintf("36 22 98:0 /data %s/opt/build rw,noatime master:1 - ext4 /dev/sdb1 rw", dir),
+		fmt.Sprintf("37 22 98:0 / %s/etc ro,noatime - ext4 /dev/sdb2 rw", dir),
+		fmt.Sprintf("38 36 98:0 / %s/opt/build/src rw - ext4 /dev/sdb3 ro,errors=continue", dir),
+		fmt.Sprintf(`39 22 0:30 / %s/with\040space rw - tmpfs tmpfs rw`, dir),
+		"",
+	}, "\n")), 0o644))
+
+	check := func(kind, value string) error {
+		assertion, err := NewAssertion(kind + ":" + value)
+		assert.NoError(t, err)
+		return assertion.Check(mountinfo)
+	}
+
+	assert.NoError(t, check(AssertMount, build))
+	assert.NoError(t, check(AssertMount, build+"/"))
+	assert.NoError(t, check(AssertMount, spaced))
+	assert.Error(t, check(AssertMount, dir))
+	assert.Error(t, check(AssertMount, filepath.Join(dir, "opt")))
+	assert.Error(t, check(AssertMount, filepath.Join(dir, "missing")))
+
+	assert.NoError(t, check(AssertReadOnly, etc))
+	// Read only super block options apply to the whole mount.
+	assert.NoError(t, check(AssertReadOnly, filepath.Join(build, "src")))
+	assert.Error(t, check(AssertReadOnly, build))
+	assert.Error(t, check(AssertReadOnly, gcc))
+
+	assert.NoError(t, check(AssertUid, strconv.Itoa(os.Getuid())))
+	assert.Error(t, check(AssertUid, strconv.Itoa(os.Getuid()+1)))
+
+	assert.NoError(t, check(AssertExists, gcc))
+	assert.Error(t, check(AssertExists, filepath.Join(dir, "cc")))
+
+	report := &strings.Builder{}
+	err = CheckAssertions(report, []Assertion{
+		{Kind: AssertMount, Value: etc},
+		{Kind: AssertReadOnly, Value: build},
+		{Kind: AssertExists, Value: gcc},
+	}, mountinfo)
+	assert.Error(t, err)
+	assert.NotContains(t, report.String(), "mount:"+etc)
+	assert.Contains(t, report.String(), "faketree: assertion readonly:"+build+" FAILED - ")
+	assert.NotContains(t, report.String(), "exists:")
+
+	assert.NoError(t, CheckAssertions(report, nil, mountinfo))
+}
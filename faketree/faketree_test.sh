@@ -161,3 +161,19 @@ $ft --fail --wait-timeout=1s -- bash -c "(sleep 3600) &>/dev/null & exit 12"
 test "$?" == "12" || {
   fail "faketree did not return the status of the main command"
 }
+
+# Assertions are verified before the command is run, and fail the setup.
+$ft --mount $tmpdir:/tmp/root/etc --assert mount:/tmp/root/etc --assert exists:$tmpfile --root --assert uid:0 -- true
+test "$?" == "0" || {
+  fail "faketree assertions on the environment failed"
+}
+out=$($ft --assert exists:$tmpdir/missing -- sh -c 'echo ran' 2>&1)
+test "$?" == "125" || {
+  fail "faketree did not fail with a setup error on a failed assertion"
+}
+echo "$out" | grep -q "assertion exists:$tmpdir/missing FAILED" || {
+  fail "faketree did not report the failed assertion - $out"
+}
+if echo "$out" | grep -q "^ran$"; then
+  fail "faketree ran the command despite a failed assertion"
+fi
@@ -5,16 +5,20 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"sync/atomic"
 	"time"
 
 	fpb "github.com/System233/enkit/flextape/proto"
 )
 
-var runCommand = func(ctx context.Context, result chan error, cmd string, args ...string) {
+var runCommand = func(ctx context.Context, result chan error, env []string, cmd string, args ...string) {
 	job := exec.CommandContext(ctx, cmd, args...)
 	job.Stdout = os.Stdout
 	job.Stderr = os.Stderr
+	if len(env) > 0 {
+		job.Env = append(os.Environ(), env...)
+	}
 
 	result <- job.Run()
 }
@@ -24,6 +28,13 @@ type LicenseClient struct {
 	client     fpb.FlextapeClient
 	invocation *fpb.Invocation
 	licenseErr chan error
+
+	// Returned by the server with the allocation, nil if the license has no template.
+	material *fpb.LicenseMaterial
+
+	// Configured with Notify, nil if no notification is requested.
+	notifyTop      uint32
+	notifyCallback func(position uint32)
 }
 
 // New returns a LicenseClient that can be used to guard command invocations
@@ -45,6 +56,18 @@ func New(client fpb.FlextapeClient, username string, vendor string, feature stri
 	}
 }
 
+// Notify configures callback to be invoked once the invocation reaches
+// position top or better in the queue, and once a license is allocated after
+// waiting in the queue, with position 0.
+//
+// The callback runs in a goroutine of its own, so it can block without
+// delaying the acquisition of the license.
+func (c *LicenseClient) Notify(top uint32, callback func(position uint32)) *LicenseClient {
+	c.notifyTop = top
+	c.notifyCallback = callback
+	return c
+}
+
 // Guard wraps the specified command with the license acquire/refresh/release
 // lifecycle.
 func (c *LicenseClient) Guard(ctx context.Context, cmd string, args ...string) error {
@@ -55,11 +78,18 @@ func (c *LicenseClient) Guard(ctx context.Context, cmd string, args ...string) e
 		return fmt.Errorf("failed to obtain license: %w", err)
 	}
 
+	defer c.release(3 * time.Second)
+
+	env, cleanup, err := Materialize(c.material)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to prepare license for the tool: %w", err)
+	}
+	defer cleanup()
+
 	jobResult := make(chan error)
 	go c.refresh(ctx)
-	go runCommand(ctx, jobResult, cmd, args...)
-
-	defer c.release(3 * time.Second)
+	go runCommand(ctx, jobResult, env, cmd, args...)
 
 	select {
 	case err := <-c.licenseErr:
@@ -98,6 +128,7 @@ func (c *LicenseClient) acquire(ctx context.Context) error {
 		Invocation: c.invocation,
 	}
 
+	queued, notified := false, false
 	for {
 		res, err := c.client.Allocate(ctx, req)
 		if err != nil {
@@ -107,12 +138,21 @@ func (c *LicenseClient) acquire(ctx context.Context) error {
 		switch r := res.GetResponseType().(type) {
 		case *fpb.AllocateResponse_LicenseAllocated:
 			req.GetInvocation().Id = r.LicenseAllocated.GetInvocationId()
+			c.material = r.LicenseAllocated.GetMaterial()
+			if queued && c.notifyCallback != nil {
+				go c.notifyCallback(0)
+			}
 			fmt.Fprintf(os.Stderr, "flextape request %s: reserved license; running tool\n", r.LicenseAllocated.GetInvocationId())
 			return nil
 		case *fpb.AllocateResponse_Queued:
 			req.GetInvocation().Id = r.Queued.GetInvocationId()
 			reqID.Store(req.GetInvocation().GetId())
 			atomic.StoreUint32(&queuePos, r.Queued.GetQueuePosition())
+			queued = true
+			if pos := r.Queued.GetQueuePosition(); !notified && c.notifyCallback != nil && pos <= c.notifyTop {
+				notified = true
+				go c.notifyCallback(pos)
+			}
 			sleepTime := min(time.Until(r.Queued.GetNextPollTime().AsTime())*3/5, 5*time.Second)
 			time.Sleep(sleepTime)
 			continue
@@ -122,6 +162,43 @@ func (c *LicenseClient) acquire(ctx context.Context) error {
 	}
 }
 
+// Materialize prepares the license material for the tool.
+//
+// Returns the environment variables to set for the tool, in "NAME=value"
+// format, and a function removing the license token file, if any was
+// created. The cleanup function must be called once the tool exits.
+func Materialize(material *fpb.LicenseMaterial) ([]string, func(), error) {
+	cleanup := func() {}
+	if material == nil {
+		return nil, cleanup, nil
+	}
+
+	var env []string
+	for name, value := range material.GetEnv() {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	if material.GetFileBody() == "" {
+		return env, cleanup, nil
+	}
+
+	f, err := os.CreateTemp("", "flextape-license-*")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	if _, err := f.WriteString(material.GetFileBody()); err != nil {
+		f.Close()
+		cleanup()
+		return nil, func() {}, err
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	return append(env, material.GetFileEnv()+"="+f.Name()), cleanup, nil
+}
+
 // logQueuePosition prints the queue position queuePos to stderr every
 // `interval` until `done` is closed.
 func logQueuePosition(id *atomic.Value, queuePos *uint32, interval time.Duration, done chan struct{}) {
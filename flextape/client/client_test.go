@@ -3,6 +3,8 @@ package client
 import (
 	"context"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
 
 	fpb "github.com/System233/enkit/flextape/proto"
@@ -49,6 +51,10 @@ func (c *fakeClient) LicensesStatus(context.Context, *fpb.LicensesStatusRequest,
 	return nil, fmt.Errorf("LicensesStatus() not implemented")
 }
 
+func (c *fakeClient) PrioritizerReport(context.Context, *fpb.PrioritizerReportRequest, ...grpc.CallOption) (*fpb.PrioritizerReportResponse, error) {
+	return nil, fmt.Errorf("PrioritizerReport() not implemented")
+}
+
 func TestLicenseClientAcquire(t *testing.T) {
 	now := timestamppb.Now()
 	testCases := []struct {
@@ -144,6 +150,51 @@ func TestLicenseClientAcquire(t *testing.T) {
 	}
 }
 
+func TestLicenseClientNotify(t *testing.T) {
+	now := timestamppb.Now()
+	queued := func(pos uint32) *fpb.AllocateResponse {
+		return &fpb.AllocateResponse{
+			ResponseType: &fpb.AllocateResponse_Queued{
+				Queued: &fpb.Queued{
+					InvocationId:  "a",
+					NextPollTime:  now,
+					QueuePosition: pos,
+				},
+			},
+		}
+	}
+	fake := &fakeClient{
+		allocateResponses: []*fpb.AllocateResponse{
+			queued(5),
+			queued(3),
+			queued(2),
+			queued(1),
+			&fpb.AllocateResponse{
+				ResponseType: &fpb.AllocateResponse_LicenseAllocated{
+					LicenseAllocated: &fpb.LicenseAllocated{
+						InvocationId:           "a",
+						LicenseRefreshDeadline: now,
+					},
+				},
+			},
+		},
+	}
+	positions := make(chan uint32, 10)
+	client := (&LicenseClient{
+		client:     fake,
+		invocation: &fpb.Invocation{Owner: "unittest", BuildTag: "test"},
+	}).Notify(3, func(position uint32) {
+		positions <- position
+	})
+
+	assert.Nil(t, client.acquire(context.Background()))
+
+	// Deeper positions don't notify, and reaching the top only notifies once.
+	got := []uint32{<-positions, <-positions}
+	assert.ElementsMatch(t, []uint32{3, 0}, got)
+	assert.Equal(t, 0, len(positions))
+}
+
 func TestLicenseClientRefresh(t *testing.T) {
 	now := timestamppb.Now()
 	testCases := []struct {
@@ -206,3 +257,30 @@ func TestLicenseClientRefresh(t *testing.T) {
 		})
 	}
 }
+
+func TestMaterialize(t *testing.T) {
+	env, cleanup, err := Materialize(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, env)
+	cleanup()
+
+	env, cleanup, err = Materialize(&fpb.LicenseMaterial{
+		Env:      map[string]string{"TOOL_SEAT": "1", "LM_LICENSE_FILE": "27000@license-server"},
+		FileBody: "SERVER license-server\n",
+		FileEnv:  "TOOL_LICENSE_FILE",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(env))
+	assert.Equal(t, []string{"LM_LICENSE_FILE=27000@license-server", "TOOL_SEAT=1"}, env[:2])
+
+	path := strings.TrimPrefix(env[2], "TOOL_LICENSE_FILE=")
+	assert.NotEqual(t, env[2], path)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "SERVER license-server\n", string(data))
+
+	// The token file is removed on cleanup.
+	cleanup()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -29,15 +29,27 @@ func New(tmpl *template.Template, svc *service.Service) *Frontend {
 	}
 }
 
+// queuePage is the data the queue page template is rendered with.
+type queuePage struct {
+	*fpb.LicensesStatusResponse
+
+	// Comparison of the prioritizers of licenses with shadow prioritizers configured.
+	Prioritizers *fpb.PrioritizerReportResponse
+}
+
 // ServeHTTP serves the template for the queue page.
 func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	res, err := f.svc.LicensesStatus(r.Context(), &fpb.LicensesStatusRequest{})
+	res, err := f.svc.LicensesStatus(r.Context(), &fpb.LicensesStatusRequest{Verbose: true})
+	if checkErr(w, err) {
+		return
+	}
+	report, err := f.svc.PrioritizerReport(r.Context(), &fpb.PrioritizerReportRequest{})
 	if checkErr(w, err) {
 		return
 	}
 
 	buf := new(bytes.Buffer)
-	err = f.tmpl.Execute(buf, res)
+	err = f.tmpl.Execute(buf, &queuePage{LicensesStatusResponse: res, Prioritizers: report})
 	if checkErr(w, err) {
 		return
 	}
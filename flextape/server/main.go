@@ -13,6 +13,7 @@ import (
 	"github.com/System233/enkit/flextape/frontend"
 	fpb "github.com/System233/enkit/flextape/proto"
 	"github.com/System233/enkit/flextape/service"
+	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/metrics"
 	"github.com/System233/enkit/lib/server"
 
@@ -24,6 +25,11 @@ var (
 	//go:embed templates/*
 	templates     embed.FS
 	serviceConfig = flag.String("service_config", "", "Path to service configuration textproto")
+	devMode       = flag.Bool("dev", false, "Run in development mode: skip the adoption period, and allow --dev_fixture")
+	devFixture    = flag.String("dev_fixture", "", "Path to a yaml or json fixture of licenses, allocations and queued invocations to load at startup. Requires --dev")
+	drainTimeout  = flag.Duration("drain_timeout", server.DefaultDrainTimeout, "On SIGTERM, how long to wait for in-flight license RPCs to complete before exiting")
+	debugFlags    = server.DefaultDebugFlags().Register(&kflags.GoFlagSet{FlagSet: flag.CommandLine}, "")
+	tlsFlags      = server.DefaultTLSFlags().Register(&kflags.GoFlagSet{FlagSet: flag.CommandLine}, "")
 )
 
 func exitIf(err error) {
@@ -37,6 +43,9 @@ func checkFlags() error {
 	if *serviceConfig == "" {
 		return fmt.Errorf("--service_config must be provided")
 	}
+	if *devFixture != "" && !*devMode {
+		return fmt.Errorf("--dev_fixture can only be used with --dev, refusing to load fixtures in production")
+	}
 	return nil
 }
 
@@ -65,9 +74,20 @@ func main() {
 	template, err := template.ParseFS(templates, "**/*.tmpl")
 	exitIf(err)
 
-	grpcs := grpc.NewServer()
+	grpcOpts, err := metrics.Register(metrics.WithGRPCServer())
+	exitIf(err)
+	grpcs := grpc.NewServer(append(grpcOpts, grpc.StatsHandler(service.StatsHandler()))...)
 	s, err := service.New(config)
 	exitIf(err)
+	if *devMode {
+		log.Printf("Running in development mode")
+		s.EnableDevMode()
+	}
+	if *devFixture != "" {
+		fixture, err := service.LoadFixture(*devFixture)
+		exitIf(err)
+		exitIf(s.ApplyFixture(fixture))
+	}
 	fpb.RegisterFlextapeServer(grpcs, s)
 
 	fe := frontend.New(template, s)
@@ -76,5 +96,5 @@ func main() {
 	metrics.AddHandler(mux, "/metrics")
 	mux.Handle("/queue", fe)
 
-	exitIf(server.Run(ctx, mux, grpcs, nil))
+	exitIf(server.Run(ctx, mux, grpcs, nil, server.WithShutdown(server.NewShutdown(server.WithDrainTimeout(*drainTimeout))), server.WithDebug(debugFlags), server.WithTLS(tlsFlags)))
 }
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The compatibility tests guarantee that clients and servers built from
+// different versions of flextape.proto can still talk to each other.
+//
+// The snapshot in testdata/compat/flextape.descriptor lists the number, name
+// and type of every field: changing or removing any of them fails the test.
+// The .binpb fixtures were encoded by the previous versions of the protocol,
+// and must keep decoding to the same messages.
+var updateCompat = flag.Bool("update-compat", false, "Rewrite the descriptor snapshot in testdata/compat, and write the fixtures that do not exist yet. Existing fixtures are never modified.")
+
+const compatDir = "testdata/compat"
+
+// compatEpoch is the time used in all the fixtures, 2026-01-01T00:00:00Z.
+var compatEpoch = time.Unix(1767225600, 0).UTC()
+
+func compatMaterial() *fpb.LicenseMaterial {
+	return &fpb.LicenseMaterial{
+		SeatIndex: 1,
+		Env:       map[string]string{"LM_LICENSE_FILE": "27000@license-server"},
+		FileBody:  "SERVER license-server ANY 27000\n",
+		FileEnv:   "XILINXD_LICENSE_FILE",
+	}
+}
+
+func compatInvocation(id string) *fpb.Invocation {
+	return &fpb.Invocation{
+		Licenses: []*fpb.License{{Vendor: "xilinx", Feature: "feature_foo"}},
+		Owner:    "alice",
+		BuildTag: "build-1",
+		Id:       id,
+	}
+}
+
+// compatFixtures maps the name of each fixture to the message it must decode to.
+var compatFixtures = map[string]proto.Message{
+	"allocate_request.binpb":      &fpb.AllocateRequest{Invocation: compatInvocation("")},
+	"allocate_request_poll.binpb": &fpb.AllocateRequest{Invocation: compatInvocation("inv-1")},
+	"refresh_request.binpb":       &fpb.RefreshRequest{Invocation: compatInvocation("inv-1")},
+	"release_request.binpb":       &fpb.ReleaseRequest{InvocationId: "inv-1"},
+	"licenses_status_request.binpb": &fpb.LicensesStatusRequest{
+		FieldMask: &fieldmaskpb.FieldMask{Paths: []string{"license", "allocated_count"}},
+		Verbose:   true,
+	},
+	"allocate_response_allocated.binpb": &fpb.AllocateResponse{
+		ResponseType: &fpb.AllocateResponse_LicenseAllocated{
+			LicenseAllocated: &fpb.LicenseAllocated{
+				InvocationId:           "inv-1",
+				LicenseRefreshDeadline: timestamppb.New(compatEpoch.Add(7 * time.Second)),
+				Material:               compatMaterial(),
+			},
+		},
+	},
+	"allocate_response_queued.binpb": &fpb.AllocateResponse{
+		ResponseType: &fpb.AllocateResponse_Queued{
+			Queued: &fpb.Queued{
+				InvocationId:  "inv-2",
+				NextPollTime:  timestamppb.New(compatEpoch.Add(5500 * time.Millisecond)),
+				QueuePosition: 3,
+				Message:       "license server unhealthy - allocations are paused",
+			},
+		},
+	},
+	"refresh_response.binpb": &fpb.RefreshResponse{
+		InvocationId:           "inv-1",
+		LicenseRefreshDeadline: timestamppb.New(compatEpoch.Add(7 * time.Second)),
+		Material:               compatMaterial(),
+	},
+	"licenses_status_response.binpb": &fpb.LicensesStatusResponse{
+		LicenseStats: []*fpb.LicenseStats{{
+			License:           &fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+			Timestamp:         timestamppb.New(compatEpoch),
+			TotalLicenseCount: 2,
+			AllocatedCount:    1,
+			QueuedCount:       1,
+			AllocatedInvocations: []*fpb.Invocation{
+				{Owner: "alice", BuildTag: "build-1", Id: "inv-1"},
+			},
+			QueuedInvocations: []*fpb.Invocation{
+				{Owner: "bob", BuildTag: "build-2", Id: "inv-2"},
+			},
+			Health:        fpb.LicenseHealth_UNHEALTHY,
+			HealthMessage: "connection refused",
+			HealthChanged: timestamppb.New(compatEpoch.Add(-10 * time.Minute)),
+		}},
+	},
+}
+
+// describeMessages appends a line for each field of the messages in msgs,
+// including nested messages and map entries, to lines.
+func describeMessages(lines []string, msgs protoreflect.MessageDescriptors) []string {
+	for i := 0; i < msgs.Len(); i++ {
+		msg := msgs.Get(i)
+		fields := msg.Fields()
+		for j := 0; j < fields.Len(); j++ {
+			field := fields.Get(j)
+			line := fmt.Sprintf("field %s %d %s %s %s", msg.FullName(), field.Number(), field.Name(), field.Cardinality(), field.Kind())
+			switch {
+			case field.Message() != nil:
+				line += " " + string(field.Message().FullName())
+			case field.Enum() != nil:
+				line += " " + string(field.Enum().FullName())
+			}
+			lines = append(lines, line)
+		}
+		lines = describeMessages(lines, msg.Messages())
+		lines = describeEnums(lines, msg.Enums())
+	}
+	return lines
+}
+
+// describeEnums appends a line for each value of the enums in enums to lines.
+func describeEnums(lines []string, enums protoreflect.EnumDescriptors) []string {
+	for i := 0; i < enums.Len(); i++ {
+		enum := enums.Get(i)
+		values := enum.Values()
+		for j := 0; j < values.Len(); j++ {
+			value := values.Get(j)
+			lines = append(lines, fmt.Sprintf("value %s %d %s", enum.FullName(), value.Number(), value.Name()))
+		}
+	}
+	return lines
+}
+
+// describeFlextape returns the snapshot lines of flextape.proto, sorted by
+// message or enum name first, and number second.
+func describeFlextape() []string {
+	file := (&fpb.AllocateRequest{}).ProtoReflect().Descriptor().ParentFile()
+	lines := describeEnums(describeMessages(nil, file.Messages()), file.Enums())
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := strings.Fields(lines[i]), strings.Fields(lines[j])
+		if a[0] != b[0] || a[1] != b[1] {
+			return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+		}
+		an, _ := strconv.Atoi(a[2])
+		bn, _ := strconv.Atoi(b[2])
+		return an < bn
+	})
+	return lines
+}
+
+// snapshotKey returns the kind, the parent and the number of a snapshot line.
+func snapshotKey(line string) string {
+	return strings.Join(strings.Fields(line)[:3], " ")
+}
+
+func TestCompatDescriptor(t *testing.T) {
+	path := filepath.Join(compatDir, "flextape.descriptor")
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	header := []string{}
+	snapshot := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#"):
+			header = append(header, line)
+		case strings.TrimSpace(line) != "":
+			snapshot[snapshotKey(line)] = line
+		}
+	}
+	assert.NotEmpty(t, snapshot, "empty snapshot in %s", path)
+
+	current := describeFlextape()
+	known := map[string]string{}
+	for _, line := range current {
+		known[snapshotKey(line)] = line
+	}
+	for key, line := range snapshot {
+		got, found := known[key]
+		if !found {
+			t.Errorf("%s was removed or renumbered - old clients still send it, reserve its number and name instead (%s)", key, line)
+			continue
+		}
+		if got != line {
+			t.Errorf("%s changed in an incompatible way\n  was: %s\n  now: %s", key, line, got)
+		}
+	}
+
+	if *updateCompat {
+		output := strings.Join(append(header, current...), "\n") + "\n"
+		assert.NoError(t, ioutil.WriteFile(path, []byte(output), 0644))
+	}
+}
+
+func TestCompatFixtures(t *testing.T) {
+	for name, want := range compatFixtures {
+		path := filepath.Join(compatDir, name)
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && *updateCompat {
+			data, err = proto.MarshalOptions{Deterministic: true}.Marshal(want)
+			assert.NoError(t, err, "%s", name)
+			assert.NoError(t, ioutil.WriteFile(path, data, 0644), "%s", name)
+		}
+		if !assert.NoError(t, err, "%s", name) {
+			continue
+		}
+
+		got := want.ProtoReflect().New().Interface()
+		if !assert.NoError(t, proto.Unmarshal(data, got), "%s", name) {
+			continue
+		}
+		assert.True(t, proto.Equal(want, got), "%s: decoded to %v, want %v", name, got, want)
+
+		// Fields and map entries are written in a stable order, so a message
+		// decoded from an old peer is forwarded unchanged.
+		encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(got)
+		assert.NoError(t, err, "%s", name)
+		assert.Equal(t, data, encoded, "%s: re-encoding changed the bytes", name)
+	}
+}
+
+// readCompatFixture decodes the fixture name into msg, failing the test on error.
+func readCompatFixture(t *testing.T, name string, msg proto.Message) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(compatDir, name))
+	if err != nil {
+		t.Fatalf("reading fixture %s: %v", name, err)
+	}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		t.Fatalf("decoding fixture %s: %v", name, err)
+	}
+}
+
+// TestCompatServer feeds the requests recorded from old clients to the server.
+func TestCompatServer(t *testing.T) {
+	ctx := context.Background()
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time { return compatEpoch })
+	defer stubs.Reset()
+
+	s := testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+		ID:       "inv-1",
+		Owner:    "alice",
+		BuildTag: "build-1",
+	})
+
+	allocate := &fpb.AllocateRequest{}
+	readCompatFixture(t, "allocate_request.binpb", allocate)
+	res, err := s.Allocate(ctx, allocate)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", res.GetLicenseAllocated().GetInvocationId())
+	assert.Nil(t, res.GetLicenseAllocated().GetMaterial())
+
+	poll := &fpb.AllocateRequest{}
+	readCompatFixture(t, "allocate_request_poll.binpb", poll)
+	res, err = s.Allocate(ctx, poll)
+	assert.NoError(t, err)
+	assert.Equal(t, "inv-1", res.GetLicenseAllocated().GetInvocationId())
+	assert.True(t, compatEpoch.Add(7*time.Second).Equal(res.GetLicenseAllocated().GetLicenseRefreshDeadline().AsTime()))
+
+	refresh := &fpb.RefreshRequest{}
+	readCompatFixture(t, "refresh_request.binpb", refresh)
+	refreshed, err := s.Refresh(ctx, refresh)
+	assert.NoError(t, err)
+	assert.Equal(t, "inv-1", refreshed.GetInvocationId())
+
+	statusReq := &fpb.LicensesStatusRequest{}
+	readCompatFixture(t, "licenses_status_request.binpb", statusReq)
+	stats, err := s.LicensesStatus(ctx, statusReq)
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(&fpb.LicensesStatusResponse{
+		LicenseStats: []*fpb.LicenseStats{{
+			License:        &fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+			AllocatedCount: 2,
+		}},
+	}, stats), "got %v", stats)
+
+	release := &fpb.ReleaseRequest{}
+	readCompatFixture(t, "release_request.binpb", release)
+	_, err = s.Release(ctx, release)
+	assert.NoError(t, err)
+	_, err = s.Refresh(ctx, refresh)
+	assert.Error(t, err)
+}
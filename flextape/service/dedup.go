@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+var metricDeduplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "flextape",
+	Name:      "deduplicated_requests",
+	Help:      "Requests answered with the response computed for an identical request received shortly before",
+},
+	[]string{
+		"method",
+	},
+)
+
+// defaultDedupWindowMilliseconds is how long a response is reused for
+// identical requests, unless configured otherwise.
+const defaultDedupWindowMilliseconds = 250
+
+// dedup answers identical requests for the same invocation with a single
+// computed response, so a client retrying in a tight loop does not take the
+// service lock for every request, inflating the latency of all other clients.
+//
+// A request is deduplicated only if it is identical to the last one received
+// for the same invocation and method, and arrives while that one is still
+// being processed, or within window after it completed. Polls spaced by the
+// refresh durations are always processed.
+//
+// A nil *dedup disables deduplication.
+type dedup struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+}
+
+type dedupKey struct {
+	method     string
+	invocation string
+}
+
+type dedupEntry struct {
+	request  []byte        // Serialized request, to detect identical requests.
+	done     chan struct{} // Closed once response and err are set.
+	computed time.Time     // When the response was computed, zero while in flight.
+
+	response proto.Message
+	err      error
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{
+		window:  window,
+		entries: map[dedupKey]*dedupEntry{},
+	}
+}
+
+// fresh returns true if the response of the entry can be reused. Must be called with mu held.
+func (d *dedup) fresh(e *dedupEntry) bool {
+	return e.computed.IsZero() || timeNow().Sub(e.computed) < d.window
+}
+
+// dedupDo returns the response computed by fn for req, or the response
+// computed for an identical request for the same invocation and method.
+//
+// Requests without an invocation ID, like the first Allocate of an
+// invocation, are never deduplicated.
+func dedupDo[T proto.Message](d *dedup, method, invocation string, req proto.Message, fn func() (T, error)) (T, error) {
+	if d == nil || invocation == "" {
+		return fn()
+	}
+	request, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return fn()
+	}
+	key := dedupKey{method: method, invocation: invocation}
+
+	d.mu.Lock()
+	e, found := d.entries[key]
+	if !found || !bytes.Equal(e.request, request) || !d.fresh(e) {
+		e = &dedupEntry{request: request, done: make(chan struct{})}
+		d.entries[key] = e
+		d.mu.Unlock()
+
+		res, err := fn()
+		e.response, e.err = res, err
+		d.mu.Lock()
+		e.computed = timeNow()
+		d.mu.Unlock()
+		close(e.done)
+		return res, err
+	}
+	d.mu.Unlock()
+
+	<-e.done
+	metricDeduplicated.WithLabelValues(method).Inc()
+	var res T
+	if e.err != nil {
+		return res, e.err
+	}
+	return proto.Clone(e.response).(T), nil
+}
+
+// Forget drops the responses computed for an invocation, so requests
+// following its release are processed.
+func (d *dedup) Forget(invocation string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range d.entries {
+		if key.invocation == invocation {
+			delete(d.entries, key)
+		}
+	}
+}
+
+// Expire drops the responses that can no longer be reused.
+func (d *dedup) Expire() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, e := range d.entries {
+		if !d.fresh(e) {
+			delete(d.entries, key)
+		}
+	}
+}
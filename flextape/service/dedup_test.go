@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func deduplicated(t *testing.T, method string) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, metricDeduplicated.WithLabelValues(method).(prometheus.Metric).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestDedupDo(t *testing.T) {
+	now := time.Now()
+	stubs := gostub.Stub(&timeNow, func() time.Time { return now })
+	defer stubs.Reset()
+
+	d := newDedup(time.Second)
+	req := &fpb.RefreshRequest{Invocation: &fpb.Invocation{Id: "abc"}}
+
+	// A burst of identical requests is processed once, while the first is in flight.
+	release := make(chan struct{})
+	var lock sync.Mutex
+	calls := 0
+	process := func() (*fpb.RefreshResponse, error) {
+		<-release
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		return &fpb.RefreshResponse{InvocationId: "abc"}, nil
+	}
+
+	before := deduplicated(t, "Test")
+	var wg sync.WaitGroup
+	responses := make([]*fpb.RefreshResponse, 20)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := dedupDo(d, "Test", "abc", req, process)
+			assert.Nil(t, err)
+			responses[i] = res
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Callers arriving after the first response was computed reuse it as well.
+	res, err := dedupDo(d, "Test", "abc", req, process)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, float64(20), deduplicated(t, "Test")-before)
+	for _, r := range append(responses, res) {
+		assert.True(t, proto.Equal(responses[0], r))
+	}
+	// Each caller gets its own copy.
+	assert.True(t, res != responses[0])
+
+	// Different requests, or requests without an invocation, are processed.
+	_, err = dedupDo(d, "Test", "abc", &fpb.RefreshRequest{Invocation: &fpb.Invocation{Id: "abc", Owner: "bob"}}, process)
+	assert.Nil(t, err)
+	_, err = dedupDo(d, "Test", "", req, process)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	// Errors are deduplicated too.
+	failures := 0
+	fail := func() (*fpb.RefreshResponse, error) {
+		failures++
+		return nil, status.Errorf(codes.FailedPrecondition, "not allocated")
+	}
+	for i := 0; i < 3; i++ {
+		res, err := dedupDo(d, "Test", "def", req, fail)
+		assert.Nil(t, res)
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+	assert.Equal(t, 1, failures)
+
+	// Once the window has passed, the request is processed again, and the expired entries are dropped.
+	now = now.Add(time.Second)
+	_, err = dedupDo(d, "Test", "def", req, fail)
+	assert.Equal(t, 2, failures)
+	d.Expire()
+	assert.Equal(t, 1, len(d.entries))
+
+	// Deduplication can be disabled.
+	var disabled *dedup
+	for i := 0; i < 2; i++ {
+		_, err := dedupDo(disabled, "Test", "def", req, fail)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 4, failures)
+	disabled.Forget("def")
+	disabled.Expire()
+}
+
+func TestAllocateDedup(t *testing.T) {
+	start := time.Now()
+	now := start
+	stubs := gostub.Stub(&timeNow, func() time.Time { return now })
+	defer stubs.Reset()
+
+	s := testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{ID: "abc", Owner: "bob", LastCheckin: start.Add(-5 * time.Second)})
+	s.dedup = newDedup(250 * time.Millisecond)
+	req := &fpb.AllocateRequest{
+		Invocation: &fpb.Invocation{
+			Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+			Owner:    "bob",
+			Id:       "abc",
+		},
+	}
+
+	before := deduplicated(t, "Allocate")
+	var wg sync.WaitGroup
+	responses := make([]*fpb.AllocateResponse, 50)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := s.Allocate(context.Background(), req)
+			assert.Nil(t, err)
+			responses[i] = res
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, "abc", responses[0].GetLicenseAllocated().GetInvocationId())
+	for _, res := range responses {
+		assert.True(t, proto.Equal(responses[0], res))
+	}
+	assert.Equal(t, float64(49), deduplicated(t, "Allocate")-before)
+	assert.Equal(t, start, s.licenses["xilinx::feature_foo"].allocations["abc"].LastCheckin)
+
+	// A poll spaced by more than the window is processed.
+	now = start.Add(time.Second)
+	res, err := s.Allocate(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, now, s.licenses["xilinx::feature_foo"].allocations["abc"].LastCheckin)
+	assert.Equal(t, float64(49), deduplicated(t, "Allocate")-before)
+	assert.False(t, proto.Equal(responses[0], res))
+
+	// Once released, the invocation is forgotten, and a stale response is never returned.
+	_, err = s.Release(context.Background(), &fpb.ReleaseRequest{InvocationId: "abc"})
+	assert.Nil(t, err)
+	_, err = s.Allocate(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
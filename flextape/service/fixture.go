@@ -0,0 +1,194 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+	"github.com/System233/enkit/lib/config/marshal"
+)
+
+// Fixture describes licenses, allocations and queued invocations to seed a
+// Service with, for local development of the dashboard and clients.
+//
+// Fixtures are loaded from yaml or json files, see TestFixtureSchema for an example.
+type Fixture struct {
+	Licenses []FixtureLicense `json:"licenses" yaml:"licenses"`
+}
+
+// FixtureLicense describes the state of a license.
+type FixtureLicense struct {
+	Vendor  string `json:"vendor" yaml:"vendor"`
+	Feature string `json:"feature" yaml:"feature"`
+
+	// Number of seats. Licenses not in the config are added, with the prioritizer
+	// specified. Licenses in the config keep their prioritizer, and their number
+	// of seats unless Quantity is not 0.
+	Quantity    int    `json:"quantity" yaml:"quantity"`
+	Prioritizer string `json:"prioritizer" yaml:"prioritizer"` // fifo (default) or even_owners.
+
+	Allocated []FixtureInvocation `json:"allocated" yaml:"allocated"`
+	Queued    []FixtureInvocation `json:"queued" yaml:"queued"`
+}
+
+// FixtureInvocation describes an allocated or queued invocation.
+type FixtureInvocation struct {
+	ID       string `json:"id" yaml:"id"` // Generated if empty.
+	Owner    string `json:"owner" yaml:"owner"`
+	BuildTag string `json:"build_tag" yaml:"build_tag"`
+
+	// How long ago the invocation was allocated or queued, relative to the
+	// time the fixture is applied, as accepted by time.ParseDuration.
+	// Queued invocations are ordered from the oldest.
+	Age string `json:"age" yaml:"age"`
+}
+
+// LoadFixture reads a fixture from a yaml or json file, based on its extension.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read fixture %q: %w", path, err)
+	}
+	fixture := &Fixture{}
+	if err := marshal.Unmarshal(path, data, fixture); err != nil {
+		return nil, fmt.Errorf("unable to parse fixture %q: %w", path, err)
+	}
+	return fixture, nil
+}
+
+// EnableDevMode prepares the Service for local development: the adoption period
+// is skipped, and fixtures can be applied.
+func (s *Service) EnableDevMode() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dev = true
+	s.currentState = stateRunning
+}
+
+// fixtureEntry is an invocation of a fixture, ready to be applied.
+type fixtureEntry struct {
+	inv *invocation
+	at  time.Time
+}
+
+// toEntries validates the invocations of a fixture license, sorted from the oldest.
+func (fl *FixtureLicense) toEntries(invocations []FixtureInvocation, now time.Time) ([]fixtureEntry, error) {
+	var entries []fixtureEntry
+	for ix, fi := range invocations {
+		var age time.Duration
+		if fi.Age != "" {
+			var err error
+			if age, err = time.ParseDuration(fi.Age); err != nil || age < 0 {
+				return nil, fmt.Errorf("license %s::%s invocation %d: invalid age %q - must be a positive duration like 5m", fl.Vendor, fl.Feature, ix, fi.Age)
+			}
+		}
+		id := fi.ID
+		if id == "" {
+			var err error
+			if id, err = generateRandomID(); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, fixtureEntry{
+			inv: &invocation{
+				ID:          id,
+				Owner:       fi.Owner,
+				BuildTag:    fi.BuildTag,
+				LastCheckin: now,
+				Pinned:      true,
+			},
+			at: now.Add(-age),
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at.Before(entries[j].at) })
+	return entries, nil
+}
+
+// ApplyFixture adds the licenses, allocations and queued invocations of the fixture.
+//
+// Invocations added are never expired, as no client refreshes them, but can be
+// released. Fails unless EnableDevMode was invoked. The fixture is validated
+// before any change is made.
+func (s *Service) ApplyFixture(fixture *Fixture) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dev {
+		return fmt.Errorf("fixtures can only be loaded in development mode")
+	}
+
+	now := timeNow()
+	config := &fpb.Config{}
+	type pending struct {
+		name      string
+		quantity  int
+		allocated []fixtureEntry
+		queued    []fixtureEntry
+	}
+	var todo []pending
+	seen := map[string]bool{}
+	for _, fl := range fixture.Licenses {
+		fl := fl
+		name := formatLicenseType(&fpb.License{Vendor: fl.Vendor, Feature: fl.Feature})
+		if fl.Vendor == "" || fl.Feature == "" || seen[name] {
+			return fmt.Errorf("license %q: vendor and feature must be set, and unique", name)
+		}
+		seen[name] = true
+		if fl.Quantity < 0 {
+			return fmt.Errorf("license %s: invalid quantity %d", name, fl.Quantity)
+		}
+
+		existing := 0
+		if lic, ok := s.licenses[name]; !ok {
+			lc := &fpb.LicenseConfig{
+				Quantity: uint32(fl.Quantity),
+				License:  &fpb.License{Vendor: fl.Vendor, Feature: fl.Feature},
+			}
+			switch fl.Prioritizer {
+			case "", "fifo":
+			case "even_owners":
+				lc.Prioritizer = &fpb.LicenseConfig_EvenOwners{}
+			default:
+				return fmt.Errorf("license %s: unknown prioritizer %q - must be fifo or even_owners", name, fl.Prioritizer)
+			}
+			config.LicenseConfigs = append(config.LicenseConfigs, lc)
+		} else {
+			existing = len(lic.allocations)
+			if fl.Quantity == 0 {
+				fl.Quantity = lic.totalAvailable
+			}
+		}
+
+		allocated, err := fl.toEntries(fl.Allocated, now)
+		if err != nil {
+			return err
+		}
+		queued, err := fl.toEntries(fl.Queued, now)
+		if err != nil {
+			return err
+		}
+		if existing+len(allocated) > fl.Quantity {
+			return fmt.Errorf("license %s: %d allocations exceed the %d seats available", name, existing+len(allocated), fl.Quantity)
+		}
+		todo = append(todo, pending{name: name, quantity: fl.Quantity, allocated: allocated, queued: queued})
+	}
+
+	for name, lic := range licensesFromConfig(config) {
+		s.licenses[name] = lic
+	}
+	for _, p := range todo {
+		lic := s.licenses[p.name]
+		lic.totalAvailable = p.quantity
+		for _, entry := range p.allocated {
+			lic.Allocate(entry.inv)
+		}
+		for _, entry := range p.queued {
+			lic.Enqueue(entry.inv)
+			if lic.shadows != nil {
+				lic.shadows.liveEnqueued[entry.inv.ID] = entry.at
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+	"github.com/System233/enkit/lib/testutil"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testFixture documents the schema of fixtures, as loaded with --dev_fixture.
+const testFixture = `
+licenses:
+  # Licenses already in the service config keep their prioritizer.
+  # Their number of seats is kept unless a quantity is specified.
+  - vendor: xilinx
+    feature: feature_foo
+    allocated:
+      - id: build-1      # IDs are generated if not specified.
+        owner: alice
+        build_tag: tag_1
+        age: 10m          # Allocated 10 minutes before the fixture was applied.
+      - owner: bob
+    queued:
+      # Invocations are queued from the oldest, regardless of their order here.
+      - owner: carol
+        build_tag: tag_3
+        age: 1m
+      - owner: dave
+        age: 1h30m
+
+  # Other licenses are added, with a fifo (default) or even_owners prioritizer.
+  - vendor: cadence
+    feature: sim
+    quantity: 3
+    prioritizer: even_owners
+    allocated:
+      - owner: erin
+`
+
+func loadTestFixture(t *testing.T, name, content string) *Fixture {
+	dir, err := ioutil.TempDir("", "fixture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	fixture, err := LoadFixture(path)
+	assert.Nil(t, err)
+	return fixture
+}
+
+func TestFixtureSchema(t *testing.T) {
+	start := time.Now()
+	now := start
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time { return now })
+	defer stubs.Reset()
+
+	s := testService(stateStarting)
+	s.EnableDevMode()
+	assert.Nil(t, s.ApplyFixture(loadTestFixture(t, "fixture.yaml", testFixture)))
+
+	want := &fpb.LicensesStatusResponse{
+		LicenseStats: []*fpb.LicenseStats{
+			&fpb.LicenseStats{
+				License:           &fpb.License{Vendor: "cadence", Feature: "sim"},
+				TotalLicenseCount: 3,
+				AllocatedCount:    1,
+				AllocatedInvocations: []*fpb.Invocation{
+					&fpb.Invocation{Id: "4", Owner: "erin"},
+				},
+				QueuedInvocations: []*fpb.Invocation{},
+				Timestamp:         timestamppb.New(start),
+			},
+			&fpb.LicenseStats{
+				License:           &fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+				TotalLicenseCount: 2,
+				AllocatedCount:    2,
+				QueuedCount:       2,
+				AllocatedInvocations: []*fpb.Invocation{
+					&fpb.Invocation{Id: "1", Owner: "bob"},
+					&fpb.Invocation{Id: "build-1", Owner: "alice", BuildTag: "tag_1"},
+				},
+				QueuedInvocations: []*fpb.Invocation{
+					&fpb.Invocation{Id: "3", Owner: "dave"},
+					&fpb.Invocation{Id: "2", Owner: "carol", BuildTag: "tag_3"},
+				},
+				Timestamp: timestamppb.New(start),
+			},
+		},
+	}
+	got, err := s.LicensesStatus(context.Background(), &fpb.LicensesStatusRequest{Verbose: true})
+	assert.Nil(t, err)
+	testutil.AssertProtoEqual(t, want, got)
+	assert.IsType(t, &EvenOwnersPrioritizer{}, s.licenses["cadence::sim"].prioritizer)
+
+	// Nothing refreshes the invocations of a fixture, they must not expire.
+	now = start.Add(24 * time.Hour)
+	s.janitor()
+	for _, stats := range want.LicenseStats {
+		stats.Timestamp = timestamppb.New(now)
+	}
+	got, err = s.LicensesStatus(context.Background(), &fpb.LicensesStatusRequest{Verbose: true})
+	assert.Nil(t, err)
+	testutil.AssertProtoEqual(t, want, got)
+}
+
+func TestFixtureJSON(t *testing.T) {
+	s := testService(stateStarting)
+	s.EnableDevMode()
+	fixture := loadTestFixture(t, "fixture.json", `{"licenses": [{"vendor": "xilinx", "feature": "feature_foo", "quantity": 5, "queued": [{"id": "q1", "owner": "alice", "age": "5m"}]}]}`)
+	assert.Nil(t, s.ApplyFixture(fixture))
+
+	lic := s.licenses["xilinx::feature_foo"]
+	assert.Equal(t, 5, lic.totalAvailable)
+	inv, pos := lic.GetQueued("q1")
+	assert.Equal(t, Position(1), pos)
+	assert.Equal(t, "alice", inv.Owner)
+}
+
+func TestFixtureProductionRefused(t *testing.T) {
+	s := testService(stateRunning)
+	err := s.ApplyFixture(loadTestFixture(t, "fixture.yaml", testFixture))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(s.licenses))
+	assert.Equal(t, 0, len(s.licenses["xilinx::feature_foo"].allocations))
+}
+
+func TestFixtureInvalid(t *testing.T) {
+	for desc, fixture := range map[string]*Fixture{
+		"missing feature":     {Licenses: []FixtureLicense{{Vendor: "xilinx"}}},
+		"duplicate license":   {Licenses: []FixtureLicense{{Vendor: "a", Feature: "b", Quantity: 1}, {Vendor: "a", Feature: "b", Quantity: 1}}},
+		"unknown prioritizer": {Licenses: []FixtureLicense{{Vendor: "a", Feature: "b", Prioritizer: "random"}}},
+		"invalid age":         {Licenses: []FixtureLicense{{Vendor: "a", Feature: "b", Queued: []FixtureInvocation{{Age: "yesterday"}}}}},
+		"negative age":        {Licenses: []FixtureLicense{{Vendor: "a", Feature: "b", Queued: []FixtureInvocation{{Age: "-5m"}}}}},
+		"too many allocations": {Licenses: []FixtureLicense{
+			{Vendor: "a", Feature: "b", Quantity: 1},
+			{Vendor: "xilinx", Feature: "feature_foo", Allocated: []FixtureInvocation{{}, {}, {}}},
+		}},
+	} {
+		t.Run(desc, func(t *testing.T) {
+			s := testService(stateStarting)
+			s.EnableDevMode()
+			assert.NotNil(t, s.ApplyFixture(fixture))
+			// Invalid fixtures are not applied, not even in part.
+			assert.Equal(t, 1, len(s.licenses))
+		})
+	}
+}
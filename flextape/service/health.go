@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricLicenseHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "license_server_healthy",
+		Help:      "1 if the health check of the license server succeeds, 0 otherwise",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+		},
+	)
+	metricLicenseHealthTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "license_server_health_transitions",
+		Help:      "Number of times the health of the license server changed",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+			// The new health state.
+			"health",
+		},
+	)
+)
+
+// HealthChecker probes the license server providing a license.
+type HealthChecker interface {
+	// Check returns nil if the license server is healthy, a description of
+	// the problem otherwise.
+	Check(ctx context.Context) error
+}
+
+// ExecChecker considers the license server healthy if the command exits with status 0.
+type ExecChecker struct {
+	Command []string
+}
+
+func (c *ExecChecker) Check(ctx context.Context) error {
+	output, err := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("probe %q failed: %w - output: %q", c.Command, err, output)
+	}
+	return nil
+}
+
+// TCPChecker considers the license server healthy if a TCP connection to Address succeeds.
+type TCPChecker struct {
+	Address string
+}
+
+func (c *TCPChecker) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return fmt.Errorf("connecting to %s failed: %w", c.Address, err)
+	}
+	return conn.Close()
+}
+
+// healthCheck is a HealthChecker configured for a license.
+type healthCheck struct {
+	checker  HealthChecker
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func healthCheckFromConfig(config *fpb.HealthCheck) (*healthCheck, error) {
+	if config == nil {
+		return nil, nil
+	}
+	check := &healthCheck{
+		interval: time.Duration(defaultUint32(config.GetIntervalSeconds(), 30)) * time.Second,
+		timeout:  time.Duration(defaultUint32(config.GetTimeoutSeconds(), 10)) * time.Second,
+	}
+	switch probe := config.Probe.(type) {
+	case *fpb.HealthCheck_Exec:
+		if len(probe.Exec.GetCommand()) == 0 {
+			return nil, fmt.Errorf("exec health check requires a command")
+		}
+		check.checker = &ExecChecker{Command: probe.Exec.GetCommand()}
+	case *fpb.HealthCheck_Tcp:
+		if probe.Tcp.GetAddress() == "" {
+			return nil, fmt.Errorf("tcp health check requires an address")
+		}
+		check.checker = &TCPChecker{Address: probe.Tcp.GetAddress()}
+	default:
+		return nil, fmt.Errorf("health check requires either an exec or tcp probe")
+	}
+	return check, nil
+}
+
+// healthChecksFromConfig returns the health checks configured, by license type.
+func healthChecksFromConfig(config *fpb.Config) (map[string]*healthCheck, error) {
+	checks := map[string]*healthCheck{}
+	for _, l := range config.GetLicenseConfigs() {
+		name := formatLicenseType(l.GetLicense())
+		check, err := healthCheckFromConfig(l.GetHealthCheck())
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check for license %q: %w", name, err)
+		}
+		if check != nil {
+			checks[name] = check
+		}
+	}
+	return checks, nil
+}
+
+// licenseHealth tracks the health of the license server of a license.
+type licenseHealth struct {
+	err     error     // Error returned by the last check, nil if healthy.
+	changed time.Time // Time of the last health transition.
+}
+
+// SetHealth records the result of a health check of the license server.
+//
+// While unhealthy, queued invocations are not promoted to allocations.
+// Transitions are logged, to leave a trail explaining allocation delays.
+func (l *license) SetHealth(err error) {
+	if l.health == nil {
+		l.health = &licenseHealth{changed: timeNow()}
+		metricLicenseHealthy.WithLabelValues(l.name).Set(1)
+	}
+	wasHealthy := l.health.err == nil
+	l.health.err = err
+	if wasHealthy == (err == nil) {
+		return
+	}
+
+	l.health.changed = timeNow()
+	if err != nil {
+		log.Printf("AUDIT: license %s license server UNHEALTHY, pausing allocations - %v", l.name, err)
+		metricLicenseHealthy.WithLabelValues(l.name).Set(0)
+		metricLicenseHealthTransitions.WithLabelValues(l.name, fpb.LicenseHealth_UNHEALTHY.String()).Inc()
+		return
+	}
+	log.Printf("AUDIT: license %s license server HEALTHY again, resuming allocations", l.name)
+	metricLicenseHealthy.WithLabelValues(l.name).Set(1)
+	metricLicenseHealthTransitions.WithLabelValues(l.name, fpb.LicenseHealth_HEALTHY.String()).Inc()
+}
+
+// Healthy returns true unless the last health check of the license server failed.
+func (l *license) Healthy() bool {
+	return l.health == nil || l.health.err == nil
+}
+
+// checkHealth runs a single health check for the license, and updates its state.
+func (s *Service) checkHealth(ctx context.Context, licenseType string, check *healthCheck) {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	err := check.checker.Check(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lic, ok := s.licenses[licenseType]
+	if !ok {
+		return
+	}
+	recovered := !lic.Healthy() && err == nil
+	lic.SetHealth(err)
+	if recovered && s.currentState == stateRunning {
+		lic.Promote()
+	}
+}
+
+// monitorHealth periodically runs the health check of a license, forever.
+func (s *Service) monitorHealth(licenseType string, check *healthCheck) {
+	t := time.NewTicker(check.interval)
+	defer t.Stop()
+	for {
+		s.checkHealth(context.Background(), licenseType, check)
+		<-t.C
+	}
+}
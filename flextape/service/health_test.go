@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChecker returns err from Check, allowing tests to flip the license server health.
+type fakeChecker struct {
+	err error
+}
+
+func (f *fakeChecker) Check(ctx context.Context) error {
+	return f.err
+}
+
+func TestHealthPausesPromotions(t *testing.T) {
+	start := time.Now()
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := testService(stateRunning)
+	checker := &fakeChecker{}
+	check := &healthCheck{checker: checker, interval: time.Second, timeout: time.Second}
+	ctx := context.Background()
+	req := func(id string) *fpb.AllocateRequest {
+		return &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+			Owner:    "unit_test",
+			BuildTag: "tag_1234",
+			Id:       id,
+			Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+		}}
+	}
+
+	server.checkHealth(ctx, "xilinx::feature_foo", check)
+	resp, err := server.Allocate(ctx, req(""))
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.GetLicenseAllocated())
+
+	// License server dies: seats are not handed out, and the reason is reported.
+	*now = now.Add(time.Second)
+	checker.err = fmt.Errorf("lmstat: cannot connect to license server")
+	server.checkHealth(ctx, "xilinx::feature_foo", check)
+
+	resp, err = server.Allocate(ctx, req(""))
+	assert.Nil(t, err)
+	queued := resp.GetQueued()
+	assert.NotNil(t, queued)
+	assert.Equal(t, uint32(1), queued.GetQueuePosition())
+	assert.True(t, strings.Contains(queued.GetMessage(), "cannot connect to license server"), queued.GetMessage())
+
+	server.janitor()
+	resp, err = server.Allocate(ctx, req(queued.GetInvocationId()))
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.GetQueued())
+
+	status, err := server.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, fpb.LicenseHealth_UNHEALTHY, status.GetLicenseStats()[0].GetHealth())
+	assert.Equal(t, checker.err.Error(), status.GetLicenseStats()[0].GetHealthMessage())
+	assert.Equal(t, now.Unix(), status.GetLicenseStats()[0].GetHealthChanged().AsTime().Unix())
+
+	// Recovery resumes promotions right away.
+	*now = now.Add(time.Second)
+	checker.err = nil
+	server.checkHealth(ctx, "xilinx::feature_foo", check)
+
+	resp, err = server.Allocate(ctx, req(queued.GetInvocationId()))
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.GetLicenseAllocated())
+
+	status, err = server.LicensesStatus(ctx, &fpb.LicensesStatusRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, fpb.LicenseHealth_HEALTHY, status.GetLicenseStats()[0].GetHealth())
+	assert.Equal(t, "", status.GetLicenseStats()[0].GetHealthMessage())
+	assert.Equal(t, now.Unix(), status.GetLicenseStats()[0].GetHealthChanged().AsTime().Unix())
+}
+
+func TestHealthCheckFromConfig(t *testing.T) {
+	check, err := healthCheckFromConfig(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, check)
+
+	_, err = healthCheckFromConfig(&fpb.HealthCheck{})
+	assert.NotNil(t, err)
+	_, err = healthCheckFromConfig(&fpb.HealthCheck{Probe: &fpb.HealthCheck_Exec{Exec: &fpb.ExecProbe{}}})
+	assert.NotNil(t, err)
+
+	check, err = healthCheckFromConfig(&fpb.HealthCheck{Probe: &fpb.HealthCheck_Exec{Exec: &fpb.ExecProbe{Command: []string{"false"}}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, check.interval)
+	assert.Equal(t, 10*time.Second, check.timeout)
+	assert.NotNil(t, check.checker.Check(context.Background()))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	check, err = healthCheckFromConfig(&fpb.HealthCheck{
+		Probe:           &fpb.HealthCheck_Tcp{Tcp: &fpb.TCPProbe{Address: listener.Addr().String()}},
+		IntervalSeconds: 5,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, check.interval)
+	assert.Nil(t, check.checker.Check(context.Background()))
+	listener.Close()
+	assert.NotNil(t, check.checker.Check(context.Background()))
+}
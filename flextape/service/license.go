@@ -1,6 +1,7 @@
 package service
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -43,6 +44,35 @@ var (
 			"license_type",
 		},
 	)
+	// The metrics below are labeled by vendor and feature, both from config.
+	metricLicenseTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "license_total",
+		Help:      "The total number of seats configured for a license",
+	},
+		[]string{"vendor", "feature"},
+	)
+	metricLicenseAllocated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "license_allocated",
+		Help:      "The number of seats of a license currently allocated to invocations",
+	},
+		[]string{"vendor", "feature"},
+	)
+	metricLicenseQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "license_queued",
+		Help:      "The number of invocations queued waiting for a seat of a license",
+	},
+		[]string{"vendor", "feature"},
+	)
+	metricLicenseInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "flextape",
+		Name:      "license_info",
+		Help:      "Always 1, labeled with the configuration of a license",
+	},
+		[]string{"vendor", "feature", "prioritizer"},
+	)
 	metricLicenseReleaseReason = promauto.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "flextape",
 		Name:      "license_release_count",
@@ -59,9 +89,19 @@ type license struct {
 	name           string                 // Name of the license, in vendor::feature format
 	totalAvailable int                    // Constant total number of licenses available for invocations.
 	allocations    map[string]*invocation // Map of invocation ID to invocation data for an allocated license.
+	maxPerOwner    int                    // Maximum seats allocated to invocations of the same owner, 0 for no limit.
+	maxPerBuildTag int                    // Maximum seats allocated to invocations with the same build tag, 0 for no limit.
 
 	queue       invocationQueue // List of invocations waiting for a license, in FIFO order.
 	prioritizer Prioritizer
+
+	health *licenseHealth // Health of the license server, nil if never checked.
+
+	template *licenseTemplate // Template rendered for allocations, nil if none configured.
+
+	shadows *shadowSet // Shadow prioritizers evaluated on the same requests, nil if none configured.
+
+	notifier *notifier // Notifies owners of invocations reaching the front of the queue, nil if none configured.
 }
 
 // formatLicenseType returns a unique string for a particular vendor/feature
@@ -70,6 +110,15 @@ func formatLicenseType(l *fpb.License) string {
 	return strings.Join([]string{l.GetVendor(), l.GetFeature()}, "::")
 }
 
+// parseLicenseType returns the vendor and feature of a license type returned by formatLicenseType.
+func parseLicenseType(name string) (string, string) {
+	fields := strings.SplitN(name, "::", 2)
+	if len(fields) != 2 {
+		return "<UNKNOWN>", name
+	}
+	return fields[0], fields[1]
+}
+
 // Enqueue puts the supplied invocation at the back of the queue. Returns the
 // 1-based index the invocation was queued at.
 func (l *license) Enqueue(inv *invocation) Position {
@@ -77,6 +126,7 @@ func (l *license) Enqueue(inv *invocation) Position {
 
 	l.queue.Enqueue(inv)
 	l.prioritizer.OnEnqueue(inv)
+	l.shadows.OnEnqueue(l, inv)
 
 	l.queue.Sort(l.prioritizer.Sorter())
 	return l.queue.Position(inv)
@@ -90,27 +140,128 @@ func (l *license) Allocate(inv *invocation) bool {
 		return false
 	}
 	l.prioritizer.OnAllocate(inv)
+	l.shadows.OnAdopt(l, inv)
+	l.assignSeat(inv)
 	l.allocations[inv.ID] = inv
 	return true
 }
 
+// assignSeat assigns the lowest free seat to an invocation being allocated.
+//
+// Seats are tracked only for licenses with a template, the only consumer of
+// seat indexes. The seat is retained until the allocation is released or expires.
+func (l *license) assignSeat(inv *invocation) {
+	if l.template == nil {
+		return
+	}
+	used := map[int]bool{}
+	for _, a := range l.allocations {
+		used[a.Seat] = true
+	}
+	seat := 1
+	for used[seat] {
+		seat++
+	}
+	inv.Seat = seat
+}
+
+// Material returns the license template rendered for an allocated invocation, or nil if no template is configured.
+func (l *license) Material(inv *invocation) (*fpb.LicenseMaterial, error) {
+	if l.template == nil {
+		return nil, nil
+	}
+	return l.template.Render(inv)
+}
+
 // Promote attempts to promote queued requests to allocations until either no
 // licenses remain or no queued requests remain.
+//
+// Nothing is promoted while the license server is unhealthy.
 func (l *license) Promote() {
 	defer l.updateMetrics()
+	// Shadow prioritizers release and promote even while unhealthy, promotions are delayed in the simulation too.
+	defer l.shadows.Advance(l)
+	defer l.notifier.Advance(l)
+	if !l.Healthy() {
+		return
+	}
 	numFree := l.totalAvailable - len(l.allocations)
+	held := l.seatsHeld()
 	for i := 0; i < numFree && l.queue.Len() > 0; i++ {
 		l.queue.Sort(l.prioritizer.Sorter())
 
-		invocation := l.queue.Dequeue()
+		invocation := l.dequeuePromotable(held)
+		if invocation == nil {
+			// All queued invocations are held back by the per owner or per build tag limits.
+			break
+		}
+		held.Add(invocation)
 
 		l.prioritizer.OnDequeue(invocation)
 		l.prioritizer.OnAllocate(invocation)
+		l.shadows.OnPromote(l, invocation)
+		l.notifier.OnPromote(l, invocation)
+		l.assignSeat(invocation)
 
 		l.allocations[invocation.ID] = invocation
 	}
 }
 
+// seatsHeld counts the seats allocated to each owner and build tag.
+type seatsHeld struct {
+	owners    map[string]int
+	buildTags map[string]int
+}
+
+func (sh *seatsHeld) Add(inv *invocation) {
+	sh.owners[inv.Owner] += 1
+	sh.buildTags[inv.BuildTag] += 1
+}
+
+// seatsHeld returns the seats currently allocated to each owner and build tag.
+func (l *license) seatsHeld() *seatsHeld {
+	held := &seatsHeld{owners: map[string]int{}, buildTags: map[string]int{}}
+	for _, inv := range l.allocations {
+		held.Add(inv)
+	}
+	return held
+}
+
+// limitMessage returns a message explaining why the invocation cannot be allocated
+// a seat due to the per owner or per build tag limits, or the empty string.
+//
+// When both limits are configured, the stricter applies: the invocation is held
+// back as soon as either is reached.
+func (l *license) limitMessage(held *seatsHeld, inv *invocation) string {
+	if l.maxPerOwner > 0 && held.owners[inv.Owner] >= l.maxPerOwner {
+		return fmt.Sprintf("owner %q already holds the maximum of %d seats of %s allowed per owner - waiting for one of them to be released",
+			inv.Owner, held.owners[inv.Owner], l.name)
+	}
+	// Invocations without a build tag are unrelated to each other, and are not limited.
+	if l.maxPerBuildTag > 0 && inv.BuildTag != "" && held.buildTags[inv.BuildTag] >= l.maxPerBuildTag {
+		return fmt.Sprintf("build tag %q already holds the maximum of %d seats of %s allowed per build tag - waiting for one of them to be released",
+			inv.BuildTag, held.buildTags[inv.BuildTag], l.name)
+	}
+	return ""
+}
+
+// dequeuePromotable removes and returns the first queued invocation that can be
+// allocated a seat within the per owner and per build tag limits, or nil if none can.
+//
+// Invocations held back by the limits keep their position in the queue.
+func (l *license) dequeuePromotable(held *seatsHeld) *invocation {
+	if l.maxPerOwner <= 0 && l.maxPerBuildTag <= 0 {
+		return l.queue.Dequeue()
+	}
+	inv, _ := l.queue.Walk(func(pos Position, inv *invocation) bool {
+		return l.limitMessage(held, inv) != ""
+	})
+	if inv == nil {
+		return nil
+	}
+	return l.queue.Forget(inv.ID)
+}
+
 // GetAllocated returns an invocation by ID if the invocation is allocated a
 // license, or nil otherwise.
 func (l *license) GetAllocated(invID string) *invocation {
@@ -123,8 +274,9 @@ func (l *license) ExpireAllocations(expiry time.Time) {
 	defer l.updateMetrics()
 	newAllocations := map[string]*invocation{}
 	for k, v := range l.allocations {
-		if !v.LastCheckin.After(expiry) {
+		if !v.Pinned && !v.LastCheckin.After(expiry) {
 			l.prioritizer.OnRelease(v)
+			l.shadows.OnRelease(l, v)
 			metricLicenseReleaseReason.WithLabelValues("allocated_expired").Inc()
 			continue
 		}
@@ -138,11 +290,12 @@ func (l *license) ExpireAllocations(expiry time.Time) {
 func (l *license) ExpireQueued(expiry time.Time) {
 	defer l.updateMetrics()
 	l.queue.Filter(func(pos Position, inv *invocation) bool {
-		if inv.LastCheckin.After(expiry) {
+		if inv.Pinned || inv.LastCheckin.After(expiry) {
 			return false
 		}
 
 		l.prioritizer.OnDequeue(inv)
+		l.shadows.OnWithdraw(l, inv)
 		metricLicenseReleaseReason.WithLabelValues("queued_expired").Inc()
 		return true
 	})
@@ -158,10 +311,7 @@ func (l *license) GetQueued(invID string) (*invocation, Position) {
 
 // GetStats returns a LicenseStats message for this license type.
 func (l *license) GetStats() *fpb.LicenseStats {
-	fields := strings.SplitN(l.name, "::", 2)
-	if len(fields) != 2 {
-		fields = []string{"<UNKNOWN>", l.name}
-	}
+	vendor, feature := parseLicenseType(l.name)
 	allocated := []*fpb.Invocation{}
 	for _, inv := range l.allocations {
 		allocated = append(allocated, inv.ToProto())
@@ -172,10 +322,10 @@ func (l *license) GetStats() *fpb.LicenseStats {
 		queued = append(queued, inv.ToProto())
 		return true
 	})
-	return &fpb.LicenseStats{
+	stats := &fpb.LicenseStats{
 		License: &fpb.License{
-			Vendor:  fields[0],
-			Feature: fields[1],
+			Vendor:  vendor,
+			Feature: feature,
 		},
 		Timestamp:            timestamppb.New(timeNow()),
 		TotalLicenseCount:    uint32(l.totalAvailable),
@@ -184,6 +334,24 @@ func (l *license) GetStats() *fpb.LicenseStats {
 		QueuedCount:          uint32(l.queue.Len()),
 		QueuedInvocations:    queued,
 	}
+	if l.health != nil {
+		stats.HealthChanged = timestamppb.New(l.health.changed)
+		if l.health.err != nil {
+			stats.Health = fpb.LicenseHealth_UNHEALTHY
+			stats.HealthMessage = l.health.err.Error()
+		}
+	}
+	return stats
+}
+
+// QueuedMessage returns a message explaining why a queued invocation is not
+// being allocated a license, other than contention, or the empty string.
+func (l *license) QueuedMessage(inv *invocation) string {
+	if l.Healthy() {
+		return l.limitMessage(l.seatsHeld(), inv)
+	}
+	return fmt.Sprintf("license server for %s is unhealthy since %s, allocations are paused until it recovers - %v",
+		l.name, l.health.changed.Format(time.RFC3339), l.health.err)
 }
 
 // Forget removes invocations matching the specified ID from allocations and
@@ -195,6 +363,7 @@ func (l *license) Forget(invID string) int {
 	for k, v := range l.allocations {
 		if k == invID {
 			l.prioritizer.OnRelease(v)
+			l.shadows.OnRelease(l, v)
 			count++
 			continue
 		}
@@ -204,6 +373,7 @@ func (l *license) Forget(invID string) int {
 
 	if inv := l.queue.Forget(invID); inv != nil {
 		l.prioritizer.OnDequeue(inv)
+		l.shadows.OnWithdraw(l, inv)
 		count += 1
 	}
 
@@ -215,4 +385,9 @@ func (l *license) updateMetrics() {
 	metricActiveCount.WithLabelValues(l.name).Set(float64(len(l.allocations)))
 	metricQueueSize.WithLabelValues(l.name).Set(float64(l.queue.Len()))
 	metricTotalLicenses.WithLabelValues(l.name).Set(float64(l.totalAvailable))
+
+	vendor, feature := parseLicenseType(l.name)
+	metricLicenseTotal.WithLabelValues(vendor, feature).Set(float64(l.totalAvailable))
+	metricLicenseAllocated.WithLabelValues(vendor, feature).Set(float64(len(l.allocations)))
+	metricLicenseQueued.WithLabelValues(vendor, feature).Set(float64(l.queue.Len()))
 }
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrape returns the value of the series of the metric name with the labels specified, or nil if not found.
+func scrape(t *testing.T, name string, labels map[string]string) *float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			value := metric.GetGauge().GetValue()
+			return &value
+		}
+	}
+	return nil
+}
+
+func assertGauge(t *testing.T, want float64, name string, labels map[string]string) {
+	t.Helper()
+	got := scrape(t, name, labels)
+	if assert.NotNil(t, got, "metric %s%v not found", name, labels) {
+		assert.Equal(t, want, *got, "metric %s%v", name, labels)
+	}
+}
+
+// metricsAllocate requests a metrics::even license for owner, returning the ID of the invocation.
+func metricsAllocate(t *testing.T, server *Service, owner string) string {
+	t.Helper()
+	resp, err := server.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    owner,
+		Licenses: []*fpb.License{{Vendor: "metrics", Feature: "even"}},
+	}})
+	assert.NoError(t, err)
+	switch r := resp.GetResponseType().(type) {
+	case *fpb.AllocateResponse_LicenseAllocated:
+		return r.LicenseAllocated.GetInvocationId()
+	case *fpb.AllocateResponse_Queued:
+		return r.Queued.GetInvocationId()
+	}
+	t.Fatalf("unexpected response %v", resp)
+	return ""
+}
+
+func TestLicenseMetrics(t *testing.T) {
+	start := time.Now()
+	now := start
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return now
+	})
+	defer stubs.Reset()
+
+	server := &Service{
+		currentState: stateRunning,
+		licenses: licensesFromConfig(&fpb.Config{
+			LicenseConfigs: []*fpb.LicenseConfig{{
+				Quantity:    2,
+				Prioritizer: &fpb.LicenseConfig_EvenOwners{},
+				License:     &fpb.License{Vendor: "metrics", Feature: "even"},
+			}, {
+				Quantity: 5,
+				License:  &fpb.License{Vendor: "metrics", Feature: "fifo"},
+			}},
+		}),
+		queueRefreshDuration:      5 * time.Second,
+		allocationRefreshDuration: 7 * time.Second,
+	}
+	even := map[string]string{"vendor": "metrics", "feature": "even"}
+	fifo := map[string]string{"vendor": "metrics", "feature": "fifo"}
+
+	// Series are exported as soon as the licenses are configured.
+	assertGauge(t, 1, "flextape_license_info", map[string]string{"vendor": "metrics", "feature": "even", "prioritizer": "even_owners"})
+	assertGauge(t, 1, "flextape_license_info", map[string]string{"vendor": "metrics", "feature": "fifo", "prioritizer": "fifo"})
+	assertGauge(t, 2, "flextape_license_total", even)
+	assertGauge(t, 5, "flextape_license_total", fifo)
+	assertGauge(t, 0, "flextape_license_allocated", even)
+	assertGauge(t, 0, "flextape_license_queued", even)
+
+	// Two seats allocated, the third request is queued.
+	ids := []string{}
+	for _, owner := range []string{"donnie", "joe", "george"} {
+		ids = append(ids, metricsAllocate(t, server, owner))
+	}
+	assertGauge(t, 2, "flextape_license_allocated", even)
+	assertGauge(t, 1, "flextape_license_queued", even)
+	assertGauge(t, 0, "flextape_license_allocated", fifo)
+
+	// Releasing a seat promotes the queued invocation.
+	shadowRelease(t, server, ids[0])
+	assertGauge(t, 2, "flextape_license_allocated", even)
+	assertGauge(t, 0, "flextape_license_queued", even)
+
+	shadowRelease(t, server, ids[1])
+	assertGauge(t, 1, "flextape_license_allocated", even)
+
+	// Allocations expire once they stop checking in.
+	now = start.Add(time.Minute)
+	server.janitor()
+	assertGauge(t, 0, "flextape_license_allocated", even)
+	assertGauge(t, 2, "flextape_license_total", even)
+}
+
+// limitsAllocate requests a limits::seat license, returning the ID of the invocation and the response.
+func limitsAllocate(t *testing.T, server *Service, owner, buildTag, id string) (string, *fpb.AllocateResponse) {
+	t.Helper()
+	resp, err := server.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Id:       id,
+		Owner:    owner,
+		BuildTag: buildTag,
+		Licenses: []*fpb.License{{Vendor: "limits", Feature: "seat"}},
+	}})
+	assert.NoError(t, err)
+	if id = resp.GetLicenseAllocated().GetInvocationId(); id == "" {
+		id = resp.GetQueued().GetInvocationId()
+	}
+	return id, resp
+}
+
+func limitsTestService(quantity, maxPerOwner, maxPerBuildTag uint32) *Service {
+	return &Service{
+		currentState: stateRunning,
+		licenses: licensesFromConfig(&fpb.Config{
+			LicenseConfigs: []*fpb.LicenseConfig{{
+				Quantity:       quantity,
+				MaxPerOwner:    maxPerOwner,
+				MaxPerBuildTag: maxPerBuildTag,
+				License:        &fpb.License{Vendor: "limits", Feature: "seat"},
+			}},
+		}),
+		queueRefreshDuration:      5 * time.Second,
+		allocationRefreshDuration: 5 * time.Second,
+	}
+}
+
+func TestLicenseBuildTagLimit(t *testing.T) {
+	now := time.Now()
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return now
+	})
+	defer stubs.Reset()
+
+	server := limitsTestService(4, 0, 2)
+	shard1, resp := limitsAllocate(t, server, "ci", "matrix", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+	_, resp = limitsAllocate(t, server, "ci", "matrix", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+
+	// The build tag holds all the seats allowed, even if more are free.
+	shard3, resp := limitsAllocate(t, server, "ci", "matrix", "")
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+	assert.Equal(t, `build tag "matrix" already holds the maximum of 2 seats of limits::seat allowed per build tag - waiting for one of them to be released`,
+		resp.GetQueued().GetMessage())
+
+	// Other build tags, and invocations without one, are promoted past it.
+	_, resp = limitsAllocate(t, server, "ci", "nightly", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+	_, resp = limitsAllocate(t, server, "alice", "", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+	other, resp := limitsAllocate(t, server, "ci", "nightly", "")
+	assert.Equal(t, uint32(2), resp.GetQueued().GetQueuePosition())
+	assert.Equal(t, "", resp.GetQueued().GetMessage())
+
+	// Once a seat is released, the queued shard keeps its turn.
+	_, err := server.Release(context.Background(), &fpb.ReleaseRequest{InvocationId: shard1})
+	assert.NoError(t, err)
+	server.janitor()
+	_, resp = limitsAllocate(t, server, "ci", "matrix", shard3)
+	assert.NotNil(t, resp.GetLicenseAllocated())
+	_, resp = limitsAllocate(t, server, "ci", "nightly", other)
+	assert.Equal(t, uint32(1), resp.GetQueued().GetQueuePosition())
+	assert.Equal(t, "", resp.GetQueued().GetMessage())
+}
+
+func TestLicenseOwnerAndBuildTagLimits(t *testing.T) {
+	now := time.Now()
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return now
+	})
+	defer stubs.Reset()
+
+	// The owner limit is the stricter.
+	server := limitsTestService(5, 2, 3)
+	for i := 0; i < 2; i++ {
+		_, resp := limitsAllocate(t, server, "ci", "matrix", "")
+		assert.NotNil(t, resp.GetLicenseAllocated())
+	}
+	_, resp := limitsAllocate(t, server, "ci", "matrix", "")
+	assert.Contains(t, resp.GetQueued().GetMessage(), `owner "ci" already holds the maximum of 2 seats`)
+	_, resp = limitsAllocate(t, server, "ci", "nightly", "")
+	assert.Contains(t, resp.GetQueued().GetMessage(), `owner "ci" already holds the maximum of 2 seats`)
+
+	// The build tag limit still applies across owners.
+	_, resp = limitsAllocate(t, server, "bob", "matrix", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+	_, resp = limitsAllocate(t, server, "carol", "matrix", "")
+	assert.Contains(t, resp.GetQueued().GetMessage(), `build tag "matrix" already holds the maximum of 3 seats`)
+	_, resp = limitsAllocate(t, server, "carol", "nightly", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+
+	// The build tag limit is the stricter.
+	server = limitsTestService(5, 3, 1)
+	_, resp = limitsAllocate(t, server, "ci", "matrix", "")
+	assert.NotNil(t, resp.GetLicenseAllocated())
+	_, resp = limitsAllocate(t, server, "ci", "matrix", "")
+	assert.Contains(t, resp.GetQueued().GetMessage(), `build tag "matrix" already holds the maximum of 1 seats`)
+	for _, tag := range []string{"nightly", "release"} {
+		_, resp = limitsAllocate(t, server, "ci", tag, "")
+		assert.NotNil(t, resp.GetLicenseAllocated())
+	}
+	_, resp = limitsAllocate(t, server, "ci", "presubmit", "")
+	assert.Contains(t, resp.GetQueued().GetMessage(), `owner "ci" already holds the maximum of 3 seats`)
+}
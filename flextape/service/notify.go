@@ -0,0 +1,219 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "flextape",
+	Name:      "notifications",
+	Help:      "Number of notifications of invocations reaching the front of the queue",
+},
+	[]string{
+		// Either "queued" or "allocated".
+		"event",
+		// One of "sent", "failed", "rate_limited" or "dropped".
+		"result",
+	},
+)
+
+const (
+	// The invocation reached one of the top positions of the queue.
+	NotificationQueued = "queued"
+	// The invocation was allocated a license, after waiting in the queue.
+	NotificationAllocated = "allocated"
+)
+
+// Notification describes an invocation about to be, or just, allocated a license.
+type Notification struct {
+	Event        string `json:"event"`
+	InvocationID string `json:"invocation_id"`
+	Owner        string `json:"owner"`
+	BuildTag     string `json:"build_tag"`
+	License      string `json:"license"`  // In vendor::feature format.
+	Position     uint32 `json:"position"` // 1 based position in the queue, 0 once allocated.
+}
+
+// Notifier delivers notifications to the owners of invocations.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// ExecNotifier runs a command for each notification, described by FLEXTAPE_* environment variables.
+type ExecNotifier struct {
+	Command []string
+}
+
+func (e *ExecNotifier) Notify(ctx context.Context, n *Notification) error {
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"FLEXTAPE_EVENT="+n.Event,
+		"FLEXTAPE_INVOCATION_ID="+n.InvocationID,
+		"FLEXTAPE_OWNER="+n.Owner,
+		"FLEXTAPE_BUILD_TAG="+n.BuildTag,
+		"FLEXTAPE_LICENSE="+n.License,
+		"FLEXTAPE_POSITION="+strconv.FormatUint(uint64(n.Position), 10),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notification command %q failed: %w - output: %q", e.Command, err, output)
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs each notification to URL, in json format.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("notification webhook %s failed: %w", w.URL, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook %s failed with status %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// notifier decides which invocations to notify about, and delivers the notifications in the background.
+//
+// Notifications are queued without blocking, so that neither the janitor nor
+// the RPCs holding the service lock ever wait for a hook to run.
+type notifier struct {
+	hook     Notifier
+	top      Position      // Invocations are notified when reaching this position or better.
+	interval time.Duration // Minimum interval between notifications for the same owner.
+	timeout  time.Duration // Maximum time a single hook invocation can take.
+
+	pending chan *Notification // Notifications waiting to be delivered.
+
+	mu   sync.Mutex
+	last map[string]time.Time // Time each owner was last notified. Protected by mu.
+}
+
+func notifierFromConfig(config *fpb.Notification) (*notifier, error) {
+	if config == nil {
+		return nil, nil
+	}
+	n := &notifier{
+		top:      Position(defaultUint32(config.GetTopPositions(), 1)),
+		interval: time.Duration(defaultUint32(config.GetMinIntervalSeconds(), 60)) * time.Second,
+		timeout:  time.Duration(defaultUint32(config.GetTimeoutSeconds(), 10)) * time.Second,
+		pending:  make(chan *Notification, 100),
+		last:     map[string]time.Time{},
+	}
+	switch hook := config.Hook.(type) {
+	case *fpb.Notification_Exec:
+		if len(hook.Exec.GetCommand()) == 0 {
+			return nil, fmt.Errorf("exec notification requires a command")
+		}
+		n.hook = &ExecNotifier{Command: hook.Exec.GetCommand()}
+	case *fpb.Notification_Webhook:
+		if hook.Webhook.GetUrl() == "" {
+			return nil, fmt.Errorf("webhook notification requires a url")
+		}
+		n.hook = &WebhookNotifier{URL: hook.Webhook.GetUrl()}
+	default:
+		return nil, fmt.Errorf("notification requires either a webhook or exec hook")
+	}
+	return n, nil
+}
+
+// send queues a notification for delivery, unless the owner was notified too recently, or too many are pending.
+func (n *notifier) send(l *license, event string, inv *invocation, pos Position) {
+	now := timeNow()
+	n.mu.Lock()
+	if last, found := n.last[inv.Owner]; found && now.Sub(last) < n.interval {
+		n.mu.Unlock()
+		metricNotifications.WithLabelValues(event, "rate_limited").Inc()
+		return
+	}
+	n.last[inv.Owner] = now
+	n.mu.Unlock()
+
+	notification := &Notification{
+		Event:        event,
+		InvocationID: inv.ID,
+		Owner:        inv.Owner,
+		BuildTag:     inv.BuildTag,
+		License:      l.name,
+		Position:     uint32(pos),
+	}
+	select {
+	case n.pending <- notification:
+	default:
+		metricNotifications.WithLabelValues(event, "dropped").Inc()
+	}
+}
+
+// OnPromote notifies the owner of an invocation allocated a license, if it had to wait for it.
+func (n *notifier) OnPromote(l *license, inv *invocation) {
+	if n == nil || !inv.Waited {
+		return
+	}
+	n.send(l, NotificationAllocated, inv, 0)
+}
+
+// Advance notifies the owners of the invocations that reached the top positions of the queue since the last call.
+//
+// Each invocation is notified at most once while queued.
+func (n *notifier) Advance(l *license) {
+	if n == nil {
+		return
+	}
+	l.queue.Walk(func(pos Position, inv *invocation) bool {
+		inv.Waited = true
+		if pos <= n.top && !inv.Notified {
+			inv.Notified = true
+			n.send(l, NotificationQueued, inv, pos)
+		}
+		return true
+	})
+}
+
+// run delivers the pending notifications, one at a time, forever.
+func (n *notifier) run() {
+	for notification := range n.pending {
+		n.deliver(notification)
+	}
+}
+
+func (n *notifier) deliver(notification *Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	if err := n.hook.Notify(ctx, notification); err != nil {
+		log.Printf("notification of %s for invocation %s failed - %v", notification.Event, notification.InvocationID, err)
+		metricNotifications.WithLabelValues(notification.Event, "failed").Inc()
+		return
+	}
+	metricNotifications.WithLabelValues(notification.Event, "sent").Inc()
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+)
+
+// drain returns the notifications pending delivery.
+func drain(n *notifier) []*Notification {
+	var result []*Notification
+	for {
+		select {
+		case notification := <-n.pending:
+			result = append(result, notification)
+		default:
+			return result
+		}
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	currentTime := time.Now()
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return currentTime
+	})
+	defer stubs.Reset()
+
+	server := testService(stateRunning)
+	server.queueRefreshDuration = time.Hour
+	server.allocationRefreshDuration = time.Hour
+	n := &notifier{top: 2, interval: time.Minute, pending: make(chan *Notification, 10), last: map[string]time.Time{}}
+	server.licenses["xilinx::feature_foo"].notifier = n
+
+	allocate := func(owner string) string {
+		resp, err := server.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+			Owner:    owner,
+			BuildTag: "tag_" + owner,
+			Licenses: []*fpb.License{{Vendor: "xilinx", Feature: "feature_foo"}},
+		}})
+		assert.NoError(t, err)
+		if queued := resp.GetQueued(); queued != nil {
+			return queued.GetInvocationId()
+		}
+		return resp.GetLicenseAllocated().GetInvocationId()
+	}
+	release := func(id string) {
+		_, err := server.Release(context.Background(), &fpb.ReleaseRequest{InvocationId: id})
+		assert.NoError(t, err)
+		server.janitor()
+	}
+
+	// Invocations allocated right away are not notified.
+	first := allocate("alice")
+	allocate("bob")
+	assert.Empty(t, drain(n))
+
+	// Invocations reaching the top 2 positions are notified once, deeper ones are not.
+	allocate("carol")
+	allocate("dave")
+	allocate("erin")
+	server.janitor()
+	assert.Equal(t, []*Notification{
+		{Event: NotificationQueued, InvocationID: "3", Owner: "carol", BuildTag: "tag_carol", License: "xilinx::feature_foo", Position: 1},
+		{Event: NotificationQueued, InvocationID: "4", Owner: "dave", BuildTag: "tag_dave", License: "xilinx::feature_foo", Position: 2},
+	}, drain(n))
+
+	// As the queue moves, the next invocation is notified, and the allocation of a queued invocation too.
+	// carol was notified too recently, so the allocation is not.
+	release(first)
+	assert.Equal(t, []*Notification{
+		{Event: NotificationQueued, InvocationID: "5", Owner: "erin", BuildTag: "tag_erin", License: "xilinx::feature_foo", Position: 2},
+	}, drain(n))
+
+	currentTime = currentTime.Add(2 * time.Minute)
+	release("2")
+	assert.Equal(t, []*Notification{
+		{Event: NotificationAllocated, InvocationID: "4", Owner: "dave", BuildTag: "tag_dave", License: "xilinx::feature_foo", Position: 0},
+	}, drain(n))
+
+	// Nothing changed, nothing is notified.
+	server.janitor()
+	assert.Empty(t, drain(n))
+}
+
+func TestNotificationsDropped(t *testing.T) {
+	n := &notifier{top: 1, interval: time.Minute, pending: make(chan *Notification, 1), last: map[string]time.Time{}}
+	l := &license{name: "xilinx::feature_foo"}
+
+	// Hooks not keeping up don't block the caller.
+	n.send(l, NotificationQueued, &invocation{ID: "1", Owner: "alice"}, 1)
+	n.send(l, NotificationQueued, &invocation{ID: "2", Owner: "bob"}, 1)
+	assert.Equal(t, []*Notification{{Event: NotificationQueued, InvocationID: "1", Owner: "alice", License: "xilinx::feature_foo", Position: 1}}, drain(n))
+}
+
+func TestNotifierFromConfig(t *testing.T) {
+	n, err := notifierFromConfig(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+
+	n, err = notifierFromConfig(&fpb.Notification{Hook: &fpb.Notification_Webhook{Webhook: &fpb.WebhookNotifier{Url: "http://localhost/notify"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, Position(1), n.top)
+	assert.Equal(t, time.Minute, n.interval)
+	assert.Equal(t, 10*time.Second, n.timeout)
+	assert.Equal(t, &WebhookNotifier{URL: "http://localhost/notify"}, n.hook)
+
+	_, err = notifierFromConfig(&fpb.Notification{Hook: &fpb.Notification_Exec{Exec: &fpb.ExecNotifier{}}})
+	assert.ErrorContains(t, err, "requires a command")
+	_, err = notifierFromConfig(&fpb.Notification{})
+	assert.ErrorContains(t, err, "requires either a webhook or exec hook")
+}
+
+func TestNotifiers(t *testing.T) {
+	notification := &Notification{Event: NotificationQueued, InvocationID: "3", Owner: "carol", BuildTag: "tag", License: "xilinx::foo", Position: 1}
+	ctx := context.Background()
+
+	received := make(chan *Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil || r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("invalid request - %v", err), http.StatusBadRequest)
+			return
+		}
+		received <- &n
+	}))
+	defer server.Close()
+
+	assert.Nil(t, (&WebhookNotifier{URL: server.URL}).Notify(ctx, notification))
+	assert.Equal(t, notification, <-received)
+	assert.ErrorContains(t, (&WebhookNotifier{URL: server.URL + "/missing"}).Notify(ctx, notification), "404 Not Found")
+
+	exec := &ExecNotifier{Command: []string{"sh", "-c", `test "$FLEXTAPE_OWNER:$FLEXTAPE_LICENSE:$FLEXTAPE_POSITION" = carol:xilinx::foo:1`}}
+	assert.Nil(t, exec.Notify(ctx, notification))
+	assert.ErrorContains(t, exec.Notify(ctx, &Notification{Owner: "dave"}), "failed")
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -33,6 +34,12 @@ var (
 		Name:      "janitor_duration_seconds",
 		Help:      "Janitor execution time",
 	})
+	metricJanitorLockHold = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "flextape",
+		Name:      "janitor_lock_hold_seconds",
+		Help:      "Time the janitor held the service lock for, per batch of licenses processed",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	})
 	metricRequestCodes = promauto.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "flextape",
 		Name:      "response_count",
@@ -50,32 +57,58 @@ type Service struct {
 	mu           sync.Mutex          // Protects the following members from concurrent access
 	currentState state               // State of the server
 	licenses     map[string]*license // Queues and allocations, managed per-license-type
+	dev          bool                // Development mode, allowing fixtures to be applied
 
 	queueRefreshDuration      time.Duration // Queue entries not refreshed within this duration are expired
 	allocationRefreshDuration time.Duration // Allocations not refreshed within this duration are expired
+	janitorBatchSize          int           // Licenses processed by the janitor per lock acquisition; 0 uses defaultJanitorBatchSize
+
+	dedup *dedup // Deduplicates identical Allocate and Refresh requests; nil disables deduplication
+}
+
+// defaultJanitorBatchSize is the number of licenses the janitor processes
+// before releasing the lock, unless configured otherwise.
+const defaultJanitorBatchSize = 16
+
+// newPrioritizer returns the name and a constructor of the prioritizer configured.
+func newPrioritizer(config interface{}) (string, func() Prioritizer) {
+	switch config.(type) {
+	case *fpb.LicenseConfig_EvenOwners, *fpb.ShadowPrioritizer_EvenOwners:
+		return "even_owners", func() Prioritizer { return NewEvenOwnersPrioritizer() }
+	default:
+		return "fifo", func() Prioritizer { return &FIFOPrioritizer{} }
+	}
 }
 
 func licensesFromConfig(config *fpb.Config) map[string]*license {
+	shadowMaxQueued := defaultUint32(config.GetServer().GetShadowMaxQueued(), 1000)
+
 	licenses := map[string]*license{}
 	for _, l := range config.GetLicenseConfigs() {
 		name := fmt.Sprintf("%s::%s", l.GetLicense().GetVendor(), l.GetLicense().GetFeature())
 
-		var prioritizer Prioritizer
-		switch l.Prioritizer.(type) {
-		case *fpb.LicenseConfig_Fifo:
-			prioritizer = &FIFOPrioritizer{}
-		case *fpb.LicenseConfig_EvenOwners:
-			prioritizer = NewEvenOwnersPrioritizer()
-		default:
-			prioritizer = &FIFOPrioritizer{}
+		live, prioritizer := newPrioritizer(l.Prioritizer)
+		var shadows *shadowSet
+		for _, sc := range l.GetShadowPrioritizers() {
+			if shadows == nil {
+				shadows = newShadowSet(live, int(shadowMaxQueued))
+			}
+			shadow, factory := newPrioritizer(sc.Prioritizer)
+			shadows.shadows = append(shadows.shadows, newShadowLicense(shadow, factory, int(l.GetQuantity())))
 		}
 
-		licenses[name] = &license{
+		lt := &license{
 			name:           name,
 			totalAvailable: int(l.GetQuantity()),
 			allocations:    map[string]*invocation{},
-			prioritizer:    prioritizer,
+			maxPerOwner:    int(l.GetMaxPerOwner()),
+			maxPerBuildTag: int(l.GetMaxPerBuildTag()),
+			prioritizer:    prioritizer(),
+			shadows:        shadows,
 		}
+		metricLicenseInfo.WithLabelValues(l.GetLicense().GetVendor(), l.GetLicense().GetFeature(), live).Set(1)
+		lt.updateMetrics()
+		licenses[name] = lt
 	}
 	return licenses
 }
@@ -95,14 +128,39 @@ func New(config *fpb.Config) (*Service, error) {
 	allocationRefreshSeconds := defaultUint32(config.GetServer().GetAllocationRefreshDurationSeconds(), 30)
 	janitorIntervalSeconds := defaultUint32(config.GetServer().GetJanitorIntervalSeconds(), 1)
 	adoptionDurationSeconds := defaultUint32(config.GetServer().GetAdoptionDurationSeconds(), 45)
+	janitorBatchSize := defaultUint32(config.GetServer().GetJanitorBatchSize(), defaultJanitorBatchSize)
+	dedupWindowMilliseconds := defaultUint32(config.GetServer().GetDedupWindowMilliseconds(), defaultDedupWindowMilliseconds)
 
 	licenses := licensesFromConfig(config)
+	checks, err := healthChecksFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := templatesFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	for name, lt := range templates {
+		licenses[name].template = lt
+	}
+	notifier, err := notifierFromConfig(config.GetServer().GetNotification())
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification config: %w", err)
+	}
+	if notifier != nil {
+		for _, lic := range licenses {
+			lic.notifier = notifier
+		}
+		go notifier.run()
+	}
 
 	service := &Service{
 		currentState:              stateStarting,
 		licenses:                  licenses,
 		queueRefreshDuration:      time.Duration(queueRefreshSeconds) * time.Second,
 		allocationRefreshDuration: time.Duration(allocationRefreshSeconds) * time.Second,
+		janitorBatchSize:          int(janitorBatchSize),
+		dedup:                     newDedup(time.Duration(dedupWindowMilliseconds) * time.Millisecond),
 	}
 
 	go func(s *Service) {
@@ -115,6 +173,10 @@ func New(config *fpb.Config) (*Service, error) {
 		}
 	}(service)
 
+	for name, check := range checks {
+		go service.monitorHealth(name, check)
+	}
+
 	go func(s *Service) {
 		// TODO: Read this from flags
 		<-time.After(time.Duration(adoptionDurationSeconds) * time.Second)
@@ -150,6 +212,11 @@ type invocation struct {
 	LastCheckin time.Time // Time the invocation last had its queue position/allocation refreshed.
 
 	QueueID QueueID // Position in the queue. 0 means the invocation has not been queued yet.
+	Seat    int     // 1 based seat allocated, for licenses with a template. 0 means no seat assigned.
+
+	Waited   bool // Whether the invocation was left queued by a promotion, instead of being allocated right away.
+	Notified bool // Whether the owner was notified of the invocation reaching the front of the queue.
+	Pinned   bool // Whether the invocation is exempt from expiry, for invocations loaded from a fixture.
 }
 
 func (i *invocation) ToProto() *fpb.Invocation {
@@ -185,23 +252,67 @@ var (
 
 	// timeNow returns the current time, and can be stubbed out for unit tests.
 	timeNow = time.Now
+
+	// observeJanitorHold is invoked every time the janitor releases the lock,
+	// with the number of licenses processed and how long the lock was held.
+	// It can be stubbed out for unit tests.
+	observeJanitorHold = func(licenses int, held time.Duration) {
+		metricJanitorLockHold.Observe(held.Seconds())
+	}
 )
 
 // janitor runs in a loop to cleanup allocations and queue spots that have not
 // been refreshed in a sufficient amount of time, as well as to promote queued
 // licenses to allocations.
+//
+// Licenses are processed in batches of janitorBatchSize, releasing the lock
+// between batches so RPCs are not blocked for the whole pass. Each license is
+// expired and promoted under a single acquisition of the lock, so the order
+// of expiry and promotion within a license is the same as in a single batch.
 func (s *Service) janitor() {
 	defer updateJanitorMetrics(time.Now())
+	s.dedup.Expire()
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	// Don't expire or promote anything during startup.
 	if s.currentState == stateStarting {
+		s.mu.Unlock()
 		return
 	}
 	allocationExpiry := timeNow().Add(-s.allocationRefreshDuration)
 	queueExpiry := timeNow().Add(-s.queueRefreshDuration)
-	for _, lic := range s.licenses {
+	names := make([]string, 0, len(s.licenses))
+	for name := range s.licenses {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	batch := s.janitorBatchSize
+	if batch <= 0 {
+		batch = defaultJanitorBatchSize
+	}
+	for start := 0; start < len(names); start += batch {
+		end := start + batch
+		if end > len(names) {
+			end = len(names)
+		}
+		s.janitorBatch(names[start:end], allocationExpiry, queueExpiry)
+	}
+}
+
+// janitorBatch expires and promotes the invocations of the named licenses, under a single acquisition of the lock.
+func (s *Service) janitorBatch(names []string, allocationExpiry, queueExpiry time.Time) {
+	s.mu.Lock()
+	acquired := time.Now()
+	defer func() {
+		held := time.Now().Sub(acquired)
+		s.mu.Unlock()
+		observeJanitorHold(len(names), held)
+	}()
+
+	for _, name := range names {
+		lic := s.licenses[name]
 		lic.ExpireAllocations(allocationExpiry)
 		lic.ExpireQueued(queueExpiry)
 		lic.Promote()
@@ -222,9 +333,18 @@ func updateMetrics(method string, err *error, startTime time.Time) {
 
 // Allocate allocates a license to the requesting invocation, or queues the
 // request if none are available. See the proto docstrings for more details.
+//
+// Identical requests for the same invocation received in a short window
+// are answered with the same response, see dedup.
 func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRes *fpb.AllocateResponse, retErr error) {
 	defer updateMetrics("Allocate", &retErr, time.Now())
 
+	return dedupDo(s.dedup, "Allocate", req.GetInvocation().GetId(), req, func() (*fpb.AllocateResponse, error) {
+		return s.allocate(req)
+	})
+}
+
+func (s *Service) allocate(req *fpb.AllocateRequest) (*fpb.AllocateResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -267,11 +387,16 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 	if inv := lic.GetAllocated(invocationID); inv != nil {
 		// Invocation is allocated
 		inv.LastCheckin = timeNow()
+		material, err := lic.Material(inv)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to render license template: %v", err)
+		}
 		return &fpb.AllocateResponse{
 			ResponseType: &fpb.AllocateResponse_LicenseAllocated{
 				LicenseAllocated: &fpb.LicenseAllocated{
 					InvocationId:           invocationID,
 					LicenseRefreshDeadline: timestamppb.New(timeNow().Add(s.allocationRefreshDuration)),
+					Material:               material,
 				},
 			},
 		}, nil
@@ -285,6 +410,7 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 					InvocationId:  invocationID,
 					NextPollTime:  timestamppb.New(timeNow().Add(s.queueRefreshDuration)),
 					QueuePosition: uint32(pos),
+					Message:       lic.QueuedMessage(inv),
 				},
 			},
 		}, nil
@@ -309,6 +435,7 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 				InvocationId:  invocationID,
 				NextPollTime:  timestamppb.New(timeNow().Add(s.queueRefreshDuration)),
 				QueuePosition: uint32(pos),
+				Message:       lic.QueuedMessage(inv),
 			},
 		},
 	}, nil
@@ -316,9 +443,17 @@ func (s *Service) Allocate(ctx context.Context, req *fpb.AllocateRequest) (retRe
 
 // Refresh serves as a keepalive to refresh an allocation while an invocation
 // is still using it. See the proto docstrings for more info.
+//
+// Like Allocate, identical requests received in a short window are deduplicated.
 func (s *Service) Refresh(ctx context.Context, req *fpb.RefreshRequest) (retRes *fpb.RefreshResponse, retErr error) {
 	defer updateMetrics("Refresh", &retErr, time.Now())
 
+	return dedupDo(s.dedup, "Refresh", req.GetInvocation().GetId(), req, func() (*fpb.RefreshResponse, error) {
+		return s.refresh(req)
+	})
+}
+
+func (s *Service) refresh(req *fpb.RefreshRequest) (*fpb.RefreshResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -347,20 +482,25 @@ func (s *Service) Refresh(ctx context.Context, req *fpb.RefreshRequest) (retRes
 			BuildTag:    invMsg.GetBuildTag(),
 			LastCheckin: timeNow(),
 		}
-		if ok := lic.Allocate(inv); ok {
-			return &fpb.RefreshResponse{
-				InvocationId:           invID,
-				LicenseRefreshDeadline: timestamppb.New(timeNow().Add(s.allocationRefreshDuration)),
-			}, nil
-		} else {
+		if ok := lic.Allocate(inv); !ok {
 			return nil, status.Errorf(codes.ResourceExhausted, "%q has no available licenses", licenseType)
 		}
+		return s.refreshResponse(lic, inv)
 	}
 	// Update the time and return the next check interval
 	inv.LastCheckin = timeNow()
+	return s.refreshResponse(lic, inv)
+}
+
+func (s *Service) refreshResponse(lic *license, inv *invocation) (*fpb.RefreshResponse, error) {
+	material, err := lic.Material(inv)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to render license template: %v", err)
+	}
 	return &fpb.RefreshResponse{
-		InvocationId:           invID,
+		InvocationId:           inv.ID,
 		LicenseRefreshDeadline: timestamppb.New(timeNow().Add(s.allocationRefreshDuration)),
+		Material:               material,
 	}, nil
 }
 
@@ -377,6 +517,7 @@ func (s *Service) Release(ctx context.Context, req *fpb.ReleaseRequest) (retRes
 	if invID == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "invocation_id must be set")
 	}
+	s.dedup.Forget(invID)
 	count := 0
 	for _, lic := range s.licenses {
 		count += lic.Forget(invID)
@@ -389,9 +530,17 @@ func (s *Service) Release(ctx context.Context, req *fpb.ReleaseRequest) (retRes
 
 // LicensesStatus returns the status for every license type. See the proto
 // docstrings for more details.
+//
+// Invocation lists are only returned to verbose requests, and the field mask
+// of the request is applied to each LicenseStats.
 func (s *Service) LicensesStatus(ctx context.Context, req *fpb.LicensesStatusRequest) (retRes *fpb.LicensesStatusResponse, retErr error) {
 	defer updateMetrics("LicensesStatus", &retErr, time.Now())
 
+	filter, err := newStatsFilter(req)
+	if err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -413,5 +562,35 @@ func (s *Service) LicensesStatus(ctx context.Context, req *fpb.LicensesStatusReq
 		}
 		return licA.GetVendor() < licB.GetVendor()
 	})
+
+	metricStatusResponseBytes.WithLabelValues("full").Observe(float64(proto.Size(res)))
+	for _, stats := range res.LicenseStats {
+		filter.Apply(stats)
+	}
+	metricStatusResponseBytes.WithLabelValues("filtered").Observe(float64(proto.Size(res)))
+	return res, nil
+}
+
+// PrioritizerReport returns the wait times of the configured and shadow
+// prioritizers of each license. See the proto docstrings for more details.
+func (s *Service) PrioritizerReport(ctx context.Context, req *fpb.PrioritizerReportRequest) (retRes *fpb.PrioritizerReportResponse, retErr error) {
+	defer updateMetrics("PrioritizerReport", &retErr, time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &fpb.PrioritizerReportResponse{}
+	for _, lic := range s.licenses {
+		if report := lic.shadows.Report(lic); report != nil {
+			res.LicenseReports = append(res.LicenseReports, report)
+		}
+	}
+	sort.Slice(res.LicenseReports, func(i, j int) bool {
+		licA, licB := res.LicenseReports[i].GetLicense(), res.LicenseReports[j].GetLicense()
+		if licA.GetVendor() == licB.GetVendor() {
+			return licA.GetFeature() < licB.GetFeature()
+		}
+		return licA.GetVendor() < licB.GetVendor()
+	})
 	return res, nil
 }
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"testing"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -887,7 +889,7 @@ func TestLicensesStatus(t *testing.T) {
 				BuildTag:    "tag_3",
 				LastCheckin: start,
 			}),
-			req: &fpb.LicensesStatusRequest{},
+			req: &fpb.LicensesStatusRequest{Verbose: true},
 			want: &fpb.LicensesStatusResponse{
 				LicenseStats: []*fpb.LicenseStats{
 					&fpb.LicenseStats{
@@ -933,6 +935,160 @@ func TestLicensesStatus(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "omits invocations unless verbose",
+			server: testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}).withQueued("xilinx::feature_foo", &invocation{
+				ID:          "9",
+				Owner:       "unit_test",
+				BuildTag:    "tag_3",
+				LastCheckin: start,
+			}),
+			req: &fpb.LicensesStatusRequest{},
+			want: &fpb.LicensesStatusResponse{
+				LicenseStats: []*fpb.LicenseStats{
+					&fpb.LicenseStats{
+						License:           &fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						TotalLicenseCount: 2,
+						AllocatedCount:    1,
+						QueuedCount:       1,
+						Timestamp:         timestamppb.New(start),
+					},
+				},
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue: invocationQueue{
+						&invocation{ID: "9", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, QueueID: 1},
+					},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc: "returns only fields in mask",
+			server: testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}).withQueued("xilinx::feature_foo", &invocation{
+				ID:          "9",
+				Owner:       "unit_test",
+				BuildTag:    "tag_3",
+				LastCheckin: start,
+			}),
+			req: &fpb.LicensesStatusRequest{
+				FieldMask: &fieldmaskpb.FieldMask{Paths: []string{"license", "allocated_count", "queued_invocations"}},
+				Verbose:   true,
+			},
+			want: &fpb.LicensesStatusResponse{
+				LicenseStats: []*fpb.LicenseStats{
+					&fpb.LicenseStats{
+						License:        &fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+						AllocatedCount: 1,
+						QueuedInvocations: []*fpb.Invocation{
+							&fpb.Invocation{
+								Id:       "9",
+								Owner:    "unit_test",
+								BuildTag: "tag_3",
+							},
+						},
+					},
+				},
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue: invocationQueue{
+						&invocation{ID: "9", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, QueueID: 1},
+					},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc: "field mask does not override verbose",
+			server: testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}).withQueued("xilinx::feature_foo", &invocation{
+				ID:          "9",
+				Owner:       "unit_test",
+				BuildTag:    "tag_3",
+				LastCheckin: start,
+			}),
+			req: &fpb.LicensesStatusRequest{
+				FieldMask: &fieldmaskpb.FieldMask{Paths: []string{"allocated_count", "allocated_invocations"}},
+			},
+			want: &fpb.LicensesStatusResponse{
+				LicenseStats: []*fpb.LicenseStats{
+					&fpb.LicenseStats{
+						AllocatedCount: 1,
+					},
+				},
+			},
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue: invocationQueue{
+						&invocation{ID: "9", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, QueueID: 1},
+					},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
+		{
+			desc: "unknown field in mask",
+			server: testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+				ID:          "5",
+				Owner:       "unit_test",
+				BuildTag:    "tag_1",
+				LastCheckin: start,
+			}).withQueued("xilinx::feature_foo", &invocation{
+				ID:          "9",
+				Owner:       "unit_test",
+				BuildTag:    "tag_3",
+				LastCheckin: start,
+			}),
+			req: &fpb.LicensesStatusRequest{
+				FieldMask: &fieldmaskpb.FieldMask{Paths: []string{"license.vendor"}},
+			},
+			wantErrCode: codes.InvalidArgument,
+			wantErr:     "unknown field",
+			wantLicenses: map[string]*license{
+				"xilinx::feature_foo": &license{
+					name:           "xilinx::feature_foo",
+					totalAvailable: 2,
+					queue: invocationQueue{
+						&invocation{ID: "9", Owner: "unit_test", BuildTag: "tag_3", LastCheckin: start, QueueID: 1},
+					},
+					allocations: map[string]*invocation{
+						"5": &invocation{ID: "5", Owner: "unit_test", BuildTag: "tag_1", LastCheckin: start},
+					},
+					prioritizer: &FIFOPrioritizer{},
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -1463,6 +1619,95 @@ func TestPrioritizerBasic(t *testing.T) {
 	}
 }
 
+// largeTestService returns a service with many licenses, each with stale and
+// fresh allocations and queued invocations, to exercise the janitor batching.
+func largeTestService(start time.Time, licenses int, batchSize int) *Service {
+	s := &Service{
+		currentState:              stateRunning,
+		licenses:                  map[string]*license{},
+		queueRefreshDuration:      5 * time.Second,
+		allocationRefreshDuration: 7 * time.Second,
+		janitorBatchSize:          batchSize,
+	}
+	for i := 0; i < licenses; i++ {
+		name := fmt.Sprintf("xilinx::feature_%03d", i)
+		s.licenses[name] = &license{
+			name:           name,
+			totalAvailable: 3,
+			queue:          invocationQueue{},
+			allocations:    map[string]*invocation{},
+			prioritizer:    &FIFOPrioritizer{},
+		}
+		for j := 0; j < 3; j++ {
+			checkin := start
+			if j%2 == 0 {
+				checkin = start.Add(-10 * time.Second) // stale
+			}
+			s.withAllocation(name, &invocation{
+				ID:          fmt.Sprintf("%s-allocated-%d", name, j),
+				Owner:       "unit_test",
+				BuildTag:    fmt.Sprintf("tag_%d", j),
+				LastCheckin: checkin,
+			})
+		}
+		for j := 0; j < 10; j++ {
+			checkin := start
+			if j%3 == 0 {
+				checkin = start.Add(-6 * time.Second) // stale
+			}
+			s.withQueued(name, &invocation{
+				ID:          fmt.Sprintf("%s-queued-%d", name, j),
+				Owner:       "unit_test",
+				BuildTag:    fmt.Sprintf("tag_%d", j),
+				LastCheckin: checkin,
+			})
+		}
+	}
+	return s
+}
+
+func TestJanitorBatches(t *testing.T) {
+	start := time.Now()
+	stubs := gostub.Stub(&timeNow, func() time.Time {
+		return start
+	})
+	defer stubs.Reset()
+
+	var holds []int
+	stubs.Stub(&observeJanitorHold, func(licenses int, held time.Duration) {
+		holds = append(holds, licenses)
+	})
+
+	// A single batch processing all the licenses is the reference.
+	want := largeTestService(start, 200, 1000)
+	want.janitor()
+	assert.Equal(t, []int{200}, holds)
+
+	holds = nil
+	got := largeTestService(start, 200, 16)
+	got.janitor()
+
+	// 12 full batches of 16 licenses, and one with the remaining 8.
+	assert.Equal(t, 13, len(holds))
+	for _, held := range holds {
+		assert.LessOrEqual(t, held, 16)
+	}
+	testutil.AssertCmp(t, got.licenses, want.licenses, cmp.AllowUnexported(invocation{}, license{}))
+
+	// Stale invocations were expired, and queued ones promoted in order.
+	lic := got.licenses["xilinx::feature_042"]
+	assert.Equal(t, 3, len(lic.allocations))
+	assert.Contains(t, lic.allocations, "xilinx::feature_042-allocated-1")
+	assert.Contains(t, lic.allocations, "xilinx::feature_042-queued-1")
+	assert.Contains(t, lic.allocations, "xilinx::feature_042-queued-2")
+	assert.Equal(t, 4, len(lic.queue))
+
+	// Without a configured batch size, the default is used.
+	holds = nil
+	largeTestService(start, 40, 0).janitor()
+	assert.Equal(t, []int{defaultJanitorBatchSize, defaultJanitorBatchSize, 8}, holds)
+}
+
 func TestPrioritization(t *testing.T) {
 	start := time.Now()
 	currentTime := start
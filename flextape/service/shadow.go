@@ -0,0 +1,463 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var (
+	metricShadowSuspensions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "flextape",
+		Name:      "shadow_prioritizer_suspensions",
+		Help:      "Number of times the simulation of shadow prioritizers was suspended due to load",
+	},
+		[]string{
+			// The license vendor + feature, in `vendor::feature` format.
+			"license_type",
+		},
+	)
+)
+
+const (
+	// Wait times retained for each owner, to compute percentiles.
+	maxWaitSamples = 1024
+	// Owners tracked for each prioritizer. Allocations of other owners are not accounted for.
+	maxWaitOwners = 1024
+)
+
+// waitStats retains the most recent wait times of each owner.
+type waitStats struct {
+	owners map[string]*waitSamples
+}
+
+type waitSamples struct {
+	samples []time.Duration
+	next    int // Index of the oldest sample, once samples is full.
+}
+
+func newWaitStats() *waitStats {
+	return &waitStats{owners: map[string]*waitSamples{}}
+}
+
+func (ws *waitStats) Add(owner string, wait time.Duration) {
+	samples := ws.owners[owner]
+	if samples == nil {
+		if len(ws.owners) >= maxWaitOwners {
+			return
+		}
+		samples = &waitSamples{}
+		ws.owners[owner] = samples
+	}
+	if len(samples.samples) < maxWaitSamples {
+		samples.samples = append(samples.samples, wait)
+		return
+	}
+	samples.samples[samples.next] = wait
+	samples.next = (samples.next + 1) % maxWaitSamples
+}
+
+// percentile returns the nearest-rank percentile p, 0 < p <= 1, of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// ToProto returns the wait time percentiles of each owner, sorted by owner.
+func (ws *waitStats) ToProto() []*fpb.OwnerWaitStats {
+	result := []*fpb.OwnerWaitStats{}
+	for owner, samples := range ws.owners {
+		sorted := append([]time.Duration{}, samples.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		result = append(result, &fpb.OwnerWaitStats{
+			Owner: owner,
+			Count: uint32(len(sorted)),
+			P50:   durationpb.New(percentile(sorted, 0.50)),
+			P90:   durationpb.New(percentile(sorted, 0.90)),
+			P99:   durationpb.New(percentile(sorted, 0.99)),
+			Max:   durationpb.New(sorted[len(sorted)-1]),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Owner < result[j].Owner })
+	return result
+}
+
+// shadowInvocation is an invocation as seen by a shadow prioritizer.
+type shadowInvocation struct {
+	inv      *invocation // Copy of the live invocation, with its own QueueID.
+	enqueued time.Time
+
+	allocated time.Time // Zero while queued.
+	// How long the invocation held the license with the live prioritizer.
+	// Only known once released, until then the allocation is held indefinitely.
+	hold     time.Duration
+	released bool
+}
+
+// releaseTime returns when a shadow allocation ends, or false if not known yet.
+func (si *shadowInvocation) releaseTime() (time.Time, bool) {
+	if !si.released {
+		return time.Time{}, false
+	}
+	return si.allocated.Add(si.hold), true
+}
+
+// shadowLicense simulates the queue and allocations of a license managed by a different prioritizer.
+//
+// The simulation replays the requests of the live license: invocations are
+// queued when they are queued live, and hold a license for the same time
+// they held it live. As allocations may happen earlier or later than they
+// did live, the simulation computes allocation times retroactively, once
+// the release of the live allocation is known. This is an approximation, the
+// order of the queue at the time of the allocation is not reconstructed.
+type shadowLicense struct {
+	name           string
+	newPrioritizer func() Prioritizer
+	prioritizer    Prioritizer
+
+	total       int
+	queue       invocationQueue
+	invocations map[string]*shadowInvocation // Queued or allocated.
+	allocations map[string]*shadowInvocation
+	free        []time.Time // Time each free seat became free.
+
+	waits *waitStats
+}
+
+func newShadowLicense(name string, newPrioritizer func() Prioritizer, total int) *shadowLicense {
+	sl := &shadowLicense{name: name, newPrioritizer: newPrioritizer, total: total, waits: newWaitStats()}
+	sl.reset()
+	return sl
+}
+
+// reset drops all queued and allocated invocations. Wait statistics are retained.
+func (sl *shadowLicense) reset() {
+	sl.prioritizer = sl.newPrioritizer()
+	sl.queue = invocationQueue{}
+	sl.invocations = map[string]*shadowInvocation{}
+	sl.allocations = map[string]*shadowInvocation{}
+	sl.free = make([]time.Time, sl.total)
+}
+
+func (sl *shadowLicense) Enqueue(inv *invocation, enqueued time.Time) {
+	si := &shadowInvocation{inv: &invocation{ID: inv.ID, Owner: inv.Owner, BuildTag: inv.BuildTag}, enqueued: enqueued}
+	sl.invocations[inv.ID] = si
+	sl.queue.Enqueue(si.inv)
+	sl.prioritizer.OnEnqueue(si.inv)
+}
+
+// Adopt records an invocation allocated outside of the queue, like when adopted after a restart.
+//
+// Adopted invocations take a seat even if none is free, as they do live.
+func (sl *shadowLicense) Adopt(inv *invocation, allocated time.Time) {
+	si := &shadowInvocation{inv: &invocation{ID: inv.ID, Owner: inv.Owner, BuildTag: inv.BuildTag}, enqueued: allocated, allocated: allocated}
+	if len(sl.free) > 0 {
+		sl.free = sl.free[1:]
+	}
+	sl.invocations[inv.ID] = si
+	sl.allocations[inv.ID] = si
+	sl.prioritizer.OnAllocate(si.inv)
+}
+
+// Release records that the live allocation of an invocation ended, after holding the license for hold.
+func (sl *shadowLicense) Release(invID string, hold time.Duration) {
+	si := sl.invocations[invID]
+	if si == nil {
+		return
+	}
+	si.hold = hold
+	si.released = true
+}
+
+// Withdraw records that an invocation left the live queue without being allocated a license.
+//
+// If the invocation was allocated a license in the simulation, the license is released at now.
+func (sl *shadowLicense) Withdraw(invID string, now time.Time) {
+	si := sl.invocations[invID]
+	if si == nil {
+		return
+	}
+	if si.allocated.IsZero() {
+		sl.queue.Forget(invID)
+		sl.prioritizer.OnDequeue(si.inv)
+		delete(sl.invocations, invID)
+		return
+	}
+	if !si.released {
+		si.released = true
+		si.hold = now.Sub(si.allocated)
+	}
+}
+
+// promote allocates the free seats to queued invocations, no earlier than notBefore.
+func (sl *shadowLicense) promote(notBefore time.Time) {
+	for len(sl.free) > 0 && sl.queue.Len() > 0 {
+		sl.queue.Sort(sl.prioritizer.Sorter())
+		inv := sl.queue.Dequeue()
+		si := sl.invocations[inv.ID]
+
+		sort.Slice(sl.free, func(i, j int) bool { return sl.free[i].Before(sl.free[j]) })
+		allocated := sl.free[0]
+		sl.free = sl.free[1:]
+		for _, t := range []time.Time{si.enqueued, notBefore} {
+			if t.After(allocated) {
+				allocated = t
+			}
+		}
+
+		si.allocated = allocated
+		sl.allocations[inv.ID] = si
+		sl.prioritizer.OnDequeue(inv)
+		sl.prioritizer.OnAllocate(inv)
+		sl.waits.Add(inv.Owner, allocated.Sub(si.enqueued))
+	}
+}
+
+// Advance runs the simulation up to now, releasing the allocations ending
+// before now, and promoting queued invocations to the seats freed.
+//
+// If promote is false, like when the license server is unhealthy, queued
+// invocations are not promoted. Otherwise, promotions happen no earlier than notBefore.
+func (sl *shadowLicense) Advance(now time.Time, promote bool, notBefore time.Time) {
+	for {
+		if promote {
+			sl.promote(notBefore)
+		}
+
+		var next *shadowInvocation
+		var nextTime time.Time
+		for _, si := range sl.allocations {
+			end, ok := si.releaseTime()
+			if !ok || end.After(now) {
+				continue
+			}
+			if next == nil || end.Before(nextTime) || (end.Equal(nextTime) && si.inv.ID < next.inv.ID) {
+				next, nextTime = si, end
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		delete(sl.allocations, next.inv.ID)
+		delete(sl.invocations, next.inv.ID)
+		sl.prioritizer.OnRelease(next.inv)
+		if len(sl.free)+len(sl.allocations) < sl.total {
+			sl.free = append(sl.free, nextTime)
+		}
+	}
+}
+
+// shadowSet evaluates the shadow prioritizers of a license, and tracks the wait times of the live prioritizer.
+//
+// All methods can be invoked on a nil shadowSet, for licenses without shadow prioritizers.
+type shadowSet struct {
+	live    string // Name of the live prioritizer.
+	shadows []*shadowLicense
+
+	// The simulation is suspended while more than maxQueued invocations are queued live.
+	maxQueued   int
+	suspended   bool
+	suspensions uint64
+
+	liveEnqueued  map[string]time.Time
+	liveAllocated map[string]time.Time
+	liveWaits     *waitStats
+}
+
+func newShadowSet(live string, maxQueued int) *shadowSet {
+	return &shadowSet{
+		live:          live,
+		maxQueued:     maxQueued,
+		liveEnqueued:  map[string]time.Time{},
+		liveAllocated: map[string]time.Time{},
+		liveWaits:     newWaitStats(),
+	}
+}
+
+// active suspends or restarts the simulation based on the length of the live queue, returns true if active.
+//
+// When restarted, the shadow prioritizers start from the current allocations and queue of the license.
+func (ss *shadowSet) active(l *license, now time.Time) bool {
+	if l.queue.Len() > ss.maxQueued {
+		if !ss.suspended {
+			ss.suspended = true
+			ss.suspensions++
+			metricShadowSuspensions.WithLabelValues(l.name).Inc()
+			for _, sl := range ss.shadows {
+				sl.reset()
+			}
+		}
+		return false
+	}
+	if !ss.suspended {
+		return true
+	}
+
+	ss.suspended = false
+	for _, sl := range ss.shadows {
+		allocated := []*invocation{}
+		for _, inv := range l.allocations {
+			allocated = append(allocated, inv)
+		}
+		sort.Slice(allocated, func(i, j int) bool { return allocated[i].ID < allocated[j].ID })
+		for _, inv := range allocated {
+			sl.Adopt(inv, timeOr(ss.liveAllocated[inv.ID], now))
+		}
+		l.queue.Walk(func(pos Position, inv *invocation) bool {
+			sl.Enqueue(inv, timeOr(ss.liveEnqueued[inv.ID], now))
+			return true
+		})
+	}
+	return true
+}
+
+// timeOr returns t, or def if t is not set.
+func timeOr(t, def time.Time) time.Time {
+	if t.IsZero() {
+		return def
+	}
+	return t
+}
+
+// advance runs the shadow prioritizers up to now.
+func (ss *shadowSet) advance(l *license, now time.Time) {
+	var notBefore time.Time
+	if l.health != nil {
+		notBefore = l.health.changed
+	}
+	for _, sl := range ss.shadows {
+		sl.Advance(now, l.Healthy(), notBefore)
+	}
+}
+
+// OnEnqueue is called every time an invocation is queued live.
+func (ss *shadowSet) OnEnqueue(l *license, inv *invocation) {
+	if ss == nil {
+		return
+	}
+	now := timeNow()
+	ss.liveEnqueued[inv.ID] = now
+	if !ss.active(l, now) {
+		return
+	}
+	for _, sl := range ss.shadows {
+		sl.Enqueue(inv, now)
+	}
+	ss.advance(l, now)
+}
+
+// OnAdopt is called every time an invocation is allocated a license live without being queued.
+func (ss *shadowSet) OnAdopt(l *license, inv *invocation) {
+	if ss == nil {
+		return
+	}
+	now := timeNow()
+	ss.liveAllocated[inv.ID] = now
+	if !ss.active(l, now) {
+		return
+	}
+	for _, sl := range ss.shadows {
+		sl.Adopt(inv, now)
+	}
+}
+
+// OnPromote is called every time a queued invocation is allocated a license live.
+func (ss *shadowSet) OnPromote(l *license, inv *invocation) {
+	if ss == nil {
+		return
+	}
+	now := timeNow()
+	if enqueued, ok := ss.liveEnqueued[inv.ID]; ok {
+		ss.liveWaits.Add(inv.Owner, now.Sub(enqueued))
+		delete(ss.liveEnqueued, inv.ID)
+	}
+	ss.liveAllocated[inv.ID] = now
+}
+
+// OnRelease is called every time a live allocation ends.
+func (ss *shadowSet) OnRelease(l *license, inv *invocation) {
+	if ss == nil {
+		return
+	}
+	now := timeNow()
+	allocated, ok := ss.liveAllocated[inv.ID]
+	delete(ss.liveAllocated, inv.ID)
+	if !ss.active(l, now) {
+		return
+	}
+	for _, sl := range ss.shadows {
+		if ok {
+			sl.Release(inv.ID, now.Sub(allocated))
+		} else {
+			// Allocated before the simulation started, the allocation ends now.
+			sl.Withdraw(inv.ID, now)
+		}
+	}
+	ss.advance(l, now)
+}
+
+// OnWithdraw is called every time an invocation leaves the live queue without being allocated.
+func (ss *shadowSet) OnWithdraw(l *license, inv *invocation) {
+	if ss == nil {
+		return
+	}
+	now := timeNow()
+	delete(ss.liveEnqueued, inv.ID)
+	if !ss.active(l, now) {
+		return
+	}
+	for _, sl := range ss.shadows {
+		sl.Withdraw(inv.ID, now)
+	}
+	ss.advance(l, now)
+}
+
+// Advance runs the shadow prioritizers up to the current time.
+func (ss *shadowSet) Advance(l *license) {
+	if ss == nil {
+		return
+	}
+	now := timeNow()
+	if ss.active(l, now) {
+		ss.advance(l, now)
+	}
+}
+
+// Report returns the wait times of the live and shadow prioritizers, or nil if no shadow is configured.
+func (ss *shadowSet) Report(l *license) *fpb.LicensePrioritizerReport {
+	if ss == nil {
+		return nil
+	}
+	fields := strings.SplitN(l.name, "::", 2)
+	if len(fields) != 2 {
+		fields = []string{"<UNKNOWN>", l.name}
+	}
+	report := &fpb.LicensePrioritizerReport{
+		License: &fpb.License{Vendor: fields[0], Feature: fields[1]},
+		Prioritizers: []*fpb.PrioritizerStats{{
+			Name:   ss.live,
+			Live:   true,
+			Owners: ss.liveWaits.ToProto(),
+		}},
+	}
+	for _, sl := range ss.shadows {
+		report.Prioritizers = append(report.Prioritizers, &fpb.PrioritizerStats{
+			Name:        sl.name,
+			Suspended:   ss.suspended,
+			Suspensions: ss.suspensions,
+			Owners:      sl.waits.ToProto(),
+		})
+	}
+	return report
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+	"github.com/System233/enkit/lib/testutil"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// shadowTestService returns a service with a single license, managed by a fifo prioritizer, shadowed by even_owners.
+func shadowTestService(quantity uint32, maxQueued uint32) *Service {
+	return &Service{
+		currentState: stateRunning,
+		licenses: licensesFromConfig(&fpb.Config{
+			Server: &fpb.ServerConfig{ShadowMaxQueued: maxQueued},
+			LicenseConfigs: []*fpb.LicenseConfig{{
+				Quantity:    quantity,
+				Prioritizer: &fpb.LicenseConfig_Fifo{},
+				License:     &fpb.License{Vendor: "xilinx", Feature: "foo"},
+				ShadowPrioritizers: []*fpb.ShadowPrioritizer{
+					{Prioritizer: &fpb.ShadowPrioritizer_EvenOwners{}},
+				},
+			}},
+		}),
+		// Long enough for nothing to expire during the test.
+		queueRefreshDuration:      time.Hour,
+		allocationRefreshDuration: time.Hour,
+	}
+}
+
+func shadowAllocate(t *testing.T, server *Service, owner string) string {
+	t.Helper()
+	resp, err := server.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    owner,
+		Licenses: []*fpb.License{{Vendor: "xilinx", Feature: "foo"}},
+	}})
+	assert.NoError(t, err)
+	switch r := resp.GetResponseType().(type) {
+	case *fpb.AllocateResponse_LicenseAllocated:
+		return r.LicenseAllocated.GetInvocationId()
+	case *fpb.AllocateResponse_Queued:
+		return r.Queued.GetInvocationId()
+	}
+	t.Fatalf("unexpected response %v", resp)
+	return ""
+}
+
+func shadowRelease(t *testing.T, server *Service, id string) {
+	t.Helper()
+	_, err := server.Release(context.Background(), &fpb.ReleaseRequest{InvocationId: id})
+	assert.NoError(t, err)
+	server.janitor()
+}
+
+func waits(owner string, count uint32, p50, p90, p99, max time.Duration) *fpb.OwnerWaitStats {
+	return &fpb.OwnerWaitStats{
+		Owner: owner,
+		Count: count,
+		P50:   durationpb.New(p50),
+		P90:   durationpb.New(p90),
+		P99:   durationpb.New(p99),
+		Max:   durationpb.New(max),
+	}
+}
+
+func TestPrioritizerReport(t *testing.T) {
+	currentTime := time.Now()
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return currentTime
+	})
+	defer stubs.Reset()
+
+	server := shadowTestService(2, 0)
+	ctx := context.Background()
+
+	// Nothing allocated yet.
+	got, err := server.PrioritizerReport(ctx, &fpb.PrioritizerReportRequest{})
+	assert.NoError(t, err)
+	testutil.AssertProtoEqual(t, got, &fpb.PrioritizerReportResponse{LicenseReports: []*fpb.LicensePrioritizerReport{{
+		License: &fpb.License{Vendor: "xilinx", Feature: "foo"},
+		Prioritizers: []*fpb.PrioritizerStats{
+			{Name: "fifo", Live: true, Owners: []*fpb.OwnerWaitStats{}},
+			{Name: "even_owners", Owners: []*fpb.OwnerWaitStats{}},
+		},
+	}}})
+
+	// Donnie takes both licenses and floods the queue, joe comes by a second later.
+	donnie := []string{}
+	for i := 0; i < 4; i++ {
+		donnie = append(donnie, shadowAllocate(t, server, "donnie"))
+	}
+	currentTime = currentTime.Add(time.Second)
+	joe := shadowAllocate(t, server, "joe")
+
+	// Invocations are released 10 seconds apart, in the order they were
+	// queued. Live, joe waits for all of donnie's invocations to be allocated.
+	currentTime = currentTime.Add(9 * time.Second)
+	for _, id := range append(donnie, joe) {
+		shadowRelease(t, server, id)
+		currentTime = currentTime.Add(10 * time.Second)
+	}
+
+	// With even_owners, joe would have been allocated the first license
+	// released, as donnie was still holding the other one. The simulation
+	// learns that joe would have released it at 30s only once joe completes
+	// live, so donnie's last invocation gets the license released at 40s.
+	got, err = server.PrioritizerReport(ctx, &fpb.PrioritizerReportRequest{})
+	assert.NoError(t, err)
+	testutil.AssertProtoEqual(t, got, &fpb.PrioritizerReportResponse{LicenseReports: []*fpb.LicensePrioritizerReport{{
+		License: &fpb.License{Vendor: "xilinx", Feature: "foo"},
+		Prioritizers: []*fpb.PrioritizerStats{
+			{Name: "fifo", Live: true, Owners: []*fpb.OwnerWaitStats{
+				waits("donnie", 4, 0, 20*time.Second, 20*time.Second, 20*time.Second),
+				waits("joe", 1, 29*time.Second, 29*time.Second, 29*time.Second, 29*time.Second),
+			}},
+			{Name: "even_owners", Owners: []*fpb.OwnerWaitStats{
+				waits("donnie", 4, 0, 40*time.Second, 40*time.Second, 40*time.Second),
+				waits("joe", 1, 9*time.Second, 9*time.Second, 9*time.Second, 9*time.Second),
+			}},
+		},
+	}}})
+}
+
+func TestPrioritizerReportSuspended(t *testing.T) {
+	currentTime := time.Now()
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return currentTime
+	})
+	defer stubs.Reset()
+
+	server := shadowTestService(1, 1)
+	ctx := context.Background()
+	report := func() *fpb.PrioritizerStats {
+		t.Helper()
+		got, err := server.PrioritizerReport(ctx, &fpb.PrioritizerReportRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(got.GetLicenseReports()))
+		return got.GetLicenseReports()[0].GetPrioritizers()[1]
+	}
+
+	// One allocated, one queued: within the limit.
+	first := shadowAllocate(t, server, "donnie")
+	second := shadowAllocate(t, server, "donnie")
+	assert.False(t, report().GetSuspended())
+
+	// A second queued invocation suspends the simulation.
+	third := shadowAllocate(t, server, "joe")
+	assert.True(t, report().GetSuspended())
+	assert.Equal(t, uint64(1), report().GetSuspensions())
+
+	// Once the queue is short enough, the simulation restarts from the live state.
+	currentTime = currentTime.Add(10 * time.Second)
+	shadowRelease(t, server, first)
+	assert.False(t, report().GetSuspended())
+	assert.Equal(t, uint64(1), report().GetSuspensions())
+
+	currentTime = currentTime.Add(10 * time.Second)
+	shadowRelease(t, server, second)
+	currentTime = currentTime.Add(10 * time.Second)
+	shadowRelease(t, server, third)
+
+	// Only the invocation queued after the restart is accounted for, with
+	// the time it was queued live.
+	testutil.AssertProtoEqual(t, report().GetOwners(), []*fpb.OwnerWaitStats{
+		waits("donnie", 1, 0, 0, 0, 0),
+		waits("joe", 1, 20*time.Second, 20*time.Second, 20*time.Second, 20*time.Second),
+	})
+}
+
+func TestPrioritizerReportNoShadows(t *testing.T) {
+	server := testService(stateRunning)
+	got, err := server.PrioritizerReport(context.Background(), &fpb.PrioritizerReportRequest{})
+	assert.NoError(t, err)
+	testutil.AssertProtoEqual(t, got, &fpb.PrioritizerReportResponse{})
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	// Registers the gzip compressor: responses are compressed for clients asking for it.
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// licensesStatusMethod is the full name of the LicensesStatus RPC, as seen by stats handlers.
+const licensesStatusMethod = "/flextape.proto.Flextape/LicensesStatus"
+
+var metricStatusResponseBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Subsystem: "flextape",
+	Name:      "licenses_status_response_bytes",
+	Help:      "Size of LicensesStatus responses: with all fields (full), after applying the field mask and verbose setting (filtered), and as sent, after compression (wire)",
+	Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+},
+	[]string{
+		"stage",
+	},
+)
+
+// verboseFields are the fields of LicenseStats only returned to verbose requests.
+var verboseFields = map[protoreflect.Name]bool{
+	"allocated_invocations": true,
+	"queued_invocations":    true,
+}
+
+// statsFilter selects the fields of LicenseStats returned by LicensesStatus.
+type statsFilter struct {
+	// Fields to return, nil to return all fields.
+	fields  map[protoreflect.Name]bool
+	verbose bool
+}
+
+func newStatsFilter(req *fpb.LicensesStatusRequest) (*statsFilter, error) {
+	filter := &statsFilter{verbose: req.GetVerbose()}
+	paths := req.GetFieldMask().GetPaths()
+	if len(paths) == 0 {
+		return filter, nil
+	}
+
+	known := (&fpb.LicenseStats{}).ProtoReflect().Descriptor().Fields()
+	filter.fields = map[protoreflect.Name]bool{}
+	for _, path := range paths {
+		name := protoreflect.Name(path)
+		if known.ByName(name) == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "field_mask: unknown field %q - must be a top level field of LicenseStats, like allocated_count", path)
+		}
+		filter.fields[name] = true
+	}
+	return filter, nil
+}
+
+// Apply clears the fields of stats that were not requested.
+func (f *statsFilter) Apply(stats *fpb.LicenseStats) {
+	m := stats.ProtoReflect()
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if (verboseFields[fd.Name()] && !f.verbose) || (f.fields != nil && !f.fields[fd.Name()]) {
+			m.Clear(fd)
+		}
+	}
+}
+
+// StatsHandler returns a gRPC stats.Handler recording the size of the LicensesStatus
+// responses as sent on the wire, after compression.
+//
+// Install it with grpc.StatsHandler when creating the gRPC server.
+func StatsHandler() stats.Handler {
+	return &statusSizeHandler{}
+}
+
+type methodKey struct{}
+
+type statusSizeHandler struct{}
+
+func (h *statusSizeHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, methodKey{}, info.FullMethodName)
+}
+
+func (h *statusSizeHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	out, ok := s.(*stats.OutPayload)
+	if !ok || out.IsClient() {
+		return
+	}
+	if method, _ := ctx.Value(methodKey{}).(string); method == licensesStatusMethod {
+		metricStatusResponseBytes.WithLabelValues("wire").Observe(float64(out.WireLength))
+	}
+}
+
+func (h *statusSizeHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *statusSizeHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// compressionRecorder records the compression used by the server in its responses.
+type compressionRecorder struct {
+	mu          sync.Mutex
+	compression []string
+}
+
+func (r *compressionRecorder) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *compressionRecorder) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if header, ok := s.(*stats.InHeader); ok && header.IsClient() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.compression = append(r.compression, header.Compression)
+	}
+}
+
+func (r *compressionRecorder) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (r *compressionRecorder) HandleConn(ctx context.Context, s stats.ConnStats) {}
+
+func (r *compressionRecorder) Last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.compression) == 0 {
+		return ""
+	}
+	return r.compression[len(r.compression)-1]
+}
+
+func wireSamples(t *testing.T) uint64 {
+	m := &dto.Metric{}
+	assert.Nil(t, metricStatusResponseBytes.WithLabelValues("wire").(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestLicensesStatusCompression(t *testing.T) {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.StatsHandler(StatsHandler()))
+	fpb.RegisterFlextapeServer(server, testService(stateRunning).withAllocation("xilinx::feature_foo", &invocation{
+		ID:       "5",
+		Owner:    "unit_test",
+		BuildTag: "tag_1",
+	}))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	recorder := &compressionRecorder{}
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(recorder),
+	)
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := fpb.NewFlextapeClient(conn)
+
+	before := wireSamples(t)
+	_, err = client.LicensesStatus(context.Background(), &fpb.LicensesStatusRequest{Verbose: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "", recorder.Last())
+
+	_, err = client.LicensesStatus(context.Background(), &fpb.LicensesStatusRequest{Verbose: true}, grpc.UseCompressor(gzip.Name))
+	assert.Nil(t, err)
+	assert.Equal(t, gzip.Name, recorder.Last())
+
+	// The size is recorded after the response is sent: wait for the RPCs to complete.
+	server.GracefulStop()
+	assert.Equal(t, before+2, wireSamples(t))
+}
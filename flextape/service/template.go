@@ -0,0 +1,113 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+)
+
+// licenseTemplate renders the environment and token file a tool needs to use an allocated seat.
+type licenseTemplate struct {
+	serverHost string
+	env        map[string]*template.Template
+	fileBody   *template.Template // nil if no token file is needed.
+	fileEnv    string
+}
+
+// templateData is the data available to the placeholders of a license template.
+type templateData struct {
+	InvocationID string
+	ServerHost   string
+	SeatIndex    int
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+func licenseTemplateFromConfig(config *fpb.LicenseTemplate) (*licenseTemplate, error) {
+	if config == nil {
+		return nil, nil
+	}
+	lt := &licenseTemplate{
+		serverHost: config.GetServerHost(),
+		env:        map[string]*template.Template{},
+		fileEnv:    config.GetFileEnv(),
+	}
+	for name, value := range config.GetEnv() {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+		t, err := parseTemplate(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for environment variable %s: %w", name, err)
+		}
+		lt.env[name] = t
+	}
+	if config.GetFileBody() != "" {
+		if lt.fileEnv == "" {
+			return nil, fmt.Errorf("file_env is required with file_body, to tell the tool where the file is")
+		}
+		t, err := parseTemplate("file_body", config.GetFileBody())
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for file_body: %w", err)
+		}
+		lt.fileBody = t
+	}
+	return lt, nil
+}
+
+// templatesFromConfig returns the license templates configured, by license type.
+func templatesFromConfig(config *fpb.Config) (map[string]*licenseTemplate, error) {
+	templates := map[string]*licenseTemplate{}
+	for _, l := range config.GetLicenseConfigs() {
+		name := formatLicenseType(l.GetLicense())
+		lt, err := licenseTemplateFromConfig(l.GetTemplate())
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for license %q: %w", name, err)
+		}
+		if lt != nil {
+			templates[name] = lt
+		}
+	}
+	return templates, nil
+}
+
+func execute(t *template.Template, data *templateData) (string, error) {
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Render returns the template rendered for the invocation, which must have a seat assigned.
+func (lt *licenseTemplate) Render(inv *invocation) (*fpb.LicenseMaterial, error) {
+	data := &templateData{
+		InvocationID: inv.ID,
+		ServerHost:   lt.serverHost,
+		SeatIndex:    inv.Seat - 1,
+	}
+	material := &fpb.LicenseMaterial{
+		SeatIndex: uint32(data.SeatIndex),
+		Env:       map[string]string{},
+		FileEnv:   lt.fileEnv,
+	}
+	for name, t := range lt.env {
+		value, err := execute(t, data)
+		if err != nil {
+			return nil, fmt.Errorf("rendering environment variable %s: %w", name, err)
+		}
+		material.Env[name] = value
+	}
+	if lt.fileBody != nil {
+		body, err := execute(lt.fileBody, data)
+		if err != nil {
+			return nil, fmt.Errorf("rendering file_body: %w", err)
+		}
+		material.FileBody = body
+	}
+	return material, nil
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fpb "github.com/System233/enkit/flextape/proto"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLicenseTemplateFromConfig(t *testing.T) {
+	lt, err := licenseTemplateFromConfig(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, lt)
+
+	for desc, config := range map[string]*fpb.LicenseTemplate{
+		"invalid env name":      {Env: map[string]string{"FOO=BAR": "x"}},
+		"invalid env template":  {Env: map[string]string{"LM_LICENSE_FILE": "{{.ServerHost"}},
+		"file without env":      {FileBody: "SERVER {{.ServerHost}}"},
+		"invalid file template": {FileBody: "{{if}}", FileEnv: "LICENSE_FILE"},
+	} {
+		_, err := licenseTemplateFromConfig(config)
+		assert.NotNil(t, err, desc)
+	}
+
+	_, err = templatesFromConfig(&fpb.Config{LicenseConfigs: []*fpb.LicenseConfig{{
+		License:  &fpb.License{Vendor: "xilinx", Feature: "feature_foo"},
+		Template: &fpb.LicenseTemplate{FileBody: "x"},
+	}}})
+	assert.ErrorContains(t, err, "xilinx::feature_foo")
+}
+
+func TestLicenseTemplateRender(t *testing.T) {
+	lt, err := licenseTemplateFromConfig(&fpb.LicenseTemplate{
+		ServerHost: "27000@license-server",
+		Env: map[string]string{
+			"LM_LICENSE_FILE": "{{.ServerHost}}",
+			"TOOL_SEAT":       "seat-{{.SeatIndex}}",
+		},
+		FileBody: "SERVER {{.ServerHost}}\nINVOCATION {{.InvocationID}}\n",
+		FileEnv:  "TOOL_LICENSE_FILE",
+	})
+	assert.Nil(t, err)
+
+	material, err := lt.Render(&invocation{ID: "inv-1", Seat: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), material.SeatIndex)
+	assert.Equal(t, map[string]string{"LM_LICENSE_FILE": "27000@license-server", "TOOL_SEAT": "seat-2"}, material.Env)
+	assert.Equal(t, "SERVER 27000@license-server\nINVOCATION inv-1\n", material.FileBody)
+	assert.Equal(t, "TOOL_LICENSE_FILE", material.FileEnv)
+
+	// Unknown placeholders are caught at render time.
+	bad, err := licenseTemplateFromConfig(&fpb.LicenseTemplate{Env: map[string]string{"X": "{{.Unknown}}"}})
+	assert.Nil(t, err)
+	_, err = bad.Render(&invocation{ID: "inv-1", Seat: 1})
+	assert.NotNil(t, err)
+}
+
+func TestSeatStability(t *testing.T) {
+	start := time.Now()
+	currentTime := start
+	now := &currentTime
+
+	idGen := &fakeID{}
+	stubs := gostub.Stub(&generateRandomID, idGen.Generate)
+	stubs.Stub(&timeNow, func() time.Time {
+		return *now
+	})
+	defer stubs.Reset()
+
+	server := testService(stateRunning)
+	lt, err := licenseTemplateFromConfig(&fpb.LicenseTemplate{Env: map[string]string{"TOOL_SEAT": "{{.SeatIndex}}"}})
+	assert.Nil(t, err)
+	server.licenses["xilinx::feature_foo"].template = lt
+
+	ctx := context.Background()
+	inv := func(id string) *fpb.Invocation {
+		return &fpb.Invocation{
+			Owner:    "unit_test",
+			BuildTag: "tag_1234",
+			Id:       id,
+			Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+		}
+	}
+	allocate := func(id string) *fpb.LicenseAllocated {
+		resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: inv(id)})
+		assert.Nil(t, err)
+		return resp.GetLicenseAllocated()
+	}
+
+	first, second := allocate(""), allocate("")
+	assert.Equal(t, "0", first.Material.Env["TOOL_SEAT"])
+	assert.Equal(t, "1", second.Material.Env["TOOL_SEAT"])
+
+	// Refreshes keep the seat.
+	for i := 0; i < 3; i++ {
+		*now = now.Add(time.Second)
+		resp, err := server.Refresh(ctx, &fpb.RefreshRequest{Invocation: inv(second.InvocationId)})
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(1), resp.Material.SeatIndex)
+	}
+
+	// A third invocation queues, and gets the seat released by the first.
+	resp, err := server.Allocate(ctx, &fpb.AllocateRequest{Invocation: inv("")})
+	assert.Nil(t, err)
+	third := resp.GetQueued().GetInvocationId()
+	assert.NotEqual(t, "", third)
+	_, err = server.Release(ctx, &fpb.ReleaseRequest{InvocationId: first.InvocationId})
+	assert.Nil(t, err)
+	server.janitor()
+	allocated := allocate(third)
+	assert.Equal(t, uint32(0), allocated.Material.SeatIndex)
+
+	resp2, err := server.Refresh(ctx, &fpb.RefreshRequest{Invocation: inv(second.InvocationId)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), resp2.Material.SeatIndex)
+}
+
+func TestNoTemplateNoMaterial(t *testing.T) {
+	stubs := gostub.Stub(&generateRandomID, (&fakeID{}).Generate)
+	defer stubs.Reset()
+
+	server := testService(stateRunning)
+	resp, err := server.Allocate(context.Background(), &fpb.AllocateRequest{Invocation: &fpb.Invocation{
+		Owner:    "unit_test",
+		BuildTag: "tag_1234",
+		Licenses: []*fpb.License{&fpb.License{Vendor: "xilinx", Feature: "feature_foo"}},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.GetLicenseAllocated().GetMaterial())
+
+	inv := server.licenses["xilinx::feature_foo"].GetAllocated(resp.GetLicenseAllocated().GetInvocationId())
+	assert.Equal(t, 0, inv.Seat)
+}
@@ -0,0 +1,61 @@
+// Package atomicfile replaces files atomically, so readers never see a partially written file.
+package atomicfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// TempSuffix is appended to the name of the temporary files used while writing.
+//
+// Temporary files are created in the same directory as the file they replace,
+// with a name starting with a '.', and are removed unless a crash happens.
+const TempSuffix = ".tmp"
+
+// rename is used to move a temporary file in place, replaced in tests.
+var rename = os.Rename
+
+// WriteFile replaces the file at path with one containing data, with the specified permissions.
+//
+// The data is written in a temporary file in the same directory, flushed to
+// disk, and renamed in place: even after a crash, path has either the old
+// or the new content, never a mix of the two, or a truncated file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	tmp, err := ioutil.TempFile(dir, "."+base+".*"+TempSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", tmp.Name(), err)
+	}
+
+	if err := rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes to disk the entries of a directory, so a rename survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,41 @@
+package atomicfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	assert.NoError(t, WriteFile(path, []byte("first"), 0600))
+	assert.NoError(t, WriteFile(path, []byte("second"), 0644))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// A failure before the rename leaves the old version in place, and no temporary files.
+	defer func() { rename = os.Rename }()
+	rename = func(from, to string) error {
+		return fmt.Errorf("simulated crash")
+	}
+	assert.ErrorContains(t, WriteFile(path, []byte("third"), 0644), "simulated crash")
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	assert.Error(t, WriteFile(filepath.Join(dir, "missing", "state.json"), []byte("first"), 0600))
+}
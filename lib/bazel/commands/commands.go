@@ -13,6 +13,7 @@ import (
 	"github.com/System233/enkit/lib/bes"
 	"github.com/System233/enkit/lib/client"
 	"github.com/System233/enkit/lib/git"
+	"github.com/System233/enkit/lib/kflags/kcobra"
 	"github.com/System233/enkit/lib/logger"
 	bespb "github.com/System233/enkit/third_party/bazel/buildeventstream"
 
@@ -25,8 +26,8 @@ type Root struct {
 	*cobra.Command
 	*client.BaseFlags
 
-	BuildBuddyApiKey string
-	BuildBuddyUrl    string
+	BuildBuddyAuth *bes.AuthFlags
+	BuildBuddyUrl  string
 }
 
 func New(base *client.BaseFlags) *Root {
@@ -50,7 +51,7 @@ func NewRoot(base *client.BaseFlags) *Root {
 		BaseFlags: base,
 	}
 
-	rc.PersistentFlags().StringVar(&rc.BuildBuddyApiKey, "buildbuddy-api-key", "", "build buddy api key used to bypass oauth2")
+	rc.BuildBuddyAuth = bes.DefaultAuthFlags().Register(&kcobra.FlagSet{FlagSet: rc.PersistentFlags()}, "buildbuddy-")
 	rc.PersistentFlags().StringVar(&rc.BuildBuddyUrl, "buildbuddy-url", "", "build buddy url instance")
 
 	return rc
@@ -61,7 +62,11 @@ func (r *Root) BuildBuddyClient() (*bes.BuildBuddyClient, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed parsing buildbuddy url: %w", err)
 	}
-	bc, err := bes.NewBuildBuddyClient(buddyUrl, r.BaseFlags, r.BuildBuddyApiKey)
+	auth, err := r.BuildBuddyAuth.Modifier(r.BaseFlags)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := bes.NewBuildBuddyClient(buddyUrl, r.BaseFlags, "", auth)
 	if err != nil {
 		return nil, fmt.Errorf("failed generating new buildbuddy client: %w", err)
 	}
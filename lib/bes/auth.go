@@ -0,0 +1,206 @@
+package bes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/config/identity"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/retry"
+)
+
+// APIKeyHeader is the header BuildBuddy expects API keys in.
+const APIKeyHeader = "x-buildbuddy-api-key"
+
+const (
+	// AuthAPIKey sends the API key in the x-buildbuddy-api-key header.
+	AuthAPIKey = "api-key"
+	// AuthBearer sends the API key as a bearer token, in the Authorization header.
+	AuthBearer = "bearer"
+)
+
+// AuthHeaders lists the valid values of AuthFlags.Header.
+var AuthHeaders = []string{AuthAPIKey, AuthBearer}
+
+// Redacted replaces the secrets in the errors returned by a BuildBuddyClient.
+const Redacted = "[REDACTED]"
+
+// WithHeader adds a header to every request, including the requests for
+// the following pages of a response.
+//
+// value is considered a secret, and redacted from errors and logs.
+func WithHeader(name, value string) Modifier {
+	return func(c *BuildBuddyClient) {
+		if c.headers == nil {
+			c.headers = http.Header{}
+		}
+		c.headers.Set(name, value)
+		c.secrets = append(c.secrets, value)
+	}
+}
+
+// WithAPIKey authenticates every request with a BuildBuddy API key, in the x-buildbuddy-api-key header.
+func WithAPIKey(key string) Modifier {
+	return func(c *BuildBuddyClient) {
+		c.apiKey = key
+	}
+}
+
+// WithBearerToken authenticates every request with a bearer token, in the Authorization header.
+func WithBearerToken(token string) Modifier {
+	return func(c *BuildBuddyClient) {
+		WithHeader("Authorization", "Bearer "+token)(c)
+		c.secrets = append(c.secrets, token)
+	}
+}
+
+// ReadSecretFile reads a secret, like an API key, from a file, ignoring surrounding whitespace.
+func ReadSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// LoadSecret loads a secret, like an API key, saved in the enkit identity store under name.
+func LoadSecret(store identity.IdentityStore, name string) (string, error) {
+	_, secret, err := store.Load(name)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", fmt.Errorf("no secret saved for %s", name)
+	}
+	return secret, nil
+}
+
+// AuthFlags configures how a BuildBuddyClient authenticates.
+type AuthFlags struct {
+	// API key to authenticate with.
+	APIKey string
+	// File to read the API key from.
+	APIKeyFile string
+	// Name the API key is saved under in the enkit identity store.
+	APIKeyIdentity string
+	// How to send the API key, one of AuthHeaders.
+	Header string
+
+	// Prefix the flags were registered with, for error messages.
+	prefix string
+}
+
+func DefaultAuthFlags() *AuthFlags {
+	return &AuthFlags{
+		Header: AuthAPIKey,
+	}
+}
+
+func (fl *AuthFlags) Register(set kflags.FlagSet, prefix string) *AuthFlags {
+	fl.prefix = prefix
+	set.StringVar(&fl.APIKey, prefix+"api-key", fl.APIKey, "build buddy api key used to bypass oauth2 - visible to other users of the machine, prefer --"+prefix+"api-key-file")
+	set.StringVar(&fl.APIKeyFile, prefix+"api-key-file", fl.APIKeyFile, "file containing the build buddy api key, as an alternative to --"+prefix+"api-key")
+	set.StringVar(&fl.APIKeyIdentity, prefix+"api-key-identity", fl.APIKeyIdentity, "name the build buddy api key was saved under in the enkit identity store, as an alternative to --"+prefix+"api-key")
+	set.StringVar(&fl.Header, prefix+"auth-header", fl.Header, "how to send the build buddy api key, one of: "+strings.Join(AuthHeaders, ", ")+" - api-key uses the "+APIKeyHeader+" header, bearer an Authorization header")
+	return fl
+}
+
+// Modifier returns a Modifier authenticating the client as configured.
+//
+// The API key is loaded from the file or identity store configured, if
+// any. bf provides the identity store, and is only used if APIKeyIdentity
+// is set.
+func (fl *AuthFlags) Modifier(bf *client.BaseFlags) (Modifier, error) {
+	set := 0
+	for _, value := range []string{fl.APIKey, fl.APIKeyFile, fl.APIKeyIdentity} {
+		if value != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, kflags.NewUsageErrorf("only one of --%[1]sapi-key, --%[1]sapi-key-file, --%[1]sapi-key-identity can be specified", fl.prefix)
+	}
+
+	key := fl.APIKey
+	switch {
+	case fl.APIKeyFile != "":
+		secret, err := ReadSecretFile(fl.APIKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read api key - %w", err)
+		}
+		key = secret
+
+	case fl.APIKeyIdentity != "":
+		if bf == nil {
+			return nil, fmt.Errorf("could not load api key %s - no identity store", fl.APIKeyIdentity)
+		}
+		store, err := bf.IdentityStore()
+		if err != nil {
+			return nil, err
+		}
+		secret, err := LoadSecret(store, fl.APIKeyIdentity)
+		if err != nil {
+			return nil, fmt.Errorf("could not load api key %s - %w", fl.APIKeyIdentity, err)
+		}
+		key = secret
+	}
+
+	switch fl.Header {
+	case AuthAPIKey, "":
+		if key == "" {
+			return func(*BuildBuddyClient) {}, nil
+		}
+		return WithAPIKey(key), nil
+	case AuthBearer:
+		if key == "" {
+			return nil, kflags.NewUsageErrorf("--%sauth-header=%s requires an api key", fl.prefix, AuthBearer)
+		}
+		return WithBearerToken(key), nil
+	}
+	return nil, kflags.NewUsageErrorf("invalid --%sauth-header %q - must be one of %s", fl.prefix, fl.Header, strings.Join(AuthHeaders, ", "))
+}
+
+// redactedError is an error with the secrets of the client removed from its message.
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redact removes the secrets of the client from the message of err.
+//
+// A retry.FatalError stays fatal, but the error it carries, which the
+// retry library returns as is, is redacted as well.
+func (c *BuildBuddyClient) redact(err error) error {
+	if err == nil {
+		return nil
+	}
+	if fatal, ok := err.(*retry.FatalError); ok {
+		return retry.Fatal(c.redact(fatal.Original))
+	}
+
+	message := err.Error()
+	for _, secret := range append([]string{c.apiKey}, c.secrets...) {
+		if secret != "" {
+			message = strings.ReplaceAll(message, secret, Redacted)
+		}
+	}
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{message: message, err: err}
+}
@@ -0,0 +1,132 @@
+package bes
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/System233/enkit/lib/errdiff"
+	bespb "github.com/System233/enkit/third_party/bazel/buildeventstream"
+)
+
+const testSecret = "s3cr3t-api-key"
+
+func TestAuthHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		mod    Modifier
+		header string
+		want   string
+	}{
+		{desc: "api key", mod: WithAPIKey(testSecret), header: APIKeyHeader, want: testSecret},
+		{desc: "bearer", mod: WithBearerToken(testSecret), header: "Authorization", want: "Bearer " + testSecret},
+		{desc: "custom", mod: WithHeader("X-Custom-Auth", testSecret), header: "X-Custom-Auth", want: testSecret},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			doer := &pagedHttpClient{t: t, events: progressEvents(25), pageSize: 10}
+			client := NewTestClient(doer, tc.mod, WithRetryOptions(fastRetry...))
+			_, err := client.GetBuildEvents(context.Background(), "invocation")
+			errdiff.Check(t, err, "")
+
+			// Every page is authenticated, not just the first.
+			if len(doer.headers) != 3 {
+				t.Fatalf("got %d requests, want 3", len(doer.headers))
+			}
+			for page, headers := range doer.headers {
+				if got := headers.Get(tc.header); got != tc.want {
+					t.Errorf("page %d: got %s %q, want %q", page, tc.header, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// echoHttpClient fails all requests, echoing the headers received.
+type echoHttpClient struct {
+	code int
+}
+
+func (c *echoHttpClient) Do(req *http.Request) (*http.Response, error) {
+	var message bytes.Buffer
+	message.WriteString("invalid credentials:")
+	for name, values := range req.Header {
+		message.WriteString(" " + name + "=" + strings.Join(values, ","))
+	}
+	return &http.Response{StatusCode: c.code, Body: io.NopCloser(&message)}, nil
+}
+
+func TestAuthRedacted(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		code int
+		mod  Modifier
+	}{
+		{desc: "api key, not retried", code: 401, mod: WithAPIKey(testSecret)},
+		{desc: "bearer, not retried", code: 403, mod: WithBearerToken(testSecret)},
+		{desc: "api key, retried", code: 503, mod: WithAPIKey(testSecret)},
+		{desc: "custom, retried", code: 500, mod: WithHeader("X-Custom-Auth", testSecret)},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			client := NewTestClient(&echoHttpClient{code: tc.code}, tc.mod, WithRetryOptions(fastRetry...))
+			err := client.ForEachEvent(context.Background(), "invocation", func(*bespb.BuildEvent) error {
+				return nil
+			})
+			errdiff.Check(t, err, "invalid credentials")
+			if err == nil {
+				return
+			}
+			if strings.Contains(err.Error(), testSecret) {
+				t.Errorf("error contains the secret: %v", err)
+			}
+			if !strings.Contains(err.Error(), Redacted) {
+				t.Errorf("error does not contain %s: %v", Redacted, err)
+			}
+		})
+	}
+}
+
+func TestAuthFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-key")
+	if err := ioutil.WriteFile(path, []byte(testSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		flags   AuthFlags
+		header  string
+		want    string
+		wantErr string
+	}{
+		{desc: "none", flags: AuthFlags{Header: AuthAPIKey}, header: APIKeyHeader},
+		{desc: "key", flags: AuthFlags{APIKey: testSecret, Header: AuthAPIKey}, header: APIKeyHeader, want: testSecret},
+		{desc: "file", flags: AuthFlags{APIKeyFile: path, Header: AuthAPIKey}, header: APIKeyHeader, want: testSecret},
+		{desc: "file bearer", flags: AuthFlags{APIKeyFile: path, Header: AuthBearer}, header: "Authorization", want: "Bearer " + testSecret},
+		{desc: "missing file", flags: AuthFlags{APIKeyFile: path + ".missing"}, wantErr: "could not read api key"},
+		{desc: "identity without store", flags: AuthFlags{APIKeyIdentity: "buildbuddy"}, wantErr: "no identity store"},
+		{desc: "both", flags: AuthFlags{APIKey: testSecret, APIKeyFile: path}, wantErr: "only one of"},
+		{desc: "bearer without key", flags: AuthFlags{Header: AuthBearer}, wantErr: "requires an api key"},
+		{desc: "invalid header", flags: AuthFlags{APIKey: testSecret, Header: "cookie"}, wantErr: "invalid --auth-header"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			mod, err := tc.flags.Modifier(nil)
+			errdiff.Check(t, err, tc.wantErr)
+			if err != nil {
+				return
+			}
+
+			doer := &pagedHttpClient{t: t, events: progressEvents(1), pageSize: 10}
+			client := NewTestClient(doer, mod)
+			_, err = client.GetBuildEvents(context.Background(), "invocation")
+			errdiff.Check(t, err, "")
+			if got := doer.headers[0].Get(tc.header); got != tc.want {
+				t.Errorf("got %s %q, want %q", tc.header, got, tc.want)
+			}
+		})
+	}
+}
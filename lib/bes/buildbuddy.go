@@ -3,13 +3,16 @@ package bes
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"time"
 
 	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/retry"
 	bespb "github.com/System233/enkit/third_party/bazel/buildeventstream"
 	bbpb "github.com/System233/enkit/third_party/buildbuddy/proto"
 
@@ -20,6 +23,9 @@ var (
 	getInvocationEndpoint = mustParseURL("rpc/BuildBuddyService/GetInvocation")
 )
 
+// DefaultMaxEvents is the maximum number of events fetched by GetBuildEvents by default.
+const DefaultMaxEvents = 1000000
+
 var _ httpDoer = http.DefaultClient
 
 type httpDoer interface {
@@ -30,15 +36,48 @@ type BuildBuddyClient struct {
 	baseEndpoint *url.URL
 	httpClient   httpDoer
 	apiKey       string
+	// Additional headers sent with every request.
+	headers http.Header
+	// Values redacted from errors, in addition to apiKey.
+	secrets []string
+
+	// Maximum number of events fetched, DefaultMaxEvents if <= 0.
+	maxEvents int
+	// Options to retry failed API calls with, after the defaults.
+	retry retry.Modifiers
+}
+
+// Modifier configures optional parameters of a BuildBuddyClient.
+type Modifier func(*BuildBuddyClient)
+
+// WithMaxEvents limits the number of events GetBuildEvents fetches before
+// giving up, to protect from invocations too large to process.
+func WithMaxEvents(max int) Modifier {
+	return func(c *BuildBuddyClient) {
+		c.maxEvents = max
+	}
+}
+
+// WithRetryOptions configures how failed API calls are retried.
+//
+// Calls failing with a transport error or an HTTP 5xx status are retried,
+// all other errors are considered fatal.
+func WithRetryOptions(mods ...retry.Modifier) Modifier {
+	return func(c *BuildBuddyClient) {
+		c.retry = append(c.retry, mods...)
+	}
 }
 
 // NewBuildBuddyClient creates a client for the BuildBuddy instance at the
 // specified URL. If not nil, auth cookies are discovered via BaseFlags and
-// added to every request. apiKey must be a valid BuildBuddy API key (other
-// forms of auth are not currently supported).
-func NewBuildBuddyClient(u *url.URL, bf *client.BaseFlags, apiKey string) (*BuildBuddyClient, error) {
+// added to every request. If not empty, apiKey must be a valid BuildBuddy
+// API key. Use WithBearerToken or WithHeader for other forms of auth, or
+// AuthFlags to configure them from the command line.
+func NewBuildBuddyClient(u *url.URL, bf *client.BaseFlags, apiKey string, mods ...Modifier) (*BuildBuddyClient, error) {
 	var jar http.CookieJar
+	var retries retry.Modifiers
 	if bf != nil {
+		retries = bf.RetryOptions()
 		_, cookie, err := bf.IdentityCookie()
 		if err != nil {
 			return nil, fmt.Errorf("failed to load identity cookie: %w", err)
@@ -50,67 +89,189 @@ func NewBuildBuddyClient(u *url.URL, bf *client.BaseFlags, apiKey string) (*Buil
 		}
 		jar.SetCookies(u, []*http.Cookie{cookie})
 	}
-	return &BuildBuddyClient{
+	c := &BuildBuddyClient{
 		baseEndpoint: u,
 		httpClient:   &http.Client{Jar: jar},
 		apiKey:       apiKey,
-	}, nil
+		retry:        retries,
+	}
+	for _, mod := range mods {
+		mod(c)
+	}
+	return c, nil
 }
 
 // NewTestClient makes a client specifically for testing. Not meant to be used in hot code.
-func NewTestClient(doer httpDoer) *BuildBuddyClient {
-	return &BuildBuddyClient{
+func NewTestClient(doer httpDoer, mods ...Modifier) *BuildBuddyClient {
+	c := &BuildBuddyClient{
 		baseEndpoint: &url.URL{},
 		httpClient:   doer,
 		apiKey:       "",
 	}
+	for _, mod := range mods {
+		mod(c)
+	}
+	return c
+}
+
+// retrier returns the options to retry API calls with.
+func (c *BuildBuddyClient) retrier(description string) *retry.Options {
+	mods := append(retry.Modifiers{
+		retry.WithDescription(description),
+		retry.WithBackoff(30 * time.Second),
+		retry.WithJitter(retry.JitterFull),
+	}, c.retry...)
+	return retry.New(mods...)
 }
 
 // GetBuildEvents fetches all BES events from the specified invocation by ID. It
 // returns an error if the call fails or exactly one invocation is not returned
 // for the specified ID.
+//
+// Events are accumulated in memory, up to the limit set with WithMaxEvents.
+// Use ForEachEvent to process the events of large invocations.
 func (c *BuildBuddyClient) GetBuildEvents(ctx context.Context, invocationId string) ([]*bespb.BuildEvent, error) {
-	reqBody := &bbpb.GetInvocationRequest{
-		Lookup: &bbpb.InvocationLookup{
-			InvocationId: invocationId,
-		},
+	maxEvents := c.maxEvents
+	if maxEvents <= 0 {
+		maxEvents = DefaultMaxEvents
 	}
-	resBody := &bbpb.GetInvocationResponse{}
-	err := c.doAPICall(ctx, getInvocationEndpoint, reqBody, resBody)
+
+	var events []*bespb.BuildEvent
+	err := c.ForEachEvent(ctx, invocationId, func(event *bespb.BuildEvent) error {
+		if len(events) >= maxEvents {
+			return fmt.Errorf("invocation %s has more than %d events - too large to process", invocationId, maxEvents)
+		}
+		events = append(events, event)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return events, nil
+}
 
-	if len(resBody.Invocation) != 1 {
-		return nil, fmt.Errorf("query by invocation_id returned %d results; want 1", len(resBody.Invocation))
-	}
+// ForEachEvent invokes callback with each BES event of the specified
+// invocation by ID, in order, as they are decoded from the response.
+//
+// Only one event at a time is held in memory. If callback returns ErrStop,
+// ForEachEvent stops and returns nil, any other error is returned as is.
+//
+// BuildBuddy returns the events of large invocations in pages, which are all
+// fetched in turn. Each page is retried independently on server and transport
+// errors, without invoking callback again for the events already processed.
+//
+// Returns an error if exactly one invocation is not returned for the
+// specified ID, after invoking callback for the events of the first.
+func (c *BuildBuddyClient) ForEachEvent(ctx context.Context, invocationId string, callback func(event *bespb.BuildEvent) error) error {
+	token := ""
+	for page := 1; ; page++ {
+		reqBody := &bbpb.GetInvocationRequest{
+			Lookup: &bbpb.InvocationLookup{
+				InvocationId: invocationId,
+			},
+		}
+		setPageToken(reqBody, token)
 
-	var events []*bespb.BuildEvent
-	for _, event := range resBody.Invocation[0].Event {
-		events = append(events, event.BuildEvent)
-	}
+		// Events already passed to callback by failed attempts are skipped.
+		delivered := 0
+		var stopped error
+		var decoder *eventDecoder
+		retrier := c.retrier(fmt.Sprintf("fetching page %d of invocation %s", page, invocationId))
+		err := retrier.RunContext(ctx, func(ctx context.Context) error {
+			seen := 0
+			decoder = &eventDecoder{callback: func(event *bespb.BuildEvent) error {
+				seen++
+				if seen <= delivered {
+					return nil
+				}
+				delivered++
+				stopped = callback(event)
+				return stopped
+			}}
+			return c.doAPIStream(ctx, getInvocationEndpoint, reqBody, func(body io.Reader) error {
+				err := decoder.Decode(body)
+				var malformed *malformedError
+				switch {
+				case stopped != nil:
+					return nil
+				case errors.As(err, &malformed):
+					return retry.Fatal(err)
+				case err != nil:
+					return fmt.Errorf("error reading body: %w", err)
+				}
+				return nil
+			})
+		})
+		if errors.Is(stopped, ErrStop) {
+			return nil
+		}
+		if stopped != nil {
+			return stopped
+		}
+		if err != nil {
+			return err
+		}
 
-	return events, nil
+		if decoder.invocations != 1 {
+			return fmt.Errorf("query by invocation_id returned %d results; want 1", decoder.invocations)
+		}
+		if decoder.nextPageToken == "" {
+			return nil
+		}
+		if decoder.nextPageToken == token {
+			return fmt.Errorf("page %d of invocation %s returned its own page token %q as next page", page, invocationId, token)
+		}
+		token = decoder.nextPageToken
+	}
 }
 
 // doAPICall performs a call at the specified input, marshaling `req` to binary
 // proto and unmarshaling the response into `res`.
+//
+// Errors that retrying the call cannot fix are wrapped in a retry.FatalError.
 func (c *BuildBuddyClient) doAPICall(ctx context.Context, endpoint *url.URL, req proto.Message, res proto.Message) error {
+	return c.doAPIStream(ctx, endpoint, req, func(body io.Reader) error {
+		resBodyBytes, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("error reading body: %w", err)
+		}
+		if err := proto.Unmarshal(resBodyBytes, res); err != nil {
+			return retry.Fatal(fmt.Errorf("failed to unmarshal response: %w", err))
+		}
+		return nil
+	})
+}
+
+// doAPIStream performs a call at the specified input, marshaling `req` to binary
+// proto and passing the body of a successful response to `decode` as it is read.
+//
+// Errors that retrying the call cannot fix are wrapped in a retry.FatalError.
+// decode is expected to do the same. Secrets are redacted from all errors.
+func (c *BuildBuddyClient) doAPIStream(ctx context.Context, endpoint *url.URL, req proto.Message, decode func(body io.Reader) error) error {
+	return c.redact(c.doRequest(ctx, endpoint, req, decode))
+}
+
+func (c *BuildBuddyClient) doRequest(ctx context.Context, endpoint *url.URL, req proto.Message, decode func(body io.Reader) error) error {
 	reqBytes, err := proto.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request to protobuf: %w", err)
+		return retry.Fatal(fmt.Errorf("failed to marshal request to protobuf: %w", err))
 	}
 
 	r, err := http.NewRequestWithContext(
 		ctx,
 		"POST",
-		c.baseEndpoint.ResolveReference(getInvocationEndpoint).String(),
+		c.baseEndpoint.ResolveReference(endpoint).String(),
 		bytes.NewReader(reqBytes),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return retry.Fatal(fmt.Errorf("failed to create request: %w", err))
+	}
+	if c.apiKey != "" {
+		r.Header.Add(APIKeyHeader, c.apiKey)
+	}
+	for name, values := range c.headers {
+		r.Header[name] = values
 	}
-	r.Header.Add("x-buildbuddy-api-key", c.apiKey)
 	r.Header.Add("Content-Type", "application/protobuf")
 
 	httpRes, err := c.httpClient.Do(r)
@@ -118,20 +279,19 @@ func (c *BuildBuddyClient) doAPICall(ctx context.Context, endpoint *url.URL, req
 		return fmt.Errorf("request failed: %w", err)
 	}
 	defer httpRes.Body.Close()
-	resBodyBytes, err := io.ReadAll(httpRes.Body)
-	if err != nil {
-		return fmt.Errorf("error reading body: %w", err)
-	}
 
 	if httpRes.StatusCode < 200 || httpRes.StatusCode > 299 {
-		return fmt.Errorf("HTTP response %d: %s", httpRes.StatusCode, resBodyBytes)
-	}
-
-	if err := proto.Unmarshal(resBodyBytes, res); err != nil {
-		return fmt.Errorf("failed to unmarshal response: %w", err)
+		resBodyBytes, err := io.ReadAll(io.LimitReader(httpRes.Body, 64*1024))
+		if err != nil {
+			return fmt.Errorf("error reading body: %w", err)
+		}
+		err = fmt.Errorf("HTTP response %d: %s", httpRes.StatusCode, resBodyBytes)
+		if httpRes.StatusCode < 500 {
+			return retry.Fatal(err)
+		}
+		return err
 	}
-
-	return nil
+	return decode(httpRes.Body)
 }
 
 // mustParseURL parses a string to a URL, panicking on failure. This function
@@ -3,17 +3,21 @@ package bes
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"testing"
 
 	"github.com/System233/enkit/lib/errdiff"
+	"github.com/System233/enkit/lib/retry"
 	"github.com/System233/enkit/lib/testutil"
 	bespb "github.com/System233/enkit/third_party/bazel/buildeventstream"
 	bbpb "github.com/System233/enkit/third_party/buildbuddy/proto"
 
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 type testHttpClient struct {
@@ -27,7 +31,7 @@ func newTestHttpClient(t *testing.T, code int, res proto.Message) *testHttpClien
 	}
 	msg, err := proto.Marshal(res)
 	if err != nil {
-		t.Fatalf("failed to marshal proto: %w", err)
+		t.Fatalf("failed to marshal proto: %v", err)
 	}
 	b := bytes.NewBuffer(msg)
 	return &testHttpClient{
@@ -147,6 +151,13 @@ func TestGetBuildEvents(t *testing.T) {
 			resCode: 500,
 			wantErr: "HTTP response 500",
 		},
+		{
+			desc:         "HTTP error not retried",
+			invocationID: "180c8fc1-bfe1-444e-a00c-2d53768125b0",
+			response:     &bbpb.GetInvocationResponse{},
+			resCode:      403,
+			wantErr:      "HTTP response 403",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -156,6 +167,7 @@ func TestGetBuildEvents(t *testing.T) {
 				baseEndpoint: &url.URL{},
 				httpClient:   testClient,
 				apiKey:       "foobar",
+				retry:        fastRetry,
 			}
 
 			got, gotErr := buildBuddy.GetBuildEvents(ctx, tc.invocationID)
@@ -167,3 +179,290 @@ func TestGetBuildEvents(t *testing.T) {
 		})
 	}
 }
+
+var fastRetry = retry.Modifiers{retry.WithAttempts(3), retry.WithWait(0), retry.WithFuzzy(0), retry.WithBackoff(0)}
+
+// pagedHttpClient serves the events of an invocation in pages of pageSize
+// events, failing the requests listed in failures with the specified error.
+type pagedHttpClient struct {
+	t        *testing.T
+	events   []*bespb.BuildEvent
+	pageSize int
+	failures map[int]error
+
+	requests []*bbpb.GetInvocationRequest
+	headers  []http.Header
+}
+
+func (c *pagedHttpClient) Do(req *http.Request) (*http.Response, error) {
+	request := len(c.requests)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &bbpb.GetInvocationRequest{}
+	if err := proto.Unmarshal(body, parsed); err != nil {
+		return nil, err
+	}
+	c.requests = append(c.requests, parsed)
+	c.headers = append(c.headers, req.Header)
+
+	failure := c.failures[request]
+	var status *httpStatusError
+	if errors.As(failure, &status) {
+		return &http.Response{StatusCode: status.code, Body: io.NopCloser(bytes.NewBufferString(status.message))}, nil
+	}
+	var truncated *truncatedError
+	if failure != nil && !errors.As(failure, &truncated) {
+		return nil, failure
+	}
+
+	start := 0
+	if token := pageToken(c.t, parsed); token != "" {
+		fmt.Sscanf(token, "page-%d", &start)
+	}
+	end := start + c.pageSize
+	if end > len(c.events) {
+		end = len(c.events)
+	}
+	response := &bbpb.GetInvocationResponse{Invocation: []*bbpb.Invocation{&bbpb.Invocation{
+		InvocationId: parsed.GetLookup().GetInvocationId(),
+		Success:      true,
+	}}}
+	for _, event := range c.events[start:end] {
+		response.Invocation[0].Event = append(response.Invocation[0].Event, &bbpb.InvocationEvent{BuildEvent: event})
+	}
+	msg, err := proto.Marshal(response)
+	if err != nil {
+		c.t.Fatalf("failed to marshal proto: %v", err)
+	}
+	if end < len(c.events) {
+		msg = protowire.AppendTag(msg, responseNextPageTokenField, protowire.BytesType)
+		msg = protowire.AppendString(msg, fmt.Sprintf("page-%d", end))
+	}
+	if truncated != nil {
+		body := io.MultiReader(bytes.NewReader(msg[:len(msg)/2]), &failingReader{err: truncated})
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(body)}, nil
+	}
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBuffer(msg))}, nil
+}
+
+// pageToken returns the page_token set with setPageToken, from the unknown fields of req.
+func pageToken(t *testing.T, req *bbpb.GetInvocationRequest) string {
+	t.Helper()
+	token := ""
+	for unknown := req.ProtoReflect().GetUnknown(); len(unknown) > 0; {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			t.Fatalf("malformed unknown fields: %v", protowire.ParseError(n))
+		}
+		unknown = unknown[n:]
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			t.Fatalf("malformed unknown field %d: %v", num, protowire.ParseError(n))
+		}
+		if num == requestPageTokenField && typ == protowire.BytesType {
+			token, _ = protowire.ConsumeString(unknown[:n])
+		}
+		unknown = unknown[n:]
+	}
+	return token
+}
+
+// truncatedError fails reading the body of a response half way through.
+type truncatedError struct{}
+
+func (e *truncatedError) Error() string {
+	return "connection reset by peer"
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+type httpStatusError struct {
+	code    int
+	message string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.message
+}
+
+func progressEvents(count int) []*bespb.BuildEvent {
+	var events []*bespb.BuildEvent
+	for i := 0; i < count; i++ {
+		events = append(events, &bespb.BuildEvent{
+			Id: &bespb.BuildEventId{
+				Id: &bespb.BuildEventId_Progress{
+					Progress: &bespb.BuildEventId_ProgressId{OpaqueCount: int32(i)},
+				},
+			},
+		})
+	}
+	return events
+}
+
+func TestGetBuildEventsPaged(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		events    int
+		pageSize  int
+		maxEvents int
+		failures  map[int]error
+		wantPages int
+		wantErr   string
+	}{
+		{
+			desc:      "single page",
+			events:    3,
+			pageSize:  10,
+			wantPages: 1,
+		},
+		{
+			desc:      "multiple pages",
+			events:    25,
+			pageSize:  10,
+			wantPages: 3,
+		},
+		{
+			desc:     "server and transport errors are retried",
+			events:   25,
+			pageSize: 10,
+			failures: map[int]error{
+				1: &httpStatusError{code: 503, message: "unavailable"},
+				2: fmt.Errorf("connection reset by peer"),
+			},
+			wantPages: 5,
+		},
+		{
+			desc:     "truncated responses are retried",
+			events:   25,
+			pageSize: 10,
+			failures: map[int]error{
+				0: &truncatedError{},
+				2: &truncatedError{},
+			},
+			wantPages: 5,
+		},
+		{
+			desc:     "client errors are not retried",
+			events:   25,
+			pageSize: 10,
+			failures: map[int]error{
+				1: &httpStatusError{code: 404, message: "not found"},
+			},
+			wantPages: 2,
+			wantErr:   "HTTP response 404: not found",
+		},
+		{
+			desc:     "retries exhausted",
+			events:   25,
+			pageSize: 10,
+			failures: map[int]error{
+				1: &httpStatusError{code: 500, message: "boom"},
+				2: &httpStatusError{code: 502, message: "bad gateway"},
+				3: &httpStatusError{code: 503, message: "unavailable"},
+			},
+			wantPages: 4,
+			wantErr:   "gave up after 3 attempts",
+		},
+		{
+			desc:      "too many events",
+			events:    25,
+			pageSize:  10,
+			maxEvents: 15,
+			wantPages: 2,
+			wantErr:   "more than 15 events",
+		},
+		{
+			desc:      "exactly max events",
+			events:    20,
+			pageSize:  10,
+			maxEvents: 20,
+			wantPages: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			events := progressEvents(tc.events)
+			doer := &pagedHttpClient{t: t, events: events, pageSize: tc.pageSize, failures: tc.failures}
+			client := NewTestClient(doer, WithMaxEvents(tc.maxEvents), WithRetryOptions(fastRetry...))
+
+			got, gotErr := client.GetBuildEvents(context.Background(), "180c8fc1-bfe1-444e-a00c-2d53768125b0")
+			errdiff.Check(t, gotErr, tc.wantErr)
+			if len(doer.requests) != tc.wantPages {
+				t.Errorf("got %d requests, want %d", len(doer.requests), tc.wantPages)
+			}
+			for _, request := range doer.requests {
+				if request.GetLookup().GetInvocationId() != "180c8fc1-bfe1-444e-a00c-2d53768125b0" {
+					t.Errorf("got request for invocation %q", request.GetLookup().GetInvocationId())
+				}
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, got, events)
+		})
+	}
+}
+
+func TestForEachEvent(t *testing.T) {
+	events := progressEvents(25)
+	invocationID := "180c8fc1-bfe1-444e-a00c-2d53768125b0"
+
+	// Stopping early does not fetch the following pages.
+	doer := &pagedHttpClient{t: t, events: events, pageSize: 10, failures: map[int]error{1: &truncatedError{}}}
+	client := NewTestClient(doer, WithRetryOptions(fastRetry...))
+	var got []*bespb.BuildEvent
+	err := client.ForEachEvent(context.Background(), invocationID, func(event *bespb.BuildEvent) error {
+		got = append(got, event)
+		if len(got) == 18 {
+			return ErrStop
+		}
+		return nil
+	})
+	errdiff.Check(t, err, "")
+	testutil.AssertProtoEqual(t, got, events[:18])
+	if len(doer.requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(doer.requests))
+	}
+
+	// Errors from the callback are returned as is, and not retried.
+	doer = &pagedHttpClient{t: t, events: events, pageSize: 10}
+	client = NewTestClient(doer, WithRetryOptions(fastRetry...))
+	failure := fmt.Errorf("callback failed")
+	err = client.ForEachEvent(context.Background(), invocationID, func(event *bespb.BuildEvent) error {
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+	if len(doer.requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(doer.requests))
+	}
+}
+
+func TestForEachEventMalformed(t *testing.T) {
+	for _, body := range [][]byte{
+		// Field number 0.
+		{0x02, 0x00},
+		// Invocation longer than the body.
+		{0x12, 0x10, 0x12, 0x00},
+		// Event of an invalid wire type.
+		{0x12, 0x02, 0x17, 0x00},
+	} {
+		doer := &testHttpClient{cannedResponse: &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewReader(body))}}
+		client := NewTestClient(doer, WithRetryOptions(fastRetry...))
+		err := client.ForEachEvent(context.Background(), "invocation", func(event *bespb.BuildEvent) error {
+			return nil
+		})
+		if err == nil {
+			t.Errorf("body %x - no error", body)
+		}
+	}
+}
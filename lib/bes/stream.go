@@ -0,0 +1,230 @@
+package bes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	bespb "github.com/System233/enkit/third_party/bazel/buildeventstream"
+	bbpb "github.com/System233/enkit/third_party/buildbuddy/proto"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ErrStop can be returned by the callback of ForEachEvent to stop iterating
+// over events without failing.
+var ErrStop = errors.New("stop iterating over build events")
+
+// MaxEventSize is the largest single event accepted in a GetInvocationResponse.
+const MaxEventSize = 64 * 1024 * 1024
+
+// Field numbers of the messages decoded by eventDecoder, from invocation.proto.
+//
+// The page_token and next_page_token fields used by BuildBuddy to page the
+// events of large invocations are not in the vendored invocation.proto: they
+// are encoded and decoded by hand, with the numbers used by BuildBuddy.
+const (
+	requestPageTokenField      protowire.Number = 3
+	responseInvocationField    protowire.Number = 2
+	responseNextPageTokenField protowire.Number = 3
+	invocationEventField       protowire.Number = 2
+)
+
+// setPageToken sets the page_token of the request, to retrieve the page of
+// events following the one that returned token as next_page_token.
+func setPageToken(req *bbpb.GetInvocationRequest, token string) {
+	var unknown []byte
+	if token != "" {
+		unknown = protowire.AppendTag(unknown, requestPageTokenField, protowire.BytesType)
+		unknown = protowire.AppendString(unknown, token)
+	}
+	req.ProtoReflect().SetUnknown(unknown)
+}
+
+// malformedError is returned by eventDecoder for responses that cannot be
+// parsed, as opposed to responses that could not be read.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return fmt.Sprintf("malformed GetInvocationResponse: %s", e.err)
+}
+
+func (e *malformedError) Unwrap() error {
+	return e.err
+}
+
+func malformed(format string, args ...interface{}) error {
+	return &malformedError{err: fmt.Errorf(format, args...)}
+}
+
+// eventDecoder decodes the events in a GetInvocationResponse as they are
+// read, without holding more than one event in memory at a time.
+type eventDecoder struct {
+	// Invoked with each event of the first invocation in the response.
+	callback func(event *bespb.BuildEvent) error
+
+	// Number of invocations in the response.
+	invocations int
+	// Token of the next page, from the response.
+	nextPageToken string
+}
+
+// Decode reads a GetInvocationResponse from body.
+//
+// Returns the errors reading body as is, a malformedError if the response
+// cannot be parsed, or the error returned by the callback.
+func (d *eventDecoder) Decode(body io.Reader) error {
+	r := bufio.NewReader(body)
+	for {
+		num, typ, err := readTag(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case num == responseInvocationField && typ == protowire.BytesType:
+			d.invocations++
+			size, err := readSize(r, -1)
+			if err != nil {
+				return err
+			}
+			// Only the events of the first invocation are returned, the
+			// others are just counted, to report the error.
+			if d.invocations > 1 {
+				err = skipBytes(r, size)
+			} else {
+				err = d.decodeInvocation(r, size)
+			}
+			if err != nil {
+				return err
+			}
+
+		case num == responseNextPageTokenField && typ == protowire.BytesType:
+			size, err := readSize(r, MaxEventSize)
+			if err != nil {
+				return err
+			}
+			token := make([]byte, size)
+			if _, err := io.ReadFull(r, token); err != nil {
+				return unexpectedEOF(err)
+			}
+			d.nextPageToken = string(token)
+
+		default:
+			if err := skipField(r, typ); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeInvocation decodes an Invocation of size bytes, invoking the callback for each event.
+func (d *eventDecoder) decodeInvocation(body *bufio.Reader, size int64) error {
+	limited := &io.LimitedReader{R: body, N: size}
+	r := bufio.NewReader(limited)
+	for {
+		num, typ, err := readTag(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if num != invocationEventField || typ != protowire.BytesType {
+			if err := skipField(r, typ); err != nil {
+				return err
+			}
+			continue
+		}
+
+		size, err := readSize(r, MaxEventSize)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return unexpectedEOF(err)
+		}
+		event := &bbpb.InvocationEvent{}
+		if err := proto.Unmarshal(data, event); err != nil {
+			return &malformedError{err: err}
+		}
+		if err := d.callback(event.BuildEvent); err != nil {
+			return err
+		}
+	}
+
+	// The body ended before the invocation did.
+	if limited.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// readTag reads the tag of the next field, returning io.EOF if there are no more fields.
+func readTag(r *bufio.Reader) (protowire.Number, protowire.Type, error) {
+	tag, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	num, typ := protowire.DecodeTag(tag)
+	if !num.IsValid() {
+		return 0, 0, malformed("invalid field number %d", num)
+	}
+	return num, typ, nil
+}
+
+// readSize reads the size of a length delimited field, up to max bytes if max >= 0.
+func readSize(r *bufio.Reader, max int64) (int64, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if (max >= 0 && size > uint64(max)) || size > uint64(1<<62) {
+		return 0, malformed("field of %d bytes is too large", size)
+	}
+	return int64(size), nil
+}
+
+func skipBytes(r *bufio.Reader, size int64) error {
+	if _, err := r.Discard(int(size)); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+// skipField skips the value of a field of type typ.
+func skipField(r *bufio.Reader, typ protowire.Type) error {
+	switch typ {
+	case protowire.VarintType:
+		_, err := binary.ReadUvarint(r)
+		return unexpectedEOF(err)
+	case protowire.Fixed32Type:
+		return skipBytes(r, 4)
+	case protowire.Fixed64Type:
+		return skipBytes(r, 8)
+	case protowire.BytesType:
+		size, err := readSize(r, -1)
+		if err != nil {
+			return err
+		}
+		return skipBytes(r, size)
+	}
+	return malformed("unsupported wire type %d", typ)
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for reads in the middle of a field.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
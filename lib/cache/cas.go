@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrDigestMismatch is returned when the content stored in a CAS does not match its sha256.
+var ErrDigestMismatch = errors.New("content sha256 does not match the expected one")
+
+// BlobFile is the name of the file storing the content of a blob in each entry of the Store.
+const BlobFile = "blob"
+
+// CAS stores blobs by their sha256, on top of a Store.
+//
+// Each blob is stored in its own entry of the Store, and is never modified once added.
+// Blobs are verified when added: a blob not matching its sha256 is never stored.
+type CAS struct {
+	Store Store
+}
+
+// NewCAS returns a CAS storing blobs in the specified Store.
+func NewCAS(store Store) *CAS {
+	return &CAS{Store: store}
+}
+
+// casKey returns the key of the entry of the Store for the blob, after validating its hash.
+func casKey(hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 '%s' - must be %d hex encoded bytes", hash, sha256.Size)
+	}
+	return "sha256:" + hash, nil
+}
+
+// Get returns the path of the file storing the blob with the specified sha256.
+//
+// If the blob is not stored, the error returned wraps os.ErrNotExist.
+func (c *CAS) Get(hash string) (string, error) {
+	key, err := casKey(hash)
+	if err != nil {
+		return "", err
+	}
+	location, err := c.Store.Exists(key)
+	if err != nil {
+		return "", err
+	}
+	if location != "" {
+		path := filepath.Join(location, BlobFile)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("blob %s - %w", hash, os.ErrNotExist)
+}
+
+// Has returns true if the blob with the specified sha256 is stored.
+func (c *CAS) Has(hash string) (bool, error) {
+	_, err := c.Get(hash)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Blob is a blob being added to a CAS, returned by Reserve.
+type Blob struct {
+	cas       *CAS
+	hash      string
+	location  string
+	committed bool
+}
+
+// Path returns the path of the file where to write the content of the blob.
+func (b *Blob) Path() string {
+	return filepath.Join(b.location, BlobFile)
+}
+
+// Commit verifies the content written to Path, and makes the blob available.
+//
+// Returns the final path of the blob. If the content does not match the sha256,
+// it is discarded, and the error returned wraps ErrDigestMismatch.
+func (b *Blob) Commit() (string, error) {
+	f, err := os.Open(b.Path())
+	if err != nil {
+		b.Discard()
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		b.Discard()
+		return "", err
+	}
+	return b.commit(hex.EncodeToString(hash.Sum(nil)))
+}
+
+// commit makes the blob available, if the computed sha256 matches the expected one.
+func (b *Blob) commit(computed string) (string, error) {
+	if computed != strings.ToLower(strings.TrimSpace(b.hash)) {
+		b.Discard()
+		return "", fmt.Errorf("%w - computed sha256 is %s, required is %s", ErrDigestMismatch, computed, b.hash)
+	}
+	final, err := b.cas.Store.Commit(b.location)
+	if err != nil {
+		b.Discard()
+		return "", err
+	}
+	b.committed = true
+	// Releases the entry, see the Store interface.
+	b.cas.Store.Rollback(final)
+	return filepath.Join(final, BlobFile), nil
+}
+
+// Discard drops the blob and any content written. It is a noop after Commit.
+func (b *Blob) Discard() error {
+	if b.committed {
+		return nil
+	}
+	return b.cas.Store.Rollback(b.location)
+}
+
+// Reserve prepares to add the blob with the specified sha256.
+//
+// If the blob is stored already, its path is returned, with a nil Blob.
+// Otherwise, the content must be written to Blob.Path, followed by either
+// Blob.Commit or Blob.Discard.
+//
+// Other processes reserving the same blob wait for it to be committed or
+// discarded, as per the Store used.
+func (c *CAS) Reserve(hash string) (string, *Blob, error) {
+	key, err := casKey(hash)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for {
+		location, found, err := c.Store.Get(key)
+		if err != nil {
+			return "", nil, err
+		}
+		if !found {
+			return "", &Blob{cas: c, hash: hash, location: location}, nil
+		}
+
+		path := filepath.Join(location, BlobFile)
+		if _, err := os.Stat(path); err == nil {
+			c.Store.Rollback(location)
+			return path, nil, nil
+		}
+		// The entry is corrupted, purge it and start over.
+		if err := c.Store.Purge(location); err != nil {
+			return "", nil, fmt.Errorf("invalid entry for blob %s could not be purged - %w", hash, err)
+		}
+	}
+}
+
+// PutReader stores the content read from r as the blob with the specified sha256, returning its path.
+//
+// If the blob is stored already, r is not read. The content is verified while
+// written: if it does not match the sha256, nothing is stored, and the error
+// returned wraps ErrDigestMismatch.
+func (c *CAS) PutReader(hash string, r io.Reader) (string, error) {
+	path, blob, err := c.Reserve(hash)
+	if err != nil || blob == nil {
+		return path, err
+	}
+
+	f, err := os.OpenFile(blob.Path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		blob.Discard()
+		return "", err
+	}
+	digest := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, digest), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		blob.Discard()
+		return "", err
+	}
+	return blob.commit(hex.EncodeToString(digest.Sum(nil)))
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Of(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// files returns the files stored under root.
+func files(t *testing.T, root string) []string {
+	var result []string
+	assert.Nil(t, filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			result = append(result, path)
+		}
+		return err
+	}))
+	return result
+}
+
+func TestCASPutReader(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	cas := NewCAS(&Local{Root: cacheRoot})
+	hash := sha256Of("hello, world")
+
+	has, err := cas.Has(hash)
+	assert.Nil(t, err)
+	assert.False(t, has)
+	_, err = cas.Get(hash)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "%s", err)
+
+	path, err := cas.PutReader(hash, strings.NewReader("hello, world"))
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, world", string(data))
+
+	has, err = cas.Has(strings.ToUpper(hash))
+	assert.Nil(t, err)
+	assert.True(t, has)
+	got, err := cas.Get(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, path, got)
+
+	// Adding the same blob again does not read the content.
+	again, err := cas.PutReader(hash, strings.NewReader("ignored"))
+	assert.Nil(t, err)
+	assert.Equal(t, path, again)
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, world", string(data))
+}
+
+func TestCASMismatch(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	cas := NewCAS(&Local{Root: cacheRoot})
+	hash := sha256Of("hello, world")
+
+	_, err = cas.PutReader(hash, strings.NewReader("goodbye, world"))
+	assert.True(t, errors.Is(err, ErrDigestMismatch), "%s", err)
+	assert.Nil(t, files(t, cacheRoot))
+
+	has, err := cas.Has(hash)
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	_, blob, err := cas.Reserve(hash)
+	assert.Nil(t, err)
+	assert.NotNil(t, blob)
+	assert.Nil(t, ioutil.WriteFile(blob.Path(), []byte("goodbye, world"), 0600))
+	_, err = blob.Commit()
+	assert.True(t, errors.Is(err, ErrDigestMismatch), "%s", err)
+	assert.Nil(t, files(t, cacheRoot))
+}
+
+func TestCASReserve(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	cas := NewCAS(&Local{Root: cacheRoot})
+	hash := sha256Of("reserved")
+
+	path, blob, err := cas.Reserve(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, "", path)
+	assert.Nil(t, ioutil.WriteFile(blob.Path(), []byte("reserved"), 0600))
+	final, err := blob.Commit()
+	assert.Nil(t, err)
+	assert.Nil(t, blob.Discard())
+
+	path, blob, err = cas.Reserve(hash)
+	assert.Nil(t, err)
+	assert.Nil(t, blob)
+	assert.Equal(t, final, path)
+
+	// A discarded blob is not stored.
+	_, blob, err = cas.Reserve(sha256Of("discarded"))
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(blob.Path(), []byte("discarded"), 0600))
+	assert.Nil(t, blob.Discard())
+	has, err := cas.Has(sha256Of("discarded"))
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	// An entry missing its blob is replaced.
+	assert.Nil(t, os.Remove(final))
+	path, blob, err = cas.Reserve(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, "", path)
+	assert.NotNil(t, blob)
+	assert.Nil(t, blob.Discard())
+}
+
+func TestCASInvalidHash(t *testing.T) {
+	cas := NewCAS(&Local{Root: "/nonexistent"})
+	for _, hash := range []string{"", "abc", "zz" + sha256Of("")[2:], sha256Of("") + "00"} {
+		_, err := cas.PutReader(hash, strings.NewReader(""))
+		assert.NotNil(t, err, "%s", hash)
+		_, err = cas.Get(hash)
+		assert.NotNil(t, err, "%s", hash)
+		assert.False(t, errors.Is(err, os.ErrNotExist))
+		_, err = cas.Has(hash)
+		assert.NotNil(t, err, "%s", hash)
+	}
+}
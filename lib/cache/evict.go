@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/lib/multierror"
+)
+
+// entryOf returns the path of the committed entry a location returned by Get refers to.
+func entryOf(location string) string {
+	location = filepath.Clean(location)
+	if idx := strings.LastIndex(location, ".tmp"); idx >= 0 {
+		return location[:idx]
+	}
+	return location
+}
+
+// acquire marks an entry as in use. Must be called with the lock held.
+func (c *Local) acquire(location string) {
+	if c.inuse == nil {
+		c.inuse = map[string]int{}
+	}
+	c.inuse[entryOf(location)] += 1
+}
+
+// release releases a location returned by Get. Must be called with the lock held.
+func (c *Local) release(location string) {
+	entry := entryOf(location)
+	if c.inuse[entry] <= 1 {
+		delete(c.inuse, entry)
+		return
+	}
+	c.inuse[entry] -= 1
+}
+
+// dirSize returns the total size of the files in a directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// cached is an entry found on disk by Evict.
+type cached struct {
+	path string
+	size int64
+	// Time of last use.
+	used time.Time
+	// True for committed entries, false for left overs of an interrupted Get or Purge.
+	committed bool
+}
+
+// scan returns all the entries in the cache.
+func (c *Local) scan() ([]cached, error) {
+	prefixes, err := ioutil.ReadDir(c.Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var errs []error
+	var result []cached
+	for _, prefix := range prefixes {
+		// Entries are stored in directories named after the first byte of the hash.
+		if !prefix.IsDir() || len(prefix.Name()) != 2 {
+			continue
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(c.Root, prefix.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(c.Root, prefix.Name(), entry.Name())
+			size, err := dirSize(path)
+			if err != nil {
+				// The entry may have been purged or committed in the meantime.
+				if !os.IsNotExist(err) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			result = append(result, cached{
+				path:      path,
+				size:      size,
+				used:      entry.ModTime(),
+				committed: !strings.ContainsAny(entry.Name(), ".-"),
+			})
+		}
+	}
+	return result, multierror.New(errs)
+}
+
+// evict removes an entry from disk, unless in use.
+func (c *Local) evict(entry cached) (bool, error) {
+	c.lock.Lock()
+	if entry.committed && c.inuse[entry.path] > 0 {
+		c.lock.Unlock()
+		return false, nil
+	}
+	tempname := rename(entry.path)
+	c.lock.Unlock()
+	return true, os.RemoveAll(tempname)
+}
+
+// Evict removes the entries not used for longer than MaxAge, followed by the least
+// recently used entries until the size of the cache is below MaxSize.
+//
+// Entries returned by Get are never evicted until the location is released with
+// Rollback or Purge. Uncommitted locations, left over by processes that
+// crashed or are still filling them, are only removed once older than MaxAge.
+//
+// Entries in use are tracked within this process only: Get records the time of
+// last use of an entry, so other processes sharing the cache should configure a
+// MaxAge long enough to never evict entries they are actively using.
+func (c *Local) Evict() error {
+	entries, err := c.scan()
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	now := time.Now()
+	var total int64
+	var candidates []cached
+	for _, entry := range entries {
+		if c.MaxAge > 0 && now.Sub(entry.used) > c.MaxAge {
+			evicted, err := c.evict(entry)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if evicted {
+				continue
+			}
+		}
+
+		total += entry.size
+		if entry.committed {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].used.Before(candidates[j].used)
+	})
+	for _, entry := range candidates {
+		if c.MaxSize <= 0 || total <= int64(c.MaxSize) {
+			break
+		}
+		evicted, err := c.evict(entry)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if evicted {
+			total -= entry.size
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.size = total
+	c.sized = true
+	return multierror.New(errs)
+}
+
+// evictIfFull accounts for a newly committed entry, and invokes Evict if the cache is now larger than MaxSize.
+func (c *Local) evictIfFull(location string) error {
+	size, err := dirSize(location)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.size += size
+	full := !c.sized || c.size > int64(c.MaxSize)
+	c.lock.Unlock()
+
+	if !full {
+		return nil
+	}
+	return c.Evict()
+}
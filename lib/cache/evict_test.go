@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fill creates a committed entry for key, containing size bytes, last used at the time specified.
+func fill(t *testing.T, c *Local, key string, size int, used time.Time) string {
+	location, found, err := c.Get(key)
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(location, "data"), []byte(strings.Repeat("x", size)), 0600))
+	final, err := c.Commit(location)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Rollback(location))
+	assert.Nil(t, os.Chtimes(final, used, used))
+	return final
+}
+
+func TestEvict(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	c := &Local{Root: cacheRoot, MaxSize: 250}
+	now := time.Now()
+	oldest := fill(t, c, "oldest", 100, now.Add(-3*time.Hour))
+	older := fill(t, c, "older", 100, now.Add(-2*time.Hour))
+	newer := fill(t, c, "newer", 100, now.Add(-1*time.Hour))
+
+	// Using an entry makes it the most recently used.
+	location, found, err := c.Get("oldest")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Nil(t, c.Rollback(location))
+
+	assert.Nil(t, c.Evict())
+	assert.True(t, PathIsDir(oldest))
+	assert.False(t, PathIsDir(older))
+	assert.True(t, PathIsDir(newer))
+
+	// Entries not used within MaxAge are evicted regardless of the size.
+	c.MaxAge = 30 * time.Minute
+	assert.Nil(t, c.Evict())
+	assert.True(t, PathIsDir(oldest))
+	assert.False(t, PathIsDir(newer))
+
+	// Uncommitted entries are only evicted once older than MaxAge.
+	c.MaxSize = 1
+	temp, found, err := c.Get("uncommitted")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, c.Evict())
+	assert.True(t, PathIsDir(temp))
+	assert.False(t, PathIsDir(oldest))
+
+	assert.Nil(t, os.Chtimes(temp, now.Add(-time.Hour), now.Add(-time.Hour)))
+	assert.Nil(t, c.Evict())
+	assert.False(t, PathIsDir(temp))
+}
+
+func TestEvictInUse(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	c := &Local{Root: cacheRoot, MaxAge: time.Minute}
+	entry := fill(t, c, "in-use", 10, time.Now())
+
+	// Entries returned by Get are not evicted until released.
+	location, found, err := c.Get("in-use")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, entry, location)
+
+	assert.Nil(t, os.Chtimes(entry, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	assert.Nil(t, c.Evict())
+	assert.True(t, PathIsDir(entry))
+
+	assert.Nil(t, c.Rollback(location))
+	assert.Nil(t, c.Evict())
+	assert.False(t, PathIsDir(entry))
+}
+
+func TestEvictOnCommit(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	c := &Local{Root: cacheRoot, MaxSize: 250, EvictOnCommit: true}
+	now := time.Now()
+	first := fill(t, c, "first", 100, now.Add(-2*time.Hour))
+	second := fill(t, c, "second", 100, now.Add(-1*time.Hour))
+	assert.True(t, PathIsDir(first))
+	assert.True(t, PathIsDir(second))
+
+	third := fill(t, c, "third", 100, now)
+	assert.False(t, PathIsDir(first))
+	assert.True(t, PathIsDir(second))
+	assert.True(t, PathIsDir(third))
+}
@@ -2,20 +2,54 @@ package cache
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/System233/enkit/lib/flock"
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/kirsle/configdir"
 )
 
 // Local implements a local file system based cache.
+//
+// By default, the cache grows forever. Set MaxSize and MaxAge to bound it,
+// and invoke Evict periodically, or set EvictOnCommit.
 type Local struct {
 	Root string
+
+	// Maximum size of the cache, in bytes. When exceeded, Evict removes the least
+	// recently used entries first. 0 means unlimited.
+	MaxSize int
+	// Maximum time an entry is kept since it was last used. 0 means forever.
+	MaxAge time.Duration
+	// If true, Commit invokes Evict once the cache grows larger than MaxSize.
+	EvictOnCommit bool
+	// Maximum time Get waits for another process filling the same entry, before
+	// falling back to a private location. 0 means DefaultLockTimeout, a negative
+	// value disables locking.
+	//
+	// Get never waits for an entry being filled through this same Local: for example,
+	// hedged downloads of the same file each get a private location right away, and
+	// the first one committed wins.
+	LockTimeout time.Duration
+
+	lock sync.Mutex
+	// Number of handles returned by Get not yet released, by entry.
+	inuse map[string]int
+	// Lock files held for uncommitted locations, by location.
+	locks map[string]*os.File
+	// Entries being filled through this Local, with the lock file held or being acquired.
+	filling map[string]bool
+	// Estimated size of the cache, valid only after the first Evict.
+	size  int64
+	sized bool
 }
 
 // NewLocal will return a Local cache pointing to the OS specific directory where files are cached.
@@ -31,6 +65,10 @@ func NewLocal(label string) *Local {
 
 func (l *Local) Register(flags kflags.FlagSet, prefix string) *Local {
 	flags.StringVar(&l.Root, prefix+"cache-dir", l.Root, "Directory where to cache files")
+	flags.IntVar(&l.MaxSize, prefix+"cache-max-size", l.MaxSize, "Maximum size of the cache in bytes, least recently used entries are evicted first - 0 means unlimited")
+	flags.DurationVar(&l.MaxAge, prefix+"cache-max-age", l.MaxAge, "Entries not used for longer than this are evicted from the cache - 0 means never")
+	flags.BoolVar(&l.EvictOnCommit, prefix+"cache-evict-on-commit", l.EvictOnCommit, "If true, evict entries from the cache as soon as it grows larger than --"+prefix+"cache-max-size")
+	flags.DurationVar(&l.LockTimeout, prefix+"cache-lock-timeout", l.LockTimeout, "How long to wait for another process storing the same entry in the cache, before storing a private copy - 0 means the default, negative disables locking")
 	return l
 }
 
@@ -73,23 +111,158 @@ func hash(key string) []byte {
 // from cache (and results stored) only after Commit() is called.
 //
 // If you need to make changes to values in Local(), use Clone().
+//
+// The entry returned is considered in use, and will not be evicted, until
+// the location is passed to Rollback() or Purge().
 func (c *Local) Get(key string) (string, bool, error) {
 	sum := hash(key)
 	dirPrefix := filepath.Join(c.Root, fmt.Sprintf("%x", sum[0:1]))
 	dirEnd := fmt.Sprintf("%x", sum[1:len(sum)-1])
 	dirFull := filepath.Join(dirPrefix, dirEnd)
-	if PathIsDir(dirFull) {
+
+	if c.existing(dirFull) {
 		return dirFull, true, nil
 	}
 	err := os.MkdirAll(dirPrefix, 0750)
 	if err != nil {
 		return "", false, err
 	}
-	dirFull, err = ioutil.TempDir(dirPrefix, dirEnd+".tmp")
+
+	// Wait for any other process filling the same entry, and check again.
+	var lock *os.File
+	if c.startFilling(dirFull) {
+		lock, err = c.lockEntry(dirFull)
+		if lock == nil {
+			c.stopFilling(dirFull)
+		}
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if lock != nil && c.existing(dirFull) {
+		closeLock(lock)
+		c.stopFilling(dirFull)
+		return dirFull, true, nil
+	}
+
+	location, err := ioutil.TempDir(dirPrefix, dirEnd+".tmp")
 	if err != nil {
+		if lock != nil {
+			closeLock(lock)
+			c.stopFilling(dirFull)
+		}
 		return "", false, err
 	}
-	return dirFull, false, nil
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.acquire(dirFull)
+	if lock != nil {
+		if c.locks == nil {
+			c.locks = map[string]*os.File{}
+		}
+		c.locks[location] = lock
+	}
+	return location, false, nil
+}
+
+// existing returns true and marks the entry as in use if it has been committed already.
+func (c *Local) existing(entry string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !PathIsDir(entry) {
+		return false
+	}
+	c.acquire(entry)
+	// Record the time of last use, to evict the least recently used entries first.
+	now := time.Now()
+	os.Chtimes(entry, now, now)
+	return true
+}
+
+// startFilling marks entry as being filled through this Local.
+//
+// Returns false if it already was: waiting for the lock would then only delay
+// the caller, who gets a private location instead.
+func (c *Local) startFilling(entry string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.filling[entry] {
+		return false
+	}
+	if c.filling == nil {
+		c.filling = map[string]bool{}
+	}
+	c.filling[entry] = true
+	return true
+}
+
+func (c *Local) stopFilling(entry string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.filling, entry)
+}
+
+// DefaultLockTimeout is the maximum time Get waits for another process filling the same entry by default.
+var DefaultLockTimeout = 30 * time.Second
+
+// lockEntry acquires the lock file of an entry, held until the location returned by Get is committed or purged.
+//
+// Returns nil if locking is disabled, or if the lock could not be acquired
+// within the timeout, in which case Get falls back to a private location.
+func (c *Local) lockEntry(entry string) (*os.File, error) {
+	timeout := c.LockTimeout
+	if timeout < 0 {
+		return nil, nil
+	}
+	if timeout == 0 {
+		timeout = DefaultLockTimeout
+	}
+
+	for {
+		f, err := os.OpenFile(entry+".lock", os.O_RDWR|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock.Lock(f, flock.Exclusive, timeout); err != nil {
+			f.Close()
+			if errors.Is(err, flock.ErrTimeout) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		// Lock files are removed once released: make sure the one locked was not
+		// removed in the meantime, or another process may lock a new one.
+		if locked, err := f.Stat(); err == nil {
+			if current, err := os.Stat(f.Name()); err == nil && os.SameFile(locked, current) {
+				return f, nil
+			}
+		}
+		flock.Unlock(f)
+		f.Close()
+	}
+}
+
+// closeLock removes and releases a lock file returned by lockEntry, if any.
+func closeLock(f *os.File) {
+	if f == nil {
+		return
+	}
+	os.Remove(f.Name())
+	flock.Unlock(f)
+	f.Close()
+}
+
+// unlock releases the lock held for an uncommitted location. Must be called with the lock held.
+func (c *Local) unlock(location string) {
+	lock, found := c.locks[location]
+	if !found {
+		return
+	}
+	closeLock(lock)
+	delete(c.locks, location)
+	delete(c.filling, location[:strings.LastIndex(location, ".tmp")])
 }
 
 // Returns true if a cache entry by the specified key exists already.
@@ -138,9 +311,17 @@ func (c *Local) Commit(location string) (string, error) {
 	// If we fail turning it into a final destination, it means we raced with another thread
 	// also calling Get() and Commit() in parallel.
 	// We should not fail here. Instead, we let the other thread win. It was faster.
-	if err := os.Rename(location, location[:idx]); err != nil && !os.IsExist(err) {
+	err := os.Rename(location, location[:idx])
+	c.lock.Lock()
+	c.unlock(location)
+	c.lock.Unlock()
+	if err != nil && !os.IsExist(err) {
 		return location[:idx], err
 	}
+	if c.EvictOnCommit && c.MaxSize > 0 {
+		// Eviction is best effort, the entry was committed successfully.
+		c.evictIfFull(location[:idx])
+	}
 	return location[:idx], nil
 }
 
@@ -175,16 +356,33 @@ func (c *Local) Purge(location string) error {
 	if c.Root != "." && !strings.HasPrefix(location, c.Root) {
 		panic(fmt.Sprintf("Tried to purge '%s' - outside the root of the cache", location))
 	}
-	// Ensure no partial file is read from the cache while deletion is in progress.
+	c.lock.Lock()
+	c.release(location)
+	tempname := rename(location)
+	// Other processes waiting for the entry will try to fill it again.
+	c.unlock(location)
+	c.lock.Unlock()
+	return os.RemoveAll(tempname)
+}
+
+// rename moves location out of the way, returning its new path.
+//
+// Ensures no partial file is read from the cache while deletion is in progress.
+func rename(location string) string {
 	tempname := fmt.Sprintf("%s-%016x", location, rand.Uint64())
 	os.Rename(location, tempname)
-	return os.RemoveAll(tempname)
+	return tempname
 }
 
 // Rollback purges the directory if it has not been committed.
+//
+// Either way, the location is no longer considered in use.
 func (c *Local) Rollback(location string) error {
 	idx := strings.LastIndex(location, ".tmp")
 	if idx < 0 {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.release(location)
 		return nil
 	}
 	return c.Purge(location)
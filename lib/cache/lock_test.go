@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fillOrRead gets key from the cache, fills it slowly if not found, and verifies its content.
+//
+// Returns true if the entry was filled, false if it was found in the cache.
+func fillOrRead(c *Local, key string) (bool, error) {
+	location, found, err := c.Get(key)
+	if err != nil {
+		return false, err
+	}
+	defer c.Rollback(location)
+
+	if !found {
+		for ix := 0; ix < 5; ix++ {
+			if err := ioutil.WriteFile(filepath.Join(location, fmt.Sprintf("part-%d", ix)), []byte(key), 0600); err != nil {
+				return false, err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if location, err = c.Commit(location); err != nil {
+			return false, err
+		}
+	}
+
+	for ix := 0; ix < 5; ix++ {
+		data, err := ioutil.ReadFile(filepath.Join(location, fmt.Sprintf("part-%d", ix)))
+		if err != nil {
+			return !found, fmt.Errorf("incomplete entry %s - %w", location, err)
+		}
+		if string(data) != key {
+			return !found, fmt.Errorf("corrupted entry %s - %s", location, data)
+		}
+	}
+	return !found, nil
+}
+
+func TestLockGoroutines(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	filled := 0
+	for ix := 0; ix < 20; ix++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &Local{Root: cacheRoot}
+			fill, err := fillOrRead(c, "hammered-key")
+			assert.Nil(t, err)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if fill {
+				filled++
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, filled)
+}
+
+func TestLockTimeout(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	c := &Local{Root: cacheRoot, LockTimeout: 50 * time.Millisecond}
+	first, found, err := c.Get("slow-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// The first location is never committed: the second falls back to a private location.
+	other := &Local{Root: cacheRoot, LockTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	second, found, err := other.Get("slow-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.NotEqual(t, first, second)
+	assert.True(t, time.Since(start) >= other.LockTimeout)
+
+	// Once released, the lock is acquired immediately.
+	assert.Nil(t, c.Rollback(first))
+	third, found, err := other.Get("slow-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, other.Rollback(third))
+	assert.Nil(t, other.Rollback(second))
+}
+
+func TestLockSameLocal(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	// An entry being filled through the same Local gets a private location right away.
+	c := &Local{Root: cacheRoot, LockTimeout: time.Hour}
+	first, found, err := c.Get("hedged-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	second, found, err := c.Get("hedged-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.NotEqual(t, first, second)
+
+	// The first location committed wins.
+	committed, err := c.Commit(second)
+	assert.Nil(t, err)
+	_, err = c.Commit(first)
+	assert.Nil(t, err)
+
+	other := &Local{Root: cacheRoot, LockTimeout: time.Hour}
+	location, found, err := other.Get("hedged-key")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, committed, location)
+	assert.Nil(t, other.Rollback(location))
+
+	// Once all locations are released, Get locks the entry again.
+	assert.Nil(t, c.Purge(committed))
+	third, found, err := c.Get("hedged-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, c.Rollback(third))
+	fourth, found, err := other.Get("hedged-key")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, other.Rollback(fourth))
+}
+
+// TestLockHelperProcess is run as a subprocess by TestLockProcesses.
+func TestLockHelperProcess(t *testing.T) {
+	root := os.Getenv("CACHE_TEST_LOCK_ROOT")
+	if root == "" {
+		t.Skip("only run as a subprocess of TestLockProcesses")
+	}
+	fill, err := fillOrRead(&Local{Root: root}, "hammered-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fill {
+		fmt.Println("FILLED")
+	}
+}
+
+func TestLockProcesses(t *testing.T) {
+	cacheRoot, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheRoot)
+
+	var wg sync.WaitGroup
+	outputs := make([]string, 8)
+	for ix := range outputs {
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+			cmd.Env = append(os.Environ(), "CACHE_TEST_LOCK_ROOT="+cacheRoot)
+			output, err := cmd.CombinedOutput()
+			assert.Nil(t, err, "%s", output)
+			outputs[ix] = string(output)
+		}(ix)
+	}
+	wg.Wait()
+
+	filled := 0
+	for _, output := range outputs {
+		if strings.Contains(output, "FILLED") {
+			filled++
+		}
+	}
+	assert.Equal(t, 1, filled, "%v", outputs)
+}
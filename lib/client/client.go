@@ -2,6 +2,7 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"github.com/System233/enkit/lib/cache"
 	"github.com/System233/enkit/lib/client/ccontext"
 	"github.com/System233/enkit/lib/config"
@@ -9,12 +10,19 @@ import (
 	"github.com/System233/enkit/lib/config/identity"
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/kflags/provider"
+	"github.com/System233/enkit/lib/khttp/kclient"
 	"github.com/System233/enkit/lib/logger"
 	"github.com/System233/enkit/lib/logger/klog"
 	"github.com/System233/enkit/lib/oauth/cookie"
 	"github.com/System233/enkit/lib/progress"
+	"github.com/System233/enkit/lib/render"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type AuthFlags struct {
@@ -61,17 +69,89 @@ type BaseFlags struct {
 	// The name of the command, used in help strings and to load config customizations specific to the command.
 	CommandName string
 
-	// Avoid displaying progress bars.
+	// Avoid displaying progress bars. Also implied by --quiet.
 	NoProgress bool
 
 	// Allow to override the security token used, and identity.
 	OverrideToken string
 	OverrideIdentity string
 
+	// When an error is returned, append the last debug messages logged to the error message.
+	DebugDumpOnError bool
+
+	// Refresh credentials expiring within this window before using them. 0 disables refreshes.
+	RefreshWindow time.Duration
+
+	// True if the command is computing shell completions, see kcobra.IsCompletion.
+	// This is not controlled by command line, it is set by the main of the command.
+	Completing bool
+	// Use the commands cached by a previous completion, if recorded within this age, 0 to disable the cache.
+	CompletionCacheMaxAge time.Duration
+	// Function used to refresh a stale completion cache without delaying the completion.
+	// By default, the command is run again in the background, see RefreshCompletionCache.
+	CompletionRefresher func() error
+
+	// Record all the outbound RPCs, and write them at the end of the run to this file, "-" for stderr.
+	TraceRPC string
+	// Number of bytes of each payload to capture in the trace, 0 to not capture payloads.
+	TraceRPCPayload int
+
+	// Format of the log messages on the console, either "text" or "json", one JSON object per line.
+	LogFormat string
+	// Minimum priority of the messages logged on the console. If set, overrides --loglevel-console, -q and -v.
+	LogLevel string
+
+	// If set, messages are appended to this file instead of being written on the console.
+	LogFile string
+	// Rotate LogFile before it grows larger than this many megabytes, 0 to never rotate based on size.
+	LogMaxSize int
+	// Rotate LogFile once it has been written for longer than this, 0 to never rotate based on age.
+	LogMaxAge time.Duration
+	// Number of rotated log files to keep.
+	LogMaxFiles int
+	// Compress the rotated log files with gzip.
+	LogCompress bool
+
+	// Format of the output of commands, and use of colors. --quiet is shared with the logger flags.
+	Output *render.Flags
+
+	// Configuration of the default http transport, like proxy and root CAs to use.
+	// Applied by Init, it affects all the http requests not using a transport of their own.
+	HTTP *kclient.Flags
+
+	// Function used to refresh credentials about to expire. If nil, credentials are never refreshed.
+	// This is not controlled by command line, commands capable of authenticating the user set it.
+	Refresher TokenRefresher
+
 	// Logger object. Guaranteed to never be nil, and always be usable.
 	Log *logger.Proxy
+
+	// Renderer to print the output of commands, configured by Output and --quiet.
+	// Guaranteed to never be nil, recreated by Init.
+	Render *render.Renderer
+
+	// Retains the last messages logged, including debug messages, for DebugDumpOnError.
+	DebugRing *logger.Ring
+
+	refreshLock sync.Mutex
+	refreshing  bool
+
+	tracer        *RPCTracer
+	tracerWritten bool
+
+	// Flags registered by Run, to redact their secrets from DebugRing.
+	secrets kflags.SecretLister
+
+	logFile *logger.RotatingFile
 }
 
+const (
+	// DefaultLogMaxSize is the size in megabytes a --log-file is rotated at by default.
+	DefaultLogMaxSize = 100
+	// DefaultLogMaxFiles is the number of rotated log files kept by default.
+	DefaultLogMaxFiles = 5
+)
+
 func DefaultBaseFlags(commandName, configName string) *BaseFlags {
 	return &BaseFlags{
 		ConfigOpener: defcon.Open,
@@ -83,10 +163,25 @@ func DefaultBaseFlags(commandName, configName string) *BaseFlags {
 		Local:         cache.NewLocal(configName),
 		ProviderFlags: provider.DefaultProviderFlags(),
 
-		Log: &logger.Proxy{Logger: logger.NewAccumulator()},
+		LogFormat:             "text",
+		LogMaxSize:            DefaultLogMaxSize,
+		LogMaxFiles:           DefaultLogMaxFiles,
+		RefreshWindow:         DefaultRefreshWindow,
+		CompletionCacheMaxAge: DefaultCompletionCacheMaxAge,
+		HTTP:                  kclient.DefaultFlags(),
+		Output:                render.DefaultFlags(),
+
+		Log:       &logger.Proxy{Logger: logger.NewAccumulator()},
+		Render:    defaultRenderer(),
+		DebugRing: logger.NewRing(logger.DefaultRingSize, nil),
 	}
 }
 
+func defaultRenderer() *render.Renderer {
+	r, _ := render.New()
+	return r
+}
+
 // Use with kcobra.Run or similar functions to decoarete an IdentityError
 // with the proper error message to guide the user through authentication.
 //
@@ -103,7 +198,7 @@ func (bf *BaseFlags) IdentityErrorHandler(message string) kflags.ErrorHandler {
 		}
 		identity := bf.Identity()
 		if identity == "" {
-			identity, _, _ = bf.IdentityToken()
+			identity, _, _ = bf.identityToken(false)
 			if identity == "" {
 				identity = "youruser@yourdomain.com"
 			}
@@ -114,6 +209,36 @@ func (bf *BaseFlags) IdentityErrorHandler(message string) kflags.ErrorHandler {
 	}
 }
 
+// DebugDumpErrorHandler returns a kflags.ErrorHandler appending the last messages
+// logged to the error, if DebugDumpOnError is set.
+//
+// Debug messages are retained even if not shown on the console, so the dump
+// can help diagnose a failure without having to re-run the command with
+// higher verbosity. Use it as the last handler passed to kcobra.Run or similar.
+func (bf *BaseFlags) DebugDumpErrorHandler() kflags.ErrorHandler {
+	return func(err error) error {
+		if !bf.DebugDumpOnError || bf.DebugRing == nil {
+			return err
+		}
+		var dump strings.Builder
+		if derr := bf.DebugRing.Dump(&dump); derr != nil || dump.Len() <= 0 {
+			return err
+		}
+		return fmt.Errorf("%w\n\nLast messages logged (secrets redacted):\n%s", err, logger.IndentLines(dump.String(), "    "))
+	}
+}
+
+// RenderErrorHandler returns a kflags.ErrorHandler writing the error on stdout
+// as JSON, with its exit code, if --format=json was specified.
+//
+// Use it as the last handler passed to kcobra.Run or similar, so the error
+// written is the one shown to the user.
+func (bf *BaseFlags) RenderErrorHandler() kflags.ErrorHandler {
+	return func(err error) error {
+		return bf.Render.Error(err)
+	}
+}
+
 func (bf *BaseFlags) IdentityStore() (identity.IdentityStore, error) {
 	bf.Log.Infof("Loading credentials from store '%s'", bf.ConfigName)
 	id, err := identity.NewStore(bf.ConfigName, bf.ConfigOpener)
@@ -124,7 +249,11 @@ func (bf *BaseFlags) IdentityStore() (identity.IdentityStore, error) {
 }
 
 func (bf *BaseFlags) IdentityCookie() (string, *http.Cookie, error) {
-	username, token, err := bf.IdentityToken()
+	return bf.identityCookie(true)
+}
+
+func (bf *BaseFlags) identityCookie(refresh bool) (string, *http.Cookie, error) {
+	username, token, err := bf.identityToken(refresh)
 	if err != nil {
 		return "", nil, kflags.NewIdentityError(err)
 	}
@@ -132,7 +261,14 @@ func (bf *BaseFlags) IdentityCookie() (string, *http.Cookie, error) {
 	return username, cookie.CredentialsCookie(bf.CookiePrefix, token), nil
 }
 
+// IdentityToken returns the identity and token to use to authenticate the user.
+//
+// Credentials expiring within RefreshWindow are refreshed first, using Refresher.
 func (bf *BaseFlags) IdentityToken() (string, string, error) {
+	return bf.identityToken(true)
+}
+
+func (bf *BaseFlags) identityToken(refresh bool) (string, string, error) {
 	if bf.OverrideToken != "" || bf.OverrideIdentity != "" {
 		if bf.OverrideIdentity == "" || bf.OverrideToken == "" {
 			return "", "", kflags.NewUsageErrorf("if override-identity or override-token is specified, both need to be specified")
@@ -145,27 +281,68 @@ func (bf *BaseFlags) IdentityToken() (string, string, error) {
 		return "", "", err
 	}
 
-	identity := bf.Identity()
-	username, token, err := store.Load(identity)
+	var expires time.Time
+	var username, token string
+	if es, ok := store.(identity.ExpiringIdentityStore); ok {
+		username, token, expires, err = es.LoadExpiring(bf.Identity())
+	} else {
+		username, token, err = store.Load(bf.Identity())
+	}
 	if err != nil {
 		bf.Log.Infof("Error loading credentials for '%s' - %s", bf.Printable(), err)
 		return "", "", kflags.NewIdentityError(err)
 	}
+	bf.redact(token)
+
+	if refresh && bf.needsRefresh(expires) {
+		rusername, rtoken, rerr := bf.RefreshToken(username)
+		switch {
+		case rerr == nil:
+			bf.redact(rtoken)
+			username, token = rusername, rtoken
+		case !expires.After(time.Now()):
+			return "", "", rerr
+		default:
+			bf.Log.Warnf("Credentials of '%s' expire at %s, and could not be refreshed - %s", username, expires.Format(time.RFC1123), rerr)
+		}
+	}
 	bf.Log.Infof("Using credentials of '%s' for requested '%s'", username, bf.Printable())
 	return username, token, nil
 }
 
+// redact hides secrets, like the credentials of the user, from the messages retained by DebugRing.
+func (bf *BaseFlags) redact(secrets ...string) {
+	if bf.DebugRing != nil {
+		bf.DebugRing.AddSecrets(secrets...)
+	}
+}
+
 func (bf *BaseFlags) Register(set kflags.FlagSet, prefix string) *BaseFlags {
 	bf.Flags.Register(set, prefix)
 	bf.AuthFlags.Register(set, prefix)
 	bf.Local.Register(set, prefix)
 	bf.ProviderFlags.Register(set, prefix)
+	bf.HTTP.Register(set, prefix)
+	bf.Output.Register(set, prefix)
 
 	set.StringVar(&bf.OverrideToken, prefix+"override-token", "", "Use this security token instead of loading one from disk")
 	set.StringVar(&bf.OverrideIdentity, prefix+"override-identity", "", "Use this identity instead of loading one from disk")
 
+	set.StringVar(&bf.LogFormat, prefix+"log-format", bf.LogFormat, "Format of the log messages: text, for humans, or json, one object per line with the time, level, message and fields of each message")
+	set.StringVar(&bf.LogLevel, prefix+"log-level", bf.LogLevel, "Minimum level of the log messages to show: debug, info, warning, error. If set, overrides --loglevel-console, --quiet and --verbose")
+	set.StringVar(&bf.LogFile, prefix+"log-file", bf.LogFile, "Append the log messages to this file instead of showing them on the console, rotating it based on --log-max-size and --log-max-age")
+	set.IntVar(&bf.LogMaxSize, prefix+"log-max-size", bf.LogMaxSize, "With --log-file, rotate the file before it grows larger than this many megabytes, 0 to never rotate based on size")
+	set.DurationVar(&bf.LogMaxAge, prefix+"log-max-age", bf.LogMaxAge, "With --log-file, rotate the file once it has been written for longer than this, 0 to never rotate based on age")
+	set.IntVar(&bf.LogMaxFiles, prefix+"log-max-files", bf.LogMaxFiles, "With --log-file, number of rotated files to keep, as <file>.1, <file>.2, ...")
+	set.BoolVar(&bf.LogCompress, prefix+"log-compress", bf.LogCompress, "With --log-file, compress the rotated files with gzip")
+
 	set.StringVar(&bf.CookiePrefix, prefix+"cookie-prefix", "", "Prefix to use in naming the authentication cookie. You should not normally need to change this")
 	set.BoolVar(&bf.NoProgress, prefix+"no-progress", bf.NoProgress, "Disable progress bars")
+	set.DurationVar(&bf.RefreshWindow, prefix+"token-refresh-window", bf.RefreshWindow, "Automatically refresh credentials expiring within this time before using them, 0 to disable")
+	set.DurationVar(&bf.CompletionCacheMaxAge, prefix+"completion-cache-max-age", bf.CompletionCacheMaxAge, "Compute shell completions with the commands cached by a previous completion, refreshing them in the background once older than this, 0 to always fetch them")
+	set.BoolVar(&bf.DebugDumpOnError, prefix+"debug-dump-on-error", bf.DebugDumpOnError, "If the command fails, show the last messages logged, including debug messages, with the error")
+	set.StringVar(&bf.TraceRPC, prefix+"trace-rpc", bf.TraceRPC, "Record all the gRPC and http calls performed, and write them at the end of the run to this file, or '-' for stderr")
+	set.IntVar(&bf.TraceRPCPayload, prefix+"trace-rpc-payload-bytes", bf.TraceRPCPayload, "With --trace-rpc, also record up to this many bytes of each request and response. Payloads may contain credentials")
 	return bf
 }
 
@@ -175,6 +352,9 @@ func (bf *BaseFlags) LoadFlagAssets(populator kflags.Populator, assets map[strin
 
 func (bf *BaseFlags) Run(set kflags.FlagSet, populator kflags.Populator, run kflags.Runner) {
 	bf.Register(set, "")
+	if lister, ok := set.(kflags.SecretLister); ok {
+		bf.secrets = lister
+	}
 	// At this point, all flags have the default value set from the .go files.
 	// Change the defaults based on environment variables.
 	if err := populator(kflags.NewEnvAugmenter()); err != nil {
@@ -184,13 +364,42 @@ func (bf *BaseFlags) Run(set kflags.FlagSet, populator kflags.Populator, run kfl
 	// Now that we have (possibly) user chosen defaults, load the defaults
 	// from the configured default provider.
 	//
-	// This will likely result in fetching the flags from https/astore.
-	if err := bf.UpdateFlagDefaults(populator, ""); err != nil {
+	// This will likely result in fetching the flags from https/astore, unless
+	// the command is computing completions, and the commands were cached.
+	if bf.Completing {
+		bf.updateCompletionDefaults(populator)
+	} else if err := bf.UpdateFlagDefaults(populator, ""); err != nil {
 		bf.Log.Infof("Updating default flags for domain failed with: %s", err)
 	}
 
 	// Finally, run the command.
 	run(set, bf.Log.Infof, bf.Init)
+	if err := bf.WriteRPCTrace(); err != nil {
+		bf.Log.Errorf("%s", err)
+	}
+}
+
+// RPCTraceErrorHandler returns a kflags.ErrorHandler writing the RPC trace, if --trace-rpc was specified.
+//
+// Run writes the trace once the command completes successfully, but commands
+// failing exit before Run returns. Pass this handler to kcobra.Run or similar
+// so the trace is also written on failures.
+func (bf *BaseFlags) RPCTraceErrorHandler() kflags.ErrorHandler {
+	return func(err error) error {
+		if werr := bf.WriteRPCTrace(); werr != nil {
+			bf.Log.Errorf("%s", werr)
+		}
+		return err
+	}
+}
+
+// WriteRPCTrace writes the calls recorded with --trace-rpc. The trace is written at most once.
+func (bf *BaseFlags) WriteRPCTrace() error {
+	if bf.tracer == nil || bf.tracer.LogOnly || bf.tracerWritten {
+		return nil
+	}
+	bf.tracerWritten = true
+	return bf.tracer.WriteFile(bf.TraceRPC)
 }
 
 // Initializes a BaseFlags object after all flags have been parsed.
@@ -200,24 +409,131 @@ func (bf *BaseFlags) Run(set kflags.FlagSet, populator kflags.Populator, run kfl
 func (bf *BaseFlags) Init() error {
 	// The newly loaded flags may change how logging needs to be performed.
 	// Let's recreate the logging objects.
-	var newlog logger.Logger
-	newlog, err := klog.New(bf.CommandName, klog.FromFlags(*bf.Flags))
+	newlog, err := bf.newLogger()
 	if err != nil {
 		bf.Log.Infof("could not initialize logger - %s", err)
 		newlog = &logger.DefaultLogger{Printer: log.Printf}
 	}
 
+	if bf.DebugRing != nil {
+		bf.DebugRing.SetNext(newlog)
+		newlog = bf.DebugRing
+
+		bf.redact(bf.OverrideToken)
+		if bf.secrets != nil {
+			bf.redact(bf.secrets.SecretValues()...)
+		}
+	}
 	bf.Log.Replace(newlog)
+
+	// Init is invoked multiple times, keep the calls recorded so far.
+	// Calls are always logged, so they are displayed with -vv.
+	if bf.tracer == nil || (bf.TraceRPC != "" && bf.tracer.LogOnly) {
+		bf.tracer = NewRPCLogger(bf.LibraryLog())
+		if bf.TraceRPC != "" {
+			bf.tracer.MaxPayload, bf.tracer.LogOnly = bf.TraceRPCPayload, false
+		}
+		SetRPCTracer(bf.tracer)
+	}
+
+	if bf.HTTP != nil {
+		if herr := kclient.ConfigureDefault(kclient.FromFlags(bf.HTTP)); herr != nil {
+			return herr
+		}
+	}
+
+	if bf.Output != nil {
+		renderer, rerr := render.New(render.FromFlags(bf.Output), render.WithQuiet(bf.Quiet))
+		if rerr != nil {
+			return rerr
+		}
+		bf.Render = renderer
+	}
 	return err
 }
 
+// newLogger creates the logger configured by --log-format and --log-level, and the klog flags.
+func (bf *BaseFlags) newLogger() (logger.Logger, error) {
+	flags := *bf.Flags
+	if bf.LogLevel != "" {
+		prio, err := logger.ParsePriority(bf.LogLevel)
+		if err != nil {
+			return nil, kflags.NewUsageErrorf("invalid --log-level - %s", err)
+		}
+		flags.ConsoleLevel, flags.Verbosity, flags.Quiet = prio.String(), 0, false
+	}
+
+	output, err := bf.logOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(bf.LogFormat) {
+	case "", "text":
+		return klog.New(bf.CommandName, klog.FromFlags(flags), klog.WithConsoleOutput(output))
+	case "json":
+		prio, err := logger.ParsePriority(flags.ConsoleLevel)
+		if err != nil {
+			return nil, kflags.NewUsageErrorf("invalid --loglevel-console - %s", err)
+		}
+		prio -= logger.Priority(flags.Verbosity)
+		if prio < logger.DebugPriority {
+			prio = logger.DebugPriority
+		}
+		if flags.Quiet {
+			prio = logger.ErrorPriority
+		}
+		return logger.NewLeveled(prio, logger.NewJSONSink(output)).With("command", bf.CommandName), nil
+	}
+	return nil, kflags.NewUsageErrorf("invalid --log-format %q - must be one of text or json", bf.LogFormat)
+}
+
+// logOutput returns where to write log messages: os.Stderr, or the file configured with --log-file.
+//
+// Init is invoked multiple times, the file opened by a previous invocation is closed.
+func (bf *BaseFlags) logOutput() (io.Writer, error) {
+	if bf.logFile != nil {
+		bf.logFile.Close()
+		bf.logFile = nil
+	}
+	if bf.LogFile == "" {
+		return os.Stderr, nil
+	}
+	if bf.LogMaxSize < 0 || bf.LogMaxFiles < 0 {
+		return nil, kflags.NewUsageErrorf("invalid --log-max-size or --log-max-files - must be 0 or positive")
+	}
+
+	file, err := logger.OpenRotatingFile(bf.LogFile, logger.RotateOptions{
+		MaxSize:  int64(bf.LogMaxSize) * 1024 * 1024,
+		MaxAge:   bf.LogMaxAge,
+		MaxFiles: bf.LogMaxFiles,
+		Compress: bf.LogCompress,
+	})
+	if err != nil {
+		return nil, kflags.NewUsageErrorf("invalid --log-file %q - %w", bf.LogFile, err)
+	}
+	bf.logFile = file
+	return file, nil
+}
+
 // UpdateFlagDefaults updates the default value of flags by fetching the
 // configuration from an https/astore server.
 func (bf *BaseFlags) UpdateFlagDefaults(populator kflags.Populator, domain string) error {
+	if err := bf.fetchFlagDefaults(populator, domain); err != nil {
+		bf.Log.Infof("could not retrieve remote defaults - continuing without (error: %s)", err)
+	}
+	bf.Init()
+	return nil
+}
+
+// fetchFlagDefaults is like UpdateFlagDefaults, but returns the error fetching the
+// configuration, and does not re-initialize the internal objects.
+func (bf *BaseFlags) fetchFlagDefaults(populator kflags.Populator, domain string) error {
 	// Try to load an authentication cookie before even trying.
 	// This may just work based on env variables, or previously loaded defaults, but
-	// it's optional - keep going if this fails.
-	username, cookie, err := bf.IdentityCookie()
+	// it's optional - keep going if this fails. Credentials are not refreshed at
+	// this stage, as the user has not yet chosen what to run.
+	username, cookie, err := bf.identityCookie(false)
 	if err != nil {
 		bf.Log.Infof("could not retrieve authentication cookie - continuing without (error: %s)", err)
 	}
@@ -229,18 +545,15 @@ func (bf *BaseFlags) UpdateFlagDefaults(populator kflags.Populator, domain strin
 		Log:    bf.Log,
 		Cookie: cookie,
 
+		DownloaderOptions: bf.DownloaderOptions(),
+
 		Cache: bf.Local,
 
 		CommandName: bf.CommandName,
 		Domain:      domain,
 	}
 
-	// Load the new flags, and re-initialize the internal objects.
-	if err := provider.SetFlagDefaults(populator, bf.ProviderFlags, options); err != nil {
-		bf.Log.Infof("could not retrieve remote defaults - continuing without (error: %s)", err)
-	}
-	bf.Init()
-	return nil
+	return provider.SetFlagDefaults(populator, bf.ProviderFlags, options)
 }
 
 // Context() creates a new Context object.
@@ -248,7 +561,7 @@ func (bf *BaseFlags) Context() *ccontext.Context {
 	context := ccontext.DefaultContext()
 
 	context.Logger = bf.Log
-	if bf.NoProgress {
+	if bf.NoProgress || bf.Level() <= klog.VerbosityQuiet {
 		context.Progress = progress.NewDiscard
 	} else {
 		context.Progress = progress.NewBar
@@ -12,6 +12,8 @@ import (
 	"github.com/System233/enkit/lib/kflags/kcobra"
 	"github.com/System233/enkit/lib/retry"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
         "google.golang.org/grpc"
         "google.golang.org/grpc/grpclog"
         "google.golang.org/grpc/metadata"
@@ -28,6 +30,7 @@ type Login struct {
 
 	base      *client.BaseFlags
 	agent     *kcerts.SSHAgentFlags
+	key       *kcerts.KeyFlags
 	populator kflags.Populator
 
         BbclientdAddress string
@@ -54,6 +57,7 @@ func NewLogin(base *client.BaseFlags, rng *rand.Rand, populator kflags.Populator
 		},
 		base:      base,
 		agent:     kcerts.SSHAgentDefaultFlags(),
+		key:       kcerts.DefaultKeyFlags(),
 		rng:       rng,
 		populator: populator,
 	}
@@ -65,10 +69,72 @@ func NewLogin(base *client.BaseFlags, rng *rand.Rand, populator kflags.Populator
 	login.Flags().BoolVarP(&login.NoDefault, "no-default", "n", false, "Do not mark this identity as the default identity to use")
 	login.Flags().DurationVar(&login.MinWaitTime, "min-wait-time", 10*time.Second, "Wait at least this long in between failed attempts to retrieve a token")
 	login.agent.Register(&kcobra.FlagSet{login.Flags()}, "")
+	login.key.Register(&kcobra.FlagSet{login.Flags()}, "")
 
+	if base.Refresher == nil {
+		base.Refresher = login.Refresh
+	}
 	return login
 }
 
+// isInteractive returns true if there is a user at the terminal, able to complete authentication.
+var isInteractive = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// Refresh re-runs the authentication flow for an identity whose credentials are about to expire.
+//
+// It implements client.TokenRefresher, and is installed by NewLogin. As the
+// auth server has no refresh RPC, a new authentication is required: in
+// non-interactive environments it fails immediately, rather than waiting
+// for a browser flow that nobody will complete.
+func (l *Login) Refresh(userid string) (string, string, time.Time, error) {
+	if !isInteractive() {
+		return "", "", time.Time{}, fmt.Errorf("credentials for '%s' are expiring, and cannot be refreshed without a terminal - run '%s login %s' interactively", userid, l.base.CommandName, userid)
+	}
+	username, domain := identity.SplitUsername(userid, l.base.DefaultDomain)
+	fmt.Printf("Your credentials for %s are about to expire, let's refresh them.\n", userid)
+
+	enCreds, err := l.login(username, domain)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return identity.Join(username, domain), enCreds.Token, credentialsExpiry(enCreds), nil
+}
+
+// credentialsExpiry returns the time the credentials expire, zero if unknown.
+//
+// The token is opaque to the client, the expiry of the certificate issued with it is used instead.
+func credentialsExpiry(creds *kauth.EnkitCredentials) time.Time {
+	if creds.SSHCertificate == nil || creds.SSHCertificate.ValidBefore == 0 || creds.SSHCertificate.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}
+	}
+	return time.Unix(int64(creds.SSHCertificate.ValidBefore), 0)
+}
+
+// login performs the authentication flow, and stores the resulting certificates in the SSH agent.
+func (l *Login) login(username, domain string) (*kauth.EnkitCredentials, error) {
+	keygen, err := l.key.Generator()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := l.base.Connect()
+	if err != nil {
+		return nil, err
+	}
+	repeater := retry.New(append(l.base.RetryOptions(), retry.WithWait(l.MinWaitTime), retry.WithRng(l.rng))...)
+	enCreds, err := kauth.PerformLogin(apb.NewAuthClient(conn), l.base.Log, repeater, l.rng, keygen, username, domain)
+	if err != nil {
+		return nil, err
+	}
+	l.base.Log.Infof("storing credentials in SSH agent...")
+	if err := kauth.SaveCredentials(enCreds, l.base.Local, kcerts.WithLogging(l.base.Log), kcerts.WithFlags(l.agent)); err != nil {
+		l.base.Log.Warnf("error saving credentials, err: %v", err)
+		return nil, err
+	}
+	return enCreds, nil
+}
+
 // Adds our auth headers to our requests
 func TokenAuthInterceptor(token string) grpc.UnaryClientInterceptor {
     return func(
@@ -180,25 +246,19 @@ func (l *Login) Run(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	conn, err := l.base.Connect()
+	enCreds, err := l.login(username, domain)
 	if err != nil {
 		return err
 	}
-	repeater := retry.New(retry.WithWait(l.MinWaitTime), retry.WithRng(l.rng))
-	enCreds, err := kauth.PerformLogin(apb.NewAuthClient(conn), l.base.Log, repeater, l.rng, username, domain)
-	if err != nil {
-		return err
-	}
-	l.base.Log.Infof("storing credentials in SSH agent...")
-	if err := kauth.SaveCredentials(enCreds, l.base.Local, kcerts.WithLogging(l.base.Log), kcerts.WithFlags(l.agent)); err != nil {
-		l.base.Log.Warnf("error saving credentials, err: %v", err)
-		return err
-	}
 
 	// TODO(adam): delete below when we are comfortable migrating from the token to pure ssh certificates
 	l.base.Log.Infof("storing identity in HOME config...")
 	userid := identity.Join(username, domain)
-	err = ids.Save(userid, enCreds.Token)
+	if es, ok := ids.(identity.ExpiringIdentityStore); ok {
+		err = es.SaveExpiring(userid, enCreds.Token, credentialsExpiry(enCreds))
+	} else {
+		err = ids.Save(userid, enCreds.Token)
+	}
 	if err != nil {
 		return fmt.Errorf("could not store identity - %w", err)
 	}
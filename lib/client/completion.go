@@ -0,0 +1,125 @@
+package client
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+)
+
+const (
+	// DefaultCompletionCacheMaxAge is the age after which cached completions are refreshed.
+	DefaultCompletionCacheMaxAge = 24 * time.Hour
+
+	// CompletionRefreshEnv is the environment variable set when the command is run in
+	// the background to refresh the completion cache. When set, the cache is not used.
+	CompletionRefreshEnv = "ENKIT_COMPLETION_REFRESH"
+
+	// completionRefreshBackoff is the time to wait for a background refresh to complete
+	// before starting a new one.
+	completionRefreshBackoff = 5 * time.Minute
+
+	// completionNamespace is the namespace of the config store holding the completion cache.
+	completionNamespace = "completion"
+)
+
+// updateCompletionDefaults adds the commands defined by the configuration, to compute shell completions.
+//
+// The commands are taken from the completion cache, so completions are fast even if
+// the config server is slow or unreachable. If the cache is missing or disabled, the
+// configuration is fetched, and the commands it defines recorded in the cache.
+// A stale cache is still used, but is refreshed in the background.
+//
+// The cache is only updated while completing, as only then all the commands are populated.
+func (bf *BaseFlags) updateCompletionDefaults(populator kflags.Populator) {
+	defer bf.Init()
+
+	if bf.CompletionCacheMaxAge > 0 && os.Getenv(CompletionRefreshEnv) == "" {
+		if cache := bf.loadCompletionCache(); cache != nil {
+			if err := populator(kflags.NewCommandCacheAugmenter(cache)); err != nil {
+				bf.Log.Infof("Adding the cached commands failed with: %s", err)
+			}
+			bf.maybeRefreshCompletionCache(cache)
+			return
+		}
+	}
+
+	recorder := kflags.NewCommandRecorder()
+	if err := bf.fetchFlagDefaults(recorder.Populator(populator), ""); err != nil {
+		// Keep the commands cached, if any, rather than replacing them with the few known.
+		bf.Log.Infof("could not retrieve remote defaults - continuing without (error: %s)", err)
+		return
+	}
+	if bf.CompletionCacheMaxAge > 0 {
+		if err := bf.saveCompletionCache(recorder.Cache(time.Now())); err != nil {
+			bf.Log.Infof("Saving the completion cache failed with: %s", err)
+		}
+	}
+}
+
+// loadCompletionCache returns the completion cache, or nil if it could not be loaded.
+func (bf *BaseFlags) loadCompletionCache() *kflags.CommandCache {
+	store, err := bf.ConfigOpener(bf.ConfigName, completionNamespace)
+	if err != nil {
+		bf.Log.Infof("Opening the completion cache failed with: %s", err)
+		return nil
+	}
+	cache := &kflags.CommandCache{}
+	if _, err := store.Unmarshal(bf.CommandName, cache); err != nil {
+		if !os.IsNotExist(err) {
+			bf.Log.Infof("Loading the completion cache failed with: %s", err)
+		}
+		return nil
+	}
+	return cache
+}
+
+func (bf *BaseFlags) saveCompletionCache(cache *kflags.CommandCache) error {
+	store, err := bf.ConfigOpener(bf.ConfigName, completionNamespace)
+	if err != nil {
+		return err
+	}
+	return store.Marshal(bf.CommandName, cache)
+}
+
+// maybeRefreshCompletionCache starts a refresh of the cache if it is stale, and
+// no other refresh was started recently.
+func (bf *BaseFlags) maybeRefreshCompletionCache(cache *kflags.CommandCache) {
+	now := time.Now()
+	if !cache.Stale(now, bf.CompletionCacheMaxAge) || now.Sub(cache.Refreshing) < completionRefreshBackoff {
+		return
+	}
+
+	cache.Refreshing = now
+	if err := bf.saveCompletionCache(cache); err != nil {
+		bf.Log.Infof("Saving the completion cache failed with: %s", err)
+		return
+	}
+
+	refresher := bf.CompletionRefresher
+	if refresher == nil {
+		refresher = RefreshCompletionCache
+	}
+	if err := refresher(); err != nil {
+		bf.Log.Infof("Refreshing the completion cache failed with: %s", err)
+	}
+}
+
+// RefreshCompletionCache runs the command again in the background, with the same
+// arguments, bypassing the completion cache so it is updated.
+//
+// The output of the command is discarded, and RefreshCompletionCache does not
+// wait for it to complete.
+func RefreshCompletionCache() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	command := exec.Command(executable, os.Args[1:]...)
+	command.Env = append(os.Environ(), CompletionRefreshEnv+"=true")
+	if err := command.Start(); err != nil {
+		return err
+	}
+	return command.Process.Release()
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/kflags/kcobra"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// complete computes the completions of args with the commands cached, returning the output of cobra.
+func complete(t *testing.T, bf *BaseFlags, args ...string) string {
+	root := &cobra.Command{Use: "test"}
+	root.AddCommand(&cobra.Command{Use: "astore", Run: func(*cobra.Command, []string) {}})
+	output := &bytes.Buffer{}
+	root.SetOut(output)
+
+	argv := append([]string{"test", cobra.ShellCompNoDescRequestCmd}, args...)
+	bf.Completing = kcobra.IsCompletion(argv)
+	bf.Run(kcobra.Runner(root, argv))
+	return output.String()
+}
+
+func TestCompletionCache(t *testing.T) {
+	bf, _ := testBaseFlags(t)
+	refreshed := 0
+	bf.CompletionRefresher = func() error {
+		refreshed++
+		return nil
+	}
+
+	recorded := time.Now()
+	assert.Nil(t, bf.saveCompletionCache(&kflags.CommandCache{
+		Updated: recorded,
+		Commands: []kflags.CachedCommand{
+			{Namespace: "test", Definition: kflags.CommandDefinition{Name: "deploy"}, Flags: []kflags.FlagDefinition{{Name: "target"}}},
+			{Namespace: "test.deploy", Definition: kflags.CommandDefinition{Name: "rollback"}},
+		},
+	}))
+
+	// The cached commands are completed, at any depth, together with those built in.
+	output := complete(t, bf, "")
+	assert.Contains(t, output, "astore\n")
+	assert.Contains(t, output, "deploy\n")
+	assert.Contains(t, complete(t, bf, "deploy", ""), "rollback\n")
+	assert.Contains(t, complete(t, bf, "deploy", "--ta"), "--target\n")
+	assert.Equal(t, 0, refreshed)
+
+	// Once stale, the cache is still used, and refreshed at most once per backoff period.
+	cache := bf.loadCompletionCache()
+	cache.Updated = recorded.Add(-2 * bf.CompletionCacheMaxAge)
+	assert.Nil(t, bf.saveCompletionCache(cache))
+	assert.Contains(t, complete(t, bf, "deploy", ""), "rollback\n")
+	assert.Equal(t, 1, refreshed)
+	assert.Contains(t, complete(t, bf, "deploy", ""), "rollback\n")
+	assert.Equal(t, 1, refreshed)
+	assert.False(t, bf.loadCompletionCache().Refreshing.IsZero())
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/config/identity"
+	"github.com/System233/enkit/lib/grpcwebclient"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/khttp/krequest"
+	"github.com/System233/enkit/lib/oauth/cookie"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRefreshWindow is how long before expiry credentials are refreshed by default.
+const DefaultRefreshWindow = 30 * time.Minute
+
+// TokenRefresher obtains new credentials for the identity specified.
+//
+// Returns the identity the credentials were issued to, the new token, and
+// the time the token expires, zero if unknown.
+//
+// The Login command in lib/client/commands installs a TokenRefresher
+// re-running the authentication flow.
+type TokenRefresher func(identity string) (string, string, time.Time, error)
+
+// needsRefresh returns true if a token expiring at the time specified should be refreshed.
+func (bf *BaseFlags) needsRefresh(expires time.Time) bool {
+	if expires.IsZero() || bf.RefreshWindow <= 0 || bf.Refresher == nil {
+		return false
+	}
+	return time.Until(expires) <= bf.RefreshWindow
+}
+
+// RefreshToken obtains new credentials for the identity using the configured
+// Refresher, and persists them in the identity store.
+//
+// Returns the identity the credentials belong to and the new token.
+func (bf *BaseFlags) RefreshToken(id string) (string, string, error) {
+	if bf.Refresher == nil {
+		return "", "", kflags.NewIdentityError(fmt.Errorf("credentials for '%s' cannot be refreshed automatically", id))
+	}
+
+	bf.refreshLock.Lock()
+	defer bf.refreshLock.Unlock()
+	if bf.refreshing {
+		return "", "", kflags.NewIdentityError(fmt.Errorf("credentials for '%s' are already being refreshed", id))
+	}
+	bf.refreshing = true
+	defer func() { bf.refreshing = false }()
+
+	bf.Log.Infof("Refreshing credentials of '%s'", id)
+	username, token, expires, err := bf.Refresher(id)
+	if err != nil {
+		return "", "", kflags.NewIdentityError(fmt.Errorf("could not refresh credentials for '%s' - %w", id, err))
+	}
+
+	store, err := bf.IdentityStore()
+	if err != nil {
+		return "", "", err
+	}
+	if es, ok := store.(identity.ExpiringIdentityStore); ok {
+		err = es.SaveExpiring(username, token, expires)
+	} else {
+		err = store.Save(username, token)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not store refreshed credentials for '%s' - %w", username, err)
+	}
+	return username, token, nil
+}
+
+// refreshingCookie holds a cookie that can be replaced once credentials are refreshed.
+type refreshingCookie struct {
+	bf       *BaseFlags
+	username string
+
+	lock   sync.Mutex
+	cookie *http.Cookie
+}
+
+func (rc *refreshingCookie) get() *http.Cookie {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.cookie
+}
+
+// refresh replaces the cookie with one carrying new credentials, unless it was already replaced after used was sent.
+func (rc *refreshingCookie) refresh(used *http.Cookie) (*http.Cookie, error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.cookie != used {
+		return rc.cookie, nil
+	}
+	username, token, err := rc.bf.RefreshToken(rc.username)
+	if err != nil {
+		return nil, err
+	}
+	rc.username = username
+	rc.cookie = cookie.CredentialsCookie(rc.bf.CookiePrefix, token)
+	return rc.cookie, nil
+}
+
+func (rc *refreshingCookie) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	used := rc.get()
+	err := SetCookieUnaryInterceptor(used)(ctx, method, req, reply, cc, invoker, opts...)
+	if status.Code(err) != codes.Unauthenticated {
+		return err
+	}
+
+	fresh, rerr := rc.refresh(used)
+	if rerr != nil {
+		rc.bf.Log.Infof("RPC %s failed with %s - and credentials could not be refreshed: %s", method, err, rerr)
+		return err
+	}
+	return SetCookieUnaryInterceptor(fresh)(ctx, method, req, reply, cc, invoker, opts...)
+}
+
+func (rc *refreshingCookie) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return SetCookieStreamInterceptor(rc.get())(ctx, desc, cc, method, streamer, opts...)
+}
+
+// WithRefreshingCookie is like WithCookie, but if a gRPC unary call fails with
+// Unauthenticated, the credentials of username are refreshed with RefreshToken,
+// and the call retried once with the new credentials.
+//
+// Streaming calls and grpc-web connections use the latest credentials
+// available, but are not retried.
+func (bf *BaseFlags) WithRefreshingCookie(username string, cookie *http.Cookie) GwcOrGrpcOptions {
+	rc := &refreshingCookie{bf: bf, username: username, cookie: cookie}
+	return GwcOrGrpcOptions{
+		gwc.WithRequestSettings(func(req *http.Request) error {
+			return krequest.WithCookie(rc.get())(req)
+		}),
+		grpc.WithUnaryInterceptor(rc.unaryInterceptor),
+		grpc.WithStreamInterceptor(rc.streamInterceptor),
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/config"
+	"github.com/System233/enkit/lib/config/directory"
+	"github.com/System233/enkit/lib/config/identity"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func testBaseFlags(t *testing.T) (*BaseFlags, *identity.ConfigIdentityStore) {
+	base := t.TempDir()
+	bf := DefaultBaseFlags("test", "test")
+	bf.ConfigOpener = func(name string, namespace ...string) (config.Store, error) {
+		dir, err := directory.OpenDir(base, append([]string{name}, namespace...)...)
+		if err != nil {
+			return nil, err
+		}
+		return config.NewMulti(dir), nil
+	}
+	store, err := identity.NewStore(bf.ConfigName, bf.ConfigOpener)
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetDefault("emma@writers.org"))
+	return bf, store
+}
+
+func TestIdentityTokenRefresh(t *testing.T) {
+	bf, store := testBaseFlags(t)
+	refreshed := 0
+	bf.Refresher = func(id string) (string, string, time.Time, error) {
+		refreshed++
+		return id, fmt.Sprintf("token-%d", refreshed), time.Now().Add(8 * time.Hour), nil
+	}
+
+	// Far from expiry, or with unknown expiry, the token is used as is.
+	assert.Nil(t, store.SaveExpiring("emma@writers.org", "old", time.Now().Add(time.Hour)))
+	user, token, err := bf.IdentityToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "emma@writers.org", user)
+	assert.Equal(t, "old", token)
+	assert.Nil(t, store.Save("emma@writers.org", "unknown"))
+	_, token, err = bf.IdentityToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown", token)
+	assert.Equal(t, 0, refreshed)
+
+	// Within the window, the token is refreshed and persisted.
+	assert.Nil(t, store.SaveExpiring("emma@writers.org", "old", time.Now().Add(10*time.Minute)))
+	_, token, err = bf.IdentityToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+	_, token, expires, err := store.LoadExpiring("")
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.True(t, expires.After(time.Now().Add(7*time.Hour)))
+
+	_, token, err = bf.IdentityToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.Equal(t, 1, refreshed)
+}
+
+func TestIdentityTokenRefreshFailure(t *testing.T) {
+	bf, store := testBaseFlags(t)
+	bf.Refresher = func(id string) (string, string, time.Time, error) {
+		return "", "", time.Time{}, fmt.Errorf("no terminal")
+	}
+
+	// A token still valid is used, even if it could not be refreshed.
+	assert.Nil(t, store.SaveExpiring("emma@writers.org", "old", time.Now().Add(10*time.Minute)))
+	_, token, err := bf.IdentityToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "old", token)
+
+	// An expired token is not.
+	assert.Nil(t, store.SaveExpiring("emma@writers.org", "old", time.Now().Add(-time.Minute)))
+	_, _, err = bf.IdentityToken()
+	var ie *kflags.IdentityError
+	assert.ErrorAs(t, err, &ie)
+	assert.Contains(t, err.Error(), "no terminal")
+}
+
+func TestRefreshingCookieRetry(t *testing.T) {
+	bf, store := testBaseFlags(t)
+	assert.Nil(t, store.Save("emma@writers.org", "old"))
+	refreshed := 0
+	bf.Refresher = func(id string) (string, string, time.Time, error) {
+		refreshed++
+		return id, "new", time.Time{}, nil
+	}
+	user, cookie, err := bf.IdentityCookie()
+	assert.Nil(t, err)
+	rc := &refreshingCookie{bf: bf, username: user, cookie: cookie}
+
+	var sent []string
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		sent = append(sent, md.Get("cookie")...)
+		if len(sent) == 1 {
+			return status.Errorf(codes.Unauthenticated, "expired")
+		}
+		return nil
+	}
+	assert.Nil(t, rc.unaryInterceptor(context.Background(), "/test", nil, nil, nil, invoker))
+	assert.Equal(t, 2, len(sent))
+	assert.Contains(t, sent[0], "old")
+	assert.Contains(t, sent[1], "new")
+	assert.Equal(t, 1, refreshed)
+
+	// The call is retried only once.
+	sent = nil
+	failing := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		sent = append(sent, method)
+		return status.Errorf(codes.Unauthenticated, "expired")
+	}
+	err = rc.unaryInterceptor(context.Background(), "/test", nil, nil, nil, failing)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, 2, len(sent))
+}
@@ -86,7 +86,15 @@ func WithCookie(cookie *http.Cookie) GwcOrGrpcOptions {
 	}
 }
 
+// Connect establishes a gRPC connection, or prepares a grpc-web client if the server is an http or https URL.
+//
+// If an RPCTracer was configured with SetRPCTracer, the calls performed are recorded in it.
 func Connect(server string, mods ...GwcOrGrpcOptions) (grpc.ClientConnInterface, error) {
+	if tracer := CurrentRPCTracer(); tracer != nil {
+		// Last, so the transport configured by other options is traced.
+		mods = append(mods, tracer.Options())
+	}
+
 	grpcOptions := []grpc.DialOption{}
 	gwcOptions := []gwc.Modifier{}
 	for _, m := range mods {
@@ -0,0 +1,378 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/grpcwebclient"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// RPCCall is an outbound call recorded by an RPCTracer.
+type RPCCall struct {
+	// Either "grpc" or "http". grpc-web calls are recorded as http.
+	Protocol string
+	// Server the call was sent to.
+	Target string
+	// Full gRPC method name, or http method and path.
+	Method string
+
+	Start    time.Time
+	Duration time.Duration
+	// gRPC status code, or http status line. Transport errors are recorded as the error message.
+	Status string
+
+	// Bytes of payload sent and received. For gRPC, the size of the marshalled messages.
+	SentBytes     int64
+	ReceivedBytes int64
+
+	// Beginning of the payloads sent and received, only captured if enabled in the tracer.
+	Request  string
+	Response string
+}
+
+// RPCTracer records every outbound gRPC and http call, and optionally logs it.
+//
+// Payloads are not captured unless MaxPayload is larger than 0, as they may
+// contain credentials or other sensitive data.
+type RPCTracer struct {
+	// Maximum number of bytes of each payload to capture, 0 disables capture.
+	MaxPayload int
+	// If not nil, every call is logged once completed.
+	Log logger.Logger
+	// If true, calls are only logged: Calls and Write return no calls.
+	LogOnly bool
+
+	lock  sync.Mutex
+	calls []*RPCCall
+}
+
+func NewRPCTracer(maxPayload int) *RPCTracer {
+	return &RPCTracer{MaxPayload: maxPayload}
+}
+
+// NewRPCLogger returns an RPCTracer logging every call to log, without recording it.
+func NewRPCLogger(log logger.Logger) *RPCTracer {
+	return &RPCTracer{Log: log, LogOnly: true}
+}
+
+// start records a new call, and returns it to be updated with update.
+func (t *RPCTracer) start(protocol, target, method string) *RPCCall {
+	call := &RPCCall{Protocol: protocol, Target: target, Method: method, Start: time.Now()}
+	if t.LogOnly {
+		return call
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.calls = append(t.calls, call)
+	return call
+}
+
+func (t *RPCTracer) update(call *RPCCall, updater func(call *RPCCall)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	updater(call)
+}
+
+// capture appends data to the captured payload, up to MaxPayload bytes.
+func (t *RPCTracer) capture(payload *string, data []byte) {
+	if left := t.MaxPayload - len(*payload); left > 0 {
+		if len(data) > left {
+			data = data[:left]
+		}
+		*payload += string(data)
+	}
+}
+
+// message records a gRPC message sent or received.
+func (t *RPCTracer) message(call *RPCCall, msg interface{}, sent bool) {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		return
+	}
+	var text []byte
+	if t.MaxPayload > 0 {
+		text = []byte(proto.CompactTextString(pm))
+	}
+	size := int64(proto.Size(pm))
+
+	t.update(call, func(call *RPCCall) {
+		if sent {
+			call.SentBytes += size
+			t.capture(&call.Request, text)
+		} else {
+			call.ReceivedBytes += size
+			t.capture(&call.Response, text)
+		}
+	})
+}
+
+func (t *RPCTracer) finish(call *RPCCall, status string) {
+	var duration time.Duration
+	t.update(call, func(call *RPCCall) {
+		call.Duration = time.Since(call.Start)
+		call.Status = status
+		duration = call.Duration
+	})
+	if t.Log != nil {
+		t.Log.Infof("rpc: %s %s on %s completed in %s - %s", call.Protocol, call.Method, call.Target, duration, status)
+	}
+}
+
+func connTarget(cc *grpc.ClientConn) string {
+	if cc == nil {
+		return ""
+	}
+	return cc.Target()
+}
+
+func (t *RPCTracer) UnaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		call := t.start("grpc", connTarget(cc), method)
+		t.message(call, req, true)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			t.message(call, reply, false)
+		}
+		t.finish(call, status.Code(err).String())
+		return err
+	}
+}
+
+func (t *RPCTracer) StreamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		call := t.start("grpc", connTarget(cc), method)
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			t.finish(call, status.Code(err).String())
+			return nil, err
+		}
+		return &tracedStream{ClientStream: stream, tracer: t, call: call, single: !desc.ServerStreams}, nil
+	}
+}
+
+// tracedStream records the messages of a stream, until the first error returned by RecvMsg.
+type tracedStream struct {
+	grpc.ClientStream
+	tracer *RPCTracer
+	call   *RPCCall
+	done   sync.Once
+	// The server returns a single message, the stream completes when received.
+	single bool
+}
+
+func (s *tracedStream) finish(err error) {
+	if err == io.EOF {
+		err = nil
+	}
+	s.done.Do(func() { s.tracer.finish(s.call, status.Code(err).String()) })
+}
+
+func (s *tracedStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.tracer.message(s.call, m, true)
+	}
+	return err
+}
+
+func (s *tracedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.tracer.message(s.call, m, false)
+		if s.single {
+			s.finish(nil)
+		}
+		return nil
+	}
+	s.finish(err)
+	return err
+}
+
+// tracedTransport is an http.RoundTripper recording the requests performed through next.
+type tracedTransport struct {
+	tracer *RPCTracer
+	next   http.RoundTripper
+}
+
+// Unwrap returns the transport wrapped, so kclient can still configure it.
+func (tt *tracedTransport) Unwrap() http.RoundTripper {
+	return tt.next
+}
+
+func (tt *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := tt.tracer.start("http", req.URL.Host, req.Method+" "+req.URL.Path)
+	if req.Body != nil && req.Body != http.NoBody {
+		body := &tracedBody{ReadCloser: req.Body, tracer: tt.tracer, call: call, sent: true}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		tt.tracer.finish(call, err.Error())
+		return nil, err
+	}
+	tt.tracer.finish(call, resp.Status)
+	if resp.Body != nil {
+		resp.Body = &tracedBody{ReadCloser: resp.Body, tracer: tt.tracer, call: call}
+	}
+	return resp, nil
+}
+
+// tracedBody accounts for the bytes of an http body, as they are read.
+type tracedBody struct {
+	io.ReadCloser
+	tracer *RPCTracer
+	call   *RPCCall
+	sent   bool
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.tracer.update(b.call, func(call *RPCCall) {
+			if b.sent {
+				call.SentBytes += int64(n)
+				b.tracer.capture(&call.Request, p[:n])
+			} else {
+				call.ReceivedBytes += int64(n)
+				b.tracer.capture(&call.Response, p[:n])
+			}
+		})
+	}
+	return n, err
+}
+
+// RoundTripper returns an http.RoundTripper recording all the requests performed through next.
+//
+// If next is nil, http.DefaultTransport is used.
+func (t *RPCTracer) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tracedTransport{tracer: t, next: next}
+}
+
+// Options returns the options to pass to Connect to trace gRPC and grpc-web calls.
+//
+// The interceptors are chained, so they don't replace other interceptors
+// configured, like those supplied by WithCookie.
+func (t *RPCTracer) Options() GwcOrGrpcOptions {
+	return GwcOrGrpcOptions{
+		grpc.WithChainUnaryInterceptor(t.UnaryInterceptor()),
+		grpc.WithChainStreamInterceptor(t.StreamInterceptor()),
+		gwc.WithHttpSettings(t.traceClient),
+	}
+}
+
+// traceClient is a kclient.Modifier wrapping the transport of an http client.
+//
+// Clients using the default transport are already traced once SetRPCTracer is invoked.
+func (t *RPCTracer) traceClient(c *http.Client) error {
+	switch tt := c.Transport.(type) {
+	case nil:
+		if _, traced := http.DefaultTransport.(*tracedTransport); !traced {
+			c.Transport = t.RoundTripper(nil)
+		}
+	case *tracedTransport:
+	default:
+		c.Transport = t.RoundTripper(tt)
+	}
+	return nil
+}
+
+// Calls returns a copy of the calls recorded so far, in the order they were started.
+func (t *RPCTracer) Calls() []RPCCall {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make([]RPCCall, 0, len(t.calls))
+	for _, call := range t.calls {
+		result = append(result, *call)
+	}
+	return result
+}
+
+// Write prints the calls recorded in a human readable format.
+func (t *RPCTracer) Write(w io.Writer) error {
+	calls := t.Calls()
+	if _, err := fmt.Fprintf(w, "RPC trace - %d outbound calls:\n", len(calls)); err != nil {
+		return err
+	}
+	for ix, call := range calls {
+		status := call.Status
+		if status == "" {
+			status = "(in progress)"
+		}
+		if _, err := fmt.Fprintf(w, "%3d. %s %s %s %s - %s - %v - sent %d bytes, received %d bytes\n", ix+1,
+			call.Start.Format("15:04:05.000"), call.Protocol, call.Target, call.Method, status, call.Duration.Round(time.Microsecond),
+			call.SentBytes, call.ReceivedBytes); err != nil {
+			return err
+		}
+		if call.Request != "" {
+			fmt.Fprintf(w, "       request: %q\n", call.Request)
+		}
+		if call.Response != "" {
+			fmt.Fprintf(w, "       response: %q\n", call.Response)
+		}
+	}
+	return nil
+}
+
+// WriteFile writes the trace to the file at path, or to stderr if path is "-".
+func (t *RPCTracer) WriteFile(path string) error {
+	if path == "-" {
+		return t.Write(os.Stderr)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create rpc trace file - %w", err)
+	}
+	if err := t.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write rpc trace to %s - %w", path, err)
+	}
+	return f.Close()
+}
+
+var (
+	tracerLock sync.Mutex
+	tracer     *RPCTracer
+	// http.DefaultTransport before being wrapped by SetRPCTracer.
+	untracedTransport http.RoundTripper
+)
+
+// SetRPCTracer configures all the clients created through Connect and
+// http.DefaultTransport to record their calls in t.
+//
+// Only the clients created after SetRPCTracer is invoked are traced, with the
+// exception of http clients using the default transport. A nil t disables tracing.
+func SetRPCTracer(t *RPCTracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+
+	if untracedTransport == nil {
+		untracedTransport = http.DefaultTransport
+	}
+	tracer = t
+	if t == nil {
+		http.DefaultTransport = untracedTransport
+		return
+	}
+	http.DefaultTransport = t.RoundTripper(untracedTransport)
+}
+
+// CurrentRPCTracer returns the tracer configured with SetRPCTracer, or nil.
+func CurrentRPCTracer() *RPCTracer {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	return tracer
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/System233/enkit/lib/kflags/kcobra"
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	hpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func fakeServers(t *testing.T) (string, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer()
+	hpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a flag configuration much longer than the payload cap"))
+	}))
+	t.Cleanup(web.Close)
+	return listener.Addr().String(), web.URL
+}
+
+// runTraced runs a command performing a gRPC and an http call through the shared factories, with the flags specified.
+func runTraced(t *testing.T, grpcAddress, httpURL string, args ...string) {
+	t.Cleanup(func() { SetRPCTracer(nil) })
+
+	bf, _ := testBaseFlags(t)
+	root := &cobra.Command{
+		Use: "test",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := Connect(grpcAddress, GwcOrGrpcOptions{grpc.WithInsecure()})
+			if err != nil {
+				return err
+			}
+			if _, err := hpb.NewHealthClient(conn).Check(context.Background(), &hpb.HealthCheckRequest{Service: "machinist"}); err == nil {
+				t.Errorf("health check for unknown service succeeded")
+			}
+			if _, err := hpb.NewHealthClient(conn).Check(context.Background(), &hpb.HealthCheckRequest{}); err != nil {
+				return err
+			}
+			return protocol.Get(httpURL+"/flags", protocol.Read(protocol.Null()))
+		},
+	}
+	bf.Run(kcobra.Runner(root, append([]string{"test"}, args...)))
+}
+
+func TestTraceRPC(t *testing.T) {
+	grpcAddress, httpURL := fakeServers(t)
+	path := filepath.Join(t.TempDir(), "trace")
+	runTraced(t, grpcAddress, httpURL, "--trace-rpc", path)
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 4, len(lines), "%s", data)
+	assert.Equal(t, "RPC trace - 3 outbound calls:", lines[0])
+	assert.Regexp(t, `^  1\. [0-9:.]+ grpc `+grpcAddress+` /grpc.health.v1.Health/Check - NotFound - .* - sent 11 bytes, received 0 bytes$`, lines[1])
+	assert.Regexp(t, `^  2\. [0-9:.]+ grpc `+grpcAddress+` /grpc.health.v1.Health/Check - OK - .* - sent 0 bytes, received 2 bytes$`, lines[2])
+	assert.Regexp(t, `^  3\. [0-9:.]+ http `+strings.TrimPrefix(httpURL, "http://")+` GET /flags - 200 OK - .* - sent 0 bytes, received 53 bytes$`, lines[3])
+}
+
+func TestTraceRPCPayload(t *testing.T) {
+	grpcAddress, httpURL := fakeServers(t)
+	path := filepath.Join(t.TempDir(), "trace")
+	runTraced(t, grpcAddress, httpURL, "--trace-rpc", path, "--trace-rpc-payload-bytes", "10")
+
+	calls := CurrentRPCTracer().Calls()
+	assert.Equal(t, 3, len(calls))
+	assert.Equal(t, `service:"m`, calls[0].Request)
+	assert.Equal(t, "", calls[0].Response)
+	assert.Equal(t, "status:SER", calls[1].Response)
+	assert.Equal(t, "a flag con", calls[2].Response)
+	assert.Equal(t, int64(53), calls[2].ReceivedBytes)
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `       response: "a flag con"`)
+}
+
+func TestTraceRPCDisabled(t *testing.T) {
+	grpcAddress, httpURL := fakeServers(t)
+	runTraced(t, grpcAddress, httpURL)
+
+	// Calls are still logged, but not recorded.
+	tracer := CurrentRPCTracer()
+	assert.True(t, tracer.LogOnly)
+	assert.NotNil(t, tracer.Log)
+	assert.Empty(t, tracer.Calls())
+
+	SetRPCTracer(nil)
+	_, traced := http.DefaultTransport.(*tracedTransport)
+	assert.False(t, traced)
+}
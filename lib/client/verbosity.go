@@ -0,0 +1,29 @@
+package client
+
+import (
+	"github.com/System233/enkit/lib/khttp/downloader"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/retry"
+)
+
+// LibraryLog returns the logger to pass to libraries like the downloader or the retry logic.
+//
+// All their messages are logged at debug level: they are displayed with -vv
+// only, but are always recorded for --debug-dump-on-error.
+func (bf *BaseFlags) LibraryLog() logger.Logger {
+	return logger.Demote(bf.Log)
+}
+
+// RetryOptions returns the retry options honoring the verbosity chosen by the user.
+//
+// Pass them to retry.New before any other option, like:
+//
+//	retry.New(append(bf.RetryOptions(), retry.WithWait(time.Second))...)
+func (bf *BaseFlags) RetryOptions() retry.Modifiers {
+	return retry.Modifiers{retry.WithLogger(bf.LibraryLog())}
+}
+
+// DownloaderOptions returns the downloader options honoring the verbosity chosen by the user.
+func (bf *BaseFlags) DownloaderOptions() downloader.Modifiers {
+	return downloader.Modifiers{downloader.WithRetryOptions(bf.RetryOptions()...)}
+}
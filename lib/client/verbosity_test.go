@@ -0,0 +1,206 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/kflags/kcobra"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/logger/klog"
+	"github.com/System233/enkit/lib/progress"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// runAtLevel runs a command logging at all levels, retrying an operation,
+// performing an http request, and showing a progress bar.
+//
+// Returns the BaseFlags, the progress bar created, and what was printed on stderr.
+func runAtLevel(t *testing.T, args ...string) (*BaseFlags, progress.Handler, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The console logger is created by Init, writing to the os.Stderr at that time.
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	assert.NoError(t, err)
+	defer stderr.Close()
+	saved := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = saved }()
+	defer SetRPCTracer(nil)
+
+	var bar progress.Handler
+	bf := DefaultBaseFlags("test", "test")
+	root := &cobra.Command{
+		Use:          "test",
+		SilenceUsage: true,
+		RunE: func(*cobra.Command, []string) error {
+			if err := bf.Init(); err != nil {
+				return err
+			}
+			bf.Log.Errorf("error-message")
+			bf.Log.Warnf("warning-message")
+			bf.Log.Infof("info-message")
+			bf.Log.Debugf("debug-message")
+
+			failures := 0
+			err := retry.New(append(bf.RetryOptions(), retry.WithWait(time.Millisecond), retry.WithDescription("retry-message"))...).Run(func() error {
+				if failures++; failures <= 1 {
+					return fmt.Errorf("transient")
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+
+			resp, err := http.Get(server.URL + "/rpc-message")
+			assert.NoError(t, err)
+			resp.Body.Close()
+
+			bar = bf.Context().Progress()
+			return nil
+		},
+	}
+	bf.Register(&kcobra.FlagSet{FlagSet: root.PersistentFlags()}, "")
+	root.SetArgs(args)
+	assert.NoError(t, root.Execute())
+
+	output, err := ioutil.ReadFile(stderr.Name())
+	assert.NoError(t, err)
+	return bf, bar, string(output)
+}
+
+func TestVerbosityLevels(t *testing.T) {
+	messages := []string{"error-message", "warning-message", "info-message", "debug-message", "retry-message", "rpc-message"}
+	for _, tc := range []struct {
+		args     []string
+		level    klog.Verbosity
+		expected []string
+		discard  bool
+	}{
+		{[]string{"-q"}, klog.VerbosityQuiet, []string{"error-message"}, true},
+		{[]string{"-vv", "--quiet"}, klog.VerbosityQuiet, []string{"error-message"}, true},
+		{nil, klog.VerbosityDefault, []string{"error-message", "warning-message"}, false},
+		{[]string{"-v"}, klog.VerbosityVerbose, []string{"error-message", "warning-message", "info-message"}, false},
+		{[]string{"--verbosity=1"}, klog.VerbosityVerbose, []string{"error-message", "warning-message", "info-message"}, false},
+		{[]string{"-vv"}, klog.VerbosityDebug, messages, false},
+		{[]string{"-v", "--verbose"}, klog.VerbosityDebug, messages, false},
+		{[]string{"-vvv"}, klog.VerbosityDebug, messages, false},
+	} {
+		bf, bar, output := runAtLevel(t, tc.args...)
+		assert.Equal(t, tc.level, bf.Level(), "%v", tc.args)
+
+		for _, message := range messages {
+			if contains(tc.expected, message) {
+				assert.Contains(t, output, message, "%v", tc.args)
+			} else {
+				assert.NotContains(t, output, message, "%v", tc.args)
+			}
+		}
+
+		_, discarded := bar.(*progress.Discard)
+		assert.Equal(t, tc.discard, discarded, "%v", tc.args)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, el := range list {
+		if el == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogFormat(t *testing.T) {
+	_, _, output := runAtLevel(t, "--log-format=json", "-v")
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Equal(t, 3, len(lines), "%s", output)
+	for ix, expected := range []struct{ level, msg string }{
+		{"error", "error-message"},
+		{"warning", "warning-message"},
+		{"info", "info-message"},
+	} {
+		parsed := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[ix]), &parsed), "%s", lines[ix])
+		assert.Equal(t, expected.level, parsed["level"])
+		assert.Equal(t, expected.msg, parsed["msg"])
+		assert.Equal(t, "test", parsed["command"])
+	}
+
+	// An explicit --log-level overrides the verbosity flags.
+	_, _, output = runAtLevel(t, "--log-level=error", "-vv")
+	assert.Contains(t, output, "error-message")
+	assert.NotContains(t, output, "warning-message")
+	assert.NotContains(t, output, "retry-message")
+
+	_, _, output = runAtLevel(t, "--log-format=json", "--log-level=debug", "-q")
+	assert.Contains(t, output, `"msg":"debug-message"`)
+	assert.Contains(t, output, `"msg":"rpc: http GET`)
+
+	bf := DefaultBaseFlags("test", "test")
+	bf.LogFormat = "xml"
+	_, err := bf.newLogger()
+	assert.Error(t, err)
+	bf.LogFormat, bf.LogLevel = "json", "loud"
+	_, err = bf.newLogger()
+	assert.Error(t, err)
+}
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "test.log")
+	bf, _, output := runAtLevel(t, "--log-file="+path, "--log-format=json", "-v")
+	defer bf.logFile.Close()
+	assert.NotContains(t, output, "error-message")
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"msg":"error-message"`)
+	assert.Contains(t, string(data), `"msg":"info-message"`)
+	assert.NotContains(t, string(data), "debug-message")
+
+	bf = DefaultBaseFlags("test", "test")
+	bf.LogFile, bf.LogMaxFiles = path, -1
+	_, err = bf.newLogger()
+	assert.Error(t, err)
+}
+
+func TestDebugDumpRedactsSecrets(t *testing.T) {
+	bf := DefaultBaseFlags("test", "test")
+	root := &cobra.Command{
+		Use:           "test",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(*cobra.Command, []string) error {
+			if err := bf.Init(); err != nil {
+				return err
+			}
+			bf.Log.Debugf("running with token tok3n and key k3y")
+			return fmt.Errorf("command-failed")
+		},
+	}
+	set := &kcobra.FlagSet{FlagSet: root.PersistentFlags()}
+	bf.Register(set, "")
+	bf.secrets = set
+
+	var key string
+	set.StringVar(&key, "api-key", "", "key")
+	assert.NoError(t, kflags.MarkSecret(&kcobra.PFlag{Flag: set.Lookup("api-key")}))
+
+	root.SetArgs([]string{"--debug-dump-on-error", "--override-identity=user@enkit.io", "--override-token=tok3n", "--api-key=k3y"})
+	err := bf.DebugDumpErrorHandler()(root.Execute())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "command-failed")
+	assert.Contains(t, err.Error(), "running with token "+logger.Redacted+" and key "+logger.Redacted)
+	assert.NotContains(t, err.Error(), "tok3n")
+	assert.NotContains(t, err.Error(), "k3y")
+}
@@ -2,15 +2,25 @@
 package directory
 
 import (
+	"errors"
+	"fmt"
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/flock"
 	"github.com/kirsle/configdir"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Directory struct {
 	path string
+
+	// Maximum time Write and Modify wait for another process holding the lock
+	// on the same config. 0 means DefaultLockTimeout.
+	LockTimeout time.Duration
 }
 
 // Returns the absolute path to a specific folder within the
@@ -63,6 +73,32 @@ func OpenDir(base string, sub ...string) (*Directory, error) {
 	return &Directory{path: path}, nil
 }
 
+// BackupSuffix is appended to the name of a config to obtain the name of the
+// copy of its last good version.
+const BackupSuffix = ".bak"
+
+// tmpSuffix is appended to the name of the temporary files used while writing.
+const tmpSuffix = atomicfile.TempSuffix
+
+// lockSuffix is appended to the name of the files used to lock a config.
+const lockSuffix = ".lock"
+
+// DefaultLockTimeout is the maximum time Write and Modify wait for a lock by default.
+var DefaultLockTimeout = 10 * time.Second
+
+// ErrLockTimeout is returned when the lock on a config could not be acquired in time.
+var ErrLockTimeout = flock.ErrTimeout
+
+// writeFile is used to replace a config atomically, replaced in tests.
+var writeFile = atomicfile.WriteFile
+
+// isInternal returns true for files created by the Directory for its own use,
+// like backups or temporary files, which are not configs.
+func isInternal(name string) bool {
+	return strings.HasSuffix(name, BackupSuffix) ||
+		(strings.HasPrefix(name, ".") && (strings.HasSuffix(name, tmpSuffix) || strings.HasSuffix(name, lockSuffix)))
+}
+
 func (hd *Directory) List() ([]string, error) {
 	files, err := ioutil.ReadDir(hd.path)
 	if err != nil {
@@ -73,7 +109,7 @@ func (hd *Directory) List() ([]string, error) {
 	}
 	paths := []string{}
 	for _, file := range files {
-		if !file.Mode().IsRegular() {
+		if !file.Mode().IsRegular() || isInternal(file.Name()) {
 			continue
 		}
 		paths = append(paths, file.Name())
@@ -81,8 +117,12 @@ func (hd *Directory) List() ([]string, error) {
 	return paths, nil
 }
 
+// Delete removes the config by the specified name, and the copy of its last good version.
 func (hd *Directory) Delete(name string) error {
 	path := filepath.Join(hd.path, name)
+	if err := os.Remove(path + BackupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return os.Remove(path)
 }
 
@@ -91,22 +131,92 @@ func (hd *Directory) Read(name string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+// ReadBackup returns the last good version of the config by the specified name.
+//
+// A copy of the data is kept every time Write succeeds, so a config that was
+// corrupted, by a crash or by a misbehaving editor, can still be recovered.
+func (hd *Directory) ReadBackup(name string) ([]byte, error) {
+	return hd.Read(name + BackupSuffix)
+}
+
+// Write stores the config by the specified name, and keeps a backup copy of it.
+//
+// The file is never written in place: data is written in a temporary file
+// in the same directory, flushed to disk, and then renamed over the config,
+// so readers see either the old or the new version in full.
+//
+// Write waits for any Modify in progress on the same config, in this or
+// other processes.
 func (hd *Directory) Write(name string, data []byte) error {
+	return hd.Modify(name, func([]byte) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// Modify performs a read-modify-write cycle of the config by the specified name.
+//
+// update is invoked with the current content of the config, nil if it does not
+// exist, and returns the data to store. If update returns an error, the config
+// is left unchanged and the error returned.
+//
+// An exclusive advisory lock on the config is held for the whole cycle, so
+// concurrent invocations of Modify or Write, in this or other processes, do not
+// lose each other's updates. If the lock cannot be acquired within LockTimeout,
+// an error matching ErrLockTimeout is returned.
+func (hd *Directory) Modify(name string, update func(current []byte) ([]byte, error)) error {
 	if err := os.MkdirAll(hd.path, 0770); err != nil {
 		return err
 	}
 
-	// Don't write the file in place, use rename to guarantee filesystem atomicity.
-	tmp, err := ioutil.TempFile(hd.path, name)
+	unlock, err := hd.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(hd.path, name)
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := update(current)
 	if err != nil {
 		return err
 	}
-	tmp.Close()
 
-	if err := ioutil.WriteFile(tmp.Name(), data, 0660); err != nil {
-		os.Remove(tmp.Name())
+	if err := writeFile(path, data, 0600); err != nil {
 		return err
 	}
+	return writeFile(path+BackupSuffix, data, 0600)
+}
+
+// lock acquires the lock on the config by the specified name.
+//
+// Returns a function to release it.
+func (hd *Directory) lock(name string) (func(), error) {
+	timeout := hd.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+
+	// Lock files are never removed: removing them safely requires the
+	// same dance done by the cache, for little benefit.
+	path := filepath.Join(hd.path, "."+name+lockSuffix)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock.Lock(f, flock.Exclusive, timeout); err != nil {
+		f.Close()
+		if errors.Is(err, flock.ErrTimeout) {
+			return nil, fmt.Errorf("config %s is locked by another process, gave up after %s - %w", filepath.Join(hd.path, name), timeout, err)
+		}
+		return nil, fmt.Errorf("could not lock %s - %w", path, err)
+	}
 
-	return os.Rename(tmp.Name(), filepath.Join(hd.path, name))
+	return func() {
+		flock.Unlock(f)
+		f.Close()
+	}, nil
 }
@@ -1,12 +1,19 @@
 package directory
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/flock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -71,3 +78,121 @@ func TestOpenDir(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []string{}, confs)
 }
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	hd, err := OpenDir(dir)
+	assert.NoError(t, err)
+
+	good := []byte(`{"token": "a very long token, that takes a while to write"}`)
+	assert.NoError(t, hd.Write("identity.json", good))
+
+	// Backups and temporary files are not configs.
+	confs, err := hd.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"identity.json"}, confs)
+	backup, err := hd.ReadBackup("identity.json")
+	assert.NoError(t, err)
+	assert.Equal(t, good, backup)
+
+	// A failure while writing leaves the old version in place, and no temporary files.
+	defer func() { writeFile = atomicfile.WriteFile }()
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		return fmt.Errorf("simulated crash")
+	}
+	assert.ErrorContains(t, hd.Write("identity.json", []byte(`{"token": "new"}`)), "simulated crash")
+	data, err := hd.Read("identity.json")
+	assert.NoError(t, err)
+	assert.Equal(t, good, data)
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix))
+	assert.NoError(t, err)
+	assert.Empty(t, tmps)
+
+	// The data is truncated, and the process dies before the backup is
+	// updated: the last good version is still available.
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		writeFile = atomicfile.WriteFile
+		if err := atomicfile.WriteFile(path, data[:5], perm); err != nil {
+			return err
+		}
+		return fmt.Errorf("simulated crash")
+	}
+	assert.Error(t, hd.Write("identity.json", []byte(`{"token": "newer"}`)))
+	data, err = hd.Read("identity.json")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"tok`), data)
+	backup, err = hd.ReadBackup("identity.json")
+	assert.NoError(t, err)
+	assert.Equal(t, good, backup)
+
+	// Deleting a config deletes its backup as well.
+	assert.NoError(t, hd.Delete("identity.json"))
+	_, err = hd.ReadBackup("identity.json")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModify(t *testing.T) {
+	hd, err := OpenDir(t.TempDir())
+	assert.NoError(t, err)
+
+	// Concurrent read-modify-write cycles don't lose updates.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := hd.Modify("counter", func(current []byte) ([]byte, error) {
+				value := 0
+				if current != nil {
+					value, _ = strconv.Atoi(string(current))
+				}
+				return []byte(strconv.Itoa(value + 1)), nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	data, err := hd.Read("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, "20", string(data))
+
+	// Errors leave the config unchanged.
+	err = hd.Modify("counter", func(current []byte) ([]byte, error) {
+		return nil, fmt.Errorf("changed my mind")
+	})
+	assert.EqualError(t, err, "changed my mind")
+	data, err = hd.Read("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, "20", string(data))
+
+	confs, err := hd.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"counter"}, confs)
+}
+
+func TestModifyLockTimeout(t *testing.T) {
+	dir := t.TempDir()
+	hd, err := OpenDir(dir)
+	assert.NoError(t, err)
+	hd.LockTimeout = 50 * time.Millisecond
+
+	// Another process holding the lock.
+	f, err := os.OpenFile(filepath.Join(dir, ".identity"+lockSuffix), os.O_RDWR|os.O_CREATE, 0660)
+	assert.NoError(t, err)
+	defer f.Close()
+	locked, err := flock.TryLock(f, flock.Exclusive)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	start := time.Now()
+	err = hd.Write("identity", []byte("token"))
+	assert.True(t, errors.Is(err, ErrLockTimeout), "%v", err)
+	assert.ErrorContains(t, err, "is locked by another process")
+	assert.GreaterOrEqual(t, time.Since(start), hd.LockTimeout)
+
+	// Other configs are not affected.
+	assert.NoError(t, hd.Write("default", []byte("identity")))
+
+	assert.NoError(t, flock.Unlock(f))
+	assert.NoError(t, hd.Write("identity", []byte("token")))
+}
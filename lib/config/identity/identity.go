@@ -5,6 +5,7 @@ import (
 	"github.com/System233/enkit/lib/config"
 	"github.com/System233/enkit/lib/kflags"
 	"strings"
+	"time"
 )
 
 // IdentityFlags stores the values retrieved form the command line use to manage identities.
@@ -89,6 +90,8 @@ func Join(username, domain string) string {
 // Token is the data structure that is serialized on disk to store a user token.
 type Token struct {
 	Token string
+	// Time after which the token is no longer valid. Zero if unknown.
+	Expires time.Time
 }
 
 // Default is the data structure that is serialized on disk to store the default identity.
@@ -103,6 +106,15 @@ type IdentityStore interface {
 	Load(identity string) (string, string, error)
 }
 
+// An ExpiringIdentityStore is an IdentityStore also keeping track of when tokens expire.
+type ExpiringIdentityStore interface {
+	IdentityStore
+	// SaveExpiring is like Save, but also records the time the token expires.
+	SaveExpiring(identity string, token string, expires time.Time) error
+	// LoadExpiring is like Load, but also returns the time the token expires, zero if unknown.
+	LoadExpiring(identity string) (string, string, time.Time, error)
+}
+
 // A ConfigIdentityStore is an IdentityStore using a config.Store to store and retrieve identities.
 type ConfigIdentityStore struct {
 	store config.Store
@@ -126,6 +138,9 @@ func NewStore(configName string, opener config.Opener) (*ConfigIdentityStore, er
 func (id *ConfigIdentityStore) Save(identity string, token string) error {
 	return id.store.Marshal(identity, Token{Token: token})
 }
+func (id *ConfigIdentityStore) SaveExpiring(identity string, token string, expires time.Time) error {
+	return id.store.Marshal(identity, Token{Token: token, Expires: expires})
+}
 func (id *ConfigIdentityStore) SetDefault(identity string) error {
 	return id.store.Marshal("default", Default{Identity: identity})
 }
@@ -135,15 +150,21 @@ func (id *ConfigIdentityStore) SetDefault(identity string) error {
 //
 // Returns the identity loaded and the security token, or an error.
 func (id *ConfigIdentityStore) Load(identity string) (string, string, error) {
+	identity, token, _, err := id.LoadExpiring(identity)
+	return identity, token, err
+}
+
+// Same as Load, but also returns the expiry time of the token, zero if unknown.
+func (id *ConfigIdentityStore) LoadExpiring(identity string) (string, string, time.Time, error) {
 	if identity == "" {
 		var def Default
 		if _, err := id.store.Unmarshal("default", &def); err != nil {
-			return identity, "", err
+			return identity, "", time.Time{}, err
 		}
 		identity = def.Identity
 	}
 
 	var token Token
 	_, err := id.store.Unmarshal(identity, &token)
-	return identity, token.Token, err
+	return identity, token.Token, token.Expires, err
 }
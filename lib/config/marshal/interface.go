@@ -12,3 +12,10 @@ type FileMarshaller interface {
 	// Returns the typical file extension used by files in this format.
 	Extension() string
 }
+
+// Implement the AliasedMarshaller interface in a FileMarshaller when files in
+// its format are also commonly found with other extensions.
+type AliasedMarshaller interface {
+	// Returns the other file extensions used by files in this format.
+	Aliases() []string
+}
@@ -43,6 +43,9 @@ func (j *YamlEncoder) Unmarshal(data []byte, value interface{}) error {
 func (j *YamlEncoder) Extension() string {
 	return "yaml"
 }
+func (j *YamlEncoder) Aliases() []string {
+	return []string{"yml"}
+}
 
 type GobEncoder struct{}
 
@@ -2,6 +2,7 @@ package marshal
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -28,3 +29,53 @@ func TestGobMarshal(t *testing.T) {
 
 	assert.Equal(t, data, comparison)
 }
+
+type TestServer struct {
+	Address string
+	Timeout time.Duration
+	Tags    []string
+}
+
+type TestNested struct {
+	Name    string
+	Servers []TestServer
+	Backup  *TestServer
+	Retry   map[string]time.Duration
+}
+
+func TestYamlMarshal(t *testing.T) {
+	data := TestNested{
+		Name: "fleet",
+		Servers: []TestServer{
+			{Address: "10.0.0.1:53", Timeout: 1500 * time.Millisecond, Tags: []string{"primary"}},
+			{Address: "10.0.0.2:53", Timeout: 2 * time.Minute, Tags: []string{"secondary", "slow"}},
+		},
+		Backup: &TestServer{Address: "10.0.0.3:53", Timeout: time.Hour, Tags: []string{}},
+		Retry:  map[string]time.Duration{"initial": time.Second, "max": 30 * time.Second},
+	}
+
+	result, err := Yaml.Marshal(data)
+	assert.NoError(t, err)
+	// Durations are stored in human readable form.
+	assert.Contains(t, string(result), "timeout: 1.5s")
+
+	var comparison TestNested
+	err = Yaml.Unmarshal(result, &comparison)
+	assert.NoError(t, err)
+	assert.Equal(t, data, comparison)
+
+	// Unknown fields are ignored, so older binaries can read newer configs.
+	var server TestServer
+	err = Yaml.Unmarshal([]byte(`
+address: 10.0.0.1:53
+timeout: 1m30s
+protocol: udp
+extra:
+  nested: true
+`), &server)
+	assert.NoError(t, err)
+	assert.Equal(t, TestServer{Address: "10.0.0.1:53", Timeout: 90 * time.Second}, server)
+
+	err = Yaml.Unmarshal([]byte("timeout: forever\n"), &server)
+	assert.Error(t, err)
+}
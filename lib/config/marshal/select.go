@@ -1,6 +1,7 @@
 package marshal
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/System233/enkit/lib/multierror"
 	"io/ioutil"
@@ -55,9 +56,46 @@ func (fm FileMarshallers) Formats() []string {
 
 // ByExtension returns the first FileMarshaller based on the format specified.
 // Format is generally a lowercase string like "json", "yaml", ...
+//
+// Aliases of a format, like "yml" for "yaml", are also accepted.
 func (fm FileMarshallers) ByFormat(format string) FileMarshaller {
 	for _, candidate := range fm {
-		if candidate.Extension() == format {
+		for _, ext := range Extensions(candidate) {
+			if ext == format {
+				return candidate
+			}
+		}
+	}
+	return nil
+}
+
+// Extensions returns all the extensions used by files in the format of the
+// marshaller, starting with the one returned by Extension().
+func Extensions(m FileMarshaller) []string {
+	extensions := []string{m.Extension()}
+	if aliased, ok := m.(AliasedMarshaller); ok {
+		extensions = append(extensions, aliased.Aliases()...)
+	}
+	return extensions
+}
+
+// Sniff returns the first FileMarshaller capable of parsing the data supplied.
+//
+// Use it to determine the format of a file when the extension is missing or
+// unknown. Data is considered parsable by a marshaller if it can be decoded
+// as a map of keys to values. As many formats are a superset of others (a
+// json document is also a valid yaml document, for example), the order of the
+// FileMarshallers matters: the first is the most preferred. Formats that
+// cannot decode into a generic map, like gob, are never detected.
+//
+// Returns nil if no marshaller can parse the data.
+func (fm FileMarshallers) Sniff(data []byte) FileMarshaller {
+	if len(bytes.TrimSpace(data)) <= 0 {
+		return nil
+	}
+	for _, candidate := range fm {
+		var value map[string]interface{}
+		if err := candidate.Unmarshal(data, &value); err == nil {
 			return candidate
 		}
 	}
@@ -121,18 +159,20 @@ func (fm FileMarshallers) UnmarshalFilePrefix(prefix string, value interface{})
 		// Linux uses / whereas Windows uses \ for paths.
 		// Standardize the file path to be the same format since openssh
 		// expects forward-slash-delimited paths.
-		name := filepath.ToSlash(prefix + "." + candidate.Extension())
+		for _, ext := range Extensions(candidate) {
+			name := filepath.ToSlash(prefix + "." + ext)
 
-		data, err := ioutil.ReadFile(name)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("opening %s: %w", name, err))
-			continue
-		}
-		if err := candidate.Unmarshal(data, value); err != nil {
-			errs = append(errs, fmt.Errorf("parsing %s: %w", name, err))
-			continue
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("opening %s: %w", name, err))
+				continue
+			}
+			if err := candidate.Unmarshal(data, value); err != nil {
+				errs = append(errs, fmt.Errorf("parsing %s: %w", name, err))
+				continue
+			}
+			return name, nil
 		}
-		return name, nil
 	}
 	return "", multierror.New(errs)
 }
@@ -162,9 +202,11 @@ func (fm FileMarshallers) UnmarshalFilePrefix(prefix string, value interface{})
 // os.ErrNotExist if no valid file could be found in the assets.
 func (fm FileMarshallers) UnmarshalAsset(name string, assets map[string][]byte, value interface{}) error {
 	for _, known := range fm {
-		asset, found := assets[name+"."+known.Extension()]
-		if found {
-			return known.Unmarshal(asset, value)
+		for _, ext := range Extensions(known) {
+			asset, found := assets[name+"."+ext]
+			if found {
+				return known.Unmarshal(asset, value)
+			}
 		}
 	}
 	return os.ErrNotExist
@@ -243,6 +285,11 @@ func ByFormat(path string) FileMarshaller {
 	return FileMarshallers(Known).ByFormat(path)
 }
 
+// Sniff is the same as FileMarshallers.Sniff, but uses the default list of Marshallers.
+func Sniff(data []byte) FileMarshaller {
+	return FileMarshallers(Known).Sniff(data)
+}
+
 // Formats is the same as FileMarshallers.Formats, but uses the default list of Marshallers.
 func Formats() []string {
 	return FileMarshallers(Known).Formats()
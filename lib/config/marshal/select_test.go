@@ -52,6 +52,16 @@ func TestFileMarshallersByExtension(t *testing.T) {
 			path:        "https://astore.example.com/g/foo/bar/baz.yaml",
 			wantEncoder: Yaml,
 		},
+		{
+			desc:        "alias",
+			path:        "foo/bar/baz.yml",
+			wantEncoder: Yaml,
+		},
+		{
+			desc:        "unknown extension",
+			path:        "foo/bar/baz.conf",
+			wantEncoder: nil,
+		},
 		{
 			desc:        "url with query parameters",
 			path:        "https://astore.example.com/g/foo/bar/baz.toml?u=123abc",
@@ -65,3 +75,43 @@ func TestFileMarshallersByExtension(t *testing.T) {
 		})
 	}
 }
+
+func TestSniff(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		data        string
+		wantEncoder FileMarshaller
+	}{
+		{
+			desc:        "toml",
+			data:        "name = \"Friedrich\"\n[inner]\nyear = 1844\n",
+			wantEncoder: Toml,
+		},
+		{
+			desc:        "json",
+			data:        `{"name": "Friedrich", "inner": {"year": 1844}}`,
+			wantEncoder: Json,
+		},
+		{
+			desc:        "yaml",
+			data:        "name: Friedrich\ninner:\n  year: 1844\n",
+			wantEncoder: Yaml,
+		},
+		{
+			desc:        "empty",
+			data:        " \n",
+			wantEncoder: nil,
+		},
+		{
+			desc:        "garbage",
+			data:        "just some text",
+			wantEncoder: nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := FileMarshallers(Known).Sniff([]byte(tc.data))
+			assert.Equal(t, tc.wantEncoder, got)
+		})
+	}
+}
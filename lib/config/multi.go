@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"github.com/System233/enkit/lib/config/marshal"
+	"github.com/System233/enkit/lib/logger"
 	"github.com/System233/enkit/lib/multierror"
 	"os"
 )
@@ -10,13 +11,14 @@ import (
 type MultiFormat struct {
 	loader     Loader
 	marshaller []marshal.FileMarshaller
+	log        logger.Logger
 }
 
 func NewMulti(loader Loader, marshaller ...marshal.FileMarshaller) *MultiFormat {
 	if len(marshaller) <= 0 {
 		marshaller = marshal.Known
 	}
-	return &MultiFormat{loader: loader, marshaller: marshaller}
+	return &MultiFormat{loader: loader, marshaller: marshaller, log: logger.Go}
 }
 
 // List returns the list of configs the loader knows about.
@@ -45,14 +47,18 @@ func (ss *MultiFormat) List() ([]string, error) {
 	return ss.loader.List()
 }
 
+// Marshal stores the value under the name specified in desc.
+//
+// If the name has no known extension, and a config by that name already
+// exists, the existing config is overwritten, in the format it was found in.
+// New configs are written in the first, preferred, format.
 func (ss *MultiFormat) Marshal(desc Descriptor, value interface{}) error {
 	name, marshaller, err := ss.parseDesc(desc)
 	if err != nil {
 		return err
 	}
 	if marshaller == nil {
-		marshaller = ss.marshaller[0]
-		name = name + "." + marshaller.Extension()
+		name, marshaller = ss.locate(name)
 	}
 
 	data, err := marshaller.Marshal(value)
@@ -89,60 +95,137 @@ func (ss *MultiFormat) Delete(desc Descriptor) error {
 		return ss.loader.Delete(name)
 	}
 
+	attempted := 0
 	nonexisting := 0
 	var errors []error
 	for _, marshaller := range ss.marshaller {
-		fullname := name + "." + marshaller.Extension()
-		err := ss.loader.Delete(fullname)
-		if err == nil {
-			continue
-		}
-
-		if os.IsNotExist(err) {
-			nonexisting += 1
-			continue
+		for _, ext := range marshal.Extensions(marshaller) {
+			fullname := name + "." + ext
+			err := ss.loader.Delete(fullname)
+			attempted += 1
+			if err == nil {
+				continue
+			}
+
+			if os.IsNotExist(err) {
+				nonexisting += 1
+				continue
+			}
+
+			errors = append(errors, fmt.Errorf("could not delete %s: %w", fullname, err))
 		}
-
-		errors = append(errors, fmt.Errorf("could not delete %s: %w", fullname, err))
 	}
 
-	if nonexisting == len(ss.marshaller) {
+	if nonexisting == attempted {
 		return os.ErrNotExist
 	}
 	return multierror.New(errors)
 }
 
+// Modify implements the Modifier interface.
+//
+// The config is located, or created, as Marshal does.
+func (ss *MultiFormat) Modify(name string, update func(current []byte) ([]byte, error)) error {
+	path, _ := ss.locate(name)
+	return modify(ss.loader, path, update)
+}
+
+// Update implements the Updater interface.
+//
+// The config is located, or created, as Marshal does.
+func (ss *MultiFormat) Update(name string, value interface{}, update func() error) error {
+	path, marshaller := ss.locate(name)
+	return modify(ss.loader, path, func(current []byte) ([]byte, error) {
+		if current != nil {
+			if err := unmarshal(ss.log, ss.loader, path, current, marshaller, value); err != nil {
+				return nil, err
+			}
+		}
+		if err := update(); err != nil {
+			return nil, err
+		}
+		return marshaller.Marshal(value)
+	})
+}
+
+// locate returns the path and format to write the config by the specified name.
+//
+// If the name has no known extension, the existing config by that name is
+// used, or a new one in the preferred format.
+func (ss *MultiFormat) locate(name string) (string, marshal.FileMarshaller) {
+	if marshaller := marshal.FileMarshallers(ss.marshaller).ByExtension(name); marshaller != nil {
+		return name, marshaller
+	}
+	if found, _, err := ss.find(name); err == nil {
+		return found.p, found.m
+	}
+	marshaller := ss.marshaller[0]
+	return name + "." + marshaller.Extension(), marshaller
+}
+
 type multiDescriptor struct {
 	m marshal.FileMarshaller
 	p string
 }
 
+// Unmarshal reads the config by the specified name into value.
+//
+// If the name has a known extension, the file is parsed in the corresponding
+// format. Otherwise, a file with the name followed by the extension of each
+// format is looked up, in order of preference. As a last resort, a file with
+// exactly the name specified is read, and its format detected from its content.
 func (ss *MultiFormat) Unmarshal(name string, value interface{}) (Descriptor, error) {
-	load := func(m marshal.FileMarshaller, path string) (Descriptor, error) {
-		data, err := ss.loader.Read(path)
-		if err != nil {
-			return nil, err
-		}
-		descriptor := &multiDescriptor{m: m, p: path}
-		if len(data) <= 0 {
-			return descriptor, nil
-		}
-		return descriptor, m.Unmarshal(data, value)
+	desc, data, err := ss.find(name)
+	if err != nil {
+		return nil, err
 	}
+	return desc, unmarshal(ss.log, ss.loader, desc.p, data, desc.m, value)
+}
 
+// find locates the config by the specified name, and determines its format.
+//
+// Returns the descriptor of the config found, and its content.
+// If no config could be found, os.IsNotExist(error) returns true.
+func (ss *MultiFormat) find(name string) (*multiDescriptor, []byte, error) {
 	marshaller := marshal.FileMarshallers(ss.marshaller).ByExtension(name)
 	if marshaller != nil {
-		return load(marshaller, name)
+		data, err := ss.loader.Read(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &multiDescriptor{m: marshaller, p: name}, data, nil
 	}
 
-	var err error
-	var desc Descriptor
+	var first error
 	for _, m := range ss.marshaller {
-		path := name + "." + m.Extension()
-		desc, err = load(m, path)
-		if err == nil {
-			return desc, err
+		for _, ext := range marshal.Extensions(m) {
+			path := name + "." + ext
+			data, err := ss.loader.Read(path)
+			if err == nil {
+				return &multiDescriptor{m: m, p: path}, data, nil
+			}
+			if first == nil || (os.IsNotExist(first) && !os.IsNotExist(err)) {
+				first = err
+			}
 		}
 	}
-	return desc, err
+
+	data, err := ss.loader.Read(name)
+	if err != nil {
+		return nil, nil, first
+	}
+	if len(data) <= 0 {
+		return &multiDescriptor{m: ss.marshaller[0], p: name}, data, nil
+	}
+	marshaller = marshal.FileMarshallers(ss.marshaller).Sniff(data)
+	if recoverer, ok := ss.loader.(Recoverer); ok && marshaller == nil {
+		// The file may be corrupted, its last good version tells the format.
+		if backup, err := recoverer.ReadBackup(name); err == nil {
+			marshaller = marshal.FileMarshallers(ss.marshaller).Sniff(backup)
+		}
+	}
+	if marshaller == nil {
+		return nil, nil, fmt.Errorf("could not determine the format of %s - known formats are %v", name, marshal.FileMarshallers(ss.marshaller).Formats())
+	}
+	return &multiDescriptor{m: marshaller, p: name}, data, nil
 }
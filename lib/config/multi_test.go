@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/System233/enkit/lib/config/directory"
+	"github.com/System233/enkit/lib/config/marshal"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
@@ -112,3 +113,78 @@ func TestMulti(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []string{}, found)
 }
+
+func TestMultiFormatDetection(t *testing.T) {
+	hd, err := directory.OpenDir(t.TempDir())
+	assert.NoError(t, err)
+
+	data := TestConfig{
+		Key:   "Hope",
+		Value: "is a good breakfast, but it is a bad supper.",
+		Inner: InnerTestConfig{Wisdom: "Knowledge is power."},
+	}
+
+	// Order of preference is respected for new files.
+	m := NewMulti(hd, marshal.Yaml, marshal.Json)
+	assert.NoError(t, m.Marshal("quote", data))
+	found, err := m.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"quote.yaml"}, found)
+
+	// Files created by hand with alias extensions are found.
+	assert.NoError(t, hd.Write("hand.yml", []byte("key: Hand\ninner:\n  wisdom: Written\n")))
+	var read TestConfig
+	desc, err := m.Unmarshal("hand", &read)
+	assert.NoError(t, err)
+	assert.Equal(t, "hand.yml", desc.(*multiDescriptor).p)
+	assert.Equal(t, TestConfig{Key: "Hand", Inner: InnerTestConfig{Wisdom: "Written"}}, read)
+
+	// Existing files are updated in place, in their format.
+	m = NewMulti(hd)
+	assert.NoError(t, m.Marshal("hand", data))
+	found, err = m.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hand.yml", "quote.yaml"}, found)
+
+	read = TestConfig{}
+	desc, err = m.Unmarshal("hand.yml", &read)
+	assert.NoError(t, err)
+	assert.Equal(t, marshal.Yaml, desc.(*multiDescriptor).m)
+	assert.Equal(t, data, read)
+
+	// Files without a known extension are detected by content.
+	for name, content := range map[string]string{
+		"conf.json": `{"Key": "Json", "Inner": {"Wisdom": "Braces"}}`,
+		"conf.toml": "Key = \"Toml\"\n[Inner]\nWisdom = \"Brackets\"\n",
+		"conf.yaml": "key: Yaml\ninner:\n  wisdom: Indentation\n",
+	} {
+		assert.NoError(t, hd.Write("detect", []byte(content)))
+
+		read = TestConfig{}
+		desc, err = m.Unmarshal("detect", &read)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "detect", desc.(*multiDescriptor).p, name)
+		assert.Equal(t, marshal.ByExtension(name), desc.(*multiDescriptor).m, name)
+		assert.NotEmpty(t, read.Key, name)
+		assert.NotEmpty(t, read.Inner.Wisdom, name)
+
+		// And are written back in the same format.
+		assert.NoError(t, m.Marshal("detect", data))
+		read = TestConfig{}
+		assert.NoError(t, marshal.Unmarshal(name, mustRead(t, hd, "detect"), &read), name)
+		assert.Equal(t, data, read, name)
+	}
+
+	assert.NoError(t, hd.Write("garbage", []byte("not a config")))
+	_, err = m.Unmarshal("garbage", &read)
+	assert.ErrorContains(t, err, "could not determine the format of garbage")
+
+	_, err = m.Unmarshal("missing", &read)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+}
+
+func mustRead(t *testing.T, hd *directory.Directory, name string) []byte {
+	data, err := hd.Read(name)
+	assert.NoError(t, err)
+	return data
+}
@@ -3,15 +3,17 @@ package config
 import (
 	"fmt"
 	"github.com/System233/enkit/lib/config/marshal"
+	"github.com/System233/enkit/lib/logger"
 )
 
 type SimpleStore struct {
 	loader     Loader
 	marshaller marshal.Marshaller
+	log        logger.Logger
 }
 
 func NewSimple(loader Loader, marshaller marshal.Marshaller) *SimpleStore {
-	return &SimpleStore{loader: loader, marshaller: marshaller}
+	return &SimpleStore{loader: loader, marshaller: marshaller, log: logger.Go}
 }
 
 func (ss *SimpleStore) List() ([]string, error) {
@@ -35,10 +37,7 @@ func (ss *SimpleStore) Unmarshal(name string, value interface{}) (Descriptor, er
 	if err != nil {
 		return name, err
 	}
-	if len(data) <= 0 {
-		return name, nil
-	}
-	return name, ss.marshaller.Unmarshal(data, value)
+	return name, unmarshal(ss.log, ss.loader, name, data, ss.marshaller, value)
 }
 
 func (ss *SimpleStore) Delete(desc Descriptor) error {
@@ -48,3 +47,23 @@ func (ss *SimpleStore) Delete(desc Descriptor) error {
 	}
 	return ss.loader.Delete(name)
 }
+
+// Modify implements the Modifier interface.
+func (ss *SimpleStore) Modify(name string, update func(current []byte) ([]byte, error)) error {
+	return modify(ss.loader, name, update)
+}
+
+// Update implements the Updater interface.
+func (ss *SimpleStore) Update(name string, value interface{}, update func() error) error {
+	return modify(ss.loader, name, func(current []byte) ([]byte, error) {
+		if current != nil {
+			if err := unmarshal(ss.log, ss.loader, name, current, ss.marshaller, value); err != nil {
+				return nil, err
+			}
+		}
+		if err := update(); err != nil {
+			return nil, err
+		}
+		return ss.marshaller.Marshal(value)
+	})
+}
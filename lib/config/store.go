@@ -42,6 +42,14 @@
 //
 package config
 
+import (
+	"fmt"
+	"os"
+
+	"github.com/System233/enkit/lib/config/marshal"
+	"github.com/System233/enkit/lib/logger"
+)
+
 // Represents a file that was Unmarshalled.
 //
 // Use descriptors to guarantee that a file is saved in the same location it was read from.
@@ -97,3 +105,86 @@ type Loader interface {
 	Write(name string, data []byte) error
 	Delete(name string) error
 }
+
+// Implement the Recoverer interface in a Loader capable of keeping a copy of
+// the last good version of each config.
+//
+// Stores created with NewSimple() or NewMulti() will fall back to this copy
+// when a config is empty or cannot be parsed, logging a warning.
+type Recoverer interface {
+	ReadBackup(name string) ([]byte, error)
+}
+
+// Implement the Modifier interface in a Loader or Store capable of atomic
+// read-modify-write cycles of a config.
+//
+// Stores created with NewSimple() or NewMulti() implement Modifier, and hold
+// the lock of the underlying Loader, if it implements Modifier as well.
+type Modifier interface {
+	// Modify invokes update with the current content of the config by the
+	// specified name, nil if it does not exist, and stores the data returned.
+	//
+	// Concurrent invocations of Modify on the same config, even from other
+	// processes, are serialized. If update returns an error, the config is
+	// left unchanged.
+	Modify(name string, update func(current []byte) ([]byte, error)) error
+}
+
+// Implement the Updater interface in a Store capable of atomically updating
+// an object, in the same way as Modifier.
+type Updater interface {
+	// Update unmarshals the config by the specified name in value, invokes
+	// update, and marshals value back, holding the lock as Modify does.
+	//
+	// If the config does not exist, value is left unchanged before invoking update.
+	Update(name string, value interface{}, update func() error) error
+}
+
+// modify implements Modifier with the loader, taking its lock if supported.
+func modify(loader Loader, name string, update func(current []byte) ([]byte, error)) error {
+	if modifier, ok := loader.(Modifier); ok {
+		return modifier.Modify(name, update)
+	}
+
+	current, err := loader.Read(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := update(current)
+	if err != nil {
+		return err
+	}
+	return loader.Write(name, data)
+}
+
+// unmarshal parses data, read from the config by the specified name, into value.
+//
+// If data is empty or invalid, and the loader keeps a backup of the config,
+// the backup is parsed instead.
+func unmarshal(log logger.Logger, loader Loader, name string, data []byte, marshaller marshal.Marshaller, value interface{}) error {
+	var err error
+	if len(data) > 0 {
+		if err = marshaller.Unmarshal(data, value); err == nil {
+			return nil
+		}
+	}
+
+	recoverer, ok := loader.(Recoverer)
+	if !ok {
+		return err
+	}
+	backup, berr := recoverer.ReadBackup(name)
+	if berr != nil || len(backup) <= 0 {
+		return err
+	}
+	if berr := marshaller.Unmarshal(backup, value); berr != nil {
+		return err
+	}
+
+	problem := "is empty"
+	if err != nil {
+		problem = fmt.Sprintf("could not be parsed - %s", err)
+	}
+	log.Warnf("config %s %s - using the last good version saved instead", name, problem)
+	return nil
+}
@@ -1,10 +1,16 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
 	"github.com/System233/enkit/lib/config/directory"
 	"github.com/System233/enkit/lib/config/marshal"
+	"github.com/System233/enkit/lib/logger"
 	"github.com/stretchr/testify/assert"
-	"testing"
 )
 
 func TestStoreImplementations(t *testing.T) {
@@ -14,9 +20,133 @@ func TestStoreImplementations(t *testing.T) {
 	var _ = []Loader{
 		hd,
 	}
+	var _ = []Recoverer{
+		hd,
+	}
+	var _ = []Modifier{
+		hd,
+		NewSimple(hd, marshal.Json),
+		NewMulti(hd),
+	}
+	var _ = []Updater{
+		NewSimple(hd, marshal.Json),
+		NewMulti(hd),
+	}
 
 	var _ = []Store{
 		NewSimple(hd, marshal.Json),
 		NewMulti(hd, marshal.Toml, marshal.Json),
 	}
 }
+
+func TestRecoverCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	hd, err := directory.OpenDir(dir)
+	assert.NoError(t, err)
+
+	var warnings []string
+	log := &logger.DefaultLogger{Printer: func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}}
+
+	multi := NewMulti(hd, marshal.Json)
+	multi.log = log
+	simple := NewSimple(hd, marshal.Json)
+	simple.log = log
+
+	good := TestConfig{Key: "Recovery", Value: "is the last good version", Inner: InnerTestConfig{Wisdom: "fsync"}}
+	assert.NoError(t, multi.Marshal("quote", good))
+	data, err := hd.Read("quote.json")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		desc        string
+		content     []byte
+		wantWarning string
+	}{
+		{
+			desc:        "zero bytes",
+			content:     []byte{},
+			wantWarning: "[warning] config quote.json is empty - using the last good version saved instead",
+		},
+		{
+			desc:        "truncated",
+			content:     data[:len(data)/2],
+			wantWarning: "[warning] config quote.json could not be parsed - unexpected end of JSON input - using the last good version saved instead",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, "quote.json"), tc.content, 0600))
+
+			for _, store := range []Store{multi, simple} {
+				warnings = nil
+				var read TestConfig
+				_, err := store.Unmarshal("quote.json", &read)
+				assert.NoError(t, err)
+				assert.Equal(t, good, read)
+				assert.Equal(t, []string{tc.wantWarning}, warnings)
+			}
+		})
+	}
+
+	// Without a good version to recover, the error is returned.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "quote.json"+directory.BackupSuffix)))
+	var read TestConfig
+	_, err = multi.Unmarshal("quote", &read)
+	assert.ErrorContains(t, err, "unexpected end of JSON input")
+}
+
+type testCounter struct {
+	Count   int
+	Writers []string
+}
+
+func TestUpdate(t *testing.T) {
+	hd, err := directory.OpenDir(t.TempDir())
+	assert.NoError(t, err)
+
+	stores := map[string]Updater{
+		"multi":  NewMulti(hd, marshal.Yaml),
+		"simple": NewSimple(hd, marshal.Json),
+	}
+	for name, store := range stores {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var counter testCounter
+				err := store.Update(name, &counter, func() error {
+					counter.Count += 1
+					counter.Writers = append(counter.Writers, fmt.Sprintf("writer-%d", i))
+					return nil
+				})
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		var counter testCounter
+		_, err := store.(Store).Unmarshal(name, &counter)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, counter.Count)
+		assert.Len(t, counter.Writers, 10)
+
+		// An error leaves the config unchanged.
+		err = store.Update(name, &counter, func() error {
+			counter.Count = 0
+			return fmt.Errorf("aborted")
+		})
+		assert.EqualError(t, err, "aborted")
+		counter = testCounter{}
+		_, err = store.(Store).Unmarshal(name, &counter)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, counter.Count)
+	}
+
+	// Each store created a single config.
+	found, err := hd.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"multi.yaml", "simple"}, found)
+}
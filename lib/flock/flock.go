@@ -0,0 +1,60 @@
+// Package flock provides advisory file locks, to coordinate processes on the same machine.
+//
+// Locks are held on an open *os.File, and released when Unlock is called or
+// the file is closed. Two files opened separately are locked independently,
+// even within the same process.
+package flock
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Mode is the mode of a lock.
+type Mode int
+
+const (
+	// Exclusive locks can only be held by one file at a time.
+	Exclusive Mode = iota
+	// Shared locks can be held by any number of files, as long as no exclusive lock is held.
+	Shared
+)
+
+// ErrTimeout is returned by Lock when the lock could not be acquired in time.
+var ErrTimeout = errors.New("timed out waiting for the lock")
+
+// PollInterval is how often Lock checks if the lock was released, when waiting with a timeout.
+var PollInterval = 20 * time.Millisecond
+
+// TryLock acquires a lock on the file, returning false if held by someone else.
+func TryLock(f *os.File, mode Mode) (bool, error) {
+	return tryLock(f, mode)
+}
+
+// Lock waits to acquire a lock on the file.
+//
+// With a timeout > 0, Lock gives up after timeout returning an error
+// matching ErrTimeout. Otherwise, it waits for as long as necessary.
+func Lock(f *os.File, mode Mode, timeout time.Duration) error {
+	if timeout <= 0 {
+		return lock(f, mode)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(f, mode)
+		if err != nil || locked {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+// Unlock releases the lock acquired on the file.
+func Unlock(f *os.File) error {
+	return unlock(f)
+}
@@ -0,0 +1,73 @@
+package flock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func open(t *testing.T, path string) *os.File {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	assert.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	first, second := open(t, path), open(t, path)
+
+	locked, err := TryLock(first, Exclusive)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	locked, err = TryLock(second, Exclusive)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+	locked, err = TryLock(second, Shared)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+
+	assert.NoError(t, Unlock(first))
+	locked, err = TryLock(second, Shared)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	// Any number of shared locks, but no exclusive one.
+	locked, err = TryLock(first, Shared)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	third := open(t, path)
+	locked, err = TryLock(third, Exclusive)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	first, second := open(t, path), open(t, path)
+
+	assert.NoError(t, Lock(first, Exclusive, 0))
+
+	start := time.Now()
+	err := Lock(second, Exclusive, 50*time.Millisecond)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		Unlock(first)
+	}()
+	assert.NoError(t, Lock(second, Exclusive, time.Hour))
+	assert.NoError(t, Unlock(second))
+
+	// Without a timeout, Lock waits for as long as necessary.
+	assert.NoError(t, Lock(first, Shared, 0))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		Unlock(first)
+	}()
+	assert.NoError(t, Lock(second, Exclusive, 0))
+}
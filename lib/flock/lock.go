@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package flock
+
+import (
+	"os"
+	"syscall"
+)
+
+func how(mode Mode) int {
+	if mode == Shared {
+		return syscall.LOCK_SH
+	}
+	return syscall.LOCK_EX
+}
+
+func tryLock(f *os.File, mode Mode) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), how(mode)|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func lock(f *os.File, mode Mode) error {
+	return syscall.Flock(int(f.Fd()), how(mode))
+}
+
+func unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
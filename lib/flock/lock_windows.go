@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package flock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func flags(mode Mode) uint32 {
+	if mode == Shared {
+		return 0
+	}
+	return windows.LOCKFILE_EXCLUSIVE_LOCK
+}
+
+func tryLock(f *os.File, mode Mode) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags(mode)|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func lock(f *os.File, mode Mode) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags(mode), 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlock(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -1,6 +1,10 @@
 package goroutine
 
 import (
+	"context"
+	"fmt"
+	"sync"
+
 	"github.com/System233/enkit/lib/multierror"
 )
 
@@ -58,6 +62,74 @@ func WaitAll(goroutine ...func() error) error {
 	return multierror.New(errs)
 }
 
+// WaitN runs the functions with at most n of them running at the same time,
+// in order, waits for each to complete, and returns all errors, like WaitAll.
+//
+// If n <= 0, all the functions run at the same time.
+func WaitN(n int, goroutine ...func() error) error {
+	wrapped := make([]func(context.Context) error, len(goroutine))
+	for ix, g := range goroutine {
+		routine := g
+		wrapped[ix] = func(context.Context) error {
+			return routine()
+		}
+	}
+	return WaitNContext(context.Background(), n, wrapped...)
+}
+
+// WaitAllContext is like WaitAll, but stops starting functions once ctx is done.
+//
+// See WaitNContext for details.
+func WaitAllContext(ctx context.Context, goroutine ...func(context.Context) error) error {
+	return WaitNContext(ctx, 0, goroutine...)
+}
+
+// WaitNContext runs the functions with at most n of them running at the same
+// time, in order, waits for each to complete, and returns all errors.
+//
+// Each function is passed ctx, and is expected to stop its work once ctx is
+// done. Functions not started by then are never started: the error returned
+// includes how many were, and wraps the error of ctx.
+//
+// The errors are returned as a multierror, in the order of the functions.
+// If n <= 0, all the functions run at the same time.
+func WaitNContext(ctx context.Context, n int, goroutine ...func(context.Context) error) error {
+	if n <= 0 || n > len(goroutine) {
+		n = len(goroutine)
+	}
+
+	errs := make([]error, len(goroutine))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ix := range indexes {
+				errs[ix] = goroutine[ix](ctx)
+			}
+		}()
+	}
+
+	started := 0
+feed:
+	for ; started < len(goroutine) && ctx.Err() == nil; started++ {
+		select {
+		case indexes <- started:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	failures := multierror.Filter(errs)
+	if started < len(goroutine) {
+		failures = append(failures, fmt.Errorf("interrupted after starting %d of %d goroutines: %w", started, len(goroutine), ctx.Err()))
+	}
+	return multierror.New(failures)
+}
+
 // WaitFirst runs a goroutine for each function, returns as soon as all have completed, or one errors out.
 func WaitFirstError(goroutine ...func() error) error {
 	ec := make(chan error, len(goroutine))
@@ -75,3 +147,31 @@ func WaitFirstError(goroutine ...func() error) error {
 	}
 	return nil
 }
+
+// WaitFirstErrorContext is like WaitFirstError, but the functions are passed
+// a context canceled as soon as one errors out, or ctx is done, so the others
+// can stop their work.
+//
+// Unlike WaitFirstError, it only returns once all the functions have
+// completed.
+func WaitFirstErrorContext(ctx context.Context, goroutine ...func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ec := make(chan error, len(goroutine))
+	for _, g := range goroutine {
+		routine := g
+		go func() {
+			ec <- routine(ctx)
+		}()
+	}
+
+	var first error
+	for i := 0; i < len(goroutine); i++ {
+		if err := <-ec; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
@@ -0,0 +1,107 @@
+package goroutine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitAll(t *testing.T) {
+	assert.NoError(t, WaitAll())
+	assert.NoError(t, WaitAll(func() error { return nil }))
+
+	err := WaitAll(
+		func() error { return nil },
+		func() error { return fmt.Errorf("second") },
+		func() error { return fmt.Errorf("third") },
+	)
+	assert.EqualError(t, err, "Multiple errors:\n  second\n  third")
+}
+
+func TestWaitN(t *testing.T) {
+	var running, peak, done int32
+	funcs := []func() error{}
+	for i := 0; i < 20; i++ {
+		i := i
+		funcs = append(funcs, func() error {
+			now := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&done, 1)
+			if i%10 == 3 {
+				return fmt.Errorf("failed %d", i)
+			}
+			return nil
+		})
+	}
+
+	err := WaitN(4, funcs...)
+	assert.EqualError(t, err, "Multiple errors:\n  failed 3\n  failed 13")
+	assert.Equal(t, int32(20), done)
+	assert.LessOrEqual(t, peak, int32(4))
+	assert.Greater(t, peak, int32(1))
+
+	assert.NoError(t, WaitN(0, funcs[0], funcs[1]))
+	assert.NoError(t, WaitN(4))
+}
+
+func TestWaitNContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var started int32
+	funcs := []func(context.Context) error{}
+	for i := 0; i < 100; i++ {
+		funcs = append(funcs, func(ctx context.Context) error {
+			if atomic.AddInt32(&started, 1) == 10 {
+				cancel()
+			}
+			return nil
+		})
+	}
+
+	err := WaitNContext(ctx, 2, funcs...)
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Less(t, started, int32(100))
+	assert.Contains(t, err.Error(), fmt.Sprintf("interrupted after starting %d of 100 goroutines", started))
+
+	// Functions completed before the context is done are not an error.
+	ctx, cancel = context.WithCancel(context.Background())
+	assert.NoError(t, WaitAllContext(ctx, func(context.Context) error { return nil }))
+	cancel()
+	assert.True(t, errors.Is(WaitAllContext(ctx, func(context.Context) error { return nil }), context.Canceled))
+}
+
+func TestWaitFirstErrorContext(t *testing.T) {
+	var canceled int32
+	err := WaitFirstErrorContext(context.Background(),
+		func(ctx context.Context) error {
+			return fmt.Errorf("first")
+		},
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			atomic.AddInt32(&canceled, 1)
+			return fmt.Errorf("second")
+		},
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			atomic.AddInt32(&canceled, 1)
+			return nil
+		},
+	)
+	assert.EqualError(t, err, "first")
+	assert.Equal(t, int32(2), canceled)
+
+	assert.NoError(t, WaitFirstErrorContext(context.Background(), func(context.Context) error { return nil }))
+}
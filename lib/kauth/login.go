@@ -12,6 +12,7 @@ import (
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/ssh"
 	"math/rand"
+	"time"
 )
 
 func init() {
@@ -19,6 +20,13 @@ func init() {
 	browser.Stderr = nil
 }
 
+const (
+	// MaxLoginWait is how long to wait for the user to complete authentication, when polling.
+	MaxLoginWait = 30 * time.Minute
+	// DefaultPollInterval is used if the server did not suggest an interval.
+	DefaultPollInterval = 2 * time.Second
+)
+
 type EnkitCredentials struct {
 	Token string
 	// The below fields can be possibly empty if the auth server does not support CA certificates.
@@ -30,7 +38,12 @@ type EnkitCredentials struct {
 
 // PerformLogin will login with the provider auth client, retry and logger. It does not care about the cache.
 // If you wish to save the result, please call SaveCredentials
-func PerformLogin(authClient apb.AuthClient, l logger.Logger, repeater *retry.Options, rng *rand.Rand, username, domain string) (*EnkitCredentials, error) {
+//
+// keygen generates the key pair the server is asked to sign, kcerts.GenerateDefault is used if nil.
+func PerformLogin(authClient apb.AuthClient, l logger.Logger, repeater *retry.Options, rng *rand.Rand, keygen kcerts.SSHKeyGenerator, username, domain string) (*EnkitCredentials, error) {
+	if keygen == nil {
+		keygen = kcerts.GenerateDefault
+	}
 	pubBox, privBox, err := box.GenerateKey(rng)
 	if err != nil {
 		return nil, err
@@ -73,25 +86,40 @@ func PerformLogin(authClient apb.AuthClient, l logger.Logger, repeater *retry.Op
 	if err != nil {
 		return nil, fmt.Errorf("server provided invalid key - please retry - %s", err)
 	}
-	sshPub, sshPriv, err := kcerts.GenerateED25519()
+	sshPub, sshPriv, err := keygen()
 	if err != nil {
 		return nil, err
 	}
 	treq := &apb.TokenRequest{
 		Url:       ares.Url,
 		Publickey: ssh.MarshalAuthorizedKey(sshPub),
+		// Older servers ignore this field, and just block until the token is available.
+		Nowait: true,
 	}
 	var tres *apb.TokenResponse
+	deadline := time.Now().Add(MaxLoginWait)
 	if err := repeater.Run(func() error {
-		l.Infof("Polling to retrieve token.")
-		t, err := authClient.Token(context.TODO(), treq)
-		if err != nil {
-			l.Infof("Polling failed - %v - retrying in %s", err, repeater.Wait)
-			return err
+		for {
+			l.Infof("Polling to retrieve token.")
+			t, err := authClient.Token(context.TODO(), treq)
+			if err != nil {
+				l.Infof("Polling failed - %v - retrying in %s", err, repeater.Wait)
+				return err
+			}
+			if !t.Pending {
+				l.Infof("Polling succeeded - decrypting token")
+				tres = t
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return retry.Fatal(fmt.Errorf("timed out waiting for authentication to complete after %s", MaxLoginWait))
+			}
+			interval := time.Duration(t.PollIntervalMs) * time.Millisecond
+			if interval <= 0 {
+				interval = DefaultPollInterval
+			}
+			time.Sleep(interval)
 		}
-		l.Infof("Polling succeeded - decrypting token")
-		tres = t
-		return nil
 	}); err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package kauth
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/System233/enkit/lib/cache"
 	"github.com/System233/enkit/lib/kcerts"
@@ -13,17 +14,24 @@ func SaveCredentials(credentials *EnkitCredentials, store cache.Store, sshopts .
 	if len(credentials.CaHosts) == 0 || credentials.SSHCertificate == nil || credentials.PrivateKey == nil {
 		return nil
 	}
-	caPublicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(credentials.CAPublicKey))
-	if err != nil {
-		return fmt.Errorf("could not parse CA public key: %w", err)
+	// During a CA rotation, the server returns multiple CAs, one per line.
+	var caPublicKeys []ssh.PublicKey
+	for rest := []byte(credentials.CAPublicKey); len(bytes.TrimSpace(rest)) > 0; {
+		caPublicKey, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return fmt.Errorf("could not parse CA public key: %w", err)
+		}
+		caPublicKeys = append(caPublicKeys, caPublicKey)
+		rest = next
 	}
 	sshDir, err := kcerts.FindSSHDir()
 	if err != nil {
 		return err
 	}
-	err = kcerts.AddSSHCAToClient(caPublicKey, credentials.CaHosts, sshDir)
-	if err != nil {
-		return err
+	for _, caPublicKey := range caPublicKeys {
+		if err := kcerts.AddSSHCAToClient(caPublicKey, credentials.CaHosts, sshDir); err != nil {
+			return err
+		}
 	}
 	agent, err := kcerts.PrepareSSHAgent(store, sshopts...)
 	if err != nil {
@@ -0,0 +1,98 @@
+package kbuildbarn
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/System233/enkit/lib/goroutine"
+	"github.com/System233/enkit/lib/multierror"
+)
+
+// DefaultApplyWorkers is the number of links created in parallel by ApplyHardlinks by default.
+const DefaultApplyWorkers = 32
+
+// ApplyOptions configures ApplyHardlinks.
+type ApplyOptions struct {
+	// How to materialize the files. StrategyAuto if empty.
+	Strategy Strategy
+	// Maximum number of files materialized in parallel. DefaultApplyWorkers if <= 0.
+	Workers int
+	// Do not touch the file system, just report the files that would be materialized.
+	DryRun bool
+
+	// If set, invoked with the number of files processed so far, including
+	// failures, and the total, every ProgressEvery files and once at the end.
+	// Invocations are serialized.
+	Progress func(done, total int)
+	// Number of files between invocations of Progress. Every file if <= 0.
+	ProgressEvery int
+}
+
+// ApplyHardlinks materializes all the files in list, in parallel.
+//
+// Like HardlinkList.Apply, parent directories are created as needed, existing
+// files are left untouched, and failures do not stop the processing of the
+// other files: they are returned together as a multierror, in list order.
+//
+// If ctx is canceled, no new file is started, and the error returned says
+// how many files were completed. The Report always lists the files that were
+// materialized, in list order.
+func ApplyHardlinks(ctx context.Context, list HardlinkList, opts ApplyOptions) (Report, error) {
+	strategy := opts.Strategy
+	if strategy == "" {
+		strategy = StrategyAuto
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultApplyWorkers
+	}
+	every := opts.ProgressEvery
+	if every <= 0 {
+		every = 1
+	}
+
+	results := make([]*Materialized, len(list))
+	errs := make([]error, len(list))
+
+	var lock sync.Mutex
+	done := 0
+	completed := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		done++
+		if opts.Progress != nil && (done%every == 0 || done == len(list)) {
+			opts.Progress(done, len(list))
+		}
+	}
+
+	funcs := make([]func(context.Context) error, len(list))
+	for ix := range list {
+		ix, link := ix, list[ix]
+		funcs[ix] = func(context.Context) error {
+			if opts.DryRun {
+				results[ix] = &Materialized{Hardlink: link, Strategy: strategy}
+			} else if used, existing, err := link.Apply(strategy); err != nil {
+				errs[ix] = err
+			} else {
+				results[ix] = &Materialized{Hardlink: link, Strategy: used, Existing: existing}
+			}
+			completed()
+			return nil
+		}
+	}
+	// Failures are collected in errs, the only error returned is for the files never started.
+	interrupted := goroutine.WaitNContext(ctx, workers, funcs...)
+
+	var report Report
+	for _, result := range results {
+		if result != nil {
+			report = append(report, *result)
+		}
+	}
+	failures := multierror.Filter(errs)
+	if interrupted != nil {
+		failures = append(failures, fmt.Errorf("interrupted after %d of %d files: %w", len(report), len(list), ctx.Err()))
+	}
+	return report, multierror.New(failures)
+}
@@ -0,0 +1,91 @@
+package kbuildbarn
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+)
+
+// manyLinks returns a list of count files linking src into dir, spread across 10 directories.
+func manyLinks(dir, src string, count int) HardlinkList {
+	var list HardlinkList
+	for i := 0; i < count; i++ {
+		list = append(list, &Hardlink{Src: src, Dest: filepath.Join(dir, fmt.Sprintf("dir%d", i%10), fmt.Sprintf("file%d", i)), Size: 11})
+	}
+	return list
+}
+
+func TestApplyHardlinks(t *testing.T) {
+	dir, links := casFixture(t)
+	list := manyLinks(filepath.Join(dir, "scratch"), links[0].Src, 1000)
+
+	progress := []int{}
+	report, err := ApplyHardlinks(context.Background(), list, ApplyOptions{
+		Workers:       8,
+		ProgressEvery: 300,
+		Progress: func(done, total int) {
+			assert.Equal(t, 1000, total)
+			progress = append(progress, done)
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{300, 600, 900, 1000}, progress)
+	assert.Equal(t, 1000, report.Count(StrategyHardlink))
+	for ix, m := range report {
+		assert.Equal(t, list[ix], m.Hardlink)
+	}
+	for _, link := range list {
+		assert.FileExists(t, link.Dest)
+	}
+}
+
+func TestApplyHardlinksDryRun(t *testing.T) {
+	dir, links := casFixture(t)
+	list := manyLinks(filepath.Join(dir, "scratch"), links[0].Src, 20)
+
+	report, err := ApplyHardlinks(context.Background(), list, ApplyOptions{DryRun: true, Strategy: StrategyCopy})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, report.Count(StrategyCopy))
+	assert.NoDirExists(t, filepath.Join(dir, "scratch"))
+}
+
+func TestApplyHardlinksErrors(t *testing.T) {
+	dir, links := casFixture(t)
+	list := manyLinks(filepath.Join(dir, "scratch"), links[0].Src, 100)
+	list[10].Src = filepath.Join(dir, "missing")
+	list[50].Src = filepath.Join(dir, "missing")
+
+	report, err := ApplyHardlinks(context.Background(), list, ApplyOptions{Workers: 4})
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, 98, len(report))
+	assert.FileExists(t, list[99].Dest)
+}
+
+func TestApplyHardlinksCancel(t *testing.T) {
+	dir, links := casFixture(t)
+	list := manyLinks(filepath.Join(dir, "scratch"), links[0].Src, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var linked int32
+	stubs := gostub.Stub(&linkFile, func(src, dest string) error {
+		if atomic.AddInt32(&linked, 1) == 100 {
+			cancel()
+		}
+		return os.Link(src, dest)
+	})
+	defer stubs.Reset()
+
+	report, err := ApplyHardlinks(ctx, list, ApplyOptions{Workers: 4})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, err.Error(), fmt.Sprintf("interrupted after %d of 1000 files", len(report)))
+	assert.GreaterOrEqual(t, len(report), 100)
+	assert.Less(t, len(report), 110)
+	assert.Equal(t, int(atomic.LoadInt32(&linked)), len(report))
+}
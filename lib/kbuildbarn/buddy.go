@@ -62,16 +62,23 @@ func WithNamedSetOfFiles() FilterOption {
 	}
 }
 
+// GenerateHardlinks returns the links to create for the outputs of invocation,
+// as selected by the options.
+//
+// Events are processed as they are fetched, so only the links, not the
+// events, are held in memory, even for very large invocations.
 func GenerateHardlinks(ctx context.Context, client *bes.BuildBuddyClient, baseName, invocation string, options ...FilterOption) (HardlinkList, error) {
-	result, err := client.GetBuildEvents(ctx, invocation)
-	if err != nil {
-		return nil, err
-	}
 	var parsedResults []HardlinkList
-	for _, event := range result {
+	err := client.ForEachEvent(ctx, invocation, func(event *bespb.BuildEvent) error {
 		for _, fOpt := range options {
-			parsedResults = append(parsedResults, fOpt(event, baseName, invocation))
+			if links := fOpt(event, baseName, invocation); len(links) > 0 {
+				parsedResults = append(parsedResults, links)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return MergeLists(parsedResults...), nil
 }
@@ -0,0 +1,218 @@
+package kbuildbarn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/System233/enkit/lib/flock"
+	"github.com/System233/enkit/lib/multierror"
+)
+
+// LockFileName is the sentinel file in each scratch/<invocation> directory,
+// locked by the processes using the outputs, and protecting them from Cleanup.
+const LockFileName = ".enkit-scratch.lock"
+
+// ScratchLock protects a scratch directory from Cleanup while its outputs are in use.
+//
+// The lock is held by the kernel on behalf of the process: if the process
+// crashes, the lock is released, and the directory can be cleaned up once
+// old enough. The sentinel file is left behind, recording the last use.
+type ScratchLock struct {
+	file *os.File
+}
+
+// LockScratch creates the scratch directory dir if necessary, and locks it.
+//
+// Any number of processes can lock the same directory. If Cleanup is
+// removing the directory, LockScratch waits for it to finish, and creates
+// the directory again.
+func LockScratch(dir string) (*ScratchLock, error) {
+	path := filepath.Join(dir, LockFileName)
+	for attempt := 0; attempt < 10; attempt++ {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock.Lock(file, flock.Shared, 0); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not lock %s: %w", path, err)
+		}
+
+		// Cleanup may have removed the directory while waiting for the lock.
+		opened, oerr := file.Stat()
+		found, ferr := os.Stat(path)
+		if oerr == nil && ferr == nil && os.SameFile(opened, found) {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return &ScratchLock{file: file}, nil
+		}
+		flock.Unlock(file)
+		file.Close()
+	}
+	return nil, fmt.Errorf("could not lock %s: removed by a concurrent cleanup too many times", path)
+}
+
+// Release releases the lock, recording the time of last use.
+func (sl *ScratchLock) Release() error {
+	now := time.Now()
+	os.Chtimes(sl.file.Name(), now, now)
+	flock.Unlock(sl.file)
+	return sl.file.Close()
+}
+
+// CleanupPolicy configures which scratch directories are removed by Cleanup.
+type CleanupPolicy struct {
+	// Remove the directories not used for longer than this, 0 to not remove directories based on age.
+	MaxAge time.Duration
+	// Remove the least recently used directories until their total size is below this many bytes,
+	// 0 to not remove directories based on size.
+	MaxSize int64
+	// Only report what would be removed.
+	DryRun bool
+
+	// Time to compute the age of directories from. time.Now() if zero.
+	Now time.Time
+}
+
+// ScratchDir is a scratch/<invocation> directory considered by Cleanup.
+type ScratchDir struct {
+	Path string
+	// Most recent time the directory was created or locked.
+	LastUsed time.Time
+	// Total size of the files in the directory. Hard links count in full,
+	// even if the data is also in the CAS.
+	Size int64
+}
+
+// CleanupResult summarizes what Cleanup did.
+type CleanupResult struct {
+	// Directories removed, or that would be removed in DryRun mode.
+	Removed []ScratchDir
+	// Directories that should have been removed, but were locked.
+	InUse []ScratchDir
+	// Directories within the policy.
+	Kept []ScratchDir
+	// Bytes freed by removing directories.
+	Freed int64
+}
+
+// Cleanup removes the scratch/<invocation> directories under baseDir, the
+// bb_clientd mount point, not used for longer than policy.MaxAge, or beyond
+// policy.MaxSize, least recently used first.
+//
+// Directories locked with LockScratch are never removed. Errors do not
+// stop the processing of other directories, and are returned as a multierror
+// together with the result.
+func Cleanup(baseDir string, policy CleanupPolicy) (*CleanupResult, error) {
+	now := policy.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	root := filepath.Join(baseDir, "scratch")
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return &CleanupResult{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	var dirs []ScratchDir
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir, err := statScratch(filepath.Join(root, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dirs = append(dirs, dir)
+		total += dir.Size
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].LastUsed.Before(dirs[j].LastUsed)
+	})
+
+	result := &CleanupResult{}
+	for _, dir := range dirs {
+		expired := policy.MaxAge > 0 && now.Sub(dir.LastUsed) > policy.MaxAge
+		oversize := policy.MaxSize > 0 && total > policy.MaxSize
+		if !expired && !oversize {
+			result.Kept = append(result.Kept, dir)
+			continue
+		}
+
+		removed, err := removeScratch(dir.Path, policy.DryRun)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !removed {
+			result.InUse = append(result.InUse, dir)
+			continue
+		}
+		result.Removed = append(result.Removed, dir)
+		result.Freed += dir.Size
+		total -= dir.Size
+	}
+	return result, multierror.New(errs)
+}
+
+// statScratch computes the size and last use of a scratch directory.
+func statScratch(path string) (ScratchDir, error) {
+	dir := ScratchDir{Path: path}
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case name == path || name == filepath.Join(path, LockFileName):
+			if info.ModTime().After(dir.LastUsed) {
+				dir.LastUsed = info.ModTime()
+			}
+		case info.Mode().IsRegular():
+			dir.Size += info.Size()
+		}
+		return nil
+	})
+	return dir, err
+}
+
+// removeScratch removes a scratch directory, unless locked. Returns true if removed.
+func removeScratch(path string, dryRun bool) (bool, error) {
+	// The sentinel is created if missing, so a concurrent LockScratch notices the removal.
+	// In dry run mode, nothing is created, to not change the last use of the directory.
+	flags := os.O_RDWR | os.O_CREATE
+	if dryRun {
+		flags = os.O_RDWR
+	}
+	file, err := os.OpenFile(filepath.Join(path, LockFileName), flags, 0666)
+	if dryRun && os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	locked, err := flock.TryLock(file, flock.Exclusive)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer flock.Unlock(file)
+
+	if dryRun {
+		return true, nil
+	}
+	return true, os.RemoveAll(path)
+}
@@ -0,0 +1,104 @@
+package kbuildbarn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scratchFixture creates a scratch directory with a file of size bytes, last used at lastUsed.
+func scratchFixture(t *testing.T, base, invocation string, size int, lastUsed time.Time) string {
+	dir := filepath.Join(base, "scratch", invocation)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bazel-bin"), 0777))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bazel-bin", "output"), make([]byte, size), 0644))
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "bazel-bin"), lastUsed, lastUsed))
+	assert.NoError(t, os.Chtimes(dir, lastUsed, lastUsed))
+	return dir
+}
+
+func paths(dirs []ScratchDir) []string {
+	result := []string{}
+	for _, dir := range dirs {
+		result = append(result, filepath.Base(dir.Path))
+	}
+	return result
+}
+
+func TestCleanupAge(t *testing.T) {
+	base := t.TempDir()
+	now := time.Now()
+	scratchFixture(t, base, "old", 10, now.Add(-48*time.Hour))
+	scratchFixture(t, base, "older", 10, now.Add(-72*time.Hour))
+	scratchFixture(t, base, "recent", 10, now.Add(-time.Hour))
+
+	result, err := Cleanup(base, CleanupPolicy{MaxAge: 24 * time.Hour, DryRun: true, Now: now})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"older", "old"}, paths(result.Removed))
+	assert.DirExists(t, filepath.Join(base, "scratch", "older"))
+	assert.NoFileExists(t, filepath.Join(base, "scratch", "older", LockFileName))
+
+	result, err = Cleanup(base, CleanupPolicy{MaxAge: 24 * time.Hour, Now: now})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"older", "old"}, paths(result.Removed))
+	assert.Equal(t, []string{"recent"}, paths(result.Kept))
+	assert.Equal(t, int64(20), result.Freed)
+	assert.NoDirExists(t, filepath.Join(base, "scratch", "older"))
+	assert.DirExists(t, filepath.Join(base, "scratch", "recent"))
+
+	// A missing scratch directory is not an error.
+	result, err = Cleanup(t.TempDir(), CleanupPolicy{MaxAge: time.Hour})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Removed)
+}
+
+func TestCleanupSize(t *testing.T) {
+	base := t.TempDir()
+	now := time.Now()
+	scratchFixture(t, base, "a", 100, now.Add(-3*time.Hour))
+	scratchFixture(t, base, "b", 100, now.Add(-2*time.Hour))
+	scratchFixture(t, base, "c", 100, now.Add(-1*time.Hour))
+
+	result, err := Cleanup(base, CleanupPolicy{MaxSize: 150, Now: now})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, paths(result.Removed))
+	assert.Equal(t, []string{"c"}, paths(result.Kept))
+}
+
+func TestCleanupLocked(t *testing.T) {
+	base := t.TempDir()
+	now := time.Now()
+	dir := scratchFixture(t, base, "locked", 10, now.Add(-72*time.Hour))
+	scratchFixture(t, base, "unlocked", 10, now.Add(-72*time.Hour))
+
+	lock, err := LockScratch(dir)
+	assert.NoError(t, err)
+	// Locking records the use of the directory.
+	result, err := Cleanup(base, CleanupPolicy{MaxAge: 24 * time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unlocked"}, paths(result.Removed))
+	assert.Equal(t, []string{"locked"}, paths(result.Kept))
+
+	// Old, but locked.
+	result, err = Cleanup(base, CleanupPolicy{MaxAge: 24 * time.Hour, Now: now.Add(48 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Removed)
+	assert.Equal(t, []string{"locked"}, paths(result.InUse))
+	assert.DirExists(t, dir)
+
+	// Once released, for example because the process crashed, it can be removed.
+	assert.NoError(t, lock.Release())
+	result, err = Cleanup(base, CleanupPolicy{MaxAge: 24 * time.Hour, Now: now.Add(48 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"locked"}, paths(result.Removed))
+	assert.NoDirExists(t, dir)
+
+	// Locking again recreates the directory.
+	lock, err = LockScratch(dir)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, LockFileName))
+	assert.NoError(t, lock.Release())
+}
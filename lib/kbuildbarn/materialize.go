@@ -0,0 +1,161 @@
+package kbuildbarn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Strategy is how a file in the CAS is materialized at its destination in the scratch directory.
+type Strategy string
+
+const (
+	// StrategyHardlink creates a hard link. Fails if the CAS and scratch directory are on different devices.
+	StrategyHardlink Strategy = "hardlink"
+	// StrategySymlink creates a symbolic link to the file in the CAS.
+	StrategySymlink Strategy = "symlink"
+	// StrategyCopy copies the file, verifying its size against the one in the digest.
+	StrategyCopy Strategy = "copy"
+	// StrategyAuto creates a hard link, falling back to a copy if the devices differ.
+	StrategyAuto Strategy = "auto"
+)
+
+// linkFile creates hard links, and can be stubbed out for unit tests.
+var linkFile = os.Link
+
+// Strategies lists all the valid strategies.
+var Strategies = []Strategy{StrategyAuto, StrategyHardlink, StrategySymlink, StrategyCopy}
+
+// ParseStrategy returns the Strategy with the specified name.
+func ParseStrategy(name string) (Strategy, error) {
+	for _, strategy := range Strategies {
+		if string(strategy) == strings.ToLower(strings.TrimSpace(name)) {
+			return strategy, nil
+		}
+	}
+	valid := []string{}
+	for _, strategy := range Strategies {
+		valid = append(valid, string(strategy))
+	}
+	return "", fmt.Errorf("invalid strategy %q - must be one of %s", name, strings.Join(valid, ", "))
+}
+
+// Materialized is a file materialized by HardlinkList.Apply.
+type Materialized struct {
+	*Hardlink
+	// Strategy actually used. With StrategyAuto, either StrategyHardlink or StrategyCopy.
+	Strategy Strategy
+	// True if Dest already existed, and was left untouched.
+	Existing bool
+}
+
+// Report lists the files materialized by HardlinkList.Apply.
+type Report []Materialized
+
+// Count returns the number of files materialized with strategy.
+func (r Report) Count(strategy Strategy) int {
+	count := 0
+	for _, m := range r {
+		if m.Strategy == strategy {
+			count++
+		}
+	}
+	return count
+}
+
+// Apply creates all the files in the list, with the specified strategy.
+//
+// Parent directories of Dest are created as needed, while files already
+// at Dest are left untouched. Errors do not stop the processing of the other
+// files, and are returned together as a multierror.
+//
+// The Report lists the files successfully materialized, and how, so callers
+// can warn when files had to be copied.
+//
+// Files are materialized one at a time, use ApplyHardlinks for large lists.
+func (l HardlinkList) Apply(strategy Strategy) (Report, error) {
+	return ApplyHardlinks(context.Background(), l, ApplyOptions{Strategy: strategy, Workers: 1})
+}
+
+// Apply materializes Src at Dest with the specified strategy.
+//
+// Returns the strategy actually used, and true if Dest already existed.
+func (h *Hardlink) Apply(strategy Strategy) (Strategy, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(h.Dest), 0777); err != nil {
+		return "", false, err
+	}
+
+	used := strategy
+	var err error
+	switch strategy {
+	case StrategyHardlink:
+		err = linkFile(h.Src, h.Dest)
+	case StrategySymlink:
+		err = os.Symlink(h.Src, h.Dest)
+	case StrategyCopy:
+		err = h.copy()
+	case StrategyAuto:
+		used = StrategyHardlink
+		err = linkFile(h.Src, h.Dest)
+		if errors.Is(err, syscall.EXDEV) {
+			used = StrategyCopy
+			err = h.copy()
+		}
+	default:
+		return "", false, fmt.Errorf("%s: invalid strategy %q", h.Dest, strategy)
+	}
+
+	if os.IsExist(err) {
+		return used, true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return used, false, nil
+}
+
+// copy copies Src into Dest, verifying that the size matches the one in the digest, if known.
+//
+// Data is copied into a temporary file renamed to Dest once complete and
+// verified, so an interrupted copy never leaves a truncated Dest behind.
+func (h *Hardlink) copy() error {
+	if _, err := os.Lstat(h.Dest); err == nil {
+		return &os.LinkError{Op: "copy", Old: h.Src, New: h.Dest, Err: os.ErrExist}
+	}
+
+	input, err := os.Open(h.Src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := h.Dest + ".tmp"
+	output, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(output, input)
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && h.Size > 0 && written != h.Size {
+		err = fmt.Errorf("copying %s to %s: copied %d bytes, but the digest has %d", h.Src, h.Dest, written, h.Size)
+	}
+	if err == nil {
+		err = os.Rename(tmp, h.Dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package kbuildbarn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/prashantv/gostub"
+	"github.com/stretchr/testify/assert"
+)
+
+// casFixture creates a file in a fake CAS, and returns a list linking it into a scratch directory.
+func casFixture(t *testing.T) (string, HardlinkList) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "cas", "digest0-11")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(src), 0777))
+	assert.NoError(t, ioutil.WriteFile(src, []byte("hello world"), 0444))
+	return dir, HardlinkList{
+		{Src: src, Dest: filepath.Join(dir, "scratch", "invocation", "one", "hello.txt"), Size: 11},
+		{Src: src, Dest: filepath.Join(dir, "scratch", "invocation", "two", "hello.txt"), Size: 11},
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	strategy, err := ParseStrategy("Copy")
+	assert.NoError(t, err)
+	assert.Equal(t, StrategyCopy, strategy)
+
+	_, err = ParseStrategy("reflink")
+	assert.Error(t, err)
+}
+
+func TestApply(t *testing.T) {
+	for _, strategy := range Strategies {
+		_, links := casFixture(t)
+		report, err := links.Apply(strategy)
+		assert.NoError(t, err, "%s", strategy)
+		assert.Equal(t, 2, len(report), "%s", strategy)
+
+		expected := strategy
+		if strategy == StrategyAuto {
+			expected = StrategyHardlink
+		}
+		assert.Equal(t, 2, report.Count(expected), "%s", strategy)
+
+		for _, link := range links {
+			data, err := ioutil.ReadFile(link.Dest)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world", string(data))
+
+			info, err := os.Lstat(link.Dest)
+			assert.NoError(t, err)
+			assert.Equal(t, strategy == StrategySymlink, info.Mode()&os.ModeSymlink != 0, "%s", strategy)
+		}
+
+		// Existing files are left untouched.
+		report, err = links.Apply(strategy)
+		assert.NoError(t, err, "%s", strategy)
+		assert.True(t, report[0].Existing, "%s", strategy)
+	}
+}
+
+func TestApplyAutoCrossDevice(t *testing.T) {
+	stubs := gostub.Stub(&linkFile, func(src, dest string) error {
+		return &os.LinkError{Op: "link", Old: src, New: dest, Err: syscall.EXDEV}
+	})
+	defer stubs.Reset()
+
+	_, links := casFixture(t)
+	_, err := links.Apply(StrategyHardlink)
+	assert.ErrorIs(t, err, syscall.EXDEV)
+
+	report, err := links.Apply(StrategyAuto)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Count(StrategyCopy))
+	data, err := ioutil.ReadFile(links[1].Dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+}
+
+func TestApplyCopySizeMismatch(t *testing.T) {
+	dir, links := casFixture(t)
+	links[0].Size = 42
+	report, err := links.Apply(StrategyCopy)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "copied 11 bytes, but the digest has 42")
+	assert.Equal(t, 1, len(report))
+
+	// Nothing is left behind by the failed copy.
+	files, err := filepath.Glob(filepath.Join(dir, "scratch", "invocation", "one", "*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -8,7 +8,7 @@ import (
 )
 
 const (
-	DefaultBBClientdCasFileTemplate     = "cas/blobs/sha256/file/%s-%s"
+	DefaultBBClientdCasFileTemplate     = "cas/blobs/%s/file/%s-%s"
 	DefaultBBClientdScratchFileTemplate = "scratch/%s/%s/%s"
 )
 
@@ -18,6 +18,8 @@ type HardlinkList []*Hardlink
 type Hardlink struct {
 	Src  string
 	Dest string
+	// Size of the file from its digest, used to verify copies. 0 if unknown.
+	Size int64
 }
 
 // FindBySrc will search through its children and find where the Src strictly matches, otherwise it will return nil.
@@ -67,15 +69,12 @@ func parsePathPrefix(prefix []string) string {
 func GenerateLinksForFiles(filesPb []*bespb.File, baseName, destPrefix, invocationPrefix string) HardlinkList {
 	var toReturn []*Hardlink
 	for _, f := range filesPb {
-		digest := f.Digest
-		size := strconv.Itoa(int(f.Length))
-		if digest == "" {
-			hash, psize, err := ParseByteStreamUrl(f.GetUri())
-			if err != nil {
-				continue
-			}
-			digest = hash
-			size = psize
+		// Only the uri carries the digest function, use digest and length for files without one.
+		hashFn, digest, size := "sha256", f.Digest, strconv.Itoa(int(f.Length))
+		if parsed, err := ParseByteStream(f.GetUri()); err == nil {
+			hashFn, digest, size = parsed.DigestFunction, parsed.Hash, parsed.Size
+		} else if digest == "" {
+			continue
 		}
 		if destPrefix == "" {
 			// TODO: This is where the bazel-bin prefix gets inserted; ideally this
@@ -85,13 +84,14 @@ func GenerateLinksForFiles(filesPb []*bespb.File, baseName, destPrefix, invocati
 		if destPrefix == "" {
 			destPrefix = "."
 		}
-		simSource := File(baseName, "sha256", digest, size,
+		simSource := File(baseName, hashFn, digest, size,
 			WithFileTemplate(DefaultBBClientdCasFileTemplate),
-			WithTemplateArgs(digest, size))
-		simDest := filepath.Clean(File(baseName, "sha256", digest, size,
+			WithTemplateArgs(hashFn, digest, size))
+		simDest := filepath.Clean(File(baseName, hashFn, digest, size,
 			WithFileTemplate(DefaultBBClientdScratchFileTemplate),
 			WithTemplateArgs(invocationPrefix, destPrefix, f.Name)))
-		toReturn = append(toReturn, &Hardlink{Dest: simDest, Src: simSource})
+		length, _ := strconv.ParseInt(size, 10, 64)
+		toReturn = append(toReturn, &Hardlink{Dest: simDest, Src: simSource, Size: length})
 	}
 	return toReturn
 }
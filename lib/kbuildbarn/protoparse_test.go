@@ -45,20 +45,63 @@ func TestParseMany(t *testing.T) {
 		&Hardlink{
 			Src:  "/foo/bar/cas/blobs/sha256/file/digest0-614",
 			Dest: "/foo/bar/scratch/invocation/subdir/simple.txt",
+			Size: 614,
 		},
 		&Hardlink{
 			Src:  "/foo/bar/cas/blobs/sha256/file/digest1-43",
 			Dest: "/foo/bar/scratch/invocation/subdir/hello/simple.txt",
+			Size: 43,
 		},
 		&Hardlink{
 			Src:  "/foo/bar/cas/blobs/sha256/file/digest2-888",
 			Dest: "/foo/bar/scratch/invocation/subdir/one/two/foo.bar",
+			Size: 888,
 		},
 		&Hardlink{
 			Src:  "/foo/bar/cas/blobs/sha256/file/digest3-777",
 			Dest: "/foo/bar/scratch/invocation/subdir/tarball.tar",
+			Size: 777,
 		},
 	}
 	r := GenerateLinksForFiles(many, baseName, "subdir", invocationPrefix)
 	assert.ElementsMatch(t, r, expected)
 }
+
+func TestParseUris(t *testing.T) {
+	files := []*bespb.File{
+		{
+			Name: "sha1.txt", File: &bespb.File_Uri{Uri: "bytestream://build.local/main/blobs/sha1/digest0/11"},
+		},
+		{
+			Name: "blake3.txt", File: &bespb.File_Uri{Uri: "bytestream://build.local/compressed-blobs/zstd/blake3/digest1/43"},
+			// The digest function is only in the uri, which takes precedence.
+			Digest: "digest1", Length: 43,
+		},
+		{
+			Name: "fallback.txt", File: &bespb.File_Uri{Uri: "file:///tmp/fallback.txt"},
+			Digest: "digest2", Length: 888,
+		},
+		{
+			Name: "skipped.txt", File: &bespb.File_Uri{Uri: "file:///tmp/skipped.txt"},
+		},
+	}
+	expected := HardlinkList{
+		&Hardlink{
+			Src:  "/foo/bar/cas/blobs/sha1/file/digest0-11",
+			Dest: "/foo/bar/scratch/invocation/sha1.txt",
+			Size: 11,
+		},
+		&Hardlink{
+			Src:  "/foo/bar/cas/blobs/blake3/file/digest1-43",
+			Dest: "/foo/bar/scratch/invocation/blake3.txt",
+			Size: 43,
+		},
+		&Hardlink{
+			Src:  "/foo/bar/cas/blobs/sha256/file/digest2-888",
+			Dest: "/foo/bar/scratch/invocation/fallback.txt",
+			Size: 888,
+		},
+	}
+	r := GenerateLinksForFiles(files, "/foo/bar", "", "invocation")
+	assert.Equal(t, expected, r)
+}
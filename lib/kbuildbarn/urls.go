@@ -11,14 +11,56 @@ import (
 	"strings"
 )
 
-// ParseByteStreamUrl retrieves  the CAS id and bytes of an action based on the input url.
-// For example, bytestream://build.local.enfabrica.net:8000/blobs/a9a664559b4d29ecb70613fad33acfb287f2fa378178e131feaaebb5dafa231a/465
-// should return (a9a664559b4d29ecb70613fad33acfb287f2fa378178e131feaaebb5dafa231a, 465, nil)
-// which is a BuildBarnParams.Hash, BuildBarnParams.Size, error.Error
-func ParseByteStreamUrl(byteStream string) (string, string, error) {
+// ByteStream is a blob referenced by a bytestream URL.
+type ByteStream struct {
+	// Name of the remote execution instance, empty for the default instance.
+	InstanceName string
+	// Digest function, like sha256, sha1 or blake3, as used in the CAS paths.
+	DigestFunction string
+	// Hash and size of the blob. For compressed blobs, of the uncompressed data.
+	Hash string
+	Size string
+	// Compressor of a compressed-blobs URL, like zstd. Empty if the blob is not compressed.
+	Compressor string
+}
+
+// DigestFunctions lists the digest functions of the remote execution API, as they appear in URLs.
+var DigestFunctions = []string{"sha256", "sha1", "md5", "vso", "sha384", "sha512", "murmur3", "sha256tree", "blake3"}
+
+// digestFunctionByLength maps the length of a hex hash to the digest function
+// implied when a URL has none, as defined by the remote execution API.
+var digestFunctionByLength = map[int]string{
+	32:  "md5",
+	40:  "sha1",
+	64:  "sha256",
+	96:  "sha384",
+	128: "sha512",
+}
+
+func isDigestFunction(name string) bool {
+	for _, fn := range DigestFunctions {
+		if fn == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseByteStream parses a bytestream URL, as found in the uri of the files of a build event.
+//
+// All the resource names of the remote execution API are supported:
+//
+//	bytestream://host/{instance_name}/blobs/{hash}/{size}
+//	bytestream://host/{instance_name}/blobs/{digest_function}/{hash}/{size}
+//	bytestream://host/{instance_name}/compressed-blobs/{compressor}/{hash}/{size}
+//	bytestream://host/{instance_name}/compressed-blobs/{compressor}/{digest_function}/{hash}/{size}
+//
+// The instance name is optional, and may contain slashes. Without a digest
+// function, it is inferred from the length of the hash, defaulting to sha256.
+func ParseByteStream(byteStream string) (*ByteStream, error) {
 	u, err := url.Parse(byteStream)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	// BUG(INFRA-1836): When bazel is talking to the BES endpoint via UNIX domain
@@ -35,11 +77,62 @@ func ParseByteStreamUrl(byteStream string) (string, string, error) {
 		u.Path = u.Path[idx+len(sockSuffix):]
 	}
 
-	splitUrl := strings.Split(u.Path, "/")
-	if len(splitUrl) != 4 {
-		return "", "", fmt.Errorf("ParseByteStreamUrl() bytestream url is not well formed %s", byteStream)
+	malformed := fmt.Errorf("ParseByteStream() bytestream url is not well formed %s", byteStream)
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	for ix, part := range parts {
+		if part != "blobs" && part != "compressed-blobs" {
+			continue
+		}
+
+		// Instance names never have empty segments, those are leftovers of an unrecognized path.
+		for _, segment := range parts[:ix] {
+			if segment == "" {
+				return nil, malformed
+			}
+		}
+
+		result := &ByteStream{InstanceName: strings.Join(parts[:ix], "/")}
+		rest := parts[ix+1:]
+		if part == "compressed-blobs" {
+			if len(rest) < 1 || rest[0] == "" {
+				return nil, malformed
+			}
+			result.Compressor, rest = rest[0], rest[1:]
+		}
+		// Hash and size are otherwise opaque, but a hash is never the name of a digest function.
+		switch {
+		case len(rest) == 3 && isDigestFunction(rest[0]):
+			result.DigestFunction, rest = rest[0], rest[1:]
+		case len(rest) != 2 || isDigestFunction(rest[0]):
+			return nil, malformed
+		}
+		result.Hash, result.Size = rest[0], rest[1]
+		if result.Hash == "" || result.Size == "" {
+			return nil, malformed
+		}
+		if result.DigestFunction == "" {
+			result.DigestFunction = digestFunctionByLength[len(result.Hash)]
+		}
+		if result.DigestFunction == "" {
+			result.DigestFunction = "sha256"
+		}
+		return result, nil
+	}
+	return nil, malformed
+}
+
+// ParseByteStreamUrl retrieves  the CAS id and bytes of an action based on the input url.
+// For example, bytestream://build.local.enfabrica.net:8000/blobs/a9a664559b4d29ecb70613fad33acfb287f2fa378178e131feaaebb5dafa231a/465
+// should return (a9a664559b4d29ecb70613fad33acfb287f2fa378178e131feaaebb5dafa231a, 465, nil)
+// which is a BuildBarnParams.Hash, BuildBarnParams.Size, error.Error
+//
+// Use ParseByteStream to also know the digest function, and instance name.
+func ParseByteStreamUrl(byteStream string) (string, string, error) {
+	parsed, err := ParseByteStream(byteStream)
+	if err != nil {
+		return "", "", err
 	}
-	return splitUrl[2], splitUrl[3], nil
+	return parsed.Hash, parsed.Size, nil
 }
 
 func performRequest(client *http.Client, url string) (io.ReadCloser, error) {
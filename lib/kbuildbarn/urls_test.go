@@ -69,6 +69,74 @@ func TestByteStreamUrl(t *testing.T) {
 	}
 }
 
+func TestParseByteStream(t *testing.T) {
+	const sha1 = "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+	const sha256 = "a9a664559b4d29ecb70613fad33acfb287f2fa378178e131feaaebb5dafa231a"
+	testCases := []struct {
+		desc    string
+		url     string
+		want    *ByteStream
+		wantErr string
+	}{
+		{
+			desc: "default instance, digest function from hash length",
+			url:  "bytestream://build.local:8000/blobs/" + sha256 + "/465",
+			want: &ByteStream{DigestFunction: "sha256", Hash: sha256, Size: "465"},
+		},
+		{
+			desc: "sha1 hash without digest function",
+			url:  "bytestream://build.local:8000/blobs/" + sha1 + "/11",
+			want: &ByteStream{DigestFunction: "sha1", Hash: sha1, Size: "11"},
+		},
+		{
+			desc: "instance name with slashes and digest function",
+			url:  "bytestream://build.local:8000/main/linux/blobs/blake3/" + sha256 + "/465",
+			want: &ByteStream{InstanceName: "main/linux", DigestFunction: "blake3", Hash: sha256, Size: "465"},
+		},
+		{
+			desc: "compressed blobs",
+			url:  "bytestream://build.local:8000/compressed-blobs/zstd/" + sha256 + "/465",
+			want: &ByteStream{DigestFunction: "sha256", Hash: sha256, Size: "465", Compressor: "zstd"},
+		},
+		{
+			desc: "compressed blobs with instance name and digest function",
+			url:  "bytestream://build.local:8000/main/compressed-blobs/zstd/sha1/" + sha1 + "/11",
+			want: &ByteStream{InstanceName: "main", DigestFunction: "sha1", Hash: sha1, Size: "11", Compressor: "zstd"},
+		},
+		{
+			desc: "unix socket address with .sock suffix",
+			url:  "bytestream://////builder/home/.cache/buildbarn.sock/main/compressed-blobs/zstd/" + sha256 + "/1203284",
+			want: &ByteStream{InstanceName: "main", DigestFunction: "sha256", Hash: sha256, Size: "1203284", Compressor: "zstd"},
+		},
+		{
+			desc:    "unknown digest function",
+			url:     "bytestream://build.local:8000/blobs/crc32/" + sha256 + "/465",
+			wantErr: "not well formed",
+		},
+		{
+			desc:    "compressed blobs without compressor",
+			url:     "bytestream://build.local:8000/compressed-blobs/" + sha256 + "/465",
+			wantErr: "not well formed",
+		},
+		{
+			desc:    "missing size",
+			url:     "bytestream://build.local:8000/blobs/sha256/" + sha256,
+			wantErr: "not well formed",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, gotErr := ParseByteStream(tc.url)
+
+			errdiff.Check(t, gotErr, tc.wantErr)
+			if gotErr != nil {
+				return
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
 func TestDefaultUrlGeneration(t *testing.T) {
 	exampleUrl := "bytestream://build.local.enfabrica.net:8000/blobs/foo/bar"
 	hash, size, err := ParseByteStreamUrl(exampleUrl)
@@ -4,8 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/System233/enkit/lib/cache"
-	"github.com/System233/enkit/lib/config/marshal"
-	"path/filepath"
+	"github.com/System233/enkit/lib/config"
+	"github.com/System233/enkit/lib/config/directory"
 )
 
 const (
@@ -25,8 +25,12 @@ func (agent *SSHAgent) LoadFromCache(store cache.Store) error {
 	if sshEnkitCache == "" {
 		return SSHAgentNoCache
 	}
+	dir, err := directory.OpenDir(sshEnkitCache)
+	if err != nil {
+		return fmt.Errorf("error opening ssh agent cache: %w", err)
+	}
 	var state SSHAgentState
-	if err := marshal.UnmarshalFile(filepath.Join(sshEnkitCache, SSHCacheFile), &state); err != nil {
+	if _, err := config.NewMulti(dir).Unmarshal(SSHCacheFile, &state); err != nil {
 		return fmt.Errorf("error deserializing ssh agent cache: %w", err)
 	}
 	agent.State = state // Ensure the whole state is set/overwritten.
@@ -39,7 +43,13 @@ func WriteAgentToCache(store cache.Store, agent *SSHAgent) error {
 		return fmt.Errorf("error fetching cache: %w", err)
 	}
 	defer store.Rollback(sshEnkitCache)
-	err = marshal.MarshalFile(filepath.Join(sshEnkitCache, SSHCacheFile), &agent.State)
+	dir, err := directory.OpenDir(sshEnkitCache)
+	if err != nil {
+		return fmt.Errorf("error opening cache: %w", err)
+	}
+	// Written atomically, holding the lock on the file: concurrent enkit
+	// commands never see a partially written state.
+	err = config.NewMulti(dir).Marshal(SSHCacheFile, &agent.State)
 	if err != nil {
 		return fmt.Errorf("error writing to cache: %w", err)
 	}
@@ -2,13 +2,18 @@ package kcerts
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"github.com/System233/enkit/lib/kcerts/ked25519"
+	"github.com/System233/enkit/lib/kflags"
 	"golang.org/x/crypto/ssh"
+	"strings"
 )
 
 func NewSigner(key PrivateKey) (ssh.Signer, error) {
@@ -67,6 +72,38 @@ func (r rsaProvider) SSHPemEncode() ([]byte, error) {
 	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}), nil
 }
 
+// ecdsaProvider wraps utility ssh functions around for PrivateKey, for keys
+// on the NIST P-256, P-384 and P-521 curves.
+type ecdsaProvider struct {
+	p *ecdsa.PrivateKey
+}
+
+func (e ecdsaProvider) Signer() crypto.Signer {
+	return e.p
+}
+
+func (e ecdsaProvider) SigningAlgo() string {
+	switch e.p.Curve {
+	case elliptic.P384():
+		return ssh.KeyAlgoECDSA384
+	case elliptic.P521():
+		return ssh.KeyAlgoECDSA521
+	}
+	return ssh.KeyAlgoECDSA256
+}
+
+func (e ecdsaProvider) Raw() interface{} {
+	return e.p
+}
+
+func (e ecdsaProvider) SSHPemEncode() ([]byte, error) {
+	b, err := x509.MarshalECPrivateKey(e.p)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+}
+
 // KeyGenerator is A function capable of generating a key pair.
 //
 // The function is expected to return a Public Key, a Private Key,
@@ -78,11 +115,92 @@ type SSHKeyGenerator func() (ssh.PublicKey, PrivateKey, error)
 var (
 	_               SSHKeyGenerator = GenerateRSA
 	_               SSHKeyGenerator = GenerateED25519
+	_               SSHKeyGenerator = GenerateECDSA
 	GenerateDefault SSHKeyGenerator = GenerateED25519
 )
 
+// KeyType identifies an algorithm to generate keys with.
+type KeyType string
+
+const (
+	KeyTypeED25519 KeyType = "ed25519"
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeECDSA   KeyType = "ecdsa"
+)
+
+// KeyTypes lists the key types supported by GenerateKey.
+var KeyTypes = []KeyType{KeyTypeED25519, KeyTypeRSA, KeyTypeECDSA}
+
+const (
+	// DefaultRSABits is the size of RSA keys generated when no size is specified.
+	DefaultRSABits = 4096
+	// MinRSABits is the smallest RSA key accepted by GenerateKey.
+	MinRSABits = 2048
+	// DefaultECDSABits selects the P-256 curve when no size is specified.
+	DefaultECDSABits = 256
+)
+
+// GenerateKey generates a key pair of the specified type.
+//
+// bits is the size of the key: the modulus size for RSA keys (4096 if 0),
+// the curve size for ECDSA keys - one of 256, 384 or 521 (256 if 0). It must
+// be 0 for ED25519 keys, which have a fixed size.
+//
+// Older network appliances often only accept RSA or ECDSA keys, prefer ED25519 otherwise.
+func GenerateKey(keyType KeyType, bits int) (ssh.PublicKey, PrivateKey, error) {
+	generator, err := KeyGenerator(keyType, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	return generator()
+}
+
+// KeyGenerator returns an SSHKeyGenerator for keys of the specified type and size.
+//
+// See GenerateKey for the meaning of the parameters. Errors are returned
+// immediately, before any key is generated.
+func KeyGenerator(keyType KeyType, bits int) (SSHKeyGenerator, error) {
+	switch KeyType(strings.ToLower(string(keyType))) {
+	case KeyTypeED25519, "":
+		if bits != 0 && bits != 256 {
+			return nil, fmt.Errorf("ed25519 keys have a fixed size - %d bits requested", bits)
+		}
+		return GenerateED25519, nil
+	case KeyTypeRSA:
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		if bits < MinRSABits {
+			return nil, fmt.Errorf("rsa keys must be at least %d bits - %d bits requested", MinRSABits, bits)
+		}
+		return func() (ssh.PublicKey, PrivateKey, error) {
+			return generateRSA(bits)
+		}, nil
+	case KeyTypeECDSA:
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("ecdsa keys must be 256, 384 or 521 bits - %d bits requested", bits)
+		}
+		return func() (ssh.PublicKey, PrivateKey, error) {
+			return generateECDSA(curve)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown key type %q - supported types are %v", keyType, KeyTypes)
+}
+
 func GenerateRSA() (ssh.PublicKey, PrivateKey, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	return generateRSA(DefaultRSABits)
+}
+
+func generateRSA(bits int) (ssh.PublicKey, PrivateKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -105,6 +223,23 @@ func GenerateED25519() (ssh.PublicKey, PrivateKey, error) {
 	return sshPub, ed25519Provider{rawKey: priv}, err
 }
 
+// GenerateECDSA generates a key on the NIST P-256 curve.
+func GenerateECDSA() (ssh.PublicKey, PrivateKey, error) {
+	return generateECDSA(elliptic.P256())
+}
+
+func generateECDSA(curve elliptic.Curve) (ssh.PublicKey, PrivateKey, error) {
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return publicKey, ecdsaProvider{p: privateKey}, err
+}
+
 func FromEC25519(key ed25519.PrivateKey) PrivateKey {
 	return ed25519Provider{
 		rawKey: key,
@@ -116,3 +251,38 @@ func FromRSA(key *rsa.PrivateKey) PrivateKey {
 		p: key,
 	}
 }
+
+func FromECDSA(key *ecdsa.PrivateKey) PrivateKey {
+	return ecdsaProvider{
+		p: key,
+	}
+}
+
+// KeyFlags configures the type of keys to generate from the command line.
+type KeyFlags struct {
+	Type string
+	Bits int
+}
+
+func DefaultKeyFlags() *KeyFlags {
+	return &KeyFlags{
+		Type: string(KeyTypeED25519),
+	}
+}
+
+func (f *KeyFlags) Register(set kflags.FlagSet, prefix string) *KeyFlags {
+	set.StringVar(&f.Type, prefix+"key-type", f.Type,
+		fmt.Sprintf("Type of key to generate, one of %v. Use rsa or ecdsa only for systems not accepting ed25519 keys", KeyTypes))
+	set.IntVar(&f.Bits, prefix+"key-bits", f.Bits,
+		"Size of the key to generate - 0 for the default size of the key type")
+	return f
+}
+
+// Generator returns the SSHKeyGenerator configured by the flags.
+func (f *KeyFlags) Generator() (SSHKeyGenerator, error) {
+	generator, err := KeyGenerator(KeyType(f.Type), f.Bits)
+	if err != nil {
+		return nil, kflags.NewUsageErrorf("invalid key-type or key-bits - %w", err)
+	}
+	return generator, nil
+}
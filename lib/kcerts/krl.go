@@ -0,0 +1,241 @@
+package kcerts
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Constants from the OpenSSH PROTOCOL.krl specification.
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.krl
+const (
+	krlMagic         = uint64(0x5353484b524c0a00)
+	krlFormatVersion = uint32(1)
+
+	krlSectionCertificates = byte(1)
+	krlCertSerialList      = byte(0x20)
+	krlCertKeyId           = byte(0x23)
+)
+
+// KRLCertificates is the set of certificates revoked for a specific CA.
+type KRLCertificates struct {
+	// CA that signed the revoked certificates. Must be set.
+	CA ssh.PublicKey
+	// Serial numbers of the revoked certificates.
+	Serials []uint64
+	// Key IDs of the revoked certificates.
+	KeyIds []string
+}
+
+// KRL is an OpenSSH Key Revocation List, usable with the RevokedKeys
+// directive of sshd, or with `ssh-keygen -Q`.
+type KRL struct {
+	// Version is an increasing number, to allow clients to know which KRL is the most recent.
+	Version   uint64
+	Generated time.Time
+	Comment   string
+
+	Certificates []KRLCertificates
+}
+
+// WithSerial returns a CertMod setting the serial number of a certificate.
+//
+// Serial numbers allow certificates to be revoked via a KRL.
+func WithSerial(serial uint64) CertMod {
+	return func(cert *ssh.Certificate) *ssh.Certificate {
+		cert.Serial = serial
+		return cert
+	}
+}
+
+func appendString(buffer []byte, data []byte) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(data)))
+	return append(buffer, data...)
+}
+
+// Marshal returns the KRL in the binary format understood by OpenSSH.
+func (k *KRL) Marshal() ([]byte, error) {
+	var out []byte
+	out = binary.BigEndian.AppendUint64(out, krlMagic)
+	out = binary.BigEndian.AppendUint32(out, krlFormatVersion)
+	out = binary.BigEndian.AppendUint64(out, k.Version)
+	out = binary.BigEndian.AppendUint64(out, uint64(k.Generated.Unix()))
+	out = binary.BigEndian.AppendUint64(out, 0) // flags
+	out = appendString(out, nil)                // reserved
+	out = appendString(out, []byte(k.Comment))
+
+	for _, certs := range k.Certificates {
+		if certs.CA == nil {
+			return nil, fmt.Errorf("invalid KRL - a CA must be specified for certificate revocations")
+		}
+
+		var section []byte
+		section = appendString(section, certs.CA.Marshal())
+		section = appendString(section, nil) // reserved
+
+		if len(certs.Serials) > 0 {
+			serials := append([]uint64{}, certs.Serials...)
+			sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+
+			var list []byte
+			for ix, serial := range serials {
+				if ix > 0 && serials[ix-1] == serial {
+					continue
+				}
+				list = binary.BigEndian.AppendUint64(list, serial)
+			}
+			section = append(section, krlCertSerialList)
+			section = appendString(section, list)
+		}
+
+		if len(certs.KeyIds) > 0 {
+			var list []byte
+			for _, id := range certs.KeyIds {
+				list = appendString(list, []byte(id))
+			}
+			section = append(section, krlCertKeyId)
+			section = appendString(section, list)
+		}
+
+		out = append(out, krlSectionCertificates)
+		out = appendString(out, section)
+	}
+	return out, nil
+}
+
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) uint64() uint64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.err = fmt.Errorf("truncated KRL")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *krlReader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = fmt.Errorf("truncated KRL")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *krlReader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = fmt.Errorf("truncated KRL")
+		return 0
+	}
+	v := r.data[0]
+	r.data = r.data[1:]
+	return v
+}
+
+func (r *krlReader) string() []byte {
+	l := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < l {
+		r.err = fmt.Errorf("truncated KRL")
+		return nil
+	}
+	v := r.data[:l]
+	r.data = r.data[l:]
+	return v
+}
+
+// ParseKRL parses a KRL in the OpenSSH binary format.
+//
+// Only the sections generated by Marshal are understood, other sections cause an error.
+func ParseKRL(data []byte) (*KRL, error) {
+	r := &krlReader{data: data}
+	if magic := r.uint64(); r.err == nil && magic != krlMagic {
+		return nil, fmt.Errorf("invalid KRL - bad magic %x", magic)
+	}
+	if version := r.uint32(); r.err == nil && version != krlFormatVersion {
+		return nil, fmt.Errorf("invalid KRL - unsupported format version %d", version)
+	}
+
+	krl := &KRL{}
+	krl.Version = r.uint64()
+	krl.Generated = time.Unix(int64(r.uint64()), 0)
+	r.uint64() // flags
+	r.string() // reserved
+	krl.Comment = string(r.string())
+
+	for r.err == nil && len(r.data) > 0 {
+		kind := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		if kind != krlSectionCertificates {
+			return nil, fmt.Errorf("invalid KRL - unsupported section type %d", kind)
+		}
+
+		certs := KRLCertificates{}
+		ca, err := ssh.ParsePublicKey(section.string())
+		if err != nil {
+			return nil, fmt.Errorf("invalid KRL - could not parse CA - %w", err)
+		}
+		certs.CA = ca
+		section.string() // reserved
+
+		for section.err == nil && len(section.data) > 0 {
+			subkind := section.byte()
+			sub := &krlReader{data: section.string()}
+			switch subkind {
+			case krlCertSerialList:
+				for sub.err == nil && len(sub.data) > 0 {
+					certs.Serials = append(certs.Serials, sub.uint64())
+				}
+			case krlCertKeyId:
+				for sub.err == nil && len(sub.data) > 0 {
+					certs.KeyIds = append(certs.KeyIds, string(sub.string()))
+				}
+			default:
+				return nil, fmt.Errorf("invalid KRL - unsupported certificate section type %d", subkind)
+			}
+			if sub.err != nil {
+				return nil, sub.err
+			}
+		}
+		if section.err != nil {
+			return nil, section.err
+		}
+		krl.Certificates = append(krl.Certificates, certs)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return krl, nil
+}
+
+// IsRevoked returns true if the certificate is revoked by the KRL.
+func (k *KRL) IsRevoked(cert *ssh.Certificate) bool {
+	ca := string(cert.SignatureKey.Marshal())
+	for _, certs := range k.Certificates {
+		if string(certs.CA.Marshal()) != ca {
+			continue
+		}
+		for _, serial := range certs.Serials {
+			if serial == cert.Serial {
+				return true
+			}
+		}
+		for _, id := range certs.KeyIds {
+			if id == cert.KeyId {
+				return true
+			}
+		}
+	}
+	return false
+}
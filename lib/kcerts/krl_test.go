@@ -0,0 +1,89 @@
+package kcerts
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func signedCert(t *testing.T, ca PrivateKey, serial uint64) *ssh.Certificate {
+	pub, _, err := GenerateED25519()
+	assert.Nil(t, err)
+	cert, err := SignPublicKey(ca, ssh.UserCert, []string{"emma"}, time.Hour, pub, WithSerial(serial))
+	assert.Nil(t, err)
+	assert.Equal(t, serial, cert.Serial)
+	return cert
+}
+
+func TestKRLRoundTrip(t *testing.T) {
+	caPub, caPriv, err := GenerateED25519()
+	assert.Nil(t, err)
+
+	krl := &KRL{
+		Version:   42,
+		Generated: time.Unix(1600000000, 0),
+		Comment:   "test krl",
+		Certificates: []KRLCertificates{{
+			CA:      caPub,
+			Serials: []uint64{7, 3, 3, 1 << 40},
+			KeyIds:  []string{"emma"},
+		}},
+	}
+	data, err := krl.Marshal()
+	assert.Nil(t, err)
+
+	parsed, err := ParseKRL(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), parsed.Version)
+	assert.Equal(t, "test krl", parsed.Comment)
+	assert.Equal(t, krl.Generated, parsed.Generated)
+	assert.Equal(t, 1, len(parsed.Certificates))
+	assert.Equal(t, []uint64{3, 7, 1 << 40}, parsed.Certificates[0].Serials)
+	assert.Equal(t, []string{"emma"}, parsed.Certificates[0].KeyIds)
+
+	assert.True(t, parsed.IsRevoked(signedCert(t, caPriv, 7)))
+	assert.False(t, parsed.IsRevoked(signedCert(t, caPriv, 8)))
+
+	_, otherCA, err := GenerateED25519()
+	assert.Nil(t, err)
+	assert.False(t, parsed.IsRevoked(signedCert(t, otherCA, 7)))
+
+	_, err = ParseKRL(data[:len(data)-3])
+	assert.NotNil(t, err)
+
+	_, err = (&KRL{Certificates: []KRLCertificates{{Serials: []uint64{1}}}}).Marshal()
+	assert.NotNil(t, err)
+}
+
+// TestKRLOpenSSH verifies that the generated KRL is understood by ssh-keygen, if available.
+func TestKRLOpenSSH(t *testing.T) {
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not available")
+	}
+
+	caPub, caPriv, err := GenerateED25519()
+	assert.Nil(t, err)
+	revoked := signedCert(t, caPriv, 1234)
+	valid := signedCert(t, caPriv, 1235)
+
+	data, err := (&KRL{Version: 1, Generated: time.Now(), Certificates: []KRLCertificates{{CA: caPub, Serials: []uint64{1234}}}}).Marshal()
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	krlPath := filepath.Join(dir, "krl")
+	assert.Nil(t, os.WriteFile(krlPath, data, 0644))
+
+	check := func(cert *ssh.Certificate) error {
+		certPath := filepath.Join(dir, "cert.pub")
+		assert.Nil(t, os.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644))
+		return exec.Command(keygen, "-Q", "-f", krlPath, certPath).Run()
+	}
+	assert.NotNil(t, check(revoked))
+	assert.Nil(t, check(valid))
+}
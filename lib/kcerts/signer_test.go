@@ -9,7 +9,7 @@ import (
 	"time"
 )
 
-var tableTestTypes = []SSHKeyGenerator{GenerateED25519, GenerateRSA}
+var tableTestTypes = []SSHKeyGenerator{GenerateED25519, GenerateRSA, GenerateECDSA}
 
 // TestSha256Signer_PublicKey tests all possible combinations of supported PrivateKey signing ssh.PublicKeys
 // It will sign the following ssh certs with the custom algos by their providers
@@ -43,3 +43,72 @@ func TestPemEncodeKeys(t *testing.T) {
 		assert.Nilf(t, err, "failed demarshalling private key for type %s", reflect.TypeOf(priv))
 	}
 }
+
+// TestGenerateKey round trips all the key types and sizes supported through PEM encoding and certificate signing.
+func TestGenerateKey(t *testing.T) {
+	for _, tc := range []struct {
+		keyType KeyType
+		bits    int
+		algo    string
+	}{
+		{KeyTypeED25519, 0, ssh.KeyAlgoED25519},
+		{KeyTypeRSA, 0, ssh.KeyAlgoRSA},
+		{KeyTypeRSA, 2048, ssh.KeyAlgoRSA},
+		{KeyTypeECDSA, 0, ssh.KeyAlgoECDSA256},
+		{KeyTypeECDSA, 384, ssh.KeyAlgoECDSA384},
+		{KeyTypeECDSA, 521, ssh.KeyAlgoECDSA521},
+	} {
+		t.Run(fmt.Sprintf("%s-%d", tc.keyType, tc.bits), func(t *testing.T) {
+			pub, priv, err := GenerateKey(tc.keyType, tc.bits)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.algo, pub.Type())
+
+			pemBytes, err := priv.SSHPemEncode()
+			assert.NoError(t, err)
+			parsed, err := ssh.ParsePrivateKey(pemBytes)
+			assert.NoError(t, err)
+			assert.Equal(t, pub.Marshal(), parsed.PublicKey().Marshal())
+
+			// Use the key both as a CA, and as the key certified.
+			for _, other := range tableTestTypes {
+				otherPub, otherPriv, err := other()
+				assert.NoError(t, err)
+
+				cert, err := SignPublicKey(priv, ssh.UserCert, []string{"user"}, time.Hour, otherPub)
+				assert.NoError(t, err)
+				checker := ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return string(auth.Marshal()) == string(pub.Marshal())
+				}}
+				assert.NoError(t, checker.CheckCert("user", cert))
+
+				cert, err = SignPublicKey(otherPriv, ssh.HostCert, []string{"host"}, time.Hour, pub)
+				assert.NoError(t, err)
+				assert.Equal(t, pub.Marshal(), cert.Key.Marshal())
+			}
+		})
+	}
+}
+
+func TestGenerateKeyInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		keyType KeyType
+		bits    int
+	}{
+		{KeyTypeED25519, 1024},
+		{KeyTypeRSA, 1024},
+		{KeyTypeECDSA, 128},
+		{"dsa", 0},
+	} {
+		_, err := KeyGenerator(tc.keyType, tc.bits)
+		assert.Error(t, err, "type %s bits %d", tc.keyType, tc.bits)
+	}
+
+	flags := DefaultKeyFlags()
+	flags.Type = "ECDSA"
+	flags.Bits = 384
+	generator, err := flags.Generator()
+	assert.NoError(t, err)
+	pub, _, err := generator()
+	assert.NoError(t, err)
+	assert.Equal(t, ssh.KeyAlgoECDSA384, pub.Type())
+}
@@ -14,6 +14,7 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"io/ioutil"
+	"math"
 	mathrand "math/rand"
 	"os"
 	"os/exec"
@@ -81,11 +82,25 @@ func AddSSHCAToClient(publicKey ssh.PublicKey, hosts []string, sshDir string) er
 	return nil
 }
 
+// AgentMode indicates how the ssh-agent in use was found.
+type AgentMode string
+
+const (
+	// An agent reached through the enkit socket in the config directory.
+	// Either started by enkit, or an agent found in the environment the socket links to.
+	AgentModeEnkit AgentMode = "enkit"
+	// An agent of the user, like gnome-keyring or a systemd managed ssh-agent,
+	// found in the environment and used directly. enkit never kills it.
+	AgentModeUser AgentMode = "user"
+)
+
 // SSHAgentState is the struct marsheld/unmarshaled to/from disk to maintain
 // state about an existing ssh-agent.
 type SSHAgentState struct {
 	PID    int    `json:"pid"`
 	Socket string `json:"sock"`
+	// Empty in states written by older versions, equivalent to AgentModeEnkit.
+	Mode AgentMode `json:"mode,omitempty"`
 }
 
 // SSHAgent is a wrapper around golang.org/x/crypto/ssh/agent to ease the
@@ -112,6 +127,10 @@ type SSHAgent struct {
 
 	// The logger to use.
 	log logger.Logger
+
+	// Use a working agent of the user found in the environment directly,
+	// rather than linking it from the enkit socket.
+	useExisting bool
 }
 
 type SSHAgentModifier func(s *SSHAgent) error
@@ -128,9 +147,10 @@ func (m SSHAgentModifiers) Apply(a *SSHAgent) error {
 }
 
 type SSHAgentFlags struct {
-	Timeout   time.Duration
-	AgentPath string
-	AgentArgs []string
+	Timeout     time.Duration
+	AgentPath   string
+	AgentArgs   []string
+	UseExisting bool
 }
 
 const kDefaultTimeout = 10 * time.Second
@@ -150,6 +170,8 @@ func (f *SSHAgentFlags) Register(set kflags.FlagSet, prefix string) *SSHAgentFla
 		"Command to use to start an ssh agent")
 	set.StringArrayVar(&f.AgentArgs, prefix+"ssh-agent-flags", f.AgentArgs,
 		"Command line options to pass to the ssh agent")
+	set.BoolVar(&f.UseExisting, prefix+"ssh-agent-use-existing", f.UseExisting,
+		"If SSH_AUTH_SOCK points to a working agent, like gnome-keyring or a systemd managed ssh-agent, use it directly instead of the enkit agent")
 	return f
 }
 
@@ -168,6 +190,19 @@ func WithAgentPath(path string, args []string) SSHAgentModifier {
 	}
 }
 
+// WithExistingAgent configures the SSHAgent to use the agent found in the environment as is, if it works.
+//
+// By default, PrepareSSHAgent links the agent found in the environment from
+// the enkit socket, and exports the enkit socket. With this option, the
+// socket in the environment is used instead, and left untouched. An
+// enkit-managed agent is only created if no working agent is found.
+func WithExistingAgent(use bool) SSHAgentModifier {
+	return func(a *SSHAgent) error {
+		a.useExisting = use
+		return nil
+	}
+}
+
 func WithLogging(log logger.Logger) SSHAgentModifier {
 	return func(a *SSHAgent) error {
 		a.log = log
@@ -193,7 +228,7 @@ func WithFlags(f *SSHAgentFlags) SSHAgentModifier {
 		if err := WithAgentPath(f.AgentPath, f.AgentArgs)(a); err != nil {
 			return kflags.NewUsageErrorf("invalid ssh-agent-command or flags - %w", err)
 		}
-		return nil
+		return WithExistingAgent(f.UseExisting)(a)
 	}
 }
 
@@ -324,19 +359,143 @@ func (a SSHAgent) Principals() ([]AgentCert, error) {
 	return toReturn, err
 }
 
+// agentLifetime returns the lifetime constraint of a certificate with the remaining ttl, in seconds.
+//
+// Certificates valid forever are added without constraint (0). The lifetime
+// is rounded up, so a constraint of 0 is never used for certificates about to expire.
+func agentLifetime(ttl time.Duration) uint32 {
+	if ttl == MaxCertTimeDuration || ttl.Seconds() >= math.MaxUint32 {
+		return 0
+	}
+	return uint32(math.Ceil(ttl.Seconds()))
+}
+
+// underlyingKey returns the key certified by a certificate, or the key itself if it is not a certificate.
+func underlyingKey(key ssh.PublicKey) ssh.PublicKey {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return cert.Key
+	}
+	return key
+}
+
+// removeIdentities removes the identities in the agent for the same key as publicKey, certificates included.
+func removeIdentities(client agent.ExtendedAgent, publicKey ssh.PublicKey) error {
+	keys, err := client.List()
+	if err != nil {
+		return err
+	}
+	wanted := underlyingKey(publicKey).Marshal()
+	for _, key := range keys {
+		parsed, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil || !bytes.Equal(underlyingKey(parsed).Marshal(), wanted) {
+			continue
+		}
+		if err := client.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AddCertificates loads an ssh certificate into the agent.
 // privateKey must be a key type accepted by the golang.org/x/ssh/agent AddedKey struct.
 // At time of writing, this can be: *rsa.PrivateKey, *dsa.PrivateKey, ed25519.PrivateKey or *ecdsa.PrivateKey.
 // Note that ed25519.PrivateKey should be passed by value.
+//
+// Identities already in the agent for the same key are removed first, and
+// the certificate is removed by the agent once it expires, where supported,
+// so ssh never tries stale certificates.
 func (a SSHAgent) AddCertificates(privateKey PrivateKey, publicKey ssh.PublicKey) error {
 	conn, err := DialTimeout(a)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(a.timeout))
+	if err := removeIdentities(agent.NewClient(conn), publicKey); err != nil {
+		return fmt.Errorf("could not remove previous identities for the key: %w", err)
+	}
 	return AddKey(conn, a, privateKey, publicKey)
 }
 
+// PrunedCert is a certificate removed from the agent by Prune.
+type PrunedCert struct {
+	AgentCert
+	// Why the certificate was removed.
+	Reason string
+}
+
+// Prune removes expired and orphaned certificates from the agent.
+//
+// A certificate is orphaned when a certificate for the same principals,
+// signed by the same CA, and expiring later, is in the agent: it was
+// replaced by a subsequent login. Keys without certificates are never removed.
+func (a SSHAgent) Prune(now time.Time) ([]PrunedCert, error) {
+	conn, err := DialTimeout(a)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(a.timeout))
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		key  *agent.Key
+		cert *ssh.Certificate
+	}
+	var certs []entry
+	latest := map[string]uint64{}
+	identity := func(cert *ssh.Certificate) string {
+		return fmt.Sprintf("%d %s %s", cert.CertType, cert.SignatureKey.Marshal(), strings.Join(cert.ValidPrincipals, ","))
+	}
+	for _, key := range keys {
+		parsed, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil {
+			continue
+		}
+		cert, ok := parsed.(*ssh.Certificate)
+		if !ok {
+			continue
+		}
+		certs = append(certs, entry{key: key, cert: cert})
+		if id := identity(cert); cert.ValidBefore > latest[id] {
+			latest[id] = cert.ValidBefore
+		}
+	}
+
+	var pruned []PrunedCert
+	for _, c := range certs {
+		var reason string
+		switch {
+		case c.cert.ValidBefore != uint64(ssh.CertTimeInfinity) && int64(c.cert.ValidBefore) < now.Unix():
+			reason = "expired"
+		case c.cert.ValidBefore < latest[identity(c.cert)]:
+			reason = "orphaned - replaced by a newer certificate"
+		default:
+			continue
+		}
+		if err := client.Remove(c.key); err != nil {
+			return pruned, fmt.Errorf("could not remove certificate for %v: %w", c.cert.ValidPrincipals, err)
+		}
+		pruned = append(pruned, PrunedCert{
+			AgentCert: AgentCert{
+				MD5:        ssh.FingerprintLegacyMD5(c.cert.SignatureKey),
+				Principals: c.cert.ValidPrincipals,
+				Ext:        c.cert.Extensions,
+				ValidFor:   time.Unix(int64(c.cert.ValidBefore), 0).Sub(now),
+			},
+			Reason: reason,
+		})
+	}
+	return pruned, nil
+}
+
 func (a SSHAgent) GetEnv() []string {
 	env := []string{fmt.Sprintf("SSH_AUTH_SOCK=%s", a.State.Socket)}
 	if a.State.PID != 0 {
@@ -361,6 +520,12 @@ func FindOrCreateSSHAgent(store cache.Store, mods ...SSHAgentModifier) (*SSHAgen
 	} else {
 		err := agent.Valid()
 		if err == nil {
+			agent.State.Mode = agent.environmentMode()
+			if agent.State.Mode == AgentModeUser {
+				// Not started by enkit, never kill it.
+				agent.State.PID = 0
+				agent.log.Infof("Using the ssh agent in the environment at %s", agent.State.Socket)
+			}
 			return agent, nil
 		}
 		errs = append(errs, fmt.Errorf("environment - %w", err))
@@ -373,11 +538,15 @@ func FindOrCreateSSHAgent(store cache.Store, mods ...SSHAgentModifier) (*SSHAgen
 	} else {
 		err := agent.Valid()
 		if err == nil {
+			if agent.State.Mode != AgentModeUser || !agent.useExisting {
+				agent.State.Mode = AgentModeEnkit
+			}
 			return agent, nil
 		}
 		errs = append(errs, fmt.Errorf("cache - %w", err))
 	}
 
+	agent.State.Mode = AgentModeEnkit
 	err = agent.CreateNew()
 	if err != nil {
 		errs = append(errs, fmt.Errorf("new - %w", err))
@@ -392,13 +561,26 @@ func FindOrCreateSSHAgent(store cache.Store, mods ...SSHAgentModifier) (*SSHAgen
 	return nil, fmt.Errorf("started ssh agent is not functional - other methods failed. %w", multierror.New(errs))
 }
 
+// environmentMode returns the mode to use a working agent found in the environment with.
+func (agent *SSHAgent) environmentMode() AgentMode {
+	if !agent.useExisting {
+		return AgentModeEnkit
+	}
+	// The environment may point to the enkit socket, for example, in a shell started by `enkit agent run`.
+	if standard, err := agent.GetStandardSocketPath(); err == nil && standard == agent.State.Socket {
+		return AgentModeEnkit
+	}
+	return AgentModeUser
+}
+
 // PrepareSSHAgent ensures that we end up with a working ssh-agent,
 // either by discovering an existing ssh-agent or creating a new one.
 // It also ensures that we have an up-to-date symlink to that agent's
 // socket in the standard location.
 //
 // The final ssh-agent socket returned by PrepareSSHAgent is always
-// ~/.config/enkit/agent.
+// ~/.config/enkit/agent, unless WithExistingAgent is used and a working
+// agent of the user was found. The mode in use is recorded in the cache.
 func PrepareSSHAgent(store cache.Store, mods ...SSHAgentModifier) (*SSHAgent, error) {
 	agent, err := FindOrCreateSSHAgent(store, mods...)
 	if err != nil {
@@ -406,8 +588,10 @@ func PrepareSSHAgent(store cache.Store, mods ...SSHAgentModifier) (*SSHAgent, er
 	}
 
 	// If we have a valid agent, make sure the paths are right.
-	if err := agent.UseStandardPaths(); err != nil {
-		return nil, err
+	if agent.State.Mode != AgentModeUser {
+		if err := agent.UseStandardPaths(); err != nil {
+			return nil, err
+		}
 	}
 
 	agent.log.Infof("%s", WriteAgentToCache(store, agent))
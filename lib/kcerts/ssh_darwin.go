@@ -27,6 +27,6 @@ func AddKey(conn net.Conn, a SSHAgent, privateKey PrivateKey, publicKey ssh.Publ
 	return agent.NewClient(conn).Add(agent.AddedKey{
 		PrivateKey:   privateKey.Raw(),
 		Certificate:  cert,
-		LifetimeSecs: uint32(ttl.Seconds()),
+		LifetimeSecs: agentLifetime(ttl),
 	})
 }
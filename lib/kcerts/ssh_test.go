@@ -1,11 +1,13 @@
 package kcerts
 
 import (
+	"bytes"
 	"flag"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/System233/enkit/lib/logger/klog"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // TODO(adam): improve this test, including files writes and other edges cases
@@ -120,6 +123,111 @@ func TestSSHAgent_Principals(t *testing.T) {
 	}
 }
 
+func TestSSHAgentPrune(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "en")
+	assert.NoError(t, err)
+	old := GetConfigDir
+	defer func() { GetConfigDir = old }()
+	GetConfigDir = func(app string, namespaces ...string) (string, error) {
+		return tmpDir + "/.config/enkit", nil
+	}
+	assert.NoError(t, os.Unsetenv("SSH_AUTH_SOCK"))
+	assert.NoError(t, os.Unsetenv("SSH_AGENT_PID"))
+
+	l, err := klog.New("test", klog.FromFlags(*klog.DefaultFlags()))
+	assert.NoError(t, err)
+	a, err := PrepareSSHAgent(&cache.Local{Root: tmpDir}, WithLogging(l))
+	assert.NoError(t, err)
+	defer a.Close()
+
+	_, caPriv, err := GenerateED25519()
+	assert.NoError(t, err)
+	principals := []string{"foo", "foo@enfabrica.net"}
+	listCerts := func() []*ssh.Certificate {
+		conn, err := DialTimeout(*a)
+		assert.NoError(t, err)
+		defer conn.Close()
+		keys, err := agent.NewClient(conn).List()
+		assert.NoError(t, err)
+		var certs []*ssh.Certificate
+		for _, key := range keys {
+			parsed, err := ssh.ParsePublicKey(key.Marshal())
+			assert.NoError(t, err)
+			certs = append(certs, parsed.(*ssh.Certificate))
+		}
+		return certs
+	}
+
+	// Adding a certificate for a key replaces the previous ones for the same key.
+	firstPub, firstPriv, err := GenerateED25519()
+	assert.NoError(t, err)
+	for _, ttl := range []time.Duration{time.Hour, 2 * time.Hour} {
+		cert, err := SignPublicKey(caPriv, ssh.UserCert, principals, ttl, firstPub)
+		assert.NoError(t, err)
+		assert.NoError(t, a.AddCertificates(firstPriv, cert))
+	}
+	certs := listCerts()
+	assert.Equal(t, 1, len(certs))
+	assert.InDelta(t, time.Now().Add(2*time.Hour).Unix(), int64(certs[0].ValidBefore), 5)
+
+	// A newer login with a different key orphans the first certificate.
+	secondPub, secondPriv, err := GenerateED25519()
+	assert.NoError(t, err)
+	newer, err := SignPublicKey(caPriv, ssh.UserCert, principals, 5*time.Hour, secondPub)
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddCertificates(secondPriv, newer))
+
+	// Certificates with other principals are not affected.
+	otherPub, otherPriv, err := GenerateED25519()
+	assert.NoError(t, err)
+	other, err := SignPublicKey(caPriv, ssh.UserCert, []string{"bar"}, time.Hour, otherPub)
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddCertificates(otherPriv, other))
+
+	// Expired certificates added without a lifetime linger until pruned.
+	expiredPub, expiredPriv, err := GenerateED25519()
+	assert.NoError(t, err)
+	expired, err := SignPublicKey(caPriv, ssh.UserCert, []string{"baz"}, time.Hour, expiredPub, func(cert *ssh.Certificate) *ssh.Certificate {
+		cert.ValidAfter = uint64(time.Now().Add(-2 * time.Hour).Unix())
+		cert.ValidBefore = uint64(time.Now().Add(-time.Hour).Unix())
+		return cert
+	})
+	assert.NoError(t, err)
+	conn, err := DialTimeout(*a)
+	assert.NoError(t, err)
+	assert.NoError(t, agent.NewClient(conn).Add(agent.AddedKey{PrivateKey: expiredPriv.Raw(), Certificate: expired}))
+	conn.Close()
+	assert.Equal(t, 4, len(listCerts()))
+
+	pruned, err := a.Prune(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(pruned))
+	reasons := map[string]string{}
+	for _, p := range pruned {
+		reasons[strings.Join(p.Principals, ",")] = p.Reason
+	}
+	assert.Equal(t, map[string]string{
+		"foo,foo@enfabrica.net": "orphaned - replaced by a newer certificate",
+		"baz":                   "expired",
+	}, reasons)
+
+	certs = listCerts()
+	assert.Equal(t, 2, len(certs))
+	for _, cert := range certs {
+		assert.True(t, bytes.Equal(cert.Key.Marshal(), secondPub.Marshal()) || bytes.Equal(cert.Key.Marshal(), otherPub.Marshal()))
+	}
+
+	pruned, err = a.Prune(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(pruned))
+}
+
+func TestAgentLifetime(t *testing.T) {
+	assert.Equal(t, uint32(0), agentLifetime(MaxCertTimeDuration))
+	assert.Equal(t, uint32(1), agentLifetime(100*time.Millisecond))
+	assert.Equal(t, uint32(3600), agentLifetime(time.Hour))
+}
+
 func TestSSHAgentTimeout(t *testing.T) {
 	dir, err := os.MkdirTemp("", "test-uds-ssh")
 	assert.NoError(t, err)
@@ -191,3 +299,95 @@ func TestSSHAgentFlags(t *testing.T) {
 	// This proves that the agent from flags was attempted.
 	assert.ErrorContains(t, err, "new - invalid agent - could not connect - dial unix /tmp/agent-from-flags")
 }
+
+// fakeUserAgent serves an in memory agent on a unix socket, like gnome-keyring or a systemd managed ssh-agent would.
+func fakeUserAgent(t *testing.T, dir string) string {
+	sockaddr := filepath.Join(dir, "user-agent")
+	l, err := net.Listen("unix", sockaddr)
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return sockaddr
+}
+
+func TestPrepareSSHAgentExisting(t *testing.T) {
+	dir := t.TempDir()
+	old := GetConfigDir
+	defer func() { GetConfigDir = old }()
+	GetConfigDir = func(app string, namespaces ...string) (string, error) {
+		return filepath.Join(dir, ".config", app), nil
+	}
+	standard := filepath.Join(dir, ".config", "enkit", "agent")
+	store := &cache.Local{Root: dir}
+
+	sockaddr := fakeUserAgent(t, dir)
+	t.Setenv("SSH_AUTH_SOCK", sockaddr)
+	t.Setenv("SSH_AGENT_PID", "1")
+
+	// The agent in the environment is used as is, and recorded in the cache.
+	a, err := PrepareSSHAgent(store, WithExistingAgent(true))
+	assert.NoError(t, err)
+	assert.Equal(t, SSHAgentState{Socket: sockaddr, Mode: AgentModeUser}, a.State)
+	assert.Equal(t, []string{"SSH_AUTH_SOCK=" + sockaddr}, a.GetEnv())
+	_, err = os.Lstat(standard)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	cached, err := NewSSHAgent()
+	assert.NoError(t, err)
+	assert.NoError(t, cached.LoadFromCache(store))
+	assert.Equal(t, a.State, cached.State)
+
+	// Still used from the cache, once gone from the environment.
+	os.Unsetenv("SSH_AUTH_SOCK")
+	a, err = PrepareSSHAgent(store, WithExistingAgent(true))
+	assert.NoError(t, err)
+	assert.Equal(t, SSHAgentState{Socket: sockaddr, Mode: AgentModeUser}, a.State)
+
+	// Without the option, the agent is reached through the enkit socket.
+	t.Setenv("SSH_AUTH_SOCK", sockaddr)
+	a, err = PrepareSSHAgent(store)
+	assert.NoError(t, err)
+	assert.Equal(t, SSHAgentState{Socket: standard, PID: 1, Mode: AgentModeEnkit}, a.State)
+	target, err := os.Readlink(standard)
+	assert.NoError(t, err)
+	assert.Equal(t, sockaddr, target)
+	assert.NoError(t, a.Valid())
+}
+
+func TestPrepareSSHAgentExistingFallback(t *testing.T) {
+	dir := t.TempDir()
+	old := GetConfigDir
+	defer func() { GetConfigDir = old }()
+	GetConfigDir = func(app string, namespaces ...string) (string, error) {
+		return filepath.Join(dir, ".config", app), nil
+	}
+	standard := filepath.Join(dir, ".config", "enkit", "agent")
+
+	// An agent that does not respond to list requests is ignored.
+	sockaddr := filepath.Join(dir, "broken-agent")
+	l, err := net.Listen("unix", sockaddr)
+	assert.NoError(t, err)
+	defer l.Close()
+	t.Setenv("SSH_AUTH_SOCK", sockaddr)
+
+	a, err := PrepareSSHAgent(&cache.Local{Root: dir}, WithExistingAgent(true), WithTimeout(time.Second))
+	assert.NoError(t, err)
+	defer a.Kill()
+	assert.Equal(t, standard, a.State.Socket)
+	assert.Equal(t, AgentModeEnkit, a.State.Mode)
+	assert.NotEqual(t, 0, a.State.PID)
+	assert.NoError(t, a.Valid())
+}
@@ -0,0 +1,159 @@
+package kflags
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CachedCommand is a command added by an Augmenter, as recorded by a CommandRecorder.
+type CachedCommand struct {
+	// Namespace of the parent command, as passed to Augmenter.VisitCommand.
+	Namespace  string
+	Definition CommandDefinition
+	Flags      []FlagDefinition
+}
+
+// CommandCache is the tree of commands added by Augmenters, stored so shell completions
+// can be computed without fetching the configs defining the commands.
+//
+// Use a CommandRecorder to create one, and a CommandCacheAugmenter to add the
+// cached commands back.
+type CommandCache struct {
+	// When the commands were recorded.
+	Updated time.Time
+	// When a refresh of the cache was last started, zero if never.
+	Refreshing time.Time
+
+	Commands []CachedCommand
+}
+
+// Stale returns true if the cache was recorded more than maxAge before now.
+func (cc *CommandCache) Stale(now time.Time, maxAge time.Duration) bool {
+	return now.Sub(cc.Updated) > maxAge
+}
+
+// CommandRecorder records the commands added by Augmenters.
+//
+// Wrap the Augmenters to record with Wrap, or all those passed to a Populator with
+// Populator, and then retrieve the commands recorded with Cache.
+type CommandRecorder struct {
+	lock     sync.Mutex
+	commands []CachedCommand
+}
+
+func NewCommandRecorder() *CommandRecorder {
+	return &CommandRecorder{}
+}
+
+func (cr *CommandRecorder) record(namespace string, def CommandDefinition, fl []FlagDefinition) {
+	cached := CachedCommand{Namespace: namespace, Definition: def}
+	for _, flag := range fl {
+		// Secrets must never be written to disk.
+		if flag.Secret {
+			flag.Default = ""
+		}
+		cached.Flags = append(cached.Flags, flag)
+	}
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.commands = append(cr.commands, cached)
+}
+
+// Cache returns the commands recorded so far, as updated at the specified time.
+func (cr *CommandRecorder) Cache(now time.Time) *CommandCache {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return &CommandCache{Updated: now, Commands: append([]CachedCommand{}, cr.commands...)}
+}
+
+// Wrap returns an Augmenter recording all the commands added by augmenter.
+func (cr *CommandRecorder) Wrap(augmenter Augmenter) Augmenter {
+	return &recordingAugmenter{Augmenter: augmenter, recorder: cr}
+}
+
+// Populator returns a Populator recording all the commands added by the Augmenters passed to populator.
+func (cr *CommandRecorder) Populator(populator Populator) Populator {
+	return func(resolvers ...Augmenter) error {
+		wrapped := make([]Augmenter, 0, len(resolvers))
+		for _, r := range resolvers {
+			wrapped = append(wrapped, cr.Wrap(r))
+		}
+		return populator(wrapped...)
+	}
+}
+
+type recordingAugmenter struct {
+	Augmenter
+	recorder *CommandRecorder
+}
+
+// String returns the name of the wrapped Augmenter, used as origin of the values it sets.
+func (ra *recordingAugmenter) String() string {
+	return AugmenterName(ra.Augmenter)
+}
+
+func (ra *recordingAugmenter) VisitCommand(namespace string, command Command) (bool, error) {
+	if commander, ok := command.(Commander); ok {
+		command = &recordingCommander{Commander: commander, namespace: namespace, recorder: ra.recorder}
+	}
+	return ra.Augmenter.VisitCommand(namespace, command)
+}
+
+type recordingCommander struct {
+	Commander
+	namespace string
+	recorder  *CommandRecorder
+}
+
+func (rc *recordingCommander) AddCommand(def CommandDefinition, fl []FlagDefinition, action CommandAction) error {
+	if err := rc.Commander.AddCommand(def, fl, action); err != nil {
+		return err
+	}
+	rc.recorder.record(rc.namespace, def, fl)
+	return nil
+}
+
+// CommandCacheAugmenter adds the commands of a CommandCache, with their flags.
+//
+// The commands added cannot be run: they are only meant to compute shell completions,
+// or show help messages, when the configs defining them cannot be fetched quickly.
+type CommandCacheAugmenter struct {
+	cache *CommandCache
+}
+
+func NewCommandCacheAugmenter(cache *CommandCache) *CommandCacheAugmenter {
+	return &CommandCacheAugmenter{cache: cache}
+}
+
+func (ca *CommandCacheAugmenter) VisitCommand(namespace string, command Command) (bool, error) {
+	commander, ok := command.(Commander)
+	if !ok {
+		return false, nil
+	}
+
+	found := false
+	for _, cached := range ca.cache.Commands {
+		if cached.Namespace != namespace {
+			continue
+		}
+		name := cached.Definition.Name
+		action := func(flags []FlagArg, args []string) error {
+			return fmt.Errorf("command %s in %s was loaded from the completion cache, and cannot be run", name, namespace)
+		}
+		if err := commander.AddCommand(cached.Definition, cached.Flags, action); err != nil {
+			return found, err
+		}
+		found = true
+	}
+	return found, nil
+}
+
+func (ca *CommandCacheAugmenter) VisitFlag(namespace string, flag Flag) (bool, error) {
+	return false, nil
+}
+
+func (ca *CommandCacheAugmenter) Done() error {
+	return nil
+}
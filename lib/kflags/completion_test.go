@@ -0,0 +1,119 @@
+package kflags
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type addedCommand struct {
+	def    CommandDefinition
+	flags  []FlagDefinition
+	action CommandAction
+}
+
+type fakeCommander struct {
+	name  string
+	added []addedCommand
+}
+
+func (fc *fakeCommander) Name() string {
+	return fc.name
+}
+
+func (fc *fakeCommander) Hide(bool) {
+}
+
+func (fc *fakeCommander) AddCommand(def CommandDefinition, fl []FlagDefinition, action CommandAction) error {
+	fc.added = append(fc.added, addedCommand{def: def, flags: fl, action: action})
+	return nil
+}
+
+// commandAugmenter adds a command to the namespaces it was configured with.
+type commandAugmenter map[string]addedCommand
+
+func (ca commandAugmenter) VisitCommand(namespace string, command Command) (bool, error) {
+	toadd, found := ca[namespace]
+	if !found {
+		return false, nil
+	}
+	return true, command.(Commander).AddCommand(toadd.def, toadd.flags, toadd.action)
+}
+
+func (ca commandAugmenter) VisitFlag(namespace string, flag Flag) (bool, error) {
+	return false, nil
+}
+
+func (ca commandAugmenter) Done() error {
+	return nil
+}
+
+func TestCommandCache(t *testing.T) {
+	ran := false
+	augmenter := commandAugmenter{
+		"enkit": {
+			def: CommandDefinition{Name: "deploy", Short: "Deploys things", Aliases: []string{"push"}},
+			flags: []FlagDefinition{
+				{Name: "target", Default: "prod", Help: "Where to deploy"},
+				{Name: "token", Default: "sekret", Secret: true},
+			},
+			action: func(flags []FlagArg, args []string) error {
+				ran = true
+				return nil
+			},
+		},
+		"enkit.deploy": {def: CommandDefinition{Name: "rollback"}},
+	}
+
+	recorder := NewCommandRecorder()
+	populator := recorder.Populator(func(resolvers ...Augmenter) error {
+		for _, r := range resolvers {
+			for _, ns := range []string{"enkit", "enkit.deploy", "enkit.other"} {
+				if _, err := r.VisitCommand(ns, &fakeCommander{name: ns}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, populator(augmenter, NewEnvAugmenter()))
+
+	now := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	cache := recorder.Cache(now)
+	assert.Equal(t, now, cache.Updated)
+	assert.Equal(t, 2, len(cache.Commands))
+	assert.Equal(t, "enkit", cache.Commands[0].Namespace)
+	assert.Equal(t, "deploy", cache.Commands[0].Definition.Name)
+	assert.Equal(t, "prod", cache.Commands[0].Flags[0].Default)
+	// Secrets are not cached, and the original definition is unchanged.
+	assert.Equal(t, "", cache.Commands[0].Flags[1].Default)
+	assert.Equal(t, "sekret", augmenter["enkit"].flags[1].Default)
+	assert.Equal(t, "enkit.deploy", cache.Commands[1].Namespace)
+
+	assert.False(t, cache.Stale(now.Add(time.Hour), 2*time.Hour))
+	assert.True(t, cache.Stale(now.Add(3*time.Hour), 2*time.Hour))
+
+	// The cached commands are added back, to the same namespaces.
+	replay := NewCommandCacheAugmenter(cache)
+	root, deploy, other := &fakeCommander{name: "enkit"}, &fakeCommander{name: "deploy"}, &fakeCommander{name: "other"}
+	found, err := replay.VisitCommand("enkit", root)
+	assert.True(t, found)
+	assert.Nil(t, err)
+	found, err = replay.VisitCommand("enkit.deploy", deploy)
+	assert.True(t, found)
+	assert.Nil(t, err)
+	found, err = replay.VisitCommand("enkit.other", other)
+	assert.False(t, found)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(root.added))
+	assert.Equal(t, CommandDefinition{Name: "deploy", Short: "Deploys things", Aliases: []string{"push"}}, root.added[0].def)
+	assert.Equal(t, cache.Commands[0].Flags, root.added[0].flags)
+	assert.Equal(t, "rollback", deploy.added[0].def.Name)
+	assert.Equal(t, 0, len(other.added))
+
+	// Cached commands cannot be run.
+	assert.NotNil(t, root.added[0].action(nil, nil))
+	assert.False(t, ran)
+}
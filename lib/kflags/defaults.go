@@ -1,11 +1,14 @@
 package kflags
 
 import (
+	"encoding/csv"
 	"flag"
 	"fmt"
 	"github.com/System233/enkit/lib/multierror"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Flag represents a command line flag.
@@ -19,6 +22,23 @@ type Flag interface {
 	SetContent(string, []byte) error
 }
 
+// UserSetter is implemented by Flags able to tell if the user explicitly
+// assigned them a value, for example on the command line.
+type UserSetter interface {
+	UserSet() bool
+}
+
+// IsUserSet returns true if the user explicitly assigned a value to the flag.
+//
+// Flags not implementing UserSetter are assumed to have been set by the user,
+// so code updating flags after they have been parsed leaves them alone.
+func IsUserSet(fl Flag) bool {
+	if setter, ok := fl.(UserSetter); ok {
+		return setter.UserSet()
+	}
+	return true
+}
+
 // GoFlagSet wraps a flag.FlagSet from the go standard library and completes the
 // implementation of the FlagSet interface in this module.
 //
@@ -34,6 +54,22 @@ func (fs *GoFlagSet) ByteFileVar(p *[]byte, name string, defaultFile string, usa
 	fs.Var(NewByteFileFlag(p, defaultFile, mods...), name, usage)
 }
 
+// ValueVar implements ValueFlagSet.
+func (fs *GoFlagSet) ValueVar(value Value, name string, usage string) {
+	fs.Var(value, name, usage)
+}
+
+// SecretValues implements SecretLister.
+func (fs *GoFlagSet) SecretValues() []string {
+	var secrets []string
+	fs.VisitAll(func(fl *flag.Flag) {
+		if value := SecretOf(fl.Value); value != "" && (&GoFlag{fl}).IsSecret() {
+			secrets = append(secrets, value)
+		}
+	})
+	return secrets
+}
+
 // stringArrayFlag is a simple implementation of the flag.Value interface to provide array of flags.
 type stringArrayFlag struct {
 	dest     *[]string
@@ -77,7 +113,7 @@ func (gf *GoFlag) Set(value string) error {
 	if err != nil {
 		return err
 	}
-	gf.Flag.DefValue = value
+	gf.setDefault(value)
 	return nil
 }
 func (gf *GoFlag) SetContent(name string, data []byte) error {
@@ -85,10 +121,48 @@ func (gf *GoFlag) SetContent(name string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	gf.Flag.DefValue = result
+	gf.setDefault(result)
 	return nil
 }
 
+// setDefault updates the default shown in help messages, unless the flag holds a secret.
+func (gf *GoFlag) setDefault(value string) {
+	if gf.IsSecret() {
+		value = RedactedValue
+	}
+	gf.Flag.DefValue = value
+}
+
+// IsSecret implements SecretFlag.
+//
+// A flag.Flag has no room for annotations: flags marked as secret are recognized
+// by their RedactedValue default.
+func (gf *GoFlag) IsSecret() bool {
+	if _, ok := gf.Flag.Value.(SecretValue); ok {
+		return true
+	}
+	return gf.Flag.DefValue == RedactedValue
+}
+
+// MarkSecret implements SecretFlag.
+func (gf *GoFlag) MarkSecret() {
+	gf.Flag.DefValue = RedactedValue
+}
+
+// UserSet implements UserSetter.
+//
+// A flag.Flag does not record if it was parsed from the command line: the flag
+// is considered set by the user if its value differs from the default, which
+// Set and SetContent update. Flags holding content are always considered set.
+func (gf *GoFlag) UserSet() bool {
+	return gf.Flag.Value.String() != gf.Flag.DefValue
+}
+
+// MaxValueSize implements ValueSizeLimiter, returning the limit configured by the flag.Value, if any.
+func (gf *GoFlag) MaxValueSize() int {
+	return ValueMaxSize(gf.Flag.Value)
+}
+
 // Command represents a command line command.
 type Command interface {
 	Name() string
@@ -105,10 +179,49 @@ type CommandDefinition struct {
 	Aliases []string
 }
 
+// FlagType is the type of the value of a flag created from a FlagDefinition.
+type FlagType string
+
+const (
+	FlagTypeString      FlagType = "string"
+	FlagTypeBool        FlagType = "bool"
+	FlagTypeInt         FlagType = "int"
+	FlagTypeDuration    FlagType = "duration"
+	FlagTypeStringSlice FlagType = "stringslice"
+)
+
+// FlagTypes lists all the valid FlagType.
+var FlagTypes = []FlagType{FlagTypeString, FlagTypeBool, FlagTypeInt, FlagTypeDuration, FlagTypeStringSlice}
+
+// Valid returns true if the type is one of FlagTypes, or empty.
+func (ft FlagType) Valid() bool {
+	if ft == "" {
+		return true
+	}
+	for _, valid := range FlagTypes {
+		if ft == valid {
+			return true
+		}
+	}
+	return false
+}
+
 type FlagDefinition struct {
 	Name    string
 	Help    string
 	Default string
+
+	// Type of the flag, empty for FlagTypeString.
+	// The Default is parsed according to the type.
+	Type FlagType
+
+	// Largest value in bytes Augmenters can assign to the flag.
+	// 0 means DefaultMaxValueSize, a negative value disables the limit.
+	MaxSize int
+
+	// If true, the value is a secret, like a token or password, and is
+	// never shown in help messages, errors, or logs.
+	Secret bool
 }
 
 type FlagArg struct {
@@ -116,6 +229,73 @@ type FlagArg struct {
 	flag.Value
 }
 
+// Get returns the value of the flag converted to its Type: a string, bool,
+// int, time.Duration or []string.
+//
+// Values that cannot be converted are returned as strings. Secrets are
+// returned as the actual value, not redacted.
+func (fa FlagArg) Get() interface{} {
+	if secret, ok := fa.Value.(SecretValue); ok {
+		return secret.Secret()
+	}
+	switch fa.Type {
+	case FlagTypeBool:
+		if v, err := fa.Bool(); err == nil {
+			return v
+		}
+	case FlagTypeInt:
+		if v, err := fa.Int(); err == nil {
+			return v
+		}
+	case FlagTypeDuration:
+		if v, err := fa.Duration(); err == nil {
+			return v
+		}
+	case FlagTypeStringSlice:
+		if v, err := fa.StringSlice(); err == nil {
+			return v
+		}
+	}
+	return fa.Value.String()
+}
+
+// Bool returns the value of a FlagTypeBool flag.
+func (fa FlagArg) Bool() (bool, error) {
+	return strconv.ParseBool(fa.Value.String())
+}
+
+// Int returns the value of a FlagTypeInt flag.
+func (fa FlagArg) Int() (int, error) {
+	return strconv.Atoi(fa.Value.String())
+}
+
+// Duration returns the value of a FlagTypeDuration flag.
+func (fa FlagArg) Duration() (time.Duration, error) {
+	return time.ParseDuration(fa.Value.String())
+}
+
+// StringSlice returns the value of a FlagTypeStringSlice flag.
+//
+// The value is retrieved with a GetSlice method if available, as implemented
+// by pflag, or parsed as a list of comma separated values otherwise.
+func (fa FlagArg) StringSlice() ([]string, error) {
+	if sv, ok := fa.Value.(interface{ GetSlice() []string }); ok {
+		return sv.GetSlice(), nil
+	}
+	return ParseStringSlice(fa.Value.String())
+}
+
+// ParseStringSlice parses a list of comma separated values, in csv format.
+//
+// Surrounding [], as added by the String method of slice flags, are ignored.
+func ParseStringSlice(value string) ([]string, error) {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if value == "" {
+		return []string{}, nil
+	}
+	return csv.NewReader(strings.NewReader(value)).Read()
+}
+
 type CommandAction func(flags []FlagArg, args []string) error
 
 // Commander is a Command that is capable of having subcommands.
@@ -131,7 +311,8 @@ type Commander interface {
 // and the existing commands defined.
 //
 // VisitFlag is invoked for each flag, with the method implementation allowed to call
-// arbitrary methods on the flag.
+// arbitrary methods on the flag. Values larger than the limit of the flag, see
+// MaxValueSize, are rejected with a ValueTooLargeError.
 //
 // VisitCommands is invoked for each sub-command, with the method implementation allowed
 // to call arbitrary methods on the command.
@@ -230,7 +411,7 @@ func PopulateDefaults(set *flag.FlagSet, resolvers ...Augmenter) error {
 				return
 			}
 
-			if _, err := r.VisitFlag(namespace, &GoFlag{fl}); err != nil {
+			if _, err := r.VisitFlag(namespace, LimitFlag(&GoFlag{fl}, AugmenterName(r))); err != nil {
 				errors = append(errors, err)
 			}
 		})
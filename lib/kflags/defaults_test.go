@@ -39,3 +39,44 @@ func TestArrayFlagsNilDefault(t *testing.T) {
 	assert.Nil(t, fs.Parse([]string{"-array", "test1", "-array", "test2", "-array=test3", "--array=test4"}))
 	assert.Equal(t, []string{"test1", "test2", "test3", "test4"}, array)
 }
+
+func TestParseStringSlice(t *testing.T) {
+	for value, expected := range map[string][]string{
+		"":              {},
+		"[]":            {},
+		"a":             {"a"},
+		"a,b":           {"a", "b"},
+		"[a,b]":         {"a", "b"},
+		`"a,b",c`:       {"a,b", "c"},
+		"//foo,//bar/x": {"//foo", "//bar/x"},
+	} {
+		got, err := ParseStringSlice(value)
+		assert.Nil(t, err, "%s", value)
+		assert.Equal(t, expected, got, "%s", value)
+	}
+	_, err := ParseStringSlice(`"a`)
+	assert.NotNil(t, err)
+}
+
+func TestFlagType(t *testing.T) {
+	for _, valid := range append(FlagTypes, "") {
+		assert.True(t, valid.Valid(), "%s", valid)
+	}
+	assert.False(t, FlagType("complex128").Valid())
+}
+
+func TestGoFlagUserSet(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("server", "default", "usage")
+	fs.String("timeout", "1s", "usage")
+	assert.Nil(t, fs.Parse([]string{"--timeout=5s"}))
+
+	server := &GoFlag{fs.Lookup("server")}
+	assert.False(t, server.UserSet())
+	assert.Nil(t, server.Set("from-config"))
+	assert.False(t, server.UserSet())
+	assert.True(t, (&GoFlag{fs.Lookup("timeout")}).UserSet())
+
+	// Wrappers forward the check to the flag.
+	assert.False(t, IsUserSet(LimitFlag(server, "test")))
+}
@@ -0,0 +1,275 @@
+package kflags
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/multierror"
+)
+
+// Deprecation describes a flag that was renamed or removed.
+//
+// By default, values assigned to the old name of a renamed flag are applied to
+// the new flag, while values assigned to a removed flag are ignored. Either way,
+// a warning is logged.
+type Deprecation struct {
+	// Old name of the flag.
+	Name string
+	// New name of the flag, empty if the flag was removed.
+	Replacement string
+	// If true, values assigned to the old name are rejected with an error, rather than
+	// applied or ignored with a warning.
+	Fatal bool
+}
+
+// Deprecations indexes Deprecation by the namespace of the flags, as passed to Augmenter.VisitFlag.
+type Deprecations map[string][]Deprecation
+
+// Add adds the deprecations to the specified namespace.
+func (d Deprecations) Add(namespace string, deprecations ...Deprecation) Deprecations {
+	d[namespace] = append(d[namespace], deprecations...)
+	return d
+}
+
+// assignment is a value assigned to a flag by an Augmenter.
+type assignment struct {
+	origin  string
+	value   []byte
+	content bool // true if assigned with SetContent, false with Set.
+}
+
+// recordingFlag is a Flag recording the values assigned, so they can be applied later.
+type recordingFlag struct {
+	name string
+	// Flag the values are applied to, nil for removed flags.
+	target Flag
+
+	lock   sync.Mutex
+	values []assignment
+	secret bool
+}
+
+func (rf *recordingFlag) Name() string {
+	return rf.name
+}
+
+func (rf *recordingFlag) Set(value string) error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	rf.values = append(rf.values, assignment{value: []byte(value)})
+	return nil
+}
+
+func (rf *recordingFlag) SetContent(origin string, data []byte) error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	rf.values = append(rf.values, assignment{origin: origin, value: data, content: true})
+	return nil
+}
+
+// MaxValueSize implements ValueSizeLimiter, returning the limit of the target flag.
+func (rf *recordingFlag) MaxValueSize() int {
+	if rf.target == nil {
+		return 0
+	}
+	return MaxValueSize(rf.target)
+}
+
+// IsSecret implements SecretFlag.
+func (rf *recordingFlag) IsSecret() bool {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.secret && (rf.target == nil || IsSecret(rf.target))
+}
+
+// MarkSecret implements SecretFlag, marking the target flag as secret as well.
+func (rf *recordingFlag) MarkSecret() {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	rf.secret = true
+	if rf.target != nil {
+		MarkSecret(rf.target)
+	}
+}
+
+func (rf *recordingFlag) assigned() bool {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return len(rf.values) > 0
+}
+
+// apply assigns the recorded values to the target flag, in order.
+func (rf *recordingFlag) apply() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	for _, value := range rf.values {
+		var err error
+		if value.content {
+			err = rf.target.SetContent(value.origin, value.value)
+		} else {
+			err = rf.target.Set(string(value.value))
+		}
+		if err != nil {
+			return fmt.Errorf("could not set flag '%s' from '%s', value %s caused %w", rf.target.Name(), rf.name, RedactValue(rf.target, string(value.value)), RedactError(rf.target, err))
+		}
+	}
+	return nil
+}
+
+// deprecatedFlag is an old name of a flag visited by the DeprecationAugmenter.
+type deprecatedFlag struct {
+	Deprecation
+	namespace string
+	flag      *recordingFlag
+	// True if the replacement was already assigned a value.
+	conflict bool
+}
+
+// resolve applies, ignores, or rejects the values assigned to the old name.
+func (df *deprecatedFlag) resolve(log logger.Logger) error {
+	switch {
+	case df.Replacement == "" && df.Fatal:
+		return fmt.Errorf("flag '%s' in namespace '%s' was removed - a value cannot be assigned to it anymore", df.Name, df.namespace)
+	case df.Replacement == "":
+		log.Warnf("flag '%s' in namespace '%s' was removed - ignoring the value assigned to it", df.Name, df.namespace)
+	case df.Fatal:
+		return fmt.Errorf("flag '%s' in namespace '%s' was renamed to '%s' - the value assigned to '%s' is rejected, assign it to '%s' instead", df.Name, df.namespace, df.Replacement, df.Name, df.Replacement)
+	case df.conflict:
+		log.Warnf("flag '%s' in namespace '%s' was renamed to '%s', and values were assigned to both - ignoring the value of '%s'", df.Name, df.namespace, df.Replacement, df.Name)
+	default:
+		log.Warnf("flag '%s' in namespace '%s' was renamed to '%s' - assigning its value to '%s', please use the new name", df.Name, df.namespace, df.Replacement, df.Replacement)
+		return df.flag.apply()
+	}
+	return nil
+}
+
+// DeprecationAugmenter is an Augmenter handling flags that were renamed or removed.
+//
+// It wraps another Augmenter: when a flag is visited, the wrapped Augmenter is
+// asked for the value of the flag, and for the value of any old name of the flag.
+// The values assigned to old names are applied, ignored or rejected in Done, as
+// described by Deprecation. If values are assigned to both the old and the new
+// name of a flag, the value of the new name is used.
+type DeprecationAugmenter struct {
+	log       logger.Logger
+	augmenter Augmenter
+
+	// Key is the namespace, then the new name of the flag.
+	renamed map[string]map[string][]Deprecation
+	// Key is the namespace.
+	removed map[string][]Deprecation
+	probed  map[string]bool
+
+	visited []*deprecatedFlag
+}
+
+// NewDeprecationAugmenter returns a DeprecationAugmenter applying the deprecations to the flags
+// configured by augmenter.
+func NewDeprecationAugmenter(log logger.Logger, augmenter Augmenter, deprecations Deprecations) (*DeprecationAugmenter, error) {
+	da := &DeprecationAugmenter{
+		log:       log,
+		augmenter: augmenter,
+		renamed:   map[string]map[string][]Deprecation{},
+		removed:   map[string][]Deprecation{},
+		probed:    map[string]bool{},
+	}
+
+	var errs []error
+	for namespace, list := range deprecations {
+		for _, dep := range list {
+			if dep.Name == "" || dep.Name == dep.Replacement {
+				errs = append(errs, fmt.Errorf("invalid deprecation in namespace '%s' - %#v: the old name must be set, and differ from the replacement", namespace, dep))
+				continue
+			}
+			if dep.Replacement == "" {
+				da.removed[namespace] = append(da.removed[namespace], dep)
+				continue
+			}
+
+			renamed := da.renamed[namespace]
+			if renamed == nil {
+				renamed = map[string][]Deprecation{}
+				da.renamed[namespace] = renamed
+			}
+			renamed[dep.Replacement] = append(renamed[dep.Replacement], dep)
+		}
+	}
+	return da, multierror.New(errs)
+}
+
+// String returns the name of the wrapped Augmenter, used as origin of the values it sets.
+func (da *DeprecationAugmenter) String() string {
+	return AugmenterName(da.augmenter)
+}
+
+// visit asks the wrapped Augmenter for the value of the old name of a flag.
+func (da *DeprecationAugmenter) visit(namespace string, dep Deprecation, target Flag, conflict bool) (bool, error) {
+	df := &deprecatedFlag{
+		Deprecation: dep,
+		namespace:   namespace,
+		flag:        &recordingFlag{name: dep.Name, target: target},
+		conflict:    conflict,
+	}
+	found, err := da.augmenter.VisitFlag(namespace, df.flag)
+	if found {
+		da.visited = append(da.visited, df)
+	}
+	return found, err
+}
+
+// VisitCommand implements the VisitCommand interface of Augmenter, by forwarding it to the wrapped Augmenter.
+func (da *DeprecationAugmenter) VisitCommand(namespace string, command Command) (bool, error) {
+	return da.augmenter.VisitCommand(namespace, command)
+}
+
+// VisitFlag implements the VisitFlag interface of Augmenter.
+//
+// The first time a namespace is visited, the wrapped Augmenter is also asked for
+// the value of the flags removed from the namespace.
+func (da *DeprecationAugmenter) VisitFlag(namespace string, flag Flag) (bool, error) {
+	var errs []error
+	if !da.probed[namespace] {
+		da.probed[namespace] = true
+		for _, dep := range da.removed[namespace] {
+			if _, err := da.visit(namespace, dep, nil, false); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	found, err := da.augmenter.VisitFlag(namespace, flag)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, dep := range da.renamed[namespace][flag.Name()] {
+		ofound, err := da.visit(namespace, dep, flag, found)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		found = found || ofound
+	}
+	return found, multierror.New(errs)
+}
+
+// Done implements the Done interface of Augmenter.
+//
+// It waits for the wrapped Augmenter to complete, and then applies, ignores,
+// or rejects the values assigned to old names of flags.
+func (da *DeprecationAugmenter) Done() error {
+	var errs []error
+	if err := da.augmenter.Done(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, df := range da.visited {
+		if !df.flag.assigned() {
+			continue
+		}
+		if err := df.resolve(da.log); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	da.visited = nil
+	return multierror.New(errs)
+}
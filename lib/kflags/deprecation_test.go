@@ -0,0 +1,84 @@
+package kflags
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeprecationAugmenter(t *testing.T) {
+	var warnings []string
+	log := &logger.DefaultLogger{Printer: func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}}
+
+	deprecations := Deprecations{}
+	deprecations.Add("test",
+		Deprecation{Name: "addr", Replacement: "address"},
+		Deprecation{Name: "port-number", Replacement: "port"},
+		Deprecation{Name: "compat"},
+	)
+	deprecations.Add("other", Deprecation{Name: "server", Replacement: "address"})
+	values := map[string]string{
+		"addr":        "127.0.0.1",
+		"port":        "8080",
+		"port-number": "9090",
+		"compat":      "true",
+		"server":      "10.0.0.1",
+	}
+	augmenter, err := NewDeprecationAugmenter(log, NewMapAugmenter(values, WithMapMangler(JoinRemap(""))), deprecations)
+	assert.Nil(t, err)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	address := fs.String("address", "localhost", "usage")
+	port := fs.String("port", "80", "usage")
+	assert.Nil(t, PopulateDefaults(fs, augmenter))
+
+	// Values of old names are applied to the new flag, unless both are set.
+	assert.Equal(t, "127.0.0.1", *address)
+	assert.Equal(t, "8080", *port)
+	assert.Equal(t, 3, len(warnings), "%v", warnings)
+	assert.Contains(t, warnings[0], "'compat' in namespace 'test' was removed")
+	assert.Contains(t, warnings[1], "'addr' in namespace 'test' was renamed to 'address'")
+	assert.Contains(t, warnings[2], "'port-number' in namespace 'test' was renamed to 'port', and values were assigned to both")
+
+	// Flags set by the user are left alone.
+	warnings = nil
+	augmenter, err = NewDeprecationAugmenter(log, NewMapAugmenter(values, WithMapMangler(JoinRemap(""))), deprecations)
+	assert.Nil(t, err)
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	address = fs.String("address", "localhost", "usage")
+	fs.String("port", "80", "usage")
+	assert.Nil(t, fs.Parse([]string{"--address=192.168.0.1"}))
+	assert.Nil(t, PopulateDefaults(fs, augmenter))
+	assert.Equal(t, "192.168.0.1", *address)
+	assert.Equal(t, 2, len(warnings), "%v", warnings)
+	assert.NotContains(t, fmt.Sprint(warnings), "'addr'")
+}
+
+func TestDeprecationAugmenterFatal(t *testing.T) {
+	deprecations := Deprecations{}
+	deprecations.Add("test",
+		Deprecation{Name: "addr", Replacement: "address", Fatal: true},
+		Deprecation{Name: "compat", Fatal: true},
+		Deprecation{Name: "unused", Fatal: true},
+	)
+	values := map[string]string{"addr": "127.0.0.1", "compat": "true"}
+	augmenter, err := NewDeprecationAugmenter(logger.Nil, NewMapAugmenter(values, WithMapMangler(JoinRemap(""))), deprecations)
+	assert.Nil(t, err)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	address := fs.String("address", "localhost", "usage")
+	err = PopulateDefaults(fs, augmenter)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'addr' in namespace 'test' was renamed to 'address' - the value assigned to 'addr' is rejected")
+	assert.Contains(t, err.Error(), "'compat' in namespace 'test' was removed")
+	assert.NotContains(t, err.Error(), "unused")
+	assert.Equal(t, "localhost", *address)
+
+	_, err = NewDeprecationAugmenter(logger.Nil, NewMapAugmenter(values, WithMapMangler(JoinRemap(""))), Deprecations{"test": {{Name: "address", Replacement: "address"}}})
+	assert.NotNil(t, err)
+}
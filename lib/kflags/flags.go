@@ -1,6 +1,8 @@
 package kflags
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"time"
 )
@@ -21,6 +23,37 @@ type FlagSet interface {
 	IntVar(p *int, name string, value int, usage string)
 }
 
+// ShorthandFlagSet is implemented by the flag sets supporting single letter shorthands, like pflag.FlagSet.
+//
+// Code registering flags can check if the FlagSet supports it with a type assertion, and fall back
+// to the long names only otherwise.
+type ShorthandFlagSet interface {
+	FlagSet
+
+	BoolVarP(p *bool, name, shorthand string, value bool, usage string)
+	// CountVarP registers a flag incrementing the counter every time it is specified, like -vv.
+	CountVarP(p *int, name, shorthand string, usage string)
+}
+
+// Value is a flag.Value naming its type, usable with both the flag and pflag libraries.
+type Value interface {
+	flag.Value
+
+	// Type returns the name of the type of the value, shown in help messages by pflag.
+	Type() string
+}
+
+// ValueFlagSet is implemented by the flag sets able to register flags with a custom Value,
+// for example to reject invalid values as soon as they are parsed.
+//
+// Like for ShorthandFlagSet, code registering flags can check if the FlagSet supports it
+// with a type assertion, and fall back to the basic types otherwise.
+type ValueFlagSet interface {
+	FlagSet
+
+	ValueVar(value Value, name string, usage string)
+}
+
 // All flags have an associated Value: a boolean, a string, an integer, ...
 //
 // This is implemented by creating an object satisfying the flag.Value or pflag.Value interface, capable
@@ -69,6 +102,21 @@ func NewStatusErrorf(code int, f string, args ...interface{}) *StatusError {
 	return &StatusError{error: fmt.Errorf(f, args...), Code: code}
 }
 
+// ExitCode returns the exit value of a program terminated by err.
+//
+// This is the Code of the first StatusError wrapped in err, 1 for any other
+// error, and 0 if err is nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	return 1
+}
+
 // Wrap errors in an UsageError to indicate that the problem has been caused
 // by incorrect flags by the user, and as such, the help screen should be printed.
 type UsageError struct {
@@ -3,6 +3,7 @@ package kflags
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"path/filepath"
@@ -72,3 +73,10 @@ func TestBinaryFileDefault(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []byte(quote), dest)
 }
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, 1, ExitCode(NewUsageErrorf("invalid flag")))
+	assert.Equal(t, 100, ExitCode(NewStatusErrorf(100, "log in again")))
+	assert.Equal(t, 3, ExitCode(fmt.Errorf("wrapped - %w", NewStatusError(3, NewUsageErrorf("invalid flag")))))
+}
@@ -15,10 +15,32 @@ type FlagSet struct {
 	*pflag.FlagSet
 }
 
+var _ kflags.ShorthandFlagSet = &FlagSet{}
+var _ kflags.ShorthandFlagSet = &HiddenFlagSet{}
+var _ kflags.SecretLister = &FlagSet{}
+var _ kflags.ValueFlagSet = &FlagSet{}
+var _ kflags.ValueFlagSet = &HiddenFlagSet{}
+
 func (fs *FlagSet) ByteFileVar(p *[]byte, name string, defaultFile string, usage string, mods ...kflags.ByteFileModifier) {
 	fs.Var(kflags.NewByteFileFlag(p, defaultFile, mods...), name, usage)
 }
 
+// ValueVar implements kflags.ValueFlagSet.
+func (fs *FlagSet) ValueVar(value kflags.Value, name string, usage string) {
+	fs.Var(value, name, usage)
+}
+
+// SecretValues implements kflags.SecretLister.
+func (fs *FlagSet) SecretValues() []string {
+	var secrets []string
+	fs.VisitAll(func(fl *pflag.Flag) {
+		if value := kflags.SecretOf(fl.Value); value != "" && (&PFlag{fl}).IsSecret() {
+			secrets = append(secrets, value)
+		}
+	})
+	return secrets
+}
+
 type Command interface {
 	Execute() error
 	UsageString() string
@@ -38,7 +60,11 @@ func LogFlags(command *cobra.Command, log logger.Printer) {
 		if flag.Changed {
 			changed = fmt.Sprintf("[changed by user - original '%s']", flag.DefValue)
 		}
-		log("- flag %s value '%s' %s", name, flag.Value, changed)
+		value := flag.Value.String()
+		if (&PFlag{flag}).IsSecret() {
+			value = kflags.RedactedValue
+		}
+		log("- flag %s value '%s' %s", name, value, changed)
 	})
 }
 
@@ -161,14 +187,8 @@ func Run(root *cobra.Command, mods ...Modifier) {
 		if errors.As(err, &ue) {
 			root.Println(cmd.UsageString())
 		}
-		exit := 1
-		var se *kflags.StatusError
-		if ok := errors.As(err, &se); ok {
-			exit = se.Code
-		}
-
 		root.Printf("ERROR: %s\n", err)
-		os.Exit(exit)
+		os.Exit(kflags.ExitCode(err))
 	}
 }
 
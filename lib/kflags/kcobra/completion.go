@@ -0,0 +1,52 @@
+package kcobra
+
+import (
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/multierror"
+	"github.com/spf13/cobra"
+)
+
+// CompletionCommand is the name of the command cobra adds to generate shell completion scripts.
+const CompletionCommand = "completion"
+
+// IsCompletion returns true if argv requests a shell completion script, or the
+// completions of a partial command line, which cobra computes when the shell asks.
+//
+// Like for PopulateDefaults, argv is expected to include the path of the command.
+func IsCompletion(argv []string) bool {
+	if len(argv) < 2 {
+		return false
+	}
+	switch argv[1] {
+	case CompletionCommand, cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return true
+	}
+	return false
+}
+
+// PopulateAllCommands invokes the resolvers on root and all its sub commands, parents first.
+//
+// Commands added by the resolvers are visited as well, so the complete tree of commands
+// is known, as required to compute shell completions.
+func PopulateAllCommands(root *cobra.Command, resolvers ...kflags.Augmenter) error {
+	var errs []error
+	queue := []*cobra.Command{root}
+	for len(queue) > 0 {
+		target := queue[0]
+		queue = queue[1:]
+
+		namespace := target.Name()
+		for cursor := target.Parent(); cursor != nil; cursor = cursor.Parent() {
+			namespace = cursor.Name() + "." + namespace
+		}
+
+		ktarget := &KCommand{target}
+		for _, r := range resolvers {
+			if _, err := r.VisitCommand(namespace, ktarget); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		queue = append(queue, target.Commands()...)
+	}
+	return multierror.New(errs)
+}
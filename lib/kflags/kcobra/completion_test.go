@@ -0,0 +1,84 @@
+package kcobra
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCompletion(t *testing.T) {
+	assert.True(t, IsCompletion([]string{"enkit", "completion", "bash"}))
+	assert.True(t, IsCompletion([]string{"enkit", cobra.ShellCompRequestCmd, "astore", ""}))
+	assert.True(t, IsCompletion([]string{"enkit", cobra.ShellCompNoDescRequestCmd, ""}))
+	assert.False(t, IsCompletion([]string{"enkit", "astore", "completion"}))
+	assert.False(t, IsCompletion([]string{"enkit"}))
+	assert.False(t, IsCompletion(nil))
+}
+
+// addingAugmenter adds a sub command named after each namespace in the map.
+type addingAugmenter map[string]string
+
+func (aa addingAugmenter) VisitCommand(ns string, command kflags.Command) (bool, error) {
+	name, found := aa[ns]
+	if !found {
+		return false, nil
+	}
+	return true, command.(kflags.Commander).AddCommand(kflags.CommandDefinition{Name: name, Short: "Added " + name}, []kflags.FlagDefinition{{Name: name + "-flag"}}, nil)
+}
+
+func (aa addingAugmenter) VisitFlag(namespace string, flag kflags.Flag) (bool, error) {
+	return false, nil
+}
+
+func (aa addingAugmenter) Done() error {
+	return nil
+}
+
+func TestPopulateCommandsCompletion(t *testing.T) {
+	augmenter := addingAugmenter{
+		"root":                  "deploy",
+		"root.user.add":         "justice",
+		"root.user.add.justice": "truth",
+	}
+
+	// Without completion, only the commands on the path of argv are visited.
+	fc := CreateFakeCommand()
+	fr := &MockAugmenter{}
+	assert.Nil(t, PopulateCommands(fc.Root, []string{"argv-0", "artifact", "upload"}, fr, augmenter))
+	found, _, err := fc.Root.Find([]string{"user", "add", "justice"})
+	assert.Nil(t, err)
+	assert.Equal(t, "add", found.Name())
+	assert.Equal(t, 1, len(fr.lcs))
+
+	// When completing, all the commands are visited, including those just added.
+	fc = CreateFakeCommand()
+	fr = &MockAugmenter{}
+	argv := []string{"argv-0", cobra.ShellCompNoDescRequestCmd, "user", "add", "justice", ""}
+	assert.Nil(t, PopulateCommands(fc.Root, argv, augmenter, fr))
+	var visited []string
+	for _, lc := range fr.lcs {
+		visited = append(visited, lc.ns)
+	}
+	assert.Equal(t, []string{
+		"root",
+		"root.artifact", "root.deploy", "root.login", "root.user",
+		"root.artifact.download", "root.artifact.upload", "root.user.add", "root.user.del",
+		"root.user.add.justice", "root.user.add.system",
+		"root.user.add.justice.truth",
+	}, visited)
+
+	// And cobra can complete them.
+	output := &bytes.Buffer{}
+	fc.Root.SetOut(output)
+	fc.Root.SetArgs(argv[1:])
+	assert.Nil(t, fc.Root.Execute())
+	assert.Contains(t, output.String(), "truth\n")
+
+	output.Reset()
+	fc.Root.SetArgs([]string{cobra.ShellCompNoDescRequestCmd, "de"})
+	assert.Nil(t, fc.Root.Execute())
+	assert.Contains(t, output.String(), "deploy\n")
+}
@@ -3,9 +3,12 @@ package kcobra
 import (
 	"fmt"
 	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/logger"
 	"github.com/System233/enkit/lib/multierror"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"strconv"
+	"time"
 )
 
 type PFlag struct {
@@ -21,7 +24,7 @@ func (pf *PFlag) Set(value string) error {
 	if err != nil {
 		return err
 	}
-	pf.Flag.DefValue = value
+	pf.setDefault(value)
 	return nil
 }
 
@@ -30,7 +33,133 @@ func (pf *PFlag) SetContent(origin string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	pf.Flag.DefValue = def
+	pf.setDefault(def)
+	return nil
+}
+
+// setDefault updates the default shown in help messages, unless the flag holds a secret.
+func (pf *PFlag) setDefault(value string) {
+	if value != "" && pf.IsSecret() {
+		value = kflags.RedactedValue
+	}
+	pf.Flag.DefValue = value
+}
+
+// SecretAnnotation is the annotation of a pflag.Flag marking it as holding a secret.
+//
+// Use MarkSecret to configure it.
+const SecretAnnotation = "kflags_secret"
+
+// IsSecret implements kflags.SecretFlag, true if the flag was marked as secret,
+// or its value implements kflags.SecretValue.
+func (pf *PFlag) IsSecret() bool {
+	if _, ok := pf.Flag.Value.(kflags.SecretValue); ok {
+		return true
+	}
+	return len(pf.Flag.Annotations[SecretAnnotation]) > 0
+}
+
+// MarkSecret implements kflags.SecretFlag.
+func (pf *PFlag) MarkSecret() {
+	if pf.Flag.Annotations == nil {
+		pf.Flag.Annotations = map[string][]string{}
+	}
+	pf.Flag.Annotations[SecretAnnotation] = []string{"true"}
+	if pf.Flag.DefValue != "" {
+		pf.Flag.DefValue = kflags.RedactedValue
+	}
+}
+
+// UserSet implements kflags.UserSetter, true if the flag was parsed from the command line.
+func (pf *PFlag) UserSet() bool {
+	return pf.Flag.Changed
+}
+
+// MaxValueSizeAnnotation is the annotation of a pflag.Flag storing the largest value Augmenters can assign to it.
+//
+// Use SetMaxValueSize to configure it.
+const MaxValueSizeAnnotation = "kflags_max_value_size"
+
+// SetMaxValueSize configures the largest value, in bytes, Augmenters can assign to the flag name.
+//
+// 0 means kflags.DefaultMaxValueSize, a negative value disables the limit.
+func SetMaxValueSize(set *pflag.FlagSet, name string, size int) error {
+	return set.SetAnnotation(name, MaxValueSizeAnnotation, []string{strconv.Itoa(size)})
+}
+
+// MaxValueSize implements kflags.ValueSizeLimiter, based on the limit configured with SetMaxValueSize,
+// or by the pflag.Value.
+func (pf *PFlag) MaxValueSize() int {
+	if values := pf.Flag.Annotations[MaxValueSizeAnnotation]; len(values) > 0 {
+		if size, err := strconv.Atoi(values[0]); err == nil {
+			return size
+		}
+	}
+	return kflags.ValueMaxSize(pf.Flag.Value)
+}
+
+// addFlag creates a pflag of the type of the FlagDefinition.
+//
+// Flags of unknown type are created as string flags, so commands defined
+// by newer configs can still be used. Secret string flags hold a kflags.SecretString.
+func addFlag(set *pflag.FlagSet, flag kflags.FlagDefinition) error {
+	invalid := func(err error) error {
+		return fmt.Errorf("flag %s: invalid default '%s' for type %s - %w", flag.Name, flag.Default, flag.Type, err)
+	}
+
+	switch flag.Type {
+	case kflags.FlagTypeBool:
+		value := false
+		if flag.Default != "" {
+			var err error
+			if value, err = strconv.ParseBool(flag.Default); err != nil {
+				return invalid(err)
+			}
+		}
+		set.Bool(flag.Name, value, flag.Help)
+
+	case kflags.FlagTypeInt:
+		value := 0
+		if flag.Default != "" {
+			var err error
+			if value, err = strconv.Atoi(flag.Default); err != nil {
+				return invalid(err)
+			}
+		}
+		set.Int(flag.Name, value, flag.Help)
+
+	case kflags.FlagTypeDuration:
+		value := time.Duration(0)
+		if flag.Default != "" {
+			var err error
+			if value, err = time.ParseDuration(flag.Default); err != nil {
+				return invalid(err)
+			}
+		}
+		set.Duration(flag.Name, value, flag.Help)
+
+	case kflags.FlagTypeStringSlice:
+		value, err := kflags.ParseStringSlice(flag.Default)
+		if err != nil {
+			return invalid(err)
+		}
+		set.StringSlice(flag.Name, value, flag.Help)
+
+	default:
+		if !flag.Type.Valid() {
+			logger.Go.Warnf("flag %s: unknown type '%s', valid types are %v - treating it as a string", flag.Name, flag.Type, kflags.FlagTypes)
+		}
+		if flag.Secret {
+			value := kflags.SecretString(flag.Default)
+			set.Var(&value, flag.Name, flag.Help)
+		} else {
+			set.String(flag.Name, flag.Default, flag.Help)
+		}
+	}
+
+	if flag.Secret {
+		(&PFlag{set.Lookup(flag.Name)}).MarkSecret()
+	}
 	return nil
 }
 
@@ -55,11 +184,18 @@ func (kc *KCommand) AddCommand(def kflags.CommandDefinition, flags []kflags.Flag
 	flargs := []kflags.FlagArg{}
 	set := command.PersistentFlags()
 	for ix, flag := range flags {
-		set.String(flag.Name, flag.Default, flag.Help)
+		if err := addFlag(set, flag); err != nil {
+			return err
+		}
 		fdef := set.Lookup(flag.Name)
 		if fdef == nil {
 			return fmt.Errorf("internal error: the flag %s was just created, and yet does not exist - nil was returned", flag.Name)
 		}
+		if flag.MaxSize != 0 {
+			if err := SetMaxValueSize(set, flag.Name, flag.MaxSize); err != nil {
+				return err
+			}
+		}
 
 		flargs = append(flargs, kflags.FlagArg{
 			FlagDefinition: &flags[ix],
@@ -108,7 +244,15 @@ func PopulateDefaults(root *cobra.Command, args []string, resolvers ...kflags.Au
 	return multierror.New(errs)
 }
 
+// PopulateCommands invokes the resolvers on the commands that would be run given args,
+// so they can add sub commands.
+//
+// When args request shell completions, see IsCompletion, the resolvers are invoked on
+// all the commands instead, with PopulateAllCommands.
 func PopulateCommands(root *cobra.Command, args []string, resolvers ...kflags.Augmenter) error {
+	if IsCompletion(args) {
+		return PopulateAllCommands(root, resolvers...)
+	}
 	if len(args) >= 1 {
 		args = args[1:]
 	}
@@ -202,7 +346,7 @@ func PopulateFlagDefaults(root *cobra.Command, args []string, resolvers ...kflag
 		}
 
 		seen[flag.Name] = struct{}{}
-		if _, err := r.VisitFlag(namespace, &PFlag{flag}); err != nil {
+		if _, err := r.VisitFlag(namespace, kflags.LimitFlag(&PFlag{flag}, kflags.AugmenterName(r))); err != nil {
 			errs = append(errs, err)
 			return
 		}
@@ -1,11 +1,14 @@
 package kcobra
 
 import (
+	"fmt"
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
+	"time"
 )
 
 type FakeCommand struct {
@@ -352,3 +355,155 @@ Flags:
 	assert.Equal(t, "peace", cbflags[0].Value.String())
 	assert.Equal(t, "truth", cbflags[1].Value.String())
 }
+
+func TestMaxValueSize(t *testing.T) {
+	root := &cobra.Command{Use: "root"}
+	kc := KCommand{root}
+	assert.Nil(t, kc.AddCommand(kflags.CommandDefinition{Name: "enkit"}, []kflags.FlagDefinition{
+		{Name: "small", Help: "small value", MaxSize: 4},
+		{Name: "unlimited", Help: "unlimited value", MaxSize: -1},
+		{Name: "default", Help: "default limit"},
+	}, func(flags []kflags.FlagArg, args []string) error {
+		return nil
+	}))
+	added, _, err := root.Find([]string{"enkit"})
+	assert.Nil(t, err)
+
+	set := added.PersistentFlags()
+	assert.Equal(t, 4, kflags.MaxValueSize(&PFlag{set.Lookup("small")}))
+	assert.Equal(t, -1, kflags.MaxValueSize(&PFlag{set.Lookup("unlimited")}))
+	assert.Equal(t, kflags.DefaultMaxValueSize, kflags.MaxValueSize(&PFlag{set.Lookup("default")}))
+
+	assert.Nil(t, SetMaxValueSize(set, "default", 8))
+	assert.Equal(t, 8, kflags.MaxValueSize(&PFlag{set.Lookup("default")}))
+
+	lf := kflags.LimitFlag(&PFlag{set.Lookup("small")}, "test")
+	assert.NotNil(t, lf.Set("12345"))
+	assert.Nil(t, lf.Set("1234"))
+	assert.Equal(t, "1234", set.Lookup("small").Value.String())
+}
+
+func TestAddCommandTyped(t *testing.T) {
+	root := &cobra.Command{Use: "root"}
+	var cbflags []kflags.FlagArg
+	kc := KCommand{root}
+	assert.Nil(t, kc.AddCommand(kflags.CommandDefinition{Name: "enkit"}, []kflags.FlagDefinition{
+		{Name: "verbose", Help: "verbose output", Type: kflags.FlagTypeBool},
+		{Name: "retries", Help: "number of retries", Type: kflags.FlagTypeInt, Default: "3"},
+		{Name: "timeout", Help: "how long to wait", Type: kflags.FlagTypeDuration, Default: "1m"},
+		{Name: "targets", Help: "targets to build", Type: kflags.FlagTypeStringSlice, Default: "//a,//b"},
+		{Name: "future", Help: "type not known yet", Type: "complex128", Default: "1+2i"},
+		{Name: "plain", Help: "a string", Default: "text"},
+	}, func(flags []kflags.FlagArg, args []string) error {
+		cbflags = flags
+		return nil
+	}))
+
+	added, _, err := root.Find([]string{"enkit"})
+	assert.Nil(t, err)
+	set := added.PersistentFlags()
+	assert.Equal(t, "bool", set.Lookup("verbose").Value.Type())
+	assert.Equal(t, "int", set.Lookup("retries").Value.Type())
+	assert.Equal(t, "duration", set.Lookup("timeout").Value.Type())
+	assert.Equal(t, "stringSlice", set.Lookup("targets").Value.Type())
+	assert.Equal(t, "string", set.Lookup("future").Value.Type())
+
+	// Defaults.
+	root.SetArgs([]string{"enkit"})
+	assert.Nil(t, root.Execute())
+	assert.Equal(t, 6, len(cbflags))
+	assert.Equal(t, false, cbflags[0].Get())
+	assert.Equal(t, 3, cbflags[1].Get())
+	assert.Equal(t, time.Minute, cbflags[2].Get())
+	assert.Equal(t, []string{"//a", "//b"}, cbflags[3].Get())
+	assert.Equal(t, "1+2i", cbflags[4].Get())
+	assert.Equal(t, "text", cbflags[5].Get())
+
+	// Bool flags don't need a value, slices replace the default.
+	root.SetArgs([]string{"enkit", "--verbose", "--retries", "5", "--timeout", "5s", "--targets", "//c", "--targets", "//d,//e"})
+	assert.Nil(t, root.Execute())
+	verbose, err := cbflags[0].Bool()
+	assert.Nil(t, err)
+	assert.True(t, verbose)
+	retries, err := cbflags[1].Int()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, retries)
+	timeout, err := cbflags[2].Duration()
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, timeout)
+	targets, err := cbflags[3].StringSlice()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"//c", "//d", "//e"}, targets)
+
+	root.SetArgs([]string{"enkit", "--retries", "many"})
+	assert.NotNil(t, root.Execute())
+}
+
+func TestAddCommandInvalidDefault(t *testing.T) {
+	for _, fd := range []kflags.FlagDefinition{
+		{Name: "verbose", Type: kflags.FlagTypeBool, Default: "maybe"},
+		{Name: "retries", Type: kflags.FlagTypeInt, Default: "many"},
+		{Name: "timeout", Type: kflags.FlagTypeDuration, Default: "forever"},
+		{Name: "targets", Type: kflags.FlagTypeStringSlice, Default: "\"unterminated"},
+	} {
+		kc := KCommand{&cobra.Command{Use: "root"}}
+		err := kc.AddCommand(kflags.CommandDefinition{Name: "enkit"}, []kflags.FlagDefinition{fd}, nil)
+		assert.NotNil(t, err, "%s", fd.Name)
+	}
+}
+
+func TestPFlagUserSet(t *testing.T) {
+	set := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	set.String("server", "default", "usage")
+	set.String("timeout", "1s", "usage")
+	assert.Nil(t, set.Parse([]string{"--timeout=5s"}))
+
+	server := &PFlag{set.Lookup("server")}
+	assert.Nil(t, server.Set("from-config"))
+	assert.False(t, kflags.IsUserSet(server))
+	assert.True(t, kflags.IsUserSet(&PFlag{set.Lookup("timeout")}))
+}
+
+func TestAddCommandSecret(t *testing.T) {
+	root := &cobra.Command{Use: "root"}
+	kc := KCommand{root}
+	var got []interface{}
+	assert.Nil(t, kc.AddCommand(kflags.CommandDefinition{Name: "enkit"}, []kflags.FlagDefinition{
+		{Name: "token", Help: "token to use", Default: "s3cr3t", Secret: true},
+		{Name: "retries", Help: "retries", Default: "3", Type: kflags.FlagTypeInt, Secret: true},
+		{Name: "server", Help: "server", Default: "localhost"},
+	}, func(flags []kflags.FlagArg, args []string) error {
+		for _, fl := range flags {
+			got = append(got, fl.Get())
+		}
+		return nil
+	}))
+	added, _, err := root.Find([]string{"enkit"})
+	assert.Nil(t, err)
+
+	set := added.PersistentFlags()
+	usage := set.FlagUsages()
+	assert.NotContains(t, usage, "s3cr3t")
+	assert.Contains(t, usage, kflags.RedactedValue)
+	assert.Contains(t, usage, "localhost")
+	assert.True(t, kflags.IsSecret(&PFlag{set.Lookup("retries")}))
+	assert.False(t, kflags.IsSecret(&PFlag{set.Lookup("server")}))
+
+	var logged []string
+	LogFlags(added, func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	assert.NotContains(t, strings.Join(logged, "\n"), "s3cr3t")
+
+	// Defaults assigned by Augmenters are redacted as well.
+	assert.Nil(t, (&PFlag{set.Lookup("token")}).Set("0th3r"))
+	assert.NotContains(t, set.FlagUsages(), "0th3r")
+
+	// Commands get the actual value.
+	root.SetArgs([]string{"enkit", "--retries=5"})
+	assert.Nil(t, root.Execute())
+	assert.Equal(t, []interface{}{"0th3r", 5, "localhost"}, got)
+
+	// The values of secret flags can be listed, to redact them from logs.
+	assert.ElementsMatch(t, []string{"0th3r", "5"}, (&FlagSet{FlagSet: set}).SecretValues())
+}
@@ -17,6 +17,16 @@ func (hfs *HiddenFlagSet) Hide(name string) {
 	hfs.flags = append(hfs.flags, name)
 }
 
+// ValueVar implements kflags.ValueFlagSet.
+func (hfs *HiddenFlagSet) ValueVar(value kflags.Value, name string, usage string) {
+	hfs.inner.ValueVar(value, name, usage)
+}
+
+// SecretValues implements kflags.SecretLister.
+func (hfs *HiddenFlagSet) SecretValues() []string {
+	return hfs.inner.SecretValues()
+}
+
 func (hfs *HiddenFlagSet) BoolVar(p *bool, name string, value bool, usage string) {
 	hfs.inner.BoolVar(p, name, value, usage)
 	hfs.Hide(name)
@@ -42,6 +52,14 @@ func (hfs *HiddenFlagSet) IntVar(p *int, name string, value int, usage string) {
 	hfs.Hide(name)
 }
 
+// Flags with a shorthand are meant to be commonly used, and are not hidden.
+func (hfs *HiddenFlagSet) BoolVarP(p *bool, name, shorthand string, value bool, usage string) {
+	hfs.inner.BoolVarP(p, name, shorthand, value, usage)
+}
+func (hfs *HiddenFlagSet) CountVarP(p *int, name, shorthand string, usage string) {
+	hfs.inner.CountVarP(p, name, shorthand, usage)
+}
+
 func (hfs *HiddenFlagSet) Help(cmd *cobra.Command, args []string) bool {
 	if !hfs.showHidden {
 		return true
@@ -0,0 +1,158 @@
+package kcobra
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Plugin is an external executable implementing a sub command.
+type Plugin struct {
+	// Name of the sub command, for example "deploy" for an executable "enkit-deploy".
+	Name string
+	// Path of the executable.
+	Path string
+}
+
+// PluginEnv returns the environment variables to pass to a plugin, in "KEY=value" format.
+//
+// It is invoked when the plugin is run, after the flags have been parsed.
+type PluginEnv func() []string
+
+// PluginDirs returns the directories to look for plugins in: dirs, followed by the
+// directories in the PATH environment variable.
+func PluginDirs(dirs ...string) []string {
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// FindPlugins returns the executables named prefix<name> in the specified directories.
+//
+// Like for commands in PATH, executables in earlier directories take precedence.
+// Directories that cannot be read are skipped.
+func FindPlugins(prefix string, dirs []string) []Plugin {
+	var plugins []Plugin
+	seen := map[string]struct{}{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := strings.TrimPrefix(entry.Name(), prefix)
+			if name == entry.Name() || name == "" || strings.HasPrefix(name, "-") {
+				continue
+			}
+			if _, found := seen[name]; found {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			// Follow symlinks, and skip directories and non executable files.
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+				continue
+			}
+
+			seen[name] = struct{}{}
+			plugins = append(plugins, Plugin{Name: name, Path: path})
+		}
+	}
+	return plugins
+}
+
+// AddPlugins adds a sub command to root for each plugin.
+//
+// Plugins with the same name as a command already defined are skipped, with a warning.
+func AddPlugins(root *cobra.Command, plugins []Plugin, env PluginEnv, log logger.Logger) {
+	for _, plugin := range plugins {
+		if existing, _, err := root.Find([]string{plugin.Name}); err == nil && existing != root {
+			log.Warnf("plugin %s ignored - there is already a %s command built in", plugin.Path, plugin.Name)
+			continue
+		}
+		root.AddCommand(NewPluginCommand(plugin, env))
+	}
+}
+
+// NewPluginCommand returns a cobra.Command running the plugin.
+//
+// Flags of the parent commands right after the name of the plugin are parsed, the
+// remaining arguments are passed to the plugin as is. Use "--" to pass all the
+// following arguments to the plugin.
+//
+// If the plugin fails, the error returned is a kflags.StatusError with the exit code of the plugin.
+func NewPluginCommand(plugin Plugin, env PluginEnv) *cobra.Command {
+	return &cobra.Command{
+		Use:                plugin.Name + " [args]...",
+		Short:              fmt.Sprintf("External command, implemented by %s", plugin.Path),
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			set := cmd.InheritedFlags()
+			parsed, args := splitFlags(set, args)
+			if err := set.Parse(parsed); err != nil {
+				return kflags.NewUsageError(err)
+			}
+
+			command := exec.Command(plugin.Path, args...)
+			command.Env = os.Environ()
+			if env != nil {
+				command.Env = append(command.Env, env()...)
+			}
+			command.Stdin = os.Stdin
+			command.Stdout = cmd.OutOrStdout()
+			command.Stderr = cmd.ErrOrStderr()
+
+			err := command.Run()
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				return kflags.NewStatusError(exit.ExitCode(), fmt.Errorf("plugin %s exited with status %d", plugin.Path, exit.ExitCode()))
+			}
+			if err != nil {
+				return fmt.Errorf("could not run plugin %s - %w", plugin.Path, err)
+			}
+			return nil
+		},
+	}
+}
+
+// splitFlags returns the leading arguments that are flags in set, and the remaining arguments.
+func splitFlags(set *pflag.FlagSet, args []string) ([]string, []string) {
+	for ix := 0; ix < len(args); ix++ {
+		arg := args[ix]
+		if arg == "--" {
+			return args[:ix], args[ix+1:]
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return args[:ix], args[ix:]
+		}
+
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		var flag *pflag.Flag
+		if strings.HasPrefix(arg, "--") {
+			flag = set.Lookup(name)
+		} else if len(name) == 1 {
+			flag = set.ShorthandLookup(name)
+		}
+		if flag == nil {
+			return args[:ix], args[ix:]
+		}
+		if !hasValue && flag.NoOptDefVal == "" {
+			ix++
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,99 @@
+package kcobra
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePlugin creates an executable script in dir.
+func writePlugin(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+	return path
+}
+
+func TestFindPlugins(t *testing.T) {
+	first, err := ioutil.TempDir("", "plugins")
+	assert.Nil(t, err)
+	defer os.RemoveAll(first)
+	second, err := ioutil.TempDir("", "plugins")
+	assert.Nil(t, err)
+	defer os.RemoveAll(second)
+
+	deploy := writePlugin(t, first, "enkit-deploy", "exit 0")
+	writePlugin(t, second, "enkit-deploy", "exit 1")
+	lint := writePlugin(t, second, "enkit-lint", "exit 0")
+	// Not plugins: not executable, directories, or not matching the prefix.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(first, "enkit-readme"), []byte("hello"), 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(first, "enkit-dir"), 0755))
+	writePlugin(t, first, "enkit-", "exit 0")
+	writePlugin(t, first, "other-tool", "exit 0")
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", second+string(os.PathListSeparator)+"/does/not/exist")
+
+	plugins := FindPlugins("enkit-", PluginDirs(first))
+	assert.Equal(t, []Plugin{{Name: "deploy", Path: deploy}, {Name: "lint", Path: lint}}, plugins)
+}
+
+func TestPluginCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	plugins := []Plugin{
+		{Name: "env", Path: writePlugin(t, dir, "enkit-env", `echo "$ENKIT_IDENTITY $@" > `+out)},
+		{Name: "fail", Path: writePlugin(t, dir, "enkit-fail", "exit 42")},
+		{Name: "login", Path: writePlugin(t, dir, "enkit-login", "exit 0")},
+	}
+
+	identity := "default@enkit.net"
+	root := &cobra.Command{Use: "enkit", SilenceUsage: true, SilenceErrors: true}
+	root.PersistentFlags().StringVarP(&identity, "identity", "i", identity, "identity")
+	root.PersistentFlags().Bool("verbose", false, "verbose")
+	root.AddCommand(&cobra.Command{Use: "login", RunE: func(*cobra.Command, []string) error { return nil }})
+
+	log := &logger.DefaultLogger{Printer: func(string, ...interface{}) {}}
+	AddPlugins(root, plugins, func() []string { return []string{"ENKIT_IDENTITY=" + identity} }, log)
+
+	// Built in commands cannot be replaced by plugins.
+	login, _, err := root.Find([]string{"login"})
+	assert.Nil(t, err)
+	assert.Nil(t, login.RunE(login, nil))
+	assert.Equal(t, 3, len(root.Commands()))
+
+	run := func(args ...string) error {
+		root.SetArgs(args)
+		root.SetOut(&bytes.Buffer{})
+		return root.Execute()
+	}
+	// Flags of enkit before the plugin arguments are parsed, and passed via the environment.
+	assert.Nil(t, run("--verbose", "env", "-i", "user@enkit.net", "--verbose", "--force", "target", "--identity", "x"))
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "user@enkit.net --force target --identity x\n", string(data))
+
+	assert.Nil(t, run("env", "--", "--identity", "x"))
+	data, err = ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "user@enkit.net --identity x\n", string(data))
+
+	err = run("fail", "arg")
+	var se *kflags.StatusError
+	assert.True(t, errors.As(err, &se), "%v", err)
+	assert.Equal(t, 42, se.Code)
+
+	err = run("env", "--identity")
+	var ue *kflags.UsageError
+	assert.True(t, errors.As(err, &ue), "%v", err)
+}
@@ -1,12 +1,11 @@
 package kconfig
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"github.com/System233/enkit/lib/cache"
 	"github.com/System233/enkit/lib/config/marshal"
 	"github.com/System233/enkit/lib/karchive"
 	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/khttp/downloader"
 	"github.com/System233/enkit/lib/khttp/kcache"
 	"github.com/System233/enkit/lib/khttp/protocol"
 	"github.com/System233/enkit/lib/logger"
@@ -15,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -58,16 +58,20 @@ func (cr *CommandRetriever) PrepareHash(url, hash string) (string, error) {
 			}
 			defer cr.cache.Rollback(unpack)
 
-			h := sha256.New()
-			r := io.TeeReader(httpr, h)
+			// The package is hashed while it is unpacked, and only committed if it matches.
+			// Packages larger than the maximum size of the downloader are aborted mid-stream.
+			verifier := downloader.NewVerifier(-1, hash)
+			r := io.TeeReader(httpr, verifier)
 			err = karchive.Untarz(url, r, unpack, karchive.WithFileUmask(0222))
 			if err != nil {
 				return fmt.Errorf("error decompressing %s: %w", url, err)
 			}
-
-			computed := hex.EncodeToString(h.Sum(nil))
-			if hash != computed {
-				return fmt.Errorf("computed sha256 for %s is %s - required is %s - REJECTED", url, computed, hash)
+			// Untarz may stop at the end of the archive, before the end of the stream.
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				return fmt.Errorf("error reading %s: %w", url, err)
+			}
+			if _, err := verifier.Finish(); err != nil {
+				return fmt.Errorf("retrieving %s - %w - REJECTED", url, err)
 			}
 
 			unpack, err = cr.cache.Commit(unpack)
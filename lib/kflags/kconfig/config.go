@@ -55,6 +55,28 @@ type ConfigAugmenter struct {
 	// getAugmenter will automatically wait for the file to be downloaded
 	// the first time it is actually needed.
 	resolver []resolver
+
+	// Applies the deprecations declared in the config file to the flags
+	// visited through the resolvers above.
+	deprecations *kflags.DeprecationAugmenter
+}
+
+// resolvers implements the kflags.Augmenter interface on top of the resolvers
+// of a ConfigAugmenter, without handling deprecations.
+type resolvers struct {
+	cr *ConfigAugmenter
+}
+
+func (r resolvers) VisitCommand(namespace string, command kflags.Command) (bool, error) {
+	return r.cr.VisitCommand(namespace, command)
+}
+
+func (r resolvers) VisitFlag(namespace string, flag kflags.Flag) (bool, error) {
+	return r.cr.visitFlag(namespace, flag)
+}
+
+func (r resolvers) Done() error {
+	return r.cr.done()
 }
 
 // Parse unmarshals a blob of bytes retrieved from a file or URL into a Config object.
@@ -135,6 +157,9 @@ type options struct {
 
 	blocklist      *SeenStack
 	recursionLimit int
+
+	// Base64 encoded ed25519 public keys. If any, configs must be signed by one of them.
+	publicKeys []string
 }
 
 func DefaultOptions() *options {
@@ -224,6 +249,19 @@ func WithMangler(mangler kflags.VarMangler) Modifier {
 	}
 }
 
+// WithPublicKeys requires the configs retrieved to be signed by one of the keys.
+//
+// Keys are base64 encoded ed25519 public keys. The signature of a config is retrieved
+// from the URL of the config followed by SignatureExtension. Configs not signed, or
+// with an invalid signature, are rejected. Packages implementing commands are only
+// retrieved if the config specifies their hash.
+func WithPublicKeys(keys ...string) Modifier {
+	return func(o *options) error {
+		o.publicKeys = append(o.publicKeys, keys...)
+		return nil
+	}
+}
+
 func WithLogger(l logger.Logger) Modifier {
 	return func(o *options) error {
 		o.log = l
@@ -243,6 +281,7 @@ type Flags struct {
 	Downloader     *downloader.Flags
 	DNS            *remote.DNSFlags
 	RecursionLimit int
+	PublicKeys     []string
 }
 
 func DefaultFlags() *Flags {
@@ -267,6 +306,7 @@ func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	fl.DNS.Register(set, prefix+"kflags-")
 
 	set.IntVar(&fl.RecursionLimit, prefix+"kflags-recursion-limit", options.recursionLimit, "How many nested includes to process at most")
+	set.StringArrayVar(&fl.PublicKeys, prefix+"kflags-public-key", fl.PublicKeys, "Base64 encoded ed25519 public key trusted to sign configs - if any key is specified, configs without a valid signature are rejected")
 	return fl
 }
 
@@ -278,6 +318,7 @@ func FromFlags(fl *Flags) Modifier {
 		o.dlo = append(o.dlo, downloader.FromFlags(fl.Downloader))
 		o.dnso = append(o.dnso, remote.FromDNSFlags(fl.DNS))
 		o.recursionLimit = fl.RecursionLimit
+		o.publicKeys = append(o.publicKeys, fl.PublicKeys...)
 		return nil
 	}
 }
@@ -394,7 +435,10 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 	if options.blocklist == nil {
 		options.blocklist = NewSeenStack()
 	}
-	var err error
+	keys, err := ParsePublicKeys(options.publicKeys)
+	if err != nil {
+		return nil, err
+	}
 	if options.dl == nil {
 		options.dl, err = downloader.New(options.dlo...)
 		if err != nil {
@@ -417,7 +461,12 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 		options.commandfactory = NewCommandRetriever(options.log, cs, options.dl.Retrier(), options.dl.ProtocolModifiers()...).Retrieve
 	}
 
-	namespace, err := NewNamespaceAugmenter(baseURL, config.Namespace, options.log, options.mangler, options.commandfactory, options.paramfactory)
+	commandfactory := options.commandfactory
+	if len(keys) > 0 {
+		commandfactory = RequireHash(commandfactory)
+	}
+
+	namespace, err := NewNamespaceAugmenter(baseURL, config.Namespace, options.log, options.mangler, commandfactory, options.paramfactory)
 	if err != nil {
 		return nil, err
 	}
@@ -425,6 +474,14 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 	cr := &ConfigAugmenter{
 		resolver: make([]resolver, len(config.Include)+1),
 	}
+	deprecations := kflags.Deprecations{}
+	for _, ns := range config.Namespace {
+		deprecations.Add(ns.Name, ns.Deprecated...)
+	}
+	cr.deprecations, err = kflags.NewDeprecationAugmenter(options.log, resolvers{cr}, deprecations)
+	if err != nil {
+		return nil, err
+	}
 
 	// When visiting flags, the last include takes priority.
 	//
@@ -457,7 +514,7 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 		}
 
 		cr.resolver[offset].cond = sync.NewCond(&cr.lock)
-		options.dl.Get(url, protocol.Read(protocol.Callback(func(data []byte) error {
+		load := func(data []byte) error {
 			config, err := Parse(url, data)
 
 			// TODO: we could easily implement an error type that causes WithCache (if used) to retry with the stale data.
@@ -484,7 +541,8 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 			cr.resolver[offset].instance = ncr
 			cr.resolver[offset].cond.Signal()
 			return nil
-		})), workpool.ErrorCallback(func(err error) {
+		}
+		eh := workpool.ErrorCallback(func(err error) {
 			cr.lock.Lock()
 			defer cr.lock.Unlock()
 
@@ -493,7 +551,14 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 			}
 			cr.resolver[offset].err = err
 			cr.resolver[offset].cond.Signal()
-		}), append([]downloader.Modifier{downloader.WithProtocolOptions(kcache.WithCache(cs))}, options.getOptions...)...)
+		})
+		mods := append([]downloader.Modifier{downloader.WithProtocolOptions(kcache.WithCache(cs))}, options.getOptions...)
+
+		if len(keys) > 0 {
+			getSigned(options.dl, url, keys, load, eh, mods...)
+		} else {
+			options.dl.Get(url, protocol.Read(protocol.Callback(load)), eh, mods...)
+		}
 	}
 	return cr, multierror.New(errs)
 }
@@ -516,7 +581,15 @@ func (cr *ConfigAugmenter) VisitCommand(namespace string, command kflags.Command
 	return false, nil
 }
 
+// VisitFlag implements the VisitFlag interface of kflags.Augmenter.
+//
+// Values assigned to the old names of flags declared as deprecated in the config
+// are applied, ignored, or rejected when Done is invoked.
 func (cr *ConfigAugmenter) VisitFlag(ns string, flag kflags.Flag) (bool, error) {
+	return cr.deprecations.VisitFlag(ns, flag)
+}
+
+func (cr *ConfigAugmenter) visitFlag(ns string, flag kflags.Flag) (bool, error) {
 	for ix := range cr.resolver {
 		resolver, err := cr.getAugmenter(ix)
 		if err != nil {
@@ -566,6 +639,10 @@ func (cr *ConfigAugmenter) getAugmenter(ix int) (kflags.Augmenter, error) {
 // It recursively invokes the Done method of the augmenters that have been **used**.
 // It does NOT wait for augmenters that have NOT been used, even if configured.
 func (cr *ConfigAugmenter) Done() error {
+	return cr.deprecations.Done()
+}
+
+func (cr *ConfigAugmenter) done() error {
 	cr.lock.Lock()
 	list := cr.resolver
 	cr.resolver = nil
@@ -187,3 +187,57 @@ func TestConfigAugmenter(t *testing.T) {
 	err = r.Done()
 	assert.Nil(t, err, "%s", err)
 }
+
+var jconfigDeprecated = `
+{
+  "Namespace": [{
+    "Name": "",
+    "Default": [{
+      "Name": "baz-server",
+      "Value": "7"
+    }],
+    "Deprecated": [{
+      "Name": "bar-server",
+      "Replacement": "astore-server"
+    }, {
+      "Name": "baz-server",
+      "Fatal": true
+    }]
+  }]
+}`
+
+func TestConfigAugmenterDeprecated(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	c := &cache.Local{Root: tempdir}
+	dl, err := downloader.New()
+	assert.Nil(t, err)
+
+	_, url, err := ktest.StartServer(ktest.StringHandler(jconfigAstore))
+	assert.Nil(t, err)
+
+	config, err := Parse("deprecated.json", []byte(jconfigDeprecated))
+	assert.Nil(t, err)
+	config.Include = []string{url}
+	r, err := NewConfigAugmenter(c, config, WithDownloader(dl))
+	assert.Nil(t, err)
+
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	fooserver := fs.String("foo-server", "initialf", "usage")
+	astoreserver := fs.String("astore-server", "initiala", "usage")
+
+	found, err := r.VisitFlag("", &kflags.GoFlag{Flag: fs.Lookup("foo-server")})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	found, err = r.VisitFlag("", &kflags.GoFlag{Flag: fs.Lookup("astore-server")})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "initiala", *astoreserver)
+
+	// Values of the old names, also from included configs, are applied when done.
+	err = r.Done()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'baz-server' in namespace '' was removed")
+	assert.Equal(t, "14", *fooserver)
+	assert.Equal(t, "42", *astoreserver)
+}
@@ -1,7 +1,9 @@
 package kconfig
 
 import (
+	"fmt"
 	"github.com/System233/enkit/lib/kflags"
+	"strings"
 )
 
 type EncodeAs string
@@ -20,6 +22,8 @@ type SourceFrom string
 const (
 	SourceInline SourceFrom = "inline" // The value represents a string to pass to the env or flag after encoding.
 	SourceURL               = "url"    // The value represents an http / https url to retrieve, encode, and pass as env or flag.
+	SourceFile              = "file"   // The value represents the path of a local file to read, encode, and pass as env or flag.
+	SourceDir               = "dir"    // The value represents the path of a local directory, the newest file in it is used as with SourceFile.
 	// Empty string "" defaults to inline.
 )
 
@@ -29,8 +33,29 @@ type Parameter struct {
 
 	Source   SourceFrom // Where to get the value from.
 	Encoding EncodeAs   // How to encode the value.
+	// Relative paths used with SourceFile and SourceDir are relative to the directory of the config file.
 
 	Hash string // Optional: hash of the value, uesful only when SourceURL is used.
+
+	// Optional: urls serving the same value, tried in order if Value cannot be
+	// retrieved. Useful only when SourceURL is used. Values are cached by Value.
+	Mirrors []string
+
+	// Optional: the value is a secret, like a token or password. It is never shown in
+	// help messages, errors or logs. With SourceFile and SourceDir, the file must
+	// only be accessible by its owner, like with mode 0600.
+	Secret bool
+}
+
+// GoString implements fmt.GoStringer, so the %#v used in errors does not show inline secrets.
+//
+// The Value of SourceFile and SourceDir parameters is a path, and is shown.
+func (p Parameter) GoString() string {
+	type parameter Parameter
+	if p.Secret && p.Source != SourceFile && p.Source != SourceDir {
+		p.Value = kflags.RedactedValue
+	}
+	return strings.Replace(fmt.Sprintf("%#v", parameter(p)), "kconfig.parameter", "kconfig.Parameter", 1)
 }
 
 type Namespace struct {
@@ -40,6 +65,11 @@ type Namespace struct {
 	Hidden  bool
 	Default []Parameter
 	Command []Command
+
+	// Flags of the namespace that were renamed or removed.
+	//
+	// Deprecations apply to the values assigned by this config, and by the configs it includes.
+	Deprecated []kflags.Deprecation
 }
 
 type Package struct {
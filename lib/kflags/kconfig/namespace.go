@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"text/template"
 )
@@ -28,6 +29,8 @@ type implementation struct {
 type namespaceData struct {
 	// All the flags to be retrieved to set the default of this command.
 	params paramIndex
+	// Flags set from a Parameter marked as Secret.
+	secrets map[string]bool
 	// Set of commands to be added.
 	commands []Command
 	// True if the command should be hidden.
@@ -85,8 +88,12 @@ func NewNamespaceAugmenter(base *url.URL, namespaces []Namespace, log logger.Log
 		}
 
 		pi := paramIndex{}
+		secrets := map[string]bool{}
 		for dx, def := range ns.Default {
 			params, _ := pi[def.Name]
+			if def.Secret {
+				secrets[def.Name] = true
+			}
 
 			retriever, err := pf(base, &ns.Default[dx])
 			if err != nil {
@@ -99,6 +106,7 @@ func NewNamespaceAugmenter(base *url.URL, namespaces []Namespace, log logger.Log
 		}
 		*ci.index.Get(ns.Name) = namespaceData{
 			params:   pi,
+			secrets:  secrets,
 			hidden:   ns.Hidden,
 			commands: ns.Command,
 		}
@@ -114,7 +122,15 @@ func BuildMap(vars []Var, flagarg []kflags.FlagArg) map[string]interface{} {
 		subs[v.Key] = v.Value
 	}
 	for _, v := range flagarg {
-		subs[v.Name] = v.Value.String()
+		value := v.Value.String()
+		if secret, ok := v.Value.(kflags.SecretValue); ok {
+			value = secret.Secret()
+		}
+		// Slices are exposed as comma separated values, rather than the [a,b] format of pflag.
+		if slice, ok := v.Get().([]string); ok {
+			value = strings.Join(slice, ",")
+		}
+		subs[v.Name] = value
 	}
 
 	wd, err := os.Getwd()
@@ -352,6 +368,12 @@ func (c *NamespaceAugmenter) VisitFlag(namespace string, flag kflags.Flag) (bool
 	if !found {
 		return false, nil
 	}
+	// Secrets are only assigned to flags able to hide them.
+	if nsIndex.secrets[flag.Name()] {
+		if err := kflags.MarkSecret(flag); err != nil {
+			return true, fmt.Errorf("secret parameter in %s not set: %w", namespace, err)
+		}
+	}
 
 	setter := func(origin, value string, err error) {
 		c.elock.Lock()
@@ -363,7 +385,7 @@ func (c *NamespaceAugmenter) VisitFlag(namespace string, flag kflags.Flag) (bool
 			return
 		}
 		if err := flag.SetContent(origin, []byte(value)); err != nil {
-			c.errs = append(c.errs, fmt.Errorf("could not set flag '%s', value '%s' caused %w", flag.Name(), value, err))
+			c.errs = append(c.errs, fmt.Errorf("could not set flag '%s', value %s caused %w", flag.Name(), kflags.RedactValue(flag, value), kflags.RedactError(flag, err)))
 		}
 	}
 
@@ -1,7 +1,9 @@
 package kconfig
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/System233/enkit/lib/cache"
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/khttp/downloader"
@@ -284,3 +286,107 @@ func TestAugmenter(t *testing.T) {
 	assert.Nil(t, err, "%s", err)
 	assert.True(t, found)
 }
+
+// limitedValue is a flag.Value accepting values of at most 16 bytes.
+type limitedValue struct {
+	value string
+}
+
+func (lv *limitedValue) String() string {
+	return lv.value
+}
+
+func (lv *limitedValue) Set(value string) error {
+	lv.value = value
+	return nil
+}
+
+func (lv *limitedValue) MaxValueSize() int {
+	return 16
+}
+
+func TestAugmenterLimits(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	c := &cache.Local{Root: tempdir}
+	dl, err := downloader.New()
+	assert.Nil(t, err)
+
+	_, url, err := ktest.StartServer(ktest.StringHandler("\x1b[31mthis is way too long\n"))
+	assert.Nil(t, err)
+
+	namespaces := []Namespace{
+		{
+			Default: []Parameter{
+				{
+					Name:   "remote",
+					Source: SourceURL,
+					Value:  url,
+				},
+			},
+		},
+	}
+	r, err := NewNamespaceAugmenter(nil, namespaces, nil, nil, nil, NewCreator(logger.Nil, c, dl).Create)
+	assert.Nil(t, err, "%s", err)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	value := &limitedValue{value: "initial"}
+	fs.Var(value, "remote", "usage")
+
+	found, err := r.VisitFlag("", kflags.LimitFlag(&kflags.GoFlag{Flag: fs.Lookup("remote")}, "test"))
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	derr := r.Done()
+	assert.NotNil(t, derr)
+	assert.True(t, errors.As(derr, new(*kflags.ValueTooLargeError)), "%s", derr)
+	assert.Contains(t, derr.Error(), "flag 'remote' from ")
+	assert.Contains(t, derr.Error(), `"\x1b[31mthis is way too long\n"`)
+	assert.Equal(t, "initial", value.value)
+}
+
+func TestAugmenterSecret(t *testing.T) {
+	namespaces := []Namespace{
+		{
+			Default: []Parameter{
+				{Name: "token", Value: "s3cr3t", Secret: true},
+				{Name: "port", Value: "p0rt-s3cr3t", Secret: true},
+			},
+		},
+	}
+	r, err := NewNamespaceAugmenter(nil, namespaces, nil, nil, nil, NewCreator(logger.Nil, nil, nil).Create)
+	assert.Nil(t, err, "%s", err)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	token := fs.String("token", "", "usage")
+	fs.Int("port", 8080, "usage")
+
+	found, err := r.VisitFlag("", &kflags.GoFlag{Flag: fs.Lookup("token")})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	found, err = r.VisitFlag("", &kflags.GoFlag{Flag: fs.Lookup("port")})
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	// The value is set, but never shown.
+	derr := r.Done()
+	assert.NotNil(t, derr)
+	assert.Contains(t, derr.Error(), "'port'")
+	assert.NotContains(t, derr.Error(), "s3cr3t")
+	assert.Equal(t, "s3cr3t", *token)
+	assert.Equal(t, kflags.RedactedValue, fs.Lookup("token").DefValue)
+
+	// Nor in errors describing the parameter.
+	assert.NotContains(t, fmt.Sprintf("%#v", namespaces[0].Default[0]), "s3cr3t")
+	assert.Contains(t, fmt.Sprintf("%#v", namespaces[0].Default[0]), "kconfig.Parameter{Name:\"token\"")
+
+	// Secrets are not assigned to flags unable to hide them.
+	namespaces = []Namespace{{Default: []Parameter{{Name: "server", Value: "s3cr3t", Secret: true}}}}
+	r, err = NewNamespaceAugmenter(nil, namespaces, nil, nil, nil, NewCreator(logger.Nil, nil, nil).Create)
+	assert.Nil(t, err, "%s", err)
+	server := &opaqueFlag{}
+	_, err = r.VisitFlag("", server)
+	assert.NotNil(t, err)
+	assert.Nil(t, r.Done())
+	assert.Equal(t, "", server.value)
+}
@@ -0,0 +1,299 @@
+package kconfig
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/logger"
+)
+
+// AugmenterFactory creates a new Augmenter, generally by fetching the config again.
+//
+// For example, a factory can wrap NewConfigAugmenterFromURL or NewConfigAugmenterFromDNS:
+// by reusing the same cache.Store, the downloads honor the HTTP caching headers
+// returned by the server, and unchanged configs are not downloaded again.
+type AugmenterFactory func() (kflags.Augmenter, error)
+
+// Change describes a flag whose default changed in the config since it was last fetched.
+type Change struct {
+	Namespace string
+	Flag      string
+
+	// Origin and Value are the origin and content the Augmenter assigned to the
+	// flag, in the same format passed to kflags.Flag.SetContent.
+	Origin string
+	Value  string
+
+	tracked *trackedFlag
+}
+
+// Apply assigns the new value to the flag.
+//
+// Flags explicitly set by the user are never changed, an error is returned instead.
+// The caller is responsible for ensuring that the flag is not read concurrently.
+func (c *Change) Apply() error {
+	return c.tracked.apply(c.Origin, c.Value)
+}
+
+// ChangeCallback is invoked by a Refresher with the flags whose default changed.
+//
+// Flags are not modified until Apply is invoked on the corresponding Change.
+type ChangeCallback func(changes []*Change)
+
+// trackedValue is a value assigned by an Augmenter to a flag.
+type trackedValue struct {
+	set    bool
+	origin string
+	value  string
+}
+
+// trackedFlag is a flag the Refresher was asked to populate.
+type trackedFlag struct {
+	namespace string
+	flag      kflags.Flag
+
+	lock sync.Mutex
+	// Last value fetched from the config, to compare newly fetched values against.
+	seen trackedValue
+}
+
+func (tf *trackedFlag) Name() string {
+	return tf.flag.Name()
+}
+
+func (tf *trackedFlag) Set(value string) error {
+	return tf.SetContent("", []byte(value))
+}
+
+func (tf *trackedFlag) SetContent(origin string, data []byte) error {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	if err := tf.flag.SetContent(origin, data); err != nil {
+		return err
+	}
+	tf.seen = trackedValue{set: true, origin: origin, value: string(data)}
+	return nil
+}
+
+func (tf *trackedFlag) MaxValueSize() int {
+	return kflags.MaxValueSize(tf.flag)
+}
+
+func (tf *trackedFlag) UserSet() bool {
+	return kflags.IsUserSet(tf.flag)
+}
+
+func (tf *trackedFlag) IsSecret() bool {
+	return kflags.IsSecret(tf.flag)
+}
+
+func (tf *trackedFlag) MarkSecret() {
+	kflags.MarkSecret(tf.flag)
+}
+
+func (tf *trackedFlag) apply(origin, value string) error {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	if kflags.IsUserSet(tf.flag) {
+		return fmt.Errorf("flag '%s' in %s was set by the user - not changing it", tf.flag.Name(), tf.namespace)
+	}
+	return tf.flag.SetContent(origin, []byte(value))
+}
+
+// probeFlag collects the value an Augmenter assigns to a flag, without changing the flag.
+type probeFlag struct {
+	tracked *trackedFlag
+
+	lock  sync.Mutex
+	value trackedValue
+}
+
+func (pf *probeFlag) Name() string {
+	return pf.tracked.Name()
+}
+
+func (pf *probeFlag) Set(value string) error {
+	return pf.SetContent("", []byte(value))
+}
+
+func (pf *probeFlag) SetContent(origin string, data []byte) error {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	pf.value = trackedValue{set: true, origin: origin, value: string(data)}
+	return nil
+}
+
+func (pf *probeFlag) MaxValueSize() int {
+	return pf.tracked.MaxValueSize()
+}
+
+func (pf *probeFlag) IsSecret() bool {
+	return pf.tracked.IsSecret()
+}
+
+func (pf *probeFlag) MarkSecret() {
+	pf.tracked.MarkSecret()
+}
+
+// Refresher is an Augmenter able to periodically fetch the config again,
+// and notify the program of the flags whose default changed.
+//
+// Use it in place of the Augmenter returned by the factory to populate the flags,
+// register a callback with OnChange, and invoke Start. Only the flags the
+// Refresher was asked to populate are tracked, which excludes the flags set
+// by the user on the command line, as skipped by the populators.
+//
+// Flags are never changed directly: the callback receives a list of Change,
+// and the program decides which ones to Apply, for example to re-configure or
+// restart a subsystem. Apply refuses to change flags set by the user, or flags
+// that cannot tell, see kflags.UserSetter.
+//
+// Commands are only configured when the flags are first populated. Flags whose
+// parameter is removed from the config keep their last value. Parameters encoded
+// as files are compared by their path, not by their content.
+type Refresher struct {
+	factory AugmenterFactory
+	log     logger.Logger
+	initial kflags.Augmenter
+
+	lock      sync.Mutex
+	flags     []*trackedFlag
+	callbacks []ChangeCallback
+}
+
+// NewRefresher returns a Refresher using factory to fetch the config.
+//
+// The factory is invoked immediately, to create the Augmenter populating the flags.
+func NewRefresher(log logger.Logger, factory AugmenterFactory) (*Refresher, error) {
+	initial, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	return &Refresher{factory: factory, log: log, initial: initial}, nil
+}
+
+// OnChange registers a callback invoked every time the defaults of some flags change.
+func (r *Refresher) OnChange(cb ChangeCallback) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.callbacks = append(r.callbacks, cb)
+}
+
+// VisitCommand implements kflags.Augmenter, delegating to the initial Augmenter.
+func (r *Refresher) VisitCommand(namespace string, command kflags.Command) (bool, error) {
+	return r.initial.VisitCommand(namespace, command)
+}
+
+// VisitFlag implements kflags.Augmenter, tracking the flag to refresh it later.
+func (r *Refresher) VisitFlag(namespace string, flag kflags.Flag) (bool, error) {
+	tracked := &trackedFlag{namespace: namespace, flag: flag}
+	r.lock.Lock()
+	r.flags = append(r.flags, tracked)
+	r.lock.Unlock()
+
+	return r.initial.VisitFlag(namespace, tracked)
+}
+
+// Done implements kflags.Augmenter.
+func (r *Refresher) Done() error {
+	return r.initial.Done()
+}
+
+// Refresh fetches the config again, and returns the flags whose default changed.
+//
+// Registered callbacks are not invoked, flags are not changed. Flags set by the user
+// are skipped. Each change is returned once, whether it is applied or not.
+// If fetching the config fails, no change is returned.
+func (r *Refresher) Refresh() ([]*Change, error) {
+	augmenter, err := r.factory()
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	flags := append([]*trackedFlag{}, r.flags...)
+	r.lock.Unlock()
+
+	var probes []*probeFlag
+	for _, tracked := range flags {
+		if tracked.UserSet() {
+			continue
+		}
+		probe := &probeFlag{tracked: tracked}
+		probes = append(probes, probe)
+		if _, err := augmenter.VisitFlag(tracked.namespace, kflags.LimitFlag(probe, kflags.AugmenterName(augmenter))); err != nil {
+			augmenter.Done()
+			return nil, err
+		}
+	}
+	if err := augmenter.Done(); err != nil {
+		return nil, err
+	}
+
+	var changes []*Change
+	for _, probe := range probes {
+		probe.lock.Lock()
+		value := probe.value
+		probe.lock.Unlock()
+		if !value.set {
+			continue
+		}
+
+		tracked := probe.tracked
+		tracked.lock.Lock()
+		changed := tracked.seen != value
+		tracked.seen = value
+		tracked.lock.Unlock()
+		if !changed {
+			continue
+		}
+
+		changes = append(changes, &Change{
+			Namespace: tracked.namespace,
+			Flag:      tracked.Name(),
+			Origin:    value.origin,
+			Value:     value.value,
+			tracked:   tracked,
+		})
+	}
+	return changes, nil
+}
+
+// RefreshAndNotify invokes Refresh, and the registered callbacks if any flag changed.
+func (r *Refresher) RefreshAndNotify() error {
+	changes, err := r.Refresh()
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	r.lock.Lock()
+	callbacks := append([]ChangeCallback{}, r.callbacks...)
+	r.lock.Unlock()
+	for _, cb := range callbacks {
+		cb(changes)
+	}
+	return nil
+}
+
+// Start invokes RefreshAndNotify every interval in background, until ctx is canceled.
+//
+// Errors are logged, and the config is fetched again at the next interval.
+func (r *Refresher) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := r.RefreshAndNotify(); err != nil {
+				r.log.Warnf("could not refresh the flag defaults - will retry in %s: %s", interval, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package kconfig
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/System233/enkit/lib/cache"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/khttp/downloader"
+	"github.com/System233/enkit/lib/khttp/ktest"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// refreshConfig serves a config that can be changed by the test.
+type refreshConfig struct {
+	lock   sync.Mutex
+	config string
+}
+
+func (rc *refreshConfig) Update(server, timeout string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.config = fmt.Sprintf(`{"Namespace": [{"Name": "test", "Default": [
+		{"Name": "server", "Value": %q},
+		{"Name": "timeout", "Value": %q}
+	]}]}`, server, timeout)
+}
+
+func (rc *refreshConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	fmt.Fprint(w, rc.config)
+}
+
+func TestRefresher(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	c := &cache.Local{Root: tempdir}
+	dl, err := downloader.New()
+	assert.Nil(t, err)
+
+	config := &refreshConfig{}
+	config.Update("server-1", "10s")
+	_, address, err := ktest.StartServer(config.ServeHTTP)
+	assert.Nil(t, err)
+
+	fetches := 0
+	r, err := NewRefresher(logger.Nil, func() (kflags.Augmenter, error) {
+		fetches++
+		return NewConfigAugmenterFromURL(c, address, WithDownloader(dl))
+	})
+	assert.Nil(t, err)
+
+	var notified [][]*Change
+	r.OnChange(func(changes []*Change) {
+		notified = append(notified, changes)
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	server := fs.String("server", "default", "usage")
+	timeout := fs.String("timeout", "1s", "usage")
+	unrelated := fs.String("unrelated", "default", "usage")
+	assert.Nil(t, fs.Parse([]string{"--timeout=5s"}))
+	assert.Nil(t, kflags.PopulateDefaults(fs, r))
+	assert.Equal(t, "server-1", *server)
+	assert.Equal(t, "5s", *timeout)
+
+	// Nothing changed.
+	assert.Nil(t, r.RefreshAndNotify())
+	assert.Equal(t, 0, len(notified))
+	assert.Equal(t, 2, fetches)
+
+	// Changes are notified once, the flags are changed only when applied.
+	config.Update("server-2", "20s")
+	assert.Nil(t, r.RefreshAndNotify())
+	assert.Equal(t, 1, len(notified))
+	assert.Nil(t, r.RefreshAndNotify())
+	assert.Equal(t, 1, len(notified))
+	assert.Equal(t, "server-1", *server)
+
+	changes := notified[0]
+	assert.Equal(t, 1, len(changes), "%v", changes)
+	assert.Equal(t, "server", changes[0].Flag)
+	assert.Equal(t, "server-2", changes[0].Value)
+	assert.Nil(t, changes[0].Apply())
+	assert.Equal(t, "server-2", *server)
+	assert.Equal(t, "5s", *timeout)
+	assert.Equal(t, "default", *unrelated)
+
+	// Flags changed by the user after the defaults were populated are never changed.
+	config.Update("server-3", "30s")
+	changes, err = r.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+	assert.Nil(t, fs.Set("server", "user-server"))
+	assert.NotNil(t, changes[0].Apply())
+	assert.Equal(t, "user-server", *server)
+
+	config.Update("server-4", "40s")
+	changes, err = r.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changes))
+}
+
+// opaqueFlag is a flag that cannot tell if it was set by the user.
+type opaqueFlag struct {
+	value string
+}
+
+func (of *opaqueFlag) Name() string {
+	return "server"
+}
+
+func (of *opaqueFlag) Set(value string) error {
+	of.value = value
+	return nil
+}
+
+func (of *opaqueFlag) SetContent(origin string, data []byte) error {
+	return of.Set(string(data))
+}
+
+func TestRefresherOpaqueFlag(t *testing.T) {
+	value := "server-1"
+	factory := func() (kflags.Augmenter, error) {
+		return NewNamespaceAugmenter(nil, []Namespace{{Name: "", Default: []Parameter{{Name: "server", Value: value}}}},
+			logger.Nil, nil, nil, func(base *url.URL, param *Parameter) (Retriever, error) {
+				return NewInlineRetriever(nil, param), nil
+			})
+	}
+	r, err := NewRefresher(logger.Nil, factory)
+	assert.Nil(t, err)
+
+	fl := &opaqueFlag{}
+	found, err := r.VisitFlag("", fl)
+	assert.True(t, found)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Done())
+	assert.Equal(t, "server-1", fl.value)
+
+	// Flags not implementing kflags.UserSetter are assumed to be set by the user.
+	value = "server-2"
+	changes, err := r.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changes))
+	assert.Equal(t, "server-1", fl.value)
+}
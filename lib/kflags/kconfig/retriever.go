@@ -10,15 +10,13 @@ import (
 	"github.com/System233/enkit/lib/logger"
 	"github.com/System233/enkit/lib/retry"
 
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
-	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -86,7 +84,7 @@ func (f *Creator) Create(base *url.URL, param *Parameter) (Retriever, error) {
 	if source == "" {
 		source = SourceInline
 	}
-	if source != SourceInline && source != SourceURL {
+	if source != SourceInline && source != SourceURL && source != SourceFile && source != SourceDir {
 		return nil, fmt.Errorf("invalid configuration - %#v requires invalid source %s", param, param.Source)
 	}
 	if param.Name == "" {
@@ -97,6 +95,14 @@ func (f *Creator) Create(base *url.URL, param *Parameter) (Retriever, error) {
 		return NewInlineRetriever(f.cache, param), nil
 	}
 
+	if source == SourceFile || source == SourceDir {
+		path, err := LocalPath(base, param.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration - %#v %w", param, err)
+		}
+		return NewFileRetriever(path, source == SourceDir, param), nil
+	}
+
 	if param.Value == "" {
 		return nil, fmt.Errorf("invalid configuration - %#v when fetching an url, an url must be specified", param)
 	}
@@ -110,6 +116,21 @@ func (f *Creator) Create(base *url.URL, param *Parameter) (Retriever, error) {
 	if base != nil {
 		desired = base.ResolveReference(u)
 	}
+
+	var mirrors []string
+	for _, mirror := range param.Mirrors {
+		m, err := url.Parse(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration - %#v the mirror %s cannot be parsed - %w", param, mirror, err)
+		}
+		if base != nil {
+			m = base.ResolveReference(m)
+		}
+		mirrors = append(mirrors, m.String())
+	}
+
+	// Mirrors are not part of the key: the same value is retrieved only once,
+	// even if different parameters list different mirrors.
 	key := fmt.Sprintf("%s:%s:%s", desired.String(), param.Encoding, param.Hash)
 
 	f.lock.Lock()
@@ -117,12 +138,30 @@ func (f *Creator) Create(base *url.URL, param *Parameter) (Retriever, error) {
 
 	retriever := f.index[key]
 	if retriever == nil {
-		retriever = NewURLRetriever(f.log, f.cache, f.downloader, desired, param, f.mods...)
+		retriever = NewURLRetriever(f.log, f.cache, f.downloader, desired, param, append([]downloader.Modifier{downloader.WithMirrors(mirrors...)}, f.mods...)...)
 		f.index[key] = retriever
 	}
 	return retriever, nil
 }
 
+// LocalPath returns the path of a local file or directory referenced by a config loaded from base.
+//
+// Relative paths are resolved against the directory of the config file, or the current
+// working directory if base is nil or empty. They are rejected if the config was not loaded
+// from a local file, as there is no location to resolve them against.
+func LocalPath(base *url.URL, value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("a path must be specified")
+	}
+	if filepath.IsAbs(value) || base == nil || (base.Scheme == "" && base.Path == "") {
+		return filepath.Clean(value), nil
+	}
+	if base.Scheme != "" && base.Scheme != "file" {
+		return "", fmt.Errorf("relative path %s cannot be used in a config retrieved from %s, only in local configs", value, base)
+	}
+	return filepath.Join(filepath.Dir(base.Path), value), nil
+}
+
 func CacheFile(path string) string {
 	return filepath.Join(path, "enkit.config")
 }
@@ -219,6 +258,72 @@ func (ir *InlineRetriever) Retrieve(callback Callback) {
 	callback(ir.param.Name, encoded, err)
 }
 
+// FileRetriever retrieves the value of a parameter from a local file.
+//
+// The file is read every time the value is retrieved, so changes are picked up by long
+// running processes. With EncodeFile, the path of the file is passed as is, without
+// copying it in the cache. Files of Secret parameters must only be accessible by their owner.
+type FileRetriever struct {
+	param *Parameter
+	path  string
+	dir   bool
+}
+
+// NewFileRetriever returns a FileRetriever reading path, or the newest file in path if dir is true.
+func NewFileRetriever(path string, dir bool, param *Parameter) *FileRetriever {
+	return &FileRetriever{param: param, path: path, dir: dir}
+}
+
+// NewestFile returns the path of the most recently modified file in dir.
+//
+// Hidden files are ignored, as well as sub directories. If two files have the
+// same modification time, the one that sorts last by name is returned.
+func NewestFile(dir string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var newest os.FileInfo
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if newest == nil || !entry.ModTime().Before(newest.ModTime()) {
+			newest = entry
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no file found in directory %s", dir)
+	}
+	return filepath.Join(dir, newest.Name()), nil
+}
+
+func (fr *FileRetriever) Retrieve(callback Callback) {
+	path := fr.path
+	if fr.dir {
+		var err error
+		if path, err = NewestFile(fr.path); err != nil {
+			callback(fr.path, "", fmt.Errorf("parameter %s: could not find a file in %s - %w", fr.param.Name, fr.path, err))
+			return
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		callback(path, "", fmt.Errorf("parameter %s: could not read file %s - %w", fr.param.Name, path, err))
+		return
+	}
+	if fr.param.Secret && info.Mode().Perm()&0077 != 0 {
+		callback(path, "", fmt.Errorf("parameter %s: secret file %s can be accessed by other users (mode %04o) - refusing to use it, run chmod 0600 %s", fr.param.Name, path, info.Mode().Perm(), path))
+		return
+	}
+
+	encoded, err := EncodeFromFile(path, fr.param.Encoding)
+	if err != nil {
+		err = fmt.Errorf("parameter %s: could not use file %s - %w", fr.param.Name, path, err)
+	}
+	callback(path, encoded, err)
+}
+
 type URLRetriever struct {
 	log logger.Logger
 
@@ -233,6 +338,7 @@ type URLRetriever struct {
 
 	origin string
 	value  *string
+	digest *downloader.Digest
 	err    error
 	cbs    []Callback
 }
@@ -281,6 +387,21 @@ func (p *URLRetriever) DeliverError(err error) {
 	p.Deliver("", "", err)
 }
 
+// Digest returns the sha256 and size of the value retrieved, or nil if not retrieved yet, or unknown.
+//
+// The digest is computed for every value retrieved, even if the parameter does not specify a Hash.
+func (p *URLRetriever) Digest() *downloader.Digest {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.digest
+}
+
+func (p *URLRetriever) setDigest(digest *downloader.Digest) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.digest = digest
+}
+
 // Retrieve by hash retrieves a parameter from a URL with a hash.
 //
 // It does not use an HTTP cache, Last-Modifier, or If-Modified-Since sorcery, as the Hash already
@@ -289,46 +410,42 @@ func (p *URLRetriever) DeliverError(err error) {
 func (p *URLRetriever) RetrieveByHash() error {
 	ihash := strings.TrimSpace(p.param.Hash)
 
-	location, found, err := p.cache.Get(ihash)
+	found, blob, err := cache.NewCAS(p.cache).Reserve(ihash)
 	if err != nil {
 		return fmt.Errorf("problem accessing cached entry for %v - %w", p.param, err)
 	}
 
-	if found {
-		location := filepath.Join(location, path.Base(p.param.Value))
-		encoded, err := EncodeFromFile(location, p.param.Encoding)
-		p.Deliver(location, encoded, err)
+	if blob == nil {
+		encoded, err := EncodeFromFile(found, p.param.Encoding)
+		p.Deliver(found, encoded, err)
 		return nil
 	}
 
-	var h hash.Hash
-	hasher := func() io.Writer {
-		h = sha256.New()
-		return h
-	}
-
-	p.dl.Get(p.url.String(), protocol.Read(protocol.Chain(protocol.WriterCreator(hasher), protocol.File(CacheFile(location)), protocol.OnClose(func(resp *http.Response) error {
-		computed := hex.EncodeToString(h.Sum(nil))
-		if ihash != computed {
-			return fmt.Errorf("computed sha256 for %s is %s - required is %s - REJECTED", p.url.String(), computed, ihash)
+	// The digest is computed as the data is written to the cache file, and
+	// verified once completely written: the file is committed to the cache
+	// only if it matches. Hashed files are generally large, and immutable:
+	// failed attempts are resumed, rather than started over.
+	digest := &downloader.Digest{}
+	read := protocol.Read(downloader.Verify(protocol.File(blob.Path()), ihash, digest))
+	p.dl.Get(p.url.String(), func(url string, resp *http.Response, err error) error {
+		if err := read(url, resp, err); err != nil {
+			return fmt.Errorf("retrieving %s - %w - REJECTED", url, err)
 		}
 
-		final, err := p.cache.Commit(location)
+		// Commit verifies the digest again, and discards the blob on failure.
+		final, err := blob.Commit()
 		if err != nil {
-			final = location
-			// Keep going, using the location before commit, but try not to leave data lingering around.
-			// Attempting rollback multiple times is ok.
-			defer p.cache.Rollback(location)
+			return fmt.Errorf("storing %s - %w", url, err)
 		}
 
-		cf := CacheFile(final)
-		value, err := EncodeFromFile(cf, p.param.Encoding)
-		p.Deliver(cf, value, err)
+		value, err := EncodeFromFile(final, p.param.Encoding)
+		p.setDigest(digest)
+		p.Deliver(final, value, err)
 		return nil
-	}))), workpool.ErrorCallback(func(err error) {
-		p.cache.Rollback(location)
+	}, workpool.ErrorCallback(func(err error) {
+		blob.Discard()
 		p.DeliverError(err)
-	}), p.mods...)
+	}), append([]downloader.Modifier{downloader.WithResume("")}, p.mods...)...)
 	return nil
 }
 
@@ -372,22 +489,35 @@ func (p *URLRetriever) RetrieveByPath() {
 		origin := url
 		cached, ok := resp.Body.(*kcache.CachedFile)
 		var value string
+		var digest *downloader.Digest
 		if ok {
 			origin = cached.Path
 			value, err = EncodeFromFile(cached.Path, p.param.Encoding)
+			if err == nil {
+				var derr error
+				if digest, derr = downloader.FileDigest(cached.Path); derr != nil {
+					p.log.Warnf("could not compute the digest of %s - %s", cached.Path, derr)
+				}
+			}
 		} else {
-			data, err := ioutil.ReadAll(resp.Body)
+			verifier := downloader.NewVerifier(-1, "")
+			data, err := ioutil.ReadAll(io.TeeReader(resp.Body, verifier))
 			if err != nil {
 				return err
 			}
+			digest = verifier.Digest()
 			value, err = EncodeFromString(p.cache, string(data), p.param.Encoding)
 		}
 
+		p.setDigest(digest)
 		p.Deliver(origin, value, err)
 		return nil
 	}, workpool.ErrorCallback(func(err error) {
 		p.DeliverError(err)
-	}), downloader.WithProtocolOptions(kcache.WithCache(p.cache, kcache.WithLogger(p.log))))
+	}), append([]downloader.Modifier{
+		// The value is cached by url, regardless of the mirror it was retrieved from.
+		downloader.WithProtocolOptions(kcache.WithCache(p.cache, kcache.WithLogger(p.log), kcache.WithCacheKey(p.url.String()))),
+	}, p.mods...)...)
 }
 
 func (p *URLRetriever) Retrieve(callback Callback) {
@@ -1,13 +1,20 @@
 package kconfig
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/System233/enkit/lib/cache"
 	"github.com/System233/enkit/lib/khttp/downloader"
 	"github.com/System233/enkit/lib/khttp/ktest"
 	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/retry"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -85,6 +92,85 @@ func TestInlineRetriever(t *testing.T) {
 	}, func() {})
 }
 
+func TestFileRetriever(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "source")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	testEncoding(t, func(message, encoding string) Retriever {
+		path := filepath.Join(tempdir, "value.txt")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(message), 0600))
+		return NewFileRetriever(path, false, &Parameter{
+			Name:     "name",
+			Value:    path,
+			Source:   SourceFile,
+			Encoding: EncodeAs(encoding),
+		})
+	}, func() {})
+}
+
+func TestDirRetriever(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "source")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	var origin, value string
+	var e error
+	callback := func(o, v string, err error) {
+		origin, value, e = o, v, err
+	}
+
+	r := NewFileRetriever(tempdir, true, &Parameter{Name: "release", Source: SourceDir})
+	r.Retrieve(callback)
+	assert.NotNil(t, e)
+	assert.Contains(t, e.Error(), "release")
+	assert.Contains(t, e.Error(), tempdir)
+
+	now := time.Now()
+	for ix, name := range []string{"v3", "v1", "v2", ".v4"} {
+		path := filepath.Join(tempdir, name)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(name), 0600))
+		assert.Nil(t, os.Chtimes(path, now, now.Add(time.Duration(ix)*time.Minute)))
+	}
+	assert.Nil(t, os.Mkdir(filepath.Join(tempdir, "v5"), 0700))
+
+	r.Retrieve(callback)
+	assert.Nil(t, e)
+	assert.Equal(t, "v2", value)
+	assert.Equal(t, filepath.Join(tempdir, "v2"), origin)
+}
+
+func TestLocalPath(t *testing.T) {
+	base, err := url.Parse("file:///etc/enkit/config.yaml")
+	assert.Nil(t, err)
+	path, err := LocalPath(base, "flags/token")
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/enkit/flags/token", path)
+
+	path, err = LocalPath(base, "/opt/token")
+	assert.Nil(t, err)
+	assert.Equal(t, "/opt/token", path)
+
+	path, err = LocalPath(&url.URL{Path: "/etc/enkit/config.yaml"}, "../token")
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/token", path)
+
+	path, err = LocalPath(&url.URL{}, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, "token", path)
+
+	remote, err := url.Parse("https://config.enfabrica.net/config.yaml")
+	assert.Nil(t, err)
+	_, err = LocalPath(remote, "token")
+	assert.NotNil(t, err)
+	path, err = LocalPath(remote, "/opt/token")
+	assert.Nil(t, err)
+	assert.Equal(t, "/opt/token", path)
+
+	_, err = LocalPath(base, "")
+	assert.NotNil(t, err)
+}
+
 func TestURLRetriever(t *testing.T) {
 	tempdir, err := ioutil.TempDir("", "cache")
 	assert.Nil(t, err)
@@ -129,6 +215,9 @@ func TestURLRetriever(t *testing.T) {
 		})
 	}
 
+	// The digest is computed even if the parameter has no hash.
+	assert.Equal(t, &downloader.Digest{SHA256: "c24e00ca3ba81c6b4071298fadcefbec2b560f13d40dff7c1881989add11c75f", Size: int64(len(message))}, r.Digest())
+
 	testEncoding(t, func(message, encoding string) Retriever {
 		return NewURLRetriever(logger.Nil, c, dl, url, &Parameter{
 			Name:     "name",
@@ -181,6 +270,60 @@ func TestURLByHash(t *testing.T) {
 	assert.Equal(t, 1, len(http.Request))
 }
 
+func TestURLByHashMismatch(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	c := &cache.Local{Root: tempdir}
+
+	payload := strings.Repeat("Be realistic, demand the impossible!\n", 256*1024)
+	_, url, err := ktest.StartServerURL(ktest.StringHandler(payload))
+	assert.Nil(t, err)
+
+	retrieve := func(dl *downloader.Downloader, hash string) (*URLRetriever, error) {
+		var rerr error
+		r := NewURLRetriever(logger.Nil, c, dl, url, &Parameter{Name: "name", Value: url.String(), Hash: hash})
+		r.Retrieve(func(_, value string, err error) {
+			rerr = err
+		})
+		dl.Wait()
+		return r, rerr
+	}
+	leftovers := func() []string {
+		var files []string
+		filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		return files
+	}
+
+	// The whole payload is streamed, and rejected at the end. Nothing is left in the cache.
+	dl, err := downloader.New(downloader.WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+	r, err := retrieve(dl, "c24e00ca3ba81c6b4071298fadcefbec2b560f13d40dff7c1881989add11c75f")
+	assert.True(t, errors.Is(err, downloader.ErrChecksum), "%v", err)
+	assert.Nil(t, r.Digest())
+	assert.Equal(t, []string(nil), leftovers())
+
+	// Transfers larger than the maximum size are aborted mid-stream.
+	dl, err = downloader.New(downloader.WithMaxSize(64*1024), downloader.WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+	_, err = retrieve(dl, "c24e00ca3ba81c6b4071298fadcefbec2b560f13d40dff7c1881989add11c75f")
+	assert.True(t, errors.Is(err, downloader.ErrTooLarge), "%v", err)
+	assert.Equal(t, []string(nil), leftovers())
+
+	// The digest is recorded for correct downloads.
+	sum := sha256.Sum256([]byte(payload))
+	dl, err = downloader.New()
+	assert.Nil(t, err)
+	r, err = retrieve(dl, hex.EncodeToString(sum[:]))
+	assert.Nil(t, err)
+	assert.Equal(t, &downloader.Digest{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(payload))}, r.Digest())
+}
+
 func TestCreator(t *testing.T) {
 	tempdir, err := ioutil.TempDir("", "cache")
 	assert.Nil(t, err)
@@ -247,6 +390,48 @@ func TestCreator(t *testing.T) {
 	assert.NotEqual(t, r1, r3)
 }
 
+func TestCreatorFile(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "source")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	dl, err := downloader.New()
+	assert.Nil(t, err)
+	creator := NewCreator(logger.Nil, &cache.Local{Root: tempdir}, dl)
+
+	// Files are resolved relative to the config file.
+	assert.Nil(t, os.Mkdir(filepath.Join(tempdir, "flags"), 0700))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(tempdir, "flags", "token"), []byte(message), 0600))
+	base := &url.URL{Scheme: "file", Path: filepath.Join(tempdir, "config.yaml")}
+
+	var value string
+	var e error
+	callback := func(_, v string, err error) {
+		value, e = v, err
+	}
+	r, err := creator.Create(base, &Parameter{Source: SourceFile, Name: "token", Value: "flags/token", Encoding: EncodeHex})
+	assert.Nil(t, err)
+	r.Retrieve(callback)
+	assert.Nil(t, e)
+	assert.Equal(t, hex.EncodeToString([]byte(message)), value)
+
+	r, err = creator.Create(base, &Parameter{Source: SourceDir, Name: "token", Value: "flags"})
+	assert.Nil(t, err)
+	r.Retrieve(callback)
+	assert.Nil(t, e)
+	assert.Equal(t, message, value)
+
+	r, err = creator.Create(base, &Parameter{Source: SourceFile, Name: "missing", Value: "flags/missing"})
+	assert.Nil(t, err)
+	r.Retrieve(callback)
+	assert.NotNil(t, e)
+	assert.Contains(t, e.Error(), "missing")
+	assert.Contains(t, e.Error(), filepath.Join(tempdir, "flags", "missing"))
+
+	r, err = creator.Create(base, &Parameter{Source: SourceFile, Name: "empty"})
+	assert.NotNil(t, err)
+	assert.Nil(t, r)
+}
+
 func TestURLFail(t *testing.T) {
 	tempdir, err := ioutil.TempDir("", "cache")
 	assert.Nil(t, err)
@@ -319,3 +504,83 @@ func TestURLSlow(t *testing.T) {
 		assert.Equal(t, message, values[ix].value)
 	}
 }
+
+func TestURLMirrors(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	c := &cache.Local{Root: tempdir}
+	dl, err := downloader.New(downloader.WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+
+	broken := ktest.Capture(ktest.ErrorHandler)
+	_, brokenURL, err := ktest.StartServerURL(broken.Handle)
+	assert.Nil(t, err)
+	working := ktest.Capture(ktest.CachableStringHandler(message))
+	_, workingURL, err := ktest.StartServerURL(working.Handle)
+	assert.Nil(t, err)
+
+	var value string
+	var verr error
+	callback := func(_, v string, err error) {
+		value, verr = v, err
+	}
+
+	creator := NewCreator(logger.Nil, c, dl)
+	r, err := creator.Create(nil, &Parameter{Source: SourceURL, Name: "name", Value: brokenURL.String(), Mirrors: []string{workingURL.String()}})
+	assert.Nil(t, err)
+	r.Retrieve(callback)
+	dl.Wait()
+	assert.Nil(t, verr)
+	assert.Equal(t, message, value)
+	assert.Equal(t, 1, len(broken.Request))
+	assert.Equal(t, 1, len(working.Request))
+
+	// Listing different mirrors does not create a different retriever.
+	r2, err := creator.Create(nil, &Parameter{Source: SourceURL, Name: "name", Value: brokenURL.String()})
+	assert.Nil(t, err)
+	assert.Equal(t, r, r2)
+
+	// The value is cached under the canonical url, no matter which mirror served it.
+	value = ""
+	NewURLRetriever(logger.Nil, c, dl, brokenURL, &Parameter{
+		Name:  "name",
+		Value: brokenURL.String(),
+	}, downloader.WithMirrors(workingURL.String())).Retrieve(callback)
+	dl.Wait()
+	assert.Nil(t, verr)
+	assert.Equal(t, message, value)
+	entries, err := filepath.Glob(filepath.Join(tempdir, "*", "*"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries), "%v", entries)
+}
+
+func TestFileRetrieverSecret(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "source")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	var value string
+	var e error
+	callback := func(o, v string, err error) {
+		value, e = v, err
+	}
+
+	path := filepath.Join(tempdir, "token")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("s3cr3t"), 0644))
+	assert.Nil(t, os.Chmod(path, 0644))
+	r := NewFileRetriever(path, false, &Parameter{Name: "token", Value: path, Source: SourceFile, Secret: true})
+	r.Retrieve(callback)
+	assert.NotNil(t, e)
+	assert.Contains(t, e.Error(), "0644")
+	assert.Equal(t, "", value)
+
+	assert.Nil(t, os.Chmod(path, 0600))
+	r.Retrieve(callback)
+	assert.Nil(t, e)
+	assert.Equal(t, "s3cr3t", value)
+
+	// Non secret parameters can be read by anyone.
+	assert.Nil(t, os.Chmod(path, 0644))
+	NewFileRetriever(path, false, &Parameter{Name: "token", Value: path, Source: SourceFile}).Retrieve(callback)
+	assert.Nil(t, e)
+}
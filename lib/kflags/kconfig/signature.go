@@ -0,0 +1,144 @@
+package kconfig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/System233/enkit/lib/khttp/downloader"
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/System233/enkit/lib/khttp/workpool"
+	"github.com/System233/enkit/lib/multierror"
+)
+
+// SignatureExtension is appended to the URL of a config to retrieve its detached signature.
+//
+// The signature is an ed25519 signature of the body of the config, base64 encoded.
+// Use SignConfig to generate it.
+const SignatureExtension = ".sig"
+
+// ParsePublicKey parses a base64 encoded ed25519 public key.
+func ParsePublicKey(key string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q - must be base64 encoded: %w", key, err)
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q - must be an ed25519 key of %d bytes, got %d", key, ed25519.PublicKeySize, len(data))
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// ParsePublicKeys parses a list of base64 encoded ed25519 public keys.
+func ParsePublicKeys(keys []string) ([]ed25519.PublicKey, error) {
+	var parsed []ed25519.PublicKey
+	for _, key := range keys {
+		pk, err := ParsePublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, pk)
+	}
+	return parsed, nil
+}
+
+// SignConfig returns the signature of a config, to be served at the URL of
+// the config followed by SignatureExtension.
+func SignConfig(key ed25519.PrivateKey, config []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, config)))
+}
+
+// VerifySignature returns an error unless signature, as returned by SignConfig,
+// is a valid signature of config by one of keys.
+func VerifySignature(keys []ed25519.PublicKey, config, signature []byte) error {
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature - must be base64 encoded: %w", err)
+	}
+	if len(decoded) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature - must be an ed25519 signature of %d bytes, got %d", ed25519.SignatureSize, len(decoded))
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, config, decoded) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not match any of the %d trusted keys", len(keys))
+}
+
+// resultHandler is a workpool.ErrorHandler invoked on success as well, with a nil error.
+//
+// workpool.ErrorCallback is only invoked on failure.
+type resultHandler func(error)
+
+func (rh resultHandler) Handle(err error) {
+	rh(err)
+}
+
+// getSigned retrieves the config at url, and its detached signature, in parallel.
+//
+// handler is invoked only if the signature of the config is valid for one of keys.
+// eh is invoked with the outcome, including failures to retrieve the signature.
+func getSigned(dl *downloader.Downloader, url string, keys []ed25519.PublicKey, handler func([]byte) error, eh workpool.ErrorHandler, mods ...downloader.Modifier) error {
+	var lock sync.Mutex
+	var config, signature []byte
+	var errs []error
+	pending := 2
+
+	done := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if pending--; pending > 0 {
+			return
+		}
+
+		if len(errs) > 0 {
+			eh.Handle(multierror.New(errs))
+			return
+		}
+		if err := VerifySignature(keys, config, signature); err != nil {
+			eh.Handle(fmt.Errorf("config %s REJECTED - %w", url, err))
+			return
+		}
+		eh.Handle(handler(config))
+	}
+
+	if err := dl.Get(url, protocol.Read(protocol.Callback(func(data []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		config = data
+		return nil
+	})), resultHandler(done), mods...); err != nil {
+		return err
+	}
+	return dl.Get(url+SignatureExtension, protocol.Read(protocol.Callback(func(data []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		signature = data
+		return nil
+	})), resultHandler(func(err error) {
+		if err != nil {
+			err = fmt.Errorf("could not retrieve signature of config %s - unsigned configs are not accepted: %w", url, err)
+		}
+		done(err)
+	}), mods...)
+}
+
+// RequireHash returns a CommandFactory rejecting packages without a hash.
+//
+// With signed configs, the hash of a package is covered by the signature. As the
+// manifest of the package is covered by the hash, so are the hashes of the packages
+// it refers to.
+func RequireHash(cf CommandFactory) CommandFactory {
+	return func(url, hash string) (string, *Manifest, error) {
+		if hash == "" {
+			return "", nil, fmt.Errorf("package %s REJECTED - configs are signed, packages must have a hash", url)
+		}
+		return cf(url, hash)
+	}
+}
@@ -0,0 +1,111 @@
+package kconfig
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/System233/enkit/lib/cache"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/khttp/downloader"
+	"github.com/System233/enkit/lib/khttp/ktest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	other, _, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+
+	keys, err := ParsePublicKeys([]string{base64.StdEncoding.EncodeToString(other), base64.StdEncoding.EncodeToString(pub)})
+	assert.Nil(t, err)
+
+	config := []byte(jconfigAstore)
+	signature := SignConfig(priv, config)
+	assert.Nil(t, VerifySignature(keys, config, signature))
+	assert.Nil(t, VerifySignature(keys, config, append(signature, '\n')))
+	assert.NotNil(t, VerifySignature(keys[:1], config, signature))
+	assert.NotNil(t, VerifySignature(keys, append(config, ' '), signature))
+	assert.NotNil(t, VerifySignature(keys, config, config))
+
+	_, err = ParsePublicKey("not base64!")
+	assert.NotNil(t, err)
+	_, err = ParsePublicKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.NotNil(t, err)
+}
+
+func TestSignedConfig(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	c := &cache.Local{Root: tempdir}
+	dl, err := downloader.New()
+	assert.Nil(t, err)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	_, other, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	key := base64.StdEncoding.EncodeToString(pub)
+
+	mux, url, err := ktest.StartServer(http.NotFound)
+	assert.Nil(t, err)
+	mux.HandleFunc("/signed.json", ktest.StringHandler(jconfigAstore))
+	mux.HandleFunc("/signed.json.sig", ktest.StringHandler(string(SignConfig(priv, []byte(jconfigAstore)))))
+	mux.HandleFunc("/badly-signed.json", ktest.StringHandler(jconfigAstore))
+	mux.HandleFunc("/badly-signed.json.sig", ktest.StringHandler(string(SignConfig(other, []byte(jconfigAstore)))))
+	mux.HandleFunc("/unsigned.json", ktest.StringHandler(jconfigAstore))
+
+	load := func(path string, mods ...Modifier) (string, error) {
+		r, err := NewConfigAugmenterFromURL(c, url+path, append(mods, WithDownloader(dl))...)
+		assert.Nil(t, err)
+
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		server := fs.String("bar-server", "initial", "usage")
+		r.VisitFlag("", &kflags.GoFlag{Flag: fs.Lookup("bar-server")})
+		return *server, r.Done()
+	}
+
+	server, err := load("/signed.json", WithPublicKeys(key))
+	assert.Nil(t, err)
+	assert.Equal(t, "42", server)
+
+	server, err = load("/badly-signed.json", WithPublicKeys(key))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "REJECTED")
+	assert.Equal(t, "initial", server)
+
+	server, err = load("/unsigned.json", WithPublicKeys(key))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsigned configs are not accepted")
+	assert.Equal(t, "initial", server)
+
+	// Without pinned keys, signatures are not checked.
+	server, err = load("/unsigned.json")
+	assert.Nil(t, err)
+	assert.Equal(t, "42", server)
+
+	_, err = NewConfigAugmenterFromURL(c, url+"/signed.json", WithDownloader(dl), WithPublicKeys("invalid"))
+	assert.NotNil(t, err)
+}
+
+func TestRequireHash(t *testing.T) {
+	var retrieved []string
+	cf := RequireHash(func(url, hash string) (string, *Manifest, error) {
+		retrieved = append(retrieved, url)
+		return "/tmp/package", &Manifest{}, nil
+	})
+
+	_, _, err := cf("https://packages/unhashed.tar.gz", "")
+	assert.NotNil(t, err)
+	dir, manifest, err := cf("https://packages/hashed.tar.gz", "b68f2a7936f57307fc46388cc5bebbf7052a5d97511b53f859a6badef84b1110")
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/package", dir)
+	assert.NotNil(t, manifest)
+	assert.Equal(t, []string{"https://packages/hashed.tar.gz"}, retrieved)
+}
@@ -0,0 +1,126 @@
+package kflags
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DefaultMaxValueSize is the largest value, in bytes, Augmenters can assign to a flag.
+//
+// Flags can configure a different limit by implementing ValueSizeLimiter.
+var DefaultMaxValueSize = 1024 * 1024
+
+// DefaultMaxLoggedSize is the number of bytes of a value kept by SanitizeValue.
+var DefaultMaxLoggedSize = 256
+
+// ValueSizeLimiter is implemented by flags, or flag.Value objects, accepting
+// values of a size different from DefaultMaxValueSize.
+type ValueSizeLimiter interface {
+	// MaxValueSize returns the largest value accepted, in bytes.
+	// 0 means DefaultMaxValueSize, a negative value disables the limit.
+	MaxValueSize() int
+}
+
+// ValueTooLargeError is returned when an Augmenter attempts to set a value larger than the limit of the flag.
+type ValueTooLargeError struct {
+	Flag   string
+	Origin string
+	Size   int
+	Max    int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value for flag '%s' from %s is %d bytes, larger than the limit of %d bytes - rejected", e.Flag, e.Origin, e.Size, e.Max)
+}
+
+// MaxValueSize returns the largest value in bytes that can be assigned to the flag, or a negative value if unlimited.
+func MaxValueSize(fl Flag) int {
+	if limiter, ok := fl.(ValueSizeLimiter); ok {
+		if max := limiter.MaxValueSize(); max != 0 {
+			return max
+		}
+	}
+	return DefaultMaxValueSize
+}
+
+// ValueMaxSize returns the limit configured by a flag.Value implementing ValueSizeLimiter, or 0.
+//
+// Useful to implement ValueSizeLimiter in wrappers of flag.Value objects.
+func ValueMaxSize(value interface{}) int {
+	if limiter, ok := value.(ValueSizeLimiter); ok {
+		return limiter.MaxValueSize()
+	}
+	return 0
+}
+
+// SanitizeValue returns a version of value safe to log.
+//
+// Control characters are escaped, and values longer than DefaultMaxLoggedSize
+// are truncated. The returned string is quoted.
+func SanitizeValue(value string) string {
+	if len(value) <= DefaultMaxLoggedSize {
+		return strconv.QuoteToGraphic(value)
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", strconv.QuoteToGraphic(value[:DefaultMaxLoggedSize]), len(value)-DefaultMaxLoggedSize)
+}
+
+// limitedFlag is a Flag rejecting values larger than its MaxValueSize.
+type limitedFlag struct {
+	Flag
+	// Describes who is setting the value, when invoking Set.
+	origin string
+}
+
+// LimitFlag returns a Flag rejecting values larger than MaxValueSize(fl) with a ValueTooLargeError.
+//
+// origin describes who assigns the value via Set, generally the Augmenter.
+// SetContent errors report the origin passed to SetContent instead.
+func LimitFlag(fl Flag, origin string) Flag {
+	return &limitedFlag{Flag: fl, origin: origin}
+}
+
+func (lf *limitedFlag) check(origin string, size int) error {
+	max := MaxValueSize(lf.Flag)
+	if max < 0 || size <= max {
+		return nil
+	}
+	return &ValueTooLargeError{Flag: lf.Name(), Origin: origin, Size: size, Max: max}
+}
+
+func (lf *limitedFlag) Set(value string) error {
+	if err := lf.check(lf.origin, len(value)); err != nil {
+		return err
+	}
+	return lf.Flag.Set(value)
+}
+
+func (lf *limitedFlag) SetContent(origin string, data []byte) error {
+	if err := lf.check(origin, len(data)); err != nil {
+		return err
+	}
+	return lf.Flag.SetContent(origin, data)
+}
+
+func (lf *limitedFlag) MaxValueSize() int {
+	return MaxValueSize(lf.Flag)
+}
+
+func (lf *limitedFlag) UserSet() bool {
+	return IsUserSet(lf.Flag)
+}
+
+func (lf *limitedFlag) IsSecret() bool {
+	return IsSecret(lf.Flag)
+}
+
+func (lf *limitedFlag) MarkSecret() {
+	MarkSecret(lf.Flag)
+}
+
+// AugmenterName returns a description of the Augmenter, to use as origin of the values it sets.
+func AugmenterName(r Augmenter) string {
+	if stringer, ok := r.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", r)
+}
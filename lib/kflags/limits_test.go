@@ -0,0 +1,92 @@
+package kflags
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sizedValue is a flag.Value configuring its own size limit.
+type sizedValue struct {
+	value string
+	max   int
+}
+
+func (sv *sizedValue) String() string {
+	return sv.value
+}
+
+func (sv *sizedValue) Set(value string) error {
+	sv.value = value
+	return nil
+}
+
+func (sv *sizedValue) MaxValueSize() int {
+	return sv.max
+}
+
+func TestLimitFlag(t *testing.T) {
+	fs := flag.NewFlagSet("fake-test-flags", flag.ContinueOnError)
+	name := fs.String("name", "default", "usage")
+	var data []byte
+	(&GoFlagSet{fs}).ByteFileVar(&data, "data", "", "usage")
+	fs.Var(&sizedValue{value: "small", max: 4}, "small", "usage")
+	fs.Var(&sizedValue{value: "large", max: -1}, "large", "usage")
+
+	lf := LimitFlag(&GoFlag{fs.Lookup("name")}, "test augmenter")
+	assert.Equal(t, DefaultMaxValueSize, MaxValueSize(lf))
+
+	// Values within the limit are accepted.
+	assert.Nil(t, lf.Set("value"))
+	assert.Equal(t, "value", *name)
+
+	// Oversized inline values are rejected, naming the flag and origin.
+	large := strings.Repeat("x", DefaultMaxValueSize+1)
+	err := lf.Set(large)
+	var terr *ValueTooLargeError
+	assert.True(t, errors.As(err, &terr), "%v", err)
+	assert.Equal(t, &ValueTooLargeError{Flag: "name", Origin: "test augmenter", Size: DefaultMaxValueSize + 1, Max: DefaultMaxValueSize}, terr)
+	assert.Contains(t, err.Error(), "'name' from test augmenter")
+	assert.Equal(t, "value", *name)
+
+	// Content reports the origin of the content.
+	lf = LimitFlag(&GoFlag{fs.Lookup("data")}, "test augmenter")
+	err = lf.SetContent("https://config.enkit.io/data", []byte(large))
+	assert.True(t, errors.As(err, &terr), "%v", err)
+	assert.Equal(t, "https://config.enkit.io/data", terr.Origin)
+	assert.Equal(t, 0, len(data))
+	assert.Nil(t, lf.SetContent("https://config.enkit.io/data", []byte("content")))
+	assert.Equal(t, "content", string(data))
+
+	// flag.Value objects can configure a different limit, or none.
+	lf = LimitFlag(&GoFlag{fs.Lookup("small")}, "test augmenter")
+	assert.Equal(t, 4, MaxValueSize(lf))
+	assert.NotNil(t, lf.Set("12345"))
+	assert.Nil(t, lf.Set("1234"))
+
+	lf = LimitFlag(&GoFlag{fs.Lookup("large")}, "test augmenter")
+	assert.Nil(t, lf.Set(large))
+}
+
+func TestPopulateDefaultsLimits(t *testing.T) {
+	fs := flag.NewFlagSet("fake-test-flags", flag.ContinueOnError)
+	name := fs.String("name", "default", "usage")
+
+	augmenter := NewMapAugmenter(map[string]string{"name": strings.Repeat("x", DefaultMaxValueSize+1)}, WithMapMangler(JoinRemap("")))
+	err := PopulateDefaults(fs, augmenter)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'name' from *kflags.MapAugmenter")
+	assert.Equal(t, "default", *name)
+}
+
+func TestSanitizeValue(t *testing.T) {
+	assert.Equal(t, `"plain value"`, SanitizeValue("plain value"))
+	assert.Equal(t, `"évalué"`, SanitizeValue("évalué"))
+	assert.Equal(t, `"line\n\x1b[31mred\x1b[0m\r\x00"`, SanitizeValue("line\n\x1b[31mred\x1b[0m\r\x00"))
+
+	long := strings.Repeat("a", DefaultMaxLoggedSize+10)
+	assert.Equal(t, `"`+long[:DefaultMaxLoggedSize]+`"... (10 more bytes)`, SanitizeValue(long))
+}
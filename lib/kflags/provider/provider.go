@@ -26,20 +26,43 @@ type Options struct {
 	Log    logger.Logger
 	Cookie *http.Cookie
 
+	// Options for the downloader used to fetch the configs, like the logger for retries.
+	DownloaderOptions downloader.Modifiers
+
 	Cache cache.Store
 
 	CommandName string
 	Domain      string
+
+	// Flags that were renamed or removed, in addition to those declared by the config.
+	Deprecations kflags.Deprecations
 }
 
-func SetFlagDefaults(populator kflags.Populator, flags *ProviderFlags, options *Options) error {
+func (options *Options) modifiers(flags *ProviderFlags) []kconfig.Modifier {
 	mods := []kconfig.Modifier{kconfig.WithLogger(options.Log)}
+	if len(options.DownloaderOptions) > 0 {
+		mods = append(mods, kconfig.WithDownloaderOptions(options.DownloaderOptions...))
+	}
 	if options.Cookie != nil {
 		mods = append(mods, kconfig.WithGetOptions(downloader.WithRequestOptions(krequest.WithCookie(options.Cookie))))
 	}
-	mods = append(mods, kconfig.FromFlags((*kconfig.Flags)(flags)))
+	return append(mods, kconfig.FromFlags((*kconfig.Flags)(flags)))
+}
+
+// augmenter returns an Augmenter applying the Deprecations in options to the flags set by config.
+func (options *Options) augmenter(config kflags.Augmenter) (kflags.Augmenter, error) {
+	if len(options.Deprecations) == 0 {
+		return config, nil
+	}
+	return kflags.NewDeprecationAugmenter(options.Log, config, options.Deprecations)
+}
 
-	resolver, err := kconfig.NewConfigAugmenterFromDNS(options.Cache, options.Domain, options.CommandName, mods...)
+func SetFlagDefaults(populator kflags.Populator, flags *ProviderFlags, options *Options) error {
+	config, err := kconfig.NewConfigAugmenterFromDNS(options.Cache, options.Domain, options.CommandName, options.modifiers(flags)...)
+	if err != nil {
+		return err
+	}
+	resolver, err := options.augmenter(config)
 	if err != nil {
 		return err
 	}
@@ -51,3 +74,31 @@ func SetFlagDefaults(populator kflags.Populator, flags *ProviderFlags, options *
 
 	return nil
 }
+
+// SetRefreshableFlagDefaults is like SetFlagDefaults, but returns a Refresher that long
+// running processes can use to periodically fetch the config again, and be notified of
+// the flags whose default changed.
+//
+// The config is fetched using the same cache and downloader, so HTTP caching is honored.
+func SetRefreshableFlagDefaults(populator kflags.Populator, flags *ProviderFlags, options *Options) (*kconfig.Refresher, error) {
+	dl, err := downloader.New(append(downloader.Modifiers{downloader.FromFlags(flags.Downloader)}, options.DownloaderOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	mods := append(options.modifiers(flags), kconfig.WithDownloader(dl))
+	refresher, err := kconfig.NewRefresher(options.Log, func() (kflags.Augmenter, error) {
+		config, err := kconfig.NewConfigAugmenterFromDNS(options.Cache, options.Domain, options.CommandName, mods...)
+		if err != nil {
+			return nil, err
+		}
+		return options.augmenter(config)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := populator(refresher); err != nil {
+		return nil, err
+	}
+	return refresher, nil
+}
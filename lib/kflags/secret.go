@@ -0,0 +1,133 @@
+package kflags
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/System233/enkit/lib/logger"
+)
+
+// RedactedValue is shown in place of secrets in help messages, errors and logs.
+//
+// It is the same marker used by logger.Ring, so secrets look the same everywhere.
+const RedactedValue = logger.Redacted
+
+// SecretValue is implemented by flag.Value objects holding a secret.
+//
+// String returns RedactedValue, so the secret is not shown by the flag libraries.
+type SecretValue interface {
+	flag.Value
+
+	// Secret returns the actual value.
+	Secret() string
+}
+
+// SecretString is a flag.Value holding a secret string, like a token or password.
+//
+// For example:
+//
+//	var token kflags.SecretString
+//	set.Var(&token, "token", "Token to use to authenticate with the server")
+//	[...]
+//	authenticate(token.Secret())
+type SecretString string
+
+func (s *SecretString) Set(value string) error {
+	*s = SecretString(value)
+	return nil
+}
+
+// String returns RedactedValue, or the empty string if the secret is not set.
+func (s *SecretString) String() string {
+	if s == nil || *s == "" {
+		return ""
+	}
+	return RedactedValue
+}
+
+// Secret returns the actual value.
+func (s *SecretString) Secret() string {
+	return string(*s)
+}
+
+// Type implements the pflag.Value interface.
+func (s *SecretString) Type() string {
+	return "string"
+}
+
+// SecretFlag is implemented by Flags able to hold secrets.
+type SecretFlag interface {
+	// IsSecret returns true if the value of the flag must not be shown.
+	IsSecret() bool
+	// MarkSecret hides the value of the flag from help messages and logs.
+	MarkSecret()
+}
+
+// SecretLister is implemented by FlagSets able to enumerate their flags.
+//
+// Code logging or reporting debug information can use it to redact the secrets
+// assigned to flags, for example with logger.Ring.AddSecrets.
+type SecretLister interface {
+	// SecretValues returns the non empty values of the flags holding secrets.
+	SecretValues() []string
+}
+
+// SecretOf returns the actual value of a flag.Value, using Secret for a SecretValue.
+func SecretOf(value flag.Value) string {
+	if secret, ok := value.(SecretValue); ok {
+		return secret.Secret()
+	}
+	return value.String()
+}
+
+// IsSecret returns true if the flag holds a secret, either because it was
+// marked as such, or because its value implements SecretValue.
+func IsSecret(fl Flag) bool {
+	if secret, ok := fl.(SecretFlag); ok {
+		return secret.IsSecret()
+	}
+	return false
+}
+
+// MarkSecret marks the flag as holding a secret.
+//
+// Flags not implementing SecretFlag cannot hide their value: an error is
+// returned, and the secret must not be assigned to the flag.
+func MarkSecret(fl Flag) error {
+	secret, ok := fl.(SecretFlag)
+	if ok {
+		// Wrappers implement SecretFlag even if the wrapped Flag does not.
+		secret.MarkSecret()
+		ok = secret.IsSecret()
+	}
+	if !ok {
+		return fmt.Errorf("flag '%s' cannot hold secrets", fl.Name())
+	}
+	return nil
+}
+
+// RedactValue returns a version of value safe to log: RedactedValue if the flag holds a secret,
+// the value sanitized with SanitizeValue otherwise.
+func RedactValue(fl Flag, value string) string {
+	if IsSecret(fl) {
+		return RedactedValue
+	}
+	return SanitizeValue(value)
+}
+
+// RedactError returns an error safe to show for a value rejected by the flag.
+//
+// The errors returned when parsing a value often include the value itself. If the
+// flag holds a secret, the error is replaced with a generic one, unless it is
+// a ValueTooLargeError.
+func RedactError(fl Flag, err error) error {
+	if err == nil || !IsSecret(fl) {
+		return err
+	}
+	var tle *ValueTooLargeError
+	if errors.As(err, &tle) {
+		return tle
+	}
+	return fmt.Errorf("invalid value for secret flag '%s'", fl.Name())
+}
@@ -0,0 +1,86 @@
+package kflags
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretString(t *testing.T) {
+	var token SecretString
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&token, "token", "usage")
+	assert.Equal(t, "", token.String())
+
+	assert.Nil(t, fs.Parse([]string{"--token=s3cr3t"}))
+	assert.Equal(t, "s3cr3t", token.Secret())
+	assert.Equal(t, RedactedValue, fs.Lookup("token").Value.String())
+	assert.Equal(t, "s3cr3t", FlagArg{FlagDefinition: &FlagDefinition{Name: "token"}, Value: &token}.Get())
+
+	gf := &GoFlag{fs.Lookup("token")}
+	assert.True(t, IsSecret(gf))
+	assert.Nil(t, gf.Set("other"))
+	assert.Equal(t, "other", token.Secret())
+	assert.Equal(t, RedactedValue, gf.Flag.DefValue)
+}
+
+func TestMarkSecret(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	password := fs.String("password", "", "usage")
+	fs.Func("port", "usage", func(value string) error {
+		return fmt.Errorf("invalid port %q", value)
+	})
+
+	lf := LimitFlag(&GoFlag{fs.Lookup("password")}, "test")
+	assert.False(t, IsSecret(lf))
+	assert.Equal(t, `"hunter2"`, RedactValue(lf, "hunter2"))
+	assert.Nil(t, MarkSecret(lf))
+	assert.True(t, IsSecret(lf))
+
+	assert.Nil(t, lf.SetContent("test", []byte("hunter2")))
+	assert.Equal(t, "hunter2", *password)
+	assert.Equal(t, RedactedValue, fs.Lookup("password").DefValue)
+	assert.Equal(t, RedactedValue, RedactValue(lf, "hunter2"))
+
+	// Errors of secret flags do not show the value.
+	bf := &GoFlag{fs.Lookup("port")}
+	assert.Nil(t, MarkSecret(bf))
+	err := bf.Set("hunter2")
+	assert.Contains(t, err.Error(), "hunter2")
+	err = RedactError(bf, err)
+	assert.NotContains(t, err.Error(), "hunter2")
+	assert.Contains(t, err.Error(), "port")
+
+	// Except for the size, which is useful to troubleshoot.
+	err = RedactError(bf, LimitFlag(bf, "test").Set(strings.Repeat("x", DefaultMaxValueSize+1)))
+	var terr *ValueTooLargeError
+	assert.True(t, errors.As(err, &terr), "%v", err)
+
+	// Flags unable to hide their value cannot be marked as secret.
+	assert.NotNil(t, MarkSecret(LimitFlag(&opaqueFlag{}, "test")))
+}
+
+func TestSecretValues(t *testing.T) {
+	var token SecretString
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&token, "token", "usage")
+	fs.String("password", "", "usage")
+	fs.String("server", "", "usage")
+	set := &GoFlagSet{FlagSet: fs}
+	assert.Empty(t, set.SecretValues())
+
+	assert.Nil(t, fs.Parse([]string{"--token=s3cr3t", "--password=hunter2", "--server=localhost"}))
+	assert.Nil(t, MarkSecret(&GoFlag{fs.Lookup("password")}))
+	assert.ElementsMatch(t, []string{"s3cr3t", "hunter2"}, set.SecretValues())
+}
+
+// opaqueFlag is a Flag not implementing any of the optional interfaces.
+type opaqueFlag struct{}
+
+func (of *opaqueFlag) Name() string                    { return "opaque" }
+func (of *opaqueFlag) Set(string) error                { return nil }
+func (of *opaqueFlag) SetContent(string, []byte) error { return nil }
@@ -2,6 +2,8 @@ package downloader
 
 import (
 	"context"
+	"net/http"
+
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/lib/khttp/kclient"
 	"github.com/System233/enkit/lib/khttp/krequest"
@@ -22,10 +24,30 @@ type roptions struct {
 
 	retry   retry.Modifiers
 	timeout time.Duration
+
+	// Limits applied to each transfer. A nil limiter imposes no limit.
+	limiter      *Limiter
+	transferRate int
+	// Largest transfer allowed, in bytes. Zero means no limit.
+	maxSize int64
+
+	// If set, retries resume the transfer from where it stopped, spilling the data in resumeDir.
+	resume    bool
+	resumeDir string
+
+	// URLs to try if the one passed to Get fails. With a hedgeDelay, the next
+	// URL is tried if the previous one has not responded within the delay.
+	mirrors    []string
+	hedgeDelay time.Duration
 }
 
 type Flags struct {
-	Timeout  time.Duration
+	Timeout       time.Duration
+	MaxConcurrent int
+	RateLimit     int
+	MaxSize       int
+	HedgeDelay    time.Duration
+
 	Retry    *retry.Flags
 	Workpool *workpool.Flags
 	Client   *kclient.Flags
@@ -43,6 +65,10 @@ func DefaultFlags() *Flags {
 
 func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.DurationVar(&fl.Timeout, prefix+"download-timeout", fl.Timeout, "Overall timeout when attempting download operations")
+	set.IntVar(&fl.MaxConcurrent, prefix+"download-max-concurrent", fl.MaxConcurrent, "How many transfers to run in parallel at most - 0 means no limit")
+	set.IntVar(&fl.RateLimit, prefix+"download-rate-limit", fl.RateLimit, "Maximum bytes per second downloaded, across all transfers - 0 means no limit")
+	set.IntVar(&fl.MaxSize, prefix+"download-max-size", fl.MaxSize, "Largest file to download, in bytes. Larger transfers are aborted as soon as the limit is exceeded - 0 means no limit")
+	set.DurationVar(&fl.HedgeDelay, prefix+"download-hedge-delay", fl.HedgeDelay, "For files with mirrors, how long to wait for a mirror to respond before trying the next one in parallel - 0 means try one at a time")
 
 	fl.Retry.Register(set, prefix+"download-")
 	fl.Workpool.Register(set, prefix+"download-")
@@ -56,7 +82,24 @@ func FromFlags(fl *Flags) Modifier {
 			return nil
 		}
 
+		if fl.MaxConcurrent < 0 {
+			return kflags.NewUsageErrorf("invalid download-max-concurrent %d - must be >= 0", fl.MaxConcurrent)
+		}
+		if fl.RateLimit < 0 {
+			return kflags.NewUsageErrorf("invalid download-rate-limit %d - must be >= 0", fl.RateLimit)
+		}
+		if fl.MaxSize < 0 {
+			return kflags.NewUsageErrorf("invalid download-max-size %d - must be >= 0", fl.MaxSize)
+		}
+		if fl.HedgeDelay < 0 {
+			return kflags.NewUsageErrorf("invalid download-hedge-delay %s - must be >= 0", fl.HedgeDelay)
+		}
+
 		o.timeout = fl.Timeout
+		o.maxConcurrent = fl.MaxConcurrent
+		o.rateLimit = fl.RateLimit
+		o.maxSize = int64(fl.MaxSize)
+		o.hedgeDelay = fl.HedgeDelay
 		o.retry = append(o.retry, retry.FromFlags(fl.Retry))
 		o.pool = append(o.pool, workpool.FromFlags(fl.Workpool))
 		o.client = append(o.client, kclient.FromFlags(fl.Client))
@@ -71,6 +114,112 @@ func WithTimeout(timeout time.Duration) Modifier {
 	}
 }
 
+// WithMaxConcurrent limits the number of transfers running in parallel.
+//
+// Transfers waiting to be retried do not count toward the limit. Only valid in New,
+// to limit a single Get use WithLimiter instead.
+func WithMaxConcurrent(transfers int) Modifier {
+	return func(o *options) error {
+		o.maxConcurrent = transfers
+		return nil
+	}
+}
+
+// WithRateLimit limits the aggregate bandwidth of all the transfers, in bytes per second.
+//
+// Only valid in New, to limit a single Get use WithTransferRateLimit instead.
+func WithRateLimit(bytesPerSecond int) Modifier {
+	return func(o *options) error {
+		o.rateLimit = bytesPerSecond
+		return nil
+	}
+}
+
+// WithLimiter uses the specified Limiter, rather than one created from WithMaxConcurrent and WithRateLimit.
+//
+// In New, it allows sharing the same limits across Downloaders. In Get, it
+// replaces the limits of the Downloader for a single transfer. A nil Limiter
+// removes all the limits.
+func WithLimiter(limiter *Limiter) Modifier {
+	return func(o *options) error {
+		o.limiter = limiter
+		o.customLimiter = true
+		return nil
+	}
+}
+
+// WithTransferRateLimit limits the bandwidth of each transfer, in bytes per second.
+//
+// The limit applies in addition to the limits of the Limiter in use. Zero
+// removes the limit.
+func WithTransferRateLimit(bytesPerSecond int) Modifier {
+	return func(o *options) error {
+		o.transferRate = bytesPerSecond
+		return nil
+	}
+}
+
+// WithMaxSize aborts transfers returning more than the specified number of bytes, with ErrTooLarge.
+//
+// Transfers are aborted as soon as the limit is exceeded, or before
+// starting if the Content-Length of the response exceeds it. Zero removes
+// the limit.
+func WithMaxSize(bytes int64) Modifier {
+	return func(o *options) error {
+		o.maxSize = bytes
+		return nil
+	}
+}
+
+// WithResume allows retries to resume a transfer from where the previous attempt stopped.
+//
+// The body is first downloaded in a temporary file created in dir, or in the
+// default directory for temporary files if dir is empty. If an attempt fails,
+// the next one requests only the missing bytes with a Range request, as long as
+// the server returned a strong ETag or a Last-Modified header, and the file was
+// not changed in the meantime. Otherwise, the transfer starts over.
+//
+// The handler is invoked only once the body has been completely downloaded,
+// with a response reading from the temporary file. The file is removed once
+// the handler succeeds, or the transfer is abandoned.
+//
+// Without WithResume, the handler is invoked as soon as the response headers
+// are received, and processes the body as it is streamed.
+func WithResume(dir string) Modifier {
+	return func(o *options) error {
+		o.resume = true
+		o.resumeDir = dir
+		return nil
+	}
+}
+
+// WithMirrors specifies URLs serving the same file as the URL passed to Get, tried in order if it fails.
+//
+// The first URL to succeed is used. If all of them fail, the error returned
+// is a multierror.MultiError with a MirrorError for each URL. Each retry tries
+// all the URLs again, starting from the first.
+func WithMirrors(urls ...string) Modifier {
+	return func(o *options) error {
+		o.mirrors = append([]string{}, urls...)
+		return nil
+	}
+}
+
+// WithHedgeDelay tries the next mirror in parallel if the previous ones did not respond within delay.
+//
+// The first mirror returning a response with a 2xx status is used, and the
+// requests to the other mirrors are canceled. Responses with other status
+// codes are treated as failures, and not passed to the handler.
+//
+// Hedged requests share the Limiter slot of the transfer. Zero disables
+// hedging, mirrors are then tried one at a time.
+func WithHedgeDelay(delay time.Duration) Modifier {
+	return func(o *options) error {
+		o.hedgeDelay = delay
+		return nil
+	}
+}
+
 func WithRetryOptions(mods ...retry.Modifier) Modifier {
 	return func(o *options) error {
 		o.retry = append(o.retry, mods...)
@@ -126,6 +275,10 @@ type options struct {
 	sched scheduler.Modifiers
 	pool  workpool.Modifiers
 	wg    *sync.WaitGroup
+
+	maxConcurrent int
+	rateLimit     int
+	customLimiter bool
 }
 
 type Downloader struct {
@@ -142,11 +295,31 @@ func (o *roptions) Retrier() *retry.Options {
 }
 
 func (o *roptions) ProtocolModifiers() []protocol.Modifier {
-	return append(protocol.Modifiers{
+	mods := append(protocol.Modifiers{
 		protocol.WithContext(o.ctx),
 		protocol.WithTimeout(o.timeout),
 		protocol.WithRequestOptions(o.request...),
 		protocol.WithClientOptions(o.client...)}, o.protocol...)
+
+	var buckets []*bucket
+	if o.limiter != nil && o.limiter.bucket != nil {
+		buckets = append(buckets, o.limiter.bucket)
+	}
+	if transfer := newBucket(o.transferRate, time.Now); transfer != nil {
+		buckets = append(buckets, transfer)
+	}
+	if len(buckets) > 0 || o.maxSize > 0 {
+		// Must be last, so the transport configured by the other modifiers is wrapped.
+		mods = append(mods, protocol.WithClientOptions(func(c *http.Client) error {
+			rt := c.Transport
+			if rt == nil {
+				rt = http.DefaultTransport
+			}
+			c.Transport = &limitedTransport{RoundTripper: rt, buckets: buckets, maxSize: o.maxSize}
+			return nil
+		}))
+	}
+	return mods
 }
 
 // Get will fetch the specified url, invoke handler to process the response, and eh to process the returned error.
@@ -158,6 +331,10 @@ func (o *roptions) ProtocolModifiers() []protocol.Modifier {
 //
 // When combining with WithRetry options, if the handler or get return error, the operation will be retried.
 //
+// Each attempt waits for a slot of the Limiter before starting, and releases it when done, so a transfer
+// waiting to be retried does not hold a slot. Bytes are charged to the Limiter as they are read, so a
+// retried transfer is only charged for the bytes each attempt actually transferred.
+//
 // Get returns an error. But given that downloads are scheduled asynchronously, the only case when Get will
 // return an error is if an invalid combination of flags or options was specified.
 func (d *Downloader) Get(url string, handler protocol.ResponseHandler, eh workpool.ErrorHandler, mods ...Modifier) error {
@@ -165,9 +342,45 @@ func (d *Downloader) Get(url string, handler protocol.ResponseHandler, eh workpo
 	if err := Modifiers(mods).Apply(options); err != nil {
 		return err
 	}
+	if options.maxConcurrent != 0 || options.rateLimit != 0 {
+		return kflags.NewUsageErrorf("WithMaxConcurrent and WithRateLimit can only be used in New - use WithLimiter or WithTransferRateLimit in Get")
+	}
+
+	var resume *resumer
+	if options.resume {
+		resume = &resumer{dir: options.resumeDir, maxSize: options.maxSize, handler: handler}
+		handler = resume.Handle
+		// Invoked once the transfer either succeeded or was abandoned.
+		nested := eh
+		eh = workpool.ErrorCallback(func(err error) {
+			resume.Close()
+			nested.Handle(err)
+		})
+	}
 
 	work := func() error {
-		return protocol.Get(url, handler, options.ProtocolModifiers()...)
+		release, err := options.limiter.Acquire(options.ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		mods := func() []protocol.Modifier {
+			mods := options.ProtocolModifiers()
+			if resume != nil {
+				mods = append(mods, protocol.WithRequestOptions(resume.RequestModifiers()...))
+			}
+			return mods
+		}
+		if len(options.mirrors) == 0 {
+			return protocol.Get(url, handler, mods()...)
+		}
+
+		urls := append([]string{url}, options.mirrors...)
+		if options.hedgeDelay > 0 {
+			return getHedged(options.ctx, options.hedgeDelay, urls, handler, mods)
+		}
+		return getFirst(urls, handler, mods)
 	}
 
 	retrier := options.Retrier()
@@ -213,6 +426,15 @@ func New(mods ...Modifier) (*Downloader, error) {
 	if err := Modifiers(mods).Apply(options); err != nil {
 		return nil, err
 	}
+	if options.maxConcurrent < 0 || options.rateLimit < 0 {
+		return nil, kflags.NewUsageErrorf("invalid limits - max concurrent transfers %d and rate limit %d must be >= 0", options.maxConcurrent, options.rateLimit)
+	}
+	if options.customLimiter && (options.maxConcurrent != 0 || options.rateLimit != 0) {
+		return nil, kflags.NewUsageErrorf("WithLimiter cannot be combined with WithMaxConcurrent or WithRateLimit")
+	}
+	if !options.customLimiter && (options.maxConcurrent != 0 || options.rateLimit != 0) {
+		options.limiter = NewLimiter(options.maxConcurrent, options.rateLimit)
+	}
 
 	wp, err := workpool.New(append([]workpool.Modifier{
 		workpool.WithWaitGroup(options.wg)}, options.pool...)...)
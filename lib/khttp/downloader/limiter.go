@@ -0,0 +1,180 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter caps the number of concurrent transfers, and their aggregate bandwidth.
+//
+// The bandwidth is limited with a token bucket shared by all the transfers
+// using the Limiter, refilled at the configured rate, and holding at most one
+// second worth of tokens.
+//
+// A Limiter can be shared by multiple Downloaders. A nil *Limiter imposes no limit.
+type Limiter struct {
+	slots  chan struct{}
+	bucket *bucket
+}
+
+// NewLimiter returns a Limiter allowing at most concurrent transfers, at bytesPerSecond overall.
+//
+// Zero or negative values disable the corresponding limit.
+func NewLimiter(concurrent int, bytesPerSecond int) *Limiter {
+	l := &Limiter{bucket: newBucket(bytesPerSecond, time.Now)}
+	if concurrent > 0 {
+		l.slots = make(chan struct{}, concurrent)
+	}
+	return l
+}
+
+// Acquire blocks until a transfer slot is available, or ctx is done.
+//
+// On success, it returns a function to invoke to release the slot once the transfer is completed.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil || l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// bucket is a token bucket, each token representing a byte.
+type bucket struct {
+	rate float64
+	now  func() time.Time
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a bucket refilled at rate tokens per second, or nil if rate is not positive.
+func newBucket(rate int, now func() time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), now: now, tokens: float64(rate), last: now()}
+}
+
+// Burst returns the largest number of tokens the bucket can hold.
+func (b *bucket) Burst() int {
+	return int(b.rate)
+}
+
+// Reserve consumes n tokens, returning how long to wait before the tokens are actually available.
+//
+// Tokens can be borrowed: after a large Reserve, the following ones wait for the debt to be repaid.
+func (b *bucket) Reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Cancel returns n tokens to the bucket, after a Reserve that was not waited for.
+func (b *bucket) Cancel(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += float64(n)
+}
+
+// Take consumes n tokens, blocking until they are available, or ctx is done.
+func (b *bucket) Take(ctx context.Context, n int) error {
+	wait := b.Reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.Cancel(n)
+		return ctx.Err()
+	}
+}
+
+// limitedBody is an io.ReadCloser charging the bytes read to a set of buckets, and failing after maxSize bytes.
+type limitedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	buckets []*bucket
+
+	maxSize int64
+	read    int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte past the limit, to detect bodies exceeding it.
+	if lb.maxSize > 0 && int64(len(p)) > lb.maxSize-lb.read+1 {
+		p = p[:lb.maxSize-lb.read+1]
+	}
+	// Never read more than a bucket can hold, or the read would never be repaid.
+	for _, b := range lb.buckets {
+		if burst := b.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := lb.ReadCloser.Read(p)
+	lb.read += int64(n)
+	if lb.maxSize > 0 && lb.read > lb.maxSize {
+		return 0, fmt.Errorf("%w - more than %d bytes returned", ErrTooLarge, lb.maxSize)
+	}
+	for _, b := range lb.buckets {
+		if terr := b.Take(lb.ctx, n); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	return n, err
+}
+
+// limitedTransport is an http.RoundTripper limiting the bandwidth used to read the responses, and their size.
+//
+// The bytes are charged as they are read from the network, so a failed or
+// retried transfer only consumes the bytes it actually transferred.
+//
+// Responses larger than maxSize fail as soon as the limit is exceeded, or
+// before reading the body, if the Content-Length already exceeds it.
+type limitedTransport struct {
+	http.RoundTripper
+	buckets []*bucket
+	maxSize int64
+}
+
+func (lt *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := lt.RoundTripper.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	if lt.maxSize > 0 && resp.ContentLength > lt.maxSize {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w - %s would return %d bytes, limit is %d", ErrTooLarge, req.URL, resp.ContentLength, lt.maxSize)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, ctx: req.Context(), buckets: lt.buckets, maxSize: lt.maxSize}
+	return resp, err
+}
@@ -0,0 +1,160 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/khttp/ktest"
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/System233/enkit/lib/khttp/workpool"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	b := newBucket(1000, func() time.Time { return now })
+	assert.Equal(t, 1000, b.Burst())
+
+	// The bucket starts full.
+	assert.Equal(t, time.Duration(0), b.Reserve(1000))
+	// Tokens are borrowed, and repaid at the configured rate.
+	assert.Equal(t, 500*time.Millisecond, b.Reserve(500))
+	b.Cancel(500)
+
+	now = now.Add(250 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.Reserve(250))
+
+	// The bucket never holds more than a second worth of tokens.
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), b.Reserve(1000))
+	assert.Equal(t, 100*time.Millisecond, b.Reserve(100))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, b.Take(ctx, 100))
+
+	assert.Nil(t, newBucket(0, time.Now))
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	var running, highest int32
+	_, url, err := ktest.StartServer(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			old := atomic.LoadInt32(&highest)
+			if current <= old || atomic.CompareAndSwapInt32(&highest, old, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+	assert.Nil(t, err)
+
+	downloader, err := New(WithMaxConcurrent(2), WithWorkpoolOptions(workpool.WithWorkers(8)))
+	assert.Nil(t, err)
+
+	results := make([]string, 10)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, downloader.Get(url, protocol.Read(protocol.String(&results[i])), workpool.ErrorIgnore))
+	}
+	downloader.Wait()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "hello", results[i])
+	}
+	assert.Equal(t, int32(2), highest)
+
+	// Limits are global, and cannot be changed in Get.
+	assert.NotNil(t, downloader.Get(url, protocol.Read(protocol.Null()), workpool.ErrorIgnore, WithMaxConcurrent(1)))
+	_, err = New(WithMaxConcurrent(1), WithLimiter(NewLimiter(2, 0)))
+	assert.NotNil(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	body := strings.Repeat("x", 4096)
+	_, url, err := ktest.StartServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	assert.Nil(t, err)
+
+	// The first 4096 bytes are free, as the bucket starts full, the other 8192 take at least 1s.
+	downloader, err := New(WithRateLimit(4096), WithWorkpoolOptions(workpool.WithWorkers(3)))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	results := make([]string, 3)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, downloader.Get(url, protocol.Read(protocol.String(&results[i])), workpool.ErrorIgnore))
+	}
+	downloader.Wait()
+	assert.True(t, time.Since(start) >= 900*time.Millisecond, "took %s", time.Since(start))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, body, results[i])
+	}
+
+	// A nil limiter in Get bypasses the limits of the downloader.
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, downloader.Get(url, protocol.Read(protocol.String(&results[i])), workpool.ErrorIgnore, WithLimiter(nil)))
+	}
+	downloader.Wait()
+	assert.True(t, time.Since(start) < 900*time.Millisecond, "took %s", time.Since(start))
+
+	// A per transfer limit applies even without a limiter.
+	unlimited, err := New()
+	assert.Nil(t, err)
+	start = time.Now()
+	result := ""
+	assert.Nil(t, unlimited.Get(url, protocol.Read(protocol.String(&result)), workpool.ErrorIgnore, WithTransferRateLimit(2048)))
+	unlimited.Wait()
+	assert.True(t, time.Since(start) >= 900*time.Millisecond, "took %s", time.Since(start))
+	assert.Equal(t, body, result)
+}
+
+func TestLimitsWithRetries(t *testing.T) {
+	var lock sync.Mutex
+	attempts := map[string]int{}
+	_, url, err := ktest.StartServer(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts[r.URL.Query().Get("id")]++
+		attempt := attempts[r.URL.Query().Get("id")]
+		lock.Unlock()
+
+		if attempt == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	assert.Nil(t, err)
+
+	// A single slot: a transfer waiting for a retry must release it, or the others would deadlock.
+	downloader, err := New(WithMaxConcurrent(1), WithRateLimit(1<<20),
+		WithRetryOptions(retry.WithAttempts(3), retry.WithWait(10*time.Millisecond)))
+	assert.Nil(t, err)
+
+	var errs []error
+	results := make([]string, 4)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, downloader.Get(fmt.Sprintf("%s?id=%d", url, i), protocol.Read(protocol.String(&results[i])), workpool.ErrorCallback(func(err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, err)
+		})))
+	}
+	downloader.Wait()
+	assert.Equal(t, 0, len(errs), "%v", errs)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "hello", results[i])
+		assert.Equal(t, 2, attempts[strconv.Itoa(i)])
+	}
+}
@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/System233/enkit/lib/multierror"
+)
+
+// errHedgeLost is returned by the mirrors that completed after another mirror already succeeded.
+var errHedgeLost = errors.New("another mirror responded first")
+
+// MirrorError annotates the error returned by one of the URLs of a download.
+//
+// When all the URLs of a download fail, Get returns a multierror.MultiError
+// with one MirrorError per URL, in the order the URLs were specified.
+type MirrorError struct {
+	error
+	URL string
+}
+
+func (e *MirrorError) Unwrap() error {
+	return e.error
+}
+
+func (e *MirrorError) Error() string {
+	return fmt.Sprintf("mirror %s - %v", e.URL, e.error)
+}
+
+// mirrorsError returns the errors of a download from multiple URLs, annotated with the corresponding URL.
+func mirrorsError(urls []string, errs []error) error {
+	annotated := make([]error, 0, len(errs))
+	for ix, err := range errs {
+		if err == nil {
+			continue
+		}
+		annotated = append(annotated, &MirrorError{error: err, URL: urls[ix]})
+	}
+	return multierror.New(annotated)
+}
+
+// getFirst fetches each url in order, until one succeeds.
+//
+// mods is invoked before each request, to compute the modifiers to use.
+func getFirst(urls []string, handler protocol.ResponseHandler, mods func() []protocol.Modifier) error {
+	errs := make([]error, len(urls))
+	for ix, url := range urls {
+		errs[ix] = protocol.Get(url, handler, mods()...)
+		if errs[ix] == nil {
+			return nil
+		}
+	}
+	return mirrorsError(urls, errs)
+}
+
+// getHedged fetches the urls in order, starting the next one if the previous did not complete within delay.
+//
+// The first url returning a successful response wins: handler is invoked for
+// that response only, while the requests to the other urls are canceled. If
+// a url fails before another one succeeds, the next url is started immediately.
+//
+// Only responses with a 2xx status can win, other responses are reported as
+// errors without invoking handler.
+func getHedged(ctx context.Context, delay time.Duration, urls []string, handler protocol.ResponseHandler, mods func() []protocol.Modifier) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(urls))
+
+	var lock sync.Mutex
+	winner := -1
+	cancels := make([]context.CancelFunc, len(urls))
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, cancel := range cancels {
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}()
+
+	won := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return winner
+	}
+	// claim returns true if index is the first url to respond successfully, canceling all the others.
+	claim := func(index int) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if winner >= 0 {
+			return false
+		}
+		winner = index
+		for ix, cancel := range cancels {
+			if ix != index && cancel != nil {
+				cancel()
+			}
+		}
+		return true
+	}
+
+	started := 0
+	start := func() {
+		index := started
+		started++
+
+		lock.Lock()
+		mctx, cancel := context.WithCancel(ctx)
+		cancels[index] = cancel
+		lock.Unlock()
+
+		claimer := func(url string, resp *http.Response, err error) error {
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Errorf("status is not successful - %s", resp.Status)
+			}
+			if !claim(index) {
+				return errHedgeLost
+			}
+			return handler(url, resp, err)
+		}
+		rmods := append(mods(), protocol.WithContext(mctx))
+		go func() {
+			err := protocol.Get(urls[index], claimer, rmods...)
+			results <- result{index: index, err: err}
+		}()
+	}
+
+	errs := make([]error, len(urls))
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if started < len(urls) && won() < 0 {
+				start()
+				pending++
+				timer.Reset(delay)
+			}
+
+		case r := <-results:
+			pending--
+			winner := won()
+			if r.index == winner {
+				return r.err
+			}
+
+			errs[r.index] = r.err
+			if winner < 0 && started < len(urls) {
+				start()
+				pending++
+				timer.Reset(delay)
+			}
+		}
+	}
+	return mirrorsError(urls, errs)
+}
@@ -0,0 +1,107 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/khttp/ktest"
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/System233/enkit/lib/khttp/workpool"
+	"github.com/System233/enkit/lib/multierror"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+// mirrorErrors returns the errors of each mirror, from the error of a Get with a single attempt.
+func mirrorErrors(t *testing.T, err error) multierror.MultiError {
+	// The retry library returns the errors of each attempt.
+	attempts, ok := err.(multierror.MultiError)
+	assert.True(t, ok, "%v", err)
+	assert.Equal(t, 1, len(attempts))
+	mirrors, ok := attempts[0].(multierror.MultiError)
+	assert.True(t, ok, "%v", attempts[0])
+	return mirrors
+}
+
+func TestMirrors(t *testing.T) {
+	broken := ktest.Capture(ktest.ErrorHandler)
+	_, brokenURL, err := ktest.StartServer(broken.Handle)
+	assert.Nil(t, err)
+	working := ktest.Capture(ktest.HelloHandler)
+	_, workingURL, err := ktest.StartServer(working.Handle)
+	assert.Nil(t, err)
+
+	dl, err := New(WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+
+	// The first mirror is broken, the second one is used.
+	var result string
+	var derr error
+	assert.Nil(t, dl.Get(brokenURL, protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr), WithMirrors(workingURL)))
+	dl.Wait()
+	assert.Nil(t, derr)
+	assert.Equal(t, "hello", result)
+	assert.Equal(t, 1, len(broken.Request))
+	assert.Equal(t, 1, len(working.Request))
+
+	// Mirrors after a successful one are not tried.
+	assert.Nil(t, dl.Get(workingURL, protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr), WithMirrors(brokenURL)))
+	dl.Wait()
+	assert.Nil(t, derr)
+	assert.Equal(t, 1, len(broken.Request))
+	assert.Equal(t, 2, len(working.Request))
+
+	// All mirrors fail: the error reports the failure of each one, in order.
+	assert.Nil(t, dl.Get(brokenURL, protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr), WithMirrors(brokenURL+"again")))
+	dl.Wait()
+	merr := mirrorErrors(t, derr)
+	assert.Equal(t, 2, len(merr))
+	for ix, url := range []string{brokenURL, brokenURL + "again"} {
+		var mirror *MirrorError
+		assert.True(t, errors.As(merr[ix], &mirror))
+		assert.Equal(t, url, mirror.URL)
+		var herr *protocol.HTTPError
+		assert.True(t, errors.As(mirror, &herr))
+		assert.Equal(t, http.StatusInternalServerError, herr.Resp.StatusCode)
+	}
+}
+
+func TestHedgedMirrors(t *testing.T) {
+	slow := ktest.Capture(ktest.Slow(2*time.Second, ktest.StringHandler("slow")))
+	_, slowURL, err := ktest.StartServer(slow.Handle)
+	assert.Nil(t, err)
+	_, fastURL, err := ktest.StartServer(ktest.StringHandler("fast"))
+	assert.Nil(t, err)
+	_, brokenURL, err := ktest.StartServer(ktest.ErrorHandler)
+	assert.Nil(t, err)
+
+	dl, err := New(WithHedgeDelay(50*time.Millisecond), WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+
+	// The first mirror does not respond within the delay, the second one is tried in parallel and wins.
+	start := time.Now()
+	var result string
+	var derr error
+	assert.Nil(t, dl.Get(slowURL, protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr), WithMirrors(fastURL)))
+	dl.Wait()
+	assert.Nil(t, derr)
+	assert.Equal(t, "fast", result)
+	assert.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+
+	// A mirror failing before the delay expires starts the next one immediately.
+	start = time.Now()
+	assert.Nil(t, dl.Get(brokenURL, protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr), WithMirrors(fastURL), WithHedgeDelay(time.Hour)))
+	dl.Wait()
+	assert.Nil(t, derr)
+	assert.Equal(t, "fast", result)
+	assert.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+
+	// All mirrors fail.
+	assert.Nil(t, dl.Get(brokenURL, protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr), WithMirrors(brokenURL+"again", brokenURL+"and-again")))
+	dl.Wait()
+	assert.Equal(t, 3, len(mirrorErrors(t, derr)))
+	assert.Contains(t, fmt.Sprintf("%v", derr), brokenURL+"and-again")
+}
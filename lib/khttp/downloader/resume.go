@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/System233/enkit/lib/khttp/krequest"
+	"github.com/System233/enkit/lib/khttp/protocol"
+)
+
+// resumer spills the body of a transfer to a temporary file, so that a retry can continue from where the
+// previous attempt stopped, with a Range request, rather than starting over from byte zero.
+//
+// Once the body is completely downloaded, the handler supplied to Get is invoked with a response
+// reading from the temporary file, as if the whole body had been returned by a single request.
+//
+// A resumer is used by the attempts of a single Get, which run sequentially, so it needs no locking.
+type resumer struct {
+	dir     string
+	maxSize int64
+	handler protocol.ResponseHandler
+
+	file *os.File
+	// Strong validator of the data in file, ETag or Last-Modified, empty if none was returned.
+	validator string
+	// Bytes stored in file so far.
+	size int64
+}
+
+// validatorOf returns a validator usable in an If-Range header for the response, or the empty string.
+//
+// Weak ETags cannot be used with If-Range, Last-Modified is used instead.
+func validatorOf(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// contentRangeStart parses a Content-Range header like "bytes 100-199/200", returning the first byte.
+func contentRangeStart(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, fmt.Errorf("unsupported Content-Range %q", value)
+	}
+	end := strings.IndexAny(value, "-/")
+	if end < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	return strconv.ParseInt(strings.TrimSpace(value[len("bytes "):end]), 10, 64)
+}
+
+// RequestModifiers returns the modifiers to resume the transfer, if possible.
+//
+// Compression is disabled, as ranges refer to the encoded data, while the
+// data stored is decoded by the http client.
+func (r *resumer) RequestModifiers() []krequest.Modifier {
+	mods := []krequest.Modifier{krequest.SetHeader("Accept-Encoding", "identity")}
+	if r.size <= 0 || r.validator == "" {
+		return mods
+	}
+	return append(mods,
+		krequest.SetHeader("Range", fmt.Sprintf("bytes=%d-", r.size)),
+		krequest.SetHeader("If-Range", r.validator))
+}
+
+// reset discards the data downloaded so far, so the next attempt starts over.
+func (r *resumer) reset() error {
+	r.size = 0
+	r.validator = ""
+	if r.file == nil {
+		return nil
+	}
+	if err := r.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := r.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// Close removes the temporary file, if any was created.
+func (r *resumer) Close() {
+	if r.file == nil {
+		return
+	}
+	r.file.Close()
+	os.Remove(r.file.Name())
+	r.file = nil
+	r.size = 0
+}
+
+// Handle is a protocol.ResponseHandler appending the body of the response to the temporary file.
+func (r *resumer) Handle(url string, resp *http.Response, err error) error {
+	if err != nil {
+		return r.handler(url, resp, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("while resuming %s - %w", url, err)
+		}
+		// Servers ignoring If-Range may return a range of a different file, or a different range.
+		if start != r.size || (validatorOf(resp) != "" && validatorOf(resp) != r.validator) {
+			r.reset()
+			return fmt.Errorf("while resuming %s - returned range starting at %d with validator %q, requested %d with %q",
+				url, start, validatorOf(resp), r.size, r.validator)
+		}
+
+	case http.StatusOK:
+		// Server without support for ranges, or the file changed: start over.
+		if err := r.reset(); err != nil {
+			return err
+		}
+		r.validator = validatorOf(resp)
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		r.reset()
+		return fmt.Errorf("while resuming %s - %s", url, resp.Status)
+
+	default:
+		// Errors are reported by the handler, like for transfers that are not resumed.
+		return r.handler(url, resp, err)
+	}
+
+	if r.file == nil {
+		r.file, err = ioutil.TempFile(r.dir, "download-*.partial")
+		if err != nil {
+			return fmt.Errorf("couldn't create temporary file to download %s - %w", url, err)
+		}
+	}
+
+	body := io.Reader(resp.Body)
+	if r.maxSize > 0 {
+		// Read one byte past the limit, to detect bodies exceeding it.
+		body = io.LimitReader(body, r.maxSize-r.size+1)
+	}
+	copied, err := io.Copy(r.file, body)
+	r.size += copied
+	if err != nil {
+		return fmt.Errorf("while downloading url %s - after %d bytes - error %w", url, r.size, err)
+	}
+	if r.maxSize > 0 && r.size > r.maxSize {
+		r.reset()
+		return fmt.Errorf("%w - more than %d bytes returned", ErrTooLarge, r.maxSize)
+	}
+
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	complete := *resp
+	complete.StatusCode = http.StatusOK
+	complete.Status = fmt.Sprintf("%d %s", http.StatusOK, http.StatusText(http.StatusOK))
+	complete.Header = resp.Header.Clone()
+	complete.Header.Del("Content-Range")
+	complete.Header.Set("Content-Length", strconv.FormatInt(r.size, 10))
+	complete.ContentLength = r.size
+	complete.Body = ioutil.NopCloser(r.file)
+
+	if err := r.handler(url, &complete, nil); err != nil {
+		// The data may be what failed the handler, like an invalid checksum: don't resume from it.
+		r.reset()
+		return err
+	}
+	r.Close()
+	return nil
+}
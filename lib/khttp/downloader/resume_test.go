@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/khttp/ktest"
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/System233/enkit/lib/khttp/workpool"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer serves data, dropping the connection half way through the first attempt.
+type flakyServer struct {
+	lock sync.Mutex
+	// Value of the Range header of each request received.
+	ranges []string
+	// Bytes of the body sent, across all requests.
+	sent int
+
+	data string
+	// Validator returned for each attempt, starting from 0. Empty for none.
+	etag func(attempt int) string
+	// If false, Range requests are ignored, and the whole body is returned.
+	supportsRange bool
+}
+
+func (fs *flakyServer) Handle(w http.ResponseWriter, r *http.Request) {
+	fs.lock.Lock()
+	attempt := len(fs.ranges)
+	fs.ranges = append(fs.ranges, r.Header.Get("Range"))
+	fs.lock.Unlock()
+
+	data := fs.data
+	if etag := fs.etag(attempt); etag != "" {
+		w.Header().Set("ETag", etag)
+		data = etag + data[len(etag):]
+	}
+
+	if attempt == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write([]byte(data[:len(data)/2]))
+		fs.addSent(len(data) / 2)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	if !fs.supportsRange {
+		r.Header.Del("Range")
+	}
+	counter := &countingWriter{ResponseWriter: w}
+	http.ServeContent(counter, r, "", time.Time{}, strings.NewReader(data))
+	fs.addSent(counter.written)
+}
+
+func (fs *flakyServer) addSent(bytes int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.sent += bytes
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+func (cw *countingWriter) Write(data []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(data)
+	cw.written += n
+	return n, err
+}
+
+func TestResume(t *testing.T) {
+	data := strings.Repeat("0123456789abcdef", 64*1024)
+	sameETag := func(int) string { return `"v1"` }
+
+	testCases := []struct {
+		desc   string
+		server *flakyServer
+
+		wantRange string
+		wantData  string
+		wantSent  int
+	}{
+		{
+			desc:      "resumes from the last byte received",
+			server:    &flakyServer{data: data, etag: sameETag, supportsRange: true},
+			wantRange: "bytes=524288-",
+			wantData:  `"v1"` + data[4:],
+			wantSent:  len(data),
+		},
+		{
+			desc:      "server without range support",
+			server:    &flakyServer{data: data, etag: sameETag},
+			wantRange: "bytes=524288-",
+			wantData:  `"v1"` + data[4:],
+			wantSent:  len(data) + len(data)/2,
+		},
+		{
+			desc:      "file changed between attempts",
+			server:    &flakyServer{data: data, etag: func(attempt int) string { return `"v` + strconv.Itoa(attempt) + `"` }, supportsRange: true},
+			wantRange: "bytes=524288-",
+			wantData:  `"v1"` + data[4:],
+			wantSent:  len(data) + len(data)/2,
+		},
+		{
+			desc:      "server without validators",
+			server:    &flakyServer{data: data, etag: func(int) string { return "" }, supportsRange: true},
+			wantRange: "",
+			wantData:  data,
+			wantSent:  len(data) + len(data)/2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "resume")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			_, url, err := ktest.StartServer(tc.server.Handle)
+			assert.Nil(t, err)
+
+			dl, err := New(WithResume(dir), WithRetryOptions(retry.WithAttempts(3), retry.WithWait(10*time.Millisecond)))
+			assert.Nil(t, err)
+
+			var result string
+			var derr error
+			digest := &Digest{}
+			assert.Nil(t, dl.Get(url, protocol.Read(Verify(protocol.String(&result), "", digest)), workpool.ErrorStore(&derr)))
+			dl.Wait()
+
+			assert.Nil(t, derr)
+			assert.Equal(t, tc.wantData, result)
+			assert.Equal(t, int64(len(tc.wantData)), digest.Size)
+			assert.Equal(t, []string{"", tc.wantRange}, tc.server.ranges)
+			assert.Equal(t, tc.wantSent, tc.server.sent)
+
+			// The temporary file is removed.
+			entries, err := ioutil.ReadDir(dir)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(entries))
+		})
+	}
+}
+
+func TestResumeFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := strings.Repeat("0123456789abcdef", 64*1024)
+	mux, url, err := ktest.StartServer(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	})
+	assert.Nil(t, err)
+	mux.HandleFunc("/missing", http.NotFound)
+
+	dl, err := New(WithResume(dir), WithMaxSize(int64(len(data)-1)), WithRetryOptions(retry.WithAttempts(2), retry.WithWait(10*time.Millisecond)))
+	assert.Nil(t, err)
+
+	// The temporary file is removed even when the transfer is abandoned.
+	var derr error
+	assert.Nil(t, dl.Get(url, protocol.Read(protocol.Null()), workpool.ErrorStore(&derr)))
+	dl.Wait()
+	assert.True(t, errors.Is(derr, ErrTooLarge), "%v", derr)
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// Errors returned by the server are still reported by the handler.
+	var result string
+	derr = nil
+	assert.Nil(t, dl.Get(url+"missing", protocol.Read(protocol.String(&result)), workpool.ErrorStore(&derr)))
+	dl.Wait()
+	var herr *protocol.HTTPError
+	assert.True(t, errors.As(derr, &herr), "%v", derr)
+	assert.Equal(t, http.StatusNotFound, herr.Resp.StatusCode)
+	assert.Equal(t, "", result)
+}
@@ -0,0 +1,155 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/System233/enkit/lib/khttp/protocol"
+)
+
+var (
+	// ErrTooLarge is returned when a transfer exceeds the maximum size configured with WithMaxSize.
+	ErrTooLarge = errors.New("transfer exceeds the maximum size")
+	// ErrSizeMismatch is returned when a transfer returns more or fewer bytes than its Content-Length.
+	ErrSizeMismatch = errors.New("transfer size does not match the Content-Length")
+	// ErrChecksum is returned when the sha256 of a transfer does not match the expected one.
+	ErrChecksum = errors.New("transfer sha256 does not match the expected one")
+)
+
+// Digest describes the data of a transfer, computed while the data was streamed.
+type Digest struct {
+	// Hex encoded sha256 of the data.
+	SHA256 string
+	// Number of bytes transferred.
+	Size int64
+}
+
+// Verifier computes the Digest of a stream as it is written, verifying it against the expected size and sha256.
+//
+// Write fails as soon as more data than expected is written, so a transfer
+// can be aborted before it is completed. Finish checks the data once
+// completely written.
+type Verifier struct {
+	expected string
+	length   int64
+
+	hash hash.Hash
+	size int64
+}
+
+// NewVerifier returns a Verifier expecting length bytes with the specified sha256.
+//
+// length is ignored if negative, like the ContentLength of an http.Response
+// when unknown. expected is ignored if empty, in which case the Verifier just
+// computes the Digest.
+func NewVerifier(length int64, expected string) *Verifier {
+	return &Verifier{
+		expected: strings.ToLower(strings.TrimSpace(expected)),
+		length:   length,
+		hash:     sha256.New(),
+	}
+}
+
+func (v *Verifier) Write(data []byte) (int, error) {
+	if v.length >= 0 && v.size+int64(len(data)) > v.length {
+		return 0, fmt.Errorf("%w - got more than %d bytes", ErrSizeMismatch, v.length)
+	}
+	v.size += int64(len(data))
+	return v.hash.Write(data)
+}
+
+// Digest returns the Digest of the data written so far.
+func (v *Verifier) Digest() *Digest {
+	return &Digest{SHA256: hex.EncodeToString(v.hash.Sum(nil)), Size: v.size}
+}
+
+// Finish verifies the data written, returning its Digest.
+//
+// The Digest is returned even if the verification fails.
+func (v *Verifier) Finish() (*Digest, error) {
+	digest := v.Digest()
+	if v.length >= 0 && digest.Size != v.length {
+		return digest, fmt.Errorf("%w - got %d bytes, expected %d", ErrSizeMismatch, digest.Size, v.length)
+	}
+	if v.expected != "" && digest.SHA256 != v.expected {
+		return digest, fmt.Errorf("%w - computed sha256 is %s, required is %s", ErrChecksum, digest.SHA256, v.expected)
+	}
+	return digest, nil
+}
+
+// verifyWriter writes the data to a Verifier before passing it to the nested writer.
+type verifyWriter struct {
+	nested   io.WriteCloser
+	verifier *Verifier
+	digest   *Digest
+	closed   bool
+}
+
+func (vw *verifyWriter) Write(data []byte) (int, error) {
+	if _, err := vw.verifier.Write(data); err != nil {
+		// protocol.Read does not close the writer on error, close it now to release the file.
+		vw.close()
+		return 0, err
+	}
+	return vw.nested.Write(data)
+}
+
+func (vw *verifyWriter) close() error {
+	if vw.closed {
+		return nil
+	}
+	vw.closed = true
+	return vw.nested.Close()
+}
+
+func (vw *verifyWriter) Close() error {
+	if err := vw.close(); err != nil {
+		return err
+	}
+	digest, err := vw.verifier.Finish()
+	if vw.digest != nil {
+		*vw.digest = *digest
+	}
+	return err
+}
+
+// Verify returns a ResponseOpener computing the Digest of the data while it is written to nested.
+//
+// The data is verified against the Content-Length of the response and, if
+// not empty, the expected sha256. Writing fails as soon as the response
+// returns more data than its Content-Length, closing fails if the data does
+// not match once completely written.
+//
+// If digest is not nil, it is filled in with the Digest computed, even if no
+// expected sha256 was supplied, or the verification failed.
+func Verify(nested protocol.ResponseOpener, expected string, digest *Digest) protocol.ResponseOpener {
+	return func(resp *http.Response) (io.WriteCloser, error) {
+		w, err := nested(resp)
+		if err != nil {
+			return nil, err
+		}
+		return &verifyWriter{nested: w, verifier: NewVerifier(resp.ContentLength, expected), digest: digest}, nil
+	}
+}
+
+// FileDigest computes the Digest of a file, streaming its content.
+func FileDigest(path string) (*Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	verifier := NewVerifier(-1, "")
+	if _, err := io.Copy(verifier, f); err != nil {
+		return nil, err
+	}
+	return verifier.Digest(), nil
+}
@@ -0,0 +1,165 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/System233/enkit/lib/khttp/ktest"
+	"github.com/System233/enkit/lib/khttp/protocol"
+	"github.com/System233/enkit/lib/khttp/workpool"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifier(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	expected := hex.EncodeToString(sum[:])
+
+	v := NewVerifier(int64(len(data)), expected)
+	_, err := v.Write(data)
+	assert.Nil(t, err)
+	digest, err := v.Finish()
+	assert.Nil(t, err)
+	assert.Equal(t, &Digest{SHA256: expected, Size: int64(len(data))}, digest)
+
+	// Without expectations, the digest is just computed.
+	v = NewVerifier(-1, "")
+	_, err = v.Write(data)
+	assert.Nil(t, err)
+	digest, err = v.Finish()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, digest.SHA256)
+
+	// More data than expected fails immediately, less data fails at the end.
+	v = NewVerifier(5, "")
+	_, err = v.Write(data)
+	assert.True(t, errors.Is(err, ErrSizeMismatch), "%v", err)
+	v = NewVerifier(20, "")
+	_, err = v.Write(data)
+	assert.Nil(t, err)
+	_, err = v.Finish()
+	assert.True(t, errors.Is(err, ErrSizeMismatch), "%v", err)
+
+	v = NewVerifier(-1, "0000")
+	_, err = v.Write(data)
+	assert.Nil(t, err)
+	digest, err = v.Finish()
+	assert.True(t, errors.Is(err, ErrChecksum), "%v", err)
+	assert.Equal(t, expected, digest.SHA256)
+}
+
+// streamHandler returns a handler streaming size bytes in 64kb chunks, without a Content-Length.
+//
+// The number of bytes actually written is stored in written.
+func streamHandler(size int64, written *int64) ktest.Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 64*1024)
+		for sent := int64(0); sent < size; sent += int64(len(chunk)) {
+			n, err := w.Write(chunk)
+			atomic.AddInt64(written, int64(n))
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func TestVerifyLargeTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var written int64
+	size := int64(8 * 1024 * 1024)
+	_, url, err := ktest.StartServer(streamHandler(size, &written))
+	assert.Nil(t, err)
+
+	dl, err := New(WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+
+	var lock sync.Mutex
+	var errs []error
+	eh := workpool.ErrorCallback(func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err)
+	})
+
+	// Wrong hash: the file is completely downloaded, but verification fails at EOF.
+	path := filepath.Join(dir, "wrong-hash")
+	digest := &Digest{}
+	assert.Nil(t, dl.Get(url, protocol.Read(Verify(protocol.File(path), "0000", digest)), eh))
+	dl.Wait()
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, errors.Is(errs[0], ErrChecksum), "%v", errs[0])
+	assert.Equal(t, size, digest.Size)
+
+	// No expected hash: the digest is still computed.
+	path = filepath.Join(dir, "no-hash")
+	digest = &Digest{}
+	errs = nil
+	assert.Nil(t, dl.Get(url, protocol.Read(Verify(protocol.File(path), "", digest)), eh))
+	dl.Wait()
+	assert.Equal(t, 0, len(errs), "%v", errs)
+	assert.Equal(t, size, digest.Size)
+	assert.Equal(t, 64, len(digest.SHA256))
+	computed, err := FileDigest(path)
+	assert.Nil(t, err)
+	assert.Equal(t, digest, computed)
+}
+
+func TestMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var written int64
+	size := int64(64 * 1024 * 1024)
+	mux, url, err := ktest.StartServer(streamHandler(size, &written))
+	assert.Nil(t, err)
+	mux.HandleFunc("/declared", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(2*1024*1024))
+		atomic.AddInt64(&written, 1)
+	})
+
+	max := int64(1024 * 1024)
+	dl, err := New(WithMaxSize(max), WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+
+	var lock sync.Mutex
+	var errs []error
+	eh := workpool.ErrorCallback(func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err)
+	})
+
+	// The transfer is aborted as soon as the limit is exceeded, without filling the disk.
+	path := filepath.Join(dir, "too-large")
+	assert.Nil(t, dl.Get(url, protocol.Read(Verify(protocol.File(path), "", nil)), eh))
+	dl.Wait()
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, errors.Is(errs[0], ErrTooLarge), "%v", errs[0])
+	assert.True(t, atomic.LoadInt64(&written) < size/2, "server wrote %d bytes", written)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.True(t, info.Size() <= max, "file has %d bytes", info.Size())
+
+	// A Content-Length larger than the limit fails before reading the body.
+	errs = nil
+	assert.Nil(t, dl.Get(url+"declared", protocol.Read(protocol.Null()), eh))
+	dl.Wait()
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, errors.Is(errs[0], ErrTooLarge), "%v", errs[0])
+}
@@ -21,6 +21,8 @@ type options struct {
 
 	defaultName string
 	logger      logger.Logger
+
+	key string
 }
 
 type Modifier func(o *options)
@@ -66,6 +68,20 @@ func WithDefaulName(name string) Modifier {
 	}
 }
 
+// WithCacheKey stores the response under the specified url, rather than the url requested.
+//
+// This allows to fetch the same file from multiple mirrors without creating
+// one cache entry per mirror.
+func WithCacheKey(url string) Modifier {
+	return func(o *options) {
+		o.key = url
+	}
+}
+
+// WithCache stores the responses in the cache, and serves the cached file when not modified.
+//
+// The returned modifier can be used for multiple requests, including
+// concurrent ones, as long as they are for the same file.
 func WithCache(cache cache.Store, mods ...Modifier) protocol.Modifier {
 	cacheOptions := &options{
 		defaultName: "index.html",
@@ -73,23 +89,28 @@ func WithCache(cache cache.Store, mods ...Modifier) protocol.Modifier {
 	}
 	Modifiers(mods).Apply(cacheOptions)
 
-	var cachepath string
-	var outfile string
-	var request *http.Request
+	optmodifier := func(options *protocol.Options) error {
+		var cachepath string
+		var outfile string
+		var request *http.Request
+
+		reqmodifier := func(req *http.Request) error {
+			stat, err := os.Stat(filepath.Join(cachepath, outfile))
+			request = req
+			if err == nil {
+				timestring := stat.ModTime().UTC().Format(LastModifiedFormat)
+				req.Header.Set("If-Modified-Since", timestring)
+			}
+			return nil
+		}
 
-	reqmodifier := func(req *http.Request) error {
-		stat, err := os.Stat(filepath.Join(cachepath, outfile))
-		request = req
-		if err == nil {
-			timestring := stat.ModTime().UTC().Format(LastModifiedFormat)
-			req.Header.Set("If-Modified-Since", timestring)
+		key := options.Url
+		if cacheOptions.key != "" {
+			key = cacheOptions.key
 		}
-		return nil
-	}
 
-	optmodifier := func(options *protocol.Options) error {
 		var err error
-		cachepath, _, err = cache.Get(options.Url)
+		cachepath, _, err = cache.Get(key)
 		if err != nil {
 			if cacheOptions.cachePolicy == CEPFail {
 				return fmt.Errorf("error retrieving url from cache: %w", err)
@@ -99,7 +120,7 @@ func WithCache(cache cache.Store, mods ...Modifier) protocol.Modifier {
 			return nil
 		}
 
-		url, err := url.Parse(options.Url)
+		url, err := url.Parse(key)
 		if err != nil {
 			outfile = cacheOptions.defaultName
 		} else {
@@ -112,7 +133,7 @@ func WithCache(cache cache.Store, mods ...Modifier) protocol.Modifier {
 		options.Cleaner = append(options.Cleaner, func() {
 			cache.Rollback(cachepath)
 		})
-		options.Handler = readUpdateHandler(options.Url, cache, cachepath, outfile, options.Handler, request, cacheOptions)
+		options.Handler = readUpdateHandler(key, cache, cachepath, outfile, options.Handler, request, cacheOptions)
 		options.RequestMods = append(options.RequestMods, reqmodifier)
 		return nil
 	}
@@ -84,3 +84,34 @@ func TestLastModified(t *testing.T) {
 	assert.Nil(t, err, "error %s", err)
 	assert.Equal(t, "hello", data)
 }
+
+// Fetching the same file from a mirror with WithCacheKey uses the same cache entry.
+func TestCacheKey(t *testing.T) {
+	recorder := ktest.Capture(ktest.CachableHelloHandler)
+	_, canonical, err := ktest.StartServer(recorder.Handle)
+	assert.Nil(t, err)
+	_, mirror, err := ktest.StartServer(recorder.Handle)
+	assert.Nil(t, err)
+
+	td, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	local := &cache.Local{Root: td}
+
+	data := ""
+	err = protocol.Get(mirror, protocol.Read(protocol.String(&data)), WithCache(local, WithCacheKey(canonical)))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", data)
+	found, err := local.Exists(canonical)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", found)
+	found, err = local.Exists(mirror)
+	assert.Nil(t, err)
+	assert.Equal(t, "", found)
+
+	// The file downloaded from the mirror is revalidated with the canonical url.
+	err = protocol.Get(canonical, protocol.Read(protocol.String(&data)), WithCache(local))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", data)
+	assert.Equal(t, 2, len(recorder.Request))
+	assert.Equal(t, http.StatusNotModified, recorder.Response[1].StatusCode)
+}
@@ -2,9 +2,14 @@ package kclient
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/System233/enkit/lib/kflags"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -20,12 +25,40 @@ type Flags struct {
 
 	ForceAttemptHTTP2    bool
 	InsecureCertificates bool
+
+	// URL of the proxy to send requests through. If empty, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are honored.
+	Proxy string
+	// PEM files, or directories of PEM files, with root CAs to trust in
+	// addition to those of the system.
+	RootCAs []string
+}
+
+// defaultTransport returns http.DefaultTransport, unwrapping it if it was wrapped, for example, to trace requests.
+func defaultTransport() (*http.Transport, bool) {
+	rt := http.DefaultTransport
+	if wrapper, ok := rt.(interface{ Unwrap() http.RoundTripper }); ok {
+		rt = wrapper.Unwrap()
+	}
+	transport, ok := rt.(*http.Transport)
+	return transport, ok
+}
+
+// newTransport returns a new transport configured like the default one.
+//
+// Unlike a zero http.Transport, the returned transport honors the proxy
+// environment variables, and any configuration applied with ConfigureDefault.
+func newTransport() *http.Transport {
+	if transport, ok := defaultTransport(); ok {
+		return transport.Clone()
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment}
 }
 
 func DefaultFlags() *Flags {
 	flags := &Flags{}
 
-	transport, ok := http.DefaultTransport.(*http.Transport)
+	transport, ok := defaultTransport()
 	if ok {
 		flags.ExpectContinueTimeout = transport.ExpectContinueTimeout
 		flags.TLSHandshakeTimeout = transport.TLSHandshakeTimeout
@@ -44,6 +77,8 @@ func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.IntVar(&fl.MaxIdleConns, prefix+"http-max-idle-conns", fl.MaxIdleConns, "How many idle connections to keep at most")
 	set.BoolVar(&fl.ForceAttemptHTTP2, prefix+"http-attempt-http2", fl.ForceAttemptHTTP2, "Try using HTTP2, fallback to HTTP1 if that does not work")
 	set.BoolVar(&fl.InsecureCertificates, prefix+"http-insecure-certificates", fl.InsecureCertificates, "Allow insecure certificates from the server")
+	set.StringVar(&fl.Proxy, prefix+"http-proxy", fl.Proxy, "URL of the proxy to send http and https requests through, like http://proxy.corp:3128 - if empty, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used")
+	set.StringArrayVar(&fl.RootCAs, prefix+"http-root-ca", fl.RootCAs, "PEM file, or directory of PEM files, with additional root CAs to trust - can be repeated")
 	return fl
 }
 
@@ -59,6 +94,10 @@ func (fl *Flags) Matches(transport *http.Transport) bool {
 	if (config == nil && fl.InsecureCertificates) || (config != nil && config.InsecureSkipVerify != fl.InsecureCertificates) {
 		return false
 	}
+	// Proxy functions and certificate pools cannot be compared, assume they need to be configured.
+	if fl.Proxy != "" || len(fl.RootCAs) > 0 {
+		return false
+	}
 	return true
 }
 
@@ -70,7 +109,7 @@ func FromFlags(fl *Flags) Modifier {
 
 		transport, ok := c.Transport.(*http.Transport)
 		if c.Transport == nil {
-			transport, ok = http.DefaultTransport.(*http.Transport)
+			transport, ok = defaultTransport()
 		}
 		if !ok {
 			return fmt.Errorf("cannot apply flags on non-http transport %#v", transport)
@@ -83,7 +122,7 @@ func FromFlags(fl *Flags) Modifier {
 
 		// Need to change the transport parameters. If it's a default transport, we need to create a new one.
 		if c.Transport == nil {
-			transport = &http.Transport{}
+			transport = newTransport()
 			c.Transport = transport
 		}
 
@@ -92,6 +131,16 @@ func FromFlags(fl *Flags) Modifier {
 		transport.IdleConnTimeout = fl.IdleConnTimeout
 		transport.MaxIdleConns = fl.MaxIdleConns
 		transport.ForceAttemptHTTP2 = fl.ForceAttemptHTTP2
+		if fl.Proxy != "" {
+			if err := WithProxy(fl.Proxy)(c); err != nil {
+				return err
+			}
+		}
+		if len(fl.RootCAs) > 0 {
+			if err := WithRootCAs(fl.RootCAs...)(c); err != nil {
+				return err
+			}
+		}
 		if fl.InsecureCertificates {
 			return WithInsecureCertificates()(c)
 		}
@@ -112,7 +161,7 @@ func (cg Modifiers) Apply(base *http.Client) error {
 func transport(c *http.Client) (*http.Transport, error) {
 	transport, ok := c.Transport.(*http.Transport)
 	if c.Transport == nil {
-		transport = &http.Transport{}
+		transport = newTransport()
 		c.Transport = transport
 		return transport, nil
 	}
@@ -232,3 +281,123 @@ func WithInsecureCertificates() Modifier {
 		return nil
 	}
 }
+
+// ConfigureDefault applies mods to http.DefaultTransport.
+//
+// All the clients not configuring a transport of their own, or creating one
+// with the modifiers in this library, are affected. Modifiers replacing the
+// transport, like WithTransport, have no effect.
+func ConfigureDefault(mods ...Modifier) error {
+	transport, ok := defaultTransport()
+	if !ok {
+		return fmt.Errorf("the default transport is not an http.Transport - %#v - cannot be configured", http.DefaultTransport)
+	}
+	return Modifiers(mods).Apply(&http.Client{Transport: transport})
+}
+
+// ProxyFunc returns a function selecting the proxy to use for each request, as used by http.Transport.
+//
+// If proxy is empty, the proxy is selected based on the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables. Otherwise, all requests go through proxy.
+func ProxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	purl, err := url.Parse(proxy)
+	if err != nil {
+		return nil, kflags.NewUsageErrorf("invalid proxy %s - %w", proxy, err)
+	}
+	if purl.Scheme == "" || purl.Host == "" {
+		return nil, kflags.NewUsageErrorf("invalid proxy %s - must be a URL like http://proxy.corp:3128", proxy)
+	}
+	return http.ProxyURL(purl), nil
+}
+
+// WithProxy configures the client to send requests through the specified proxy.
+//
+// An empty proxy restores the default behavior of honoring the proxy environment variables.
+func WithProxy(proxy string) Modifier {
+	return func(c *http.Client) error {
+		pf, err := ProxyFunc(proxy)
+		if err != nil {
+			return err
+		}
+
+		transport, err := transport(c)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = pf
+		return nil
+	}
+}
+
+// LoadRootCAs returns the system certificate pool, with the certificates in paths added.
+//
+// Each path is either a PEM file, or a directory. All the files in a directory
+// are loaded, subdirectories are ignored. Each file must contain at least one
+// PEM certificate.
+func LoadRootCAs(paths ...string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, kflags.NewUsageErrorf("invalid root CA %s - %w", path, err)
+		}
+
+		files := []string{path}
+		if info.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, fmt.Errorf("could not list root CAs in %s - %w", path, err)
+			}
+			files = nil
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("could not read root CA %s - %w", file, err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, kflags.NewUsageErrorf("invalid root CA %s - no PEM certificate found", file)
+			}
+		}
+	}
+	return pool, nil
+}
+
+// WithRootCAs configures the client to trust the certificates in paths, in addition to the system ones.
+//
+// See LoadRootCAs for the format of paths.
+func WithRootCAs(paths ...string) Modifier {
+	return func(c *http.Client) error {
+		pool, err := LoadRootCAs(paths...)
+		if err != nil {
+			return err
+		}
+
+		transport, err := transport(c)
+		if err != nil {
+			return err
+		}
+
+		config := transport.TLSClientConfig
+		if config == nil {
+			config = &tls.Config{}
+			transport.TLSClientConfig = config
+		}
+		config.RootCAs = pool
+		return nil
+	}
+}
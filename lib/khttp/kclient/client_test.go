@@ -0,0 +1,75 @@
+package kclient
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+
+	c := &http.Client{}
+	assert.Nil(t, FromFlags(&Flags{Proxy: proxy.URL})(c))
+	resp, err := c.Get("http://enkit.invalid/config.toml")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"http://enkit.invalid/config.toml"}, proxied)
+
+	// Transports created by other modifiers honor the environment, like the default one.
+	c = &http.Client{}
+	assert.Nil(t, WithIdleConnTimeout(0)(c))
+	assert.NotNil(t, c.Transport.(*http.Transport).Proxy)
+
+	var uerr *kflags.UsageError
+	assert.ErrorAs(t, WithProxy("proxy.corp:3128")(&http.Client{}), &uerr)
+}
+
+func TestRootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kclient")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Without the CA of the server, the request fails.
+	c := &http.Client{}
+	assert.Nil(t, FromFlags(&Flags{})(c))
+	_, err = c.Get(server.URL)
+	assert.NotNil(t, err)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "corp.pem"), cert, 0644))
+
+	// Both directories and files can be specified.
+	for _, path := range []string{dir, filepath.Join(dir, "corp.pem")} {
+		c = &http.Client{}
+		assert.Nil(t, FromFlags(&Flags{RootCAs: []string{path}})(c))
+		resp, err := c.Get(server.URL)
+		assert.Nil(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0644))
+	_, err = LoadRootCAs(dir)
+	assert.NotNil(t, err)
+	_, err = LoadRootCAs(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(t, err)
+}
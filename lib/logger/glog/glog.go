@@ -0,0 +1,154 @@
+// Package glog bridges the API of github.com/golang/glog to a logger.Logger.
+//
+// It allows code written against glog, like bestie, to send its messages
+// to the loggers configured in enkit, including the structured ones, by
+// just replacing the import:
+//
+//	import "github.com/System233/enkit/lib/logger/glog"
+//
+//	func main() {
+//	    glog.SetLogger(logger.NewLeveled(logger.InfoPriority, logger.NewJSONSink(nil)), 1)
+//	    glog.V(1).Infof("only logged with verbosity >= 1")
+//	    ...
+//
+// Until SetLogger is invoked, messages are logged with the standard go log library.
+package glog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/System233/enkit/lib/logger"
+)
+
+// Level is the verbosity of a message logged with V.
+type Level int32
+
+var (
+	lock      sync.Mutex
+	current   logger.Logger = logger.Go
+	verbosity Level
+
+	// Invoked by Exit and Fatal, replaced in tests.
+	osExit = os.Exit
+)
+
+// SetLogger configures the logger to send messages to, and the maximum Level of the V messages logged.
+func SetLogger(log logger.Logger, level Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	current = log
+	verbosity = level
+}
+
+func get() logger.Logger {
+	lock.Lock()
+	defer lock.Unlock()
+	return current
+}
+
+// Verbose is returned by V. It is a bool, so it can be used in an if statement, like in glog.
+type Verbose bool
+
+// V returns true if messages of the level specified should be logged.
+func V(level Level) Verbose {
+	lock.Lock()
+	defer lock.Unlock()
+	return Verbose(level <= verbosity)
+}
+
+func (v Verbose) Info(args ...interface{}) {
+	if v {
+		get().Infof("%s", fmt.Sprint(args...))
+	}
+}
+func (v Verbose) Infoln(args ...interface{}) {
+	if v {
+		get().Infof("%s", sprintln(args...))
+	}
+}
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		get().Infof(format, args...)
+	}
+}
+
+// sprintln formats like fmt.Sprintln, without the trailing newline.
+func sprintln(args ...interface{}) string {
+	message := fmt.Sprintln(args...)
+	return message[:len(message)-1]
+}
+
+func Info(args ...interface{}) {
+	get().Infof("%s", fmt.Sprint(args...))
+}
+func Infoln(args ...interface{}) {
+	get().Infof("%s", sprintln(args...))
+}
+func Infof(format string, args ...interface{}) {
+	get().Infof(format, args...)
+}
+
+func Warning(args ...interface{}) {
+	get().Warnf("%s", fmt.Sprint(args...))
+}
+func Warningln(args ...interface{}) {
+	get().Warnf("%s", sprintln(args...))
+}
+func Warningf(format string, args ...interface{}) {
+	get().Warnf(format, args...)
+}
+
+func Error(args ...interface{}) {
+	get().Errorf("%s", fmt.Sprint(args...))
+}
+func Errorln(args ...interface{}) {
+	get().Errorf("%s", sprintln(args...))
+}
+func Errorf(format string, args ...interface{}) {
+	get().Errorf(format, args...)
+}
+
+// Exit logs an error, and terminates the program with exit status 1.
+func Exit(args ...interface{}) {
+	Error(args...)
+	Flush()
+	osExit(1)
+}
+func Exitln(args ...interface{}) {
+	Errorln(args...)
+	Flush()
+	osExit(1)
+}
+func Exitf(format string, args ...interface{}) {
+	Errorf(format, args...)
+	Flush()
+	osExit(1)
+}
+
+// Fatal logs an error, and terminates the program with exit status 2.
+//
+// Unlike glog, the stack traces of the goroutines are not dumped.
+func Fatal(args ...interface{}) {
+	Error(args...)
+	Flush()
+	osExit(2)
+}
+func Fatalln(args ...interface{}) {
+	Errorln(args...)
+	Flush()
+	osExit(2)
+}
+func Fatalf(format string, args ...interface{}) {
+	Errorf(format, args...)
+	Flush()
+	osExit(2)
+}
+
+// Flush flushes the logger, if it buffers messages, like those based on zap.
+func Flush() {
+	if flusher, ok := get().(interface{ Sync() error }); ok {
+		flusher.Sync()
+	}
+}
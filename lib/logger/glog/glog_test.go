@@ -0,0 +1,54 @@
+package glog
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBridge(t *testing.T) {
+	acc := logger.NewAccumulator()
+	SetLogger(acc, 1)
+	defer SetLogger(logger.Go, 0)
+
+	exited := []int{}
+	osExit = func(code int) { exited = append(exited, code) }
+
+	// The calls used by bestie.
+	Infof("serving on %d", 8080)
+	Info("a", "b")
+	V(1).Infof("verbose %d", 1)
+	V(2).Infof("verbose %d", 2)
+	V(2).Info("not shown")
+	if V(2) {
+		Info("not shown")
+	}
+	if !V(1) {
+		Info("not shown")
+	}
+	Warningf("slow %s", "table")
+	Error(fmt.Errorf("failed"))
+	Errorf("failed %s", "again")
+	Exitf("invalid command: %s", "foo")
+	Exit(fmt.Errorf("server failed"))
+	Flush()
+
+	events := acc.Retrieve()
+	messages := []string{}
+	for _, ev := range events {
+		messages = append(messages, fmt.Sprintf("%s %s", ev.Priority, ev.Message))
+	}
+	assert.Equal(t, []string{
+		"info serving on 8080",
+		"info ab",
+		"info verbose 1",
+		"warning slow table",
+		"error failed",
+		"error failed again",
+		"error invalid command: foo",
+		"error server failed",
+	}, messages)
+	assert.Equal(t, []int{1, 1}, exited)
+}
@@ -48,14 +48,14 @@ func DefaultFlags() *Flags {
 func (cf *Flags) Register(flags kflags.FlagSet, prefix string) *Flags {
 	flags.StringVar(&cf.ConsoleLevel, prefix+"loglevel-console", cf.ConsoleLevel, "Can be debug, info, warn, error. Indicates the minimum severity of messages to log on the console")
 	flags.StringVar(&cf.SyslogLevel, prefix+"loglevel-syslog", cf.SyslogLevel, "Can be debug, info, warn, error. Indicates the minimum severity of messages to log in syslog")
-	flags.IntVar(&cf.Verbosity, prefix+"verbosity", cf.Verbosity, "Increases the verbosity level of logs by the specified amount")
-	flags.BoolVar(&cf.Quiet, prefix+"quiet", cf.Quiet, "If set to true, only errors will be logged on the console")
+	cf.registerVerbosity(flags, prefix)
 	return cf
 }
 
 type options struct {
 	minConsole zapcore.Level
 	minSyslog  zapcore.Level
+	console    io.Writer
 }
 
 type Modifier func(o *options) error
@@ -133,6 +133,16 @@ func FromFlags(flags Flags) Modifier {
 	}
 }
 
+// WithConsoleOutput writes the console messages to writer, rather than os.Stderr.
+//
+// Use it to log to a file, like a logger.RotatingFile.
+func WithConsoleOutput(writer io.Writer) Modifier {
+	return func(o *options) error {
+		o.console = writer
+		return nil
+	}
+}
+
 func New(name string, mods ...Modifier) (*Logger, error) {
 	options := &options{
 		minConsole: zap.WarnLevel,
@@ -149,9 +159,13 @@ func New(name string, mods ...Modifier) (*Logger, error) {
 		return lvl >= options.minSyslog
 	})
 
+	output := zapcore.Lock(os.Stderr)
+	if options.console != nil {
+		output = zapcore.AddSync(options.console)
+	}
 	console := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
 	tees := []zapcore.Core{
-		zapcore.NewCore(console, zapcore.Lock(os.Stderr), matchConsole),
+		zapcore.NewCore(console, output, matchConsole),
 	}
 	for _, level := range []struct {
 		Syslog syslog.Priority
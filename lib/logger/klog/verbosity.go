@@ -0,0 +1,68 @@
+package klog
+
+import (
+	"github.com/System233/enkit/lib/kflags"
+)
+
+// Verbosity is the amount of output a command produces, shared across all
+// commands and libraries so that -q and -v mean the same thing everywhere.
+type Verbosity int
+
+const (
+	// Only errors are logged, and progress bars are not displayed. Selected with -q.
+	VerbosityQuiet Verbosity = iota - 1
+	// Warnings and errors are logged, progress bars are displayed.
+	VerbosityDefault
+	// Informational messages are logged as well. Selected with -v.
+	VerbosityVerbose
+	// Debug messages are logged as well, including those of libraries
+	// like the downloader or the retry logic. Selected with -vv.
+	VerbosityDebug
+)
+
+func (v Verbosity) String() string {
+	switch {
+	case v <= VerbosityQuiet:
+		return "quiet"
+	case v == VerbosityDefault:
+		return "default"
+	case v == VerbosityVerbose:
+		return "verbose"
+	}
+	return "debug"
+}
+
+// Level returns the Verbosity selected by the flags.
+//
+// --quiet takes precedence over any --verbose or --verbosity flag.
+func (cf *Flags) Level() Verbosity {
+	if cf.Quiet {
+		return VerbosityQuiet
+	}
+	if cf.Verbosity <= 0 {
+		return VerbosityDefault
+	}
+	if cf.Verbosity >= int(VerbosityDebug) {
+		return VerbosityDebug
+	}
+	return Verbosity(cf.Verbosity)
+}
+
+// registerVerbosity registers --quiet, --verbose and --verbosity.
+//
+// If the flag set supports it, and there is no prefix, -q and -v are registered
+// as shorthands, with -v counting the occurrences: -vv selects VerbosityDebug.
+func (cf *Flags) registerVerbosity(flags kflags.FlagSet, prefix string) {
+	usage := "If set to true, only errors will be logged on the console, and no progress bar displayed"
+	if set, ok := flags.(kflags.ShorthandFlagSet); ok && prefix == "" {
+		set.BoolVarP(&cf.Quiet, "quiet", "q", cf.Quiet, usage)
+
+		// CountVarP resets the counter, restored by the --verbosity flag registered below.
+		verbosity := cf.Verbosity
+		set.CountVarP(&cf.Verbosity, "verbose", "v", "Log more details, can be repeated: -v shows informational messages, -vv debug messages, including those of the libraries")
+		cf.Verbosity = verbosity
+	} else {
+		flags.BoolVar(&cf.Quiet, prefix+"quiet", cf.Quiet, usage)
+	}
+	flags.IntVar(&cf.Verbosity, prefix+"verbosity", cf.Verbosity, "Increases the verbosity level of logs by the specified amount")
+}
@@ -109,6 +109,36 @@ func (dl NilLogger) Warnf(format string, args ...interface{}) {
 func (dl NilLogger) SetOutput(output io.Writer) {
 }
 
+// Demoted is a logger forwarding all messages to Logger as debug messages.
+//
+// Use it to pass a logger to libraries whose messages are only useful when
+// troubleshooting, like the retries of a downloader: the messages are shown
+// only when the user asks for debug output, but are still recorded by a Ring.
+type Demoted struct {
+	Logger Logger
+}
+
+// Demote returns a Logger turning all the messages into debug messages of log.
+func Demote(log Logger) Logger {
+	return &Demoted{Logger: log}
+}
+
+func (dl *Demoted) Debugf(format string, args ...interface{}) {
+	dl.Logger.Debugf(format, args...)
+}
+func (dl *Demoted) Infof(format string, args ...interface{}) {
+	dl.Logger.Debugf(format, args...)
+}
+func (dl *Demoted) Errorf(format string, args ...interface{}) {
+	dl.Logger.Debugf("[error] "+format, args...)
+}
+func (dl *Demoted) Warnf(format string, args ...interface{}) {
+	dl.Logger.Debugf("[warning] "+format, args...)
+}
+func (dl *Demoted) SetOutput(output io.Writer) {
+	dl.Logger.SetOutput(output)
+}
+
 // IndentedError reformats the error to have indented new lines.
 type IndentedError struct {
 	indent string
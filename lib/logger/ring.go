@@ -0,0 +1,182 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRingSize is the number of messages retained by a Ring created with a size <= 0.
+const DefaultRingSize = 200
+
+// MaxRingMessage is the maximum length of a message retained by a Ring. Longer messages are truncated.
+const MaxRingMessage = 4096
+
+// Redacted is the string replacing secrets in messages retrieved from a Ring.
+//
+// It is the same marker used by the kflags library to hide the value of flags holding secrets.
+const Redacted = "<redacted>"
+
+// Ring is a thread safe Logger retaining the last messages logged in memory,
+// at every priority, including debug.
+//
+// Secrets registered with AddSecrets are redacted from the messages retrieved,
+// to make it safe to attach the content of a Ring to error reports.
+//
+// Messages are also forwarded to the Next logger, if set, unmodified. This
+// allows to capture debug messages while the Next logger only shows messages
+// according to the verbosity chosen by the user.
+type Ring struct {
+	lock  sync.Mutex
+	next  Logger
+	event []Event
+	first int
+	full  bool
+
+	secrets  []string
+	redactor *strings.Replacer
+}
+
+// NewRing creates a Ring retaining the last size messages, forwarding all messages to next.
+//
+// next can be nil. If size is <= 0, DefaultRingSize is used.
+func NewRing(size int, next Logger) *Ring {
+	if size <= 0 {
+		size = DefaultRingSize
+	}
+	return &Ring{event: make([]Event, size), next: next}
+}
+
+// SetNext changes the logger messages are forwarded to.
+func (r *Ring) SetNext(next Logger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.next = next
+}
+
+// AddSecrets registers values that must not appear in the messages retrieved, like
+// the values of flags holding secrets, or credentials loaded from disk.
+//
+// Secrets are replaced with Redacted, including in messages logged before
+// the secret was added.
+func (r *Ring) AddSecrets(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	added := false
+	for _, secret := range secrets {
+		if secret == "" || secret == Redacted || r.hasSecret(secret) {
+			continue
+		}
+		r.secrets = append(r.secrets, secret)
+		added = true
+	}
+	if !added {
+		return
+	}
+
+	// Longer secrets first, so a secret containing another one is redacted as a whole.
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+	var pairs []string
+	for _, secret := range r.secrets {
+		pairs = append(pairs, secret, Redacted)
+	}
+	r.redactor = strings.NewReplacer(pairs...)
+}
+
+func (r *Ring) hasSecret(secret string) bool {
+	for _, known := range r.secrets {
+		if known == secret {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Ring) Add(prio Priority, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if len(message) > MaxRingMessage {
+		message = message[:MaxRingMessage] + "... (truncated)"
+	}
+	ev := Event{
+		Priority: prio,
+		Message:  message,
+		Time:     time.Now(),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.event[r.first] = ev
+	r.first = (r.first + 1) % len(r.event)
+	if r.first == 0 {
+		r.full = true
+	}
+}
+
+// Retrieve returns a copy of the messages retained, oldest first, with secrets redacted.
+func (r *Ring) Retrieve() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var events []Event
+	if !r.full {
+		events = append([]Event{}, r.event[:r.first]...)
+	} else {
+		events = append(append([]Event{}, r.event[r.first:]...), r.event[:r.first]...)
+	}
+	if r.redactor != nil {
+		for i := range events {
+			events[i].Message = r.redactor.Replace(events[i].Message)
+		}
+	}
+	return events
+}
+
+var priorityName = map[Priority]string{
+	DebugPriority: "debug",
+	InfoPriority:  "info",
+	WarnPriority:  "warning",
+	ErrorPriority: "error",
+}
+
+// Dump writes the messages retained to writer, oldest first, one per line.
+func (r *Ring) Dump(writer io.Writer) error {
+	for _, ev := range r.Retrieve() {
+		if _, err := fmt.Fprintf(writer, "%s [%s] %s\n", ev.Time.Format(time.RFC3339), priorityName[ev.Priority], ev.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Ring) logger() Logger {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.next == nil {
+		return Nil
+	}
+	return r.next
+}
+
+func (r *Ring) Debugf(format string, args ...interface{}) {
+	r.Add(DebugPriority, format, args...)
+	r.logger().Debugf(format, args...)
+}
+func (r *Ring) Infof(format string, args ...interface{}) {
+	r.Add(InfoPriority, format, args...)
+	r.logger().Infof(format, args...)
+}
+func (r *Ring) Errorf(format string, args ...interface{}) {
+	r.Add(ErrorPriority, format, args...)
+	r.logger().Errorf(format, args...)
+}
+func (r *Ring) Warnf(format string, args ...interface{}) {
+	r.Add(WarnPriority, format, args...)
+	r.logger().Warnf(format, args...)
+}
+func (r *Ring) SetOutput(writer io.Writer) {
+	r.logger().SetOutput(writer)
+}
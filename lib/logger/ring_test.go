@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingRetainsNewest(t *testing.T) {
+	acc := NewAccumulator()
+	r := NewRing(10, acc)
+	assert.Empty(t, r.Retrieve())
+
+	for i := 0; i < 25; i++ {
+		r.Debugf("message %d", i)
+	}
+	r.Errorf("failed")
+
+	events := r.Retrieve()
+	assert.Equal(t, 10, len(events))
+	for i, ev := range events[:9] {
+		assert.Equal(t, fmt.Sprintf("message %d", 16+i), ev.Message)
+		assert.Equal(t, DebugPriority, ev.Priority)
+	}
+	assert.Equal(t, "failed", events[9].Message)
+	assert.Equal(t, ErrorPriority, events[9].Priority)
+
+	// All messages are forwarded to the next logger.
+	assert.Equal(t, 26, len(acc.Retrieve()))
+
+	var buffer bytes.Buffer
+	assert.Nil(t, r.Dump(&buffer))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, 10, len(lines))
+	assert.True(t, strings.HasSuffix(lines[0], "[debug] message 16"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[9], "[error] failed"), lines[9])
+
+	r = NewRing(0, nil)
+	r.Infof("%s", strings.Repeat("x", 2*MaxRingMessage))
+	events = r.Retrieve()
+	assert.Equal(t, 1, len(events))
+	assert.True(t, len(events[0].Message) < MaxRingMessage+100)
+	assert.Equal(t, DefaultRingSize, len(r.event))
+}
+
+func TestRingRedacts(t *testing.T) {
+	r := NewRing(10, nil)
+	r.Debugf("running with --override-token=%s", "abcd1234")
+	r.Infof("sending Cookie: Creds=%s", "f00ba2")
+	r.Debugf("fetching https://astore/g/ssh.tar.gz")
+
+	// Secrets are redacted even if added after being logged.
+	r.AddSecrets("abcd1234", "", Redacted)
+	r.Infof("loaded token %s, %s", "f00ba2", "f00ba2-refreshed")
+	r.AddSecrets("f00ba2", "f00ba2-refreshed")
+
+	var buffer bytes.Buffer
+	assert.Nil(t, r.Dump(&buffer))
+	dump := buffer.String()
+	for _, secret := range []string{"abcd1234", "f00ba2", "refreshed"} {
+		assert.NotContains(t, dump, secret)
+	}
+	assert.Contains(t, dump, "--override-token="+Redacted)
+	assert.Contains(t, dump, "Cookie: Creds="+Redacted)
+	assert.Contains(t, dump, "loaded token "+Redacted+", "+Redacted)
+	assert.Contains(t, dump, "https://astore/g/ssh.tar.gz")
+
+	// The messages forwarded to the next logger are not modified.
+	acc := NewAccumulator()
+	r.SetNext(acc)
+	r.Infof("token %s", "abcd1234")
+	assert.Equal(t, "token abcd1234", acc.Retrieve()[0].Message)
+	assert.Equal(t, "token "+Redacted, r.Retrieve()[4].Message)
+}
@@ -0,0 +1,258 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RotateOptions configures when a RotatingFile is rotated, and which rotated files are kept.
+type RotateOptions struct {
+	// Rotate the file before it grows larger than this many bytes, 0 to never rotate based on size.
+	MaxSize int64
+	// Rotate the file once it has been written for longer than this, 0 to never rotate based on age.
+	MaxAge time.Duration
+	// Number of rotated files to keep, as path.1 (the most recent), path.2, ..., 0 to keep none.
+	MaxFiles int
+	// Compress the rotated files with gzip, as path.1.gz, path.2.gz, ...
+	Compress bool
+
+	// Invoked with the errors rotating or reopening the file, which cannot be
+	// returned to the code logging. If nil, errors are printed on os.Stderr.
+	OnError func(err error)
+}
+
+// CheckInterval is how often a RotatingFile verifies that the file it is
+// writing to is still the one at its path.
+const CheckInterval = 10 * time.Second
+
+// RotatingFile is an io.WriteCloser appending to a log file, and rotating it
+// once too large or too old. It is safe to use from multiple goroutines.
+//
+// Rotation renames the file to path.1, shifting older files to path.2, path.3, ...,
+// and then creates a new file at path. At no point the file being written is
+// deleted: if the process crashes midway, or the new file cannot be created,
+// messages keep going to the renamed file, and the error is reported.
+//
+// If the file is removed or replaced by some other process, like logrotate or
+// an operator cleaning up disk space, RotatingFile notices within CheckInterval
+// and creates a new one, rather than writing to a file nobody can see.
+type RotatingFile struct {
+	path    string
+	options RotateOptions
+
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	checked time.Time
+	now     func() time.Time
+}
+
+// OpenRotatingFile opens the log file at path, creating it and its directory if necessary.
+//
+// Messages are appended to an existing file, which is rotated based on its
+// current size, and its age counting from when it was opened.
+func OpenRotatingFile(path string, options RotateOptions) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, options: options, now: time.Now}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Path returns the path of the file written.
+func (rf *RotatingFile) Path() string {
+	return rf.path
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return fmt.Errorf("could not create log directory - %w", err)
+	}
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open log file - %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not stat log file - %w", err)
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = rf.now()
+	rf.checked = rf.opened
+	return nil
+}
+
+func (rf *RotatingFile) report(err error) {
+	if rf.options.OnError != nil {
+		rf.options.OnError(err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "log file %s: %s\n", rf.path, err)
+}
+
+func (rf *RotatingFile) Write(data []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	now := rf.now()
+	tooLarge := rf.options.MaxSize > 0 && rf.size+int64(len(data)) > rf.options.MaxSize
+	tooOld := rf.options.MaxAge > 0 && now.Sub(rf.opened) >= rf.options.MaxAge
+	switch {
+	case rf.size > 0 && (tooLarge || tooOld):
+		if err := rf.rotate(); err != nil {
+			rf.report(err)
+		}
+	case now.Sub(rf.checked) >= CheckInterval:
+		if err := rf.reopenIfMoved(); err != nil {
+			rf.report(err)
+		}
+	}
+
+	written, err := rf.file.Write(data)
+	rf.size += int64(written)
+	return written, err
+}
+
+// reopenIfMoved creates a new file if the one written is no longer at path.
+func (rf *RotatingFile) reopenIfMoved() error {
+	rf.checked = rf.now()
+	current, err := rf.file.Stat()
+	if err != nil {
+		return err
+	}
+	found, err := os.Stat(rf.path)
+	if err == nil && os.SameFile(current, found) {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	old := rf.file
+	if err := rf.open(); err != nil {
+		return fmt.Errorf("file was removed or replaced, and could not be recreated - %w", err)
+	}
+	old.Close()
+	rf.report(fmt.Errorf("file was removed or replaced - created a new one"))
+	return nil
+}
+
+// rotated returns the path of the n-th rotated file.
+func (rf *RotatingFile) rotated(n int, compressed bool) string {
+	path := fmt.Sprintf("%s.%d", rf.path, n)
+	if compressed {
+		path += ".gz"
+	}
+	return path
+}
+
+func (rf *RotatingFile) rotate() error {
+	// Make room for path.1, dropping the oldest file. Files are shifted
+	// whether compressed or not, in case Compress changed across runs.
+	for _, compressed := range []bool{false, true} {
+		if rf.options.MaxFiles <= 0 {
+			continue
+		}
+		if err := os.Remove(rf.rotated(rf.options.MaxFiles, compressed)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove oldest log - %w", err)
+		}
+	}
+	for n := rf.options.MaxFiles - 1; n >= 1; n-- {
+		for _, compressed := range []bool{false, true} {
+			if err := os.Rename(rf.rotated(n, compressed), rf.rotated(n+1, compressed)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("could not shift rotated log - %w", err)
+			}
+		}
+	}
+
+	// The open handle follows the rename, messages go to path.1 until the new file is created.
+	first := rf.rotated(1, false)
+	if err := os.Rename(rf.path, first); err != nil {
+		return fmt.Errorf("could not rotate log - %w", err)
+	}
+	old := rf.file
+	if err := rf.open(); err != nil {
+		// Keep writing to the renamed file, and retry after another MaxSize or MaxAge.
+		rf.size = 0
+		rf.opened = rf.now()
+		return err
+	}
+	old.Sync()
+	old.Close()
+
+	if rf.options.MaxFiles <= 0 {
+		return os.Remove(first)
+	}
+	if rf.options.Compress {
+		return compressFile(first, rf.rotated(1, true))
+	}
+	return nil
+}
+
+// compressFile compresses source into dest, and removes source.
+//
+// The compressed data is written to a temporary file renamed to dest once
+// complete, so a crash never leaves a truncated dest behind.
+func compressFile(source, dest string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	tmp := dest + ".tmp"
+	output, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not compress rotated log - %w", err)
+	}
+	writer := gzip.NewWriter(output)
+	_, err = io.Copy(writer, input)
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not compress rotated log - %w", err)
+	}
+	return os.Remove(source)
+}
+
+// Sync flushes the file to disk.
+func (rf *RotatingFile) Sync() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	return rf.file.Sync()
+}
+
+// Close closes the file. Following writes fail with os.ErrClosed.
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
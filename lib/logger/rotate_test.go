@@ -0,0 +1,163 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err, "%s", path)
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "daemon.log")
+	errs := []error{}
+	rf, err := OpenRotatingFile(path, RotateOptions{MaxSize: 10, MaxFiles: 2, OnError: func(err error) { errs = append(errs, err) }})
+	assert.NoError(t, err)
+	defer rf.Close()
+
+	for _, message := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+		_, err := rf.Write([]byte(message))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "gggg\n", readFile(t, path))
+	assert.Equal(t, "eeee\nffff\n", readFile(t, path+".1"))
+	assert.Equal(t, "cccc\ndddd\n", readFile(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+	assert.Empty(t, errs)
+
+	// Messages larger than MaxSize are written whole, to a file of their own.
+	_, err = rf.Write([]byte("a message longer than 10 bytes\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a message longer than 10 bytes\n", readFile(t, path))
+	assert.Equal(t, "gggg\n", readFile(t, path+".1"))
+
+	// Appends to existing files, accounting for their size.
+	assert.NoError(t, rf.Close())
+	_, err = rf.Write([]byte("closed"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	rf, err = OpenRotatingFile(path, RotateOptions{MaxSize: 40, MaxFiles: 2})
+	assert.NoError(t, err)
+	rf.Write([]byte("next\n"))
+	assert.Equal(t, "a message longer than 10 bytes\nnext\n", readFile(t, path))
+	rf.Write([]byte("rotated\n"))
+	assert.Equal(t, "rotated\n", readFile(t, path))
+	assert.NoError(t, rf.Close())
+
+	// With MaxFiles 0, the file is truncated.
+	rf, err = OpenRotatingFile(path, RotateOptions{MaxSize: 10})
+	assert.NoError(t, err)
+	rf.Write([]byte("truncated\n"))
+	assert.Equal(t, "truncated\n", readFile(t, path))
+	assert.NoFileExists(t, path+".1")
+	assert.NoError(t, rf.Close())
+}
+
+func TestRotatingFileAgeAndCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	rf, err := OpenRotatingFile(path, RotateOptions{MaxAge: time.Hour, MaxFiles: 3, Compress: true})
+	assert.NoError(t, err)
+	defer rf.Close()
+
+	now := time.Now()
+	rf.now = func() time.Time { return now }
+	rf.opened = now
+
+	for i := 0; i < 5; i++ {
+		rf.Write([]byte(fmt.Sprintf("hour %d\n", i)))
+		now = now.Add(59 * time.Minute)
+		rf.Write([]byte(fmt.Sprintf("hour %d, later\n", i)))
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(t, "hour 4\nhour 4, later\n", readFile(t, path))
+	for n, hour := range []int{3, 2, 1} {
+		rotated := fmt.Sprintf("%s.%d.gz", path, n+1)
+		file, err := os.Open(rotated)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		reader, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("hour %d\nhour %d, later\n", hour, hour), string(data), "%s", rotated)
+		file.Close()
+		assert.NoFileExists(t, fmt.Sprintf("%s.%d", path, n+1))
+	}
+	assert.NoFileExists(t, path+".4.gz")
+	assert.NoFileExists(t, path+".1.gz.tmp")
+}
+
+func TestRotatingFileRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	errs := []error{}
+	rf, err := OpenRotatingFile(path, RotateOptions{OnError: func(err error) { errs = append(errs, err) }})
+	assert.NoError(t, err)
+	defer rf.Close()
+
+	now := time.Now()
+	rf.now = func() time.Time { return now }
+
+	rf.Write([]byte("before\n"))
+	assert.NoError(t, os.Remove(path))
+	rf.Write([]byte("lost\n"))
+
+	now = now.Add(CheckInterval)
+	rf.Write([]byte("after\n"))
+	assert.Equal(t, "after\n", readFile(t, path))
+	assert.Equal(t, 1, len(errs))
+
+	// A file moved away and replaced, like logrotate does.
+	assert.NoError(t, os.Rename(path, path+".old"))
+	assert.NoError(t, ioutil.WriteFile(path, []byte("replaced\n"), 0644))
+	now = now.Add(CheckInterval)
+	rf.Write([]byte("appended\n"))
+	assert.Equal(t, "replaced\nappended\n", readFile(t, path))
+	assert.Equal(t, "after\n", readFile(t, path+".old"))
+	assert.Equal(t, 2, len(errs))
+}
+
+func TestRotatingFileConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	rf, err := OpenRotatingFile(path, RotateOptions{MaxSize: 1000, MaxFiles: 100})
+	assert.NoError(t, err)
+	defer rf.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(rf, "goroutine %d message %d\n", g, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	lines := 0
+	files, err := filepath.Glob(path + "*")
+	assert.NoError(t, err)
+	for _, file := range files {
+		data := readFile(t, file)
+		assert.LessOrEqual(t, len(data), 1000, "%s", file)
+		for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+			assert.True(t, strings.HasPrefix(line, "goroutine "), "%q in %s", line, file)
+			lines++
+		}
+	}
+	assert.Equal(t, 1000, lines)
+}
@@ -0,0 +1,228 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field is a key value pair attached to the messages logged by a FieldLogger.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// FieldLogger is a Logger capable of attaching fields to the messages logged.
+//
+// Backends writing structured logs, like JSONSink, record the fields separately
+// from the message, so a log pipeline can index them.
+type FieldLogger interface {
+	Logger
+
+	// With returns a logger adding key = value to all the messages logged.
+	//
+	// The original logger is not modified. If key was already set, the value is replaced.
+	With(key string, value interface{}) FieldLogger
+}
+
+// With adds key = value to the messages logged by log, if it is a FieldLogger.
+//
+// Other loggers are returned unmodified, so libraries can add fields without
+// knowing which backend was configured.
+func With(log Logger, key string, value interface{}) Logger {
+	if fl, ok := log.(FieldLogger); ok {
+		return fl.With(key, value)
+	}
+	return log
+}
+
+var priorityNames = []string{"debug", "info", "warning", "error"}
+
+func (p Priority) String() string {
+	if p < DebugPriority || p > ErrorPriority {
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority parses the name of a Priority, like "debug" or "warning".
+//
+// Any prefix of the name is accepted, like "warn", case insensitively.
+func ParsePriority(name string) (Priority, error) {
+	name = strings.TrimSpace(strings.ToLower(name))
+	if name != "" {
+		for prio, known := range priorityNames {
+			if strings.HasPrefix(known, name) {
+				return Priority(prio), nil
+			}
+		}
+	}
+	return DebugPriority, fmt.Errorf("invalid log level %q - valid levels are: %s", name, strings.Join(priorityNames, ", "))
+}
+
+// Sink writes the messages logged by a Leveled logger.
+type Sink interface {
+	Write(ev *Event, fields []Field)
+	SetOutput(writer io.Writer)
+}
+
+// Leveled is a FieldLogger discarding the messages below Level, and writing the others to a Sink.
+type Leveled struct {
+	Level Priority
+	Sink  Sink
+
+	fields []Field
+	now    func() time.Time
+}
+
+// NewLeveled returns a Leveled logger writing messages of level or higher priority to sink.
+func NewLeveled(level Priority, sink Sink) *Leveled {
+	return &Leveled{Level: level, Sink: sink, now: time.Now}
+}
+
+func (l *Leveled) With(key string, value interface{}) FieldLogger {
+	fields := make([]Field, 0, len(l.fields)+1)
+	for _, field := range l.fields {
+		if field.Key != key {
+			fields = append(fields, field)
+		}
+	}
+
+	result := *l
+	result.fields = append(fields, Field{Key: key, Value: value})
+	return &result
+}
+
+func (l *Leveled) log(prio Priority, format string, args ...interface{}) {
+	if prio < l.Level {
+		return
+	}
+	now := time.Now
+	if l.now != nil {
+		now = l.now
+	}
+	l.Sink.Write(&Event{Time: now(), Priority: prio, Message: fmt.Sprintf(format, args...)}, l.fields)
+}
+
+func (l *Leveled) Debugf(format string, args ...interface{}) {
+	l.log(DebugPriority, format, args...)
+}
+func (l *Leveled) Infof(format string, args ...interface{}) {
+	l.log(InfoPriority, format, args...)
+}
+func (l *Leveled) Warnf(format string, args ...interface{}) {
+	l.log(WarnPriority, format, args...)
+}
+func (l *Leveled) Errorf(format string, args ...interface{}) {
+	l.log(ErrorPriority, format, args...)
+}
+func (l *Leveled) SetOutput(writer io.Writer) {
+	l.Sink.SetOutput(writer)
+}
+
+// JSONSink writes each message as a JSON object on a line of its own.
+//
+// Each object has the "time", "level" and "msg" keys, followed by the fields
+// in the order they were added. Errors are written as their message.
+type JSONSink struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+// NewJSONSink returns a JSONSink writing to out, os.Stderr if nil.
+func NewJSONSink(out io.Writer) *JSONSink {
+	if out == nil {
+		out = os.Stderr
+	}
+	return &JSONSink{out: out}
+}
+
+// jsonValue returns a representation of value that can be marshalled.
+func jsonValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Time:
+		value = v.Format(time.RFC3339Nano)
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	// Messages are not embedded in HTML, keep characters like < and > readable.
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		data.Reset()
+		encoder.Encode(fmt.Sprintf("%v", value))
+	}
+	return bytes.TrimSuffix(data.Bytes(), []byte("\n"))
+}
+
+func (js *JSONSink) Write(ev *Event, fields []Field) {
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	line.Write(jsonValue(ev.Time.Format(time.RFC3339Nano)))
+	line.WriteString(`,"level":`)
+	line.Write(jsonValue(ev.Priority.String()))
+	line.WriteString(`,"msg":`)
+	line.Write(jsonValue(ev.Message))
+	for _, field := range fields {
+		switch field.Key {
+		case "time", "level", "msg":
+			continue
+		}
+		line.WriteString(",")
+		line.Write(jsonValue(field.Key))
+		line.WriteString(":")
+		line.Write(jsonValue(field.Value))
+	}
+	line.WriteString("}\n")
+
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	js.out.Write(line.Bytes())
+}
+
+func (js *JSONSink) SetOutput(writer io.Writer) {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	js.out = writer
+}
+
+// PrintfSink writes messages with a Printer, like DefaultLogger does.
+//
+// Fields are appended to the message as key=value pairs, sorted by key.
+type PrintfSink struct {
+	Printer Printer
+	Setter  func(writer io.Writer)
+}
+
+func (ps *PrintfSink) Write(ev *Event, fields []Field) {
+	message := ev.Message
+	if len(fields) > 0 {
+		sorted := append([]Field{}, fields...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Key < sorted[j].Key
+		})
+		pairs := []string{}
+		for _, field := range sorted {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", field.Key, field.Value))
+		}
+		message += " " + strings.Join(pairs, " ")
+	}
+	ps.Printer("[%s] %s", ev.Priority, message)
+}
+
+func (ps *PrintfSink) SetOutput(writer io.Writer) {
+	if ps.Setter != nil {
+		ps.Setter(writer)
+	}
+}
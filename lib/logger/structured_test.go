@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePriority(t *testing.T) {
+	for name, expected := range map[string]Priority{
+		"debug": DebugPriority, "info": InfoPriority, "warn": WarnPriority, "Warning": WarnPriority, " error": ErrorPriority, "e": ErrorPriority,
+	} {
+		prio, err := ParsePriority(name)
+		assert.NoError(t, err, "%s", name)
+		assert.Equal(t, expected, prio, "%s", name)
+	}
+	for _, name := range []string{"", "loud", "errors"} {
+		_, err := ParsePriority(name)
+		assert.Error(t, err, "%s", name)
+	}
+	assert.Equal(t, "warning", WarnPriority.String())
+}
+
+func TestJSONSink(t *testing.T) {
+	var buffer bytes.Buffer
+	log := NewLeveled(InfoPriority, NewJSONSink(&buffer))
+	log.now = func() time.Time { return time.Date(2026, 10, 15, 8, 30, 0, 0, time.UTC) }
+
+	log.Debugf("not logged")
+	log.Infof("starting %d workers", 4)
+	assert.Equal(t, `{"time":"2026-10-15T08:30:00Z","level":"info","msg":"starting 4 workers"}`+"\n", buffer.String())
+
+	// With returns a new logger, fields are replaced, and errors and durations are logged as strings.
+	buffer.Reset()
+	node := log.With("node", "worker-1").With("attempt", 1)
+	node.With("attempt", 2).With("error", fmt.Errorf("connection <refused>")).With("wait", 3*time.Second).Errorf("enrolling failed")
+	node.Warnf("retrying")
+	log.Warnf("done")
+	assert.Equal(t, ``+
+		`{"time":"2026-10-15T08:30:00Z","level":"error","msg":"enrolling failed","node":"worker-1","attempt":2,"error":"connection <refused>","wait":"3s"}`+"\n"+
+		`{"time":"2026-10-15T08:30:00Z","level":"warning","msg":"retrying","node":"worker-1","attempt":1}`+"\n"+
+		`{"time":"2026-10-15T08:30:00Z","level":"warning","msg":"done"}`+"\n", buffer.String())
+
+	// Fields cannot override the fixed keys.
+	buffer.Reset()
+	log.With("msg", "other").With("labels", map[string]string{"zone": "a"}).Infof("message")
+	assert.Equal(t, `{"time":"2026-10-15T08:30:00Z","level":"info","msg":"message","labels":{"zone":"a"}}`+"\n", buffer.String())
+
+	var other bytes.Buffer
+	log.SetOutput(&other)
+	log.Errorf("moved")
+	assert.Contains(t, other.String(), `"msg":"moved"`)
+}
+
+func TestPrintfSink(t *testing.T) {
+	var buffer bytes.Buffer
+	printer := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buffer, format+"\n", args...)
+	}
+	log := NewLeveled(DebugPriority, &PrintfSink{Printer: printer})
+
+	// Without fields, the output is the same as DefaultLogger.
+	log.Debugf("checking %s", "config")
+	log.Warnf("slow")
+	DefaultLogger{Printer: printer}.Warnf("slow")
+	assert.Equal(t, "[debug] checking config\n[warning] slow\n[warning] slow\n", buffer.String())
+
+	buffer.Reset()
+	log.With("zone", "b").With("node", "n1").Infof("enrolled")
+	assert.Equal(t, "[info] enrolled node=n1 zone=b\n", buffer.String())
+
+	// With works on any logger, and is a no-op on loggers not supporting fields.
+	buffer.Reset()
+	With(DefaultLogger{Printer: printer}, "node", "n1").Infof("plain")
+	With(log, "node", "n1").Infof("fields")
+	assert.Equal(t, "[info] plain\n[info] fields node=n1\n", buffer.String())
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/stamp"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"google.golang.org/grpc"
+)
+
+type registerOptions struct {
+	registerer prometheus.Registerer
+	grpc       bool
+}
+
+// RegisterModifier customizes the behavior of Register.
+type RegisterModifier func(*registerOptions)
+
+// WithRegisterer installs the metrics in the specified registerer, rather
+// than in the default prometheus registry.
+func WithRegisterer(registerer prometheus.Registerer) RegisterModifier {
+	return func(o *registerOptions) {
+		o.registerer = registerer
+	}
+}
+
+// WithGRPCServer installs the metrics of a grpc server as well.
+//
+// Register returns the options to pass to grpc.NewServer to populate them.
+func WithGRPCServer() RegisterModifier {
+	return func(o *registerOptions) {
+		o.grpc = true
+	}
+}
+
+var (
+	registeredLock sync.Mutex
+	// grpc server metrics already installed, by registerer.
+	registeredGRPC = map[prometheus.Registerer]*grpc_prometheus.ServerMetrics{}
+)
+
+// Register installs the metrics every server should export:
+//   - enfabrica_bin_build_info, a gauge always set to 1, labeled with the
+//     version, commit and build date injected at link time in lib/stamp.
+//   - the go runtime and process collectors.
+//   - with WithGRPCServer, the grpc_server_* metrics of grpc-prometheus,
+//     including the handling time histogram.
+//
+// Returns the grpc.ServerOption to pass to grpc.NewServer to record the
+// grpc server metrics, none unless WithGRPCServer is used.
+//
+// Register is idempotent: it can be invoked multiple times, for example by
+// tests creating multiple servers, and the metrics are installed only once.
+func Register(mods ...RegisterModifier) ([]grpc.ServerOption, error) {
+	options := &registerOptions{registerer: prometheus.DefaultRegisterer}
+	for _, mod := range mods {
+		mod(options)
+	}
+
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "enfabrica",
+		Subsystem: "bin",
+		Name:      "build_info",
+		Help:      "Always 1, labeled with the version of the binary and how it was built",
+	}, []string{"version", "commit", "branch", "build_date", "go_version"})
+	collector, err := register(options.registerer, buildInfo)
+	if err != nil {
+		return nil, err
+	}
+	buildDate := ""
+	if built := stamp.BuildTimestamp(); !built.IsZero() {
+		buildDate = built.UTC().Format(time.RFC3339)
+	}
+	collector.(*prometheus.GaugeVec).WithLabelValues(stamp.Version, stamp.GitSha, stamp.GitBranch, buildDate, runtime.Version()).Set(1)
+
+	// Already part of the default registry, only needed for custom ones.
+	if _, err := register(options.registerer, collectors.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if _, err := register(options.registerer, collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+
+	if !options.grpc {
+		return nil, nil
+	}
+	server, err := registerGRPC(options.registerer)
+	if err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(server.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(server.StreamServerInterceptor()),
+	}, nil
+}
+
+// register installs the collector in the registerer.
+//
+// Returns the collector installed, which is the one previously registered
+// if an identical collector was registered already.
+func register(registerer prometheus.Registerer, collector prometheus.Collector) (prometheus.Collector, error) {
+	err := registerer.Register(collector)
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		return already.ExistingCollector, nil
+	}
+	return collector, err
+}
+
+// registerGRPC returns the grpc server metrics installed in the registerer, installing them if necessary.
+func registerGRPC(registerer prometheus.Registerer) (*grpc_prometheus.ServerMetrics, error) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	if server, ok := registeredGRPC[registerer]; ok {
+		return server, nil
+	}
+
+	// The grpc-prometheus library installs its default metrics in the
+	// default registry as soon as it is imported.
+	var server *grpc_prometheus.ServerMetrics
+	if registerer == prometheus.DefaultRegisterer {
+		grpc_prometheus.EnableHandlingTimeHistogram()
+		server = grpc_prometheus.DefaultServerMetrics
+	} else {
+		server = grpc_prometheus.NewServerMetrics()
+		server.EnableHandlingTimeHistogram()
+		if err := registerer.Register(server); err != nil {
+			return nil, err
+		}
+	}
+	registeredGRPC[registerer] = server
+	return server, nil
+}
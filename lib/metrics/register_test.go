@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	hpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// gathered returns the names of the metric families in the registry, and the value of the build_info gauge.
+func gathered(t *testing.T, registry *prometheus.Registry) (map[string]bool, float64) {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	names := map[string]bool{}
+	var info float64
+	for _, family := range families {
+		names[family.GetName()] = true
+		if family.GetName() == "enfabrica_bin_build_info" {
+			assert.Len(t, family.GetMetric(), 1)
+			info = family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return names, info
+}
+
+func TestRegister(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	opts, err := Register(WithRegisterer(registry))
+	assert.NoError(t, err)
+	assert.Empty(t, opts)
+
+	names, info := gathered(t, registry)
+	assert.Equal(t, 1.0, info)
+	assert.True(t, names["go_goroutines"])
+	assert.True(t, names["process_start_time_seconds"])
+
+	// Registering again, with or without grpc, is fine.
+	for i := 0; i < 2; i++ {
+		opts, err = Register(WithRegisterer(registry), WithGRPCServer())
+		assert.NoError(t, err)
+		assert.Len(t, opts, 2)
+	}
+	_, info = gathered(t, registry)
+	assert.Equal(t, 1.0, info)
+
+	// Same with the default registry, where grpc metrics are installed by the library.
+	for i := 0; i < 2; i++ {
+		_, err = Register(WithGRPCServer())
+		assert.NoError(t, err)
+	}
+}
+
+func TestRegisterGRPC(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	opts, err := Register(WithRegisterer(registry), WithGRPCServer())
+	assert.NoError(t, err)
+
+	grpcs := grpc.NewServer(opts...)
+	hpb.RegisterHealthServer(grpcs, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go grpcs.Serve(listener)
+	defer grpcs.Stop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = hpb.NewHealthClient(conn).Check(context.Background(), &hpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+
+	names, _ := gathered(t, registry)
+	assert.True(t, names["grpc_server_started_total"])
+	assert.True(t, names["grpc_server_handled_total"])
+	assert.True(t, names["grpc_server_handling_seconds"])
+}
@@ -2,6 +2,7 @@ package multierror
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -43,11 +44,12 @@ func NewOr(errs []error, fallback error) error {
 	return fallback
 }
 
-// Unwrap for MultiError always returns nil, as there is no reasonable way to implement it.
+// Unwrap for MultiError returns the list of errors, skipping nil ones.
 //
-// Use As and Is methods, or loop over the list directly to access the underlying errors.
-func (me MultiError) Unwrap() error {
-	return nil
+// This allows errors.Is and errors.As to find the errors contained, even
+// when the MultiError itself is wrapped by fmt.Errorf("... %w", ...).
+func (me MultiError) Unwrap() []error {
+	return Filter(me)
 }
 
 // As for MultiError returns the first error that can be considered As the specified target.
@@ -70,17 +72,66 @@ func (me MultiError) Is(target error) bool {
 	return false
 }
 
-func (me MultiError) Error() string {
-	if len(me) == 1 && me[0] != nil {
-		return me[0].Error()
-	}
-
-	messages := []string{}
-	for _, err := range me {
+// Filter returns the errors in errs that are not nil, and are not one of the ignore errors.
+//
+// Errors are compared with errors.Is, so an error wrapping one of the ignore errors
+// is dropped as well. For example, Filter(errs, context.Canceled) drops all the
+// errors caused by a cancelled context.
+//
+// The result can be passed to New, to obtain a nil error if all errors were dropped.
+func Filter(errs []error, ignore ...error) []error {
+	result := []error{}
+outer:
+	for _, err := range errs {
 		if err == nil {
 			continue
 		}
-		messages = append(messages, err.Error())
+		for _, target := range ignore {
+			if errors.Is(err, target) {
+				continue outer
+			}
+		}
+		result = append(result, err)
+	}
+	return result
+}
+
+// format returns the message of each non nil error, obtained with toString.
+//
+// Messages spanning multiple lines, like those of a nested MultiError, are indented.
+func (me MultiError) format(toString func(error) string) string {
+	errs := Filter(me)
+	if len(errs) == 1 && len(me) == 1 {
+		return toString(errs[0])
+	}
+
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, strings.ReplaceAll(toString(err), "\n", "\n  "))
 	}
 	return "Multiple errors:\n  " + strings.Join(messages, "\n  ")
 }
+
+func (me MultiError) Error() string {
+	return me.format(func(err error) string {
+		return err.Error()
+	})
+}
+
+// Format implements fmt.Formatter.
+//
+// %s and %v print the same message as Error. %+v formats each of the errors
+// with %+v instead, so errors that provide more details, like stack traces,
+// are printed in full, indented below the error that contains them.
+func (me MultiError) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('+'):
+		fmt.Fprint(f, me.format(func(err error) string {
+			return fmt.Sprintf("%+v", err)
+		}))
+	case verb == 'q':
+		fmt.Fprintf(f, "%q", me.Error())
+	default:
+		fmt.Fprint(f, me.Error())
+	}
+}
@@ -0,0 +1,95 @@
+package multierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	assert.Nil(t, New(nil))
+	assert.Nil(t, New([]error{}))
+	assert.Nil(t, New([]error{nil, nil}))
+	assert.Nil(t, New(Filter([]error{context.Canceled, nil}, context.Canceled)))
+
+	fallback := fmt.Errorf("fallback")
+	assert.Equal(t, fallback, NewOr(nil, fallback))
+	assert.Equal(t, fallback, NewOr([]error{nil}, fallback))
+
+	err := New([]error{nil, os.ErrNotExist})
+	assert.Equal(t, MultiError{nil, os.ErrNotExist}, err)
+	assert.Equal(t, MultiError{os.ErrNotExist}, NewOr([]error{os.ErrNotExist}, fallback))
+}
+
+func TestFilter(t *testing.T) {
+	canceled := fmt.Errorf("upload failed: %w", context.Canceled)
+	assert.Equal(t, []error{}, Filter(nil))
+	assert.Equal(t, []error{os.ErrNotExist, canceled}, Filter([]error{nil, os.ErrNotExist, nil, canceled}))
+	assert.Equal(t, []error{os.ErrNotExist}, Filter([]error{nil, os.ErrNotExist, canceled}, context.Canceled, context.DeadlineExceeded))
+}
+
+func TestIsAs(t *testing.T) {
+	_, statErr := os.Stat("/this/path/does/not/exist")
+	err := New([]error{fmt.Errorf("first failure"), nil, fmt.Errorf("reading config: %w", statErr)})
+
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.False(t, errors.Is(err, os.ErrPermission))
+
+	var pathErr *fs.PathError
+	assert.True(t, errors.As(err, &pathErr))
+	assert.Equal(t, "/this/path/does/not/exist", pathErr.Path)
+
+	// Also when the MultiError is wrapped, or nested in another MultiError.
+	wrapped := fmt.Errorf("loading: %w", New([]error{fmt.Errorf("other"), err}))
+	assert.True(t, errors.Is(wrapped, os.ErrNotExist))
+	pathErr = nil
+	assert.True(t, errors.As(wrapped, &pathErr))
+	assert.Equal(t, "/this/path/does/not/exist", pathErr.Path)
+
+	// And directly with Unwrap, as a Go 1.20 multi-error.
+	unwrapped := err.(interface{ Unwrap() []error }).Unwrap()
+	assert.Equal(t, 2, len(unwrapped))
+	assert.True(t, errors.Is(errors.Join(unwrapped...), os.ErrNotExist))
+}
+
+// detailed is an error with additional details printed with %+v.
+type detailed struct {
+	message string
+}
+
+func (d detailed) Error() string {
+	return d.message
+}
+
+func (d detailed) Format(f fmt.State, verb rune) {
+	if verb == 'v' && f.Flag('+') {
+		fmt.Fprintf(f, "%s\ndetails of %s", d.message, d.message)
+		return
+	}
+	fmt.Fprint(f, d.message)
+}
+
+func TestFormat(t *testing.T) {
+	single := New([]error{fmt.Errorf("single")})
+	assert.Equal(t, "single", single.Error())
+
+	flat := New([]error{fmt.Errorf("first"), nil, fmt.Errorf("second")})
+	assert.Equal(t, "Multiple errors:\n  first\n  second", flat.Error())
+	assert.Equal(t, flat.Error(), fmt.Sprintf("%v", flat))
+	assert.Equal(t, flat.Error(), fmt.Sprintf("%s", flat))
+	assert.Equal(t, fmt.Sprintf("%q", flat.Error()), fmt.Sprintf("%q", flat))
+
+	nested := New([]error{fmt.Errorf("first"), flat, detailed{"third"}})
+	assert.Equal(t, "Multiple errors:\n  first\n  Multiple errors:\n    first\n    second\n  third", nested.Error())
+	assert.Equal(t, nested.Error(), fmt.Sprintf("%v", nested))
+	assert.Equal(t, "Multiple errors:\n  first\n  Multiple errors:\n    first\n    second\n  third\n  details of third", fmt.Sprintf("%+v", nested))
+
+	deep := New([]error{New([]error{detailed{"a"}, New([]error{detailed{"b"}, detailed{"c"}})})})
+	assert.Equal(t, "Multiple errors:\n  a\n  Multiple errors:\n    b\n    c", deep.Error())
+	assert.Equal(t, "Multiple errors:\n  a\n  details of a\n  Multiple errors:\n    b\n    details of b\n    c\n    details of c", fmt.Sprintf("%+v", deep))
+}
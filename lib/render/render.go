@@ -0,0 +1,277 @@
+// Package render helps commands emit their output either as text for humans,
+// or as JSON for scripts.
+//
+// Commands get a Renderer configured by the --format, --quiet and --no-color
+// flags shared by all enkit commands, see client.BaseFlags, and use it to
+// print their results, tables, and informational messages.
+//
+// With --format=json, a single JSON document is written on stdout, either
+// with the result of the command, or with the error that caused it to fail.
+// Informational messages are always written on stderr, so stdout can be
+// parsed by scripts, and are suppressed by --quiet.
+package render
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/fatih/color"
+)
+
+const (
+	// FormatText renders the output as text, for humans to read.
+	FormatText = "text"
+	// FormatJSON renders the output as JSON, for scripts to parse.
+	FormatJSON = "json"
+)
+
+// Formats lists the output formats supported.
+var Formats = []string{FormatText, FormatJSON}
+
+type Flags struct {
+	// One of Formats.
+	Format string
+	// Disable colors in text output.
+	NoColor bool
+}
+
+func DefaultFlags() *Flags {
+	return &Flags{
+		Format: FormatText,
+	}
+}
+
+func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
+	set.StringVar(&fl.Format, prefix+"format", fl.Format, "Format of the output of the command, one of: "+strings.Join(Formats, ", "))
+	set.BoolVar(&fl.NoColor, prefix+"no-color", fl.NoColor, "Disable colors in the output of the command")
+	return fl
+}
+
+// Renderer writes the output of a command in the format chosen by the user.
+type Renderer struct {
+	// One of Formats.
+	Format string
+	// If true, informational messages are not shown.
+	Quiet bool
+	// If true, text output may use colors.
+	Color bool
+
+	// Where the output of the command is written, stdout by default.
+	Out io.Writer
+	// Where informational messages are written, stderr by default.
+	Err io.Writer
+}
+
+type Modifier func(r *Renderer) error
+
+type Modifiers []Modifier
+
+func (mods Modifiers) Apply(r *Renderer) error {
+	for _, m := range mods {
+		if err := m(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithFormat selects one of Formats. An invalid format returns a kflags.UsageError.
+func WithFormat(format string) Modifier {
+	return func(r *Renderer) error {
+		format = strings.ToLower(strings.TrimSpace(format))
+		for _, valid := range Formats {
+			if format == valid {
+				r.Format = format
+				return nil
+			}
+		}
+		return kflags.NewUsageErrorf("invalid --format %q - must be one of: %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+func WithQuiet(quiet bool) Modifier {
+	return func(r *Renderer) error {
+		r.Quiet = quiet
+		return nil
+	}
+}
+
+func WithColor(enabled bool) Modifier {
+	return func(r *Renderer) error {
+		r.Color = enabled
+		return nil
+	}
+}
+
+func WithWriters(out, err io.Writer) Modifier {
+	return func(r *Renderer) error {
+		r.Out = out
+		r.Err = err
+		return nil
+	}
+}
+
+// FromFlags configures the Renderer from command line flags.
+//
+// Colors are enabled only if stdout is a terminal, and neither --no-color nor the
+// NO_COLOR environment variable are set, as detected by github.com/fatih/color.
+// As most commands print colors with that library, --no-color also disables
+// them globally.
+func FromFlags(fl *Flags) Modifier {
+	return func(r *Renderer) error {
+		if fl.NoColor {
+			color.NoColor = true
+		}
+		return Modifiers{WithFormat(fl.Format), WithColor(!color.NoColor)}.Apply(r)
+	}
+}
+
+// New returns a Renderer writing text on stdout, without colors, unless configured otherwise.
+func New(mods ...Modifier) (*Renderer, error) {
+	r := &Renderer{
+		Format: FormatText,
+		Out:    os.Stdout,
+		Err:    os.Stderr,
+	}
+	if err := Modifiers(mods).Apply(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// JSON returns true if the output must be rendered as JSON.
+func (r *Renderer) JSON() bool {
+	return r.Format == FormatJSON
+}
+
+// Render writes the result of a command.
+//
+// With JSON output, value is written as a JSON document. Otherwise, text is invoked
+// to write the result for humans. text can be nil if the command already printed
+// its text output while running.
+func (r *Renderer) Render(value interface{}, text func(w io.Writer) error) error {
+	if r.JSON() {
+		encoder := json.NewEncoder(r.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	if text == nil {
+		return nil
+	}
+	return text(r.Out)
+}
+
+// Infof writes an informational message, unless Quiet is set.
+//
+// Messages are written on Err, so they never mix with JSON output.
+func (r *Renderer) Infof(format string, args ...interface{}) {
+	if r.Quiet {
+		return
+	}
+	fmt.Fprintf(r.Err, format, args...)
+}
+
+// Table writes rows of values in aligned columns, for text output.
+type Table struct {
+	out  io.Writer
+	bold bool
+	rows [][]string
+}
+
+// Table returns a Table writing on Out, with the specified column headers.
+// Headers are shown in bold if Color is enabled.
+func (r *Renderer) Table(headers ...string) *Table {
+	return &Table{out: r.Out, bold: r.Color, rows: [][]string{headers}}
+}
+
+// Row adds a row to the table, formatting each value with %v.
+func (t *Table) Row(values ...interface{}) {
+	columns := make([]string, 0, len(values))
+	for _, v := range values {
+		columns = append(columns, fmt.Sprint(v))
+	}
+	t.rows = append(t.rows, columns)
+}
+
+// Flush writes the table, aligning all the rows added so far.
+//
+// Columns are aligned here rather than with a tabwriter, as the escape
+// sequences used for colors would be counted in the width of the headers.
+func (t *Table) Flush() error {
+	var widths []int
+	for _, row := range t.rows {
+		for i, column := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if width := utf8.RuneCountInString(column); width > widths[i] {
+				widths[i] = width
+			}
+		}
+	}
+
+	bold := color.New(color.Bold)
+	bold.EnableColor()
+	for r, row := range t.rows {
+		line := &strings.Builder{}
+		for i, column := range row {
+			if r == 0 && t.bold {
+				line.WriteString(bold.Sprint(column))
+			} else {
+				line.WriteString(column)
+			}
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(column)+2))
+			}
+		}
+		line.WriteString("\n")
+		if _, err := io.WriteString(t.out, line.String()); err != nil {
+			return err
+		}
+	}
+	t.rows = nil
+	return nil
+}
+
+// ErrorOutput is the JSON document written when a command fails with JSON output.
+type ErrorOutput struct {
+	Error ErrorDetails `json:"error"`
+}
+
+type ErrorDetails struct {
+	Message string `json:"message"`
+	// Exit code of the command, as computed by kflags.ExitCode.
+	ExitCode int `json:"exit_code"`
+	// True if the command failed due to invalid flags or arguments.
+	Usage bool `json:"usage,omitempty"`
+}
+
+// NewErrorOutput returns the JSON document describing err.
+func NewErrorOutput(err error) *ErrorOutput {
+	var ue *kflags.UsageError
+	return &ErrorOutput{Error: ErrorDetails{
+		Message:  err.Error(),
+		ExitCode: kflags.ExitCode(err),
+		Usage:    errors.As(err, &ue),
+	}}
+}
+
+// Error writes err as an ErrorOutput with JSON output, and returns it unchanged.
+//
+// With text output, nothing is written: the error is printed by the
+// command runner, like kcobra.Run.
+func (r *Renderer) Error(err error) error {
+	if err == nil || !r.JSON() {
+		return err
+	}
+	if rerr := r.Render(NewErrorOutput(err), nil); rerr != nil {
+		fmt.Fprintf(r.Err, "could not write error as JSON - %s\n", rerr)
+	}
+	return err
+}
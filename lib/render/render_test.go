@@ -0,0 +1,98 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRenderer(t *testing.T, mods ...Modifier) (*Renderer, *bytes.Buffer, *bytes.Buffer) {
+	out, errs := &bytes.Buffer{}, &bytes.Buffer{}
+	r, err := New(append([]Modifier{WithWriters(out, errs)}, mods...)...)
+	assert.NoError(t, err)
+	return r, out, errs
+}
+
+func TestFormats(t *testing.T) {
+	r, err := New()
+	assert.NoError(t, err)
+	assert.False(t, r.JSON())
+
+	r, err = New(FromFlags(&Flags{Format: " JSON", NoColor: true}))
+	assert.NoError(t, err)
+	assert.True(t, r.JSON())
+	assert.False(t, r.Color)
+
+	_, err = New(FromFlags(&Flags{Format: "yaml"}))
+	var ue *kflags.UsageError
+	assert.ErrorAs(t, err, &ue)
+}
+
+func TestRender(t *testing.T) {
+	result := struct {
+		Name string `json:"name"`
+	}{Name: "fry"}
+	text := func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "name: %s\n", result.Name)
+		return err
+	}
+
+	r, out, errs := newTestRenderer(t)
+	r.Infof("looking up %s\n", "fry")
+	assert.NoError(t, r.Render(result, text))
+	assert.Equal(t, "name: fry\n", out.String())
+	assert.Equal(t, "looking up fry\n", errs.String())
+
+	r, out, errs = newTestRenderer(t, WithFormat(FormatJSON), WithQuiet(true))
+	r.Infof("looking up %s\n", "fry")
+	assert.NoError(t, r.Render(result, text))
+	assert.Equal(t, "{\n  \"name\": \"fry\"\n}\n", out.String())
+	assert.Equal(t, "", errs.String())
+}
+
+func TestTable(t *testing.T) {
+	r, out, _ := newTestRenderer(t)
+	table := r.Table("NAME", "CPUS", "TAGS")
+	table.Row("bender", 4, "gpu,large")
+	table.Row("léela", 128, "")
+	assert.NoError(t, table.Flush())
+	assert.Equal(t, ""+
+		"NAME    CPUS  TAGS\n"+
+		"bender  4     gpu,large\n"+
+		"léela   128   \n", out.String())
+
+	// Colors don't affect the alignment.
+	r, out, _ = newTestRenderer(t, WithColor(true))
+	table = r.Table("NAME", "CPUS")
+	table.Row("bender", 4)
+	assert.NoError(t, table.Flush())
+	assert.Equal(t, ""+
+		"\x1b[1mNAME\x1b[22m    \x1b[1mCPUS\x1b[22m\n"+
+		"bender  4\n", out.String())
+}
+
+func TestError(t *testing.T) {
+	r, out, _ := newTestRenderer(t)
+	failure := kflags.NewStatusErrorf(100, "log in again")
+	assert.Equal(t, failure, r.Error(failure))
+	assert.Equal(t, "", out.String())
+
+	r, out, _ = newTestRenderer(t, WithFormat(FormatJSON))
+	assert.Equal(t, failure, r.Error(failure))
+	var parsed ErrorOutput
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &parsed))
+	assert.Equal(t, ErrorOutput{Error: ErrorDetails{Message: "log in again", ExitCode: 100}}, parsed)
+
+	out.Reset()
+	r.Error(fmt.Errorf("while listing - %w", kflags.NewUsageErrorf("too many arguments")))
+	assert.JSONEq(t, `{"error": {"message": "while listing - too many arguments", "exit_code": 1, "usage": true}}`, out.String())
+
+	out.Reset()
+	assert.NoError(t, r.Error(nil))
+	assert.Equal(t, "", out.String())
+}
@@ -0,0 +1,139 @@
+package retry
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "enfabrica",
+		Subsystem: "retry",
+		Name:      "attempts_total",
+		Help:      "Attempts run by Run and its variants, by shared budget - empty when not sharing one",
+	}, []string{"budget"})
+
+	metricSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "enfabrica",
+		Subsystem: "retry",
+		Name:      "successes_total",
+		Help:      "Operations run by Run and its variants that eventually succeeded, by shared budget",
+	}, []string{"budget"})
+
+	metricBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "enfabrica",
+		Subsystem: "retry",
+		Name:      "budget_exhausted_total",
+		Help:      "Retries denied as the shared budget was exhausted, by budget",
+	}, []string{"budget"})
+)
+
+// Budget limits how many retries can be performed per time window by all
+// the Options sharing it, configured with WithSharedBudget.
+//
+// When the network flaps, every retry loop in the process ends up hammering
+// the same dead endpoint at the same time. By sharing a Budget, the loops
+// give up early instead, once the retries they collectively performed exceed
+// the budget.
+//
+// Budget is a token bucket: it holds at most Retries tokens, refilled at a
+// rate of Retries per Window. The first attempt of an operation is always
+// run, each retry takes a token.
+//
+// A Budget is safe for concurrent use.
+type Budget struct {
+	// Name of the budget, used in errors and as the label of the metrics.
+	Name string
+	// How many retries are allowed per Window, and at most in a burst.
+	Retries int
+	Window  time.Duration
+
+	// How to read time, time.Now if nil.
+	Now TimeSource
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBudget creates a Budget allowing retries per window.
+func NewBudget(name string, retries int, window time.Duration) *Budget {
+	return &Budget{
+		Name:    name,
+		Retries: retries,
+		Window:  window,
+		Now:     time.Now,
+	}
+}
+
+// refill adds the tokens accrued since the last call, starting from a full
+// bucket. Must be called with lock held.
+func (b *Budget) refill() {
+	now := time.Now()
+	if b.Now != nil {
+		now = b.Now()
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(b.Retries)
+	} else if b.Window > 0 {
+		b.tokens += float64(b.Retries) * float64(now.Sub(b.last)) / float64(b.Window)
+	}
+	if b.tokens > float64(b.Retries) {
+		b.tokens = float64(b.Retries)
+	}
+	b.last = now
+}
+
+// Take returns true and consumes a token if a retry is allowed, false otherwise.
+func (b *Budget) Take() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Available returns how many retries are allowed right now.
+func (b *Budget) Available() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	return int(b.tokens)
+}
+
+// name returns the label to use for the metrics of a possibly nil budget.
+func (b *Budget) name() string {
+	if b == nil {
+		return ""
+	}
+	return b.Name
+}
+
+// BudgetExhaustedError is returned when a retry was denied by a shared Budget.
+//
+// Unlike ExaustedError, it wraps only the error returned by the last attempt.
+type BudgetExhaustedError struct {
+	// Name of the exhausted budget.
+	Budget string
+	// How many attempts were run.
+	Attempts int
+	// The error returned by the last attempt.
+	Original error
+}
+
+func (be *BudgetExhaustedError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts - retry budget %s exhausted - %s", be.Attempts, be.Budget, be.Original)
+}
+
+func (be *BudgetExhaustedError) Unwrap() error {
+	return be.Original
+}
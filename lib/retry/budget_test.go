@@ -0,0 +1,97 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func counter(t *testing.T, vec *prometheus.CounterVec, budget string) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, vec.WithLabelValues(budget).(prometheus.Metric).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestBudgetTake(t *testing.T) {
+	now := time.Now()
+	b := NewBudget("take", 4, time.Minute)
+	b.Now = func() time.Time { return now }
+
+	assert.Equal(t, 4, b.Available())
+	for i := 0; i < 4; i++ {
+		assert.True(t, b.Take())
+	}
+	assert.False(t, b.Take())
+
+	// Tokens are refilled over the window, up to the number of retries.
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, 2, b.Available())
+	assert.True(t, b.Take())
+	now = now.Add(time.Hour)
+	assert.Equal(t, 4, b.Available())
+
+	// A zero value budget starts full, and is never refilled without a window.
+	b = &Budget{Name: "zero", Retries: 1}
+	assert.True(t, b.Take())
+	assert.False(t, b.Take())
+}
+
+func TestSharedBudget(t *testing.T) {
+	now := time.Now()
+	budget := NewBudget("shared", 3, time.Minute)
+	budget.Now = func() time.Time { return now }
+	mods := []Modifier{WithWait(0), WithFuzzy(0), WithAttempts(10), WithLogger(logger.Nil), WithSharedBudget(budget)}
+
+	attempts := counter(t, metricAttempts, "shared")
+	successes := counter(t, metricSuccesses, "shared")
+	exhausted := counter(t, metricBudgetExhausted, "shared")
+
+	// The first operation uses up the budget.
+	failure := errors.New("endpoint down")
+	runs := 0
+	err := New(mods...).Run(func() error {
+		runs++
+		return fmt.Errorf("attempt %d - %w", runs, failure)
+	})
+	assert.Equal(t, 4, runs)
+	var be *BudgetExhaustedError
+	assert.True(t, errors.As(err, &be))
+	assert.Equal(t, "shared", be.Budget)
+	assert.Equal(t, 4, be.Attempts)
+	assert.True(t, errors.Is(err, failure))
+	assert.Contains(t, err.Error(), "attempt 4")
+
+	// Any other operation sharing the budget fails fast.
+	runs = 0
+	err = New(mods...).Run(func() error {
+		runs++
+		return failure
+	})
+	assert.Equal(t, 1, runs)
+	assert.True(t, errors.As(err, &be))
+
+	// Operations succeeding at the first attempt do not need the budget.
+	assert.Nil(t, New(mods...).Run(func() error { return nil }))
+
+	// The last attempt does not take from the budget.
+	now = now.Add(20 * time.Second)
+	runs = 0
+	err = New(append(mods, WithAttempts(2))...).Run(func() error {
+		runs++
+		return failure
+	})
+	assert.Equal(t, 2, runs)
+	var ee *ExaustedError
+	assert.True(t, errors.As(err, &ee))
+	assert.Equal(t, 0, budget.Available())
+
+	assert.Equal(t, float64(8), counter(t, metricAttempts, "shared")-attempts)
+	assert.Equal(t, float64(1), counter(t, metricSuccesses, "shared")-successes)
+	assert.Equal(t, float64(2), counter(t, metricBudgetExhausted, "shared")-exhausted)
+}
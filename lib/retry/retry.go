@@ -33,13 +33,31 @@
 // The retry library will run your functions as many times as configured until it
 // returns an error, or until it returns retry.FatalError (use retry.Fatal to
 // create one) or an error wrapping a retry.FatalError (see the errors library,
-// and all the magic wrapping/unwrapping logic).
+// and all the magic wrapping/unwrapping logic), or an error considered fatal
+// by the function configured with WithClassifier.
+//
+// To stop many operations failing at once from all retrying at the same time,
+// share a Budget of retries among them with WithSharedBudget:
+//
+//	budget := retry.NewBudget("backend", 10, time.Minute)
+//	options := retry.New(retry.WithSharedBudget(budget))
+//
+// To give each attempt its own deadline, distinct from the deadline of the
+// whole operation, use RunContext with WithAttemptTimeout:
+//
+//	options := retry.New(retry.WithBackoff(time.Minute), retry.WithJitter(retry.JitterFull),
+//	    retry.WithAttemptTimeout(10 * time.Second), retry.WithBudget(5 * time.Minute))
+//	options.RunContext(ctx, func (ctx context.Context) error {
+//	  ...
+//	})
 package retry
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/System233/enkit/lib/kflags"
@@ -58,6 +76,10 @@ type Options struct {
 	logger logger.Logger
 	// Description to add to log messages.
 	description string
+	// Returns true if an error must not be retried.
+	classifier Classifier
+	// Retries allowed across all the Options sharing it, nil for unlimited.
+	budget *Budget
 
 	// How to read time.
 	Now TimeSource
@@ -82,12 +104,39 @@ type Flags struct {
 	AtMost int
 	// How long to wait between attempts.
 	Wait time.Duration
-	// How much of a random retry time to add.
+	// If greater than Wait, the wait grows by Factor after each failed attempt, up to MaxWait.
+	MaxWait time.Duration
+	// How much the wait grows after each failed attempt, if MaxWait is set. 2 if 0.
+	Factor float64
+	// How much of a random retry time to add, with JitterAdd.
 	Fuzzy time.Duration
+	// How to randomize the wait, one of the Jitter constants. JitterAdd if empty.
+	Jitter string
+	// If not 0, stop retrying once the next attempt would start after this
+	// much time since the first attempt started.
+	Budget time.Duration
+	// If not 0, how long each attempt run by RunContext can take.
+	AttemptTimeout time.Duration
 	// How many errors to store at most.
 	MaxErrors int
 }
 
+const (
+	// JitterAdd adds a random time up to Fuzzy to the wait.
+	JitterAdd = "add"
+	// JitterFull waits a random time between 0 and the wait, as computed
+	// from Wait, MaxWait and Factor. Spreads retries the most, see
+	// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/.
+	JitterFull = "full"
+	// JitterEqual waits half of the wait, plus a random time up to the other half.
+	JitterEqual = "equal"
+	// JitterNone waits exactly the wait.
+	JitterNone = "none"
+)
+
+// Jitters lists the valid values of Flags.Jitter.
+var Jitters = []string{JitterAdd, JitterFull, JitterEqual, JitterNone}
+
 func DefaultFlags() *Flags {
 	return &Flags{
 		AtMost:    5,
@@ -97,11 +146,46 @@ func DefaultFlags() *Flags {
 	}
 }
 
+// jitterValue is a kflags.Value accepting only one of the Jitters, or empty for the default.
+type jitterValue struct {
+	dest *string
+}
+
+func (jv *jitterValue) String() string {
+	if jv.dest == nil {
+		return ""
+	}
+	return *jv.dest
+}
+
+func (jv *jitterValue) Set(value string) error {
+	for _, valid := range append([]string{""}, Jitters...) {
+		if value == valid {
+			*jv.dest = value
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid jitter %q - must be one of: %s", value, strings.Join(Jitters, ", "))
+}
+
+func (jv *jitterValue) Type() string {
+	return "string"
+}
+
 func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.IntVar(&fl.AtMost, prefix+"retry-at-most", fl.AtMost, "How many time to retry the operation at most")
 	set.IntVar(&fl.MaxErrors, prefix+"retry-max-errors", fl.MaxErrors, "How many errors to record when retrying")
 	set.DurationVar(&fl.Wait, prefix+"retry-wait", fl.Wait, "How long to wait from the start of an attempt to the next")
+	set.DurationVar(&fl.MaxWait, prefix+"retry-max-wait", fl.MaxWait, "If greater than retry-wait, the wait doubles after each failed attempt, up to this value")
 	set.DurationVar(&fl.Fuzzy, prefix+"retry-fuzzy", fl.Fuzzy, "How much randomized time to add to each retry-wait time")
+	jitter := "How to randomize the wait between attempts, one of: " + strings.Join(Jitters, ", ") + " - add uses retry-fuzzy"
+	if vs, ok := set.(kflags.ValueFlagSet); ok {
+		vs.ValueVar(&jitterValue{dest: &fl.Jitter}, prefix+"retry-jitter", jitter)
+	} else {
+		set.StringVar(&fl.Jitter, prefix+"retry-jitter", fl.Jitter, jitter)
+	}
+	set.DurationVar(&fl.Budget, prefix+"retry-budget", fl.Budget, "If not 0, stop retrying after this much time since the first attempt")
+	set.DurationVar(&fl.AttemptTimeout, prefix+"retry-attempt-timeout", fl.AttemptTimeout, "If not 0, how long each attempt can take")
 	return fl
 }
 
@@ -163,6 +247,89 @@ func WithWait(duration time.Duration) Modifier {
 	}
 }
 
+// WithBackoff doubles the wait time after each failed attempt, up to max.
+//
+// The first retry waits the time configured with WithWait, the second twice
+// as long, the third four times as long, and so on, until max is reached.
+//
+// This is useful when an operation can fail for a long period of time, for
+// example while reconnecting to a server that is down: transient errors are
+// recovered from quickly, while a long outage does not result in a storm of
+// pointless attempts.
+func WithBackoff(max time.Duration) Modifier {
+	return func(o *Options) {
+		o.MaxWait = max
+	}
+}
+
+// WithBackoffFactor configures how much the wait grows after each failed attempt,
+// up to the max configured with WithBackoff. The default is 2, doubling it.
+func WithBackoffFactor(factor float64) Modifier {
+	return func(o *Options) {
+		o.Factor = factor
+	}
+}
+
+// WithJitter configures how to randomize the wait, one of the Jitter constants.
+//
+// With the default, JitterAdd, a random time up to the value configured with
+// WithFuzzy is added to the wait. With exponential backoff, JitterFull is
+// generally better at spreading the retries of many clients over time.
+func WithJitter(mode string) Modifier {
+	return func(o *Options) {
+		o.Jitter = mode
+	}
+}
+
+// WithBudget stops retrying once the next attempt would start after budget
+// since the first attempt started, even if more attempts are allowed.
+func WithBudget(budget time.Duration) Modifier {
+	return func(o *Options) {
+		o.Budget = budget
+	}
+}
+
+// WithAttemptTimeout configures how long each attempt run by RunContext can take.
+//
+// Each attempt is passed a context derived from the one passed to RunContext,
+// expiring after timeout, and cancelled as soon as the attempt returns.
+// An attempt timing out is retried, while the parent context being done
+// stops all retries.
+func WithAttemptTimeout(timeout time.Duration) Modifier {
+	return func(o *Options) {
+		o.AttemptTimeout = timeout
+	}
+}
+
+// WithSharedBudget limits the retries to those allowed by budget, shared
+// with all the other Options configured with the same budget.
+//
+// Once the budget is exhausted, Run and its variants stop retrying, and
+// return a BudgetExhaustedError wrapping the error of the last attempt.
+//
+// Unlike WithBudget, which limits the time spent retrying a single operation,
+// a shared budget prevents retry storms, when many operations fail at once.
+func WithSharedBudget(budget *Budget) Modifier {
+	return func(o *Options) {
+		o.budget = budget
+	}
+}
+
+// Classifier returns true if err is fatal, and must not be retried.
+type Classifier func(err error) bool
+
+// WithClassifier configures a function deciding which errors are fatal.
+//
+// Errors wrapping a FatalError are always fatal. Other errors are retried,
+// unless the classifier returns true. This allows to stop retrying on errors
+// returned by libraries that know nothing about retry, like a gRPC status
+// with codes.InvalidArgument.
+func WithClassifier(classifier Classifier) Modifier {
+	return func(o *Options) {
+		o.classifier = classifier
+	}
+}
+
 // WithFuzzy introduces a random offset from 0 to fuzzy time in between connection attempts.
 //
 // This is very important in distributed environments, to avoid connection storms or
@@ -254,12 +421,16 @@ func Fatal(err error) *FatalError {
 // how longer the code still has to wait based on a delay computed
 // with the Delay() function.
 func (o *Options) DelaySince(start time.Time) time.Duration {
-	delay := o.Delay()
+	return o.delaySince(0, start)
+}
+
+func (o *Options) delaySince(attempt int, start time.Time) time.Duration {
+	delay := o.AttemptDelay(attempt)
 	if start.IsZero() {
 		return delay
 	}
 
-	elapsed := time.Now().Sub(start)
+	elapsed := o.Now().Sub(start)
 	if elapsed >= delay {
 		return 0
 	}
@@ -271,15 +442,59 @@ func (o *Options) DelaySince(start time.Time) time.Duration {
 // If Fuzzy is non 0, the delay is fuzzied by a random amount
 // less than the value of fuzzy.
 func (o *Options) Delay() time.Duration {
-	delta := int64(0)
-	if o.Fuzzy > 0 {
-		r := rand.Int63n
-		if o.rng != nil {
-			r = o.rng.Int63n
+	return o.AttemptDelay(0)
+}
+
+// AttemptDelay computes how long to wait after the specified attempt failed.
+//
+// It is just like Delay, except that the wait time is increased as
+// configured with WithBackoff and WithBackoffFactor.
+func (o *Options) AttemptDelay(attempt int) time.Duration {
+	factor := o.Factor
+	if factor == 0 {
+		factor = 2
+	}
+
+	wait := o.Wait
+	for ; attempt > 0 && wait > 0 && wait < o.MaxWait && factor > 1; attempt-- {
+		wait = time.Duration(float64(wait) * factor)
+	}
+	if o.MaxWait > o.Wait && wait > o.MaxWait {
+		wait = o.MaxWait
+	}
+
+	r := rand.Int63n
+	if o.rng != nil {
+		r = o.rng.Int63n
+	}
+	random := func(max time.Duration) time.Duration {
+		if max <= 0 {
+			return 0
 		}
-		delta = r(int64(o.Fuzzy))
+		return time.Duration(r(int64(max)))
 	}
-	return o.Wait + time.Duration(delta)
+
+	switch o.Jitter {
+	case JitterNone:
+		return wait
+	case JitterFull:
+		return random(wait)
+	case JitterEqual:
+		return wait/2 + random(wait-wait/2)
+	}
+	return wait + random(o.Fuzzy)
+}
+
+// fatal returns the error to return if err must not be retried, or nil.
+func (o *Options) fatal(err error) error {
+	var stop *FatalError
+	if errors.As(err, &stop) {
+		return stop.Original
+	}
+	if o.classifier != nil && o.classifier(err) {
+		return err
+	}
+	return nil
 }
 
 // ExaustedError is returned when the retrier has exhausted all attempts.
@@ -337,14 +552,13 @@ func (o *Options) OnceAttempt(attempt int, runner func(attempt int) error) (time
 		return 0, nil
 	}
 
-	var stop *FatalError
 	var delay time.Duration
 	message := "considered FATAL - not retrying anymore"
 	format := "attempt #%d%s - FAILED - %s - %s"
-	if errors.As(err, &stop) {
+	if o.fatal(err) != nil {
 		o.logger.Errorf(format, attempt+1, description, err, message)
 	} else {
-		delay = o.DelaySince(start)
+		delay = o.delaySince(attempt, start)
 		if delay > 0 {
 			message = fmt.Sprintf("will retry in %s", delay)
 		} else {
@@ -380,25 +594,87 @@ func (o *Options) Run(runner func() error) error {
 // attempts, to re-initialize state on non-first attempt, or
 // try harder after a number of attempts, ...
 func (o *Options) RunAttempt(runner func(attempt int) error) error {
+	return o.RunAttemptContext(context.Background(), func(ctx context.Context, attempt int) error {
+		return runner(attempt)
+	})
+}
+
+// RunContext is just like Run, but passes a context to each attempt.
+//
+// If configured with WithAttemptTimeout, each attempt gets a context
+// expiring after the attempt timeout, cancelled as soon as it returns.
+//
+// Once ctx is done, RunContext stops waiting and retrying, and returns an
+// ExaustedError wrapping ctx.Err(), so errors.Is(err, context.Canceled)
+// or errors.Is(err, context.DeadlineExceeded) can be used.
+func (o *Options) RunContext(ctx context.Context, runner func(ctx context.Context) error) error {
+	return o.RunAttemptContext(ctx, func(ctx context.Context, attempt int) error {
+		return runner(ctx)
+	})
+}
+
+// RunAttemptContext is just like RunContext, but propagates the attempt #.
+func (o *Options) RunAttemptContext(ctx context.Context, runner func(ctx context.Context, attempt int) error) error {
 	errs := []error{}
-	for ix := 0; o.AtMost == 0 || ix < o.AtMost; ix++ {
-		delay, err := o.OnceAttempt(ix, runner)
+	start := o.Now()
+	label := o.budget.name()
+
+	attempts := 0
+	reason := ""
+	for ; o.AtMost == 0 || attempts < o.AtMost; attempts++ {
+		delay, err := o.OnceAttempt(attempts, func(attempt int) error {
+			actx, cancel := ctx, context.CancelFunc(func() {})
+			if o.AttemptTimeout > 0 {
+				actx, cancel = context.WithTimeout(ctx, o.AttemptTimeout)
+			}
+			defer cancel()
+			metricAttempts.WithLabelValues(label).Inc()
+			return runner(actx, attempt)
+		})
 		if err == nil {
+			metricSuccesses.WithLabelValues(label).Inc()
 			return nil
 		}
-		var stop *FatalError
-		if errors.As(err, &stop) {
-			return stop.Original
+		if fatal := o.fatal(err); fatal != nil {
+			return fatal
 		}
 
 		if len(errs) <= o.MaxErrors {
 			errs = append(errs, err)
 		}
 
+		if o.Budget > 0 && o.Now().Add(delay).Sub(start) > o.Budget {
+			attempts++
+			reason = fmt.Sprintf(" - retry budget of %s exhausted", o.Budget)
+			break
+		}
+		if o.budget != nil && (o.AtMost == 0 || attempts+1 < o.AtMost) && !o.budget.Take() {
+			metricBudgetExhausted.WithLabelValues(label).Inc()
+			description := ""
+			if o.description != "" {
+				description = " - " + o.description
+			}
+			o.logger.Warnf("attempt #%d%s - retry budget %s exhausted - not retrying", attempts+1, description, o.budget.Name)
+			return &BudgetExhaustedError{Budget: o.budget.Name, Attempts: attempts + 1, Original: err}
+		}
 		if delay > 0 {
-			time.Sleep(delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			attempts++
+			break
 		}
 	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+		reason = fmt.Sprintf(" - %s", ctx.Err())
+	}
+
 	err := multierror.New(errs)
-	return &ExaustedError{Original: err, Message: fmt.Sprintf("gave up after %d attempts - %s", o.AtMost, err)}
+	return &ExaustedError{Original: err, Message: fmt.Sprintf("gave up after %d attempts%s - %s", attempts, reason, err)}
 }
@@ -0,0 +1,172 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttemptDelay(t *testing.T) {
+	o := New(WithWait(time.Second), WithBackoff(10*time.Second), WithFuzzy(0))
+	assert.Equal(t, time.Second, o.AttemptDelay(0))
+	assert.Equal(t, 2*time.Second, o.AttemptDelay(1))
+	assert.Equal(t, 8*time.Second, o.AttemptDelay(3))
+	assert.Equal(t, 10*time.Second, o.AttemptDelay(4))
+	assert.Equal(t, 10*time.Second, o.AttemptDelay(100))
+
+	o = New(WithWait(time.Second), WithBackoff(time.Minute), WithBackoffFactor(3), WithFuzzy(0))
+	assert.Equal(t, 9*time.Second, o.AttemptDelay(2))
+	assert.Equal(t, time.Minute, o.AttemptDelay(5))
+
+	// Without backoff, the wait is fixed.
+	o = New(WithWait(time.Second), WithFuzzy(0))
+	assert.Equal(t, time.Second, o.AttemptDelay(5))
+}
+
+func TestJitter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		o := New(WithRng(rng), WithWait(time.Second), WithBackoff(time.Minute), WithFuzzy(time.Second))
+		delay := o.AttemptDelay(2)
+		assert.True(t, delay >= 4*time.Second && delay < 5*time.Second, "%s", delay)
+
+		o = New(WithRng(rng), WithWait(time.Second), WithBackoff(time.Minute), WithJitter(JitterFull))
+		delay = o.AttemptDelay(2)
+		assert.True(t, delay >= 0 && delay < 4*time.Second, "%s", delay)
+
+		o = New(WithRng(rng), WithWait(time.Second), WithBackoff(time.Minute), WithJitter(JitterEqual))
+		delay = o.AttemptDelay(2)
+		assert.True(t, delay >= 2*time.Second && delay < 4*time.Second, "%s", delay)
+
+		o = New(WithRng(rng), WithWait(time.Second), WithBackoff(time.Minute), WithJitter(JitterNone))
+		assert.Equal(t, 4*time.Second, o.AttemptDelay(2))
+	}
+}
+
+func TestJitterFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fl := DefaultFlags().Register(&kflags.GoFlagSet{FlagSet: fs}, "")
+	assert.NoError(t, fs.Parse([]string{"--retry-jitter=full"}))
+	assert.Equal(t, JitterFull, fl.Jitter)
+
+	// Invalid values are rejected when parsed, rather than ignored when used.
+	assert.Error(t, fs.Parse([]string{"--retry-jitter=0.5"}))
+	assert.Error(t, fs.Parse([]string{"--retry-jitter=-1"}))
+	assert.Equal(t, JitterFull, fl.Jitter)
+
+	// Empty selects the default.
+	assert.NoError(t, fs.Parse([]string{"--retry-jitter="}))
+	assert.Equal(t, "", fl.Jitter)
+}
+
+func TestRun(t *testing.T) {
+	o := New(WithWait(0), WithFuzzy(0), WithAttempts(3), WithLogger(logger.Nil))
+
+	attempts := 0
+	err := o.Run(func() error {
+		attempts++
+		return fmt.Errorf("failure %d", attempts)
+	})
+	assert.Equal(t, 3, attempts)
+	var exausted *ExaustedError
+	assert.ErrorAs(t, err, &exausted)
+	assert.Contains(t, err.Error(), "gave up after 3 attempts")
+
+	errFatal := errors.New("fatal")
+	attempts = 0
+	err = o.Run(func() error {
+		attempts++
+		return Fatal(errFatal)
+	})
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, errFatal, err)
+}
+
+func TestClassifier(t *testing.T) {
+	errInvalid := errors.New("invalid argument")
+	o := New(WithWait(0), WithFuzzy(0), WithAttempts(5), WithLogger(logger.Nil), WithClassifier(func(err error) bool {
+		return errors.Is(err, errInvalid)
+	}))
+
+	attempts := 0
+	err := o.Run(func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("unavailable")
+		}
+		return fmt.Errorf("request rejected: %w", errInvalid)
+	})
+	assert.Equal(t, 2, attempts)
+	assert.ErrorIs(t, err, errInvalid)
+	var exausted *ExaustedError
+	assert.False(t, errors.As(err, &exausted))
+}
+
+func TestRunContextAttemptTimeout(t *testing.T) {
+	o := New(WithWait(0), WithFuzzy(0), WithAttempts(3), WithLogger(logger.Nil), WithAttemptTimeout(10*time.Millisecond))
+
+	var contexts []context.Context
+	err := o.RunContext(context.Background(), func(ctx context.Context) error {
+		contexts = append(contexts, ctx)
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.True(t, time.Until(deadline) <= 10*time.Millisecond)
+
+		if len(contexts) < 3 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(contexts))
+	// Each attempt context is cancelled once the attempt returns.
+	for _, ctx := range contexts {
+		assert.Error(t, ctx.Err())
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	o := New(WithWait(time.Hour), WithFuzzy(0), WithLogger(logger.Nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := o.RunContext(ctx, func(ctx context.Context) error {
+		attempts++
+		return errors.New("unavailable")
+	})
+	assert.Equal(t, 1, attempts)
+	assert.ErrorIs(t, err, context.Canceled)
+	var exausted *ExaustedError
+	assert.ErrorAs(t, err, &exausted)
+}
+
+func TestBudget(t *testing.T) {
+	now := time.Now()
+	o := New(WithWait(0), WithFuzzy(0), WithLogger(logger.Nil), WithBudget(time.Minute), WithTimeSource(func() time.Time {
+		return now
+	}))
+
+	attempts := 0
+	err := o.Run(func() error {
+		attempts++
+		now = now.Add(25 * time.Second)
+		return errors.New("slow failure")
+	})
+	assert.Equal(t, 3, attempts)
+	assert.Contains(t, err.Error(), "budget")
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DebugPrefix is the path under which the debug handlers are mounted.
+const DebugPrefix = "/debug/"
+
+var metricDebugDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "enfabrica",
+	Subsystem: "server",
+	Name:      "debug_denied_total",
+	Help:      "Requests to the debug handlers denied for a missing or invalid token, or not from loopback",
+}, []string{"reason"})
+
+// DebugFlags controls the pprof and runtime debug handlers mounted by WithDebug.
+type DebugFlags struct {
+	// If true, the handlers are mounted under DebugPrefix.
+	Enable bool
+	// If true, the handlers are mounted under DebugPrefix, but only serve
+	// requests from loopback addresses, like through kubectl port-forward.
+	Loopback bool
+	// If not empty, requests must carry an "Authorization: Bearer <token>" header.
+	Token []byte
+}
+
+func DefaultDebugFlags() *DebugFlags {
+	return &DebugFlags{}
+}
+
+func (fl *DebugFlags) Register(set kflags.FlagSet, prefix string) *DebugFlags {
+	set.BoolVar(&fl.Enable, prefix+"debug-handlers", fl.Enable, "Expose pprof profiles, expvar and runtime stats under "+DebugPrefix+" on the HTTP port")
+	set.BoolVar(&fl.Loopback, prefix+"debug-loopback", fl.Loopback, "Like --"+prefix+"debug-handlers, but only serve requests from loopback addresses")
+	set.ByteFileVar(&fl.Token, prefix+"debug-token-file", "", "If specified, path of a file with the bearer token required to access the handlers enabled by --"+prefix+"debug-handlers")
+	return fl
+}
+
+// Handler returns an http.Handler serving the debug handlers under
+// DebugPrefix, and passing all other requests to next.
+//
+// The handlers are:
+//   - /debug/pprof/, the profiles from net/http/pprof.
+//   - /debug/vars, the variables exported with expvar.
+//   - /debug/runtime, a JSON summary of the state of the go runtime.
+func (fl *DebugFlags) Handler(next http.Handler) http.Handler {
+	debug := http.NewServeMux()
+	debug.HandleFunc(DebugPrefix+"pprof/", pprof.Index)
+	debug.HandleFunc(DebugPrefix+"pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc(DebugPrefix+"pprof/profile", pprof.Profile)
+	debug.HandleFunc(DebugPrefix+"pprof/symbol", pprof.Symbol)
+	debug.HandleFunc(DebugPrefix+"pprof/trace", pprof.Trace)
+	debug.Handle(DebugPrefix+"vars", expvar.Handler())
+	debug.HandleFunc(DebugPrefix+"runtime", serveRuntime)
+
+	token := bytes.TrimSpace(fl.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, DebugPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !fl.Enable && !fromLoopback(r) {
+			metricDebugDenied.WithLabelValues("remote").Inc()
+			http.Error(w, "debug handlers are only available from loopback addresses", http.StatusForbidden)
+			return
+		}
+		if len(token) > 0 {
+			if reason := checkBearer(r, token); reason != "" {
+				metricDebugDenied.WithLabelValues(reason).Inc()
+				http.Error(w, "debug handlers require a valid bearer token", http.StatusUnauthorized)
+				return
+			}
+		}
+		debug.ServeHTTP(w, r)
+	})
+}
+
+// Enabled returns true if the debug handlers must be mounted.
+func (fl *DebugFlags) Enabled() bool {
+	return fl != nil && (fl.Enable || fl.Loopback)
+}
+
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkBearer returns the reason the request is denied, or the empty string
+// if it carries the expected token.
+func checkBearer(r *http.Request, token []byte) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "missing"
+	}
+	const scheme = "bearer "
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return "malformed"
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len(scheme):])), token) != 1 {
+		return "invalid"
+	}
+	return ""
+}
+
+// RuntimeStats is the document returned by /debug/runtime.
+type RuntimeStats struct {
+	Version    string `json:"version"`
+	NumCPU     int    `json:"num_cpu"`
+	GoMaxProcs int    `json:"gomaxprocs"`
+	Goroutines int    `json:"goroutines"`
+	NumCgoCall int64  `json:"num_cgo_call"`
+
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	LastGC       string `json:"last_gc,omitempty"`
+	PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+}
+
+func serveRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := RuntimeStats{
+		Version:      runtime.Version(),
+		NumCPU:       runtime.NumCPU(),
+		GoMaxProcs:   runtime.GOMAXPROCS(0),
+		Goroutines:   runtime.NumGoroutine(),
+		NumCgoCall:   runtime.NumCgoCall(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+	}
+	if mem.LastGC != 0 {
+		stats.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339Nano)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// get returns the status code of a GET of path on a server started with opts.
+func get(t *testing.T, path string, opts ...Option) int {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- Run(ctx, nil, nil, lis, append(opts, WithShutdown(NewShutdown(WithSignals())))...)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-result)
+	}()
+
+	resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get("http://" + lis.Addr().String() + path)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func denied(t *testing.T, reason string) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, metricDebugDenied.WithLabelValues(reason).(prometheus.Counter).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestDebugEnable(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, get(t, "/debug/pprof/"))
+	assert.Equal(t, http.StatusNotFound, get(t, "/debug/pprof/", WithDebug(DefaultDebugFlags())))
+	assert.Equal(t, http.StatusOK, get(t, "/debug/pprof/", WithDebug(&DebugFlags{Enable: true})))
+	assert.Equal(t, http.StatusOK, get(t, "/debug/vars", WithDebug(&DebugFlags{Enable: true})))
+}
+
+func TestDebugLoopback(t *testing.T) {
+	loopback := &DebugFlags{Loopback: true}
+	assert.Equal(t, http.StatusOK, get(t, "/debug/vars", WithDebug(loopback)))
+
+	before := denied(t, "remote")
+	resp := httptest.NewRecorder()
+	loopback.Handler(http.NotFoundHandler()).ServeHTTP(resp, httptest.NewRequest("GET", "/debug/vars", nil))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Equal(t, before+1, denied(t, "remote"))
+}
+
+func TestDebugRuntime(t *testing.T) {
+	handler := (&DebugFlags{Enable: true}).Handler(http.NotFoundHandler())
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/debug/runtime", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var stats RuntimeStats
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.NotZero(t, stats.Goroutines)
+	assert.NotZero(t, stats.NumCPU)
+	assert.NotEmpty(t, stats.Version)
+}
+
+func TestDebugToken(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := (&DebugFlags{Enable: true, Token: []byte("fry\n")}).Handler(next)
+
+	status := func(path, auth string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	missing := denied(t, "missing")
+	malformed := denied(t, "malformed")
+	invalid := denied(t, "invalid")
+
+	assert.Equal(t, http.StatusUnauthorized, status("/debug/vars", ""))
+	assert.Equal(t, http.StatusUnauthorized, status("/debug/pprof/", "Basic fry"))
+	assert.Equal(t, http.StatusUnauthorized, status("/debug/runtime", "Bearer leela"))
+	assert.Equal(t, http.StatusOK, status("/debug/vars", "Bearer fry"))
+	assert.Equal(t, http.StatusOK, status("/debug/vars", "bearer fry"))
+
+	assert.Equal(t, missing+1, denied(t, "missing"))
+	assert.Equal(t, malformed+1, denied(t, "malformed"))
+	assert.Equal(t, invalid+1, denied(t, "invalid"))
+
+	// Other paths don't require the token.
+	assert.Equal(t, http.StatusTeapot, status("/metrics", ""))
+}
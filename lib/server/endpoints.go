@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/stamp"
+)
+
+// Paths of the endpoints served by default by Run, unless WithoutEndpoints is used.
+const (
+	// Always returns 200 while the process is able to serve HTTP requests.
+	HealthzPath = "/healthz"
+	// Returns 200 if all the readiness checks pass, 503 otherwise, see Checks.
+	ReadyzPath = "/readyz"
+	// Returns a BuildInfo, describing the binary.
+	BuildInfoPath = "/buildinfo"
+)
+
+// DefaultCheckTimeout is how long /readyz waits for each readiness check.
+const DefaultCheckTimeout = 5 * time.Second
+
+// Checks is a set of readiness checks, reported by ReadyzPath.
+//
+// Checks can be added at any time, before or after Run started.
+type Checks struct {
+	// How long each check is given to complete.
+	Timeout time.Duration
+
+	lock     sync.Mutex
+	checks   []check
+	draining bool
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func NewChecks() *Checks {
+	return &Checks{Timeout: DefaultCheckTimeout}
+}
+
+// DefaultChecks are the checks used by Run, unless configured otherwise with WithChecks.
+//
+// Services can add their checks from anywhere, like when initializing a
+// database connection, without passing Checks around.
+var DefaultChecks = NewChecks()
+
+// Add registers a check. The service is ready only if all checks return nil.
+func (c *Checks) Add(name string, run func(ctx context.Context) error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checks = append(c.checks, check{name: name, run: run})
+}
+
+// setDraining marks the service as not ready while it is shutting down.
+func (c *Checks) setDraining(draining bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.draining = draining
+}
+
+// Readiness is the document returned by ReadyzPath.
+type Readiness struct {
+	Ready bool `json:"ready"`
+	// True if the server is shutting down.
+	Draining bool `json:"draining,omitempty"`
+	// Result of each check by name, "ok" or the error returned.
+	Checks map[string]string `json:"checks"`
+}
+
+// Run runs all the checks concurrently, returning their result.
+func (c *Checks) Run(ctx context.Context) *Readiness {
+	c.lock.Lock()
+	checks := append([]check{}, c.checks...)
+	readiness := &Readiness{Ready: !c.draining, Draining: c.draining, Checks: map[string]string{}}
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, run func(ctx context.Context) error) {
+			defer wg.Done()
+			errs[i] = run(ctx)
+		}(i, check.run)
+	}
+	wg.Wait()
+
+	for i, check := range checks {
+		result := "ok"
+		if errs[i] != nil {
+			result = errs[i].Error()
+			readiness.Ready = false
+		}
+		readiness.Checks[check.name] = result
+	}
+	return readiness
+}
+
+// BuildInfo is the document returned by BuildInfoPath, from the values
+// injected at link time in the stamp package.
+type BuildInfo struct {
+	Version      string `json:"version"`
+	Commit       string `json:"commit"`
+	Branch       string `json:"branch"`
+	MasterCommit string `json:"master_commit"`
+	Builder      string `json:"builder"`
+	BuiltAt      string `json:"built_at,omitempty"`
+	Clean        bool   `json:"clean"`
+	Official     bool   `json:"official"`
+	GoVersion    string `json:"go_version"`
+}
+
+func NewBuildInfo() *BuildInfo {
+	info := &BuildInfo{
+		Version:      stamp.Version,
+		Commit:       stamp.GitSha,
+		Branch:       stamp.GitBranch,
+		MasterCommit: stamp.GitMasterSha,
+		Builder:      stamp.BuildUser,
+		Clean:        stamp.IsClean(),
+		Official:     stamp.IsOfficial(),
+		GoVersion:    runtime.Version(),
+	}
+	if built := stamp.BuildTimestamp(); !built.IsZero() {
+		info.BuiltAt = built.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Endpoints returns an http.Handler serving HealthzPath, ReadyzPath and
+// BuildInfoPath, and passing all other requests to next.
+func Endpoints(checks *Checks, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case HealthzPath:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok\n"))
+		case ReadyzPath:
+			readiness := checks.Run(r.Context())
+			status := http.StatusOK
+			if !readiness.Ready {
+				status = http.StatusServiceUnavailable
+			}
+			writeJSON(w, status, readiness)
+		case BuildInfoPath:
+			writeJSON(w, http.StatusOK, NewBuildInfo())
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
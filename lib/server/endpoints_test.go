@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/System233/enkit/lib/stamp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointsDefault(t *testing.T) {
+	checks := NewChecks()
+	assert.Equal(t, http.StatusOK, get(t, HealthzPath, WithChecks(checks)))
+	assert.Equal(t, http.StatusOK, get(t, ReadyzPath, WithChecks(checks)))
+	assert.Equal(t, http.StatusOK, get(t, BuildInfoPath, WithChecks(checks)))
+
+	assert.Equal(t, http.StatusNotFound, get(t, HealthzPath, WithoutEndpoints()))
+	assert.Equal(t, http.StatusNotFound, get(t, ReadyzPath, WithoutEndpoints()))
+
+	// Checks added after Run started are used.
+	checks.Add("database", func(ctx context.Context) error {
+		return fmt.Errorf("connection refused")
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, get(t, ReadyzPath, WithChecks(checks)))
+	assert.Equal(t, http.StatusOK, get(t, HealthzPath, WithChecks(checks)))
+}
+
+func readyz(t *testing.T, checks *Checks) (int, Readiness) {
+	resp := httptest.NewRecorder()
+	Endpoints(checks, http.NotFoundHandler()).ServeHTTP(resp, httptest.NewRequest("GET", ReadyzPath, nil))
+
+	var readiness Readiness
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &readiness))
+	return resp.Code, readiness
+}
+
+func TestReadiness(t *testing.T) {
+	checks := NewChecks()
+	code, readiness := readyz(t, checks)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, Readiness{Ready: true, Checks: map[string]string{}}, readiness)
+
+	failing := fmt.Errorf("table not found")
+	checks.Add("bigquery", func(ctx context.Context) error { return nil })
+	checks.Add("license-config", func(ctx context.Context) error { return failing })
+	code, readiness = readyz(t, checks)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, Readiness{Checks: map[string]string{"bigquery": "ok", "license-config": "table not found"}}, readiness)
+
+	failing = nil
+	code, readiness = readyz(t, checks)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, readiness.Ready)
+
+	// Checks that don't complete in time fail.
+	checks.Timeout = 0
+	checks.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	code, readiness = readyz(t, checks)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "context deadline exceeded", readiness.Checks["slow"])
+
+	checks = NewChecks()
+	checks.setDraining(true)
+	code, readiness = readyz(t, checks)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, readiness.Draining)
+}
+
+func TestChecksConcurrent(t *testing.T) {
+	checks := NewChecks()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			checks.Add(fmt.Sprintf("check-%d", i), func(ctx context.Context) error { return nil })
+		}(i)
+		go func() {
+			defer wg.Done()
+			checks.Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, checks.Run(context.Background()).Checks, 10)
+}
+
+func TestBuildInfo(t *testing.T) {
+	resp := httptest.NewRecorder()
+	Endpoints(NewChecks(), http.NotFoundHandler()).ServeHTTP(resp, httptest.NewRequest("GET", BuildInfoPath, nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var info BuildInfo
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &info))
+	assert.Equal(t, stamp.GitSha, info.Commit)
+	assert.Equal(t, stamp.Version, info.Version)
+	assert.NotEmpty(t, info.GoVersion)
+}
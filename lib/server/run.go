@@ -2,10 +2,17 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/improbable-eng/grpc-web/go/grpcweb"
 	"github.com/soheilhy/cmux"
@@ -15,16 +22,209 @@ import (
 	"google.golang.org/grpc/reflection"
 )
 
+// DefaultDrainTimeout is how long in-flight requests and streams are given to
+// complete on shutdown, unless configured otherwise with WithDrainTimeout.
+const DefaultDrainTimeout = 30 * time.Second
+
+// Shutdown configures how a server started by Run stops, see WithShutdown.
+type Shutdown struct {
+	// Signals that trigger the shutdown of the server.
+	Signals []os.Signal
+	// How long to wait for in-flight requests and streams to complete before
+	// closing their connections forcefully.
+	DrainTimeout time.Duration
+
+	lock  sync.Mutex
+	hooks []hook
+}
+
+type hook struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+type ShutdownModifier func(*Shutdown)
+
+func WithDrainTimeout(timeout time.Duration) ShutdownModifier {
+	return func(s *Shutdown) {
+		s.DrainTimeout = timeout
+	}
+}
+
+func WithSignals(signals ...os.Signal) ShutdownModifier {
+	return func(s *Shutdown) {
+		s.Signals = signals
+	}
+}
+
+// NewShutdown returns a Shutdown triggered by SIGTERM or SIGINT, waiting
+// DefaultDrainTimeout for in-flight requests, unless configured otherwise.
+func NewShutdown(mods ...ShutdownModifier) *Shutdown {
+	s := &Shutdown{
+		Signals:      []os.Signal{syscall.SIGTERM, syscall.SIGINT},
+		DrainTimeout: DefaultDrainTimeout,
+	}
+	for _, m := range mods {
+		m(s)
+	}
+	return s
+}
+
+// OnStop registers a hook to invoke as soon as the shutdown starts, before the
+// server stops accepting connections.
+//
+// Hooks are invoked in the order they were registered, with a context expiring
+// after the drain timeout. An error is logged, and does not stop the shutdown.
+// State that can only be flushed once all requests completed should instead be
+// flushed by the caller, after Run returns.
+func (s *Shutdown) OnStop(name string, run func(ctx context.Context) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hooks = append(s.hooks, hook{name: name, run: run})
+}
+
+func (s *Shutdown) runHooks(ctx context.Context) {
+	s.lock.Lock()
+	hooks := append([]hook{}, s.hooks...)
+	s.lock.Unlock()
+
+	for _, h := range hooks {
+		if err := h.run(ctx); err != nil {
+			log.Printf("Shutdown hook %s failed: %s", h.name, err)
+		}
+	}
+}
+
+// drain stops the servers, waiting at most DrainTimeout for in-flight
+// requests and streams to complete.
+func (s *Shutdown) drain(cml cmux.CMux, grpcs *grpc.Server, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+
+	s.runHooks(ctx)
+
+	// Closing the mux closes the listener: no new connections are accepted,
+	// while the ones already established keep being served.
+	cml.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcs.GracefulStop()
+		close(stopped)
+	}()
+
+	for _, https := range servers {
+		if err := https.Shutdown(ctx); err != nil {
+			log.Printf("HTTP requests still running after %s, closing connections: %s", s.DrainTimeout, err)
+			https.Close()
+		}
+	}
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("gRPC requests still running after %s, closing connections", s.DrainTimeout)
+		grpcs.Stop()
+		<-stopped
+	}
+}
+
+// Option configures a server started by Run.
+type Option func(*options)
+
+type options struct {
+	shutdown *Shutdown
+	debug    *DebugFlags
+	tls      *TLSFlags
+
+	checks      *Checks
+	noEndpoints bool
+}
+
+// WithShutdown configures how the server stops, NewShutdown() by default.
+func WithShutdown(shutdown *Shutdown) Option {
+	return func(o *options) {
+		o.shutdown = shutdown
+	}
+}
+
+// WithDebug mounts the pprof and runtime debug handlers under /debug/, if enabled
+// by the flags. See DebugFlags.
+func WithDebug(flags *DebugFlags) Option {
+	return func(o *options) {
+		o.debug = flags
+	}
+}
+
+// WithChecks configures the readiness checks reported by ReadyzPath,
+// DefaultChecks by default.
+func WithChecks(checks *Checks) Option {
+	return func(o *options) {
+		o.checks = checks
+	}
+}
+
+// WithoutEndpoints disables HealthzPath, ReadyzPath and BuildInfoPath,
+// served by default. See Endpoints.
+func WithoutEndpoints() Option {
+	return func(o *options) {
+		o.noEndpoints = true
+	}
+}
+
+// WithTLS serves TLS, and optionally mutual TLS, if configured by the flags.
+// See TLSFlags.
+func WithTLS(flags *TLSFlags) Option {
+	return func(o *options) {
+		o.tls = flags
+	}
+}
+
 // Run() starts a server supporting the following protocols:
 //
 // ✔ grpc
 // ✔ grpc-web via websockets
 // ✔ HTTP 1.1
 // ✗ HTTP 2.0 (hijacked by grpc support)
-func Run(ctx context.Context, mux http.Handler, grpcs *grpc.Server, lis net.Listener) error {
+//
+// With WithTLS, the same protocols are served over TLS on the same port.
+//
+// Unless WithoutEndpoints is used, the HTTP port also serves the health,
+// readiness and build information endpoints, see Endpoints.
+//
+// The server is gracefully stopped when one of the signals configured with
+// WithShutdown is received, SIGTERM or SIGINT by default, or ctx is done.
+//
+// On shutdown, the hooks registered with Shutdown.OnStop are invoked, new
+// connections are refused, and in-flight requests and streams are given up to
+// the drain timeout to complete. Run then returns nil, letting the caller
+// flush its state before exiting. A second signal terminates the process
+// immediately.
+func Run(ctx context.Context, mux http.Handler, grpcs *grpc.Server, lis net.Listener, opts ...Option) error {
+	o := options{shutdown: NewShutdown(), checks: DefaultChecks}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	shutdown := o.shutdown
+
+	var ts *tlsServer
+	if o.tls.Enabled() {
+		var err error
+		if ts, err = newTLSServer(o.tls); err != nil {
+			return err
+		}
+	}
+
 	if mux == nil {
 		mux = http.NewServeMux()
 	}
+	if o.debug.Enabled() {
+		mux = o.debug.Handler(mux)
+	}
+	if !o.noEndpoints {
+		o.checks.setDraining(false)
+		mux = Endpoints(o.checks, mux)
+	}
 	if grpcs == nil {
 		grpcs = grpc.NewServer()
 	}
@@ -36,7 +236,11 @@ func Run(ctx context.Context, mux http.Handler, grpcs *grpc.Server, lis net.List
 			port = "6433"
 		}
 
-		log.Printf("Opening port %s - will be available at http://127.0.0.1:%s/", port, port)
+		scheme := "http"
+		if ts != nil {
+			scheme = "https"
+		}
+		log.Printf("Opening port %s - will be available at %s://127.0.0.1:%s/", port, scheme, port)
 		var err error
 		lis, err = net.Listen("tcp", net.JoinHostPort("", port))
 		if err != nil {
@@ -44,17 +248,29 @@ func Run(ctx context.Context, mux http.Handler, grpcs *grpc.Server, lis net.List
 		}
 	}
 
+	var servers []*http.Server
+	if ts != nil {
+		if o.tls.RedirectPort != 0 {
+			redirectl, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(o.tls.RedirectPort)))
+			if err != nil {
+				return fmt.Errorf("could not open port %d to redirect to HTTPS - %w", o.tls.RedirectPort, err)
+			}
+			port := 443
+			if addr, ok := lis.Addr().(*net.TCPAddr); ok {
+				port = addr.Port
+			}
+			redirect := ts.redirect(port)
+			go redirect.Serve(redirectl)
+			servers = append(servers, redirect)
+		}
+		lis = tls.NewListener(lis, ts.config)
+	}
+
 	// Create all listeners.
 	cml := cmux.New(lis)
 	grpcl := cml.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
 	httpl := cml.Match(cmux.Any())
 
-	go func() {
-		<-ctx.Done()
-		log.Printf("Got context done (err: %v): attempting graceful shutdown by closing mux", ctx.Err())
-		cml.Close()
-	}()
-
 	grpcw := grpcweb.WrapServer(grpcs, grpcweb.WithAllowNonRootResource(true), grpcweb.WithWebsockets(true), grpcweb.WithOriginFunc(func(string) bool { return true }))
 
 	https := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
@@ -64,10 +280,36 @@ func Run(ctx context.Context, mux http.Handler, grpcs *grpc.Server, lis net.List
 			mux.ServeHTTP(resp, req)
 		}
 	})}
+	servers = append(servers, https)
 	go grpcs.Serve(grpcl)
 	go https.Serve(httpl)
 
-	return cml.Serve()
+	served := make(chan error, 1)
+	go func() {
+		served <- cml.Serve()
+	}()
+
+	// With no signals, signal.Notify would relay all of them.
+	signals := make(chan os.Signal, 1)
+	if len(shutdown.Signals) > 0 {
+		signal.Notify(signals, shutdown.Signals...)
+	}
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		log.Printf("Got signal %s: draining connections for up to %s", sig, shutdown.DrainTimeout)
+	case <-ctx.Done():
+		log.Printf("Got context done (err: %v): draining connections for up to %s", ctx.Err(), shutdown.DrainTimeout)
+	}
+	// Restores the default behavior of the signals, so a second one kills the process.
+	signal.Stop(signals)
+
+	o.checks.setDraining(true)
+	shutdown.drain(cml, grpcs, servers...)
+	return nil
 }
 
 // CloudRun starts an HTTP and gRPC server handling requests for all on the same
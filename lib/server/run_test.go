@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve starts a server with a /slow handler blocking until release is closed,
+// returning its address and a channel receiving the result of Run.
+func serve(t *testing.T, ctx context.Context, shutdown *Shutdown, started chan struct{}, release chan struct{}) (string, chan error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		result <- Run(ctx, mux, nil, lis, WithShutdown(shutdown))
+	}()
+	return "http://" + lis.Addr().String(), result
+}
+
+func TestRunDrainsRequests(t *testing.T) {
+	stopped := 0
+	shutdown := NewShutdown(WithSignals(syscall.SIGUSR1), WithDrainTimeout(10*time.Second))
+	shutdown.OnStop("count", func(ctx context.Context) error {
+		stopped++
+		return nil
+	})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	url, result := serve(t, context.Background(), shutdown, started, release)
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+	<-started
+
+	assert.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+	// The server keeps waiting for the in-flight request.
+	select {
+	case err := <-result:
+		t.Fatalf("server returned with a request in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, 1, stopped)
+
+	// New connections are refused.
+	_, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get(url + "/slow")
+	assert.Error(t, err)
+
+	close(release)
+	resp := <-responses
+	assert.NoError(t, resp.err)
+	assert.Equal(t, "done", resp.body)
+	assert.NoError(t, <-result)
+}
+
+func TestRunDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown := NewShutdown(WithSignals(), WithDrainTimeout(100*time.Millisecond))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	url, result := serve(t, ctx, shutdown, started, release)
+	go http.Get(url + "/slow")
+	<-started
+
+	// The request never completes: the server gives up after the drain timeout.
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after the drain timeout")
+	}
+}
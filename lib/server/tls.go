@@ -0,0 +1,292 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultReloadInterval is how often the certificate files are checked for changes.
+const DefaultReloadInterval = time.Minute
+
+// TLSFlags configures TLS, and optionally mutual TLS, on the port of a server
+// started by Run. See WithTLS.
+//
+// The certificate is either read from a pair of files, reloaded when they
+// change, or obtained with ACME and cached in a directory.
+type TLSFlags struct {
+	// PEM encoded certificate chain and private key.
+	CertFile string
+	KeyFile  string
+
+	// Directory where the certificates obtained via ACME are cached,
+	// for the domains in AutocertDomains.
+	AutocertDir     string
+	AutocertDomains []string
+
+	// PEM encoded CAs verifying the certificates clients must present.
+	// If empty, clients are not required to present certificates.
+	ClientCAFile string
+
+	// If not 0, port on which HTTP requests are redirected to HTTPS.
+	RedirectPort int
+
+	// How often the certificate, key and client CA files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+func DefaultTLSFlags() *TLSFlags {
+	return &TLSFlags{
+		ReloadInterval: DefaultReloadInterval,
+	}
+}
+
+func (fl *TLSFlags) Register(set kflags.FlagSet, prefix string) *TLSFlags {
+	set.StringVar(&fl.CertFile, prefix+"tls-cert-file", fl.CertFile, "Path of the PEM encoded certificate chain to serve with TLS - reloaded when it changes")
+	set.StringVar(&fl.KeyFile, prefix+"tls-key-file", fl.KeyFile, "Path of the PEM encoded private key of --"+prefix+"tls-cert-file")
+	set.StringVar(&fl.AutocertDir, prefix+"tls-autocert-dir", fl.AutocertDir, "Directory where to cache the certificates obtained via ACME (e.g. letsencrypt), instead of using --"+prefix+"tls-cert-file")
+	set.StringArrayVar(&fl.AutocertDomains, prefix+"tls-autocert-domain", fl.AutocertDomains, "Domain to obtain a certificate for with --"+prefix+"tls-autocert-dir - can be repeated")
+	set.StringVar(&fl.ClientCAFile, prefix+"tls-client-ca-file", fl.ClientCAFile, "Path of the PEM encoded CAs to verify client certificates with - if set, clients must present a valid certificate")
+	set.IntVar(&fl.RedirectPort, prefix+"tls-redirect-port", fl.RedirectPort, "If not 0, port on which to redirect HTTP requests to HTTPS")
+	set.DurationVar(&fl.ReloadInterval, prefix+"tls-reload-interval", fl.ReloadInterval, "How often to check the certificate, key and client CA files for changes")
+	return fl
+}
+
+// Enabled returns true if TLS was configured.
+func (fl *TLSFlags) Enabled() bool {
+	return fl != nil && (fl.CertFile != "" || fl.KeyFile != "" || fl.AutocertDir != "")
+}
+
+// tlsServer holds the state needed to serve TLS.
+type tlsServer struct {
+	config  *tls.Config
+	manager *autocert.Manager
+}
+
+// newTLSServer returns the tls.Config to serve, or a kflags.UsageError if the flags are invalid.
+func newTLSServer(fl *TLSFlags) (*tlsServer, error) {
+	if fl.AutocertDir != "" && (fl.CertFile != "" || fl.KeyFile != "") {
+		return nil, kflags.NewUsageErrorf("--tls-autocert-dir and --tls-cert-file are mutually exclusive")
+	}
+	if fl.AutocertDir != "" && len(fl.AutocertDomains) <= 0 {
+		return nil, kflags.NewUsageErrorf("--tls-autocert-dir requires at least one --tls-autocert-domain")
+	}
+	if fl.AutocertDir == "" && (fl.CertFile == "" || fl.KeyFile == "") {
+		return nil, kflags.NewUsageErrorf("--tls-cert-file and --tls-key-file must be specified together")
+	}
+
+	reloader := &certReloader{
+		certFile: fl.CertFile,
+		keyFile:  fl.KeyFile,
+		caFile:   fl.ClientCAFile,
+		interval: fl.ReloadInterval,
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	ts := &tlsServer{config: &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}}
+	if fl.AutocertDir != "" {
+		if err := os.MkdirAll(fl.AutocertDir, 0700); err != nil {
+			return nil, err
+		}
+		ts.manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(fl.AutocertDomains...),
+			Cache:      autocert.DirCache(fl.AutocertDir),
+		}
+		ts.config.GetCertificate = ts.manager.GetCertificate
+		ts.config.NextProtos = append(ts.config.NextProtos, acme.ALPNProto)
+	} else {
+		ts.config.GetCertificate = reloader.GetCertificate
+	}
+
+	if fl.ClientCAFile != "" {
+		ts.config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ts.config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		config := ts.config.Clone()
+		config.GetConfigForClient = nil
+		if fl.ClientCAFile != "" {
+			config.ClientCAs = reloader.ClientCAs()
+		}
+		// As with plain text, HTTP 2.0 is reserved to gRPC: gRPC clients only
+		// offer h2, while HTTP clients fall back to HTTP 1.1. The connections
+		// seen by the HTTP server are wrapped by cmux, which breaks HTTP 2.0.
+		for _, proto := range hello.SupportedProtos {
+			if proto == "http/1.1" {
+				config.NextProtos = config.NextProtos[1:]
+				break
+			}
+		}
+		return config, nil
+	}
+	return ts, nil
+}
+
+// redirect returns a server redirecting HTTP requests to the HTTPS port.
+//
+// With ACME, the server also answers the http-01 challenges.
+func (ts *tlsServer) redirect(port int) *http.Server {
+	var handler http.Handler = redirectHandler(port)
+	if ts.manager != nil {
+		handler = ts.manager.HTTPHandler(handler)
+	}
+	return &http.Server{Handler: handler}
+}
+
+// redirectHandler redirects requests to the same URL over HTTPS on the specified port.
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		target := *r.URL
+		target.Scheme = "https"
+		target.Host = host
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// fileStamp identifies a version of a file, to detect changes.
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+func stampFiles(paths ...string) ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, path := range paths {
+		if path == "" {
+			stamps = append(stamps, fileStamp{})
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modified: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
+
+// certReloader serves the certificate and client CAs from files, reloading
+// them at most every interval if they changed.
+//
+// Connections already established are not affected by a reload.
+type certReloader struct {
+	certFile, keyFile, caFile string
+	interval                  time.Duration
+
+	lock    sync.Mutex
+	checked time.Time
+	stamps  []fileStamp
+	cert    *tls.Certificate
+	cas     *x509.CertPool
+}
+
+// load reads the files, returning an error if they are invalid.
+func (cr *certReloader) load() error {
+	stamps, err := stampFiles(cr.certFile, cr.keyFile, cr.caFile)
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if cr.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+		if err != nil {
+			return fmt.Errorf("invalid certificate %s or key %s - %w", cr.certFile, cr.keyFile, err)
+		}
+		cert = &loaded
+	}
+
+	var cas *x509.CertPool
+	if cr.caFile != "" {
+		data, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no valid PEM certificates in client CA file %s", cr.caFile)
+		}
+	}
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.checked = time.Now()
+	cr.stamps = stamps
+	cr.cert = cert
+	cr.cas = cas
+	return nil
+}
+
+// maybeReload reloads the files if interval has passed since the last check, and they changed.
+//
+// If the new files are invalid, for example as they are still being written,
+// the previous ones keep being used, and the files are checked again later.
+func (cr *certReloader) maybeReload() {
+	cr.lock.Lock()
+	if time.Since(cr.checked) < cr.interval {
+		cr.lock.Unlock()
+		return
+	}
+	cr.checked = time.Now()
+	previous := cr.stamps
+	cr.lock.Unlock()
+
+	stamps, err := stampFiles(cr.certFile, cr.keyFile, cr.caFile)
+	if err != nil {
+		log.Printf("Could not check certificates for changes - %s", err)
+		return
+	}
+	changed := false
+	for i := range stamps {
+		if stamps[i] != previous[i] {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := cr.load(); err != nil {
+		log.Printf("Could not reload certificates, still using the previous ones - %s", err)
+		return
+	}
+	log.Printf("Reloaded certificate %s and client CAs %s", cr.certFile, cr.caFile)
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.maybeReload()
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) ClientCAs() *x509.CertPool {
+	cr.maybeReload()
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return cr.cas
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	hpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "planet express"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key for 127.0.0.1 with the specified common name.
+func (ca *testCA) issue(t *testing.T, name string, serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyder, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func writeFile(t *testing.T, path string, data []byte) string {
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+// serveTLS starts a server with TLS configured by fl, returning its address.
+func serveTLS(t *testing.T, fl *TLSFlags) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	grpcs := grpc.NewServer()
+	hpb.RegisterHealthServer(grpcs, health.NewServer())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- Run(ctx, mux, grpcs, lis, WithTLS(fl), WithShutdown(NewShutdown(WithSignals())))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-result)
+	})
+	return lis.Addr().String()
+}
+
+// getTLS returns the body of /hello, and the common name of the certificate of the server.
+func getTLS(t *testing.T, addr string, config *tls.Config) (string, string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true, DisableKeepAlives: true}}
+	resp, err := client.Get("https://" + addr + "/hello")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func checkGRPC(addr string, config *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(config)), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = hpb.NewHealthClient(conn).Check(ctx, &hpb.HealthCheckRequest{})
+	return err
+}
+
+func TestTLSFlags(t *testing.T) {
+	assert.False(t, DefaultTLSFlags().Enabled())
+	var nilFlags *TLSFlags
+	assert.False(t, nilFlags.Enabled())
+
+	var ue *kflags.UsageError
+	for _, invalid := range []*TLSFlags{
+		{CertFile: "cert.pem"},
+		{KeyFile: "key.pem"},
+		{AutocertDir: t.TempDir()},
+		{AutocertDir: t.TempDir(), AutocertDomains: []string{"enfabrica.net"}, CertFile: "cert.pem"},
+	} {
+		_, err := newTLSServer(invalid)
+		assert.ErrorAs(t, err, &ue, "%+v", invalid)
+	}
+
+	_, err := newTLSServer(&TLSFlags{CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"})
+	assert.Error(t, err)
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "bender", 2)
+	fl := DefaultTLSFlags()
+	fl.CertFile = writeFile(t, filepath.Join(dir, "cert.pem"), cert)
+	fl.KeyFile = writeFile(t, filepath.Join(dir, "key.pem"), key)
+	fl.ReloadInterval = 0
+
+	addr := serveTLS(t, fl)
+	config := &tls.Config{RootCAs: ca.pool()}
+
+	// HTTP and gRPC share the same port, HTTP clients are served HTTP 1.1 even if they offer HTTP 2.0.
+	body, name, err := getTLS(t, addr, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1", body)
+	assert.Equal(t, "bender", name)
+
+	assert.NoError(t, checkGRPC(addr, config))
+
+	// A rotated certificate is served to new connections.
+	cert, key = ca.issue(t, "flexo", 3)
+	writeFile(t, fl.CertFile, cert)
+	writeFile(t, fl.KeyFile, key)
+	_, name, err = getTLS(t, addr, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "flexo", name)
+
+	// An invalid certificate is ignored, the previous one is still served.
+	writeFile(t, fl.KeyFile, []byte("not a key"))
+	_, name, err = getTLS(t, addr, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "flexo", name)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "bender", 2)
+	fl := DefaultTLSFlags()
+	fl.CertFile = writeFile(t, filepath.Join(dir, "cert.pem"), cert)
+	fl.KeyFile = writeFile(t, filepath.Join(dir, "key.pem"), key)
+	fl.ClientCAFile = writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem)
+
+	addr := serveTLS(t, fl)
+
+	_, _, err := getTLS(t, addr, &tls.Config{RootCAs: ca.pool()})
+	assert.Error(t, err)
+
+	// Certificates from another CA are refused.
+	other := newTestCA(t)
+	ccert, ckey := other.issue(t, "zoidberg", 4)
+	rogue, err := tls.X509KeyPair(ccert, ckey)
+	assert.NoError(t, err)
+	_, _, err = getTLS(t, addr, &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{rogue}})
+	assert.Error(t, err)
+
+	ccert, ckey = ca.issue(t, "leela", 5)
+	client, err := tls.X509KeyPair(ccert, ckey)
+	assert.NoError(t, err)
+	config := &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{client}}
+	_, _, err = getTLS(t, addr, config)
+	assert.NoError(t, err)
+	assert.NoError(t, checkGRPC(addr, config))
+}
+
+func TestRedirect(t *testing.T) {
+	for port, location := range map[int]string{
+		443:  "https://planetexpress.com/delivery?to=moon",
+		6433: "https://planetexpress.com:6433/delivery?to=moon",
+	} {
+		resp := httptest.NewRecorder()
+		redirectHandler(port).ServeHTTP(resp, httptest.NewRequest("GET", "http://planetexpress.com:8080/delivery?to=moon", nil))
+		assert.Equal(t, http.StatusPermanentRedirect, resp.Code)
+		assert.Equal(t, location, resp.Header().Get("Location"))
+	}
+}
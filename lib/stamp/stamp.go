@@ -7,6 +7,7 @@ import (
 )
 
 var (
+	Version      = "<unknown>"
 	BuildUser    = "<unknown>"
 	GitBranch    = "<unknown>"
 	GitSha       = "<unknown>"
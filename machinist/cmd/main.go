@@ -10,7 +10,7 @@ func main() {
 	base := client.DefaultBaseFlags("astore", "enkit")
 	c := machinist.NewRootCommand(base)
 
-	set, populator, runner := kcobra.Runner(c, nil, base.IdentityErrorHandler("enkit login"))
+	set, populator, runner := kcobra.Runner(c, nil, base.IdentityErrorHandler("enkit login"), base.DebugDumpErrorHandler(), base.RPCTraceErrorHandler(), base.RenderErrorHandler())
 
 	base.Run(set, populator, runner)
 }
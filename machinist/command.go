@@ -21,5 +21,7 @@ func NewRootCommand(bf *client.BaseFlags) *cobra.Command {
 	c.PersistentFlags().BoolVar(&conf.EnableMetrics, "metrics-enable", true, "")
 	c.AddCommand(machine.NewNodeCommand(conf))
 	c.AddCommand(mserver.NewCommand(conf.Root))
+	c.AddCommand(mserver.NewFreeCommand(conf))
+	c.AddCommand(mserver.NewDrainCommand(conf))
 	return c
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"path/filepath"
+	"time"
 )
 
 type Node struct {
@@ -9,9 +10,25 @@ type Node struct {
 	Tags          []string
 	SSHPrincipals []string
 	IpAddresses   []string
+	// Site the node belongs to, empty for the default site.
+	Site string
+
+	// Network interfaces whose addresses are registered, in addition to
+	// IpAddresses. The node registers again as soon as their addresses change,
+	// but at most once every AddressChangeInterval.
+	Interfaces            []string
+	AddressChangeInterval time.Duration
+	// How often to check the addresses of Interfaces when the system
+	// does not notify address changes.
+	AddressPollInterval time.Duration
 
 	RequireRoot bool
 
+	// Type and size of the host key generated at enrollment, as accepted by
+	// kcerts.GenerateKey. A size of 0 selects the default for the type.
+	KeyType string
+	KeyBits int
+
 	// BUG(INFRA-2550): Machinist can unpack files/scripts/config onto the host
 	// machine, but this is better managed out-of-band by another tool, such as
 	// Ansible or Puppet. If this bool is set, perform the legacy unpacking
@@ -30,6 +47,24 @@ type Node struct {
 	HostKeyLocation           string
 	SSHDConfigurationLocation string
 	ReWriteConfigs            bool
+	// Command run to reload sshd after the host key is rotated, split on spaces.
+	SSHDReloadCommand string
+
+	// Revoked keys configs. An empty RevokedKeysLocation disables the
+	// RevokedKeys directive, an empty RevokedKeysURL disables fetching.
+	RevokedKeysLocation string
+	RevokedKeysURL      string
+	RevokedKeysInterval time.Duration
+
+	// File caching the last configuration received from the controller and
+	// the certificates received at enrollment. Empty disables the cache.
+	ConfigCacheLocation string
+	// How long to wait for the controller at startup before applying the
+	// cached configuration.
+	ConfigCacheWait time.Duration
+	// File where the principals of the node sent by the controller are
+	// written, one per line. Empty to not write them.
+	PrincipalsLocation string
 
 	*Common
 }
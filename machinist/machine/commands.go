@@ -2,10 +2,12 @@ package machine
 
 import (
 	"fmt"
+	"github.com/System233/enkit/lib/kcerts"
 	"github.com/System233/enkit/machinist/config"
 	"github.com/spf13/cobra"
 	"os"
 	"strings"
+	"time"
 )
 
 func NewNodeCommand(common *config.Common) *cobra.Command {
@@ -22,10 +24,14 @@ func NewNodeCommand(common *config.Common) *cobra.Command {
 		panic(err) // Hostnames are important for ssh configuration, this is a valid panic.
 	}
 	c.PersistentFlags().StringVar(&conf.Name, "name", h, "the name of this node. If a node already exists with this name, polling the machinist server will fail")
+	c.PersistentFlags().StringVar(&conf.Site, "site", "", "the site (lab, cluster, ...) this node belongs to. Node names need to be unique within a site only. If empty, the node belongs to the default site")
 	c.PersistentFlags().StringArrayVar(&conf.SSHPrincipals, "ssh-principals", []string{"localhost"}, "the list of ssh names you want this node to have, typically these line up with the dns aliases of the machine")
+	c.PersistentFlags().StringVar(&conf.RevokedKeysLocation, "revoked-keys-file", "", "the location of the KRL used by sshd to reject revoked certificates. If empty, no RevokedKeys directive is configured")
+	c.PersistentFlags().StringVar(&conf.ConfigCacheLocation, "config-cache-file", "/var/lib/machinist/config-cache.json", "the file caching the configuration received from the controller and the certificates installed at enrollment, used when the node starts while the controller is unreachable. If empty, nothing is cached")
 
 	c.AddCommand(NewEnrollCommand(conf))
 	c.AddCommand(NewPollCommand(conf))
+	c.AddCommand(NewRotateKeyCommand(conf))
 	c.AddCommand(NewSystemdCommand())
 	return c
 }
@@ -58,6 +64,8 @@ func NewEnrollCommand(conf *config.Node) *cobra.Command {
 	c.PersistentFlags().StringVar(&conf.HostKeyLocation, "host-key-file", "/etc/ssh/machinist_host_key", "the location where to save the machinist host key, the signed certificate will be written to the same path with -cert.pub appended")
 	c.PersistentFlags().StringVar(&conf.CaPublicKeyLocation, "ca-key-file", "/etc/ssh/machinist_ca.pub", "the file location of the CA's public key from the auth server. If the file already exists, defers to the rewrite flag")
 	c.PersistentFlags().BoolVar(&conf.ReWriteConfigs, "rewrite", true, "rewrite HostKey and HostCert and TrustedCAKey if it already exists on the system")
+	c.PersistentFlags().StringVar(&conf.KeyType, "key-type", string(kcerts.KeyTypeED25519), fmt.Sprintf("the type of host key to generate, one of %v. Use rsa or ecdsa only if clients do not accept ed25519 keys", kcerts.KeyTypes))
+	c.PersistentFlags().IntVar(&conf.KeyBits, "key-bits", 0, "the size of the host key to generate, 0 for the default size of the key type")
 
 	return c
 }
@@ -77,11 +85,51 @@ func NewPollCommand(conf *config.Node) *cobra.Command {
 		},
 	}
 	c.PersistentFlags().StringArrayVar(&conf.IpAddresses, "ips", []string{}, "the list of ip addresses bound to this machine")
+	c.PersistentFlags().StringArrayVar(&conf.Interfaces, "interfaces", []string{}, "the network interfaces whose addresses are registered, in addition to --ips. When their addresses change, for example because of DHCP, the machine registers again immediately")
+	c.PersistentFlags().DurationVar(&conf.AddressChangeInterval, "address-change-interval", 30*time.Second, "how often at most to register again because of address changes of --interfaces, to avoid flapping")
+	c.PersistentFlags().DurationVar(&conf.AddressPollInterval, "address-poll-interval", 10*time.Second, "how often to check the addresses of --interfaces, if the system does not notify address changes")
+	c.PersistentFlags().StringVar(&conf.RevokedKeysURL, "revoked-keys-url", "", "url of the KRL published by the auth server, periodically installed in --revoked-keys-file. If empty, the KRL is not fetched")
+	c.PersistentFlags().DurationVar(&conf.RevokedKeysInterval, "revoked-keys-interval", 5*time.Minute, "how often to fetch the KRL from --revoked-keys-url")
+	c.PersistentFlags().DurationVar(&conf.ConfigCacheWait, "config-cache-wait", 30*time.Second, "how long to wait for the controller at startup before applying the configuration from --config-cache-file")
+	c.PersistentFlags().StringVar(&conf.PrincipalsLocation, "principals-file", "", "the file where to write the principals of this node sent by the controller, one per line. If empty, they are not written")
 	return c
 }
 
 
 
+func NewRotateKeyCommand(conf *config.Node) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "rotate-key [OPTIONS]",
+		Short: "Replaces the host key and certificate of an enrolled node, and reloads sshd",
+		Long: `Replaces the host key and certificate of an enrolled node, and reloads sshd.
+
+The files replaced are those referenced by the sshd configuration written by enroll.
+If any step fails, the previous host key and certificate are left in place.
+
+The fingerprint of the previous host key is printed, so it can be revoked.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			n, err := New(WithConfig(conf))
+			if err != nil {
+				return err
+			}
+			result, err := n.RotateKey()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Rotated host key %s, certificate %s\n", result.HostKey, result.HostCertificate)
+			fmt.Printf("Old fingerprint: %s\n", result.OldFingerprint)
+			fmt.Printf("New fingerprint: %s\n", result.NewFingerprint)
+			return nil
+		},
+	}
+	c.PersistentFlags().BoolVar(&conf.RequireRoot, "require-root", true, "should the rotate-key command require root for execution")
+	c.PersistentFlags().StringVar(&conf.SSHDConfigurationLocation, "sshd-configuration-file", "/etc/ssh/sshd_config.d/machinist.conf", "the location of the sshd configuration written by enroll, referencing the host key and certificate to replace")
+	c.PersistentFlags().StringVar(&conf.SSHDReloadCommand, "sshd-reload-command", "systemctl reload sshd", "the command to run to have sshd load the new host key. If empty, sshd is not reloaded")
+	c.PersistentFlags().StringVar(&conf.KeyType, "key-type", string(kcerts.KeyTypeED25519), fmt.Sprintf("the type of host key to generate, one of %v. Use rsa or ecdsa only if clients do not accept ed25519 keys", kcerts.KeyTypes))
+	c.PersistentFlags().IntVar(&conf.KeyBits, "key-bits", 0, "the size of the host key to generate, 0 for the default size of the key type")
+	return c
+}
+
 type SystemdDConfig struct {
 	User        string
 	InstallPath string
@@ -57,6 +57,13 @@ func WithName(name string) NodeModifier {
 	}
 }
 
+func WithSite(site string) NodeModifier {
+	return func(node *Machine) error {
+		node.Site = site
+		return nil
+	}
+}
+
 func WithTags(tags []string) NodeModifier {
 	return func(node *Machine) error {
 		node.Tags = tags
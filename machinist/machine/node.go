@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	apb "github.com/System233/enkit/auth/proto"
 	"github.com/System233/enkit/lib/goroutine"
@@ -62,16 +63,47 @@ func (n *Machine) Init() error {
 
 func (n *Machine) BeginPolling() error {
 	ctx := context.Background()
+
+	ips := n.IpAddresses
+	var watcher *polling.AddressWatcher
+	var changes chan []string
+	if len(n.Interfaces) > 0 {
+		watcher = polling.NewAddressWatcher(ctx, n.Node)
+		var err error
+		if ips, err = watcher.Addresses(); err != nil {
+			return err
+		}
+		changes = make(chan []string)
+	}
+
+	var cache *polling.ConfigCache
+	if n.ConfigCacheLocation != "" {
+		cache = polling.NewConfigCache(n.ConfigCacheLocation)
+	}
+	configs := make(chan *mpb.NodeConfig)
+
 	return goroutine.WaitFirstError(
 		func() error {
-			return polling.SendRegisterRequests(ctx, n.MachinistClient, n.Node)
+			return polling.SendRegisterRequests(ctx, n.MachinistClient, n.Node, ips, changes, configs)
 		},
 		func() error {
-			return polling.SendKeepAliveRequest(ctx, n.MachinistClient)
+			return polling.SyncNodeConfig(ctx, n.Node, cache, configs)
+		},
+		func() error {
+			if watcher == nil {
+				return nil
+			}
+			return polling.SendAddressChanges(ctx, watcher, ips, changes)
+		},
+		func() error {
+			return polling.SendKeepAliveRequest(ctx, n.MachinistClient, n.Node)
 		},
 		func() error {
 			return polling.SendMetricsRequest(ctx, n.Node)
 		},
+		func() error {
+			return polling.SendRevokedKeysRequests(ctx, n.Node)
+		},
 	)
 }
 
@@ -80,9 +112,9 @@ func (n *Machine) Enroll() error {
 	if os.Geteuid() != 0 && n.RequireRoot {
 		return errors.New("this command must be run as root since it touches the /etc/ssh directory")
 	}
-	pubKey, privKey, err := kcerts.GenerateED25519()
+	pubKey, privKey, err := kcerts.GenerateKey(kcerts.KeyType(n.KeyType), n.KeyBits)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not generate host key: %w", err)
 	}
 	hcr := &apb.HostCertificateRequest{
 		Hostcert: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ssh.MarshalAuthorizedKey(pubKey)}),
@@ -130,7 +162,7 @@ func (n *Machine) Enroll() error {
 	if err := os.MkdirAll(filepath.Dir(n.SSHDConfigurationLocation), os.ModePerm); err != nil {
 		return err
 	}
-	sshdConfigContent, err := ReadSSHDContent(n.CaPublicKeyLocation, n.HostKeyLocation, n.HostCertificate())
+	sshdConfigContent, err := ReadSSHDContent(n.CaPublicKeyLocation, n.HostKeyLocation, n.HostCertificate(), n.RevokedKeysLocation)
 	if err != nil {
 		return err
 	}
@@ -154,9 +186,47 @@ func (n *Machine) Enroll() error {
 	if err := ioutil.WriteFile(n.HostKeyLocation, pemBytes, 0644); err != nil {
 		return err
 	}
+	if n.RevokedKeysLocation != "" {
+		if err := installEmptyRevokedKeys(n.RevokedKeysLocation); err != nil {
+			return err
+		}
+	}
+	n.cacheCertificates(n.CaPublicKeyLocation, resp.Capublickey, n.HostCertificate(), resp.Signedhostcert)
 	return nil
 }
 
+// cacheCertificates records the certificates just installed in the config cache, if enabled,
+// so they can be restored if lost. An empty caPath leaves the cached CA public key unchanged.
+func (n *Machine) cacheCertificates(caPath string, ca []byte, certPath string, cert []byte) {
+	if n.ConfigCacheLocation == "" {
+		return
+	}
+	err := polling.NewConfigCache(n.ConfigCacheLocation).Update(func(cached *polling.CachedConfig) {
+		if cached.Enrollment == nil {
+			cached.Enrollment = &polling.CachedEnrollment{}
+		}
+		e := cached.Enrollment
+		e.Received = time.Now()
+		if caPath != "" {
+			e.CAPublicKeyPath, e.CAPublicKey = caPath, ca
+		}
+		e.HostCertificatePath, e.HostCertificate = certPath, cert
+	})
+	if err != nil {
+		n.Log.Warnf("Could not cache the certificates in %s - %s", n.ConfigCacheLocation, err)
+	}
+}
+
+// installEmptyRevokedKeys creates an empty revoked keys file, unless one exists already.
+//
+// sshd refuses all keys if the RevokedKeys file is missing, polling will later replace it with the KRL.
+func installEmptyRevokedKeys(path string) error {
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte{}, 0644)
+}
+
 func anyFileExist(names ...string) error {
 	var errs []error
 	for _, name := range names {
@@ -0,0 +1,258 @@
+package machine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/multierror"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RotateResult describes the outcome of a successful RotateKey.
+type RotateResult struct {
+	// Paths of the files replaced, as referenced by the sshd configuration.
+	HostKey         string
+	HostCertificate string
+
+	// SHA256 fingerprints of the host keys, as printed by ssh-keygen -l.
+	// OldFingerprint is empty if the previous key could not be read.
+	OldFingerprint string
+	NewFingerprint string
+}
+
+// sshdHostFiles returns the HostKey and HostCertificate files configured in the sshd configuration.
+func sshdHostFiles(config []byte) (string, string, error) {
+	var key, cert string
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "hostkey":
+			key = fields[1]
+		case "hostcertificate":
+			cert = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if key == "" || cert == "" {
+		return "", "", fmt.Errorf("the sshd configuration must have both a HostKey and a HostCertificate directive - found '%s' and '%s'", key, cert)
+	}
+	return key, cert, nil
+}
+
+// hostKeyFingerprint returns the fingerprint of the host key in keyFile, or of the key certified in certFile.
+func hostKeyFingerprint(keyFile, certFile string) (string, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		var signer ssh.Signer
+		if signer, err = ssh.ParsePrivateKey(data); err == nil {
+			return ssh.FingerprintSHA256(signer.PublicKey()), nil
+		}
+	}
+	var cerr error
+	if data, cerr = ioutil.ReadFile(certFile); cerr == nil {
+		var pub ssh.PublicKey
+		if pub, _, _, _, cerr = ssh.ParseAuthorizedKey(data); cerr == nil {
+			if cert, ok := pub.(*ssh.Certificate); ok {
+				return ssh.FingerprintSHA256(cert.Key), nil
+			}
+			cerr = fmt.Errorf("%s is not a certificate", certFile)
+		}
+	}
+	return "", multierror.New([]error{err, cerr})
+}
+
+// swap replaces a file with new content, keeping the previous content until committed.
+type swap struct {
+	path   string
+	tmp    string
+	backup string
+	// True once path has been replaced by the new content.
+	swapped bool
+}
+
+// prepareSwap writes the new content for path to a temporary file in the same directory.
+func prepareSwap(path string, content []byte, mode os.FileMode) (*swap, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".rotate-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &swap{path: path, tmp: f.Name(), backup: path + ".rotate-old"}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(s.tmp, mode)
+	}
+	if err != nil {
+		os.Remove(s.tmp)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Swap atomically replaces the file with the new content, keeping a link to the previous one.
+func (s *swap) Swap() error {
+	os.Remove(s.backup)
+	if err := os.Link(s.path, s.backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not preserve %s - %w", s.path, err)
+	}
+	if err := os.Rename(s.tmp, s.path); err != nil {
+		return err
+	}
+	s.swapped = true
+	return nil
+}
+
+// Rollback restores the previous content of the file.
+func (s *swap) Rollback() error {
+	if !s.swapped {
+		return os.Remove(s.tmp)
+	}
+	if _, err := os.Stat(s.backup); os.IsNotExist(err) {
+		return os.Remove(s.path)
+	}
+	return os.Rename(s.backup, s.path)
+}
+
+// Commit drops the previous content of the file.
+func (s *swap) Commit() error {
+	if err := os.Remove(s.backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// reloadSSHD runs the command configured to have sshd load the new host key and certificate.
+func (n *Machine) reloadSSHD() error {
+	argv := strings.Fields(n.SSHDReloadCommand)
+	if len(argv) == 0 {
+		n.Log.Warnf("No command configured to reload sshd - the new host key will be used once sshd is restarted")
+		return nil
+	}
+	output, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reloading sshd with %v failed - %w - output: %s", argv, err, output)
+	}
+	return nil
+}
+
+// RotateKey replaces the host key and certificate of an enrolled node, and reloads sshd.
+//
+// The files replaced are those referenced by the sshd configuration written by Enroll.
+// A new key is generated and signed by the auth server before any file is touched.
+// If any step fails, including the reload of sshd, the previous key and certificate
+// are left in place.
+func (n *Machine) RotateKey() (*RotateResult, error) {
+	if os.Geteuid() != 0 && n.RequireRoot {
+		return nil, errors.New("this command must be run as root since it touches the /etc/ssh directory")
+	}
+	config, err := ioutil.ReadFile(n.SSHDConfigurationLocation)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the sshd configuration, was the node enrolled? - %w", err)
+	}
+	result := &RotateResult{}
+	result.HostKey, result.HostCertificate, err = sshdHostFiles(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sshd configuration %s - %w", n.SSHDConfigurationLocation, err)
+	}
+	result.OldFingerprint, err = hostKeyFingerprint(result.HostKey, result.HostCertificate)
+	if err != nil {
+		n.Log.Warnf("Could not determine the fingerprint of the previous host key - %s", err)
+	}
+
+	pubKey, privKey, err := kcerts.GenerateKey(kcerts.KeyType(n.KeyType), n.KeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate host key: %w", err)
+	}
+	result.NewFingerprint = ssh.FingerprintSHA256(pubKey)
+
+	n.Log.Infof("Requesting a certificate for the new host key %s", result.NewFingerprint)
+	resp, err := n.AuthClient.HostCertificate(context.Background(), &apb.HostCertificateRequest{
+		Hostcert: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ssh.MarshalAuthorizedKey(pubKey)}),
+		Hosts:    n.SSHPrincipals,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not sign the new host key - %w", err)
+	}
+	signed, _, _, _, err := ssh.ParseAuthorizedKey(resp.Signedhostcert)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate returned by the auth server - %w", err)
+	}
+	if cert, ok := signed.(*ssh.Certificate); !ok || !bytes.Equal(cert.Key.Marshal(), pubKey.Marshal()) {
+		return nil, fmt.Errorf("the auth server returned a certificate for a different key")
+	}
+	pemBytes, err := privKey.SSHPemEncode()
+	if err != nil {
+		return nil, err
+	}
+
+	var swaps []*swap
+	rollback := func(err error) (*RotateResult, error) {
+		errs := []error{err}
+		for ix := len(swaps) - 1; ix >= 0; ix-- {
+			if rerr := swaps[ix].Rollback(); rerr != nil {
+				errs = append(errs, fmt.Errorf("could not restore %s - %w", swaps[ix].path, rerr))
+			}
+		}
+		if len(errs) == 1 {
+			return nil, err
+		}
+		return nil, multierror.New(errs)
+	}
+	for _, file := range []struct {
+		path    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{result.HostKey, pemBytes, 0600},
+		{result.HostCertificate, resp.Signedhostcert, 0644},
+	} {
+		s, err := prepareSwap(file.path, file.content, file.mode)
+		if err != nil {
+			return rollback(fmt.Errorf("could not write the new %s - %w", file.path, err))
+		}
+		swaps = append(swaps, s)
+	}
+	for _, s := range swaps {
+		n.Log.Infof("Replacing %s", s.path)
+		if err := s.Swap(); err != nil {
+			return rollback(fmt.Errorf("could not replace %s - %w", s.path, err))
+		}
+	}
+
+	if err := n.reloadSSHD(); err != nil {
+		result, err := rollback(err)
+		// sshd may have loaded some of the new files, have it load the previous ones again.
+		if rerr := n.reloadSSHD(); rerr != nil {
+			err = multierror.New([]error{err, rerr})
+		}
+		return result, err
+	}
+
+	for _, s := range swaps {
+		if err := s.Commit(); err != nil {
+			n.Log.Warnf("Could not remove the previous %s - %s", s.path, err)
+		}
+	}
+	n.cacheCertificates("", nil, result.HostCertificate, resp.Signedhostcert)
+	return result, nil
+}
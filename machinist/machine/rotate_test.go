@@ -0,0 +1,214 @@
+package machine_test
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	apb "github.com/System233/enkit/auth/proto"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/machinist/config"
+	"github.com/System233/enkit/machinist/machine"
+	"github.com/System233/enkit/machinist/polling"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+)
+
+// fakeAuth signs host certificates with its CA, like the auth server would.
+type fakeAuth struct {
+	apb.AuthClient
+
+	ca  kcerts.PrivateKey
+	err error
+}
+
+func (f *fakeAuth) HostCertificate(ctx context.Context, in *apb.HostCertificateRequest, opts ...grpc.CallOption) (*apb.HostCertificateResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	block, _ := pem.Decode(in.Hostcert)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := kcerts.SignPublicKey(f.ca, ssh.HostCert, in.Hosts, time.Hour, pub)
+	if err != nil {
+		return nil, err
+	}
+	return &apb.HostCertificateResponse{Signedhostcert: ssh.MarshalAuthorizedKey(cert)}, nil
+}
+
+// rotateSetup creates an /etc/ssh like directory with an enrolled host key, returning the
+// Machine to rotate it, and the fingerprint of the enrolled key.
+func rotateSetup(t *testing.T, dir string, reloadExit int) (*machine.Machine, *fakeAuth, string) {
+	_, ca, err := kcerts.GenerateED25519()
+	assert.Nil(t, err)
+	auth := &fakeAuth{ca: ca}
+
+	keyFile := filepath.Join(dir, "machinist_host_key")
+	certFile := filepath.Join(dir, "machinist_host_key-cert.pub")
+	pub, key, err := kcerts.GenerateED25519()
+	assert.Nil(t, err)
+	pemBytes, err := key.SSHPemEncode()
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(keyFile, pemBytes, 0600))
+	cert, err := kcerts.SignPublicKey(ca, ssh.HostCert, []string{"node01"}, time.Hour, pub)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644))
+
+	sshdConfig := filepath.Join(dir, "machinist.conf")
+	content, err := machine.ReadSSHDContent(filepath.Join(dir, "machinist_ca.pub"), keyFile, certFile, "")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(sshdConfig, content, 0644))
+
+	// Records each invocation, as sshd would be reloaded.
+	reload := filepath.Join(dir, "reload.sh")
+	script := fmt.Sprintf("#!/bin/sh\necho reloaded >> %s\nexit %d\n", filepath.Join(dir, "reloads"), reloadExit)
+	assert.Nil(t, ioutil.WriteFile(reload, []byte(script), 0755))
+
+	m := &machine.Machine{
+		AuthClient: auth,
+		Log:        logger.Nil,
+		Node: &config.Node{
+			SSHPrincipals:             []string{"node01"},
+			KeyType:                   string(kcerts.KeyTypeED25519),
+			SSHDConfigurationLocation: sshdConfig,
+			SSHDReloadCommand:         reload,
+		},
+	}
+	return m, auth, ssh.FingerprintSHA256(pub)
+}
+
+// snapshot returns the content of all the files in dir.
+func snapshot(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	result := map[string]string{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		assert.Nil(t, err)
+		result[file.Name()] = string(data)
+	}
+	return result
+}
+
+func names(files map[string]string) []string {
+	var result []string
+	for name := range files {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestRotateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, _, old := rotateSetup(t, dir, 0)
+	before := snapshot(t, dir)
+
+	result, err := m.RotateKey()
+	assert.Nil(t, err)
+	assert.Equal(t, old, result.OldFingerprint)
+	assert.NotEqual(t, old, result.NewFingerprint)
+	assert.Equal(t, filepath.Join(dir, "machinist_host_key"), result.HostKey)
+	assert.Equal(t, filepath.Join(dir, "machinist_host_key-cert.pub"), result.HostCertificate)
+
+	// The key and certificate were replaced, and match each other. No other file was left around.
+	after := snapshot(t, dir)
+	assert.Equal(t, append(names(before), "reloads"), names(after))
+	assert.NotEqual(t, before["machinist_host_key"], after["machinist_host_key"])
+	signer, err := ssh.ParsePrivateKey([]byte(after["machinist_host_key"]))
+	assert.Nil(t, err)
+	assert.Equal(t, result.NewFingerprint, ssh.FingerprintSHA256(signer.PublicKey()))
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(after["machinist_host_key-cert.pub"]))
+	assert.Nil(t, err)
+	assert.Equal(t, result.NewFingerprint, ssh.FingerprintSHA256(pub.(*ssh.Certificate).Key))
+	info, err := os.Stat(result.HostKey)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	assert.Equal(t, "reloaded\n", after["reloads"])
+	assert.Equal(t, before["machinist.conf"], after["machinist.conf"])
+}
+
+func TestRotateKeyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, _, _ := rotateSetup(t, dir, 0)
+	m.ConfigCacheLocation = filepath.Join(dir, "cache", "config.json")
+	result, err := m.RotateKey()
+	assert.Nil(t, err)
+
+	// The new certificate is cached, to be restored if lost.
+	cached, err := polling.NewConfigCache(m.ConfigCacheLocation).Load()
+	assert.Nil(t, err)
+	cert, err := ioutil.ReadFile(result.HostCertificate)
+	assert.Nil(t, err)
+	assert.Equal(t, result.HostCertificate, cached.Enrollment.HostCertificatePath)
+	assert.Equal(t, cert, cached.Enrollment.HostCertificate)
+}
+
+func TestRotateKeySigningFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, auth, _ := rotateSetup(t, dir, 0)
+	auth.err = fmt.Errorf("node is drained")
+	before := snapshot(t, dir)
+
+	result, err := m.RotateKey()
+	assert.Nil(t, result)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "node is drained"), "%s", err)
+
+	// Nothing was touched, sshd was not reloaded.
+	assert.Equal(t, before, snapshot(t, dir))
+}
+
+func TestRotateKeyReloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, _, _ := rotateSetup(t, dir, 1)
+	before := snapshot(t, dir)
+
+	result, err := m.RotateKey()
+	assert.Nil(t, result)
+	assert.NotNil(t, err)
+
+	// The previous key and certificate were restored, and sshd reloaded again to use them.
+	after := snapshot(t, dir)
+	assert.Equal(t, "reloaded\nreloaded\n", after["reloads"])
+	delete(after, "reloads")
+	assert.Equal(t, before, after)
+}
+
+func TestRotateKeyNotEnrolled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, _, _ := rotateSetup(t, dir, 0)
+	assert.Nil(t, ioutil.WriteFile(m.SSHDConfigurationLocation, []byte("TrustedUserCAKeys /etc/ssh/ca.pub\n"), 0644))
+	before := snapshot(t, dir)
+
+	_, err = m.RotateKey()
+	assert.NotNil(t, err)
+	assert.Equal(t, before, snapshot(t, dir))
+}
@@ -18,7 +18,7 @@ func InstallLibPam(l logger.Logger) error {
 	return err
 }
 
-func ReadSSHDContent(cafile, hostKey, hostCertificateFile string) ([]byte, error) {
+func ReadSSHDContent(cafile, hostKey, hostCertificateFile, revokedKeysFile string) ([]byte, error) {
 	tpl, err := template.New("ssh_server").Parse(assets.SSHDTemplate)
 	if err != nil {
 		return nil, err
@@ -27,11 +27,13 @@ func ReadSSHDContent(cafile, hostKey, hostCertificateFile string) ([]byte, error
 		HostKeyFile         string
 		TrustedCAFile       string
 		HostCertificateFile string
+		RevokedKeysFile     string
 	}
 	l := localConfig{
 		TrustedCAFile:       cafile,
 		HostKeyFile:         hostKey,
 		HostCertificateFile: hostCertificateFile,
+		RevokedKeysFile:     revokedKeysFile,
 	}
 	var r []byte
 	reader := bytes.NewBuffer(r)
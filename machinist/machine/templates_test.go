@@ -10,8 +10,12 @@ import (
 )
 // Todo(adam): validate tempalte with nss somehow calling the parse lib
 func TestMachinistNodeTemplate(t *testing.T) {
-	_, err := machine.ReadSSHDContent("/bar", "/foo", "/baz")
+	out, err := machine.ReadSSHDContent("/bar", "/foo", "/baz", "")
 	assert.Nil(t, err)
+	assert.NotContains(t, string(out), "RevokedKeys")
+	out, err = machine.ReadSSHDContent("/bar", "/foo", "/baz", "/krl")
+	assert.Nil(t, err)
+	assert.Contains(t, string(out), "RevokedKeys /krl\n")
 	for k := range assets.AutoUserBinaries {
 		fmt.Println(k)
 	}
@@ -33,7 +37,7 @@ func TestMachinistNodeTemplate(t *testing.T) {
 			},
 		},
 	}
-	out, err := machine.ReadNssConf(c)
+	out, err = machine.ReadNssConf(c)
 	assert.Nil(t, err)
 	fmt.Print(string(out))
 }
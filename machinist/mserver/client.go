@@ -0,0 +1,113 @@
+package mserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/lib/render"
+	"github.com/System233/enkit/machinist/config"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/System233/enkit/machinist/state"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+func dialController(conf *config.Common) (mpb.ControllerClient, error) {
+	conn, err := grpc.Dial(net.JoinHostPort(conf.ControlPlaneHost, strconv.Itoa(conf.ControlPlanePort)), grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	return mpb.NewControllerClient(conn), nil
+}
+
+func humanBytes(b uint64) string {
+	return fmt.Sprintf("%.1fG", float64(b)/(1<<30))
+}
+
+// FreeOutput is the output of 'machinist free' with --format=json.
+type FreeOutput struct {
+	Nodes []*mpb.FreeNode `json:"nodes"`
+}
+
+// WriteFree outputs the machines returned by the Free RPC, most idle first, as a table or as FreeOutput.
+func WriteFree(r *render.Renderer, resp *mpb.FreeResponse, now time.Time) error {
+	output := &FreeOutput{Nodes: resp.Node}
+	if output.Nodes == nil {
+		output.Nodes = []*mpb.FreeNode{}
+	}
+	return r.Render(output, func(w io.Writer) error {
+		if len(resp.Node) == 0 {
+			_, err := fmt.Fprintln(w, "No free machines found")
+			return err
+		}
+		table := r.Table("NAME", "SITE", "USERS", "LOAD (1/5/15)", "CPUS", "MEM FREE", "TAGS", "SAMPLED")
+		for _, n := range resp.Node {
+			u := n.Utilization
+			if u == nil {
+				u = &mpb.Utilization{}
+			}
+			age := now.Sub(time.Unix(n.Sampled, 0)).Truncate(time.Second)
+			table.Row(n.Name, state.CanonicalSite(n.Site), u.Users, fmt.Sprintf("%.2f/%.2f/%.2f", u.Load1, u.Load5, u.Load15),
+				u.Cpus, humanBytes(u.MemoryFree)+"/"+humanBytes(u.MemoryTotal), strings.Join(n.Tag, ","), fmt.Sprintf("%s ago", age))
+		}
+		return table.Flush()
+	})
+}
+
+func NewFreeCommand(conf *config.Common) *cobra.Command {
+	req := &mpb.FreeRequest{}
+	c := &cobra.Command{
+		Use:   "free [OPTIONS]",
+		Short: "Suggests idle machines, as reported by the controlplane",
+		Example: `  $ machinist free --tag gpu -n 3
+        Shows the 3 most idle machines tagged gpu.
+
+  $ machinist free --site lab2
+        Shows the idle machines in site lab2.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := dialController(conf)
+			if err != nil {
+				return err
+			}
+			resp, err := client.Free(context.Background(), req)
+			if err != nil {
+				return err
+			}
+			return WriteFree(conf.Root.Render, resp, time.Now())
+		},
+	}
+	c.Flags().StringVar(&req.Tag, "tag", "", "only suggest machines with this tag")
+	c.Flags().Int32VarP(&req.Limit, "limit", "n", 0, "maximum number of machines to suggest, 0 means all")
+	c.Flags().StringVar(&req.Site, "site", "", "only suggest machines in this site, empty means all sites")
+	return c
+}
+
+func NewDrainCommand(conf *config.Common) *cobra.Command {
+	undrain := false
+	site := ""
+	c := &cobra.Command{
+		Use:   "drain [OPTIONS] [NAME]...",
+		Short: "Stops suggesting the named machines as free, or suggests them again with --undo",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := dialController(conf)
+			if err != nil {
+				return err
+			}
+			for _, name := range args {
+				if _, err := client.Drain(context.Background(), &mpb.DrainRequest{Name: name, Site: site, Drained: !undrain}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	c.Flags().BoolVar(&undrain, "undo", false, "undrain the machines instead")
+	c.Flags().StringVar(&site, "site", "", "site of the machines, empty for the default site")
+	return c
+}
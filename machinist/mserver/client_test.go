@@ -0,0 +1,241 @@
+package mserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/knetwork/kdns"
+	"github.com/System233/enkit/lib/render"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/System233/enkit/machinist/state"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakePollServer struct {
+	mpb.Controller_PollServer
+	sent []*mpb.PollResponse
+}
+
+func (f *fakePollServer) Send(resp *mpb.PollResponse) error {
+	f.sent = append(f.sent, resp)
+	return nil
+}
+
+func TestFree(t *testing.T) {
+	en, err := NewController(WithSampleMaxAge(time.Minute))
+	assert.Nil(t, err)
+
+	for _, name := range []string{"gpu01", "gpu02", "gpu03", "cpu01"} {
+		tag := name[:3]
+		assert.Nil(t, state.AddMachine(en.State, &state.Machine{Name: name, Tags: []string{tag}, Ips: []net.IP{net.ParseIP("10.0.0.1")}}))
+	}
+
+	stream := &fakePollServer{}
+	for _, ping := range []*mpb.ClientPing{
+		{Name: "gpu01", Utilization: &mpb.Utilization{Users: 3, Load1: 1, Load5: 1, Load15: 1, Cpus: 4, MemoryFree: 1 << 30, MemoryTotal: 4 << 30}},
+		{Name: "gpu02", Utilization: &mpb.Utilization{Users: 0, Load1: 0.5, Load5: 0.25, Load15: 0.1, Cpus: 4, MemoryFree: 3 << 30, MemoryTotal: 4 << 30}},
+		{Name: "cpu01", Utilization: &mpb.Utilization{Cpus: 4}},
+		{Name: "unknown", Utilization: &mpb.Utilization{}},
+		// gpu03 never reports a sample, so it is not healthy.
+		{Name: "gpu03"},
+	} {
+		assert.Nil(t, en.HandlePing(stream, ping))
+	}
+	assert.Equal(t, 5, len(stream.sent))
+
+	resp, err := en.Free(context.Background(), &mpb.FreeRequest{Tag: "gpu"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Node))
+	assert.Equal(t, "gpu02", resp.Node[0].Name)
+	assert.Equal(t, "gpu01", resp.Node[1].Name)
+	assert.Equal(t, []string{"10.0.0.1"}, resp.Node[0].Ips)
+
+	limited, err := en.Free(context.Background(), &mpb.FreeRequest{Tag: "gpu", Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(limited.Node))
+
+	// Stale samples disqualify a node.
+	state.GetMachine(en.State, "", "gpu02").Utilization.Sampled = time.Now().Add(-2 * time.Minute)
+	stale, err := en.Free(context.Background(), &mpb.FreeRequest{Tag: "gpu"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(stale.Node))
+	assert.Equal(t, "gpu01", stale.Node[0].Name)
+
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "gpu01", Drained: true})
+	assert.Nil(t, err)
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "unknown", Drained: true})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	drained, err := en.Free(context.Background(), &mpb.FreeRequest{Tag: "gpu"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(drained.Node))
+
+	// Sampled times are reported in seconds, make the output deterministic.
+	now := time.Unix(resp.Node[0].Sampled, 0).Add(5 * time.Second)
+	resp.Node[1].Sampled = resp.Node[0].Sampled - 10
+
+	var out bytes.Buffer
+	r, err := render.New(render.WithWriters(&out, nil))
+	assert.Nil(t, err)
+	assert.Nil(t, WriteFree(r, resp, now))
+	assert.Equal(t, ""+
+		"NAME   SITE     USERS  LOAD (1/5/15)   CPUS  MEM FREE   TAGS  SAMPLED\n"+
+		"gpu02  default  0      0.50/0.25/0.10  4     3.0G/4.0G  gpu   5s ago\n"+
+		"gpu01  default  3      1.00/1.00/1.00  4     1.0G/4.0G  gpu   15s ago\n", out.String())
+
+	out.Reset()
+	assert.Nil(t, WriteFree(r, drained, now))
+	assert.Equal(t, "No free machines found\n", out.String())
+
+	out.Reset()
+	r.Format = render.FormatJSON
+	assert.Nil(t, WriteFree(r, drained, now))
+	assert.Equal(t, "{\n  \"nodes\": []\n}\n", out.String())
+}
+
+func TestSites(t *testing.T) {
+	en, err := NewController(WithSampleMaxAge(time.Minute))
+	assert.Nil(t, err)
+
+	for _, m := range []*state.Machine{
+		{Name: "node01", Ips: []net.IP{net.ParseIP("10.0.0.1")}},
+		{Name: "node01", Site: "lab2", Ips: []net.IP{net.ParseIP("10.1.0.1")}},
+		{Name: "node02", Site: "lab2", Ips: []net.IP{net.ParseIP("10.1.0.2")}},
+	} {
+		assert.Nil(t, state.AddMachine(en.State, m))
+	}
+	stream := &fakePollServer{}
+	for _, ping := range []*mpb.ClientPing{
+		{Name: "node01", Utilization: &mpb.Utilization{Cpus: 4}},
+		{Name: "node01", Site: "lab2", Utilization: &mpb.Utilization{Users: 1, Cpus: 4}},
+		{Name: "node02", Site: "lab2", Utilization: &mpb.Utilization{Cpus: 4}},
+	} {
+		assert.Nil(t, en.HandlePing(stream, ping))
+	}
+
+	resp, err := en.Free(context.Background(), &mpb.FreeRequest{Site: "lab2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Node))
+	assert.Equal(t, "node02", resp.Node[0].Name)
+	assert.Equal(t, "lab2", resp.Node[0].Site)
+	all, err := en.Free(context.Background(), &mpb.FreeRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(all.Node))
+
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "node02", Drained: true})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "node02", Site: "lab2", Drained: true})
+	assert.Nil(t, err)
+	resp, err = en.Free(context.Background(), &mpb.FreeRequest{Site: "lab2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Node))
+
+	targets := func(query string) []map[string]interface{} {
+		w := httptest.NewRecorder()
+		en.MetricsTargets(w, httptest.NewRequest("GET", "/targets"+query, nil))
+		var result []map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+		return result
+	}
+	assert.Equal(t, 3, len(targets("")))
+	lab2 := targets("?site=lab2")
+	assert.Equal(t, 2, len(lab2))
+	assert.Equal(t, "lab2", lab2[0]["labels"].(map[string]interface{})["site"])
+	def := targets("?site=default")
+	assert.Equal(t, 1, len(def))
+	assert.Equal(t, []interface{}{"10.0.0.1"}, def[0]["targets"])
+
+	assert.Equal(t, []string{"node01.default.enkit.", "node01.enkit."}, dnsNames(state.GetMachine(en.State, "", "node01"), "enkit."))
+	assert.Equal(t, []string{"node01.lab2.enkit."}, dnsNames(state.GetMachine(en.State, "lab2", "node01"), "enkit."))
+}
+
+func TestLookup(t *testing.T) {
+	en, err := NewController(WithKDnsFlags(kdns.WithDomains([]string{"enkit.cloud"})))
+	assert.Nil(t, err)
+	for _, m := range []*state.Machine{
+		{Name: "node01", Ips: []net.IP{net.ParseIP("10.0.0.1")}},
+		{Name: "node01", Site: "lab2", Ips: []net.IP{net.ParseIP("10.1.0.1")}},
+		{Name: "node02", Site: "lab2", Ips: []net.IP{net.ParseIP("10.1.0.2")}, Drained: true},
+	} {
+		assert.Nil(t, state.AddMachine(en.State, m))
+	}
+
+	lookup := func(principals ...string) []*mpb.LookupNode {
+		resp, err := en.Lookup(context.Background(), &mpb.LookupRequest{Principal: principals})
+		assert.Nil(t, err)
+		return resp.Node
+	}
+	assert.Equal(t, 0, len(lookup("unknown", "localhost", "10.9.9.9", "")))
+
+	// Node names are unique within a site only.
+	assert.Equal(t, 2, len(lookup("node01")))
+
+	nodes := lookup("node01.enkit.cloud", "node01.lab2.enkit.cloud.", "10.1.0.2")
+	assert.Equal(t, 3, len(nodes))
+	assert.Equal(t, &mpb.LookupNode{Principal: "node01.enkit.cloud", Name: "node01", Site: "default"}, nodes[0])
+	assert.Equal(t, &mpb.LookupNode{Principal: "node01.lab2.enkit.cloud.", Name: "node01", Site: "lab2"}, nodes[1])
+	assert.Equal(t, &mpb.LookupNode{Principal: "10.1.0.2", Name: "node02", Site: "lab2", Drained: true}, nodes[2])
+}
+
+func TestRegisterConfig(t *testing.T) {
+	en, err := NewController(WithKDnsFlags(kdns.WithDomains([]string{"enkit.cloud"})))
+	assert.Nil(t, err)
+	go en.dnsServer.HandleControllers()
+	defer en.dnsServer.Stop()
+
+	stream := &fakePollServer{}
+	assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "node01", Ips: []string{"10.0.0.1"}}))
+	assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "node02", Site: "lab2", Ips: []string{"10.1.0.2"}}))
+	assert.Equal(t, 2, len(stream.sent))
+
+	assert.Equal(t, &mpb.NodeConfig{
+		Site:      "default",
+		Principal: []string{"node01", "node01.default.enkit.cloud", "node01.enkit.cloud", "10.0.0.1"},
+	}, stream.sent[0].GetResult().GetConfig())
+	assert.Equal(t, &mpb.NodeConfig{
+		Site:      "lab2",
+		Principal: []string{"node02", "node02.lab2.enkit.cloud", "10.1.0.2"},
+	}, stream.sent[1].GetResult().GetConfig())
+
+	// Every principal sent to the node is accepted by Lookup.
+	for _, principal := range stream.sent[1].GetResult().GetConfig().Principal {
+		resp, err := en.Lookup(context.Background(), &mpb.LookupRequest{Principal: []string{principal}})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(resp.Node), principal)
+	}
+}
+
+func TestSiteTagsAndQuotas(t *testing.T) {
+	en, err := NewController(
+		WithKDnsFlags(kdns.WithDomains([]string{"enkit.cloud"})),
+		WithSiteTags("lab2", "lab2", "gpu"),
+		WithSiteQuota("lab2", 2),
+		WithSiteQuota("", 1),
+	)
+	assert.Nil(t, err)
+
+	assert.Nil(t, en.register("lab2", "node01", []string{"10.1.0.1"}, []string{"gpu", "big"}))
+	assert.Nil(t, en.register("lab2", "node02", []string{"10.1.0.2"}, nil))
+	assert.Equal(t, []string{"gpu", "big", "lab2"}, state.GetMachine(en.State, "lab2", "node01").Tags)
+	assert.Equal(t, []string{"lab2", "gpu"}, state.GetMachine(en.State, "lab2", "node02").Tags)
+
+	// The site is full: new nodes are rejected, registered nodes can register again.
+	err = en.register("lab2", "node03", []string{"10.1.0.3"}, nil)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Nil(t, state.GetMachine(en.State, "lab2", "node03"))
+	assert.Nil(t, en.register("lab2", "node02", []string{"10.1.0.4"}, []string{"cpu"}))
+	assert.Equal(t, []string{"cpu", "lab2", "gpu"}, state.GetMachine(en.State, "lab2", "node02").Tags)
+
+	// Quotas and tags of a site do not apply to other sites, the empty site is the default site.
+	assert.Nil(t, en.register("lab3", "node03", []string{"10.2.0.3"}, nil))
+	assert.Nil(t, state.GetMachine(en.State, "lab3", "node03").Tags)
+	assert.Nil(t, en.register("", "node01", []string{"10.0.0.1"}, nil))
+	err = en.register(state.DefaultSite, "node02", []string{"10.0.0.2"}, nil)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
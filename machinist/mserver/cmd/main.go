@@ -10,7 +10,7 @@ func main() {
 	base := client.DefaultBaseFlags("astore", "enkit")
 
 	root := mserver.NewCommand(base)
-	set, populator, runner := kcobra.Runner(root, nil, base.IdentityErrorHandler("astore login"))
+	set, populator, runner := kcobra.Runner(root, nil, base.IdentityErrorHandler("astore login"), base.DebugDumpErrorHandler(), base.RPCTraceErrorHandler(), base.RenderErrorHandler())
 
 	base.Run(set, populator, runner)
 }
@@ -1,12 +1,22 @@
 package mserver
 
 import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"github.com/System233/enkit/bes_publisher/buildevent"
 	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/kflags/kcobra"
 	"github.com/System233/enkit/lib/knetwork/kdns"
+	"github.com/System233/enkit/lib/server"
 	"github.com/System233/enkit/machinist/config"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type controlPlaneFlags struct {
@@ -15,12 +25,29 @@ type controlPlaneFlags struct {
 	Domains   []string
 	BindNet   string
 	StateFile string
-	bf        *client.BaseFlags
+	MaxAge    time.Duration
+
+	SiteTags   []string
+	SiteQuotas map[string]int
+
+	EventsProject string
+	EventsTopic   string
+	EventsTimeout time.Duration
+
+	RecordEvents  string
+	RecordMaxSize int64
+
+	Debug *server.DebugFlags
+	TLS   *server.TLSFlags
+
+	bf *client.BaseFlags
 }
 
 func NewCommand(bf *client.BaseFlags) *cobra.Command {
 	cpf := &controlPlaneFlags{
-		bf: bf,
+		Debug: server.DefaultDebugFlags(),
+		TLS:   server.DefaultTLSFlags(),
+		bf:    bf,
 	}
 	c := &cobra.Command{
 		Use: "controlplane",
@@ -34,19 +61,51 @@ func NewCommand(bf *client.BaseFlags) *cobra.Command {
 				return err
 			}
 
-			mController, err := NewController(
+			var publisher *EventPublisher
+			if cpf.EventsTopic != "" {
+				pubsubClient, err := pubsub.NewClient(context.Background(), cpf.EventsProject)
+				if err != nil {
+					return err
+				}
+				defer pubsubClient.Close()
+
+				topic := pubsubClient.Topic(cpf.EventsTopic)
+				topic.EnableMessageOrdering = true
+				defer topic.Stop()
+				publisher = NewEventPublisher(buildevent.NewTopic(topic), bf.Log, cpf.EventsTimeout)
+			}
+
+			var recorder *EventRecorder
+			if cpf.RecordEvents != "" {
+				recorder, err = NewEventRecorder(bf.Log, cpf.RecordEvents, cpf.RecordMaxSize)
+				if err != nil {
+					return err
+				}
+				defer recorder.Close()
+			}
+
+			siteMods, err := cpf.siteModifiers()
+			if err != nil {
+				return err
+			}
+			mController, err := NewController(append([]ControllerModifier{
 				WithStateFile(cpf.StateFile),
+				WithSampleMaxAge(cpf.MaxAge),
+				WithEventPublisher(publisher),
+				WithEventRecorder(recorder),
 				WithKDnsFlags(
 					kdns.WithTCPListener(dnsListener),
 					kdns.WithPort(cpf.DnsPort),
 					kdns.WithDomains(cpf.Domains),
 				),
-			)
+			}, siteMods...)...)
 			if err != nil {
 				return err
 			}
 			s, err := New(
 				WithController(mController),
+				WithDebug(cpf.Debug),
+				WithTLS(cpf.TLS),
 				WithMachinistFlags(
 					config.WithInsecure(),
 					config.WithListener(machinistListener),
@@ -65,5 +124,114 @@ func NewCommand(bf *client.BaseFlags) *cobra.Command {
 	c.PersistentFlags().StringSliceVar(&cpf.Domains, "domains", []string{}, "domains that the master ControlPlane will be serving")
 	c.PersistentFlags().StringVar(&cpf.BindNet, "bind-net", "127.0.0.1", "the address to bind the grpc listener to")
 	c.PersistentFlags().StringVar(&cpf.StateFile, "state", "", "file to write and load state to")
+	c.PersistentFlags().DurationVar(&cpf.MaxAge, "free-max-sample-age", time.Minute, "nodes that have not reported utilization for longer than this are not suggested as free")
+	c.PersistentFlags().StringArrayVar(&cpf.SiteTags, "site-tag", []string{}, "tag to add to every node registered in a site, as site=tag - can be repeated")
+	c.PersistentFlags().StringToIntVar(&cpf.SiteQuotas, "site-quota", map[string]int{}, "maximum number of nodes that can be registered in a site, as site=max - nodes already registered can always register again")
+	c.PersistentFlags().StringVar(&cpf.EventsProject, "events-project", "", "GCP project of the Pub/Sub topic node events are published to")
+	c.PersistentFlags().StringVar(&cpf.EventsTopic, "events-topic", "", "Pub/Sub topic to publish node registration, drain and stale events to, as JSON - no events are published if empty")
+	c.PersistentFlags().DurationVar(&cpf.EventsTimeout, "events-timeout", 30*time.Second, "how long to wait for each node event to be published before dropping it")
+	c.Flags().StringVar(&cpf.RecordEvents, "record-events", "", "file to append node registration, keepalive and drain events to, for the replay subcommand - no events are recorded if empty")
+	c.Flags().Int64Var(&cpf.RecordMaxSize, "record-max-size", 64*1024*1024, "size in bytes after which the file of recorded events is rotated - at most twice this size is used on disk")
+	cpf.Debug.Register(&kcobra.FlagSet{FlagSet: c.Flags()}, "")
+	cpf.TLS.Register(&kcobra.FlagSet{FlagSet: c.Flags()}, "")
+
+	c.AddCommand(NewReplayCommand(cpf))
+	return c
+}
+
+// siteModifiers returns the modifiers applying the tags and quotas of the sites specified with flags.
+func (cpf *controlPlaneFlags) siteModifiers() ([]ControllerModifier, error) {
+	var mods []ControllerModifier
+	for _, st := range cpf.SiteTags {
+		site, tag, found := strings.Cut(st, "=")
+		if !found || site == "" || tag == "" {
+			return nil, kflags.NewUsageErrorf("invalid --site-tag %q - must be in the form site=tag, like lab2=gpu", st)
+		}
+		mods = append(mods, WithSiteTags(site, tag))
+	}
+	for site, max := range cpf.SiteQuotas {
+		if max < 0 {
+			return nil, kflags.NewUsageErrorf("invalid --site-quota for %s: %d - must be 0 or more, 0 meaning no limit", site, max)
+		}
+		mods = append(mods, WithSiteQuota(site, max))
+	}
+	return mods, nil
+}
+
+type replayFlags struct {
+	Log    string
+	At     string
+	Expect string
+}
+
+// NewReplayCommand returns a command replaying a log recorded with --record-events on an offline
+// controller, and printing its nodes and DNS records at the specified time.
+func NewReplayCommand(cpf *controlPlaneFlags) *cobra.Command {
+	rf := &replayFlags{}
+	c := &cobra.Command{
+		Use:   "replay",
+		Short: "Replays the events recorded by a controller, and shows its nodes and DNS records at a point in time",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rf.Log == "" {
+				return kflags.NewUsageErrorf("the log of events to replay must be specified with --log")
+			}
+			events, err := ReadEventLog(rf.Log)
+			if err != nil {
+				return err
+			}
+
+			siteMods, err := cpf.siteModifiers()
+			if err != nil {
+				return err
+			}
+			mods := append([]ControllerModifier{WithSampleMaxAge(cpf.MaxAge), WithKDnsFlags(kdns.WithDomains(cpf.Domains), kdns.WithLogger(cpf.bf.Log))}, siteMods...)
+			if cpf.StateFile != "" {
+				mods = append(mods, WithStateFile(cpf.StateFile))
+			}
+			replay, err := NewReplay(events, mods...)
+			if err != nil {
+				return err
+			}
+			defer replay.Close()
+
+			at := replay.End()
+			if rf.At != "" {
+				at, err = time.Parse(time.RFC3339Nano, rf.At)
+				if err != nil {
+					return kflags.NewUsageErrorf("invalid --at %q - must be an RFC3339 time, like 2026-10-15T10:00:00Z: %w", rf.At, err)
+				}
+			}
+			if err := replay.ReplayTo(at); err != nil {
+				cpf.bf.Log.Warnf("Replayed events diverged from the recording: %s", err)
+			}
+
+			snapshot := replay.Controller.Snapshot()
+			if rf.Expect == "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "# at %s\n", at.UTC().Format(time.RFC3339Nano))
+				fmt.Fprintln(cmd.OutOrStdout(), strings.Join(snapshot, "\n"))
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(rf.Expect)
+			if err != nil {
+				return err
+			}
+			var expected []string
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					expected = append(expected, line)
+				}
+			}
+			if diff := DiffSnapshots(expected, snapshot); len(diff) > 0 {
+				return fmt.Errorf("state at %s does not match %s:\n%s", at.UTC().Format(time.RFC3339Nano), rf.Expect, strings.Join(diff, "\n"))
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "state at %s matches %s\n", at.UTC().Format(time.RFC3339Nano), rf.Expect)
+			return nil
+		},
+	}
+
+	c.Flags().StringVar(&rf.Log, "log", "", "file of events recorded with --record-events - the rotated file is replayed first, if present")
+	c.Flags().StringVar(&rf.At, "at", "", "RFC3339 time to replay the events up to - defaults to the time of the last event")
+	c.Flags().StringVar(&rf.Expect, "expect", "", "file with the expected nodes and DNS records, as printed by this command - the differences are printed, and the command fails, if they do not match")
 	return c
 }
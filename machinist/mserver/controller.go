@@ -1,13 +1,16 @@
 package mserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
-	
+
 	"github.com/System233/enkit/lib/knetwork/kdns"
 	"github.com/System233/enkit/lib/logger"
 	mpb "github.com/System233/enkit/machinist/rpc"
@@ -29,14 +32,34 @@ type Controller struct {
 	stateFile     string
 	stateWriteTTL time.Duration
 
+	// Nodes without a utilization sample more recent than this are not suggested by Free.
+	sampleMaxAge time.Duration
+
 	dnsServer *kdns.DnsServer
 	domains   []string
+
+	// Tags added to the nodes registered in a site, by canonical site name.
+	siteTags map[string][]string
+	// Maximum number of nodes that can be registered in a site, by canonical site name.
+	siteQuotas map[string]int
+
+	// Publishes node state transitions, nil if not configured.
+	events *EventPublisher
+	// Records the requests changing the state of the controller, nil if not configured.
+	recorder *EventRecorder
+	// Returns the current time, replaced with a virtual clock when replaying events.
+	now func() time.Time
+	// How often to check for nodes that stopped reporting utilization samples.
+	staleCheckInterval time.Duration
+	// Nodes that are currently stale, by ordering key.
+	staleLock sync.Mutex
+	stale     map[string]bool
 }
 
 // Init is designed to run after all components have been started up before running itself as a server
 func (en *Controller) Init() {
 	for _, m := range en.State.Machines {
-		en.addNodeToDns(m.Name, m.Ips, m.Tags)
+		en.addNodeToDns(m)
 	}
 }
 
@@ -57,6 +80,17 @@ func (en *Controller) Upload(mpb.Controller_UploadServer) error {
 }
 
 func (en *Controller) HandlePing(stream mpb.Controller_PollServer, ping *mpb.ClientPing) error {
+	if u := ping.Utilization; u != nil && ping.Name != "" {
+		en.keepalive(ping.Site, ping.Name, &state.Utilization{
+			Users:       u.Users,
+			Load1:       u.Load1,
+			Load5:       u.Load5,
+			Load15:      u.Load15,
+			MemoryFree:  u.MemoryFree,
+			MemoryTotal: u.MemoryTotal,
+			Cpus:        u.Cpus,
+		})
+	}
 	return stream.Send(
 		&mpb.PollResponse{
 			Resp: &mpb.PollResponse_Pong{
@@ -67,9 +101,62 @@ func (en *Controller) HandlePing(stream mpb.Controller_PollServer, ping *mpb.Cli
 		})
 }
 
+// keepalive stores a utilization sample of a node, taken now. Returns false if the node is not registered.
+func (en *Controller) keepalive(site, name string, sample *state.Utilization) bool {
+	sample.Sampled = en.now()
+	if !state.SetUtilization(en.State, site, name, sample) {
+		en.Log.Warnf("Received utilization for unregistered node %s in site %s", name, state.CanonicalSite(site))
+		return false
+	}
+	en.recorder.Record(&RecordedEvent{Time: sample.Sampled, Type: RecordKeepalive, Site: state.CanonicalSite(site), Node: name, Utilization: sample})
+	return true
+}
+
 func (en *Controller) HandleRegister(stream mpb.Controller_PollServer, ping *mpb.ClientRegister) error {
+	if err := en.register(ping.Site, ping.Name, ping.Ips, ping.Tag); err != nil {
+		return err
+	}
+	result := &mpb.ActionResult{}
+	if m := state.GetMachine(en.State, state.CanonicalSite(ping.Site), ping.Name); m != nil {
+		result.Config = en.nodeConfig(m)
+	}
+	return stream.Send(
+		&mpb.PollResponse{
+			Resp: &mpb.PollResponse_Result{
+				Result: result,
+			},
+		})
+
+}
+
+// nodeConfig returns the configuration of a registered node, sent back to the node.
+//
+// The principals are those accepted by matchesPrincipal.
+func (en *Controller) nodeConfig(m *state.Machine) *mpb.NodeConfig {
+	nc := &mpb.NodeConfig{
+		Site:      state.CanonicalSite(m.Site),
+		Principal: []string{m.Name},
+	}
+	if en.dnsServer != nil {
+		for _, d := range en.dnsServer.Domains {
+			for _, dnsName := range dnsNames(m, d) {
+				nc.Principal = append(nc.Principal, strings.TrimSuffix(dnsName, "."))
+			}
+		}
+	}
+	for _, ip := range m.Ips {
+		nc.Principal = append(nc.Principal, ip.String())
+	}
+	return nc
+}
+
+// register adds or replaces a node, and its DNS records.
+//
+// The tags of the site are added to those of the node. New nodes are rejected
+// once the site has reached its quota, nodes already registered are not.
+func (en *Controller) register(site, name string, ips, tags []string) error {
 	var parsedIps []net.IP
-	for _, p := range ping.Ips {
+	for _, p := range ips {
 		i := net.ParseIP(p)
 		if i != nil {
 			parsedIps = append(parsedIps, i)
@@ -78,22 +165,171 @@ func (en *Controller) HandleRegister(stream mpb.Controller_PollServer, ping *mpb
 	if len(parsedIps) == 0 {
 		return errors.New("no valid ip sent")
 	}
+	site = state.CanonicalSite(site)
 	newMachine := &state.Machine{
-		Name: ping.Name,
+		Name: name,
 		Ips:  parsedIps,
-		Tags: ping.Tag,
+		Tags: withTags(tags, en.siteTags[site]),
+		Site: site,
 	}
-	if err := state.AddMachine(en.State, newMachine); err != nil {
+	previous := state.GetMachine(en.State, newMachine.Site, newMachine.Name)
+	if err := state.AddMachineInQuota(en.State, newMachine, en.siteQuotas[site]); err != nil {
+		if errors.Is(err, state.ErrSiteFull) {
+			return status.Errorf(codes.ResourceExhausted, "cannot register node %s: %s", name, err)
+		}
 		return status.Errorf(codes.AlreadyExists, err.Error())
 	}
-	en.addNodeToDns(ping.Name, newMachine.Ips, newMachine.Tags)
-	return stream.Send(
-		&mpb.PollResponse{
-			Resp: &mpb.PollResponse_Result{
-				Result: &mpb.ActionResult{},
+	if previous != nil && !sameIps(previous.Ips, newMachine.Ips) {
+		en.Log.Infof("Node %s in site %s changed addresses: %v -> %v", newMachine.Name, newMachine.Site, previous.Ips, newMachine.Ips)
+	}
+	en.recorder.Record(&RecordedEvent{Time: en.now(), Type: RecordRegister, Site: newMachine.Site, Node: name, Ips: ips, Tags: tags})
+	en.addNodeToDns(newMachine)
+	en.publishEvent(EventRegistered, newMachine.Site, newMachine.Name)
+	return nil
+}
+
+// withTags returns the tags, followed by the extra tags not already in tags.
+func withTags(tags, extra []string) []string {
+	if len(extra) == 0 {
+		return tags
+	}
+	result := append([]string{}, tags...)
+	for _, e := range extra {
+		found := false
+		for _, t := range result {
+			if t == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// sameIps returns true if both lists have the same ips, in the same order.
+func sameIps(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ix := range a {
+		if !a[ix].Equal(b[ix]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Free returns the machines with the requested tag and site sorted by idleness, excluding drained
+// machines and those without a recent utilization sample.
+func (en *Controller) Free(ctx context.Context, req *mpb.FreeRequest) (*mpb.FreeResponse, error) {
+	free := state.FreeMachines(en.State, req.Site, req.Tag, en.now(), en.sampleMaxAge)
+	if req.Limit > 0 && len(free) > int(req.Limit) {
+		free = free[:req.Limit]
+	}
+
+	resp := &mpb.FreeResponse{}
+	for _, m := range free {
+		var ips []string
+		for _, ip := range m.Ips {
+			ips = append(ips, ip.String())
+		}
+		u := m.Utilization
+		resp.Node = append(resp.Node, &mpb.FreeNode{
+			Name: m.Name,
+			Tag:  m.Tags,
+			Ips:  ips,
+			Utilization: &mpb.Utilization{
+				Users:       u.Users,
+				Load1:       u.Load1,
+				Load5:       u.Load5,
+				Load15:      u.Load15,
+				MemoryFree:  u.MemoryFree,
+				MemoryTotal: u.MemoryTotal,
+				Cpus:        u.Cpus,
 			},
+			Sampled: u.Sampled.Unix(),
+			Site:    state.CanonicalSite(m.Site),
 		})
+	}
+	return resp, nil
+}
 
+func (en *Controller) Drain(ctx context.Context, req *mpb.DrainRequest) (*mpb.DrainResponse, error) {
+	if err := en.drain(req.Site, req.Name, req.Drained); err != nil {
+		return nil, err
+	}
+	return &mpb.DrainResponse{}, nil
+}
+
+// drain drains or undrains a node.
+func (en *Controller) drain(site, name string, drained bool) error {
+	site = state.CanonicalSite(site)
+	if !state.SetDrained(en.State, site, name, drained) {
+		return status.Errorf(codes.NotFound, "no node named %s in site %s", name, site)
+	}
+	en.recorder.Record(&RecordedEvent{Time: en.now(), Type: RecordDrain, Site: site, Node: name, Drained: drained})
+	en.Log.Infof("Node %s in site %s drained: %v", name, site, drained)
+	if drained {
+		en.publishEvent(EventDrained, site, name)
+	} else {
+		en.publishEvent(EventUndrained, site, name)
+	}
+	return nil
+}
+
+// Lookup returns the registered machines matching the principals requested, by name, DNS name, or IP.
+func (en *Controller) Lookup(ctx context.Context, req *mpb.LookupRequest) (*mpb.LookupResponse, error) {
+	en.State.RLock()
+	defer en.State.RUnlock()
+
+	resp := &mpb.LookupResponse{}
+	for _, principal := range req.Principal {
+		for _, m := range en.State.Machines {
+			if !en.matchesPrincipal(m, principal) {
+				continue
+			}
+			resp.Node = append(resp.Node, &mpb.LookupNode{
+				Principal: principal,
+				Name:      m.Name,
+				Site:      state.CanonicalSite(m.Site),
+				Drained:   m.Drained,
+			})
+		}
+	}
+	return resp, nil
+}
+
+// matchesPrincipal returns true if the principal is the name, one of the DNS names, or one of the IPs of the node.
+func (en *Controller) matchesPrincipal(m *state.Machine, principal string) bool {
+	if principal == "" {
+		return false
+	}
+	if principal == m.Name {
+		return true
+	}
+	if ip := net.ParseIP(principal); ip != nil {
+		for _, mip := range m.Ips {
+			if mip.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if en.dnsServer == nil {
+		return false
+	}
+	name := dns.CanonicalName(principal)
+	for _, d := range en.dnsServer.Domains {
+		for _, dnsName := range dnsNames(m, d) {
+			if dnsName == name {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (en *Controller) Poll(stream mpb.Controller_PollServer) error {
@@ -115,69 +351,105 @@ func (en *Controller) Poll(stream mpb.Controller_PollServer) error {
 	}
 }
 
-func (en *Controller) addNodeToDns(name string, ips []net.IP, tags []string) {
+// dnsNames returns the names a node is reachable at in a domain.
+//
+// Nodes are always reachable as <node>.<site>.<domain>. Nodes in the default
+// site are also reachable as <node>.<domain>, as they were before sites existed.
+func dnsNames(m *state.Machine, domain string) []string {
+	site := state.CanonicalSite(m.Site)
+	names := []string{dns.CanonicalName(fmt.Sprintf("%s.%s.%s", m.Name, site, domain))}
+	if site == state.DefaultSite {
+		names = append(names, dns.CanonicalName(fmt.Sprintf("%s.%s", m.Name, domain)))
+	}
+	return names
+}
+
+func (en *Controller) addNodeToDns(m *state.Machine) {
 	for _, d := range en.dnsServer.Domains {
-		dnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", name, d))
-		var recordTags []dns.RR
-		for _, t := range tags {
-			entry, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, "TXT", t))
+		for _, dnsName := range dnsNames(m, d) {
+			en.addDnsName(dnsName, m.Ips, m.Tags)
+		}
+	}
+}
+
+func (en *Controller) addDnsName(dnsName string, ips []net.IP, tags []string) {
+	var recordTags []dns.RR
+	for _, t := range tags {
+		entry, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, "TXT", t))
+		if err != nil {
+			continue
+		}
+		recordTags = append(recordTags, entry)
+	}
+	for _, i := range ips {
+		var recordType string
+		if i.To4() != nil {
+			recordType = "A"
+		}
+		if i.To16() != nil && recordType == "" {
+			recordType = "AAAA"
+		}
+		if recordType != "" {
+			entry, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, recordType, i.String()))
 			if err != nil {
 				continue
 			}
-			recordTags = append(recordTags, entry)
+			en.Log.Infof("Adding %s to the dns ControlPlane %s", dnsName, entry)
+			en.dnsServer.SetEntry(dnsName, []dns.RR{entry})
+			en.dnsServer.SetEntry(dnsName, recordTags)
 		}
-		for _, i := range ips {
-			var recordType string
-			if i.To4() != nil {
-				recordType = "A"
-			}
-			if i.To16() != nil && recordType == "" {
-				recordType = "AAAA"
+	}
+}
+
+// setAllAndInfoRecords sets the _all.<suffix> and _info.<suffix> records for the nodes specified.
+func (en *Controller) setAllAndInfoRecords(suffix string, ns []*state.Machine) {
+	dnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", "_all", suffix))
+	infoDnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", "_info", suffix))
+	var allDnsRecords []dns.RR
+	var infoDnsRecords []dns.RR
+	for _, v := range ns {
+		for _, i := range v.Ips {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, "A", i.String()))
+			if err != nil {
+				en.Log.Errorf("err: %v", err)
 			}
-			if recordType != "" {
-				entry, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, recordType, i.String()))
-				if err != nil {
-					continue
-				}
-				en.Log.Infof("Adding %s to the dns ControlPlane %s", dnsName, entry)
-				en.dnsServer.SetEntry(dnsName, []dns.RR{entry})
-				en.dnsServer.SetEntry(dnsName, recordTags)
+			infoRR, err := dns.NewRR(fmt.Sprintf("%s %s { name: %s, ip: %s }", infoDnsName, "TXT", v.Name, i.String()))
+			if err != nil {
+				en.Log.Errorf("err: %v", err)
 			}
+			allDnsRecords = append(allDnsRecords, rr)
+			infoDnsRecords = append(infoDnsRecords, infoRR)
+		}
+	}
+	en.dnsServer.SetEntry(dnsName, allDnsRecords)
+	en.dnsServer.SetEntry(infoDnsName, infoDnsRecords)
+}
+
+// refreshAllAndInfoRecords sets the _all and _info records of each domain, and of each site in each domain.
+func (en *Controller) refreshAllAndInfoRecords() {
+	ns := en.Nodes()
+	bySite := map[string][]*state.Machine{}
+	for _, v := range ns {
+		site := state.CanonicalSite(v.Site)
+		bySite[site] = append(bySite[site], v)
+	}
+	for _, d := range en.dnsServer.Domains {
+		en.setAllAndInfoRecords(d, ns)
+		for site, sns := range bySite {
+			en.setAllAndInfoRecords(fmt.Sprintf("%s.%s", site, d), sns)
 		}
 	}
 }
 
 // ServeAllAndInfoRecords will continuously poll Nodes() and create multiple _all.<domain> records containing the ip addresses
-// of all machines attached.
+// of all machines attached, and _all.<site>.<domain> records containing the ip addresses of the machines in each site.
 // It also serves the current state of the dns server via the _info record.
 // TODO(adam): be able to pass in a wrapped ticker for testing intervals
 func (en *Controller) ServeAllAndInfoRecords(killChannel chan struct{}, killChannelAck chan struct{}) {
 	for {
 		select {
 		case <-time.After(en.allRecordsRefreshRate):
-			ns := en.Nodes()
-			for _, d := range en.dnsServer.Domains {
-				dnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", "_all", d))
-				infoDnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", "_info", d))
-				var allDnsRecords []dns.RR
-				var infoDnsRecords []dns.RR
-				for _, v := range ns {
-					for _, i := range v.Ips {
-						rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, "A", i.String()))
-						if err != nil {
-							en.Log.Errorf("err: %v", err)
-						}
-						infoRR, err := dns.NewRR(fmt.Sprintf("%s %s { name: %s, ip: %s }", infoDnsName, "TXT", v.Name, i.String()))
-						if err != nil {
-							en.Log.Errorf("err: %v", err)
-						}
-						allDnsRecords = append(allDnsRecords, rr)
-						infoDnsRecords = append(infoDnsRecords, infoRR)
-					}
-				}
-				en.dnsServer.SetEntry(dnsName, allDnsRecords)
-				en.dnsServer.SetEntry(infoDnsName, infoDnsRecords)
-			}
+			en.refreshAllAndInfoRecords()
 		case <-killChannel:
 			killChannelAck <- struct{}{}
 			return
@@ -188,32 +460,93 @@ func (en *Controller) ServeAllAndInfoRecords(killChannel chan struct{}, killChan
 // scrapeConfigForHost returns a config object to instruct Prometheus to scrape
 // this host. See:
 // https://prometheus.io/docs/prometheus/latest/configuration/configuration/#http_sd_config.
-// Set a "hostname" label on all metrics from this host.
-func scrapeConfigForHost(hostname string, addrs []string) map[string]interface{} {
+// Set a "hostname" and "site" label on all metrics from this host.
+func scrapeConfigForHost(hostname, site string, addrs []string) map[string]interface{} {
 	return map[string]interface{} {
 		"targets": addrs,
 		"labels": map[string]string{
 			"hostname": hostname,
+			"site":     site,
 		},
 	}
 }
 
 // MetricsTargets is an HTTP handler that satisfies
 // https://prometheus.io/docs/prometheus/latest/configuration/configuration/#http_sd_config.
+//
+// A site query parameter restricts the targets to the hosts in that site.
 func (en *Controller) MetricsTargets(w http.ResponseWriter, r *http.Request) {
 	scrapeConfig := []map[string]interface{}{}
-	for _, node := range en.Nodes() {
+	for _, node := range state.MachinesInSite(en.State, r.URL.Query().Get("site")) {
 		var ips []string
 		for _, ip := range node.Ips {
 			ips = append(ips, ip.String())
 		}
-		scrapeConfig = append(scrapeConfig, scrapeConfigForHost(node.Name, ips))
+		scrapeConfig = append(scrapeConfig, scrapeConfigForHost(node.Name, state.CanonicalSite(node.Site), ips))
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(scrapeConfig)
 }
 
-// WriteState writes state to the specified state file every 2 seconds. Will not exit or error out unless no statefile is
+// publishEvent publishes an event of the specified type with the current state of a node, if a publisher is configured.
+func (en *Controller) publishEvent(kind, site, name string) {
+	if en.events == nil {
+		return
+	}
+	en.State.RLock()
+	defer en.State.RUnlock()
+	for _, m := range en.State.Machines {
+		if m.Name == name && m.InSite(site) {
+			en.events.Publish(NewNodeEvent(kind, m, en.now()))
+			return
+		}
+	}
+}
+
+// CheckStale publishes a stale event for the nodes whose latest utilization sample became older
+// than the maximum sample age, and an active event for the stale nodes that reported a sample again.
+//
+// Nodes that never reported a sample are not considered stale.
+func (en *Controller) CheckStale(now time.Time) {
+	if en.events == nil {
+		return
+	}
+	en.State.RLock()
+	defer en.State.RUnlock()
+	en.staleLock.Lock()
+	defer en.staleLock.Unlock()
+
+	if en.stale == nil {
+		en.stale = map[string]bool{}
+	}
+	for _, m := range en.State.Machines {
+		ev := NewNodeEvent(EventStale, m, now)
+		stale := m.Utilization != nil && now.Sub(m.Utilization.Sampled) > en.sampleMaxAge
+		if stale == en.stale[ev.OrderingKey()] {
+			continue
+		}
+		if stale {
+			en.stale[ev.OrderingKey()] = true
+		} else {
+			delete(en.stale, ev.OrderingKey())
+			ev.Type = EventActive
+		}
+		en.events.Publish(ev)
+	}
+}
+
+// WatchStale invokes CheckStale periodically. Returns immediately if no publisher is configured.
+func (en *Controller) WatchStale() {
+	if en.events == nil {
+		return
+	}
+	for {
+		<-time.After(en.staleCheckInterval)
+		en.CheckStale(en.now())
+	}
+}
+
+// WriteState writes state to the specified state file every 2 seconds, if it changed. Will not exit or error out unless no statefile is
 // provided.
 func (en *Controller) WriteState() {
 	if en.stateFile == "" {
@@ -222,8 +555,13 @@ func (en *Controller) WriteState() {
 	}
 	for {
 		<-time.After(en.stateWriteTTL)
-		if err := state.WriteController(en.State, en.stateFile); err != nil {
+		written, revision, err := state.SaveController(en.State, en.stateFile)
+		if err != nil {
 			en.Log.Errorf("machinist: writing to state failed with err: %v", err)
+			continue
+		}
+		if written {
+			en.Log.Infof("machinist: wrote state revision %d to %s", revision, en.stateFile)
 		}
 	}
 }
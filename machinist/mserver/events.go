@@ -0,0 +1,182 @@
+package mserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/System233/enkit/bes_publisher/buildevent"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/machinist/state"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricNodeEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "machinist_controller",
+		Name:      "node_events",
+		Help:      "Node events published, by type and outcome",
+	},
+		[]string{
+			// Type of the event, one of the Event* constants.
+			"type",
+			// One of "ok", "marshal_failure", "publish_failure".
+			"result",
+		},
+	)
+)
+
+// NodeEventVersion is the version of the NodeEvent schema, increased on incompatible changes.
+const NodeEventVersion = 1
+
+// Types of NodeEvent.
+const (
+	// The node registered, or registered again, with the controller.
+	EventRegistered = "registered"
+	// The node was drained, and is no longer suggested as free.
+	EventDrained = "drained"
+	// The node was undrained.
+	EventUndrained = "undrained"
+	// The node stopped reporting utilization samples for longer than the maximum sample age.
+	EventStale = "stale"
+	// A stale node reported a utilization sample again.
+	EventActive = "active"
+)
+
+// NodeEvent is the message published for each node state transition.
+//
+// Events are serialized as JSON, for example:
+//
+//	{
+//	  "version": 1,
+//	  "type": "drained",
+//	  "time": "2026-10-15T10:00:00Z",
+//	  "site": "default",
+//	  "node": "gpu01",
+//	  "ips": ["10.0.0.1"],
+//	  "tags": ["gpu"],
+//	  "drained": true,
+//	  "sampled": "2026-10-15T09:59:40Z"
+//	}
+//
+// Pub/Sub messages carry the ordering key "<site>/<node>", so that the events
+// of a node are delivered in order, and the attributes "type", "site" and
+// "node", so subscriptions can filter without parsing the payload.
+//
+// The controller does not hand out leases on nodes, so no lease events are
+// published.
+type NodeEvent struct {
+	Version int       `json:"version"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+
+	Site string   `json:"site"`
+	Node string   `json:"node"`
+	Ips  []string `json:"ips"`
+	Tags []string `json:"tags"`
+
+	Drained bool `json:"drained"`
+	// Time of the latest utilization sample, omitted if the node never reported one.
+	Sampled *time.Time `json:"sampled,omitempty"`
+}
+
+// NewNodeEvent returns an event of the specified type for the machine.
+func NewNodeEvent(kind string, m *state.Machine, now time.Time) *NodeEvent {
+	ev := &NodeEvent{
+		Version: NodeEventVersion,
+		Type:    kind,
+		Time:    now.UTC(),
+		Site:    state.CanonicalSite(m.Site),
+		Node:    m.Name,
+		Ips:     []string{},
+		Tags:    append([]string{}, m.Tags...),
+		Drained: m.Drained,
+	}
+	for _, ip := range m.Ips {
+		ev.Ips = append(ev.Ips, ip.String())
+	}
+	if m.Utilization != nil {
+		sampled := m.Utilization.Sampled.UTC()
+		ev.Sampled = &sampled
+	}
+	return ev
+}
+
+// OrderingKey returns the key ordering the events of a node.
+func (ev *NodeEvent) OrderingKey() string {
+	return fmt.Sprintf("%s/%s", ev.Site, ev.Node)
+}
+
+// resumer is implemented by sinks that pause publishing on an ordering key after an error, like *buildevent.Topic.
+type resumer interface {
+	ResumePublish(key string)
+}
+
+// EventPublisher publishes NodeEvents to a buildevent.Sink.
+//
+// Publishing is asynchronous, and never blocks or fails the controller:
+// errors are logged and counted in a metric, and the event is dropped.
+type EventPublisher struct {
+	sink    buildevent.Sink
+	log     logger.Logger
+	timeout time.Duration
+
+	pending sync.WaitGroup
+}
+
+// NewEventPublisher returns an EventPublisher waiting at most timeout for each event to be published.
+func NewEventPublisher(sink buildevent.Sink, log logger.Logger, timeout time.Duration) *EventPublisher {
+	return &EventPublisher{sink: sink, log: log, timeout: timeout}
+}
+
+// Publish sends the event to the sink. A nil EventPublisher discards all events.
+func (p *EventPublisher) Publish(ev *NodeEvent) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		metricNodeEvents.WithLabelValues(ev.Type, "marshal_failure").Inc()
+		p.log.Warnf("Could not marshal %s event for node %s - %s", ev.Type, ev.OrderingKey(), err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	key := ev.OrderingKey()
+	res := p.sink.Publish(ctx, &pubsub.Message{
+		Data:        data,
+		OrderingKey: key,
+		Attributes: map[string]string{
+			"type": ev.Type,
+			"site": ev.Site,
+			"node": ev.Node,
+		},
+	})
+
+	p.pending.Add(1)
+	go func() {
+		defer p.pending.Done()
+		defer cancel()
+		if _, err := res.Get(ctx); err != nil {
+			metricNodeEvents.WithLabelValues(ev.Type, "publish_failure").Inc()
+			p.log.Warnf("Could not publish %s event for node %s - %s", ev.Type, key, err)
+			if r, ok := p.sink.(resumer); ok {
+				r.ResumePublish(key)
+			}
+			return
+		}
+		metricNodeEvents.WithLabelValues(ev.Type, "ok").Inc()
+	}()
+}
+
+// Wait blocks until all the events published so far were acknowledged, or failed.
+func (p *EventPublisher) Wait() {
+	if p == nil {
+		return
+	}
+	p.pending.Wait()
+}
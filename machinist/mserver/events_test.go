@@ -0,0 +1,160 @@
+package mserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/System233/enkit/bes_publisher/buildevent"
+	"github.com/System233/enkit/lib/knetwork/kdns"
+	"github.com/System233/enkit/lib/logger"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/System233/enkit/machinist/state"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResult struct {
+	err error
+}
+
+func (r *fakeResult) Get(context.Context) (string, error) {
+	return "id", r.err
+}
+
+// fakeSink records the messages published, and fails them all if err is set.
+type fakeSink struct {
+	sync.Mutex
+	err      error
+	messages []*pubsub.Message
+	resumed  []string
+}
+
+func (s *fakeSink) Publish(ctx context.Context, msg *pubsub.Message) buildevent.PublishResult {
+	s.Lock()
+	defer s.Unlock()
+	s.messages = append(s.messages, msg)
+	return &fakeResult{err: s.err}
+}
+
+func (s *fakeSink) ResumePublish(key string) {
+	s.Lock()
+	defer s.Unlock()
+	s.resumed = append(s.resumed, key)
+}
+
+// take returns the messages published since the last invocation.
+func (s *fakeSink) take() []*pubsub.Message {
+	s.Lock()
+	defer s.Unlock()
+	messages := s.messages
+	s.messages = nil
+	return messages
+}
+
+func decodeEvent(t *testing.T, msg *pubsub.Message) map[string]interface{} {
+	var ev map[string]interface{}
+	assert.Nil(t, json.Unmarshal(msg.Data, &ev))
+	return ev
+}
+
+func TestNodeEvents(t *testing.T) {
+	sink := &fakeSink{}
+	publisher := NewEventPublisher(sink, logger.Nil, time.Second)
+	en, err := NewController(WithSampleMaxAge(time.Minute), WithEventPublisher(publisher), WithKDnsFlags(kdns.WithDomains([]string{"enkit.cloud"})))
+	assert.Nil(t, err)
+
+	stream := &fakePollServer{}
+	assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "gpu01", Site: "lab", Ips: []string{"10.0.0.1"}, Tag: []string{"gpu"}}))
+	publisher.Wait()
+
+	messages := sink.take()
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "lab/gpu01", messages[0].OrderingKey)
+	assert.Equal(t, map[string]string{"type": "registered", "site": "lab", "node": "gpu01"}, messages[0].Attributes)
+
+	ev := decodeEvent(t, messages[0])
+	assert.Equal(t, float64(NodeEventVersion), ev["version"])
+	assert.Equal(t, "registered", ev["type"])
+	assert.Equal(t, "lab", ev["site"])
+	assert.Equal(t, "gpu01", ev["node"])
+	assert.Equal(t, []interface{}{"10.0.0.1"}, ev["ips"])
+	assert.Equal(t, []interface{}{"gpu"}, ev["tags"])
+	assert.Equal(t, false, ev["drained"])
+	assert.NotContains(t, ev, "sampled")
+	_, err = time.Parse(time.RFC3339Nano, ev["time"].(string))
+	assert.Nil(t, err)
+
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "gpu01", Site: "lab", Drained: true})
+	assert.Nil(t, err)
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "gpu01", Site: "lab", Drained: false})
+	assert.Nil(t, err)
+	publisher.Wait()
+
+	messages = sink.take()
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "drained", decodeEvent(t, messages[0])["type"])
+	assert.Equal(t, true, decodeEvent(t, messages[0])["drained"])
+	assert.Equal(t, "undrained", decodeEvent(t, messages[1])["type"])
+	assert.Equal(t, false, decodeEvent(t, messages[1])["drained"])
+	assert.Equal(t, "lab/gpu01", messages[1].OrderingKey)
+
+	// Nodes without samples are never stale.
+	now := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	en.CheckStale(now)
+	publisher.Wait()
+	assert.Equal(t, 0, len(sink.take()))
+
+	state.SetUtilization(en.State, "lab", "gpu01", &state.Utilization{Sampled: now.Add(-2 * time.Minute)})
+	en.CheckStale(now)
+	// A node is only reported stale once.
+	en.CheckStale(now.Add(time.Second))
+	publisher.Wait()
+
+	messages = sink.take()
+	assert.Equal(t, 1, len(messages))
+	ev = decodeEvent(t, messages[0])
+	assert.Equal(t, "stale", ev["type"])
+	assert.Equal(t, "2026-10-15T09:58:00Z", ev["sampled"])
+	assert.Equal(t, "2026-10-15T10:00:00Z", ev["time"])
+
+	state.SetUtilization(en.State, "lab", "gpu01", &state.Utilization{Sampled: now})
+	en.CheckStale(now.Add(time.Second))
+	publisher.Wait()
+
+	messages = sink.take()
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "active", decodeEvent(t, messages[0])["type"])
+}
+
+func TestNodeEventsFailures(t *testing.T) {
+	sink := &fakeSink{err: errors.New("topic not found")}
+	publisher := NewEventPublisher(sink, logger.Nil, time.Second)
+	en, err := NewController(WithEventPublisher(publisher), WithKDnsFlags(kdns.WithDomains([]string{"enkit.cloud"})))
+	assert.Nil(t, err)
+
+	// Failures to publish are not propagated to the nodes.
+	stream := &fakePollServer{}
+	assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "cpu01", Ips: []string{"10.0.0.2"}}))
+	assert.Equal(t, 1, len(stream.sent))
+	_, err = en.Drain(context.Background(), &mpb.DrainRequest{Name: "cpu01", Drained: true})
+	assert.Nil(t, err)
+	publisher.Wait()
+
+	assert.Equal(t, 2, len(sink.take()))
+	assert.True(t, state.GetMachine(en.State, "", "cpu01").Drained)
+	// Publishing is resumed after each failure, so events of the node are not blocked forever.
+	assert.Equal(t, []string{"default/cpu01", "default/cpu01"}, sink.resumed)
+}
+
+func TestNodeEventsDisabled(t *testing.T) {
+	en, err := NewController(WithKDnsFlags(kdns.WithDomains([]string{"enkit.cloud"})))
+	assert.Nil(t, err)
+
+	stream := &fakePollServer{}
+	assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "cpu01", Ips: []string{"10.0.0.2"}}))
+	en.CheckStale(time.Now())
+}
@@ -13,6 +13,9 @@ func NewController(mods ...ControllerModifier) (*Controller, error) {
 		State:                 &state.MachineController{},
 		stateWriteTTL:         time.Second * 30,
 		allRecordsRefreshRate: time.Second * 5,
+		sampleMaxAge:          time.Minute,
+		staleCheckInterval:    time.Second * 10,
+		now:                   time.Now,
 		Log:                   &logger.DefaultLogger{Printer: log.Printf},
 	}
 	for _, m := range mods {
@@ -72,3 +75,57 @@ func WithAllRecordsRefreshRate(duration string) ControllerModifier {
 		return nil
 	}
 }
+
+func WithSampleMaxAge(duration time.Duration) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.sampleMaxAge = duration
+		return nil
+	}
+}
+
+// WithEventPublisher publishes the node state transitions with the publisher.
+func WithEventPublisher(publisher *EventPublisher) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.events = publisher
+		return nil
+	}
+}
+
+// WithEventRecorder records the requests changing the state of the controller with the recorder.
+func WithEventRecorder(recorder *EventRecorder) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.recorder = recorder
+		return nil
+	}
+}
+
+// WithClock uses now to determine the current time, rather than time.Now.
+func WithClock(now func() time.Time) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.now = now
+		return nil
+	}
+}
+
+// WithSiteTags adds the tags to every node registered in the site.
+func WithSiteTags(site string, tags ...string) ControllerModifier {
+	return func(controller *Controller) error {
+		if controller.siteTags == nil {
+			controller.siteTags = map[string][]string{}
+		}
+		site = state.CanonicalSite(site)
+		controller.siteTags[site] = append(controller.siteTags[site], tags...)
+		return nil
+	}
+}
+
+// WithSiteQuota limits the number of nodes that can be registered in the site. A max <= 0 means no limit.
+func WithSiteQuota(site string, max int) ControllerModifier {
+	return func(controller *Controller) error {
+		if controller.siteQuotas == nil {
+			controller.siteQuotas = map[string]int{}
+		}
+		controller.siteQuotas[state.CanonicalSite(site)] = max
+		return nil
+	}
+}
@@ -1,6 +1,7 @@
 package mserver
 
 import (
+	"github.com/System233/enkit/lib/server"
 	"github.com/System233/enkit/machinist/config"
 )
 
@@ -23,3 +24,19 @@ func WithController(controller *Controller) Modifier {
 		return nil
 	}
 }
+
+// WithDebug mounts the pprof and runtime debug handlers on the HTTP port, if enabled by flags.
+func WithDebug(flags *server.DebugFlags) Modifier {
+	return func(s *ControlPlane) error {
+		s.debug = flags
+		return nil
+	}
+}
+
+// WithTLS serves the HTTP port with TLS, if enabled by flags.
+func WithTLS(flags *server.TLSFlags) Modifier {
+	return func(s *ControlPlane) error {
+		s.tls = flags
+		return nil
+	}
+}
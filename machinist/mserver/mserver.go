@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/System233/enkit/lib/metrics"
 	"github.com/System233/enkit/lib/server"
 	"github.com/System233/enkit/machinist/config"
 	mpb "github.com/System233/enkit/machinist/rpc"
@@ -37,6 +38,8 @@ type ControlPlane struct {
 	allRecordsKillChannel    chan struct{}
 	allRecordsKillAckChannel chan struct{}
 	killChannel              chan error
+	debug                    *server.DebugFlags
+	tls                      *server.TLSFlags
 
 	Controller *Controller
 	*config.Common
@@ -49,7 +52,11 @@ func (s *ControlPlane) MachinistCommon() *config.Common {
 func (s *ControlPlane) Run() error {
 	ctx := context.Background()
 
-	grpcs := grpc.NewServer()
+	grpcOpts, err := metrics.Register(metrics.WithGRPCServer())
+	if err != nil {
+		return err
+	}
+	grpcs := grpc.NewServer(grpcOpts...)
 	mpb.RegisterControllerServer(grpcs, s.Controller)
 	s.runningServer = grpcs
 	go func() {
@@ -58,11 +65,13 @@ func (s *ControlPlane) Run() error {
 	s.Controller.Init()
 	go s.Controller.ServeAllAndInfoRecords(s.allRecordsKillChannel, s.allRecordsKillAckChannel)
 	go s.Controller.WriteState()
+	go s.Controller.WatchStale()
 
 	mux := http.NewServeMux()
+	metrics.AddHandler(mux, "/metrics")
 	mux.HandleFunc("/metrics_targets", s.Controller.MetricsTargets)
 
-	return server.Run(ctx, mux, grpcs, s.Listener)
+	return server.Run(ctx, mux, grpcs, s.Listener, server.WithDebug(s.debug), server.WithTLS(s.tls))
 }
 
 func (s *ControlPlane) Stop() error {
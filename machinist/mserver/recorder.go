@@ -0,0 +1,185 @@
+package mserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/machinist/state"
+)
+
+// Types of RecordedEvent.
+const (
+	// The node registered with the controller.
+	RecordRegister = "register"
+	// The node sent a ping, possibly with a utilization sample.
+	RecordKeepalive = "keepalive"
+	// The node was drained or undrained.
+	RecordDrain = "drain"
+)
+
+// RecordedEvent is a request that changed the state of the controller, as written
+// in the event log, one JSON object per line.
+//
+// Replaying the events in order on an empty controller rebuilds its state and
+// DNS records, see Replay.
+type RecordedEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	Site string `json:"site"`
+	Node string `json:"node"`
+
+	// Set for RecordRegister events.
+	Ips  []string `json:"ips,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	// Set for RecordDrain events.
+	Drained bool `json:"drained,omitempty"`
+	// Set for RecordKeepalive events carrying a sample.
+	Utilization *state.Utilization `json:"utilization,omitempty"`
+}
+
+// EventRecorder appends RecordedEvents to a log file.
+//
+// The log is size-bounded: once the file would grow past the maximum size, it
+// is renamed by appending ".1" to its path, replacing the previous one, and a new
+// file is started. At most twice the maximum size is used on disk, and the oldest
+// events are lost first.
+type EventRecorder struct {
+	log     logger.Logger
+	path    string
+	maxSize int64
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// RotatedPath returns the path the event log at path is rotated to.
+func RotatedPath(path string) string {
+	return path + ".1"
+}
+
+// NewEventRecorder returns an EventRecorder appending to the file at path, rotated every maxSize bytes.
+func NewEventRecorder(log logger.Logger, path string, maxSize int64) (*EventRecorder, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid maximum size %d for event log %s - must be positive", maxSize, path)
+	}
+	r := &EventRecorder{log: log, path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *EventRecorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open event log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not open event log: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *EventRecorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, RotatedPath(r.path)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Record appends the event to the log.
+//
+// Recording never fails the controller: errors are logged, and the event is dropped.
+// A nil EventRecorder discards all events.
+func (r *EventRecorder) Record(ev *RecordedEvent) {
+	if r == nil {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		r.log.Warnf("Could not marshal %s event for node %s in site %s - %s", ev.Type, ev.Node, ev.Site, err)
+		return
+	}
+	data = append(data, '\n')
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	if r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			r.log.Warnf("Could not rotate event log %s - %s", r.path, err)
+			return
+		}
+	}
+	written, err := r.file.Write(data)
+	r.size += int64(written)
+	if err != nil {
+		r.log.Warnf("Could not record %s event for node %s in site %s - %s", ev.Type, ev.Node, ev.Site, err)
+	}
+}
+
+// Close closes the log. Events recorded afterwards are dropped.
+func (r *EventRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// ReadEventLog reads the events recorded by an EventRecorder at path, including
+// the rotated log, if any, oldest first.
+func ReadEventLog(path string) ([]*RecordedEvent, error) {
+	var events []*RecordedEvent
+	for _, p := range []string{RotatedPath(path), path} {
+		file, err := os.Open(p)
+		if os.IsNotExist(err) && p != path {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			ev := &RecordedEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), ev); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: invalid event - %w", p, line, err)
+			}
+			events = append(events, ev)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return events, nil
+}
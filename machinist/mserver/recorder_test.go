@@ -0,0 +1,140 @@
+package mserver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/knetwork/kdns"
+	"github.com/System233/enkit/lib/logger"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "replay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "events.log")
+
+	recorder, err := NewEventRecorder(logger.Nil, path, 1024*1024)
+	assert.Nil(t, err)
+
+	start := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	now := start
+	domains := kdns.WithDomains([]string{"enkit.cloud"})
+	en, err := NewController(WithClock(func() time.Time { return now }), WithEventRecorder(recorder), WithKDnsFlags(domains, kdns.WithLogger(logger.Nil)))
+	assert.Nil(t, err)
+	en.Log = logger.Nil
+	go en.dnsServer.HandleControllers()
+	defer en.dnsServer.Stop()
+
+	stream := &fakePollServer{}
+	snapshots := map[time.Time][]string{}
+	for _, step := range []func(){
+		func() {
+			assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "gpu01", Site: "lab", Ips: []string{"10.0.0.1"}, Tag: []string{"gpu"}}))
+		},
+		func() {
+			assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "cpu01", Ips: []string{"10.0.1.1"}}))
+		},
+		func() {
+			assert.Nil(t, en.HandlePing(stream, &mpb.ClientPing{Name: "gpu01", Site: "lab", Utilization: &mpb.Utilization{Users: 2, Load5: 1.5, Cpus: 8}}))
+			// Pings without samples, or from unknown nodes, change nothing and are not recorded.
+			assert.Nil(t, en.HandlePing(stream, &mpb.ClientPing{Name: "cpu01"}))
+			assert.Nil(t, en.HandlePing(stream, &mpb.ClientPing{Name: "unknown", Utilization: &mpb.Utilization{}}))
+		},
+		func() {
+			_, err := en.Drain(context.Background(), &mpb.DrainRequest{Name: "gpu01", Site: "lab", Drained: true})
+			assert.Nil(t, err)
+		},
+		func() {
+			// The node flaps to a different address.
+			assert.Nil(t, en.HandleRegister(stream, &mpb.ClientRegister{Name: "gpu01", Site: "lab", Ips: []string{"10.0.0.9"}, Tag: []string{"gpu"}}))
+		},
+		func() {
+			_, err := en.Drain(context.Background(), &mpb.DrainRequest{Name: "gpu01", Site: "lab", Drained: false})
+			assert.Nil(t, err)
+		},
+	} {
+		now = now.Add(10 * time.Second)
+		step()
+		// Take snapshots in between events.
+		now = now.Add(5 * time.Second)
+		en.refreshAllAndInfoRecords()
+		snapshots[now] = en.Snapshot()
+	}
+	assert.Nil(t, recorder.Close())
+
+	events, err := ReadEventLog(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(events))
+	assert.Equal(t, &RecordedEvent{Time: start.Add(55 * time.Second), Type: RecordDrain, Site: "lab", Node: "gpu01", Drained: true}, events[3])
+
+	first := snapshots[start.Add(15*time.Second)]
+	assert.Contains(t, first, "node lab/gpu01 ips=10.0.0.1 tags=gpu drained=false sampled=never")
+	assert.Contains(t, first, "dns gpu01.lab.enkit.cloud. 3600 IN A 10.0.0.1")
+	last := snapshots[start.Add(90*time.Second)]
+	assert.Contains(t, last, "node lab/gpu01 ips=10.0.0.9 tags=gpu drained=false sampled=2026-10-15T10:00:40Z")
+	assert.Contains(t, DiffSnapshots(first, last), "+ dns gpu01.lab.enkit.cloud. 3600 IN A 10.0.0.9")
+	assert.Contains(t, DiffSnapshots(first, last), "- dns gpu01.lab.enkit.cloud. 3600 IN A 10.0.0.1")
+
+	replay, err := NewReplay(events, WithKDnsFlags(domains, kdns.WithLogger(logger.Nil)))
+	assert.Nil(t, err)
+	defer replay.Close()
+	replay.Controller.Log = logger.Nil
+	assert.Equal(t, start.Add(85*time.Second), replay.End())
+
+	for step := 1; step <= 6; step++ {
+		at := start.Add(time.Duration(step*15) * time.Second)
+		assert.Nil(t, replay.ReplayTo(at))
+		assert.Nil(t, DiffSnapshots(snapshots[at], replay.Controller.Snapshot()), "at %s", at)
+	}
+	// Replays cannot go back in time.
+	assert.NotNil(t, replay.ReplayTo(start))
+}
+
+func TestEventRecorderRotation(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "replay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "events.log")
+
+	recorder, err := NewEventRecorder(logger.Nil, path, 512)
+	assert.Nil(t, err)
+	start := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		recorder.Record(&RecordedEvent{Time: start.Add(time.Duration(i) * time.Second), Type: RecordDrain, Node: fmt.Sprintf("node%02d", i)})
+	}
+	assert.Nil(t, recorder.Close())
+
+	for _, p := range []string{path, RotatedPath(path)} {
+		info, err := os.Stat(p)
+		assert.Nil(t, err)
+		assert.True(t, info.Size() <= 512, "%s is %d bytes", p, info.Size())
+	}
+
+	// The oldest events are dropped, the most recent are all there, in order.
+	events, err := ReadEventLog(path)
+	assert.Nil(t, err)
+	assert.True(t, len(events) > 2 && len(events) < 100, "%d events", len(events))
+	for ix, ev := range events {
+		assert.Equal(t, fmt.Sprintf("node%02d", 100-len(events)+ix), ev.Node)
+	}
+
+	// Recording resumes on the existing log.
+	recorder, err = NewEventRecorder(logger.Nil, path, 512)
+	assert.Nil(t, err)
+	recorder.Record(&RecordedEvent{Time: start, Type: RecordDrain, Node: "last"})
+	assert.Nil(t, recorder.Close())
+	events, err = ReadEventLog(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "last", events[len(events)-1].Node)
+
+	_, err = NewEventRecorder(logger.Nil, path, 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,188 @@
+package mserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/System233/enkit/lib/multierror"
+	"github.com/System233/enkit/machinist/state"
+
+	"github.com/miekg/dns"
+)
+
+// Snapshot returns the nodes and DNS records of the controller, one per line, sorted.
+//
+// Snapshots are meant to be compared with DiffSnapshots. Only the records of the
+// names of the registered nodes, and the _all and _info records, are included.
+func (en *Controller) Snapshot() []string {
+	var lines []string
+	nodes := en.Nodes()
+	names := map[string]bool{}
+	for _, m := range nodes {
+		var ips []string
+		for _, ip := range m.Ips {
+			ips = append(ips, ip.String())
+		}
+		sampled := "never"
+		if m.Utilization != nil {
+			sampled = m.Utilization.Sampled.UTC().Format(time.RFC3339)
+		}
+		lines = append(lines, fmt.Sprintf("node %s/%s ips=%s tags=%s drained=%v sampled=%s",
+			state.CanonicalSite(m.Site), m.Name, strings.Join(ips, ","), strings.Join(m.Tags, ","), m.Drained, sampled))
+
+		if en.dnsServer == nil {
+			continue
+		}
+		for _, d := range en.dnsServer.Domains {
+			for _, name := range dnsNames(m, d) {
+				names[name] = true
+			}
+			for _, suffix := range []string{d, fmt.Sprintf("%s.%s", state.CanonicalSite(m.Site), d)} {
+				names[dns.CanonicalName("_all."+suffix)] = true
+				names[dns.CanonicalName("_info."+suffix)] = true
+			}
+		}
+	}
+
+	for name := range names {
+		rc := en.dnsServer.ControllerForName(name)
+		if rc == nil {
+			continue
+		}
+		for _, rtype := range []uint16{dns.TypeA, dns.TypeTXT} {
+			for _, rr := range rc.FetchRecords(rtype) {
+				lines = append(lines, "dns "+strings.Join(strings.Fields(rr.String()), " "))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// DiffSnapshots returns the lines only in expected, prefixed by "- ", followed by
+// the lines only in actual, prefixed by "+ ". Returns nil if the snapshots match.
+func DiffSnapshots(expected, actual []string) []string {
+	count := map[string]int{}
+	for _, line := range actual {
+		count[line]++
+	}
+	for _, line := range expected {
+		count[line]--
+	}
+
+	var missing, extra []string
+	for _, line := range expected {
+		if count[line] < 0 {
+			missing = append(missing, "- "+line)
+			count[line]++
+		}
+	}
+	for _, line := range actual {
+		if count[line] > 0 {
+			extra = append(extra, "+ "+line)
+			count[line]--
+		}
+	}
+	return append(missing, extra...)
+}
+
+// Replay feeds recorded events into an offline controller, with a virtual clock.
+//
+// The controller does not listen on the network, and does not publish or record
+// events unless configured to. Its state and DNS records can be inspected at any
+// point of the replayed timeline with Controller.Snapshot, and Controller.Nodes.
+type Replay struct {
+	Controller *Controller
+
+	events []*RecordedEvent
+	next   int
+	clock  time.Time
+}
+
+// NewReplay returns a Replay of the events, on a controller configured with mods.
+//
+// The controller starts from an empty state, unless a state file is configured with WithStateFile.
+// Close must be invoked to release the resources of the controller.
+func NewReplay(events []*RecordedEvent, mods ...ControllerModifier) (*Replay, error) {
+	r := &Replay{events: events}
+	if len(events) > 0 {
+		r.clock = events[0].Time
+	}
+
+	mods = append([]ControllerModifier{WithClock(r.Now)}, append(mods, WithKDnsFlags())...)
+	en, err := NewController(mods...)
+	if err != nil {
+		return nil, err
+	}
+	go en.dnsServer.HandleControllers()
+	en.Init()
+	en.refreshAllAndInfoRecords()
+
+	r.Controller = en
+	return r, nil
+}
+
+// Now returns the time the replay reached.
+func (r *Replay) Now() time.Time {
+	return r.clock
+}
+
+// End returns the time of the last event to replay.
+func (r *Replay) End() time.Time {
+	if len(r.events) == 0 {
+		return r.clock
+	}
+	return r.events[len(r.events)-1].Time
+}
+
+// ReplayTo applies the events recorded up to, and including, the specified time.
+//
+// Replays only move forward: an error is returned if the time is before the time
+// the replay already reached. Errors applying events are returned after all the events
+// up to the specified time were applied.
+func (r *Replay) ReplayTo(t time.Time) error {
+	if t.Before(r.clock) {
+		return fmt.Errorf("cannot replay to %s - the replay already reached %s", t.Format(time.RFC3339Nano), r.clock.Format(time.RFC3339Nano))
+	}
+
+	var errs []error
+	for ; r.next < len(r.events) && !r.events[r.next].Time.After(t); r.next++ {
+		ev := r.events[r.next]
+		if ev.Time.After(r.clock) {
+			r.clock = ev.Time
+		}
+		if err := r.apply(ev); err != nil {
+			errs = append(errs, fmt.Errorf("event %d, %s of node %s in site %s at %s - %w", r.next, ev.Type, ev.Node, ev.Site, ev.Time.Format(time.RFC3339Nano), err))
+		}
+	}
+	r.clock = t
+	r.Controller.refreshAllAndInfoRecords()
+	return multierror.New(errs)
+}
+
+func (r *Replay) apply(ev *RecordedEvent) error {
+	en := r.Controller
+	switch ev.Type {
+	case RecordRegister:
+		return en.register(ev.Site, ev.Node, ev.Ips, ev.Tags)
+	case RecordKeepalive:
+		if ev.Utilization == nil {
+			return fmt.Errorf("no utilization sample")
+		}
+		sample := *ev.Utilization
+		if !en.keepalive(ev.Site, ev.Node, &sample) {
+			return fmt.Errorf("node is not registered")
+		}
+		return nil
+	case RecordDrain:
+		return en.drain(ev.Site, ev.Node, ev.Drained)
+	}
+	return fmt.Errorf("unknown event type %q", ev.Type)
+}
+
+// Close stops the controller.
+func (r *Replay) Close() error {
+	return r.Controller.dnsServer.Stop()
+}
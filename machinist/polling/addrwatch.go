@@ -0,0 +1,214 @@
+package polling
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/machinist/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	addressChangeCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "machinist_address_changes",
+		Help: "The number of times the addresses of the watched interfaces changed, causing the machine to register again",
+	})
+	addressChangeRateLimitedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "machinist_address_changes_rate_limited",
+		Help: "The number of address changes whose registration was delayed to avoid flapping",
+	})
+)
+
+// AddressSource returns the addresses currently assigned to the network interfaces specified.
+type AddressSource func(interfaces []string) ([]string, error)
+
+// InterfaceAddresses is an AddressSource returning the addresses of the network interfaces of the machine.
+//
+// Loopback and link local addresses are ignored, as they are not reachable by other machines.
+func InterfaceAddresses(interfaces []string) ([]string, error) {
+	var result []string
+	for _, name := range interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface %s - %w", name, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("could not retrieve the addresses of %s - %w", name, err)
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			result = append(result, ipnet.IP.String())
+		}
+	}
+	return result, nil
+}
+
+// AddressWatcher detects changes to the addresses of a set of network interfaces.
+type AddressWatcher struct {
+	Log logger.Logger
+
+	// Addresses always registered, in addition to those of the Interfaces.
+	Static     []string
+	Interfaces []string
+	Source     AddressSource
+
+	// Receives a value every time the addresses may have changed. When nil,
+	// or once closed, the addresses are checked every PollInterval instead.
+	Notify       <-chan struct{}
+	PollInterval time.Duration
+	// Changes are reported at most once every MinInterval.
+	MinInterval time.Duration
+}
+
+// NewAddressWatcher returns an AddressWatcher for the interfaces of the node.
+//
+// Address changes are detected through notifications from the kernel where
+// supported, by polling otherwise. Notifications stop once ctx is canceled.
+func NewAddressWatcher(ctx context.Context, conf *config.Node) *AddressWatcher {
+	w := &AddressWatcher{
+		Log:          conf.Root.Log,
+		Static:       conf.IpAddresses,
+		Interfaces:   conf.Interfaces,
+		Source:       InterfaceAddresses,
+		PollInterval: conf.AddressPollInterval,
+		MinInterval:  conf.AddressChangeInterval,
+	}
+
+	notify, err := addressNotifications(ctx)
+	if err != nil {
+		w.Log.Warnf("address change notifications not available, polling every %s instead - %s", w.PollInterval, err)
+		return w
+	}
+	w.Notify = notify
+	return w
+}
+
+// Addresses returns the addresses to register: the Static ones, followed by those of the Interfaces, sorted.
+func (w *AddressWatcher) Addresses() ([]string, error) {
+	addrs, err := w.Source(w.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var result []string
+	for _, addr := range w.Static {
+		if !seen[addr] {
+			seen[addr] = true
+			result = append(result, addr)
+		}
+	}
+	var found []string
+	for _, addr := range addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			found = append(found, addr)
+		}
+	}
+	sort.Strings(found)
+	return append(result, found...), nil
+}
+
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ix := range a {
+		if a[ix] != b[ix] {
+			return false
+		}
+	}
+	return true
+}
+
+// Run invokes changed every time the addresses differ from those last reported, until ctx is canceled.
+//
+// current is the list of addresses already registered, as returned by Addresses.
+// Changes happening less than MinInterval after the last one reported are
+// coalesced: once MinInterval has elapsed, changed is invoked only if the
+// addresses are still different from those last reported.
+func (w *AddressWatcher) Run(ctx context.Context, current []string, changed func(old, new []string)) error {
+	notify := w.Notify
+	var poll <-chan time.Time
+	startPolling := func() {
+		ticker := time.NewTicker(w.PollInterval)
+		go func() {
+			<-ctx.Done()
+			ticker.Stop()
+		}()
+		poll = ticker.C
+	}
+	if notify == nil {
+		startPolling()
+	}
+
+	var last time.Time
+	var delayed <-chan time.Time
+	check := func() {
+		addrs, err := w.Addresses()
+		if err != nil {
+			w.Log.Warnf("could not retrieve the addresses of %v - %s", w.Interfaces, err)
+			return
+		}
+		if sameAddresses(addrs, current) {
+			return
+		}
+
+		if wait := w.MinInterval - time.Since(last); !last.IsZero() && wait > 0 {
+			if delayed == nil {
+				w.Log.Infof("addresses changed from %v to %v - registering again in %s, to avoid flapping", current, addrs, wait)
+				addressChangeRateLimitedCounter.Inc()
+				delayed = time.After(wait)
+			}
+			return
+		}
+
+		w.Log.Infof("addresses changed from %v to %v - registering again", current, addrs)
+		addressChangeCounter.Inc()
+		old := current
+		current = addrs
+		last = time.Now()
+		changed(old, addrs)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case _, ok := <-notify:
+			if !ok {
+				w.Log.Warnf("address change notifications stopped, polling every %s instead", w.PollInterval)
+				notify = nil
+				startPolling()
+			}
+			check()
+
+		case <-poll:
+			check()
+
+		case <-delayed:
+			delayed = nil
+			check()
+		}
+	}
+}
+
+// SendAddressChanges sends the new list of addresses to register on changes, every time they change.
+func SendAddressChanges(ctx context.Context, w *AddressWatcher, current []string, changes chan<- []string) error {
+	return w.Run(ctx, current, func(old, new []string) {
+		select {
+		case changes <- new:
+		case <-ctx.Done():
+		}
+	})
+}
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// addressNotifications returns a channel receiving a value every time an address is added to, or removed
+// from, any network interface, using a netlink subscription.
+//
+// The channel is closed if the subscription fails, or once ctx is canceled.
+func addressNotifications(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("could not open netlink socket - %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not subscribe to address changes - %w", err)
+	}
+
+	// With a non blocking descriptor, reads use the runtime poller, and are interrupted by Close.
+	socket := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+
+	notify := make(chan struct{}, 1)
+	go func() {
+		defer close(notify)
+		buffer := make([]byte, os.Getpagesize())
+		for {
+			// The content of the message is irrelevant: the addresses are re-read on any change.
+			_, err := socket.Read(buffer)
+			// Notifications were dropped as the socket buffer was full: something changed.
+			if err != nil && !errors.Is(err, unix.ENOBUFS) {
+				return
+			}
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return notify, nil
+}
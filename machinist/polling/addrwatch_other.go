@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package polling
+
+import (
+	"context"
+	"errors"
+)
+
+// addressNotifications is only supported on linux, other systems poll for address changes.
+func addressNotifications(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this operating system")
+}
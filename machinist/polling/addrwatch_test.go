@@ -0,0 +1,116 @@
+package polling
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAddresses is an AddressSource returning the addresses set by the test.
+type fakeAddresses struct {
+	lock  sync.Mutex
+	addrs []string
+}
+
+func (f *fakeAddresses) Set(addrs ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.addrs = addrs
+}
+
+func (f *fakeAddresses) Source(interfaces []string) ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.addrs...), nil
+}
+
+func TestAddressWatcher(t *testing.T) {
+	source := &fakeAddresses{}
+	source.Set("10.0.0.2")
+	notify := make(chan struct{}, 1)
+	w := &AddressWatcher{
+		Log:          logger.Nil,
+		Static:       []string{"192.168.0.1"},
+		Interfaces:   []string{"eth0"},
+		Source:       source.Source,
+		Notify:       notify,
+		PollInterval: time.Hour,
+		MinInterval:  500 * time.Millisecond,
+	}
+
+	current, err := w.Addresses()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.0.1", "10.0.0.2"}, current)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan []string)
+	go SendAddressChanges(ctx, w, current, changes)
+
+	// A notification without an actual change is not reported.
+	notify <- struct{}{}
+	select {
+	case ips := <-changes:
+		t.Fatalf("unexpected change %v", ips)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first change is reported immediately.
+	start := time.Now()
+	source.Set("10.0.0.3")
+	notify <- struct{}{}
+	assert.Equal(t, []string{"192.168.0.1", "10.0.0.3"}, <-changes)
+	assert.True(t, time.Since(start) < 200*time.Millisecond, "took %s", time.Since(start))
+
+	// Changes right after are delayed, and coalesced into a single update.
+	source.Set("10.0.0.4")
+	notify <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	source.Set("10.0.0.5", "10.0.0.4")
+	notify <- struct{}{}
+	assert.Equal(t, []string{"192.168.0.1", "10.0.0.4", "10.0.0.5"}, <-changes)
+	assert.True(t, time.Since(start) >= w.MinInterval, "took %s", time.Since(start))
+
+	// Flapping back to the addresses already reported within the interval is not reported.
+	source.Set("10.0.0.6")
+	notify <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	source.Set("10.0.0.4", "10.0.0.5")
+	notify <- struct{}{}
+	select {
+	case ips := <-changes:
+		t.Fatalf("unexpected change %v", ips)
+	case <-time.After(w.MinInterval + 100*time.Millisecond):
+	}
+}
+
+func TestAddressWatcherPolls(t *testing.T) {
+	source := &fakeAddresses{}
+	source.Set("10.0.0.2")
+	// Notifications stopped, the watcher falls back to polling.
+	notify := make(chan struct{})
+	close(notify)
+	w := &AddressWatcher{
+		Log:          logger.Nil,
+		Source:       source.Source,
+		Notify:       notify,
+		PollInterval: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan []string)
+	done := make(chan error)
+	go func() {
+		done <- SendAddressChanges(ctx, w, []string{"10.0.0.2"}, changes)
+	}()
+
+	source.Set("10.0.0.3")
+	assert.Equal(t, []string{"10.0.0.3"}, <-changes)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
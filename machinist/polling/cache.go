@@ -0,0 +1,233 @@
+package polling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/machinist/config"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// cacheRefreshInterval is how often the cache is rewritten while the configuration
+// received from the controller does not change, to keep its timestamp current.
+const cacheRefreshInterval = time.Hour
+
+var configCachedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "machinist_config_cached",
+	Help: "1 while the node uses the configuration from its cache, as the controller was unreachable at startup",
+})
+
+// CachedNode is the last configuration received from the controller.
+type CachedNode struct {
+	// When the configuration was received from the controller.
+	Received   time.Time `json:"received"`
+	Site       string    `json:"site"`
+	Principals []string  `json:"principals"`
+}
+
+// CachedEnrollment is the last set of certificates received from the auth
+// server when enrolling the node, and where they were installed.
+type CachedEnrollment struct {
+	Received            time.Time `json:"received"`
+	CAPublicKeyPath     string    `json:"ca_public_key_path"`
+	CAPublicKey         []byte    `json:"ca_public_key"`
+	HostCertificatePath string    `json:"host_certificate_path"`
+	HostCertificate     []byte    `json:"host_certificate"`
+}
+
+// CachedConfig is the content of the cache file.
+type CachedConfig struct {
+	Node       *CachedNode       `json:"node,omitempty"`
+	Enrollment *CachedEnrollment `json:"enrollment,omitempty"`
+}
+
+// ConfigCache stores a CachedConfig in a file, so a node starting while the
+// controller is unreachable can come up with the state it had before.
+type ConfigCache struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func NewConfigCache(path string) *ConfigCache {
+	return &ConfigCache{Path: path}
+}
+
+// Load returns the cached configuration, empty if the cache file does not exist.
+func (c *ConfigCache) Load() (*CachedConfig, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.load()
+}
+
+func (c *ConfigCache) load() (*CachedConfig, error) {
+	cached := &CachedConfig{}
+	data, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return cached, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cached); err != nil {
+		return nil, fmt.Errorf("invalid config cache %s - %w", c.Path, err)
+	}
+	return cached, nil
+}
+
+// Update atomically replaces the cached configuration with the one modified by update.
+func (c *ConfigCache) Update(update func(cached *CachedConfig)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cached, err := c.load()
+	if err != nil {
+		// A corrupted cache is replaced, it would be useless anyway.
+		cached = &CachedConfig{}
+	}
+	update(cached)
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.Path, data, 0600)
+}
+
+// ApplyNodeConfig writes the principals in node to conf.PrincipalsLocation, if set.
+func ApplyNodeConfig(conf *config.Node, node *CachedNode) error {
+	if conf.Site != "" && conf.Site != node.Site {
+		conf.Root.Log.Warnf("Node configured for site %s, but registered by the controller in site %s", conf.Site, node.Site)
+	}
+	if conf.PrincipalsLocation == "" {
+		return nil
+	}
+	return atomicfile.WriteFile(conf.PrincipalsLocation, []byte(strings.Join(node.Principals, "\n")+"\n"), 0644)
+}
+
+// RestoreEnrollment installs the cached certificates that are missing, for
+// example because they were stored on a volatile file system.
+//
+// Files that exist are left untouched, as they may be newer than the cache.
+func RestoreEnrollment(conf *config.Node, enrollment *CachedEnrollment) error {
+	for _, file := range []struct {
+		path    string
+		content []byte
+	}{
+		{enrollment.CAPublicKeyPath, enrollment.CAPublicKey},
+		{enrollment.HostCertificatePath, enrollment.HostCertificate},
+	} {
+		if file.path == "" || len(file.content) == 0 {
+			continue
+		}
+		if _, err := os.Stat(file.path); !os.IsNotExist(err) {
+			continue
+		}
+		conf.Root.Log.Warnf("Restoring %s from the certificates cached at %s", file.path, enrollment.Received.Format(time.RFC3339))
+		if err := atomicfile.WriteFile(file.path, file.content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncNodeConfig applies the configurations received from the controller on
+// configs, and keeps the last one in cache.
+//
+// If no configuration is received within conf.ConfigCacheWait, for example
+// because the node rebooted while the controller is down, the cached
+// configuration is applied instead, until the controller is reachable again.
+// Missing certificates are restored from the cache immediately.
+//
+// cache can be nil, in which case the configurations are only applied.
+func SyncNodeConfig(ctx context.Context, conf *config.Node, cache *ConfigCache, configs <-chan *mpb.NodeConfig) error {
+	l := conf.Root.Log
+
+	var wait <-chan time.Time
+	if cache != nil {
+		cached, err := cache.Load()
+		if err != nil {
+			l.Warnf("Ignoring config cache - %s", err)
+		} else if cached.Enrollment != nil {
+			if err := RestoreEnrollment(conf, cached.Enrollment); err != nil {
+				l.Errorf("Could not restore the cached certificates - %s", err)
+			}
+		}
+
+		timer := time.NewTimer(conf.ConfigCacheWait)
+		defer timer.Stop()
+		wait = timer.C
+	}
+
+	var applied *CachedNode
+	var stored time.Time
+	fromCache := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-wait:
+			wait = nil
+			cached, err := cache.Load()
+			if err != nil {
+				l.Warnf("Controller unreachable, and cached configuration unusable - %s", err)
+				continue
+			}
+			if cached.Node == nil {
+				l.Warnf("Controller unreachable after %s, and no cached configuration to apply", conf.ConfigCacheWait)
+				continue
+			}
+			l.Warnf("Controller unreachable after %s - applying the configuration cached at %s, %s old", conf.ConfigCacheWait,
+				cached.Node.Received.Format(time.RFC3339), time.Since(cached.Node.Received).Truncate(time.Second))
+			if err := ApplyNodeConfig(conf, cached.Node); err != nil {
+				l.Errorf("Could not apply the cached configuration - %s", err)
+				continue
+			}
+			applied = cached.Node
+			fromCache = true
+			configCachedGauge.Set(1)
+
+		case nc := <-configs:
+			wait = nil
+			node := &CachedNode{Received: time.Now(), Site: nc.Site, Principals: nc.Principal}
+			changed := applied == nil || applied.Site != node.Site || !reflect.DeepEqual(applied.Principals, node.Principals)
+			if changed {
+				if err := ApplyNodeConfig(conf, node); err != nil {
+					l.Errorf("Could not apply the configuration received from the controller - %s", err)
+					continue
+				}
+				applied = node
+			}
+			if fromCache {
+				l.Infof("Controller reachable again - the cached configuration was superseded")
+				fromCache = false
+				configCachedGauge.Set(0)
+			}
+
+			if cache == nil || (!changed && time.Since(stored) < cacheRefreshInterval) {
+				continue
+			}
+			if err := cache.Update(func(cached *CachedConfig) {
+				cached.Node = node
+			}); err != nil {
+				l.Errorf("Could not update the config cache %s - %s", cache.Path, err)
+				continue
+			}
+			stored = node.Received
+		}
+	}
+}
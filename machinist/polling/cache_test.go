@@ -0,0 +1,156 @@
+package polling
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/machinist/config"
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeController is a controller that is unreachable until up is called.
+type fakeController struct {
+	mpb.ControllerClient
+
+	lock   sync.Mutex
+	config *mpb.NodeConfig
+}
+
+func (f *fakeController) up(config *mpb.NodeConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.config = config
+}
+
+func (f *fakeController) Poll(ctx context.Context, opts ...grpc.CallOption) (mpb.Controller_PollClient, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.config == nil {
+		return nil, status.Errorf(codes.Unavailable, "connection refused")
+	}
+	return &fakePollClient{config: f.config}, nil
+}
+
+// fakePollClient answers each registration with a config.
+type fakePollClient struct {
+	mpb.Controller_PollClient
+	config *mpb.NodeConfig
+}
+
+func (f *fakePollClient) Send(*mpb.PollRequest) error {
+	return nil
+}
+
+func (f *fakePollClient) Recv() (*mpb.PollResponse, error) {
+	return &mpb.PollResponse{Resp: &mpb.PollResponse_Result{Result: &mpb.ActionResult{Config: f.config}}}, nil
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestConfigCacheUpdate(t *testing.T) {
+	cache := NewConfigCache(filepath.Join(t.TempDir(), "state", "cache.json"))
+	cached, err := cache.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &CachedConfig{}, cached)
+
+	received := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, cache.Update(func(cached *CachedConfig) {
+		cached.Node = &CachedNode{Received: received, Site: "lab", Principals: []string{"node01"}}
+	}))
+	assert.NoError(t, cache.Update(func(cached *CachedConfig) {
+		cached.Enrollment = &CachedEnrollment{Received: received, HostCertificate: []byte("cert")}
+	}))
+
+	cached, err = cache.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &CachedNode{Received: received, Site: "lab", Principals: []string{"node01"}}, cached.Node)
+	assert.Equal(t, []byte("cert"), cached.Enrollment.HostCertificate)
+
+	// A corrupted cache is reported, and replaced at the next update.
+	assert.NoError(t, ioutil.WriteFile(cache.Path, []byte("{\"node\": "), 0600))
+	_, err = cache.Load()
+	assert.Error(t, err)
+	assert.NoError(t, cache.Update(func(cached *CachedConfig) {}))
+	cached, err = cache.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, cached.Node)
+
+	// No temporary file is left behind.
+	files, err := ioutil.ReadDir(filepath.Dir(cache.Path))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestConfigCacheStartup(t *testing.T) {
+	dir := t.TempDir()
+	conf := &config.Node{
+		Name:                "node01",
+		ConfigCacheLocation: filepath.Join(dir, "cache.json"),
+		ConfigCacheWait:     10 * time.Millisecond,
+		PrincipalsLocation:  filepath.Join(dir, "principals"),
+		Common: &config.Common{
+			Root: &client.BaseFlags{Log: &logger.Proxy{Logger: logger.Nil}},
+		},
+	}
+
+	// Warm cache, from a previous run of the node.
+	cache := NewConfigCache(conf.ConfigCacheLocation)
+	assert.NoError(t, cache.Update(func(cached *CachedConfig) {
+		cached.Node = &CachedNode{
+			Received:   time.Now().Add(-2 * time.Hour),
+			Site:       "default",
+			Principals: []string{"node01", "node01.enkit.cloud", "10.0.0.1"},
+		}
+		cached.Enrollment = &CachedEnrollment{
+			Received:        time.Now().Add(-48 * time.Hour),
+			CAPublicKeyPath: filepath.Join(dir, "machinist_ca.pub"),
+			CAPublicKey:     []byte("ca"),
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controller := &fakeController{}
+	changes := make(chan []string)
+	configs := make(chan *mpb.NodeConfig)
+	go SendRegisterRequests(ctx, controller, conf, []string{"10.0.0.2"}, changes, configs)
+	go SyncNodeConfig(ctx, conf, cache, configs)
+
+	// The controller is unreachable, the cached data is applied.
+	assert.Eventually(t, func() bool {
+		return readFile(t, conf.PrincipalsLocation) == "node01\nnode01.enkit.cloud\n10.0.0.1\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "ca", readFile(t, filepath.Join(dir, "machinist_ca.pub")))
+
+	// Once the controller is reachable, its configuration supersedes the cached one.
+	controller.up(&mpb.NodeConfig{Site: "default", Principal: []string{"node01", "node01.enkit.cloud", "10.0.0.2"}})
+	changes <- []string{"10.0.0.2"}
+	assert.Eventually(t, func() bool {
+		return readFile(t, conf.PrincipalsLocation) == "node01\nnode01.enkit.cloud\n10.0.0.2\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		cached, err := cache.Load()
+		return err == nil && cached.Node != nil && cached.Node.Principals[2] == "10.0.0.2" && time.Since(cached.Node.Received) < time.Minute
+	}, 5*time.Second, 10*time.Millisecond)
+	cached, err := cache.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ca"), cached.Enrollment.CAPublicKey)
+}
@@ -3,27 +3,50 @@ package polling
 import (
 	"context"
 
+	"github.com/System233/enkit/machinist/config"
 	mpb "github.com/System233/enkit/machinist/rpc"
 
 	"time"
 )
+
+// utilizationInterval is how often the utilization is sampled and attached to a keepalive.
+const utilizationInterval = 10 * time.Second
+
 // SendKeepAliveRequest will run a keepalive request ad infinittum, only logging when EOF.
-func SendKeepAliveRequest(ctx context.Context, client mpb.ControllerClient) error {
+//
+// Every utilizationInterval, the keepalive also carries a sample of the utilization of the machine.
+// If the controller is unreachable, the keepalive keeps trying to connect.
+func SendKeepAliveRequest(ctx context.Context, client mpb.ControllerClient, conf *config.Node) error {
 	pollStream, err := client.Poll(ctx)
 	if err != nil {
-		return err
+		keepAliveErrorCounter.Inc()
+		pollStream = nil
 	}
+	var lastSample time.Time
 	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-time.After(1 * time.Second):
+			ping := &mpb.ClientPing{
+				Payload: []byte(``),
+				Name:    conf.Name,
+				Site:    conf.Site,
+			}
+			if time.Since(lastSample) >= utilizationInterval {
+				u, err := CollectUtilization()
+				if err != nil {
+					conf.Root.Log.Warnf("unable to collect utilization: %s", err)
+				}
+				ping.Utilization = u
+				lastSample = time.Now()
+			}
 			pollReq := &mpb.PollRequest{
 				Req: &mpb.PollRequest_Ping{
-					Ping: &mpb.ClientPing{
-						Payload: []byte(``),
-					},
+					Ping: ping,
 				},
 			}
-			if err := pollStream.Send(pollReq); err != nil {
+			if pollStream == nil || pollStream.Send(pollReq) != nil {
 				ps, err := client.Poll(ctx)
 				if err != nil {
 					keepAliveErrorCounter.Inc()
@@ -0,0 +1,92 @@
+package polling
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/lib/kcerts"
+	"github.com/System233/enkit/machinist/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	revokedKeysFailCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "machinist_revoked_keys_fail",
+		Help: "The number of times the machine has failed to fetch or install the revoked keys list",
+	})
+	revokedKeysVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "machinist_revoked_keys_version",
+		Help: "The version of the revoked keys list currently installed",
+	})
+)
+
+// InstallRevokedKeys fetches the KRL from url, verifies it can be parsed, and atomically replaces the file at path.
+//
+// Returns the parsed KRL.
+func InstallRevokedKeys(ctx context.Context, url, path string) (*kcerts.KRL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned status %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Installing a corrupted file would cause sshd to refuse all keys, validate first.
+	krl, err := kcerts.ParseKRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KRL from %s - %w", url, err)
+	}
+
+	if err := atomicfile.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+	return krl, nil
+}
+
+// SendRevokedKeysRequests periodically fetches the KRL from the auth server, and installs it for sshd to use.
+//
+// Failures are logged and retried at the next interval, the previously installed list is kept in place.
+func SendRevokedKeysRequests(ctx context.Context, c *config.Node) error {
+	l := c.Root.Log
+	if c.RevokedKeysURL == "" {
+		l.Infof("Fetching of revoked keys is disabled")
+		return nil
+	}
+	if c.RevokedKeysLocation == "" {
+		return fmt.Errorf("a revoked keys url was specified, but no file to install it to")
+	}
+	if c.RevokedKeysInterval <= 0 {
+		return fmt.Errorf("invalid revoked keys interval %s - must be positive", c.RevokedKeysInterval)
+	}
+
+	for {
+		krl, err := InstallRevokedKeys(ctx, c.RevokedKeysURL, c.RevokedKeysLocation)
+		if err != nil {
+			l.Errorf("unable to install revoked keys: %s", err)
+			revokedKeysFailCounter.Inc()
+		} else {
+			revokedKeysVersion.Set(float64(krl.Version))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.RevokedKeysInterval):
+		}
+	}
+}
@@ -11,39 +11,80 @@ import (
 )
 
 // SendRegisterRequests is a blocking function that will send re-register requests every 5 seconds.
-func SendRegisterRequests(ctx context.Context, client mpb.ControllerClient, conf *config.Node) error {
-	pollStream, err := client.Poll(ctx)
-	if err != nil {
-		return err
-	}
+//
+// The node registers with the specified ips. Every time a new list of ips is
+// received from changes, the node registers again immediately with the new list.
+// changes can be nil if the ips never change.
+//
+// The configuration returned by the controller with each registration is sent
+// on configs, unless nil. If the controller is unreachable, the node keeps
+// trying to connect, rather than returning an error.
+func SendRegisterRequests(ctx context.Context, client mpb.ControllerClient, conf *config.Node, ips []string, changes <-chan []string, configs chan<- *mpb.NodeConfig) error {
 	l := conf.Common.Root.Log
 	registerRequest := &mpb.PollRequest{
 		Req: &mpb.PollRequest_Register{
 			Register: &mpb.ClientRegister{
 				Name: conf.Name,
 				Tag:  conf.Tags,
-				Ips:  conf.IpAddresses,
+				Ips:  ips,
+				Site: conf.Site,
 			},
 		},
 	}
+	var pollStream mpb.Controller_PollClient
 	for {
-		if err := pollStream.Send(registerRequest); err != nil {
-			_, err := pollStream.Recv()
-			s, ok := status.FromError(err)
-			if ok {
-				l.Errorf("unable to send register request: %+v", s.Message())
-			} else {
-				l.Errorf("unable to send request, unknown err: %w", err)
-			}
+		if pollStream == nil {
 			p, err := client.Poll(ctx)
 			if err != nil {
-				l.Errorf("error %w reconnecting, trying again", err)
+				l.Errorf("error %s connecting to the controller, trying again", err)
 				registerFailCounter.Inc()
 			} else {
-				l.Infof("Successfully reconnected")
+				l.Infof("Successfully connected")
 				pollStream = p
 			}
 		}
-		_ = <-time.After(5 * time.Second)
+		if pollStream != nil {
+			result, err := register(pollStream, registerRequest)
+			if err != nil {
+				s, ok := status.FromError(err)
+				if ok {
+					l.Errorf("unable to send register request: %+v", s.Message())
+				} else {
+					l.Errorf("unable to send request, unknown err: %s", err)
+				}
+				registerFailCounter.Inc()
+				pollStream = nil
+			} else if nc := result.GetConfig(); nc != nil && configs != nil {
+				select {
+				case configs <- nc:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		case ips := <-changes:
+			registerRequest.GetRegister().Ips = ips
+		}
+	}
+}
+
+// register sends a register request on the stream, and waits for its result.
+func register(stream mpb.Controller_PollClient, req *mpb.PollRequest) (*mpb.ActionResult, error) {
+	if err := stream.Send(req); err != nil {
+		// Send only returns io.EOF, the actual error is returned by Recv.
+		if _, rerr := stream.Recv(); rerr != nil {
+			err = rerr
+		}
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
 	}
+	return resp.GetResult(), nil
 }
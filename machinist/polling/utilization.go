@@ -0,0 +1,102 @@
+package polling
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	mpb "github.com/System233/enkit/machinist/rpc"
+)
+
+// parseLoadAvg parses the content of /proc/loadavg.
+func parseLoadAvg(content string, u *mpb.Utilization) error {
+	fields := strings.Fields(content)
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid loadavg %q", content)
+	}
+	var loads [3]float64
+	for i := range loads {
+		load, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("invalid loadavg %q - %w", content, err)
+		}
+		loads[i] = load
+	}
+	u.Load1, u.Load5, u.Load15 = loads[0], loads[1], loads[2]
+	return nil
+}
+
+// parseMemInfo parses the content of /proc/meminfo.
+func parseMemInfo(content string, u *mpb.Utilization) error {
+	found := 0
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dest *uint64
+		switch fields[0] {
+		case "MemAvailable:":
+			dest = &u.MemoryFree
+		case "MemTotal:":
+			dest = &u.MemoryTotal
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid meminfo line %q - %w", scanner.Text(), err)
+		}
+		*dest = kb * 1024
+		found++
+	}
+	if found != 2 {
+		return fmt.Errorf("meminfo is missing MemAvailable or MemTotal")
+	}
+	return nil
+}
+
+// countUsers returns the number of distinct users in the output of `who`.
+func countUsers(who string) uint32 {
+	users := map[string]struct{}{}
+	scanner := bufio.NewScanner(strings.NewReader(who))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			users[fields[0]] = struct{}{}
+		}
+	}
+	return uint32(len(users))
+}
+
+// CollectUtilization samples the utilization of the local machine.
+func CollectUtilization() (*mpb.Utilization, error) {
+	u := &mpb.Utilization{Cpus: uint32(runtime.NumCPU())}
+
+	loadavg, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	if err := parseLoadAvg(string(loadavg), u); err != nil {
+		return nil, err
+	}
+
+	meminfo, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	if err := parseMemInfo(string(meminfo), u); err != nil {
+		return nil, err
+	}
+
+	who, err := exec.Command("who").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not count users - %w", err)
+	}
+	u.Users = countUsers(string(who))
+	return u, nil
+}
@@ -0,0 +1,35 @@
+package polling
+
+import (
+	"testing"
+
+	mpb "github.com/System233/enkit/machinist/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUtilization(t *testing.T) {
+	u := &mpb.Utilization{}
+	assert.Nil(t, parseLoadAvg("0.52 1.25 2.00 1/634 12345\n", u))
+	assert.Equal(t, 0.52, u.Load1)
+	assert.Equal(t, 1.25, u.Load5)
+	assert.Equal(t, 2.0, u.Load15)
+	assert.NotNil(t, parseLoadAvg("0.52\n", u))
+	assert.NotNil(t, parseLoadAvg("a b c d", u))
+
+	meminfo := `MemTotal:       16314252 kB
+MemFree:          512000 kB
+MemAvailable:    8157126 kB
+Buffers:          123456 kB
+`
+	assert.Nil(t, parseMemInfo(meminfo, u))
+	assert.Equal(t, uint64(16314252*1024), u.MemoryTotal)
+	assert.Equal(t, uint64(8157126*1024), u.MemoryFree)
+	assert.NotNil(t, parseMemInfo("MemTotal: 1 kB\n", u))
+
+	who := `emma     pts/0        2021-05-01 10:00 (10.0.0.1)
+emma     pts/1        2021-05-01 10:05 (10.0.0.1)
+jdoe     pts/2        2021-05-01 11:00 (10.0.0.2)
+`
+	assert.Equal(t, uint32(2), countUsers(who))
+	assert.Equal(t, uint32(0), countUsers(""))
+}
@@ -1,30 +1,123 @@
 package state
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/System233/enkit/lib/config/marshal"
 	"net"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
+// DefaultSite is the site of machines registered without one.
+const DefaultSite = "default"
+
+// CanonicalSite returns the name of the site, mapping the empty site to DefaultSite.
+func CanonicalSite(site string) string {
+	if site == "" {
+		return DefaultSite
+	}
+	return site
+}
+
 type Machine struct {
 	Name string   `json:"name"`
 	Ips  []net.IP `json:"ips"`
 	Tags []string `json:"tags"`
+	// Site the machine belongs to. Names are unique within a site only.
+	// Machines loaded from older state files have no site, and belong to DefaultSite.
+	Site string `json:"site,omitempty"`
+
+	// Drained machines are not suggested by FreeMachines.
+	Drained bool `json:"drained,omitempty"`
+	// Latest utilization sample reported by the machine, nil if none was received.
+	Utilization *Utilization `json:"utilization,omitempty"`
+}
+
+// Utilization is a sample of how busy a machine is.
+type Utilization struct {
+	Sampled time.Time `json:"sampled"`
+
+	Users       uint32  `json:"users"`
+	Load1       float64 `json:"load1"`
+	Load5       float64 `json:"load5"`
+	Load15      float64 `json:"load15"`
+	MemoryFree  uint64  `json:"memory_free"`
+	MemoryTotal uint64  `json:"memory_total"`
+	Cpus        uint32  `json:"cpus"`
+}
+
+// InSite returns true if the machine belongs to the site. An empty site is the DefaultSite.
+func (m *Machine) InSite(site string) bool {
+	return CanonicalSite(m.Site) == CanonicalSite(site)
+}
+
+// is returns true if the machine is the one named name in site.
+func (m *Machine) is(site, name string) bool {
+	return m.Name == name && m.InSite(site)
+}
+
+// NormalizedLoad returns the 5 minutes load average divided by the number of CPUs.
+func (u *Utilization) NormalizedLoad() float64 {
+	if u.Cpus == 0 {
+		return u.Load5
+	}
+	return u.Load5 / float64(u.Cpus)
 }
 
 type MachineController struct {
 	sync.RWMutex
 	Machines []*Machine
+
+	// Revision is incremented every time a changed state is written.
+	// State files predating revisions are loaded with revision 0.
+	Revision uint64
+	// Hash of the machines in the last state written, empty if none was written.
+	Hash string
 }
 
-// AddMachine adds a machine to the parsed in state. If a machine exists with the same name, it returns an error.
+// ErrSiteFull is returned by AddMachineInQuota when a site already has the maximum number of machines.
+var ErrSiteFull = errors.New("site has reached its quota of machines")
+
+// AddMachine adds a machine to the parsed in state. A machine with the same name in the same site is replaced.
 func AddMachine(mc *MachineController, m *Machine) error {
+	return AddMachineInQuota(mc, m, 0)
+}
+
+// AddMachineInQuota is like AddMachine, but returns ErrSiteFull without adding the machine if it is not
+// already in the state, and its site has maxInSite machines or more. A maxInSite <= 0 means no limit.
+func AddMachineInQuota(mc *MachineController, m *Machine, maxInSite int) error {
 	mc.Lock()
 	defer mc.Unlock()
+	m.Site = CanonicalSite(m.Site)
+	if maxInSite > 0 {
+		inSite := 0
+		for _, mm := range mc.Machines {
+			if mm.is(m.Site, m.Name) {
+				inSite = 0
+				break
+			}
+			if mm.InSite(m.Site) {
+				inSite++
+			}
+		}
+		if inSite >= maxInSite {
+			return fmt.Errorf("%w - %s has %d machines", ErrSiteFull, m.Site, inSite)
+		}
+	}
 	modifiedInPlace := false
 	for i := range mc.Machines {
-		if mc.Machines[i].Name == m.Name {
+		if mc.Machines[i].is(m.Site, m.Name) {
+			// Re-registering does not undrain a machine, or lose its latest sample.
+			if m.Utilization == nil {
+				m.Utilization = mc.Machines[i].Utilization
+			}
+			m.Drained = m.Drained || mc.Machines[i].Drained
 			mc.Machines[i] = m
 			modifiedInPlace = true
 		}
@@ -35,18 +128,115 @@ func AddMachine(mc *MachineController, m *Machine) error {
 	return nil
 }
 
-// GetMachine fetches a machine from the state. If no machine exists with the name, it returns nil.
-func GetMachine(mc *MachineController, name string) *Machine {
+// GetMachine fetches a machine from the state. If no machine exists with the name in the site, it returns nil.
+func GetMachine(mc *MachineController, site, name string) *Machine {
 	mc.RLock()
 	defer mc.RUnlock()
 	for _, mm := range mc.Machines {
-		if mm.Name == name {
+		if mm.is(site, name) {
 			return mm
 		}
 	}
 	return nil
 }
 
+// SetUtilization records the latest utilization sample of a machine. Returns false if no machine exists with the name in the site.
+func SetUtilization(mc *MachineController, site, name string, u *Utilization) bool {
+	mc.Lock()
+	defer mc.Unlock()
+	for _, mm := range mc.Machines {
+		if mm.is(site, name) {
+			mm.Utilization = u
+			return true
+		}
+	}
+	return false
+}
+
+// SetDrained drains or undrains a machine. Returns false if no machine exists with the name in the site.
+func SetDrained(mc *MachineController, site, name string, drained bool) bool {
+	mc.Lock()
+	defer mc.Unlock()
+	for _, mm := range mc.Machines {
+		if mm.is(site, name) {
+			mm.Drained = drained
+			return true
+		}
+	}
+	return false
+}
+
+// FreeMachines returns copies of the machines with the specified tag in the specified site,
+// sorted from the most to the least idle.
+//
+// Drained machines, and machines that did not report a utilization sample
+// in the last maxAge, are excluded. An empty tag matches all machines, an
+// empty site matches all sites.
+//
+// Machines are ranked by number of logged in users first, then by load
+// normalized by the number of CPUs, and finally by memory available.
+func FreeMachines(mc *MachineController, site, tag string, now time.Time, maxAge time.Duration) []*Machine {
+	mc.RLock()
+	defer mc.RUnlock()
+
+	var free []*Machine
+	for _, mm := range mc.Machines {
+		if mm.Drained || mm.Utilization == nil || now.Sub(mm.Utilization.Sampled) > maxAge {
+			continue
+		}
+		if tag != "" && !hasTag(mm, tag) {
+			continue
+		}
+		if site != "" && !mm.InSite(site) {
+			continue
+		}
+		m := *mm
+		u := *mm.Utilization
+		m.Utilization = &u
+		free = append(free, &m)
+	}
+
+	sort.SliceStable(free, func(i, j int) bool {
+		ui, uj := free[i].Utilization, free[j].Utilization
+		if ui.Users != uj.Users {
+			return ui.Users < uj.Users
+		}
+		if li, lj := ui.NormalizedLoad(), uj.NormalizedLoad(); li != lj {
+			return li < lj
+		}
+		if ui.MemoryFree != uj.MemoryFree {
+			return ui.MemoryFree > uj.MemoryFree
+		}
+		if free[i].Name != free[j].Name {
+			return free[i].Name < free[j].Name
+		}
+		return CanonicalSite(free[i].Site) < CanonicalSite(free[j].Site)
+	})
+	return free
+}
+
+// MachinesInSite returns the machines in the specified site. An empty site returns all machines.
+func MachinesInSite(mc *MachineController, site string) []*Machine {
+	mc.RLock()
+	defer mc.RUnlock()
+	var machines []*Machine
+	for _, mm := range mc.Machines {
+		if site == "" || mm.InSite(site) {
+			machines = append(machines, mm)
+		}
+	}
+	return machines
+}
+
+func hasTag(m *Machine, tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 // ReadInController will attempt to read in the filepath provided and deserialize it into the machine controller.
 // Fails if the file exists and cannot deserialize. If the file does not exist, it will create tje file and return a fresh state.
 func ReadInController(filepath string) (*MachineController, error) {
@@ -59,8 +249,67 @@ func ReadInController(filepath string) (*MachineController, error) {
 	return m, err
 }
 
+// WriteController writes the state to the specified path, unless it did not change since it was last written.
 func WriteController(mc *MachineController, path string) error {
-	mc.RLock()
-	defer mc.RUnlock()
-	return marshal.MarshalFile(path, mc)
+	_, _, err := SaveController(mc, path)
+	return err
+}
+
+// SaveController writes the state to the specified path, unless it did not change since it was last written.
+//
+// The state is serialized deterministically: machines are sorted by site and
+// name, and their tags alphabetically, so that writing the same state always
+// results in the same file.
+//
+// Utilization samples are not persisted, nor considered a change of the state:
+// they are refreshed by the machines every few seconds, and would be stale
+// by the time the state is loaded again.
+//
+// Returns true and the new revision of the state if the file was written,
+// false and the current revision if the write was skipped.
+func SaveController(mc *MachineController, path string) (bool, uint64, error) {
+	mc.Lock()
+	defer mc.Unlock()
+
+	snapshot := canonicalMachines(mc.Machines)
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return false, mc.Revision, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if hash == mc.Hash {
+		return false, mc.Revision, nil
+	}
+
+	err = marshal.MarshalFile(path, &struct {
+		Revision uint64
+		Hash     string
+		Machines []*Machine
+	}{Revision: mc.Revision + 1, Hash: hash, Machines: snapshot})
+	if err != nil {
+		return false, mc.Revision, err
+	}
+	mc.Revision += 1
+	mc.Hash = hash
+	return true, mc.Revision, nil
+}
+
+// canonicalMachines returns shallow copies of the machines, sorted by site and name, with sorted tags and no utilization.
+func canonicalMachines(machines []*Machine) []*Machine {
+	sorted := make([]*Machine, 0, len(machines))
+	for _, mm := range machines {
+		m := *mm
+		m.Utilization = nil
+		m.Tags = append([]string{}, mm.Tags...)
+		sort.Strings(m.Tags)
+		sorted = append(sorted, &m)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if si, sj := CanonicalSite(sorted[i].Site), CanonicalSite(sorted[j].Site); si != sj {
+			return si < sj
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
 }
@@ -1,14 +1,19 @@
 package state_test
 
 import (
+	"errors"
 	"github.com/System233/enkit/lib/srand"
 	"github.com/System233/enkit/machinist/state"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestReadInController(t *testing.T) {
@@ -56,3 +61,226 @@ func TestReadInController(t *testing.T) {
 		assert.NotNil(t, err)
 	})
 }
+
+func TestWriteControllerDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	machines := []*state.Machine{
+		{Name: "node02", Site: "lab2", Tags: []string{"gpu", "big"}, Ips: []net.IP{net.ParseIP("10.0.0.2")}},
+		{Name: "node01", Tags: []string{"cpu"}},
+		{Name: "node01", Site: "lab2", Tags: []string{"zz", "aa", "mm"}},
+	}
+
+	// The same machines, registered in a different order, and with tags in a different order.
+	first := &state.MachineController{}
+	second := &state.MachineController{}
+	for i := range machines {
+		f := *machines[i]
+		assert.Nil(t, state.AddMachine(first, &f))
+
+		s := *machines[len(machines)-1-i]
+		s.Tags = append([]string{}, s.Tags...)
+		sort.Sort(sort.Reverse(sort.StringSlice(s.Tags)))
+		assert.Nil(t, state.AddMachine(second, &s))
+	}
+
+	fpath := filepath.Join(dir, "first.json")
+	spath := filepath.Join(dir, "second.json")
+	assert.Nil(t, state.WriteController(first, fpath))
+	assert.Nil(t, state.WriteController(second, spath))
+
+	fdata, err := ioutil.ReadFile(fpath)
+	assert.Nil(t, err)
+	sdata, err := ioutil.ReadFile(spath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(fdata), string(sdata))
+	assert.Equal(t, first.Hash, second.Hash)
+	assert.Equal(t, uint64(1), first.Revision)
+
+	// Registration order is preserved in memory.
+	assert.Equal(t, "node02", first.Machines[0].Name)
+	assert.Equal(t, []string{"gpu", "big"}, first.Machines[0].Tags)
+
+	loaded, err := state.ReadInController(fpath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), loaded.Revision)
+	assert.Equal(t, first.Hash, loaded.Hash)
+	assert.Equal(t, "default", loaded.Machines[0].Site)
+	assert.Equal(t, "node01", loaded.Machines[0].Name)
+}
+
+func TestSaveControllerUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	m := &state.MachineController{}
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "node01", Tags: []string{"gpu"}}))
+
+	written, revision, err := state.SaveController(m, path)
+	assert.Nil(t, err)
+	assert.True(t, written)
+	assert.Equal(t, uint64(1), revision)
+
+	// Nothing changed, the file is not touched.
+	assert.Nil(t, os.Remove(path))
+	written, revision, err = state.SaveController(m, path)
+	assert.Nil(t, err)
+	assert.False(t, written)
+	assert.Equal(t, uint64(1), revision)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Utilization samples are refreshed continuously, and are not a change of the state.
+	assert.True(t, state.SetUtilization(m, "", "node01", &state.Utilization{Sampled: time.Now(), Users: 3, Load5: 1.5}))
+	written, revision, err = state.SaveController(m, path)
+	assert.Nil(t, err)
+	assert.False(t, written)
+	assert.Equal(t, uint64(1), revision)
+	assert.True(t, state.SetUtilization(m, "", "node01", &state.Utilization{Sampled: time.Now().Add(10 * time.Second), Users: 1}))
+	written, _, err = state.SaveController(m, path)
+	assert.Nil(t, err)
+	assert.False(t, written)
+
+	assert.True(t, state.SetDrained(m, "", "node01", true))
+	written, revision, err = state.SaveController(m, path)
+	assert.Nil(t, err)
+	assert.True(t, written)
+	assert.Equal(t, uint64(2), revision)
+
+	// A reloaded state keeps its revision, and is not written again unless modified.
+	loaded, err := state.ReadInController(path)
+	assert.Nil(t, err)
+	assert.Nil(t, state.GetMachine(loaded, "", "node01").Utilization)
+	written, revision, err = state.SaveController(loaded, path)
+	assert.Nil(t, err)
+	assert.False(t, written)
+	assert.Equal(t, uint64(2), revision)
+}
+
+func TestReadInControllerLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	legacy := `{"Machines":[{"name":"node02","ips":["10.0.0.2"],"tags":["gpu"]},{"name":"node01","ips":null,"tags":null,"drained":true}]}`
+	assert.Nil(t, ioutil.WriteFile(path, []byte(legacy), 0644))
+
+	m, err := state.ReadInController(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), m.Revision)
+	assert.Equal(t, "", m.Hash)
+	assert.Equal(t, 2, len(m.Machines))
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.2")}, m.Machines[0].Ips)
+	assert.True(t, state.GetMachine(m, "", "node01").Drained)
+
+	// The first write converts the file to the new format.
+	written, revision, err := state.SaveController(m, path)
+	assert.Nil(t, err)
+	assert.True(t, written)
+	assert.Equal(t, uint64(1), revision)
+	m, err = state.ReadInController(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), m.Revision)
+	assert.Equal(t, 2, len(m.Machines))
+}
+
+func TestFreeMachines(t *testing.T) {
+	now := time.Now()
+	sample := func(users uint32, load float64, cpus uint32, free uint64, age time.Duration) *state.Utilization {
+		return &state.Utilization{Sampled: now.Add(-age), Users: users, Load5: load, Cpus: cpus, MemoryFree: free}
+	}
+
+	m := &state.MachineController{}
+	for _, machine := range []*state.Machine{
+		{Name: "busy", Tags: []string{"gpu"}, Utilization: sample(2, 0.1, 8, 1<<30, time.Second)},
+		{Name: "loaded", Tags: []string{"gpu"}, Utilization: sample(0, 8, 8, 1<<30, time.Second)},
+		{Name: "idle-small", Tags: []string{"gpu"}, Utilization: sample(0, 0.5, 1, 1<<30, time.Second)},
+		{Name: "idle", Tags: []string{"gpu", "big"}, Utilization: sample(0, 0.5, 8, 1<<20, time.Second)},
+		{Name: "idle-more-mem", Tags: []string{"gpu"}, Utilization: sample(0, 0.5, 8, 1<<30, time.Second)},
+		{Name: "stale", Tags: []string{"gpu"}, Utilization: sample(0, 0, 8, 1<<30, time.Hour)},
+		{Name: "never-reported", Tags: []string{"gpu"}},
+		{Name: "cpu", Tags: []string{"cpu"}, Utilization: sample(0, 0, 8, 1<<30, time.Second)},
+	} {
+		assert.Nil(t, state.AddMachine(m, machine))
+	}
+
+	names := func(machines []*state.Machine) []string {
+		var result []string
+		for _, m := range machines {
+			result = append(result, m.Name)
+		}
+		return result
+	}
+
+	free := state.FreeMachines(m, "", "gpu", now, time.Minute)
+	assert.Equal(t, []string{"idle-more-mem", "idle", "idle-small", "loaded", "busy"}, names(free))
+	assert.Equal(t, []string{"cpu"}, names(state.FreeMachines(m, "", "cpu", now, time.Minute)))
+	assert.Equal(t, 6, len(state.FreeMachines(m, "", "", now, time.Minute)))
+
+	// A larger staleness threshold qualifies the stale machine again.
+	assert.Contains(t, names(state.FreeMachines(m, "", "gpu", now, 2*time.Hour)), "stale")
+
+	// Drained machines are excluded, and stay drained across re-registrations.
+	assert.True(t, state.SetDrained(m, "", "idle-more-mem", true))
+	assert.False(t, state.SetDrained(m, "", "unknown", true))
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "idle-more-mem", Tags: []string{"gpu"}}))
+	assert.Equal(t, []string{"idle", "idle-small", "loaded", "busy"}, names(state.FreeMachines(m, "", "gpu", now, time.Minute)))
+
+	assert.True(t, state.SetDrained(m, "", "idle-more-mem", false))
+	assert.True(t, state.SetUtilization(m, "", "idle-more-mem", sample(1, 0, 8, 1<<30, 0)))
+	assert.False(t, state.SetUtilization(m, "", "unknown", sample(1, 0, 8, 1<<30, 0)))
+	assert.Equal(t, []string{"idle", "idle-small", "loaded", "idle-more-mem", "busy"}, names(state.FreeMachines(m, "", "gpu", now, time.Minute)))
+}
+
+func TestSites(t *testing.T) {
+	now := time.Now()
+	sample := &state.Utilization{Sampled: now, Cpus: 4}
+
+	m := &state.MachineController{}
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "node01", Tags: []string{"gpu"}, Utilization: sample}))
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "node01", Site: "lab2", Tags: []string{"gpu"}, Utilization: sample}))
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "node02", Site: "lab2", Tags: []string{"cpu"}, Utilization: sample}))
+	// The same name in different sites refers to different machines.
+	assert.Equal(t, 3, len(m.Machines))
+
+	// Machines registered without a site belong to the default site.
+	def := state.GetMachine(m, "", "node01")
+	assert.NotNil(t, def)
+	assert.Equal(t, state.DefaultSite, def.Site)
+	assert.Equal(t, def, state.GetMachine(m, state.DefaultSite, "node01"))
+	lab2 := state.GetMachine(m, "lab2", "node01")
+	assert.NotNil(t, lab2)
+	assert.NotEqual(t, def, lab2)
+	assert.Nil(t, state.GetMachine(m, "lab2", "node03"))
+	assert.Nil(t, state.GetMachine(m, "", "node02"))
+
+	// Machines from state files predating sites are in the default site.
+	m.Machines = append(m.Machines, &state.Machine{Name: "legacy"})
+	assert.NotNil(t, state.GetMachine(m, state.DefaultSite, "legacy"))
+	assert.Equal(t, 2, len(state.MachinesInSite(m, state.DefaultSite)))
+	assert.Equal(t, 2, len(state.MachinesInSite(m, "lab2")))
+	assert.Equal(t, 4, len(state.MachinesInSite(m, "")))
+
+	// Draining is scoped to the site.
+	assert.True(t, state.SetDrained(m, "lab2", "node01", true))
+	assert.False(t, state.SetDrained(m, "lab3", "node01", true))
+	assert.True(t, lab2.Drained)
+	assert.False(t, def.Drained)
+
+	free := state.FreeMachines(m, "", "gpu", now, time.Minute)
+	assert.Equal(t, 1, len(free))
+	assert.Equal(t, state.DefaultSite, free[0].Site)
+	assert.Equal(t, 0, len(state.FreeMachines(m, "lab2", "gpu", now, time.Minute)))
+	assert.Equal(t, 1, len(state.FreeMachines(m, "lab2", "", now, time.Minute)))
+}
+
+func TestAddMachineInQuota(t *testing.T) {
+	m := &state.MachineController{}
+	assert.Nil(t, state.AddMachineInQuota(m, &state.Machine{Name: "node01", Site: "lab2"}, 2))
+	assert.Nil(t, state.AddMachineInQuota(m, &state.Machine{Name: "node02", Site: "lab2"}, 2))
+
+	err := state.AddMachineInQuota(m, &state.Machine{Name: "node03", Site: "lab2"}, 2)
+	assert.True(t, errors.Is(err, state.ErrSiteFull), "%v", err)
+	assert.Nil(t, state.GetMachine(m, "lab2", "node03"))
+
+	// Machines already in the site can register again, and other sites are not affected.
+	assert.Nil(t, state.AddMachineInQuota(m, &state.Machine{Name: "node02", Site: "lab2", Tags: []string{"gpu"}}, 2))
+	assert.Equal(t, []string{"gpu"}, state.GetMachine(m, "lab2", "node02").Tags)
+	assert.Nil(t, state.AddMachineInQuota(m, &state.Machine{Name: "node03"}, 2))
+	assert.Nil(t, state.AddMachineInQuota(m, &state.Machine{Name: "node03", Site: "lab2"}, 0))
+	assert.Equal(t, 4, len(m.Machines))
+}
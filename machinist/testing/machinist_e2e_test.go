@@ -83,16 +83,32 @@ func TestJoinServerAndPoll(t *testing.T) {
 			config.WithEnableMetrics(false),
 		),
 	})
+
+	// Same name as a node in the default site, but in a different site.
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("test01"),
+		machine.WithSite("lab2"),
+		machine.WithIps([]string{"10.1.0.4"}),
+		machine.WithTags([]string{"far"}),
+		machine.WithMachinistFlags(
+			config.WithListener(lis),
+			config.WithEnableMetrics(false),
+		),
+	})
 	// IMPORTANT TIME TTL, LETS CONTROLPLANE WRITE AND DO ASYNC ACTIVITIES
 	time.Sleep(200 * time.Millisecond)
 
-	assert.Equal(t, 2, len(mController.Nodes()))
-	assert.NotNil(t, state.GetMachine(mController.State, "test02"))
-	assert.NotNil(t, state.GetMachine(mController.State, "test01"))
+	assert.Equal(t, 3, len(mController.Nodes()))
+	assert.NotNil(t, state.GetMachine(mController.State, "", "test02"))
+	assert.NotNil(t, state.GetMachine(mController.State, "", "test01"))
+	assert.NotNil(t, state.GetMachine(mController.State, "lab2", "test01"))
 
 	//TODO(adam): table test this
 	for _, v := range mController.Nodes() {
-		if v.Name == "test01" {
+		if v.Name == "test01" && v.Site == "lab2" {
+			assert.Equal(t, []string{"far"}, v.Tags)
+		} else if v.Name == "test01" {
 			assert.Equal(t, []string{"big", "heavy"}, v.Tags)
 		} else if v.Name == "test02" {
 			assert.Equal(t, []string{"teeny", "weeny"}, v.Tags)
@@ -106,17 +122,34 @@ func TestJoinServerAndPoll(t *testing.T) {
 	tagsRes, err := customResolver.LookupTXT(context.TODO(), "test01.enkit")
 	assert.Nil(t, err)
 	assert.Equal(t, []string{"big", "heavy"}, tagsRes)
+	// Nodes are scoped by site, nodes in the default site are also reachable without.
+	res, err = customResolver.LookupHost(context.TODO(), "test01.default.enkitdev")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.4"}, res)
+	res, err = customResolver.LookupHost(context.TODO(), "test01.lab2.enkit")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.1.0.4"}, res)
+	tagsRes, err = customResolver.LookupTXT(context.TODO(), "test01.lab2.enkitdev")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"far"}, tagsRes)
+
 	allRecordsRes, err := customResolver.LookupHost(context.TODO(), "_all.enkitdev")
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(allRecordsRes))
+	assert.Equal(t, 3, len(allRecordsRes))
+	siteRecordsRes, err := customResolver.LookupHost(context.TODO(), "_all.lab2.enkitdev")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.1.0.4"}, siteRecordsRes)
+	siteRecordsRes, err = customResolver.LookupHost(context.TODO(), "_all.default.enkit")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.4", "10.0.0.1"}, siteRecordsRes)
 
 	infoRecords, err := customResolver.LookupTXT(context.TODO(), "_info.enkitdev")
 	assert.NoError(t, err)
-	assert.Equal(t, len(infoRecords), 2)
-	assert.ElementsMatch(t, []string{"{name:test01,ip:10.0.0.4}", "{name:test02,ip:10.0.0.1}"}, infoRecords)
+	assert.Equal(t, len(infoRecords), 3)
+	assert.ElementsMatch(t, []string{"{name:test01,ip:10.0.0.4}", "{name:test02,ip:10.0.0.1}", "{name:test01,ip:10.1.0.4}"}, infoRecords)
 
 	assert.Nil(t, s.Stop())
-	assert.ElementsMatch(t, []string{"10.0.0.4", "10.0.0.1"}, allRecordsRes)
+	assert.ElementsMatch(t, []string{"10.0.0.4", "10.0.0.1", "10.1.0.4"}, allRecordsRes)
 	time.Sleep(20 * time.Millisecond)
 	//Test serialization
 	dnsLis, customResolver = registerPort(t)
@@ -151,6 +184,9 @@ func TestJoinServerAndPoll(t *testing.T) {
 	tagsRes, err = customResolver.LookupTXT(context.TODO(), "test01.enkit")
 	assert.Nil(t, err)
 	assert.Equal(t, []string{"big", "heavy"}, tagsRes)
+	res, err = customResolver.LookupHost(context.TODO(), "test01.lab2.enkit")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.1.0.4"}, res)
 	assert.Nil(t, mainServer.Stop())
 }
 
@@ -53,6 +53,9 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 // Config is the content of the proxy configuration file.
@@ -115,6 +118,7 @@ type Flags struct {
 	ConfigContent          []byte
 	ConfigName             string
 	DisabledAuthentication bool
+	PolicyFile             string
 }
 
 // DefaultFlags returns the default flags.
@@ -141,6 +145,7 @@ func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 
 	set.ByteFileVar(&fl.ConfigContent, prefix+"config", fl.ConfigName, "Default config file location.", kflags.WithFilename(&fl.ConfigName))
 	set.BoolVar(&fl.DisabledAuthentication, prefix+"without-authentication", false, "allow tunneling even without authentication")
+	set.StringVar(&fl.PolicyFile, prefix+"policy", "", "File with the per user policies of the destinations that can be tunneled to, in addition to the tunnels allowed by the config file. Reloaded on SIGHUP.")
 
 	return fl
 }
@@ -167,6 +172,8 @@ type Options struct {
 
 	authenticate               oauth.Authenticate
 	withoutNasshAuthentication bool
+
+	policy *utils.PolicyFile
 }
 
 type Modifier func(opt *Options) error
@@ -202,6 +209,20 @@ func WithAuthenticator(auth oauth.Authenticate) Modifier {
 	}
 }
 
+// WithPolicyFile enforces the per user policies in the file on tunnels, see utils.Policy.
+//
+// The file is reloaded every time the proxy receives a SIGHUP.
+func WithPolicyFile(path string) Modifier {
+	return func(op *Options) error {
+		policy, err := utils.LoadPolicyFile(path)
+		if err != nil {
+			return kflags.NewUsageErrorf("Invalid policy file: %w", err)
+		}
+		op.policy = policy
+		return nil
+	}
+}
+
 func WithHttpStarter(starter Starter) Modifier {
 	return func(op *Options) error {
 		op.proxy = starter
@@ -313,6 +334,11 @@ func FromFlags(flags *Flags) Modifier {
 		if err := WithMetricsFlags(flags.Prometheus)(op); err != nil {
 			return err
 		}
+		if flags.PolicyFile != "" {
+			if err := WithPolicyFile(flags.PolicyFile)(op); err != nil {
+				return err
+			}
+		}
 
 		return WithConfig(config)(op)
 	}
@@ -325,6 +351,7 @@ type Enproxy struct {
 	domains []string
 
 	nproxy   *nasshp.NasshProxy
+	policy   *utils.PolicyFile
 	register prometheus.Registerer
 	gatherer prometheus.Gatherer
 
@@ -365,7 +392,11 @@ func New(rng *rand.Rand, mods ...Modifier) (*Enproxy, error) {
 			authenticate = nil
 		}
 
-		nproxy, err = nasshp.New(rng, authenticate, append([]nasshp.Modifier{nasshp.WithFilter(wl.Allow), nasshp.WithLogging(op.log)}, op.nmods...)...)
+		nmods := []nasshp.Modifier{nasshp.WithFilter(wl.Allow), nasshp.WithLogging(op.log)}
+		if op.policy != nil {
+			nmods = append(nmods, nasshp.WithPolicy(op.policy))
+		}
+		nproxy, err = nasshp.New(rng, authenticate, append(nmods, op.nmods...)...)
 		if err != nil {
 			return nil, err
 		}
@@ -397,6 +428,7 @@ func New(rng *rand.Rand, mods ...Modifier) (*Enproxy, error) {
 		domains:  append(append([]string{}, op.config.Domains...), hproxy.Domains...),
 		proxy:    op.proxy,
 		nproxy:   nproxy,
+		policy:   op.policy,
 		metrics:  op.metrics,
 		gatherer: op.gatherer,
 		register: op.register,
@@ -421,6 +453,31 @@ func (ep *Enproxy) Run() error {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 		go ep.nproxy.Run(ctx)
+		if ep.policy != nil {
+			go ep.ReloadPolicyOnSignal(ctx, syscall.SIGHUP)
+		}
 	}
 	return ep.RunProxy()
 }
+
+// ReloadPolicyOnSignal reloads the policy file every time one of the signals is received, until ctx is canceled.
+//
+// If the file cannot be loaded, an error is logged and the policies previously loaded are kept.
+func (ep *Enproxy) ReloadPolicyOnSignal(ctx context.Context, signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+		if err := ep.policy.Reload(); err != nil {
+			ep.log.Errorf("Keeping the previous policies - %s", err)
+			continue
+		}
+		ep.log.Infof("Policies reloaded")
+	}
+}
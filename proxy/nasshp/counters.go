@@ -1,6 +1,8 @@
 package nasshp
 
 import (
+	"sync"
+
 	"github.com/System233/enkit/proxy/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -19,6 +21,7 @@ type ProxyErrors struct {
 	ProxyInvalidAuth     utils.Counter
 	ProxyInvalidHostPort utils.Counter
 	ProxyCouldNotEncrypt utils.Counter
+	ProxyInvalidProto    utils.Counter
 	ProxyAllow           AllowErrors
 
 	ConnectInvalidSID utils.Counter
@@ -32,6 +35,43 @@ type ProxyErrors struct {
 	SshDialFailed    utils.Counter
 }
 
+type policyDenialKey struct {
+	user    string
+	pattern string
+}
+
+// PolicyCounters counts the connections denied by the Policy, by user and destination pattern.
+type PolicyCounters struct {
+	denied sync.Map // policyDenialKey -> *utils.Counter
+}
+
+// Increment counts a denial. Denials not caused by a deny pattern are counted with pattern "none".
+func (pc *PolicyCounters) Increment(denial *utils.Denial) {
+	key := policyDenialKey{user: denial.User, pattern: denial.Pattern}
+	if key.pattern == "" {
+		key.pattern = "none"
+	}
+	counter, _ := pc.denied.LoadOrStore(key, new(utils.Counter))
+	counter.(*utils.Counter).Increment()
+}
+
+// Get returns the number of denials for the user and pattern.
+func (pc *PolicyCounters) Get(user, pattern string) uint64 {
+	counter, found := pc.denied.Load(policyDenialKey{user: user, pattern: pattern})
+	if !found {
+		return 0
+	}
+	return counter.(*utils.Counter).Get()
+}
+
+func (pc *PolicyCounters) collect(ch chan<- prometheus.Metric) {
+	pc.denied.Range(func(key, value interface{}) bool {
+		k := key.(policyDenialKey)
+		ch <- prometheus.MustNewConstMetric(descPolicyDenied, prometheus.CounterValue, float64(value.(*utils.Counter).Get()), k.user, k.pattern)
+		return true
+	})
+}
+
 type BrowserWindowCounters struct {
 	BrowserWindowReset    utils.Counter
 	BrowserWindowResumed  utils.Counter
@@ -77,8 +117,19 @@ type ExpireCounters struct {
 	ExpireYoungest utils.Counter
 }
 
+type UDPCounters struct {
+	UDPFlowStarted utils.Counter
+	UDPFlowExpired utils.Counter
+	UDPDialFailed  utils.Counter
+
+	UDPDatagramsToBackend   utils.Counter
+	UDPDatagramsFromBackend utils.Counter
+	UDPDatagramsTooLarge    utils.Counter
+}
+
 type ProxyCounters struct {
 	ReadWriterCounters
+	UDPCounters
 
 	SshProxyStarted utils.Counter
 	SshProxyStopped utils.Counter
@@ -172,6 +223,12 @@ var (
 		nil, prometheus.Labels{"url": "/proxy", "error": "could not encrypt", "type": "internal"},
 	)
 
+	descProxyInvalidProto = prometheus.NewDesc(
+		"nasshp_url_errors",
+		helpError,
+		nil, prometheus.Labels{"url": "/proxy", "error": "invalid protocol", "type": "bad client"},
+	)
+
 	descProxyInvalidCookie = prometheus.NewDesc(
 		"nasshp_url_errors",
 		helpError,
@@ -335,6 +392,38 @@ var (
 		nil, prometheus.Labels{"type": "proxy", "action": "stopped"},
 	)
 
+	descUDPFlowStarted = prometheus.NewDesc(
+		"nasshp_udp_flows",
+		"Number of UDP flows forwarded to backends",
+		nil, prometheus.Labels{"action": "started"},
+	)
+	descUDPFlowExpired = prometheus.NewDesc(
+		"nasshp_udp_flows",
+		"Number of UDP flows forwarded to backends",
+		nil, prometheus.Labels{"action": "expired"},
+	)
+	descUDPDialFailed = prometheus.NewDesc(
+		"nasshp_udp_flows",
+		"Number of UDP flows forwarded to backends",
+		nil, prometheus.Labels{"action": "failed"},
+	)
+
+	descUDPDatagramsToBackend = prometheus.NewDesc(
+		"nasshp_udp_datagrams",
+		"Number of datagrams forwarded by UDP sessions",
+		nil, prometheus.Labels{"direction": "to backend"},
+	)
+	descUDPDatagramsFromBackend = prometheus.NewDesc(
+		"nasshp_udp_datagrams",
+		"Number of datagrams forwarded by UDP sessions",
+		nil, prometheus.Labels{"direction": "from backend"},
+	)
+	descUDPDatagramsTooLarge = prometheus.NewDesc(
+		"nasshp_udp_datagrams",
+		"Number of datagrams forwarded by UDP sessions",
+		nil, prometheus.Labels{"direction": "dropped, larger than mtu"},
+	)
+
 	descBrowserWindowReset = prometheus.NewDesc(
 		"nasshp_window_reset",
 		"Number of times a browser window rack/wack was reset to 0 (should be rare)",
@@ -436,12 +525,20 @@ var (
 		"Epoch in nanoseconds of the most recent session expired",
 		nil, nil,
 	)
+
+	descPolicyDenied = prometheus.NewDesc(
+		"nasshp_policy_denied",
+		"Total number of connections denied by the policy, by user and deny pattern",
+		[]string{"user", "pattern"}, nil,
+	)
 )
 
 type nasshCollector NasshProxy
 
 func (nc *nasshCollector) Describe(ch chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(nc, ch)
+	// Only collected once a connection is denied.
+	ch <- descPolicyDenied
 }
 
 func (nc *nasshCollector) Collect(ch chan<- prometheus.Metric) {
@@ -467,6 +564,7 @@ func (nc *nasshCollector) Collect(ch chan<- prometheus.Metric) {
 		{descProxyInvalidAuth, errors.ProxyInvalidAuth.Get()},
 		{descProxyInvalidHostPort, errors.ProxyInvalidHostPort.Get()},
 		{descProxyCouldNotEncrypt, errors.ProxyCouldNotEncrypt.Get()},
+		{descProxyInvalidProto, errors.ProxyInvalidProto.Get()},
 
 		{descProxyInvalidCookie, errors.ProxyAllow.InvalidCookie.Get()},
 		{descProxyInvalidHostFormat, errors.ProxyAllow.InvalidHostFormat.Get()},
@@ -504,6 +602,13 @@ func (nc *nasshCollector) Collect(ch chan<- prometheus.Metric) {
 		{descSshProxyStarted, counters.SshProxyStarted.Get()},
 		{descSshProxyStopped, counters.SshProxyStopped.Get()},
 
+		{descUDPFlowStarted, counters.UDPFlowStarted.Get()},
+		{descUDPFlowExpired, counters.UDPFlowExpired.Get()},
+		{descUDPDialFailed, counters.UDPDialFailed.Get()},
+		{descUDPDatagramsToBackend, counters.UDPDatagramsToBackend.Get()},
+		{descUDPDatagramsFromBackend, counters.UDPDatagramsFromBackend.Get()},
+		{descUDPDatagramsTooLarge, counters.UDPDatagramsTooLarge.Get()},
+
 		{descSessionResumed, sessions.Resumed.Get()},
 		{descSessionInvalid, sessions.Invalid.Get()},
 		{descSessionCreated, sessions.Created.Get()},
@@ -537,4 +642,5 @@ func (nc *nasshCollector) Collect(ch chan<- prometheus.Metric) {
 	for _, metric := range metrics {
 		ch <- prometheus.MustNewConstMetric(metric.desc, prometheus.CounterValue, float64(metric.value))
 	}
+	np.denied.collect(ch)
 }
@@ -3,6 +3,7 @@ package nasshp
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/System233/enkit/lib/kflags"
@@ -12,6 +13,7 @@ import (
 	"github.com/System233/enkit/proxy/utils"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
 	"io"
 	"math/rand"
 	"net"
@@ -88,6 +90,7 @@ type NasshProxy struct {
 	authenticator oauth.Authenticate
 	encoder       token.BinaryEncoder
 	filter        Filter
+	policy        Policy
 	resolver      Resolver
 
 	// Timeouts to use, must be set.
@@ -97,6 +100,13 @@ type NasshProxy struct {
 	// Where to redirect users after authentication to get their connections going.
 	relayHost string
 
+	// Largest datagram UDP sessions can forward.
+	udpMTU int
+
+	// Public key of the CA signing the host keys of the tunneled domains, in authorized_keys format.
+	hostCA        string
+	hostCADomains string
+
 	// sync.Pool of buffers to allocate and use for clients.
 	pool *BufferPool
 
@@ -107,6 +117,7 @@ type NasshProxy struct {
 	errors   ProxyErrors
 	counters ProxyCounters
 	expires  ExpireCounters
+	denied   PolicyCounters
 }
 
 func (np *NasshProxy) RelayHost() string {
@@ -252,6 +263,10 @@ type Flags struct {
 	SymmetricKey []byte
 	BufferSize   int
 	RelayHost    string
+	UDPMaxMTU    int
+
+	HostCA        []byte
+	HostCADomains []string
 }
 
 func DefaultTimeouts() *Timeouts {
@@ -262,6 +277,7 @@ func DefaultTimeouts() *Timeouts {
 		BrowserAckTimeout:   time.Second * 1,
 		ConnWriteTimeout:    time.Second * 60,
 		ResolutionTimeout:   time.Second * 30,
+		UDPIdleTimeout:      time.Minute * 2,
 	}
 }
 
@@ -279,6 +295,12 @@ func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.IntVar(&fl.BufferSize, prefix+"buffer-size", 8192, "Size of the buffers to use to send/receive data for connections")
 	set.StringVar(&fl.RelayHost, prefix+"host-port", "", "The hostname and port number the nassh client has to be redirected to to establish an ssh connection. "+
 		"Typically, this is the DNS name and port 80 or 443 of the host running this proxy.")
+	set.IntVar(&fl.UDPMaxMTU, prefix+"udp-max-mtu", 8192, "Largest datagram UDP tunnels can forward. Clients requesting a larger MTU are capped to this value")
+	set.ByteFileVar(&fl.HostCA, prefix+"host-ca-file", "",
+		"Path of the file containing the public key of the CA signing the host keys of the tunneled machines, like the machinist CA. "+
+			"The key is sent to clients when a tunnel is established, so they can verify the ssh hosts they reach through the proxy")
+	set.StringArrayVar(&fl.HostCADomains, prefix+"host-ca-domains", nil,
+		"Host patterns the keys signed by the --host-ca-file CA are trusted for, like '*.enkit.cloud'. Defaults to all hosts")
 
 	set.DurationVar(&fl.BrowserWriteTimeout, prefix+"browser-write-timeout", fl.BrowserWriteTimeout,
 		"How long to wait for a write to the browser to complete before giving up.")
@@ -288,6 +310,8 @@ func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 		"How long to wait for a write to the proxied connection (eg, ssh) to complete before giving up.")
 	set.DurationVar(&fl.ResolutionTimeout, prefix+"resolution-timeout", fl.ResolutionTimeout,
 		"How long to wait to resolve the name of the destination of the proxied connection")
+	set.DurationVar(&fl.UDPIdleTimeout, prefix+"udp-idle-timeout", fl.UDPIdleTimeout,
+		"How long to keep the socket of a UDP flow open without any datagram sent or received")
 
 	fl.ExpirationPolicy.Register(set, prefix)
 	return fl
@@ -320,6 +344,17 @@ func WithBufferSize(size int) Modifier {
 	}
 }
 
+// WithUDPMaxMTU configures the largest datagram UDP sessions can forward.
+func WithUDPMaxMTU(mtu int) Modifier {
+	return func(np *NasshProxy, o *options) error {
+		if mtu <= 0 || mtu > MaxDatagramSize {
+			return kflags.NewUsageErrorf("invalid UDP MTU %d - must be between 1 and %d", mtu, MaxDatagramSize)
+		}
+		np.udpMTU = mtu
+		return nil
+	}
+}
+
 func WithRelayHost(relayHost string) Modifier {
 	return func(np *NasshProxy, o *options) error {
 		np.relayHost = relayHost
@@ -336,6 +371,56 @@ func WithFilter(filter Filter) Modifier {
 	}
 }
 
+// Policy decides which destinations each user can connect to, like utils.Policies.
+type Policy interface {
+	Check(proto string, hostport string, creds *oauth.CredentialsCookie) (utils.Verdict, *utils.Denial)
+}
+
+// WithPolicy enforces the policy on every connection, in addition to the Filter.
+//
+// Connections denied by the policy are rejected with http.StatusForbidden,
+// and the utils.Denial returned by the policy as a JSON body.
+func WithPolicy(policy Policy) Modifier {
+	return func(np *NasshProxy, o *options) error {
+		np.policy = policy
+		return nil
+	}
+}
+
+// HostCAHeader and HostCADomainsHeader are the headers of the response to a /proxy request
+// carrying the public key of the host CA, and the host patterns it is trusted for, comma separated.
+const (
+	HostCAHeader        = "X-Enkit-Host-CA"
+	HostCADomainsHeader = "X-Enkit-Host-CA-Domains"
+)
+
+// WithHostCA distributes the public key of the CA signing the ssh host keys of the tunneled machines.
+//
+// key is in authorized_keys format, and is trusted by clients for the hosts
+// matching domains, or any host if domains is empty.
+func WithHostCA(key []byte, domains []string) Modifier {
+	return func(np *NasshProxy, o *options) error {
+		if len(key) == 0 {
+			return nil
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(key)
+		if err != nil {
+			return kflags.NewUsageErrorf("invalid host CA public key - %w", err)
+		}
+		for _, domain := range domains {
+			if domain == "" || strings.ContainsAny(domain, ", \t") {
+				return kflags.NewUsageErrorf("invalid host CA domain %q - must be a non empty ssh host pattern", domain)
+			}
+		}
+		if len(domains) == 0 {
+			domains = []string{"*"}
+		}
+		np.hostCA = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+		np.hostCADomains = strings.Join(domains, ",")
+		return nil
+	}
+}
+
 func FromFlags(fl *Flags) Modifier {
 	return func(np *NasshProxy, o *options) error {
 		relayHost := strings.TrimSpace(fl.RelayHost)
@@ -354,6 +439,8 @@ func FromFlags(fl *Flags) Modifier {
 			WithRelayHost(fl.RelayHost),
 			WithSymmetricOptions(token.UseSymmetricKey(fl.SymmetricKey)),
 			WithBufferSize(fl.BufferSize),
+			WithUDPMaxMTU(fl.UDPMaxMTU),
+			WithHostCA(fl.HostCA, fl.HostCADomains),
 			WithTimeouts(fl.Timeouts),
 			WithExpirationPolicy(fl.ExpirationPolicy),
 		}
@@ -411,6 +498,7 @@ func New(rng *rand.Rand, authenticator oauth.Authenticate, mods ...Modifier) (*N
 		epolicy:       DefaultExpirationPolicy(),
 		authenticator: authenticator,
 		log:           logger.Nil,
+		udpMTU:        DefaultUDPMTU,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				origin := strings.TrimSpace(r.Header.Get("Origin"))
@@ -490,6 +578,7 @@ func (np *NasshProxy) ServeProxy(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	host := params.Get("host")
 	port := params.Get("port")
+	proto := params.Get("proto")
 	origin := r.Header.Get("Origin")
 	if origin != "" && OriginMatcher.MatchString(origin) {
 		w.Header().Add("Vary", "Origin")
@@ -512,18 +601,41 @@ func (np *NasshProxy) ServeProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hostport := net.JoinHostPort(resolvedHost, resolvedPort)
+	dest := target{proto: "tcp", hostport: net.JoinHostPort(resolvedHost, resolvedPort)}
+	switch proto {
+	case "", "tcp":
+	case "udp":
+		// The MTU is the smallest between the one requested by the client and the one configured.
+		dest.proto, dest.mtu = proto, np.udpMTU
+		if mtu := params.Get("mtu"); mtu != "" {
+			requested, err := strconv.Atoi(mtu)
+			if err != nil || requested <= 0 {
+				np.requestError(&np.errors.ProxyInvalidProto, w, "invalid mtu: %q", mtu)
+				return
+			}
+			if requested < dest.mtu {
+				dest.mtu = requested
+			}
+		}
+	default:
+		np.requestError(&np.errors.ProxyInvalidProto, w, "invalid protocol: %q", proto)
+		return
+	}
 
-	_, allowed := np.allow(&np.errors.ProxyAllow, r, w, "", hostport)
+	_, allowed := np.allow(&np.errors.ProxyAllow, r, w, "", dest)
 	if !allowed {
 		return
 	}
 
-	sid, err := np.encoder.Encode([]byte(hostport))
+	sid, err := np.encoder.Encode([]byte(dest.String()))
 	if err != nil {
 		np.requestErrorStatus(&np.errors.ProxyCouldNotEncrypt, w, http.StatusInternalServerError,
 			"Sorry, the world is coming to an end, there was an error generating a session id. Good Luck.")
 	}
+	if np.hostCA != "" {
+		w.Header().Set(HostCAHeader, np.hostCA)
+		w.Header().Set(HostCADomainsHeader, np.hostCADomains)
+	}
 	fmt.Fprintln(w, string(sid))
 }
 
@@ -538,13 +650,15 @@ func LogId(sid string, r *http.Request, hostport string, c *oauth.CredentialsCoo
 	return fmt.Sprintf("%s[IP:%s][DEST:%s]%s", sid, r.RemoteAddr, hostport, identity)
 }
 
-func (np *NasshProxy) allow(counters *AllowErrors, r *http.Request, w http.ResponseWriter, sid, hostport string) (string, bool) {
+func (np *NasshProxy) allow(counters *AllowErrors, r *http.Request, w http.ResponseWriter, sid string, dest target) (string, bool) {
+	hostport := dest.hostport
 	logid := LogId(sid, r, hostport, nil)
 
 	var creds *oauth.CredentialsCookie
 	if np.authenticator != nil {
 		// TODO: merge credentials checking with filtering mechanism.
-		creds, err := np.authenticator(w, r, nil)
+		var err error
+		creds, err = np.authenticator(w, r, nil)
 		if err != nil {
 			np.log.Warnf("%s - authentication error: %s", logid, err)
 			np.requestError(&counters.InvalidCookie, w, "invalid request for: %s - %s", r.URL, err)
@@ -555,40 +669,98 @@ func (np *NasshProxy) allow(counters *AllowErrors, r *http.Request, w http.Respo
 		}
 		logid = LogId(sid, r, hostport, creds)
 	}
+	if np.filter == nil && np.policy == nil {
+		return logid, true
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		np.log.Infof("%s - err %v splitting host and port %s", logid, err, hostport)
+		np.requestErrorStatus(
+			&counters.InvalidHostFormat, w, http.StatusUnauthorized,
+			"Go somewhere else, you are not allowed to connect here.")
+		return logid, false
+	}
+	res, err := net.LookupHost(host)
+	if err != nil {
+		np.log.Infof("%s - err %v looking up host %s", logid, err, host)
+		np.requestErrorStatus(
+			&counters.InvalidHostName, w, http.StatusUnauthorized,
+			"Go somewhere else, you are not allowed to connect here.")
+		return logid, false
+	}
+
 	if np.filter != nil {
-		host, port, err := net.SplitHostPort(hostport)
-		if err != nil {
-			np.log.Infof("%s - err %v splitting host and port %s", logid, err, hostport)
-			np.requestErrorStatus(
-				&counters.InvalidHostFormat, w, http.StatusUnauthorized,
-				"Go somewhere else, you are not allowed to connect here.")
-			return logid, false
+		verdict := utils.VerdictUnknown
+		for _, u := range res {
+			// TODO(adam): make verdict merging configurable from ACL list
+			// TODO(adam): return here after making authz engine
+			verdict = verdict.MergeOnlyAcceptAllow(np.filter(dest.proto, net.JoinHostPort(u, port), creds))
 		}
-		res, err := net.LookupHost(host)
-		if err != nil {
-			np.log.Infof("%s - err %v looking up host %s", logid, err, host)
+		if verdict != utils.VerdictAllow {
+			np.log.Infof("%s was rejected by filter", logid)
 			np.requestErrorStatus(
-				&counters.InvalidHostName, w, http.StatusUnauthorized,
+				&counters.Unauthorized, w, http.StatusUnauthorized,
 				"Go somewhere else, you are not allowed to connect here.")
 			return logid, false
 		}
-		verdict := utils.VerdictUnknown
-		for _, u := range res {
-			// TODO(adam): make verdict merging configurable from ACL list
-			// TODO(adam): return here after making authz engine
-			verdict = verdict.MergeOnlyAcceptAllow(np.filter("tcp", net.JoinHostPort(u, port), creds))
+	}
+
+	if np.policy != nil {
+		if denial := np.checkPolicy(dest.proto, host, port, res, creds); denial != nil {
+			np.log.Infof("%s was rejected by policy - %s", logid, denial)
+			np.policyError(&counters.Unauthorized, w, denial)
+			return logid, false
 		}
+	}
+	return logid, true
+}
+
+// checkPolicy returns the reason the policy rejects a connection to host and port, nil if the connection is allowed.
+//
+// Policies can list both host names and addresses, so both the host name as
+// supplied by the user and all the addresses it resolves to are checked. The
+// connection is rejected if any of them is denied by a Deny pattern.
+// Otherwise, it is allowed if the host name is allowed, or all the addresses are.
+func (np *NasshProxy) checkPolicy(proto, host, port string, addrs []string, creds *oauth.CredentialsCookie) *utils.Denial {
+	check := func(host string) (bool, *utils.Denial) {
+		verdict, denial := np.policy.Check(proto, net.JoinHostPort(host, port), creds)
 		if verdict == utils.VerdictAllow {
-			return logid, true
+			return true, nil
 		}
+		if denial == nil {
+			denial = &utils.Denial{Destination: proto + "|" + net.JoinHostPort(host, port)}
+		}
+		return false, denial
+	}
 
-		np.log.Infof("%s was rejected by filter", logid)
-		np.requestErrorStatus(
-			&counters.Unauthorized, w, http.StatusUnauthorized,
-			"Go somewhere else, you are not allowed to connect here.")
-		return logid, false
+	allowed, denial := check(host)
+	if denial != nil && denial.Pattern != "" {
+		return denial
 	}
-	return logid, true
+	all := len(addrs) > 0
+	for _, addr := range addrs {
+		addrAllowed, addrDenial := check(addr)
+		if addrDenial != nil && addrDenial.Pattern != "" {
+			return addrDenial
+		}
+		all = all && addrAllowed
+	}
+	if allowed || all {
+		return nil
+	}
+	return denial
+}
+
+// policyError rejects a request denied by the policy, returning the denial as JSON.
+func (np *NasshProxy) policyError(counter *utils.Counter, w http.ResponseWriter, denial *utils.Denial) {
+	counter.Increment()
+	np.denied.Increment(denial)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(denial)
 }
 
 func (np *NasshProxy) ServeConnect(w http.ResponseWriter, r *http.Request) {
@@ -602,11 +774,13 @@ func (np *NasshProxy) ServeConnect(w http.ResponseWriter, r *http.Request) {
 		np.requestError(&np.errors.ConnectInvalidSID, w, "invalid sid provided")
 		return
 	}
-	hostport := string(hostportb)
-
-	logid := LogId(sid, r, hostport, nil)
+	dest, err := parseTarget(string(hostportb))
+	if err != nil {
+		np.requestError(&np.errors.ConnectInvalidSID, w, "invalid sid provided")
+		return
+	}
 
-	logid, allow := np.allow(&np.errors.ConnectAllow, r, w, sid, hostport)
+	logid, allow := np.allow(&np.errors.ConnectAllow, r, w, sid, dest)
 	if !allow {
 		return
 	}
@@ -696,6 +870,8 @@ type Timeouts struct {
 	BrowserAckTimeout   time.Duration
 
 	ConnWriteTimeout time.Duration
+
+	UDPIdleTimeout time.Duration
 }
 
 // readFromBrowser reads from the browser, and writes to the ssh connection.
@@ -966,6 +1142,10 @@ func (np *NasshProxy) Run(ctx context.Context) {
 	}
 }
 
+// ProxySsh proxies the websocket of the request to the destination of the session.
+//
+// hostport is the destination of the session, as encoded in the sid:
+// either a host:port to connect to via TCP, or a UDP destination.
 func (np *NasshProxy) ProxySsh(logid string, r *http.Request, w http.ResponseWriter, sid string, rack, wack uint32, hostport string) error {
 	np.counters.SshProxyStarted.Increment()
 	defer np.counters.SshProxyStopped.Increment()
@@ -988,7 +1168,7 @@ func (np *NasshProxy) ProxySsh(logid string, r *http.Request, w http.ResponseWri
 
 	var waiter waiter
 	if rw == nil {
-		sshconn, err := net.DialTimeout("tcp", hostport, np.timeouts.ResolutionTimeout)
+		sshconn, err := np.dial(hostport)
 		if err != nil {
 			np.errors.SshDialFailed.Increment()
 			return err
@@ -1027,6 +1207,19 @@ func (np *NasshProxy) ProxySsh(logid string, r *http.Request, w http.ResponseWri
 // handler is the http.Handler to invoke for the specified path.
 type MuxHandle func(pattern string, handler http.Handler)
 
+// dial connects to the destination of a session, as encoded in its sid.
+func (np *NasshProxy) dial(encoded string) (net.Conn, error) {
+	dest, err := parseTarget(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if dest.proto == "udp" {
+		// Sockets are created for each flow as datagrams arrive.
+		return newUDPConn(np.log, np.timeouts, &np.counters.UDPCounters, dest.hostport, dest.mtu), nil
+	}
+	return net.DialTimeout("tcp", dest.hostport, np.timeouts.ResolutionTimeout)
+}
+
 // Register is a convenience function to configure all the handlers in your favourite Mux.
 //
 // It configures the http paths and corresponding handlers that are necessary for
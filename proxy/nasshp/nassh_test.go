@@ -3,6 +3,7 @@ package nasshp
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
@@ -19,6 +20,7 @@ import (
 	"github.com/System233/enkit/lib/khttp/ktest"
 	"github.com/System233/enkit/lib/khttp/protocol"
 	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/oauth"
 	"github.com/System233/enkit/lib/srand"
 	"github.com/System233/enkit/lib/token"
 	"github.com/System233/enkit/proxy/utils"
@@ -383,3 +385,95 @@ func TestExpire(t *testing.T) {
 
 	assert.Equal(t, ExpireCounters{ExpireRuns: 7, ExpireAboveOrphanThresholdRuns: 2, ExpireAboveOrphanThresholdTotal: 8, ExpireAboveOrphanThresholdFound: 3, ExpireOrphanClosed: 1, ExpireRuthlessClosed: 1, ExpireYoungest: utils.Counter(pt2.UnixNano()), ExpireLifetimeTotal: utils.Counter(ft.Now().Sub(pt1).Seconds() + ft.Now().Sub(pt2).Seconds())}, *counters)
 }
+
+func TestPolicy(t *testing.T) {
+	policies, err := utils.NewPolicies(&utils.PolicyConfig{Policies: []utils.Policy{
+		{Name: "devs", Groups: []string{"dev"}, Allow: []string{"tcp|127.0.0.0/8:*"}, Deny: []string{"tcp|127.0.0.1:1", "tcp|local*:2"}},
+		{Name: "ops", Users: []string{"ops@example.com"}, Allow: []string{"udp|*:53"}},
+		{Name: "named", Users: []string{"named@example.com"}, Allow: []string{"tcp|localhost:*"}},
+	}})
+	require.Nil(t, err)
+
+	// Authenticates users by the X-User header, members of the dev group by X-Group.
+	authenticate := func(w http.ResponseWriter, r *http.Request, rurl *url.URL) (*oauth.CredentialsCookie, error) {
+		creds := &oauth.CredentialsCookie{Identity: oauth.Identity{Username: r.Header.Get("X-User"), Organization: "example.com"}}
+		if group := r.Header.Get("X-Group"); group != "" {
+			creds.Identity.Groups = []string{group}
+		}
+		return creds, nil
+	}
+
+	rng := rand.New(srand.Source)
+	nassh, err := New(
+		rng,
+		authenticate,
+		WithLogging(&logger.DefaultLogger{Printer: t.Logf}),
+		WithSymmetricOptions(token.WithGeneratedSymmetricKey(0)),
+		WithPolicy(policies),
+	)
+	require.Nil(t, err)
+
+	mux := http.NewServeMux()
+	nassh.Register(mux.Handle)
+	tu, err := ktest.Start(&khttp.Dumper{Log: t.Logf, Real: mux})
+	require.Nil(t, err)
+
+	getHost := func(user, group, host, port string) (int, *utils.Denial) {
+		u, err := url.Parse(tu)
+		require.Nil(t, err)
+		u.Path = "/proxy"
+		u.RawQuery = url.Values{"host": {host}, "port": {port}}.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		require.Nil(t, err)
+		req.Header.Set("X-User", user)
+		req.Header.Set("X-Group", group)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			return resp.StatusCode, nil
+		}
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		denial := &utils.Denial{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(denial))
+		return resp.StatusCode, denial
+	}
+	get := func(user, group, port string) (int, *utils.Denial) {
+		return getHost(user, group, "127.0.0.1", port)
+	}
+
+	status, _ := get("carlo", "dev", "22")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, denial := get("carlo", "dev", "1")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, &utils.Denial{User: "carlo@example.com", Destination: "tcp|127.0.0.1:1", Policy: "devs", Pattern: "tcp|127.0.0.1:1"}, denial)
+
+	status, denial = get("ops", "", "22")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, &utils.Denial{User: "ops@example.com", Destination: "tcp|127.0.0.1:22", Policy: "ops"}, denial)
+
+	status, denial = get("mallory", "", "22")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, &utils.Denial{User: "mallory@example.com", Destination: "tcp|127.0.0.1:22"}, denial)
+	get("mallory", "", "23")
+
+	// Host name patterns match the host as supplied, even if the addresses it resolves to are allowed.
+	status, _ = get("carlo", "dev", "2")
+	assert.Equal(t, http.StatusOK, status)
+	status, denial = getHost("carlo", "dev", "localhost", "2")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, &utils.Denial{User: "carlo@example.com", Destination: "tcp|localhost:2", Policy: "devs", Pattern: "tcp|local*:2"}, denial)
+	status, _ = getHost("named", "", "localhost", "22")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = get("named", "", "22")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	assert.Equal(t, uint64(1), nassh.denied.Get("carlo@example.com", "tcp|127.0.0.1:1"))
+	assert.Equal(t, uint64(1), nassh.denied.Get("ops@example.com", "none"))
+	assert.Equal(t, uint64(2), nassh.denied.Get("mallory@example.com", "none"))
+	assert.Equal(t, uint64(1), nassh.denied.Get("carlo@example.com", "tcp|local*:2"))
+	assert.Equal(t, uint64(6), nassh.errors.ProxyAllow.Unauthorized.Get())
+}
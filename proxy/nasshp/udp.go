@@ -0,0 +1,374 @@
+package nasshp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+)
+
+const (
+	// DatagramHeaderSize is the size of the header preceding each datagram
+	// carried over the stream of a UDP session: a 32 bit stream id, followed
+	// by a 16 bit length, both big endian.
+	DatagramHeaderSize = 6
+
+	// MaxDatagramSize is the largest datagram that can be represented in the header.
+	MaxDatagramSize = 0xffff
+
+	// DefaultUDPMTU is the largest datagram forwarded when none is configured.
+	DefaultUDPMTU = 1400
+)
+
+var ErrDatagramTooLarge = errors.New("datagram larger than the MTU of the session")
+
+// WriteDatagram writes a datagram belonging to the specified stream in the format used by UDP sessions.
+//
+// The header and the data are written with a single Write, so that writers
+// serializing calls to WriteDatagram never interleave datagrams.
+func WriteDatagram(w io.Writer, stream uint32, data []byte) error {
+	if len(data) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	frame := make([]byte, DatagramHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, stream)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(data)))
+	copy(frame[DatagramHeaderSize:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// DatagramReader reads datagrams from the stream of a UDP session.
+type DatagramReader struct {
+	reader *bufio.Reader
+	mtu    int
+	header [DatagramHeaderSize]byte
+}
+
+// NewDatagramReader returns a DatagramReader rejecting datagrams larger than mtu.
+func NewDatagramReader(r io.Reader, mtu int) *DatagramReader {
+	return &DatagramReader{reader: bufio.NewReader(r), mtu: mtu}
+}
+
+// Read reads the next datagram in buffer, which must be at least mtu bytes long.
+//
+// Datagrams larger than mtu are skipped, and reported by returning
+// ErrDatagramTooLarge: the stream is still usable after that error.
+// Returns the stream id the datagram belongs to, and the datagram.
+func (dr *DatagramReader) Read(buffer []byte) (uint32, []byte, error) {
+	if _, err := io.ReadFull(dr.reader, dr.header[:]); err != nil {
+		return 0, nil, err
+	}
+	stream := binary.BigEndian.Uint32(dr.header[:])
+	length := int(binary.BigEndian.Uint16(dr.header[4:]))
+	if length > dr.mtu || length > len(buffer) {
+		if _, err := io.CopyN(io.Discard, dr.reader, int64(length)); err != nil {
+			return 0, nil, err
+		}
+		return stream, nil, ErrDatagramTooLarge
+	}
+	if _, err := io.ReadFull(dr.reader, buffer[:length]); err != nil {
+		return 0, nil, err
+	}
+	return stream, buffer[:length], nil
+}
+
+// target is the destination of a session, as encoded in its sid.
+//
+// TCP sessions are encoded as just host:port, for compatibility with
+// sids created before UDP support. UDP sessions as udp|mtu|host:port.
+type target struct {
+	proto    string
+	mtu      int
+	hostport string
+}
+
+func (t target) String() string {
+	if t.proto != "udp" {
+		return t.hostport
+	}
+	return strings.Join([]string{t.proto, strconv.Itoa(t.mtu), t.hostport}, "|")
+}
+
+func parseTarget(encoded string) (target, error) {
+	if !strings.HasPrefix(encoded, "udp|") {
+		return target{proto: "tcp", hostport: encoded}, nil
+	}
+	parts := strings.SplitN(encoded, "|", 3)
+	if len(parts) != 3 {
+		return target{}, fmt.Errorf("invalid udp destination %q", encoded)
+	}
+	mtu, err := strconv.Atoi(parts[1])
+	if err != nil || mtu <= 0 || mtu > MaxDatagramSize {
+		return target{}, fmt.Errorf("invalid mtu in udp destination %q", encoded)
+	}
+	return target{proto: parts[0], mtu: mtu, hostport: parts[2]}, nil
+}
+
+// udpAddr is the net.Addr of the destination of a UDP session.
+type udpAddr string
+
+func (a udpAddr) Network() string {
+	return "udp"
+}
+
+func (a udpAddr) String() string {
+	return string(a)
+}
+
+type udpFlow struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// udpConn turns the datagrams exchanged with a UDP destination into a stream, so it can be proxied like a TCP connection.
+//
+// Each stream id in the datagrams written by the browser is a flow, forwarded
+// from a UDP socket of its own, so that replies can be routed back to the
+// client that sent the request. Flows idle for longer than the idle timeout
+// are closed.
+type udpConn struct {
+	log      logger.Logger
+	counters *UDPCounters
+	timeouts *Timeouts
+	hostport string
+	mtu      int
+
+	// Written by Write, read by dispatch.
+	writer *io.PipeWriter
+
+	incoming chan []byte
+	closed   chan struct{}
+	once     sync.Once
+
+	lock  sync.Mutex
+	flows map[uint32]*udpFlow // Protected by lock.
+
+	// Data returned by Read, never invoked concurrently by the proxy.
+	pending []byte
+
+	dlock    sync.Mutex
+	deadline time.Time // Protected by dlock.
+}
+
+func newUDPConn(log logger.Logger, timeouts *Timeouts, counters *UDPCounters, hostport string, mtu int) *udpConn {
+	reader, writer := io.Pipe()
+	uc := &udpConn{
+		log:      log,
+		counters: counters,
+		timeouts: timeouts,
+		hostport: hostport,
+		mtu:      mtu,
+		writer:   writer,
+		incoming: make(chan []byte, 64),
+		closed:   make(chan struct{}),
+		flows:    map[uint32]*udpFlow{},
+	}
+	go uc.dispatch(reader)
+	return uc
+}
+
+// dispatch parses the datagrams written to the connection, and sends each through the socket of its flow.
+func (uc *udpConn) dispatch(reader *io.PipeReader) {
+	defer reader.Close()
+
+	dr := NewDatagramReader(reader, uc.mtu)
+	buffer := make([]byte, uc.mtu)
+	for {
+		stream, data, err := dr.Read(buffer)
+		if errors.Is(err, ErrDatagramTooLarge) {
+			uc.counters.UDPDatagramsTooLarge.Increment()
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		flow, err := uc.flow(stream)
+		if err != nil {
+			uc.log.Infof("udp flow %d to %s could not be started - %s", stream, uc.hostport, err)
+			continue
+		}
+		flow.conn.SetWriteDeadline(uc.timeouts.Now().Add(uc.timeouts.ConnWriteTimeout))
+		if _, err := flow.conn.Write(data); err != nil {
+			uc.log.Infof("udp flow %d to %s write failed - %s", stream, uc.hostport, err)
+			continue
+		}
+		uc.counters.UDPDatagramsToBackend.Increment()
+	}
+}
+
+// flow returns the flow with the specified stream id, starting it if necessary.
+func (uc *udpConn) flow(stream uint32) (*udpFlow, error) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	// A flow whose timer fired is being closed, a new one is needed.
+	if flow, found := uc.flows[stream]; found && uc.touch(flow) {
+		return flow, nil
+	}
+
+	select {
+	case <-uc.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	conn, err := net.DialTimeout("udp", uc.hostport, uc.timeouts.ResolutionTimeout)
+	if err != nil {
+		uc.counters.UDPDialFailed.Increment()
+		return nil, err
+	}
+	uc.counters.UDPFlowStarted.Increment()
+
+	flow := &udpFlow{conn: conn}
+	flow.timer = time.AfterFunc(uc.timeouts.UDPIdleTimeout, func() {
+		uc.counters.UDPFlowExpired.Increment()
+		uc.drop(stream, flow)
+	})
+	uc.flows[stream] = flow
+	go uc.receive(stream, flow)
+	return flow, nil
+}
+
+// touch postpones the expiration of an idle flow.
+//
+// Returns false if the flow already expired. Must be called with lock held.
+func (uc *udpConn) touch(flow *udpFlow) bool {
+	if !flow.timer.Stop() {
+		return false
+	}
+	flow.timer.Reset(uc.timeouts.UDPIdleTimeout)
+	return true
+}
+
+// drop closes a flow, and forgets about it.
+func (uc *udpConn) drop(stream uint32, flow *udpFlow) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	if uc.flows[stream] == flow {
+		delete(uc.flows, stream)
+	}
+	flow.timer.Stop()
+	flow.conn.Close()
+}
+
+// receive reads the replies to a flow, and queues them to be returned by Read.
+func (uc *udpConn) receive(stream uint32, flow *udpFlow) {
+	defer uc.drop(stream, flow)
+
+	// One byte larger than the mtu, to detect datagrams that don't fit.
+	buffer := make([]byte, uc.mtu+1)
+	for {
+		read, err := flow.conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		uc.lock.Lock()
+		uc.touch(flow)
+		uc.lock.Unlock()
+		if read > uc.mtu {
+			uc.counters.UDPDatagramsTooLarge.Increment()
+			continue
+		}
+
+		frame := make([]byte, DatagramHeaderSize+read)
+		binary.BigEndian.PutUint32(frame, stream)
+		binary.BigEndian.PutUint16(frame[4:], uint16(read))
+		copy(frame[DatagramHeaderSize:], buffer[:read])
+
+		select {
+		case uc.incoming <- frame:
+			uc.counters.UDPDatagramsFromBackend.Increment()
+		case <-uc.closed:
+			return
+		}
+	}
+}
+
+// Read returns the datagrams received from the destination, each preceded by its header.
+func (uc *udpConn) Read(buffer []byte) (int, error) {
+	if len(uc.pending) == 0 {
+		select {
+		case <-uc.closed:
+			return 0, io.EOF
+		default:
+		}
+
+		uc.dlock.Lock()
+		deadline := uc.deadline
+		uc.dlock.Unlock()
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(deadline.Sub(uc.timeouts.Now()))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case uc.pending = <-uc.incoming:
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-uc.closed:
+			return 0, io.EOF
+		}
+	}
+
+	copied := copy(buffer, uc.pending)
+	uc.pending = uc.pending[copied:]
+	return copied, nil
+}
+
+// Write parses the datagrams written, blocking until they have been forwarded.
+func (uc *udpConn) Write(data []byte) (int, error) {
+	return uc.writer.Write(data)
+}
+
+func (uc *udpConn) Close() error {
+	uc.once.Do(func() {
+		close(uc.closed)
+		uc.writer.Close()
+
+		uc.lock.Lock()
+		defer uc.lock.Unlock()
+		for stream, flow := range uc.flows {
+			flow.timer.Stop()
+			flow.conn.Close()
+			delete(uc.flows, stream)
+		}
+	})
+	return nil
+}
+
+func (uc *udpConn) LocalAddr() net.Addr {
+	return udpAddr("")
+}
+
+func (uc *udpConn) RemoteAddr() net.Addr {
+	return udpAddr(uc.hostport)
+}
+
+func (uc *udpConn) SetDeadline(t time.Time) error {
+	return uc.SetReadDeadline(t)
+}
+
+func (uc *udpConn) SetReadDeadline(t time.Time) error {
+	uc.dlock.Lock()
+	defer uc.dlock.Unlock()
+	uc.deadline = t
+	return nil
+}
+
+// SetWriteDeadline is ignored: writes to each flow have a deadline of their own.
+func (uc *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
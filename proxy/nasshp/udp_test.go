@@ -0,0 +1,138 @@
+package nasshp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatagramReader(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	assert.Nil(t, WriteDatagram(buffer, 1, []byte("first")))
+	assert.Nil(t, WriteDatagram(buffer, 2, []byte(strings.Repeat("x", 20))))
+	assert.Nil(t, WriteDatagram(buffer, 0xffffffff, nil))
+	assert.Nil(t, WriteDatagram(buffer, 3, []byte("last")))
+	assert.Equal(t, ErrDatagramTooLarge, WriteDatagram(buffer, 4, make([]byte, MaxDatagramSize+1)))
+
+	dr := NewDatagramReader(buffer, 10)
+	data := make([]byte, 10)
+	stream, datagram, err := dr.Read(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), stream)
+	assert.Equal(t, "first", string(datagram))
+
+	stream, _, err = dr.Read(data)
+	assert.Equal(t, ErrDatagramTooLarge, err)
+	assert.Equal(t, uint32(2), stream)
+
+	stream, datagram, err = dr.Read(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0xffffffff), stream)
+	assert.Equal(t, 0, len(datagram))
+
+	stream, datagram, err = dr.Read(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), stream)
+	assert.Equal(t, "last", string(datagram))
+
+	_, _, err = dr.Read(data)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, dest := range []target{
+		{proto: "tcp", hostport: "127.0.0.1:22"},
+		{proto: "udp", mtu: 1400, hostport: "127.0.0.1:53"},
+		{proto: "udp", mtu: 9000, hostport: "[::1]:53"},
+	} {
+		parsed, err := parseTarget(dest.String())
+		assert.Nil(t, err)
+		assert.Equal(t, dest, parsed)
+	}
+
+	// Sids encoded before UDP support are just a host:port.
+	parsed, err := parseTarget("localhost:22")
+	assert.Nil(t, err)
+	assert.Equal(t, target{proto: "tcp", hostport: "localhost:22"}, parsed)
+
+	for _, invalid := range []string{"udp|localhost:53", "udp|0|localhost:53", "udp|100000|localhost:53", "udp|mtu|localhost:53"} {
+		_, err := parseTarget(invalid)
+		assert.NotNil(t, err, "%s", invalid)
+	}
+}
+
+// udpEcho replies to each datagram received with the same datagram, prefixed by "echo ".
+func udpEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			read, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte("echo "), buffer[:read]...), addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPConn(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	timeouts := DefaultTimeouts()
+	timeouts.UDPIdleTimeout = 200 * time.Millisecond
+	counters := &UDPCounters{}
+	uc := newUDPConn(logger.Nil, timeouts, counters, echo.LocalAddr().String(), 16)
+	defer uc.Close()
+
+	dr := NewDatagramReader(uc, 16)
+	buffer := make([]byte, 16)
+	for _, stream := range []uint32{1, 2, 1} {
+		assert.Nil(t, WriteDatagram(uc, stream, []byte("hello")))
+		received, datagram, err := dr.Read(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, stream, received)
+		assert.Equal(t, "echo hello", string(datagram))
+	}
+	assert.Equal(t, uint64(2), counters.UDPFlowStarted.Get())
+	assert.Equal(t, uint64(3), counters.UDPDatagramsToBackend.Get())
+	assert.Equal(t, uint64(3), counters.UDPDatagramsFromBackend.Get())
+
+	// Too large to be forwarded, or for the reply to be returned.
+	assert.Nil(t, WriteDatagram(uc, 1, []byte(strings.Repeat("x", 17))))
+	assert.Nil(t, WriteDatagram(uc, 1, []byte(strings.Repeat("x", 12))))
+	assert.Nil(t, WriteDatagram(uc, 1, []byte("small")))
+	received, datagram, err := dr.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), received)
+	assert.Equal(t, "echo small", string(datagram))
+	assert.Equal(t, uint64(2), counters.UDPDatagramsTooLarge.Get())
+
+	// Flows are closed once idle, and restarted by the next datagram.
+	assert.Eventually(t, func() bool { return counters.UDPFlowExpired.Get() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, WriteDatagram(uc, 1, []byte("again")))
+	_, datagram, err = dr.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo again", string(datagram))
+	assert.Equal(t, uint64(3), counters.UDPFlowStarted.Get())
+
+	uc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = uc.Read(buffer)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	assert.Nil(t, uc.Close())
+	assert.Nil(t, uc.Close())
+	_, err = uc.Read(buffer)
+	assert.Equal(t, io.EOF, err)
+	assert.NotNil(t, WriteDatagram(uc, 1, []byte("closed")))
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 type AgentCommandFlags struct {
@@ -33,6 +34,7 @@ func NewAgentCommand(bf *client.BaseFlags) *cobra.Command {
 	c.AddCommand(NewPrintCommand(c, flags))
 	c.AddCommand(NewCshPrintCommand(c, flags))
 	c.AddCommand(NewListAgentCommand(flags))
+	c.AddCommand(NewPruneAgentCommand(flags))
 	return c
 }
 func NewListAgentCommand(flags *AgentCommandFlags) *cobra.Command {
@@ -63,6 +65,25 @@ func NewListAgentCommand(flags *AgentCommandFlags) *cobra.Command {
 	return c
 }
 
+func NewPruneAgentCommand(flags *AgentCommandFlags) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "prune",
+		Short: "Removes expired certificates, and certificates replaced by a newer login, from the enkit agent",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			agent, err := kcerts.PrepareSSHAgent(flags.Base.Local, kcerts.WithLogging(flags.Base.Log), kcerts.WithFlags(flags.Agent))
+			if err != nil {
+				return err
+			}
+			pruned, err := agent.Prune(time.Now())
+			for _, p := range pruned {
+				fmt.Fprintf(cmd.OutOrStdout(), "Removed PKS: %s Identities: %v ValidFor: %s - %s\n", p.MD5, p.Principals, p.ValidFor.String(), p.Reason)
+			}
+			return err
+		},
+	}
+	return c
+}
+
 func NewRunAgentCommand(parent *cobra.Command, flags *AgentCommandFlags) *cobra.Command {
 	c := &cobra.Command{
 		Use:   "run -- [COMMAND]",
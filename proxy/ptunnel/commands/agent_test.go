@@ -7,8 +7,11 @@ import (
 	"github.com/System233/enkit/lib/kflags"
 	"github.com/System233/enkit/proxy/ptunnel/commands"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh/agent"
 	"io/ioutil"
+	"net"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -33,6 +36,40 @@ func TestRunAgentCommand(t *testing.T) {
 	assert.Equal(t, testAgent.State.Socket, b.String())
 }
 
+func TestRunAgentCommand_UseExisting(t *testing.T) {
+	tmpDir := t.TempDir()
+	old := kcerts.GetConfigDir
+	defer func() { kcerts.GetConfigDir = old }()
+	kcerts.GetConfigDir = func(app string, namespaces ...string) (string, error) {
+		return tmpDir + "/.config/enkit", nil
+	}
+
+	sockaddr := filepath.Join(tmpDir, "user-agent")
+	l, err := net.Listen("unix", sockaddr)
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		keyring := agent.NewKeyring()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sockaddr)
+
+	bf := client.DefaultBaseFlags("", "testing")
+	bf.Local.Root = tmpDir
+	c := commands.NewAgentCommand(bf)
+	c.SetArgs([]string{"run", "--ssh-agent-use-existing", "--", "echo", "-n", "$SSH_AUTH_SOCK"})
+	b := bytes.NewBufferString("")
+	c.SetOut(b)
+	assert.Nil(t, c.Execute())
+	assert.Equal(t, sockaddr, b.String())
+}
+
 func TestRunAgentCommand_Error(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "en")
 	assert.NoError(t, err)
@@ -0,0 +1,529 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/System233/enkit/lib/config/directory"
+	"github.com/System233/enkit/lib/goroutine"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/kflags/kcobra"
+	"github.com/System233/enkit/lib/knetwork"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	daemonSocketName = "daemon.sock"
+	daemonPidName    = "daemon.pid"
+	daemonLogName    = "daemon.log"
+)
+
+var magicDaemonVariable = "__ENKIT_TUNNEL_DAEMON__"
+
+// IsDaemonFork returns true if this code is running in the process forked by 'tunnel daemon start'.
+func IsDaemonFork() bool {
+	_, present := os.LookupEnv(magicDaemonVariable)
+	return present
+}
+
+// DaemonForward is the state of a local port forwarded by the daemon.
+type DaemonForward struct {
+	// Local address the daemon accepts connections on.
+	Listen string
+	Host   string
+	Port   uint16
+
+	// Connections currently tunneled, and accepted since the daemon started.
+	Active int
+	Total  int
+
+	LastError string `json:",omitempty"`
+}
+
+// Destination returns the host:port the forward tunnels connections to.
+func (f *DaemonForward) Destination() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(int(f.Port)))
+}
+
+// DaemonStatus is the state of the daemon, as returned over the control socket.
+type DaemonStatus struct {
+	PID      int
+	Started  time.Time
+	Proxy    string
+	Forwards []DaemonForward
+
+	LastError string `json:",omitempty"`
+}
+
+// Find returns the forward tunneling to host and port, or nil if the daemon does not cover that destination.
+func (s *DaemonStatus) Find(host string, port uint16) *DaemonForward {
+	for ix := range s.Forwards {
+		if s.Forwards[ix].Host == host && s.Forwards[ix].Port == port {
+			return &s.Forwards[ix]
+		}
+	}
+	return nil
+}
+
+// DaemonDir returns the directory holding the pidfile, control socket and log of the daemon.
+func (r *Tunnel) DaemonDir() (string, error) {
+	if r.DaemonPath != "" {
+		return r.DaemonPath, nil
+	}
+	return directory.GetConfigDir(r.ConfigName, "tunnel")
+}
+
+// daemonClient returns an http client sending all requests to the control socket in dir.
+func daemonClient(dir string) *http.Client {
+	socket := filepath.Join(dir, daemonSocketName)
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// QueryDaemon returns the status of the daemon controlled by the socket in dir.
+//
+// An error is returned if the daemon is not running.
+func QueryDaemon(dir string) (*DaemonStatus, error) {
+	resp, err := daemonClient(dir).Get("http://daemon/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("daemon status request failed with %s", resp.Status)
+	}
+
+	status := &DaemonStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("invalid daemon status - %w", err)
+	}
+	return status, nil
+}
+
+// StopDaemon requests the daemon controlled by the socket in dir to shut down.
+func StopDaemon(dir string) error {
+	resp, err := daemonClient(dir).Post("http://daemon/stop", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon stop request failed with %s", resp.Status)
+	}
+	return nil
+}
+
+// Daemon keeps the configured forwards open, and serves the control socket.
+type Daemon struct {
+	lock   sync.Mutex
+	status DaemonStatus
+	stop   context.CancelFunc
+}
+
+func (d *Daemon) Status() DaemonStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status := d.status
+	status.Forwards = append([]DaemonForward{}, d.status.Forwards...)
+	return status
+}
+
+func (d *Daemon) update(fn func(status *DaemonStatus)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	fn(&d.status)
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/status" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Status())
+	case r.URL.Path == "/stop" && r.Method == http.MethodPost:
+		d.stop()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// RunDaemon forwards the ports configured with --forward, and serves the control socket in dir, until ctx is canceled or a stop is requested.
+//
+// The pidfile and control socket are removed on exit.
+func (r *Tunnel) RunDaemon(ctx context.Context, dir string, proxy *url.URL, cookie *http.Cookie, forwards []Forward) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	socket := filepath.Join(dir, daemonSocketName)
+	if _, err := QueryDaemon(dir); err == nil {
+		return fmt.Errorf("a tunnel daemon is already running, controlled by %s", socket)
+	}
+	// Nobody is answering on the socket, any left over file is from a daemon that did not clean up.
+	os.Remove(socket)
+
+	control, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to open control socket %s: %w", socket, err)
+	}
+	control = &knetwork.CleanupListener{FileListener: control.(knetwork.FileListener), Path: socket}
+	defer control.Close()
+
+	d := &Daemon{stop: cancel, status: DaemonStatus{PID: os.Getpid(), Started: time.Now(), Proxy: proxy.String()}}
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for _, forward := range forwards {
+		listener, err := net.Listen("tcp", forward.Local)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", forward.Local, err)
+		}
+		listeners = append(listeners, listener)
+		d.status.Forwards = append(d.status.Forwards, DaemonForward{Listen: listener.Addr().String(), Host: forward.Host, Port: forward.Port})
+	}
+
+	pidfile := filepath.Join(dir, daemonPidName)
+	if err := ioutil.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(pidfile)
+
+	server := &http.Server{Handler: d}
+	go server.Serve(control)
+	defer func() {
+		// Give the reply to a stop request a chance to be delivered.
+		sctx, scancel := context.WithTimeout(context.Background(), time.Second)
+		defer scancel()
+		server.Shutdown(sctx)
+	}()
+
+	for ix, listener := range listeners {
+		go r.serveDaemonForward(ctx, d, ix, listener, proxy, cookie)
+	}
+	r.Log.Infof("tunnel daemon by %s with pid %d controlled by %s, forwarding %d ports through %s", r.Username(), os.Getpid(), socket, len(listeners), proxy)
+
+	<-ctx.Done()
+	r.Log.Infof("tunnel daemon with pid %d shutting down", os.Getpid())
+	return nil
+}
+
+func (r *Tunnel) serveDaemonForward(ctx context.Context, d *Daemon, ix int, listener net.Listener, proxy *url.URL, cookie *http.Cookie) {
+	forward := d.Status().Forwards[ix]
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				r.Log.Infof("tunnel daemon stopped accepting on %s - %v", forward.Listen, err)
+				d.update(func(status *DaemonStatus) {
+					status.Forwards[ix].LastError = err.Error()
+					status.LastError = fmt.Sprintf("%s: %v", forward.Listen, err)
+				})
+			}
+			return
+		}
+
+		d.update(func(status *DaemonStatus) {
+			status.Forwards[ix].Active++
+			status.Forwards[ix].Total++
+		})
+		id := fmt.Sprintf("daemon tunnel by %s on %s with %s via %s from %s", r.Username(), forward.Listen, forward.Destination(), proxy, conn.RemoteAddr())
+		r.Log.Infof("%s - accepted connection", id)
+		go func() {
+			defer conn.Close()
+			err := r.RunTunnel(proxy, id, forward.Host, forward.Port, cookie,
+				knetwork.ReadOnlyClose(conn.(knetwork.ReadOnlyCloser)),
+				knetwork.WriteOnlyClose(conn.(knetwork.WriteOnlyCloser)),
+			)
+			d.update(func(status *DaemonStatus) {
+				status.Forwards[ix].Active--
+				if err != nil && !errors.Is(err, io.EOF) {
+					status.Forwards[ix].LastError = err.Error()
+					status.LastError = fmt.Sprintf("%s: %v", forward.Destination(), err)
+				}
+			})
+			if err != nil {
+				r.Log.Infof("%s - terminated with %v", id, err)
+			}
+		}()
+	}
+}
+
+// DaemonForwardFor returns the forward of a running daemon tunneling to host and port, or nil if there is none.
+func (r *Tunnel) DaemonForwardFor(host string, port uint16) *DaemonForward {
+	dir, err := r.DaemonDir()
+	if err != nil {
+		return nil
+	}
+	status, err := QueryDaemon(dir)
+	if err != nil {
+		return nil
+	}
+	return status.Find(host, port)
+}
+
+// RunViaDaemon copies reader and writer to and from the local port of a daemon forward.
+//
+// Returns once the daemon closes the connection.
+func (r *Tunnel) RunViaDaemon(forward *DaemonForward, reader io.ReadCloser, writer io.WriteCloser) error {
+	conn, err := net.Dial("tcp", forward.Listen)
+	if err != nil {
+		return fmt.Errorf("could not connect to the tunnel daemon on %s - %w", forward.Listen, err)
+	}
+	defer conn.Close()
+
+	err = goroutine.WaitFirstError(
+		func() error {
+			defer writer.Close()
+			if _, err := io.Copy(writer, conn); err != nil {
+				return err
+			}
+			return io.EOF
+		},
+		func() error {
+			defer reader.Close()
+			if _, err := io.Copy(conn, reader); err != nil {
+				return err
+			}
+			// Let the remote end know there is nothing more to send, and wait for its reply.
+			return conn.(*net.TCPConn).CloseWrite()
+		},
+	)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// StartDaemon forks the process in the background to run the daemon, and waits for its control socket to be ready.
+func (r *Tunnel) StartDaemon(dir string) (*DaemonStatus, error) {
+	if status, err := QueryDaemon(dir); err == nil {
+		return nil, fmt.Errorf("a tunnel daemon is already running with pid %d", status.PID)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	logpath := filepath.Join(dir, daemonLogName)
+	log, err := os.OpenFile(logpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), magicDaemonVariable+"=true")
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := startDetached(cmd); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("tunnel daemon terminated with %v - see %s for details", err, logpath)
+		case <-timeout:
+			return nil, fmt.Errorf("tunnel daemon with pid %d did not open its control socket in time - see %s for details", cmd.Process.Pid, logpath)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if status, err := QueryDaemon(dir); err == nil {
+			return status, nil
+		}
+	}
+}
+
+// KillDaemon stops the daemon through its control socket, or with SIGTERM if the control socket does not respond.
+//
+// Returns false if no daemon was running.
+func KillDaemon(dir string) (bool, error) {
+	if err := StopDaemon(dir); err == nil {
+		return true, nil
+	}
+
+	pidfile := filepath.Join(dir, daemonPidName)
+	data, err := ioutil.ReadFile(pidfile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false, fmt.Errorf("invalid pidfile %s - %w", pidfile, err)
+	}
+	running, err := terminateProcess(pid)
+	if err != nil {
+		return false, fmt.Errorf("could not stop tunnel daemon with pid %d - %w", pid, err)
+	}
+	if !running {
+		// The daemon died without cleaning up.
+		os.Remove(pidfile)
+		os.Remove(filepath.Join(dir, daemonSocketName))
+		return false, nil
+	}
+	return true, nil
+}
+
+// FormatDaemonStatus returns a human readable description of the daemon status.
+func FormatDaemonStatus(status *DaemonStatus, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tunnel daemon with pid %d, up %s, through %s\n", status.PID, now.Sub(status.Started).Round(time.Second), status.Proxy)
+	for _, forward := range status.Forwards {
+		fmt.Fprintf(&b, "  %s -> %s - %d active, %d total connections", forward.Listen, forward.Destination(), forward.Active, forward.Total)
+		if forward.LastError != "" {
+			fmt.Fprintf(&b, " - last error: %s", forward.LastError)
+		}
+		b.WriteString("\n")
+	}
+	if status.LastError != "" {
+		fmt.Fprintf(&b, "last error: %s\n", status.LastError)
+	}
+	return b.String()
+}
+
+func NewDaemon(root *Tunnel) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "daemon",
+		Short: "Keeps tunnels open in the background, without a terminal",
+		Long: `daemon - keeps tunnels open in the background, without a terminal
+
+The daemon forwards local ports through the proxy, like 'tunnel -L'. Its pid,
+control socket and log are stored in the enkit config directory.
+
+While the daemon is running, 'tunnel <host> <port>' invocations for a
+destination forwarded by the daemon, like those from an ssh ProxyCommand,
+connect to the daemon rather than opening a new tunnel.`,
+	}
+	command.AddCommand(NewDaemonStart(root))
+	command.AddCommand(NewDaemonStop(root))
+	command.AddCommand(NewDaemonStatus(root))
+	command.PersistentFlags().StringVar(&root.DaemonPath, "daemon-dir", "", "Directory with the pidfile and control socket of the daemon - defaults to the enkit config directory")
+	return command
+}
+
+func NewDaemonStart(root *Tunnel) *cobra.Command {
+	var specs []string
+	command := &cobra.Command{
+		Use:   "start",
+		Short: "Starts the tunnel daemon in the background",
+		Example: `  $ tunnel daemon start -F 2222:10.10.0.12:22 -F 8080:build.internal:80
+	Forward the local port 2222 to port 22 of 10.10.0.12, and 8080 to port 80
+	of build.internal, until 'tunnel daemon stop' is run.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(specs) == 0 {
+				return kflags.NewUsageErrorf("At least one port to forward must be specified with --forward (or -F)")
+			}
+			var forwards []Forward
+			for _, spec := range specs {
+				forward, err := parseForward("--forward", spec)
+				if err != nil {
+					return kflags.NewUsageErrorf("%w", err)
+				}
+				forwards = append(forwards, forward)
+			}
+
+			_, cookie, _ := root.IdentityCookie()
+			proxy, err := root.ProxyURL(cookie)
+			if err != nil {
+				return err
+			}
+			dir, err := root.DaemonDir()
+			if err != nil {
+				return err
+			}
+
+			if IsDaemonFork() {
+				ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+				defer cancel()
+				root.summarizeOnUserSignal(ctx, cmd.ErrOrStderr())
+				return root.RunDaemon(ctx, dir, proxy, cookie, forwards)
+			}
+
+			status, err := root.StartDaemon(dir)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), FormatDaemonStatus(status, time.Now()))
+			return nil
+		},
+	}
+	command.Flags().StringArrayVarP(&specs, "forward", "F", nil, "Local TCP port to forward to a remote host, in [bind:]localport:host:port format - can be repeated")
+	command.Flags().IntVar(&root.BufferSize, "buffer-size", root.BufferSize, "Default read and write buffer size for window management")
+	command.Flags().StringVarP(&root.Proxy, "proxy", "p", root.Proxy, "Full url of the proxy to connect to, must be specified")
+	root.TunnelFlags.Register(&kcobra.FlagSet{FlagSet: command.Flags()}, "")
+	return command
+}
+
+func NewDaemonStop(root *Tunnel) *cobra.Command {
+	return &cobra.Command{
+		Use:   "stop",
+		Short: "Stops the tunnel daemon, closing all the tunnels it holds",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := root.DaemonDir()
+			if err != nil {
+				return err
+			}
+			stopped, err := KillDaemon(dir)
+			if err != nil {
+				return err
+			}
+			if !stopped {
+				return kflags.NewStatusErrorf(1, "no tunnel daemon running")
+			}
+			return nil
+		},
+	}
+}
+
+func NewDaemonStatus(root *Tunnel) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Shows the ports forwarded by the tunnel daemon, and their connections",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := root.DaemonDir()
+			if err != nil {
+				return err
+			}
+			status, err := QueryDaemon(dir)
+			if err != nil {
+				return kflags.NewStatusErrorf(1, "no tunnel daemon running - %w", err)
+			}
+			fmt.Fprint(cmd.OutOrStdout(), FormatDaemonStatus(status, time.Now()))
+			return nil
+		},
+	}
+}
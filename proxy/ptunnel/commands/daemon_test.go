@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/System233/enkit/lib/token"
+	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/System233/enkit/proxy/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemon(t *testing.T) {
+	port := echoServer(t)
+	filter, err := utils.NewPatternList([]string{"tcp|" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port))})
+	assert.Nil(t, err)
+	nassh, err := nasshp.New(rand.New(srand.Source), nil,
+		nasshp.WithLogging(logger.Nil),
+		nasshp.WithSymmetricOptions(token.WithGeneratedSymmetricKey(0)),
+		nasshp.WithOriginChecker(func(r *http.Request) bool { return true }),
+		nasshp.WithFilter(filter.Allow),
+	)
+	assert.Nil(t, err)
+	mux := http.NewServeMux()
+	nassh.Register(mux.Handle)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	purl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	tunnel := NewTunnel(client.DefaultBaseFlags("test", "enkit"))
+	tunnel.BaseFlags.Log = &logger.Proxy{Logger: logger.Nil}
+	dir := t.TempDir()
+	tunnel.DaemonPath = dir
+
+	_, err = QueryDaemon(dir)
+	assert.NotNil(t, err, "no daemon should be running yet")
+	stopped, err := KillDaemon(dir)
+	assert.Nil(t, err)
+	assert.False(t, stopped)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tunnel.RunDaemon(context.Background(), dir, purl, nil, []Forward{{Local: "127.0.0.1:0", Host: "127.0.0.1", Port: uint16(port)}})
+	}()
+
+	var status *DaemonStatus
+	assert.Eventually(t, func() bool {
+		status, err = QueryDaemon(dir)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, os.Getpid(), status.PID)
+	assert.Equal(t, purl.String(), status.Proxy)
+	assert.Equal(t, 1, len(status.Forwards))
+
+	// A second daemon on the same directory is refused.
+	err = tunnel.RunDaemon(context.Background(), dir, purl, nil, nil)
+	assert.ErrorContains(t, err, "already running")
+
+	// Destinations not forwarded by the daemon need their own tunnel.
+	assert.Nil(t, tunnel.DaemonForwardFor("127.0.0.1", uint16(port+1)))
+	forward := tunnel.DaemonForwardFor("127.0.0.1", uint16(port))
+	assert.NotNil(t, forward)
+
+	// Data flows through the daemon, until the local end is closed.
+	stdinr, stdinw := io.Pipe()
+	stdoutr, stdoutw := io.Pipe()
+	result := make(chan error, 1)
+	go func() { result <- tunnel.RunViaDaemon(forward, stdinr, stdoutw) }()
+
+	_, err = stdinw.Write([]byte(quote + "\n"))
+	assert.Nil(t, err)
+	line, err := bufio.NewReader(stdoutr).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, quote+"\n", line)
+
+	status, err = QueryDaemon(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, status.Forwards[0].Active)
+	assert.Equal(t, 1, status.Forwards[0].Total)
+	assert.True(t, strings.Contains(FormatDaemonStatus(status, time.Now()), "127.0.0.1:"+strconv.Itoa(port)+" - 1 active, 1 total connections"))
+
+	stdinw.Close()
+	assert.Nil(t, <-result)
+
+	stopped, err = KillDaemon(dir)
+	assert.Nil(t, err)
+	assert.True(t, stopped)
+	assert.Nil(t, <-done)
+
+	for _, name := range []string{daemonSocketName, daemonPidName} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err), "%s should have been removed", name)
+	}
+	_, err = QueryDaemon(dir)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package commands
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// startDetached starts cmd in a new session, so the daemon survives the terminal being closed.
+func startDetached(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd.Start()
+}
+
+// terminateProcess sends SIGTERM to the process with the pid.
+//
+// Returns false if no such process is running.
+func terminateProcess(pid int) (bool, error) {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package commands
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+var errDaemonUnsupported = fmt.Errorf("the tunnel daemon is not supported on windows - use 'tunnel -L' in a terminal instead")
+
+func startDetached(cmd *exec.Cmd) error {
+	return errDaemonUnsupported
+}
+
+func terminateProcess(pid int) (bool, error) {
+	return false, errDaemonUnsupported
+}
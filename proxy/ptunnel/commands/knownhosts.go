@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/System233/enkit/lib/config/directory"
+	"github.com/System233/enkit/proxy/ptunnel"
+)
+
+// KnownHostsName is the name of the known_hosts file pinning the host CAs distributed by the proxies.
+const KnownHostsName = "known_hosts"
+
+// KnownHostsPath returns the path of the known_hosts file in the tunnel config directory.
+//
+// The file is updated by the tunnel command every time a proxy distributes a
+// host CA, and passed to ssh by the ssh command.
+func KnownHostsPath(configName string) (string, error) {
+	dir, err := directory.GetConfigDir(configName, "tunnel")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, KnownHostsName), nil
+}
+
+// knownHostsLock serializes the updates of the known_hosts file by the tunnels of this process.
+var knownHostsLock sync.Mutex
+
+// PinHostCA returns a modifier recording the host CA distributed by proxy in the known_hosts file.
+//
+// Failures to update the file are logged, and do not prevent the tunnel from being established.
+func (r *Tunnel) PinHostCA(proxy *url.URL) ptunnel.GetModifier {
+	return ptunnel.WithHostCAHandler(func(ca *ptunnel.HostCA) {
+		path, err := KnownHostsPath(r.ConfigName)
+		if err == nil {
+			knownHostsLock.Lock()
+			err = ptunnel.WriteKnownHosts(path, proxy.Host, ca)
+			knownHostsLock.Unlock()
+		}
+		if err != nil {
+			r.Log.Warnf("could not pin the host CA of proxy %s - %s", proxy.Host, err)
+		}
+	})
+}
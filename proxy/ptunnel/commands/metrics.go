@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/System233/enkit/proxy/ptunnel"
+
+	"github.com/dustin/go-humanize"
+)
+
+func (r *Tunnel) track(tunnel *ptunnel.Tunnel) {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+	if r.active == nil {
+		r.active = map[*ptunnel.Tunnel]struct{}{}
+	}
+	r.active[tunnel] = struct{}{}
+}
+
+func (r *Tunnel) untrack(tunnel *ptunnel.Tunnel) {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+	delete(r.active, tunnel)
+}
+
+// Summary returns a one line description of the tunnels currently open.
+//
+// Time to first byte and round trip time are averaged across the tunnels
+// that measured them.
+func (r *Tunnel) Summary() string {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+
+	var connected, sent, received uint64
+	var firstByte, rtt time.Duration
+	var firstBytes, rtts int64
+	for tunnel := range r.active {
+		stats := tunnel.Stats()
+		if stats.State == ptunnel.TunnelConnected {
+			connected++
+		}
+		sent += stats.BytesSent
+		received += stats.BytesReceived
+		if stats.FirstByte > 0 {
+			firstByte += stats.FirstByte
+			firstBytes++
+		}
+		if stats.RTT > 0 {
+			rtt += stats.RTT
+			rtts++
+		}
+	}
+
+	average := func(total time.Duration, count int64) string {
+		if count == 0 {
+			return "n/a"
+		}
+		return (total / time.Duration(count)).Round(time.Microsecond).String()
+	}
+	return fmt.Sprintf("%d tunnels, %d connected - sent %s, received %s - first byte %s, proxy rtt %s",
+		len(r.active), connected, humanize.IBytes(sent), humanize.IBytes(received), average(firstByte, firstBytes), average(rtt, rtts))
+}
+
+// SummarizeOnSignal writes the Summary to w every time one of the signals is received, until ctx is canceled.
+func (r *Tunnel) SummarizeOnSignal(ctx context.Context, w io.Writer, signals ...os.Signal) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go func() {
+		defer signal.Stop(received)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-received:
+				fmt.Fprintln(w, r.Summary())
+			}
+		}
+	}()
+}
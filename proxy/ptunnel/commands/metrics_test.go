@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/System233/enkit/proxy/ptunnel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary(t *testing.T) {
+	tunnel := NewTunnel(client.DefaultBaseFlags("test", "enkit"))
+	tunnel.BaseFlags.Log = &logger.Proxy{Logger: logger.Nil}
+	assert.Equal(t, "0 tunnels, 0 connected - sent 0 B, received 0 B - first byte n/a, proxy rtt n/a", tunnel.Summary())
+
+	// Tunnels that never connected are counted, but have nothing to report.
+	tl, err := ptunnel.NewTunnel(nasshp.NewBufferPool(32))
+	assert.Nil(t, err)
+	defer tl.Close()
+	tunnel.track(tl)
+	assert.Equal(t, "1 tunnels, 0 connected - sent 0 B, received 0 B - first byte n/a, proxy rtt n/a", tunnel.Summary())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader, writer := io.Pipe()
+	tunnel.SummarizeOnSignal(ctx, writer, syscall.SIGUSR1)
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(reader).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		assert.Equal(t, "1 tunnels, 0 connected - sent 0 B, received 0 B - first byte n/a, proxy rtt n/a\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no summary printed on SIGUSR1")
+	}
+
+	tunnel.untrack(tl)
+	assert.Equal(t, "0 tunnels, 0 connected - sent 0 B, received 0 B - first byte n/a, proxy rtt n/a", tunnel.Summary())
+}
@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/lib/knetwork"
+	"github.com/System233/enkit/proxy/ptunnel"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricSOCKS5Connections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "tunnel",
+		Name:      "socks5_connections",
+		Help:      "Number of connections accepted on the SOCKS5 listener",
+	},
+		[]string{
+			// host:port requested by the client, empty if the handshake failed.
+			"destination",
+			// One of "tunneled", "denied", "failed" or "handshake_failed".
+			"result",
+		},
+	)
+	metricSOCKS5Active = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "tunnel",
+		Name:      "socks5_active_connections",
+		Help:      "Number of connections currently tunneled from the SOCKS5 listener",
+	},
+		[]string{
+			// host:port requested by the client.
+			"destination",
+		},
+	)
+)
+
+// SOCKS5Credentials returns the credentials SOCKS5 clients must authenticate with, or nil if none are configured.
+func (r *Tunnel) SOCKS5Credentials() (*ptunnel.SOCKS5Credentials, error) {
+	if r.SOCKS5User == "" && r.SOCKS5PasswordFile == "" {
+		return nil, nil
+	}
+	if r.SOCKS5User == "" || r.SOCKS5PasswordFile == "" {
+		return nil, fmt.Errorf("--socks5-user and --socks5-password-file must be specified together")
+	}
+	password, err := os.ReadFile(r.SOCKS5PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read SOCKS5 password - %w", err)
+	}
+	return &ptunnel.SOCKS5Credentials{Username: r.SOCKS5User, Password: strings.TrimRight(string(password), "\r\n")}, nil
+}
+
+// ListenSOCKS5 opens the socket configured with --socks5, and serves SOCKS5 clients until ctx is canceled.
+func (r *Tunnel) ListenSOCKS5(ctx context.Context, proxy *url.URL, cookie *http.Cookie) error {
+	network, addr, err := normalizeListenAddr(r.SOCKS5)
+	if err != nil {
+		return kflags.NewUsageErrorf("--socks5 address does not look like one of: [port num, ip:port, unix:///path/to/socket]: %w", err)
+	}
+	creds, err := r.SOCKS5Credentials()
+	if err != nil {
+		return kflags.NewUsageErrorf("%w", err)
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s %s: %w", network, addr, err)
+	}
+	var listener net.Listener = l
+	if network == "unix" {
+		listener = &knetwork.CleanupListener{FileListener: l.(knetwork.FileListener), Path: addr}
+	}
+	r.Log.Infof("socks5 server by %s listening on %s %s, through %s", r.Username(), network, listener.Addr(), proxy)
+	return r.RunSOCKS5(ctx, listener, proxy, cookie, creds)
+}
+
+// RunSOCKS5 accepts SOCKS5 connections on listener, and forwards each to the destination requested through the proxy.
+//
+// Hostnames are resolved by the proxy, and destinations are subject to the
+// same checks as any other tunnel: connections rejected by the proxy are
+// replied to with a "not allowed by ruleset" error.
+func (r *Tunnel) RunSOCKS5(ctx context.Context, listener net.Listener, proxy *url.URL, cookie *http.Cookie, creds *ptunnel.SOCKS5Credentials) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go r.ServeSOCKS5(proxy, cookie, creds, conn)
+	}
+}
+
+// ServeSOCKS5 performs the SOCKS5 handshake on conn, and tunnels it to the destination requested.
+func (r *Tunnel) ServeSOCKS5(proxy *url.URL, cookie *http.Cookie, creds *ptunnel.SOCKS5Credentials, conn net.Conn) {
+	defer conn.Close()
+
+	request, err := ptunnel.ReadSOCKS5Request(conn, creds)
+	if err != nil {
+		r.Log.Infof("socks5 connection by %s on %s from %s - handshake failed - %v", r.Username(), conn.LocalAddr(), conn.RemoteAddr(), err)
+		metricSOCKS5Connections.WithLabelValues("", "handshake_failed").Inc()
+		return
+	}
+
+	destination := request.Destination()
+	id := fmt.Sprintf("socks5 tunnel by %s on %s with %s via %s from %s", r.Username(), conn.LocalAddr(), destination, proxy, conn.RemoteAddr())
+	r.Log.Infof("%s - accepted connection", id)
+
+	mods := r.NewTunnelOptions(proxy, id, cookie)
+	sid, err := ptunnel.GetSID(proxy, request.Host, request.Port, mods...)
+	if err != nil {
+		reply, result := ptunnel.SOCKS5HostUnreachable, "failed"
+		if ptunnel.IsAccessDenied(err) {
+			reply, result = ptunnel.SOCKS5NotAllowed, "denied"
+		}
+		request.Reply(reply)
+		metricSOCKS5Connections.WithLabelValues(destination, result).Inc()
+		r.Log.Infof("%s - could not open tunnel - %v", id, err)
+		return
+	}
+	if err := request.Reply(ptunnel.SOCKS5Succeeded); err != nil {
+		metricSOCKS5Connections.WithLabelValues(destination, "failed").Inc()
+		r.Log.Infof("%s - could not reply to client - %v", id, err)
+		return
+	}
+
+	metricSOCKS5Connections.WithLabelValues(destination, "tunneled").Inc()
+	metricSOCKS5Active.WithLabelValues(destination).Inc()
+	defer metricSOCKS5Active.WithLabelValues(destination).Dec()
+
+	err = r.RunTunnel(
+		proxy,
+		id,
+		request.Host,
+		request.Port,
+		cookie,
+		knetwork.ReadOnlyClose(conn.(knetwork.ReadOnlyCloser)),
+		knetwork.WriteOnlyClose(conn.(knetwork.WriteOnlyCloser)),
+		ptunnel.WithSID(sid),
+	)
+	if err != nil {
+		r.Log.Infof("%s - terminated with %v", id, err)
+	}
+}
@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/System233/enkit/lib/token"
+	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/System233/enkit/proxy/ptunnel"
+	"github.com/System233/enkit/proxy/utils"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+)
+
+// echoServer returns the port of a server echoing back everything it receives.
+func echoServer(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// socks5Proxy starts a proxy allowing connections to the allowed host:port only, and a SOCKS5 listener using it.
+func socks5Proxy(t *testing.T, allowed string, creds *ptunnel.SOCKS5Credentials) string {
+	filter, err := utils.NewPatternList([]string{"tcp|" + allowed})
+	assert.Nil(t, err)
+	nassh, err := nasshp.New(rand.New(srand.Source), nil,
+		nasshp.WithLogging(logger.Nil),
+		nasshp.WithSymmetricOptions(token.WithGeneratedSymmetricKey(0)),
+		nasshp.WithOriginChecker(func(r *http.Request) bool { return true }),
+		nasshp.WithFilter(filter.Allow),
+	)
+	assert.Nil(t, err)
+	mux := http.NewServeMux()
+	nassh.Register(mux.Handle)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	purl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	tunnel := NewTunnel(client.DefaultBaseFlags("test", "enkit"))
+	tunnel.BaseFlags.Log = &logger.Proxy{Logger: logger.Nil}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go tunnel.RunSOCKS5(ctx, listener, purl, nil, creds)
+	return listener.Addr().String()
+}
+
+func TestSOCKS5(t *testing.T) {
+	port := echoServer(t)
+	allowed := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	creds := &ptunnel.SOCKS5Credentials{Username: "joe", Password: "secret"}
+	address := socks5Proxy(t, allowed, creds)
+	denied := net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1))
+
+	dialer, err := proxy.SOCKS5("tcp", address, &proxy.Auth{User: "joe", Password: "secret"}, proxy.Direct)
+	assert.Nil(t, err)
+	conn, err := dialer.Dial("tcp", allowed)
+	assert.Nil(t, err, "%v", err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(quote))
+	assert.Nil(t, err)
+	buffer := make([]byte, len(quote))
+	_, err = io.ReadFull(conn, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, quote, string(buffer))
+
+	// Destinations not allowed by the proxy are rejected.
+	_, err = dialer.Dial("tcp", denied)
+	assert.ErrorContains(t, err, "connection not allowed by ruleset")
+
+	// As are clients not authenticating.
+	unauthenticated, err := proxy.SOCKS5("tcp", address, nil, proxy.Direct)
+	assert.Nil(t, err)
+	_, err = unauthenticated.Dial("tcp", allowed)
+	assert.ErrorContains(t, err, "no acceptable authentication methods")
+}
+
+func TestSOCKS5Credentials(t *testing.T) {
+	tunnel := &Tunnel{}
+	creds, err := tunnel.SOCKS5Credentials()
+	assert.Nil(t, err)
+	assert.Nil(t, creds)
+
+	tunnel.SOCKS5User = "joe"
+	_, err = tunnel.SOCKS5Credentials()
+	assert.ErrorContains(t, err, "must be specified together")
+
+	tunnel.SOCKS5PasswordFile = filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, os.WriteFile(tunnel.SOCKS5PasswordFile, []byte("secret\n"), 0600))
+	creds, err = tunnel.SOCKS5Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, &ptunnel.SOCKS5Credentials{Username: "joe", Password: "secret"}, creds)
+}
+
+var quote = "The future depends on what you do today."
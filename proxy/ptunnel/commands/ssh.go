@@ -33,6 +33,7 @@ type SSH struct {
 	BufferSize       int
 	SSH              string
 	UseInternalAgent bool
+	PinnedHostCA     bool
 }
 
 func (r *SSH) Username() string {
@@ -122,9 +123,18 @@ func (r *SSH) Run(cmd *cobra.Command, args []string) error {
 		params += " " + r.Extra
 	}
 
-	args = append([]string{
+	options := []string{
 		fmt.Sprintf("-oProxyCommand=%s%s %%h %%p", r.Tunnel, params),
-	}, args...)
+	}
+	if r.PinnedHostCA {
+		// The known_hosts files of the user are still used, the pinned host CAs are just added.
+		knownHosts, err := KnownHostsPath(r.ConfigName)
+		if err != nil {
+			return err
+		}
+		options = append(options, fmt.Sprintf("-oUserKnownHostsFile=%q ~/.ssh/known_hosts ~/.ssh/known_hosts2", knownHosts))
+	}
+	args = append(options, args...)
 
 	ecmd := exec.Command(found, args...)
 	ecmd.Stdin = os.Stdin
@@ -215,6 +225,7 @@ func NewSSH(base *client.BaseFlags) *SSH {
 	root.Command.Flags().StringVar(&root.Subcommand, "tunnel-command", tcommand, "Subcommand to use with the tunnel command. Defaults to empty if the tunnel command does not end with enkit")
 	root.Command.Flags().StringVar(&root.Extra, "tunnel-extra", "", "Extra arguments to pass to the tunnel command")
 	root.Command.Flags().BoolVar(&root.UseInternalAgent, "use-internal-agent", true, "Use the builtin agent that enkit manages")
+	root.Command.Flags().BoolVar(&root.PinnedHostCA, "pinned-host-ca", true, "Trust the host CAs distributed by the proxies, in addition to the known_hosts files of the user")
 	root.AgentFlags.Register(&kcobra.FlagSet{root.Command.Flags()}, "")
 
 	return root
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package commands
+
+import (
+	"context"
+	"io"
+	"syscall"
+)
+
+// summarizeOnUserSignal writes the Summary to w every time SIGUSR1 is received, until ctx is canceled.
+func (r *Tunnel) summarizeOnUserSignal(ctx context.Context, w io.Writer) {
+	r.SummarizeOnSignal(ctx, w, syscall.SIGUSR1)
+}
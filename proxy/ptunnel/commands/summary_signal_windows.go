@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package commands
+
+import (
+	"context"
+	"io"
+)
+
+// summarizeOnUserSignal does nothing: there is no SIGUSR1 on windows.
+func (r *Tunnel) summarizeOnUserSignal(ctx context.Context, w io.Writer) {
+}
@@ -14,7 +14,9 @@ import (
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/System233/enkit/lib/client"
 	"github.com/System233/enkit/lib/goroutine"
@@ -23,6 +25,7 @@ import (
 	"github.com/System233/enkit/lib/khttp/krequest"
 	"github.com/System233/enkit/lib/khttp/protocol"
 	"github.com/System233/enkit/lib/knetwork"
+	"github.com/System233/enkit/lib/metrics"
 	"github.com/System233/enkit/lib/retry"
 	"github.com/System233/enkit/proxy/nasshp"
 	"github.com/System233/enkit/proxy/ptunnel"
@@ -41,6 +44,24 @@ type Tunnel struct {
 	Listen      string
 	Background  bool
 	CheckAccess bool
+
+	SOCKS5             string
+	SOCKS5User         string
+	SOCKS5PasswordFile string
+	MetricsListen      string
+	MetricsPort        int
+
+	UDP            []string
+	UDPMTU         int
+	UDPIdleTimeout time.Duration
+
+	// Directory of the daemon control socket, empty for the default.
+	DaemonPath string
+	UseDaemon  bool
+
+	// Tunnels currently open, summarized on SIGUSR1.
+	activeLock sync.Mutex
+	active     map[*ptunnel.Tunnel]struct{}
 }
 
 func (r *Tunnel) Username() string {
@@ -120,24 +141,54 @@ func (r *Tunnel) Run(cmd *cobra.Command, args []string) (err error) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	// Print a summary on SIGUSR1 - on stderr, as stdout may be carrying the tunnel.
+	r.summarizeOnUserSignal(ctx, cmd.ErrOrStderr())
+
 	// Treat credentials as optional, move forward in any case.
 	_, cookie, _ := r.IdentityCookie()
 
-	proxy := strings.TrimSpace(r.Proxy)
-	if proxy == "" {
-		if cookie != nil {
-			return kflags.NewUsageErrorf("A proxy must be specified with --proxy (or -p)")
+	purl, err := r.ProxyURL(cookie)
+	if err != nil {
+		return err
+	}
+	proxy := purl.String()
+
+	if r.MetricsPort != 0 {
+		if r.MetricsListen != "" {
+			return kflags.NewUsageErrorf("--metrics-port and --metrics-listen cannot be used together")
 		}
-		return kflags.NewIdentityError(
-			kflags.NewUsageErrorf("No proxy detected, and no proxy specified with --proxy. Maybe you need to authenticate to get the default settings?"),
-		)
+		r.MetricsListen = net.JoinHostPort("localhost", strconv.Itoa(r.MetricsPort))
 	}
-	if strings.Index(proxy, "//") < 0 {
-		proxy = "https://" + proxy
+	if r.MetricsListen != "" {
+		if err := r.ServeMetrics(); err != nil {
+			return err
+		}
 	}
-	purl, err := url.Parse(proxy)
-	if err != nil {
-		return kflags.NewUsageErrorf("Invalid proxy %s specified with --proxy - %w", proxy, err)
+
+	if len(r.UDP) > 0 {
+		switch {
+		case len(args) > 0:
+			return kflags.NewUsageErrorf("No target host can be specified with --udp - the destination is part of each --udp flag")
+		case r.Listen != "" || r.SOCKS5 != "":
+			return kflags.NewUsageErrorf("--udp cannot be used together with --listen/-L or --socks5")
+		case r.Background:
+			return kflags.NewUsageErrorf("--background is not supported with --udp")
+		}
+		id = fmt.Sprintf("udp forwarder by %s of %s through %s", r.Username(), strings.Join(r.UDP, ","), proxy)
+		return r.ListenUDP(ctx, purl, cookie)
+	}
+
+	if r.SOCKS5 != "" {
+		switch {
+		case len(args) > 0:
+			return kflags.NewUsageErrorf("No target host can be specified with --socks5 - the SOCKS5 client picks the destination of each connection")
+		case r.Listen != "":
+			return kflags.NewUsageErrorf("--socks5 and --listen/-L cannot be used together")
+		case r.Background:
+			return kflags.NewUsageErrorf("--background is not supported with --socks5")
+		}
+		id = fmt.Sprintf("socks5 listener by %s on %s through %s", r.Username(), r.SOCKS5, proxy)
+		return r.ListenSOCKS5(ctx, purl, cookie)
 	}
 
 	// Zero port (default) means the server should try to discover the
@@ -173,6 +224,12 @@ func (r *Tunnel) Run(cmd *cobra.Command, args []string) (err error) {
 	}
 
 	id = fmt.Sprintf("tunnel by %s on <stdin/stdout> with %s:%d through %s", r.Username(), host, port, proxy)
+	if r.UseDaemon {
+		if forward := r.DaemonForwardFor(host, port); forward != nil {
+			r.Log.Infof("%s - reusing the tunnel daemon forward on %s", id, forward.Listen)
+			return r.RunViaDaemon(forward, os.Stdin, knetwork.NopWriteCloser(os.Stdout))
+		}
+	}
 	r.Log.Infof("%s - establishing connection", id)
 
 	err = r.RunTunnel(purl, id, host, port, cookie, os.Stdin, knetwork.NopWriteCloser(os.Stdout))
@@ -182,6 +239,29 @@ func (r *Tunnel) Run(cmd *cobra.Command, args []string) (err error) {
 	return err
 }
 
+// ProxyURL returns the URL of the proxy configured with --proxy.
+//
+// cookie is only used to suggest authenticating if no proxy is configured.
+func (r *Tunnel) ProxyURL(cookie *http.Cookie) (*url.URL, error) {
+	proxy := strings.TrimSpace(r.Proxy)
+	if proxy == "" {
+		if cookie != nil {
+			return nil, kflags.NewUsageErrorf("A proxy must be specified with --proxy (or -p)")
+		}
+		return nil, kflags.NewIdentityError(
+			kflags.NewUsageErrorf("No proxy detected, and no proxy specified with --proxy. Maybe you need to authenticate to get the default settings?"),
+		)
+	}
+	if strings.Index(proxy, "//") < 0 {
+		proxy = "https://" + proxy
+	}
+	purl, err := url.Parse(proxy)
+	if err != nil {
+		return nil, kflags.NewUsageErrorf("Invalid proxy %s specified with --proxy - %w", proxy, err)
+	}
+	return purl, nil
+}
+
 // listenerChan returns a channel that contains connections that the Listener is
 // accepting. If the listener encounters an error, it will fill in `e` before
 // closing the returned channel and terminating.
@@ -367,9 +447,27 @@ func (r *Tunnel) RunBackground(listener knetwork.FileListener) error {
 	return cmd.Start()
 }
 
-func (r *Tunnel) NewTunnelOptions(id string, cookie *http.Cookie) []ptunnel.GetModifier {
+// ServeMetrics exports prometheus metrics on the address configured with --metrics-listen or --metrics-port.
+func (r *Tunnel) ServeMetrics() error {
+	listener, err := net.Listen("tcp", r.MetricsListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %w", r.MetricsListen, err)
+	}
+	mux := http.NewServeMux()
+	metrics.AddHandler(mux, "/metrics")
+	go func() {
+		err := http.Serve(listener, mux)
+		r.Log.Infof("metrics server on %s terminated - %v", r.MetricsListen, err)
+	}()
+	return nil
+}
+
+func (r *Tunnel) NewTunnelOptions(proxy *url.URL, id string, cookie *http.Cookie) []ptunnel.GetModifier {
 	mods := []ptunnel.GetModifier{
-		ptunnel.WithRetryOptions(retry.WithDescription(id)),
+		ptunnel.WithRetryOptions(append(r.RetryOptions(), retry.WithDescription(id))...),
+		r.PinHostCA(proxy),
+		// The http requests use the default transport, configured by BaseFlags.Init.
+		ptunnel.WithConnectOptions(ptunnel.WithClientFlags(r.HTTP)),
 	}
 	if cookie != nil {
 		loader := func(o *ptunnel.GetOptions) error {
@@ -410,11 +508,11 @@ func (r *Tunnel) CanConnect(proxy *url.URL, id, host string, port uint16, cookie
 		return nil
 	}
 
-	_, err := ptunnel.GetSID(proxy, host, port, r.NewTunnelOptions(id, cookie)...)
+	_, err := ptunnel.GetSID(proxy, host, port, r.NewTunnelOptions(proxy, id, cookie)...)
 	return err
 }
 
-func (r *Tunnel) RunTunnel(proxy *url.URL, id, host string, port uint16, cookie *http.Cookie, reader io.ReadCloser, writer io.WriteCloser) error {
+func (r *Tunnel) RunTunnel(proxy *url.URL, id, host string, port uint16, cookie *http.Cookie, reader io.ReadCloser, writer io.WriteCloser, extra ...ptunnel.GetModifier) error {
 	pool := nasshp.NewBufferPool(r.BufferSize)
 	tunnel, err := ptunnel.NewTunnel(pool, ptunnel.WithLogger(r.Log), ptunnel.FromFlags(r.TunnelFlags))
 	if err != nil {
@@ -422,7 +520,10 @@ func (r *Tunnel) RunTunnel(proxy *url.URL, id, host string, port uint16, cookie
 	}
 	defer tunnel.Close()
 
-	mods := r.NewTunnelOptions(id, cookie)
+	r.track(tunnel)
+	defer r.untrack(tunnel)
+
+	mods := append(r.NewTunnelOptions(proxy, id, cookie), extra...)
 	err = goroutine.WaitFirstError(
 		func() error {
 			return tunnel.KeepConnected(proxy, host, port, mods...)
@@ -469,6 +570,28 @@ func NewTunnel(base *client.BaseFlags) *Tunnel {
 	Open the local port 1234 on INADDR_ANY (dangerous! anyone will be able to connect) and
 	forward every connection to 10.10.0.12 port 80.
 
+  $ tunnel --socks5 1080
+	Run a SOCKS5 server on local port 1080, and forward each connection through the
+	proxy to the host and port requested by the SOCKS5 client. Hostnames are resolved
+	by the proxy, so internal names work as expected. For example:
+	    curl --socks5-hostname localhost:1080 http://build.internal.enfabrica.net/
+
+  $ tunnel --udp 5353:10.10.0.12:53
+	Open the local UDP port 5353, and forward every datagram received through the
+	proxy to port 53 of 10.10.0.12, returning the replies to the sender. For example:
+	    dig -p 5353 @localhost build.internal.enfabrica.net
+
+  $ tunnel --metrics-port 9090 --probe-interval 10s -L 1234 10.10.0.12 80
+	Same as the first listening tunnel, but export bytes sent and received, time to
+	first byte and round trip time to the proxy on http://localhost:9090/metrics.
+	At any time, 'kill -USR1 <pid>' prints a one line summary of the open tunnels.
+
+  $ tunnel daemon start -F 2222:10.10.0.12:22
+	Start a daemon in the background forwarding the local port 2222 to port 22 of
+	10.10.0.12. While the daemon runs, 'tunnel 10.10.0.12 22' connects through it
+	rather than opening a new tunnel. Use 'tunnel daemon status' to see its
+	connections, and 'tunnel daemon stop' to shut it down.
+
   $ tunnel --background -L 1234 10.10.0.12 80
 	Same as the first listening tunnel, but background the process as soon
         as it's believed doing so won't result in any error.
@@ -481,11 +604,17 @@ To use in ssh_config, you can have a block like:
     # Use the proxy for any host in the 'internal.enfabrica.net' domain.
     Host *.internal.enfabrica.net
       ProxyCommand tunnel %h %p
+      UserKnownHostsFile ~/.config/enkit/tunnel/known_hosts ~/.ssh/known_hosts
+
+If the proxy distributes the CA signing the host keys of your corp machines,
+the tunnel command records it in the known_hosts file of its config directory,
+so ssh can verify the hosts it connects to. The ssh command uses it automatically.
 
 IMPORTANT: in the example, we use a 'tunnel' command. Depending on how the tool
 was installed in your system, it may require running 'enkit tunnel ...' instead.
 `,
 			Aliases: []string{"tun", "corp"},
+			Args:    cobra.ArbitraryArgs,
 		},
 		BaseFlags: base,
 	}
@@ -496,7 +625,18 @@ was installed in your system, it may require running 'enkit tunnel ...' instead.
 	root.Command.Flags().StringVarP(&root.Listen, "listen", "L", "", "Local address or port to listen on")
 	root.Command.Flags().BoolVarP(&root.Background, "background", "b", false, "When listening with -L - run the tunnel in the background")
 	root.Command.Flags().BoolVarP(&root.CheckAccess, "check-access", "c", true, "When listening with -L - check credentials before opening the socket")
+	root.Command.Flags().StringVar(&root.SOCKS5, "socks5", "", "Local address or port to run a SOCKS5 server on, forwarding connections to the destination requested by the client")
+	root.Command.Flags().StringVar(&root.SOCKS5User, "socks5-user", "", "With --socks5 - username SOCKS5 clients must authenticate with. Requires --socks5-password-file")
+	root.Command.Flags().StringVar(&root.SOCKS5PasswordFile, "socks5-password-file", "", "With --socks5 - path of a file containing the password SOCKS5 clients must authenticate with")
+	root.Command.Flags().StringArrayVar(&root.UDP, "udp", nil, "Local UDP port to forward to a remote host, in [bind:]localport:host:port format - can be repeated")
+	root.Command.Flags().IntVar(&root.UDPMTU, "udp-mtu", nasshp.DefaultUDPMTU, "With --udp - largest datagram to forward, larger datagrams are dropped")
+	root.Command.Flags().DurationVar(&root.UDPIdleTimeout, "udp-idle-timeout", 2*time.Minute, "With --udp - how long to remember a local client that sent no datagrams, to return replies to")
+	root.Command.Flags().StringVar(&root.MetricsListen, "metrics-listen", "", "Local address to export prometheus metrics on, like localhost:9090 - disabled if empty")
+	root.Command.Flags().IntVar(&root.MetricsPort, "metrics-port", 0, "Local port to export prometheus metrics on, on localhost - disabled if 0")
+
+	root.Command.Flags().BoolVar(&root.UseDaemon, "use-daemon", true, "When tunneling <stdin/stdout> - connect through the tunnel daemon if it forwards the destination")
 
 	root.TunnelFlags = ptunnel.DefaultFlags().Register(&kcobra.FlagSet{FlagSet: root.Command.Flags()}, "")
+	root.AddCommand(NewDaemon(root))
 	return root
 }
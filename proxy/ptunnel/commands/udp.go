@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/System233/enkit/lib/goroutine"
+	"github.com/System233/enkit/lib/kflags"
+	"github.com/System233/enkit/proxy/ptunnel"
+)
+
+// Forward is a local socket forwarding to a remote host, as configured with --udp or daemon --forward.
+type Forward struct {
+	// Local address to bind, in host:port format. host may be empty.
+	Local string
+
+	Host string
+	Port uint16
+}
+
+// cutLast splits value at its last colon, treating anything within [] as a single field.
+func cutLast(value string) (string, string, bool) {
+	if strings.HasSuffix(value, "]") {
+		start := strings.LastIndex(value, "[")
+		if start <= 0 || value[start-1] != ':' {
+			return "", "", false
+		}
+		return value[:start-1], strings.Trim(value[start:], "[]"), true
+	}
+	index := strings.LastIndex(value, ":")
+	if index < 0 {
+		return "", "", false
+	}
+	return value[:index], value[index+1:], true
+}
+
+// ParseUDPForward parses a --udp specification, in the [bind:]localport:host:port format.
+//
+// IPv6 addresses must be enclosed in [], like [::1]:5353:[fd00::1]:53.
+func ParseUDPForward(spec string) (Forward, error) {
+	return parseForward("--udp", spec)
+}
+
+func parseForward(flag, spec string) (Forward, error) {
+	rest, port, ok := cutLast(spec)
+	if !ok {
+		return Forward{}, fmt.Errorf("invalid %s %q - must be in [bind:]localport:host:port format", flag, spec)
+	}
+	local, host, ok := cutLast(rest)
+	if !ok || host == "" || local == "" {
+		return Forward{}, fmt.Errorf("invalid %s %q - must be in [bind:]localport:host:port format", flag, spec)
+	}
+
+	rport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || rport == 0 {
+		return Forward{}, fmt.Errorf("invalid %s %q - invalid remote port %q", flag, spec, port)
+	}
+
+	// Just a port means binding on all local addresses.
+	if _, err := strconv.ParseUint(local, 10, 16); err == nil {
+		local = ":" + local
+	} else if _, _, err := net.SplitHostPort(local); err != nil {
+		return Forward{}, fmt.Errorf("invalid %s %q - invalid local address %q - %w", flag, spec, local, err)
+	}
+	return Forward{Local: local, Host: host, Port: uint16(rport)}, nil
+}
+
+// ListenUDP opens the sockets configured with --udp, and forwards their datagrams through the proxy until ctx is canceled.
+func (r *Tunnel) ListenUDP(ctx context.Context, proxy *url.URL, cookie *http.Cookie) error {
+	var runners []func() error
+	for _, spec := range r.UDP {
+		forward, err := ParseUDPForward(spec)
+		if err != nil {
+			return kflags.NewUsageErrorf("%w", err)
+		}
+		conn, err := net.ListenPacket("udp", forward.Local)
+		if err != nil {
+			return fmt.Errorf("failed to listen on udp %s: %w", forward.Local, err)
+		}
+		defer conn.Close()
+
+		runners = append(runners, func() error {
+			return r.RunUDP(ctx, conn, proxy, forward.Host, forward.Port, cookie)
+		})
+	}
+	return goroutine.WaitFirstError(runners...)
+}
+
+// RunUDP forwards the datagrams received on conn to host and port through the proxy, and the replies back.
+//
+// All the datagrams are carried by a single tunnel, which is closed when
+// ctx is canceled.
+func (r *Tunnel) RunUDP(ctx context.Context, conn net.PacketConn, proxy *url.URL, host string, port uint16, cookie *http.Cookie) error {
+	id := fmt.Sprintf("udp tunnel by %s on %s with %s via %s", r.Username(), conn.LocalAddr(), net.JoinHostPort(host, strconv.Itoa(int(port))), proxy)
+	r.Log.Infof("%s - forwarding datagrams", id)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	forwarder := ptunnel.NewUDPForwarder(conn, r.UDPMTU, r.UDPIdleTimeout)
+	sendr, sendw := io.Pipe()
+	recvr, recvw := io.Pipe()
+	go func() {
+		sendw.CloseWithError(forwarder.Send(sendw))
+	}()
+	go func() {
+		recvr.CloseWithError(forwarder.Receive(recvr))
+	}()
+
+	err := r.RunTunnel(proxy, id, host, port, cookie, sendr, recvw, ptunnel.WithUDP(r.UDPMTU))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
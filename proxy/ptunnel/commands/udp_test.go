@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/client"
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/System233/enkit/lib/token"
+	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/System233/enkit/proxy/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUDPForward(t *testing.T) {
+	for spec, expected := range map[string]Forward{
+		"5353:10.10.0.12:53":            {Local: ":5353", Host: "10.10.0.12", Port: 53},
+		"127.0.0.1:5353:dns.corp:53":    {Local: "127.0.0.1:5353", Host: "dns.corp", Port: 53},
+		"[::1]:5353:[fd00::12]:53":      {Local: "[::1]:5353", Host: "fd00::12", Port: 53},
+		"localhost:5353:10.10.0.12:123": {Local: "localhost:5353", Host: "10.10.0.12", Port: 123},
+	} {
+		forward, err := ParseUDPForward(spec)
+		assert.Nil(t, err, "%s", spec)
+		assert.Equal(t, expected, forward, "%s", spec)
+	}
+
+	for _, spec := range []string{"", "53", "10.10.0.12:53", ":10.10.0.12:53", "5353:10.10.0.12:0", "5353:10.10.0.12:dns", "a:b:c:d:53", "5353:[fd00::12:53"} {
+		_, err := ParseUDPForward(spec)
+		assert.NotNil(t, err, "%s", spec)
+	}
+}
+
+func TestRunUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			read, addr, err := echo.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buffer[:read], addr)
+		}
+	}()
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+
+	filter, err := utils.NewPatternList([]string{"udp|" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port))})
+	assert.Nil(t, err)
+	nassh, err := nasshp.New(rand.New(srand.Source), nil,
+		nasshp.WithLogging(logger.Nil),
+		nasshp.WithSymmetricOptions(token.WithGeneratedSymmetricKey(0)),
+		nasshp.WithOriginChecker(func(r *http.Request) bool { return true }),
+		nasshp.WithFilter(filter.Allow),
+	)
+	assert.Nil(t, err)
+	mux := http.NewServeMux()
+	nassh.Register(mux.Handle)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	purl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	tunnel := NewTunnel(client.DefaultBaseFlags("test", "enkit"))
+	tunnel.BaseFlags.Log = &logger.Proxy{Logger: logger.Nil}
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- tunnel.RunUDP(ctx, local, purl, "127.0.0.1", uint16(port), nil)
+	}()
+
+	conn, err := net.Dial("udp", local.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(quote))
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 1024)
+	read, err := conn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, quote, string(buffer[:read]))
+
+	cancel()
+	assert.Nil(t, <-done)
+
+	// Destinations not allowed by the proxy are rejected, as TCP ones.
+	local, err = net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	err = tunnel.RunUDP(context.Background(), local, purl, "127.0.0.1", uint16(port+1), nil)
+	assert.ErrorContains(t, err, "permanently rejected")
+}
@@ -0,0 +1,123 @@
+package ptunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/System233/enkit/lib/atomicfile"
+	"github.com/System233/enkit/proxy/nasshp"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostCA is the CA signing the ssh host keys of the machines reachable through a proxy.
+type HostCA struct {
+	// Public key of the CA, in authorized_keys format.
+	Key string
+	// Host patterns the CA is trusted for, in ssh known_hosts format, like "*.enkit.cloud".
+	Domains []string
+}
+
+// HostCAFromResponse returns the HostCA distributed by the proxy in the response to a /proxy request.
+//
+// Returns nil if the proxy did not distribute a CA, or the CA is invalid.
+func HostCAFromResponse(resp *http.Response) *HostCA {
+	key := strings.TrimSpace(resp.Header.Get(nasshp.HostCAHeader))
+	if key == "" {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return nil
+	}
+
+	ca := &HostCA{Key: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))}
+	for _, domain := range strings.Split(resp.Header.Get(nasshp.HostCADomainsHeader), ",") {
+		domain = strings.TrimSpace(domain)
+		if domain == "" || strings.ContainsAny(domain, " \t") {
+			continue
+		}
+		ca.Domains = append(ca.Domains, domain)
+	}
+	if len(ca.Domains) == 0 {
+		ca.Domains = []string{"*"}
+	}
+	return ca
+}
+
+// Line returns the @cert-authority known_hosts line trusting the CA.
+func (ca *HostCA) Line() string {
+	return fmt.Sprintf("@cert-authority %s %s", strings.Join(ca.Domains, ","), ca.Key)
+}
+
+const (
+	knownHostsHeader = "# Managed by enkit tunnel, changes will be overwritten."
+	knownHostsProxy  = "# proxy "
+)
+
+// WriteKnownHosts records the CA distributed by proxy in the known_hosts file at path.
+//
+// The file keeps one entry per proxy. The entry of the proxy is replaced
+// every time the proxy distributes a different CA, pruning the previous one,
+// and is removed if ca is nil. Other entries are left untouched.
+//
+// The file is replaced atomically, so ssh never reads a partially written
+// file, and it is not modified at all if the CA did not change.
+func WriteKnownHosts(path, proxy string, ca *HostCA) error {
+	original, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read %s - %w", path, err)
+	}
+	if len(original) == 0 && ca == nil {
+		return nil
+	}
+
+	var updated bytes.Buffer
+	fmt.Fprintln(&updated, knownHostsHeader)
+
+	current := ""
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, knownHostsProxy) {
+			current = strings.TrimPrefix(line, knownHostsProxy)
+			if current != proxy {
+				fmt.Fprintln(&updated, line)
+			}
+			continue
+		}
+		// Comments and lines not belonging to any proxy are dropped, as they cannot be pruned.
+		if line == "" || strings.HasPrefix(line, "#") || current == "" || current == proxy {
+			continue
+		}
+		fmt.Fprintln(&updated, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not parse %s - %w", path, err)
+	}
+	if ca != nil {
+		fmt.Fprintln(&updated, knownHostsProxy+proxy)
+		fmt.Fprintln(&updated, ca.Line())
+	}
+
+	if bytes.Equal(original, updated.Bytes()) {
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create %s - %w", dir, err)
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := atomicfile.WriteFile(path, updated.Bytes(), mode); err != nil {
+		return fmt.Errorf("could not replace %s - %w", path, err)
+	}
+	return nil
+}
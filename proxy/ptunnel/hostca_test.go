@@ -0,0 +1,119 @@
+package ptunnel
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/srand"
+	"github.com/System233/enkit/lib/token"
+	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateCA(t *testing.T) string {
+	pub, _, err := ed25519.GenerateKey(rand.New(srand.Source))
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestHostCAHandshake(t *testing.T) {
+	ca := generateCA(t)
+	nassh, err := nasshp.New(rand.New(srand.Source), nil, nasshp.WithLogging(&logger.DefaultLogger{Printer: log.Printf}),
+		nasshp.WithSymmetricOptions(token.WithGeneratedSymmetricKey(0)),
+		nasshp.WithHostCA([]byte(ca+" machinist-ca\n"), []string{"*.enkit.cloud", "10.0.*"}),
+		nasshp.WithOriginChecker(func(r *http.Request) bool { return true }))
+	assert.Nil(t, err)
+
+	mux := http.NewServeMux()
+	nassh.Register(mux.Handle)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	proxy, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	var received *HostCA
+	sid, err := GetSID(proxy, "127.0.0.1", 22, WithHostCAHandler(func(ca *HostCA) { received = ca }))
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", sid)
+	assert.Equal(t, &HostCA{Key: ca, Domains: []string{"*.enkit.cloud", "10.0.*"}}, received)
+
+	// Proxies without a host CA don't invoke the handler.
+	proxy, _ = startProxy(t)
+	received = nil
+	_, err = GetSID(proxy, "127.0.0.1", 22, WithHostCAHandler(func(ca *HostCA) { received = ca }))
+	assert.Nil(t, err)
+	assert.Nil(t, received)
+
+	_, err = nasshp.New(rand.New(srand.Source), nil, nasshp.WithHostCA([]byte("not-a-key"), nil))
+	assert.NotNil(t, err)
+}
+
+func TestWriteKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunnel", "known_hosts")
+
+	// Removing a CA from a file that does not exist creates nothing.
+	assert.Nil(t, WriteKnownHosts(path, "proxy.enkit.cloud", nil))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	ca1, ca2, ca3 := generateCA(t), generateCA(t), generateCA(t)
+	assert.Nil(t, WriteKnownHosts(path, "proxy.enkit.cloud", &HostCA{Key: ca1, Domains: []string{"*.enkit.cloud"}}))
+	assert.Nil(t, WriteKnownHosts(path, "proxy.example.com", &HostCA{Key: ca2, Domains: []string{"*"}}))
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, knownHostsHeader+"\n"+
+		"# proxy proxy.enkit.cloud\n@cert-authority *.enkit.cloud "+ca1+"\n"+
+		"# proxy proxy.example.com\n@cert-authority * "+ca2+"\n", string(data))
+
+	// The CA changed: the stale entry is pruned, and the new one added.
+	assert.Nil(t, WriteKnownHosts(path, "proxy.enkit.cloud", &HostCA{Key: ca3, Domains: []string{"*.enkit.cloud", "10.0.*"}}))
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, knownHostsHeader+"\n"+
+		"# proxy proxy.example.com\n@cert-authority * "+ca2+"\n"+
+		"# proxy proxy.enkit.cloud\n@cert-authority *.enkit.cloud,10.0.* "+ca3+"\n", string(data))
+
+	// Nothing changed, the file is left untouched.
+	before, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, WriteKnownHosts(path, "proxy.enkit.cloud", &HostCA{Key: ca3, Domains: []string{"*.enkit.cloud", "10.0.*"}}))
+	after, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(before, after))
+
+	// The mode of an existing file is preserved.
+	assert.Nil(t, os.Chmod(path, 0600))
+	assert.Nil(t, WriteKnownHosts(path, "proxy.example.com", nil))
+	info, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, knownHostsHeader+"\n"+
+		"# proxy proxy.enkit.cloud\n@cert-authority *.enkit.cloud,10.0.* "+ca3+"\n", string(data))
+
+	// No temporary file is left behind.
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
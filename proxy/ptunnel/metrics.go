@@ -0,0 +1,152 @@
+package ptunnel
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricBytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "tunnel",
+		Name:      "bytes_sent",
+		Help:      "Bytes sent through the proxy, including data sent again after a reconnection",
+	},
+		[]string{
+			// host:port the tunnel was opened with.
+			"destination",
+		},
+	)
+	metricBytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "tunnel",
+		Name:      "bytes_received",
+		Help:      "Bytes received through the proxy",
+	},
+		[]string{
+			// host:port the tunnel was opened with.
+			"destination",
+		},
+	)
+	metricFirstByte = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "tunnel",
+		Name:      "first_byte_seconds",
+		Help:      "Time between a tunnel being opened and the first byte received through it",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	metricProxyRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "tunnel",
+		Name:      "proxy_rtt_seconds",
+		Help:      "Round trip time to the proxy, as measured by the latency probe",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+)
+
+// Stats is a snapshot of the traffic carried by a Tunnel, as returned by Tunnel.Stats.
+type Stats struct {
+	// host:port the tunnel was opened with, empty until KeepConnected is invoked.
+	Destination string
+	State       TunnelState
+
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// Time between KeepConnected being invoked and the first byte received,
+	// zero if nothing was received yet.
+	FirstByte time.Duration
+	// Round trip time to the proxy measured by the last latency probe,
+	// zero if the probe is disabled or has not completed yet.
+	RTT time.Duration
+}
+
+// Stats returns a snapshot of the traffic carried by the tunnel.
+func (t *Tunnel) Stats() Stats {
+	state := t.State()
+
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	stats := t.stats
+	stats.State = state
+	return stats
+}
+
+// setDestination resets the time to first byte, and starts accounting traffic for destination.
+func (t *Tunnel) setDestination(destination string) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	t.stats.Destination = destination
+	t.stats.FirstByte = 0
+	t.started = t.timeouts.Now()
+	t.sent = metricBytesSent.WithLabelValues(destination)
+	t.received = metricBytesReceived.WithLabelValues(destination)
+}
+
+func (t *Tunnel) countSent(size int) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	t.stats.BytesSent += uint64(size)
+	if t.sent != nil {
+		t.sent.Add(float64(size))
+	}
+}
+
+func (t *Tunnel) countReceived(size int) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	t.stats.BytesReceived += uint64(size)
+	if t.received != nil {
+		t.received.Add(float64(size))
+	}
+	if size > 0 && t.stats.FirstByte == 0 && !t.started.IsZero() {
+		t.stats.FirstByte = t.timeouts.Now().Sub(t.started)
+		metricFirstByte.Observe(t.stats.FirstByte.Seconds())
+	}
+}
+
+// probe sends a ping carrying the current time to the proxy every Timeouts.ProbeInterval, until stop is closed.
+//
+// The proxy echoes the payload back in a pong, which is passed to handleProbe.
+func (t *Tunnel) probe(conn *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(t.timeouts.ProbeInterval)
+	defer ticker.Stop()
+
+	payload := [8]byte{}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := t.timeouts.Now()
+		binary.BigEndian.PutUint64(payload[:], uint64(now.UnixNano()))
+		if err := conn.WriteControl(websocket.PingMessage, payload[:], now.Add(t.timeouts.BrowserWriteTimeout)); err != nil {
+			t.log.Debugf("latency probe failed - %s", err)
+			return
+		}
+	}
+}
+
+// handleProbe records the round trip time of a pong sent in reply to a probe.
+//
+// Pongs in reply to the keepalive pings, which carry no payload, are ignored.
+func (t *Tunnel) handleProbe(data string, now time.Time) {
+	if len(data) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+	rtt := now.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+	metricProxyRTT.Observe(rtt.Seconds())
+
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	t.stats.RTT = rtt
+}
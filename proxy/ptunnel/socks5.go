@@ -0,0 +1,201 @@
+package ptunnel
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5Reply is the status code returned to a SOCKS5 client, as per RFC 1928.
+type SOCKS5Reply byte
+
+const (
+	SOCKS5Succeeded           SOCKS5Reply = 0x00
+	SOCKS5GeneralFailure      SOCKS5Reply = 0x01
+	SOCKS5NotAllowed          SOCKS5Reply = 0x02
+	SOCKS5HostUnreachable     SOCKS5Reply = 0x04
+	SOCKS5CommandNotSupported SOCKS5Reply = 0x07
+	SOCKS5AddressNotSupported SOCKS5Reply = 0x08
+)
+
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoneUsable = 0xff
+	socks5Connect        = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+)
+
+// SOCKS5Credentials are the username and password SOCKS5 clients must authenticate with.
+//
+// A nil SOCKS5Credentials accepts clients without authentication.
+type SOCKS5Credentials struct {
+	Username string
+	Password string
+}
+
+// SOCKS5Request is a CONNECT request received from a SOCKS5 client.
+type SOCKS5Request struct {
+	// Host to connect to, an IP address, or a hostname to be resolved
+	// by the proxy.
+	Host string
+	Port uint16
+
+	conn io.Writer
+}
+
+// Destination returns the host and port requested, in host:port format.
+func (r *SOCKS5Request) Destination() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// Reply sends the result of the request to the client.
+//
+// Once SOCKS5Succeeded is sent, the connection carries the data of the
+// tunnel. The bound address is always reported as 0.0.0.0:0, as the
+// connection is established by the proxy.
+func (r *SOCKS5Request) Reply(code SOCKS5Reply) error {
+	return socks5Reply(r.conn, code)
+}
+
+func socks5Reply(w io.Writer, code SOCKS5Reply) error {
+	_, err := w.Write([]byte{socks5Version, byte(code), 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// ReadSOCKS5Request performs the SOCKS5 handshake on conn, and returns the CONNECT request of the client.
+//
+// If creds is not nil, the client must authenticate with username and
+// password, as per RFC 1929. Requests other than CONNECT are replied to with
+// an error, and return an error. Once a request is returned, the caller must
+// send a reply with Reply.
+func ReadSOCKS5Request(conn io.ReadWriter, creds *SOCKS5Credentials) (*SOCKS5Request, error) {
+	header := [2]byte{}
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, fmt.Errorf("could not read SOCKS greeting - %w", err)
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, fmt.Errorf("could not read SOCKS authentication methods - %w", err)
+	}
+
+	want := byte(socks5AuthNone)
+	if creds != nil {
+		want = socks5AuthPassword
+	}
+	found := false
+	for _, method := range methods {
+		if method == want {
+			found = true
+			break
+		}
+	}
+	if !found {
+		conn.Write([]byte{socks5Version, socks5AuthNoneUsable})
+		return nil, fmt.Errorf("client does not support the required SOCKS authentication method %d, offered %v", want, methods)
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		if err := socks5Authenticate(conn, creds); err != nil {
+			return nil, err
+		}
+	}
+
+	request := [4]byte{}
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return nil, fmt.Errorf("could not read SOCKS request - %w", err)
+	}
+	if request[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d in request", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, fmt.Errorf("could not read SOCKS destination address - %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := [1]byte{}
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, fmt.Errorf("could not read SOCKS destination host - %w", err)
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, fmt.Errorf("could not read SOCKS destination host - %w", err)
+		}
+		host = string(name)
+	default:
+		socks5Reply(conn, SOCKS5AddressNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := [2]byte{}
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, fmt.Errorf("could not read SOCKS destination port - %w", err)
+	}
+
+	result := &SOCKS5Request{Host: host, Port: binary.BigEndian.Uint16(port[:]), conn: conn}
+	if request[1] != socks5Connect {
+		socks5Reply(conn, SOCKS5CommandNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d for %s - only CONNECT is supported", request[1], result.Destination())
+	}
+	return result, nil
+}
+
+// socks5Authenticate verifies the username and password sent by the client, as per RFC 1929.
+func socks5Authenticate(conn io.ReadWriter, creds *SOCKS5Credentials) error {
+	readString := func(what string) ([]byte, error) {
+		length := [1]byte{}
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, fmt.Errorf("could not read SOCKS %s - %w", what, err)
+		}
+		value := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, value); err != nil {
+			return nil, fmt.Errorf("could not read SOCKS %s - %w", what, err)
+		}
+		return value, nil
+	}
+
+	version := [1]byte{}
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return fmt.Errorf("could not read SOCKS authentication - %w", err)
+	}
+	if version[0] != socks5AuthVersion {
+		return fmt.Errorf("unsupported SOCKS authentication version %d", version[0])
+	}
+	username, err := readString("username")
+	if err != nil {
+		return err
+	}
+	password, err := readString("password")
+	if err != nil {
+		return err
+	}
+
+	userOk := subtle.ConstantTimeCompare(username, []byte(creds.Username))
+	passOk := subtle.ConstantTimeCompare(password, []byte(creds.Password))
+	if userOk&passOk != 1 {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return fmt.Errorf("invalid SOCKS username or password for user %q", username)
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, 0x00})
+	return err
+}
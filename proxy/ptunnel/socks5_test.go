@@ -0,0 +1,121 @@
+package ptunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/System233/enkit/lib/errdiff"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// socks5Conn is a connection replaying the bytes sent by a client, and recording the replies.
+type socks5Conn struct {
+	client io.Reader
+	sent   bytes.Buffer
+}
+
+func (c *socks5Conn) Read(p []byte) (int, error) {
+	return c.client.Read(p)
+}
+
+func (c *socks5Conn) Write(p []byte) (int, error) {
+	return c.sent.Write(p)
+}
+
+func TestReadSOCKS5Request(t *testing.T) {
+	creds := &SOCKS5Credentials{Username: "joe", Password: "secret"}
+	reply := []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+
+	testCases := []struct {
+		desc     string
+		creds    *SOCKS5Credentials
+		client   []byte
+		wantHost string
+		wantPort uint16
+		wantSent []byte
+		wantErr  string
+	}{
+		{
+			desc:     "ipv4 without authentication",
+			client:   []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 10, 0, 0, 12, 0x00, 0x16},
+			wantHost: "10.0.0.12",
+			wantPort: 22,
+			wantSent: []byte{0x05, 0x00},
+		},
+		{
+			desc:     "hostnames are not resolved",
+			client:   append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 17}, append([]byte("build.corp.lan.ch"), 0x01, 0xbb)...),
+			wantHost: "build.corp.lan.ch",
+			wantPort: 443,
+			wantSent: []byte{0x05, 0x00},
+		},
+		{
+			desc:     "ipv6",
+			client:   []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x04, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x50},
+			wantHost: "fd00::1",
+			wantPort: 80,
+			wantSent: []byte{0x05, 0x00},
+		},
+		{
+			desc:     "username and password",
+			creds:    creds,
+			client:   append([]byte{0x05, 0x02, 0x00, 0x02, 0x01, 3, 'j', 'o', 'e', 6}, append([]byte("secret"), 0x05, 0x01, 0x00, 0x01, 10, 0, 0, 12, 0x00, 0x16)...),
+			wantHost: "10.0.0.12",
+			wantPort: 22,
+			wantSent: []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			desc:     "invalid password",
+			creds:    creds,
+			client:   append([]byte{0x05, 0x01, 0x02, 0x01, 3, 'j', 'o', 'e', 5}, []byte("guess")...),
+			wantSent: []byte{0x05, 0x02, 0x01, 0x01},
+			wantErr:  "invalid SOCKS username or password",
+		},
+		{
+			desc:     "authentication required",
+			creds:    creds,
+			client:   []byte{0x05, 0x01, 0x00},
+			wantSent: []byte{0x05, 0xff},
+			wantErr:  "required SOCKS authentication method 2",
+		},
+		{
+			desc:     "only connect is supported",
+			client:   []byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 10, 0, 0, 12, 0x00, 0x16},
+			wantSent: append([]byte{0x05, 0x00}, 0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0),
+			wantErr:  "only CONNECT is supported",
+		},
+		{
+			desc:     "unsupported address type",
+			client:   []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x09},
+			wantSent: append([]byte{0x05, 0x00}, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0),
+			wantErr:  "unsupported SOCKS address type 9",
+		},
+		{
+			desc:    "socks4",
+			client:  []byte{0x04, 0x01, 0x00, 0x16, 10, 0, 0, 12, 0},
+			wantErr: "unsupported SOCKS version 4",
+		},
+		{
+			desc:     "truncated request",
+			client:   []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 10, 0},
+			wantSent: []byte{0x05, 0x00},
+			wantErr:  "could not read SOCKS destination address",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			conn := &socks5Conn{client: bytes.NewReader(tc.client)}
+			got, err := ReadSOCKS5Request(conn, tc.creds)
+			errdiff.Check(t, err, tc.wantErr)
+			if err == nil {
+				assert.Equal(t, tc.wantHost, got.Host)
+				assert.Equal(t, tc.wantPort, got.Port)
+				assert.Nil(t, got.Reply(SOCKS5Succeeded))
+				tc.wantSent = append(tc.wantSent, reply...)
+			}
+			assert.Equal(t, tc.wantSent, conn.sent.Bytes())
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package ptunnel
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/System233/enkit/lib/kflags"
@@ -21,9 +24,36 @@ import (
 	"github.com/System233/enkit/lib/logger"
 	"github.com/System233/enkit/lib/retry"
 	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/System233/enkit/proxy/utils"
 
 	"github.com/gorilla/websocket"
 	"github.com/jackpal/gateway"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Subsystem: "tunnel",
+	Name:      "state",
+	Help:      "Number of tunnels in each state",
+},
+	[]string{
+		// One of "connected", "reconnecting" or "down".
+		"state",
+	},
+)
+
+// TunnelState describes the connection of a Tunnel with the proxy.
+type TunnelState string
+
+const (
+	// The websocket with the proxy is established.
+	TunnelConnected TunnelState = "connected"
+	// The websocket is being established, or re-established after it dropped.
+	TunnelReconnecting TunnelState = "reconnecting"
+	// The tunnel is not trying to connect, either because KeepConnected
+	// has not been invoked yet, or because it gave up.
+	TunnelDown TunnelState = "down"
 )
 
 type Tunnel struct {
@@ -33,12 +63,28 @@ type Tunnel struct {
 
 	SendWin    *nasshp.BlockingSendWindow
 	ReceiveWin *nasshp.BlockingReceiveWindow
+
+	stateLock sync.Mutex
+	state     TunnelState // Protected by stateLock, empty once closed.
+
+	// All protected by statsLock.
+	statsLock sync.Mutex
+	stats     Stats
+	started   time.Time
+	sent      prometheus.Counter
+	received  prometheus.Counter
 }
 
 type GetOptions struct {
 	getOptions     []protocol.Modifier
 	retryOptions   []retry.Modifier
 	connectOptions []ConnectModifier
+
+	sid string
+	// Largest datagram forwarded, zero for TCP tunnels.
+	udpMTU int
+	// Invoked with the host CA distributed by the proxy, if any.
+	onHostCA func(*HostCA)
 }
 
 type GetModifier func(*GetOptions) error
@@ -82,6 +128,37 @@ func WithConnectOptions(mods ...ConnectModifier) GetModifier {
 	}
 }
 
+// Configures KeepConnected to use a session id already obtained with GetSID,
+// rather than requesting a new one.
+func WithSID(sid string) GetModifier {
+	return func(o *GetOptions) error {
+		o.sid = sid
+		return nil
+	}
+}
+
+// Configures the tunnel to forward UDP datagrams, as framed by nasshp.WriteDatagram,
+// rather than a TCP connection.
+//
+// mtu is the largest datagram the proxy should forward. The proxy may lower it.
+func WithUDP(mtu int) GetModifier {
+	return func(o *GetOptions) error {
+		if mtu <= 0 || mtu > nasshp.MaxDatagramSize {
+			return fmt.Errorf("invalid UDP MTU %d - must be between 1 and %d", mtu, nasshp.MaxDatagramSize)
+		}
+		o.udpMTU = mtu
+		return nil
+	}
+}
+
+// WithHostCAHandler invokes handler every time a session id is obtained from a proxy distributing a host CA.
+func WithHostCAHandler(handler func(*HostCA)) GetModifier {
+	return func(o *GetOptions) error {
+		o.onHostCA = handler
+		return nil
+	}
+}
+
 func WithOptions(r *GetOptions) GetModifier {
 	return func(o *GetOptions) error {
 		*o = *r
@@ -92,19 +169,23 @@ func WithOptions(r *GetOptions) GetModifier {
 func GetSID(proxy *url.URL, host string, port uint16, mods ...GetModifier) (string, error) {
 	curl := *proxy
 
+	options := &GetOptions{}
+	if err := GetModifiers(mods).Apply(options); err != nil {
+		return "", err
+	}
+
 	params := proxy.Query()
 	params.Add("host", host)
 	if port > 0 {
 		params.Add("port", fmt.Sprintf("%d", port))
 	}
+	if options.udpMTU > 0 {
+		params.Add("proto", "udp")
+		params.Add("mtu", strconv.Itoa(options.udpMTU))
+	}
 	curl.RawQuery = params.Encode()
 	curl.Path = path.Join(curl.Path, "/proxy")
 
-	options := &GetOptions{}
-	if err := GetModifiers(mods).Apply(options); err != nil {
-		return "", err
-	}
-
 	retrier := retry.New(options.retryOptions...)
 
 	sid := ""
@@ -117,11 +198,32 @@ func GetSID(proxy *url.URL, host string, port uint16, mods ...GetModifier) (stri
 			}
 		}
 
-		err := protocol.Get(curl.String(), protocol.Read(protocol.String(&sid)),
+		var denial *utils.Denial
+		var ca *HostCA
+		read := protocol.Read(protocol.String(&sid))
+		err := protocol.Get(curl.String(), func(url string, resp *http.Response, err error) error {
+			if err == nil && resp.StatusCode == http.StatusOK {
+				ca = HostCAFromResponse(resp)
+			}
+			// Denials by the proxy policy carry a JSON body explaining the reason.
+			if err == nil && resp.StatusCode == http.StatusForbidden && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+				denial = &utils.Denial{}
+				if err := json.NewDecoder(resp.Body).Decode(denial); err != nil {
+					denial = nil
+				}
+			}
+			return read(url, resp, err)
+		},
 			append([]protocol.Modifier{
 				protocol.WithClientOptions(kclient.WithDisabledRedirects()),
 				protocol.WithRequestOptions(krequest.AddHeader("Origin", "chrome://enkit-tunnel"))}, options.getOptions...)...)
 
+		if denial != nil {
+			return retry.Fatal(fmt.Errorf("Proxy %s rejected your connection attempt - %w", curl.String(), denial))
+		}
+		if err == nil && ca != nil && options.onHostCA != nil {
+			options.onHostCA(ca)
+		}
 		herr, ok := err.(*protocol.HTTPError)
 		if ok && herr.Resp != nil {
 			if herr.Resp.StatusCode == http.StatusTemporaryRedirect {
@@ -130,7 +232,7 @@ func GetSID(proxy *url.URL, host string, port uint16, mods ...GetModifier) (stri
 				))
 			}
 			if herr.Resp.StatusCode == http.StatusUnauthorized {
-				return retry.Fatal(fmt.Errorf("Proxy %s permanently rejected your connection attempt - ACLs?", curl.String()))
+				return retry.Fatal(fmt.Errorf("Proxy %s permanently rejected your connection attempt - ACLs?\n    %w", curl.String(), err))
 			}
 		}
 		return err
@@ -138,6 +240,13 @@ func GetSID(proxy *url.URL, host string, port uint16, mods ...GetModifier) (stri
 	return sid, err
 }
 
+// IsAccessDenied returns true if err was caused by the proxy refusing to
+// establish a tunnel with the requested host and port.
+func IsAccessDenied(err error) bool {
+	var herr *protocol.HTTPError
+	return errors.As(err, &herr) && herr.Resp != nil && herr.Resp.StatusCode == http.StatusUnauthorized
+}
+
 func Connect(proxy *url.URL, host string, port uint16, pos, ack uint32, mods ...GetModifier) (*websocket.Conn, error) {
 	options := &GetOptions{}
 	if err := GetModifiers(mods).Apply(options); err != nil {
@@ -208,6 +317,40 @@ func WithHeader(key, value string) ConnectModifier {
 	}
 }
 
+// WithClientFlags configures the websocket to honor the proxy and certificate settings in fl.
+//
+// This is the equivalent of kclient.FromFlags for websockets, so the tunnel
+// connects the same way as the http requests preparing it.
+func WithClientFlags(fl *kclient.Flags) ConnectModifier {
+	return func(d *websocket.Dialer, h http.Header) error {
+		if fl == nil {
+			return nil
+		}
+
+		proxy, err := kclient.ProxyFunc(fl.Proxy)
+		if err != nil {
+			return err
+		}
+		d.Proxy = proxy
+
+		if len(fl.RootCAs) <= 0 && !fl.InsecureCertificates {
+			return nil
+		}
+		config := &tls.Config{}
+		if d.TLSClientConfig != nil {
+			config = d.TLSClientConfig.Clone()
+		}
+		if len(fl.RootCAs) > 0 {
+			if config.RootCAs, err = kclient.LoadRootCAs(fl.RootCAs...); err != nil {
+				return err
+			}
+		}
+		config.InsecureSkipVerify = fl.InsecureCertificates
+		d.TLSClientConfig = config
+		return nil
+	}
+}
+
 func ConnectURL(curl *url.URL, mods ...ConnectModifier) (*websocket.Conn, error) {
 	header := http.Header{}
 	header.Add("Origin", "chrome://enkit-tunnel")
@@ -240,7 +383,7 @@ func ConnectURL(curl *url.URL, mods ...ConnectModifier) (*websocket.Conn, error)
 			)
 		case http.StatusGone:
 			return nil, retry.Fatal(
-				fmt.Errorf("Proxy %s permanently rejected the connection - proxy restarted? different region? No longer accepts your session id", durl),
+				fmt.Errorf("Proxy %s permanently rejected the connection - proxy restarted? different region? No longer accepts your session id\n    %w", durl, SessionLost),
 			)
 		}
 	}
@@ -258,6 +401,15 @@ type Timeouts struct {
 	BrowserAckInterval  time.Duration
 	BrowserPingInterval time.Duration
 	BrowserPingTimeout  time.Duration
+
+	// How long to keep trying to resume the session once the connection
+	// with the proxy drops. 0 means forever.
+	ResumeTimeout time.Duration
+	// Longest wait between attempts to connect to the proxy.
+	ReconnectMaxWait time.Duration
+
+	// How often to measure the round trip time to the proxy. 0 disables the probe.
+	ProbeInterval time.Duration
 }
 
 func DefaultTimeouts() *Timeouts {
@@ -269,6 +421,9 @@ func DefaultTimeouts() *Timeouts {
 
 		BrowserAckInterval:  time.Second * 1,
 		BrowserPingInterval: time.Second * 10,
+
+		ResumeTimeout:    time.Minute * 15,
+		ReconnectMaxWait: time.Second * 30,
 	}
 	to.BrowserPingTimeout = time.Duration(to.BrowserAckInterval + to.BrowserPingInterval*2)
 	return to
@@ -284,6 +439,13 @@ func (t *Timeouts) Register(set kflags.FlagSet, prefix string) *Timeouts {
 	set.DurationVar(&t.BrowserPingInterval, "browser-ping-interval", t.BrowserPingInterval, "How long to wait before sending a ping.")
 	set.DurationVar(&t.BrowserPingTimeout, "browser-ping-timeout", t.BrowserPingTimeout, "How long to wait for a pong to be received before considering the connection dead. Should be greater than browser-ping-interval")
 
+	set.DurationVar(&t.ResumeTimeout, "resume-timeout", t.ResumeTimeout,
+		"How long to keep trying to reconnect to the proxy once the connection drops, before closing the tunnel. 0 means forever")
+	set.DurationVar(&t.ReconnectMaxWait, "reconnect-max-wait", t.ReconnectMaxWait,
+		"The wait between reconnection attempts doubles at each failure, up to this value")
+	set.DurationVar(&t.ProbeInterval, "probe-interval", t.ProbeInterval,
+		"How often to measure the round trip time to the proxy with a websocket ping, exported as a metric. 0 disables the probe")
+
 	return t
 }
 
@@ -388,7 +550,10 @@ func NewTunnel(pool *nasshp.BufferPool, mods ...Modifier) (*Tunnel, error) {
 
 		SendWin:    nasshp.NewBlockingSendWindow(pool, uint64(options.MaxSendWindow)),
 		ReceiveWin: nasshp.NewBlockingReceiveWindow(pool, uint64(options.MaxReceiveWindow)),
-		browser:    nasshp.NewReplaceableBrowser(options.Logger, nil)}
+		browser:    nasshp.NewReplaceableBrowser(options.Logger, nil),
+		state:      TunnelDown,
+	}
+	metricState.WithLabelValues(string(tl.state)).Inc()
 
 	go tl.BrowserReceive()
 	go tl.BrowserSend()
@@ -400,59 +565,151 @@ func NewTunnel(pool *nasshp.BufferPool, mods ...Modifier) (*Tunnel, error) {
 // has been requested by the user.
 var CloseRequested = errors.New("close requested")
 
+// SessionLost error is returned once the session with the proxy cannot be resumed.
+//
+// Data that was in flight when the connection dropped may have been lost,
+// so the tunnel is closed, and all Reads/Writes are interrupted.
+var SessionLost = errors.New("tunnel session could not be resumed")
+
 func (t *Tunnel) Close() {
-	err := CloseRequested
+	t.fail(CloseRequested)
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if t.state != "" {
+		metricState.WithLabelValues(string(t.state)).Dec()
+		t.state = ""
+	}
+}
+
+// fail terminates all operations on the tunnel with the specified error.
+func (t *Tunnel) fail(err error) {
 	t.browser.Close(err)
 	t.SendWin.Fail(err)
 	t.ReceiveWin.Fail(err)
 }
 
-func (t *Tunnel) KeepConnected(proxy *url.URL, host string, port uint16, mods ...GetModifier) error {
-	options := &GetOptions{
-		retryOptions: []retry.Modifier{retry.WithAttempts(0), retry.WithLogger(t.log), retry.WithDescription(fmt.Sprintf("connecting to %s:%d via %s", host, port, proxy.String()))},
+// State returns the current state of the connection with the proxy.
+//
+// Once the tunnel is closed, State returns an empty TunnelState.
+func (t *Tunnel) State() TunnelState {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.state
+}
+
+func (t *Tunnel) setState(state TunnelState) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if t.state == state || t.state == "" {
+		return
 	}
+	metricState.WithLabelValues(string(t.state)).Dec()
+	metricState.WithLabelValues(string(state)).Inc()
+	t.state = state
+}
+
+// KeepConnected connects the tunnel to host and port via the proxy, and reconnects it every time the connection drops.
+//
+// On reconnect, the session is resumed: data not acknowledged by the proxy
+// is sent again, as per the nassh relay protocol. The wait between attempts
+// grows exponentially, up to Timeouts.ReconnectMaxWait. If the session
+// cannot be resumed within Timeouts.ResumeTimeout, or the proxy no longer
+// knows about it, the tunnel is failed with an error wrapping SessionLost.
+//
+// KeepConnected returns nil once Close is invoked.
+func (t *Tunnel) KeepConnected(proxy *url.URL, host string, port uint16, mods ...GetModifier) error {
+	t.setState(TunnelReconnecting)
+	defer t.setState(TunnelDown)
+
+	t.setDestination(net.JoinHostPort(host, strconv.Itoa(int(port))))
+
+	description := fmt.Sprintf("connecting to %s:%d via %s", host, port, proxy.String())
+	defaults := []retry.Modifier{retry.WithAttempts(0), retry.WithBackoff(t.timeouts.ReconnectMaxWait), retry.WithLogger(t.log), retry.WithDescription(description)}
+	options := &GetOptions{retryOptions: defaults}
 	if err := GetModifiers(mods).Apply(options); err != nil {
 		return err
 	}
 
-	sid, err := GetSID(proxy, host, port, WithOptions(options))
-	if err != nil {
-		return err
+	sid := options.sid
+	if sid == "" {
+		var err error
+		sid, err = GetSID(proxy, host, port, WithOptions(options))
+		if err != nil {
+			return err
+		}
 	}
 
-	retrier := retry.New(options.retryOptions...)
-	return retrier.RunAttempt(func(attempt int) error {
-		// Re-evaluate the options - this may result in a new cookie loaded.
-		if attempt > 0 {
-			options = &GetOptions{}
-			if err := GetModifiers(mods).Apply(options); err != nil {
-				return err
+	// When the connection last dropped, zero until the first connection is established.
+	var dropped time.Time
+	for {
+		// A new retrier for each connection, so the backoff restarts from the
+		// shortest wait every time the connection drops.
+		var conn *websocket.Conn
+		var pos, ack uint32
+		retrier := retry.New(options.retryOptions...)
+		err := retrier.RunAttempt(func(attempt int) error {
+			// Re-evaluate the options - this may result in a new cookie loaded.
+			if attempt > 0 {
+				options = &GetOptions{retryOptions: defaults}
+				if err := GetModifiers(mods).Apply(options); err != nil {
+					return err
+				}
 			}
-		}
 
-		// Following the nassh documentation, at:
-		//  https://chromium.googlesource.com/apps/libapps/+/4763ff7fa95760c9c85ef3563953cdfb391d209f/nassh/doc/relay-protocol.md
-		// pos: "... the last write ack the client received" -> WrittenUntil
-		// ack: "... the last read ack the client received" -> ReadUntil
+			if t.State() == "" {
+				return retry.Fatal(CloseRequested)
+			}
+			if !dropped.IsZero() && t.timeouts.ResumeTimeout > 0 {
+				if elapsed := t.timeouts.Now().Sub(dropped); elapsed > t.timeouts.ResumeTimeout {
+					return retry.Fatal(fmt.Errorf("%w - connection dropped %s ago, giving up after %s", SessionLost, elapsed.Round(time.Second), t.timeouts.ResumeTimeout))
+				}
+			}
 
-		pos, ack := t.browser.GetWriteReadUntil()
-		conn, err := ConnectSID(proxy, sid, pos, ack, options.connectOptions...)
+			// Following the nassh documentation, at:
+			//  https://chromium.googlesource.com/apps/libapps/+/4763ff7fa95760c9c85ef3563953cdfb391d209f/nassh/doc/relay-protocol.md
+			// pos: "... the last write ack the client received" -> WrittenUntil
+			// ack: "... the last read ack the client received" -> ReadUntil
+			var err error
+			pos, ack = t.browser.GetWriteReadUntil()
+			conn, err = ConnectSID(proxy, sid, pos, ack, options.connectOptions...)
+			return err
+		})
+		if errors.Is(err, CloseRequested) {
+			return nil
+		}
 		if err != nil {
+			if errors.Is(err, SessionLost) {
+				t.fail(err)
+			}
 			return err
 		}
 
 		conn.SetReadDeadline(t.timeouts.Now().Add(t.timeouts.BrowserPingTimeout))
-		conn.SetPongHandler(func(string) error {
-			conn.SetReadDeadline(t.timeouts.Now().Add(t.timeouts.BrowserPingTimeout))
+		conn.SetPongHandler(func(data string) error {
+			now := t.timeouts.Now()
+			conn.SetReadDeadline(now.Add(t.timeouts.BrowserPingTimeout))
+			t.handleProbe(data, now)
 			return nil
 		})
 
 		waiter := t.browser.Set(conn, ack, pos)
-		if err := waiter.Wait(); !errors.Is(err, CloseRequested) {
-			return err
+		t.setState(TunnelConnected)
+
+		stop := make(chan struct{})
+		if t.timeouts.ProbeInterval > 0 {
+			go t.probe(conn, stop)
 		}
-		return nil
-	})
+		err = waiter.Wait()
+		close(stop)
+		if errors.Is(err, CloseRequested) {
+			return nil
+		}
+		t.log.Infof("%s - connection dropped - %s - resuming", description, err)
+
+		t.setState(TunnelReconnecting)
+		dropped = t.timeouts.Now()
+	}
 }
 
 func (t *Tunnel) BrowserSend() error {
@@ -530,6 +787,7 @@ outer:
 				continue outer
 			}
 			t.SendWin.Empty(written)
+			t.countSent(written)
 
 			buffer = t.SendWin.ToEmpty()
 			if len(buffer) == 0 {
@@ -610,6 +868,7 @@ retry:
 				break
 			}
 			conn.SetReadDeadline(t.timeouts.Now().Add(t.timeouts.BrowserPingTimeout))
+			t.countReceived(size)
 			filled := t.ReceiveWin.Fill(size)
 			t.browser.PushReadUntil((uint32)(filled) & 0xffffff)
 		}
@@ -1,6 +1,7 @@
 package ptunnel
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,17 +13,21 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/System233/enkit/lib/errdiff"
 	"github.com/System233/enkit/lib/khttp"
+	"github.com/System233/enkit/lib/khttp/kclient"
 	"github.com/System233/enkit/lib/khttp/ktest"
 	"github.com/System233/enkit/lib/khttp/protocol"
 	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/retry"
 	"github.com/System233/enkit/lib/srand"
 	"github.com/System233/enkit/lib/token"
 	"github.com/System233/enkit/proxy/nasshp"
 	"github.com/System233/enkit/proxy/utils"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -139,6 +144,167 @@ func TestBasic(t *testing.T) {
 	assert.Equal(t, quote2, string(buffer[:r]))
 }
 
+// startProxy starts a nassh proxy, returning its URL, and the server to stop it.
+func startProxy(t *testing.T) (*url.URL, *httptest.Server) {
+	nassh, err := nasshp.New(rand.New(srand.Source), nil, nasshp.WithLogging(&logger.DefaultLogger{Printer: log.Printf}),
+		nasshp.WithSymmetricOptions(token.WithGeneratedSymmetricKey(0)),
+		nasshp.WithOriginChecker(func(r *http.Request) bool { return true }))
+	assert.Nil(t, err)
+
+	mux := http.NewServeMux()
+	nassh.Register(mux.Handle)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	return u, server
+}
+
+func waitState(t *testing.T, tl *Tunnel, state TunnelState) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return tl.State() == state }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestResume(t *testing.T) {
+	buffer := [8192]byte{}
+	u, _ := startProxy(t)
+
+	tl, err := NewTunnel(nasshp.NewBufferPool(32), WithLogger(logger.Nil))
+	assert.Nil(t, err)
+	assert.Equal(t, TunnelDown, tl.State())
+
+	port, a, err := Listener()
+	assert.Nil(t, err)
+
+	tr, pw := io.Pipe()
+	pr, tw := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tl.KeepConnected(u, "127.0.0.1", (uint16)(port), WithRetryOptions(retry.WithWait(10*time.Millisecond)))
+	}()
+	go tl.Receive(pw)
+	go tl.Send(pr)
+
+	tcp := a.Get()
+	tw.Write([]byte(quote1))
+	r, err := ReadN(tcp, len(quote1), buffer[:])
+	assert.Nil(t, err)
+	assert.Equal(t, quote1, string(buffer[:r]))
+	tcp.Write([]byte(quote2))
+	r, err = ReadN(tr, len(quote2), buffer[:])
+	assert.Nil(t, err)
+	assert.Equal(t, quote2, string(buffer[:r]))
+	waitState(t, tl, TunnelConnected)
+
+	// A resume with 0 positions is indistinguishable from a new session
+	// for the proxy, wait for data to be acknowledged in both directions.
+	assert.Eventually(t, func() bool {
+		pos, ack := tl.browser.GetWriteReadUntil()
+		return pos != 0 && ack != 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Drop the websocket, data must keep flowing in both directions once the session is resumed.
+	for i := 0; i < 3; i++ {
+		conn, err := tl.browser.Get()
+		assert.Nil(t, err)
+		conn.Close()
+
+		tcp.Write([]byte(quote2))
+		r, err = ReadN(tr, len(quote2), buffer[:])
+		assert.Nil(t, err)
+		assert.Equal(t, quote2, string(buffer[:r]))
+
+		tw.Write([]byte(quote1))
+		r, err = ReadN(tcp, len(quote1), buffer[:])
+		assert.Nil(t, err)
+		assert.Equal(t, quote1, string(buffer[:r]))
+	}
+	waitState(t, tl, TunnelConnected)
+
+	tl.Close()
+	assert.Nil(t, <-done)
+	assert.Equal(t, TunnelState(""), tl.State())
+}
+
+func TestSessionLost(t *testing.T) {
+	u, server := startProxy(t)
+
+	timeouts := DefaultTimeouts()
+	timeouts.ResumeTimeout = 200 * time.Millisecond
+	tl, err := NewTunnel(nasshp.NewBufferPool(32), WithLogger(logger.Nil), WithTimeouts(timeouts))
+	assert.Nil(t, err)
+
+	port, a, err := Listener()
+	assert.Nil(t, err)
+
+	tr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- tl.KeepConnected(u, "127.0.0.1", (uint16)(port), WithRetryOptions(retry.WithWait(10*time.Millisecond)))
+	}()
+	received := make(chan error, 1)
+	go func() { received <- tl.Receive(pw) }()
+
+	a.Get()
+	waitState(t, tl, TunnelConnected)
+
+	// With the proxy no longer accepting connections, the session cannot be resumed.
+	server.Listener.Close()
+	conn, err := tl.browser.Get()
+	assert.Nil(t, err)
+	conn.Close()
+
+	err = <-done
+	assert.True(t, errors.Is(err, SessionLost), "%v", err)
+	assert.Equal(t, TunnelDown, tl.State())
+
+	// Pending operations on the tunnel are interrupted with the same error.
+	assert.True(t, errors.Is(<-received, SessionLost))
+	tr.Close()
+}
+
+func TestStats(t *testing.T) {
+	buffer := [8192]byte{}
+	u, _ := startProxy(t)
+
+	timeouts := DefaultTimeouts()
+	timeouts.ProbeInterval = 10 * time.Millisecond
+	tl, err := NewTunnel(nasshp.NewBufferPool(32), WithLogger(logger.Nil), WithTimeouts(timeouts))
+	assert.Nil(t, err)
+	defer tl.Close()
+
+	port, a, err := Listener()
+	assert.Nil(t, err)
+
+	tr, pw := io.Pipe()
+	pr, tw := io.Pipe()
+	go tl.KeepConnected(u, "127.0.0.1", (uint16)(port))
+	go tl.Receive(pw)
+	go tl.Send(pr)
+
+	tcp := a.Get()
+	tw.Write([]byte(quote1))
+	r, err := ReadN(tcp, len(quote1), buffer[:])
+	assert.Nil(t, err)
+	assert.Equal(t, quote1, string(buffer[:r]))
+	tcp.Write([]byte(quote2))
+	r, err = ReadN(tr, len(quote2), buffer[:])
+	assert.Nil(t, err)
+	assert.Equal(t, quote2, string(buffer[:r]))
+
+	// The probe runs in the background, wait for at least one round trip.
+	assert.Eventually(t, func() bool { return tl.Stats().RTT > 0 }, 5*time.Second, 10*time.Millisecond)
+
+	stats := tl.Stats()
+	assert.Equal(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), stats.Destination)
+	assert.Equal(t, TunnelConnected, stats.State)
+	assert.Equal(t, uint64(len(quote1)), stats.BytesSent)
+	assert.Equal(t, uint64(len(quote2)), stats.BytesReceived)
+	assert.True(t, stats.FirstByte > 0)
+}
+
 var (
 	hosts     = []string{"google.com", "amazon.com", "reddit.com"}
 	protocols = []string{"udp|", "tcp|", ""}
@@ -246,3 +412,19 @@ func testCanConnect(serverUrl, host string, port int, shouldFail bool) func(t *t
 		assert.GreaterOrEqual(t, len(responseString), 5, "%s", responseString)
 	}
 }
+
+func TestWithClientFlags(t *testing.T) {
+	dialer := *websocket.DefaultDialer
+	assert.Nil(t, WithClientFlags(&kclient.Flags{Proxy: "http://proxy.corp:3128", InsecureCertificates: true})(&dialer, http.Header{}))
+
+	req := httptest.NewRequest(http.MethodGet, "https://enkit.io/connect", nil)
+	proxy, err := dialer.Proxy(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://proxy.corp:3128", proxy.String())
+	assert.True(t, dialer.TLSClientConfig.InsecureSkipVerify)
+	// The default dialer is not modified.
+	assert.Nil(t, websocket.DefaultDialer.TLSClientConfig)
+
+	assert.NotNil(t, WithClientFlags(&kclient.Flags{RootCAs: []string{"/nonexistent/ca.pem"}})(&dialer, http.Header{}))
+	assert.NotNil(t, WithClientFlags(&kclient.Flags{Proxy: "proxy.corp"})(&dialer, http.Header{}))
+}
@@ -0,0 +1,147 @@
+package ptunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/System233/enkit/proxy/nasshp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricUDPDatagrams = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "tunnel",
+	Name:      "udp_datagrams",
+	Help:      "Number of datagrams handled by UDP forwarders",
+},
+	[]string{
+		// "sent" for datagrams from the local socket to the tunnel,
+		// "received" for datagrams from the tunnel to the local socket.
+		"direction",
+		// One of "forwarded", "too_large" or "unknown_flow".
+		"result",
+	},
+)
+
+// udpSource is a local client sending datagrams through the UDPForwarder.
+type udpSource struct {
+	stream uint32
+	addr   net.Addr
+	last   time.Time
+}
+
+// UDPForwarder forwards the datagrams received on a local socket through a tunnel, and the replies back.
+//
+// Each address sending datagrams to the socket is assigned a stream id, so
+// that the proxy can use a different socket for each, and replies can be
+// returned to the address that sent the request. Addresses idle for longer
+// than the idle timeout are forgotten.
+type UDPForwarder struct {
+	conn net.PacketConn
+	mtu  int
+	idle time.Duration
+
+	lock    sync.Mutex
+	next    uint32
+	expired time.Time
+	sources map[string]*udpSource // Protected by lock, indexed by address.
+	streams map[uint32]*udpSource // Protected by lock, indexed by stream id.
+}
+
+// NewUDPForwarder returns a forwarder for the datagrams received on conn.
+//
+// Datagrams larger than mtu are dropped.
+func NewUDPForwarder(conn net.PacketConn, mtu int, idle time.Duration) *UDPForwarder {
+	return &UDPForwarder{
+		conn:    conn,
+		mtu:     mtu,
+		idle:    idle,
+		sources: map[string]*udpSource{},
+		streams: map[uint32]*udpSource{},
+	}
+}
+
+// source returns the udpSource of addr, assigning a new stream id if necessary.
+func (f *UDPForwarder) source(addr net.Addr, now time.Time) *udpSource {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// No need to scan all sources at every datagram.
+	if now.Sub(f.expired) > f.idle/2 {
+		f.expired = now
+		for key, source := range f.sources {
+			if now.Sub(source.last) > f.idle {
+				delete(f.sources, key)
+				delete(f.streams, source.stream)
+			}
+		}
+	}
+
+	source := f.sources[addr.String()]
+	if source == nil {
+		f.next++
+		source = &udpSource{stream: f.next, addr: addr}
+		f.sources[addr.String()] = source
+		f.streams[source.stream] = source
+	}
+	source.last = now
+	return source
+}
+
+// Send reads the datagrams received on the local socket, and writes them to w.
+//
+// Returns when the local socket is closed, or w fails.
+func (f *UDPForwarder) Send(w io.Writer) error {
+	// One byte larger than the mtu, to detect datagrams that don't fit.
+	buffer := make([]byte, f.mtu+1)
+	for {
+		read, addr, err := f.conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if read > f.mtu {
+			metricUDPDatagrams.WithLabelValues("sent", "too_large").Inc()
+			continue
+		}
+
+		source := f.source(addr, time.Now())
+		if err := nasshp.WriteDatagram(w, source.stream, buffer[:read]); err != nil {
+			return err
+		}
+		metricUDPDatagrams.WithLabelValues("sent", "forwarded").Inc()
+	}
+}
+
+// Receive reads the datagrams from r, and sends each to the local address the flow belongs to.
+//
+// Returns when r is closed, or the local socket fails.
+func (f *UDPForwarder) Receive(r io.Reader) error {
+	dr := nasshp.NewDatagramReader(r, f.mtu)
+	buffer := make([]byte, f.mtu)
+	for {
+		stream, datagram, err := dr.Read(buffer)
+		if errors.Is(err, nasshp.ErrDatagramTooLarge) {
+			metricUDPDatagrams.WithLabelValues("received", "too_large").Inc()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		f.lock.Lock()
+		source := f.streams[stream]
+		f.lock.Unlock()
+		if source == nil {
+			metricUDPDatagrams.WithLabelValues("received", "unknown_flow").Inc()
+			continue
+		}
+		if _, err := f.conn.WriteTo(datagram, source.addr); err != nil {
+			return err
+		}
+		metricUDPDatagrams.WithLabelValues("received", "forwarded").Inc()
+	}
+}
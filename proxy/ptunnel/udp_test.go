@@ -0,0 +1,95 @@
+package ptunnel
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/System233/enkit/lib/logger"
+	"github.com/System233/enkit/lib/retry"
+	"github.com/System233/enkit/proxy/nasshp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPForwarder(t *testing.T) {
+	u, _ := startProxy(t)
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			read, addr, err := echo.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buffer[:read], addr)
+		}
+	}()
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer local.Close()
+	forwarder := NewUDPForwarder(local, 32, time.Minute)
+
+	tl, err := NewTunnel(nasshp.NewBufferPool(1024), WithLogger(logger.Nil))
+	assert.Nil(t, err)
+	defer tl.Close()
+
+	tr, fw := io.Pipe()
+	fr, tw := io.Pipe()
+	go tl.KeepConnected(u, "127.0.0.1", uint16(echo.LocalAddr().(*net.UDPAddr).Port), WithUDP(32), WithRetryOptions(retry.WithWait(10*time.Millisecond)))
+	go tl.Send(tr)
+	go tl.Receive(tw)
+	go forwarder.Send(fw)
+	go forwarder.Receive(fr)
+
+	// Each client gets its own replies.
+	clients := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("udp", local.LocalAddr().String())
+		assert.Nil(t, err)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	buffer := make([]byte, 64)
+	for i, client := range clients {
+		message := strings.Repeat(string(rune('a'+i)), 16)
+		_, err := client.Write([]byte(message))
+		assert.Nil(t, err)
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		read, err := client.Read(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, message, string(buffer[:read]))
+	}
+
+	// Datagrams larger than the mtu are dropped, without affecting the following ones.
+	_, err = clients[0].Write([]byte(strings.Repeat("x", 33)))
+	assert.Nil(t, err)
+	_, err = clients[0].Write([]byte("small"))
+	assert.Nil(t, err)
+	read, err := clients[0].Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "small", string(buffer[:read]))
+}
+
+func TestUDPForwarderExpire(t *testing.T) {
+	forwarder := NewUDPForwarder(nil, 32, time.Minute)
+	first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}
+
+	now := time.Now()
+	assert.Equal(t, uint32(1), forwarder.source(first, now).stream)
+	assert.Equal(t, uint32(2), forwarder.source(second, now).stream)
+	assert.Equal(t, uint32(1), forwarder.source(first, now.Add(50*time.Second)).stream)
+
+	// second has been idle for longer than the timeout.
+	assert.Equal(t, uint32(1), forwarder.source(first, now.Add(90*time.Second)).stream)
+	assert.Equal(t, map[uint32]*udpSource{1: forwarder.sources[first.String()]}, forwarder.streams)
+	assert.Equal(t, uint32(3), forwarder.source(second, now.Add(90*time.Second)).stream)
+}
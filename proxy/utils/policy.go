@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/System233/enkit/lib/config/marshal"
+	"github.com/System233/enkit/lib/oauth"
+)
+
+// Anonymous is the user reported for connections without credentials.
+const Anonymous = "anonymous"
+
+// Policy grants a set of users and groups access to a set of destinations.
+type Policy struct {
+	// Name of the policy, reported to users denied access by it.
+	Name string
+
+	// Users the policy applies to, by oauth.Identity.GlobalName, like "carlo@enfabrica.net".
+	// "*" applies the policy to all users, including unauthenticated ones.
+	Users []string
+	// Groups the policy applies to, as listed in oauth.Identity.Groups.
+	Groups []string
+
+	// Destinations allowed, as "[proto|]host:port" patterns.
+	//
+	// host is either a CIDR, or a pattern valid as per filepath.Match. port is
+	// a pattern valid as per filepath.Match. Without proto, the pattern applies
+	// to all protocols. Patterns are matched both against the host name as
+	// supplied by the user, and against the addresses it resolves to.
+	//
+	// Some example patterns:
+	// - "10.10.0.0/16:22" -> allow any connection to port 22 of hosts in 10.10.0.0/16.
+	// - "tcp|10.10.0.12:*" -> allow tcp connections to 10.10.0.12 on any port.
+	// - "udp|[fd00::/8]:53" -> allow forwarding UDP datagrams to port 53 of hosts in fd00::/8.
+	Allow []string
+	// Destinations denied, in the same format as Allow.
+	//
+	// Denied destinations cannot be reached by the users the policy applies to,
+	// even if allowed by this or other policies.
+	Deny []string
+}
+
+// PolicyConfig is the content of a policy file.
+type PolicyConfig struct {
+	Policies []Policy
+}
+
+// Denial explains why a destination was denied.
+//
+// It is returned to clients as JSON, so they can show which policy blocked a connection.
+type Denial struct {
+	User        string `json:"user"`
+	Destination string `json:"destination"`
+
+	// Name of the policies that blocked the connection. Empty if no policy applies to the user.
+	Policy string `json:"policy,omitempty"`
+	// Deny pattern matching the destination. Empty if no pattern allowed the destination.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+func (d *Denial) Error() string {
+	switch {
+	case d.Policy == "":
+		return fmt.Sprintf("%s is not allowed to connect to %s - no policy applies to the user", d.User, d.Destination)
+	case d.Pattern == "":
+		return fmt.Sprintf("%s is not allowed to connect to %s - not allowed by policy %s", d.User, d.Destination, d.Policy)
+	}
+	return fmt.Sprintf("%s is not allowed to connect to %s - denied by pattern %s of policy %s", d.User, d.Destination, d.Pattern, d.Policy)
+}
+
+type destinationPattern struct {
+	raw string
+
+	proto string
+	host  string
+	cidr  *net.IPNet
+	port  string
+}
+
+func parseDestinationPattern(raw string) (*destinationPattern, error) {
+	dp := &destinationPattern{raw: raw, proto: "*"}
+
+	hostport := raw
+	if index := strings.Index(raw, "|"); index >= 0 {
+		dp.proto, hostport = raw[:index], raw[index+1:]
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %s - must be [proto|]host:port - %w", raw, err)
+	}
+	dp.port = port
+	if _, cidr, err := net.ParseCIDR(host); err == nil {
+		dp.cidr = cidr
+	} else {
+		dp.host = host
+	}
+
+	for _, pattern := range []string{dp.proto, dp.host, dp.port} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid destination %s - %w", raw, err)
+		}
+	}
+	return dp, nil
+}
+
+func (dp *destinationPattern) Match(proto, host, port string) bool {
+	if match, _ := filepath.Match(dp.proto, proto); !match {
+		return false
+	}
+	if match, _ := filepath.Match(dp.port, port); !match {
+		return false
+	}
+	if dp.cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && dp.cidr.Contains(ip)
+	}
+	match, _ := filepath.Match(dp.host, host)
+	return match
+}
+
+type parsedPolicy struct {
+	name   string
+	users  []string
+	groups []string
+	allow  []*destinationPattern
+	deny   []*destinationPattern
+}
+
+func (pp *parsedPolicy) AppliesTo(user string, groups []string) bool {
+	for _, u := range pp.users {
+		if u == "*" || u == user {
+			return true
+		}
+	}
+	for _, g := range pp.groups {
+		for _, group := range groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Policies is a set of parsed policies, created with NewPolicies.
+type Policies struct {
+	policies []*parsedPolicy
+}
+
+// NewPolicies verifies and parses the configured policies.
+func NewPolicies(config *PolicyConfig) (*Policies, error) {
+	policies := &Policies{}
+	names := map[string]bool{}
+	for _, policy := range config.Policies {
+		if policy.Name == "" {
+			return nil, fmt.Errorf("invalid policy - all policies must have a name")
+		}
+		if names[policy.Name] {
+			return nil, fmt.Errorf("invalid policy %s - the name is used by another policy", policy.Name)
+		}
+		names[policy.Name] = true
+
+		parsed := &parsedPolicy{name: policy.Name, users: policy.Users, groups: policy.Groups}
+		for _, raw := range policy.Allow {
+			dp, err := parseDestinationPattern(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy %s - %w", policy.Name, err)
+			}
+			parsed.allow = append(parsed.allow, dp)
+		}
+		for _, raw := range policy.Deny {
+			dp, err := parseDestinationPattern(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy %s - %w", policy.Name, err)
+			}
+			parsed.deny = append(parsed.deny, dp)
+		}
+		policies.policies = append(policies.policies, parsed)
+	}
+	return policies, nil
+}
+
+// Check returns VerdictAllow if the user identified by creds can connect to proto and ipport.
+//
+// Otherwise, it returns VerdictDrop together with a Denial explaining which
+// policy blocked the connection. creds can be nil for unauthenticated users.
+func (p *Policies) Check(proto string, ipport string, creds *oauth.CredentialsCookie) (Verdict, *Denial) {
+	user, groups := Anonymous, []string(nil)
+	if creds != nil {
+		user, groups = creds.Identity.GlobalName(), creds.Identity.Groups
+	}
+	denial := &Denial{User: user, Destination: proto + "|" + ipport}
+
+	host, port, err := net.SplitHostPort(ipport)
+	if err != nil {
+		return VerdictDrop, denial
+	}
+
+	var applied []string
+	allowed := false
+	for _, policy := range p.policies {
+		if !policy.AppliesTo(user, groups) {
+			continue
+		}
+		applied = append(applied, policy.name)
+
+		for _, dp := range policy.deny {
+			if dp.Match(proto, host, port) {
+				denial.Policy, denial.Pattern = policy.name, dp.raw
+				return VerdictDrop, denial
+			}
+		}
+		for _, dp := range policy.allow {
+			if dp.Match(proto, host, port) {
+				allowed = true
+				break
+			}
+		}
+	}
+	if allowed {
+		return VerdictAllow, nil
+	}
+	denial.Policy = strings.Join(applied, ",")
+	return VerdictDrop, denial
+}
+
+// PolicyFile is a set of Policies loaded from a file, that can be reloaded while in use.
+type PolicyFile struct {
+	path string
+
+	lock     sync.RWMutex
+	policies *Policies
+}
+
+// LoadPolicyFile loads the policies from the file at path, in any format supported by marshal.UnmarshalFile.
+func LoadPolicyFile(path string) (*PolicyFile, error) {
+	pf := &PolicyFile{path: path}
+	if err := pf.Reload(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Reload loads the file again. If the file cannot be loaded or is invalid, the policies already loaded are kept.
+func (pf *PolicyFile) Reload() error {
+	var config PolicyConfig
+	if err := marshal.UnmarshalFile(pf.path, &config); err != nil {
+		return fmt.Errorf("policy file %s: %w", pf.path, err)
+	}
+	policies, err := NewPolicies(&config)
+	if err != nil {
+		return fmt.Errorf("policy file %s: %w", pf.path, err)
+	}
+
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	pf.policies = policies
+	return nil
+}
+
+// Check is the same as Policies.Check, using the policies last loaded.
+func (pf *PolicyFile) Check(proto string, ipport string, creds *oauth.CredentialsCookie) (Verdict, *Denial) {
+	pf.lock.RLock()
+	policies := pf.policies
+	pf.lock.RUnlock()
+	return policies.Check(proto, ipport, creds)
+}
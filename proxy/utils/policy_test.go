@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/System233/enkit/lib/oauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicies(t *testing.T) {
+	policies, err := NewPolicies(&PolicyConfig{Policies: []Policy{
+		{Name: "everyone", Users: []string{"*"}, Allow: []string{"*.*.*.*:22"}},
+		{Name: "lab", Groups: []string{"lab"}, Allow: []string{"tcp|10.10.0.0/16:*", "udp|[fd00::/8]:53"}, Deny: []string{"10.10.0.1:*"}},
+	}})
+	assert.Nil(t, err)
+
+	lab := &oauth.CredentialsCookie{Identity: oauth.Identity{Username: "carlo", Organization: "example.com", Groups: []string{"lab"}}}
+	for _, tc := range []struct {
+		proto, ipport string
+		creds         *oauth.CredentialsCookie
+		verdict       Verdict
+		policy        string
+		pattern       string
+	}{
+		{"tcp", "192.168.0.1:22", nil, VerdictAllow, "", ""},
+		{"tcp", "192.168.0.1:23", nil, VerdictDrop, "everyone", ""},
+		{"tcp", "10.10.3.4:8080", lab, VerdictAllow, "", ""},
+		{"udp", "10.10.3.4:8080", lab, VerdictDrop, "everyone,lab", ""},
+		{"tcp", "10.11.3.4:8080", lab, VerdictDrop, "everyone,lab", ""},
+		{"udp", "[fd00::1]:53", lab, VerdictAllow, "", ""},
+		// Denied even if allowed by the everyone policy.
+		{"tcp", "10.10.0.1:22", lab, VerdictDrop, "lab", "10.10.0.1:*"},
+	} {
+		verdict, denial := policies.Check(tc.proto, tc.ipport, tc.creds)
+		assert.Equal(t, tc.verdict, verdict, "%s|%s", tc.proto, tc.ipport)
+		if tc.verdict == VerdictAllow {
+			assert.Nil(t, denial)
+			continue
+		}
+		assert.Equal(t, tc.policy, denial.Policy, "%s|%s", tc.proto, tc.ipport)
+		assert.Equal(t, tc.pattern, denial.Pattern, "%s|%s", tc.proto, tc.ipport)
+		assert.Equal(t, tc.proto+"|"+tc.ipport, denial.Destination)
+	}
+
+	_, denial := policies.Check("tcp", "192.168.0.1:23", nil)
+	assert.Equal(t, Anonymous, denial.User)
+	assert.Equal(t, "anonymous is not allowed to connect to tcp|192.168.0.1:23 - not allowed by policy everyone", denial.Error())
+
+	_, err = NewPolicies(&PolicyConfig{Policies: []Policy{{Name: "invalid", Allow: []string{"10.0.0.1"}}}})
+	assert.NotNil(t, err)
+	_, err = NewPolicies(&PolicyConfig{Policies: []Policy{{Name: "dup"}, {Name: "dup"}}})
+	assert.NotNil(t, err)
+}
+
+func TestPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"Policies": [{"Name": "ssh", "Users": ["*"], "Allow": ["*:22"]}]}`), 0644))
+
+	pf, err := LoadPolicyFile(path)
+	assert.Nil(t, err)
+	verdict, _ := pf.Check("tcp", "10.0.0.1:22", nil)
+	assert.Equal(t, VerdictAllow, verdict)
+
+	// Invalid files leave the loaded policies untouched.
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"Policies": [{"Name": "ssh", "Allow": ["[invalid"]}]}`), 0644))
+	assert.NotNil(t, pf.Reload())
+	verdict, _ = pf.Check("tcp", "10.0.0.1:22", nil)
+	assert.Equal(t, VerdictAllow, verdict)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"Policies": [{"Name": "http", "Users": ["*"], "Allow": ["*:80"]}]}`), 0644))
+	assert.Nil(t, pf.Reload())
+	verdict, denial := pf.Check("tcp", "10.0.0.1:22", nil)
+	assert.Equal(t, VerdictDrop, verdict)
+	assert.Equal(t, "http", denial.Policy)
+}
@@ -21,6 +21,7 @@ type PatternList []string
 // - "tcp|10.10.0.12:*" -> allow connecting to 10.10.0.12 on any port.
 // - "tcp|10.10.0.12:22" -> allow connecting to 10.10.0.12 on port 22.
 // - "tcp|10.10.*.*:22" -> allow connecting to any host in 10.10.0.0/16 on port 22.
+// - "udp|10.10.0.12:53" -> allow forwarding UDP datagrams to 10.10.0.12 on port 53.
 //
 func NewPatternList(allowed []string) (PatternList, error) {
 	// Iterate over the list just to ensure that the patterns are valid.